@@ -0,0 +1,15 @@
+#!/usr/bin/env bash
+
+# Run constant-time audit of critical comparisons (MAC and signature checks) built with "constanttime" tag and
+# benchmarks of them. Benchmark results are written to $BENCHMARK_OUTPUT to compare with previous builds.
+
+set -o pipefail
+
+go test -count=1 -tags constanttime -run ConstantTime ./...
+status="$?"
+if [[ "${status}" != "0" ]]; then
+    echo "Constant-time audit failed: execution time of critical comparisons depends on secret data"
+    exit 1
+fi
+
+go test -run '^$' -bench . -benchmem ./keystore/v2/keystore/crypto/... | tee "${BENCHMARK_OUTPUT:-/tmp/benchmarks.txt}"
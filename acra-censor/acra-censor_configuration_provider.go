@@ -38,6 +38,8 @@ const (
 	AllowAllConfigStr     = "allowall"
 	QueryCaptureConfigStr = "query_capture"
 	QueryIgnoreConfigStr  = "query_ignore"
+	// QueryAttributesConfigStr is handler which checks attributes sent by client with query
+	QueryAttributesConfigStr = "query_attributes"
 )
 
 // Config shows handlers configuration: queries, tables, patterns
@@ -45,12 +47,18 @@ type Config struct {
 	Version          string `yaml:"version"`
 	IgnoreParseError bool   `yaml:"ignore_parse_error"`
 	ParseErrorsLog   string `yaml:"parse_errors_log"`
-	Handlers         []struct {
+	// Parser is name of custom query parser registered with common.RegisterQueryParser
+	Parser string `yaml:"parser"`
+	// LogQueryAttributes are names of query attributes added to logs of allowed and denied queries
+	LogQueryAttributes []string `yaml:"log_query_attributes"`
+	Handlers           []struct {
 		Handler  string
 		Queries  []string
 		Tables   []string
 		Patterns []string
 		FilePath string
+		// Attributes are required query attributes with allowed values
+		Attributes map[string][]string
 	}
 }
 
@@ -59,6 +67,17 @@ var ErrUnsupportedConfigVersion = errors.New("acra-censor's config is outdated")
 
 // LoadConfiguration loads configuration of AcraCensor
 func (acraCensor *AcraCensor) LoadConfiguration(configuration []byte) error {
+	return acraCensor.loadConfiguration(configuration, true)
+}
+
+// ValidateConfiguration checks configuration of AcraCensor the same way as LoadConfiguration but doesn't open log
+// files of query_capture handler and parse_errors_log, so it may be used outside of AcraServer
+func ValidateConfiguration(configuration []byte) error {
+	return NewAcraCensor().loadConfiguration(configuration, false)
+}
+
+// loadConfiguration loads configuration of AcraCensor, files of query writers are opened only if openFiles is true
+func (acraCensor *AcraCensor) loadConfiguration(configuration []byte, openFiles bool) error {
 	var censorConfiguration Config
 	err := yaml.Unmarshal(configuration, &censorConfiguration)
 	if err != nil {
@@ -83,8 +102,18 @@ func (acraCensor *AcraCensor) LoadConfiguration(configuration []byte) error {
 		// censor has version newer than config
 		return ErrUnsupportedConfigVersion
 	}
+	if censorConfiguration.Parser != "" {
+		// queries of handlers are normalized by the same parser as checked queries
+		parser, err := common.GetRegisteredQueryParser(censorConfiguration.Parser)
+		if err != nil {
+			return err
+		}
+		common.SetQueryParser(parser)
+		logrus.WithField("parser", censorConfiguration.Parser).Infoln("Use custom query parser")
+	}
 	acraCensor.ignoreParseError = censorConfiguration.IgnoreParseError
-	if !strings.EqualFold(censorConfiguration.ParseErrorsLog, "") {
+	acraCensor.SetLogQueryAttributes(censorConfiguration.LogQueryAttributes)
+	if openFiles && !strings.EqualFold(censorConfiguration.ParseErrorsLog, "") {
 		queryWriter, err := common.NewFileQueryWriter(censorConfiguration.ParseErrorsLog)
 		if err != nil {
 			return err
@@ -130,12 +159,19 @@ func (acraCensor *AcraCensor) LoadConfiguration(configuration []byte) error {
 			queryIgnoreHandler.AddQueries(handlerConfiguration.Queries)
 			acraCensor.AddHandler(queryIgnoreHandler)
 		case QueryCaptureConfigStr:
+			if !openFiles {
+				break
+			}
 			queryCaptureHandler, err := handlers.NewQueryCaptureHandler(handlerConfiguration.FilePath)
 			if err != nil {
 				return err
 			}
 			go queryCaptureHandler.Start()
 			acraCensor.AddHandler(queryCaptureHandler)
+		case QueryAttributesConfigStr:
+			queryAttributesHandler := handlers.NewQueryAttributesHandler()
+			queryAttributesHandler.AddAttributes(handlerConfiguration.Attributes)
+			acraCensor.AddHandler(queryAttributesHandler)
 		default:
 			acraCensor.logger.
 				WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCensorSetupError).
@@ -20,6 +20,7 @@ import (
 	"github.com/cossacklabs/acra/acra-censor/common"
 	"github.com/cossacklabs/acra/acra-censor/handlers"
 	"github.com/cossacklabs/acra/logging"
+	"github.com/cossacklabs/acra/notification"
 	"github.com/cossacklabs/acra/sqlparser"
 	log "github.com/sirupsen/logrus"
 )
@@ -33,6 +34,9 @@ type AcraCensor struct {
 	ignoreParseError      bool
 	unparsedQueriesWriter *common.QueryWriter
 	logger                *log.Entry
+	notifier              notification.Notifier
+	// logQueryAttributes are names of query attributes added to logs of allowed and denied queries
+	logQueryAttributes []string
 }
 
 // NewAcraCensor creates new censor object.
@@ -48,6 +52,11 @@ func (acraCensor *AcraCensor) AddHandler(handler QueryHandlerInterface) {
 	acraCensor.handlers = append(acraCensor.handlers, handler)
 }
 
+// SetNotifier sets notifier which receives anomaly events about denied queries
+func (acraCensor *AcraCensor) SetNotifier(notifier notification.Notifier) {
+	acraCensor.notifier = notifier
+}
+
 // RemoveHandler removes handler from the list of Censor handlers.
 func (acraCensor *AcraCensor) RemoveHandler(handler QueryHandlerInterface) {
 	for index, handlerFromRange := range acraCensor.handlers {
@@ -69,21 +78,35 @@ func (acraCensor *AcraCensor) ReleaseAll() {
 
 }
 
+// SetLogQueryAttributes sets names of query attributes added to logs of allowed and denied queries
+func (acraCensor *AcraCensor) SetLogQueryAttributes(names []string) {
+	acraCensor.logQueryAttributes = names
+}
+
 // HandleQuery processes every query through each handler.
 func (acraCensor *AcraCensor) HandleQuery(rawQuery string) error {
+	return acraCensor.HandleQueryWithAttributes(rawQuery, nil)
+}
+
+// HandleQueryWithAttributes processes every query through each handler, handlers which implement
+// QueryAttributesHandlerInterface also check attributes sent by client with query.
+func (acraCensor *AcraCensor) HandleQueryWithAttributes(rawQuery string, attributes common.QueryAttributes) error {
 	if len(acraCensor.handlers) == 0 && acraCensor.unparsedQueriesWriter == nil {
 		// no handlers, AcraCensor won't work
 		return nil
 	}
+	logger := acraCensor.loggerWithAttributes(attributes)
 	normalizedQuery, queryWithHiddenValues, parsedQuery, err := common.HandleRawSQLQuery(rawQuery)
+	loggedQuery := queryForLog(rawQuery, queryWithHiddenValues)
 	// Unparsed query handling
 	if err == common.ErrQuerySyntaxError {
 		acraCensor.saveUnparsedQuery(rawQuery)
 		if acraCensor.ignoreParseError {
 			// log warning if we ignore such errors
-			acraCensor.logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCensorQueryParseError).Warning("Failed to parse input query")
+			logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCensorQueryParseError).Warning("Failed to parse input query")
 		} else {
-			acraCensor.logger.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCensorQueryParseError).Errorln("Unparsed query has been denied")
+			logger.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCensorQueryParseError).Errorln("Unparsed query has been denied")
+			acraCensor.notifyDeniedQuery("Unparsed query has been denied", "")
 			return err
 		}
 	}
@@ -96,55 +119,96 @@ func (acraCensor *AcraCensor) HandleQuery(rawQuery string) error {
 		if queryIgnoreHandler, ok := handler.(*handlers.QueryIgnoreHandler); ok {
 			continueHandling, _ := queryIgnoreHandler.CheckQuery(rawQuery, nil)
 			if !continueHandling {
-				acraCensor.logAllowedQuery(queryWithHiddenValues, parsedQuery)
+				acraCensor.logAllowedQuery(logger, loggedQuery, parsedQuery)
 				return nil
 			}
 			continue
 		}
 		// Security checks (allow/deny handlers)
-		continueHandling, err := handler.CheckQuery(normalizedQuery, parsedQuery)
+		var continueHandling bool
+		if attributesHandler, ok := handler.(QueryAttributesHandlerInterface); ok {
+			continueHandling, err = attributesHandler.CheckQueryWithAttributes(normalizedQuery, parsedQuery, attributes)
+		} else {
+			continueHandling, err = handler.CheckQuery(normalizedQuery, parsedQuery)
+		}
 		if err != nil {
-			acraCensor.logDeniedQuery(queryWithHiddenValues, handler, parsedQuery)
+			acraCensor.logDeniedQuery(logger, loggedQuery, handler, parsedQuery)
+			acraCensor.notifyDeniedQuery("Query has been denied", loggedQuery)
 			return err
 		}
 		//we don't have errors so allow query
 		if !continueHandling {
-			acraCensor.logAllowedQuery(queryWithHiddenValues, parsedQuery)
+			acraCensor.logAllowedQuery(logger, loggedQuery, parsedQuery)
 			return nil
 		}
 	}
-	acraCensor.logAllowedQuery(queryWithHiddenValues, parsedQuery)
+	acraCensor.logAllowedQuery(logger, loggedQuery, parsedQuery)
 	return nil
 }
 
-func (acraCensor *AcraCensor) logAllowedQuery(queryWithHiddenValues string, parsedQuery sqlparser.Statement) {
+// queryForLog returns query with literals hidden according to common.GetQueryLogRedaction, queryWithHiddenValues
+// already has them stripped
+func queryForLog(rawQuery, queryWithHiddenValues string) string {
+	if queryWithHiddenValues == "" || common.GetQueryLogRedaction() != common.QueryLogRedactionHash {
+		return queryWithHiddenValues
+	}
+	return common.RedactQueryForLog(rawQuery)
+}
+
+// loggerWithAttributes returns logger with values of query attributes from logQueryAttributes
+func (acraCensor *AcraCensor) loggerWithAttributes(attributes common.QueryAttributes) *log.Entry {
+	if len(acraCensor.logQueryAttributes) == 0 || len(attributes) == 0 {
+		return acraCensor.logger
+	}
+	fields := log.Fields{}
+	for _, name := range acraCensor.logQueryAttributes {
+		if value, ok := attributes[name]; ok {
+			fields["query_attribute_"+name] = value
+		}
+	}
+	return acraCensor.logger.WithFields(fields)
+}
+
+func (acraCensor *AcraCensor) logAllowedQuery(logger *log.Entry, queryWithHiddenValues string, parsedQuery sqlparser.Statement) {
 	if parsedQuery != nil && queryWithHiddenValues != "" {
-		acraCensor.logger.Infof("Allowed query: '%s'", common.TrimStringToN(queryWithHiddenValues, common.LogQueryLength))
+		logger.Infof("Allowed query: '%s'", common.TrimStringToN(queryWithHiddenValues, common.LogQueryLength))
 		return
 	}
 	if parsedQuery == nil && queryWithHiddenValues == "" {
-		acraCensor.logger.Infoln("Allowed query can't be shown in plaintext")
+		logger.Infoln("Allowed query can't be shown in plaintext")
 		return
 	}
-	acraCensor.logger.Debugf("parsedQuery: %T, queryWithHiddenValues: %s", parsedQuery, queryWithHiddenValues)
+	logger.Debugf("parsedQuery: %T, queryWithHiddenValues: %s", parsedQuery, queryWithHiddenValues)
 	return
 }
 
-func (acraCensor *AcraCensor) logDeniedQuery(queryWithHiddenValues string, handler QueryHandlerInterface, parsedQuery sqlparser.Statement) {
+func (acraCensor *AcraCensor) logDeniedQuery(logger *log.Entry, queryWithHiddenValues string, handler QueryHandlerInterface, parsedQuery sqlparser.Statement) {
 	if parsedQuery != nil && queryWithHiddenValues != "" {
-		acraCensor.logger.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCensorQueryIsNotAllowed).Errorf("Denied query: '%s'", common.TrimStringToN(queryWithHiddenValues, common.LogQueryLength))
-		acraCensor.logger.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCensorQueryIsNotAllowed).Debugf("Denied query by %T", handler)
+		logger.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCensorQueryIsNotAllowed).Errorf("Denied query: '%s'", common.TrimStringToN(queryWithHiddenValues, common.LogQueryLength))
+		logger.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCensorQueryIsNotAllowed).Debugf("Denied query by %T", handler)
 		return
 	}
 	if parsedQuery == nil && queryWithHiddenValues == "" {
-		acraCensor.logger.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCensorQueryIsNotAllowed).Errorln("Denied query can't be shown in plaintext")
-		acraCensor.logger.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCensorQueryIsNotAllowed).Debugf("Denied query by %T", handler)
+		logger.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCensorQueryIsNotAllowed).Errorln("Denied query can't be shown in plaintext")
+		logger.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCensorQueryIsNotAllowed).Debugf("Denied query by %T", handler)
 		return
 	}
-	acraCensor.logger.Debugf("parsedQuery: %T, queryWithHiddenValues: %s", parsedQuery, queryWithHiddenValues)
+	logger.Debugf("parsedQuery: %T, queryWithHiddenValues: %s", parsedQuery, queryWithHiddenValues)
 	return
 }
 
+// notifyDeniedQuery sends anomaly event, query is sent only with hidden values
+func (acraCensor *AcraCensor) notifyDeniedQuery(summary, queryWithHiddenValues string) {
+	if acraCensor.notifier == nil {
+		return
+	}
+	var details map[string]string
+	if queryWithHiddenValues != "" {
+		details = map[string]string{"query": common.TrimStringToN(queryWithHiddenValues, common.LogQueryLength)}
+	}
+	acraCensor.notifier.Notify(notification.NewEvent(notification.EventTypeAnomaly, notification.SeverityWarning, ServiceName, summary, details))
+}
+
 func (acraCensor *AcraCensor) saveUnparsedQuery(query string) {
 	if acraCensor.unparsedQueriesWriter != nil {
 		acraCensor.unparsedQueriesWriter.WriteQuery(query)
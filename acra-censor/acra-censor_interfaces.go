@@ -23,6 +23,7 @@ limitations under the License.
 package acracensor
 
 import (
+	"github.com/cossacklabs/acra/acra-censor/common"
 	"github.com/cossacklabs/acra/sqlparser"
 )
 
@@ -32,9 +33,17 @@ type QueryHandlerInterface interface {
 	Release()
 }
 
+// QueryAttributesHandlerInterface is implemented by query handlers which also check attributes sent by client with
+// query, attributes are nil if client can't send them
+type QueryAttributesHandlerInterface interface {
+	QueryHandlerInterface
+	CheckQueryWithAttributes(sqlQuery string, parsedQuery sqlparser.Statement, attributes common.QueryAttributes) (bool, error)
+}
+
 // AcraCensorInterface describes main AcraCensor methods: adding and removing query handlers and processing query
 type AcraCensorInterface interface {
 	HandleQuery(sqlQuery string) error
+	HandleQueryWithAttributes(sqlQuery string, attributes common.QueryAttributes) error
 	AddHandler(handler QueryHandlerInterface)
 	RemoveHandler(handler QueryHandlerInterface)
 	ReleaseAll()
@@ -25,6 +25,7 @@ package acracensor
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"github.com/cossacklabs/acra/acra-censor/common"
 	"io/ioutil"
 	"os"
@@ -36,6 +37,7 @@ import (
 
 	"fmt"
 	"github.com/cossacklabs/acra/acra-censor/handlers"
+	"github.com/cossacklabs/acra/sqlparser"
 	"github.com/cossacklabs/acra/utils"
 )
 
@@ -1836,3 +1838,128 @@ handlers:
 		}
 	}
 }
+
+func TestQueryAttributesHandler(t *testing.T) {
+	configuration := fmt.Sprintf(`version: %s
+log_query_attributes:
+  - traceparent
+handlers:
+  - handler: query_attributes
+    attributes:
+      app_name:
+        - billing
+        - reporting
+      traceparent: []
+  - handler: allowall`, MinimalCensorConfigVersion)
+	acraCensor := NewAcraCensor()
+	defer acraCensor.ReleaseAll()
+	if err := acraCensor.LoadConfiguration([]byte(configuration)); err != nil {
+		t.Fatal(err)
+	}
+	if len(acraCensor.logQueryAttributes) != 1 {
+		t.Fatal("Expected names of logged attributes from config")
+	}
+	query := "select * from x"
+	allowed := common.QueryAttributes{"app_name": "billing", "traceparent": "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"}
+	if err := acraCensor.HandleQueryWithAttributes(query, allowed); err != nil {
+		t.Fatal(err)
+	}
+	denied := []common.QueryAttributes{
+		nil,
+		{"app_name": "billing"},
+		{"app_name": "console", "traceparent": "00"},
+		{"traceparent": "00"},
+	}
+	for i, attributes := range denied {
+		if err := acraCensor.HandleQueryWithAttributes(query, attributes); err != common.ErrDenyByQueryAttributesError {
+			t.Fatalf("[%d] Expected ErrDenyByQueryAttributesError, took %v", i, err)
+		}
+	}
+	// queries without attributes are checked too
+	if err := acraCensor.HandleQuery(query); err != common.ErrDenyByQueryAttributesError {
+		t.Fatalf("Expected ErrDenyByQueryAttributesError, took %v", err)
+	}
+}
+
+func TestValidateConfiguration(t *testing.T) {
+	var defaultConfigPath = utils.GetConfigPathByName("acra-censor.example")
+	filePath, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	configuration, err := ioutil.ReadFile(filepath.Join(filePath, "../", defaultConfigPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	re := regexp.MustCompile(`(version:\s+?)((\d+\.?){3})`)
+	configuration = []byte(re.ReplaceAllString(string(configuration), fmt.Sprintf("$1 %s", MinimalCensorConfigVersion)))
+	if err := ValidateConfiguration(configuration); err != nil {
+		t.Fatal(err)
+	}
+	// log files of query_capture and parse_errors_log aren't created
+	for _, path := range []string{"censor.log", "unparsed_queries.log"} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			os.Remove(path)
+			t.Fatalf("Validation created %s", path)
+		}
+	}
+
+	for _, testcase := range []struct {
+		configuration string
+		expected      error
+	}{
+		{"handlers:\n  - handler: allowall\n", ErrUnsupportedConfigVersion},
+		{fmt.Sprintf("version: %s\nhandlers:\n  - handler: unknown\n", MinimalCensorConfigVersion), common.ErrCensorConfigurationError},
+		{fmt.Sprintf("version: %s\nhandlers:\n  - handler: deny\n    patterns:\n      - SELECT * FROM\n", MinimalCensorConfigVersion), common.ErrPatternSyntaxError},
+	} {
+		if err := ValidateConfiguration([]byte(testcase.configuration)); err != testcase.expected {
+			t.Fatalf("Expected %v for config %q, took %v", testcase.expected, testcase.configuration, err)
+		}
+	}
+}
+
+func TestCustomQueryParser(t *testing.T) {
+	// parser of dialect which allows DELETE without FROM
+	parser := common.QueryParserFunc(func(query string) (sqlparser.Statement, error) {
+		if strings.HasPrefix(strings.ToLower(query), "delete ") && !strings.HasPrefix(strings.ToLower(query), "delete from ") {
+			query = "delete from " + query[len("delete "):]
+		}
+		return common.DefaultQueryParser.Parse(query)
+	})
+	if err := common.RegisterQueryParser("test-delete-without-from", parser); err != nil {
+		t.Fatal(err)
+	}
+	defer common.SetQueryParser(nil)
+	if err := common.RegisterQueryParser("test-delete-without-from", parser); !errors.Is(err, common.ErrQueryParserAlreadyRegistered) {
+		t.Fatalf("Expected ErrQueryParserAlreadyRegistered, took %v", err)
+	}
+
+	configuration := fmt.Sprintf(`version: %s
+parser: %s
+handlers:
+  - handler: deny
+    queries:
+      - delete orders where id = 1
+  - handler: allowall`, MinimalCensorConfigVersion, "%s")
+	if err := ValidateConfiguration([]byte(fmt.Sprintf(configuration, "unknown"))); !errors.Is(err, common.ErrUnknownQueryParser) {
+		t.Fatalf("Expected ErrUnknownQueryParser, took %v", err)
+	}
+	acraCensor := NewAcraCensor()
+	defer acraCensor.ReleaseAll()
+	if err := acraCensor.LoadConfiguration([]byte(fmt.Sprintf(configuration, "test-delete-without-from"))); err != nil {
+		t.Fatal(err)
+	}
+	// queries of config are normalized by the same parser
+	for _, query := range []string{"DELETE orders WHERE id = 1", "DELETE FROM orders WHERE id = 1"} {
+		if err := acraCensor.HandleQuery(query); err != common.ErrDenyByQueryError {
+			t.Fatalf("%s: expected ErrDenyByQueryError, took %v", query, err)
+		}
+	}
+	if err := acraCensor.HandleQuery("DELETE orders WHERE id = 2"); err != nil {
+		t.Fatal(err)
+	}
+	common.SetQueryParser(nil)
+	if err := acraCensor.HandleQuery("DELETE orders WHERE id = 2"); err != common.ErrQuerySyntaxError {
+		t.Fatalf("Expected ErrQuerySyntaxError with default parser, took %v", err)
+	}
+}
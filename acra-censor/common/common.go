@@ -25,6 +25,10 @@ import (
 	"strings"
 )
 
+// QueryAttributes are names and values of metadata sent by client with query, e.g. MySQL query attributes with trace
+// IDs or application names set by drivers
+type QueryAttributes map[string]string
+
 type pattern struct {
 	placeholder string
 	replacer    string
@@ -35,6 +39,7 @@ var (
 	ErrDenyByQueryError                = errors.New("deny by query")
 	ErrDenyByTableError                = errors.New("deny by table")
 	ErrDenyByPatternError              = errors.New("deny by pattern")
+	ErrDenyByQueryAttributesError      = errors.New("deny by query attributes")
 	ErrPatternSyntaxError              = errors.New("fail to parse specified pattern")
 	ErrPatternCheckError               = errors.New("failed to check specified pattern match")
 	ErrQuerySyntaxError                = errors.New("fail to parse specified query")
@@ -192,16 +197,20 @@ func HandleRawSQLQuery(sql string) (normalizedQuery, redactedQuery string, parse
 	// sometimes queries might have ; at the end, that should be stripped
 	sqlStripped = strings.TrimSuffix(sqlStripped, ";")
 
-	stmt, err := sqlparser.Parse(sqlStripped)
+	stmt, err := parseQuery(sqlStripped)
+	if err != nil {
+		return "", "", nil, ErrQuerySyntaxError
+	}
+	outputStmt, err := parseQuery(sqlStripped)
 	if err != nil {
 		return "", "", nil, ErrQuerySyntaxError
 	}
-	outputStmt, _ := sqlparser.Parse(sqlStripped)
 
 	normalizedQ := sqlparser.String(stmt)
 
 	// redact and mask VALUES
 	sqlparser.Normalize(stmt, bv, ValueMask)
+	maskLiterals(stmt, func([]byte) string { return ValueMask })
 	redactedQ := sqlparser.String(stmt)
 
 	return normalizedQ, redactedQ, outputStmt, nil
@@ -0,0 +1,107 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package common
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/cossacklabs/acra/sqlparser"
+)
+
+// QueryParser parses queries checked by AcraCensor into statements of sqlparser. Custom parsers translate syntax of
+// dialects which sqlparser doesn't support (like Oracle-compatible dialects routed through gateways) into equivalent
+// statements, so allow/deny handlers inspect them as other queries.
+type QueryParser interface {
+	Parse(query string) (sqlparser.Statement, error)
+}
+
+// QueryParserFunc is QueryParser implemented by function
+type QueryParserFunc func(query string) (sqlparser.Statement, error)
+
+// Parse calls parser function
+func (parser QueryParserFunc) Parse(query string) (sqlparser.Statement, error) {
+	return parser(query)
+}
+
+// DefaultQueryParser parses queries with sqlparser of dialect set by sqlparser.SetDefaultDialect. Custom parsers may
+// use it for queries which don't need translation.
+var DefaultQueryParser QueryParser = QueryParserFunc(sqlparser.Parse)
+
+// Errors returned by registry of query parsers
+var (
+	ErrQueryParserAlreadyRegistered = errors.New("query parser with this name is already registered")
+	ErrUnknownQueryParser           = errors.New("query parser with this name isn't registered")
+	ErrEmptyQueryParserName         = errors.New("name of query parser is empty")
+)
+
+var (
+	queryParsersLock sync.RWMutex
+	queryParsers     = map[string]QueryParser{}
+	queryParser      = DefaultQueryParser
+)
+
+// RegisterQueryParser registers custom parser selected by name with `parser` option of AcraCensor config. Parsers
+// should be registered in init functions of packages imported by custom build of AcraServer.
+func RegisterQueryParser(name string, parser QueryParser) error {
+	if name == "" {
+		return ErrEmptyQueryParserName
+	}
+	queryParsersLock.Lock()
+	defer queryParsersLock.Unlock()
+	if _, ok := queryParsers[name]; ok {
+		return fmt.Errorf("%w: '%s'", ErrQueryParserAlreadyRegistered, name)
+	}
+	queryParsers[name] = parser
+	return nil
+}
+
+// GetRegisteredQueryParser returns parser registered with name
+func GetRegisteredQueryParser(name string) (QueryParser, error) {
+	queryParsersLock.RLock()
+	defer queryParsersLock.RUnlock()
+	parser, ok := queryParsers[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: '%s'", ErrUnknownQueryParser, name)
+	}
+	return parser, nil
+}
+
+// SetQueryParser sets parser of queries checked by AcraCensor and logged by AcraServer, nil resets it to
+// DefaultQueryParser. Parser is process-wide like SQL dialect. Patterns of allow/deny handlers are always parsed with
+// DefaultQueryParser because of their placeholders.
+func SetQueryParser(parser QueryParser) {
+	if parser == nil {
+		parser = DefaultQueryParser
+	}
+	queryParsersLock.Lock()
+	queryParser = parser
+	queryParsersLock.Unlock()
+}
+
+// GetQueryParser returns parser of queries checked by AcraCensor
+func GetQueryParser() QueryParser {
+	queryParsersLock.RLock()
+	defer queryParsersLock.RUnlock()
+	return queryParser
+}
+
+// parseQuery parses query with parser set by SetQueryParser
+func parseQuery(query string) (sqlparser.Statement, error) {
+	return GetQueryParser().Parse(query)
+}
@@ -0,0 +1,136 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package common
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/cossacklabs/acra/random"
+	"github.com/cossacklabs/acra/sqlparser"
+	"github.com/cossacklabs/acra/sqlparser/dependency/querypb"
+)
+
+// QueryLogRedaction defines how literals of SQL queries are hidden in logs
+type QueryLogRedaction string
+
+// Supported values of QueryLogRedaction
+const (
+	// QueryLogRedactionStrip replaces literals with ValueMask placeholders
+	QueryLogRedactionStrip QueryLogRedaction = "strip"
+	// QueryLogRedactionHash replaces literals with keyed hashes, so equal values in logs of one process may be
+	// correlated without revealing them. Key is generated on start, hashes differ between processes.
+	QueryLogRedactionHash QueryLogRedaction = "hash"
+)
+
+// hashedValuePrefix starts placeholders of hashed literals
+const hashedValuePrefix = "h_"
+
+// hashedValueLength is count of bytes of HMAC written into placeholders of hashed literals
+const hashedValueLength = 8
+
+// ErrInvalidQueryLogRedaction returned for unknown QueryLogRedaction
+var ErrInvalidQueryLogRedaction = errors.New("invalid redaction of logged queries")
+
+// ParseQueryLogRedaction validates redaction of logged queries, empty string means QueryLogRedactionStrip
+func ParseQueryLogRedaction(value string) (QueryLogRedaction, error) {
+	switch QueryLogRedaction(value) {
+	case "":
+		return QueryLogRedactionStrip, nil
+	case QueryLogRedactionStrip, QueryLogRedactionHash:
+		return QueryLogRedaction(value), nil
+	}
+	return "", fmt.Errorf("%w '%s', expected '%s' or '%s'", ErrInvalidQueryLogRedaction, value,
+		QueryLogRedactionStrip, QueryLogRedactionHash)
+}
+
+var (
+	queryLogRedactionLock sync.RWMutex
+	queryLogRedaction     = QueryLogRedactionStrip
+	queryLogHashKey       []byte
+)
+
+// SetQueryLogRedaction sets redaction of queries logged by AcraServer and AcraCensor, generates key for hashes
+func SetQueryLogRedaction(redaction QueryLogRedaction) error {
+	var key []byte
+	if redaction == QueryLogRedactionHash {
+		key = make([]byte, sha256.Size)
+		if _, err := random.Read(key); err != nil {
+			return err
+		}
+	}
+	queryLogRedactionLock.Lock()
+	queryLogRedaction, queryLogHashKey = redaction, key
+	queryLogRedactionLock.Unlock()
+	return nil
+}
+
+// GetQueryLogRedaction returns redaction of logged queries
+func GetQueryLogRedaction() QueryLogRedaction {
+	queryLogRedactionLock.RLock()
+	defer queryLogRedactionLock.RUnlock()
+	return queryLogRedaction
+}
+
+// RedactQueryForLog returns query without comments and with all literals hidden according to QueryLogRedaction,
+// keeping only its structure. Returns empty string for queries which can't be parsed, because their literals can't be
+// found reliably.
+func RedactQueryForLog(query string) string {
+	queryLogRedactionLock.RLock()
+	redaction, key := queryLogRedaction, queryLogHashKey
+	queryLogRedactionLock.RUnlock()
+	sqlStripped, _ := sqlparser.SplitMarginComments(query)
+	stmt, err := parseQuery(strings.TrimSuffix(sqlStripped, ";"))
+	if err != nil {
+		return ""
+	}
+	if redaction == QueryLogRedactionHash {
+		maskLiterals(stmt, func(value []byte) string {
+			mac := hmac.New(sha256.New, key)
+			mac.Write(value)
+			return hashedValuePrefix + hex.EncodeToString(mac.Sum(nil)[:hashedValueLength])
+		})
+		return sqlparser.String(stmt)
+	}
+	sqlparser.Normalize(stmt, map[string]*querypb.BindVariable{}, ValueMask)
+	maskLiterals(stmt, func([]byte) string { return ValueMask })
+	return sqlparser.String(stmt)
+}
+
+// maskLiterals replaces all literals of stmt with placeholders named by mask, including literals which Normalize
+// leaves as is, like hex and bit values or integers out of int64 range
+func maskLiterals(stmt sqlparser.Statement, mask func(value []byte) string) {
+	sqlparser.Walk(func(node sqlparser.SQLNode) (bool, error) {
+		value, ok := node.(*sqlparser.SQLVal)
+		if !ok {
+			return true, nil
+		}
+		switch value.Type {
+		case sqlparser.ValArg, sqlparser.PgPlaceholder:
+			// placeholders of prepared statements don't contain values
+		default:
+			value.Val = []byte(":" + mask(value.Val))
+			value.Type = sqlparser.ValArg
+		}
+		return true, nil
+	}, stmt)
+}
@@ -0,0 +1,69 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package common
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestRedactQueryForLog(t *testing.T) {
+	defer SetQueryLogRedaction(QueryLogRedactionStrip)
+	if _, err := ParseQueryLogRedaction("raw"); !errors.Is(err, ErrInvalidQueryLogRedaction) {
+		t.Fatalf("Expected ErrInvalidQueryLogRedaction, took %v", err)
+	}
+	if redaction, err := ParseQueryLogRedaction(""); err != nil || redaction != QueryLogRedactionStrip {
+		t.Fatalf("Expected default %s, took %s (%v)", QueryLogRedactionStrip, redaction, err)
+	}
+	secrets := []string{"secret@example.com", "123456789", "99999999999999999999", "deadbeef", "0101", "comment"}
+	query := "/* comment */ SELECT name FROM users WHERE email = 'secret@example.com' AND card = 123456789 " +
+		"AND big = 99999999999999999999 AND hash = X'deadbeef' AND flags = B'0101' AND id = ?"
+	for _, redaction := range []QueryLogRedaction{QueryLogRedactionStrip, QueryLogRedactionHash} {
+		if err := SetQueryLogRedaction(redaction); err != nil {
+			t.Fatal(err)
+		}
+		redacted := RedactQueryForLog(query)
+		if !strings.HasPrefix(redacted, "select name from users where email = :") || !strings.HasSuffix(redacted, "id = :v1") {
+			t.Fatalf("[%s] Structure of query isn't kept: %s", redaction, redacted)
+		}
+		for _, secret := range secrets {
+			if strings.Contains(redacted, secret) {
+				t.Fatalf("[%s] Redacted query contains '%s': %s", redaction, secret, redacted)
+			}
+		}
+		if RedactQueryForLog("SELECT 'secret' FROM") != "" {
+			t.Fatalf("[%s] Expected empty string for unparsable query", redaction)
+		}
+	}
+
+	// equal values have equal hashes
+	hashes := regexp.MustCompile(`:h_[0-9a-f]{16}`).FindAllString(RedactQueryForLog("SELECT 1 FROM t WHERE a = 'x' OR b = 'x' OR c = 'y'"), -1)
+	if len(hashes) != 4 || hashes[1] != hashes[2] || hashes[2] == hashes[3] {
+		t.Fatalf("Unexpected hashes of literals: %v", hashes)
+	}
+
+	// HandleRawSQLQuery hides literals which normalization keeps
+	_, queryWithHiddenValues, _, err := HandleRawSQLQuery("SELECT a FROM t WHERE b = X'deadbeef'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(queryWithHiddenValues, "deadbeef") {
+		t.Fatalf("Query contains hex value: %s", queryWithHiddenValues)
+	}
+}
@@ -0,0 +1,79 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handlers
+
+import (
+	"github.com/cossacklabs/acra/acra-censor/common"
+	"github.com/cossacklabs/acra/logging"
+	"github.com/cossacklabs/acra/sqlparser"
+	log "github.com/sirupsen/logrus"
+)
+
+// QueryAttributesHandler forbids queries without required attributes or with values of attributes which aren't allowed,
+// e.g. to accept queries only from known applications which set their names in MySQL query attributes
+type QueryAttributesHandler struct {
+	// allowedValues of required attributes, attribute may have any value if set is empty
+	allowedValues map[string]map[string]bool
+	logger        *log.Entry
+}
+
+// NewQueryAttributesHandler creates new query attributes handler
+func NewQueryAttributesHandler() *QueryAttributesHandler {
+	return &QueryAttributesHandler{allowedValues: make(map[string]map[string]bool), logger: log.WithField("handler", "query-attributes")}
+}
+
+// AddAttributes adds required attributes with lists of allowed values, empty list allows any value
+func (handler *QueryAttributesHandler) AddAttributes(attributes map[string][]string) {
+	for name, values := range attributes {
+		allowed, ok := handler.allowedValues[name]
+		if !ok {
+			allowed = make(map[string]bool)
+			handler.allowedValues[name] = allowed
+		}
+		for _, value := range values {
+			allowed[value] = true
+		}
+	}
+}
+
+// CheckQuery forbids queries without attributes if any attributes are required
+func (handler *QueryAttributesHandler) CheckQuery(sqlQuery string, parsedQuery sqlparser.Statement) (bool, error) {
+	return handler.CheckQueryWithAttributes(sqlQuery, parsedQuery, nil)
+}
+
+// CheckQueryWithAttributes returns false and error if query doesn't have required attribute or its value isn't allowed
+func (handler *QueryAttributesHandler) CheckQueryWithAttributes(sqlQuery string, parsedQuery sqlparser.Statement, attributes common.QueryAttributes) (bool, error) {
+	for name, allowed := range handler.allowedValues {
+		value, ok := attributes[name]
+		if !ok || (len(allowed) > 0 && !allowed[value]) {
+			handler.logger.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCensorQueryIsNotAllowed).WithField("attribute", name).
+				WithError(common.ErrDenyByQueryAttributesError).Errorln("Query has been blocked by QUERY_ATTRIBUTES")
+			return false, common.ErrDenyByQueryAttributesError
+		}
+	}
+	return true, nil
+}
+
+// Reset removes all required attributes
+func (handler *QueryAttributesHandler) Reset() {
+	handler.allowedValues = make(map[string]map[string]bool)
+}
+
+// Release removes all required attributes
+func (handler *QueryAttributesHandler) Release() {
+	handler.Reset()
+}
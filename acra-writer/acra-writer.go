@@ -22,11 +22,11 @@ limitations under the License.
 package acrawriter
 
 import (
-	"crypto/rand"
 	"encoding/binary"
 	"errors"
 
 	"github.com/cossacklabs/acra/decryptor/base"
+	"github.com/cossacklabs/acra/random"
 	"github.com/cossacklabs/acra/utils"
 	"github.com/cossacklabs/themis/gothemis/cell"
 	"github.com/cossacklabs/themis/gothemis/keys"
@@ -42,7 +42,7 @@ func CreateAcrastruct(data []byte, acraPublic *keys.PublicKey, context []byte) (
 	}
 	// generate random symmetric key
 	randomKey := make([]byte, base.SymmetricKeySize)
-	n, err := rand.Read(randomKey)
+	n, err := random.Read(randomKey)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,102 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Command generate writes AcraStruct specification and test vectors into acra-writer/spec or checks test vectors of
+// another implementation
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/cossacklabs/acra/acra-writer/spec"
+	log "github.com/sirupsen/logrus"
+)
+
+func main() {
+	outputDir := flag.String("output_dir", "acra-writer/spec", "Folder to write acrastruct.md and testdata/vectors.json")
+	verifyPath := flag.String("verify", "", "Check that all AcraStructs of test vectors file are decrypted to their plaintexts instead of generating files")
+	flag.Parse()
+
+	if *verifyPath != "" {
+		if !verifyVectors(*verifyPath) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	markdown := &bytes.Buffer{}
+	spec.WriteMarkdown(markdown)
+	if err := ioutil.WriteFile(filepath.Join(*outputDir, "acrastruct.md"), markdown.Bytes(), 0644); err != nil {
+		log.WithError(err).Errorln("Can't write specification")
+		os.Exit(1)
+	}
+
+	vectors, err := spec.GenerateVectors()
+	if err != nil {
+		log.WithError(err).Errorln("Can't generate test vectors")
+		os.Exit(1)
+	}
+	for _, vector := range vectors.Vectors {
+		if err := spec.VerifyVector(vector); err != nil {
+			log.WithError(err).Errorln("Generated test vector is invalid")
+			os.Exit(1)
+		}
+	}
+	testdata := filepath.Join(*outputDir, "testdata")
+	if err := os.MkdirAll(testdata, 0755); err != nil {
+		log.WithError(err).Errorln("Can't create folder for test vectors")
+		os.Exit(1)
+	}
+	output := &bytes.Buffer{}
+	if err := spec.WriteVectors(output, vectors); err != nil {
+		log.WithError(err).Errorln("Can't encode test vectors")
+		os.Exit(1)
+	}
+	if err := ioutil.WriteFile(filepath.Join(testdata, "vectors.json"), output.Bytes(), 0644); err != nil {
+		log.WithError(err).Errorln("Can't write test vectors")
+		os.Exit(1)
+	}
+}
+
+// verifyVectors returns true if all vectors of file are valid and logs invalid ones
+func verifyVectors(path string) bool {
+	file, err := os.Open(path)
+	if err != nil {
+		log.WithError(err).Errorln("Can't open test vectors")
+		return false
+	}
+	defer file.Close()
+	vectors, err := spec.ReadVectors(file)
+	if err != nil {
+		log.WithError(err).Errorln("Can't read test vectors")
+		return false
+	}
+	valid := true
+	for _, vector := range vectors.Vectors {
+		if err := spec.VerifyVector(vector); err != nil {
+			log.WithError(err).Errorln("Invalid test vector")
+			valid = false
+		}
+	}
+	if valid {
+		log.Infof("All %d test vectors are valid", len(vectors.Vectors))
+	}
+	return valid
+}
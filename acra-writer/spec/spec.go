@@ -0,0 +1,100 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package spec generates specification of AcraStruct wire format from constants used by Go implementation, and test
+// vectors which writers and readers of AcraStructs in other languages use to check compatibility with each release.
+package spec
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/cossacklabs/acra/decryptor/base"
+)
+
+// Version of AcraStruct specification, incremented on any change of envelope or payload headers. Readers should
+// reject vectors of newer versions than they implement.
+const Version = 1
+
+// Field describes one field of AcraStruct envelope or payload header
+type Field struct {
+	Name        string
+	Length      string
+	Description string
+}
+
+// EnvelopeFields returns fields of AcraStruct in order of appearance
+func EnvelopeFields() []Field {
+	return []Field{
+		{"begin tag", fmt.Sprint(len(base.TagBegin)), fmt.Sprintf("`%s`, %d bytes `0x%02x` (`%c`)", hexBytes(base.TagBegin), len(base.TagBegin), base.TagSymbol, base.TagSymbol)},
+		{"ephemeral public key", fmt.Sprint(base.PublicKeyLength), "Themis EC public key of ephemeral keypair generated for each AcraStruct"},
+		{"wrapped symmetric key", fmt.Sprint(base.SMessageKeyLength), fmt.Sprintf("random %d-byte symmetric key encrypted with Themis Secure Message from ephemeral private key to recipient public key (client ID or zone key)", base.SymmetricKeySize)},
+		{"data length", fmt.Sprint(base.DataLengthSize), "length of encrypted data as unsigned little-endian integer"},
+		{"encrypted data", "data length", "payload encrypted with Themis Secure Cell in Seal mode with symmetric key, zone ID is used as context if AcraStruct is encrypted with zone key"},
+	}
+}
+
+// PayloadHeaders returns optional headers at the start of decrypted payload in order of appearance
+func PayloadHeaders() []Field {
+	return []Field{
+		{"creation timestamp", fmt.Sprint(base.TimestampLength), fmt.Sprintf("tag `%s` followed by creation time in seconds since Unix epoch as unsigned big-endian integer", hexBytes(base.TimestampTag))},
+		{"compression header", fmt.Sprint(base.CompressionHeaderLength), fmt.Sprintf("tag `%s` followed by algorithm byte: `%d` - DEFLATE (RFC 1951), `%d` - Zstandard (RFC 8878). The rest of payload is compressed data", hexBytes(base.CompressionTag), base.CompressionDeflate, base.CompressionZstd)},
+	}
+}
+
+func hexBytes(data []byte) string {
+	parts := make([]string, len(data))
+	for i, b := range data {
+		parts[i] = fmt.Sprintf("%02x", b)
+	}
+	return strings.Join(parts, " ")
+}
+
+func writeFieldsTable(output io.Writer, fields []Field) {
+	fmt.Fprintln(output, "| Field | Length (bytes) | Description |")
+	fmt.Fprintln(output, "|-------|----------------|-------------|")
+	for _, field := range fields {
+		fmt.Fprintf(output, "| %s | %s | %s |\n", field.Name, field.Length, field.Description)
+	}
+}
+
+// WriteMarkdown writes specification of AcraStruct format as Markdown document
+func WriteMarkdown(output io.Writer) {
+	fmt.Fprintf(output, "<!-- Generated by `make acrastruct_spec` from constants of Go implementation, don't edit. -->\n\n")
+	fmt.Fprintf(output, "# AcraStruct specification, version %d\n\n", Version)
+	fmt.Fprintf(output, "AcraStruct is a cryptographic container of one value encrypted for AcraServer or AcraTranslator. ")
+	fmt.Fprintf(output, "Minimal length of AcraStruct is %d bytes plus encrypted data.\n\n", base.GetMinAcraStructLength())
+	fmt.Fprintf(output, "## Envelope\n\n")
+	writeFieldsTable(output, EnvelopeFields())
+	fmt.Fprintf(output, "\n## Payload headers\n\n")
+	fmt.Fprintf(output, "Decrypted payload may start with headers, in this order. Headers are optional, readers remove them before ")
+	fmt.Fprintf(output, "returning data, and payload without a known tag is data as is. Decompressed data longer than %d bytes ", base.MaxDecompressedLength)
+	fmt.Fprintf(output, "is rejected.\n\n")
+	writeFieldsTable(output, PayloadHeaders())
+	fmt.Fprintf(output, "\n## Test vectors\n\n")
+	fmt.Fprintf(output, "`make acrastruct_spec` writes `testdata/vectors.json` with AcraStructs generated by the Go implementation ")
+	fmt.Fprintf(output, "built with libthemis of the release as a JSON object with `version` of specification and list of `vectors`. Binary values are hex-encoded:\n\n")
+	fmt.Fprintf(output, "- `private_key`, `public_key` - recipient keypair\n")
+	fmt.Fprintf(output, "- `zone_id` - context of Secure Cell, empty if AcraStruct is encrypted without zone\n")
+	fmt.Fprintf(output, "- `plaintext` - data after removal of payload headers\n")
+	fmt.Fprintf(output, "- `created_at` - creation timestamp, 0 if payload has no timestamp header\n")
+	fmt.Fprintf(output, "- `compression` - algorithm of compression header, `%s` or `%s`, empty if payload has no compression header\n", CompressionDeflate, CompressionZstd)
+	fmt.Fprintf(output, "- `acrastruct` - AcraStruct\n\n")
+	fmt.Fprintf(output, "Readers should decrypt every vector to its `plaintext`. AcraStructs are randomized, so writers can't ")
+	fmt.Fprintf(output, "reproduce vectors byte by byte: they should replace `acrastruct` fields with their own output for the ")
+	fmt.Fprintf(output, "same keys and input, and check the file with `make test_interop INTEROP_VECTORS=<path>`.\n")
+}
@@ -0,0 +1,74 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package spec
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestGenerateVectors(t *testing.T) {
+	vectors, err := GenerateVectors()
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := &bytes.Buffer{}
+	if err := WriteVectors(output, vectors); err != nil {
+		t.Fatal(err)
+	}
+	vectors, err = ReadVectors(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vectors.Vectors) != len(vectorInputs()) {
+		t.Fatalf("Expected %d vectors, took %d", len(vectorInputs()), len(vectors.Vectors))
+	}
+	for _, vector := range vectors.Vectors {
+		if err := VerifyVector(vector); err != nil {
+			t.Fatal(err)
+		}
+		// vector with other plaintext or headers must fail
+		for _, changed := range []Vector{
+			{Plaintext: hex.EncodeToString([]byte("other")), CreatedAt: vector.CreatedAt, Compression: vector.Compression},
+			{Plaintext: vector.Plaintext, CreatedAt: vector.CreatedAt + 1, Compression: vector.Compression},
+		} {
+			changed.Name, changed.PrivateKey, changed.ZoneID, changed.AcraStruct = vector.Name, vector.PrivateKey, vector.ZoneID, vector.AcraStruct
+			if err := VerifyVector(changed); !errors.Is(err, ErrVectorMismatch) {
+				t.Fatalf("[%s] Expected ErrVectorMismatch, took %v", vector.Name, err)
+			}
+		}
+	}
+	if _, err := ReadVectors(strings.NewReader(`{"version": 2, "vectors": []}`)); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Fatalf("Expected ErrUnsupportedVersion, took %v", err)
+	}
+}
+
+func TestMarkdownIsUpToDate(t *testing.T) {
+	committed, err := ioutil.ReadFile("acrastruct.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := &bytes.Buffer{}
+	WriteMarkdown(output)
+	if !bytes.Equal(committed, output.Bytes()) {
+		t.Fatal("acrastruct.md is outdated, run `make acrastruct_spec`")
+	}
+}
@@ -0,0 +1,198 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package spec
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	acrawriter "github.com/cossacklabs/acra/acra-writer"
+	"github.com/cossacklabs/acra/decryptor/base"
+	"github.com/cossacklabs/themis/gothemis/keys"
+)
+
+// Values of Vector.Compression for payload with compression header
+const (
+	CompressionDeflate = "deflate"
+	CompressionZstd    = "zstd"
+)
+
+// compressionAlgorithms are algorithms of compression header by values of Vector.Compression
+var compressionAlgorithms = map[string]base.CompressionAlgorithm{
+	CompressionDeflate: base.CompressionDeflate,
+	CompressionZstd:    base.CompressionZstd,
+}
+
+// Errors returned by VerifyVector and ReadVectors
+var (
+	ErrVectorMismatch      = errors.New("AcraStruct doesn't match test vector")
+	ErrUnsupportedVersion  = errors.New("unsupported version of test vectors")
+	ErrInvalidVectorFormat = errors.New("invalid format of test vector")
+)
+
+// Vector is AcraStruct with keys and input used to create it, binary values are hex-encoded
+type Vector struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	PrivateKey  string `json:"private_key"`
+	PublicKey   string `json:"public_key"`
+	ZoneID      string `json:"zone_id"`
+	Plaintext   string `json:"plaintext"`
+	CreatedAt   int64  `json:"created_at"`
+	Compression string `json:"compression"`
+	AcraStruct  string `json:"acrastruct"`
+}
+
+// Vectors is content of test vectors file
+type Vectors struct {
+	Version int      `json:"version"`
+	Vectors []Vector `json:"vectors"`
+}
+
+// vectorInput describes one generated vector
+type vectorInput struct {
+	name        string
+	description string
+	zoneID      []byte
+	plaintext   []byte
+	createdAt   int64
+	compression string
+}
+
+func vectorInputs() []vectorInput {
+	binary := make([]byte, 256)
+	for i := range binary {
+		binary[i] = byte(i)
+	}
+	json := bytes.Repeat([]byte(`{"name": "John Doe", "email": "john@example.com"}`), 20)
+	return []vectorInput{
+		{"client_id", "AcraStruct encrypted with client ID key", nil, []byte("Hello, AcraStruct!"), 0, ""},
+		{"zone", "AcraStruct encrypted with zone key, zone ID is context", []byte("DDDDDDDDMatNOMYjqVOuhACC"), []byte("Hello, zone!"), 0, ""},
+		{"binary", "all byte values", nil, binary, 0, ""},
+		{"timestamp", "payload with creation timestamp", nil, []byte("expires"), 1600000000, ""},
+		{"deflate", "payload with DEFLATE compression header", nil, json, 0, CompressionDeflate},
+		{"timestamp_deflate", "payload with creation timestamp and DEFLATE compression header", []byte("DDDDDDDDMatNOMYjqVOuhACC"), json, 1600000000, CompressionDeflate},
+		{"zstd", "payload with Zstandard compression header", nil, json, 0, CompressionZstd},
+	}
+}
+
+// GenerateVectors creates test vectors with new keypair
+func GenerateVectors() (*Vectors, error) {
+	keypair, err := keys.New(keys.TypeEC)
+	if err != nil {
+		return nil, err
+	}
+	vectors := &Vectors{Version: Version}
+	for _, input := range vectorInputs() {
+		payload := input.plaintext
+		if input.compression != "" {
+			payload, err = base.Compress(payload, compressionAlgorithms[input.compression])
+			if err != nil {
+				return nil, err
+			}
+		}
+		if input.createdAt != 0 {
+			payload = base.AddCreationTimestamp(payload, time.Unix(input.createdAt, 0))
+		}
+		acraStruct, err := acrawriter.CreateAcrastruct(payload, keypair.Public, input.zoneID)
+		if err != nil {
+			return nil, err
+		}
+		vectors.Vectors = append(vectors.Vectors, Vector{
+			Name:        input.name,
+			Description: input.description,
+			PrivateKey:  hex.EncodeToString(keypair.Private.Value),
+			PublicKey:   hex.EncodeToString(keypair.Public.Value),
+			ZoneID:      hex.EncodeToString(input.zoneID),
+			Plaintext:   hex.EncodeToString(input.plaintext),
+			CreatedAt:   input.createdAt,
+			Compression: input.compression,
+			AcraStruct:  hex.EncodeToString(acraStruct),
+		})
+	}
+	return vectors, nil
+}
+
+// WriteVectors writes vectors as indented JSON
+func WriteVectors(output io.Writer, vectors *Vectors) error {
+	encoder := json.NewEncoder(output)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(vectors)
+}
+
+// ReadVectors reads vectors and checks their version
+func ReadVectors(input io.Reader) (*Vectors, error) {
+	vectors := &Vectors{}
+	if err := json.NewDecoder(input).Decode(vectors); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidVectorFormat, err)
+	}
+	if vectors.Version < 1 || vectors.Version > Version {
+		return nil, fmt.Errorf("%w %d, expected at most %d", ErrUnsupportedVersion, vectors.Version, Version)
+	}
+	return vectors, nil
+}
+
+// VerifyVector decrypts AcraStruct of vector and checks its payload headers and plaintext
+func VerifyVector(vector Vector) error {
+	var decoded [4][]byte
+	for i, value := range []string{vector.PrivateKey, vector.ZoneID, vector.Plaintext, vector.AcraStruct} {
+		data, err := hex.DecodeString(value)
+		if err != nil {
+			return fmt.Errorf("%w '%s': %s", ErrInvalidVectorFormat, vector.Name, err)
+		}
+		decoded[i] = data
+	}
+	privateKey, zoneID, plaintext, acraStruct := &keys.PrivateKey{Value: decoded[0]}, decoded[1], decoded[2], decoded[3]
+	if len(zoneID) == 0 {
+		zoneID = nil
+	}
+	if err := base.ValidateAcraStructLength(acraStruct); err != nil {
+		return fmt.Errorf("%w '%s': %s", ErrVectorMismatch, vector.Name, err)
+	}
+	payload, err := base.DecryptAcrastructPayload(acraStruct, privateKey, zoneID)
+	if err != nil {
+		return fmt.Errorf("%w '%s': can't decrypt: %s", ErrVectorMismatch, vector.Name, err)
+	}
+	payload, created := base.SplitCreationTimestamp(payload)
+	createdAt := int64(0)
+	if !created.IsZero() {
+		createdAt = created.Unix()
+	}
+	if createdAt != vector.CreatedAt {
+		return fmt.Errorf("%w '%s': creation time %d, expected %d", ErrVectorMismatch, vector.Name, createdAt, vector.CreatedAt)
+	}
+	data, algorithm, err := base.Decompress(payload)
+	if err != nil {
+		return fmt.Errorf("%w '%s': %s", ErrVectorMismatch, vector.Name, err)
+	}
+	expectedAlgorithm, ok := compressionAlgorithms[vector.Compression]
+	if !ok && vector.Compression != "" {
+		return fmt.Errorf("%w '%s': unknown compression '%s'", ErrInvalidVectorFormat, vector.Name, vector.Compression)
+	}
+	if algorithm != expectedAlgorithm {
+		return fmt.Errorf("%w '%s': compression algorithm %d, expected %d", ErrVectorMismatch, vector.Name, algorithm, expectedAlgorithm)
+	}
+	if !bytes.Equal(data, plaintext) {
+		return fmt.Errorf("%w '%s': decrypted data differs from plaintext", ErrVectorMismatch, vector.Name)
+	}
+	return nil
+}
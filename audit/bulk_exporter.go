@@ -0,0 +1,500 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package audit
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cossacklabs/acra/logging"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// Labels and values of exported events statuses
+const (
+	ExportStatusLabel    = "status"
+	ExportStatusExported = "exported"
+	ExportStatusDropped  = "dropped"
+	ExportStatusRejected = "rejected"
+)
+
+var (
+	// ExportedEventsCounter collects count of audit events by status. Dropped events weren't exported because queue
+	// or disk buffer was full, rejected events were refused by cluster, e.g. due to invalid mapping.
+	ExportedEventsCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "acra_audit_export_events_total",
+			Help: "number of audit events exported to Elasticsearch/OpenSearch",
+		}, []string{ExportStatusLabel})
+
+	// BufferSizeGauge collects size of audit events buffered on disk until cluster becomes available
+	BufferSizeGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "acra_audit_export_buffer_bytes",
+		Help: "size of audit events buffered on disk",
+	})
+)
+
+var registerLock = sync.Once{}
+
+// RegisterMetrics register in default prometheus registry metrics related with export of audit events
+func RegisterMetrics() {
+	registerLock.Do(func() {
+		prometheus.MustRegister(ExportedEventsCounter)
+		prometheus.MustRegister(BufferSizeGauge)
+	})
+}
+
+// Default values of BulkExporterOptions
+const (
+	DefaultIndexPrefix    = "acra-audit"
+	DefaultBatchSize      = 500
+	DefaultFlushInterval  = time.Second * 5
+	DefaultRetryInterval  = time.Second
+	DefaultMaxBufferBytes = 100 * 1024 * 1024
+	maxRetryInterval      = time.Minute
+	defaultHTTPTimeout    = time.Second * 10
+	bufferFileExtension   = ".ndjson"
+)
+
+// Errors returned by BulkExporter
+var (
+	ErrEmptyExportURL       = errors.New("empty URL of Elasticsearch/OpenSearch")
+	ErrEmptyBufferDirectory = errors.New("empty directory for buffered audit events")
+	errRetriableExport      = errors.New("cluster temporarily can't accept audit events")
+)
+
+// BulkExporterOptions configures BulkExporter
+type BulkExporterOptions struct {
+	// URL of Elasticsearch/OpenSearch cluster, e.g. https://localhost:9200
+	URL string
+	// IndexPrefix used for daily indices <prefix>-YYYY.MM.DD and index template matching them
+	IndexPrefix string
+	Username    string
+	Password    string
+	// Service is name of service stored in every event
+	Service string
+	// BufferDir stores batches which can't be exported until cluster becomes available
+	BufferDir string
+	// BatchSize is max count of events sent with one bulk request
+	BatchSize int
+	// FlushInterval is max time events wait in memory before export
+	FlushInterval time.Duration
+	// MaxBufferBytes limits size of BufferDir, next batches are dropped when it's exceeded
+	MaxBufferBytes int64
+	// RetryInterval is initial backoff after failed export, doubled on every next failure
+	RetryInterval time.Duration
+	// Client used for requests, http.Client with timeout by default
+	Client *http.Client
+}
+
+func (options *BulkExporterOptions) setDefaults() {
+	if options.IndexPrefix == "" {
+		options.IndexPrefix = DefaultIndexPrefix
+	}
+	if options.BatchSize <= 0 {
+		options.BatchSize = DefaultBatchSize
+	}
+	if options.FlushInterval <= 0 {
+		options.FlushInterval = DefaultFlushInterval
+	}
+	if options.MaxBufferBytes <= 0 {
+		options.MaxBufferBytes = DefaultMaxBufferBytes
+	}
+	if options.RetryInterval <= 0 {
+		options.RetryInterval = DefaultRetryInterval
+	}
+	if options.Client == nil {
+		options.Client = &http.Client{Timeout: defaultHTTPTimeout}
+	}
+}
+
+// BulkExporter exports audit events to Elasticsearch/OpenSearch with bulk API. Events are recorded without blocking
+// callers and sent by batches from separate goroutine. Batches which cluster can't accept are written to buffer
+// directory and resent in order of arrival after backoff, including batches left by previous run. Every event has
+// unique id so resending batches doesn't create duplicates.
+type BulkExporter struct {
+	options  BulkExporterOptions
+	queue    chan Event
+	done     chan struct{}
+	lock     sync.RWMutex
+	closed   bool
+	logger   *log.Entry
+	sequence uint64
+
+	templateInstalled bool
+	bufferedBytes     int64
+	backoff           time.Duration
+	retryAt           time.Time
+}
+
+// NewBulkExporter returns BulkExporter configured with options and starts worker which exports recorded events
+func NewBulkExporter(options BulkExporterOptions) (*BulkExporter, error) {
+	if options.URL == "" {
+		return nil, ErrEmptyExportURL
+	}
+	if options.BufferDir == "" {
+		return nil, ErrEmptyBufferDirectory
+	}
+	options.setDefaults()
+	options.URL = strings.TrimRight(options.URL, "/")
+	if err := os.MkdirAll(options.BufferDir, 0700); err != nil {
+		return nil, err
+	}
+	exporter := &BulkExporter{
+		options: options,
+		queue:   make(chan Event, options.BatchSize*10),
+		done:    make(chan struct{}),
+		logger:  log.WithField("service", "audit_exporter"),
+	}
+	files, err := exporter.bufferedFiles()
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		exporter.bufferedBytes += file.size
+	}
+	BufferSizeGauge.Set(float64(exporter.bufferedBytes))
+	go exporter.run()
+	return exporter, nil
+}
+
+// Record queues event for export. Events are dropped if queue is full. Safe to call on nil BulkExporter.
+func (exporter *BulkExporter) Record(event Event) {
+	if exporter == nil {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+	if event.Service == "" {
+		event.Service = exporter.options.Service
+	}
+	exporter.lock.RLock()
+	defer exporter.lock.RUnlock()
+	if exporter.closed {
+		ExportedEventsCounter.WithLabelValues(ExportStatusDropped).Inc()
+		return
+	}
+	select {
+	case exporter.queue <- event:
+	default:
+		ExportedEventsCounter.WithLabelValues(ExportStatusDropped).Inc()
+	}
+}
+
+// Close stops accepting events and waits until queued events are exported or buffered on disk
+func (exporter *BulkExporter) Close() {
+	exporter.lock.Lock()
+	if exporter.closed {
+		exporter.lock.Unlock()
+		return
+	}
+	exporter.closed = true
+	close(exporter.queue)
+	exporter.lock.Unlock()
+	<-exporter.done
+}
+
+func (exporter *BulkExporter) run() {
+	defer close(exporter.done)
+	ticker := time.NewTicker(exporter.options.FlushInterval)
+	defer ticker.Stop()
+	batch := make([]Event, 0, exporter.options.BatchSize)
+	for {
+		select {
+		case event, ok := <-exporter.queue:
+			if !ok {
+				exporter.flush(batch)
+				return
+			}
+			batch = append(batch, event)
+			if len(batch) >= exporter.options.BatchSize {
+				exporter.flush(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			exporter.flush(batch)
+			batch = batch[:0]
+		}
+	}
+}
+
+// flush resends buffered batches if backoff expired and exports events, events are buffered on disk if cluster is
+// unavailable or older batches are still buffered to keep order of events
+func (exporter *BulkExporter) flush(events []Event) {
+	exporter.drainBuffer()
+	if len(events) == 0 {
+		return
+	}
+	body, err := exporter.encodeBatch(events)
+	if err != nil {
+		exporter.logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorAuditExport).
+			Errorln("Can't encode audit events")
+		ExportedEventsCounter.WithLabelValues(ExportStatusDropped).Add(float64(len(events)))
+		return
+	}
+	if exporter.bufferedBytes > 0 || time.Now().Before(exporter.retryAt) {
+		exporter.bufferBatch(body, len(events))
+		return
+	}
+	if err := exporter.send(body); err != nil {
+		exporter.onFailure(err)
+		exporter.bufferBatch(body, len(events))
+		return
+	}
+	exporter.onSuccess()
+}
+
+func (exporter *BulkExporter) onFailure(err error) {
+	if exporter.backoff == 0 {
+		exporter.backoff = exporter.options.RetryInterval
+	} else if exporter.backoff *= 2; exporter.backoff > maxRetryInterval {
+		exporter.backoff = maxRetryInterval
+	}
+	exporter.retryAt = time.Now().Add(exporter.backoff)
+	exporter.logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorAuditExport).
+		WithField("retry_in", exporter.backoff.String()).Warningln("Can't export audit events, buffer them on disk")
+}
+
+func (exporter *BulkExporter) onSuccess() {
+	exporter.backoff = 0
+	exporter.retryAt = time.Time{}
+}
+
+func (exporter *BulkExporter) newEventID() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		exporter.sequence++
+		return fmt.Sprintf("%d-%d", time.Now().UnixNano(), exporter.sequence)
+	}
+	return hex.EncodeToString(id)
+}
+
+// encodeBatch returns NDJSON body of bulk request which creates every event in daily index
+func (exporter *BulkExporter) encodeBatch(events []Event) ([]byte, error) {
+	output := &bytes.Buffer{}
+	encoder := json.NewEncoder(output)
+	for _, event := range events {
+		action := map[string]map[string]string{"create": {
+			"_index": fmt.Sprintf("%s-%s", exporter.options.IndexPrefix, event.Time.UTC().Format("2006.01.02")),
+			"_id":    exporter.newEventID(),
+		}}
+		if err := encoder.Encode(action); err != nil {
+			return nil, err
+		}
+		if err := encoder.Encode(event); err != nil {
+			return nil, err
+		}
+	}
+	return output.Bytes(), nil
+}
+
+func (exporter *BulkExporter) newRequest(method, path string, body []byte, contentType string) (*http.Request, error) {
+	request, err := http.NewRequest(method, exporter.options.URL+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", contentType)
+	if exporter.options.Username != "" {
+		request.SetBasicAuth(exporter.options.Username, exporter.options.Password)
+	}
+	return request, nil
+}
+
+// installTemplate creates index template with mappings of Event fields for indices with IndexPrefix. Cluster which
+// doesn't support composable templates rejects it; events are exported anyway with dynamic mapping.
+func (exporter *BulkExporter) installTemplate() error {
+	template, err := json.Marshal(map[string]interface{}{
+		"index_patterns": []string{exporter.options.IndexPrefix + "-*"},
+		"template":       map[string]interface{}{"mappings": indexTemplateMappings},
+	})
+	if err != nil {
+		return err
+	}
+	request, err := exporter.newRequest(http.MethodPut, "/_index_template/"+exporter.options.IndexPrefix, template, "application/json")
+	if err != nil {
+		return err
+	}
+	response, err := exporter.options.Client.Do(request)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errRetriableExport, err)
+	}
+	defer response.Body.Close()
+	if isRetriableStatus(response.StatusCode) {
+		return fmt.Errorf("%w: index template request failed with status %d", errRetriableExport, response.StatusCode)
+	}
+	if response.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(response.Body)
+		exporter.logger.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorAuditExport).
+			WithField("status", response.StatusCode).Warningf("Can't install index template: %s", body)
+	}
+	exporter.templateInstalled = true
+	return nil
+}
+
+func isRetriableStatus(status int) bool {
+	return status == http.StatusTooManyRequests || status >= http.StatusInternalServerError
+}
+
+type bulkResponse struct {
+	Errors bool `json:"errors"`
+	Items  []map[string]struct {
+		Status int             `json:"status"`
+		Error  json.RawMessage `json:"error"`
+	} `json:"items"`
+}
+
+// send exports batch and returns error if it should be resent later. Events rejected by cluster aren't resent.
+func (exporter *BulkExporter) send(body []byte) error {
+	if !exporter.templateInstalled {
+		if err := exporter.installTemplate(); err != nil {
+			return err
+		}
+	}
+	request, err := exporter.newRequest(http.MethodPost, "/_bulk", body, "application/x-ndjson")
+	if err != nil {
+		return err
+	}
+	response, err := exporter.options.Client.Do(request)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errRetriableExport, err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode/100 != 2 {
+		return fmt.Errorf("%w: bulk request failed with status %d", errRetriableExport, response.StatusCode)
+	}
+	result := bulkResponse{}
+	if err := json.NewDecoder(response.Body).Decode(&result); err != nil {
+		return fmt.Errorf("%w: invalid bulk response: %v", errRetriableExport, err)
+	}
+	exported, rejected := 0, 0
+	for _, item := range result.Items {
+		for _, status := range item {
+			switch {
+			// already created by previous attempt
+			case status.Status/100 == 2 || status.Status == http.StatusConflict:
+				exported++
+			case isRetriableStatus(status.Status):
+				return fmt.Errorf("%w: event failed with status %d", errRetriableExport, status.Status)
+			default:
+				rejected++
+				exporter.logger.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorAuditExport).
+					WithField("status", status.Status).Warningf("Audit event rejected: %s", status.Error)
+			}
+		}
+	}
+	ExportedEventsCounter.WithLabelValues(ExportStatusExported).Add(float64(exported))
+	ExportedEventsCounter.WithLabelValues(ExportStatusRejected).Add(float64(rejected))
+	return nil
+}
+
+type bufferedFile struct {
+	path string
+	size int64
+}
+
+// bufferedFiles returns buffered batches in order of arrival
+func (exporter *BulkExporter) bufferedFiles() ([]bufferedFile, error) {
+	infos, err := ioutil.ReadDir(exporter.options.BufferDir)
+	if err != nil {
+		return nil, err
+	}
+	files := make([]bufferedFile, 0, len(infos))
+	for _, info := range infos {
+		if info.IsDir() || filepath.Ext(info.Name()) != bufferFileExtension {
+			continue
+		}
+		files = append(files, bufferedFile{path: filepath.Join(exporter.options.BufferDir, info.Name()), size: info.Size()})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].path < files[j].path })
+	return files, nil
+}
+
+// bufferBatch writes batch to buffer directory. File is renamed after write so partially written batches are never
+// resent.
+func (exporter *BulkExporter) bufferBatch(body []byte, count int) {
+	if exporter.bufferedBytes+int64(len(body)) > exporter.options.MaxBufferBytes {
+		exporter.logger.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorAuditExport).
+			Warningln("Buffer of audit events is full, drop events")
+		ExportedEventsCounter.WithLabelValues(ExportStatusDropped).Add(float64(count))
+		return
+	}
+	exporter.sequence++
+	name := fmt.Sprintf("%020d-%06d", time.Now().UnixNano(), exporter.sequence%1000000)
+	tmpPath := filepath.Join(exporter.options.BufferDir, name+".tmp")
+	err := ioutil.WriteFile(tmpPath, body, 0600)
+	if err == nil {
+		err = os.Rename(tmpPath, filepath.Join(exporter.options.BufferDir, name+bufferFileExtension))
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		exporter.logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorAuditExport).
+			Errorln("Can't buffer audit events on disk, drop events")
+		ExportedEventsCounter.WithLabelValues(ExportStatusDropped).Add(float64(count))
+		return
+	}
+	exporter.bufferedBytes += int64(len(body))
+	BufferSizeGauge.Set(float64(exporter.bufferedBytes))
+}
+
+// drainBuffer resends buffered batches one by one until buffer is empty or export fails
+func (exporter *BulkExporter) drainBuffer() {
+	if exporter.bufferedBytes == 0 || time.Now().Before(exporter.retryAt) {
+		return
+	}
+	defer func() { BufferSizeGauge.Set(float64(exporter.bufferedBytes)) }()
+	files, err := exporter.bufferedFiles()
+	if err != nil {
+		exporter.logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorAuditExport).
+			Errorln("Can't read buffered audit events")
+		return
+	}
+	for _, file := range files {
+		body, err := ioutil.ReadFile(file.path)
+		if err == nil {
+			if err = exporter.send(body); err != nil && errors.Is(err, errRetriableExport) {
+				exporter.onFailure(err)
+				return
+			}
+			exporter.onSuccess()
+		}
+		if err != nil {
+			exporter.logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorAuditExport).
+				WithField("file", file.path).Errorln("Can't export buffered audit events, drop them")
+		}
+		if err := os.Remove(file.path); err != nil {
+			exporter.logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorAuditExport).
+				WithField("file", file.path).Errorln("Can't remove buffered audit events")
+			return
+		}
+		exporter.bufferedBytes -= file.size
+	}
+	exporter.bufferedBytes = 0
+}
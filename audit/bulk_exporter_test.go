@@ -0,0 +1,165 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testCluster imitates bulk API of Elasticsearch which may be unavailable
+type testCluster struct {
+	lock        sync.Mutex
+	unavailable bool
+	templates   []string
+	ids         map[string]bool
+	operations  []string
+}
+
+func (cluster *testCluster) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	cluster.lock.Lock()
+	defer cluster.lock.Unlock()
+	if cluster.unavailable {
+		writer.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	if request.Method == http.MethodPut && strings.HasPrefix(request.URL.Path, "/_index_template/") {
+		cluster.templates = append(cluster.templates, request.URL.Path)
+		writer.Write([]byte(`{"acknowledged":true}`))
+		return
+	}
+	if request.Method != http.MethodPost || request.URL.Path != "/_bulk" {
+		writer.WriteHeader(http.StatusNotFound)
+		return
+	}
+	items := []string{}
+	scanner := bufio.NewScanner(request.Body)
+	for scanner.Scan() {
+		action := map[string]map[string]string{}
+		if err := json.Unmarshal(scanner.Bytes(), &action); err != nil || !scanner.Scan() {
+			writer.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		event := Event{}
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			writer.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		status := http.StatusCreated
+		if id := action["create"]["_id"]; cluster.ids[id] {
+			status = http.StatusConflict
+		} else {
+			cluster.ids[id] = true
+			cluster.operations = append(cluster.operations, event.Operation)
+		}
+		items = append(items, fmt.Sprintf(`{"create":{"_index":%q,"status":%d}}`, action["create"]["_index"], status))
+	}
+	fmt.Fprintf(writer, `{"errors":false,"items":[%s]}`, strings.Join(items, ","))
+}
+
+func (cluster *testCluster) setUnavailable(unavailable bool) {
+	cluster.lock.Lock()
+	cluster.unavailable = unavailable
+	cluster.lock.Unlock()
+}
+
+func (cluster *testCluster) exportedOperations() []string {
+	cluster.lock.Lock()
+	defer cluster.lock.Unlock()
+	return append([]string{}, cluster.operations...)
+}
+
+func waitFor(t *testing.T, condition func() bool, msg string) {
+	deadline := time.Now().Add(time.Second * 5)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal(msg)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func bufferedFilesCount(t *testing.T, dir string) int {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(infos)
+}
+
+func TestBulkExporter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit_buffer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cluster := &testCluster{ids: make(map[string]bool), unavailable: true}
+	server := httptest.NewServer(cluster)
+	defer server.Close()
+
+	if _, err := NewBulkExporter(BulkExporterOptions{URL: server.URL}); err != ErrEmptyBufferDirectory {
+		t.Fatalf("Expected ErrEmptyBufferDirectory, took %v", err)
+	}
+	// nil exporter ignores events
+	var nilExporter *BulkExporter
+	nilExporter.Record(Event{})
+
+	exporter, err := NewBulkExporter(BulkExporterOptions{
+		URL:           server.URL,
+		IndexPrefix:   "test",
+		Service:       "test-service",
+		BufferDir:     dir,
+		BatchSize:     2,
+		FlushInterval: time.Millisecond * 10,
+		RetryInterval: time.Millisecond * 10,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		exporter.Record(NewEvent(fmt.Sprintf("operation%d", i), "http", []byte("client"), nil, 10, nil))
+	}
+	waitFor(t, func() bool { return bufferedFilesCount(t, dir) == 2 }, "Events should be buffered while cluster is unavailable")
+
+	cluster.setUnavailable(false)
+	exporter.Record(NewEvent("operation3", "grpc", []byte("client"), []byte("zone"), 10, nil))
+	waitFor(t, func() bool { return len(cluster.exportedOperations()) == 4 }, "Buffered events should be exported")
+	exporter.Close()
+
+	expected := []string{"operation0", "operation1", "operation2", "operation3"}
+	operations := cluster.exportedOperations()
+	for i := range expected {
+		if operations[i] != expected[i] {
+			t.Fatalf("Expected events in order %v, took %v", expected, operations)
+		}
+	}
+	if count := bufferedFilesCount(t, dir); count != 0 {
+		t.Fatalf("Expected empty buffer, took %d files", count)
+	}
+	if len(cluster.templates) != 1 || cluster.templates[0] != "/_index_template/test" {
+		t.Fatalf("Expected installed index template, took %v", cluster.templates)
+	}
+}
@@ -0,0 +1,76 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package audit exports audit and access events of Acra services (who encrypted or decrypted which data and with
+// which result) directly to Elasticsearch or OpenSearch with bulk API, so security dashboards don't depend on
+// separate log-shipping agent. Events are buffered on disk while cluster is unavailable.
+package audit
+
+import (
+	"time"
+)
+
+// Results of audited operations
+const (
+	ResultSuccess = "success"
+	ResultFailure = "failure"
+)
+
+// Event describes one audited operation
+type Event struct {
+	Time        time.Time `json:"@timestamp"`
+	Service     string    `json:"service"`
+	Operation   string    `json:"operation"`
+	ClientID    string    `json:"client_id,omitempty"`
+	ZoneID      string    `json:"zone_id,omitempty"`
+	RequestType string    `json:"request_type,omitempty"`
+	Result      string    `json:"result"`
+	Error       string    `json:"error,omitempty"`
+	DataSize    int       `json:"data_size"`
+}
+
+// NewEvent returns event of operation with result according to err
+func NewEvent(operation, requestType string, clientID, zoneID []byte, dataSize int, err error) Event {
+	event := Event{
+		Time:        time.Now().UTC(),
+		Operation:   operation,
+		ClientID:    string(clientID),
+		ZoneID:      string(zoneID),
+		RequestType: requestType,
+		Result:      ResultSuccess,
+		DataSize:    dataSize,
+	}
+	if err != nil {
+		event.Result = ResultFailure
+		event.Error = err.Error()
+	}
+	return event
+}
+
+// indexTemplateMappings used for fields of Event in index template
+var indexTemplateMappings = map[string]interface{}{
+	"properties": map[string]interface{}{
+		"@timestamp":   map[string]string{"type": "date"},
+		"service":      map[string]string{"type": "keyword"},
+		"operation":    map[string]string{"type": "keyword"},
+		"client_id":    map[string]string{"type": "keyword"},
+		"zone_id":      map[string]string{"type": "keyword"},
+		"request_type": map[string]string{"type": "keyword"},
+		"result":       map[string]string{"type": "keyword"},
+		"error":        map[string]string{"type": "text"},
+		"data_size":    map[string]string{"type": "long"},
+	},
+}
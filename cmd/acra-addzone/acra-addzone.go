@@ -54,6 +54,7 @@ var (
 func main() {
 	outputDir := flag.String("keys_output_dir", keystore.DefaultKeyDirShort, "Folder where will be saved generated zone keys")
 	flag.Bool("fs_keystore_enable", true, "Use filesystem keystore (deprecated, ignored)")
+	cmd.RegisterRandomSourceCmdParameters()
 
 	logging.SetLogLevel(logging.LogVerbose)
 
@@ -63,6 +64,12 @@ func main() {
 			Errorln("Can't parse args")
 		os.Exit(1)
 	}
+	log.Warningf("%s is deprecated and will be removed in future releases, use \"acra-keys generate --zone\" instead", serviceName)
+	if err := cmd.InitRandomSource(); err != nil {
+		log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorRandomSource).
+			Errorln("Can't initialize random source")
+		os.Exit(1)
+	}
 
 	var keyStore keystore.StorageKeyCreation
 	if filesystemV2.IsKeyDirectory(*outputDir) {
@@ -85,16 +92,11 @@ func main() {
 }
 
 func openKeyStoreV1(output string) keystore.StorageKeyCreation {
-	masterKey, err := keystore.GetMasterKeyFromEnvironment()
+	scellEncryptor, err := keystore.EnvironmentMasterKeyProvider{}.KeyEncryptor()
 	if err != nil {
 		log.WithError(err).Errorln("Cannot load master key")
 		os.Exit(1)
 	}
-	scellEncryptor, err := keystore.NewSCellKeyEncryptor(masterKey)
-	if err != nil {
-		log.WithError(err).Errorln("Can't init scell encryptor")
-		os.Exit(1)
-	}
 	keyStore, err := filesystem.NewFilesystemKeyStore(output, scellEncryptor)
 	if err != nil {
 		log.WithError(err).Errorln("Can't init keystore")
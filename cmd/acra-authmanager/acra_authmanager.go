@@ -241,16 +241,11 @@ func main() {
 }
 
 func openKeyStoreV1(keysDir string) keystore.WebConfigKeyStore {
-	masterKey, err := keystore.GetMasterKeyFromEnvironment()
+	encryptor, err := keystore.EnvironmentMasterKeyProvider{}.KeyEncryptor()
 	if err != nil {
 		log.WithError(err).Errorln("Cannot load master key")
 		os.Exit(1)
 	}
-	encryptor, err := keystore.NewSCellKeyEncryptor(masterKey)
-	if err != nil {
-		log.WithError(err).Errorln("Can't init scell encryptor")
-		os.Exit(1)
-	}
 	keyStore, err := filesystem.NewFilesystemKeyStore(keysDir, encryptor)
 	if err != nil {
 		log.WithError(err).Errorln("Can't init keystore")
@@ -0,0 +1,243 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Operations of ChangeEvent
+const (
+	OperationInsert = "insert"
+	OperationUpdate = "update"
+	OperationDelete = "delete"
+)
+
+// ErrMalformedMessage returned for pgoutput messages which can't be parsed
+var ErrMalformedMessage = errors.New("malformed pgoutput message")
+
+// ColumnValue is value of column in text format. Nil Value means NULL or unchanged TOAST value.
+type ColumnValue struct {
+	Name      string
+	Value     []byte
+	Unchanged bool
+}
+
+// ChangeEvent describes changed row
+type ChangeEvent struct {
+	Table      string
+	Operation  string
+	LSN        string
+	CommitTime time.Time
+	// new row for insert/update, old row or its key for delete
+	Columns []*ColumnValue
+}
+
+// Transaction groups events committed together
+type Transaction struct {
+	Events    []*ChangeEvent
+	CommitLSN uint64
+	EndLSN    uint64
+}
+
+type relation struct {
+	name    string
+	columns []string
+}
+
+// PgOutputDecoder decodes messages of pgoutput plugin (protocol version 1) into transactions
+type PgOutputDecoder struct {
+	relations  map[uint32]*relation
+	current    *Transaction
+	commitTime time.Time
+}
+
+// NewPgOutputDecoder returns new decoder
+func NewPgOutputDecoder() *PgOutputDecoder {
+	return &PgOutputDecoder{relations: make(map[uint32]*relation)}
+}
+
+// FormatLSN returns LSN in PostgreSQL text format like "16/B374D848"
+func FormatLSN(lsn uint64) string {
+	return fmt.Sprintf("%X/%X", uint32(lsn>>32), uint32(lsn))
+}
+
+// Decode processes pgoutput message from XLogData at walStart and returns transaction when it is committed
+func (decoder *PgOutputDecoder) Decode(walStart uint64, message []byte) (*Transaction, error) {
+	if len(message) == 0 {
+		return nil, ErrMalformedMessage
+	}
+	data := message[1:]
+	switch message[0] {
+	case 'B':
+		// final LSN + commit time + xid
+		if len(data) < 20 {
+			return nil, ErrMalformedMessage
+		}
+		decoder.current = &Transaction{}
+		decoder.commitTime = postgresEpoch.Add(time.Duration(binary.BigEndian.Uint64(data[8:16])) * time.Microsecond)
+	case 'C':
+		// flags + commit LSN + end LSN + commit time
+		if len(data) < 25 || decoder.current == nil {
+			return nil, ErrMalformedMessage
+		}
+		transaction := decoder.current
+		transaction.CommitLSN = binary.BigEndian.Uint64(data[1:9])
+		transaction.EndLSN = binary.BigEndian.Uint64(data[9:17])
+		decoder.current = nil
+		return transaction, nil
+	case 'R':
+		return nil, decoder.decodeRelation(data)
+	case 'I', 'U', 'D':
+		if decoder.current == nil {
+			return nil, ErrMalformedMessage
+		}
+		event, err := decoder.decodeChange(message[0], data)
+		if err != nil {
+			return nil, err
+		}
+		event.LSN = FormatLSN(walStart)
+		event.CommitTime = decoder.commitTime
+		decoder.current.Events = append(decoder.current.Events, event)
+	}
+	// Origin, Type and Truncate messages aren't published
+	return nil, nil
+}
+
+func (decoder *PgOutputDecoder) decodeRelation(data []byte) error {
+	if len(data) < 4 {
+		return ErrMalformedMessage
+	}
+	id := binary.BigEndian.Uint32(data[:4])
+	namespace, data, err := readCString(data[4:])
+	if err != nil {
+		return err
+	}
+	name, data, err := readCString(data)
+	if err != nil {
+		return err
+	}
+	if len(data) < 3 {
+		return ErrMalformedMessage
+	}
+	count := int(binary.BigEndian.Uint16(data[1:3]))
+	data = data[3:]
+	rel := &relation{name: namespace + "." + name, columns: make([]string, 0, count)}
+	for i := 0; i < count; i++ {
+		if len(data) < 1 {
+			return ErrMalformedMessage
+		}
+		var column string
+		column, data, err = readCString(data[1:])
+		if err != nil {
+			return err
+		}
+		if len(data) < 8 {
+			return ErrMalformedMessage
+		}
+		data = data[8:]
+		rel.columns = append(rel.columns, column)
+	}
+	decoder.relations[id] = rel
+	return nil
+}
+
+func (decoder *PgOutputDecoder) decodeChange(messageType byte, data []byte) (*ChangeEvent, error) {
+	if len(data) < 5 {
+		return nil, ErrMalformedMessage
+	}
+	rel, ok := decoder.relations[binary.BigEndian.Uint32(data[:4])]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown relation", ErrMalformedMessage)
+	}
+	event := &ChangeEvent{Table: rel.name}
+	switch messageType {
+	case 'I':
+		event.Operation = OperationInsert
+	case 'U':
+		event.Operation = OperationUpdate
+	case 'D':
+		event.Operation = OperationDelete
+	}
+	data = data[4:]
+	// update may contain old row or key before new row, publish only the last tuple
+	for len(data) > 0 {
+		marker := data[0]
+		if marker != 'N' && marker != 'K' && marker != 'O' {
+			return nil, ErrMalformedMessage
+		}
+		columns, rest, err := decodeTuple(rel, data[1:])
+		if err != nil {
+			return nil, err
+		}
+		event.Columns = columns
+		data = rest
+	}
+	return event, nil
+}
+
+func decodeTuple(rel *relation, data []byte) ([]*ColumnValue, []byte, error) {
+	if len(data) < 2 {
+		return nil, nil, ErrMalformedMessage
+	}
+	count := int(binary.BigEndian.Uint16(data[:2]))
+	if count > len(rel.columns) {
+		return nil, nil, ErrMalformedMessage
+	}
+	data = data[2:]
+	columns := make([]*ColumnValue, 0, count)
+	for i := 0; i < count; i++ {
+		if len(data) < 1 {
+			return nil, nil, ErrMalformedMessage
+		}
+		column := &ColumnValue{Name: rel.columns[i]}
+		kind := data[0]
+		data = data[1:]
+		switch kind {
+		case 'n':
+		case 'u':
+			column.Unchanged = true
+		case 't':
+			// replication is started without binary option so values are sent only in text format
+			if len(data) < 4 {
+				return nil, nil, ErrMalformedMessage
+			}
+			length := int(binary.BigEndian.Uint32(data[:4]))
+			if len(data) < 4+length {
+				return nil, nil, ErrMalformedMessage
+			}
+			column.Value = data[4 : 4+length]
+			data = data[4+length:]
+		default:
+			return nil, nil, ErrMalformedMessage
+		}
+		columns = append(columns, column)
+	}
+	return columns, data, nil
+}
+
+func readCString(data []byte) (string, []byte, error) {
+	end := bytes.IndexByte(data, 0)
+	if end == -1 {
+		return "", nil, ErrMalformedMessage
+	}
+	return string(data[:end]), data[end+1:], nil
+}
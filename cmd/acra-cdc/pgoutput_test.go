@@ -0,0 +1,153 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+func writeTestString(output *bytes.Buffer, value string) {
+	output.WriteString(value)
+	output.WriteByte(0)
+}
+
+func testBeginMessage() []byte {
+	output := &bytes.Buffer{}
+	output.WriteByte('B')
+	// final LSN, commit time and xid
+	binary.Write(output, binary.BigEndian, uint64(0x100))
+	binary.Write(output, binary.BigEndian, uint64(0))
+	binary.Write(output, binary.BigEndian, uint32(42))
+	return output.Bytes()
+}
+
+func testCommitMessage(commitLSN, endLSN uint64) []byte {
+	output := &bytes.Buffer{}
+	output.WriteByte('C')
+	output.WriteByte(0)
+	binary.Write(output, binary.BigEndian, commitLSN)
+	binary.Write(output, binary.BigEndian, endLSN)
+	binary.Write(output, binary.BigEndian, uint64(0))
+	return output.Bytes()
+}
+
+func testRelationMessage(relationID uint32, namespace, name string, columns ...string) []byte {
+	output := &bytes.Buffer{}
+	output.WriteByte('R')
+	binary.Write(output, binary.BigEndian, relationID)
+	writeTestString(output, namespace)
+	writeTestString(output, name)
+	// replica identity
+	output.WriteByte('d')
+	binary.Write(output, binary.BigEndian, uint16(len(columns)))
+	for _, column := range columns {
+		output.WriteByte(0)
+		writeTestString(output, column)
+		// text oid and type modifier
+		binary.Write(output, binary.BigEndian, uint32(25))
+		binary.Write(output, binary.BigEndian, int32(-1))
+	}
+	return output.Bytes()
+}
+
+func writeTestTuple(output *bytes.Buffer, marker byte, values ...[]byte) {
+	output.WriteByte(marker)
+	binary.Write(output, binary.BigEndian, uint16(len(values)))
+	for _, value := range values {
+		if value == nil {
+			output.WriteByte('n')
+			continue
+		}
+		output.WriteByte('t')
+		binary.Write(output, binary.BigEndian, uint32(len(value)))
+		output.Write(value)
+	}
+}
+
+func testChangeMessage(messageType byte, relationID uint32, tuples ...[][]byte) []byte {
+	output := &bytes.Buffer{}
+	output.WriteByte(messageType)
+	binary.Write(output, binary.BigEndian, relationID)
+	for i, values := range tuples {
+		marker := byte('N')
+		if messageType == 'D' || (messageType == 'U' && i < len(tuples)-1) {
+			marker = 'O'
+		}
+		writeTestTuple(output, marker, values...)
+	}
+	return output.Bytes()
+}
+
+func TestPgOutputDecoder(t *testing.T) {
+	decoder := NewPgOutputDecoder()
+	messages := [][]byte{
+		testBeginMessage(),
+		testRelationMessage(1, "public", "users", "id", "email"),
+		testChangeMessage('I', 1, [][]byte{[]byte("1"), []byte("user@example.com")}),
+		testChangeMessage('U', 1, [][]byte{[]byte("1"), []byte("user@example.com")}, [][]byte{[]byte("1"), nil}),
+		testChangeMessage('D', 1, [][]byte{[]byte("1"), nil}),
+	}
+	for i, message := range messages {
+		transaction, err := decoder.Decode(uint64(i), message)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if transaction != nil {
+			t.Fatal("Transaction returned before commit")
+		}
+	}
+	transaction, err := decoder.Decode(10, testCommitMessage(0x1000000200, 0x1000000210))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if transaction == nil || len(transaction.Events) != 3 {
+		t.Fatal("Expected transaction with 3 events")
+	}
+	if transaction.EndLSN != 0x1000000210 || FormatLSN(transaction.CommitLSN) != "10/200" {
+		t.Fatal("Incorrect transaction LSN")
+	}
+	operations := []string{OperationInsert, OperationUpdate, OperationDelete}
+	for i, event := range transaction.Events {
+		if event.Table != "public.users" || event.Operation != operations[i] {
+			t.Fatalf("%d: incorrect event %s %s", i, event.Table, event.Operation)
+		}
+		if len(event.Columns) != 2 || event.Columns[0].Name != "id" || string(event.Columns[0].Value) != "1" {
+			t.Fatalf("%d: incorrect columns", i)
+		}
+	}
+	if string(transaction.Events[0].Columns[1].Value) != "user@example.com" {
+		t.Fatal("Incorrect inserted value")
+	}
+	// update contains new row after old one
+	if transaction.Events[1].Columns[1].Value != nil {
+		t.Fatal("Update should contain new row")
+	}
+
+	if _, err := decoder.Decode(0, testChangeMessage('I', 1, [][]byte{[]byte("1")})); !errors.Is(err, ErrMalformedMessage) {
+		t.Fatalf("Expected ErrMalformedMessage outside of transaction, took %v", err)
+	}
+	decoder.Decode(0, testBeginMessage())
+	if _, err := decoder.Decode(0, testChangeMessage('I', 2, [][]byte{[]byte("1")})); !errors.Is(err, ErrMalformedMessage) {
+		t.Fatalf("Expected ErrMalformedMessage for unknown relation, took %v", err)
+	}
+	if _, err := decoder.Decode(0, testRelationMessage(1, "public", "users")[:8]); !errors.Is(err, ErrMalformedMessage) {
+		t.Fatalf("Expected ErrMalformedMessage for truncated relation, took %v", err)
+	}
+}
@@ -0,0 +1,232 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/cossacklabs/acra/decryptor/base"
+	"github.com/cossacklabs/acra/keystore"
+	"github.com/cossacklabs/acra/logging"
+	"github.com/cossacklabs/acra/utils"
+	"github.com/cossacklabs/themis/gothemis/keys"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// Masking types applied to column values
+const (
+	MaskingNone    = ""
+	MaskingFull    = "full"
+	MaskingPartial = "partial"
+	MaskingHash    = "hash"
+	MaskingDrop    = "drop"
+)
+
+// maskSymbol replaces masked characters
+const maskSymbol = "*"
+
+// ErrInvalidPolicy returned for invalid policy configuration
+var ErrInvalidPolicy = errors.New("invalid CDC policy")
+
+// ColumnPolicy describes processing of column value before publishing.
+// Decrypt enables AcraStruct decryption with keys of ClientID or ZoneID, then Masking is applied to value.
+type ColumnPolicy struct {
+	Column          string `yaml:"column"`
+	Decrypt         bool   `yaml:"decrypt"`
+	ClientID        string `yaml:"client_id"`
+	ZoneID          string `yaml:"zone_id"`
+	Masking         string `yaml:"masking"`
+	PlaintextLength int    `yaml:"plaintext_length"`
+}
+
+// TablePolicy lists processed columns of table ("schema.name") and optional topic for its events
+type TablePolicy struct {
+	Table   string         `yaml:"table"`
+	Topic   string         `yaml:"topic"`
+	Columns []ColumnPolicy `yaml:"columns"`
+}
+
+// Policy describes processing of change events
+type Policy struct {
+	Tables []TablePolicy `yaml:"tables"`
+}
+
+// LoadPolicy reads Policy from YAML file. Empty path returns policy which publishes events as is.
+func LoadPolicy(path string) (*Policy, error) {
+	policy := &Policy{}
+	if path == "" {
+		return policy, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.Unmarshal(data, policy); err != nil {
+		return nil, err
+	}
+	if err := policy.Validate(); err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+// Validate checks masking types and decryption keys
+func (policy *Policy) Validate() error {
+	for _, table := range policy.Tables {
+		for _, column := range table.Columns {
+			switch column.Masking {
+			case MaskingNone, MaskingFull, MaskingHash, MaskingDrop:
+			case MaskingPartial:
+				if column.PlaintextLength <= 0 {
+					return fmt.Errorf("%w: %s.%s: partial masking requires positive plaintext_length", ErrInvalidPolicy, table.Table, column.Column)
+				}
+			default:
+				return fmt.Errorf("%w: %s.%s: unknown masking '%s'", ErrInvalidPolicy, table.Table, column.Column, column.Masking)
+			}
+			if column.Decrypt && column.ClientID == "" && column.ZoneID == "" {
+				return fmt.Errorf("%w: %s.%s: decryption requires client_id or zone_id", ErrInvalidPolicy, table.Table, column.Column)
+			}
+		}
+	}
+	return nil
+}
+
+func (policy *Policy) table(name string) *TablePolicy {
+	for i := range policy.Tables {
+		if policy.Tables[i].Table == name {
+			return &policy.Tables[i]
+		}
+	}
+	return nil
+}
+
+// Topic returns topic for events of table
+func (policy *Policy) Topic(table, topicPrefix string) string {
+	if tablePolicy := policy.table(table); tablePolicy != nil && tablePolicy.Topic != "" {
+		return tablePolicy.Topic
+	}
+	return topicPrefix + table
+}
+
+// EventProcessor applies Policy to change events
+type EventProcessor struct {
+	policy   *Policy
+	keystore keystore.PrivateKeyStore
+}
+
+// NewEventProcessor returns EventProcessor which decrypts data with keys from keystore
+func NewEventProcessor(policy *Policy, keystore keystore.PrivateKeyStore) *EventProcessor {
+	return &EventProcessor{policy: policy, keystore: keystore}
+}
+
+// Process applies policy to columns of event in place
+func (processor *EventProcessor) Process(event *ChangeEvent) {
+	tablePolicy := processor.policy.table(event.Table)
+	if tablePolicy == nil {
+		return
+	}
+	columns := event.Columns[:0]
+	for _, column := range event.Columns {
+		columnPolicy := tablePolicy.column(column.Name)
+		if columnPolicy == nil {
+			columns = append(columns, column)
+			continue
+		}
+		if columnPolicy.Masking == MaskingDrop {
+			continue
+		}
+		if column.Value != nil {
+			column.Value = processor.processValue(event.Table, columnPolicy, column.Value)
+		}
+		columns = append(columns, column)
+	}
+	event.Columns = columns
+}
+
+func (table *TablePolicy) column(name string) *ColumnPolicy {
+	for i := range table.Columns {
+		if table.Columns[i].Column == name {
+			return &table.Columns[i]
+		}
+	}
+	return nil
+}
+
+func (processor *EventProcessor) processValue(table string, policy *ColumnPolicy, value []byte) []byte {
+	if policy.Decrypt {
+		decrypted, err := processor.decrypt(policy, value)
+		if err != nil {
+			log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorDecryptorCantDecryptBinary).
+				WithFields(log.Fields{"table": table, "column": policy.Column}).Warningln("Can't decrypt column value")
+			// never publish undecrypted data as plaintext, encrypted value is masked as any other
+		} else {
+			value = decrypted
+		}
+	}
+	return mask(policy, value)
+}
+
+// decrypt value in bytea text format
+func (processor *EventProcessor) decrypt(policy *ColumnPolicy, value []byte) ([]byte, error) {
+	decoded, err := utils.DecodeEscaped(value)
+	if err != nil {
+		return nil, err
+	}
+	if err := base.ValidateAcraStructLength(decoded.Data()); err != nil {
+		return nil, err
+	}
+	var privateKeys []*keys.PrivateKey
+	var zoneID []byte
+	if policy.ZoneID != "" {
+		zoneID = []byte(policy.ZoneID)
+		privateKeys, err = processor.keystore.GetZonePrivateKeys(zoneID)
+	} else {
+		privateKeys, err = processor.keystore.GetServerDecryptionPrivateKeys([]byte(policy.ClientID))
+	}
+	defer utils.ZeroizePrivateKeys(privateKeys)
+	if err != nil {
+		return nil, err
+	}
+	return base.DecryptRotatedAcrastruct(decoded.Data(), privateKeys, zoneID)
+}
+
+// mask value according to policy
+func mask(policy *ColumnPolicy, value []byte) []byte {
+	switch policy.Masking {
+	case MaskingFull:
+		return []byte(strings.Repeat(maskSymbol, utf8.RuneCount(value)))
+	case MaskingPartial:
+		runes := []rune(string(value))
+		if len(runes) <= policy.PlaintextLength {
+			return []byte(strings.Repeat(maskSymbol, len(runes)))
+		}
+		masked := len(runes) - policy.PlaintextLength
+		return []byte(strings.Repeat(maskSymbol, masked) + string(runes[masked:]))
+	case MaskingHash:
+		hash := sha256.Sum256(value)
+		return []byte(hex.EncodeToString(hash[:]))
+	default:
+		return value
+	}
+}
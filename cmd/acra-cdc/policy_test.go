@@ -0,0 +1,133 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"testing"
+
+	acrawriter "github.com/cossacklabs/acra/acra-writer"
+	"github.com/cossacklabs/acra/keystore"
+	"github.com/cossacklabs/themis/gothemis/keys"
+)
+
+// testKeystore returns copy of storage private key of one client
+type testKeystore struct {
+	keystore.PrivateKeyStore
+	clientID string
+	keypair  *keys.Keypair
+}
+
+func (store *testKeystore) GetServerDecryptionPrivateKeys(id []byte) ([]*keys.PrivateKey, error) {
+	if string(id) != store.clientID {
+		return nil, errors.New("key not found")
+	}
+	return []*keys.PrivateKey{{Value: append([]byte{}, store.keypair.Private.Value...)}}, nil
+}
+
+func (store *testKeystore) GetZonePrivateKeys(id []byte) ([]*keys.PrivateKey, error) {
+	return nil, errors.New("not supported")
+}
+
+func TestEventProcessor(t *testing.T) {
+	keypair, err := keys.New(keys.TypeEC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	acrastruct, err := acrawriter.CreateAcrastruct([]byte("user@example.com"), keypair.Public, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encryptedEmail := []byte("\\x" + hex.EncodeToString(acrastruct))
+	policy := &Policy{Tables: []TablePolicy{{
+		Table: "public.users",
+		Columns: []ColumnPolicy{
+			{Column: "email", Decrypt: true, ClientID: "client"},
+			{Column: "card", Masking: MaskingPartial, PlaintextLength: 4},
+			{Column: "name", Masking: MaskingFull},
+			{Column: "phone", Masking: MaskingHash},
+			{Column: "password", Masking: MaskingDrop},
+			{Column: "secret", Decrypt: true, ClientID: "unknown", Masking: MaskingFull},
+		},
+	}}}
+	if err := policy.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	processor := NewEventProcessor(policy, &testKeystore{clientID: "client", keypair: keypair})
+	event := &ChangeEvent{Table: "public.users", Columns: []*ColumnValue{
+		{Name: "id", Value: []byte("1")},
+		{Name: "email", Value: encryptedEmail},
+		{Name: "card", Value: []byte("4111111111111111")},
+		{Name: "name", Value: []byte("Имя")},
+		{Name: "phone", Value: []byte("123")},
+		{Name: "password", Value: []byte("password")},
+		{Name: "secret", Value: []byte("\\x0102")},
+		{Name: "nullable"},
+	}}
+	processor.Process(event)
+	expected := map[string]string{
+		"id":    "1",
+		"email": "user@example.com",
+		"card":  "************1111",
+		"name":  "***",
+		// sha256("123")
+		"phone": "a665a45920422f9d417e4867efdc4fb8a04a1f3fff1fa07e998e86f7f7a27ae3",
+		// undecrypted values are masked
+		"secret": "******",
+	}
+	if len(event.Columns) != 7 {
+		t.Fatalf("Expected 7 columns, took %d", len(event.Columns))
+	}
+	for _, column := range event.Columns {
+		if column.Name == "nullable" {
+			if column.Value != nil {
+				t.Fatal("NULL value was changed")
+			}
+			continue
+		}
+		value, ok := expected[column.Name]
+		if !ok {
+			t.Fatalf("Unexpected column %s", column.Name)
+		}
+		if string(column.Value) != value {
+			t.Errorf("%s: expected %s, took %s", column.Name, value, column.Value)
+		}
+	}
+
+	if policy.Topic("public.users", "acra.cdc.") != "acra.cdc.public.users" {
+		t.Fatal("Incorrect default topic")
+	}
+	policy.Tables[0].Topic = "users"
+	if policy.Topic("public.users", "acra.cdc.") != "users" {
+		t.Fatal("Topic from policy should be used")
+	}
+}
+
+func TestPolicyValidate(t *testing.T) {
+	invalidColumns := []ColumnPolicy{
+		{Column: "email", Masking: "unknown"},
+		{Column: "email", Masking: MaskingPartial},
+		{Column: "email", Decrypt: true},
+	}
+	for i, column := range invalidColumns {
+		policy := &Policy{Tables: []TablePolicy{{Table: "public.users", Columns: []ColumnPolicy{column}}}}
+		if err := policy.Validate(); !errors.Is(err, ErrInvalidPolicy) {
+			t.Errorf("%d: expected ErrInvalidPolicy, took %v", i, err)
+		}
+	}
+}
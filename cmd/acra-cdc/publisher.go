@@ -0,0 +1,277 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Supported output formats
+const (
+	OutputFormatJSON = "json"
+	OutputFormatAvro = "avro"
+)
+
+// ErrUnsupportedOutputFormat returned for unknown output format
+var ErrUnsupportedOutputFormat = errors.New("unsupported output format")
+
+// Publisher delivers change events to sink
+type Publisher interface {
+	// Publish delivers events of one topic and returns error if any of them wasn't accepted
+	Publish(topic string, events []*ChangeEvent) error
+	Close() error
+}
+
+// eventRecord returns event as JSON object where columns values are strings or null
+func eventRecord(event *ChangeEvent) map[string]interface{} {
+	columns := make(map[string]interface{}, len(event.Columns))
+	for _, column := range event.Columns {
+		if column.Unchanged {
+			// unchanged TOAST values aren't sent by PostgreSQL
+			continue
+		}
+		if column.Value == nil {
+			columns[column.Name] = nil
+		} else {
+			columns[column.Name] = string(column.Value)
+		}
+	}
+	return map[string]interface{}{
+		"table":       event.Table,
+		"operation":   event.Operation,
+		"lsn":         event.LSN,
+		"commit_time": event.CommitTime.UTC().Format(time.RFC3339Nano),
+		"columns":     columns,
+	}
+}
+
+// WriterPublisher writes events as JSON lines, used for debugging without Kafka
+type WriterPublisher struct {
+	writer io.Writer
+}
+
+// NewWriterPublisher returns publisher which writes events to writer
+func NewWriterPublisher(writer io.Writer) *WriterPublisher {
+	return &WriterPublisher{writer: writer}
+}
+
+// Publish writes one line per event
+func (publisher *WriterPublisher) Publish(topic string, events []*ChangeEvent) error {
+	encoder := json.NewEncoder(publisher.writer)
+	for _, event := range events {
+		record := eventRecord(event)
+		record["topic"] = topic
+		if err := encoder.Encode(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close does nothing
+func (publisher *WriterPublisher) Close() error {
+	return nil
+}
+
+// KafkaRESTPublisher produces events to Kafka through Confluent REST Proxy (API v2)
+type KafkaRESTPublisher struct {
+	url    string
+	format string
+	client *http.Client
+}
+
+// NewKafkaRESTPublisher returns publisher which sends events to REST Proxy at url in json or avro format
+func NewKafkaRESTPublisher(url, format string, timeout time.Duration) (*KafkaRESTPublisher, error) {
+	if format != OutputFormatJSON && format != OutputFormatAvro {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedOutputFormat, format)
+	}
+	return &KafkaRESTPublisher{url: strings.TrimRight(url, "/"), format: format, client: &http.Client{Timeout: timeout}}, nil
+}
+
+type kafkaProduceResponse struct {
+	Offsets []struct {
+		Partition *int   `json:"partition"`
+		Offset    *int64 `json:"offset"`
+		ErrorCode *int   `json:"error_code"`
+		Error     string `json:"error"`
+	} `json:"offsets"`
+}
+
+// Publish sends all events in one produce request
+func (publisher *KafkaRESTPublisher) Publish(topic string, events []*ChangeEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+	var body interface{}
+	var contentType string
+	switch publisher.format {
+	case OutputFormatAvro:
+		contentType = "application/vnd.kafka.avro.v2+json"
+		avroRequest, err := avroProduceRequest(topic, events)
+		if err != nil {
+			return err
+		}
+		body = avroRequest
+	default:
+		contentType = "application/vnd.kafka.json.v2+json"
+		records := make([]map[string]interface{}, 0, len(events))
+		for _, event := range events {
+			records = append(records, map[string]interface{}{"value": eventRecord(event)})
+		}
+		body = map[string]interface{}{"records": records}
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequest(http.MethodPost, publisher.url+"/topics/"+topic, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", contentType)
+	request.Header.Set("Accept", "application/vnd.kafka.v2+json")
+	response, err := publisher.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	responseBody, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("kafka REST proxy returned %d: %s", response.StatusCode, bytes.TrimSpace(responseBody))
+	}
+	produceResponse := kafkaProduceResponse{}
+	if err := json.Unmarshal(responseBody, &produceResponse); err != nil {
+		return err
+	}
+	for _, offset := range produceResponse.Offsets {
+		if offset.Error != "" || offset.ErrorCode != nil {
+			return fmt.Errorf("kafka REST proxy can't produce record: %s", offset.Error)
+		}
+	}
+	return nil
+}
+
+// Close releases idle connections
+func (publisher *KafkaRESTPublisher) Close() error {
+	publisher.client.CloseIdleConnections()
+	return nil
+}
+
+var avroInvalidNameSymbols = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+// ErrAvroNameCollision returned when several columns of table have same Avro name
+var ErrAvroNameCollision = errors.New("columns have same avro name")
+
+// avroName returns valid Avro name: [A-Za-z_][A-Za-z0-9_]*
+func avroName(name string) string {
+	name = avroInvalidNameSymbols.ReplaceAllString(name, "_")
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		name = "_" + name
+	}
+	return name
+}
+
+// avroBytes returns value of Avro bytes type in JSON encoding where each byte is a code point of string
+func avroBytes(value []byte) string {
+	runes := make([]rune, len(value))
+	for i, b := range value {
+		runes[i] = rune(b)
+	}
+	return string(runes)
+}
+
+// avroProduceRequest returns request with record schema generated from columns of events. Columns are nested in
+// separate record, so they don't overwrite event metadata. All columns are optional strings because values are
+// published in PostgreSQL text format, values which aren't valid UTF-8 (decrypted binary data) are sent as bytes.
+func avroProduceRequest(topic string, events []*ChangeEvent) (map[string]interface{}, error) {
+	recordName := avroName(topic)
+	columnFields := []map[string]interface{}{}
+	// avro name -> column name
+	known := map[string]string{}
+	records := make([]map[string]interface{}, 0, len(events))
+	columnValues := make([]map[string]interface{}, 0, len(events))
+	for _, event := range events {
+		columns := map[string]interface{}{}
+		for _, column := range event.Columns {
+			name := avroName(column.Name)
+			if columnName, ok := known[name]; !ok {
+				known[name] = column.Name
+				columnFields = append(columnFields, map[string]interface{}{
+					"name": name, "type": []string{"null", "string", "bytes"}, "default": nil})
+			} else if columnName != column.Name {
+				return nil, fmt.Errorf("%w: %s, %s", ErrAvroNameCollision, columnName, column.Name)
+			}
+			if column.Value != nil && !column.Unchanged {
+				if utf8.Valid(column.Value) {
+					columns[name] = map[string]string{"string": string(column.Value)}
+				} else {
+					columns[name] = map[string]string{"bytes": avroBytes(column.Value)}
+				}
+			}
+		}
+		columnValues = append(columnValues, columns)
+		records = append(records, map[string]interface{}{"value": map[string]interface{}{
+			"table":       event.Table,
+			"operation":   event.Operation,
+			"lsn":         event.LSN,
+			"commit_time": event.CommitTime.UTC().Format(time.RFC3339Nano),
+			"columns":     columns,
+		}})
+	}
+	// fields missing in some events are null
+	for _, columns := range columnValues {
+		for _, field := range columnFields {
+			name := field["name"].(string)
+			if _, ok := columns[name]; !ok {
+				columns[name] = nil
+			}
+		}
+	}
+	schema := map[string]interface{}{
+		"type": "record",
+		"name": recordName,
+		"fields": []map[string]interface{}{
+			{"name": "table", "type": "string"},
+			{"name": "operation", "type": "string"},
+			{"name": "lsn", "type": "string"},
+			{"name": "commit_time", "type": "string"},
+			{"name": "columns", "type": map[string]interface{}{
+				"type":   "record",
+				"name":   recordName + "_columns",
+				"fields": columnFields,
+			}},
+		},
+	}
+	schemaData, err := json.Marshal(schema)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"value_schema": string(schemaData), "records": records}, nil
+}
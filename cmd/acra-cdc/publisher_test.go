@@ -0,0 +1,145 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func testEvents() []*ChangeEvent {
+	return []*ChangeEvent{
+		{Table: "public.users", Operation: OperationInsert, LSN: "0/10", Columns: []*ColumnValue{
+			{Name: "id", Value: []byte("1")}, {Name: "e-mail", Value: []byte("user@example.com")}}},
+		{Table: "public.users", Operation: OperationDelete, LSN: "0/20", Columns: []*ColumnValue{
+			{Name: "id", Value: []byte("1")}}},
+	}
+}
+
+func TestKafkaRESTPublisher(t *testing.T) {
+	var path, contentType string
+	var request map[string]interface{}
+	responseBody := `{"offsets":[{"partition":0,"offset":1,"error_code":null,"error":null}]}`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		contentType = r.Header.Get("Content-Type")
+		body, _ := ioutil.ReadAll(r.Body)
+		request = nil
+		json.Unmarshal(body, &request)
+		w.Write([]byte(responseBody))
+	}))
+	defer server.Close()
+
+	publisher, err := NewKafkaRESTPublisher(server.URL+"/", OutputFormatJSON, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := publisher.Publish("acra.cdc.public.users", testEvents()); err != nil {
+		t.Fatal(err)
+	}
+	if path != "/topics/acra.cdc.public.users" || contentType != "application/vnd.kafka.json.v2+json" {
+		t.Fatalf("Incorrect request %s %s", path, contentType)
+	}
+	records := request["records"].([]interface{})
+	if len(records) != 2 {
+		t.Fatal("Expected 2 records")
+	}
+	value := records[0].(map[string]interface{})["value"].(map[string]interface{})
+	if value["operation"] != OperationInsert || value["columns"].(map[string]interface{})["e-mail"] != "user@example.com" {
+		t.Fatalf("Incorrect record %v", value)
+	}
+
+	publisher, err = NewKafkaRESTPublisher(server.URL, OutputFormatAvro, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := publisher.Publish("acra.cdc.public.users", testEvents()); err != nil {
+		t.Fatal(err)
+	}
+	if contentType != "application/vnd.kafka.avro.v2+json" {
+		t.Fatalf("Incorrect content type %s", contentType)
+	}
+	schema := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(request["value_schema"].(string)), &schema); err != nil {
+		t.Fatal(err)
+	}
+	fields := schema["fields"].([]interface{})
+	if schema["name"] != "acra_cdc_public_users" || len(fields) != 5 {
+		t.Fatalf("Incorrect schema %v", schema)
+	}
+	columnsSchema := fields[4].(map[string]interface{})["type"].(map[string]interface{})
+	if columnsSchema["name"] != "acra_cdc_public_users_columns" || len(columnsSchema["fields"].([]interface{})) != 2 {
+		t.Fatalf("Incorrect columns schema %v", columnsSchema)
+	}
+	records = request["records"].([]interface{})
+	deleted := records[1].(map[string]interface{})["value"].(map[string]interface{})["columns"].(map[string]interface{})
+	if _, ok := deleted["e_mail"]; !ok || deleted["e_mail"] != nil {
+		t.Fatal("Missing column should be null")
+	}
+
+	responseBody = `{"offsets":[{"partition":null,"offset":null,"error_code":50301,"error":"Leader not available"}]}`
+	if err := publisher.Publish("acra.cdc.public.users", testEvents()); err == nil {
+		t.Fatal("Expected error for rejected record")
+	}
+	if _, err := NewKafkaRESTPublisher(server.URL, "xml", time.Second); !errors.Is(err, ErrUnsupportedOutputFormat) {
+		t.Fatalf("Expected ErrUnsupportedOutputFormat, took %v", err)
+	}
+}
+
+func TestAvroProduceRequest(t *testing.T) {
+	events := []*ChangeEvent{{Table: "public.users", Operation: OperationInsert, LSN: "0/10", Columns: []*ColumnValue{
+		{Name: "table", Value: []byte("column")},
+		{Name: "data", Value: []byte{0xff, 0x00, 'a'}},
+	}}}
+	request, err := avroProduceRequest("users", events)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := struct {
+		Records []struct {
+			Value struct {
+				Table   string                       `json:"table"`
+				Columns map[string]map[string]string `json:"columns"`
+			} `json:"value"`
+		} `json:"records"`
+	}{}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	value := decoded.Records[0].Value
+	if value.Table != "public.users" || value.Columns["table"]["string"] != "column" {
+		t.Fatalf("Column overwrote metadata: %v", value)
+	}
+	// each byte of Avro bytes value is encoded as one code point
+	if value.Columns["data"]["bytes"] != "\u00ff\u0000a" {
+		t.Fatalf("Incorrect bytes value %q", value.Columns["data"]["bytes"])
+	}
+
+	events[0].Columns = append(events[0].Columns, &ColumnValue{Name: "a-b"}, &ColumnValue{Name: "a_b"})
+	if _, err := avroProduceRequest("users", events); !errors.Is(err, ErrAvroNameCollision) {
+		t.Fatalf("Expected ErrAvroNameCollision, took %v", err)
+	}
+}
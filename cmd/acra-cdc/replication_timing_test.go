@@ -0,0 +1,43 @@
+//go:build constanttime
+// +build constanttime
+
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/cossacklabs/acra/utils/timing"
+)
+
+func TestVerifyServerFinalConstantTime(t *testing.T) {
+	client := &scramClient{serverSignature: computeHMAC([]byte("server key"), []byte("auth message"))}
+	early := append([]byte{}, client.serverSignature...)
+	early[0] ^= 0xff
+	late := append([]byte{}, client.serverSignature...)
+	late[len(late)-1] ^= 0xff
+	earlyFinal := []byte("v=" + base64.StdEncoding.EncodeToString(early))
+	lateFinal := []byte("v=" + base64.StdEncoding.EncodeToString(late))
+	result := timing.Measure(func(serverFinal []byte) {
+		client.verifyServerFinal(string(serverFinal))
+	}, earlyFinal, lateFinal, timing.DefaultSamples)
+	if result.Leaks() {
+		t.Fatalf("Verification of server signature depends on position of mismatched byte, t=%f", result.T)
+	}
+}
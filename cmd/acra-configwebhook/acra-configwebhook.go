@@ -0,0 +1,161 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package main is entry point for AcraConfigWebhook service. AcraConfigWebhook is validating admission webhook of
+// Kubernetes which checks encryptor and AcraCensor configs in ConfigMaps before they are created or updated, so
+// broken configs never reach running AcraServers. Encryptor configs are also checked against schema of the database
+// if connection string is set. See configs/acra-configwebhook-kubernetes.example.yaml for webhook registration.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"net/http"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/cossacklabs/acra/cmd"
+	"github.com/cossacklabs/acra/kubernetes"
+	"github.com/cossacklabs/acra/logging"
+	"github.com/cossacklabs/acra/network"
+	"github.com/cossacklabs/acra/utils"
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+)
+
+// Constants used by AcraConfigWebhook
+var (
+	// defaultConfigPath relative path to config which will be parsed as default
+	defaultConfigPath = utils.GetConfigPathByName("acra-configwebhook")
+	serviceName       = "acra-configwebhook"
+)
+
+// HTTP paths served by AcraConfigWebhook
+const (
+	validatePath = "/validate"
+	healthPath   = "/healthz"
+)
+
+// shutdownTimeout limits time of finishing of requests in progress after SIGTERM
+const shutdownTimeout = time.Second * 10
+
+func main() {
+	incomingConnectionString := flag.String("incoming_connection_string", network.BuildConnectionString("tcp", "0.0.0.0", 8443, ""), "Connection string like tcp://x.x.x.x:yyyy to listen for AdmissionReview requests by HTTPS")
+	tlsCert := flag.String("tls_cert", "", "Path to TLS certificate of webhook, Kubernetes API server verifies it with caBundle of webhook configuration")
+	tlsKey := flag.String("tls_key", "", "Path to private key of tls_cert")
+	encryptorConfigKey := flag.String("encryptor_config_key", "encryptor_config.yaml", "Key of ConfigMap data with encryptor config")
+	censorConfigKey := flag.String("acracensor_config_key", "acra-censor.yaml", "Key of ConfigMap data with AcraCensor config")
+	connectionString := flag.String("connection_string", "", "Connection string for db to check that tables and columns of encryptor config exist. If empty, only syntax of configs is checked")
+	useMysql := flag.Bool("mysql_enable", false, "Handle MySQL connections")
+	usePostgresql := flag.Bool("postgresql_enable", false, "Handle Postgresql connections")
+	dbSchema := flag.String("db_schema", "public", "PostgreSQL schema of tables (MySQL uses database from connection string)")
+	dbQueryTimeout := flag.Int("db_query_timeout", 5, "Timeout of reading database schema for each validated ConfigMap, in seconds. Should be less than timeoutSeconds of webhook configuration")
+	verbose := flag.Bool("v", false, "Log to stderr all INFO, WARNING and ERROR logs")
+	debug := flag.Bool("d", false, "Log everything to stderr")
+
+	err := cmd.Parse(defaultConfigPath, serviceName)
+	if err != nil {
+		log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCantReadServiceConfig).
+			Errorln("Can't parse args")
+		os.Exit(1)
+	}
+	if *debug {
+		logging.SetLogLevel(logging.LogDebug)
+	} else if *verbose {
+		logging.SetLogLevel(logging.LogVerbose)
+	} else {
+		logging.SetLogLevel(logging.LogDiscard)
+	}
+
+	if *tlsCert == "" || *tlsKey == "" {
+		log.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+			Errorln("--tls_cert and --tls_key are required, Kubernetes calls webhooks only by HTTPS")
+		os.Exit(1)
+	}
+	if *dbQueryTimeout <= 0 {
+		log.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+			Errorln("--db_query_timeout should be greater than zero")
+		os.Exit(1)
+	}
+
+	var database DatabaseSchema
+	if *connectionString != "" {
+		if *useMysql == *usePostgresql {
+			log.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+				Errorln("You must pass only --mysql_enable or --postgresql_enable (one required) with --connection_string")
+			os.Exit(1)
+		}
+		dbDriverName := "postgres"
+		if *useMysql {
+			dbDriverName = "mysql"
+		}
+		db, err := sql.Open(dbDriverName, *connectionString)
+		if err != nil {
+			log.WithError(err).Errorln("Can't connect to db")
+			os.Exit(1)
+		}
+		defer db.Close()
+		// webhook starts even if database is unavailable, ConfigMaps are denied until it's reachable
+		if err := db.Ping(); err != nil {
+			log.WithError(err).Warningln("Can't connect to db")
+		}
+		if *useMysql {
+			database = NewMySQLDatabaseSchema(db)
+		} else {
+			database = NewPostgreSQLDatabaseSchema(db, *dbSchema)
+		}
+	} else {
+		log.Infoln("Database connection isn't configured, encryptor configs aren't checked against database schema")
+	}
+
+	validator := NewConfigValidator(*encryptorConfigKey, *censorConfigKey, database, time.Duration(*dbQueryTimeout)*time.Second)
+	mux := http.NewServeMux()
+	mux.Handle(validatePath, kubernetes.NewAdmissionHandler(validator))
+	mux.HandleFunc(healthPath, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: shutdownTimeout}
+
+	listener, err := network.Listen(*incomingConnectionString)
+	if err != nil {
+		log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCantStartListenConnections).
+			Errorln("Can't start listen connections")
+		os.Exit(1)
+	}
+	sigHandlerSIGTERM, err := cmd.NewSignalHandler([]os.Signal{os.Interrupt, syscall.SIGTERM})
+	if err != nil {
+		log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCantRegisterSignalHandler).
+			Errorln("System error: can't register SIGTERM handler")
+		os.Exit(1)
+	}
+	sigHandlerSIGTERM.AddCallback(func() {
+		log.Infoln("Received signal, stop serving")
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		server.Shutdown(ctx)
+	})
+	go sigHandlerSIGTERM.Register()
+
+	log.Infof("Start listening AdmissionReview requests on %s, path %s", *incomingConnectionString, validatePath)
+	if err := server.ServeTLS(listener, *tlsCert, *tlsKey); err != http.ErrServerClosed {
+		log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCantStartListenConnections).
+			Errorln("Can't serve AdmissionReview requests")
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,156 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	acracensor "github.com/cossacklabs/acra/acra-censor"
+	"github.com/cossacklabs/acra/encryptor/config"
+	"github.com/cossacklabs/acra/kubernetes"
+)
+
+// ErrConfigDoesntMatchDatabase returned when encryptor config describes tables or columns missing in the database
+var ErrConfigDoesntMatchDatabase = errors.New("encryptor config doesn't match database schema")
+
+// DatabaseSchema returns columns per table of the database
+type DatabaseSchema interface {
+	TableColumns(ctx context.Context) (map[string]map[string]bool, error)
+}
+
+const (
+	postgresqlColumnsQuery = `SELECT table_name, column_name FROM information_schema.columns WHERE table_schema = $1`
+	mysqlColumnsQuery      = `SELECT table_name, column_name FROM information_schema.columns WHERE table_schema = DATABASE()`
+)
+
+// SQLDatabaseSchema reads columns of tables from information_schema of PostgreSQL schema or current MySQL database
+type SQLDatabaseSchema struct {
+	db    *sql.DB
+	query string
+	args  []interface{}
+}
+
+// NewPostgreSQLDatabaseSchema returns DatabaseSchema of PostgreSQL schema (usually "public")
+func NewPostgreSQLDatabaseSchema(db *sql.DB, schema string) *SQLDatabaseSchema {
+	return &SQLDatabaseSchema{db: db, query: postgresqlColumnsQuery, args: []interface{}{schema}}
+}
+
+// NewMySQLDatabaseSchema returns DatabaseSchema of MySQL database selected in connection string
+func NewMySQLDatabaseSchema(db *sql.DB) *SQLDatabaseSchema {
+	return &SQLDatabaseSchema{db: db, query: mysqlColumnsQuery}
+}
+
+// TableColumns returns columns per table read from information_schema
+func (schema *SQLDatabaseSchema) TableColumns(ctx context.Context) (map[string]map[string]bool, error) {
+	rows, err := schema.db.QueryContext(ctx, schema.query, schema.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tables := make(map[string]map[string]bool)
+	for rows.Next() {
+		var table, column string
+		if err := rows.Scan(&table, &column); err != nil {
+			return nil, err
+		}
+		if tables[table] == nil {
+			tables[table] = make(map[string]bool)
+		}
+		tables[table][column] = true
+	}
+	return tables, rows.Err()
+}
+
+// ConfigValidator validates encryptor and AcraCensor configs stored in ConfigMaps by keys. Encryptor config is also
+// checked against database schema if it's set.
+type ConfigValidator struct {
+	encryptorConfigKey string
+	censorConfigKey    string
+	database           DatabaseSchema
+	timeout            time.Duration
+}
+
+// NewConfigValidator returns ConfigValidator of ConfigMap keys, database may be nil to skip checks of database
+// schema which are limited by timeout
+func NewConfigValidator(encryptorConfigKey, censorConfigKey string, database DatabaseSchema, timeout time.Duration) *ConfigValidator {
+	return &ConfigValidator{encryptorConfigKey: encryptorConfigKey, censorConfigKey: censorConfigKey, database: database, timeout: timeout}
+}
+
+// ValidateConfigMap checks configs found in configMap, ConfigMaps without configs are valid
+func (validator *ConfigValidator) ValidateConfigMap(ctx context.Context, configMap *kubernetes.ConfigMap) error {
+	if data, ok := configMap.Data[validator.encryptorConfigKey]; ok {
+		if err := validator.validateEncryptorConfig(ctx, []byte(data)); err != nil {
+			return fmt.Errorf("%s: %w", validator.encryptorConfigKey, err)
+		}
+	}
+	if data, ok := configMap.Data[validator.censorConfigKey]; ok {
+		if err := acracensor.ValidateConfiguration([]byte(data)); err != nil {
+			return fmt.Errorf("%s: %w", validator.censorConfigKey, err)
+		}
+	}
+	return nil
+}
+
+// validateEncryptorConfig parses encryptor config and checks that its tables and columns exist in the database
+func (validator *ConfigValidator) validateEncryptorConfig(ctx context.Context, data []byte) error {
+	store, err := config.MapTableSchemaStoreFromConfig(data)
+	if err != nil {
+		return err
+	}
+	if validator.database == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, validator.timeout)
+	defer cancel()
+	tables, err := validator.database.TableColumns(ctx)
+	if err != nil {
+		return fmt.Errorf("can't read database schema: %w", err)
+	}
+	encryptedColumns := store.EncryptedColumns()
+	tableNames := make([]string, 0, len(encryptedColumns))
+	for table := range encryptedColumns {
+		tableNames = append(tableNames, table)
+	}
+	sort.Strings(tableNames)
+	// aliases are historical names, only current names of tables and columns should exist
+	var problems []string
+	for _, table := range tableNames {
+		columns, ok := tables[table]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("table '%s' doesn't exist", table))
+			continue
+		}
+		// encrypted columns are usually in list of columns too, report them once
+		reported := make(map[string]bool)
+		for _, column := range append(store.GetTableSchema(table).Columns(), encryptedColumns[table]...) {
+			if !columns[column] && !reported[column] {
+				problems = append(problems, fmt.Sprintf("column '%s' of table '%s' doesn't exist", column, table))
+				reported[column] = true
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%w: %s", ErrConfigDoesntMatchDatabase, strings.Join(problems, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	acracensor "github.com/cossacklabs/acra/acra-censor"
+	"github.com/cossacklabs/acra/encryptor/config"
+	"github.com/cossacklabs/acra/kubernetes"
+)
+
+// testDatabaseSchema returns configured tables or error
+type testDatabaseSchema struct {
+	tables map[string]map[string]bool
+	err    error
+}
+
+func (schema *testDatabaseSchema) TableColumns(ctx context.Context) (map[string]map[string]bool, error) {
+	return schema.tables, schema.err
+}
+
+const testEncryptorConfig = `
+schemas:
+- table: users
+  aliases:
+  - clients
+  columns:
+  - id
+  - email
+  - phone
+  encrypted:
+  - column: email
+    aliases:
+    - mail
+    client_id: client
+  - column: phone
+    client_id: client
+`
+
+func TestConfigValidator(t *testing.T) {
+	database := &testDatabaseSchema{tables: map[string]map[string]bool{
+		"users": {"id": true, "email": true, "phone": true},
+	}}
+	validator := NewConfigValidator("encryptor_config.yaml", "acra-censor.yaml", database, time.Second)
+	validate := func(data map[string]string) error {
+		return validator.ValidateConfigMap(context.Background(), &kubernetes.ConfigMap{Data: data})
+	}
+
+	if err := validate(map[string]string{"encryptor_config.yaml": testEncryptorConfig}); err != nil {
+		t.Fatal(err)
+	}
+	// ConfigMaps without configs aren't checked
+	if err := validate(map[string]string{"other.yaml": "{"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// column was renamed in database, but not in config
+	database.tables["users"] = map[string]bool{"id": true, "email_address": true, "phone": true}
+	err := validate(map[string]string{"encryptor_config.yaml": testEncryptorConfig})
+	if !errors.Is(err, ErrConfigDoesntMatchDatabase) || strings.Count(err.Error(), "column 'email' of table 'users'") != 1 {
+		t.Fatalf("Expected ErrConfigDoesntMatchDatabase about column, took %v", err)
+	}
+	if !strings.HasPrefix(err.Error(), "encryptor_config.yaml: ") {
+		t.Fatalf("Error doesn't refer to key of ConfigMap: %v", err)
+	}
+	database.tables = map[string]map[string]bool{"clients": {"id": true}}
+	if err := validate(map[string]string{"encryptor_config.yaml": testEncryptorConfig}); !errors.Is(err, ErrConfigDoesntMatchDatabase) || !strings.Contains(err.Error(), "table 'users' doesn't exist") {
+		t.Fatalf("Expected ErrConfigDoesntMatchDatabase about table, took %v", err)
+	}
+	database.err = errors.New("connection refused")
+	if err := validate(map[string]string{"encryptor_config.yaml": testEncryptorConfig}); err == nil || !strings.Contains(err.Error(), "connection refused") {
+		t.Fatalf("Expected error of database, took %v", err)
+	}
+
+	// syntax is checked without database
+	validator = NewConfigValidator("encryptor_config.yaml", "acra-censor.yaml", nil, time.Second)
+	if err := validate(map[string]string{"encryptor_config.yaml": testEncryptorConfig}); err != nil {
+		t.Fatal(err)
+	}
+	duplicate := testEncryptorConfig + "- table: clients\n"
+	if err := validate(map[string]string{"encryptor_config.yaml": duplicate}); !errors.Is(err, config.ErrInvalidSchemaConfig) {
+		t.Fatalf("Expected ErrInvalidSchemaConfig, took %v", err)
+	}
+	if err := validate(map[string]string{"acra-censor.yaml": "handlers:\n  - handler: allowall\n"}); !errors.Is(err, acracensor.ErrUnsupportedConfigVersion) {
+		t.Fatalf("Expected ErrUnsupportedConfigVersion, took %v", err)
+	}
+	censorConfig := "version: " + acracensor.MinimalCensorConfigVersion + "\nhandlers:\n  - handler: query_capture\n    filepath: /nonexistent/censor.log\n  - handler: allowall\n"
+	if err := validate(map[string]string{"acra-censor.yaml": censorConfig}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -37,6 +37,7 @@ import (
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/cossacklabs/acra/cmd"
 	connector_mode "github.com/cossacklabs/acra/cmd/acra-connector/connector-mode"
@@ -133,27 +134,26 @@ func handleConnection(config *Config, connection net.Conn) {
 		}
 	}
 	logger.WithField("connection_string", config.OutgoingConnectionString).Infof("Connect to AcraServer")
-	acraConn, err := network.Dial(config.OutgoingConnectionString)
-	if err != nil {
-		msg := "Can't connect to AcraServer"
-		logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCantStartConnection).
-			Errorln(msg)
-		span.SetStatus(trace.Status{Code: trace.StatusCodeUnknown, Message: msg})
-		return
-	}
-	_, wrapSpan := trace.StartSpan(ctx, "WrapClient")
-	acraConnWrapped, err := config.ConnectionWrapper.WrapClient(ctx, acraConn)
-	if err != nil {
-		logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCantWrapConnection).
-			Errorln("Can't wrap connection")
-		span.SetStatus(trace.Status{Code: trace.StatusCodeUnknown})
-		if err = acraConn.Close(); err != nil {
-			logger.WithError(err).Errorf("Error on closing connection with %v", connector_mode.ModeToServiceName(config.Mode))
+	var acraConn, acraConnWrapped net.Conn
+	var err error
+	if config.MuxDialer != nil {
+		// stream of multiplexed session is already wrapped and closed with one Close call
+		acraConnWrapped, err = config.MuxDialer.Dial()
+		if err != nil {
+			msg := "Can't open stream of multiplexed session with AcraServer"
+			logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCantStartConnection).
+				Errorln(msg)
+			span.SetStatus(trace.Status{Code: trace.StatusCodeUnknown, Message: msg})
+			return
+		}
+		acraConn = acraConnWrapped
+	} else {
+		acraConn, acraConnWrapped, err = dialAcraServer(ctx, config, logger)
+		if err != nil {
+			span.SetStatus(trace.Status{Code: trace.StatusCodeUnknown})
+			return
 		}
-		wrapSpan.End()
-		return
 	}
-	wrapSpan.End()
 	defer func() {
 		if err := acraConnWrapped.Close(); err != nil {
 			logger.WithError(err).Errorln("Error on closing wrapped connection to Acra-Server")
@@ -197,6 +197,28 @@ func handleConnection(config *Config, connection net.Conn) {
 	}
 }
 
+// dialAcraServer connects to AcraServer and returns connection with its wrapped version
+func dialAcraServer(ctx context.Context, config *Config, logger *log.Entry) (net.Conn, net.Conn, error) {
+	acraConn, err := network.Dial(config.OutgoingConnectionString)
+	if err != nil {
+		logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCantStartConnection).
+			Errorln("Can't connect to AcraServer")
+		return nil, nil, err
+	}
+	_, wrapSpan := trace.StartSpan(ctx, "WrapClient")
+	defer wrapSpan.End()
+	acraConnWrapped, err := config.ConnectionWrapper.WrapClient(ctx, acraConn)
+	if err != nil {
+		logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCantWrapConnection).
+			Errorln("Can't wrap connection")
+		if err := acraConn.Close(); err != nil {
+			logger.WithError(err).Errorf("Error on closing connection with %v", connector_mode.ModeToServiceName(config.Mode))
+		}
+		return nil, nil, err
+	}
+	return acraConn, acraConnWrapped, nil
+}
+
 // Config stores AcraConnector configuration
 type Config struct {
 	KeysDir                  string
@@ -208,10 +230,13 @@ type Config struct {
 	KeyStore                 keystore.SecureSessionKeyStore
 	ConnectionWrapper        network.ConnectionWrapper
 	Mode                     connector_mode.ConnectorMode
+	// MuxDialer opens streams of multiplexed session with AcraServer instead of new connections if not nil
+	MuxDialer *network.MuxDialer
 }
 
 func main() {
 	loggingFormat := flag.String("logging_format", "plaintext", "Logging format: plaintext, json or CEF")
+	loggingBackend := flag.String("logging_backend", logging.DefaultBackendName, "Logging backend: logrus or zap (zap requires build with \"-tags zap\")")
 	keysDir := flag.String("keys_dir", keystore.DefaultKeyDirShort, "Folder from which will be loaded keys")
 	clientID := flag.String("client_id", "", "Client ID")
 	acraServerHost := flag.String("acraserver_connection_host", "", "IP or domain to AcraServer daemon")
@@ -229,12 +254,39 @@ func main() {
 	tlsCert := flag.String("tls_cert", "", "Path to certificate")
 	tlsAcraserverSNI := flag.String("tls_acraserver_sni", "", "Expected Server Name (SNI) from AcraServer")
 	tlsAuthType := flag.Int("tls_auth", int(tls.RequireAndVerifyClientCert), "Set authentication mode that will be used in TLS connection with AcraServer/AcraTranslator. Values in range 0-4 that set auth type (https://golang.org/pkg/crypto/tls/#ClientAuthType). Default is tls.RequireAndVerifyClientCert")
-	tlsOcspURL := flag.String("tls_ocsp_url", "", "OCSP service URL")
+	tlsOcspURL := flag.String("tls_ocsp_url", "", "OCSP service URL. Comma-separated list of responders <url>[;priority=<number>][;role=required|advisory] is accepted: responders with greater priority are backups queried only if previous ones didn't respond, advisory responders can only deny revoked certificates, required ones should know the certificate")
 	tlsOcspRequired := flag.String("tls_ocsp_required", network.OcspRequiredDenyUnknownStr,
 		fmt.Sprintf("How to treat certificates unknown to OCSP: <%s>", strings.Join(network.OcspRequiredValuesList, "|")))
 	tlsOcspFromCert := flag.String("tls_ocsp_from_cert", network.OcspFromCertPreferStr,
 		fmt.Sprintf("How to treat OCSP server described in certificate itself: <%s>", strings.Join(network.OcspFromCertValuesList, "|")))
 	tlsOcspCheckOnlyLeafCertificate := flag.Bool("tls_ocsp_check_only_leaf_certificate", false, "Put 'true' to check only final/last certificate, or 'false' to check the whole certificate chain using OCSP")
+	tlsOcspQueryTimeout := flag.Uint("tls_ocsp_query_timeout", uint(network.OcspHttpClientDefaultTimeout/time.Second), "Timeout of each OCSP query, in seconds")
+	tlsOcspVerifyTimeout := flag.Uint("tls_ocsp_verify_timeout", uint(network.OcspDefaultVerifyTimeout/time.Second), "Deadline of all OCSP queries made to verify certificate chain, in seconds. Servers that don't respond in time are treated as unavailable")
+	tlsOcspClientTimeout := flag.Uint("tls_ocsp_client_timeout", uint(network.OcspHttpClientDefaultTimeout/time.Second), "Timeout of each HTTP request to OCSP server including connection, in seconds")
+	tlsOcspHTTPProxy := flag.String("tls_ocsp_http_proxy", "", "URL of HTTP proxy for OCSP queries (default - proxy from HTTP_PROXY/HTTPS_PROXY/NO_PROXY environment variables)")
+	tlsOcspCABundle := flag.String("tls_ocsp_ca_bundle", "", "Path to PEM file with CA certificates to verify OCSP servers with HTTPS URLs (default - system root certificates)")
+	tlsOcspRetryCount := flag.Uint("tls_ocsp_retry_count", 0, "How many times to retry OCSP requests failed with network errors or 5xx HTTP statuses, within tls_ocsp_query_timeout")
+	tlsOcspForcePOST := flag.Bool("tls_ocsp_force_post", false, "Send OCSP requests only with POST method. By default short requests are sent with GET method, which may be cached by CDNs and HTTP caches")
+	tlsOcspNonce := flag.String("tls_ocsp_nonce", network.OcspNonceNoneStr,
+		fmt.Sprintf("Whether to add nonce to OCSP requests to prevent replay of old responses: <%s>. Requests with nonce aren't cached by HTTP caches", strings.Join(network.OcspNonceValuesList, "|")))
+	tlsOcspClockSkew := flag.Uint("tls_ocsp_clock_skew", uint(network.OcspDefaultClockSkew/time.Second), "Tolerance of clock difference with OCSP server, in seconds. Responses produced later than now, or with NextUpdate earlier than now, by more than this value are denied")
+	tlsReloadInterval := flag.Int("tls_reload_interval", 0, "Time (in seconds) between checks of TLS certificate, key and CA files for changes, changed files are reloaded for new connections without restart. 0 disables checks, files are reloaded on SIGHUP anyway")
+	tlsSpiffeSocket := flag.String("tls_spiffe_workload_api_socket", "", "Path to unix socket of SPIFFE Workload API (like SPIRE agent). If set, TLS certificate and CA bundle for connections to AcraServer are fetched as X.509 SVID and rotated without restart instead of tls_* files, AcraServer is verified by SPIFFE ID")
+	tlsSpiffeTrustDomain := flag.String("tls_spiffe_trust_domain", "", "SPIFFE trust domain of own and AcraServer's SVIDs (required with tls_spiffe_workload_api_socket)")
+	tlsSpiffeAllowedIDs := flag.String("tls_spiffe_allowed_ids", "", "Comma-separated list of SPIFFE IDs of AcraServer allowed to connect to (default - any SPIFFE ID of tls_spiffe_trust_domain)")
+	tlsVerifiers := flag.String("tls_verifiers", network.DefaultCertVerifiers, "Comma-separated list of verifiers of peer certificates in order they run: <ocsp|crl|allowlist|script>. ocsp and crl run only if enabled by their settings")
+	tlsVerifiersMode := flag.String("tls_verifiers_mode", network.CertVerifierModeAll, "How to combine results of tls_verifiers: <all|any>. 'all' requires every verifier to accept the certificate, 'any' requires at least one")
+	tlsCertAllowlistFile := flag.String("tls_cert_allowlist_file", "", "Path to file with SHA-256 fingerprints of allowed peer certificates, one per line, used by 'allowlist' verifier")
+	tlsVerifierScript := flag.String("tls_verifier_script", "", "Path to executable used by 'script' verifier, it reads PEM certificates of the peer from stdin and accepts the peer with zero exit code")
+	tlsPinnedSPKI := flag.String("tls_pinned_spki", "", "Comma-separated list of base64 SHA-256 hashes of SubjectPublicKeyInfo of allowed AcraServer certificates. AcraServer without pinned public key is rejected even if its certificate is issued by trusted CA")
+	tlsVerifyLatencyBudget := flag.Uint("tls_verify_latency_budget", 0, "Maximum time (in milliseconds) TLS handshake waits for tls_verifiers (OCSP/CRL queries, script) of AcraServer certificate. Slower verification continues in background, AcraServer is accepted (rejected if tls_ocsp_required is requireGood) and next handshake gets the verdict (0 - wait until verification finishes)")
+	tlsVerifyDeferredTimeout := flag.Uint("tls_verify_deferred_timeout", uint(network.DefaultDeferredVerificationTimeout/time.Second), "Deadline (in seconds) of certificate verification continued in background after tls_verify_latency_budget, peer is rejected on next handshake if it's exceeded")
+	tlsPolicyProfile := flag.String("tls_policy", network.DefaultTLSPolicy, "Profile of TLS versions and cipher suites of connection with AcraServer: <modern|intermediate|fips>. 'modern' allows only TLS 1.3, 'intermediate' - TLS 1.2 with ECDHE AEAD cipher suites and TLS 1.3, 'fips' - TLS 1.2 with ECDHE AES-GCM cipher suites on NIST curves")
+	tlsMinVersion := flag.String("tls_min_version", "", "Minimal TLS version (1.0, 1.1, 1.2 or 1.3), overrides version of tls_policy")
+	tlsMaxVersion := flag.String("tls_max_version", "", "Maximal TLS version (1.0, 1.1, 1.2 or 1.3), overrides version of tls_policy")
+	tlsCipherSuites := flag.String("tls_cipher_suites", "", "Comma-separated list of IANA names of cipher suites (like TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256) of TLS 1.0-1.2, overrides cipher suites of tls_policy. Cipher suites of TLS 1.3 aren't configurable")
+	tlsSessionCacheSize := flag.Int("tls_session_cache_size", 0, "Count of TLS sessions with AcraServer cached to resume them with session tickets without full handshake. 0 - sessions aren't resumed")
+	tlsPinnedSPKIMatchChain := flag.Bool("tls_pinned_spki_match_chain", false, "Put 'true' to accept AcraServer if any certificate of verified chain (like intermediate or root CA) matches tls_pinned_spki, or 'false' to match only leaf certificate")
 	tlsCrlURL := flag.String("tls_crl_url", "", "URL of the Certificate Revocation List (CRL) to use")
 	tlsCrlFromCert := flag.String("tls_crl_from_cert", network.CrlFromCertPreferStr,
 		fmt.Sprintf("How to treat CRL URL described in certificate itself: <%s>", strings.Join(network.CrlFromCertValuesList, "|")))
@@ -243,6 +295,7 @@ func main() {
 	tlsCrlCacheTime := flag.Uint("tls_crl_cache_time", network.CrlDisableCacheTime,
 		fmt.Sprintf("How long to keep CRLs cached, in seconds (use 0 to disable caching, maximum: %d s)", network.CrlCacheTimeMax))
 	noEncryptionTransport := flag.Bool("acraserver_transport_encryption_disable", false, "Enable this flag to omit AcraConnector and connect client app to AcraServer directly using raw transport (tcp/unix socket). From security perspective please use at least TLS encryption (over tcp socket) between AcraServer and client app.")
+	acraServerMultiplexing := flag.Bool("acraserver_multiplexing_enable", false, "Carry all client connections over one connection with AcraServer as streams of multiplexed session instead of connecting to AcraServer for every client connection. AcraServer should be started with acraconnector_multiplexing_enable")
 	connectionString := flag.String("incoming_connection_string", network.BuildConnectionString(cmd.DefaultAcraConnectorConnectionProtocol, cmd.DefaultAcraConnectorHost, cmd.DefaultAcraConnectorPort, ""), "Connection string like tcp://x.x.x.x:yyyy or unix:///path/to/socket")
 	connectionAPIString := flag.String("incoming_connection_api_string", network.BuildConnectionString(cmd.DefaultAcraConnectorConnectionProtocol, cmd.DefaultAcraConnectorHost, cmd.DefaultAcraConnectorAPIPort, ""), "Connection string like tcp://x.x.x.x:yyyy or unix:///path/to/socket")
 	acraServerConnectionString := flag.String("acraserver_connection_string", "", "Connection string to AcraServer like tcp://x.x.x.x:yyyy or unix:///path/to/socket")
@@ -257,6 +310,7 @@ func main() {
 
 	cmd.RegisterTracingCmdParameters()
 	cmd.RegisterJaegerCmdParameters()
+	cmd.RegisterKubernetesSidecarCmdParameters()
 
 	verbose := flag.Bool("v", false, "Log to stderr all INFO, WARNING and ERROR logs")
 	debug := flag.Bool("d", false, "Log everything to stderr")
@@ -271,7 +325,11 @@ func main() {
 	// Start customizing logs here (directly after command line arguments parsing)
 	formatter := logging.CreateFormatter(*loggingFormat)
 	formatter.SetServiceName(ServiceName)
-	log.SetOutput(os.Stderr)
+	if _, err := logging.SetBackend(*loggingBackend, *loggingFormat, ServiceName, os.Stderr); err != nil {
+		log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+			Errorln("Configuration error: can't set logging backend")
+		os.Exit(1)
+	}
 
 	log.WithField("version", utils.VERSION).Infof("Starting service %v [pid=%v]", ServiceName, os.Getpid())
 	log.Infof("Validating service configuration...")
@@ -290,6 +348,22 @@ func main() {
 
 	log.Infof("Preparing to start in mode: %s", connectorMode)
 
+	if cmd.IsKubernetesSidecarEnabled() {
+		if *clientID != "" {
+			log.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+				Errorln("--client_id can't be used with --kubernetes_sidecar_enable")
+			os.Exit(1)
+		}
+		sidecarClientID, err := cmd.GetKubernetesSidecarClientID()
+		if err != nil {
+			log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+				Errorln("Can't derive client ID from Kubernetes pod identity")
+			os.Exit(1)
+		}
+		cmd.ValidateClientID(sidecarClientID)
+		*clientID = sidecarClientID
+	}
+
 	outgoingConnectionString := ""
 	outgoingSecureSessionID := ""
 
@@ -303,6 +377,11 @@ func main() {
 		if *acraTranslatorPort != cmd.DefaultAcraTranslatorGRPCPort {
 			*acraTranslatorConnectionString = network.BuildConnectionString(cmd.DefaultAcraConnectorConnectionProtocol, *acraTranslatorHost, *acraTranslatorPort, "")
 		}
+		if *acraServerMultiplexing {
+			log.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+				Errorln("Configuration error: acraserver_multiplexing_enable can be used only in AcraServer mode")
+			os.Exit(1)
+		}
 		outgoingConnectionString = *acraTranslatorConnectionString
 		outgoingSecureSessionID = *acraTranslatorID
 	}
@@ -407,11 +486,27 @@ func main() {
 		}
 	}
 
+	certVerifierConfig, err := network.NewCompositeVerifierConfig(*tlsVerifiers, *tlsVerifiersMode, *tlsCertAllowlistFile, *tlsVerifierScript)
+	if err != nil {
+		log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+			Errorln("Configuration error: invalid certificate verifiers config")
+		os.Exit(1)
+	}
+	ocspHTTPClientConfig := network.OCSPClientConfig{
+		Timeout:      time.Duration(*tlsOcspClientTimeout) * time.Second,
+		ProxyURL:     *tlsOcspHTTPProxy,
+		CABundlePath: *tlsOcspCABundle,
+		Retries:      *tlsOcspRetryCount,
+		RetryDelay:   network.OcspDefaultRetryDelay,
+		ForcePOST:    *tlsOcspForcePOST,
+		Nonce:        *tlsOcspNonce,
+		ClockSkew:    time.Duration(*tlsOcspClockSkew) * time.Second,
+	}
 	if connectorMode == connector_mode.AcraServerMode {
 		if *useTLS {
 			log.Infof("Selecting transport: use TLS transport wrapper")
 
-			ocspConfig, err := network.NewOCSPConfig(*tlsOcspURL, *tlsOcspRequired, *tlsOcspFromCert, *tlsOcspCheckOnlyLeafCertificate)
+			ocspConfig, err := network.NewOCSPConfig(*tlsOcspURL, *tlsOcspRequired, *tlsOcspFromCert, *tlsOcspCheckOnlyLeafCertificate, time.Duration(*tlsOcspQueryTimeout)*time.Second, time.Duration(*tlsOcspVerifyTimeout)*time.Second, ocspHTTPClientConfig)
 			if err != nil {
 				log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
 					Errorln("Configuration error: invalid OCSP config")
@@ -425,10 +520,18 @@ func main() {
 				os.Exit(1)
 			}
 
-			certVerifier, err := network.NewCertVerifierFromConfigs(ocspConfig, crlConfig)
+			certVerifier, err := network.NewCompositeVerifierFromConfigs(certVerifierConfig, ocspConfig, crlConfig)
 			if err != nil {
 				log.WithError(err).Fatalln("Cannot create client certificate verifier")
 			}
+			certVerifier = network.NewLatencyBudgetCertVerifier(certVerifier, time.Duration(*tlsVerifyLatencyBudget)*time.Millisecond,
+				time.Duration(*tlsVerifyDeferredTimeout)*time.Second, *tlsOcspRequired == network.OcspRequiredGoodStr)
+			certVerifier, err = network.NewPinnedCertVerifier(*tlsPinnedSPKI, *tlsPinnedSPKIMatchChain, certVerifier)
+			if err != nil {
+				log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+					Errorln("Configuration error: invalid pinned SPKI hashes")
+				os.Exit(1)
+			}
 
 			tlsConfig, err := network.NewTLSConfig(network.SNIOrHostname(*tlsAcraserverSNI, *acraServerHost), *tlsCA, *tlsKey, *tlsCert, tls.ClientAuthType(*tlsAuthType), certVerifier)
 			if err != nil {
@@ -436,6 +539,49 @@ func main() {
 					Errorln("Configuration error: Can't get config for TLS")
 				os.Exit(1)
 			}
+			tlsPolicy, err := network.NewTLSPolicy(*tlsPolicyProfile, *tlsMinVersion, *tlsMaxVersion, *tlsCipherSuites)
+			if err != nil {
+				log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+					Errorln("Configuration error: invalid TLS policy")
+				os.Exit(1)
+			}
+			tlsPolicy.Apply(tlsConfig)
+			if *tlsSessionCacheSize < 0 {
+				log.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+					Errorln("Configuration error: --tls_session_cache_size can't be negative")
+				os.Exit(1)
+			}
+			if *tlsSessionCacheSize > 0 {
+				tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(*tlsSessionCacheSize)
+			}
+			if *tlsSpiffeSocket != "" {
+				spiffeProvider, err := network.NewSpiffeCredentialsProvider(*tlsSpiffeSocket, *tlsSpiffeTrustDomain, strings.Split(*tlsSpiffeAllowedIDs, ","))
+				if err != nil {
+					log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+						Errorln("Configuration error: invalid SPIFFE config")
+					os.Exit(1)
+				}
+				go spiffeProvider.Run(context.Background())
+				fetchCtx, cancelFetch := context.WithTimeout(context.Background(), network.DefaultSpiffeFetchTimeout)
+				err = spiffeProvider.WaitForSVID(fetchCtx)
+				cancelFetch()
+				if err != nil {
+					log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorTransportConfiguration).
+						Errorln("Configuration error: can't fetch X.509 SVID from SPIFFE Workload API")
+					os.Exit(1)
+				}
+				log.WithField("spiffe_id", spiffeProvider.SpiffeID()).Infoln("Fetched X.509 SVID from SPIFFE Workload API")
+				spiffeProvider.Apply(tlsConfig)
+			} else {
+				tlsReloader, err := network.NewTLSReloader(*tlsCA, *tlsKey, *tlsCert)
+				if err != nil {
+					log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorTransportConfiguration).
+						Errorln("Configuration error: Can't load TLS certificates")
+					os.Exit(1)
+				}
+				tlsReloader.Apply(tlsConfig)
+				go tlsReloader.Run(context.Background(), time.Duration(*tlsReloadInterval)*time.Second, syscall.SIGHUP)
+			}
 			config.ConnectionWrapper, err = network.NewTLSConnectionWrapper(nil, tlsConfig)
 			if err != nil {
 				log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorTransportConfiguration).
@@ -454,11 +600,28 @@ func main() {
 				os.Exit(1)
 			}
 		}
+		if *acraServerMultiplexing {
+			log.Infoln("Multiplex connections to AcraServer over one connection")
+			config.MuxDialer = network.NewMuxDialer(func() (net.Conn, error) {
+				conn, err := network.Dial(config.OutgoingConnectionString)
+				if err != nil {
+					return nil, err
+				}
+				wrappedConn, err := config.ConnectionWrapper.WrapClient(context.Background(), conn)
+				if err != nil {
+					conn.Close()
+					return nil, err
+				}
+				return wrappedConn, nil
+			})
+		}
 		if *acraServerEnableHTTPAPI {
 			go func() {
 				// copy config and replace ports
 				commandsConfig := *config
 				commandsConfig.OutgoingConnectionString = *acraServerAPIConnectionString
+				// HTTP API isn't multiplexed
+				commandsConfig.MuxDialer = nil
 
 				log.Infof("Start listening HTTP API: %s", *connectionAPIString)
 				commandsListener, err := network.Listen(*connectionAPIString)
@@ -536,18 +699,13 @@ func main() {
 }
 
 func openKeyStoreV1(keysDir string, clientID []byte, connectorMode connector_mode.ConnectorMode) keystore.TransportKeyStore {
-	masterKey, err := keystore.GetMasterKeyFromEnvironment()
+	scellEncryptor, err := keystore.EnvironmentMasterKeyProvider{}.KeyEncryptor()
 	if err != nil {
 		log.WithError(err).
 			WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCantLoadMasterKey).
 			Errorln("Cannot load master key")
 		os.Exit(1)
 	}
-	scellEncryptor, err := keystore.NewSCellKeyEncryptor(masterKey)
-	if err != nil {
-		log.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCantInitPrivateKeysEncryptor).WithError(err).Errorln("Can't init scell encryptor")
-		os.Exit(1)
-	}
 	keyStore, err := filesystem.NewConnectorFileSystemKeyStore(keysDir, clientID, scellEncryptor, connectorMode)
 	if err != nil {
 		log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCantInitKeyStore).
@@ -17,6 +17,7 @@ package main
 
 import (
 	"github.com/cossacklabs/acra/cmd"
+	"github.com/cossacklabs/acra/network"
 	"github.com/cossacklabs/acra/utils"
 	"github.com/prometheus/client_golang/prometheus"
 	"sync"
@@ -48,6 +49,7 @@ func registerMetrics() {
 	registerLock.Do(func() {
 		prometheus.MustRegister(connectionCounter)
 		prometheus.MustRegister(connectionProcessingTimeHistogram)
+		network.RegisterLatencyBudgetMetrics()
 		version, err := utils.GetParsedVersion()
 		if err != nil {
 			panic(err)
@@ -0,0 +1,141 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package main is entry point for AcraDevCerts utility. AcraDevCerts generates throwaway CA with server and client
+// certificates for local development and testing of TLS connections between applications, Acra services and
+// databases. Generated certificates must not be used in production.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/cossacklabs/acra/cmd"
+	"github.com/cossacklabs/acra/logging"
+	"github.com/cossacklabs/acra/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+// Constants used by AcraDevCerts
+var (
+	// defaultConfigPath relative path to config which will be parsed as default
+	defaultConfigPath = utils.GetConfigPathByName("acra-devcerts")
+	serviceName       = "acra-devcerts"
+)
+
+// Names of generated files without extensions
+const (
+	caName     = "ca"
+	serverName = "acra-server"
+)
+
+// splitList returns non-empty trimmed items of comma-separated value
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func main() {
+	outputDir := flag.String("output_dir", "./.acratls", "Folder where certificates and private keys will be written, created if doesn't exist")
+	serverHosts := flag.String("server_hosts", "localhost,127.0.0.1,acra-server", "Comma-separated DNS names and IP addresses of server certificate, the first one is used as common name")
+	clientIDs := flag.String("client_ids", "acra-client", "Comma-separated common names of client certificates, one certificate per name. Names are used as client IDs with --tls_client_id_from_cert")
+	organization := flag.String("organization", "Acra development", "Organization of subjects of generated certificates")
+	keyType := flag.String("key_type", KeyTypeECDSA, fmt.Sprintf("Type of generated keys: <%s|%s>", KeyTypeECDSA, KeyTypeRSA))
+	validityDays := flag.Int("validity_days", 30, "Number of days generated certificates are valid")
+	ocspURL := flag.String("ocsp_url", "", "OCSP service URL embedded into server and client certificates, for --tls_ocsp_from_cert")
+	crlURL := flag.String("crl_url", "", "CRL distribution point embedded into server and client certificates, for --tls_crl_from_cert")
+	overwrite := flag.Bool("overwrite", false, "Overwrite existing files in output_dir")
+
+	logging.SetLogLevel(logging.LogVerbose)
+
+	err := cmd.Parse(defaultConfigPath, serviceName)
+	if err != nil {
+		log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCantReadServiceConfig).
+			Errorln("Can't parse args")
+		os.Exit(1)
+	}
+	if *validityDays <= 0 {
+		log.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+			Errorln("--validity_days should be positive")
+		os.Exit(1)
+	}
+	hosts := splitList(*serverHosts)
+	if len(hosts) == 0 {
+		log.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+			Errorln("--server_hosts should contain at least one host")
+		os.Exit(1)
+	}
+	clients := splitList(*clientIDs)
+	for _, clientID := range clients {
+		cmd.ValidateClientID(clientID)
+		if clientID == caName || clientID == serverName {
+			log.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+				Errorf("Client ID '%s' clashes with name of CA or server certificate file", clientID)
+			os.Exit(1)
+		}
+	}
+	options := Options{
+		Organization: *organization,
+		KeyType:      *keyType,
+		Validity:     time.Duration(*validityDays) * 24 * time.Hour,
+		OCSPURL:      *ocspURL,
+		CRLURL:       *crlURL,
+	}
+
+	if err := os.MkdirAll(*outputDir, 0700); err != nil {
+		log.WithError(err).WithField("path", *outputDir).Errorln("Can't create output directory")
+		os.Exit(1)
+	}
+	ca, err := GenerateCA(caName, options)
+	if err != nil {
+		log.WithError(err).Errorln("Can't generate CA certificate")
+		os.Exit(1)
+	}
+	certificates := []*Certificate{ca}
+	server, err := GenerateServer(ca, serverName, hosts, options)
+	if err != nil {
+		log.WithError(err).Errorln("Can't generate server certificate")
+		os.Exit(1)
+	}
+	certificates = append(certificates, server)
+	for _, clientID := range clients {
+		client, err := GenerateClient(ca, clientID, clientID, options)
+		if err != nil {
+			log.WithError(err).WithField("client_id", clientID).Errorln("Can't generate client certificate")
+			os.Exit(1)
+		}
+		certificates = append(certificates, client)
+	}
+	for _, certificate := range certificates {
+		certPath, keyPath, err := certificate.Write(*outputDir, *overwrite)
+		if err != nil {
+			log.WithError(err).WithField("name", certificate.Name).Errorln("Can't write certificate, use --overwrite to replace existing files")
+			os.Exit(1)
+		}
+		log.WithFields(log.Fields{"certificate": certPath, "key": keyPath}).Infof("Generated '%s' certificate", certificate.Certificate.Subject.CommonName)
+	}
+	log.Infof("Use --tls_ca=%s with --tls_cert and --tls_key of generated certificates. Don't use them in production",
+		filepath.Join(*outputDir, caName+".crt"))
+}
@@ -0,0 +1,241 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Supported values of --key_type
+const (
+	KeyTypeECDSA = "ecdsa"
+	KeyTypeRSA   = "rsa"
+)
+
+// rsaKeyBits is size of generated RSA keys
+const rsaKeyBits = 2048
+
+// Errors returned by certificate generation
+var (
+	ErrUnknownKeyType = errors.New("unknown key type")
+	ErrNoServerHosts  = errors.New("server certificate should have at least one host")
+)
+
+// Options of generated certificates
+type Options struct {
+	Organization string
+	KeyType      string
+	Validity     time.Duration
+	// OCSPURL and CRLURL are embedded into issued certificates if not empty, so Acra services can check revocation
+	// with --tls_ocsp_from_cert and --tls_crl_from_cert
+	OCSPURL string
+	CRLURL  string
+}
+
+// Certificate is generated certificate with its private key
+type Certificate struct {
+	Name        string
+	Certificate *x509.Certificate
+	PrivateKey  crypto.Signer
+	// chain contains DER of certificate followed by its issuers
+	chain [][]byte
+}
+
+func generateKey(keyType string) (crypto.Signer, error) {
+	switch keyType {
+	case KeyTypeECDSA:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case KeyTypeRSA:
+		return rsa.GenerateKey(rand.Reader, rsaKeyBits)
+	default:
+		return nil, fmt.Errorf("%w '%s', expected %s or %s", ErrUnknownKeyType, keyType, KeyTypeECDSA, KeyTypeRSA)
+	}
+}
+
+func newSerialNumber() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+// newTemplate returns template with fields common for all generated certificates
+func newTemplate(commonName string, options Options) (*x509.Certificate, error) {
+	serial, err := newSerialNumber()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName, Organization: []string{options.Organization}},
+		// tolerate clock skew between containers of local setup
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(options.Validity),
+		BasicConstraintsValid: true,
+	}, nil
+}
+
+func createCertificate(name string, template *x509.Certificate, key crypto.Signer, issuer *Certificate) (*Certificate, error) {
+	parent, signer := template, key
+	if issuer != nil {
+		parent, signer = issuer.Certificate, issuer.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), signer)
+	if err != nil {
+		return nil, err
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	chain := [][]byte{der}
+	if issuer != nil {
+		chain = append(chain, issuer.chain...)
+	}
+	return &Certificate{Name: name, Certificate: certificate, PrivateKey: key, chain: chain}, nil
+}
+
+// GenerateCA returns self-signed CA certificate which issues server and client certificates
+func GenerateCA(name string, options Options) (*Certificate, error) {
+	key, err := generateKey(options.KeyType)
+	if err != nil {
+		return nil, err
+	}
+	template, err := newTemplate(options.Organization+" CA", options)
+	if err != nil {
+		return nil, err
+	}
+	template.IsCA = true
+	template.MaxPathLenZero = true
+	template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature
+	return createCertificate(name, template, key, nil)
+}
+
+// newLeafTemplate returns template and key of certificate with usage and revocation endpoints of options
+func newLeafTemplate(commonName string, usage []x509.ExtKeyUsage, options Options) (*x509.Certificate, crypto.Signer, error) {
+	key, err := generateKey(options.KeyType)
+	if err != nil {
+		return nil, nil, err
+	}
+	template, err := newTemplate(commonName, options)
+	if err != nil {
+		return nil, nil, err
+	}
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	if _, ok := key.(*rsa.PrivateKey); ok {
+		// RSA key exchange of TLS 1.2 encrypts pre-master secret with the key
+		template.KeyUsage |= x509.KeyUsageKeyEncipherment
+	}
+	template.ExtKeyUsage = usage
+	if options.OCSPURL != "" {
+		template.OCSPServer = []string{options.OCSPURL}
+	}
+	if options.CRLURL != "" {
+		template.CRLDistributionPoints = []string{options.CRLURL}
+	}
+	return template, key, nil
+}
+
+// GenerateServer returns certificate for TLS listeners of Acra services and databases, valid for hosts which are
+// DNS names or IP addresses. The first host is used as common name.
+func GenerateServer(ca *Certificate, name string, hosts []string, options Options) (*Certificate, error) {
+	if len(hosts) == 0 {
+		return nil, ErrNoServerHosts
+	}
+	template, key, err := newLeafTemplate(hosts[0], []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}, options)
+	if err != nil {
+		return nil, err
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	return createCertificate(name, template, key, ca)
+}
+
+// GenerateClient returns certificate for clients of TLS connections with commonName in subject, which AcraServer
+// and AcraTranslator use as client ID with --tls_client_id_from_cert. The certificate can be used by Acra services
+// as server certificate too, e.g. by AcraConnector which authenticates to AcraServer and accepts applications.
+func GenerateClient(ca *Certificate, name, commonName string, options Options) (*Certificate, error) {
+	usage := []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth}
+	template, key, err := newLeafTemplate(commonName, usage, options)
+	if err != nil {
+		return nil, err
+	}
+	template.DNSNames = []string{commonName}
+	return createCertificate(name, template, key, ca)
+}
+
+// openNewFile creates file with permissions, fails if file exists unless overwrite is set
+func openNewFile(path string, perm os.FileMode, overwrite bool) (*os.File, error) {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if !overwrite {
+		flags |= os.O_EXCL
+	}
+	return os.OpenFile(path, flags, perm)
+}
+
+func writePEM(path string, perm os.FileMode, overwrite bool, blocks ...*pem.Block) error {
+	file, err := openNewFile(path, perm, overwrite)
+	if err != nil {
+		return err
+	}
+	for _, block := range blocks {
+		if err := pem.Encode(file, block); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	return file.Close()
+}
+
+// Write saves certificate chain into <name>.crt and private key into <name>.key (with 0600 permissions) in dir.
+// Issuers follow the certificate in chain, so it can be used for OCSP stapling. Returns paths of written files.
+func (certificate *Certificate) Write(dir string, overwrite bool) (string, string, error) {
+	certPath := filepath.Join(dir, certificate.Name+".crt")
+	keyPath := filepath.Join(dir, certificate.Name+".key")
+	keyDER, err := x509.MarshalPKCS8PrivateKey(certificate.PrivateKey)
+	if err != nil {
+		return "", "", err
+	}
+	blocks := make([]*pem.Block, 0, len(certificate.chain))
+	for _, der := range certificate.chain {
+		blocks = append(blocks, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	}
+	if err := writePEM(certPath, 0644, overwrite, blocks...); err != nil {
+		return "", "", err
+	}
+	if err := writePEM(keyPath, 0600, overwrite, &pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}); err != nil {
+		return "", "", err
+	}
+	return certPath, keyPath, nil
+}
@@ -0,0 +1,153 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestGenerateCertificates(t *testing.T) {
+	for _, keyType := range []string{KeyTypeECDSA, KeyTypeRSA} {
+		options := Options{Organization: "test", KeyType: keyType, Validity: time.Hour, OCSPURL: "http://127.0.0.1:8888", CRLURL: "http://127.0.0.1:8889/crl"}
+		ca, err := GenerateCA("ca", options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		server, err := GenerateServer(ca, "server", []string{"localhost", "127.0.0.1"}, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client, err := GenerateClient(ca, "client", "test-client", options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		roots := x509.NewCertPool()
+		roots.AddCert(ca.Certificate)
+		if _, err := server.Certificate.Verify(x509.VerifyOptions{Roots: roots, DNSName: "127.0.0.1"}); err != nil {
+			t.Fatalf("[%s] Server certificate isn't valid for IP: %v", keyType, err)
+		}
+		if _, err := client.Certificate.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}); err != nil {
+			t.Fatalf("[%s] Client certificate isn't valid for client auth: %v", keyType, err)
+		}
+		if _, err := server.Certificate.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}); err == nil {
+			t.Fatalf("[%s] Server certificate is valid for client auth", keyType)
+		}
+		for _, certificate := range []*x509.Certificate{server.Certificate, client.Certificate} {
+			if len(certificate.OCSPServer) != 1 || certificate.OCSPServer[0] != options.OCSPURL {
+				t.Fatalf("[%s] Expected OCSP server %s, took %v", keyType, options.OCSPURL, certificate.OCSPServer)
+			}
+			if len(certificate.CRLDistributionPoints) != 1 || certificate.CRLDistributionPoints[0] != options.CRLURL {
+				t.Fatalf("[%s] Expected CRL distribution point %s, took %v", keyType, options.CRLURL, certificate.CRLDistributionPoints)
+			}
+		}
+	}
+
+	if _, err := GenerateCA("ca", Options{KeyType: "dsa", Validity: time.Hour}); !errors.Is(err, ErrUnknownKeyType) {
+		t.Fatalf("Expected ErrUnknownKeyType, took %v", err)
+	}
+	ca, err := GenerateCA("ca", Options{KeyType: KeyTypeECDSA, Validity: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := GenerateServer(ca, "server", nil, Options{KeyType: KeyTypeECDSA, Validity: time.Hour}); err != ErrNoServerHosts {
+		t.Fatalf("Expected ErrNoServerHosts, took %v", err)
+	}
+}
+
+func TestWriteCertificates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "acra-devcerts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	options := Options{Organization: "test", KeyType: KeyTypeECDSA, Validity: time.Hour}
+	ca, err := GenerateCA("ca", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := GenerateServer(ca, "server", []string{"localhost"}, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := GenerateClient(ca, "client", "test-client", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, certificate := range []*Certificate{ca, server, client} {
+		if _, _, err := certificate.Write(dir, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, err := server.Write(dir, false); !os.IsExist(err) {
+		t.Fatalf("Expected error of existing file, took %v", err)
+	}
+	if _, _, err := server.Write(dir, true); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(filepath.Join(dir, "server.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Fatalf("Expected 0600 permissions of private key, took %v", info.Mode().Perm())
+	}
+
+	// written files are usable for mutual TLS as Acra services load them
+	caPEM, err := ioutil.ReadFile(filepath.Join(dir, "ca.crt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(caPEM) {
+		t.Fatal("Can't load CA certificate")
+	}
+	serverCertificate, err := tls.LoadX509KeyPair(filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(serverCertificate.Certificate) != 2 {
+		t.Fatalf("Expected certificate with issuer in chain, took %d certificates", len(serverCertificate.Certificate))
+	}
+	clientCertificate, err := tls.LoadX509KeyPair(filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+	tlsServer := tls.Server(serverConn, &tls.Config{Certificates: []tls.Certificate{serverCertificate}, ClientCAs: roots, ClientAuth: tls.RequireAndVerifyClientCert})
+	serverErr := make(chan error, 1)
+	go func() { serverErr <- tlsServer.Handshake() }()
+	tlsClient := tls.Client(clientConn, &tls.Config{Certificates: []tls.Certificate{clientCertificate}, RootCAs: roots, ServerName: "localhost"})
+	if err := tlsClient.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-serverErr; err != nil {
+		t.Fatal(err)
+	}
+	if peers := tlsServer.ConnectionState().PeerCertificates; len(peers) == 0 || peers[0].Subject.CommonName != "test-client" {
+		t.Fatal("Server didn't receive client certificate")
+	}
+}
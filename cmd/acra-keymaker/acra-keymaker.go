@@ -54,6 +54,11 @@ func main() {
 	outputPublicKey := flag.String("keys_public_output_dir", keystore.DefaultKeyDirShort, "Folder where will be saved public key")
 	masterKey := flag.String("generate_master_key", "", "Generate new random master key and save to file")
 	keystoreVersion := flag.String("keystore", "", "set keystore format: v1 (current), v2 (new)")
+	cmd.RegisterRandomSourceCmdParameters()
+	cmd.RegisterKeystoreVaultCmdParameters()
+	cmd.RegisterKeystoreRedisCmdParameters()
+	cmd.RegisterKeystoreAWSKMSCmdParameters()
+	cmd.RegisterKeystorePKCS11CmdParameters()
 
 	logging.SetLogLevel(logging.LogVerbose)
 
@@ -63,6 +68,12 @@ func main() {
 			Errorln("Can't parse args")
 		os.Exit(1)
 	}
+	log.Warningf("%s is deprecated and will be removed in future releases, use \"acra-keys generate\" instead", serviceName)
+	if err := cmd.InitRandomSource(); err != nil {
+		log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorRandomSource).
+			Errorln("Can't initialize random source")
+		os.Exit(1)
+	}
 
 	cmd.ValidateClientID(*clientID)
 
@@ -93,6 +104,14 @@ func main() {
 
 	var store keystore.KeyMaking
 	// If the keystore already exists, detect its version automatically and allow to not specify it.
+	if cmd.IsKeystoreVaultEnabled() || cmd.IsKeystoreRedisEnabled() {
+		if *keystoreVersion == "v2" {
+			log.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+				Errorln("Configuration error: Vault and Redis keystores support only keystore v1")
+			os.Exit(1)
+		}
+		*keystoreVersion = "v1"
+	}
 	if *keystoreVersion == "" {
 		if filesystemV2.IsKeyDirectory(*outputDir) {
 			*keystoreVersion = "v2"
@@ -167,21 +186,57 @@ func main() {
 }
 
 func openKeyStoreV1(outputDir, outputPublicKey string) keystore.KeyMaking {
-	symmetricKey, err := keystore.GetMasterKeyFromEnvironment()
-	if err != nil {
-		log.WithError(err).Errorln("Cannot load master key")
-		os.Exit(1)
-	}
-	scellEncryptor, err := keystore.NewSCellKeyEncryptor(symmetricKey)
-	if err != nil {
-		log.WithError(err).Errorln("Can't init scell encryptor")
-		os.Exit(1)
+	var keyEncryptor keystore.KeyEncryptor
+	var err error
+	if cmd.IsKeystoreAWSKMSEnabled() {
+		keyEncryptor, err = cmd.NewKeystoreAWSKMSEncryptor()
+		if err != nil {
+			log.WithError(err).
+				WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCantInitPrivateKeysEncryptor).
+				Errorln("Can't init AWS KMS key encryptor")
+			os.Exit(1)
+		}
+	} else {
+		var provider keystore.MasterKeyProvider
+		provider, err = cmd.NewKeystoreMasterKeyProvider()
+		if err == nil {
+			keyEncryptor, err = provider.KeyEncryptor()
+		}
+		if err != nil {
+			log.WithError(err).Errorln("Cannot load master key")
+			os.Exit(1)
+		}
 	}
 	var store keystore.KeyMaking
-	if outputPublicKey != outputDir {
-		store, err = filesystem.NewFilesystemKeyStoreTwoPath(outputDir, outputPublicKey, scellEncryptor)
+	if cmd.IsKeystoreVaultEnabled() || cmd.IsKeystoreRedisEnabled() {
+		if outputPublicKey != outputDir {
+			log.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+				Errorln("Configuration error: --keys_public_output_dir isn't supported with Vault and Redis keystores")
+			os.Exit(1)
+		}
+		var storage filesystem.Storage
+		if cmd.IsKeystoreRedisEnabled() {
+			storage, err = cmd.NewKeystoreRedisStorage(outputDir, keyEncryptor)
+			if err != nil {
+				log.WithError(err).Errorln("Can't connect to Redis keystore")
+				os.Exit(1)
+			}
+		} else {
+			storage, err = cmd.NewKeystoreVaultStorage(outputDir)
+			if err != nil {
+				log.WithError(err).Errorln("Can't connect to Vault keystore")
+				os.Exit(1)
+			}
+		}
+		store, err = filesystem.NewCustomFilesystemKeyStore().
+			KeyDirectory(outputDir).
+			Encryptor(keyEncryptor).
+			Storage(storage).
+			Build()
+	} else if outputPublicKey != outputDir {
+		store, err = filesystem.NewFilesystemKeyStoreTwoPath(outputDir, outputPublicKey, keyEncryptor)
 	} else {
-		store, err = filesystem.NewFilesystemKeyStore(outputDir, scellEncryptor)
+		store, err = filesystem.NewFilesystemKeyStore(outputDir, keyEncryptor)
 	}
 	if err != nil {
 		log.WithError(err).Errorln("Can't init keystore")
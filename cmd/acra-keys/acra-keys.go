@@ -16,15 +16,20 @@
 
 // Package main is entry point for `acra-keys` utility.
 //
-// It can access and maniplulate keystores:
+// It can access and maniplulate keystores of any configured backend, printing
+// machine-readable JSON output with --json:
 //
 //   - list keys
 //   - export keys
 //   - import keys
 //   - migrate keystores
+//   - back up and restore all keys with encrypted archive
 //   - read key data
 //   - destroy keys
+//   - rotate keys
+//   - shred storage keys of client or zone
 //   - generate keys
+//   - pack keystore into KMS-wrapped bundle
 package main
 
 import (
@@ -37,9 +42,18 @@ func main() {
 		&keys.ExportKeysSubcommand{},
 		&keys.ImportKeysSubcommand{},
 		&keys.MigrateKeysSubcommand{},
+		&keys.BackupKeysSubcommand{},
+		&keys.RestoreKeysSubcommand{},
 		&keys.ReadKeySubcommand{},
 		&keys.DestroyKeySubcommand{},
+		&keys.RotateKeySubcommand{},
+		&keys.ShredKeysSubcommand{},
 		&keys.GenerateKeySubcommand{},
+		&keys.KMSBundleSubcommand{},
+		&keys.MasterKeyKDFSubcommand{},
+		&keys.ResealKeysSubcommand{},
+		&keys.ListZonesSubcommand{},
+		&keys.RevokeZoneSubcommand{},
 	}
 	subcommand := keys.ParseParameters(subcommands)
 	if subcommand != nil {
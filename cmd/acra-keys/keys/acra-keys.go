@@ -18,7 +18,9 @@
 package keys
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
 	"os"
 
 	"github.com/cossacklabs/acra/keystore"
@@ -34,6 +36,39 @@ func warnKeystoreV2Only(command string) {
 	log.Info("Read more: https://docs.cossacklabs.com/pages/documentation-acra/#key-management")
 }
 
+// KeyInfo is machine-readable description of the key processed by "read", "destroy" and "rotate" commands.
+type KeyInfo struct {
+	KeyKind  string `json:"key_kind"`
+	ClientID string `json:"client_id,omitempty"`
+	ZoneID   string `json:"zone_id,omitempty"`
+	Format   string `json:"format,omitempty"`
+	Key      []byte `json:"key,omitempty"`
+}
+
+// NewKeyInfo returns description of the key of given kind with client or zone ID.
+func NewKeyInfo(kind string, id, key []byte) *KeyInfo {
+	info := &KeyInfo{KeyKind: kind, Key: key}
+	switch kind {
+	case KeyZoneKeypair, KeyZonePublic, KeyZonePrivate:
+		info.ZoneID = string(id)
+	case KeyPoisonKeypair, KeyPoisonPublic, KeyPoisonPrivate:
+	default:
+		info.ClientID = string(id)
+	}
+	return info
+}
+
+// PrintKeyInfoJSON prints key description as JSON into the given writer.
+func PrintKeyInfoJSON(info *KeyInfo, writer io.Writer) error {
+	json, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	json = append(json, byte('\n'))
+	_, err = writer.Write(json)
+	return err
+}
+
 // ListKeysCommand implements the "list" command.
 func ListKeysCommand(params ListKeysParams, keyStore keystore.ServerKeyStore) {
 	keyDescriptions, err := keyStore.ListKeys()
@@ -107,7 +142,21 @@ func PrintKeyCommand(params ReadKeyParams, keyStore keystore.ServerKeyStore) {
 	}
 	defer utils.ZeroizeSymmetricKey(keyBytes)
 
-	_, err = os.Stdout.Write(keyBytes)
+	if params.KeyFormat() != KeyFormatRaw {
+		keyBytes, err = FormatPublicKey(keyBytes, params.KeyFormat())
+		if err != nil {
+			log.WithError(err).Fatal("Failed to convert key")
+		}
+	}
+	if params.UseJSON() {
+		info := NewKeyInfo(params.ReadKeyKind(), params.ClientID(), keyBytes)
+		if params.KeyFormat() != KeyFormatRaw {
+			info.Format = params.KeyFormat()
+		}
+		err = PrintKeyInfoJSON(info, os.Stdout)
+	} else {
+		_, err = os.Stdout.Write(keyBytes)
+	}
 	if err != nil {
 		log.WithError(err).Fatal("Failed to write key")
 	}
@@ -119,4 +168,26 @@ func DestroyKeyCommand(params DestroyKeyParams, keyStore keystore.KeyMaking) {
 	if err != nil {
 		log.WithError(err).Fatal("Failed to destroy key")
 	}
+	if params.UseJSON() {
+		err = PrintKeyInfoJSON(NewKeyInfo(params.DestroyKeyKind(), params.ClientID(), nil), os.Stdout)
+		if err != nil {
+			log.WithError(err).Fatal("Failed to print destroyed key")
+		}
+	}
+}
+
+// RotateKeyCommand implements the "rotate" command.
+func RotateKeyCommand(params RotateKeyParams, keyStore RotateKeyStore) {
+	publicKey, err := RotateKey(params, keyStore)
+	if err != nil {
+		log.WithError(err).Fatal("Failed to rotate key")
+	}
+	if params.UseJSON() {
+		err = PrintKeyInfoJSON(NewKeyInfo(params.RotateKeyKind(), params.ID(), publicKey), os.Stdout)
+		if err != nil {
+			log.WithError(err).Fatal("Failed to print rotated key")
+		}
+		return
+	}
+	log.Infof("Key pair rotated: %s", params.RotateKeyKind())
 }
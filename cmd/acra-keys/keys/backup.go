@@ -0,0 +1,250 @@
+/*
+ * Copyright 2020, Cossack Labs Limited
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package keys
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/cossacklabs/acra/cmd"
+	keystoreV2 "github.com/cossacklabs/acra/keystore/v2/keystore"
+	"github.com/cossacklabs/acra/keystore/v2/keystore/crypto"
+	"github.com/cossacklabs/acra/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+// BackupKeysParams are parameters of "acra-keys backup" subcommand.
+type BackupKeysParams interface {
+	KeyStoreParameters
+	ExportKeysParams
+}
+
+// RestoreKeysParams are parameters of "acra-keys restore" subcommand.
+type RestoreKeysParams interface {
+	KeyStoreParameters
+	ImportKeysParams
+}
+
+// BackupKeysSubcommand is the "acra-keys backup" subcommand.
+type BackupKeysSubcommand struct {
+	CommonKeyStoreParameters
+	CommonExportImportParameters
+	FlagSet *flag.FlagSet
+}
+
+// Name returns the same of this subcommand.
+func (p *BackupKeysSubcommand) Name() string {
+	return CmdBackupKeys
+}
+
+// GetFlagSet returns flag set of this subcommand.
+func (p *BackupKeysSubcommand) GetFlagSet() *flag.FlagSet {
+	return p.FlagSet
+}
+
+// RegisterFlags registers command-line flags of "acra-keys backup".
+func (p *BackupKeysSubcommand) RegisterFlags() {
+	p.FlagSet = flag.NewFlagSet(CmdBackupKeys, flag.ContinueOnError)
+	p.CommonKeyStoreParameters.Register(p.FlagSet)
+	p.CommonExportImportParameters.Register(p.FlagSet, "output")
+	p.FlagSet.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Command \"%s\": pack all keys of the keystore into encrypted archive protected by new backup key\n", CmdBackupKeys)
+		fmt.Fprintf(os.Stderr, "\n\t%s %s [options...] --key_bundle_file <file> --key_bundle_secret <file>\n", os.Args[0], CmdBackupKeys)
+		fmt.Fprintf(os.Stderr, "\nOptions:\n")
+		cmd.PrintFlags(p.FlagSet)
+	}
+}
+
+// Parse command-line parameters of the subcommand.
+func (p *BackupKeysSubcommand) Parse(arguments []string) error {
+	err := cmd.ParseFlagsWithConfig(p.FlagSet, arguments, DefaultConfigPath, ServiceName)
+	if err != nil {
+		return err
+	}
+	return p.CommonExportImportParameters.validate()
+}
+
+// Execute this subcommand.
+func (p *BackupKeysSubcommand) Execute() {
+	backupKeys, err := keystoreV2.NewMasterKeys()
+	if err != nil {
+		log.WithError(err).Fatal("Failed to generate backup keys")
+	}
+	serializedKeys, err := backupKeys.Marshal()
+	if err != nil {
+		log.WithError(err).Fatal("Failed to serialize backup keys")
+	}
+	defer utils.ZeroizeSymmetricKey(serializedKeys)
+
+	backup, err := BackupKeys(p, backupKeys)
+	if err != nil {
+		log.WithError(err).Fatal("Failed to back up keys")
+	}
+	err = WriteExportedData(backup, serializedKeys, p)
+	if err != nil {
+		log.WithError(err).Fatal("Failed to write keystore backup")
+	}
+	log.Infof("Keystore backup is encrypted and saved here: %s", p.ExportDataFile())
+	log.Infof("Backup key generated here: %s", p.ExportKeysFile())
+	log.Infof("DO NOT transport or store these files together")
+	log.Infof("Restore the keys like this:\n\tacra-keys restore --key_bundle_file \"%s\" --key_bundle_secret \"%s\"", p.ExportDataFile(), p.ExportKeysFile())
+}
+
+// ExportIDs returns key IDs to export, backup always contains all keys.
+func (p *BackupKeysSubcommand) ExportIDs() []string {
+	return nil
+}
+
+// ExportAll returns true since backup contains all keys.
+func (p *BackupKeysSubcommand) ExportAll() bool {
+	return true
+}
+
+// ExportPrivate returns true since backup contains private keys.
+func (p *BackupKeysSubcommand) ExportPrivate() bool {
+	return true
+}
+
+// BackupKeys returns archive of all keys of the keystore encrypted with backup keys.
+// Keystore v1 archive keeps private keys encrypted with master key, keystore v2 re-encrypts them with backup keys.
+func BackupKeys(params BackupKeysParams, backupKeys *keystoreV2.SerializedKeys) ([]byte, error) {
+	if isKeyStoreV2(params) {
+		keyStore, err := openKeyStoreV2(params)
+		if err != nil {
+			return nil, err
+		}
+		cryptosuite, err := crypto.NewSCellSuite(backupKeys.Encryption, backupKeys.Signature)
+		if err != nil {
+			log.WithError(err).Debug("Failed to setup cryptosuite")
+			return nil, err
+		}
+		return ExportKeys(keyStore, cryptosuite, params)
+	}
+	keyStore, err := openKeyStoreV1(params)
+	if err != nil {
+		return nil, err
+	}
+	return keyStore.Export(backupKeys.Encryption)
+}
+
+// RestoreKeysSubcommand is the "acra-keys restore" subcommand.
+type RestoreKeysSubcommand struct {
+	CommonKeyStoreParameters
+	CommonExportImportParameters
+	CommonKeyListingParameters
+	FlagSet *flag.FlagSet
+}
+
+// Name returns the same of this subcommand.
+func (p *RestoreKeysSubcommand) Name() string {
+	return CmdRestoreKeys
+}
+
+// GetFlagSet returns flag set of this subcommand.
+func (p *RestoreKeysSubcommand) GetFlagSet() *flag.FlagSet {
+	return p.FlagSet
+}
+
+// RegisterFlags registers command-line flags of "acra-keys restore".
+func (p *RestoreKeysSubcommand) RegisterFlags() {
+	p.FlagSet = flag.NewFlagSet(CmdRestoreKeys, flag.ContinueOnError)
+	p.CommonKeyStoreParameters.Register(p.FlagSet)
+	p.CommonExportImportParameters.Register(p.FlagSet, "input")
+	p.CommonKeyListingParameters.Register(p.FlagSet)
+	p.FlagSet.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Command \"%s\": restore keys from archive created by \"%s\" into the keystore of any backend\n", CmdRestoreKeys, CmdBackupKeys)
+		fmt.Fprintf(os.Stderr, "\n\t%s %s [options...] --key_bundle_file <file> --key_bundle_secret <file>\n", os.Args[0], CmdRestoreKeys)
+		fmt.Fprintf(os.Stderr, "\nOptions:\n")
+		cmd.PrintFlags(p.FlagSet)
+	}
+}
+
+// Parse command-line parameters of the subcommand.
+func (p *RestoreKeysSubcommand) Parse(arguments []string) error {
+	err := cmd.ParseFlagsWithConfig(p.FlagSet, arguments, DefaultConfigPath, ServiceName)
+	if err != nil {
+		return err
+	}
+	return p.CommonExportImportParameters.validate()
+}
+
+// Execute this subcommand.
+func (p *RestoreKeysSubcommand) Execute() {
+	backup, err := ReadExportedData(p)
+	if err != nil {
+		log.WithError(err).Fatal("Failed to read keystore backup")
+	}
+	backupKeys, err := readBackupKeys(p)
+	if err != nil {
+		log.WithError(err).Fatal("Failed to read backup keys")
+	}
+	if err := RestoreKeys(backup, backupKeys, p); err != nil {
+		log.WithError(err).Fatal("Failed to restore keys")
+	}
+}
+
+// RestoreKeys writes keys of the backup into the keystore. Keys of keystore v2 are printed.
+func RestoreKeys(backup []byte, backupKeys *keystoreV2.SerializedKeys, params RestoreKeysParams) error {
+	if isKeyStoreV2(params) {
+		keyStore, err := openKeyStoreV2(params)
+		if err != nil {
+			return err
+		}
+		cryptosuite, err := crypto.NewSCellSuite(backupKeys.Encryption, backupKeys.Signature)
+		if err != nil {
+			log.WithError(err).Debug("Failed to setup cryptosuite")
+			return err
+		}
+		descriptions, err := ImportKeys(backup, keyStore, cryptosuite, params)
+		if err != nil {
+			return err
+		}
+		log.Infof("successfully restored %d keys", len(descriptions))
+		return PrintKeys(descriptions, os.Stdout, params)
+	}
+	keyStore, err := openKeyStoreV1(params)
+	if err != nil {
+		return err
+	}
+	restored, err := keyStore.Import(backup, backupKeys.Encryption)
+	if err != nil {
+		return err
+	}
+	log.Infof("successfully restored %d key files", restored)
+	return nil
+}
+
+// readBackupKeys reads backup keys generated by "acra-keys backup".
+func readBackupKeys(params ExportImportCommonParams) (*keystoreV2.SerializedKeys, error) {
+	keysFile := params.ExportKeysFile()
+	backupKeyData, err := ioutil.ReadFile(keysFile)
+	if err != nil {
+		log.WithField("path", keysFile).WithError(err).Debug("Failed to read key file")
+		return nil, err
+	}
+	defer utils.ZeroizeSymmetricKey(backupKeyData)
+
+	backupKeys := &keystoreV2.SerializedKeys{}
+	err = backupKeys.Unmarshal(backupKeyData)
+	if err != nil {
+		log.WithField("path", keysFile).WithError(err).Debug("Failed to parse key file content")
+		return nil, err
+	}
+	return backupKeys, nil
+}
@@ -41,13 +41,22 @@ var DefaultConfigPath = utils.GetConfigPathByName("acra-keys")
 
 // Sub-command names:
 const (
-	CmdGenerate    = "generate"
-	CmdListKeys    = "list"
-	CmdExportKeys  = "export"
-	CmdImportKeys  = "import"
-	CmdMigrateKeys = "migrate"
-	CmdReadKey     = "read"
-	CmdDestroyKey  = "destroy"
+	CmdGenerate     = "generate"
+	CmdListKeys     = "list"
+	CmdExportKeys   = "export"
+	CmdImportKeys   = "import"
+	CmdMigrateKeys  = "migrate"
+	CmdReadKey      = "read"
+	CmdDestroyKey   = "destroy"
+	CmdShredKeys    = "shred"
+	CmdKMSBundle    = "kms-bundle"
+	CmdRotateKey    = "rotate"
+	CmdBackupKeys   = "backup"
+	CmdRestoreKeys  = "restore"
+	CmdMasterKeyKDF = "master-key-kdf"
+	CmdResealKeys   = "reseal"
+	CmdListZones    = "list-zones"
+	CmdRevokeZone   = "revoke-zone"
 )
 
 // Key kind constants:
@@ -100,6 +109,7 @@ func ParseParameters(subcommands []Subcommand) Subcommand {
 		}
 		fmt.Fprintf(os.Stderr, "\nSupported commands:\n  %s\n", strings.Join(names, ", "))
 	}
+	RegisterKeyStoreBackendParameters()
 	for _, c := range subcommands {
 		c.RegisterFlags()
 	}
@@ -120,22 +130,37 @@ func parseParameters(subcommands []Subcommand) (Subcommand, error) {
 	err := cmd.ParseFlagsWithConfig(flag.CommandLine, os.Args[1:], DefaultConfigPath, ServiceName)
 	// If there is "--dump_config" on the command line,
 	// dump configuration for all subcommand and immediately exit.
+	flagSets := make([]*flag.FlagSet, len(subcommands)+1)
+	flagSets[0] = flag.CommandLine
+	names := make([]string, len(subcommands))
+	for i, command := range subcommands {
+		flagSets[i+1] = command.GetFlagSet()
+		names[i] = command.Name()
+	}
 	if err == cmd.ErrDumpRequested {
-		flagSets := make([]*flag.FlagSet, len(subcommands)+1)
-		flagSets[0] = flag.CommandLine
-		for i, command := range subcommands {
-			flagSets[i+1] = command.GetFlagSet()
-		}
 		cmd.DumpConfigFromFlagSets(flagSets, DefaultConfigPath, ServiceName, true)
 		os.Exit(0)
 	}
+	if err == cmd.ErrVersionRequested {
+		cmd.PrintVersion(os.Stdout)
+		os.Exit(0)
+	}
+	// completion and schema cover flags of all subcommands like dumped config
+	if err == cmd.ErrCompletionRequested {
+		if err := cmd.GenerateCompletionFromFlagSets(flagSets, names, os.Stdout, cmd.CompletionShell(), ServiceName); err != nil {
+			return nil, err
+		}
+		os.Exit(0)
+	}
+	if err == cmd.ErrFlagsSchemaRequested {
+		if err := cmd.GenerateFlagsSchemaFromFlagSets(flagSets, os.Stdout, ServiceName); err != nil {
+			return nil, err
+		}
+		os.Exit(0)
+	}
 	if err != nil {
 		return nil, err
 	}
-	names := make([]string, len(subcommands))
-	for i, command := range subcommands {
-		names[i] = command.Name()
-	}
 	args := flag.CommandLine.Args()
 	if len(args) == 0 {
 		log.WithField("supported", names).Info("No command specified")
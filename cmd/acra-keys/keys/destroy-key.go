@@ -35,6 +35,7 @@ var SupportedDestroyKeyKinds = []string{
 
 // DestroyKeyParams are parameters of "acra-keys destroy" subcommand.
 type DestroyKeyParams interface {
+	ListKeysParams
 	DestroyKeyKind() string
 	ClientID() []byte
 }
@@ -42,6 +43,7 @@ type DestroyKeyParams interface {
 // DestroyKeySubcommand is the "acra-keys destroy" subcommand.
 type DestroyKeySubcommand struct {
 	CommonKeyStoreParameters
+	CommonKeyListingParameters
 	FlagSet *flag.FlagSet
 
 	destroyKeyKind string
@@ -62,6 +64,7 @@ func (p *DestroyKeySubcommand) GetFlagSet() *flag.FlagSet {
 func (p *DestroyKeySubcommand) RegisterFlags() {
 	p.FlagSet = flag.NewFlagSet(CmdReadKey, flag.ContinueOnError)
 	p.CommonKeyStoreParameters.Register(p.FlagSet)
+	p.CommonKeyListingParameters.Register(p.FlagSet)
 	p.FlagSet.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Command \"%s\": destroy key material\n", CmdDestroyKey)
 		fmt.Fprintf(os.Stderr, "\n\t%s %s [options...] <key-ID>\n\n", os.Args[0], CmdDestroyKey)
@@ -79,6 +79,8 @@ type GenerateKeySubcommand struct {
 	acraWebConfig   bool
 	newZone         bool
 	rotateZone      bool
+
+	encryptorConfigFile string
 }
 
 // KeystoreVersion returns requested keystore version.
@@ -157,6 +159,7 @@ func (g *GenerateKeySubcommand) GetFlagSet() *flag.FlagSet {
 func (g *GenerateKeySubcommand) RegisterFlags() {
 	g.flagSet = flag.NewFlagSet(CmdGenerate, flag.ContinueOnError)
 	g.CommonKeyStoreParameters.Register(g.flagSet)
+	cmd.RegisterRandomSourceCmdParametersWithFlags(g.flagSet)
 	g.flagSet.StringVar(&g.keystoreVersion, "keystore", "", "Keystore format: v1 (current), v2 (new)")
 	g.flagSet.StringVar(&g.clientID, "client_id", "", "Client ID")
 	g.flagSet.StringVar(&g.zoneID, "zone_id", "", "Zone ID")
@@ -168,6 +171,7 @@ func (g *GenerateKeySubcommand) RegisterFlags() {
 	g.flagSet.BoolVar(&g.acraWebConfig, "acrawebconfig_symmetric_key", false, "Generate symmetric key for AcraWebconfig's basic auth DB")
 	g.flagSet.BoolVar(&g.newZone, "zone", false, "Generate new Acra storage zone")
 	g.flagSet.BoolVar(&g.rotateZone, "zone_storage_key", false, "Rotate existing Acra zone storagae keypair")
+	g.flagSet.StringVar(&g.encryptorConfigFile, "encryptor_config_file", "", "Path to Encryptor configuration file of AcraServer, zone storage keys used by its format-preserving encrypted columns are not rotated")
 	g.flagSet.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Command \"%s\": generate new keys\n", CmdGenerate)
 		fmt.Fprintf(os.Stderr, "\n\t%s %s [options...]\n", os.Args[0], CmdGenerate)
@@ -182,6 +186,9 @@ func (g *GenerateKeySubcommand) Parse(arguments []string) error {
 	if err != nil {
 		return err
 	}
+	if err := cmd.InitRandomSource(); err != nil {
+		return err
+	}
 	err = ValidateClientID(g)
 	if err != nil {
 		return err
@@ -190,7 +197,15 @@ func (g *GenerateKeySubcommand) Parse(arguments []string) error {
 	if err != nil {
 		return err
 	}
-	return nil
+	return g.checkFormatPreservingKeys()
+}
+
+// checkFormatPreservingKeys refuses rotation of zone storage keys used by format-preserving encrypted columns
+func (g *GenerateKeySubcommand) checkFormatPreservingKeys() error {
+	if !g.rotateZone {
+		return nil
+	}
+	return CheckFormatPreservingKeys(g.encryptorConfigFile, nil, g.ZoneID())
 }
 
 // ValidateClientID checks that client ID is specified correctly.
@@ -0,0 +1,160 @@
+/*
+ * Copyright 2020, Cossack Labs Limited
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package keys
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+)
+
+// Key formats of "acra-keys read":
+const (
+	KeyFormatRaw         = "raw"
+	KeyFormatPEM         = "pem"
+	KeyFormatDER         = "der"
+	KeyFormatJWK         = "jwk"
+	KeyFormatFingerprint = "fingerprint"
+)
+
+// SupportedKeyFormats is a list of formats supported by `read` subcommand.
+var SupportedKeyFormats = []string{
+	KeyFormatRaw,
+	KeyFormatPEM,
+	KeyFormatDER,
+	KeyFormatJWK,
+	KeyFormatFingerprint,
+}
+
+// Key format errors:
+var (
+	ErrUnknownKeyFormat     = errors.New("unknown key format")
+	ErrKeyFormatNotPublic   = errors.New("key format is supported only for public keys")
+	ErrInvalidThemisEC256PK = errors.New("invalid Themis EC P-256 public key")
+)
+
+// Themis EC public key is "UEC2" tag, big-endian length of whole key, CRC and compressed point of P-256 curve
+var themisEC256PublicKeyTag = []byte("UEC2")
+
+const (
+	themisKeyHeaderLength      = 12
+	compressedP256PointLength  = 33
+	themisEC256PublicKeyLength = themisKeyHeaderLength + compressedP256PointLength
+)
+
+// jsonWebKey is public key in JWK format, RFC 7517
+type jsonWebKey struct {
+	KeyType string `json:"kty"`
+	Curve   string `json:"crv"`
+	X       string `json:"x"`
+	Y       string `json:"y"`
+	KeyID   string `json:"kid"`
+}
+
+// themisPublicKeyToECDSA returns P-256 public key of Themis EC public key
+func themisPublicKeyToECDSA(key []byte) (*ecdsa.PublicKey, error) {
+	if len(key) != themisEC256PublicKeyLength || !bytes.Equal(key[:len(themisEC256PublicKeyTag)], themisEC256PublicKeyTag) {
+		return nil, ErrInvalidThemisEC256PK
+	}
+	point := key[themisKeyHeaderLength:]
+	if point[0] != 2 && point[0] != 3 {
+		return nil, ErrInvalidThemisEC256PK
+	}
+	curve := elliptic.P256()
+	params := curve.Params()
+	x := new(big.Int).SetBytes(point[1:])
+	if x.Cmp(params.P) >= 0 {
+		return nil, ErrInvalidThemisEC256PK
+	}
+	// y² = x³ - 3x + b, P-256 prime is 3 mod 4, so y = (y²)^((p+1)/4)
+	y := new(big.Int).Mul(x, x)
+	y.Mul(y, x)
+	threeX := new(big.Int).Lsh(x, 1)
+	threeX.Add(threeX, x)
+	y.Sub(y, threeX)
+	y.Add(y, params.B)
+	y.Mod(y, params.P)
+	exponent := new(big.Int).Add(params.P, big.NewInt(1))
+	exponent.Rsh(exponent, 2)
+	y.Exp(y, exponent, params.P)
+	if y.Bit(0) != uint(point[0]&1) {
+		y.Sub(params.P, y)
+	}
+	if !curve.IsOnCurve(x, y) {
+		return nil, ErrInvalidThemisEC256PK
+	}
+	return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+}
+
+// publicKeyFingerprint returns base64 SHA-256 of DER-encoded SubjectPublicKeyInfo, like SPKI pins of certificates
+func publicKeyFingerprint(der []byte) string {
+	hash := sha256.Sum256(der)
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+// FormatPublicKey converts Themis EC public key into the given format
+func FormatPublicKey(key []byte, format string) ([]byte, error) {
+	if format == KeyFormatRaw {
+		return key, nil
+	}
+	publicKey, err := themisPublicKeyToECDSA(key)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	switch format {
+	case KeyFormatDER:
+		return der, nil
+	case KeyFormatPEM:
+		return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), nil
+	case KeyFormatFingerprint:
+		return []byte(publicKeyFingerprint(der) + "\n"), nil
+	case KeyFormatJWK:
+		size := (publicKey.Curve.Params().BitSize + 7) / 8
+		jwk, err := json.Marshal(&jsonWebKey{
+			KeyType: "EC",
+			Curve:   publicKey.Curve.Params().Name,
+			X:       base64.RawURLEncoding.EncodeToString(leftPad(publicKey.X.Bytes(), size)),
+			Y:       base64.RawURLEncoding.EncodeToString(leftPad(publicKey.Y.Bytes(), size)),
+			KeyID:   publicKeyFingerprint(der),
+		})
+		if err != nil {
+			return nil, err
+		}
+		return append(jwk, '\n'), nil
+	default:
+		return nil, ErrUnknownKeyFormat
+	}
+}
+
+// leftPad returns data padded with leading zeroes to size bytes
+func leftPad(data []byte, size int) []byte {
+	if len(data) >= size {
+		return data
+	}
+	return append(make([]byte, size-len(data)), data...)
+}
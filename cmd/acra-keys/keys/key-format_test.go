@@ -0,0 +1,121 @@
+/*
+ * Copyright 2020, Cossack Labs Limited
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package keys
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/cossacklabs/themis/gothemis/keys"
+)
+
+func TestFormatPublicKey(t *testing.T) {
+	for i := 0; i < 10; i++ {
+		keypair, err := keys.New(keys.TypeEC)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Themis EC private key is header and scalar of P-256 curve
+		x, y := elliptic.P256().ScalarBaseMult(keypair.Private.Value[themisKeyHeaderLength:])
+
+		der, err := FormatPublicKey(keypair.Public.Value, KeyFormatDER)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed, err := x509.ParsePKIXPublicKey(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		publicKey, ok := parsed.(*ecdsa.PublicKey)
+		if !ok || publicKey.X.Cmp(x) != 0 || publicKey.Y.Cmp(y) != 0 {
+			t.Fatal("Converted public key doesn't match private key")
+		}
+
+		pemData, err := FormatPublicKey(keypair.Public.Value, KeyFormatPEM)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block, _ := pem.Decode(pemData)
+		if block == nil || block.Type != "PUBLIC KEY" || !bytes.Equal(block.Bytes, der) {
+			t.Fatal("Invalid PEM of public key")
+		}
+
+		fingerprint, err := FormatPublicKey(keypair.Public.Value, KeyFormatFingerprint)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.TrimSpace(string(fingerprint)) != publicKeyFingerprint(der) {
+			t.Fatal("Unexpected fingerprint of public key")
+		}
+
+		jwkData, err := FormatPublicKey(keypair.Public.Value, KeyFormatJWK)
+		if err != nil {
+			t.Fatal(err)
+		}
+		jwk := jsonWebKey{}
+		if err := json.Unmarshal(jwkData, &jwk); err != nil {
+			t.Fatal(err)
+		}
+		jwkX, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if err != nil {
+			t.Fatal(err)
+		}
+		jwkY, err := base64.RawURLEncoding.DecodeString(jwk.Y)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if jwk.KeyType != "EC" || jwk.Curve != "P-256" || len(jwkX) != 32 || len(jwkY) != 32 ||
+			new(big.Int).SetBytes(jwkX).Cmp(x) != 0 || new(big.Int).SetBytes(jwkY).Cmp(y) != 0 {
+			t.Fatalf("Invalid JWK of public key: %s", jwkData)
+		}
+	}
+
+	if _, err := FormatPublicKey([]byte("not a key"), KeyFormatPEM); err != ErrInvalidThemisEC256PK {
+		t.Fatalf("Expected ErrInvalidThemisEC256PK, took %v", err)
+	}
+	keypair, err := keys.New(keys.TypeEC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := FormatPublicKey(keypair.Public.Value, "ssh"); err != ErrUnknownKeyFormat {
+		t.Fatalf("Expected ErrUnknownKeyFormat, took %v", err)
+	}
+}
+
+func TestReadKeyFormatRequiresPublicKey(t *testing.T) {
+	subcommand := &ReadKeySubcommand{}
+	subcommand.RegisterFlags()
+	if err := subcommand.Parse([]string{"--private", "--format=pem", "client/Alice/storage"}); err != ErrKeyFormatNotPublic {
+		t.Fatalf("Expected ErrKeyFormatNotPublic, took %v", err)
+	}
+	subcommand = &ReadKeySubcommand{}
+	subcommand.RegisterFlags()
+	if err := subcommand.Parse([]string{"--public", "--format=jwk", "client/Alice/storage"}); err != nil {
+		t.Fatal(err)
+	}
+	if subcommand.KeyFormat() != KeyFormatJWK {
+		t.Fatalf("Unexpected format %s", subcommand.KeyFormat())
+	}
+}
@@ -20,6 +20,7 @@ import (
 	"errors"
 	"flag"
 
+	"github.com/cossacklabs/acra/cmd"
 	"github.com/cossacklabs/acra/keystore"
 	keystoreV1 "github.com/cossacklabs/acra/keystore"
 	filesystemV1 "github.com/cossacklabs/acra/keystore/filesystem"
@@ -32,6 +33,7 @@ import (
 // KeyStoreFactory should return one of those errors when it is not able to construct requested keystore.
 var (
 	ErrNotImplementedV1 = errors.New("not implemented for keystore v1")
+	ErrNotImplementedV2 = errors.New("not implemented for keystore v2")
 )
 
 // KeyStoreParameters are parameters for DefaultKeyStoreFactory.
@@ -73,9 +75,32 @@ func (p *CommonKeyStoreParameters) RegisterPrefixed(flags *flag.FlagSet, default
 	flags.StringVar(&p.keyDirPublic, flagPrefix+"keys_dir_public", "", "path to key directory for public keys"+descriptionSuffix)
 }
 
+// RegisterKeyStoreBackendParameters registers global command-line flags of keystore v1 kept in Vault or Redis instead
+// of key directory and of master key kept in HSM or AWS KMS, like in AcraServer configuration
+func RegisterKeyStoreBackendParameters() {
+	cmd.RegisterKeystoreVaultCmdParameters()
+	cmd.RegisterKeystoreRedisCmdParameters()
+	cmd.RegisterKeystorePKCS11CmdParameters()
+	cmd.RegisterKeystoreAWSKMSCmdParameters()
+}
+
+// isKeyStoreV2 returns true if keys of params are kept in keystore v2, other backends support only keystore v1
+func isKeyStoreV2(params KeyStoreParameters) bool {
+	if cmd.IsKeystoreVaultEnabled() || cmd.IsKeystoreRedisEnabled() {
+		return false
+	}
+	return filesystemV2.IsKeyDirectory(params.KeyDir())
+}
+
+// RotateKeyStore enables rotation of keys with access to new public keys.
+type RotateKeyStore interface {
+	keystore.KeyMaking
+	keystore.PublicKeyStore
+}
+
 // OpenKeyStoreForReading opens a keystore suitable for reading keys.
 func OpenKeyStoreForReading(params KeyStoreParameters) (keystore.ServerKeyStore, error) {
-	if filesystemV2.IsKeyDirectory(params.KeyDir()) {
+	if isKeyStoreV2(params) {
 		return openKeyStoreV2(params)
 	}
 	return openKeyStoreV1(params)
@@ -83,15 +108,31 @@ func OpenKeyStoreForReading(params KeyStoreParameters) (keystore.ServerKeyStore,
 
 // OpenKeyStoreForWriting opens a keystore suitable for modifications.
 func OpenKeyStoreForWriting(params KeyStoreParameters) (keystore.KeyMaking, error) {
-	if filesystemV2.IsKeyDirectory(params.KeyDir()) {
+	if isKeyStoreV2(params) {
 		return openKeyStoreV2(params)
 	}
 	return openKeyStoreV1(params)
 }
 
+// OpenKeyStoreForRotation opens a keystore suitable for key rotation.
+func OpenKeyStoreForRotation(params KeyStoreParameters) (RotateKeyStore, error) {
+	if isKeyStoreV2(params) {
+		return openKeyStoreV2(params)
+	}
+	return openKeyStoreV1(params)
+}
+
+// OpenKeyStoreForZoneManagement opens a keystore suitable for listing and revocation of zones.
+func OpenKeyStoreForZoneManagement(params KeyStoreParameters) (keystore.ZoneManagement, error) {
+	if isKeyStoreV2(params) {
+		return nil, ErrNotImplementedV2
+	}
+	return openKeyStoreV1(params)
+}
+
 // OpenKeyStoreForExport opens a keystore suitable for export operations.
 func OpenKeyStoreForExport(params KeyStoreParameters) (api.KeyStore, error) {
-	if filesystemV2.IsKeyDirectory(params.KeyDir()) {
+	if isKeyStoreV2(params) {
 		return openKeyStoreV2(params)
 	}
 	// Not supported in Acra CE
@@ -100,7 +141,7 @@ func OpenKeyStoreForExport(params KeyStoreParameters) (api.KeyStore, error) {
 
 // OpenKeyStoreForImport opens a keystore suitable for import operations.
 func OpenKeyStoreForImport(params KeyStoreParameters) (api.MutableKeyStore, error) {
-	if filesystemV2.IsKeyDirectory(params.KeyDir()) {
+	if isKeyStoreV2(params) {
 		return openKeyStoreV2(params)
 	}
 	// Not supported in Acra CE
@@ -108,24 +149,46 @@ func OpenKeyStoreForImport(params KeyStoreParameters) (api.MutableKeyStore, erro
 }
 
 func openKeyStoreV1(params KeyStoreParameters) (*filesystemV1.KeyStore, error) {
-	symmetricKey, err := keystoreV1.GetMasterKeyFromEnvironment()
-	if err != nil {
-		log.WithError(err).Errorln("Cannot load master key")
-		return nil, err
-	}
-	scellEncryptor, err := keystoreV1.NewSCellKeyEncryptor(symmetricKey)
-	if err != nil {
-		log.WithError(err).Errorln("Failed to initialize Secure Cell encryptor")
-		return nil, err
+	var keyEncryptor keystoreV1.KeyEncryptor
+	var err error
+	if cmd.IsKeystoreAWSKMSEnabled() {
+		keyEncryptor, err = cmd.NewKeystoreAWSKMSEncryptor()
+		if err != nil {
+			log.WithError(err).Errorln("Failed to initialize AWS KMS key encryptor")
+			return nil, err
+		}
+	} else {
+		var provider keystoreV1.MasterKeyProvider
+		provider, err = cmd.NewKeystoreMasterKeyProvider()
+		if err == nil {
+			keyEncryptor, err = provider.KeyEncryptor()
+		}
+		if err != nil {
+			log.WithError(err).Errorln("Cannot load master key")
+			return nil, err
+		}
 	}
-	var store *filesystemV1.KeyStore
 	keyDir := params.KeyDir()
-	keyDirPublic := params.KeyDirPublic()
-	if keyDir != keyDirPublic {
-		store, err = filesystemV1.NewFilesystemKeyStoreTwoPath(keyDir, keyDirPublic, scellEncryptor)
-	} else {
-		store, err = filesystemV1.NewFilesystemKeyStore(keyDir, scellEncryptor)
+	builder := filesystemV1.NewCustomFilesystemKeyStore().
+		KeyDirectories(keyDir, params.KeyDirPublic()).
+		Encryptor(keyEncryptor)
+	if cmd.IsKeystoreVaultEnabled() {
+		storage, err := cmd.NewKeystoreVaultStorage(keyDir)
+		if err != nil {
+			log.WithError(err).Errorln("Failed to connect to Vault keystore")
+			return nil, err
+		}
+		builder = builder.Storage(storage)
+	}
+	if cmd.IsKeystoreRedisEnabled() {
+		storage, err := cmd.NewKeystoreRedisStorage(keyDir, keyEncryptor)
+		if err != nil {
+			log.WithError(err).Errorln("Failed to connect to Redis keystore")
+			return nil, err
+		}
+		builder = builder.Storage(storage)
 	}
+	store, err := builder.Build()
 	if err != nil {
 		log.WithError(err).Errorln("Failed to initialize key")
 		return nil, err
@@ -0,0 +1,112 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package keys
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/cossacklabs/acra/cmd"
+	"github.com/cossacklabs/acra/keystore/filesystem"
+	"github.com/cossacklabs/acra/keystore/kms"
+	filesystemV2 "github.com/cossacklabs/acra/keystore/v2/keystore/filesystem"
+	log "github.com/sirupsen/logrus"
+)
+
+// KMS bundle errors:
+var (
+	ErrMissingKMSKeyID           = errors.New("KMS key ID not specified")
+	ErrUnsupportedBundleKeyStore = errors.New("only keystore v1 with single key directory can be bundled")
+)
+
+// KMSBundleSubcommand is the "acra-keys kms-bundle" subcommand.
+type KMSBundleSubcommand struct {
+	CommonKeyStoreParameters
+	FlagSet *flag.FlagSet
+
+	kmsType     string
+	kmsKeyID    string
+	kmsEndpoint string
+	outputFile  string
+}
+
+// Name returns the same of this subcommand.
+func (p *KMSBundleSubcommand) Name() string {
+	return CmdKMSBundle
+}
+
+// GetFlagSet returns flag set of this subcommand.
+func (p *KMSBundleSubcommand) GetFlagSet() *flag.FlagSet {
+	return p.FlagSet
+}
+
+// RegisterFlags registers command-line flags of "acra-keys kms-bundle".
+func (p *KMSBundleSubcommand) RegisterFlags() {
+	p.FlagSet = flag.NewFlagSet(CmdKMSBundle, flag.ContinueOnError)
+	p.CommonKeyStoreParameters.Register(p.FlagSet)
+	p.FlagSet.StringVar(&p.kmsType, "kms", kms.TypeAWS, "KMS which wraps bundle key: aws or vault")
+	p.FlagSet.StringVar(&p.kmsKeyID, "kms_key_id", "", "AWS KMS key ID, ARN or alias, or Vault Transit key as <name> or <mount>/<name>")
+	p.FlagSet.StringVar(&p.kmsEndpoint, "kms_endpoint", "", "custom KMS endpoint, default is regional AWS KMS endpoint or VAULT_ADDR for Vault")
+	p.FlagSet.StringVar(&p.outputFile, "output", "", "path to output file for keystore bundle")
+	p.FlagSet.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Command \"%s\": pack keystore into KMS-wrapped bundle for in-memory keystore (\"keystore_bundle\" option of AcraServer and AcraTranslator)\n", CmdKMSBundle)
+		fmt.Fprintf(os.Stderr, "\n\t%s %s [options...] --kms_key_id <key> --output <file>\n", os.Args[0], CmdKMSBundle)
+		fmt.Fprintf(os.Stderr, "\nOptions:\n")
+		cmd.PrintFlags(p.FlagSet)
+	}
+}
+
+// Parse command-line parameters of the subcommand.
+func (p *KMSBundleSubcommand) Parse(arguments []string) error {
+	err := cmd.ParseFlagsWithConfig(p.FlagSet, arguments, DefaultConfigPath, ServiceName)
+	if err != nil {
+		return err
+	}
+	if p.outputFile == "" {
+		log.Errorf("\"--output\" option is required")
+		return ErrMissingOutputFile
+	}
+	if p.kmsKeyID == "" {
+		log.Errorf("\"--kms_key_id\" option is required")
+		return ErrMissingKMSKeyID
+	}
+	if p.KeyDirPublic() != p.KeyDir() || filesystemV2.IsKeyDirectory(p.KeyDir()) {
+		return ErrUnsupportedBundleKeyStore
+	}
+	return nil
+}
+
+// Execute this subcommand.
+func (p *KMSBundleSubcommand) Execute() {
+	wrapper, err := kms.NewKeyWrapperFromEnvironment(p.kmsType, p.kmsKeyID, p.kmsEndpoint)
+	if err != nil {
+		log.WithError(err).Fatal("Failed to initialize KMS client")
+	}
+	bundle, err := filesystem.CreateKeyBundle(&filesystem.DummyStorage{}, p.KeyDir(), wrapper)
+	if err != nil {
+		log.WithError(err).Fatal("Failed to create keystore bundle")
+	}
+	// Bundle is encrypted, but keep it private like other key files.
+	err = ioutil.WriteFile(p.outputFile, bundle, filesystem.PrivateFileMode)
+	if err != nil {
+		log.WithError(err).WithField("path", p.outputFile).Fatal("Failed to write keystore bundle")
+	}
+	log.Infof("Keystore bundle written to %s", p.outputFile)
+}
@@ -0,0 +1,135 @@
+/*
+ * Copyright 2020, Cossack Labs Limited
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package keys
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/cossacklabs/acra/cmd"
+	keystoreV1 "github.com/cossacklabs/acra/keystore"
+	"github.com/cossacklabs/acra/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrMissingKDFFile is returned when path to KDF parameters isn't specified
+var ErrMissingKDFFile = errors.New("KDF parameters file not specified")
+
+// MasterKeyKDFSubcommand is the "acra-keys master-key-kdf" subcommand.
+type MasterKeyKDFSubcommand struct {
+	FlagSet *flag.FlagSet
+
+	kdfFile   string
+	algorithm string
+	validate  bool
+}
+
+// Name returns the same of this subcommand.
+func (p *MasterKeyKDFSubcommand) Name() string {
+	return CmdMasterKeyKDF
+}
+
+// GetFlagSet returns flag set of this subcommand.
+func (p *MasterKeyKDFSubcommand) GetFlagSet() *flag.FlagSet {
+	return p.FlagSet
+}
+
+// RegisterFlags registers command-line flags of "acra-keys master-key-kdf".
+func (p *MasterKeyKDFSubcommand) RegisterFlags() {
+	p.FlagSet = flag.NewFlagSet(CmdMasterKeyKDF, flag.ContinueOnError)
+	p.FlagSet.StringVar(&p.kdfFile, "kdf_file", "", "path to file with salt and parameters of master key derivation, set it in "+keystoreV1.AcraMasterKeyVarName+keystoreV1.MasterKeyKDFFileVarSuffix+" for Acra services")
+	p.FlagSet.StringVar(&p.algorithm, "algorithm", keystoreV1.KDFAlgorithmArgon2id, "key derivation function for new parameters: "+strings.Join(keystoreV1.SupportedKDFAlgorithms, ", "))
+	p.FlagSet.BoolVar(&p.validate, "validate", false, "check that passphrase matches existing parameters instead of generating new ones")
+	p.FlagSet.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Command \"%s\": generate parameters to derive keystore v1 master key from passphrase in %s, or validate passphrase with them\n", CmdMasterKeyKDF, keystoreV1.AcraMasterKeyVarName)
+		fmt.Fprintf(os.Stderr, "\n\t%s %s [options...] --kdf_file <file>\n", os.Args[0], CmdMasterKeyKDF)
+		fmt.Fprintf(os.Stderr, "\nOptions:\n")
+		cmd.PrintFlags(p.FlagSet)
+	}
+}
+
+// Parse command-line parameters of the subcommand.
+func (p *MasterKeyKDFSubcommand) Parse(arguments []string) error {
+	err := cmd.ParseFlagsWithConfig(p.FlagSet, arguments, DefaultConfigPath, ServiceName)
+	if err != nil {
+		return err
+	}
+	if p.kdfFile == "" {
+		log.Errorf("\"--kdf_file\" option is required")
+		return ErrMissingKDFFile
+	}
+	if !p.validate {
+		if _, err := keystoreV1.NewMasterKeyKDFParameters(p.algorithm); err != nil {
+			log.Errorf("\"--algorithm\" must be one of: %s", strings.Join(keystoreV1.SupportedKDFAlgorithms, ", "))
+			return err
+		}
+	}
+	return nil
+}
+
+// Execute this subcommand.
+func (p *MasterKeyKDFSubcommand) Execute() {
+	passphrase := []byte(os.Getenv(keystoreV1.AcraMasterKeyVarName))
+	defer utils.ZeroizeBytes(passphrase)
+	if len(passphrase) == 0 {
+		log.Fatalf("Passphrase is not set in %s", keystoreV1.AcraMasterKeyVarName)
+	}
+	if p.validate {
+		if err := ValidateMasterKeyKDF(p.kdfFile, passphrase); err != nil {
+			log.WithError(err).Fatal("Failed to validate master key passphrase")
+		}
+		log.Infof("Passphrase matches master key KDF parameters in %s", p.kdfFile)
+		return
+	}
+	if err := GenerateMasterKeyKDF(p.kdfFile, p.algorithm, passphrase); err != nil {
+		log.WithError(err).Fatal("Failed to generate master key KDF parameters")
+	}
+	log.Infof("Master key KDF parameters written to %s", p.kdfFile)
+	log.Infof("Set %s=%s and keep passphrase in %s to use derived master key", keystoreV1.AcraMasterKeyVarName+keystoreV1.MasterKeyKDFFileVarSuffix, p.kdfFile, keystoreV1.AcraMasterKeyVarName)
+}
+
+// GenerateMasterKeyKDF writes new parameters of algorithm to derive master key from passphrase into kdfFile.
+func GenerateMasterKeyKDF(kdfFile, algorithm string, passphrase []byte) error {
+	params, err := keystoreV1.NewMasterKeyKDFParameters(algorithm)
+	if err != nil {
+		return err
+	}
+	key, err := params.Seal(passphrase)
+	if err != nil {
+		return err
+	}
+	utils.ZeroizeSymmetricKey(key)
+	return params.WriteFile(kdfFile)
+}
+
+// ValidateMasterKeyKDF checks that master key derived from passphrase with parameters of kdfFile matches their
+// check value.
+func ValidateMasterKeyKDF(kdfFile string, passphrase []byte) error {
+	params, err := keystoreV1.ReadMasterKeyKDFParameters(kdfFile)
+	if err != nil {
+		return err
+	}
+	key, err := params.DeriveMasterKey(passphrase)
+	if err != nil {
+		return err
+	}
+	utils.ZeroizeSymmetricKey(key)
+	return nil
+}
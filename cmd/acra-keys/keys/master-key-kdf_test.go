@@ -0,0 +1,59 @@
+/*
+ * Copyright 2020, Cossack Labs Limited
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package keys
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	keystoreV1 "github.com/cossacklabs/acra/keystore"
+)
+
+func TestMasterKeyKDF(t *testing.T) {
+	subcommand := &MasterKeyKDFSubcommand{}
+	subcommand.RegisterFlags()
+	if err := subcommand.Parse([]string{}); err != ErrMissingKDFFile {
+		t.Fatalf("Expected ErrMissingKDFFile, took %v", err)
+	}
+	subcommand = &MasterKeyKDFSubcommand{}
+	subcommand.RegisterFlags()
+	if err := subcommand.Parse([]string{"--kdf_file=kdf.json", "--algorithm=md5"}); err != keystoreV1.ErrUnknownKDFAlgorithm {
+		t.Fatalf("Expected ErrUnknownKDFAlgorithm, took %v", err)
+	}
+
+	dir, err := ioutil.TempDir("", "acra_keys_kdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	kdfFile := filepath.Join(dir, "kdf.json")
+	passphrase := []byte("correct horse battery staple")
+	if err := GenerateMasterKeyKDF(kdfFile, keystoreV1.KDFAlgorithmScrypt, passphrase); err != nil {
+		t.Fatal(err)
+	}
+	if err := GenerateMasterKeyKDF(kdfFile, keystoreV1.KDFAlgorithmScrypt, passphrase); err != keystoreV1.ErrMasterKeyKDFFileExists {
+		t.Fatalf("Expected ErrMasterKeyKDFFileExists, took %v", err)
+	}
+	if err := ValidateMasterKeyKDF(kdfFile, passphrase); err != nil {
+		t.Fatal(err)
+	}
+	if err := ValidateMasterKeyKDF(kdfFile, []byte("wrong horse battery staple")); err != keystoreV1.ErrWrongMasterKeyPassphrase {
+		t.Fatalf("Expected ErrWrongMasterKeyPassphrase, took %v", err)
+	}
+}
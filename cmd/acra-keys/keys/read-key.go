@@ -48,7 +48,9 @@ var (
 
 // ReadKeyParams are parameters of "acra-keys read" subcommand.
 type ReadKeyParams interface {
+	ListKeysParams
 	ReadKeyKind() string
+	KeyFormat() string
 	ClientID() []byte
 	ZoneID() []byte
 }
@@ -56,9 +58,11 @@ type ReadKeyParams interface {
 // ReadKeySubcommand is the "acra-keys read" subcommand.
 type ReadKeySubcommand struct {
 	CommonKeyStoreParameters
+	CommonKeyListingParameters
 	FlagSet *flag.FlagSet
 
 	public, private bool
+	keyFormat       string
 
 	readKeyKind string
 	contextID   []byte
@@ -78,8 +82,10 @@ func (p *ReadKeySubcommand) GetFlagSet() *flag.FlagSet {
 func (p *ReadKeySubcommand) RegisterFlags() {
 	p.FlagSet = flag.NewFlagSet(CmdReadKey, flag.ContinueOnError)
 	p.CommonKeyStoreParameters.Register(p.FlagSet)
+	p.CommonKeyListingParameters.Register(p.FlagSet)
 	p.FlagSet.BoolVar(&p.public, "public", false, "read public key of the keypair")
 	p.FlagSet.BoolVar(&p.private, "private", false, "read private key of the keypair")
+	p.FlagSet.StringVar(&p.keyFormat, "format", KeyFormatRaw, "format of key: raw (Themis), or pem, der, jwk, fingerprint (base64 SHA-256 of DER) for public keys")
 	p.FlagSet.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Command \"%s\": read and print key material in plaintext\n", CmdReadKey)
 		fmt.Fprintf(os.Stderr, "\n\t%s %s [options...] <key-ID>\n\n", os.Args[0], CmdReadKey)
@@ -149,7 +155,24 @@ func (p *ReadKeySubcommand) Parse(arguments []string) error {
 	default:
 		return ErrUnknownKeyKind
 	}
-	return nil
+	return p.validateKeyFormat()
+}
+
+func (p *ReadKeySubcommand) validateKeyFormat() error {
+	switch p.keyFormat {
+	case KeyFormatRaw:
+		return nil
+	case KeyFormatPEM, KeyFormatDER, KeyFormatJWK, KeyFormatFingerprint:
+		switch p.readKeyKind {
+		case KeyPoisonPublic, KeyStoragePublic, KeyZonePublic:
+			return nil
+		}
+		log.Warnf("Option --format=%s requires --public", p.keyFormat)
+		return ErrKeyFormatNotPublic
+	default:
+		log.WithField("expected", SupportedKeyFormats).Warnf("Unknown key format: %s", p.keyFormat)
+		return ErrUnknownKeyFormat
+	}
 }
 
 func (p *ReadKeySubcommand) validateKeyParts() error {
@@ -178,6 +201,11 @@ func (p *ReadKeySubcommand) ReadKeyKind() string {
 	return p.readKeyKind
 }
 
+// KeyFormat returns requested format of the key.
+func (p *ReadKeySubcommand) KeyFormat() string {
+	return p.keyFormat
+}
+
 // ClientID returns client ID of the requested key.
 func (p *ReadKeySubcommand) ClientID() []byte {
 	return p.contextID
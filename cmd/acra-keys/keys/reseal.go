@@ -0,0 +1,86 @@
+/*
+ * Copyright 2020, Cossack Labs Limited
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package keys
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/cossacklabs/acra/cmd"
+	keystoreV1 "github.com/cossacklabs/acra/keystore"
+	log "github.com/sirupsen/logrus"
+)
+
+// ResealKeysSubcommand is the "acra-keys reseal" subcommand.
+type ResealKeysSubcommand struct {
+	CommonKeyStoreParameters
+	FlagSet *flag.FlagSet
+}
+
+// Name returns the same of this subcommand.
+func (p *ResealKeysSubcommand) Name() string {
+	return CmdResealKeys
+}
+
+// GetFlagSet returns flag set of this subcommand.
+func (p *ResealKeysSubcommand) GetFlagSet() *flag.FlagSet {
+	return p.FlagSet
+}
+
+// RegisterFlags registers command-line flags of "acra-keys reseal".
+func (p *ResealKeysSubcommand) RegisterFlags() {
+	p.FlagSet = flag.NewFlagSet(CmdResealKeys, flag.ContinueOnError)
+	p.CommonKeyStoreParameters.Register(p.FlagSet)
+	p.FlagSet.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Command \"%s\": encrypt private keys of keystore v1 with the first master key of %s if they are encrypted with older ones\n", CmdResealKeys, keystoreV1.AcraMasterKeysVarName)
+		fmt.Fprintf(os.Stderr, "\n\t%s %s [options...]\n", os.Args[0], CmdResealKeys)
+		fmt.Fprintf(os.Stderr, "\nOptions:\n")
+		cmd.PrintFlags(p.FlagSet)
+	}
+}
+
+// Parse command-line parameters of the subcommand.
+func (p *ResealKeysSubcommand) Parse(arguments []string) error {
+	return cmd.ParseFlagsWithConfig(p.FlagSet, arguments, DefaultConfigPath, ServiceName)
+}
+
+// Execute this subcommand.
+func (p *ResealKeysSubcommand) Execute() {
+	if isKeyStoreV2(p) {
+		log.Fatalf("\"%s\" is supported only by keystore v1", CmdResealKeys)
+	}
+	// Redis storage encrypts all files with master key, public ones too, they aren't resealed
+	if cmd.IsKeystoreRedisEnabled() {
+		log.Fatalf("\"%s\" is not supported for Redis keystore", CmdResealKeys)
+	}
+	if !keystoreV1.IsMultiMasterKeyEnabled() {
+		log.Fatalf("Set master keys in %s, the new one first, to reseal keys", keystoreV1.AcraMasterKeysVarName)
+	}
+	keyStore, err := openKeyStoreV1(p)
+	if err != nil {
+		log.WithError(err).Fatal("Failed to open keystore")
+	}
+	result, err := keyStore.Reseal()
+	if result != nil {
+		log.WithFields(log.Fields{"total": result.Total, "resealed": result.Resealed}).Infoln("Keys resealed with the newest master key")
+	}
+	if err != nil {
+		log.WithError(err).Fatal("Failed to reseal keys")
+	}
+	log.Infof("All keys are encrypted with the first master key of %s, older master keys may be removed", keystoreV1.AcraMasterKeysVarName)
+}
@@ -0,0 +1,220 @@
+/*
+ * Copyright 2020, Cossack Labs Limited
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package keys
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/cossacklabs/acra/cmd"
+	"github.com/cossacklabs/acra/encryptor/config"
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrFormatPreservingKeyRotation is returned for rotation of storage key used by format-preserving encrypted columns
+var ErrFormatPreservingKeyRotation = errors.New("storage key is used by format-preserving encrypted columns")
+
+// SupportedRotateKeyKinds is a list of keys supported by `rotate` subcommand.
+var SupportedRotateKeyKinds = []string{
+	KeyStorageKeypair,
+	KeyZoneKeypair,
+	KeyTransportConnector,
+	KeyTransportServer,
+	KeyTransportTranslator,
+}
+
+// RotateKeyParams are parameters of "acra-keys rotate" subcommand.
+type RotateKeyParams interface {
+	ListKeysParams
+	RotateKeyKind() string
+	ID() []byte
+}
+
+// RotateKeySubcommand is the "acra-keys rotate" subcommand.
+type RotateKeySubcommand struct {
+	CommonKeyStoreParameters
+	CommonKeyListingParameters
+	FlagSet *flag.FlagSet
+
+	rotateKeyKind       string
+	contextID           []byte
+	encryptorConfigFile string
+}
+
+// Name returns the same of this subcommand.
+func (p *RotateKeySubcommand) Name() string {
+	return CmdRotateKey
+}
+
+// GetFlagSet returns flag set of this subcommand.
+func (p *RotateKeySubcommand) GetFlagSet() *flag.FlagSet {
+	return p.FlagSet
+}
+
+// RegisterFlags registers command-line flags of "acra-keys rotate".
+func (p *RotateKeySubcommand) RegisterFlags() {
+	p.FlagSet = flag.NewFlagSet(CmdRotateKey, flag.ContinueOnError)
+	p.CommonKeyStoreParameters.Register(p.FlagSet)
+	p.CommonKeyListingParameters.Register(p.FlagSet)
+	p.FlagSet.StringVar(&p.encryptorConfigFile, "encryptor_config_file", "", "Path to Encryptor configuration file of AcraServer, storage keys used by its format-preserving encrypted columns are not rotated")
+	p.FlagSet.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Command \"%s\": generate new key pair replacing current one, previous keys are kept for decryption\n", CmdRotateKey)
+		fmt.Fprintf(os.Stderr, "\n\t%s %s [options...] <key-ID>\n\n", os.Args[0], CmdRotateKey)
+		fmt.Fprintf(os.Stderr, "\nOptions:\n")
+		cmd.PrintFlags(p.FlagSet)
+	}
+}
+
+// Parse command-line parameters of the subcommand.
+func (p *RotateKeySubcommand) Parse(arguments []string) error {
+	err := cmd.ParseFlagsWithConfig(p.FlagSet, arguments, DefaultConfigPath, ServiceName)
+	if err != nil {
+		return err
+	}
+	args := p.FlagSet.Args()
+	if len(args) < 1 {
+		log.Errorf("\"%s\" command requires key kind", CmdRotateKey)
+		return ErrMissingKeyKind
+	}
+	if len(args) > 1 {
+		log.Errorf("\"%s\" command does not support more than one key kind", CmdRotateKey)
+		return ErrMultipleKeyKinds
+	}
+	coarseKind, id, err := ParseKeyKind(args[0])
+	if err != nil {
+		return err
+	}
+	switch coarseKind {
+	case KeyStorageKeypair, KeyZoneKeypair, KeyTransportConnector, KeyTransportServer, KeyTransportTranslator:
+		p.rotateKeyKind = coarseKind
+		p.contextID = id
+
+	default:
+		return ErrUnknownKeyKind
+	}
+	return p.checkFormatPreservingKey()
+}
+
+// checkFormatPreservingKey refuses rotation of storage keys used by format-preserving encrypted columns of encryptor
+// config
+func (p *RotateKeySubcommand) checkFormatPreservingKey() error {
+	switch p.rotateKeyKind {
+	case KeyStorageKeypair:
+		return CheckFormatPreservingKeys(p.encryptorConfigFile, p.contextID, nil)
+	case KeyZoneKeypair:
+		return CheckFormatPreservingKeys(p.encryptorConfigFile, nil, p.contextID)
+	}
+	return nil
+}
+
+// CheckFormatPreservingKeys returns ErrFormatPreservingKeyRotation if format-preserving encrypted columns of encryptor
+// config use storage key of client id or zone id. Their ciphertexts don't refer to the key, so they can be decrypted
+// only with the key they were encrypted with. Nothing is checked without encryptor config.
+func CheckFormatPreservingKeys(encryptorConfigFile string, clientID, zoneID []byte) error {
+	if encryptorConfigFile == "" {
+		return nil
+	}
+	configData, err := ioutil.ReadFile(encryptorConfigFile)
+	if err != nil {
+		log.WithError(err).Errorln("Can't read encryptor config")
+		return err
+	}
+	schemaStore, err := config.MapTableSchemaStoreFromConfig(configData)
+	if err != nil {
+		log.WithError(err).Errorln("Can't parse encryptor config")
+		return err
+	}
+	if schemaStore.UsesFormatPreservingKey(clientID, zoneID) {
+		log.WithFields(log.Fields{"client_id": string(clientID), "zone_id": string(zoneID)}).
+			Errorln("Storage key is used by format-preserving encrypted columns, their values can't be decrypted after rotation")
+		return ErrFormatPreservingKeyRotation
+	}
+	return nil
+}
+
+// Execute this subcommand.
+func (p *RotateKeySubcommand) Execute() {
+	keyStore, err := OpenKeyStoreForRotation(p)
+	if err != nil {
+		log.WithError(err).Fatal("Failed to open keystore")
+	}
+	RotateKeyCommand(p, keyStore)
+}
+
+// RotateKeyKind returns requested kind of the key to rotate.
+func (p *RotateKeySubcommand) RotateKeyKind() string {
+	return p.rotateKeyKind
+}
+
+// ID returns client or zone ID of the requested key.
+func (p *RotateKeySubcommand) ID() []byte {
+	return p.contextID
+}
+
+// RotateKey generates new key pair of the requested key and returns its public key for storage keys.
+func RotateKey(params RotateKeyParams, keyStore RotateKeyStore) ([]byte, error) {
+	kind := params.RotateKeyKind()
+	switch kind {
+	case KeyStorageKeypair:
+		if err := keyStore.GenerateDataEncryptionKeys(params.ID()); err != nil {
+			log.WithError(err).Error("Cannot rotate client storage key pair")
+			return nil, err
+		}
+		publicKey, err := keyStore.GetClientIDEncryptionPublicKey(params.ID())
+		if err != nil {
+			log.WithError(err).Error("Cannot read new client storage public key")
+			return nil, err
+		}
+		return publicKey.Value, nil
+
+	case KeyZoneKeypair:
+		publicKey, err := keyStore.RotateZoneKey(params.ID())
+		if err != nil {
+			log.WithError(err).Error("Cannot rotate zone storage key pair")
+			return nil, err
+		}
+		return publicKey, nil
+
+	case KeyTransportConnector:
+		if err := keyStore.GenerateConnectorKeys(params.ID()); err != nil {
+			log.WithError(err).Error("Cannot rotate AcraConnector transport key pair")
+			return nil, err
+		}
+		return nil, nil
+
+	case KeyTransportServer:
+		if err := keyStore.GenerateServerKeys(params.ID()); err != nil {
+			log.WithError(err).Error("Cannot rotate AcraServer transport key pair")
+			return nil, err
+		}
+		return nil, nil
+
+	case KeyTransportTranslator:
+		if err := keyStore.GenerateTranslatorKeys(params.ID()); err != nil {
+			log.WithError(err).Error("Cannot rotate AcraTranslator transport key pair")
+			return nil, err
+		}
+		return nil, nil
+
+	default:
+		log.WithField("expected", SupportedRotateKeyKinds).Errorf("Unknown key kind: %s", kind)
+		return nil, ErrUnknownKeyKind
+	}
+}
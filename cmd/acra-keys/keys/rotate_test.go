@@ -0,0 +1,165 @@
+/*
+ * Copyright 2020, Cossack Labs Limited
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package keys
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/cossacklabs/themis/gothemis/keys"
+)
+
+// rotatingKeyStore records rotated keys and returns public keys of their ids
+type rotatingKeyStore struct {
+	RotateKeyStore
+	rotated []string
+}
+
+func (store *rotatingKeyStore) GenerateDataEncryptionKeys(id []byte) error {
+	store.rotated = append(store.rotated, "storage/"+string(id))
+	return nil
+}
+
+func (store *rotatingKeyStore) GetClientIDEncryptionPublicKey(id []byte) (*keys.PublicKey, error) {
+	return &keys.PublicKey{Value: append([]byte("public "), id...)}, nil
+}
+
+func (store *rotatingKeyStore) RotateZoneKey(id []byte) ([]byte, error) {
+	store.rotated = append(store.rotated, "zone/"+string(id))
+	return append([]byte("zone public "), id...), nil
+}
+
+func (store *rotatingKeyStore) GenerateServerKeys(id []byte) error {
+	store.rotated = append(store.rotated, "server/"+string(id))
+	return nil
+}
+
+func TestRotateKey(t *testing.T) {
+	testcases := []struct {
+		keyID     string
+		rotated   string
+		publicKey []byte
+	}{
+		{"client/Alice/storage", "storage/Alice", []byte("public Alice")},
+		{"zone/Bob/storage", "zone/Bob", []byte("zone public Bob")},
+		{"client/Carol/transport/server", "server/Carol", nil},
+	}
+	for _, testcase := range testcases {
+		subcommand := &RotateKeySubcommand{}
+		subcommand.RegisterFlags()
+		if err := subcommand.Parse([]string{testcase.keyID}); err != nil {
+			t.Fatalf("[%s] %v", testcase.keyID, err)
+		}
+		keyStore := &rotatingKeyStore{}
+		publicKey, err := RotateKey(subcommand, keyStore)
+		if err != nil {
+			t.Fatalf("[%s] %v", testcase.keyID, err)
+		}
+		if len(keyStore.rotated) != 1 || keyStore.rotated[0] != testcase.rotated {
+			t.Fatalf("[%s] Expected rotation of %s, took %v", testcase.keyID, testcase.rotated, keyStore.rotated)
+		}
+		if !bytes.Equal(publicKey, testcase.publicKey) {
+			t.Fatalf("[%s] Unexpected public key %q", testcase.keyID, publicKey)
+		}
+	}
+
+	subcommand := &RotateKeySubcommand{}
+	subcommand.RegisterFlags()
+	if err := subcommand.Parse([]string{"poison-record"}); err != ErrUnknownKeyKind {
+		t.Fatalf("Expected ErrUnknownKeyKind for poison record keys, took %v", err)
+	}
+}
+
+func TestPrintKeyInfoJSON(t *testing.T) {
+	testcases := []struct {
+		info     *KeyInfo
+		expected string
+	}{
+		{NewKeyInfo(KeyStorageKeypair, []byte("Alice"), []byte("key")), `{"key_kind":"storage-keypair","client_id":"Alice","key":"a2V5"}`},
+		{NewKeyInfo(KeyZonePrivate, []byte("Bob"), nil), `{"key_kind":"zone-private","zone_id":"Bob"}`},
+		{NewKeyInfo(KeyPoisonPublic, nil, []byte("key")), `{"key_kind":"poison-public","key":"a2V5"}`},
+	}
+	for _, testcase := range testcases {
+		output := &bytes.Buffer{}
+		if err := PrintKeyInfoJSON(testcase.info, output); err != nil {
+			t.Fatal(err)
+		}
+		if output.String() != testcase.expected+"\n" {
+			t.Fatalf("Expected %s, took %s", testcase.expected, output.String())
+		}
+		var parsed KeyInfo
+		if err := json.Unmarshal(output.Bytes(), &parsed); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRotateFormatPreservingKey(t *testing.T) {
+	configFile, err := ioutil.TempFile("", "encryptor_config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(configFile.Name())
+	configStr := `
+schemas:
+  - table: users
+    encrypted:
+      - column: id
+        format_preserving: integer
+        client_id: Alice
+      - column: uid
+        format_preserving: uuid
+        zone_id: Bob
+      - column: email
+        client_id: Carol
+`
+	if _, err := configFile.WriteString(configStr); err != nil {
+		t.Fatal(err)
+	}
+	configFile.Close()
+	testcases := []struct {
+		keyID    string
+		expected error
+	}{
+		{"client/Alice/storage", ErrFormatPreservingKeyRotation},
+		{"zone/Bob/storage", ErrFormatPreservingKeyRotation},
+		// AcraStructs refer to the key, so keys of other columns are rotated
+		{"client/Carol/storage", nil},
+		{"zone/Dave/storage", nil},
+		{"client/Alice/transport/server", nil},
+	}
+	for _, testcase := range testcases {
+		subcommand := &RotateKeySubcommand{}
+		subcommand.RegisterFlags()
+		if err := subcommand.Parse([]string{"--encryptor_config_file=" + configFile.Name(), testcase.keyID}); err != testcase.expected {
+			t.Fatalf("[%s] Expected %v, took %v", testcase.keyID, testcase.expected, err)
+		}
+	}
+
+	// columns without client_id and zone_id use keys of any client id
+	if err := ioutil.WriteFile(configFile.Name(), []byte("schemas:\n  - table: users\n    encrypted:\n      - column: id\n        format_preserving: digits\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	subcommand := &RotateKeySubcommand{}
+	subcommand.RegisterFlags()
+	if err := subcommand.Parse([]string{"--encryptor_config_file=" + configFile.Name(), "client/Carol/storage"}); err != ErrFormatPreservingKeyRotation {
+		t.Fatalf("Expected ErrFormatPreservingKeyRotation, took %v", err)
+	}
+}
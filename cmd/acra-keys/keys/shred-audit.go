@@ -0,0 +1,124 @@
+/*
+ * Copyright 2020, Cossack Labs Limited
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package keys
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// ErrShredAuditLogTampered is returned when hash chain of shred audit log is broken.
+var ErrShredAuditLogTampered = errors.New("shred audit log is tampered")
+
+// ShredAuditEntry is a record of shred audit log.
+//
+// Entries form hash chain: Hash is SHA-256 of PrevHash and JSON of entry with empty Hash,
+// so modification or removal of any entry except the last one breaks the chain.
+type ShredAuditEntry struct {
+	Time            time.Time `json:"time"`
+	KeyKind         string    `json:"key_kind"`
+	ID              string    `json:"id"`
+	SamplesVerified int       `json:"samples_verified"`
+	Verified        bool      `json:"verified"`
+	PrevHash        string    `json:"prev_hash"`
+	Hash            string    `json:"hash"`
+}
+
+func (entry ShredAuditEntry) computeHash() (string, error) {
+	entry.Hash = ""
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.New()
+	hash.Write([]byte(entry.PrevHash))
+	hash.Write(data)
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// VerifyShredAuditLog checks hash chain of audit log and returns hash of the last entry.
+// Empty hash is returned for empty or missing log.
+func VerifyShredAuditLog(path string) (string, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	lastHash := ""
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var entry ShredAuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return "", fmt.Errorf("%w: line %d: %v", ErrShredAuditLogTampered, line, err)
+		}
+		hash, err := entry.computeHash()
+		if err != nil {
+			return "", err
+		}
+		if entry.PrevHash != lastHash || entry.Hash != hash {
+			return "", fmt.Errorf("%w: line %d", ErrShredAuditLogTampered, line)
+		}
+		lastHash = entry.Hash
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return lastHash, nil
+}
+
+// AppendShredAuditEntry verifies audit log and appends entry chained to the last one.
+func AppendShredAuditEntry(path string, entry ShredAuditEntry) error {
+	lastHash, err := VerifyShredAuditLog(path)
+	if err != nil {
+		return err
+	}
+	entry.PrevHash = lastHash
+	entry.Hash, err = entry.computeHash()
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,256 @@
+/*
+ * Copyright 2020, Cossack Labs Limited
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package keys
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/cossacklabs/acra/cmd"
+	"github.com/cossacklabs/acra/decryptor/base"
+	"github.com/cossacklabs/acra/keystore"
+	"github.com/cossacklabs/acra/utils"
+	"github.com/cossacklabs/themis/gothemis/keys"
+	log "github.com/sirupsen/logrus"
+)
+
+// SupportedShredKeyKinds is a list of keys supported by `shred` subcommand.
+var SupportedShredKeyKinds = []string{
+	KeyStorageKeypair,
+	KeyZoneKeypair,
+}
+
+// Shred errors:
+var (
+	ErrMissingAuditLog        = errors.New("shred audit log not specified")
+	ErrSampleNotDecryptable   = errors.New("sample can't be decrypted with keys which should be shredded")
+	ErrSampleDecryptableShred = errors.New("sample still can be decrypted after shredding")
+)
+
+// ShredKeysParams are parameters of "acra-keys shred" subcommand.
+type ShredKeysParams interface {
+	ShredKeyKind() string
+	ContextID() []byte
+	AuditLog() string
+	SampleFiles() []string
+}
+
+// ShredKeysSubcommand is the "acra-keys shred" subcommand.
+type ShredKeysSubcommand struct {
+	CommonKeyStoreParameters
+	FlagSet *flag.FlagSet
+
+	auditLog    string
+	samples     string
+	shredKind   string
+	contextID   []byte
+	sampleFiles []string
+}
+
+// Name returns the same of this subcommand.
+func (p *ShredKeysSubcommand) Name() string {
+	return CmdShredKeys
+}
+
+// GetFlagSet returns flag set of this subcommand.
+func (p *ShredKeysSubcommand) GetFlagSet() *flag.FlagSet {
+	return p.FlagSet
+}
+
+// RegisterFlags registers command-line flags of "acra-keys shred".
+func (p *ShredKeysSubcommand) RegisterFlags() {
+	p.FlagSet = flag.NewFlagSet(CmdShredKeys, flag.ContinueOnError)
+	p.CommonKeyStoreParameters.Register(p.FlagSet)
+	p.FlagSet.StringVar(&p.auditLog, "audit_log", "", "path to hash-chained audit log where shredding is recorded")
+	p.FlagSet.StringVar(&p.samples, "verify_samples", "", "comma-separated paths to files with sample AcraStructs, they should decrypt before and must not decrypt after shredding")
+	p.FlagSet.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Command \"%s\": destroy all current and rotated storage keys of client or zone, making its data unreadable\n", CmdShredKeys)
+		fmt.Fprintf(os.Stderr, "\n\t%s %s [options...] --audit_log <file> <key-ID>\n\n", os.Args[0], CmdShredKeys)
+		fmt.Fprintf(os.Stderr, "\nSupported key IDs:\n\tclient/<client-ID>/storage\n\tzone/<zone-ID>/storage\n")
+		fmt.Fprintf(os.Stderr, "\nOptions:\n")
+		cmd.PrintFlags(p.FlagSet)
+	}
+}
+
+// Parse command-line parameters of the subcommand.
+func (p *ShredKeysSubcommand) Parse(arguments []string) error {
+	err := cmd.ParseFlagsWithConfig(p.FlagSet, arguments, DefaultConfigPath, ServiceName)
+	if err != nil {
+		return err
+	}
+	args := p.FlagSet.Args()
+	if len(args) < 1 {
+		log.Errorf("\"%s\" command requires key kind", CmdShredKeys)
+		return ErrMissingKeyKind
+	}
+	if len(args) > 1 {
+		log.Errorf("\"%s\" command does not support more than one key kind", CmdShredKeys)
+		return ErrMultipleKeyKinds
+	}
+	if p.auditLog == "" {
+		log.Errorf("\"--audit_log\" option is required")
+		return ErrMissingAuditLog
+	}
+	coarseKind, id, err := ParseKeyKind(args[0])
+	if err != nil {
+		return err
+	}
+	switch coarseKind {
+	case KeyStorageKeypair, KeyZoneKeypair:
+		p.shredKind = coarseKind
+		p.contextID = id
+	default:
+		log.WithField("expected", SupportedShredKeyKinds).Errorf("Unknown key kind: %s", coarseKind)
+		return ErrUnknownKeyKind
+	}
+	p.sampleFiles = nil
+	for _, path := range strings.Split(p.samples, ",") {
+		if path = strings.TrimSpace(path); path != "" {
+			p.sampleFiles = append(p.sampleFiles, path)
+		}
+	}
+	return nil
+}
+
+// Execute this subcommand.
+func (p *ShredKeysSubcommand) Execute() {
+	ShredKeysCommand(p, p)
+}
+
+// ShredKeyKind returns requested kind of the keys to shred.
+func (p *ShredKeysSubcommand) ShredKeyKind() string {
+	return p.shredKind
+}
+
+// ContextID returns client ID or zone ID of the keys to shred.
+func (p *ShredKeysSubcommand) ContextID() []byte {
+	return p.contextID
+}
+
+// AuditLog returns path to shred audit log.
+func (p *ShredKeysSubcommand) AuditLog() string {
+	return p.auditLog
+}
+
+// SampleFiles returns paths to files with sample AcraStructs.
+func (p *ShredKeysSubcommand) SampleFiles() []string {
+	return p.sampleFiles
+}
+
+// ShredKeys destroys current and rotated storage keys of client or zone.
+func ShredKeys(params ShredKeysParams, keyStore keystore.StorageKeyDestruction) error {
+	switch params.ShredKeyKind() {
+	case KeyStorageKeypair:
+		return keyStore.DestroyDataEncryptionKeys(params.ContextID())
+	case KeyZoneKeypair:
+		return keyStore.DestroyZoneKeys(params.ContextID())
+	default:
+		return ErrUnknownKeyKind
+	}
+}
+
+// CountDecryptableSamples returns number of samples which can be decrypted with storage keys of client or zone.
+// Missing keys mean that no samples can be decrypted.
+func CountDecryptableSamples(params ShredKeysParams, keyStore keystore.PrivateKeyStore, samples [][]byte) int {
+	var zoneID []byte
+	var privateKeys []*keys.PrivateKey
+	var err error
+	switch params.ShredKeyKind() {
+	case KeyStorageKeypair:
+		privateKeys, err = keyStore.GetServerDecryptionPrivateKeys(params.ContextID())
+	case KeyZoneKeypair:
+		zoneID = params.ContextID()
+		privateKeys, err = keyStore.GetZonePrivateKeys(zoneID)
+	default:
+		return 0
+	}
+	defer utils.ZeroizePrivateKeys(privateKeys)
+	if err != nil {
+		log.WithError(err).Debug("Can't load storage keys")
+		return 0
+	}
+	decryptable := 0
+	for _, sample := range samples {
+		decrypted, err := base.DecryptRotatedAcrastruct(sample, privateKeys, zoneID)
+		if err == nil {
+			utils.ZeroizeSymmetricKey(decrypted)
+			decryptable++
+		}
+	}
+	return decryptable
+}
+
+// ShredKeysCommand implements the "shred" command.
+// Keys are destroyed only if all samples can be decrypted with them. After shredding samples are checked with
+// reopened keystore, then result is recorded in audit log.
+func ShredKeysCommand(params ShredKeysParams, keyStoreParams KeyStoreParameters) {
+	logger := log.WithFields(log.Fields{"kind": params.ShredKeyKind(), "id": string(params.ContextID())})
+	samples := make([][]byte, 0, len(params.SampleFiles()))
+	for _, path := range params.SampleFiles() {
+		sample, err := ioutil.ReadFile(path)
+		if err != nil {
+			logger.WithError(err).WithField("path", path).Fatal("Failed to read sample")
+		}
+		samples = append(samples, sample)
+	}
+	// Audit log is verified before keys are destroyed, so shredding is never left unrecorded because of broken log.
+	if _, err := VerifyShredAuditLog(params.AuditLog()); err != nil {
+		logger.WithError(err).Fatal("Failed to verify shred audit log")
+	}
+
+	readKeyStore, err := OpenKeyStoreForReading(keyStoreParams)
+	if err != nil {
+		logger.WithError(err).Fatal("Failed to open keystore")
+	}
+	if decryptable := CountDecryptableSamples(params, readKeyStore, samples); decryptable != len(samples) {
+		logger.WithError(ErrSampleNotDecryptable).Fatalf("Only %d of %d samples can be decrypted, keys aren't destroyed", decryptable, len(samples))
+	}
+
+	writeKeyStore, err := OpenKeyStoreForWriting(keyStoreParams)
+	if err != nil {
+		logger.WithError(err).Fatal("Failed to open keystore")
+	}
+	if err := ShredKeys(params, writeKeyStore); err != nil {
+		logger.WithError(err).Fatal("Failed to shred keys")
+	}
+
+	// Reopen keystore to verify keys on storage rather than cached ones.
+	readKeyStore, err = OpenKeyStoreForReading(keyStoreParams)
+	if err != nil {
+		logger.WithError(err).Fatal("Failed to open keystore")
+	}
+	decryptable := CountDecryptableSamples(params, readKeyStore, samples)
+	entry := ShredAuditEntry{
+		Time:            time.Now().UTC(),
+		KeyKind:         params.ShredKeyKind(),
+		ID:              string(params.ContextID()),
+		SamplesVerified: len(samples),
+		Verified:        decryptable == 0,
+	}
+	if err := AppendShredAuditEntry(params.AuditLog(), entry); err != nil {
+		logger.WithError(err).Fatal("Failed to write shred audit log")
+	}
+	if decryptable != 0 {
+		logger.WithError(ErrSampleDecryptableShred).Fatalf("%d of %d samples still can be decrypted", decryptable, len(samples))
+	}
+	logger.Infof("Keys are shredded, %d samples can't be decrypted anymore", len(samples))
+}
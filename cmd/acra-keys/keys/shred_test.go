@@ -0,0 +1,148 @@
+/*
+ * Copyright 2020, Cossack Labs Limited
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package keys
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	acrawriter "github.com/cossacklabs/acra/acra-writer"
+	keystoreV1 "github.com/cossacklabs/acra/keystore"
+	filesystemV1 "github.com/cossacklabs/acra/keystore/filesystem"
+)
+
+type testShredParams struct {
+	kind string
+	id   []byte
+}
+
+func (p *testShredParams) ShredKeyKind() string  { return p.kind }
+func (p *testShredParams) ContextID() []byte     { return p.id }
+func (p *testShredParams) AuditLog() string      { return "" }
+func (p *testShredParams) SampleFiles() []string { return nil }
+
+func TestShredAuditLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shred_audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	for _, id := range []string{"client1", "client2"} {
+		entry := ShredAuditEntry{Time: time.Now().UTC(), KeyKind: KeyStorageKeypair, ID: id, Verified: true}
+		if err := AppendShredAuditEntry(path, entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lastHash, err := VerifyShredAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastHash == "" {
+		t.Fatal("Expected hash of the last entry")
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := strings.Replace(string(data), "client1", "client3", 1)
+	if err := ioutil.WriteFile(path, []byte(tampered), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := VerifyShredAuditLog(path); !errors.Is(err, ErrShredAuditLogTampered) {
+		t.Fatalf("Expected ErrShredAuditLogTampered, took %v", err)
+	}
+	if err := AppendShredAuditEntry(path, ShredAuditEntry{ID: "client4"}); !errors.Is(err, ErrShredAuditLogTampered) {
+		t.Fatalf("Expected ErrShredAuditLogTampered on append, took %v", err)
+	}
+}
+
+func TestShredKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shred_keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	encryptor, err := keystoreV1.NewSCellKeyEncryptor([]byte("some key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	openKeyStore := func() *filesystemV1.KeyStore {
+		keyStore, err := filesystemV1.NewFilesystemKeyStore(dir, encryptor)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return keyStore
+	}
+	keyStore := openKeyStore()
+	clientID := []byte("client")
+	otherClientID := []byte("other client")
+	params := &testShredParams{kind: KeyStorageKeypair, id: clientID}
+	otherParams := &testShredParams{kind: KeyStorageKeypair, id: otherClientID}
+
+	// samples encrypted with current and rotated keys
+	var samples, otherSamples [][]byte
+	for i := 0; i < 2; i++ {
+		for _, id := range [][]byte{clientID, otherClientID} {
+			if err := keyStore.GenerateDataEncryptionKeys(id); err != nil {
+				t.Fatal(err)
+			}
+			publicKey, err := keyStore.GetClientIDEncryptionPublicKey(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sample, err := acrawriter.CreateAcrastruct([]byte("data"), publicKey, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(id) == string(clientID) {
+				samples = append(samples, sample)
+			} else {
+				otherSamples = append(otherSamples, sample)
+			}
+		}
+	}
+	if count := CountDecryptableSamples(params, keyStore, samples); count != len(samples) {
+		t.Fatalf("Expected %d decryptable samples before shredding, took %d", len(samples), count)
+	}
+
+	if err := ShredKeys(params, keyStore); err != nil {
+		t.Fatal(err)
+	}
+	// cached keys are purged too
+	if count := CountDecryptableSamples(params, keyStore, samples); count != 0 {
+		t.Fatalf("Expected no decryptable samples after shredding, took %d", count)
+	}
+	keyStore = openKeyStore()
+	if count := CountDecryptableSamples(params, keyStore, samples); count != 0 {
+		t.Fatalf("Expected no decryptable samples after reopening keystore, took %d", count)
+	}
+	if count := CountDecryptableSamples(otherParams, keyStore, otherSamples); count != len(otherSamples) {
+		t.Fatalf("Keys of other client should stay untouched, decrypted %d samples", count)
+	}
+	// shredding is idempotent
+	if err := ShredKeys(params, keyStore); err != nil {
+		t.Fatal(err)
+	}
+}
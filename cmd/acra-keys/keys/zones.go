@@ -0,0 +1,198 @@
+/*
+ * Copyright 2020, Cossack Labs Limited
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package keys
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/cossacklabs/acra/cmd"
+	"github.com/cossacklabs/acra/keystore"
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrMultipleZoneIDs returned when "revoke-zone" gets more than one zone ID
+var ErrMultipleZoneIDs = errors.New("multiple zone IDs")
+
+// ListZonesSubcommand is the "acra-keys list-zones" subcommand.
+type ListZonesSubcommand struct {
+	CommonKeyStoreParameters
+	CommonKeyListingParameters
+	FlagSet *flag.FlagSet
+}
+
+// Name returns the same of this subcommand.
+func (p *ListZonesSubcommand) Name() string {
+	return CmdListZones
+}
+
+// GetFlagSet returns flag set of this subcommand.
+func (p *ListZonesSubcommand) GetFlagSet() *flag.FlagSet {
+	return p.FlagSet
+}
+
+// RegisterFlags registers command-line flags of "acra-keys list-zones".
+func (p *ListZonesSubcommand) RegisterFlags() {
+	p.FlagSet = flag.NewFlagSet(CmdListZones, flag.ContinueOnError)
+	p.CommonKeyStoreParameters.Register(p.FlagSet)
+	p.CommonKeyListingParameters.Register(p.FlagSet)
+	p.FlagSet.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Command \"%s\": list zones of keystore v1 and their revocation status\n", CmdListZones)
+		fmt.Fprintf(os.Stderr, "\n\t%s %s [options...]\n", os.Args[0], CmdListZones)
+		fmt.Fprintf(os.Stderr, "\nOptions:\n")
+		cmd.PrintFlags(p.FlagSet)
+	}
+}
+
+// Parse command-line parameters of the subcommand.
+func (p *ListZonesSubcommand) Parse(arguments []string) error {
+	return cmd.ParseFlagsWithConfig(p.FlagSet, arguments, DefaultConfigPath, ServiceName)
+}
+
+// Execute this subcommand.
+func (p *ListZonesSubcommand) Execute() {
+	keyStore, err := OpenKeyStoreForZoneManagement(p)
+	if err != nil {
+		log.WithError(err).Fatal("Failed to open keystore")
+	}
+	zones, err := keyStore.ListZones()
+	if err != nil {
+		log.WithError(err).Fatal("Failed to read zone list")
+	}
+	if err := PrintZones(zones, os.Stdout, p); err != nil {
+		log.WithError(err).Fatal("Failed to print zone list")
+	}
+}
+
+// PrintZones prints zone list prettily into the given writer.
+func PrintZones(zones []keystore.ZoneDescription, writer io.Writer, params ListKeysParams) error {
+	if params.UseJSON() {
+		data, err := json.Marshal(zones)
+		if err != nil {
+			return err
+		}
+		_, err = writer.Write(append(data, '\n'))
+		return err
+	}
+	maxZoneIDLen := len(zoneIDHeader)
+	maxStatusLen := len(zoneStatusHeader)
+	statuses := make([]string, len(zones))
+	for i, zone := range zones {
+		statuses[i] = zoneStatusActive
+		if zone.Revoked {
+			statuses[i] = zoneStatusRevoked
+			if zone.RevokedAt != nil {
+				statuses[i] += " at " + zone.RevokedAt.Format(time.RFC3339)
+			}
+		}
+		if len(zone.ZoneID) > maxZoneIDLen {
+			maxZoneIDLen = len(zone.ZoneID)
+		}
+		if len(statuses[i]) > maxStatusLen {
+			maxStatusLen = len(statuses[i])
+		}
+	}
+	fmt.Fprintf(writer, "%-*s | %s\n", maxZoneIDLen, zoneIDHeader, zoneStatusHeader)
+	separator := make([]byte, maxZoneIDLen+maxStatusLen+3)
+	for i := range separator {
+		separator[i] = '-'
+	}
+	separator[maxZoneIDLen+1] = byte('+')
+	fmt.Fprintln(writer, string(separator))
+	for i, zone := range zones {
+		fmt.Fprintf(writer, "%-*s | %s\n", maxZoneIDLen, zone.ZoneID, statuses[i])
+	}
+	return nil
+}
+
+const (
+	zoneIDHeader      = "Zone ID"
+	zoneStatusHeader  = "Status"
+	zoneStatusActive  = "active"
+	zoneStatusRevoked = "revoked"
+)
+
+// RevokeZoneSubcommand is the "acra-keys revoke-zone" subcommand.
+type RevokeZoneSubcommand struct {
+	CommonKeyStoreParameters
+	FlagSet *flag.FlagSet
+
+	zoneID []byte
+}
+
+// Name returns the same of this subcommand.
+func (p *RevokeZoneSubcommand) Name() string {
+	return CmdRevokeZone
+}
+
+// GetFlagSet returns flag set of this subcommand.
+func (p *RevokeZoneSubcommand) GetFlagSet() *flag.FlagSet {
+	return p.FlagSet
+}
+
+// RegisterFlags registers command-line flags of "acra-keys revoke-zone".
+func (p *RevokeZoneSubcommand) RegisterFlags() {
+	p.FlagSet = flag.NewFlagSet(CmdRevokeZone, flag.ContinueOnError)
+	p.CommonKeyStoreParameters.Register(p.FlagSet)
+	p.FlagSet.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Command \"%s\": mark zone of keystore v1 as revoked, so its keys are refused for encryption, decryption and rotation\n", CmdRevokeZone)
+		fmt.Fprintf(os.Stderr, "\n\t%s %s [options...] <zone-ID>\n", os.Args[0], CmdRevokeZone)
+		fmt.Fprintf(os.Stderr, "\nOptions:\n")
+		cmd.PrintFlags(p.FlagSet)
+	}
+}
+
+// Parse command-line parameters of the subcommand.
+func (p *RevokeZoneSubcommand) Parse(arguments []string) error {
+	err := cmd.ParseFlagsWithConfig(p.FlagSet, arguments, DefaultConfigPath, ServiceName)
+	if err != nil {
+		return err
+	}
+	args := p.FlagSet.Args()
+	if len(args) < 1 {
+		log.Errorf("\"%s\" command requires zone ID", CmdRevokeZone)
+		return ErrMissingZoneID
+	}
+	if len(args) > 1 {
+		log.Errorf("\"%s\" command does not support more than one zone ID", CmdRevokeZone)
+		return ErrMultipleZoneIDs
+	}
+	p.zoneID = []byte(args[0])
+	return nil
+}
+
+// ZoneID returns ID of zone to revoke.
+func (p *RevokeZoneSubcommand) ZoneID() []byte {
+	return p.zoneID
+}
+
+// Execute this subcommand.
+func (p *RevokeZoneSubcommand) Execute() {
+	keyStore, err := OpenKeyStoreForZoneManagement(p)
+	if err != nil {
+		log.WithError(err).Fatal("Failed to open keystore")
+	}
+	if err := keyStore.RevokeZone(p.zoneID); err != nil {
+		log.WithError(err).Fatal("Failed to revoke zone")
+	}
+	log.Infof("Zone %s is revoked, services which cache decrypted keys refuse its keys after expiration of the cache or restart", p.zoneID)
+}
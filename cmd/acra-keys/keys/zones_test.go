@@ -0,0 +1,66 @@
+/*
+ * Copyright 2020, Cossack Labs Limited
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package keys
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cossacklabs/acra/keystore"
+)
+
+func TestPrintZones(t *testing.T) {
+	revokedAt := time.Date(2020, 12, 1, 10, 0, 0, 0, time.UTC)
+	zones := []keystore.ZoneDescription{
+		{ZoneID: []byte("DDDDDDDDHCzqZAZNbBvybWLR")},
+		{ZoneID: []byte("DDDDDDDDMatNOMYjqVOuhACC"), Revoked: true, RevokedAt: &revokedAt},
+	}
+	output := strings.Builder{}
+	if err := PrintZones(zones, &output, &CommonKeyListingParameters{useJSON: false}); err != nil {
+		t.Fatal(err)
+	}
+	expected := `Zone ID                  | Status
+-------------------------+--------------------------------
+DDDDDDDDHCzqZAZNbBvybWLR | active
+DDDDDDDDMatNOMYjqVOuhACC | revoked at 2020-12-01T10:00:00Z
+`
+	if output.String() != expected {
+		t.Errorf("Incorrect output.\nActual:\n%s\nExpected:\n%s", output.String(), expected)
+	}
+}
+
+func TestRevokeZoneRequiresOneZoneID(t *testing.T) {
+	subcommand := &RevokeZoneSubcommand{}
+	subcommand.RegisterFlags()
+	if err := subcommand.Parse([]string{}); err != ErrMissingZoneID {
+		t.Fatalf("Expected ErrMissingZoneID, took %v", err)
+	}
+	subcommand = &RevokeZoneSubcommand{}
+	subcommand.RegisterFlags()
+	if err := subcommand.Parse([]string{"zone1", "zone2"}); err != ErrMultipleZoneIDs {
+		t.Fatalf("Expected ErrMultipleZoneIDs, took %v", err)
+	}
+	subcommand = &RevokeZoneSubcommand{}
+	subcommand.RegisterFlags()
+	if err := subcommand.Parse([]string{"DDDDDDDDMatNOMYjqVOuhACC"}); err != nil {
+		t.Fatal(err)
+	}
+	if string(subcommand.ZoneID()) != "DDDDDDDDMatNOMYjqVOuhACC" {
+		t.Fatalf("Unexpected zone ID %s", subcommand.ZoneID())
+	}
+}
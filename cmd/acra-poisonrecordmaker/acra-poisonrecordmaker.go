@@ -26,8 +26,10 @@ package main
 
 import (
 	"encoding/base64"
+	"encoding/hex"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"os"
 
 	"github.com/cossacklabs/acra/cmd"
@@ -48,9 +50,39 @@ var (
 	serviceName       = "acra-poisonrecordmaker"
 )
 
+// Supported values of --output_encoding
+const (
+	outputEncodingBase64 = "base64"
+	outputEncodingHex    = "hex"
+	outputEncodingBinary = "binary"
+)
+
+// encodeRecord returns poison record encoded for output, text encodings end with newline unless noNewline is set
+func encodeRecord(record []byte, encoding string, noNewline bool) ([]byte, error) {
+	var output []byte
+	switch encoding {
+	case outputEncodingBase64:
+		output = []byte(base64.StdEncoding.EncodeToString(record))
+	case outputEncodingHex:
+		output = []byte(hex.EncodeToString(record))
+	case outputEncodingBinary:
+		return record, nil
+	default:
+		return nil, fmt.Errorf("unknown output encoding '%s', expected %s, %s or %s", encoding, outputEncodingBase64, outputEncodingHex, outputEncodingBinary)
+	}
+	if !noNewline {
+		output = append(output, '\n')
+	}
+	return output, nil
+}
+
 func main() {
 	keysDir := flag.String("keys_dir", keystore.DefaultKeyDirShort, "Folder from which will be loaded keys")
 	dataLength := flag.Int("data_length", poison.UseDefaultDataLength, fmt.Sprintf("Length of random data for data block in acrastruct. -1 is random in range 1..%v", poison.DefaultDataLength))
+	outputEncoding := flag.String("output_encoding", outputEncodingBase64, fmt.Sprintf("Encoding of poison record: <%s|%s|%s>", outputEncodingBase64, outputEncodingHex, outputEncodingBinary))
+	outputFile := flag.String("output_file", "", "Write poison record into file (created with 0600 permissions) instead of stdout")
+	quiet := flag.Bool("quiet", false, "Print nothing but the record: no trailing newline and no error messages, failures are reported by exit code only")
+	cmd.RegisterRandomSourceCmdParameters()
 
 	logging.SetLogLevel(logging.LogDiscard)
 
@@ -60,6 +92,19 @@ func main() {
 			Errorln("can't parse args")
 		os.Exit(1)
 	}
+	if *quiet {
+		log.SetOutput(ioutil.Discard)
+	}
+	if _, err := encodeRecord(nil, *outputEncoding, *quiet); err != nil {
+		log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+			Errorln("Invalid --output_encoding")
+		os.Exit(1)
+	}
+	if err := cmd.InitRandomSource(); err != nil {
+		log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorRandomSource).
+			Errorln("Can't initialize random source")
+		os.Exit(1)
+	}
 
 	var store keystore.PoisonKeyStore
 	if filesystemV2.IsKeyDirectory(*keysDir) {
@@ -73,20 +118,33 @@ func main() {
 		log.WithError(err).Errorln("can't create poison record")
 		os.Exit(1)
 	}
-	fmt.Println(base64.StdEncoding.EncodeToString(poisonRecord))
+	output, err := encodeRecord(poisonRecord, *outputEncoding, *quiet)
+	if err != nil {
+		log.WithError(err).Errorln("can't encode poison record")
+		os.Exit(1)
+	}
+	if *outputFile != "" {
+		if err := ioutil.WriteFile(*outputFile, output, 0600); err != nil {
+			log.WithError(err).WithField("path", *outputFile).Errorln("can't write poison record")
+			os.Exit(1)
+		}
+		if !*quiet {
+			fmt.Fprintf(os.Stderr, "Poison record was written to %s\n", *outputFile)
+		}
+		return
+	}
+	if _, err := os.Stdout.Write(output); err != nil {
+		log.WithError(err).Errorln("can't write poison record to stdout")
+		os.Exit(1)
+	}
 }
 
 func openKeyStoreV1(keysDir string) keystore.PoisonKeyStore {
-	masterKey, err := keystore.GetMasterKeyFromEnvironment()
+	scellEncryptor, err := keystore.EnvironmentMasterKeyProvider{}.KeyEncryptor()
 	if err != nil {
 		log.WithError(err).Errorln("Cannot load master key")
 		os.Exit(1)
 	}
-	scellEncryptor, err := keystore.NewSCellKeyEncryptor(masterKey)
-	if err != nil {
-		log.WithError(err).Errorln("can't init scell encryptor")
-		os.Exit(1)
-	}
 	store, err := filesystem.NewFilesystemKeyStore(keysDir, scellEncryptor)
 	if err != nil {
 		log.WithError(err).Errorln("can't initialize keystore")
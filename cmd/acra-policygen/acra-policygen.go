@@ -0,0 +1,150 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package main is entry point for AcraPolicyGen utility. AcraPolicyGen connects to database, reads its schema and
+// generates starter encryptor config for AcraServer and AcraCensor allowlist skeleton. Columns to encrypt are
+// selected by annotations file, interactively or by column name pattern.
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"os"
+
+	"github.com/cossacklabs/acra/cmd"
+	"github.com/cossacklabs/acra/logging"
+	"github.com/cossacklabs/acra/utils"
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+)
+
+// Constants used by AcraPolicyGen
+var (
+	// defaultConfigPath relative path to config which will be parsed as default
+	defaultConfigPath = utils.GetConfigPathByName("acra-policygen")
+	serviceName       = "acra-policygen"
+)
+
+// writePolicyFile writes config with header to file at path
+func writePolicyFile(path, header string, config interface{}) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := WritePolicy(file, header, config); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func main() {
+	connectionString := flag.String("connection_string", "", "Connection string for db")
+	useMysql := flag.Bool("mysql_enable", false, "Handle MySQL connections")
+	usePostgresql := flag.Bool("postgresql_enable", false, "Handle Postgresql connections")
+	dbSchema := flag.String("db_schema", "public", "PostgreSQL schema to introspect (MySQL uses database from connection string)")
+	annotationsFile := flag.String("annotations_file", "", "Path to YAML file with list of columns to encrypt. If empty, columns are selected by --sensitive_columns_pattern")
+	interactive := flag.Bool("interactive", false, "Ask about every column whether it should be encrypted")
+	clientID := flag.String("client_id", "", "Client ID used for encrypted columns selected by pattern or interactively. If empty, client ID of connection is used")
+	sensitivePattern := flag.String("sensitive_columns_pattern", DefaultSensitiveColumnsPattern, "Regular expression for names of columns which should be encrypted")
+	encryptorConfigOutput := flag.String("encryptor_config_output", "encryptor_config.yaml", "Path to output file for generated encryptor config")
+	censorConfigOutput := flag.String("censor_config_output", "acra-censor.yaml", "Path to output file for generated AcraCensor config")
+
+	logging.SetLogLevel(logging.LogVerbose)
+
+	err := cmd.Parse(defaultConfigPath, serviceName)
+	if err != nil {
+		log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCantReadServiceConfig).
+			Errorln("Can't parse args")
+		os.Exit(1)
+	}
+
+	twoDrivers := *useMysql && *usePostgresql
+	noDrivers := !(*useMysql || *usePostgresql)
+	if twoDrivers || noDrivers {
+		log.Errorln("You must pass only --mysql_enable or --postgresql_enable (one required)")
+		os.Exit(1)
+	}
+	if *connectionString == "" {
+		log.Errorln("Connection_string arg is missing")
+		os.Exit(1)
+	}
+	if *clientID != "" {
+		cmd.ValidateClientID(*clientID)
+	}
+
+	var selector ColumnSelector
+	if *annotationsFile != "" {
+		annotations, err := LoadAnnotations(*annotationsFile)
+		if err != nil {
+			log.WithError(err).Errorln("Can't load annotations file")
+			os.Exit(1)
+		}
+		selector = NewAnnotationsSelector(annotations)
+	} else {
+		selector, err = NewPatternSelector(*sensitivePattern, *clientID)
+		if err != nil {
+			log.WithError(err).Errorln("Invalid sensitive_columns_pattern")
+			os.Exit(1)
+		}
+	}
+	if *interactive {
+		selector = NewInteractiveSelector(os.Stdin, os.Stdout, selector, *clientID)
+	}
+
+	dbDriverName := "postgres"
+	if *useMysql {
+		dbDriverName = "mysql"
+	}
+	db, err := sql.Open(dbDriverName, *connectionString)
+	if err != nil {
+		log.WithError(err).Errorln("Can't connect to db")
+		os.Exit(1)
+	}
+	defer db.Close()
+	if err = db.Ping(); err != nil {
+		log.WithError(err).Errorln("Can't connect to db")
+		os.Exit(1)
+	}
+
+	var tables []Table
+	if *useMysql {
+		tables, err = ReadMySQLSchema(db)
+	} else {
+		tables, err = ReadPostgreSQLSchema(db, *dbSchema)
+	}
+	if err != nil {
+		log.WithError(err).Errorln("Can't read database schema")
+		os.Exit(1)
+	}
+	if len(tables) == 0 {
+		log.Errorln("Database schema doesn't contain any tables")
+		os.Exit(1)
+	}
+	log.Infof("Found %d tables", len(tables))
+
+	if err := writePolicyFile(*encryptorConfigOutput, encryptorConfigHeader, GenerateEncryptorConfig(tables, selector)); err != nil {
+		log.WithError(err).Errorln("Can't write encryptor config")
+		os.Exit(1)
+	}
+	log.Infof("Encryptor config saved to %s", *encryptorConfigOutput)
+	if err := writePolicyFile(*censorConfigOutput, censorConfigHeader, GenerateCensorConfig(tables)); err != nil {
+		log.WithError(err).Errorln("Can't write AcraCensor config")
+		os.Exit(1)
+	}
+	log.Infof("AcraCensor config saved to %s", *censorConfigOutput)
+}
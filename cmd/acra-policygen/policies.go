@@ -0,0 +1,251 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strings"
+
+	acracensor "github.com/cossacklabs/acra/acra-censor"
+	"github.com/cossacklabs/acra/utils"
+	"gopkg.in/yaml.v2"
+)
+
+// DefaultSensitiveColumnsPattern matches names of columns which usually store sensitive data
+const DefaultSensitiveColumnsPattern = `(?i)(email|phone|ssn|passport|card|secret|password|token|address|birth|salary|iban)`
+
+// ColumnAnnotation marks column which should be encrypted and keys to use
+type ColumnAnnotation struct {
+	Table    string `yaml:"table"`
+	Column   string `yaml:"column"`
+	ClientID string `yaml:"client_id,omitempty"`
+	ZoneID   string `yaml:"zone_id,omitempty"`
+}
+
+// Annotations lists columns which should be encrypted
+type Annotations struct {
+	Encrypt []ColumnAnnotation `yaml:"encrypt"`
+}
+
+// LoadAnnotations reads Annotations from YAML file
+func LoadAnnotations(path string) (*Annotations, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	annotations := &Annotations{}
+	if err := yaml.Unmarshal(data, annotations); err != nil {
+		return nil, err
+	}
+	return annotations, nil
+}
+
+// ColumnSelector decides whether column should be encrypted, returns settings for encrypted column or nil
+type ColumnSelector interface {
+	Select(table Table, column Column) *ColumnAnnotation
+}
+
+// annotationsSelector selects columns listed in annotations file
+type annotationsSelector struct {
+	columns map[string]ColumnAnnotation
+}
+
+// NewAnnotationsSelector returns ColumnSelector which selects only columns from annotations
+func NewAnnotationsSelector(annotations *Annotations) ColumnSelector {
+	columns := make(map[string]ColumnAnnotation, len(annotations.Encrypt))
+	for _, annotation := range annotations.Encrypt {
+		columns[annotation.Table+"."+annotation.Column] = annotation
+	}
+	return &annotationsSelector{columns}
+}
+
+// Select column listed in annotations
+func (selector *annotationsSelector) Select(table Table, column Column) *ColumnAnnotation {
+	if annotation, ok := selector.columns[table.Name+"."+column.Name]; ok {
+		return &annotation
+	}
+	return nil
+}
+
+// patternSelector selects columns which names match regexp
+type patternSelector struct {
+	pattern  *regexp.Regexp
+	clientID string
+}
+
+// NewPatternSelector returns ColumnSelector which selects columns with names matching pattern
+// and encrypts them with clientID
+func NewPatternSelector(pattern, clientID string) (ColumnSelector, error) {
+	compiled, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	return &patternSelector{pattern: compiled, clientID: clientID}, nil
+}
+
+// Select column with name matching pattern
+func (selector *patternSelector) Select(table Table, column Column) *ColumnAnnotation {
+	if selector.pattern.MatchString(column.Name) {
+		return &ColumnAnnotation{Table: table.Name, Column: column.Name, ClientID: selector.clientID}
+	}
+	return nil
+}
+
+// interactiveSelector asks user about every column, suggestions of another selector are used as default answers
+type interactiveSelector struct {
+	input    *bufio.Reader
+	output   io.Writer
+	suggest  ColumnSelector
+	clientID string
+}
+
+// NewInteractiveSelector returns ColumnSelector which asks user about every column
+func NewInteractiveSelector(input io.Reader, output io.Writer, suggest ColumnSelector, clientID string) ColumnSelector {
+	return &interactiveSelector{input: bufio.NewReader(input), output: output, suggest: suggest, clientID: clientID}
+}
+
+// ask prints question and returns trimmed answer or defaultAnswer if answer is empty
+func (selector *interactiveSelector) ask(question, defaultAnswer string) string {
+	fmt.Fprintf(selector.output, "%s [%s]: ", question, defaultAnswer)
+	answer, _ := selector.input.ReadString('\n')
+	answer = strings.TrimSpace(answer)
+	if answer == "" {
+		return defaultAnswer
+	}
+	return answer
+}
+
+// Select column if user confirms it
+func (selector *interactiveSelector) Select(table Table, column Column) *ColumnAnnotation {
+	suggestion := selector.suggest.Select(table, column)
+	defaultAnswer := "n"
+	if suggestion != nil {
+		defaultAnswer = "y"
+	}
+	answer := selector.ask(fmt.Sprintf("Encrypt column %s.%s (%s)? y/n", table.Name, column.Name, column.DataType), defaultAnswer)
+	if !strings.EqualFold(answer, "y") && !strings.EqualFold(answer, "yes") {
+		return nil
+	}
+	clientID := selector.clientID
+	if suggestion != nil && suggestion.ClientID != "" {
+		clientID = suggestion.ClientID
+	}
+	annotation := &ColumnAnnotation{Table: table.Name, Column: column.Name}
+	annotation.ZoneID = selector.ask("Zone ID (empty to use client ID)", "")
+	if annotation.ZoneID == "" {
+		annotation.ClientID = selector.ask("Client ID (empty to use client ID from connection)", clientID)
+	}
+	return annotation
+}
+
+// encryptorColumnConfig mirrors column settings format of encryptor config (see encryptor/config)
+type encryptorColumnConfig struct {
+	Column   string `yaml:"column"`
+	ClientID string `yaml:"client_id,omitempty"`
+	ZoneID   string `yaml:"zone_id,omitempty"`
+}
+
+// encryptorTableConfig mirrors table format of encryptor config (see encryptor/config)
+type encryptorTableConfig struct {
+	Table     string                  `yaml:"table"`
+	Columns   []string                `yaml:"columns"`
+	Encrypted []encryptorColumnConfig `yaml:"encrypted,omitempty"`
+}
+
+// EncryptorConfig is encryptor config in format accepted by "encryptor_config_file" option of AcraServer
+type EncryptorConfig struct {
+	Schemas []encryptorTableConfig `yaml:"schemas"`
+}
+
+// GenerateEncryptorConfig returns encryptor config for all tables with columns chosen by selector marked as encrypted
+func GenerateEncryptorConfig(tables []Table, selector ColumnSelector) *EncryptorConfig {
+	config := &EncryptorConfig{}
+	for _, table := range tables {
+		tableConfig := encryptorTableConfig{Table: table.Name}
+		for _, column := range table.Columns {
+			tableConfig.Columns = append(tableConfig.Columns, column.Name)
+			if annotation := selector.Select(table, column); annotation != nil {
+				tableConfig.Encrypted = append(tableConfig.Encrypted, encryptorColumnConfig{
+					Column: column.Name, ClientID: annotation.ClientID, ZoneID: annotation.ZoneID})
+			}
+		}
+		config.Schemas = append(config.Schemas, tableConfig)
+	}
+	return config
+}
+
+// censorHandlerConfig mirrors handler format of AcraCensor config (see acracensor.Config)
+type censorHandlerConfig struct {
+	Handler  string   `yaml:"handler"`
+	Queries  []string `yaml:"queries,omitempty"`
+	Tables   []string `yaml:"tables,omitempty"`
+	Patterns []string `yaml:"patterns,omitempty"`
+	FilePath string   `yaml:"filepath,omitempty"`
+}
+
+// CensorConfig is AcraCensor config in format accepted by "acracensor_config_file" option of AcraServer
+type CensorConfig struct {
+	Version          string                `yaml:"version"`
+	IgnoreParseError bool                  `yaml:"ignore_parse_error"`
+	ParseErrorsLog   string                `yaml:"parse_errors_log"`
+	Handlers         []censorHandlerConfig `yaml:"handlers"`
+}
+
+// GenerateCensorConfig returns AcraCensor allowlist skeleton: all queries are captured to log, common transaction
+// queries are ignored, queries to known tables are allowed and everything else is denied
+func GenerateCensorConfig(tables []Table) *CensorConfig {
+	tableNames := make([]string, 0, len(tables))
+	for _, table := range tables {
+		tableNames = append(tableNames, table.Name)
+	}
+	return &CensorConfig{
+		Version:        utils.VERSION,
+		ParseErrorsLog: "unparsed_queries.log",
+		Handlers: []censorHandlerConfig{
+			{Handler: acracensor.QueryCaptureConfigStr, FilePath: "censor.log"},
+			{Handler: acracensor.QueryIgnoreConfigStr, Queries: []string{"BEGIN", "COMMIT", "ROLLBACK"}},
+			{Handler: acracensor.AllowConfigStr, Tables: tableNames},
+			{Handler: acracensor.DenyAllConfigStr},
+		},
+	}
+}
+
+const encryptorConfigHeader = `# Starter encryptor config generated by acra-policygen, review it before use.
+# Only binary columns (bytea, blob, etc.) can store AcraStructs.
+`
+
+const censorConfigHeader = `# Starter AcraCensor config generated by acra-policygen, review it before use.
+# Queries to all tables found in database are allowed, everything else is denied.
+# Replace "tables" of the "allow" handler with exact queries or patterns captured in censor.log.
+`
+
+// WritePolicy serializes config as YAML with header comment to output
+func WritePolicy(output io.Writer, header string, config interface{}) error {
+	data, err := yaml.Marshal(config)
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(output, header); err != nil {
+		return err
+	}
+	_, err = output.Write(data)
+	return err
+}
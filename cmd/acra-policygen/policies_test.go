@@ -0,0 +1,145 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	acracensor "github.com/cossacklabs/acra/acra-censor"
+	"github.com/cossacklabs/acra/encryptor/config"
+)
+
+var testTables = []Table{
+	{Name: "users", Columns: []Column{{"id", "integer"}, {"email", "bytea"}, {"name", "text"}}},
+	{Name: "orders", Columns: []Column{{"id", "integer"}, {"card_number", "bytea"}}},
+}
+
+func TestGenerateEncryptorConfigByPattern(t *testing.T) {
+	selector, err := NewPatternSelector(DefaultSensitiveColumnsPattern, "client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := &bytes.Buffer{}
+	if err := WritePolicy(output, encryptorConfigHeader, GenerateEncryptorConfig(testTables, selector)); err != nil {
+		t.Fatal(err)
+	}
+	store, err := config.MapTableSchemaStoreFromConfig(output.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	users := store.GetTableSchema("users")
+	if users == nil {
+		t.Fatal("Table users not found")
+	}
+	if len(users.Columns()) != 3 {
+		t.Fatalf("Expected 3 columns, took %v", users.Columns())
+	}
+	if !users.NeedToEncrypt("email") || users.NeedToEncrypt("name") || users.NeedToEncrypt("id") {
+		t.Fatal("Incorrect encrypted columns of table users")
+	}
+	if setting := users.GetColumnEncryptionSettings("email"); string(setting.ClientID()) != "client" {
+		t.Fatalf("Incorrect client ID, took %s", setting.ClientID())
+	}
+	orders := store.GetTableSchema("orders")
+	if orders == nil || !orders.NeedToEncrypt("card_number") {
+		t.Fatal("Column orders.card_number should be encrypted")
+	}
+}
+
+func TestGenerateEncryptorConfigByAnnotations(t *testing.T) {
+	selector := NewAnnotationsSelector(&Annotations{Encrypt: []ColumnAnnotation{
+		{Table: "users", Column: "name", ZoneID: "zone"},
+	}})
+	output := &bytes.Buffer{}
+	if err := WritePolicy(output, encryptorConfigHeader, GenerateEncryptorConfig(testTables, selector)); err != nil {
+		t.Fatal(err)
+	}
+	store, err := config.MapTableSchemaStoreFromConfig(output.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	users := store.GetTableSchema("users")
+	if !users.NeedToEncrypt("name") || users.NeedToEncrypt("email") {
+		t.Fatal("Only annotated column should be encrypted")
+	}
+	if setting := users.GetColumnEncryptionSettings("name"); string(setting.ZoneID()) != "zone" {
+		t.Fatalf("Incorrect zone ID, took %s", setting.ZoneID())
+	}
+	if store.GetTableSchema("orders").NeedToEncrypt("card_number") {
+		t.Fatal("Not annotated column shouldn't be encrypted")
+	}
+}
+
+func TestInteractiveSelector(t *testing.T) {
+	suggest, err := NewPatternSelector(DefaultSensitiveColumnsPattern, "client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// users.id: default "n"; users.email: default "y", no zone, suggested client; users.name: "y" with zone;
+	// orders.id: "n"; orders.card_number: "n" overrides suggestion
+	input := strings.NewReader("\n\n\n\ny\nzone\nn\nn\n")
+	output := &bytes.Buffer{}
+	selector := NewInteractiveSelector(input, output, suggest, "default")
+	encryptorConfig := GenerateEncryptorConfig(testTables, selector)
+	users := encryptorConfig.Schemas[0]
+	if len(users.Encrypted) != 2 {
+		t.Fatalf("Expected 2 encrypted columns, took %v", users.Encrypted)
+	}
+	if users.Encrypted[0] != (encryptorColumnConfig{Column: "email", ClientID: "client"}) {
+		t.Fatalf("Incorrect settings of email column: %v", users.Encrypted[0])
+	}
+	if users.Encrypted[1] != (encryptorColumnConfig{Column: "name", ZoneID: "zone"}) {
+		t.Fatalf("Incorrect settings of name column: %v", users.Encrypted[1])
+	}
+	if len(encryptorConfig.Schemas[1].Encrypted) != 0 {
+		t.Fatal("Table orders shouldn't have encrypted columns")
+	}
+	if !strings.Contains(output.String(), "Encrypt column users.email (bytea)? y/n [y]") {
+		t.Fatalf("Unexpected prompt: %s", output.String())
+	}
+}
+
+func TestGenerateCensorConfig(t *testing.T) {
+	// censor creates log files from config in working directory
+	tmpDir, err := ioutil.TempDir("", "acra-policygen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	workingDir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(tmpDir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(workingDir)
+
+	output := &bytes.Buffer{}
+	if err := WritePolicy(output, censorConfigHeader, GenerateCensorConfig(testTables)); err != nil {
+		t.Fatal(err)
+	}
+	censor := acracensor.NewAcraCensor()
+	defer censor.ReleaseAll()
+	if err := censor.LoadConfiguration(output.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+}
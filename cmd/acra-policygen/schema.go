@@ -0,0 +1,77 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"database/sql"
+)
+
+// Column describes table column found in database schema
+type Column struct {
+	Name     string
+	DataType string
+}
+
+// Table describes table found in database schema with columns in their ordinal order
+type Table struct {
+	Name    string
+	Columns []Column
+}
+
+const (
+	postgresqlSchemaQuery = `SELECT table_name, column_name, data_type FROM information_schema.columns
+WHERE table_schema = $1 ORDER BY table_name, ordinal_position`
+	mysqlSchemaQuery = `SELECT table_name, column_name, data_type FROM information_schema.columns
+WHERE table_schema = DATABASE() ORDER BY table_name, ordinal_position`
+)
+
+// ReadPostgreSQLSchema returns tables of PostgreSQL schema (usually "public")
+func ReadPostgreSQLSchema(db *sql.DB, schema string) ([]Table, error) {
+	rows, err := db.Query(postgresqlSchemaQuery, schema)
+	if err != nil {
+		return nil, err
+	}
+	return readTables(rows)
+}
+
+// ReadMySQLSchema returns tables of current MySQL database selected in connection string
+func ReadMySQLSchema(db *sql.DB) ([]Table, error) {
+	rows, err := db.Query(mysqlSchemaQuery)
+	if err != nil {
+		return nil, err
+	}
+	return readTables(rows)
+}
+
+// readTables groups rows of (table, column, type) sorted by table name into tables
+func readTables(rows *sql.Rows) ([]Table, error) {
+	defer rows.Close()
+	var tables []Table
+	for rows.Next() {
+		var tableName string
+		var column Column
+		if err := rows.Scan(&tableName, &column.Name, &column.DataType); err != nil {
+			return nil, err
+		}
+		if len(tables) == 0 || tables[len(tables)-1].Name != tableName {
+			tables = append(tables, Table{Name: tableName})
+		}
+		last := &tables[len(tables)-1]
+		last.Columns = append(last.Columns, column)
+	}
+	return tables, rows.Err()
+}
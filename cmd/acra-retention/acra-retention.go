@@ -0,0 +1,144 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package main is entry point for AcraRetention utility. AcraRetention enforces data retention policy: for every
+// configured table it periodically deletes rows with TTL column older than retention period or crypto-shreds them by
+// erasing their encrypted columns. Every run writes audit event with table, action, cutoff time and count of rows.
+// In dry run mode expired rows are only counted.
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/cossacklabs/acra/cmd"
+	"github.com/cossacklabs/acra/logging"
+	"github.com/cossacklabs/acra/utils"
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+)
+
+// Constants used by AcraRetention
+var (
+	// defaultConfigPath relative path to config which will be parsed as default
+	defaultConfigPath = utils.GetConfigPathByName("acra-retention")
+	serviceName       = "acra-retention"
+)
+
+func main() {
+	connectionString := flag.String("connection_string", "", "Connection string for db")
+	useMysql := flag.Bool("mysql_enable", false, "Handle MySQL connections")
+	usePostgresql := flag.Bool("postgresql_enable", false, "Handle Postgresql connections")
+	policyFile := flag.String("retention_config_file", "", "Path to config with retention policies of tables")
+	dryRun := flag.Bool("dry_run", false, "Only count expired rows without deleting or shredding them")
+	runOnce := flag.Bool("run_once", false, "Run jobs of all tables once and exit instead of running them by schedule")
+	debug := flag.Bool("d", false, "Log everything to stderr")
+
+	err := cmd.Parse(defaultConfigPath, serviceName)
+	if err != nil {
+		log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCantReadServiceConfig).
+			Errorln("Can't parse args")
+		os.Exit(1)
+	}
+	// audit events are logged at INFO level, so they are always written
+	if *debug {
+		logging.SetLogLevel(logging.LogDebug)
+	} else {
+		logging.SetLogLevel(logging.LogVerbose)
+	}
+
+	if *useMysql == *usePostgresql {
+		log.Errorln("You must pass only --mysql_enable or --postgresql_enable (one required)")
+		os.Exit(1)
+	}
+	dbDriverName := "postgres"
+	dialect := PostgreSQLDialect
+	if *useMysql {
+		dbDriverName = "mysql"
+		dialect = MySQLDialect
+	}
+	if *connectionString == "" {
+		log.Errorln("Connection_string arg is missing")
+		os.Exit(1)
+	}
+	if *policyFile == "" {
+		log.Errorln("Retention_config_file arg is missing")
+		os.Exit(1)
+	}
+	policy, err := LoadPolicy(*policyFile)
+	if err != nil {
+		log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+			Errorln("Can't load retention config")
+		os.Exit(1)
+	}
+
+	db, err := sql.Open(dbDriverName, *connectionString)
+	if err != nil {
+		log.WithError(err).Errorln("Can't connect to db")
+		os.Exit(1)
+	}
+	defer db.Close()
+	if err := db.Ping(); err != nil {
+		log.WithError(err).Errorln("Can't connect to db")
+		os.Exit(1)
+	}
+	if *dryRun {
+		log.Infoln("Dry run mode, expired rows will be only counted")
+	}
+
+	jobs := make([]*Job, 0, len(policy.Tables))
+	for i := range policy.Tables {
+		jobs = append(jobs, NewJob(db, dialect, &policy.Tables[i], *dryRun))
+	}
+	if *runOnce {
+		failed := false
+		for _, job := range jobs {
+			if err := job.Run(time.Now()); err != nil {
+				failed = true
+			}
+		}
+		if failed {
+			os.Exit(1)
+		}
+		return
+	}
+	wg := sync.WaitGroup{}
+	for _, job := range jobs {
+		wg.Add(1)
+		go func(job *Job) {
+			defer wg.Done()
+			runBySchedule(job)
+		}(job)
+	}
+	wg.Wait()
+}
+
+// runBySchedule runs job right after start and then once per schedule interval of table. Failed runs are retried
+// on the next tick.
+func runBySchedule(job *Job) {
+	log.WithField("table", job.table.Table).Infof("Run retention job every %s", job.table.ScheduleInterval())
+	ticker := time.NewTicker(job.table.ScheduleInterval())
+	defer ticker.Stop()
+	for {
+		// error already logged by job
+		_ = job.Run(time.Now())
+		<-ticker.C
+	}
+}
@@ -0,0 +1,123 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/cossacklabs/acra/logging"
+	"github.com/cossacklabs/acra/utils/sqlidentifier"
+	log "github.com/sirupsen/logrus"
+)
+
+// Dialect generates database specific SQL of retention jobs
+type Dialect struct {
+	quote       sqlidentifier.Quote
+	placeholder string
+}
+
+// Supported dialects
+var (
+	PostgreSQLDialect = Dialect{quote: sqlidentifier.PostgreSQLQuote, placeholder: "$1"}
+	MySQLDialect      = Dialect{quote: sqlidentifier.MySQLQuote, placeholder: "?"}
+)
+
+// expiredCondition returns WHERE condition of rows which should be processed by job.
+// Already shredded rows are excluded, so repeated runs don't count them again.
+func (dialect Dialect) expiredCondition(table *TablePolicy) string {
+	condition := dialect.quote.Identifier(table.TTLColumn) + " < " + dialect.placeholder
+	if table.Action != ActionShred {
+		return condition
+	}
+	notNull := make([]string, 0, len(table.ShredColumns))
+	for _, column := range table.ShredColumns {
+		notNull = append(notNull, dialect.quote.Identifier(column)+" IS NOT NULL")
+	}
+	return condition + " AND (" + strings.Join(notNull, " OR ") + ")"
+}
+
+// CountQuery returns query which counts expired rows with cutoff time as the only parameter
+func (dialect Dialect) CountQuery(table *TablePolicy) string {
+	return "SELECT COUNT(*) FROM " + dialect.quote.Identifier(table.Table) + " WHERE " + dialect.expiredCondition(table)
+}
+
+// ApplyQuery returns query which deletes or shreds expired rows with cutoff time as the only parameter
+func (dialect Dialect) ApplyQuery(table *TablePolicy) string {
+	if table.Action == ActionDelete {
+		return "DELETE FROM " + dialect.quote.Identifier(table.Table) + " WHERE " + dialect.expiredCondition(table)
+	}
+	assignments := make([]string, 0, len(table.ShredColumns))
+	for _, column := range table.ShredColumns {
+		assignments = append(assignments, dialect.quote.Identifier(column)+" = NULL")
+	}
+	return "UPDATE " + dialect.quote.Identifier(table.Table) + " SET " + strings.Join(assignments, ", ") +
+		" WHERE " + dialect.expiredCondition(table)
+}
+
+// Job applies retention policy of one table
+type Job struct {
+	db      *sql.DB
+	dialect Dialect
+	table   *TablePolicy
+	dryRun  bool
+}
+
+// NewJob returns Job for table. In dry run mode job only counts expired rows.
+func NewJob(db *sql.DB, dialect Dialect, table *TablePolicy, dryRun bool) *Job {
+	return &Job{db: db, dialect: dialect, table: table, dryRun: dryRun}
+}
+
+// Run processes rows expired at moment now and writes audit event with result
+func (job *Job) Run(now time.Time) error {
+	cutoff := now.Add(-job.table.RetentionPeriod())
+	logger := log.WithFields(log.Fields{
+		"table":      job.table.Table,
+		"action":     job.table.Action,
+		"ttl_column": job.table.TTLColumn,
+		"cutoff":     cutoff.Format(time.RFC3339),
+		"dry_run":    job.dryRun,
+	})
+	var affected int64
+	if job.dryRun {
+		if err := job.db.QueryRow(job.dialect.CountQuery(job.table), cutoff).Scan(&affected); err != nil {
+			logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorRetentionJob).
+				Errorln("Can't count expired rows")
+			return err
+		}
+	} else {
+		result, err := job.db.Exec(job.dialect.ApplyQuery(job.table), cutoff)
+		if err != nil {
+			logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorRetentionJob).
+				Errorln("Can't process expired rows")
+			return err
+		}
+		affected, err = result.RowsAffected()
+		if err != nil {
+			logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorRetentionJob).
+				Errorln("Can't get count of processed rows")
+			return err
+		}
+	}
+	if len(job.table.ShredColumns) > 0 {
+		logger = logger.WithField("shred_columns", strings.Join(job.table.ShredColumns, ","))
+	}
+	logger.WithField(logging.FieldKeyEventCode, logging.EventCodeRetentionAudit).WithField("rows", affected).
+		Infoln("Retention job finished")
+	return nil
+}
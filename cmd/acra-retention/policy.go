@@ -0,0 +1,152 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cossacklabs/acra/utils/sqlidentifier"
+	"gopkg.in/yaml.v2"
+)
+
+// Actions applied to expired rows
+const (
+	ActionDelete = "delete"
+	ActionShred  = "shred"
+)
+
+// DefaultSchedule is interval between runs of table job if schedule isn't specified
+const DefaultSchedule = time.Hour * 24
+
+// ErrInvalidPolicy returned for invalid retention policy configuration
+var ErrInvalidPolicy = errors.New("invalid retention policy")
+
+// TablePolicy describes retention of rows of table ("name" or "schema.name"). Rows with TTLColumn older than
+// Retention are deleted or, for "shred" action, encrypted ShredColumns are overwritten with NULL. Every AcraStruct
+// carries own per-record symmetric key wrapped with public key, so erasing ciphertext destroys per-record key while
+// other columns of row stay untouched.
+type TablePolicy struct {
+	Table        string   `yaml:"table"`
+	TTLColumn    string   `yaml:"ttl_column"`
+	Retention    string   `yaml:"retention"`
+	Action       string   `yaml:"action"`
+	ShredColumns []string `yaml:"shred_columns"`
+	Schedule     string   `yaml:"schedule"`
+
+	retention time.Duration
+	schedule  time.Duration
+}
+
+// RetentionPeriod returns parsed Retention
+func (table *TablePolicy) RetentionPeriod() time.Duration {
+	return table.retention
+}
+
+// ScheduleInterval returns parsed Schedule or DefaultSchedule
+func (table *TablePolicy) ScheduleInterval() time.Duration {
+	return table.schedule
+}
+
+// Policy describes retention jobs of tables
+type Policy struct {
+	Tables []TablePolicy `yaml:"tables"`
+}
+
+// LoadPolicy reads Policy from YAML file
+func LoadPolicy(path string) (*Policy, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParsePolicy(data)
+}
+
+// ParsePolicy parses Policy from YAML and validates it
+func ParsePolicy(data []byte) (*Policy, error) {
+	policy := &Policy{}
+	if err := yaml.Unmarshal(data, policy); err != nil {
+		return nil, err
+	}
+	if err := policy.validate(); err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+// validate checks identifiers, actions and parses durations
+func (policy *Policy) validate() error {
+	if len(policy.Tables) == 0 {
+		return fmt.Errorf("%w: no tables", ErrInvalidPolicy)
+	}
+	for i := range policy.Tables {
+		table := &policy.Tables[i]
+		if !sqlidentifier.IsValid(table.Table) {
+			return fmt.Errorf("%w: invalid table name '%s'", ErrInvalidPolicy, table.Table)
+		}
+		if !sqlidentifier.IsValidColumn(table.TTLColumn) {
+			return fmt.Errorf("%w: %s: invalid ttl_column '%s'", ErrInvalidPolicy, table.Table, table.TTLColumn)
+		}
+		retention, err := parseDuration(table.Retention)
+		if err != nil || retention <= 0 {
+			return fmt.Errorf("%w: %s: retention should be positive duration like 720h or 30d", ErrInvalidPolicy, table.Table)
+		}
+		table.retention = retention
+		table.schedule = DefaultSchedule
+		if table.Schedule != "" {
+			schedule, err := parseDuration(table.Schedule)
+			if err != nil || schedule <= 0 {
+				return fmt.Errorf("%w: %s: schedule should be positive duration like 1h or 1d", ErrInvalidPolicy, table.Table)
+			}
+			table.schedule = schedule
+		}
+		switch table.Action {
+		case ActionDelete:
+			if len(table.ShredColumns) != 0 {
+				return fmt.Errorf("%w: %s: shred_columns are used only with shred action", ErrInvalidPolicy, table.Table)
+			}
+		case ActionShred:
+			if len(table.ShredColumns) == 0 {
+				return fmt.Errorf("%w: %s: shred action requires shred_columns", ErrInvalidPolicy, table.Table)
+			}
+			for _, column := range table.ShredColumns {
+				if !sqlidentifier.IsValidColumn(column) || column == table.TTLColumn {
+					return fmt.Errorf("%w: %s: invalid shred column '%s'", ErrInvalidPolicy, table.Table, column)
+				}
+			}
+		default:
+			return fmt.Errorf("%w: %s: unknown action '%s'", ErrInvalidPolicy, table.Table, table.Action)
+		}
+	}
+	return nil
+}
+
+// parseDuration parses time.Duration with additional "d" suffix for days, e.g. "30d"
+func parseDuration(value string) (time.Duration, error) {
+	if strings.HasSuffix(value, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(value, "d"))
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(days) * time.Hour * 24, nil
+	}
+	return time.ParseDuration(value)
+}
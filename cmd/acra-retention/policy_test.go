@@ -0,0 +1,99 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestParsePolicy(t *testing.T) {
+	policy, err := ParsePolicy([]byte(`
+tables:
+  - table: public.sessions
+    ttl_column: created_at
+    retention: 30d
+    action: delete
+    schedule: 1h
+  - table: users
+    ttl_column: deleted_at
+    retention: 720h
+    action: shred
+    shred_columns: [email, phone]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if policy.Tables[0].RetentionPeriod() != time.Hour*24*30 || policy.Tables[0].ScheduleInterval() != time.Hour {
+		t.Fatal("Incorrect parsed durations of the first table")
+	}
+	if policy.Tables[1].RetentionPeriod() != time.Hour*720 || policy.Tables[1].ScheduleInterval() != DefaultSchedule {
+		t.Fatal("Incorrect parsed durations of the second table")
+	}
+
+	invalidPolicies := []string{
+		`tables: []`,
+		`tables: [{table: "users; DROP TABLE users", ttl_column: created_at, retention: 1d, action: delete}]`,
+		`tables: [{table: users, ttl_column: t.created_at, retention: 1d, action: delete}]`,
+		`tables: [{table: users, ttl_column: created_at, retention: -1h, action: delete}]`,
+		`tables: [{table: users, ttl_column: created_at, retention: month, action: delete}]`,
+		`tables: [{table: users, ttl_column: created_at, retention: 1d, action: delete, schedule: 0s}]`,
+		`tables: [{table: users, ttl_column: created_at, retention: 1d, action: delete, shred_columns: [email]}]`,
+		`tables: [{table: users, ttl_column: created_at, retention: 1d, action: shred}]`,
+		`tables: [{table: users, ttl_column: created_at, retention: 1d, action: shred, shred_columns: [created_at]}]`,
+		`tables: [{table: users, ttl_column: created_at, retention: 1d, action: truncate}]`,
+	}
+	for _, data := range invalidPolicies {
+		if _, err := ParsePolicy([]byte(data)); !errors.Is(err, ErrInvalidPolicy) {
+			t.Fatalf("Expected ErrInvalidPolicy for %s, took %v", data, err)
+		}
+	}
+}
+
+func TestDialectQueries(t *testing.T) {
+	deletePolicy := &TablePolicy{Table: "public.sessions", TTLColumn: "created_at", Action: ActionDelete}
+	shredPolicy := &TablePolicy{Table: "users", TTLColumn: "deleted_at", Action: ActionShred, ShredColumns: []string{"email", "phone"}}
+	testcases := []struct {
+		dialect  Dialect
+		policy   *TablePolicy
+		count    string
+		apply    string
+		dialName string
+	}{
+		{PostgreSQLDialect, deletePolicy,
+			`SELECT COUNT(*) FROM "public"."sessions" WHERE "created_at" < $1`,
+			`DELETE FROM "public"."sessions" WHERE "created_at" < $1`, "postgresql"},
+		{MySQLDialect, deletePolicy,
+			"SELECT COUNT(*) FROM `public`.`sessions` WHERE `created_at` < ?",
+			"DELETE FROM `public`.`sessions` WHERE `created_at` < ?", "mysql"},
+		{PostgreSQLDialect, shredPolicy,
+			`SELECT COUNT(*) FROM "users" WHERE "deleted_at" < $1 AND ("email" IS NOT NULL OR "phone" IS NOT NULL)`,
+			`UPDATE "users" SET "email" = NULL, "phone" = NULL WHERE "deleted_at" < $1 AND ("email" IS NOT NULL OR "phone" IS NOT NULL)`, "postgresql"},
+		{MySQLDialect, shredPolicy,
+			"SELECT COUNT(*) FROM `users` WHERE `deleted_at` < ? AND (`email` IS NOT NULL OR `phone` IS NOT NULL)",
+			"UPDATE `users` SET `email` = NULL, `phone` = NULL WHERE `deleted_at` < ? AND (`email` IS NOT NULL OR `phone` IS NOT NULL)", "mysql"},
+	}
+	for _, testcase := range testcases {
+		if query := testcase.dialect.CountQuery(testcase.policy); query != testcase.count {
+			t.Fatalf("Incorrect %s count query: %s", testcase.dialName, query)
+		}
+		if query := testcase.dialect.ApplyQuery(testcase.policy); query != testcase.apply {
+			t.Fatalf("Incorrect %s apply query: %s", testcase.dialName, query)
+		}
+	}
+}
@@ -303,16 +303,11 @@ func main() {
 }
 
 func openKeyStoreV1(keysDir string) keystore.DecryptionKeyStore {
-	masterKey, err := keystore.GetMasterKeyFromEnvironment()
+	scellEncryptor, err := keystore.EnvironmentMasterKeyProvider{}.KeyEncryptor()
 	if err != nil {
 		log.WithError(err).Errorln("Cannot load master key")
 		os.Exit(1)
 	}
-	scellEncryptor, err := keystore.NewSCellKeyEncryptor(masterKey)
-	if err != nil {
-		log.WithError(err).Errorln("Can't init scell encryptor")
-		os.Exit(1)
-	}
 	keystorage, err := filesystem.NewFilesystemKeyStore(keysDir, scellEncryptor)
 	if err != nil {
 		log.WithError(err).Errorln("Can't initialize keystore")
@@ -22,6 +22,7 @@ import (
 	"database/sql"
 	"flag"
 	"os"
+	"strings"
 
 	"github.com/cossacklabs/acra/cmd"
 	"github.com/cossacklabs/acra/keystore"
@@ -43,16 +44,11 @@ var (
 )
 
 func openKeyStoreV1(dirPath string) keystore.RotateStorageKeyStore {
-	masterKey, err := keystore.GetMasterKeyFromEnvironment()
+	scellEncryptor, err := keystore.EnvironmentMasterKeyProvider{}.KeyEncryptor()
 	if err != nil {
 		log.WithError(err).Errorln("Cannot load master key")
 		os.Exit(1)
 	}
-	scellEncryptor, err := keystore.NewSCellKeyEncryptor(masterKey)
-	if err != nil {
-		log.WithError(err).Errorln("Can't init scell encryptor")
-		os.Exit(1)
-	}
 	keystorage, err := filesystem.NewFilesystemKeyStore(dirPath, scellEncryptor)
 	if err != nil {
 		log.WithError(err).Errorln("can't initialize keystore")
@@ -86,11 +82,14 @@ func main() {
 
 	sqlSelect := flag.String("sql_select", "", "Select query with ? as placeholders where last columns in result must be ClientId/ZoneId and AcraStruct. Other columns will be passed into insert/update query into placeholders")
 	sqlUpdate := flag.String("sql_update", "", "Insert/Update query with ? as placeholder where into first will be placed rotated AcraStruct")
+	sqlMapConfig := flag.String("sql_map_config", "", "Path to file with pairs of sql_select and sql_update queries of all tables rotated with the same keys in json format [{\"select\": \"select_query1\", \"update\": \"update_query1\"}, {\"select\": \"select_query2\", \"update\": \"update_query2\"}]")
+	keyIDs := flag.String("key_ids", "", "Comma-separated list of ClientIds/ZoneIds which keys are rotated even without data, AcraStructs of other ids are left as is. Rotate keys of all found AcraStructs if empty")
 	connectionString := flag.String("db_connection_string", "", "Connection string to db")
 	useMysql := flag.Bool("mysql_enable", false, "Handle MySQL connections")
 	zoneMode := flag.Bool("zonemode_enable", true, "Rotate acrastructs as it was encrypted with zonemode or without. With zonemode_enable=true will be used zoneID for encryption/decryption. If false then key id will not be used")
 	_ = flag.Bool("postgresql_enable", false, "Handle Postgresql connections")
 	dryRun := flag.Bool("dry-run", false, "perform rotation without saving rotated AcraStructs and keys")
+	cmd.RegisterRandomSourceCmdParameters()
 	logging.SetLogLevel(logging.LogVerbose)
 
 	err := cmd.Parse(DefaultConfigPath, ServiceName)
@@ -99,6 +98,11 @@ func main() {
 			Errorln("Can't parse args")
 		os.Exit(1)
 	}
+	if err := cmd.InitRandomSource(); err != nil {
+		log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorRandomSource).
+			Errorln("Can't initialize random source")
+		os.Exit(1)
+	}
 
 	var keystorage keystore.RotateStorageKeyStore
 	if filesystemV2.IsKeyDirectory(*keysDir) {
@@ -107,17 +111,41 @@ func main() {
 		keystorage = openKeyStoreV1(*keysDir)
 	}
 
-	if *dryRun {
-		log.Infoln("Rotating in dry-run mode")
-	}
-	if *fileMapConfig != "" {
-		runFileRotation(*fileMapConfig, keystorage, *zoneMode, *dryRun)
+	var rotatedKeyIDs []string
+	if *keyIDs != "" {
+		rotatedKeyIDs = strings.Split(*keyIDs, ",")
 	}
-	if *sqlSelect != "" || *sqlUpdate != "" {
+	var queryMap SQLQueryMap
+	if *sqlMapConfig != "" {
+		if *sqlSelect != "" || *sqlUpdate != "" {
+			log.Errorln("sql_map_config can't be used with sql_select and sql_update")
+			os.Exit(1)
+		}
+		queryMap, err = loadSQLQueryMap(*sqlMapConfig)
+		if err != nil {
+			log.WithError(err).Errorln("Can't load config with map of sql queries")
+			os.Exit(1)
+		}
+	} else if *sqlSelect != "" || *sqlUpdate != "" {
 		if *sqlSelect == "" || *sqlUpdate == "" {
 			log.Errorln("sql_select and sql_update must be set both")
 			os.Exit(1)
 		}
+		queryMap = SQLQueryMap{{Select: *sqlSelect, Update: *sqlUpdate}}
+	}
+
+	if *dryRun {
+		log.Infoln("Rotating in dry-run mode")
+	}
+	if *fileMapConfig == "" && len(queryMap) == 0 && len(rotatedKeyIDs) != 0 {
+		if !rotateKeys(rotatedKeyIDs, keystorage, *zoneMode, *dryRun) {
+			os.Exit(1)
+		}
+	}
+	if *fileMapConfig != "" {
+		runFileRotation(*fileMapConfig, keystorage, *zoneMode, *dryRun, rotatedKeyIDs)
+	}
+	if len(queryMap) != 0 {
 		var db *sql.DB
 		var encoder utils.BinaryEncoder
 		if *useMysql {
@@ -141,8 +169,7 @@ func main() {
 			log.WithError(err).Errorln("Error on pinging database", *connectionString)
 			os.Exit(1)
 		}
-		log.WithFields(log.Fields{"select_query": *sqlSelect, "update_query": *sqlUpdate}).Infoln("Rotate data in database")
-		if !rotateDb(*sqlSelect, *sqlUpdate, db, keystorage, encoder, *zoneMode, *dryRun) {
+		if !rotateDb(queryMap, db, keystorage, encoder, *zoneMode, *dryRun, rotatedKeyIDs) {
 			os.Exit(1)
 		}
 	}
@@ -27,14 +27,51 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-// rotateDb execute selectQuery to fetch AcraStructs with related zone ids, decrypt with rotated zone keys and
-func rotateDb(selectQuery, updateQuery string, db *sql.DB, keystore keystore.RotateStorageKeyStore, encoder utils.BinaryEncoder, zoneMode, dryRun bool) bool {
-	rotator, err := newRotator(keystore, zoneMode)
+// rotateDb execute select query of each pair to fetch AcraStructs with related zone ids, decrypt with rotated zone keys
+// and save with update query. All AcraStructs are updated in one transaction which is committed after new keys are
+// saved, so data is never left encrypted with keys which weren't saved
+func rotateDb(queryMap SQLQueryMap, db *sql.DB, keystore keystore.RotateStorageKeyStore, encoder utils.BinaryEncoder, zoneMode, dryRun bool, keyIDs []string) bool {
+	rotator, err := newRotator(keystore, zoneMode, keyIDs)
 	if err != nil {
+		log.WithError(err).Errorln("Can't generate new keys")
 		return false
 	}
 	defer rotator.clearKeys()
 
+	tx, err := db.Begin()
+	if err != nil {
+		log.WithError(err).Errorln("Can't begin transaction")
+		return false
+	}
+	// does nothing after commit
+	defer tx.Rollback()
+	for _, pair := range queryMap {
+		log.WithFields(log.Fields{"select_query": pair.Select, "update_query": pair.Update}).Infoln("Rotate data in database")
+		if !rotateQueryPair(pair.Select, pair.Update, db, tx, rotator, encoder, dryRun) {
+			return false
+		}
+	}
+	if !dryRun {
+		if err = rotator.saveRotatedKeys(); err != nil {
+			log.WithError(err).Errorln("Can't save rotated keys")
+			return false
+		}
+		if err = tx.Commit(); err != nil {
+			log.WithError(err).Errorln("Can't commit rotated data, it's left encrypted with archived keys")
+			return false
+		}
+	}
+	jsonOutput, err := rotator.marshal()
+	if err != nil {
+		log.WithError(err).Errorln("Can't encode to json")
+		return false
+	}
+	fmt.Println(string(jsonOutput))
+	return true
+}
+
+// rotateQueryPair rotates AcraStructs fetched with selectQuery and saves them with updateQuery executed in tx
+func rotateQueryPair(selectQuery, updateQuery string, db *sql.DB, tx *sql.Tx, rotator *keyRotator, encoder utils.BinaryEncoder, dryRun bool) bool {
 	rows, err := db.Query(selectQuery)
 	if err != nil {
 		log.WithError(err).Errorf("Can't fetch result with sql_select query")
@@ -80,6 +117,10 @@ func rotateDb(selectQuery, updateQuery string, db *sql.DB, keystore keystore.Rot
 			return false
 		}
 		logger := log.WithFields(log.Fields{"Key ID": string(acraStructID)})
+		if !rotator.isRotated(acraStructID) {
+			logger.Debugln("Skip AcraStruct of key id which isn't rotated")
+			continue
+		}
 		logger.Infof("Rotate AcraStruct")
 
 		// rotate
@@ -96,24 +137,16 @@ func rotateDb(selectQuery, updateQuery string, db *sql.DB, keystore keystore.Rot
 			extraArgs = []interface{}{rotatedStr}
 		}
 		if !dryRun {
-			_, err = db.Exec(updateQuery, extraArgs...)
+			_, err = tx.Exec(updateQuery, extraArgs...)
 			if err != nil {
 				logger.WithError(err).Errorln("Can't update data in db via sql_update query")
 				return false
 			}
 		}
 	}
-	if !dryRun {
-		if err = rotator.saveRotatedKeys(); err != nil {
-			log.WithError(err).Errorln("Can't save rotated keys")
-			return false
-		}
-	}
-	jsonOutput, err := rotator.marshal()
-	if err != nil {
-		log.WithError(err).Errorln("Can't encode to json")
+	if err = rows.Err(); err != nil {
+		log.WithError(err).Errorln("Can't fetch result with sql_select query")
 		return false
 	}
-	fmt.Println(string(jsonOutput))
 	return true
 }
@@ -42,20 +42,32 @@ type ZoneRotateData struct {
 	FilePaths    []string `json:"file_paths"`
 }
 
+// rotatedFile store re-encrypted AcraStruct until it is written in place of file with path
+type rotatedFile struct {
+	path string
+	data []byte
+	mode os.FileMode
+}
+
 // ZoneRotateResult store result of rotation
 type ZoneRotateResult map[string]*ZoneRotateData
 
 // rotateFiles generate new key pair for each zone in KeyIDFileMap and re-encrypt all files encrypted with each zone
-func rotateFiles(fileMap KeyIDFileMap, keyStore keystore.RotateStorageKeyStore, zoneMode, dryRun bool) (ZoneRotateResult, error) {
-	rotator, err := newRotator(keyStore, zoneMode)
+func rotateFiles(fileMap KeyIDFileMap, keyStore keystore.RotateStorageKeyStore, zoneMode, dryRun bool, keyIDs []string) (ZoneRotateResult, error) {
+	rotator, err := newRotator(keyStore, zoneMode, keyIDs)
 	if err != nil {
 		return nil, err
 	}
 	defer rotator.clearKeys()
 	output := ZoneRotateResult{}
+	var rotatedFiles []rotatedFile
 	for zoneID, paths := range fileMap {
 		logger := log.WithField("Key ID", zoneID)
 		binZoneID := []byte(zoneID)
+		if !rotator.isRotated(binZoneID) {
+			logger.Infoln("Skip files of key id which isn't rotated")
+			continue
+		}
 		newPublicKey, err := rotator.getRotatedPublicKey(binZoneID)
 		if err != nil {
 			logger.WithError(err).Errorln("Can't rotate zone key")
@@ -81,33 +93,37 @@ func rotateFiles(fileMap KeyIDFileMap, keyStore keystore.RotateStorageKeyStore,
 				fileLogger.WithError(err).Errorln("Can't get stat info about file to retrieve current file permissions")
 				return nil, err
 			}
-			if !dryRun {
-				if err := ioutil.WriteFile(path, rotated, stat.Mode()); err != nil {
-					fileLogger.WithError(err).Errorln("Can't write rotated AcraStruct with zone")
-					return nil, err
-				}
-			}
+			rotatedFiles = append(rotatedFiles, rotatedFile{path: path, data: rotated, mode: stat.Mode()})
 			fileLogger.Infof("Finish rotate file")
 		}
 		output[zoneID] = result
 		logger.Infoln("Finish rotate zone")
 	}
-	if !dryRun {
-		if err := rotator.saveRotatedKeys(); err != nil {
-			log.WithError(err).Errorln("Can't save rotated keys")
+	if dryRun {
+		return output, nil
+	}
+	// keys are saved before files, so files which failed to be written are still decrypted with archived keys
+	if err := rotator.saveRotatedKeys(); err != nil {
+		log.WithError(err).Errorln("Can't save rotated keys")
+		return nil, err
+	}
+	for _, file := range rotatedFiles {
+		if err := ioutil.WriteFile(file.path, file.data, file.mode); err != nil {
+			log.WithField("filepath", file.path).WithError(err).Errorln("Can't write rotated AcraStruct with zone")
+			return nil, err
 		}
 	}
 	return output, nil
 }
 
 // runFileRotation read map zones to files, re-generate zone key pairs and re-encrypt files
-func runFileRotation(fileMapConfigPath string, keystorage keystore.RotateStorageKeyStore, zoneMode, dryRun bool) {
+func runFileRotation(fileMapConfigPath string, keystorage keystore.RotateStorageKeyStore, zoneMode, dryRun bool, keyIDs []string) {
 	fileMap, err := loadFileMap(fileMapConfigPath)
 	if err != nil {
 		log.WithError(err).Errorln("Can't load config with map <ZoneId>: <FilePath>")
 		os.Exit(1)
 	}
-	result, err := rotateFiles(fileMap, keystorage, zoneMode, dryRun)
+	result, err := rotateFiles(fileMap, keystorage, zoneMode, dryRun, keyIDs)
 	if err != nil {
 		log.WithError(err).Errorln("Can't rotate files")
 		os.Exit(1)
@@ -19,6 +19,8 @@ package main
 import (
 	"encoding/hex"
 	"encoding/json"
+	"fmt"
+	"time"
 
 	acrawriter "github.com/cossacklabs/acra/acra-writer"
 	"github.com/cossacklabs/acra/decryptor/base"
@@ -32,10 +34,28 @@ type keyRotator struct {
 	keystore    keystore.RotateStorageKeyStore
 	newKeypairs map[string]*keys.Keypair
 	zoneMode    bool
+	// keyIDs limits rotation to keys of ClientIds/ZoneIds if not empty
+	keyIDs map[string]bool
 }
 
-func newRotator(store keystore.RotateStorageKeyStore, zoneMode bool) (*keyRotator, error) {
-	return &keyRotator{keystore: store, newKeypairs: make(map[string]*keys.Keypair), zoneMode: zoneMode}, nil
+// newRotator returns rotator which generates new keys for each id of keyIDs and for ids of rotated AcraStructs. If
+// keyIDs are set, AcraStructs of other ids are left as is
+func newRotator(store keystore.RotateStorageKeyStore, zoneMode bool, keyIDs []string) (*keyRotator, error) {
+	rotator := &keyRotator{keystore: store, newKeypairs: make(map[string]*keys.Keypair), zoneMode: zoneMode,
+		keyIDs: make(map[string]bool, len(keyIDs))}
+	for _, id := range keyIDs {
+		rotator.keyIDs[id] = true
+		if _, err := rotator.getRotatedPublicKey([]byte(id)); err != nil {
+			rotator.clearKeys()
+			return nil, err
+		}
+	}
+	return rotator, nil
+}
+
+// isRotated returns true if AcraStructs and keys of id should be rotated
+func (rotator *keyRotator) isRotated(id []byte) bool {
+	return len(rotator.keyIDs) == 0 || rotator.keyIDs[string(id)]
 }
 func (rotator *keyRotator) getRotatedPublicKey(keyID []byte) (*keys.PublicKey, error) {
 	keypair, ok := rotator.newKeypairs[string(keyID)]
@@ -60,11 +80,13 @@ func (rotator *keyRotator) rotateAcrastructWithZone(zoneID, acrastruct []byte) (
 		return nil, err
 	}
 	defer utils.ZeroizePrivateKeys(privateKeys)
-	decrypted, err := base.DecryptRotatedAcrastruct(acrastruct, privateKeys, zoneID)
+	// payload is re-encrypted as is, so compressed data stays compressed
+	decrypted, err := base.DecryptRotatedAcrastructPayload(acrastruct, privateKeys, zoneID)
 	if err != nil {
 		logger.WithField("acrastruct", hex.EncodeToString(acrastruct)).WithError(err).Errorln("Can't decrypt AcraStruct")
 		return nil, err
 	}
+	decrypted = withRotationTimestamp(decrypted)
 	defer utils.ZeroizeBytes(decrypted)
 	publicKey, err := rotator.getRotatedPublicKey(zoneID)
 	if err != nil {
@@ -79,6 +101,18 @@ func (rotator *keyRotator) rotateAcrastructWithZone(zoneID, acrastruct []byte) (
 	return rotated, nil
 }
 
+// withRotationTimestamp replaces creation time in payload of AcraStruct created with timestamp by time of rotation,
+// because rotated AcraStruct is encrypted anew and its age limited by max_age of encryptor config starts again
+func withRotationTimestamp(payload []byte) []byte {
+	data, created := base.SplitCreationTimestamp(payload)
+	if created.IsZero() {
+		return payload
+	}
+	timestamped := base.AddCreationTimestamp(data, time.Now())
+	utils.ZeroizeBytes(payload)
+	return timestamped
+}
+
 func (rotator *keyRotator) rotateAcrastruct(id, acrastruct []byte) ([]byte, error) {
 	if rotator.zoneMode {
 		return rotator.rotateAcrastructWithZone(id, acrastruct)
@@ -96,11 +130,13 @@ func (rotator *keyRotator) rotateAcrastructWithClientID(clientID, acrastruct []b
 		return nil, err
 	}
 	defer utils.ZeroizePrivateKeys(privateKeys)
-	decrypted, err := base.DecryptRotatedAcrastruct(acrastruct, privateKeys, nil)
+	// payload is re-encrypted as is, so compressed data stays compressed
+	decrypted, err := base.DecryptRotatedAcrastructPayload(acrastruct, privateKeys, nil)
 	if err != nil {
 		logger.WithField("acrastruct", hex.EncodeToString(acrastruct)).WithError(err).Errorln("Can't decrypt AcraStruct")
 		return nil, err
 	}
+	decrypted = withRotationTimestamp(decrypted)
 	defer utils.ZeroizeBytes(decrypted)
 	publicKey, err := rotator.getRotatedPublicKey(clientID)
 	if err != nil {
@@ -122,6 +158,8 @@ func (rotator *keyRotator) saveRotatedKey(id []byte, keypair *keys.Keypair) erro
 	return rotator.keystore.SaveDataEncryptionKeys(id, keypair)
 }
 
+// saveRotatedKeys replaces current keys with new ones, previous keys are kept archived by keystore, so AcraStructs
+// which weren't rotated can be decrypted and rotation can be rolled back
 func (rotator *keyRotator) saveRotatedKeys() error {
 	for id, keypair := range rotator.newKeypairs {
 		if err := rotator.saveRotatedKey([]byte(id), keypair); err != nil {
@@ -134,6 +172,29 @@ func (rotator *keyRotator) saveRotatedKeys() error {
 	return nil
 }
 
+// rotateKeys generates and saves new keys of keyIDs without re-encryption of data and prints their public keys
+func rotateKeys(keyIDs []string, store keystore.RotateStorageKeyStore, zoneMode, dryRun bool) bool {
+	rotator, err := newRotator(store, zoneMode, keyIDs)
+	if err != nil {
+		log.WithError(err).Errorln("Can't generate new keys")
+		return false
+	}
+	defer rotator.clearKeys()
+	if !dryRun {
+		if err := rotator.saveRotatedKeys(); err != nil {
+			log.WithError(err).Errorln("Can't save rotated keys")
+			return false
+		}
+	}
+	jsonOutput, err := rotator.marshal()
+	if err != nil {
+		log.WithError(err).Errorln("Can't encode to json")
+		return false
+	}
+	fmt.Println(string(jsonOutput))
+	return true
+}
+
 func (rotator *keyRotator) clearKeys() {
 	for _, keypair := range rotator.newKeypairs {
 		utils.ZeroizePrivateKey(keypair.Private)
@@ -0,0 +1,66 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// SQLQueryPair is select query which fetches AcraStructs with ClientId/ZoneId in last columns and update query which
+// saves rotated AcraStruct, like sql_select and sql_update parameters
+type SQLQueryPair struct {
+	Select string `json:"select"`
+	Update string `json:"update"`
+}
+
+// SQLQueryMap store queries of all tables with AcraStructs which are rotated with the same new keys
+type SQLQueryMap []SQLQueryPair
+
+// ErrIncorrectSQLMapFormat is the error when user pass sql map config with incorrect format
+var ErrIncorrectSQLMapFormat = errors.New("sql map config must have json format [{\"select\": selectQueryStr, \"update\": updateQueryStr}]")
+
+// ParseSQLQueryMap parse json config with pairs of select and update queries
+func ParseSQLQueryMap(configData []byte) (SQLQueryMap, error) {
+	decoder := json.NewDecoder(bytes.NewReader(configData))
+	decoder.DisallowUnknownFields()
+	var queryMap SQLQueryMap
+	if err := decoder.Decode(&queryMap); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrIncorrectSQLMapFormat, err)
+	}
+	if len(queryMap) == 0 {
+		return nil, ErrIncorrectSQLMapFormat
+	}
+	for i, pair := range queryMap {
+		if pair.Select == "" || pair.Update == "" {
+			return nil, fmt.Errorf("%w: select and update must be set both in item %d", ErrIncorrectSQLMapFormat, i)
+		}
+	}
+	return queryMap, nil
+}
+
+// loadSQLQueryMap read file with <path> and parse it as SQLQueryMap
+func loadSQLQueryMap(path string) (SQLQueryMap, error) {
+	configData, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseSQLQueryMap(configData)
+}
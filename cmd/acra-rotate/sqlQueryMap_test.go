@@ -0,0 +1,73 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestParseSQLQueryMap(t *testing.T) {
+	queryMap, err := ParseSQLQueryMap([]byte(`[
+		{"select": "select id, zone, data from t1", "update": "update t1 set data=$1 where id=$2"},
+		{"select": "select zone, data from t2", "update": "update t2 set data=$1"}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := SQLQueryMap{
+		{Select: "select id, zone, data from t1", Update: "update t1 set data=$1 where id=$2"},
+		{Select: "select zone, data from t2", Update: "update t2 set data=$1"},
+	}
+	if !reflect.DeepEqual(queryMap, expected) {
+		t.Fatalf("Expected %v, took %v", expected, queryMap)
+	}
+
+	invalidConfigs := []string{
+		`{"select": "select zone, data from t1", "update": "update t1 set data=$1"}`,
+		`[]`,
+		`[{"select": "select zone, data from t1"}]`,
+		`[{"select": "select zone, data from t1", "update": "update t1 set data=$1", "insert": "insert"}]`,
+	}
+	for _, config := range invalidConfigs {
+		if _, err := ParseSQLQueryMap([]byte(config)); !errors.Is(err, ErrIncorrectSQLMapFormat) {
+			t.Fatalf("Expected ErrIncorrectSQLMapFormat for %s, took %v", config, err)
+		}
+	}
+}
+
+func TestRotatorKeyIDs(t *testing.T) {
+	rotator, err := newRotator(nil, true, []string{"zone1", "zone2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rotator.clearKeys()
+	if len(rotator.newKeypairs) != 2 {
+		t.Fatalf("Expected new keys of listed ids, took %d keys", len(rotator.newKeypairs))
+	}
+	if !rotator.isRotated([]byte("zone1")) || rotator.isRotated([]byte("zone3")) {
+		t.Fatal("Rotated ids don't match listed ones")
+	}
+	rotator, err = newRotator(nil, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rotator.newKeypairs) != 0 || !rotator.isRotated([]byte("zone3")) {
+		t.Fatal("Expected rotation of any id without listed ones")
+	}
+}
@@ -33,30 +33,43 @@ package main
 import (
 	"context"
 	"crypto/tls"
+	"database/sql"
 	"flag"
 	"fmt"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
+	"path/filepath"
 	"strings"
 	"syscall"
 	"time"
 
+	acracensor "github.com/cossacklabs/acra/acra-censor"
+	censorCommon "github.com/cossacklabs/acra/acra-censor/common"
 	"github.com/cossacklabs/acra/cmd"
 	"github.com/cossacklabs/acra/cmd/acra-server/common"
 	"github.com/cossacklabs/acra/decryptor/base"
 	"github.com/cossacklabs/acra/decryptor/mysql"
 	"github.com/cossacklabs/acra/decryptor/postgresql"
+	"github.com/cossacklabs/acra/decryptor/relay"
+	"github.com/cossacklabs/acra/encryptor"
+	"github.com/cossacklabs/acra/featureflags"
 	"github.com/cossacklabs/acra/keystore"
 	"github.com/cossacklabs/acra/keystore/filesystem"
+	"github.com/cossacklabs/acra/keystore/kms"
 	keystoreV2 "github.com/cossacklabs/acra/keystore/v2/keystore"
+	"github.com/cossacklabs/acra/keystore/v2/keystore/api"
 	filesystemV2 "github.com/cossacklabs/acra/keystore/v2/keystore/filesystem"
 	"github.com/cossacklabs/acra/logging"
 	"github.com/cossacklabs/acra/network"
+	"github.com/cossacklabs/acra/notification"
 	"github.com/cossacklabs/acra/sqlparser"
 	mysqlDialect "github.com/cossacklabs/acra/sqlparser/dialect/mysql"
 	pgDialect "github.com/cossacklabs/acra/sqlparser/dialect/postgresql"
+	"github.com/cossacklabs/acra/standby"
 	"github.com/cossacklabs/acra/utils"
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -78,19 +91,40 @@ var defaultConfigPath = utils.GetConfigPathByName(ServiceName)
 
 const tlsAuthNotSet = -1
 
+// Storages of TLS session ticket keys
+const (
+	sessionTicketKeysStorageMemory   = "memory"
+	sessionTicketKeysStorageKeystore = "keystore"
+	// how often instances check keys stored in keystore for rotations of each other
+	sessionTicketKeysSyncInterval = time.Minute
+)
+
 func main() {
 	loggingFormat := flag.String("logging_format", "plaintext", "Logging format: plaintext, json or CEF")
+	loggingBackend := flag.String("logging_backend", logging.DefaultBackendName, "Logging backend: logrus or zap (zap requires build with \"-tags zap\")")
+	logQueryRedaction := flag.String("log_query_redaction", string(censorCommon.QueryLogRedactionStrip), "How literals of SQL queries are hidden in logs: 'strip' replaces them with placeholders, 'hash' replaces them with keyed hashes so equal values may be correlated in logs of one process. Comments of queries aren't logged")
 	dbHost := flag.String("db_host", "", "Host to db")
 	dbPort := flag.Int("db_port", 5432, "Port to db")
+	dbUnixSocket := flag.String("db_unix_socket", "", "Absolute path to unix socket of database (like /var/run/postgresql/.s.PGSQL.5432 or /var/run/mysqld/mysqld.sock) used instead of db_host/db_port")
+	dbSRVRecord := flag.String("db_srv_record", "", "DNS SRV record (like _postgresql._tcp.db.example.com) used to discover database address instead of db_host/db_port. Set tls_database_sni if database uses TLS")
+	dbSRVRefreshInterval := flag.Int("db_srv_refresh_interval", int(network.DefaultSRVRefreshInterval.Seconds()), "How often (in seconds) to re-resolve db_srv_record")
+	dbSRVDrainTimeout := flag.Int("db_srv_drain_timeout", int(network.DefaultSRVDrainTimeout.Seconds()), "Time (in seconds) to wait before closing connections to database hosts removed from db_srv_record")
 
 	prometheusAddress := flag.String("incoming_connection_prometheus_metrics_string", "", "URL (tcp://host:port) which will be used to expose Prometheus metrics (<URL>/metrics address to pull metrics)")
 
 	host := flag.String("incoming_connection_host", cmd.DefaultAcraServerHost, "Host for AcraServer")
 	port := flag.Int("incoming_connection_port", cmd.DefaultAcraServerPort, "Port for AcraServer")
 	apiPort := flag.Int("incoming_connection_api_port", cmd.DefaultAcraServerAPIPort, "Port for AcraServer for HTTP API")
+	proxyProtocolEnable := flag.Bool("proxy_protocol_enable", false, "Read PROXY protocol v1/v2 header from connections of proxies of proxy_protocol_trusted_cidrs (HAProxy, AWS NLB) to use real client address in logs")
+	proxyProtocolTrustedCIDRs := flag.String("proxy_protocol_trusted_cidrs", "", "Comma-separated list of networks (like 10.0.0.0/8) of proxies which must send PROXY protocol header. Addresses of other peers are used as is")
+	maxConnections := flag.Int("incoming_connection_max_connections", 0, "Max count of concurrent database connections from clients, new ones are rejected with 'too many connections' error. 0 - no limits")
+	connectionAddressRate := flag.Float64("incoming_connection_address_rate", 0, "Max count of new connections per second from one client IP address. 0 - no limits")
+	connectionHandshakeRate := flag.Float64("incoming_connection_handshake_rate", 0, "Max count of new connections per second from all clients which start TLS/Secure Session handshakes. 0 - no limits")
+	proxyProtocolDBEmit := flag.Bool("proxy_protocol_db_emit", false, "Send PROXY protocol v2 header with client address on connections to database (database or its proxy should expect it)")
 
 	keysDir := flag.String("keys_dir", keystore.DefaultKeyDirShort, "Folder from which will be loaded keys")
 	keysCacheSize := flag.Int("keystore_cache_size", keystore.InfiniteCacheSize, "Maximum number of keys stored in in-memory LRU cache in encrypted form. 0 - no limits, -1 - turn off cache")
+	keysHistoryLimit := flag.Int("keystore_historical_keys", keystore.AllHistoricalKeys, "Maximum number of rotated keys tried after the current one to decrypt data, from newest to oldest. -1 - all rotated keys, 0 - only current key (keystore v1 only)")
 
 	_ = flag.Bool("pgsql_hex_bytea", false, "Hex format for Postgresql bytea data (deprecated, ignored)")
 	flag.Bool("pgsql_escape_bytea", false, "Escape format for Postgresql bytea data (deprecated, ignored)")
@@ -99,6 +133,7 @@ func main() {
 
 	flag.Bool("acrastruct_wholecell_enable", true, "Acrastruct will stored in whole data cell")
 	injectedcell := flag.Bool("acrastruct_injectedcell_enable", false, "Acrastruct may be injected into any place of data cell")
+	inlineFallback := flag.Bool("acrastruct_wholecell_inline_fallback_enable", false, "In whole cell mode search AcraStructs inside data cells which aren't AcraStructs entirely, e.g. in results of views, CTEs and expressions computed from encrypted columns")
 
 	debugServer := flag.Bool("ds", false, "Turn on HTTP debug server")
 	closeConnectionTimeout := flag.Int("incoming_connection_close_timeout", defaultAcraserverWaitTimeout, "Time that AcraServer will wait (in seconds) on restart before closing all connections")
@@ -106,6 +141,8 @@ func main() {
 	detectPoisonRecords := flag.Bool("poison_detect_enable", true, "Turn on poison record detection, if server shutdown is disabled, AcraServer logs the poison record detection and returns decrypted data")
 	stopOnPoison := flag.Bool("poison_shutdown_enable", false, "On detecting poison record: log about poison record detection, stop and shutdown")
 	scriptOnPoison := flag.String("poison_run_script_file", "", "On detecting poison record: log about poison record detection, execute script, return decrypted data")
+	notificationConfig := flag.String("notification_config_file", "", "Path to configuration of notification channels (Slack, PagerDuty, email) and routing of poison record, certificate expiry and anomaly events")
+	certificateExpiryThreshold := flag.Int("notification_certificate_expiry_days", int(notification.DefaultCertificateExpiryThreshold.Hours()/24), "Send certificate_expiry notifications when TLS certificates expire in less than this number of days")
 
 	withZone := flag.Bool("zonemode_enable", false, "Turn on zone mode")
 	enableHTTPAPI := flag.Bool("http_api_enable", false, "Enable HTTP API")
@@ -127,40 +164,152 @@ func main() {
 	tlsDbKey := flag.String("tls_database_key", "", "Path to private key of the TLS certificate used to connect to database (see \"tls_database_cert\")")
 	tlsUseClientIDFromCertificate := flag.Bool("tls_client_id_from_cert", false, "Extract clientID from TLS certificate. Take TLS certificate from AcraConnector's connection if acraconnector_tls_transport_enable is TRUE; otherwise take TLS certificate from application's connection if acraconnector_transport_encryption_disable is TRUE")
 	tlsIdentifierExtractorType := flag.String("tls_identifier_extractor_type", network.IdentifierExtractorTypeDistinguishedName, fmt.Sprintf("Decide which field of TLS certificate to use as ClientID (%s)", strings.Join(network.IdentifierExtractorTypesList, "|")))
-	tlsOcspURL := flag.String("tls_ocsp_url", "", "OCSP service URL")
-	tlsOcspClientURL := flag.String("tls_ocsp_client_url", "", "OCSP service URL, for client/connector certificates only")
-	tlsOcspDbURL := flag.String("tls_ocsp_database_url", "", "OCSP service URL, for database certificates only")
+	tlsOcspURL := flag.String("tls_ocsp_url", "", "OCSP service URL. Comma-separated list of responders <url>[;priority=<number>][;role=required|advisory] is accepted: responders with greater priority are backups queried only if previous ones didn't respond, advisory responders can only deny revoked certificates, required ones should know the certificate")
+	tlsOcspClientURL := flag.String("tls_ocsp_client_url", "", "OCSP service URL, for client/connector certificates only. Accepts list of responders like tls_ocsp_url")
+	tlsOcspDbURL := flag.String("tls_ocsp_database_url", "", "OCSP service URL, for database certificates only. Accepts list of responders like tls_ocsp_url")
 	tlsOcspRequired := flag.String("tls_ocsp_required", network.OcspRequiredDenyUnknownStr,
 		fmt.Sprintf("How to treat certificates unknown to OCSP: <%s>", strings.Join(network.OcspRequiredValuesList, "|")))
+	tlsOcspClientRequired := flag.String("tls_ocsp_client_required", "", "How to treat certificates unknown to OCSP, for client/connector certificates only. Overrides \"tls_ocsp_required\"")
+	tlsOcspDbRequired := flag.String("tls_ocsp_database_required", "", "How to treat certificates unknown to OCSP, for database certificates only. Overrides \"tls_ocsp_required\"")
 	tlsOcspFromCert := flag.String("tls_ocsp_from_cert", network.OcspFromCertPreferStr,
 		fmt.Sprintf("How to treat OCSP server described in certificate itself: <%s>", strings.Join(network.OcspFromCertValuesList, "|")))
+	tlsOcspClientFromCert := flag.String("tls_ocsp_client_from_cert", "", "How to treat OCSP server described in certificate itself, for client/connector certificates only. Overrides \"tls_ocsp_from_cert\"")
+	tlsOcspDbFromCert := flag.String("tls_ocsp_database_from_cert", "", "How to treat OCSP server described in certificate itself, for database certificates only. Overrides \"tls_ocsp_from_cert\"")
 	tlsOcspCheckOnlyLeafCertificate := flag.Bool("tls_ocsp_check_only_leaf_certificate", false, "Put 'true' to check only final/last certificate, or 'false' to check the whole certificate chain using OCSP")
+	tlsOcspQueryTimeout := flag.Uint("tls_ocsp_query_timeout", uint(network.OcspHttpClientDefaultTimeout/time.Second), "Timeout of each OCSP query, in seconds")
+	tlsOcspVerifyTimeout := flag.Uint("tls_ocsp_verify_timeout", uint(network.OcspDefaultVerifyTimeout/time.Second), "Deadline of all OCSP queries made to verify certificate chain, in seconds. Servers that don't respond in time are treated as unavailable")
+	tlsOcspClientTimeout := flag.Uint("tls_ocsp_client_timeout", uint(network.OcspHttpClientDefaultTimeout/time.Second), "Timeout of each HTTP request to OCSP server including connection, in seconds")
+	tlsOcspHTTPProxy := flag.String("tls_ocsp_http_proxy", "", "URL of HTTP proxy for OCSP queries (default - proxy from HTTP_PROXY/HTTPS_PROXY/NO_PROXY environment variables)")
+	tlsOcspCABundle := flag.String("tls_ocsp_ca_bundle", "", "Path to PEM file with CA certificates to verify OCSP servers with HTTPS URLs (default - system root certificates)")
+	tlsOcspRetryCount := flag.Uint("tls_ocsp_retry_count", 0, "How many times to retry OCSP requests failed with network errors or 5xx HTTP statuses, within tls_ocsp_query_timeout")
+	tlsOcspForcePOST := flag.Bool("tls_ocsp_force_post", false, "Send OCSP requests only with POST method. By default short requests are sent with GET method, which may be cached by CDNs and HTTP caches")
+	tlsOcspNonce := flag.String("tls_ocsp_nonce", network.OcspNonceNoneStr,
+		fmt.Sprintf("Whether to add nonce to OCSP requests to prevent replay of old responses: <%s>. Requests with nonce aren't cached by HTTP caches", strings.Join(network.OcspNonceValuesList, "|")))
+	tlsOcspClockSkew := flag.Uint("tls_ocsp_clock_skew", uint(network.OcspDefaultClockSkew/time.Second), "Tolerance of clock difference with OCSP server, in seconds. Responses produced later than now, or with NextUpdate earlier than now, by more than this value are denied")
+	tlsVerifiers := flag.String("tls_verifiers", network.DefaultCertVerifiers, "Comma-separated list of verifiers of peer certificates in order they run: <ocsp|crl|allowlist|script>. ocsp and crl run only if enabled by their settings")
+	tlsVerifiersMode := flag.String("tls_verifiers_mode", network.CertVerifierModeAll, "How to combine results of tls_verifiers: <all|any>. 'all' requires every verifier to accept the certificate, 'any' requires at least one")
+	tlsVerifiersClient := flag.String("tls_verifiers_client", "", "Verifiers of client/connector certificates. Overrides \"tls_verifiers\"")
+	tlsVerifiersDb := flag.String("tls_verifiers_database", "", "Verifiers of database certificates. Overrides \"tls_verifiers\"")
+	tlsVerifiersModeClient := flag.String("tls_verifiers_mode_client", "", "How to combine results of verifiers of client/connector certificates. Overrides \"tls_verifiers_mode\"")
+	tlsVerifiersModeDb := flag.String("tls_verifiers_mode_database", "", "How to combine results of verifiers of database certificates. Overrides \"tls_verifiers_mode\"")
+	tlsCertAllowlistFile := flag.String("tls_cert_allowlist_file", "", "Path to file with SHA-256 fingerprints of allowed peer certificates, one per line, used by 'allowlist' verifier")
+	tlsVerifierScript := flag.String("tls_verifier_script", "", "Path to executable used by 'script' verifier, it reads PEM certificates of the peer from stdin and accepts the peer with zero exit code")
+	tlsPinnedSPKI := flag.String("tls_pinned_spki", "", "Comma-separated list of base64 SHA-256 hashes of SubjectPublicKeyInfo of allowed peer certificates. Peers without pinned public key are rejected even if their certificate is issued by trusted CA")
+	tlsPinnedSPKIClient := flag.String("tls_pinned_spki_client", "", "Pinned SPKI hashes, for client/connector certificates only. Accepts list like tls_pinned_spki")
+	tlsPinnedSPKIDb := flag.String("tls_pinned_spki_database", "", "Pinned SPKI hashes, for database certificates only. Accepts list like tls_pinned_spki")
+	tlsPinnedSPKIMatchChain := flag.Bool("tls_pinned_spki_match_chain", false, "Put 'true' to accept peer if any certificate of verified chain (like intermediate or root CA) matches pinned SPKI hashes, or 'false' to match only leaf certificate")
 	tlsCrlURL := flag.String("tls_crl_url", "", "URL of the Certificate Revocation List (CRL) to use")
 	tlsCrlClientURL := flag.String("tls_crl_client_url", "", "URL of the Certificate Revocation List (CRL) to use, for client/connector certificates only")
 	tlsCrlDbURL := flag.String("tls_crl_database_url", "", "URL of the Certificate Revocation List (CRL) to use, for database certificates only")
 	tlsCrlFromCert := flag.String("tls_crl_from_cert", network.CrlFromCertPreferStr,
 		fmt.Sprintf("How to treat CRL URL described in certificate itself: <%s>", strings.Join(network.CrlFromCertValuesList, "|")))
+	tlsCrlClientFromCert := flag.String("tls_crl_client_from_cert", "", "How to treat CRL URL described in certificate itself, for client/connector certificates only. Overrides \"tls_crl_from_cert\"")
+	tlsCrlDbFromCert := flag.String("tls_crl_database_from_cert", "", "How to treat CRL URL described in certificate itself, for database certificates only. Overrides \"tls_crl_from_cert\"")
 	tlsCrlCheckOnlyLeafCertificate := flag.Bool("tls_crl_check_only_leaf_certificate", false, "Put 'true' to check only final/last certificate, or 'false' to check the whole certificate chain using CRL")
 	tlsCrlCacheSize := flag.Uint("tls_crl_cache_size", network.CrlDefaultCacheSize, "How many CRLs to cache in memory (use 0 to disable caching)")
 	tlsCrlCacheTime := flag.Uint("tls_crl_cache_time", network.CrlDisableCacheTime,
 		fmt.Sprintf("How long to keep CRLs cached, in seconds (use 0 to disable caching, maximum: %d s)", network.CrlCacheTimeMax))
+	tlsRevocationVerdictCacheTime := flag.Uint("tls_revocation_verdict_cache_time", network.RevocationVerdictDisableCacheTime, "How long to reuse results of OCSP/CRL checks of client certificate for next and resumed TLS sessions of the same client, in seconds (use 0 to check on every handshake)")
+	tlsVerifyLatencyBudget := flag.Uint("tls_verify_latency_budget", 0, "Maximum time (in milliseconds) TLS handshake waits for tls_verifiers (OCSP/CRL queries, script). Slower verification continues in background, the peer is accepted (rejected if tls_ocsp_required is requireGood) and its next handshake gets the verdict (0 - wait until verification finishes)")
+	tlsVerifyDeferredTimeout := flag.Uint("tls_verify_deferred_timeout", uint(network.DefaultDeferredVerificationTimeout/time.Second), "Deadline (in seconds) of certificate verification continued in background after tls_verify_latency_budget, peer is rejected on next handshake if it's exceeded")
+	tlsPolicyProfile := flag.String("tls_policy", network.DefaultTLSPolicy, "Profile of TLS versions and cipher suites of connections with AcraConnector/clients and database: <modern|intermediate|fips>. 'modern' allows only TLS 1.3, 'intermediate' - TLS 1.2 with ECDHE AEAD cipher suites and TLS 1.3, 'fips' - TLS 1.2 with ECDHE AES-GCM cipher suites on NIST curves")
+	tlsPolicyClientProfile := flag.String("tls_policy_client", "", "Profile of TLS versions and cipher suites of connections with AcraConnector/clients. Overrides \"tls_policy\"")
+	tlsPolicyDbProfile := flag.String("tls_policy_database", "", "Profile of TLS versions and cipher suites of connections with database. Overrides \"tls_policy\"")
+	tlsMinVersion := flag.String("tls_min_version", "", "Minimal TLS version (1.0, 1.1, 1.2 or 1.3), overrides version of tls_policy")
+	tlsMaxVersion := flag.String("tls_max_version", "", "Maximal TLS version (1.0, 1.1, 1.2 or 1.3), overrides version of tls_policy")
+	tlsCipherSuites := flag.String("tls_cipher_suites", "", "Comma-separated list of IANA names of cipher suites (like TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256) of TLS 1.0-1.2, overrides cipher suites of tls_policy. Cipher suites of TLS 1.3 aren't configurable")
+	tlsRevocationVerdictCacheSize := flag.Uint("tls_revocation_verdict_cache_size", network.RevocationVerdictDefaultCacheSize, "How many results of OCSP/CRL checks of client certificates to cache in memory")
+	standbyPairEnable := flag.Bool("standby_pair_enable", false, "Run as node of active/standby pair: standby node accepts connections only after active node stops heartbeats, TLS session ticket keys and revocation verdicts are synced via standby_shared_dir")
+	standbySharedDir := flag.String("standby_shared_dir", "", "Directory shared by both nodes of standby pair (like NFS volume) where lease with heartbeats and state encrypted with master key are stored")
+	standbyNodeID := flag.String("standby_node_id", "", "Unique ID of node in standby pair (default - hostname)")
+	standbyHeartbeatInterval := flag.Int("standby_heartbeat_interval", int(standby.DefaultHeartbeatInterval.Seconds()), "Time (in seconds) between heartbeats and state syncs of standby pair")
+	standbyFailoverTimeout := flag.Int("standby_failover_timeout", int(standby.DefaultFailoverTimeout.Seconds()), "Time (in seconds) without heartbeats of active node after which standby node takes over")
+	tlsOcspStaplingEnable := flag.Bool("tls_ocsp_stapling_enable", false, "Staple OCSP responses for own TLS certificate (\"tls_client_cert\" or \"tls_cert\") into handshakes with clients/connectors. Certificate file should contain issuer certificate after leaf one")
+	tlsOcspStaplingURL := flag.String("tls_ocsp_stapling_url", "", "OCSP service URL to query responses for stapling (default - first OCSP server listed in own certificate)")
+	tlsOcspStaplingRefreshInterval := flag.Int("tls_ocsp_stapling_refresh_interval", int(network.DefaultOCSPStaplingRefreshInterval.Seconds()), "Time (in seconds) between refreshes of stapled OCSP response, response is refreshed earlier if it expires sooner")
+	tlsReloadInterval := flag.Int("tls_reload_interval", 0, "Time (in seconds) between checks of TLS certificate, key and CA files for changes, changed files are reloaded for new connections without restart. 0 disables checks, files are reloaded on SIGUSR1 anyway")
+	tlsSpiffeSocket := flag.String("tls_spiffe_workload_api_socket", "", "Path to unix socket of SPIFFE Workload API (like SPIRE agent). If set, TLS certificate and CA bundle for connections with clients/connectors are fetched as X.509 SVID and rotated without restart instead of tls_* files, peers are verified by SPIFFE ID")
+	tlsSpiffeTrustDomain := flag.String("tls_spiffe_trust_domain", "", "SPIFFE trust domain of own and peer SVIDs (required with tls_spiffe_workload_api_socket)")
+	tlsSpiffeAllowedIDs := flag.String("tls_spiffe_allowed_ids", "", "Comma-separated list of SPIFFE IDs of clients/connectors allowed to connect (default - any SPIFFE ID of tls_spiffe_trust_domain)")
+	tlsSessionTicketsEnable := flag.Bool("tls_session_tickets_enable", true, "Issue TLS session tickets to clients/connectors, so they resume TLS sessions without full handshake")
+	tlsSessionTicketKeysStorage := flag.String("tls_session_ticket_keys_storage", sessionTicketKeysStorageMemory, "Storage of TLS session ticket keys: 'memory' - random keys of process (synced via standby_shared_dir with standby_pair_enable), 'keystore' - keys encrypted with master key in keys_dir, shared by all instances which use the same keystore directory")
+	tlsSessionTicketKeyRotationInterval := flag.Int("tls_session_ticket_key_rotation_interval", int(network.DefaultSessionTicketKeyRotationInterval.Seconds()), "Time (in seconds) between rotations of TLS session ticket keys shared by standby pair or stored in keystore")
+	tlsDbSessionCacheSize := flag.Int("tls_database_session_cache_size", 0, "Count of TLS sessions with database cached to resume them without full handshake. 0 - sessions aren't resumed")
+	connectorMultiplexing := flag.Bool("acraconnector_multiplexing_enable", false, "Accept multiplexed sessions from AcraConnector which carry many client connections over one connection (AcraConnector started with acraserver_multiplexing_enable). Plain connections from AcraConnector are accepted too")
 	noEncryptionTransport := flag.Bool("acraconnector_transport_encryption_disable", false, "Use raw transport (tcp/unix socket) between AcraServer and AcraConnector/client (don't use this flag if you not connect to database with SSL/TLS")
 	clientID := flag.String("client_id", "", "Expected client ID of AcraConnector in mode without encryption")
+	unixSocketClientIDs := flag.String("unix_socket_client_ids", "", "Comma-separated list of <uid>:<client_id> pairs to identify clients connected over unix socket by uid of their process (SO_PEERCRED, Linux only) in mode without encryption. Connections of other uids are rejected, TCP connections use client_id")
 	acraConnectionString := flag.String("incoming_connection_string", network.BuildConnectionString(cmd.DefaultAcraServerConnectionProtocol, cmd.DefaultAcraServerHost, cmd.DefaultAcraServerPort, ""), "Connection string like tcp://x.x.x.x:yyyy or unix:///path/to/socket")
 	acraAPIConnectionString := flag.String("incoming_connection_api_string", network.BuildConnectionString(cmd.DefaultAcraServerConnectionProtocol, cmd.DefaultAcraServerHost, cmd.DefaultAcraServerAPIPort, ""), "Connection string for api like tcp://x.x.x.x:yyyy or unix:///path/to/socket")
 	authPath = flag.String("auth_keys", cmd.DefaultAcraServerAuthPath, "Path to basic auth passwords. To add user, use: `./acra-authmanager --set --user <user> --pwd <pwd>`")
 
 	useMysql := flag.Bool("mysql_enable", false, "Handle MySQL connections")
 	usePostgresql := flag.Bool("postgresql_enable", false, "Handle Postgresql connections (default true)")
+	protocolDetection := flag.Bool("db_protocol_detection_enable", false, "Detect protocol of each connection and handle both PostgreSQL (proxied to db_host/db_port) and MySQL (proxied to mysql_db_host/mysql_db_port) on one port. Not compatible with encryptor_config_file and acracensor_config_file")
+	protocolDetectionTimeout := flag.Int("db_protocol_detection_timeout_ms", int(base.DefaultProtocolDetectionTimeout/time.Millisecond), "Time (in milliseconds) to wait for PostgreSQL startup packet before connection is handled as MySQL")
+	mysqlDBHost := flag.String("mysql_db_host", "", "Host of MySQL database used with db_protocol_detection_enable")
+	mysqlDBPort := flag.Int("mysql_db_port", 3306, "Port of MySQL database used with db_protocol_detection_enable")
+	mysqlDBUnixSocket := flag.String("mysql_db_unix_socket", "", "Absolute path to unix socket of MySQL database used with db_protocol_detection_enable instead of mysql_db_host/mysql_db_port")
+	mysqlCapabilitiesAction := flag.String("mysql_uninspectable_capabilities_action", string(mysql.CapabilitiesActionStrip), "Action on MySQL protocol extensions which AcraServer can't inspect (compression including zstd): 'strip' removes them from server greeting and client handshake so connections fall back to plain protocol, 'reject' closes connections of clients which request them, 'allow' passes them as is, so queries and results of such connections may bypass processing")
+	sessionIdentitySource := flag.String("db_session_identity", "", "Export identity of client into its database session, so database auditing attributes queries to clients instead of database user of AcraServer: 'client_id' or identifier of verified client certificate ('"+strings.Join(network.IdentifierExtractorTypesList, "', '")+"'). Empty value turns off export")
+	postgresqlSessionIdentityParameter := flag.String("postgresql_session_identity_parameter", postgresql.DefaultSessionIdentityParameter, "PostgreSQL startup parameter set to identity of client, e.g. custom setting 'acra.client_id' readable with current_setting(). Used with db_session_identity")
+	mysqlSessionIdentityAttribute := flag.String("mysql_session_identity_attribute", mysql.DefaultSessionIdentityAttribute, "MySQL connection attribute set to identity of client, shown in performance_schema.session_connect_attrs. Used with db_session_identity")
+	idleInTransactionTimeout := flag.Int("db_idle_in_transaction_timeout", 0, "Time (in seconds) client sessions may stay idle inside open transaction holding its locks, sessions which exceed it are reported or terminated according to db_idle_in_transaction_action. 0 disables the check")
+	idleInTransactionAction := flag.String("db_idle_in_transaction_action", base.IdleInTransactionActionLog, "Action on sessions idle in transaction longer than db_idle_in_transaction_timeout: 'log' logs them and increments metric, 'terminate' also closes connections of client and database, so the database rolls back the transaction")
+	featureFlagsFile := flag.String("feature_flags_file", "", "Path to YAML or JSON file with rules of feature flags which gate new behaviors for percentage of sessions or listed client IDs, e.g. 'idle_in_transaction_terminate'")
+	featureFlagsURL := flag.String("feature_flags_url", "", "URL of HTTP(S) endpoint returning rules of feature flags in the same format as feature_flags_file, used instead of it")
+	featureFlagsReloadInterval := flag.Int("feature_flags_reload_interval", 30, "Interval (in seconds) of reloading rules of feature flags, they are also reloaded on SIGUSR1. 0 disables periodic reloads")
+	requestTimeout := flag.Int("request_timeout", 0, "Time (in seconds) to process each data row of database responses, connections which exceed it are closed. 0 means no limit")
+	pipelineQueueSize := flag.Int("db_pipeline_queue_size", 0, "Size of queues between stages of processing of PostgreSQL packets (read, censor/decrypt, write) which run concurrently, so slow clients or database stop reading of packets when queues are full. 0 - packets are processed one by one")
+	maxPacketSize := flag.Int("db_max_packet_size", base.DefaultMaxPacketSize, "Max size (in bytes) of packets from clients and database, connections which send larger packets are closed")
 	censorConfig := flag.String("acracensor_config_file", "", "Path to AcraCensor configuration file")
 
 	encryptorConfig := flag.String("encryptor_config_file", "", "Path to Encryptor configuration file")
+	contextConfusionAction := flag.String("encryptor_context_confusion_action", string(encryptor.ContextConfusionActionOff), "Action on AcraStructs decrypted with zone or client id which doesn't match encryptor config of their columns, e.g. copied from another column: 'flag' logs them and increments metric, 'block' also returns them encrypted, 'off' disables the check. Requires encryptor_config_file and whole cell mode")
+	maxAgeAction := flag.String("encryptor_max_age_action", string(encryptor.MaxAgeActionBlock), "Action on AcraStructs older than max_age of their columns in encryptor config: 'block' returns them encrypted, 'flag' logs them and increments metric but returns decrypted, 'off' disables the check. Checked only in whole cell mode")
+	ciphertextSizeAction := flag.String("encryptor_max_ciphertext_size_action", string(encryptor.CiphertextSizeActionError), "Action on encrypted values larger than max_ciphertext_size of their columns in encryptor config, checked before values are read from database response: 'error' returns error instead of response (PostgreSQL connection is closed because previous rows may be already sent), 'pass' returns them as is without decryption")
+	decryptionScheduleConfig := flag.String("decryption_schedule_config_file", "", "Path to configuration file with cron-like time windows when clients or columns may be decrypted, values decrypted outside of them are returned masked. Requires whole cell mode, rules of columns require encryptor_config_file")
+	decryptionPurposeConfig := flag.String("decryption_purpose_config_file", "", "Path to configuration file with purposes of sessions (set by PostgreSQL startup parameter or signed comment of query) allowed to decrypt columns, other values are returned masked. Requires whole cell mode and encryptor_config_file")
+	relayEnable := flag.Bool("relay_enable", false, "Relay data of arbitrary protocol between clients and service at db_host/db_port without parsing it, only TLS of clients (with --acraconnector_tls_transport_enable) and of service is handled. Not compatible with database specific options")
+	relayTLSOrigination := flag.Bool("relay_tls_origination_enable", false, "Connect to service with TLS using tls_database_* parameters in relay mode")
+	tenantIsolationConfig := flag.String("tenant_isolation_config_file", "", "Path to configuration file with tenant columns of tables and tenants of client ids. Predicates on tenant columns are added to SELECT, UPDATE and DELETE queries of these clients so they access only rows of their tenants, queries which can't be scoped are rejected")
+	accessHeatmapEnable := flag.Bool("access_heatmap_enable", false, "Aggregate count of decryptions of encrypted columns per client, returned by HTTP API /getAccessHeatmap. Requires encryptor_config_file and whole cell mode")
+	accessHeatmapBucketSize := flag.Int("access_heatmap_bucket_size", int(encryptor.DefaultAccessHeatmapBucketSize/time.Second), "Time (in seconds) aggregated in one bucket of access heatmap")
+	accessHeatmapRetention := flag.Int("access_heatmap_retention", int(encryptor.DefaultAccessHeatmapRetention/time.Second), "Time (in seconds) during which buckets of access heatmap are stored")
+	accessHeatmapExportFile := flag.String("access_heatmap_export_file", "", "Path to file where access heatmap is periodically written as JSON. Disabled if empty")
+	accessHeatmapExportInterval := flag.Int("access_heatmap_export_interval", int(encryptor.DefaultAccessHeatmapExportInterval/time.Second), "Time (in seconds) between writes of access_heatmap_export_file")
+	replicationConfig := flag.String("postgresql_replication_config_file", "", "Path to configuration file with columns to decrypt or re-encrypt in PostgreSQL logical replication streams (pgoutput)")
+	largeObjectEncryption := flag.Bool("postgresql_large_object_encryption_enable", false, "Encrypt data of PostgreSQL large objects written with lo_write and decrypt data read with lo_read")
+	largeObjectChunkSize := flag.Int("postgresql_large_object_chunk_size", postgresql.DefaultLargeObjectChunkSize, "Size of plaintext chunks of PostgreSQL large objects encrypted as separate AcraStructs. Reads and seeks should be aligned to it")
+	postgresqlCredentialsConfig := flag.String("postgresql_credentials_config_file", "", "Path to configuration file with PostgreSQL user and password per client ID. AcraServer replaces user and database of clients with them and authenticates to the database itself, so clients don't know passwords of the database")
+	postgresqlCredentialsRefreshInterval := flag.Int("postgresql_credentials_refresh_interval", int(postgresql.DefaultCredentialsRefreshInterval.Seconds()), "Time (in seconds) between refreshes of PostgreSQL credentials stored in Vault or AWS Secrets Manager, if secret backend doesn't tell when they expire or rotate")
+	postgresqlCredentialsDrainTimeout := flag.Int("postgresql_credentials_drain_timeout", int(postgresql.DefaultCredentialsDrainTimeout.Seconds()), "Time (in seconds) to wait before closing connections authenticated with rotated PostgreSQL credentials, clients reconnect with new ones")
+	postgresqlErrorFieldsStrip := flag.String("postgresql_error_fields_strip", "", fmt.Sprintf("Comma-separated groups of fields removed from PostgreSQL errors and notices forwarded to clients: <%s>. 'source' is source file, line and routine revealing server version, 'internal_query' is text and context of internal queries", strings.Join(postgresql.ErrorFieldsList, "|")))
+	shadowDBConnectionString := flag.String("shadow_db_connection_string", "", "Connection string of shadow database (PostgreSQL URL or MySQL DSN) where INSERT, UPDATE and DELETE queries are duplicated after encryption to validate migrations. Disabled if empty")
+	shadowWriteQueueSize := flag.Int("shadow_write_queue_size", 1000, "Max number of write queries waiting for execution on shadow database, new queries are dropped when queue is full")
+	canaryConnectionString := flag.String("canary_db_connection_string", "", "Connection string (PostgreSQL URL or MySQL DSN) to listener of this AcraServer used to read canary row and check that it's decrypted. Results are exported as metrics and served as readiness probe on <incoming_connection_prometheus_metrics_string>/ready. Disabled if empty")
+	canaryQuery := flag.String("canary_query", "", "Query which returns one encrypted canary value, e.g. SELECT data FROM acra_canary WHERE id=1")
+	canaryExpectedValue := flag.String("canary_expected_value", "", "Plaintext of canary value returned by canary_query")
+	canaryCheckInterval := flag.Int("canary_check_interval", 10, "Time (in seconds) between canary decryption checks")
+	canaryCheckTimeout := flag.Int("canary_check_timeout", 5, "Time (in seconds) to wait for result of canary_query")
 
 	cmd.RegisterTracingCmdParameters()
 	cmd.RegisterJaegerCmdParameters()
+	cmd.RegisterKeystoreBundleCmdParameters()
+	cmd.RegisterKeystoreVaultCmdParameters()
+	cmd.RegisterKeystoreRedisCmdParameters()
+	cmd.RegisterKeystoreAWSKMSCmdParameters()
+	cmd.RegisterKeystorePKCS11CmdParameters()
+	cmd.RegisterKeystorePrivateKeysCacheCmdParameters()
+	cmd.RegisterKeyIntegrityScanCmdParameters()
+	cmd.RegisterStartupRetryCmdParameters()
+	cmd.RegisterKubernetesSidecarCmdParameters()
+	cmd.RegisterRandomSourceCmdParameters()
 
 	verbose := flag.Bool("v", false, "Log to stderr all INFO, WARNING and ERROR logs")
 	debug := flag.Bool("d", false, "Log everything to stderr")
+	decryptionDiagnosticsClientIDs := flag.String("decryption_diagnostics_client_ids", "", "Comma-separated list of client IDs for which stage of decryption failures is logged (requires -v or -d). Keys and decrypted data are never logged")
+	decryptionDiagnosticsDuration := flag.Int("decryption_diagnostics_duration", int(base.DefaultDecryptionDiagnosticsDuration.Seconds()), "Time (in seconds) after start during which diagnostics for decryption_diagnostics_client_ids is enabled")
 
 	err := cmd.Parse(defaultConfigPath, ServiceName)
 	if err != nil {
@@ -172,7 +321,11 @@ func main() {
 	// Start customizing logs here (directly after command line arguments parsing)
 	formatter := logging.CreateFormatter(*loggingFormat)
 	formatter.SetServiceName(ServiceName)
-	log.SetOutput(os.Stderr)
+	if _, err := logging.SetBackend(*loggingBackend, *loggingFormat, ServiceName, os.Stderr); err != nil {
+		log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+			Errorln("Configuration error: can't set logging backend")
+		os.Exit(1)
+	}
 
 	log.WithField("version", utils.VERSION).Infof("Starting service %v [pid=%v]", ServiceName, os.Getpid())
 
@@ -187,7 +340,39 @@ func main() {
 	cmd.SetupTracing(ServiceName)
 
 	log.Infof("Validating service configuration...")
+	cmd.LogHardwareAESSupport()
 	cmd.ValidateClientID(*secureSessionID)
+	if err := cmd.InitRandomSource(); err != nil {
+		log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorRandomSource).
+			Errorln("Can't initialize random source")
+		os.Exit(1)
+	}
+	queryLogRedaction, err := censorCommon.ParseQueryLogRedaction(*logQueryRedaction)
+	if err != nil {
+		log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+			Errorln("Invalid --log_query_redaction")
+		os.Exit(1)
+	}
+	if err := censorCommon.SetQueryLogRedaction(queryLogRedaction); err != nil {
+		log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorRandomSource).
+			Errorln("Can't generate key for hashes of logged queries")
+		os.Exit(1)
+	}
+	if cmd.IsKubernetesSidecarEnabled() {
+		if *clientID != "" {
+			log.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+				Errorln("--client_id can't be used with --kubernetes_sidecar_enable")
+			os.Exit(1)
+		}
+		sidecarClientID, err := cmd.GetKubernetesSidecarClientID()
+		if err != nil {
+			log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+				Errorln("Can't derive client ID from Kubernetes pod identity")
+			os.Exit(1)
+		}
+		cmd.ValidateClientID(sidecarClientID)
+		*clientID = sidecarClientID
+	}
 
 	config.SetAcraConnectionString(*acraConnectionString)
 	if *host != cmd.DefaultAcraServerHost || *port != cmd.DefaultAcraServerPort {
@@ -198,13 +383,62 @@ func main() {
 		config.SetAcraAPIConnectionString(network.BuildConnectionString("tcp", *host, *apiPort, ""))
 	}
 
-	if *dbHost == "" {
+	if *dbHost == "" && *dbSRVRecord == "" && *dbUnixSocket == "" {
 		log.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
-			Errorln("db_host is empty: you must specify db_host")
+			Errorln("db_host is empty: you must specify db_host, db_srv_record or db_unix_socket")
 		flag.Usage()
 		os.Exit(1)
 	}
 	config.SetDBConnectionSettings(*dbHost, *dbPort)
+	for _, socket := range []string{*dbUnixSocket, *mysqlDBUnixSocket} {
+		if socket != "" && !filepath.IsAbs(socket) {
+			log.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+				Errorf("Configuration error: path to unix socket of database %s should be absolute", socket)
+			os.Exit(1)
+		}
+	}
+	if *dbUnixSocket != "" {
+		config.SetDBUnixSocket(*dbUnixSocket)
+		log.WithField("path", *dbUnixSocket).Infoln("Use unix socket of database")
+	}
+	if *dbSRVRecord != "" {
+		resolver, err := network.NewSRVResolver(*dbSRVRecord, time.Duration(*dbSRVRefreshInterval)*time.Second, time.Duration(*dbSRVDrainTimeout)*time.Second)
+		if err != nil {
+			log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+				Errorln("Can't initialize SRV resolver")
+			os.Exit(1)
+		}
+		if err := cmd.RetryOnStartup("database SRV record", resolver.Resolve); err != nil {
+			log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+				WithField("srv", *dbSRVRecord).Errorln("Can't resolve database address from SRV record")
+			os.Exit(1)
+		}
+		go resolver.Run(context.Background())
+		config.SetDBSRVResolver(resolver)
+		log.WithField("srv", *dbSRVRecord).Infoln("Use database address from SRV record")
+	}
+	if *proxyProtocolEnable {
+		acceptor, err := network.NewProxyProtocolAcceptor(strings.Split(*proxyProtocolTrustedCIDRs, ","))
+		if err != nil {
+			log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+				Errorln("Configuration error: invalid proxy_protocol_trusted_cidrs")
+			os.Exit(1)
+		}
+		config.SetProxyProtocolAcceptor(acceptor)
+		log.WithField("trusted_cidrs", *proxyProtocolTrustedCIDRs).Infoln("Read PROXY protocol header from trusted proxies")
+	}
+	config.SetProxyProtocolDBEmit(*proxyProtocolDBEmit)
+	if *maxConnections < 0 || *connectionAddressRate < 0 || *connectionHandshakeRate < 0 {
+		log.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+			Errorln("Configuration error: incoming_connection_max_connections, incoming_connection_address_rate and incoming_connection_handshake_rate can't be negative")
+		os.Exit(1)
+	}
+	connectionLimits := network.ConnectionLimits{MaxConnections: *maxConnections, AddressRate: *connectionAddressRate, HandshakeRate: *connectionHandshakeRate}
+	if connectionLimits.Enabled() {
+		config.SetConnectionLimiter(network.NewConnectionLimiter(connectionLimits))
+		log.WithFields(log.Fields{"max_connections": *maxConnections, "address_rate": *connectionAddressRate, "handshake_rate": *connectionHandshakeRate}).
+			Infoln("Limit incoming database connections")
+	}
 
 	if *encryptorConfig != "" {
 		log.Infof("Load encryptor configuration from %s ...", *encryptorConfig)
@@ -220,6 +454,52 @@ func main() {
 			Errorln("Can't configure database type")
 		os.Exit(1)
 	}
+	if *relayEnable {
+		if *protocolDetection || *useMysql {
+			log.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+				Errorln("--mysql_enable and --db_protocol_detection_enable can't be used with --relay_enable")
+			os.Exit(1)
+		}
+		if *encryptorConfig != "" || *censorConfig != "" || *tenantIsolationConfig != "" {
+			log.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+				Errorln("--encryptor_config_file, --acracensor_config_file and --tenant_isolation_config_file aren't supported with --relay_enable")
+			os.Exit(1)
+		}
+	} else if *relayTLSOrigination {
+		log.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+			Errorln("--relay_tls_origination_enable requires --relay_enable")
+		os.Exit(1)
+	}
+	if *protocolDetection {
+		if *useMysql || *usePostgresql {
+			log.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+				Errorln("--mysql_enable and --postgresql_enable can't be used with --db_protocol_detection_enable")
+			os.Exit(1)
+		}
+		// SQL dialect is process-wide so queries of only one protocol can be parsed
+		if *encryptorConfig != "" || *censorConfig != "" {
+			log.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+				Errorln("--encryptor_config_file and --acracensor_config_file aren't supported with --db_protocol_detection_enable")
+			os.Exit(1)
+		}
+		if *tenantIsolationConfig != "" {
+			log.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+				Errorln("--tenant_isolation_config_file isn't supported with --db_protocol_detection_enable")
+			os.Exit(1)
+		}
+		if *mysqlDBHost == "" && *mysqlDBUnixSocket == "" {
+			log.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+				Errorln("mysql_db_host is empty: you must specify it or mysql_db_unix_socket with --db_protocol_detection_enable")
+			os.Exit(1)
+		}
+		if *protocolDetectionTimeout <= 0 {
+			log.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+				Errorln("--db_protocol_detection_timeout_ms should be greater than zero")
+			os.Exit(1)
+		}
+		config.SetMySQLDBConnectionSettings(*mysqlDBHost, *mysqlDBPort)
+		config.SetMySQLDBUnixSocket(*mysqlDBUnixSocket)
+	}
 
 	if err = config.SetCensor(*censorConfig); err != nil {
 		log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCensorSetupError).
@@ -233,16 +513,40 @@ func main() {
 	config.SetWholeMatch(!(*injectedcell))
 	config.SetEnableHTTPAPI(*enableHTTPAPI)
 	config.SetDebug(*debug)
+	if *requestTimeout < 0 {
+		log.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+			Errorln("--request_timeout should be non-negative")
+		os.Exit(1)
+	}
+	config.SetRequestTimeout(time.Duration(*requestTimeout) * time.Second)
 	config.SetAuthDataPath(*authPath)
 	config.SetServiceName(ServiceName)
 	config.SetConfigPath(cmd.ConfigPath(defaultConfigPath))
 
 	log.Infof("Initialising keystore...")
 	var keyStore keystore.ServerKeyStore
-	if filesystemV2.IsKeyDirectory(*keysDir) {
+	if *keysHistoryLimit < keystore.AllHistoricalKeys {
+		log.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+			Errorln("--keystore_historical_keys should be -1 or non-negative")
+		os.Exit(1)
+	}
+	if !cmd.IsKeystoreBundleEnabled() && !cmd.IsKeystoreVaultEnabled() && !cmd.IsKeystoreRedisEnabled() && filesystemV2.IsKeyDirectory(*keysDir) {
+		if *keysHistoryLimit != keystore.AllHistoricalKeys {
+			log.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+				Errorln("--keystore_historical_keys is not supported by keystore v2")
+			os.Exit(1)
+		}
 		keyStore = openKeyStoreV2(*keysDir)
 	} else {
-		keyStore = openKeyStoreV1(*keysDir, *keysCacheSize)
+		keyStore = openKeyStoreV1(*keysDir, *keysCacheSize, *keysHistoryLimit)
+	}
+	if cmd.IsKeystorePrivateKeysCacheEnabled() {
+		keyStore, err = cmd.NewKeystoreServerPrivateKeysCache(keyStore)
+		if err != nil {
+			log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+				Errorln("Configuration error: invalid cache of decrypted private keys")
+			os.Exit(1)
+		}
 	}
 	config.SetKeyStore(keyStore)
 	log.Infof("Keystore init OK")
@@ -251,7 +555,105 @@ func main() {
 	var proxyTLSWrapper base.TLSConnectionWrapper
 	var tlsWrapper network.ConnectionWrapper
 	var clientTLSConfig, dbTLSConfig *tls.Config
-	if *useTLS || *tlsKey != "" {
+	var ocspStapler *network.OCSPStapler
+	var tlsReloaders []*network.TLSReloader
+	var verdictCache *network.RevocationVerdictCache
+	// Use common verification settings, unless the user requests specific ones for clients or database
+	if *tlsVerifiersClient == "" {
+		*tlsVerifiersClient = *tlsVerifiers
+	}
+	if *tlsVerifiersDb == "" {
+		*tlsVerifiersDb = *tlsVerifiers
+	}
+	if *tlsVerifiersModeClient == "" {
+		*tlsVerifiersModeClient = *tlsVerifiersMode
+	}
+	if *tlsVerifiersModeDb == "" {
+		*tlsVerifiersModeDb = *tlsVerifiersMode
+	}
+	certClientVerifierConfig, err := network.NewCompositeVerifierConfig(*tlsVerifiersClient, *tlsVerifiersModeClient, *tlsCertAllowlistFile, *tlsVerifierScript)
+	if err != nil {
+		log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+			Errorln("Configuration error: invalid verifiers config of client certificates")
+		os.Exit(1)
+	}
+	certDbVerifierConfig, err := network.NewCompositeVerifierConfig(*tlsVerifiersDb, *tlsVerifiersModeDb, *tlsCertAllowlistFile, *tlsVerifierScript)
+	if err != nil {
+		log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+			Errorln("Configuration error: invalid verifiers config of database certificates")
+		os.Exit(1)
+	}
+	if *tlsOcspClientRequired == "" {
+		*tlsOcspClientRequired = *tlsOcspRequired
+	}
+	if *tlsOcspDbRequired == "" {
+		*tlsOcspDbRequired = *tlsOcspRequired
+	}
+	if *tlsOcspClientFromCert == "" {
+		*tlsOcspClientFromCert = *tlsOcspFromCert
+	}
+	if *tlsOcspDbFromCert == "" {
+		*tlsOcspDbFromCert = *tlsOcspFromCert
+	}
+	if *tlsCrlClientFromCert == "" {
+		*tlsCrlClientFromCert = *tlsCrlFromCert
+	}
+	if *tlsCrlDbFromCert == "" {
+		*tlsCrlDbFromCert = *tlsCrlFromCert
+	}
+	ocspHTTPClientConfig := network.OCSPClientConfig{
+		Timeout:      time.Duration(*tlsOcspClientTimeout) * time.Second,
+		ProxyURL:     *tlsOcspHTTPProxy,
+		CABundlePath: *tlsOcspCABundle,
+		Retries:      *tlsOcspRetryCount,
+		RetryDelay:   network.OcspDefaultRetryDelay,
+		ForcePOST:    *tlsOcspForcePOST,
+		Nonce:        *tlsOcspNonce,
+		ClockSkew:    time.Duration(*tlsOcspClockSkew) * time.Second,
+	}
+	var spiffeProvider *network.SpiffeCredentialsProvider
+	if *tlsSpiffeSocket != "" {
+		if *tlsOcspStaplingEnable {
+			log.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+				Errorln("Configuration error: tls_ocsp_stapling_enable can't be used with tls_spiffe_workload_api_socket")
+			os.Exit(1)
+		}
+		spiffeProvider, err = network.NewSpiffeCredentialsProvider(*tlsSpiffeSocket, *tlsSpiffeTrustDomain, strings.Split(*tlsSpiffeAllowedIDs, ","))
+		if err != nil {
+			log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+				Errorln("Configuration error: invalid SPIFFE config")
+			os.Exit(1)
+		}
+		go spiffeProvider.Run(context.Background())
+		fetchCtx, cancelFetch := context.WithTimeout(context.Background(), network.DefaultSpiffeFetchTimeout)
+		err = spiffeProvider.WaitForSVID(fetchCtx)
+		cancelFetch()
+		if err != nil {
+			log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorTransportConfiguration).
+				Errorln("Configuration error: can't fetch X.509 SVID from SPIFFE Workload API")
+			os.Exit(1)
+		}
+		log.WithField("spiffe_id", spiffeProvider.SpiffeID()).Infoln("Fetched X.509 SVID from SPIFFE Workload API")
+	}
+	if *tlsPolicyClientProfile == "" {
+		*tlsPolicyClientProfile = *tlsPolicyProfile
+	}
+	if *tlsPolicyDbProfile == "" {
+		*tlsPolicyDbProfile = *tlsPolicyProfile
+	}
+	tlsClientPolicy, err := network.NewTLSPolicy(*tlsPolicyClientProfile, *tlsMinVersion, *tlsMaxVersion, *tlsCipherSuites)
+	if err != nil {
+		log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+			Errorln("Configuration error: invalid TLS policy of connections with clients")
+		os.Exit(1)
+	}
+	tlsDbPolicy, err := network.NewTLSPolicy(*tlsPolicyDbProfile, *tlsMinVersion, *tlsMaxVersion, *tlsCipherSuites)
+	if err != nil {
+		log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+			Errorln("Configuration error: invalid TLS policy of connections with database")
+		os.Exit(1)
+	}
+	if *useTLS || *tlsKey != "" || spiffeProvider != nil {
 		// Use common TLS settings, unless the user requests specific ones
 		if *tlsClientCA == "" {
 			*tlsClientCA = *tlsCA
@@ -268,9 +670,9 @@ func main() {
 
 		var ocspClientConfig *network.OCSPConfig
 		if *tlsOcspClientURL != "" {
-			ocspClientConfig, err = network.NewOCSPConfig(*tlsOcspClientURL, *tlsOcspRequired, *tlsOcspFromCert, *tlsOcspCheckOnlyLeafCertificate)
+			ocspClientConfig, err = network.NewOCSPConfig(*tlsOcspClientURL, *tlsOcspClientRequired, *tlsOcspClientFromCert, *tlsOcspCheckOnlyLeafCertificate, time.Duration(*tlsOcspQueryTimeout)*time.Second, time.Duration(*tlsOcspVerifyTimeout)*time.Second, ocspHTTPClientConfig)
 		} else {
-			ocspClientConfig, err = network.NewOCSPConfig(*tlsOcspURL, *tlsOcspRequired, *tlsOcspFromCert, *tlsOcspCheckOnlyLeafCertificate)
+			ocspClientConfig, err = network.NewOCSPConfig(*tlsOcspURL, *tlsOcspClientRequired, *tlsOcspClientFromCert, *tlsOcspCheckOnlyLeafCertificate, time.Duration(*tlsOcspQueryTimeout)*time.Second, time.Duration(*tlsOcspVerifyTimeout)*time.Second, ocspHTTPClientConfig)
 		}
 		if err != nil {
 			log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
@@ -281,9 +683,9 @@ func main() {
 
 		var crlClientConfig *network.CRLConfig
 		if *tlsCrlClientURL != "" {
-			crlClientConfig, err = network.NewCRLConfig(*tlsCrlClientURL, *tlsCrlFromCert, *tlsCrlCheckOnlyLeafCertificate, *tlsCrlCacheSize, *tlsCrlCacheTime)
+			crlClientConfig, err = network.NewCRLConfig(*tlsCrlClientURL, *tlsCrlClientFromCert, *tlsCrlCheckOnlyLeafCertificate, *tlsCrlCacheSize, *tlsCrlCacheTime)
 		} else {
-			crlClientConfig, err = network.NewCRLConfig(*tlsCrlURL, *tlsCrlFromCert, *tlsCrlCheckOnlyLeafCertificate, *tlsCrlCacheSize, *tlsCrlCacheTime)
+			crlClientConfig, err = network.NewCRLConfig(*tlsCrlURL, *tlsCrlClientFromCert, *tlsCrlCheckOnlyLeafCertificate, *tlsCrlCacheSize, *tlsCrlCacheTime)
 		}
 		if err != nil {
 			log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
@@ -292,10 +694,26 @@ func main() {
 		}
 		crlClientConfig.ClientAuthType = tls.ClientAuthType(*tlsClientAuthType)
 
-		certClientVerifier, err := network.NewCertVerifierFromConfigs(ocspClientConfig, crlClientConfig)
+		certClientVerifier, err := network.NewCompositeVerifierFromConfigs(certClientVerifierConfig, ocspClientConfig, crlClientConfig)
 		if err != nil {
 			log.WithError(err).Fatalln("Cannot create client certificate verifier")
 		}
+		if *tlsRevocationVerdictCacheTime > 0 {
+			verdictCache = network.NewRevocationVerdictCache(*tlsRevocationVerdictCacheSize, time.Duration(*tlsRevocationVerdictCacheTime)*time.Second)
+			certClientVerifier = network.NewCachingCertVerifier(certClientVerifier, verdictCache)
+		}
+		// budget limits waiting for cached verifier, so deferred verdicts are cached too
+		certClientVerifier = network.NewLatencyBudgetCertVerifier(certClientVerifier, time.Duration(*tlsVerifyLatencyBudget)*time.Millisecond,
+			time.Duration(*tlsVerifyDeferredTimeout)*time.Second, *tlsOcspClientRequired == network.OcspRequiredGoodStr)
+		if *tlsPinnedSPKIClient == "" {
+			*tlsPinnedSPKIClient = *tlsPinnedSPKI
+		}
+		certClientVerifier, err = network.NewPinnedCertVerifier(*tlsPinnedSPKIClient, *tlsPinnedSPKIMatchChain, certClientVerifier)
+		if err != nil {
+			log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+				Errorln("Configuration error: invalid pinned SPKI hashes of client certificates")
+			os.Exit(1)
+		}
 
 		clientTLSConfig, err = network.NewTLSConfig("", *tlsClientCA, *tlsClientKey, *tlsClientCert, tls.ClientAuthType(*tlsClientAuthType), certClientVerifier)
 		if err != nil {
@@ -303,6 +721,55 @@ func main() {
 				Errorln("Configuration error: can't create AcraConnector TLS config")
 			os.Exit(1)
 		}
+		tlsClientPolicy.Apply(clientTLSConfig)
+		clientTLSConfig.SessionTicketsDisabled = !*tlsSessionTicketsEnable
+		if *tlsOcspStaplingEnable {
+			ocspStapler, err = network.NewOCSPStapler(clientTLSConfig, *tlsOcspStaplingURL, ocspClientConfig.Client(), time.Duration(*tlsOcspQueryTimeout)*time.Second)
+			if err != nil {
+				log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+					Errorln("Configuration error: can't configure OCSP stapling")
+				os.Exit(1)
+			}
+			// handshakes go without staple until OCSP server responds
+			err = cmd.RetryOnStartup("OCSP server", func() error {
+				return ocspStapler.Refresh(context.Background())
+			})
+			if err != nil {
+				log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorNetworkTLSGeneral).
+					Warnln("OCSP stapling: can't fetch response for own certificate, will retry")
+			}
+			ocspStapler.Apply(clientTLSConfig)
+		}
+		if spiffeProvider != nil {
+			// SVID is rotated by provider, so certificate files aren't reloaded
+			spiffeProvider.Apply(clientTLSConfig)
+		} else {
+			clientTLSReloader, err := network.NewTLSReloader(*tlsClientCA, *tlsClientKey, *tlsClientCert)
+			if err != nil {
+				log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorTransportConfiguration).
+					Errorln("Configuration error: can't load AcraConnector TLS certificates")
+				os.Exit(1)
+			}
+			clientTLSReloader.Apply(clientTLSConfig)
+			if ocspStapler != nil {
+				stapler := ocspStapler
+				clientTLSReloader.OnReload(func(certificate *tls.Certificate) {
+					if certificate == nil {
+						return
+					}
+					if err := stapler.SetCertificate(*certificate); err != nil {
+						log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorNetworkTLSGeneral).
+							Errorln("OCSP stapling: can't use reloaded certificate, previous one is used")
+						return
+					}
+					if err := stapler.Refresh(context.Background()); err != nil {
+						log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorNetworkTLSGeneral).
+							Warnln("OCSP stapling: can't fetch response for reloaded certificate, will retry")
+					}
+				})
+			}
+			tlsReloaders = append(tlsReloaders, clientTLSReloader)
+		}
 		// Use common TLS settings, unless the user requests specific ones.
 		// Also handle deprecated options.
 		if *tlsDbCA == "" {
@@ -323,9 +790,9 @@ func main() {
 
 		var ocspDbConfig *network.OCSPConfig
 		if *tlsOcspDbURL != "" {
-			ocspDbConfig, err = network.NewOCSPConfig(*tlsOcspDbURL, *tlsOcspRequired, *tlsOcspFromCert, *tlsOcspCheckOnlyLeafCertificate)
+			ocspDbConfig, err = network.NewOCSPConfig(*tlsOcspDbURL, *tlsOcspDbRequired, *tlsOcspDbFromCert, *tlsOcspCheckOnlyLeafCertificate, time.Duration(*tlsOcspQueryTimeout)*time.Second, time.Duration(*tlsOcspVerifyTimeout)*time.Second, ocspHTTPClientConfig)
 		} else {
-			ocspDbConfig, err = network.NewOCSPConfig(*tlsOcspURL, *tlsOcspRequired, *tlsOcspFromCert, *tlsOcspCheckOnlyLeafCertificate)
+			ocspDbConfig, err = network.NewOCSPConfig(*tlsOcspURL, *tlsOcspDbRequired, *tlsOcspDbFromCert, *tlsOcspCheckOnlyLeafCertificate, time.Duration(*tlsOcspQueryTimeout)*time.Second, time.Duration(*tlsOcspVerifyTimeout)*time.Second, ocspHTTPClientConfig)
 		}
 		if err != nil {
 			log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
@@ -335,9 +802,9 @@ func main() {
 
 		var crlDbConfig *network.CRLConfig
 		if *tlsCrlDbURL != "" {
-			crlDbConfig, err = network.NewCRLConfig(*tlsCrlDbURL, *tlsCrlFromCert, *tlsCrlCheckOnlyLeafCertificate, *tlsCrlCacheSize, *tlsCrlCacheTime)
+			crlDbConfig, err = network.NewCRLConfig(*tlsCrlDbURL, *tlsCrlDbFromCert, *tlsCrlCheckOnlyLeafCertificate, *tlsCrlCacheSize, *tlsCrlCacheTime)
 		} else {
-			crlDbConfig, err = network.NewCRLConfig(*tlsCrlURL, *tlsCrlFromCert, *tlsCrlCheckOnlyLeafCertificate, *tlsCrlCacheSize, *tlsCrlCacheTime)
+			crlDbConfig, err = network.NewCRLConfig(*tlsCrlURL, *tlsCrlDbFromCert, *tlsCrlCheckOnlyLeafCertificate, *tlsCrlCacheSize, *tlsCrlCacheTime)
 		}
 		if err != nil {
 			log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
@@ -345,10 +812,21 @@ func main() {
 			os.Exit(1)
 		}
 
-		certDbVerifier, err := network.NewCertVerifierFromConfigs(ocspDbConfig, crlDbConfig)
+		certDbVerifier, err := network.NewCompositeVerifierFromConfigs(certDbVerifierConfig, ocspDbConfig, crlDbConfig)
 		if err != nil {
 			log.WithError(err).Fatalln("Cannot create database certificate verifier")
 		}
+		certDbVerifier = network.NewLatencyBudgetCertVerifier(certDbVerifier, time.Duration(*tlsVerifyLatencyBudget)*time.Millisecond,
+			time.Duration(*tlsVerifyDeferredTimeout)*time.Second, *tlsOcspDbRequired == network.OcspRequiredGoodStr)
+		if *tlsPinnedSPKIDb == "" {
+			*tlsPinnedSPKIDb = *tlsPinnedSPKI
+		}
+		certDbVerifier, err = network.NewPinnedCertVerifier(*tlsPinnedSPKIDb, *tlsPinnedSPKIMatchChain, certDbVerifier)
+		if err != nil {
+			log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+				Errorln("Configuration error: invalid pinned SPKI hashes of database certificates")
+			os.Exit(1)
+		}
 
 		dbTLSConfig, err = network.NewTLSConfig(network.SNIOrHostname(*tlsDbSNI, *dbHost), *tlsDbCA, *tlsDbKey, *tlsDbCert, tls.ClientAuthType(*tlsDbAuthType), certDbVerifier)
 		if err != nil {
@@ -356,6 +834,18 @@ func main() {
 				Errorln("Configuration error: can't create database TLS config")
 			os.Exit(1)
 		}
+		tlsDbPolicy.Apply(dbTLSConfig)
+		if *tlsDbSessionCacheSize > 0 {
+			dbTLSConfig.ClientSessionCache = tls.NewLRUClientSessionCache(*tlsDbSessionCacheSize)
+		}
+		dbTLSReloader, err := network.NewTLSReloader(*tlsDbCA, *tlsDbKey, *tlsDbCert)
+		if err != nil {
+			log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorTransportConfiguration).
+				Errorln("Configuration error: can't load database TLS certificates")
+			os.Exit(1)
+		}
+		dbTLSReloader.Apply(dbTLSConfig)
+		tlsReloaders = append(tlsReloaders, dbTLSReloader)
 		idConverter, err := network.NewDefaultHexIdentifierConverter()
 		if err != nil {
 			log.WithError(err).Errorln("Can't initialize identifier converter")
@@ -375,6 +865,11 @@ func main() {
 		proxyTLSWrapper = base.NewTLSConnectionWrapper(useForClientID, tlsWrapper)
 		log.WithField("use_client_id_from_cert", useForClientID).Infoln("Loaded TLS configuration")
 	}
+	if *unixSocketClientIDs != "" && (*useTLS || !*noEncryptionTransport) {
+		log.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+			Errorln("Configuration error: unix_socket_client_ids requires --acraconnector_transport_encryption_disable")
+		os.Exit(1)
+	}
 	if *useTLS {
 		if *tlsUseClientIDFromCertificate {
 			config.ConnectionWrapper = tlsWrapper
@@ -394,13 +889,23 @@ func main() {
 		}
 	} else if *noEncryptionTransport {
 		config.SetWithConnector(false)
-		if (*clientID == "" && !*withZone) && *tlsKey == "" {
+		if (*clientID == "" && !*withZone) && *tlsKey == "" && *unixSocketClientIDs == "" {
 			log.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorTransportConfiguration).
 				Errorln("Configuration error: without zone mode and without encryption you must set <client_id> which will be used to connect from AcraConnector to AcraServer")
 			os.Exit(1)
 		}
 		log.Infof("Selecting transport: use raw transport wrapper")
 		config.ConnectionWrapper = &network.RawConnectionWrapper{ClientID: []byte(*clientID)}
+		if *unixSocketClientIDs != "" {
+			peerClientIDs, err := network.ParsePeerClientIDs(*unixSocketClientIDs)
+			if err != nil {
+				log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+					Errorln("Configuration error: invalid unix_socket_client_ids")
+				os.Exit(1)
+			}
+			config.ConnectionWrapper = network.NewPeerCredentialsConnectionWrapper(config.ConnectionWrapper, peerClientIDs)
+			log.Infof("Identify clients connected over unix socket by uid of their process")
+		}
 	} else {
 		log.Infof("Selecting transport: use Secure Session transport wrapper")
 		config.ConnectionWrapper, err = network.NewSecureSessionConnectionWrapper([]byte(*secureSessionID), keyStore)
@@ -410,6 +915,15 @@ func main() {
 			os.Exit(1)
 		}
 	}
+	if *connectorMultiplexing {
+		if !config.WithConnector() {
+			log.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+				Errorln("Configuration error: acraconnector_multiplexing_enable can't be used with acraconnector_transport_encryption_disable")
+			os.Exit(1)
+		}
+		config.SetConnectorMultiplexing(true)
+		log.Infoln("Accept multiplexed sessions from AcraConnector")
+	}
 
 	log.Debugf("Registering process signal handlers")
 	sigHandlerSIGTERM, err := cmd.NewSignalHandler([]os.Signal{os.Interrupt, syscall.SIGTERM})
@@ -429,6 +943,27 @@ func main() {
 	}
 
 	poisonCallbacks := base.NewPoisonCallbackStorage()
+	if *notificationConfig != "" {
+		router, err := notification.LoadRouter(*notificationConfig)
+		if err != nil {
+			log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+				Errorln("Can't load notification config")
+			os.Exit(1)
+		}
+		// poison record callbacks may stop service, so notification is delivered synchronously before them
+		poisonCallbacks.AddCallback(notification.NewPoisonRecordCallback(router, ServiceName))
+		asyncNotifier := notification.NewAsyncNotifier(router)
+		if censor, ok := config.GetCensor().(*acracensor.AcraCensor); ok {
+			censor.SetNotifier(asyncNotifier)
+		}
+		certificateChecker := notification.NewCertificateExpiryChecker(asyncNotifier, ServiceName,
+			[]string{*tlsCert, *tlsClientCert, *tlsDbCert, *tlsCA, *tlsClientCA, *tlsDbCA},
+			time.Duration(*certificateExpiryThreshold)*time.Hour*24)
+		if certificateChecker.HasCertificates() {
+			go certificateChecker.Run(nil)
+		}
+		log.Infoln("Notifications configured")
+	}
 	if *scriptOnPoison != "" {
 		poisonCallbacks.AddCallback(base.NewExecuteScriptCallback(*scriptOnPoison))
 		config.SetScriptOnPoison(*scriptOnPoison)
@@ -440,32 +975,372 @@ func main() {
 	}
 
 	decryptorSetting := base.NewDecryptorSetting(config.GetWithZone(), config.GetWholeMatch(), *detectPoisonRecords, poisonCallbacks, keyStore)
-	var decryptorFactory base.DecryptorFactory
-	var proxyFactory base.ProxyFactory
-	if *useMysql {
-		decryptorFactory = mysql.NewMysqlDecryptorFactory(decryptorSetting)
-		proxyFactory, err = mysql.NewProxyFactory(base.NewProxySetting(decryptorFactory, config.GetTableSchema(), keyStore, proxyTLSWrapper, config.GetCensor()))
+	if *inlineFallback {
+		if !config.GetWholeMatch() {
+			log.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+				Errorln("acrastruct_wholecell_inline_fallback_enable is supported only in whole cell mode")
+			os.Exit(1)
+		}
+		log.Infoln("Enabled search of AcraStructs inside data cells in whole cell mode")
+		decryptorSetting.SetInlineFallback(true)
+	}
+	confusionAction, err := encryptor.ParseContextConfusionAction(*contextConfusionAction)
+	if err != nil {
+		log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+			Errorln("Invalid --encryptor_context_confusion_action")
+		os.Exit(1)
+	}
+	if confusionAction.Enabled() {
+		if *encryptorConfig == "" || !config.GetWholeMatch() {
+			log.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+				Errorln("--encryptor_context_confusion_action requires --encryptor_config_file and whole cell mode")
+			os.Exit(1)
+		}
+		log.Infof("Enabled context confusion checks with action '%s'", confusionAction)
+	}
+	staleAction, err := encryptor.ParseMaxAgeAction(*maxAgeAction)
+	if err != nil {
+		log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+			Errorln("Invalid --encryptor_max_age_action")
+		os.Exit(1)
+	}
+	if staleAction.Enabled() && *encryptorConfig != "" && !config.GetWholeMatch() {
+		log.Warningln("max_age of columns in encryptor config is checked only in whole cell mode")
+	}
+	oversizedAction, err := encryptor.ParseCiphertextSizeAction(*ciphertextSizeAction)
+	if err != nil {
+		log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+			Errorln("Invalid --encryptor_max_ciphertext_size_action")
+		os.Exit(1)
+	}
+	var decryptionSchedule *encryptor.DecryptionSchedulePolicy
+	if *decryptionScheduleConfig != "" {
+		if !config.GetWholeMatch() {
+			log.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+				Errorln("--decryption_schedule_config_file is supported only in whole cell mode")
+			os.Exit(1)
+		}
+		decryptionSchedule, err = encryptor.LoadDecryptionSchedulePolicy(*decryptionScheduleConfig)
+		if err != nil {
+			log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+				Errorln("Can't load decryption schedule configuration")
+			os.Exit(1)
+		}
+		if decryptionSchedule.HasColumnRules() && *encryptorConfig == "" {
+			log.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+				Errorln("Rules of columns in --decryption_schedule_config_file require --encryptor_config_file")
+			os.Exit(1)
+		}
+		log.Infoln("Enabled decryption schedule")
+	}
+	var decryptionPurpose *encryptor.DecryptionPurposePolicy
+	if *decryptionPurposeConfig != "" {
+		if !config.GetWholeMatch() || *encryptorConfig == "" {
+			log.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+				Errorln("--decryption_purpose_config_file requires whole cell mode and --encryptor_config_file")
+			os.Exit(1)
+		}
+		decryptionPurpose, err = encryptor.LoadDecryptionPurposePolicy(*decryptionPurposeConfig)
+		if err != nil {
+			log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+				Errorln("Can't load decryption purpose configuration")
+			os.Exit(1)
+		}
+		log.Infoln("Enabled decryption purpose checks")
+	}
+	var tenantIsolation *encryptor.TenantIsolationPolicy
+	if *tenantIsolationConfig != "" {
+		tenantIsolation, err = encryptor.LoadTenantIsolationPolicy(*tenantIsolationConfig)
+		if err != nil {
+			log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+				Errorln("Can't load tenant isolation configuration")
+			os.Exit(1)
+		}
+		log.Infoln("Enabled tenant isolation of queries")
+	}
+	var accessHeatmap *encryptor.AccessHeatmap
+	if *accessHeatmapEnable {
+		if *encryptorConfig == "" || !config.GetWholeMatch() {
+			log.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+				Errorln("--access_heatmap_enable requires --encryptor_config_file and whole cell mode")
+			os.Exit(1)
+		}
+		accessHeatmap, err = encryptor.NewAccessHeatmap(time.Duration(*accessHeatmapBucketSize)*time.Second,
+			time.Duration(*accessHeatmapRetention)*time.Second, config.GetTableSchema().EncryptedColumns())
+		if err != nil {
+			log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+				Errorln("Invalid --access_heatmap_bucket_size or --access_heatmap_retention")
+			os.Exit(1)
+		}
+		if *accessHeatmapExportFile != "" {
+			if *accessHeatmapExportInterval <= 0 {
+				log.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+					Errorln("--access_heatmap_export_interval should be greater than 0")
+				os.Exit(1)
+			}
+			go accessHeatmap.RunExport(context.Background(), *accessHeatmapExportFile, time.Duration(*accessHeatmapExportInterval)*time.Second)
+		}
+		config.SetAccessHeatmap(accessHeatmap)
+		log.Infoln("Enabled access heatmap")
+	}
+	var shadowWriter *base.ShadowWriter
+	if *shadowDBConnectionString != "" {
+		if *protocolDetection {
+			log.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+				Errorln("--shadow_db_connection_string isn't supported with --db_protocol_detection_enable")
+			os.Exit(1)
+		}
+		shadowDBDriver := "postgres"
+		if *useMysql {
+			shadowDBDriver = "mysql"
+		}
+		shadowDB, err := sql.Open(shadowDBDriver, *shadowDBConnectionString)
+		if err != nil {
+			log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+				Errorln("Can't configure shadow database connection")
+			os.Exit(1)
+		}
+		shadowWriter, err = base.NewShadowWriter(shadowDB, *shadowWriteQueueSize)
+		if err != nil {
+			log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+				Errorln("Can't initialize shadow writes")
+			os.Exit(1)
+		}
+		log.Infoln("Shadow writes enabled")
+	}
+	var canaryChecker *base.CanaryChecker
+	if *canaryConnectionString != "" {
+		if *protocolDetection {
+			log.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+				Errorln("--canary_db_connection_string isn't supported with --db_protocol_detection_enable")
+			os.Exit(1)
+		}
+		canaryDBDriver := "postgres"
+		if *useMysql {
+			canaryDBDriver = "mysql"
+		}
+		canaryDB, err := sql.Open(canaryDBDriver, *canaryConnectionString)
+		if err != nil {
+			log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+				Errorln("Can't configure canary database connection")
+			os.Exit(1)
+		}
+		canaryChecker, err = base.NewCanaryChecker(canaryDB, *canaryQuery, []byte(*canaryExpectedValue),
+			time.Duration(*canaryCheckInterval)*time.Second, time.Duration(*canaryCheckTimeout)*time.Second)
+		if err != nil {
+			log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+				Errorln("Can't initialize canary decryption checks")
+			os.Exit(1)
+		}
+		if *prometheusAddress == "" {
+			log.Warningln("Readiness probe isn't exposed without --incoming_connection_prometheus_metrics_string, canary checks are only logged")
+		}
+		// served on the same HTTP server as metrics
+		http.Handle("/ready", canaryChecker)
+		log.Infoln("Canary decryption checks enabled")
+	}
+	if err := base.ValidateMaxPacketSize(*maxPacketSize); err != nil {
+		log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+			Errorln("Invalid --db_max_packet_size")
+		os.Exit(1)
+	}
+	if *pipelineQueueSize < 0 {
+		log.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+			Errorln("--db_pipeline_queue_size can't be negative")
+		os.Exit(1)
+	}
+	if *pipelineQueueSize > 0 && *useMysql && !*protocolDetection {
+		log.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+			Errorln("--db_pipeline_queue_size is supported only for PostgreSQL")
+		os.Exit(1)
+	}
+	if *postgresqlCredentialsConfig != "" && *useMysql && !*protocolDetection {
+		log.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+			Errorln("--postgresql_credentials_config_file is supported only for PostgreSQL")
+		os.Exit(1)
+	}
+	// client IDs are authenticated by Secure Session or TLS certificates of AcraConnector's connections
+	connectionClientIDVerified := (!*useTLS && !*noEncryptionTransport) || (*useTLS && *tlsUseClientIDFromCertificate)
+	if *postgresqlCredentialsConfig != "" && !connectionClientIDVerified && (proxyTLSWrapper == nil || !proxyTLSWrapper.UseConnectionClientID()) {
+		log.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+			Errorln("--postgresql_credentials_config_file requires client IDs from TLS certificates (--tls_client_id_from_cert) or Secure Session transport, static --client_id isn't verified")
+		os.Exit(1)
+	}
+	var sessionIdentity *base.SessionIdentity
+	if *sessionIdentitySource != "" {
+		sessionIdentity, err = base.NewSessionIdentity(*sessionIdentitySource)
+		if err != nil {
+			log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+				Errorln("Invalid --db_session_identity")
+			os.Exit(1)
+		}
+		if *sessionIdentitySource != base.SessionIdentitySourceClientID && !*useTLS {
+			log.Warningln("Identifiers of certificates are exported only from TLS connections with verified client certificates, other connections are closed")
+		}
+		log.Infof("Export of client identity into database sessions enabled: %s", *sessionIdentitySource)
+	}
+	var idleInTransaction *base.IdleInTransactionPolicy
+	if *idleInTransactionTimeout < 0 {
+		log.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+			Errorln("--db_idle_in_transaction_timeout can't be negative")
+		os.Exit(1)
+	}
+	if *idleInTransactionTimeout > 0 {
+		idleInTransaction, err = base.NewIdleInTransactionPolicy(time.Duration(*idleInTransactionTimeout)*time.Second, *idleInTransactionAction)
+		if err != nil {
+			log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+				Errorln("Invalid --db_idle_in_transaction_action")
+			os.Exit(1)
+		}
+		log.Infof("Sessions idle in transaction longer than %v are handled with action: %s", idleInTransaction.Timeout(), idleInTransaction.Action())
+	}
+	var featureFlags *featureflags.Flags
+	if *featureFlagsFile != "" && *featureFlagsURL != "" {
+		log.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+			Errorln("--feature_flags_file and --feature_flags_url can't be used together")
+		os.Exit(1)
+	}
+	if *featureFlagsReloadInterval < 0 {
+		log.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+			Errorln("--feature_flags_reload_interval can't be negative")
+		os.Exit(1)
+	}
+	if *featureFlagsFile != "" || *featureFlagsURL != "" {
+		var source featureflags.Source = featureflags.NewFileSource(*featureFlagsFile)
+		if *featureFlagsURL != "" {
+			source = featureflags.NewHTTPSource(*featureFlagsURL, featureflags.DefaultHTTPTimeout)
+		}
+		featureFlags, err = featureflags.NewFlags(source)
+		if err != nil {
+			log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+				Errorln("Can't load feature flags")
+			os.Exit(1)
+		}
+		log.Infof("Feature flags loaded from %s", source)
+	}
+	var proxyFactory, mysqlProxyFactory, postgresqlProxyFactory base.ProxyFactory
+	if *useMysql || *protocolDetection {
+		decryptorFactory := mysql.NewMysqlDecryptorFactory(decryptorSetting)
+		capabilitiesAction, err := mysql.ParseCapabilitiesAction(*mysqlCapabilitiesAction)
+		if err != nil {
+			log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+				Errorln("Invalid --mysql_uninspectable_capabilities_action")
+			os.Exit(1)
+		}
+		if capabilitiesAction == mysql.CapabilitiesActionAllow {
+			log.Warningln("MySQL compression is allowed, such connections may bypass AcraServer processing")
+		}
+		mysqlProxyOptions := mysql.ProxyFactoryOptions{ContextConfusionAction: confusionAction, MaxAgeAction: staleAction, CiphertextSizeAction: oversizedAction, DecryptionSchedule: decryptionSchedule, DecryptionPurpose: decryptionPurpose, TenantIsolation: tenantIsolation, AccessHeatmap: accessHeatmap, CapabilitiesAction: capabilitiesAction, MaxPacketSize: *maxPacketSize}
+		if shadowWriter != nil {
+			mysqlProxyOptions.ShadowWriter = shadowWriter
+		}
+		if sessionIdentity != nil {
+			mysqlProxyOptions.SessionIdentity = sessionIdentity
+			mysqlProxyOptions.SessionIdentityAttribute = *mysqlSessionIdentityAttribute
+		}
+		mysqlProxyOptions.IdleInTransaction = idleInTransaction
+		mysqlProxyOptions.FeatureFlags = featureFlags
+		mysqlProxyFactory, err = mysql.NewProxyFactoryWithOptions(base.NewProxySetting(decryptorFactory, config.GetTableSchema(), keyStore, proxyTLSWrapper, config.GetCensor()), mysqlProxyOptions)
 		if err != nil {
 			log.WithError(err).Errorln("Can't initialize proxy for connections")
 			os.Exit(1)
 		}
+		proxyFactory = mysqlProxyFactory
 		sqlparser.SetDefaultDialect(mysqlDialect.NewMySQLDialect())
-	} else {
-		decryptorFactory = postgresql.NewDecryptorFactory(decryptorSetting)
-		proxyFactory, err = postgresql.NewProxyFactory(base.NewProxySetting(decryptorFactory, config.GetTableSchema(), keyStore, proxyTLSWrapper, config.GetCensor()))
+	}
+	if !*useMysql || *protocolDetection {
+		decryptorFactory := postgresql.NewDecryptorFactory(decryptorSetting)
+		proxyOptions := postgresql.ProxyFactoryOptions{ContextConfusionAction: confusionAction, MaxAgeAction: staleAction, CiphertextSizeAction: oversizedAction, DecryptionSchedule: decryptionSchedule, DecryptionPurpose: decryptionPurpose, TenantIsolation: tenantIsolation, AccessHeatmap: accessHeatmap, MaxPacketSize: *maxPacketSize, PipelineQueueSize: *pipelineQueueSize}
+		if *replicationConfig != "" {
+			proxyOptions.ReplicationPolicy, err = postgresql.LoadReplicationPolicy(*replicationConfig)
+			if err != nil {
+				log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+					Errorln("Can't load logical replication configuration")
+				os.Exit(1)
+			}
+			log.Infof("Logical replication processing enabled")
+		}
+		if *largeObjectEncryption {
+			if *largeObjectChunkSize <= 0 {
+				log.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+					Errorln("--postgresql_large_object_chunk_size should be greater than zero")
+				os.Exit(1)
+			}
+			proxyOptions.LargeObjectChunkSize = *largeObjectChunkSize
+			log.Infof("Large object encryption enabled with chunks of %d bytes", *largeObjectChunkSize)
+		}
+		if shadowWriter != nil {
+			proxyOptions.ShadowWriter = shadowWriter
+		}
+		if sessionIdentity != nil {
+			proxyOptions.SessionIdentity = sessionIdentity
+			proxyOptions.SessionIdentityParameter = *postgresqlSessionIdentityParameter
+		}
+		proxyOptions.IdleInTransaction = idleInTransaction
+		proxyOptions.FeatureFlags = featureFlags
+		if *postgresqlCredentialsConfig != "" {
+			proxyOptions.ClientIDVerified = connectionClientIDVerified
+			proxyOptions.CredentialStore, err = postgresql.LoadCredentialStore(*postgresqlCredentialsConfig)
+			if err != nil {
+				log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+					Errorln("Can't load PostgreSQL credentials configuration")
+				os.Exit(1)
+			}
+			if *protocolDetection {
+				log.Warningln("Database credentials are injected only into PostgreSQL connections, MySQL clients authenticate with own credentials")
+			}
+			go proxyOptions.CredentialStore.Run(context.Background(), time.Duration(*postgresqlCredentialsRefreshInterval)*time.Second, time.Duration(*postgresqlCredentialsDrainTimeout)*time.Second)
+			log.Infof("Injection of PostgreSQL credentials enabled")
+		}
+		if *postgresqlErrorFieldsStrip != "" {
+			proxyOptions.ErrorMessagePolicy, err = postgresql.NewErrorMessagePolicy(*postgresqlErrorFieldsStrip)
+			if err != nil {
+				log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+					Errorln("Invalid --postgresql_error_fields_strip")
+				os.Exit(1)
+			}
+			log.Infof("Fields of PostgreSQL errors and notices are stripped: %s", *postgresqlErrorFieldsStrip)
+		}
+		postgresqlProxyFactory, err = postgresql.NewProxyFactoryWithOptions(base.NewProxySetting(decryptorFactory, config.GetTableSchema(), keyStore, proxyTLSWrapper, config.GetCensor()), proxyOptions)
 		if err != nil {
 			log.WithError(err).Errorln("Can't initialize proxy for connections")
 			os.Exit(1)
 		}
+		proxyFactory = postgresqlProxyFactory
+		// with protocol detection SQL is parsed only in PostgreSQL connections
 		sqlparser.SetDefaultDialect(pgDialect.NewPostgreSQLDialect())
 	}
 
+	if *relayEnable {
+		var serviceTLSWrapper base.TLSConnectionWrapper
+		if *relayTLSOrigination {
+			if proxyTLSWrapper == nil {
+				log.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+					Errorln("--relay_tls_origination_enable requires TLS configuration with --acraconnector_tls_transport_enable or --tls_key")
+				os.Exit(1)
+			}
+			serviceTLSWrapper = proxyTLSWrapper
+		}
+		if !*useTLS {
+			log.Warningln("Connections of clients aren't protected with TLS in relay mode without --acraconnector_tls_transport_enable")
+		}
+		proxyFactory = relay.NewProxyFactory(serviceTLSWrapper)
+		log.WithField("tls_origination", *relayTLSOrigination).Infoln("Relay data between clients and service without parsing")
+	}
+
 	server, err := common.NewServer(config, proxyFactory, errorSignalChannel, restartSignalsChannel)
 	if err != nil {
 		log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCantStartService).
 			Errorf("System error: can't start %s", ServiceName)
 		panic(err)
 	}
+	if *protocolDetection {
+		server.EnableProtocolDetection(map[base.DatabaseProtocol]base.ProxyFactory{
+			base.PostgreSQLProtocol: postgresqlProxyFactory,
+			base.MySQLProtocol:      mysqlProxyFactory,
+		}, time.Duration(*protocolDetectionTimeout)*time.Millisecond)
+		log.Infof("Database protocol detection enabled, MySQL connections are proxied to %s:%d", *mysqlDBHost, *mysqlDBPort)
+	}
 
 	if os.Getenv(gracefulEnv) == "true" {
 		log.Debugf("Will be using GRACEFUL_RESTART if configured from WebUI")
@@ -506,11 +1381,77 @@ func main() {
 		sigHandlerSIGTERM.AddCallback(stopPrometheusServer)
 	}
 
+	switch *tlsSessionTicketKeysStorage {
+	case sessionTicketKeysStorageMemory:
+	case sessionTicketKeysStorageKeystore:
+		if *standbyPairEnable || cmd.IsKeystoreBundleEnabled() || cmd.IsKeystoreVaultEnabled() || cmd.IsKeystoreRedisEnabled() {
+			log.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+				Errorln("Configuration error: --tls_session_ticket_keys_storage=keystore isn't supported with standby pair, keystore bundle, Vault and Redis keystores")
+			os.Exit(1)
+		}
+	default:
+		log.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+			Errorf("Configuration error: unknown --tls_session_ticket_keys_storage '%s', should be 'memory' or 'keystore'", *tlsSessionTicketKeysStorage)
+		os.Exit(1)
+	}
+	if *tlsDbSessionCacheSize < 0 {
+		log.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+			Errorln("Configuration error: --tls_database_session_cache_size can't be negative")
+		os.Exit(1)
+	}
+
+	var standbyPair *standby.Pair
+	if *standbyPairEnable {
+		standbyPair = newStandbyPair(*standbySharedDir, *standbyNodeID, *keysDir, *standbyHeartbeatInterval, *standbyFailoverTimeout)
+		if clientTLSConfig != nil && *tlsSessionTicketsEnable {
+			ticketKeys, err := network.NewSessionTicketKeys()
+			if err != nil {
+				log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorStandbyPair).
+					Errorln("Can't generate TLS session ticket keys")
+				os.Exit(1)
+			}
+			ticketKeys.Apply(clientTLSConfig)
+			standbyPair.Register(ticketKeys)
+			go rotateSessionTicketKeys(standbyPair, ticketKeys, time.Duration(*tlsSessionTicketKeyRotationInterval)*time.Second)
+		}
+		if verdictCache != nil {
+			standbyPair.Register(verdictCache)
+		}
+	}
+	if *tlsSessionTicketKeysStorage == sessionTicketKeysStorageKeystore && clientTLSConfig != nil && *tlsSessionTicketsEnable {
+		rotationInterval := time.Duration(*tlsSessionTicketKeyRotationInterval) * time.Second
+		ticketKeys, err := network.NewSessionTicketKeys()
+		if err != nil {
+			log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorTransportConfiguration).
+				Errorln("Can't generate TLS session ticket keys")
+			os.Exit(1)
+		}
+		ticketKeysStorage := network.NewFileSessionTicketKeysStorage(*keysDir, newMasterKeyEncryptor(*keysDir))
+		err = cmd.RetryOnStartup("TLS session ticket keys", func() error {
+			return ticketKeys.Sync(ticketKeysStorage, rotationInterval)
+		})
+		if err != nil {
+			log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorTransportConfiguration).
+				Errorln("Can't sync TLS session ticket keys with keystore")
+			os.Exit(1)
+		}
+		ticketKeys.Apply(clientTLSConfig)
+		go ticketKeys.RunSync(context.Background(), ticketKeysStorage, rotationInterval, sessionTicketKeysSyncInterval)
+		log.Infoln("Use TLS session ticket keys stored in keystore")
+	}
+
 	sigHandlerSIGTERM.AddCallback(func() {
 		log.Infof("Received incoming SIGTERM or SIGINT signal")
 		log.Debugf("Stop accepting new connections, waiting until current connections close")
 		// Stop accepting new connections
 		server.StopListeners()
+		if standbyPair != nil {
+			// standby node takes over without waiting for failover timeout
+			if err := standbyPair.Release(); err != nil {
+				log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorStandbyPair).
+					Warningln("Can't release lease of active node")
+			}
+		}
 		// Wait a maximum of N seconds for existing connections to finish
 		err := server.WaitWithTimeout(time.Duration(*closeConnectionTimeout) * time.Second)
 		if err == common.ErrWaitTimeout {
@@ -576,6 +1517,26 @@ func main() {
 		os.Exit(0)
 	})
 
+	if standbyPair != nil {
+		go standbyPair.Run(context.Background())
+		log.Infof("Waiting as standby node until active node stops heartbeats")
+		<-standbyPair.Active()
+		go func() {
+			<-standbyPair.Lost()
+			log.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorStandbyPair).
+				Errorln("Other node of standby pair became active, stop serving connections")
+			os.Exit(1)
+		}()
+	}
+
+	if cmd.IsStartupRetryEnabled() {
+		// database is waited for only if retries are enabled, without them it is connected per client session
+		if err := cmd.RetryOnStartup("database", config.CheckDBConnection); err != nil {
+			log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCantConnectToDB).
+				Warnln("Database is unavailable, client connections will fail until it becomes available")
+		}
+	}
+
 	log.Infof("Start listening to connections. Current PID: %v", os.Getpid())
 
 	if *debug {
@@ -589,6 +1550,12 @@ func main() {
 		logging.SetLogLevel(logging.LogDiscard)
 	}
 
+	if *decryptionDiagnosticsClientIDs != "" {
+		for _, clientID := range strings.Split(*decryptionDiagnosticsClientIDs, ",") {
+			base.GetDecryptionDiagnostics().Enable([]byte(strings.TrimSpace(clientID)), time.Duration(*decryptionDiagnosticsDuration)*time.Second)
+		}
+	}
+
 	ctx := context.Background()
 	if os.Getenv(gracefulEnv) == "true" {
 		if *withZone || *enableHTTPAPI {
@@ -601,34 +1568,121 @@ func main() {
 		}
 		go server.Start(ctx)
 	}
+	if canaryChecker != nil {
+		// canary is read through listener of this server, so checks start when it serves connections
+		go canaryChecker.Run(ctx)
+	}
+	if ocspStapler != nil {
+		go ocspStapler.Run(ctx, time.Duration(*tlsOcspStaplingRefreshInterval)*time.Second)
+	}
+	if featureFlags != nil {
+		go featureFlags.Run(ctx, time.Duration(*featureFlagsReloadInterval)*time.Second, syscall.SIGUSR1)
+	}
+	// SIGHUP is used for graceful restart, so certificates are reloaded without restart on SIGUSR1
+	for _, reloader := range tlsReloaders {
+		go reloader.Run(ctx, time.Duration(*tlsReloadInterval)*time.Second, syscall.SIGUSR1)
+	}
 
 	// on sighup we run callback that stop all listeners (that stop background goroutine of server.Start())
 	// and try to restart acra-server and only after that exits
 	sigHandlerSIGHUP.Register()
 }
 
-func openKeyStoreV1(keysDir string, cacheSize int) keystore.ServerKeyStore {
-	masterKey, err := keystore.GetMasterKeyFromEnvironment()
-	if err != nil {
-		log.WithError(err).Errorln("Cannot load master key")
-		os.Exit(1)
+func openKeyStoreV1(keysDir string, cacheSize, historicalKeysLimit int) keystore.ServerKeyStore {
+	var keyEncryptor keystore.KeyEncryptor
+	var err error
+	if cmd.IsKeystoreAWSKMSEnabled() {
+		keyEncryptor, err = cmd.NewKeystoreAWSKMSEncryptor()
+		if err != nil {
+			log.WithError(err).
+				WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCantInitPrivateKeysEncryptor).
+				Errorln("Can't init AWS KMS key encryptor")
+			os.Exit(1)
+		}
+	} else {
+		var provider keystore.MasterKeyProvider
+		provider, err = cmd.NewKeystoreMasterKeyProvider()
+		if err == nil {
+			keyEncryptor, err = provider.KeyEncryptor()
+		}
+		if err != nil {
+			log.WithError(err).Errorln("Cannot load master key")
+			os.Exit(1)
+		}
 	}
-	scellEncryptor, err := keystore.NewSCellKeyEncryptor(masterKey)
-	if err != nil {
-		log.WithError(err).Errorln("Can't init scell encryptor")
-		os.Exit(1)
+	keyStoreBuilder := filesystem.NewCustomFilesystemKeyStore().
+		KeyDirectory(keysDir).
+		Encryptor(keyEncryptor).
+		CacheSize(cacheSize).
+		HistoricalKeysLimit(historicalKeysLimit)
+	if cmd.IsKeystoreBundleEnabled() {
+		var storage *filesystem.MemoryStorage
+		err := cmd.RetryOnStartup("keystore bundle", func() (err error) {
+			storage, err = cmd.LoadKeystoreBundle(keysDir)
+			return err
+		})
+		if err != nil {
+			log.WithError(err).
+				WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCantInitKeyStore).
+				Errorln("Can't load keystore bundle")
+			os.Exit(1)
+		}
+		keyStoreBuilder = keyStoreBuilder.Storage(storage)
 	}
-	keyStore, err := filesystem.NewFileSystemKeyStoreWithCacheSize(keysDir, scellEncryptor, cacheSize)
+	if cmd.IsKeystoreVaultEnabled() {
+		var storage *kms.VaultStorage
+		err := cmd.RetryOnStartup("Vault keystore", func() (err error) {
+			storage, err = cmd.NewKeystoreVaultStorage(keysDir)
+			return err
+		})
+		if err != nil {
+			log.WithError(err).
+				WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCantInitKeyStore).
+				Errorln("Can't connect to Vault keystore")
+			os.Exit(1)
+		}
+		keyStoreBuilder = keyStoreBuilder.Storage(storage)
+	}
+	if cmd.IsKeystoreRedisEnabled() {
+		var storage *filesystem.RedisStorage
+		err := cmd.RetryOnStartup("Redis keystore", func() (err error) {
+			storage, err = cmd.NewKeystoreRedisStorage(keysDir, keyEncryptor)
+			return err
+		})
+		if err != nil {
+			log.WithError(err).
+				WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCantInitKeyStore).
+				Errorln("Can't connect to Redis keystore")
+			os.Exit(1)
+		}
+		keyStoreBuilder = keyStoreBuilder.Storage(storage)
+	}
+	var keyStore *filesystem.KeyStore
+	err = cmd.RetryOnStartup("keystore", func() (err error) {
+		keyStore, err = keyStoreBuilder.Build()
+		return err
+	})
 	if err != nil {
 		log.WithError(err).
 			WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCantInitKeyStore).
 			Errorln("Can't initialise keystore")
 		os.Exit(1)
 	}
+	if cmd.IsKeyIntegrityScanEnabled() {
+		if err := cmd.ScanKeyIntegrity(keyStore); err != nil {
+			log.WithError(err).
+				WithField(logging.FieldKeyEventCode, logging.EventCodeErrorKeyIntegrityScanFailed).
+				Errorln("Keystore integrity scan failed, check master key")
+			os.Exit(1)
+		}
+	}
 	return keyStore
 }
 
 func openKeyStoreV2(keyDirPath string) keystore.ServerKeyStore {
+	if cmd.IsKeyIntegrityScanEnabled() {
+		log.Warningln("Keystore integrity scan is supported only for keystore v1, skipped")
+	}
 	encryption, signature, err := keystoreV2.GetMasterKeysFromEnvironment()
 	if err != nil {
 		log.WithError(err).Errorln("Cannot load master key")
@@ -639,7 +1693,11 @@ func openKeyStoreV2(keyDirPath string) keystore.ServerKeyStore {
 		log.WithError(err).Error("failed to initialize Secure Cell crypto suite")
 		os.Exit(1)
 	}
-	keyDir, err := filesystemV2.OpenDirectoryRW(keyDirPath, suite)
+	var keyDir api.MutableKeyStore
+	err = cmd.RetryOnStartup("keystore", func() (err error) {
+		keyDir, err = filesystemV2.OpenDirectoryRW(keyDirPath, suite)
+		return err
+	})
 	if err != nil {
 		log.WithError(err).
 			WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCantInitKeyStore).
@@ -648,3 +1706,69 @@ func openKeyStoreV2(keyDirPath string) keystore.ServerKeyStore {
 	}
 	return keystoreV2.NewServerKeyStore(keyDir)
 }
+
+// newMasterKeyEncryptor returns encryptor with master key of keystore of keysDir
+func newMasterKeyEncryptor(keysDir string) keystore.KeyEncryptor {
+	var encryptor keystore.KeyEncryptor
+	var err error
+	if !cmd.IsKeystoreBundleEnabled() && !cmd.IsKeystoreVaultEnabled() && !cmd.IsKeystoreRedisEnabled() && filesystemV2.IsKeyDirectory(keysDir) {
+		var masterKey []byte
+		masterKey, _, err = keystoreV2.GetMasterKeysFromEnvironment()
+		if err == nil {
+			encryptor, err = keystore.NewSCellKeyEncryptor(masterKey)
+		}
+	} else {
+		encryptor, err = keystore.EnvironmentMasterKeyProvider{}.KeyEncryptor()
+	}
+	if err != nil {
+		log.WithError(err).Errorln("Cannot load master key")
+		os.Exit(1)
+	}
+	return encryptor
+}
+
+// newStandbyPair returns node of standby pair which encrypts synced state with master key of keystore
+func newStandbyPair(sharedDir, nodeID, keysDir string, heartbeatInterval, failoverTimeout int) *standby.Pair {
+	encryptor := newMasterKeyEncryptor(keysDir)
+	var err error
+	if nodeID == "" {
+		nodeID, err = os.Hostname()
+		if err != nil {
+			log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+				Errorln("Can't get hostname for standby_node_id")
+			os.Exit(1)
+		}
+	}
+	pair, err := standby.NewPair(standby.Options{
+		Dir:               sharedDir,
+		NodeID:            nodeID,
+		Encryptor:         encryptor,
+		HeartbeatInterval: time.Duration(heartbeatInterval) * time.Second,
+		FailoverTimeout:   time.Duration(failoverTimeout) * time.Second,
+	})
+	if err != nil {
+		log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+			Errorln("Invalid standby pair options: standby_shared_dir is required, standby_failover_timeout should exceed standby_heartbeat_interval")
+		os.Exit(1)
+	}
+	log.WithField("node_id", nodeID).Infof("Standby pair mode enabled")
+	return pair
+}
+
+// rotateSessionTicketKeys rotates TLS session ticket keys while node is active, standby node imports rotated keys
+func rotateSessionTicketKeys(pair *standby.Pair, ticketKeys *network.SessionTicketKeys, interval time.Duration) {
+	<-pair.Active()
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		if err := ticketKeys.RotateIfExpired(interval); err != nil {
+			log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorStandbyPair).
+				Warningln("Can't rotate TLS session ticket keys")
+		}
+		select {
+		case <-pair.Lost():
+			return
+		case <-ticker.C:
+		}
+	}
+}
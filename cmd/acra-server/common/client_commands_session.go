@@ -25,9 +25,12 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"strconv"
 	"syscall"
+	"time"
 
 	"github.com/cossacklabs/acra/cmd"
+	"github.com/cossacklabs/acra/decryptor/base"
 	"github.com/cossacklabs/acra/keystore"
 	"github.com/cossacklabs/acra/logging"
 	"github.com/cossacklabs/acra/utils"
@@ -43,6 +46,11 @@ const (
 	Response500Error = "HTTP/1.1 500 Server error\r\n\r\n\r\n\r\n"
 )
 
+// HTTP 400 response
+const (
+	Response400Error = "HTTP/1.1 400 Bad Request\r\n\r\n%s\r\n\r\n"
+)
+
 // ClientCommandsSession handles Secure Session for client commands API
 type ClientCommandsSession struct {
 	ctx        context.Context
@@ -149,6 +157,60 @@ func (clientSession *ClientCommandsSession) HandleSession() {
 			logger.Debugln(string(jsonOutput))
 			response = fmt.Sprintf("HTTP/1.1 200 OK Found\r\n\r\n%s\r\n\r\n", string(jsonOutput))
 		}
+	case "/getVersion":
+		logger.Debugln("Got /getVersion request")
+		jsonOutput, err := utils.GetBuildInfo().ToJSON()
+		if err != nil {
+			logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorGeneral).
+				Warningln("Can't convert build info to JSON")
+			response = Response500Error
+		} else {
+			logger.Debugln("Handled request correctly")
+			response = fmt.Sprintf("HTTP/1.1 200 OK Found\r\n\r\n%s\r\n\r\n", string(jsonOutput))
+		}
+	case "/getAccessHeatmap":
+		logger.Debugln("Got /getAccessHeatmap request")
+		heatmap := clientSession.config.GetAccessHeatmap()
+		if heatmap == nil {
+			response = fmt.Sprintf(Response400Error, "access heatmap is disabled")
+			break
+		}
+		jsonOutput, err := heatmap.ToJSON()
+		if err != nil {
+			logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorGeneral).
+				Warningln("Can't convert access heatmap to JSON")
+			response = Response500Error
+		} else {
+			logger.Debugln("Handled request correctly")
+			response = fmt.Sprintf("HTTP/1.1 200 OK Found\r\n\r\n%s\r\n\r\n", string(jsonOutput))
+		}
+	case "/enableDecryptionDiagnostics":
+		logger.Debugln("Got /enableDecryptionDiagnostics request")
+		clientID := req.URL.Query().Get("client_id")
+		if clientID == "" {
+			response = fmt.Sprintf(Response400Error, "client_id is required")
+			break
+		}
+		duration := base.DefaultDecryptionDiagnosticsDuration
+		if value := req.URL.Query().Get("duration"); value != "" {
+			seconds, err := strconv.ParseUint(value, 10, 32)
+			if err != nil || seconds == 0 {
+				response = fmt.Sprintf(Response400Error, "duration should be positive number of seconds")
+				break
+			}
+			duration = time.Duration(seconds) * time.Second
+		}
+		base.GetDecryptionDiagnostics().Enable([]byte(clientID), duration)
+		response = "HTTP/1.1 200 OK Found\r\n\r\n"
+	case "/disableDecryptionDiagnostics":
+		logger.Debugln("Got /disableDecryptionDiagnostics request")
+		clientID := req.URL.Query().Get("client_id")
+		if clientID == "" {
+			response = fmt.Sprintf(Response400Error, "client_id is required")
+			break
+		}
+		base.GetDecryptionDiagnostics().Disable([]byte(clientID))
+		response = "HTTP/1.1 200 OK Found\r\n\r\n"
 	case "/setConfig":
 		logger.Debugln("Got /setConfig request")
 		decoder := json.NewDecoder(req.Body)
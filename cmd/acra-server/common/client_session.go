@@ -18,8 +18,10 @@ package common
 
 import (
 	"context"
+	"fmt"
 	"net"
 	"sync/atomic"
+	"time"
 
 	"github.com/cossacklabs/acra/decryptor/base"
 	"github.com/cossacklabs/acra/logging"
@@ -33,9 +35,12 @@ type ClientSession struct {
 	connection     net.Conn
 	connectionToDb net.Conn
 	ctx            context.Context
+	cancel         context.CancelFunc
 	logger         *log.Entry
 	statements     base.PreparedStatementRegistry
 	protocolState  interface{}
+	// protocol is database protocol detected on the connection, empty if detection is disabled
+	protocol base.DatabaseProtocol
 }
 
 var sessionCounter uint32
@@ -48,7 +53,10 @@ func NewClientSession(ctx context.Context, config *Config, connection net.Conn)
 	logger := logging.GetLoggerFromContext(ctx)
 	logger = logger.WithField("session_id", sessionID)
 	ctx = logging.SetLoggerToContext(ctx, logger)
-	return &ClientSession{connection: connection, config: config, ctx: ctx, logger: logger}, nil
+	ctx = base.NewContextWithRequestTimeout(ctx, config.GetRequestTimeout())
+	// cancelled on close to stop processing of responses for disconnected client
+	ctx, cancel := context.WithCancel(ctx)
+	return &ClientSession{connection: connection, config: config, ctx: ctx, cancel: cancel, logger: logger}, nil
 }
 
 // Logger returns session's logger.
@@ -94,9 +102,57 @@ func (clientSession *ClientSession) SetProtocolState(state interface{}) {
 	clientSession.protocolState = state
 }
 
-// ConnectToDb connects to the database via tcp using Host and Port from config.
+// detectProtocol detects database protocol of client connection and replaces the connection with one which replays
+// data read during detection.
+func (clientSession *ClientSession) detectProtocol(timeout time.Duration) (base.DatabaseProtocol, error) {
+	protocol, connection, err := base.DetectDatabaseProtocol(clientSession.connection, timeout)
+	if err != nil {
+		return "", err
+	}
+	clientSession.connection = connection
+	clientSession.protocol = protocol
+	clientSession.logger = clientSession.logger.WithField("db_protocol", protocol)
+	return protocol, nil
+}
+
+// ConnectToDb connects to the database via unix socket if it's configured, via tcp using Host and Port from config,
+// or address resolved from DNS SRV record if it's configured.
+// Connections detected as MySQL use MySQL database address.
 func (clientSession *ClientSession) ConnectToDb() error {
-	conn, err := network.Dial(network.BuildConnectionString("tcp", clientSession.config.GetDBHost(), clientSession.config.GetDBPort(), ""))
+	if clientSession.protocol == base.MySQLProtocol {
+		connectionString := network.BuildConnectionString("tcp", clientSession.config.mysqlDBHost, clientSession.config.mysqlDBPort, "")
+		if socket := clientSession.config.mysqlDBUnixSocket; socket != "" {
+			connectionString = "unix://" + socket
+		}
+		conn, err := clientSession.dialDb(connectionString)
+		if err != nil {
+			return err
+		}
+		clientSession.connectionToDb = conn
+		return nil
+	}
+	if socket := clientSession.config.GetDBUnixSocket(); socket != "" {
+		conn, err := clientSession.dialDb("unix://" + socket)
+		if err != nil {
+			return err
+		}
+		clientSession.connectionToDb = conn
+		return nil
+	}
+	if resolver := clientSession.config.GetDBSRVResolver(); resolver != nil {
+		address, err := resolver.Address()
+		if err != nil {
+			return err
+		}
+		clientSession.logger.WithField("db_address", address).Debugln("Use database address from SRV record")
+		conn, err := clientSession.dialDb(fmt.Sprintf("tcp://%s", address))
+		if err != nil {
+			return err
+		}
+		clientSession.connectionToDb = resolver.TrackConnection(address, conn)
+		return nil
+	}
+	conn, err := clientSession.dialDb(network.BuildConnectionString("tcp", clientSession.config.GetDBHost(), clientSession.config.GetDBPort(), ""))
 	if err != nil {
 		return err
 	}
@@ -104,8 +160,24 @@ func (clientSession *ClientSession) ConnectToDb() error {
 	return nil
 }
 
-// Close session connections to AcraConnector and database.
+// dialDb connects to the database and sends PROXY protocol header with address of client if it's enabled
+func (clientSession *ClientSession) dialDb(connectionString string) (net.Conn, error) {
+	conn, err := network.Dial(connectionString)
+	if err != nil {
+		return nil, err
+	}
+	if clientSession.config.GetProxyProtocolDBEmit() {
+		if err := network.WriteProxyProtocolHeader(conn, clientSession.connection.RemoteAddr(), clientSession.connection.LocalAddr()); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// Close session connections to AcraConnector and database and cancel session's context.
 func (clientSession *ClientSession) Close() {
+	clientSession.cancel()
 	clientSession.logger.Debugln("Close acra-connector connection")
 
 	err := clientSession.connection.Close()
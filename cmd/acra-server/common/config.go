@@ -20,6 +20,7 @@ import (
 	"encoding/json"
 	"errors"
 	"io/ioutil"
+	"time"
 
 	acracensor "github.com/cossacklabs/acra/acra-censor"
 	"github.com/cossacklabs/acra/encryptor"
@@ -35,6 +36,16 @@ import (
 type Config struct {
 	dbPort                  int
 	dbHost                  string
+	dbUnixSocket            string
+	dbSRVResolver           *network.SRVResolver
+	proxyProtocolAcceptor   *network.ProxyProtocolAcceptor
+	proxyProtocolDBEmit     bool
+	connectorMultiplexing   bool
+	connectionLimiter       *network.ConnectionLimiter
+	accessHeatmap           *encryptor.AccessHeatmap
+	mysqlDBHost             string
+	mysqlDBPort             int
+	mysqlDBUnixSocket       string
 	detectPoisonRecords     bool
 	stopOnPoison            bool
 	scriptOnPoison          string
@@ -57,6 +68,7 @@ type Config struct {
 	authDataPath            string
 	serviceName             string
 	configPath              string
+	requestTimeout          time.Duration
 }
 
 // UIEditableConfig describes which parts of AcraServer configuration can be changed from AcraWebconfig page
@@ -89,6 +101,89 @@ func (config *Config) SetDBConnectionSettings(host string, port int) {
 	config.dbPort = port
 }
 
+// SetMySQLDBConnectionSettings sets address of MySQL database used for connections detected as MySQL when
+// protocol detection is enabled, other connections use address set by SetDBConnectionSettings.
+func (config *Config) SetMySQLDBConnectionSettings(host string, port int) {
+	config.mysqlDBHost = host
+	config.mysqlDBPort = port
+}
+
+// SetDBUnixSocket sets path to unix socket of the database which overrides host and port
+func (config *Config) SetDBUnixSocket(path string) {
+	config.dbUnixSocket = path
+}
+
+// GetDBUnixSocket returns path to unix socket of the database or empty string if database is connected over tcp
+func (config *Config) GetDBUnixSocket() string {
+	return config.dbUnixSocket
+}
+
+// SetMySQLDBUnixSocket sets path to unix socket of MySQL database used for connections detected as MySQL, which
+// overrides address set by SetMySQLDBConnectionSettings
+func (config *Config) SetMySQLDBUnixSocket(path string) {
+	config.mysqlDBUnixSocket = path
+}
+
+// SetDBSRVResolver sets resolver of database address from DNS SRV record which overrides host and port
+func (config *Config) SetDBSRVResolver(resolver *network.SRVResolver) {
+	config.dbSRVResolver = resolver
+}
+
+// GetDBSRVResolver returns resolver of database address from DNS SRV record or nil if it's not used
+func (config *Config) GetDBSRVResolver() *network.SRVResolver {
+	return config.dbSRVResolver
+}
+
+// SetProxyProtocolAcceptor sets reader of PROXY protocol headers from trusted proxies
+func (config *Config) SetProxyProtocolAcceptor(acceptor *network.ProxyProtocolAcceptor) {
+	config.proxyProtocolAcceptor = acceptor
+}
+
+// GetProxyProtocolAcceptor returns reader of PROXY protocol headers or nil if PROXY protocol isn't accepted
+func (config *Config) GetProxyProtocolAcceptor() *network.ProxyProtocolAcceptor {
+	return config.proxyProtocolAcceptor
+}
+
+// SetProxyProtocolDBEmit sets that PROXY protocol header with client address is sent to database
+func (config *Config) SetProxyProtocolDBEmit(emit bool) {
+	config.proxyProtocolDBEmit = emit
+}
+
+// GetProxyProtocolDBEmit returns true if PROXY protocol header with client address is sent to database
+func (config *Config) GetProxyProtocolDBEmit() bool {
+	return config.proxyProtocolDBEmit
+}
+
+// SetConnectorMultiplexing sets that AcraConnector may carry client connections as streams of one multiplexed session
+func (config *Config) SetConnectorMultiplexing(enable bool) {
+	config.connectorMultiplexing = enable
+}
+
+// GetConnectorMultiplexing returns true if multiplexed sessions from AcraConnector are accepted
+func (config *Config) GetConnectorMultiplexing() bool {
+	return config.connectorMultiplexing
+}
+
+// SetConnectionLimiter sets limiter of incoming database connections
+func (config *Config) SetConnectionLimiter(limiter *network.ConnectionLimiter) {
+	config.connectionLimiter = limiter
+}
+
+// GetConnectionLimiter returns limiter of incoming database connections or nil if connections aren't limited
+func (config *Config) GetConnectionLimiter() *network.ConnectionLimiter {
+	return config.connectionLimiter
+}
+
+// SetAccessHeatmap sets aggregation of decryptions returned by HTTP API
+func (config *Config) SetAccessHeatmap(heatmap *encryptor.AccessHeatmap) {
+	config.accessHeatmap = heatmap
+}
+
+// GetAccessHeatmap returns aggregation of decryptions or nil if it's disabled
+func (config *Config) GetAccessHeatmap() *encryptor.AccessHeatmap {
+	return config.accessHeatmap
+}
+
 // WithConnector shows that AcraServer expects connections from AcraConnector
 func (config *Config) WithConnector() bool {
 	return config.withConnector
@@ -187,6 +282,16 @@ func (config *Config) DetectPoisonRecords() bool {
 	return config.detectPoisonRecords
 }
 
+// SetRequestTimeout sets time to process each data row of database responses, zero means no limit
+func (config *Config) SetRequestTimeout(timeout time.Duration) {
+	config.requestTimeout = timeout
+}
+
+// GetRequestTimeout returns time to process each data row of database responses
+func (config *Config) GetRequestTimeout() time.Duration {
+	return config.requestTimeout
+}
+
 // SetDebug sets if AcraServer should run in debug mode and print debug logs
 func (config *Config) SetDebug(value bool) {
 	config.debug = value
@@ -227,6 +332,26 @@ func (config *Config) GetDBPort() int {
 	return config.dbPort
 }
 
+// CheckDBConnection connects to the database with the same address as client sessions use and closes connection, so
+// availability of the database can be checked on startup
+func (config *Config) CheckDBConnection() error {
+	connectionString := network.BuildConnectionString("tcp", config.dbHost, config.dbPort, "")
+	if config.dbUnixSocket != "" {
+		connectionString = "unix://" + config.dbUnixSocket
+	} else if config.dbSRVResolver != nil {
+		address, err := config.dbSRVResolver.Address()
+		if err != nil {
+			return err
+		}
+		connectionString = "tcp://" + address
+	}
+	conn, err := network.Dial(connectionString)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
 // GetWholeMatch returns if AcraServer assumes that whole database cell has one AcraStruct
 func (config *Config) GetWholeMatch() bool {
 	return config.wholeMatch
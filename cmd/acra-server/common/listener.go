@@ -29,6 +29,8 @@ import (
 	"time"
 
 	"github.com/cossacklabs/acra/decryptor/base"
+	"github.com/cossacklabs/acra/decryptor/mysql"
+	"github.com/cossacklabs/acra/decryptor/postgresql"
 	"github.com/cossacklabs/acra/logging"
 	"github.com/cossacklabs/acra/network"
 	"github.com/prometheus/client_golang/prometheus"
@@ -47,8 +49,11 @@ type SServer struct {
 	errorSignalChannel    chan os.Signal
 	restartSignalsChannel chan os.Signal
 	proxyFactory          base.ProxyFactory
-	backgroundWorkersSync sync.WaitGroup
-	stopListenersSignal   chan bool
+	// protocolProxyFactories are used instead of proxyFactory if protocol detection is enabled
+	protocolProxyFactories   map[base.DatabaseProtocol]base.ProxyFactory
+	protocolDetectionTimeout time.Duration
+	backgroundWorkersSync    sync.WaitGroup
+	stopListenersSignal      chan bool
 }
 
 // ErrWaitTimeout error indicates that server was shutdown and waited N seconds while shutting down all connections.
@@ -66,6 +71,13 @@ func NewServer(config *Config, proxyFactory base.ProxyFactory, errorChan chan os
 	}, nil
 }
 
+// EnableProtocolDetection makes server detect database protocol of each connection and proxy it with factory of
+// detected protocol.
+func (server *SServer) EnableProtocolDetection(proxyFactories map[base.DatabaseProtocol]base.ProxyFactory, timeout time.Duration) {
+	server.protocolProxyFactories = proxyFactories
+	server.protocolDetectionTimeout = timeout
+}
+
 // Close all listeners and return first error
 func (server *SServer) Close() {
 	log.Debugln("Closing server listeners..")
@@ -147,6 +159,23 @@ func (server *SServer) handleClientSession(clientID []byte, clientSession *Clien
 	clientProxyErrorCh := make(chan error, 1)
 	dbProxyErrorCh := make(chan error, 1)
 
+	proxyFactory := server.proxyFactory
+	if server.protocolProxyFactories != nil {
+		protocol, err := clientSession.detectProtocol(server.protocolDetectionTimeout)
+		if err != nil {
+			sessionLogger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorGeneralConnectionProcessing).
+				Errorln("Can't detect database protocol of connection")
+			if err = clientSession.ClientConnection().Close(); err != nil {
+				sessionLogger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCantCloseConnectionToService).
+					Errorln("Error with closing connection to acra-connector")
+			}
+			return
+		}
+		sessionLogger = clientSession.Logger()
+		sessionLogger.Debugln("Detected database protocol")
+		proxyFactory = server.protocolProxyFactories[protocol]
+	}
+
 	sessionLogger.Debugf("Connecting to db")
 	err := clientSession.ConnectToDb()
 	if err != nil {
@@ -162,9 +191,10 @@ func (server *SServer) handleClientSession(clientID []byte, clientSession *Clien
 		return
 	}
 
-	proxy, err := server.proxyFactory.New(clientID, clientSession)
+	proxy, err := proxyFactory.New(clientID, clientSession)
 	if err != nil {
 		sessionLogger.WithError(err).Errorln("Can't create new proxy for connection")
+		clientSession.Close()
 		return
 	}
 
@@ -229,6 +259,37 @@ func (server *SServer) processConnection(connection net.Conn, callback *callback
 	wrapCtx, wrapSpan := trace.StartSpan(ctx, "WrapServer", server.config.GetTraceOptions()...)
 	logger := logging.NewLoggerWithTrace(wrapCtx)
 
+	if acceptor := server.config.GetProxyProtocolAcceptor(); acceptor != nil {
+		proxiedConnection, err := acceptor.Accept(connection)
+		if err != nil {
+			logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCantWrapConnection).
+				WithField("proxy_address", connection.RemoteAddr().String()).Errorln("Can't read PROXY protocol header")
+			if closeErr := connection.Close(); closeErr != nil {
+				logger.WithError(closeErr).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCantCloseConnection).
+					Errorln("Can't close connection")
+			}
+			wrapSpan.End()
+			return
+		}
+		if proxiedConnection != connection {
+			logger = logger.WithField("client_address", proxiedConnection.RemoteAddr().String())
+			logger.Infof("Got client address from PROXY protocol header of %v", connection.RemoteAddr())
+		}
+		connection = proxiedConnection
+	}
+
+	if callback.connectionType == dbConnectionType {
+		release, err := server.config.GetConnectionLimiter().Acquire(connection.RemoteAddr())
+		if err != nil {
+			logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCantAcceptNewConnections).
+				WithField("client_address", connection.RemoteAddr().String()).Warningln("Reject connection due to connection limits")
+			server.rejectConnection(connection, logger)
+			wrapSpan.End()
+			return
+		}
+		defer release()
+	}
+
 	wrappedConnection, clientID, err := server.config.ConnectionWrapper.WrapServer(wrapCtx, connection)
 	if err != nil {
 		logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCantWrapConnection).
@@ -242,6 +303,62 @@ func (server *SServer) processConnection(connection net.Conn, callback *callback
 	}
 	logger = logger.WithField("client_id", string(clientID))
 	wrapSpan.End()
+	if server.config.GetConnectorMultiplexing() {
+		session, plainConnection, err := network.AcceptMuxSession(wrappedConnection)
+		if err != nil {
+			logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCantWrapConnection).
+				Errorln("Can't read first bytes of connection from AcraConnector")
+			if closeErr := wrappedConnection.Close(); closeErr != nil {
+				logger.WithError(closeErr).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCantCloseConnection).
+					Errorln("Can't close connection")
+			}
+			return
+		}
+		if session != nil {
+			server.serveMuxSession(wrapCtx, wrapSpan, session, clientID, callback, logger)
+			return
+		}
+		wrappedConnection = plainConnection
+	}
+	server.serveConnection(wrapCtx, wrapSpan, wrappedConnection, clientID, callback, logger)
+}
+
+// serveMuxSession processes every stream of multiplexed session from AcraConnector as separate connection until
+// session is closed
+func (server *SServer) serveMuxSession(wrapCtx context.Context, wrapSpan *trace.Span, session *network.MuxSession, clientID []byte, callback *callbackData, logger *log.Entry) {
+	logger.Infoln("Start multiplexed session with AcraConnector")
+	defer session.Close()
+	for {
+		stream, err := session.Accept()
+		if err != nil {
+			logger.Infoln("Multiplexed session with AcraConnector closed")
+			return
+		}
+		server.backgroundWorkersSync.Add(1)
+		go func() {
+			defer server.backgroundWorkersSync.Done()
+			_ = server.connectionManager.AddConnection(stream)
+			defer server.connectionManager.RemoveConnection(stream)
+			defer stream.Close()
+			// every stream is limited as separate connection of client
+			if callback.connectionType == dbConnectionType {
+				release, err := server.config.GetConnectionLimiter().Acquire(stream.RemoteAddr())
+				if err != nil {
+					logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCantAcceptNewConnections).
+						Warningln("Reject stream of multiplexed session due to connection limits")
+					server.rejectConnection(stream, logger)
+					return
+				}
+				defer release()
+			}
+			server.serveConnection(wrapCtx, wrapSpan, stream, clientID, callback, logger)
+		}()
+	}
+}
+
+// serveConnection reads trace from AcraConnector and calls callback with wrapped connection
+func (server *SServer) serveConnection(wrapCtx context.Context, wrapSpan *trace.Span, wrappedConnection net.Conn, clientID []byte, callback *callbackData, logger *log.Entry) {
+	var ctx context.Context
 	var span *trace.Span
 	if server.config.WithConnector() {
 		logger.Debugln("Read trace")
@@ -308,6 +425,34 @@ func (server *SServer) start(parentContext context.Context, listener net.Listene
 	}
 }
 
+// rejectConnectionWriteTimeout limits time to send error to rejected client
+const rejectConnectionWriteTimeout = time.Second
+
+// rejectConnection sends "too many connections" error of database protocol to client and closes connection. Error is
+// sent only to clients connected directly, connections from AcraConnector and connections with unknown protocol are
+// just closed.
+func (server *SServer) rejectConnection(connection net.Conn, logger *log.Entry) {
+	var errorPacket []byte
+	if !server.config.WithConnector() && server.protocolProxyFactories == nil {
+		if server.config.UseMySQL() {
+			errorPacket = mysql.NewTooManyConnectionsError()
+		} else if server.config.UsePostgreSQL() {
+			errorPacket = postgresql.NewPgTooManyConnectionsError()
+		}
+	}
+	if errorPacket != nil {
+		if err := connection.SetWriteDeadline(time.Now().Add(rejectConnectionWriteTimeout)); err == nil {
+			if _, err := connection.Write(errorPacket); err != nil {
+				logger.WithError(err).Debugln("Can't send error to rejected client")
+			}
+		}
+	}
+	if err := connection.Close(); err != nil {
+		logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCantCloseConnection).
+			Errorln("Can't close connection")
+	}
+}
+
 // ListenerAcra returns listener for AcraServer database connections.
 func (server *SServer) ListenerAcra() net.Listener {
 	return server.listenerACRA
@@ -21,6 +21,10 @@ import (
 
 	"github.com/cossacklabs/acra/cmd"
 	"github.com/cossacklabs/acra/decryptor/base"
+	"github.com/cossacklabs/acra/encryptor"
+	"github.com/cossacklabs/acra/featureflags"
+	"github.com/cossacklabs/acra/keystore/lru"
+	"github.com/cossacklabs/acra/network"
 	"github.com/cossacklabs/acra/utils"
 	"github.com/prometheus/client_golang/prometheus"
 )
@@ -54,6 +58,19 @@ func RegisterMetrics(serviceName string, version *utils.Version, edition utils.P
 		prometheus.MustRegister(connectionProcessingTimeHistogram)
 		base.RegisterAcraStructProcessingMetrics()
 		base.RegisterDbProcessingMetrics()
+		base.RegisterShadowWriteMetrics()
+		base.RegisterCanaryMetrics()
+		base.RegisterIdleInTransactionMetrics()
+		encryptor.RegisterContextConfusionMetrics()
+		encryptor.RegisterMaxAgeMetrics()
+		encryptor.RegisterCiphertextSizeMetrics()
+		encryptor.RegisterDecryptionScheduleMetrics()
+		encryptor.RegisterDecryptionPurposeMetrics()
+		encryptor.RegisterTenantIsolationMetrics()
+		network.RegisterLatencyBudgetMetrics()
+		network.RegisterConnectionLimiterMetrics()
+		lru.RegisterKeyStoreCacheMetrics()
+		featureflags.RegisterFeatureFlagsMetrics()
 		cmd.RegisterVersionMetrics(serviceName, version)
 		cmd.RegisterBuildInfoMetrics(serviceName, edition)
 	})
@@ -0,0 +1,145 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package main is entry point for AcraSupportBundle utility. AcraSupportBundle gathers configs of Acra services
+// (only fields which differ from defaults), versions of installed services, inventory of keys without their content,
+// summaries of errors from logs and environment info into one archive for support tickets. Secrets are removed by
+// redaction pass and every collected file is listed in manifest, so archive can be reviewed before it's sent.
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/cossacklabs/acra/cmd"
+	"github.com/cossacklabs/acra/logging"
+	"github.com/cossacklabs/acra/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+// Constants used by AcraSupportBundle
+var (
+	// defaultConfigPath relative path to config which will be parsed as default
+	defaultConfigPath = utils.GetConfigPathByName("acra-support-bundle")
+	serviceName       = "acra-support-bundle"
+)
+
+// defaultServices are services which versions are collected by default
+var defaultServices = []string{"acra-server", "acra-translator", "acra-connector", "acra-keys"}
+
+// splitList returns non-empty items of comma-separated list
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// collectLogSummaries adds summaries of warnings and errors of logFiles into bundle
+func collectLogSummaries(bundle *Bundle, logFiles []string, maxLines int, redactor *Redactor) {
+	for _, path := range logFiles {
+		file, err := os.Open(path)
+		if err != nil {
+			bundle.Skip(path, err)
+			continue
+		}
+		summary, err := SummarizeLog(file, maxLines, redactor)
+		file.Close()
+		if err != nil {
+			bundle.Skip(path, err)
+			continue
+		}
+		if err := bundle.AddJSON("logs/"+filepath.Base(path)+".summary.json", path, summary); err != nil {
+			bundle.Skip(path, err)
+		}
+	}
+}
+
+func main() {
+	configDir := flag.String("config_dir", "configs", "Directory with YAML configs of Acra services (acra-*.yaml) to collect")
+	defaultConfigDir := flag.String("default_config_dir", "", "Directory with default configs of Acra services (e.g. generated with --dump_config), only fields which differ from them are collected. Whole configs are collected if empty")
+	keysDir := flag.String("keys_dir", "", "Folder of keystore to collect inventory of keys (purposes, IDs and modification times, without key content). Skipped if empty")
+	keysDirPublic := flag.String("keys_dir_public", "", "Folder with public keys of keystore v1 if it differs from keys_dir")
+	logFiles := flag.String("log_files", "", "Comma-separated list of log files of Acra services to summarize warnings and errors of")
+	logMaxLines := flag.Int("log_max_lines", 10000, "Number of the last lines of every log file to summarize")
+	services := flag.String("services", strings.Join(defaultServices, ","), "Comma-separated list of installed services which versions are collected with --version. Versions are skipped if empty")
+	redactFields := flag.String("redact_fields", "", "Comma-separated list of extra config fields which values should be redacted")
+	output := flag.String("output", "acra-support-bundle.tar.gz", "Path to output archive")
+
+	logging.SetLogLevel(logging.LogVerbose)
+
+	err := cmd.Parse(defaultConfigPath, serviceName)
+	if err != nil {
+		log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCantReadServiceConfig).
+			Errorln("Can't parse args")
+		os.Exit(1)
+	}
+	if *logMaxLines <= 0 {
+		log.Errorln("--log_max_lines should be greater than zero")
+		os.Exit(1)
+	}
+
+	redactor := NewRedactor(splitList(*redactFields))
+	bundle := NewBundle()
+
+	if err := CollectConfigs(bundle, *configDir, *defaultConfigDir, redactor); err != nil {
+		bundle.Skip(*configDir, err)
+	}
+	if *keysDir != "" {
+		inventory, err := CollectKeyInventory(*keysDir, *keysDirPublic)
+		if err == nil {
+			err = bundle.AddJSON("keys/inventory.json", *keysDir, inventory)
+		}
+		if err != nil {
+			bundle.Skip(*keysDir, err)
+		}
+	}
+	collectLogSummaries(bundle, splitList(*logFiles), *logMaxLines, redactor)
+	if err := bundle.AddJSON("environment.json", "", CollectEnvironment()); err != nil {
+		bundle.Skip("environment", err)
+	}
+	if serviceList := splitList(*services); len(serviceList) > 0 {
+		if err := bundle.AddJSON("versions.json", "", CollectVersions(serviceList, time.Second*5)); err != nil {
+			bundle.Skip("versions", err)
+		}
+	}
+
+	file, err := os.OpenFile(*output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		log.WithError(err).Errorln("Can't create output archive")
+		os.Exit(1)
+	}
+	if err := bundle.Write(file); err != nil {
+		file.Close()
+		log.WithError(err).Errorln("Can't write support bundle")
+		os.Exit(1)
+	}
+	if err := file.Close(); err != nil {
+		log.WithError(err).Errorln("Can't write support bundle")
+		os.Exit(1)
+	}
+	manifest := bundle.Manifest()
+	for _, skipped := range manifest.Skipped {
+		log.WithField("source", skipped.Source).Warningf("Skipped: %s", skipped.Reason)
+	}
+	log.Infof("Support bundle with %d files saved to %s, review %s before sending it", len(manifest.Files), *output, ManifestFileName)
+}
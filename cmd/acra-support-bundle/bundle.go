@@ -0,0 +1,138 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/cossacklabs/acra/utils"
+)
+
+// ManifestFileName is name of manifest in support bundle
+const ManifestFileName = "manifest.json"
+
+// ManifestEntry describes file of support bundle
+type ManifestEntry struct {
+	Path     string   `json:"path"`
+	Source   string   `json:"source,omitempty"`
+	Size     int      `json:"size"`
+	SHA256   string   `json:"sha256"`
+	Redacted []string `json:"redacted,omitempty"`
+}
+
+// ManifestSkippedSource describes data which was requested but couldn't be collected
+type ManifestSkippedSource struct {
+	Source string `json:"source"`
+	Reason string `json:"reason"`
+}
+
+// Manifest lists everything collected into support bundle, so it can be reviewed before sending
+type Manifest struct {
+	CreatedAt time.Time               `json:"created_at"`
+	Tool      *utils.BuildInfo        `json:"tool"`
+	Files     []ManifestEntry         `json:"files"`
+	Skipped   []ManifestSkippedSource `json:"skipped,omitempty"`
+}
+
+type bundleFile struct {
+	path string
+	data []byte
+}
+
+// Bundle accumulates files of support bundle and their manifest
+type Bundle struct {
+	files    []bundleFile
+	manifest Manifest
+}
+
+// NewBundle returns empty Bundle
+func NewBundle() *Bundle {
+	return &Bundle{manifest: Manifest{CreatedAt: time.Now().UTC(), Tool: utils.GetBuildInfo(), Files: []ManifestEntry{}}}
+}
+
+// Add adds file with data collected from source, redacted are names of fields removed from it
+func (bundle *Bundle) Add(path, source string, data []byte, redacted []string) {
+	hash := sha256.Sum256(data)
+	bundle.files = append(bundle.files, bundleFile{path: path, data: data})
+	bundle.manifest.Files = append(bundle.manifest.Files, ManifestEntry{
+		Path:     path,
+		Source:   source,
+		Size:     len(data),
+		SHA256:   hex.EncodeToString(hash[:]),
+		Redacted: redacted,
+	})
+}
+
+// AddJSON adds file with value serialized as indented JSON
+func (bundle *Bundle) AddJSON(path, source string, value interface{}) error {
+	buffer := &bytes.Buffer{}
+	encoder := json.NewEncoder(buffer)
+	// redacted values shouldn't be escaped
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(value); err != nil {
+		return err
+	}
+	bundle.Add(path, source, buffer.Bytes(), nil)
+	return nil
+}
+
+// Skip records source which couldn't be collected
+func (bundle *Bundle) Skip(source string, err error) {
+	bundle.manifest.Skipped = append(bundle.manifest.Skipped, ManifestSkippedSource{Source: source, Reason: err.Error()})
+}
+
+// Manifest returns manifest of collected files
+func (bundle *Bundle) Manifest() *Manifest {
+	return &bundle.manifest
+}
+
+// Write writes bundle as gzipped tar archive with manifest as the first file
+func (bundle *Bundle) Write(writer io.Writer) error {
+	manifest, err := json.MarshalIndent(&bundle.manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	gzipWriter := gzip.NewWriter(writer)
+	tarWriter := tar.NewWriter(gzipWriter)
+	files := append([]bundleFile{{path: ManifestFileName, data: append(manifest, '\n')}}, bundle.files...)
+	for _, file := range files {
+		header := &tar.Header{
+			Name:    file.path,
+			Mode:    0600,
+			Size:    int64(len(file.data)),
+			ModTime: bundle.manifest.CreatedAt.Truncate(time.Second),
+		}
+		if err := tarWriter.WriteHeader(header); err != nil {
+			return err
+		}
+		if _, err := tarWriter.Write(file.data); err != nil {
+			return err
+		}
+	}
+	if err := tarWriter.Close(); err != nil {
+		return err
+	}
+	return gzipWriter.Close()
+}
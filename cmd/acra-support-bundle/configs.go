@@ -0,0 +1,112 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// configVersionField is field of service configs with version of config format, always exported
+const configVersionField = "version"
+
+// LoadServiceConfig reads YAML config of Acra service
+func LoadServiceConfig(path string) (map[string]interface{}, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config := make(map[string]interface{})
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("invalid config %s: %w", path, err)
+	}
+	return config, nil
+}
+
+// DiffConfig returns fields of config which differ from defaults, fields absent in defaults are kept
+func DiffConfig(config, defaults map[string]interface{}) map[string]interface{} {
+	diff := make(map[string]interface{})
+	for name, value := range config {
+		defaultValue, ok := defaults[name]
+		if name == configVersionField || !ok || !reflect.DeepEqual(value, defaultValue) {
+			diff[name] = value
+		}
+	}
+	return diff
+}
+
+// listServiceConfigs returns names of files with configs of Acra services in directory
+func listServiceConfigs(configDir string) ([]string, error) {
+	files, err := ioutil.ReadDir(configDir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, file := range files {
+		if !file.IsDir() && strings.HasPrefix(file.Name(), "acra-") && strings.HasSuffix(file.Name(), ".yaml") {
+			names = append(names, file.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// CollectConfigs adds redacted configs of services from configDir into bundle. If defaultConfigDir isn't empty, only
+// fields which differ from default configs with the same names are exported.
+func CollectConfigs(bundle *Bundle, configDir, defaultConfigDir string, redactor *Redactor) error {
+	names, err := listServiceConfigs(configDir)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		path := filepath.Join(configDir, name)
+		config, err := LoadServiceConfig(path)
+		if err != nil {
+			bundle.Skip(path, err)
+			continue
+		}
+		header := "# full config"
+		if defaultConfigDir != "" {
+			defaultPath := filepath.Join(defaultConfigDir, name)
+			defaults, err := LoadServiceConfig(defaultPath)
+			switch {
+			case err == nil:
+				config = DiffConfig(config, defaults)
+				header = fmt.Sprintf("# fields which differ from %s", defaultPath)
+			case os.IsNotExist(err):
+				header = "# full config, no default config to compare with"
+			default:
+				bundle.Skip(defaultPath, err)
+			}
+		}
+		redacted := redactor.RedactConfig(config)
+		data, err := yaml.Marshal(config)
+		if err != nil {
+			bundle.Skip(path, err)
+			continue
+		}
+		bundle.Add("configs/"+name, path, append([]byte(header+"\n"), data...), redacted)
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+// environmentVariablePrefixes are prefixes of environment variables related to Acra, only their names are exported
+var environmentVariablePrefixes = []string{"ACRA_", "SRC_ACRA_", "DST_ACRA_", "AWS_", "VAULT_", "GODEBUG"}
+
+// EnvironmentInfo describes host where support bundle is collected
+type EnvironmentInfo struct {
+	Platform  string   `json:"platform"`
+	CPUs      int      `json:"cpus"`
+	GoVersion string   `json:"go_version"`
+	Variables []string `json:"variables"`
+}
+
+// CollectEnvironment returns EnvironmentInfo of current host, values of environment variables aren't exported
+func CollectEnvironment() *EnvironmentInfo {
+	info := &EnvironmentInfo{
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+		CPUs:      runtime.NumCPU(),
+		GoVersion: runtime.Version(),
+		Variables: []string{},
+	}
+	for _, variable := range os.Environ() {
+		name := strings.SplitN(variable, "=", 2)[0]
+		for _, prefix := range environmentVariablePrefixes {
+			if strings.HasPrefix(name, prefix) {
+				info.Variables = append(info.Variables, name)
+				break
+			}
+		}
+	}
+	sort.Strings(info.Variables)
+	return info
+}
+
+// ServiceVersion is build information of installed service or reason why it isn't available
+type ServiceVersion struct {
+	Path      string          `json:"path,omitempty"`
+	BuildInfo json.RawMessage `json:"build_info,omitempty"`
+	Error     string          `json:"error,omitempty"`
+}
+
+// CollectVersions runs installed binaries of services with --version and returns their build information
+func CollectVersions(services []string, timeout time.Duration) map[string]ServiceVersion {
+	versions := make(map[string]ServiceVersion, len(services))
+	for _, service := range services {
+		service = strings.TrimSpace(service)
+		if service == "" {
+			continue
+		}
+		path, err := exec.LookPath(service)
+		if err != nil {
+			versions[service] = ServiceVersion{Error: err.Error()}
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		output, err := exec.CommandContext(ctx, path, "--version").Output()
+		cancel()
+		version := ServiceVersion{Path: path}
+		output = bytes.TrimSpace(output)
+		switch {
+		case err != nil:
+			version.Error = err.Error()
+		case json.Valid(output):
+			version.BuildInfo = output
+		default:
+			version.Error = "unexpected output of --version"
+		}
+		versions[service] = version
+	}
+	return versions
+}
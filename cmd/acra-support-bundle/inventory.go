@@ -0,0 +1,172 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cossacklabs/acra/keystore/filesystem"
+	filesystemV2 "github.com/cossacklabs/acra/keystore/v2/keystore/filesystem"
+)
+
+// Keystore versions of key inventory
+const (
+	keyStoreVersion1 = "v1"
+	keyStoreVersion2 = "v2"
+)
+
+// Suffixes of key files which aren't current keys
+const (
+	keyHistoryDirSuffix = ".old"
+	keyRingSuffix       = ".keyring"
+)
+
+// KeyInventoryEntry describes key of keystore without its content
+type KeyInventoryEntry struct {
+	Purpose   string    `json:"purpose"`
+	ID        string    `json:"id,omitempty"`
+	Public    bool      `json:"public,omitempty"`
+	Private   bool      `json:"private,omitempty"`
+	Symmetric bool      `json:"symmetric,omitempty"`
+	History   int       `json:"history,omitempty"`
+	Modified  time.Time `json:"modified"`
+}
+
+// KeyInventory lists keys of keystore
+type KeyInventory struct {
+	Version string              `json:"version"`
+	Keys    []KeyInventoryEntry `json:"keys"`
+}
+
+// keyFileEnumerator lists current key files of keystore v1 directories
+type keyFileEnumerator struct {
+	directories []string
+}
+
+// EnumerateExportedKeyPaths returns paths of key files ignoring history of rotated keys
+func (enumerator *keyFileEnumerator) EnumerateExportedKeyPaths() ([]string, error) {
+	var paths []string
+	for _, directory := range enumerator.directories {
+		err := filepath.Walk(directory, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() && strings.HasSuffix(info.Name(), keyHistoryDirSuffix) {
+				return filepath.SkipDir
+			}
+			if !info.IsDir() {
+				paths = append(paths, path)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return paths, nil
+}
+
+// keyFileInfo returns count of rotated versions and modification time of key file, zero values if path is empty
+func keyFileInfo(path string) (int, time.Time) {
+	if path == "" {
+		return 0, time.Time{}
+	}
+	var modified time.Time
+	if info, err := os.Stat(path); err == nil {
+		modified = info.ModTime().UTC()
+	}
+	history, _ := filepath.Glob(filepath.Join(path+keyHistoryDirSuffix, "*"))
+	return len(history), modified
+}
+
+// CollectKeyInventory returns purposes, IDs and modification times of keys in directories of keystore. Keys aren't
+// read, so master key isn't required.
+func CollectKeyInventory(keysDir, keysDirPublic string) (*KeyInventory, error) {
+	if filesystemV2.IsKeyDirectory(keysDir) {
+		return collectKeyRingInventory(keysDir)
+	}
+	enumerator := &keyFileEnumerator{directories: []string{keysDir}}
+	if keysDirPublic != "" && keysDirPublic != keysDir {
+		enumerator.directories = append(enumerator.directories, keysDirPublic)
+	}
+	exportedKeys, err := filesystem.EnumerateExportedKeys(enumerator)
+	if err != nil {
+		return nil, err
+	}
+	inventory := &KeyInventory{Version: keyStoreVersion1, Keys: make([]KeyInventoryEntry, 0, len(exportedKeys))}
+	for _, key := range exportedKeys {
+		entry := KeyInventoryEntry{
+			Purpose:   key.Purpose,
+			ID:        string(key.ID),
+			Public:    key.PublicPath != "",
+			Private:   key.PrivatePath != "",
+			Symmetric: key.SymmetricPath != "",
+		}
+		for _, path := range []string{key.PrivatePath, key.SymmetricPath, key.PublicPath} {
+			history, modified := keyFileInfo(path)
+			if history > entry.History {
+				entry.History = history
+			}
+			if modified.After(entry.Modified) {
+				entry.Modified = modified
+			}
+		}
+		inventory.Keys = append(inventory.Keys, entry)
+	}
+	sortKeyInventory(inventory)
+	return inventory, nil
+}
+
+// collectKeyRingInventory lists key rings of keystore v2 by their paths
+func collectKeyRingInventory(keysDir string) (*KeyInventory, error) {
+	inventory := &KeyInventory{Version: keyStoreVersion2, Keys: []KeyInventoryEntry{}}
+	err := filepath.Walk(keysDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !strings.HasSuffix(path, keyRingSuffix) {
+			return nil
+		}
+		relative, err := filepath.Rel(keysDir, path)
+		if err != nil {
+			return err
+		}
+		inventory.Keys = append(inventory.Keys, KeyInventoryEntry{
+			Purpose:  filepath.ToSlash(strings.TrimSuffix(relative, keyRingSuffix)),
+			Modified: info.ModTime().UTC(),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sortKeyInventory(inventory)
+	return inventory, nil
+}
+
+func sortKeyInventory(inventory *KeyInventory) {
+	sort.Slice(inventory.Keys, func(i, j int) bool {
+		if inventory.Keys[i].Purpose != inventory.Keys[j].Purpose {
+			return inventory.Keys[i].Purpose < inventory.Keys[j].Purpose
+		}
+		return inventory.Keys[i].ID < inventory.Keys[j].ID
+	})
+}
@@ -0,0 +1,62 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cossacklabs/acra/keystore/filesystem"
+)
+
+func TestCollectKeyInventory(t *testing.T) {
+	keysDir, err := ioutil.TempDir("", "support-bundle-keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(keysDir)
+	files := []string{"alice_storage", "alice_storage.pub", "alice_storage.old/2020-12-01T10:00:00", "bob_zone.pub", "auth_key"}
+	for _, file := range files {
+		path := filepath.Join(keysDir, file)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte("key"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	inventory, err := CollectKeyInventory(keysDir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inventory.Version != keyStoreVersion1 || len(inventory.Keys) != 3 {
+		t.Fatalf("Unexpected inventory %+v", inventory)
+	}
+	alice := inventory.Keys[1]
+	if alice.Purpose != filesystem.PurposeStorageClientKeyPair || alice.ID != "alice" || !alice.Private || !alice.Public ||
+		alice.History != 1 || alice.Modified.IsZero() {
+		t.Fatalf("Unexpected inventory of client key %+v", alice)
+	}
+	if inventory.Keys[0].Purpose != filesystem.PurposeAuthenticationSymKey || !inventory.Keys[0].Symmetric {
+		t.Fatalf("Unexpected inventory of auth key %+v", inventory.Keys[0])
+	}
+	if inventory.Keys[2].Purpose != filesystem.PurposeStorageZoneKeyPair || inventory.Keys[2].Private {
+		t.Fatalf("Unexpected inventory of zone key %+v", inventory.Keys[2])
+	}
+}
@@ -0,0 +1,197 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/cossacklabs/acra/logging"
+)
+
+// maxLogLineSize limits length of parsed lines of logs
+const maxLogLineSize = 1024 * 1024
+
+// cefLogStart starts log lines of CEF formatter
+const cefLogStart = "CEF:0|"
+
+// summarizedLogLevels are levels of log entries included into summaries, other levels are ignored
+var summarizedLogLevels = map[string]string{
+	"warn":    "warning",
+	"warning": "warning",
+	"error":   "error",
+	"fatal":   "fatal",
+	"panic":   "panic",
+}
+
+// cefSeverityLevels maps severity of CEF log entries to levels
+var cefSeverityLevels = map[string]string{
+	"3":  "warning",
+	"6":  "error",
+	"8":  "fatal",
+	"10": "panic",
+}
+
+// textLogFieldRegexp matches key=value fields of plaintext logs, values may be quoted
+var textLogFieldRegexp = regexp.MustCompile(`([\w.]+)=("(?:[^"\\]|\\.)*"|\S*)`)
+
+// LogSummaryEntry aggregates log entries with the same level, event code and message
+type LogSummaryEntry struct {
+	Level     string `json:"level"`
+	Code      string `json:"code,omitempty"`
+	Message   string `json:"message"`
+	Count     int    `json:"count"`
+	FirstSeen string `json:"first_seen,omitempty"`
+	LastSeen  string `json:"last_seen,omitempty"`
+}
+
+// logEntry is parsed line of log
+type logEntry struct {
+	level, code, message, timestamp string
+}
+
+// parseLogLine parses line of log in plaintext, JSON or CEF format of Acra services, returns false for unknown lines
+func parseLogLine(line string) (logEntry, bool) {
+	line = strings.TrimSpace(line)
+	if strings.HasPrefix(line, "{") {
+		fields := make(map[string]interface{})
+		if err := json.Unmarshal([]byte(line), &fields); err != nil {
+			return logEntry{}, false
+		}
+		entry := logEntry{}
+		for key, value := range fields {
+			var text string
+			switch typedValue := value.(type) {
+			case string:
+				text = typedValue
+			case float64:
+				text = strconv.FormatFloat(typedValue, 'f', -1, 64)
+			default:
+				continue
+			}
+			switch key {
+			case "level":
+				entry.level = text
+			case logging.FieldKeyEventCode:
+				entry.code = text
+			case "msg":
+				entry.message = text
+			case "timestamp":
+				entry.timestamp = text
+			}
+		}
+		return entry, entry.level != ""
+	}
+	if index := strings.Index(line, cefLogStart); index >= 0 {
+		// CEF:0|Vendor|Product|Version|Signature ID|Name|Severity|Extension
+		parts := strings.SplitN(line[index:], "|", 8)
+		if len(parts) < 7 {
+			return logEntry{}, false
+		}
+		entry := logEntry{code: parts[4], message: parts[5], level: cefSeverityLevels[parts[6]]}
+		if index > 0 {
+			// syslog prefix contains timestamp and host
+			entry.timestamp = strings.Fields(line[:index])[0]
+		}
+		return entry, entry.level != ""
+	}
+	entry := logEntry{}
+	for _, match := range textLogFieldRegexp.FindAllStringSubmatch(line, -1) {
+		value := match[2]
+		if strings.HasPrefix(value, `"`) {
+			if unquoted, err := strconv.Unquote(value); err == nil {
+				value = unquoted
+			}
+		}
+		switch match[1] {
+		case "level":
+			entry.level = value
+		case logging.FieldKeyEventCode:
+			entry.code = value
+		case "msg":
+			entry.message = value
+		case "time":
+			entry.timestamp = value
+		}
+	}
+	return entry, entry.level != ""
+}
+
+// SummarizeLog groups warnings and errors of the last maxLines lines of log by level, event code and message. Messages
+// are redacted, other fields of entries aren't exported.
+func SummarizeLog(reader io.Reader, maxLines int, redactor *Redactor) ([]LogSummaryEntry, error) {
+	if maxLines <= 0 {
+		return nil, fmt.Errorf("max lines of log should be greater than zero, took %d", maxLines)
+	}
+	// keep only the last maxLines lines in ring buffer
+	lines := make([]string, 0, maxLines)
+	next := 0
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxLogLineSize)
+	for scanner.Scan() {
+		if len(lines) < maxLines {
+			lines = append(lines, scanner.Text())
+			continue
+		}
+		lines[next] = scanner.Text()
+		next = (next + 1) % maxLines
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	lines = append(lines[next:], lines[:next]...)
+
+	summaries := make(map[logEntry]*LogSummaryEntry)
+	for _, line := range lines {
+		entry, ok := parseLogLine(line)
+		if !ok {
+			continue
+		}
+		level, ok := summarizedLogLevels[strings.ToLower(entry.level)]
+		if !ok {
+			continue
+		}
+		key := logEntry{level: level, code: entry.code, message: redactor.RedactString(entry.message)}
+		summary, ok := summaries[key]
+		if !ok {
+			summary = &LogSummaryEntry{Level: key.level, Code: key.code, Message: key.message, FirstSeen: entry.timestamp}
+			summaries[key] = summary
+		}
+		summary.Count++
+		summary.LastSeen = entry.timestamp
+	}
+	result := make([]LogSummaryEntry, 0, len(summaries))
+	for _, summary := range summaries {
+		result = append(result, *summary)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Count != result[j].Count {
+			return result[i].Count > result[j].Count
+		}
+		if result[i].Level != result[j].Level {
+			return result[i].Level < result[j].Level
+		}
+		return result[i].Message < result[j].Message
+	})
+	return result, nil
+}
@@ -0,0 +1,57 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSummarizeLog(t *testing.T) {
+	log := strings.Join([]string{
+		`time="2020-12-01T10:00:00Z" level=error msg="Can't connect to postgres://acra:first@db" code=580`,
+		`{"level":"error","msg":"Can't connect to postgres://acra:second@db","code":580,"timestamp":"2020-12-01T10:01:00Z"}`,
+		`2020-12-01T10:02:00Z host CEF:0|cossacklabs|acra-server|0.85.0|580|Can't connect to postgres://acra:third@db|6|unixTime=1`,
+		`time="2020-12-01T10:03:00Z" level=warning msg="Connection limit reached" code=100`,
+		`time="2020-12-01T10:04:00Z" level=info msg="Start listening" code=100`,
+		`not a log line`,
+	}, "\n")
+	summary, err := SummarizeLog(strings.NewReader(log), 100, NewRedactor(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []LogSummaryEntry{
+		{Level: "error", Code: "580", Message: "Can't connect to postgres://acra:<redacted>@db", Count: 3, FirstSeen: "2020-12-01T10:00:00Z", LastSeen: "2020-12-01T10:02:00Z"},
+		{Level: "warning", Code: "100", Message: "Connection limit reached", Count: 1, FirstSeen: "2020-12-01T10:03:00Z", LastSeen: "2020-12-01T10:03:00Z"},
+	}
+	if !reflect.DeepEqual(summary, expected) {
+		t.Fatalf("Unexpected summary %+v", summary)
+	}
+
+	// only the last lines are summarized
+	summary, err = SummarizeLog(strings.NewReader(log), 3, NewRedactor(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(summary) != 1 || summary[0].Level != "warning" {
+		t.Fatalf("Unexpected summary of the last lines %+v", summary)
+	}
+	if _, err := SummarizeLog(strings.NewReader(log), 0, NewRedactor(nil)); err == nil {
+		t.Fatal("Expected error for zero max lines")
+	}
+}
@@ -26,18 +26,26 @@ import (
 	"github.com/cossacklabs/acra/cmd/acra-translator/common"
 	"github.com/cossacklabs/acra/cmd/acra-translator/grpc_api"
 	"github.com/cossacklabs/acra/cmd/acra-translator/server"
+	"net/http"
 	_ "net/http/pprof"
 	"os"
+	"strings"
 	"syscall"
 	"time"
 
+	"github.com/cossacklabs/acra/audit"
 	"github.com/cossacklabs/acra/cmd"
+	"github.com/cossacklabs/acra/decryptor/base"
+	encryptorConfig "github.com/cossacklabs/acra/encryptor/config"
 	"github.com/cossacklabs/acra/keystore"
 	"github.com/cossacklabs/acra/keystore/filesystem"
+	"github.com/cossacklabs/acra/keystore/kms"
 	keystoreV2 "github.com/cossacklabs/acra/keystore/v2/keystore"
+	"github.com/cossacklabs/acra/keystore/v2/keystore/api"
 	filesystemV2 "github.com/cossacklabs/acra/keystore/v2/keystore/filesystem"
 	"github.com/cossacklabs/acra/logging"
 	"github.com/cossacklabs/acra/network"
+	"github.com/cossacklabs/acra/oidc"
 	"github.com/cossacklabs/acra/utils"
 	log "github.com/sirupsen/logrus"
 )
@@ -60,12 +68,15 @@ const (
 var DefaultConfigPath = utils.GetConfigPathByName(ServiceName)
 
 func main() {
+	fileCommand := parseFileCommand()
 	config := common.NewConfig()
 	loggingFormat := flag.String("logging_format", "plaintext", "Logging format: plaintext, json or CEF")
+	loggingBackend := flag.String("logging_backend", logging.DefaultBackendName, "Logging backend: logrus or zap (zap requires build with \"-tags zap\")")
 	log.WithField("version", utils.VERSION).Infof("Starting service %v [pid=%v]", ServiceName, os.Getpid())
 
 	incomingConnectionHTTPString := flag.String("incoming_connection_http_string", "", "Connection string for HTTP transport like http://0.0.0.0:9595")
 	incomingConnectionGRPCString := flag.String("incoming_connection_grpc_string", "", "Default option: connection string for gRPC transport like grpc://0.0.0.0:9696")
+	grpcGateway := flag.Bool("grpc_gateway_enable", false, "Serve REST/JSON transcoded gRPC API (POST /v1/decrypt, /v1/encrypt) on gRPC port with the same transport authentication")
 
 	keysDir := flag.String("keys_dir", keystore.DefaultKeyDirShort, "Folder from which will be loaded keys")
 	keysCacheSize := flag.Int("keystore_cache_size", keystore.InfiniteCacheSize, "Count of keys that will be stored in in-memory LRU cache in encrypted form. 0 - no limits, -1 - turn off cache")
@@ -80,11 +91,50 @@ func main() {
 
 	prometheusAddress := flag.String("incoming_connection_prometheus_metrics_string", "", "URL which will be used to expose Prometheus metrics (use <URL>/metrics address to pull metrics)")
 
+	quotaRequestsPerSecond := flag.Uint("quota_requests_per_second", 0, "Maximum number of encrypt/decrypt requests per second allowed for each client (0 - no limit)")
+	quotaBytesPerDay := flag.Uint64("quota_bytes_per_day", 0, "Maximum number of bytes per day allowed to be encrypted/decrypted by each client (0 - no limit)")
+	emptyValue := flag.String("empty_value", string(encryptorConfig.ValueHandlingReject), "Handling of empty data in encrypt/decrypt requests, AcraStruct can't contain empty data: \"reject\" - return error, \"pass\" - return empty data as is, like AcraServer does with empty values of encrypted columns by default")
+	quotaConfigFile := flag.String("quota_config_file", "", "Path to YAML file with per-client quotas that override \"quota_requests_per_second\" and \"quota_bytes_per_day\"")
+	auditExportURL := flag.String("audit_export_url", "", "URL of Elasticsearch/OpenSearch to export audit events of encrypt/decrypt requests with bulk API, like https://localhost:9200 (empty - turn off export)")
+	auditExportIndexPrefix := flag.String("audit_export_index_prefix", "acra-translator-audit", "Prefix of daily indices <prefix>-YYYY.MM.DD and index template used for exported audit events")
+	auditExportUsername := flag.String("audit_export_username", "", "Username for basic authentication on Elasticsearch/OpenSearch")
+	auditExportPassword := flag.String("audit_export_password", "", "Password for basic authentication on Elasticsearch/OpenSearch")
+	auditExportBufferDir := flag.String("audit_export_buffer_dir", "", "Folder where audit events are buffered while Elasticsearch/OpenSearch is unavailable (required with audit_export_url)")
+	auditExportBatchSize := flag.Int("audit_export_batch_size", audit.DefaultBatchSize, "Maximum number of audit events sent with one bulk request")
+	auditExportFlushInterval := flag.Int("audit_export_flush_interval", int(audit.DefaultFlushInterval.Seconds()), "Maximum time (in seconds) audit events wait before export")
+	auditExportBufferMaxSize := flag.Int64("audit_export_buffer_max_size", audit.DefaultMaxBufferBytes, "Maximum size (in bytes) of audit events buffered on disk, next events are dropped when it's exceeded")
+
+	oidcIssuer := flag.String("oidc_issuer", "", "Issuer of OpenID Connect tokens accepted as bearer tokens in Authorization header of HTTP/gRPC requests, like https://accounts.example.com (empty - turn off token authentication)")
+	oidcAudience := flag.String("oidc_audience", "", "Audience which should be in \"aud\" claim of accepted tokens (required with oidc_issuer)")
+	oidcJWKSURL := flag.String("oidc_jwks_url", "", "URL of JSON Web Key Set with keys of issuer (empty - discover from <oidc_issuer>/.well-known/openid-configuration)")
+	oidcJWKSRefreshInterval := flag.Int("oidc_jwks_refresh_interval", int(oidc.DefaultRefreshInterval.Seconds()), "Time (in seconds) between refreshes of JSON Web Key Set (0 - refresh only on tokens signed with unknown keys)")
+	oidcClaimsMappingConfigFile := flag.String("oidc_claims_mapping_config_file", "", "Path to YAML file with mappings of token claims to client IDs (empty - \"sub\" claim is used as client ID)")
+	oidcTokenRequired := flag.Bool("oidc_token_required", false, "Reject requests without bearer token, otherwise they use client ID of connection (HTTP) or request (gRPC)")
+
+	idempotencyKeyTTL := flag.Int("idempotency_key_ttl", 0, "Time (in seconds) during which encrypt requests retried with the same Idempotency-Key HTTP header or idempotency-key gRPC metadata return the same AcraStruct (0 - idempotency keys are ignored)")
+	idempotencyMaxKeys := flag.Int("idempotency_max_keys", common.DefaultIdempotencyMaxKeys, "Maximum number of stored idempotency keys, requests with new keys are rejected when it's reached (0 - no limit)")
+
 	cmd.RegisterTracingCmdParameters()
 	cmd.RegisterJaegerCmdParameters()
+	cmd.RegisterKeystoreBundleCmdParameters()
+	cmd.RegisterKeystoreVaultCmdParameters()
+	cmd.RegisterKeystoreRedisCmdParameters()
+	cmd.RegisterKeystoreAWSKMSCmdParameters()
+	cmd.RegisterKeystorePKCS11CmdParameters()
+	cmd.RegisterKeystorePrivateKeysCacheCmdParameters()
+	cmd.RegisterKeyIntegrityScanCmdParameters()
+	cmd.RegisterStartupRetryCmdParameters()
+	cmd.RegisterRandomSourceCmdParameters()
 
 	verbose := flag.Bool("v", false, "Log to stderr all INFO, WARNING and ERROR logs")
 	debug := flag.Bool("d", false, "Log everything to stderr")
+	decryptionDiagnosticsClientIDs := flag.String("decryption_diagnostics_client_ids", "", "Comma-separated list of client IDs for which stage of decryption failures is logged (requires -v or -d). Keys and decrypted data are never logged")
+	decryptionDiagnosticsDuration := flag.Int("decryption_diagnostics_duration", int(base.DefaultDecryptionDiagnosticsDuration.Seconds()), "Time (in seconds) after start during which diagnostics for decryption_diagnostics_client_ids is enabled")
+
+	var fileOptions fileCommandOptions
+	if fileCommand != "" {
+		fileOptions = registerFileCommandFlags()
+	}
 
 	err := cmd.Parse(DefaultConfigPath, ServiceName)
 	if err != nil {
@@ -96,11 +146,24 @@ func main() {
 	// Start customizing logs here (directly after command line arguments parsing)
 	formatter := logging.CreateFormatter(*loggingFormat)
 	formatter.SetServiceName(ServiceName)
-	log.SetOutput(os.Stderr)
+	if _, err := logging.SetBackend(*loggingBackend, *loggingFormat, ServiceName, os.Stderr); err != nil {
+		log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+			Errorln("Configuration error: can't set logging backend")
+		os.Exit(1)
+	}
 
 	log.WithField("version", utils.VERSION).Infof("Starting service %v [pid=%v]", ServiceName, os.Getpid())
 	log.Infof("Validating service configuration...")
+	cmd.LogHardwareAESSupport()
 	cmd.ValidateClientID(*secureSessionID)
+	if err := cmd.InitRandomSource(); err != nil {
+		log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorRandomSource).
+			Errorln("Can't initialize random source")
+		os.Exit(1)
+	}
+	if fileCommand != "" {
+		os.Exit(runFileCommand(fileCommand, fileOptions, *keysDir, *keysCacheSize))
+	}
 
 	if len(*incomingConnectionHTTPString) == 0 && len(*incomingConnectionGRPCString) == 0 {
 		*incomingConnectionGRPCString = network.BuildConnectionString(network.GRPCScheme, cmd.DefaultAcraTranslatorGRPCHost, cmd.DefaultAcraTranslatorGRPCPort, "")
@@ -115,19 +178,101 @@ func main() {
 	config.SetServerID([]byte(*secureSessionID))
 	config.SetIncomingConnectionHTTPString(*incomingConnectionHTTPString)
 	config.SetIncomingConnectionGRPCString(*incomingConnectionGRPCString)
+	config.SetGRPCGateway(*grpcGateway)
 	config.SetConfigPath(DefaultConfigPath)
 	config.SetDebug(*debug)
 	config.SetTraceToLog(cmd.IsTraceToLogOn())
 
+	emptyValueHandling, err := encryptorConfig.ParseValueHandling(*emptyValue)
+	if err != nil {
+		log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+			Errorln("Invalid empty_value option")
+		os.Exit(1)
+	}
+	config.SetPassEmptyValues(emptyValueHandling == encryptorConfig.ValueHandlingPass)
+
+	quotaConfig, err := common.LoadQuotaConfig(*quotaConfigFile, common.ClientQuota{RequestsPerSecond: *quotaRequestsPerSecond, BytesPerDay: *quotaBytesPerDay})
+	if err != nil {
+		log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+			Errorln("Can't load quota configuration")
+		os.Exit(1)
+	}
+	if quotaConfig.Enabled() {
+		log.Infof("Per-client quotas enabled")
+		config.SetQuotaManager(common.NewQuotaManager(quotaConfig))
+	}
+
+	if *auditExportURL != "" {
+		auditExporter, err := audit.NewBulkExporter(audit.BulkExporterOptions{
+			URL:            *auditExportURL,
+			IndexPrefix:    *auditExportIndexPrefix,
+			Username:       *auditExportUsername,
+			Password:       *auditExportPassword,
+			Service:        ServiceName,
+			BufferDir:      *auditExportBufferDir,
+			BatchSize:      *auditExportBatchSize,
+			FlushInterval:  time.Duration(*auditExportFlushInterval) * time.Second,
+			MaxBufferBytes: *auditExportBufferMaxSize,
+		})
+		if err != nil {
+			log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+				Errorln("Can't initialize export of audit events")
+			os.Exit(1)
+		}
+		log.Infof("Export of audit events enabled")
+		config.SetAuditExporter(auditExporter)
+	}
+
+	if *idempotencyKeyTTL > 0 {
+		log.Infof("Idempotency keys enabled")
+		config.SetIdempotencyStore(common.NewIdempotencyStore(time.Duration(*idempotencyKeyTTL)*time.Second, *idempotencyMaxKeys))
+	}
+
+	var jwks *oidc.KeySet
+	if *oidcIssuer != "" {
+		jwks, err = newJWKS(*oidcIssuer, *oidcJWKSURL)
+		if err != nil {
+			log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+				Errorln("Can't load JSON Web Key Set of token issuer")
+			os.Exit(1)
+		}
+		verifier, err := oidc.NewVerifier(*oidcIssuer, *oidcAudience, jwks)
+		if err != nil {
+			log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+				Errorln("Invalid token authentication options")
+			os.Exit(1)
+		}
+		claimsMapping, err := common.LoadClaimsMappingConfig(*oidcClaimsMappingConfigFile)
+		if err != nil {
+			log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+				Errorln("Can't load claims mapping configuration")
+			os.Exit(1)
+		}
+		log.Infof("Token authentication enabled")
+		config.SetTokenAuthenticator(common.NewTokenAuthenticator(verifier, claimsMapping, *oidcTokenRequired))
+	} else if *oidcTokenRequired {
+		log.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+			Errorln("oidc_token_required can't be used without oidc_issuer")
+		os.Exit(1)
+	}
+
 	cmd.SetupTracing(ServiceName)
 
 	log.Infof("Initialising keystore...")
 	var keyStore keystore.TranslationKeyStore
-	if filesystemV2.IsKeyDirectory(*keysDir) {
+	if !cmd.IsKeystoreBundleEnabled() && !cmd.IsKeystoreVaultEnabled() && !cmd.IsKeystoreRedisEnabled() && filesystemV2.IsKeyDirectory(*keysDir) {
 		keyStore = openKeyStoreV2(*keysDir)
 	} else {
 		keyStore = openKeyStoreV1(*keysDir, *keysCacheSize)
 	}
+	if cmd.IsKeystorePrivateKeysCacheEnabled() {
+		keyStore, err = cmd.NewKeystoreTranslationPrivateKeysCache(keyStore)
+		if err != nil {
+			log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+				Errorln("Configuration error: invalid cache of decrypted private keys")
+			os.Exit(1)
+		}
+	}
 	log.Infof("Keystore init OK")
 
 	// --------- Config  -----------
@@ -165,6 +310,9 @@ func main() {
 
 	mainContext, cancel := context.WithCancel(context.Background())
 	mainContext = logging.SetLoggerToContext(mainContext, log.NewEntry(log.StandardLogger()))
+	if jwks != nil && *oidcJWKSRefreshInterval > 0 {
+		go jwks.RunRefresh(mainContext, time.Duration(*oidcJWKSRefreshInterval)*time.Second)
+	}
 
 	go sigHandlerSIGTERM.RegisterWithContext(mainContext)
 	sigHandlerSIGTERM.AddCallback(func() {
@@ -246,6 +394,11 @@ func main() {
 		sigHandlerSIGHUP.AddCallback(prometheusClose)
 	}
 
+	if auditExporter := config.AuditExporter(); auditExporter != nil {
+		sigHandlerSIGTERM.AddCallback(auditExporter.Close)
+		sigHandlerSIGHUP.AddCallback(auditExporter.Close)
+	}
+
 	// -------- START -----------
 
 	log.Infof("Setup ready. Start listening to connections. Current PID: %v", os.Getpid())
@@ -261,6 +414,12 @@ func main() {
 		logging.SetLogLevel(logging.LogDiscard)
 	}
 
+	if *decryptionDiagnosticsClientIDs != "" {
+		for _, clientID := range strings.Split(*decryptionDiagnosticsClientIDs, ",") {
+			base.GetDecryptionDiagnostics().Enable([]byte(strings.TrimSpace(clientID)), time.Duration(*decryptionDiagnosticsDuration)*time.Second)
+		}
+	}
+
 	if os.Getenv(GracefulRestartEnv) == "true" {
 		readerServer.StartFromFileDescriptor(mainContext, DescriptorHTTP, DescriptorGRPC)
 	} else {
@@ -269,31 +428,101 @@ func main() {
 }
 
 func openKeyStoreV1(keysDir string, cacheSize int) keystore.TranslationKeyStore {
-	masterKey, err := keystore.GetMasterKeyFromEnvironment()
-	if err != nil {
-		log.WithError(err).
-			WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCantLoadMasterKey).
-			Errorln("Cannot load master key")
-		os.Exit(1)
+	var keyEncryptor keystore.KeyEncryptor
+	var err error
+	if cmd.IsKeystoreAWSKMSEnabled() {
+		keyEncryptor, err = cmd.NewKeystoreAWSKMSEncryptor()
+		if err != nil {
+			log.WithError(err).
+				WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCantInitPrivateKeysEncryptor).
+				Errorln("Can't init AWS KMS key encryptor")
+			os.Exit(1)
+		}
+	} else {
+		var provider keystore.MasterKeyProvider
+		provider, err = cmd.NewKeystoreMasterKeyProvider()
+		if err == nil {
+			keyEncryptor, err = provider.KeyEncryptor()
+		}
+		if err != nil {
+			log.WithError(err).
+				WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCantLoadMasterKey).
+				Errorln("Cannot load master key")
+			os.Exit(1)
+		}
 	}
-	scellEncryptor, err := keystore.NewSCellKeyEncryptor(masterKey)
-	if err != nil {
-		log.WithError(err).
-			WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCantInitPrivateKeysEncryptor).
-			Errorln("Can't init scell encryptor")
-		os.Exit(1)
+	keyStoreBuilder := filesystem.NewCustomTranslatorFileSystemKeyStore().
+		KeyDirectory(keysDir).
+		Encryptor(keyEncryptor).
+		CacheSize(cacheSize)
+	if cmd.IsKeystoreBundleEnabled() {
+		var storage *filesystem.MemoryStorage
+		err := cmd.RetryOnStartup("keystore bundle", func() (err error) {
+			storage, err = cmd.LoadKeystoreBundle(keysDir)
+			return err
+		})
+		if err != nil {
+			log.WithError(err).
+				WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCantInitKeyStore).
+				Errorln("Can't load keystore bundle")
+			os.Exit(1)
+		}
+		keyStoreBuilder = keyStoreBuilder.Storage(storage)
+	}
+	if cmd.IsKeystoreVaultEnabled() {
+		var storage *kms.VaultStorage
+		err := cmd.RetryOnStartup("Vault keystore", func() (err error) {
+			storage, err = cmd.NewKeystoreVaultStorage(keysDir)
+			return err
+		})
+		if err != nil {
+			log.WithError(err).
+				WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCantInitKeyStore).
+				Errorln("Can't connect to Vault keystore")
+			os.Exit(1)
+		}
+		keyStoreBuilder = keyStoreBuilder.Storage(storage)
 	}
-	keyStore, err := filesystem.NewTranslatorFileSystemKeyStore(keysDir, scellEncryptor, cacheSize)
+	if cmd.IsKeystoreRedisEnabled() {
+		var storage *filesystem.RedisStorage
+		err := cmd.RetryOnStartup("Redis keystore", func() (err error) {
+			storage, err = cmd.NewKeystoreRedisStorage(keysDir, keyEncryptor)
+			return err
+		})
+		if err != nil {
+			log.WithError(err).
+				WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCantInitKeyStore).
+				Errorln("Can't connect to Redis keystore")
+			os.Exit(1)
+		}
+		keyStoreBuilder = keyStoreBuilder.Storage(storage)
+	}
+	var keyStore *filesystem.TranslatorFileSystemKeyStore
+	err = cmd.RetryOnStartup("keystore", func() (err error) {
+		keyStore, err = keyStoreBuilder.Build()
+		return err
+	})
 	if err != nil {
 		log.WithError(err).
 			WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCantInitKeyStore).
 			Errorln("Can't initialise keystore")
 		os.Exit(1)
 	}
+	if cmd.IsKeyIntegrityScanEnabled() {
+		if err := cmd.ScanKeyIntegrity(keyStore.KeyStore); err != nil {
+			log.WithError(err).
+				WithField(logging.FieldKeyEventCode, logging.EventCodeErrorKeyIntegrityScanFailed).
+				Errorln("Keystore integrity scan failed, check master key")
+			os.Exit(1)
+		}
+	}
 	return keyStore
 }
 
 func openKeyStoreV2(keyDirPath string) keystore.TranslationKeyStore {
+	if cmd.IsKeyIntegrityScanEnabled() {
+		log.Warningln("Keystore integrity scan is supported only for keystore v1, skipped")
+	}
 	encryption, signature, err := keystoreV2.GetMasterKeysFromEnvironment()
 	if err != nil {
 		log.WithError(err).
@@ -308,7 +537,11 @@ func openKeyStoreV2(keyDirPath string) keystore.TranslationKeyStore {
 			Error("failed to initialize Secure Cell crypto suite")
 		os.Exit(1)
 	}
-	keyDir, err := filesystemV2.OpenDirectoryRW(keyDirPath, suite)
+	var keyDir api.MutableKeyStore
+	err = cmd.RetryOnStartup("keystore", func() (err error) {
+		keyDir, err = filesystemV2.OpenDirectoryRW(keyDirPath, suite)
+		return err
+	})
 	if err != nil {
 		log.WithError(err).
 			WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCantInitKeyStore).
@@ -317,3 +550,20 @@ func openKeyStoreV2(keyDirPath string) keystore.TranslationKeyStore {
 	}
 	return keystoreV2.NewTranslatorKeyStore(keyDir)
 }
+
+// newJWKS returns JSON Web Key Set of issuer loaded from jwksURL or from URL in OpenID provider configuration
+func newJWKS(issuer, jwksURL string) (*oidc.KeySet, error) {
+	client := &http.Client{Timeout: oidc.DefaultHTTPTimeout}
+	if jwksURL == "" {
+		var err error
+		jwksURL, err = oidc.DiscoverJWKSURL(issuer, client)
+		if err != nil {
+			return nil, err
+		}
+	}
+	jwks := oidc.NewKeySet(jwksURL, client)
+	if err := jwks.Refresh(); err != nil {
+		return nil, err
+	}
+	return jwks, nil
+}
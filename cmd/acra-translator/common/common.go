@@ -20,6 +20,7 @@ package common
 import (
 	"errors"
 
+	"github.com/cossacklabs/acra/audit"
 	"github.com/cossacklabs/acra/decryptor/base"
 	"github.com/cossacklabs/acra/keystore"
 )
@@ -29,6 +30,16 @@ type TranslatorData struct {
 	Keystorage            keystore.TranslationKeyStore
 	PoisonRecordCallbacks *base.PoisonCallbackStorage
 	CheckPoisonRecords    bool
+	QuotaManager          *QuotaManager
+	// PassEmptyValues makes encrypt and decrypt return empty data as is instead of error, consistently with
+	// AcraServer which passes empty values of encrypted columns by default
+	PassEmptyValues bool
+	// AuditExporter exports audit events of encrypt/decrypt requests, nil if export is off
+	AuditExporter *audit.BulkExporter
+	// TokenAuthenticator maps bearer tokens of requests to client IDs, nil if token authentication is off
+	TokenAuthenticator *TokenAuthenticator
+	// IdempotencyStore replays results of encrypt requests retried with the same idempotency key, nil if it's off
+	IdempotencyStore *IdempotencyStore
 }
 
 var (
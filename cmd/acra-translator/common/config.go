@@ -18,6 +18,7 @@ package common
 
 import (
 	"crypto/tls"
+	"github.com/cossacklabs/acra/audit"
 	"github.com/cossacklabs/acra/network"
 	"go.opencensus.io/trace"
 )
@@ -36,6 +37,12 @@ type AcraTranslatorConfig struct {
 	debug                        bool
 	traceToLog                   bool
 	tlsConfig                    *tls.Config
+	quotaManager                 *QuotaManager
+	grpcGateway                  bool
+	passEmptyValues              bool
+	auditExporter                *audit.BulkExporter
+	tokenAuthenticator           *TokenAuthenticator
+	idempotencyStore             *IdempotencyStore
 }
 
 // NewConfig creates new AcraTranslatorConfig.
@@ -58,6 +65,66 @@ func (a *AcraTranslatorConfig) GetTLSConfig() *tls.Config {
 	return a.tlsConfig
 }
 
+// SetQuotaManager sets QuotaManager which enforces per-client quotas, nil turns quotas off
+func (a *AcraTranslatorConfig) SetQuotaManager(manager *QuotaManager) {
+	a.quotaManager = manager
+}
+
+// QuotaManager returns QuotaManager which enforces per-client quotas or nil if quotas are off
+func (a *AcraTranslatorConfig) QuotaManager() *QuotaManager {
+	return a.quotaManager
+}
+
+// SetPassEmptyValues sets whether empty data is returned as is instead of error on encryption/decryption
+func (a *AcraTranslatorConfig) SetPassEmptyValues(pass bool) {
+	a.passEmptyValues = pass
+}
+
+// PassEmptyValues returns true if empty data should be returned as is instead of error on encryption/decryption
+func (a *AcraTranslatorConfig) PassEmptyValues() bool {
+	return a.passEmptyValues
+}
+
+// SetAuditExporter sets BulkExporter which exports audit events of requests, nil turns export off
+func (a *AcraTranslatorConfig) SetAuditExporter(exporter *audit.BulkExporter) {
+	a.auditExporter = exporter
+}
+
+// AuditExporter returns BulkExporter which exports audit events of requests or nil if export is off
+func (a *AcraTranslatorConfig) AuditExporter() *audit.BulkExporter {
+	return a.auditExporter
+}
+
+// SetTokenAuthenticator sets TokenAuthenticator which maps bearer tokens to client IDs, nil turns token authentication off
+func (a *AcraTranslatorConfig) SetTokenAuthenticator(authenticator *TokenAuthenticator) {
+	a.tokenAuthenticator = authenticator
+}
+
+// TokenAuthenticator returns TokenAuthenticator which maps bearer tokens to client IDs or nil if it's off
+func (a *AcraTranslatorConfig) TokenAuthenticator() *TokenAuthenticator {
+	return a.tokenAuthenticator
+}
+
+// SetIdempotencyStore sets IdempotencyStore which stores results of requests with idempotency keys, nil turns it off
+func (a *AcraTranslatorConfig) SetIdempotencyStore(store *IdempotencyStore) {
+	a.idempotencyStore = store
+}
+
+// IdempotencyStore returns IdempotencyStore which stores results of requests with idempotency keys or nil if it's off
+func (a *AcraTranslatorConfig) IdempotencyStore() *IdempotencyStore {
+	return a.idempotencyStore
+}
+
+// SetGRPCGateway enables REST/JSON transcoded gRPC API on gRPC port
+func (a *AcraTranslatorConfig) SetGRPCGateway(enabled bool) {
+	a.grpcGateway = enabled
+}
+
+// GRPCGateway returns true if REST/JSON transcoded gRPC API should be served on gRPC port
+func (a *AcraTranslatorConfig) GRPCGateway() bool {
+	return a.grpcGateway
+}
+
 // SetTraceToLog true if want to log trace data otherwise false
 func (a *AcraTranslatorConfig) SetTraceToLog(v bool) {
 	a.traceToLog = v
@@ -17,10 +17,14 @@ limitations under the License.
 package common
 
 import (
+	"net/http"
+
 	"google.golang.org/grpc"
 )
 
 // GRPCServerFactory factory which return new generated grpc.Server which implements API
 type GRPCServerFactory interface {
 	New(data *TranslatorData, opts ...grpc.ServerOption) (*grpc.Server, error)
+	// NewWithGateway returns grpc.Server and HTTP handler which serves it with REST/JSON transcoded API
+	NewWithGateway(data *TranslatorData, opts ...grpc.ServerOption) (*grpc.Server, http.Handler, error)
 }
@@ -0,0 +1,109 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package common
+
+import (
+	"bytes"
+	"errors"
+	"io"
+
+	acrawriter "github.com/cossacklabs/acra/acra-writer"
+	"github.com/cossacklabs/acra/decryptor/base"
+	"github.com/cossacklabs/themis/gothemis/keys"
+)
+
+// Limits of chunks of encrypted files
+const (
+	DefaultFileChunkSize = 1024 * 1024
+	MaxFileChunkSize     = 64 * 1024 * 1024
+	// maxFileAcraStructDataLength limits data block of AcraStruct read from file, so corrupted length doesn't make
+	// decryption allocate unbounded memory. It leaves place for Secure Cell overhead of the biggest chunk.
+	maxFileAcraStructDataLength = MaxFileChunkSize + 4096
+)
+
+// Errors returned by file encryption
+var (
+	ErrInvalidFileChunkSize = errors.New("file chunk size should be in range from 1 to 64 MiB")
+	ErrInvalidEncryptedFile = errors.New("encrypted file isn't sequence of AcraStructs")
+)
+
+// EncryptFile encrypts data of reader by chunks of chunkSize and writes them to writer as sequence of AcraStructs
+// encrypted with publicKey and zoneID as context, so files bigger than memory are encrypted too. Empty data produces
+// empty output.
+func EncryptFile(reader io.Reader, writer io.Writer, publicKey *keys.PublicKey, zoneID []byte, chunkSize int) error {
+	if chunkSize <= 0 || chunkSize > MaxFileChunkSize {
+		return ErrInvalidFileChunkSize
+	}
+	chunk := make([]byte, chunkSize)
+	for {
+		n, err := io.ReadFull(reader, chunk)
+		if n > 0 {
+			acrastruct, encryptErr := acrawriter.CreateAcrastruct(chunk[:n], publicKey, zoneID)
+			if encryptErr != nil {
+				return encryptErr
+			}
+			if _, writeErr := writer.Write(acrastruct); writeErr != nil {
+				return writeErr
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// DecryptFile reads sequence of AcraStructs written by EncryptFile and writes decrypted data to writer. AcraStructs
+// are decrypted with privateKeys and zoneID as context.
+func DecryptFile(reader io.Reader, writer io.Writer, privateKeys []*keys.PrivateKey, zoneID []byte) error {
+	header := make([]byte, base.GetMinAcraStructLength())
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			if err == io.ErrUnexpectedEOF {
+				return ErrInvalidEncryptedFile
+			}
+			return err
+		}
+		if !bytes.Equal(header[:len(base.TagBegin)], base.TagBegin) {
+			return ErrInvalidEncryptedFile
+		}
+		dataLength := base.GetDataLengthFromAcraStruct(header)
+		if dataLength <= 0 || dataLength > maxFileAcraStructDataLength {
+			return ErrInvalidEncryptedFile
+		}
+		acrastruct := make([]byte, len(header)+dataLength)
+		copy(acrastruct, header)
+		if _, err := io.ReadFull(reader, acrastruct[len(header):]); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return ErrInvalidEncryptedFile
+			}
+			return err
+		}
+		data, err := base.DecryptRotatedAcrastruct(acrastruct, privateKeys, zoneID)
+		if err != nil {
+			return err
+		}
+		if _, err := writer.Write(data); err != nil {
+			return err
+		}
+	}
+}
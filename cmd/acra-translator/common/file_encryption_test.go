@@ -0,0 +1,71 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package common
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/cossacklabs/themis/gothemis/keys"
+)
+
+func TestFileEncryption(t *testing.T) {
+	keypair, err := keys.New(keys.TypeEC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKeypair, err := keys.New(keys.TypeEC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zoneID := []byte("zone")
+	for _, size := range []int{0, 1, 9, 10, 25} {
+		data := bytes.Repeat([]byte("a"), size)
+		encrypted := &bytes.Buffer{}
+		if err := EncryptFile(bytes.NewReader(data), encrypted, keypair.Public, zoneID, 10); err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(encrypted.Bytes(), []byte("aaa")) {
+			t.Fatal("Data wasn't encrypted")
+		}
+		decrypted := &bytes.Buffer{}
+		// rotated keys are tried in order
+		if err := DecryptFile(bytes.NewReader(encrypted.Bytes()), decrypted, []*keys.PrivateKey{otherKeypair.Private, keypair.Private}, zoneID); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decrypted.Bytes(), data) {
+			t.Fatalf("Size %d: decrypted data differs", size)
+		}
+		if size == 0 {
+			continue
+		}
+		if err := DecryptFile(bytes.NewReader(encrypted.Bytes()), &bytes.Buffer{}, []*keys.PrivateKey{keypair.Private}, []byte("other zone")); err == nil {
+			t.Fatal("Expected error with other zone")
+		}
+		if err := DecryptFile(bytes.NewReader(encrypted.Bytes()[:encrypted.Len()-1]), &bytes.Buffer{}, []*keys.PrivateKey{keypair.Private}, zoneID); err != ErrInvalidEncryptedFile {
+			t.Fatalf("Expected ErrInvalidEncryptedFile for truncated file, took %v", err)
+		}
+	}
+	if err := DecryptFile(bytes.NewReader([]byte("plain data which isn't AcraStruct but has enough length to read header of AcraStruct")), &bytes.Buffer{}, []*keys.PrivateKey{keypair.Private}, nil); err != ErrInvalidEncryptedFile {
+		t.Fatalf("Expected ErrInvalidEncryptedFile, took %v", err)
+	}
+	for _, chunkSize := range []int{0, MaxFileChunkSize + 1} {
+		if err := EncryptFile(bytes.NewReader(nil), &bytes.Buffer{}, keypair.Public, nil, chunkSize); err != ErrInvalidFileChunkSize {
+			t.Fatalf("Expected ErrInvalidFileChunkSize, took %v", err)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package common
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/cossacklabs/acra/logging"
+	"github.com/cossacklabs/acra/network"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/credentials"
+)
+
+// ErrListenerClosed returned by Accept of closed HandshakeListener
+var ErrListenerClosed = errors.New("listener closed")
+
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+// HandshakeListener accepts connections and returns them after server handshake with transport credentials, the same
+// which authenticate gRPC connections. Handshakes run in separate goroutines to not block accepting of connections.
+type HandshakeListener struct {
+	net.Listener
+	credentials credentials.TransportCredentials
+	results     chan acceptResult
+	done        chan struct{}
+	closeOnce   sync.Once
+}
+
+// NewHandshakeListener starts accepting connections from listener
+func NewHandshakeListener(listener net.Listener, transportCredentials credentials.TransportCredentials) *HandshakeListener {
+	handshakeListener := &HandshakeListener{
+		Listener:    listener,
+		credentials: transportCredentials,
+		results:     make(chan acceptResult),
+		done:        make(chan struct{}),
+	}
+	go handshakeListener.acceptLoop()
+	return handshakeListener
+}
+
+func (listener *HandshakeListener) acceptLoop() {
+	for {
+		conn, err := listener.Listener.Accept()
+		if err != nil {
+			// temporary errors (like deadline on stop) are returned to caller which decides to retry
+			select {
+			case listener.results <- acceptResult{err: err}:
+			case <-listener.done:
+				return
+			}
+			continue
+		}
+		go listener.handshake(conn)
+	}
+}
+
+func (listener *HandshakeListener) handshake(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(network.DefaultNetworkTimeout))
+	wrappedConn, _, err := listener.credentials.ServerHandshake(conn)
+	if err != nil {
+		log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorTranslatorCantWrapConnectionToSS).
+			Errorln("Can't wrap new connection")
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	select {
+	case listener.results <- acceptResult{conn: wrappedConn}:
+	case <-listener.done:
+		wrappedConn.Close()
+	}
+}
+
+// Accept returns next connection after successful handshake
+func (listener *HandshakeListener) Accept() (net.Conn, error) {
+	select {
+	case <-listener.done:
+		return nil, ErrListenerClosed
+	default:
+	}
+	select {
+	case result := <-listener.results:
+		return result.conn, result.err
+	case <-listener.done:
+		return nil, ErrListenerClosed
+	}
+}
+
+// Close stops accepting connections and closes wrapped listener
+func (listener *HandshakeListener) Close() error {
+	var err error
+	listener.closeOnce.Do(func() {
+		close(listener.done)
+		err = listener.Listener.Close()
+	})
+	return err
+}
@@ -0,0 +1,89 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package common
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"google.golang.org/grpc/credentials"
+)
+
+// testCredentials accepts connections which send "ok" and rejects others
+type testCredentials struct{}
+
+func (testCredentials) ClientHandshake(ctx context.Context, authority string, conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	return conn, nil, nil
+}
+func (testCredentials) ServerHandshake(conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	hello := make([]byte, 2)
+	if _, err := io.ReadFull(conn, hello); err != nil {
+		return nil, nil, err
+	}
+	if string(hello) != "ok" {
+		return nil, nil, errors.New("handshake failed")
+	}
+	return conn, nil, nil
+}
+func (testCredentials) Info() credentials.ProtocolInfo             { return credentials.ProtocolInfo{} }
+func (testCredentials) Clone() credentials.TransportCredentials    { return testCredentials{} }
+func (testCredentials) OverrideServerName(serverName string) error { return nil }
+
+func TestHandshakeListener(t *testing.T) {
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := NewHandshakeListener(tcpListener, testCredentials{})
+	defer listener.Close()
+
+	// client which doesn't finish handshake shouldn't block others
+	stalled, err := net.Dial("tcp", tcpListener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stalled.Close()
+	rejected, err := net.Dial("tcp", tcpListener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rejected.Close()
+	rejected.Write([]byte("no"))
+	accepted, err := net.Dial("tcp", tcpListener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer accepted.Close()
+	accepted.Write([]byte("ok"))
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if conn.RemoteAddr().String() != accepted.LocalAddr().String() {
+		t.Fatal("Accepted connection without successful handshake")
+	}
+
+	listener.Close()
+	if _, err := listener.Accept(); err != ErrListenerClosed {
+		t.Fatalf("Expected ErrListenerClosed, took %v", err)
+	}
+}
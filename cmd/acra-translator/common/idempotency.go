@@ -0,0 +1,159 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package common
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Idempotency key is passed in HTTP header or gRPC metadata, replayed results are marked with IdempotentReplayedHeader
+const (
+	IdempotencyKeyHeader      = "Idempotency-Key"
+	IdempotentReplayedHeader  = "Idempotent-Replayed"
+	MaxIdempotencyKeyLength   = 255
+	DefaultIdempotencyMaxKeys = 100000
+)
+
+// Errors returned by IdempotencyStore
+var (
+	ErrInvalidIdempotencyKey = errors.New("idempotency key is longer than 255 characters")
+	ErrIdempotencyKeyReused  = errors.New("idempotency key is already used with different request")
+	ErrIdempotencyStoreFull  = errors.New("too many idempotency keys are stored, retry later")
+)
+
+type idempotencyKey struct {
+	clientID string
+	key      string
+}
+
+// idempotencyEntry stores result of request processed with idempotency key. Zero expiration means that request is
+// still processed, done is closed when processing is finished.
+type idempotencyEntry struct {
+	requestHash [sha256.Size]byte
+	result      []byte
+	expiration  time.Time
+	done        chan struct{}
+}
+
+// IdempotencyStore stores results of requests with idempotency keys for TTL, so retries of request after network
+// failure return the same result instead of repeated operation, like AcraStruct of the same data encrypted twice.
+// Keys are scoped by client ID. Methods of nil IdempotencyStore process all requests. It is safe for concurrent use.
+type IdempotencyStore struct {
+	ttl       time.Duration
+	maxKeys   int
+	lock      sync.Mutex
+	entries   map[idempotencyKey]*idempotencyEntry
+	nextSweep time.Time
+	now       func() time.Time
+}
+
+// NewIdempotencyStore returns IdempotencyStore which keeps results for ttl and at most maxKeys keys (0 - no limit)
+func NewIdempotencyStore(ttl time.Duration, maxKeys int) *IdempotencyStore {
+	return &IdempotencyStore{ttl: ttl, maxKeys: maxKeys, entries: make(map[idempotencyKey]*idempotencyEntry), now: time.Now}
+}
+
+// requestHash returns hash of request parts, so the same key with other data, zone or operation is detected
+func requestHash(request [][]byte) [sha256.Size]byte {
+	hasher := sha256.New()
+	length := make([]byte, 8)
+	for _, part := range request {
+		binary.BigEndian.PutUint64(length, uint64(len(part)))
+		hasher.Write(length)
+		hasher.Write(part)
+	}
+	var hash [sha256.Size]byte
+	copy(hash[:], hasher.Sum(nil))
+	return hash
+}
+
+// Do returns result stored for key of clientID or result of process which is stored if it succeeds. The second
+// value is true if stored result is replayed. Concurrent requests with the same key wait for the first one, failed
+// processing isn't stored, so next retry processes request again. Empty key turns off idempotency for request.
+func (store *IdempotencyStore) Do(clientID []byte, key string, request [][]byte, process func() ([]byte, error)) ([]byte, bool, error) {
+	if store == nil || key == "" {
+		result, err := process()
+		return result, false, err
+	}
+	if len(key) > MaxIdempotencyKeyLength {
+		return nil, false, ErrInvalidIdempotencyKey
+	}
+	id := idempotencyKey{clientID: string(clientID), key: key}
+	hash := requestHash(request)
+	for {
+		store.lock.Lock()
+		now := store.now()
+		store.sweep(now)
+		entry, ok := store.entries[id]
+		if ok && !entry.expiration.IsZero() && !now.Before(entry.expiration) {
+			delete(store.entries, id)
+			ok = false
+		}
+		if !ok {
+			if store.maxKeys > 0 && len(store.entries) >= store.maxKeys {
+				store.lock.Unlock()
+				return nil, false, ErrIdempotencyStoreFull
+			}
+			entry = &idempotencyEntry{requestHash: hash, done: make(chan struct{})}
+			store.entries[id] = entry
+			store.lock.Unlock()
+
+			result, err := process()
+
+			store.lock.Lock()
+			if err != nil {
+				delete(store.entries, id)
+			} else {
+				entry.result = result
+				entry.expiration = store.now().Add(store.ttl)
+			}
+			close(entry.done)
+			store.lock.Unlock()
+			return result, false, err
+		}
+		store.lock.Unlock()
+
+		if entry.requestHash != hash {
+			return nil, false, ErrIdempotencyKeyReused
+		}
+		<-entry.done
+		store.lock.Lock()
+		processed := !entry.expiration.IsZero()
+		store.lock.Unlock()
+		if !processed {
+			// first request failed, process this one instead
+			continue
+		}
+		return entry.result, true, nil
+	}
+}
+
+// sweep removes expired results at most once a minute. Should be called with locked store.
+func (store *IdempotencyStore) sweep(now time.Time) {
+	if now.Before(store.nextSweep) {
+		return
+	}
+	store.nextSweep = now.Add(time.Minute)
+	for id, entry := range store.entries {
+		if !entry.expiration.IsZero() && !now.Before(entry.expiration) {
+			delete(store.entries, id)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package common
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestIdempotencyStore(t *testing.T) {
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	store := NewIdempotencyStore(time.Hour, 2)
+	store.now = func() time.Time { return now }
+	calls := 0
+	process := func() ([]byte, error) {
+		calls++
+		return []byte{byte(calls)}, nil
+	}
+	request := [][]byte{[]byte("encrypt"), nil, []byte("data")}
+
+	result, replayed, err := store.Do([]byte("client"), "key", request, process)
+	if err != nil || replayed || result[0] != 1 {
+		t.Fatalf("Unexpected result of first request: %v %v %v", result, replayed, err)
+	}
+	result, replayed, err = store.Do([]byte("client"), "key", request, process)
+	if err != nil || !replayed || result[0] != 1 || calls != 1 {
+		t.Fatalf("Expected replayed result: %v %v %v", result, replayed, err)
+	}
+	// key is scoped by client ID
+	if _, replayed, _ := store.Do([]byte("other client"), "key", request, process); replayed || calls != 2 {
+		t.Fatal("Key of other client shouldn't be replayed")
+	}
+	if _, _, err := store.Do([]byte("client"), "key", [][]byte{[]byte("encrypt"), []byte("data"), nil}, process); err != ErrIdempotencyKeyReused {
+		t.Fatalf("Expected ErrIdempotencyKeyReused, took %v", err)
+	}
+	if _, _, err := store.Do([]byte("client"), strings.Repeat("k", MaxIdempotencyKeyLength+1), request, process); err != ErrInvalidIdempotencyKey {
+		t.Fatalf("Expected ErrInvalidIdempotencyKey, took %v", err)
+	}
+	if _, _, err := store.Do([]byte("client"), "new key", request, process); err != ErrIdempotencyStoreFull {
+		t.Fatalf("Expected ErrIdempotencyStoreFull, took %v", err)
+	}
+	// requests without key are always processed
+	if _, replayed, _ := store.Do([]byte("client"), "", request, process); replayed || calls != 3 {
+		t.Fatal("Request without key shouldn't be replayed")
+	}
+
+	// expired results are removed
+	now = now.Add(time.Hour)
+	result, replayed, err = store.Do([]byte("client"), "key", request, process)
+	if err != nil || replayed || result[0] != 4 {
+		t.Fatalf("Expected processing after expiration: %v %v %v", result, replayed, err)
+	}
+	if len(store.entries) != 1 {
+		t.Fatalf("Expected expired entries to be swept, took %d entries", len(store.entries))
+	}
+
+	// failed processing isn't stored
+	failure := errors.New("failure")
+	if _, _, err := store.Do([]byte("client"), "failed", request, func() ([]byte, error) { return nil, failure }); err != failure {
+		t.Fatalf("Expected failure, took %v", err)
+	}
+	if _, replayed, err := store.Do([]byte("client"), "failed", request, process); err != nil || replayed {
+		t.Fatalf("Expected processing of retry after failure: %v %v", replayed, err)
+	}
+
+	var nilStore *IdempotencyStore
+	if _, replayed, err := nilStore.Do([]byte("client"), "key", request, process); err != nil || replayed {
+		t.Fatal("Nil store should process request")
+	}
+}
+
+func TestIdempotencyStoreConcurrentRequests(t *testing.T) {
+	store := NewIdempotencyStore(time.Hour, 0)
+	started := make(chan struct{})
+	release := make(chan struct{})
+	calls := 0
+	process := func() ([]byte, error) {
+		calls++
+		close(started)
+		<-release
+		return []byte("result"), nil
+	}
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		store.Do([]byte("client"), "key", nil, process)
+	}()
+	<-started
+	results := make(chan bool, 1)
+	go func() {
+		_, replayed, _ := store.Do([]byte("client"), "key", nil, process)
+		results <- replayed
+	}()
+	close(release)
+	wg.Wait()
+	if replayed := <-results; !replayed || calls != 1 {
+		t.Fatalf("Expected concurrent request to wait for the first one, replayed %v, calls %d", replayed, calls)
+	}
+}
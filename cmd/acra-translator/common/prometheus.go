@@ -17,8 +17,10 @@ limitations under the License.
 package common
 
 import (
+	"github.com/cossacklabs/acra/audit"
 	"github.com/cossacklabs/acra/cmd"
 	"github.com/cossacklabs/acra/decryptor/base"
+	"github.com/cossacklabs/acra/keystore/lru"
 	"github.com/cossacklabs/acra/utils"
 	"github.com/prometheus/client_golang/prometheus"
 	"sync"
@@ -32,6 +34,24 @@ const (
 	GrpcRequestType = "grpc"
 )
 
+const (
+	quotaTypeLabel = "quota"
+)
+
+const (
+	operationLabel = "operation"
+	// OperationEncrypt encryption of data for metric label
+	OperationEncrypt = "encrypt"
+	// OperationDecrypt decryption of AcraStruct for metric label
+	OperationDecrypt = "decrypt"
+)
+
+const (
+	payloadLabel    = "payload"
+	requestPayload  = "request"
+	responsePayload = "response"
+)
+
 const (
 	connectionTypeLabel = "connection_type"
 	httpConnectionType  = "http"
@@ -45,6 +65,21 @@ var (
 		Help:    "Time of response processing",
 		Buckets: []float64{0.000001, 0.00001, 0.00002, 0.00003, 0.00004, 0.00005, 0.00006, 0.00007, 0.00008, 0.00009, 0.0001, 0.0005, 0.001, 0.005, 0.01, 1},
 	}, []string{requestTypeLabel})
+
+	// PayloadSizeHistogram collect metrics about sizes of request and response payloads of processed operations:
+	// plaintext in encrypt requests and decrypt responses, AcraStructs in encrypt responses and decrypt requests
+	PayloadSizeHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "acratranslator_payload_size_bytes",
+		Help:    "Size of request and response payloads of processed operations",
+		Buckets: prometheus.ExponentialBuckets(16, 4, 10),
+	}, []string{requestTypeLabel, operationLabel, payloadLabel})
+
+	// QuotaExceededCounter collect metrics about requests rejected due to exceeded client quota
+	QuotaExceededCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "acratranslator_quota_exceeded_total",
+			Help: "number of requests rejected due to exceeded client quota",
+		}, []string{quotaTypeLabel})
 )
 
 var (
@@ -61,6 +96,12 @@ var (
 	}, []string{connectionTypeLabel})
 )
 
+// ObservePayloadSizes collects sizes of request and response payloads of successfully processed operation
+func ObservePayloadSizes(requestType, operation string, requestData, responseData []byte) {
+	PayloadSizeHistogram.WithLabelValues(requestType, operation, requestPayload).Observe(float64(len(requestData)))
+	PayloadSizeHistogram.WithLabelValues(requestType, operation, responsePayload).Observe(float64(len(responseData)))
+}
+
 var registerLock = sync.Once{}
 
 // RegisterMetrics register metrics in prometheus exporter related with translator
@@ -69,7 +110,11 @@ func RegisterMetrics(serviceName string) {
 		prometheus.MustRegister(connectionCounter)
 		prometheus.MustRegister(connectionProcessingTimeHistogram)
 		prometheus.MustRegister(RequestProcessingTimeHistogram)
+		prometheus.MustRegister(QuotaExceededCounter)
+		prometheus.MustRegister(PayloadSizeHistogram)
 		base.RegisterAcraStructProcessingMetrics()
+		audit.RegisterMetrics()
+		lru.RegisterKeyStoreCacheMetrics()
 		version, err := utils.GetParsedVersion()
 		if err != nil {
 			panic(err)
@@ -0,0 +1,199 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package common
+
+import (
+	"errors"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Errors returned when client exceeds its quota
+var (
+	ErrRequestsQuotaExceeded = errors.New("requests per second quota exceeded")
+	ErrBytesQuotaExceeded    = errors.New("bytes per day quota exceeded")
+)
+
+// Quota types used as metric label values
+const (
+	QuotaTypeRequests = "requests"
+	QuotaTypeBytes    = "bytes"
+)
+
+// ClientQuota limits request rate and daily traffic of one client. Zero values mean no limit.
+type ClientQuota struct {
+	RequestsPerSecond uint   `yaml:"requests_per_second"`
+	BytesPerDay       uint64 `yaml:"bytes_per_day"`
+}
+
+// QuotaConfig stores default quota applied to all clients and per-client overrides
+type QuotaConfig struct {
+	Default ClientQuota            `yaml:"default"`
+	Clients map[string]ClientQuota `yaml:"clients"`
+}
+
+// clientQuotaOverride is ClientQuota as written in config file where omitted fields are nil and inherited from the
+// default quota while explicit zeros still mean no limit
+type clientQuotaOverride struct {
+	RequestsPerSecond *uint   `yaml:"requests_per_second"`
+	BytesPerDay       *uint64 `yaml:"bytes_per_day"`
+}
+
+// mergeWith returns base quota with fields set in override replaced
+func (override clientQuotaOverride) mergeWith(base ClientQuota) ClientQuota {
+	if override.RequestsPerSecond != nil {
+		base.RequestsPerSecond = *override.RequestsPerSecond
+	}
+	if override.BytesPerDay != nil {
+		base.BytesPerDay = *override.BytesPerDay
+	}
+	return base
+}
+
+// quotaConfigFile is the structure of quota config file
+type quotaConfigFile struct {
+	Default clientQuotaOverride            `yaml:"default"`
+	Clients map[string]clientQuotaOverride `yaml:"clients"`
+}
+
+// LoadQuotaConfig reads QuotaConfig from YAML file and uses defaultQuota for clients without explicit settings
+// if file doesn't override it. Fields omitted in per-client settings are taken from the default quota.
+func LoadQuotaConfig(path string, defaultQuota ClientQuota) (*QuotaConfig, error) {
+	config := &QuotaConfig{Default: defaultQuota}
+	if path == "" {
+		return config, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	file := quotaConfigFile{}
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+	config.Default = file.Default.mergeWith(defaultQuota)
+	if len(file.Clients) > 0 {
+		config.Clients = make(map[string]ClientQuota, len(file.Clients))
+		for clientID, override := range file.Clients {
+			config.Clients[clientID] = override.mergeWith(config.Default)
+		}
+	}
+	return config, nil
+}
+
+// quotaFor returns quota configured for clientID or default one
+func (config *QuotaConfig) quotaFor(clientID []byte) ClientQuota {
+	if quota, ok := config.Clients[string(clientID)]; ok {
+		return quota
+	}
+	return config.Default
+}
+
+// Enabled returns true if any limit is configured
+func (config *QuotaConfig) Enabled() bool {
+	if config.Default != (ClientQuota{}) {
+		return true
+	}
+	for _, quota := range config.Clients {
+		if quota != (ClientQuota{}) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientQuotaState tracks consumption of quota by one client
+type clientQuotaState struct {
+	// token bucket for requests per second with capacity equal to the limit
+	tokens     float64
+	lastRefill time.Time
+	// bytes processed during current UTC day
+	bytesUsed uint64
+	day       time.Time
+}
+
+// QuotaManager enforces per-client quotas. It is safe for concurrent use.
+type QuotaManager struct {
+	config *QuotaConfig
+	lock   sync.Mutex
+	states map[string]*clientQuotaState
+	now    func() time.Time
+}
+
+// NewQuotaManager returns QuotaManager which enforces quotas from config
+func NewQuotaManager(config *QuotaConfig) *QuotaManager {
+	return &QuotaManager{config: config, states: make(map[string]*clientQuotaState), now: time.Now}
+}
+
+// Allow registers request of clientID with dataSize bytes of payload and returns error if it exceeds quota.
+// Nil QuotaManager allows all requests.
+func (manager *QuotaManager) Allow(clientID []byte, dataSize int) error {
+	if manager == nil {
+		return nil
+	}
+	quota := manager.config.quotaFor(clientID)
+	if quota == (ClientQuota{}) {
+		return nil
+	}
+	now := manager.now()
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+
+	state, ok := manager.states[string(clientID)]
+	if !ok {
+		state = &clientQuotaState{tokens: float64(quota.RequestsPerSecond), lastRefill: now, day: dayStart(now)}
+		manager.states[string(clientID)] = state
+	}
+
+	if quota.RequestsPerSecond != 0 {
+		limit := float64(quota.RequestsPerSecond)
+		state.tokens += now.Sub(state.lastRefill).Seconds() * limit
+		if state.tokens > limit {
+			state.tokens = limit
+		}
+		state.lastRefill = now
+		if state.tokens < 1 {
+			QuotaExceededCounter.WithLabelValues(QuotaTypeRequests).Inc()
+			return ErrRequestsQuotaExceeded
+		}
+	}
+
+	if quota.BytesPerDay != 0 {
+		if today := dayStart(now); !today.Equal(state.day) {
+			state.day = today
+			state.bytesUsed = 0
+		}
+		if state.bytesUsed+uint64(dataSize) > quota.BytesPerDay {
+			QuotaExceededCounter.WithLabelValues(QuotaTypeBytes).Inc()
+			return ErrBytesQuotaExceeded
+		}
+		state.bytesUsed += uint64(dataSize)
+	}
+
+	if quota.RequestsPerSecond != 0 {
+		state.tokens--
+	}
+	return nil
+}
+
+// dayStart returns beginning of UTC day of t
+func dayStart(t time.Time) time.Time {
+	return t.UTC().Truncate(24 * time.Hour)
+}
@@ -0,0 +1,153 @@
+package common
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestQuotaManagerRequestsPerSecond(t *testing.T) {
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	manager := NewQuotaManager(&QuotaConfig{Default: ClientQuota{RequestsPerSecond: 2}})
+	manager.now = func() time.Time { return now }
+	clientID := []byte("client")
+
+	for i := 0; i < 2; i++ {
+		if err := manager.Allow(clientID, 10); err != nil {
+			t.Fatalf("Request %d: unexpected error %s", i, err)
+		}
+	}
+	if err := manager.Allow(clientID, 10); err != ErrRequestsQuotaExceeded {
+		t.Fatalf("Expected %s, took %v", ErrRequestsQuotaExceeded, err)
+	}
+	// other clients have own quota
+	if err := manager.Allow([]byte("other client"), 10); err != nil {
+		t.Fatalf("Unexpected error for another client: %s", err)
+	}
+	// half of second is enough to refill one request
+	now = now.Add(time.Millisecond * 500)
+	if err := manager.Allow(clientID, 10); err != nil {
+		t.Fatalf("Unexpected error after refill: %s", err)
+	}
+	if err := manager.Allow(clientID, 10); err != ErrRequestsQuotaExceeded {
+		t.Fatalf("Expected %s, took %v", ErrRequestsQuotaExceeded, err)
+	}
+}
+
+func TestQuotaManagerBytesPerDay(t *testing.T) {
+	now := time.Date(2020, 1, 1, 23, 0, 0, 0, time.UTC)
+	manager := NewQuotaManager(&QuotaConfig{
+		Default: ClientQuota{BytesPerDay: 100},
+		Clients: map[string]ClientQuota{"unlimited": {}},
+	})
+	manager.now = func() time.Time { return now }
+	clientID := []byte("client")
+
+	if err := manager.Allow(clientID, 60); err != nil {
+		t.Fatal(err)
+	}
+	if err := manager.Allow(clientID, 60); err != ErrBytesQuotaExceeded {
+		t.Fatalf("Expected %s, took %v", ErrBytesQuotaExceeded, err)
+	}
+	// rejected request doesn't consume quota
+	if err := manager.Allow(clientID, 40); err != nil {
+		t.Fatal(err)
+	}
+	if err := manager.Allow([]byte("unlimited"), 1000); err != nil {
+		t.Fatalf("Unexpected error for client without quota: %s", err)
+	}
+	// quota resets on the next day
+	now = now.Add(time.Hour * 2)
+	if err := manager.Allow(clientID, 100); err != nil {
+		t.Fatalf("Unexpected error on the next day: %s", err)
+	}
+}
+
+func TestNilQuotaManager(t *testing.T) {
+	var manager *QuotaManager
+	if err := manager.Allow([]byte("client"), 1000); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadQuotaConfig(t *testing.T) {
+	defaultQuota := ClientQuota{RequestsPerSecond: 10}
+	config, err := LoadQuotaConfig("", defaultQuota)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Default != defaultQuota || !config.Enabled() {
+		t.Fatalf("Unexpected config without file: %v", config)
+	}
+
+	file, err := ioutil.TempFile("", "quota")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.WriteString("clients:\n  client:\n    requests_per_second: 5\n    bytes_per_day: 100\n"); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	config, err = LoadQuotaConfig(file.Name(), defaultQuota)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.quotaFor([]byte("client")) != (ClientQuota{RequestsPerSecond: 5, BytesPerDay: 100}) {
+		t.Fatalf("Unexpected client quota: %v", config.quotaFor([]byte("client")))
+	}
+	if config.quotaFor([]byte("unknown")) != defaultQuota {
+		t.Fatalf("Unexpected default quota: %v", config.quotaFor([]byte("unknown")))
+	}
+
+	if (&QuotaConfig{}).Enabled() {
+		t.Fatal("Empty config shouldn't be enabled")
+	}
+}
+
+func TestLoadQuotaConfigPartialOverride(t *testing.T) {
+	file, err := ioutil.TempFile("", "quota")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	content := `default:
+  bytes_per_day: 1000
+clients:
+  partial:
+    requests_per_second: 5
+  unlimited:
+    requests_per_second: 0
+    bytes_per_day: 0
+  empty: {}
+`
+	if _, err := file.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	config, err := LoadQuotaConfig(file.Name(), ClientQuota{RequestsPerSecond: 10, BytesPerDay: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedDefault := ClientQuota{RequestsPerSecond: 10, BytesPerDay: 1000}
+	if config.Default != expectedDefault {
+		t.Fatalf("Unexpected default quota: %v", config.Default)
+	}
+	testcases := []struct {
+		clientID string
+		quota    ClientQuota
+	}{
+		{"partial", ClientQuota{RequestsPerSecond: 5, BytesPerDay: 1000}},
+		{"unlimited", ClientQuota{}},
+		{"empty", expectedDefault},
+		{"unknown", expectedDefault},
+	}
+	for _, tcase := range testcases {
+		if quota := config.quotaFor([]byte(tcase.clientID)); quota != tcase.quota {
+			t.Fatalf("Unexpected quota for %s: %v, expected %v", tcase.clientID, quota, tcase.quota)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package common
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/cossacklabs/acra/oidc"
+	"gopkg.in/yaml.v2"
+)
+
+// DefaultClientIDClaim is claim used as client ID if claims mapping isn't configured
+const DefaultClientIDClaim = "sub"
+
+// Errors returned by TokenAuthenticator
+var (
+	ErrTokenRequired              = errors.New("request without bearer token")
+	ErrInvalidAuthorizationHeader = errors.New("authorization header should contain bearer token")
+	ErrNoClientIDForClaims        = errors.New("token claims aren't mapped to client ID")
+	ErrInvalidClaimsMappingConfig = errors.New("invalid claims mapping config")
+)
+
+// ClaimMapping maps tokens with claim equal to value (or list claim containing value) to client ID
+type ClaimMapping struct {
+	Claim    string `yaml:"claim"`
+	Value    string `yaml:"value"`
+	ClientID string `yaml:"client_id"`
+}
+
+// ClaimsMappingConfig stores mappings which are checked in order, first matched mapping sets client ID. If none is
+// matched, value of ClientIDClaim is used as client ID, empty ClientIDClaim rejects such tokens.
+type ClaimsMappingConfig struct {
+	ClientIDClaim string         `yaml:"client_id_claim"`
+	Mappings      []ClaimMapping `yaml:"mappings"`
+}
+
+// LoadClaimsMappingConfig reads ClaimsMappingConfig from YAML file. Without file "sub" claim is used as client ID.
+func LoadClaimsMappingConfig(path string) (*ClaimsMappingConfig, error) {
+	if path == "" {
+		return &ClaimsMappingConfig{ClientIDClaim: DefaultClientIDClaim}, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config := &ClaimsMappingConfig{}
+	if err := yaml.Unmarshal(data, config); err != nil {
+		return nil, err
+	}
+	if config.ClientIDClaim == "" && len(config.Mappings) == 0 {
+		return nil, fmt.Errorf("%w: neither client_id_claim nor mappings are set", ErrInvalidClaimsMappingConfig)
+	}
+	for i, mapping := range config.Mappings {
+		if mapping.Claim == "" || mapping.ClientID == "" {
+			return nil, fmt.Errorf("%w: mapping %d without claim or client_id", ErrInvalidClaimsMappingConfig, i)
+		}
+	}
+	return config, nil
+}
+
+// ClientID returns client ID which claims are mapped to
+func (config *ClaimsMappingConfig) ClientID(claims oidc.Claims) ([]byte, error) {
+	for _, mapping := range config.Mappings {
+		if claimContains(claims[mapping.Claim], mapping.Value) {
+			return []byte(mapping.ClientID), nil
+		}
+	}
+	if config.ClientIDClaim != "" {
+		if clientID, ok := claims[config.ClientIDClaim].(string); ok && clientID != "" {
+			return []byte(clientID), nil
+		}
+	}
+	return nil, ErrNoClientIDForClaims
+}
+
+// claimContains returns true if claim is equal to value or is a list with item equal to value
+func claimContains(claim interface{}, value string) bool {
+	switch claim := claim.(type) {
+	case nil:
+		return false
+	case []interface{}:
+		for _, item := range claim {
+			if claimContains(item, value) {
+				return true
+			}
+		}
+		return false
+	case map[string]interface{}:
+		return false
+	default:
+		return fmt.Sprint(claim) == value
+	}
+}
+
+// TokenAuthenticator authenticates requests with bearer tokens of OpenID Connect provider and maps token claims to
+// client ID. Methods of nil TokenAuthenticator keep client ID of connection or request.
+type TokenAuthenticator struct {
+	verifier *oidc.Verifier
+	mapping  *ClaimsMappingConfig
+	required bool
+}
+
+// NewTokenAuthenticator returns TokenAuthenticator which verifies tokens with verifier and maps claims to client ID.
+// If required is false, requests without token keep client ID of connection or request.
+func NewTokenAuthenticator(verifier *oidc.Verifier, mapping *ClaimsMappingConfig, required bool) *TokenAuthenticator {
+	return &TokenAuthenticator{verifier: verifier, mapping: mapping, required: required}
+}
+
+// Authenticate returns client ID of bearer token from value of Authorization header. Without header clientID is
+// returned if token isn't required.
+func (authenticator *TokenAuthenticator) Authenticate(authorization string, clientID []byte) ([]byte, error) {
+	if authenticator == nil {
+		return clientID, nil
+	}
+	if authorization == "" {
+		if authenticator.required {
+			return nil, ErrTokenRequired
+		}
+		return clientID, nil
+	}
+	parts := strings.Fields(authorization)
+	if len(parts) != 2 || !strings.EqualFold(parts[0], "Bearer") {
+		return nil, ErrInvalidAuthorizationHeader
+	}
+	claims, err := authenticator.verifier.Verify(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	return authenticator.mapping.ClientID(claims)
+}
@@ -0,0 +1,143 @@
+package common
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/cossacklabs/acra/oidc"
+)
+
+func TestClaimsMappingConfig(t *testing.T) {
+	file, err := ioutil.TempFile("", "claims_mapping")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.WriteString(`
+client_id_claim: client_id
+mappings:
+  - claim: groups
+    value: billing
+    client_id: billing_app
+  - claim: sub
+    value: system:serviceaccount:payments:reporting
+    client_id: reporting
+`); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	config, err := LoadClaimsMappingConfig(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testcases := []struct {
+		claims   oidc.Claims
+		clientID string
+	}{
+		{oidc.Claims{"sub": "user", "groups": []interface{}{"admins", "billing"}, "client_id": "other"}, "billing_app"},
+		{oidc.Claims{"sub": "system:serviceaccount:payments:reporting"}, "reporting"},
+		{oidc.Claims{"sub": "user", "client_id": "app"}, "app"},
+		{oidc.Claims{"sub": "user", "groups": "billing"}, "billing_app"},
+	}
+	for _, testcase := range testcases {
+		clientID, err := config.ClientID(testcase.claims)
+		if err != nil || string(clientID) != testcase.clientID {
+			t.Fatalf("Claims %v: expected %s, took %s and %v", testcase.claims, testcase.clientID, clientID, err)
+		}
+	}
+	if _, err := config.ClientID(oidc.Claims{"sub": "user", "client_id": 10}); !errors.Is(err, ErrNoClientIDForClaims) {
+		t.Fatalf("Expected ErrNoClientIDForClaims, took %v", err)
+	}
+
+	config, err = LoadClaimsMappingConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if clientID, err := config.ClientID(oidc.Claims{"sub": "user"}); err != nil || string(clientID) != "user" {
+		t.Fatalf("Expected client ID from sub claim, took %s and %v", clientID, err)
+	}
+
+	for _, data := range []string{"mappings: []\n", "mappings:\n  - claim: sub\n    value: user\n"} {
+		if err := ioutil.WriteFile(file.Name(), []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadClaimsMappingConfig(file.Name()); !errors.Is(err, ErrInvalidClaimsMappingConfig) {
+			t.Fatalf("Expected ErrInvalidClaimsMappingConfig for %s, took %v", data, err)
+		}
+	}
+}
+
+func TestTokenAuthenticator(t *testing.T) {
+	var nilAuthenticator *TokenAuthenticator
+	if clientID, err := nilAuthenticator.Authenticate("Bearer token", []byte("connection")); err != nil || string(clientID) != "connection" {
+		t.Fatalf("Nil authenticator should keep client ID, took %s and %v", clientID, err)
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		json.NewEncoder(writer).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "key",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	}))
+	defer server.Close()
+	verifier, err := oidc.NewVerifier("https://issuer.example.com", "acra-translator", oidc.NewKeySet(server.URL, server.Client()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	encode := func(value interface{}) string {
+		data, err := json.Marshal(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	signed := encode(map[string]string{"alg": "RS256", "kid": "key"}) + "." + encode(map[string]interface{}{
+		"iss": "https://issuer.example.com",
+		"aud": "acra-translator",
+		"sub": "app",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+	hashed := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hashed[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+
+	authenticator := NewTokenAuthenticator(verifier, &ClaimsMappingConfig{ClientIDClaim: DefaultClientIDClaim}, false)
+	if clientID, err := authenticator.Authenticate("Bearer "+token, []byte("connection")); err != nil || string(clientID) != "app" {
+		t.Fatalf("Expected client ID of token, took %s and %v", clientID, err)
+	}
+	if clientID, err := authenticator.Authenticate("", []byte("connection")); err != nil || string(clientID) != "connection" {
+		t.Fatalf("Expected client ID of connection without token, took %s and %v", clientID, err)
+	}
+	if _, err := authenticator.Authenticate("Basic dXNlcjpwYXNzd29yZA==", nil); !errors.Is(err, ErrInvalidAuthorizationHeader) {
+		t.Fatalf("Expected ErrInvalidAuthorizationHeader, took %v", err)
+	}
+	if _, err := authenticator.Authenticate("Bearer "+token+"x", nil); !errors.Is(err, oidc.ErrInvalidSignature) {
+		t.Fatalf("Expected ErrInvalidSignature, took %v", err)
+	}
+
+	authenticator = NewTokenAuthenticator(verifier, &ClaimsMappingConfig{ClientIDClaim: DefaultClientIDClaim}, true)
+	if _, err := authenticator.Authenticate("", []byte("connection")); !errors.Is(err, ErrTokenRequired) {
+		t.Fatalf("Expected ErrTokenRequired, took %v", err)
+	}
+}
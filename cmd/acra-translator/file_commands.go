@@ -0,0 +1,180 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"io"
+	"os"
+
+	"github.com/cossacklabs/acra/cmd"
+	"github.com/cossacklabs/acra/cmd/acra-translator/common"
+	"github.com/cossacklabs/acra/keystore"
+	filesystemV2 "github.com/cossacklabs/acra/keystore/v2/keystore/filesystem"
+	"github.com/cossacklabs/acra/logging"
+	"github.com/cossacklabs/acra/utils"
+	"github.com/cossacklabs/themis/gothemis/keys"
+	log "github.com/sirupsen/logrus"
+)
+
+// Subcommands which encrypt and decrypt local files without starting the service
+const (
+	EncryptFileCommand = "encrypt-file"
+	DecryptFileCommand = "decrypt-file"
+)
+
+// stdioPath is value of file_input/file_output which means stdin/stdout
+const stdioPath = "-"
+
+// fileCommandOptions are flags registered only for file subcommands
+type fileCommandOptions struct {
+	input     *string
+	output    *string
+	clientID  *string
+	zoneID    *string
+	chunkSize *int
+}
+
+// parseFileCommand returns file subcommand passed as first argument and removes it from os.Args, so other flags are
+// parsed as usual, or empty string if the service should be started
+func parseFileCommand() string {
+	if len(os.Args) < 2 || (os.Args[1] != EncryptFileCommand && os.Args[1] != DecryptFileCommand) {
+		return ""
+	}
+	command := os.Args[1]
+	os.Args = append(os.Args[:1], os.Args[2:]...)
+	return command
+}
+
+// registerFileCommandFlags registers flags of file subcommands
+func registerFileCommandFlags() fileCommandOptions {
+	return fileCommandOptions{
+		input:     flag.String("file_input", stdioPath, "Path to file to encrypt/decrypt, '-' - stdin"),
+		output:    flag.String("file_output", stdioPath, "Path to file where result is written, '-' - stdout"),
+		clientID:  flag.String("file_client_id", "", "Client ID which keys are used to encrypt/decrypt file"),
+		zoneID:    flag.String("file_zone_id", "", "Zone ID which keys are used to encrypt/decrypt file instead of file_client_id keys"),
+		chunkSize: flag.Int("file_chunk_size", common.DefaultFileChunkSize, "Size of chunks (in bytes) encrypted into separate AcraStructs, so files bigger than memory can be encrypted"),
+	}
+}
+
+// runFileCommand encrypts or decrypts file with keys of keystore and returns exit code
+func runFileCommand(command string, options fileCommandOptions, keysDir string, keysCacheSize int) int {
+	logger := log.WithFields(log.Fields{"command": command, "client_id": *options.clientID, "zone_id": *options.zoneID})
+	if *options.clientID == "" && *options.zoneID == "" {
+		logger.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+			Errorln("Configuration error: file_client_id or file_zone_id should be set")
+		return 1
+	}
+	var keyStore keystore.TranslationKeyStore
+	if !cmd.IsKeystoreBundleEnabled() && filesystemV2.IsKeyDirectory(keysDir) {
+		keyStore = openKeyStoreV2(keysDir)
+	} else {
+		keyStore = openKeyStoreV1(keysDir, keysCacheSize)
+	}
+
+	input := os.Stdin
+	if *options.input != stdioPath {
+		file, err := os.Open(*options.input)
+		if err != nil {
+			logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorGeneral).Errorln("Can't open input file")
+			return 1
+		}
+		defer file.Close()
+		input = file
+	}
+	// result is written to temporary file which replaces output only on success, so output isn't left half-written
+	output := os.Stdout
+	var outputFile *os.File
+	if *options.output != stdioPath {
+		file, err := os.OpenFile(*options.output+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorGeneral).Errorln("Can't create output file")
+			return 1
+		}
+		defer func() {
+			file.Close()
+			os.Remove(file.Name())
+		}()
+		output, outputFile = file, file
+	}
+	writer := bufio.NewWriter(output)
+
+	var zoneID []byte
+	if *options.zoneID != "" {
+		zoneID = []byte(*options.zoneID)
+	}
+	if err := processFile(command, keyStore, bufio.NewReader(input), writer, []byte(*options.clientID), zoneID, *options.chunkSize, logger); err != nil {
+		return 1
+	}
+	if err := writer.Flush(); err != nil {
+		logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorGeneral).Errorln("Can't write output")
+		return 1
+	}
+	if outputFile != nil {
+		if err := outputFile.Sync(); err != nil {
+			logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorGeneral).Errorln("Can't write output file")
+			return 1
+		}
+		if err := os.Rename(outputFile.Name(), *options.output); err != nil {
+			logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorGeneral).Errorln("Can't replace output file")
+			return 1
+		}
+	}
+	logger.Infoln("File processed")
+	return 0
+}
+
+// processFile encrypts reader with public key or decrypts it with private keys of zone or client ID
+func processFile(command string, keyStore keystore.TranslationKeyStore, reader io.Reader, writer io.Writer, clientID, zoneID []byte, chunkSize int, logger *log.Entry) error {
+	if command == EncryptFileCommand {
+		var publicKey *keys.PublicKey
+		var err error
+		if zoneID != nil {
+			publicKey, err = keyStore.GetZonePublicKey(zoneID)
+		} else {
+			publicKey, err = keyStore.GetClientIDEncryptionPublicKey(clientID)
+		}
+		if err != nil {
+			logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCantReadKeys).Errorln("Can't load public key for encryption")
+			return err
+		}
+		if err := common.EncryptFile(reader, writer, publicKey, zoneID, chunkSize); err != nil {
+			logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCantEncryptData).Errorln("Can't encrypt file")
+			return err
+		}
+		return nil
+	}
+
+	var privateKeys []*keys.PrivateKey
+	var err error
+	if zoneID != nil {
+		privateKeys, err = keyStore.GetZonePrivateKeys(zoneID)
+	} else {
+		privateKeys, err = keyStore.GetServerDecryptionPrivateKeys(clientID)
+	}
+	if err != nil {
+		logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCantReadKeys).Errorln("Can't load private keys for decryption")
+		return err
+	}
+	defer utils.ZeroizePrivateKeys(privateKeys)
+	if err := common.DecryptFile(reader, writer, privateKeys, zoneID); err != nil {
+		logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorTranslatorCantDecryptAcraStruct).Errorln("Can't decrypt file")
+		return err
+	}
+	return nil
+}
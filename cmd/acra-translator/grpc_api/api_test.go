@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"errors"
 	"testing"
+	"time"
 
 	"github.com/cossacklabs/acra/acra-writer"
 	"github.com/cossacklabs/acra/cmd/acra-translator/common"
@@ -11,6 +12,9 @@ import (
 	"github.com/cossacklabs/acra/poison"
 	"github.com/cossacklabs/themis/gothemis/keys"
 	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 )
 
 type testKeystore struct {
@@ -286,3 +290,80 @@ func TestDecryptGRPCService_Encrypt(t *testing.T) {
 		t.Fatal("Incorrect encryption/decryption with zone id")
 	}
 }
+
+func TestDecryptGRPCService_EncryptIdempotencyKey(t *testing.T) {
+	clientID := []byte("test client")
+	encryptionKey, err := keys.New(keys.TypeEC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	translatorData := &common.TranslatorData{
+		Keystorage:       &testKeystore{EncryptionKeypair: encryptionKey},
+		IdempotencyStore: common.NewIdempotencyStore(time.Hour, 0),
+	}
+	service, err := NewDecryptGRPCService(translatorData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(IdempotencyKeyMetadata, "request-1"))
+	first, err := service.Encrypt(ctx, &EncryptRequest{Data: []byte("data"), ClientId: clientID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	retried, err := service.Encrypt(ctx, &EncryptRequest{Data: []byte("data"), ClientId: clientID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(first.Acrastruct, retried.Acrastruct) {
+		t.Fatal("Retry with the same idempotency key should return the same AcraStruct")
+	}
+	other, err := service.Encrypt(context.Background(), &EncryptRequest{Data: []byte("data"), ClientId: clientID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(first.Acrastruct, other.Acrastruct) {
+		t.Fatal("Request without idempotency key should return new AcraStruct")
+	}
+	if _, err := service.Encrypt(ctx, &EncryptRequest{Data: []byte("other data"), ClientId: clientID}); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("Expected InvalidArgument for reused idempotency key, took %v", err)
+	}
+}
+
+func TestDecryptGRPCService_EmptyData(t *testing.T) {
+	ctx := context.Background()
+	clientID := []byte("test client")
+	encryptionKey, err := keys.New(keys.TypeEC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keystore := &testKeystore{EncryptionKeypair: encryptionKey}
+
+	translatorData := &common.TranslatorData{Keystorage: keystore}
+	service, err := NewDecryptGRPCService(translatorData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// AcraStruct can't contain empty data
+	if _, err := service.Encrypt(ctx, &EncryptRequest{Data: []byte{}, ClientId: clientID}); err != ErrCantEncrypt {
+		t.Fatalf("Expected ErrCantEncrypt, took %v", err)
+	}
+	if _, err := service.Decrypt(ctx, &DecryptRequest{Acrastruct: []byte{}, ClientId: clientID}); err != ErrCantDecrypt {
+		t.Fatalf("Expected ErrCantDecrypt, took %v", err)
+	}
+
+	translatorData.PassEmptyValues = true
+	response, err := service.Encrypt(ctx, &EncryptRequest{Data: []byte{}, ClientId: clientID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Acrastruct) != 0 {
+		t.Fatal("Empty data was encrypted")
+	}
+	decryptResponse, err := service.Decrypt(ctx, &DecryptRequest{Acrastruct: []byte{}, ClientId: clientID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decryptResponse.Data) != 0 {
+		t.Fatal("Expected empty data on decryption of empty data")
+	}
+}
@@ -20,8 +20,10 @@ limitations under the License.
 package grpc_api
 
 import (
+	"bytes"
 	"errors"
 	acrawriter "github.com/cossacklabs/acra/acra-writer"
+	"github.com/cossacklabs/acra/audit"
 	"github.com/cossacklabs/acra/cmd/acra-translator/common"
 	"github.com/cossacklabs/acra/decryptor/base"
 	"github.com/cossacklabs/acra/logging"
@@ -30,6 +32,10 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 )
 
 // DecryptGRPCService represents decryptor for decrypting AcraStructs from gRPC requests.
@@ -50,14 +56,110 @@ var (
 	ErrCantEncrypt      = errors.New("can't encrypt data")
 )
 
+// Keys of gRPC metadata used by translator, HTTP gateway passes HTTP headers with the same names
+const (
+	AuthorizationMetadata      = "authorization"
+	IdempotencyKeyMetadata     = "idempotency-key"
+	IdempotentReplayedMetadata = "idempotent-replayed"
+)
+
+// metadataValue returns first value of incoming metadata key or empty string
+func metadataValue(ctx context.Context, key string) string {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get(key); len(values) > 0 {
+			return values[0]
+		}
+	}
+	return ""
+}
+
+// checkQuota returns ResourceExhausted error if client exceeded its quota, otherwise nil
+func (service *DecryptGRPCService) checkQuota(clientID []byte, dataSize int, logger *logrus.Entry) error {
+	if err := service.TranslatorData.QuotaManager.Allow(clientID, dataSize); err != nil {
+		logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorTranslatorQuotaExceeded).Warningln("Client exceeded quota")
+		return status.Error(codes.ResourceExhausted, err.Error())
+	}
+	return nil
+}
+
+// authenticate returns client ID of bearer token from "authorization" metadata. Requests without token keep clientID
+// if token isn't required, clientID which differs from token's one is rejected with PermissionDenied error.
+func (service *DecryptGRPCService) authenticate(ctx context.Context, clientID []byte, logger *logrus.Entry) ([]byte, error) {
+	if service.TranslatorData.TokenAuthenticator == nil {
+		return clientID, nil
+	}
+	tokenClientID, err := service.TranslatorData.TokenAuthenticator.Authenticate(metadataValue(ctx, AuthorizationMetadata), clientID)
+	if err != nil {
+		logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorTokenAuthentication).Warningln("Can't authenticate request with bearer token")
+		return nil, status.Error(codes.Unauthenticated, "invalid bearer token")
+	}
+	if len(clientID) != 0 && !bytes.Equal(clientID, tokenClientID) {
+		logger.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorTokenAuthentication).
+			WithField("token_client_id", string(tokenClientID)).Warningln("ClientID of request doesn't match bearer token")
+		return nil, status.Error(codes.PermissionDenied, "clientID doesn't match bearer token")
+	}
+	return tokenClientID, nil
+}
+
 // Encrypt encrypt data from gRPC request and returns AcraStruct or error.
-func (service *DecryptGRPCService) Encrypt(ctx context.Context, request *EncryptRequest) (*EncryptResponse, error) {
+func (service *DecryptGRPCService) Encrypt(ctx context.Context, request *EncryptRequest) (response *EncryptResponse, err error) {
 	logger := service.logger.WithFields(logrus.Fields{"client_id": string(request.ClientId), "zone_id": string(request.ZoneId), "operation": "Encrypt"})
 	logger.Debugln("New request")
 	defer logger.WithFields(logrus.Fields{"client_id": string(request.ClientId), "zone_id": string(request.ZoneId), "operation": "Encrypt"}).Debugln("End processing request")
 	timer := prometheus.NewTimer(prometheus.ObserverFunc(common.RequestProcessingTimeHistogram.WithLabelValues(common.GrpcRequestType).Observe))
 	defer timer.ObserveDuration()
+	defer func() {
+		service.TranslatorData.AuditExporter.Record(audit.NewEvent(
+			"encrypt", common.GrpcRequestType, request.ClientId, request.ZoneId, len(request.Data), err))
+	}()
 
+	clientID, err := service.authenticate(ctx, request.ClientId, logger)
+	if err != nil {
+		return nil, err
+	}
+	request.ClientId = clientID
+	if err := service.checkQuota(request.ClientId, len(request.Data), logger); err != nil {
+		return nil, err
+	}
+	if len(request.Data) == 0 {
+		if !service.TranslatorData.PassEmptyValues {
+			base.APIEncryptionCounter.WithLabelValues(base.EncryptionTypeFail).Inc()
+			logger.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCantEncryptData).Warningln("Empty data can't be encrypted")
+			return nil, ErrCantEncrypt
+		}
+		logger.Debugln("Pass empty data without encryption")
+		return &EncryptResponse{Acrastruct: request.Data}, nil
+	}
+
+	// retry with the same idempotency key returns the same AcraStruct instead of new one
+	acrastruct, replayed, err := service.TranslatorData.IdempotencyStore.Do(request.ClientId, metadataValue(ctx, IdempotencyKeyMetadata),
+		[][]byte{[]byte("encrypt"), request.ZoneId, request.Data}, func() ([]byte, error) {
+			return service.encrypt(request, logger)
+		})
+	switch err {
+	case nil:
+	case ErrCantEncrypt:
+		return nil, err
+	case common.ErrIdempotencyStoreFull:
+		base.APIEncryptionCounter.WithLabelValues(base.EncryptionTypeFail).Inc()
+		logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorTranslatorIdempotencyKey).Warningln("Can't process request with idempotency key")
+		return nil, status.Error(codes.Unavailable, err.Error())
+	default:
+		base.APIEncryptionCounter.WithLabelValues(base.EncryptionTypeFail).Inc()
+		logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorTranslatorIdempotencyKey).Warningln("Can't process request with idempotency key")
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if replayed {
+		logger.Infoln("Replayed AcraStruct of request with the same idempotency key")
+		// error means that method is called without gRPC stream, response is valid without header
+		grpc.SetHeader(ctx, metadata.Pairs(IdempotentReplayedMetadata, "true"))
+	}
+	common.ObservePayloadSizes(common.GrpcRequestType, common.OperationEncrypt, request.Data, acrastruct)
+	return &EncryptResponse{Acrastruct: acrastruct}, nil
+}
+
+// encrypt returns AcraStruct of request data encrypted with key of zone or client ID
+func (service *DecryptGRPCService) encrypt(request *EncryptRequest, logger *logrus.Entry) ([]byte, error) {
 	var publicKey *keys.PublicKey
 	var err error
 	if len(request.ZoneId) != 0 {
@@ -84,25 +186,45 @@ func (service *DecryptGRPCService) Encrypt(ctx context.Context, request *Encrypt
 	}
 	base.APIEncryptionCounter.WithLabelValues(base.EncryptionTypeSuccess).Inc()
 	logger.Infoln("Encrypted data to AcraStruct")
-	return &EncryptResponse{Acrastruct: acrastruct}, nil
+	return acrastruct, nil
 }
 
 // Decrypt decrypts AcraStruct from gRPC request and returns decrypted data or error.
-func (service *DecryptGRPCService) Decrypt(ctx context.Context, request *DecryptRequest) (*DecryptResponse, error) {
+func (service *DecryptGRPCService) Decrypt(ctx context.Context, request *DecryptRequest) (response *DecryptResponse, err error) {
 	logger := service.logger.WithFields(logrus.Fields{"client_id": string(request.ClientId), "zone_id": string(request.ZoneId), "operation": "Decrypt"})
 	logger.Debugln("New request")
 	defer logger.WithFields(logrus.Fields{"client_id": string(request.ClientId), "zone_id": string(request.ZoneId), "operation": "Decrypt"}).Debugln("End processing request")
 	var privateKeys []*keys.PrivateKey
-	var err error
 	var decryptionContext []byte
 
 	timer := prometheus.NewTimer(prometheus.ObserverFunc(common.RequestProcessingTimeHistogram.WithLabelValues(common.GrpcRequestType).Observe))
 	defer timer.ObserveDuration()
+	defer func() {
+		service.TranslatorData.AuditExporter.Record(audit.NewEvent(
+			"decrypt", common.GrpcRequestType, request.ClientId, request.ZoneId, len(request.Acrastruct), err))
+	}()
 
+	clientID, err := service.authenticate(ctx, request.ClientId, logger)
+	if err != nil {
+		return nil, err
+	}
+	request.ClientId = clientID
 	if len(request.ClientId) == 0 {
 		logger.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorTranslatorClientIDMissing).Errorln("GRPC request without ClientID not allowed")
 		return nil, ErrClientIDRequired
 	}
+	if err := service.checkQuota(request.ClientId, len(request.Acrastruct), logger); err != nil {
+		return nil, err
+	}
+	if len(request.Acrastruct) == 0 {
+		if !service.TranslatorData.PassEmptyValues {
+			base.AcrastructDecryptionCounter.WithLabelValues(base.DecryptionTypeFail).Inc()
+			logger.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorTranslatorCantDecryptAcraStruct).Warningln("Empty data can't be decrypted")
+			return nil, ErrCantDecrypt
+		}
+		logger.Debugln("Pass empty data without decryption")
+		return &DecryptResponse{Data: request.Acrastruct}, nil
+	}
 	if len(request.ZoneId) != 0 {
 		privateKeys, err = service.TranslatorData.Keystorage.GetZonePrivateKeys(request.ZoneId)
 		decryptionContext = request.ZoneId
@@ -112,6 +234,7 @@ func (service *DecryptGRPCService) Decrypt(ctx context.Context, request *Decrypt
 	if err != nil {
 		base.AcrastructDecryptionCounter.WithLabelValues(base.DecryptionTypeFail).Inc()
 		logger.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCantReadKeys).WithError(err).Errorln("Can't load private key for decryption")
+		base.LogKeyLookupFailure(logger, request.ClientId, request.ZoneId, err)
 		return nil, ErrCantDecrypt
 	}
 	defer utils.ZeroizePrivateKeys(privateKeys)
@@ -119,6 +242,7 @@ func (service *DecryptGRPCService) Decrypt(ctx context.Context, request *Decrypt
 	if decryptErr != nil {
 		base.AcrastructDecryptionCounter.WithLabelValues(base.DecryptionTypeFail).Inc()
 		logger.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorTranslatorCantDecryptAcraStruct).WithError(decryptErr).Errorln("Can't decrypt AcraStruct")
+		base.LogDecryptionFailure(logger, request.ClientId, decryptionContext, request.Acrastruct, privateKeys, decryptErr)
 		if service.TranslatorData.CheckPoisonRecords {
 			poisoned, err := base.CheckPoisonRecord(request.Acrastruct, service.TranslatorData.Keystorage)
 			if err != nil {
@@ -139,5 +263,6 @@ func (service *DecryptGRPCService) Decrypt(ctx context.Context, request *Decrypt
 		return nil, ErrCantDecrypt
 	}
 	base.AcrastructDecryptionCounter.WithLabelValues(base.DecryptionTypeSuccess).Inc()
+	common.ObservePayloadSizes(common.GrpcRequestType, common.OperationDecrypt, request.Acrastruct, data)
 	return &DecryptResponse{Data: data}, nil
 }
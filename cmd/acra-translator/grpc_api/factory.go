@@ -17,6 +17,8 @@ limitations under the License.
 package grpc_api
 
 import (
+	"net/http"
+
 	"github.com/cossacklabs/acra/cmd/acra-translator/common"
 	"github.com/cossacklabs/acra/logging"
 	"github.com/cossacklabs/acra/network"
@@ -44,3 +46,18 @@ func (factory *GRPCServerFactory) New(data *common.TranslatorData, opts ...grpc.
 	reflection.Register(grpcServer)
 	return grpcServer, nil
 }
+
+// NewWithGateway return new generated grpc.Server with gRPC Translator API and HTTP handler which serves gRPC requests
+// with this server and REST/JSON transcoded requests on the same connection. Transport credentials shouldn't be passed
+// in opts, connections passed to handler should be wrapped already.
+func (factory *GRPCServerFactory) NewWithGateway(data *common.TranslatorData, opts ...grpc.ServerOption) (*grpc.Server, http.Handler, error) {
+	grpcServer, err := factory.New(data, opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	service, err := NewDecryptGRPCService(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	return grpcServer, NewGRPCWithGatewayHandler(grpcServer, NewGatewayHandler(service, service)), nil
+}
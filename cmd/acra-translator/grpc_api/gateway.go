@@ -0,0 +1,212 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package grpc_api
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/cossacklabs/acra/logging"
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Paths of REST/JSON transcoded gRPC methods
+const (
+	GatewayDecryptPath = "/v1/decrypt"
+	GatewayEncryptPath = "/v1/encrypt"
+)
+
+// gatewayMaxRequestSize matches default limit of received gRPC message
+const gatewayMaxRequestSize = 4 * 1024 * 1024
+
+// gatewayMethod transcodes JSON request body to request message of gRPC method
+type gatewayMethod struct {
+	newRequest func() proto.Message
+	call       func(ctx context.Context, request proto.Message) (proto.Message, error)
+}
+
+// GatewayHandler serves gRPC API methods as POST requests with JSON bodies. Messages are transcoded with field names
+// from api.proto and base64 encoded bytes, errors are returned with HTTP status mapped from gRPC code like
+// grpc-gateway does.
+type GatewayHandler struct {
+	methods   map[string]*gatewayMethod
+	marshaler *jsonpb.Marshaler
+	logger    *logrus.Entry
+}
+
+// NewGatewayHandler returns handler which calls reader and writer implementations of gRPC API
+func NewGatewayHandler(reader ReaderServer, writer WriterServer) *GatewayHandler {
+	return &GatewayHandler{
+		methods: map[string]*gatewayMethod{
+			GatewayDecryptPath: {
+				newRequest: func() proto.Message { return &DecryptRequest{} },
+				call: func(ctx context.Context, request proto.Message) (proto.Message, error) {
+					return reader.Decrypt(ctx, request.(*DecryptRequest))
+				},
+			},
+			GatewayEncryptPath: {
+				newRequest: func() proto.Message { return &EncryptRequest{} },
+				call: func(ctx context.Context, request proto.Message) (proto.Message, error) {
+					return writer.Encrypt(ctx, request.(*EncryptRequest))
+				},
+			},
+		},
+		marshaler: &jsonpb.Marshaler{OrigName: true},
+		logger:    logrus.WithField("service", "grpc_gateway"),
+	}
+}
+
+// ServeHTTP transcodes request to gRPC method call
+func (handler *GatewayHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	method, ok := handler.methods[r.URL.Path]
+	if !ok {
+		handler.writeError(w, status.Error(codes.NotFound, "Not Found"))
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		handler.writeStatus(w, http.StatusMethodNotAllowed, status.New(codes.Unimplemented, "Method Not Allowed"))
+		return
+	}
+	request := method.newRequest()
+	unmarshaler := &jsonpb.Unmarshaler{}
+	if err := unmarshaler.Unmarshal(io.LimitReader(r.Body, gatewayMaxRequestSize), request); err != nil {
+		handler.logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorTranslatorCantHandleGRPCConnection).
+			Warningln("Can't parse JSON request")
+		handler.writeError(w, status.Error(codes.InvalidArgument, "invalid JSON request body"))
+		return
+	}
+	// bearer token and idempotency key are passed the same way as metadata of gRPC request
+	md := metadata.MD{}
+	for _, key := range []string{AuthorizationMetadata, IdempotencyKeyMetadata} {
+		if value := r.Header.Get(key); value != "" {
+			md.Set(key, value)
+		}
+	}
+	headers := metadata.MD{}
+	ctx := grpc.NewContextWithServerTransportStream(metadata.NewIncomingContext(r.Context(), md), &gatewayTransportStream{method: r.URL.Path, headers: headers})
+	response, err := method.call(ctx, request)
+	if err != nil {
+		handler.writeError(w, err)
+		return
+	}
+	if len(headers.Get(IdempotentReplayedMetadata)) > 0 {
+		w.Header().Set(IdempotentReplayedMetadata, headers.Get(IdempotentReplayedMetadata)[0])
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := handler.marshaler.Marshal(w, response); err != nil {
+		handler.logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorTranslatorCantHandleGRPCConnection).
+			Errorln("Can't write JSON response")
+	}
+}
+
+// gatewayTransportStream collects headers set by gRPC method called by gateway
+type gatewayTransportStream struct {
+	method  string
+	headers metadata.MD
+}
+
+func (stream *gatewayTransportStream) Method() string {
+	return stream.method
+}
+
+func (stream *gatewayTransportStream) SetHeader(md metadata.MD) error {
+	for key, values := range md {
+		stream.headers.Append(key, values...)
+	}
+	return nil
+}
+
+func (stream *gatewayTransportStream) SendHeader(md metadata.MD) error {
+	return stream.SetHeader(md)
+}
+
+func (stream *gatewayTransportStream) SetTrailer(md metadata.MD) error {
+	return nil
+}
+
+func (handler *GatewayHandler) writeError(w http.ResponseWriter, err error) {
+	st := status.Convert(err)
+	handler.writeStatus(w, HTTPStatusFromCode(st.Code()), st)
+}
+
+// writeStatus writes error in grpc-gateway format: {"error": message, "code": gRPC code, "message": message}
+func (handler *GatewayHandler) writeStatus(w http.ResponseWriter, httpStatus int, st *status.Status) {
+	body, err := json.Marshal(map[string]interface{}{"error": st.Message(), "code": st.Code(), "message": st.Message()})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(httpStatus)
+	w.Write(body)
+}
+
+// HTTPStatusFromCode maps gRPC status code to HTTP status code the same way as grpc-gateway
+func HTTPStatusFromCode(code codes.Code) int {
+	switch code {
+	case codes.OK:
+		return http.StatusOK
+	case codes.Canceled:
+		return 499
+	case codes.InvalidArgument, codes.FailedPrecondition, codes.OutOfRange:
+		return http.StatusBadRequest
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists, codes.Aborted:
+		return http.StatusConflict
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// NewGRPCWithGatewayHandler returns handler which passes gRPC requests (HTTP/2 with application/grpc content type)
+// to grpcServer and other requests to gateway. HTTP/2 is accepted without TLS negotiation (h2c) because connections
+// are already authenticated and encrypted by transport credentials.
+func NewGRPCWithGatewayHandler(grpcServer *grpc.Server, gateway http.Handler) http.Handler {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor == 2 && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+			grpcServer.ServeHTTP(w, r)
+			return
+		}
+		gateway.ServeHTTP(w, r)
+	})
+	return h2c.NewHandler(handler, &http2.Server{})
+}
@@ -0,0 +1,103 @@
+package grpc_api
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/cossacklabs/acra/cmd/acra-translator/common"
+	"github.com/cossacklabs/themis/gothemis/keys"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+func TestGRPCWithGatewayHandler(t *testing.T) {
+	encryptionKey, err := keys.New(keys.TypeEC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	translatorData := &common.TranslatorData{Keystorage: &testKeystore{EncryptionKeypair: encryptionKey}}
+	grpcServer, handler, err := (&GRPCServerFactory{}).NewWithGateway(translatorData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer grpcServer.Stop()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpServer := &http.Server{Handler: handler}
+	go httpServer.Serve(listener)
+	defer httpServer.Close()
+	address := listener.Addr().String()
+
+	// gRPC clients use the same port
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	connection, err := grpc.DialContext(ctx, address, grpc.WithInsecure(), grpc.WithBlock())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer connection.Close()
+	encryptResponse, err := NewWriterClient(connection).Encrypt(ctx, &EncryptRequest{ClientId: []byte("client"), Data: []byte("data")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// REST clients decrypt AcraStruct encrypted via gRPC
+	requestBody, _ := json.Marshal(map[string]string{
+		"client_id":  base64.StdEncoding.EncodeToString([]byte("client")),
+		"acrastruct": base64.StdEncoding.EncodeToString(encryptResponse.Acrastruct),
+	})
+	response, err := http.Post("http://"+address+GatewayDecryptPath, "application/json", bytes.NewReader(requestBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("Unexpected status %d", response.StatusCode)
+	}
+	decryptResponse := map[string]string{}
+	if err := json.NewDecoder(response.Body).Decode(&decryptResponse); err != nil {
+		t.Fatal(err)
+	}
+	if decryptResponse["data"] != base64.StdEncoding.EncodeToString([]byte("data")) {
+		t.Fatalf("Incorrect decrypted data %v", decryptResponse)
+	}
+
+	testCases := []struct {
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{http.MethodPost, GatewayEncryptPath, "{invalid", http.StatusBadRequest},
+		{http.MethodPost, "/v1/unknown", "{}", http.StatusNotFound},
+		{http.MethodGet, GatewayEncryptPath, "", http.StatusMethodNotAllowed},
+		// service returns error without gRPC code
+		{http.MethodPost, GatewayDecryptPath, `{"acrastruct": "AAAA"}`, http.StatusInternalServerError},
+	}
+	for i, testCase := range testCases {
+		request, err := http.NewRequest(testCase.method, "http://"+address+testCase.path, bytes.NewReader([]byte(testCase.body)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		errorBody := map[string]interface{}{}
+		json.NewDecoder(response.Body).Decode(&errorBody)
+		response.Body.Close()
+		if response.StatusCode != testCase.status {
+			t.Errorf("%d: expected status %d, took %d", i, testCase.status, response.StatusCode)
+		}
+		if _, ok := errorBody["message"]; !ok {
+			t.Errorf("%d: error response without message", i)
+		}
+	}
+}
@@ -21,8 +21,10 @@ package http_api
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	acrawriter "github.com/cossacklabs/acra/acra-writer"
+	"github.com/cossacklabs/acra/audit"
 	"github.com/cossacklabs/acra/cmd/acra-translator/common"
 	"github.com/cossacklabs/acra/decryptor/base"
 	"github.com/cossacklabs/acra/logging"
@@ -34,6 +36,7 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"path"
 	"strings"
 )
 
@@ -42,6 +45,9 @@ const (
 	httpAPIMethodEncrypt = "encrypt"
 )
 
+// errEncryptionFailed marks failed encryption which result isn't stored for idempotency key
+var errEncryptionFailed = errors.New("can't encrypt data")
+
 // HTTPConnectionsDecryptor object for decrypting AcraStructs from HTTP requests.
 type HTTPConnectionsDecryptor struct {
 	*common.TranslatorData
@@ -120,15 +126,29 @@ func newBinaryResponseWithBody(request *http.Request, data []byte) *http.Respons
 
 // ParseRequestPrepareResponse parses HTTP request to find AcraStruct and ZoneID, then decrypts AcraStruct.
 // Returns HTTP response with appropriate status code, headers, decrypted AcraStruct or error message.
-func (decryptor *HTTPConnectionsDecryptor) ParseRequestPrepareResponse(logger *log.Entry, request *http.Request, clientID []byte) *http.Response {
+func (decryptor *HTTPConnectionsDecryptor) ParseRequestPrepareResponse(logger *log.Entry, request *http.Request, clientID []byte) (response *http.Response) {
 	timer := prometheus.NewTimer(prometheus.ObserverFunc(common.RequestProcessingTimeHistogram.WithLabelValues(common.HTTPRequestType).Observe))
 	defer timer.ObserveDuration()
+	defer func() {
+		decryptor.recordAuditEvent(request, clientID, response)
+	}()
 
 	requestLogger := logger.WithFields(log.Fields{"client_id": string(clientID), "translator": "http"})
 	if request == nil || request.URL == nil {
 		return emptyResponseWithStatus(request, http.StatusBadRequest)
 	}
 
+	// client ID of bearer token replaces client ID of connection
+	tokenClientID, err := decryptor.TranslatorData.TokenAuthenticator.Authenticate(request.Header.Get("Authorization"), clientID)
+	if err != nil {
+		requestLogger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorTokenAuthentication).Warningln("Can't authenticate request with bearer token")
+		response := responseWithMessage(request, http.StatusUnauthorized, "invalid bearer token")
+		response.Header.Set("WWW-Authenticate", "Bearer")
+		return response
+	}
+	clientID = tokenClientID
+	requestLogger = requestLogger.WithField("client_id", string(clientID))
+
 	requestLogger.Debugf("Incoming API request to %v", request.URL.Path)
 
 	if request.Method != http.MethodPost {
@@ -164,38 +184,72 @@ func (decryptor *HTTPConnectionsDecryptor) ParseRequestPrepareResponse(logger *l
 			base.APIEncryptionCounter.WithLabelValues(base.EncryptionTypeFail).Inc()
 			return httpResponse
 		}
+		if httpResponse := decryptor.checkQuota(request, clientID, len(context.Data), requestLogger); httpResponse != nil {
+			return httpResponse
+		}
+		if len(context.Data) == 0 {
+			if !decryptor.TranslatorData.PassEmptyValues {
+				base.APIEncryptionCounter.WithLabelValues(base.EncryptionTypeFail).Inc()
+				msg := "Empty data can't be encrypted"
+				requestLogger.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCantEncryptData).Warningln(msg)
+				return responseWithMessage(request, http.StatusBadRequest, msg)
+			}
+			requestLogger.Debugln("Pass empty data without encryption")
+			return newBinaryResponseWithBody(request, context.Data)
+		}
 		requestLogger = requestLogger.WithField("zone_id", context.ZoneID)
-		var publicKey *keys.PublicKey
-		var err error
-		if context.ZoneID != nil {
-			publicKey, err = decryptor.Keystorage.GetZonePublicKey(context.ZoneID)
-		} else {
-			publicKey, err = decryptor.Keystorage.GetClientIDEncryptionPublicKey(clientID)
+		// retry with the same idempotency key returns the same AcraStruct instead of new one
+		var errorResponse *http.Response
+		idempotencyKey := request.Header.Get(common.IdempotencyKeyHeader)
+		acrastruct, replayed, err := decryptor.TranslatorData.IdempotencyStore.Do(clientID, idempotencyKey, [][]byte{[]byte(endpoint), context.ZoneID, context.Data}, func() ([]byte, error) {
+			var acrastruct []byte
+			acrastruct, errorResponse = decryptor.encrypt(request, clientID, context, requestLogger)
+			if errorResponse != nil {
+				return nil, errEncryptionFailed
+			}
+			return acrastruct, nil
+		})
+		if errorResponse != nil {
+			return errorResponse
 		}
 		if err != nil {
 			base.APIEncryptionCounter.WithLabelValues(base.EncryptionTypeFail).Inc()
-			msg := "Invalid client or zone id"
-			requestLogger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCantReadKeys).Warningln(msg)
-			return responseWithMessage(request, http.StatusBadRequest, msg)
+			requestLogger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorTranslatorIdempotencyKey).Warningln("Can't process request with idempotency key")
+			status := http.StatusUnprocessableEntity
+			switch err {
+			case common.ErrInvalidIdempotencyKey:
+				status = http.StatusBadRequest
+			case common.ErrIdempotencyStoreFull:
+				status = http.StatusServiceUnavailable
+			}
+			return responseWithMessage(request, status, err.Error())
 		}
-		// publicKey will be clientID' if wasn't provided ZoneID and context.ZoneID will be nil, otherwise used ZoneID
-		// public key and context.ZoneID will have value
-		acrastruct, err := acrawriter.CreateAcrastruct(context.Data, publicKey, context.ZoneID)
-		if err != nil {
-			base.APIEncryptionCounter.WithLabelValues(base.EncryptionTypeFail).Inc()
-			msg := "Unexpected error with AcraStruct generation"
-			requestLogger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCantEncryptData).Warningln(msg)
-			return responseWithMessage(request, http.StatusBadRequest, msg)
+		common.ObservePayloadSizes(common.HTTPRequestType, common.OperationEncrypt, context.Data, acrastruct)
+		response := newBinaryResponseWithBody(request, acrastruct)
+		if replayed {
+			requestLogger.Infoln("Replayed AcraStruct of request with the same idempotency key")
+			response.Header.Set(common.IdempotentReplayedHeader, "true")
 		}
-		base.APIEncryptionCounter.WithLabelValues(base.EncryptionTypeSuccess).Inc()
-		requestLogger.Infoln("Encrypted data to AcraStruct")
-		return newBinaryResponseWithBody(request, acrastruct)
+		return response
 	case httpAPIMethodDecrypt:
 		requestLogger.Debugln("Process HTTP request to decrypt data")
 		context, httpResponse := newEncryptDecryptContextOrErrorResponse(request, clientID, requestLogger)
 		if httpResponse != nil {
 			return httpResponse
 		}
+		if httpResponse := decryptor.checkQuota(request, clientID, len(context.Data), requestLogger); httpResponse != nil {
+			return httpResponse
+		}
+		if len(context.Data) == 0 {
+			if !decryptor.TranslatorData.PassEmptyValues {
+				base.AcrastructDecryptionCounter.WithLabelValues(base.DecryptionTypeFail).Inc()
+				msg := "Empty data can't be decrypted"
+				requestLogger.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorTranslatorCantDecryptAcraStruct).Warningln(msg)
+				return responseWithMessage(request, http.StatusUnprocessableEntity, msg)
+			}
+			requestLogger.Debugln("Pass empty data without decryption")
+			return newBinaryResponseWithBody(request, context.Data)
+		}
 
 		decryptedStruct, err := decryptor.decryptAcraStruct(logger, context.Data, context.ZoneID, clientID)
 
@@ -225,6 +279,7 @@ func (decryptor *HTTPConnectionsDecryptor) ParseRequestPrepareResponse(logger *l
 		}
 		base.AcrastructDecryptionCounter.WithLabelValues(base.DecryptionTypeSuccess).Inc()
 		requestLogger.Infoln("Decrypted AcraStruct")
+		common.ObservePayloadSizes(common.HTTPRequestType, common.OperationDecrypt, context.Data, decryptedStruct)
 		return newBinaryResponseWithBody(request, decryptedStruct)
 	}
 	msg := "HTTP endpoint not supported"
@@ -233,6 +288,62 @@ func (decryptor *HTTPConnectionsDecryptor) ParseRequestPrepareResponse(logger *l
 	return responseWithMessage(request, http.StatusBadRequest, msg)
 }
 
+// encrypt returns AcraStruct of data encrypted with key of zone or clientID or response with error
+func (decryptor *HTTPConnectionsDecryptor) encrypt(request *http.Request, clientID []byte, context encryptDecryptContext, logger *log.Entry) ([]byte, *http.Response) {
+	var publicKey *keys.PublicKey
+	var err error
+	if context.ZoneID != nil {
+		publicKey, err = decryptor.Keystorage.GetZonePublicKey(context.ZoneID)
+	} else {
+		publicKey, err = decryptor.Keystorage.GetClientIDEncryptionPublicKey(clientID)
+	}
+	if err != nil {
+		base.APIEncryptionCounter.WithLabelValues(base.EncryptionTypeFail).Inc()
+		msg := "Invalid client or zone id"
+		logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCantReadKeys).Warningln(msg)
+		return nil, responseWithMessage(request, http.StatusBadRequest, msg)
+	}
+	// publicKey will be clientID' if wasn't provided ZoneID and context.ZoneID will be nil, otherwise used ZoneID
+	// public key and context.ZoneID will have value
+	acrastruct, err := acrawriter.CreateAcrastruct(context.Data, publicKey, context.ZoneID)
+	if err != nil {
+		base.APIEncryptionCounter.WithLabelValues(base.EncryptionTypeFail).Inc()
+		msg := "Unexpected error with AcraStruct generation"
+		logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCantEncryptData).Warningln(msg)
+		return nil, responseWithMessage(request, http.StatusBadRequest, msg)
+	}
+	base.APIEncryptionCounter.WithLabelValues(base.EncryptionTypeSuccess).Inc()
+	logger.Infoln("Encrypted data to AcraStruct")
+	return acrastruct, nil
+}
+
+// checkQuota returns response with 429 status if client exceeded its quota, otherwise nil
+// recordAuditEvent exports audit event of request processed with response
+func (decryptor *HTTPConnectionsDecryptor) recordAuditEvent(request *http.Request, clientID []byte, response *http.Response) {
+	if decryptor.TranslatorData.AuditExporter == nil || request == nil || request.URL == nil || response == nil {
+		return
+	}
+	var err error
+	if response.StatusCode != http.StatusOK {
+		err = errors.New(http.StatusText(response.StatusCode))
+	}
+	dataSize := 0
+	if request.ContentLength > 0 {
+		dataSize = int(request.ContentLength)
+	}
+	zoneID := []byte(request.URL.Query().Get("zone_id"))
+	decryptor.TranslatorData.AuditExporter.Record(audit.NewEvent(
+		path.Base(request.URL.Path), common.HTTPRequestType, clientID, zoneID, dataSize, err))
+}
+
+func (decryptor *HTTPConnectionsDecryptor) checkQuota(request *http.Request, clientID []byte, dataSize int, logger *log.Entry) *http.Response {
+	if err := decryptor.TranslatorData.QuotaManager.Allow(clientID, dataSize); err != nil {
+		logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorTranslatorQuotaExceeded).Warningln("Client exceeded quota")
+		return responseWithMessage(request, http.StatusTooManyRequests, err.Error())
+	}
+	return nil
+}
+
 func (decryptor *HTTPConnectionsDecryptor) decryptAcraStruct(logger *log.Entry, acraStruct []byte, zoneID []byte, clientID []byte) ([]byte, error) {
 	var err error
 	var privateKeys []*keys.PrivateKey
@@ -248,12 +359,14 @@ func (decryptor *HTTPConnectionsDecryptor) decryptAcraStruct(logger *log.Entry,
 
 	if err != nil {
 		logger.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCantReadKeys).Errorln("Can't load private key to decrypt AcraStruct")
+		base.LogKeyLookupFailure(logger, clientID, zoneID, err)
 		return nil, err
 	}
 
 	decryptedStruct, err := base.DecryptRotatedAcrastruct(acraStruct, privateKeys, decryptionContext)
 
 	if err != nil {
+		base.LogDecryptionFailure(logger, clientID, decryptionContext, acraStruct, privateKeys, err)
 		return nil, err
 	}
 
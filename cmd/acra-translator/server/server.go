@@ -48,6 +48,7 @@ type ReaderServer struct {
 	keystorage            keystore.TranslationKeyStore
 	connectionManager     *network.ConnectionManager
 	grpcServer            *grpc.Server
+	grpcGatewayServer     *http.Server
 	httpDecryptor         *http_api.HTTPConnectionsDecryptor
 	waitTimeout           time.Duration
 	grpcServerFactory     common.GRPCServerFactory
@@ -86,6 +87,16 @@ func (server *ReaderServer) Stop() {
 		}()
 	}
 
+	if server.grpcGatewayServer != nil {
+		server.backgroundWorkersSync.Add(1)
+		go func() {
+			defer server.backgroundWorkersSync.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), server.waitTimeout)
+			defer cancel()
+			server.grpcGatewayServer.Shutdown(ctx)
+		}()
+	}
+
 	if server.connectionManager.Counter != 0 {
 		log.Infof("Wait ending current connections (%v)", server.connectionManager.Counter)
 		// wait existing connections to end request
@@ -97,6 +108,9 @@ func (server *ReaderServer) Stop() {
 		// force stop of grpc server
 		server.grpcServer.Stop()
 	}
+	if server.grpcGatewayServer != nil {
+		server.grpcGatewayServer.Close()
+	}
 	// force close all connections
 	if err := server.connectionManager.CloseConnections(); err != nil {
 		log.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCantCloseConnection).WithError(err).Errorln("Took error on closing available connections")
@@ -211,7 +225,7 @@ func (server *ReaderServer) Start(parentContext context.Context) {
 	server.detectPoisonRecords(poisonCallbacks)
 	errCh := make(chan error)
 
-	decryptorData := &common.TranslatorData{Keystorage: server.keystorage, PoisonRecordCallbacks: poisonCallbacks, CheckPoisonRecords: server.config.DetectPoisonRecords()}
+	decryptorData := &common.TranslatorData{Keystorage: server.keystorage, PoisonRecordCallbacks: poisonCallbacks, CheckPoisonRecords: server.config.DetectPoisonRecords(), QuotaManager: server.config.QuotaManager(), PassEmptyValues: server.config.PassEmptyValues(), AuditExporter: server.config.AuditExporter(), TokenAuthenticator: server.config.TokenAuthenticator(), IdempotencyStore: server.config.IdempotencyStore()}
 	if server.config.IncomingConnectionHTTPString() != "" {
 		listener, err := network.Listen(server.config.IncomingConnectionHTTPString())
 		if err != nil {
@@ -282,10 +296,9 @@ func (server *ReaderServer) startGRPC(logger *log.Entry, decryptorData *common.T
 		defer server.backgroundWorkersSync.Done()
 		grpcLogger := logger.WithField(ConnectionTypeKey, GRPCConnectionType)
 		logger.WithField("connection_string", server.config.IncomingConnectionGRPCString()).Infof("Start process gRPC requests")
-		var err error
-		var opts []grpc.ServerOption
+		var transportCredentials credentials.TransportCredentials
 		if server.config.WithTLS() {
-			opts = append(opts, grpc.Creds(credentials.NewTLS(server.config.GetTLSConfig())))
+			transportCredentials = credentials.NewTLS(server.config.GetTLSConfig())
 		} else {
 			wrapper, err := network.NewSecureSessionConnectionWrapper(server.config.ServerID(), server.keystorage)
 			if err != nil {
@@ -293,12 +306,16 @@ func (server *ReaderServer) startGRPC(logger *log.Entry, decryptorData *common.T
 				errCh <- err
 				return
 			}
-			opts = append(opts, grpc.Creds(wrapper))
+			transportCredentials = wrapper
 		}
 
 		server.listenerGRPC = listener
 		grpcListener := common.WrapListenerWithMetrics(listener)
-		grpcServer, err := server.grpcServerFactory.New(decryptorData, opts...)
+		if server.config.GRPCGateway() {
+			server.serveGRPCWithGateway(grpcLogger, decryptorData, errCh, grpcListener, transportCredentials)
+			return
+		}
+		grpcServer, err := server.grpcServerFactory.New(decryptorData, grpc.Creds(transportCredentials))
 		if err != nil {
 			logger.WithError(err).Errorln("Can't create new gRPC server")
 			errCh <- err
@@ -314,6 +331,25 @@ func (server *ReaderServer) startGRPC(logger *log.Entry, decryptorData *common.T
 	}()
 }
 
+// serveGRPCWithGateway serves gRPC and REST/JSON transcoded API on the same listener. Connections are authenticated
+// with transportCredentials before they are passed to HTTP server.
+func (server *ReaderServer) serveGRPCWithGateway(logger *log.Entry, decryptorData *common.TranslatorData, errCh chan<- error, listener net.Listener, transportCredentials credentials.TransportCredentials) {
+	grpcServer, handler, err := server.grpcServerFactory.NewWithGateway(decryptorData)
+	if err != nil {
+		logger.WithError(err).Errorln("Can't create new gRPC server")
+		errCh <- err
+		return
+	}
+	server.grpcServer = grpcServer
+	server.grpcGatewayServer = &http.Server{Handler: handler, ReadHeaderTimeout: network.DefaultNetworkTimeout}
+	logger.Infoln("Serve REST/JSON transcoded gRPC API")
+	if err := server.grpcGatewayServer.Serve(common.NewHandshakeListener(listener, transportCredentials)); err != nil && err != http.ErrServerClosed {
+		logger.Errorf("failed to serve: %v", err)
+		server.Stop()
+		errCh <- err
+	}
+}
+
 func (server *ReaderServer) detectPoisonRecords(poisonCallbackStorage *base.PoisonCallbackStorage) {
 	if server.config.DetectPoisonRecords() {
 		if server.config.ScriptOnPoison() != "" {
@@ -348,7 +384,7 @@ func (server *ReaderServer) StartFromFileDescriptor(parentContext context.Contex
 	server.detectPoisonRecords(poisonCallbacks)
 	errCh := make(chan error)
 
-	decryptorData := &common.TranslatorData{Keystorage: server.keystorage, PoisonRecordCallbacks: poisonCallbacks, CheckPoisonRecords: server.config.DetectPoisonRecords()}
+	decryptorData := &common.TranslatorData{Keystorage: server.keystorage, PoisonRecordCallbacks: poisonCallbacks, CheckPoisonRecords: server.config.DetectPoisonRecords(), QuotaManager: server.config.QuotaManager(), PassEmptyValues: server.config.PassEmptyValues(), AuditExporter: server.config.AuditExporter(), TokenAuthenticator: server.config.TokenAuthenticator(), IdempotencyStore: server.config.IdempotencyStore()}
 	if server.config.IncomingConnectionHTTPString() != "" {
 		// create HTTP listener from correspondent file descriptor
 		file := os.NewFile(fdHTTP, httpFilenamePlaceholder)
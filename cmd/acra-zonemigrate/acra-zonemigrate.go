@@ -0,0 +1,303 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package main is entry point for AcraZoneMigrate utility. AcraZoneMigrate reorganizes zones of data stored in
+// database: merge re-encrypts all rows of source zone with key of target zone, split re-encrypts rows of source zone
+// matched by SQL predicate with key of new or existing zone. Rows are migrated in batches, progress is saved to
+// checkpoint file after every batch, so interrupted migration continues from the last committed batch.
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/cossacklabs/acra/cmd"
+	"github.com/cossacklabs/acra/keystore"
+	"github.com/cossacklabs/acra/keystore/filesystem"
+	keystoreV2 "github.com/cossacklabs/acra/keystore/v2/keystore"
+	filesystemV2 "github.com/cossacklabs/acra/keystore/v2/keystore/filesystem"
+	"github.com/cossacklabs/acra/logging"
+	"github.com/cossacklabs/acra/utils"
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+)
+
+// Constants used by AcraZoneMigrate
+var (
+	// defaultConfigPath relative path to config which will be parsed as default
+	defaultConfigPath = utils.GetConfigPathByName("acra-zonemigrate")
+	serviceName       = "acra-zonemigrate"
+)
+
+// zoneKeyStore provides keys of source and target zones and creates zone for split
+type zoneKeyStore interface {
+	keystore.StorageKeyCreation
+	keystore.PrivateKeyStore
+	keystore.PublicKeyStore
+}
+
+func openKeyStoreV1(dirPath string) zoneKeyStore {
+	scellEncryptor, err := keystore.EnvironmentMasterKeyProvider{}.KeyEncryptor()
+	if err != nil {
+		log.WithError(err).Errorln("Cannot load master key")
+		os.Exit(1)
+	}
+	keystorage, err := filesystem.NewFilesystemKeyStore(dirPath, scellEncryptor)
+	if err != nil {
+		log.WithError(err).Errorln("Can't initialize keystore")
+		os.Exit(1)
+	}
+	return keystorage
+}
+
+func openKeyStoreV2(keyDirPath string) zoneKeyStore {
+	encryption, signature, err := keystoreV2.GetMasterKeysFromEnvironment()
+	if err != nil {
+		log.WithError(err).Errorln("Cannot load master key")
+		os.Exit(1)
+	}
+	suite, err := keystoreV2.NewSCellSuite(encryption, signature)
+	if err != nil {
+		log.WithError(err).Error("Failed to initialize Secure Cell crypto suite")
+		os.Exit(1)
+	}
+	keyDir, err := filesystemV2.OpenDirectoryRW(keyDirPath, suite)
+	if err != nil {
+		log.WithError(err).WithField("path", keyDirPath).Error("Cannot open key directory")
+		os.Exit(1)
+	}
+	return keystoreV2.NewServerKeyStore(keyDir)
+}
+
+// summary is printed to stdout after migration
+type summary struct {
+	Mode                string `json:"mode"`
+	Table               string `json:"table"`
+	SourceZone          string `json:"source_zone"`
+	TargetZone          string `json:"target_zone"`
+	TargetZonePublicKey []byte `json:"target_zone_public_key,omitempty"`
+	Rows                int64  `json:"rows"`
+	DryRun              bool   `json:"dry_run"`
+}
+
+func main() {
+	connectionString := flag.String("connection_string", "", "Connection string for db")
+	useMysql := flag.Bool("mysql_enable", false, "Handle MySQL connections")
+	usePostgresql := flag.Bool("postgresql_enable", false, "Handle Postgresql connections")
+	keysDir := flag.String("keys_dir", keystore.DefaultKeyDirShort, "Folder from which the keys will be loaded")
+	mode := flag.String("mode", ModeMerge, "Mode of migration: 'merge' re-encrypts all rows of source zone with key of target zone, 'split' re-encrypts rows matched by predicate with key of new zone")
+	sourceZone := flag.String("source_zone", "", "Zone ID of data to migrate")
+	targetZone := flag.String("target_zone", "", "Zone ID to migrate data to. Required for merge, for split new zone is generated if empty")
+	table := flag.String("table", "", "Table with encrypted data")
+	idColumn := flag.String("id_column", "id", "Unique column used to order rows and split them into batches")
+	columns := flag.String("columns", "", "Comma separated list of columns with AcraStructs")
+	zoneColumn := flag.String("zone_column", "", "Column with zone ID of row. If set, only rows of source zone are migrated and column is updated to target zone")
+	where := flag.String("where", "", "SQL predicate of rows moved to new zone by split")
+	batchSize := flag.Int("batch_size", DefaultBatchSize, "Count of rows migrated in one transaction")
+	checkpointFile := flag.String("checkpoint_file", "", "Path to file with progress of migration, migration continues from it if file exists")
+	dryRun := flag.Bool("dry_run", false, "Only decrypt and count rows to migrate without updating them and generating zone")
+	debug := flag.Bool("d", false, "Log everything to stderr")
+
+	err := cmd.Parse(defaultConfigPath, serviceName)
+	if err != nil {
+		log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCantReadServiceConfig).
+			Errorln("Can't parse args")
+		os.Exit(1)
+	}
+	if *debug {
+		logging.SetLogLevel(logging.LogDebug)
+	} else {
+		logging.SetLogLevel(logging.LogVerbose)
+	}
+
+	if *useMysql == *usePostgresql {
+		log.Errorln("You must pass only --mysql_enable or --postgresql_enable (one required)")
+		os.Exit(1)
+	}
+	dbDriverName := "postgres"
+	dialect := PostgreSQLDialect
+	if *useMysql {
+		dbDriverName = "mysql"
+		dialect = MySQLDialect
+	}
+	if *connectionString == "" {
+		log.Errorln("Connection_string arg is missing")
+		os.Exit(1)
+	}
+	migrationTable := &Table{
+		Name:       *table,
+		IDColumn:   *idColumn,
+		ZoneColumn: *zoneColumn,
+		Where:      *where,
+	}
+	for _, column := range strings.Split(*columns, ",") {
+		if column = strings.TrimSpace(column); column != "" {
+			migrationTable.Columns = append(migrationTable.Columns, column)
+		}
+	}
+	if err := migrationTable.Validate(*mode); err != nil {
+		log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+			Errorln("Invalid migration parameters")
+		os.Exit(1)
+	}
+	if *sourceZone == "" {
+		log.Errorln("Source_zone arg is missing")
+		os.Exit(1)
+	}
+	if *mode == ModeMerge && *targetZone == "" {
+		log.Errorln("Target_zone arg is required for merge")
+		os.Exit(1)
+	}
+	if *targetZone == *sourceZone {
+		log.Errorln("Target_zone should differ from source_zone")
+		os.Exit(1)
+	}
+	if *batchSize <= 0 {
+		log.Errorln("Batch_size should be greater than 0")
+		os.Exit(1)
+	}
+	if *checkpointFile == "" && !*dryRun {
+		log.Errorln("Checkpoint_file arg is missing")
+		os.Exit(1)
+	}
+
+	var keyStore zoneKeyStore
+	if filesystemV2.IsKeyDirectory(*keysDir) {
+		keyStore = openKeyStoreV2(*keysDir)
+	} else {
+		keyStore = openKeyStoreV1(*keysDir)
+	}
+
+	checkpoint := &Checkpoint{Mode: *mode, Table: *table, SourceZone: *sourceZone, TargetZone: *targetZone}
+	if *checkpointFile != "" {
+		saved, err := LoadCheckpoint(*checkpointFile)
+		if err != nil {
+			log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorZoneMigration).
+				Errorln("Can't load checkpoint")
+			os.Exit(1)
+		}
+		if saved != nil {
+			if err := saved.Matches(*mode, *table, *sourceZone, *targetZone); err != nil {
+				log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorZoneMigration).
+					Errorln("Can't continue migration from checkpoint")
+				os.Exit(1)
+			}
+			checkpoint = saved
+			log.WithFields(log.Fields{"last_id": checkpoint.LastID, "rows": checkpoint.Rows}).Infoln("Continue migration from checkpoint")
+		}
+	}
+	result := summary{Mode: *mode, Table: *table, SourceZone: *sourceZone, DryRun: *dryRun}
+	if checkpoint.Finished {
+		log.Infoln("Migration already finished")
+		result.TargetZone = checkpoint.TargetZone
+		result.Rows = checkpoint.Rows
+		printSummary(&result)
+		return
+	}
+
+	if checkpoint.TargetZone == "" && !*dryRun {
+		zoneID, publicKey, err := keyStore.GenerateZoneKey()
+		if err != nil {
+			log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorZoneMigration).
+				Errorln("Can't generate zone")
+			os.Exit(1)
+		}
+		checkpoint.TargetZone = string(zoneID)
+		result.TargetZonePublicKey = publicKey
+		// save zone before the first batch, so resumed migration uses the same zone
+		if err := checkpoint.Save(*checkpointFile); err != nil {
+			log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorZoneMigration).
+				WithField("zone_id", checkpoint.TargetZone).Errorln("Can't save checkpoint with generated zone")
+			os.Exit(1)
+		}
+		log.WithField("zone_id", checkpoint.TargetZone).Infoln("Generated new zone")
+	}
+
+	reencryptor, err := newReencryptor(keyStore, checkpoint, *dryRun)
+	if err != nil {
+		log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorZoneMigration).
+			Errorln("Can't load zone keys")
+		os.Exit(1)
+	}
+	defer reencryptor.Close()
+
+	db, err := sql.Open(dbDriverName, *connectionString)
+	if err != nil {
+		log.WithError(err).Errorln("Can't connect to db")
+		os.Exit(1)
+	}
+	defer db.Close()
+	if err := db.Ping(); err != nil {
+		log.WithError(err).Errorln("Can't connect to db")
+		os.Exit(1)
+	}
+	if *dryRun {
+		log.Infoln("Dry run mode, rows will be only decrypted and counted")
+	}
+
+	migration := NewMigration(db, dialect, migrationTable, reencryptor, *batchSize, checkpoint, *checkpointFile, *dryRun)
+	if err := migration.Run(); err != nil {
+		// error already logged by migration, os.Exit skips deferred calls
+		reencryptor.Close()
+		db.Close()
+		os.Exit(1)
+	}
+	result.TargetZone = checkpoint.TargetZone
+	result.Rows = checkpoint.Rows
+	printSummary(&result)
+}
+
+// newReencryptor loads keys of source and target zones. Target zone may be empty only in dry run of split.
+func newReencryptor(keyStore zoneKeyStore, checkpoint *Checkpoint, dryRun bool) (*ZoneReencryptor, error) {
+	sourceZone := []byte(checkpoint.SourceZone)
+	sourceKeys, err := keyStore.GetZonePrivateKeys(sourceZone)
+	if err != nil {
+		return nil, fmt.Errorf("source zone %s: %w", checkpoint.SourceZone, err)
+	}
+	if checkpoint.TargetZone == "" {
+		return NewZoneReencryptor(sourceZone, sourceKeys, nil, nil, nil), nil
+	}
+	targetZone := []byte(checkpoint.TargetZone)
+	targetKeys, err := keyStore.GetZonePrivateKeys(targetZone)
+	if err != nil {
+		utils.ZeroizePrivateKeys(sourceKeys)
+		return nil, fmt.Errorf("target zone %s: %w", checkpoint.TargetZone, err)
+	}
+	if dryRun {
+		return NewZoneReencryptor(sourceZone, sourceKeys, targetZone, targetKeys, nil), nil
+	}
+	targetPublic, err := keyStore.GetZonePublicKey(targetZone)
+	if err != nil {
+		utils.ZeroizePrivateKeys(sourceKeys)
+		utils.ZeroizePrivateKeys(targetKeys)
+		return nil, fmt.Errorf("target zone %s: %w", checkpoint.TargetZone, err)
+	}
+	return NewZoneReencryptor(sourceZone, sourceKeys, targetZone, targetKeys, targetPublic), nil
+}
+
+func printSummary(result *summary) {
+	output, err := json.Marshal(result)
+	if err != nil {
+		log.WithError(err).Errorln("Can't encode summary")
+		os.Exit(1)
+	}
+	fmt.Println(string(output))
+}
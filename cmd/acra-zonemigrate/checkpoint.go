@@ -0,0 +1,83 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// ErrCheckpointMismatch returned when checkpoint file was written by migration with other parameters
+var ErrCheckpointMismatch = errors.New("checkpoint belongs to another migration")
+
+// Checkpoint stores progress of migration, it's saved after every committed batch so interrupted migration continues
+// after the last processed row. Zone generated by split is saved too, so resumed migration uses the same zone.
+type Checkpoint struct {
+	Mode       string `json:"mode"`
+	Table      string `json:"table"`
+	SourceZone string `json:"source_zone"`
+	TargetZone string `json:"target_zone"`
+	// LastID is value of id column of the last migrated row, empty if no batches were committed
+	LastID   string `json:"last_id,omitempty"`
+	Rows     int64  `json:"rows"`
+	Finished bool   `json:"finished"`
+}
+
+// LoadCheckpoint reads checkpoint from path, returns nil without error if file doesn't exist
+func LoadCheckpoint(path string) (*Checkpoint, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	checkpoint := &Checkpoint{}
+	if err := json.Unmarshal(data, checkpoint); err != nil {
+		return nil, err
+	}
+	return checkpoint, nil
+}
+
+// Save writes checkpoint to temporary file and renames it to path, so checkpoint isn't corrupted if process is killed
+// during write
+func (checkpoint *Checkpoint) Save(path string) error {
+	data, err := json.Marshal(checkpoint)
+	if err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// Matches returns ErrCheckpointMismatch if checkpoint was saved by migration with other mode, table or zones.
+// Empty targetZone matches zone generated by split.
+func (checkpoint *Checkpoint) Matches(mode, table, sourceZone, targetZone string) error {
+	if checkpoint.Mode != mode || checkpoint.Table != table || checkpoint.SourceZone != sourceZone {
+		return fmt.Errorf("%w: %s of %s from zone %s", ErrCheckpointMismatch, checkpoint.Mode, checkpoint.Table, checkpoint.SourceZone)
+	}
+	if targetZone != "" && checkpoint.TargetZone != targetZone {
+		return fmt.Errorf("%w: target zone %s", ErrCheckpointMismatch, checkpoint.TargetZone)
+	}
+	return nil
+}
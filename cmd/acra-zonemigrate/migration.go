@@ -0,0 +1,363 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	acrawriter "github.com/cossacklabs/acra/acra-writer"
+	"github.com/cossacklabs/acra/decryptor/base"
+	"github.com/cossacklabs/acra/logging"
+	"github.com/cossacklabs/acra/utils"
+	"github.com/cossacklabs/acra/utils/sqlidentifier"
+	"github.com/cossacklabs/themis/gothemis/keys"
+	log "github.com/sirupsen/logrus"
+)
+
+// Modes of migration
+const (
+	// ModeMerge re-encrypts all rows of source zone with key of existing target zone
+	ModeMerge = "merge"
+	// ModeSplit re-encrypts rows of source zone matched by predicate with key of new zone
+	ModeSplit = "split"
+)
+
+// DefaultBatchSize is count of rows migrated in one transaction
+const DefaultBatchSize = 1000
+
+// ErrInvalidMigration returned for invalid parameters of migration
+var ErrInvalidMigration = errors.New("invalid zone migration")
+
+// Dialect generates database specific SQL of migration
+type Dialect struct {
+	quote sqlidentifier.Quote
+	// numberedPlaceholders is true if placeholders have position of parameter, like $1
+	numberedPlaceholders bool
+}
+
+// Supported dialects
+var (
+	PostgreSQLDialect = Dialect{quote: sqlidentifier.PostgreSQLQuote, numberedPlaceholders: true}
+	MySQLDialect      = Dialect{quote: sqlidentifier.MySQLQuote}
+)
+
+// placeholder returns placeholder of parameter with position starting from 1
+func (dialect Dialect) placeholder(position int) string {
+	if dialect.numberedPlaceholders {
+		return "$" + strconv.Itoa(position)
+	}
+	return "?"
+}
+
+// Table describes rows and encrypted columns to migrate. Rows are read in batches ordered by IDColumn which should be
+// unique. If ZoneColumn is set then only rows with source zone in it are migrated and it's updated to target zone.
+// Where is SQL predicate inserted into queries as is.
+type Table struct {
+	Name       string
+	IDColumn   string
+	Columns    []string
+	ZoneColumn string
+	Where      string
+}
+
+// Validate checks identifiers of table and that split has predicate
+func (table *Table) Validate(mode string) error {
+	switch mode {
+	case ModeMerge:
+	case ModeSplit:
+		if table.Where == "" {
+			return fmt.Errorf("%w: split requires predicate of rows moved to new zone", ErrInvalidMigration)
+		}
+	default:
+		return fmt.Errorf("%w: unknown mode '%s', expected '%s' or '%s'", ErrInvalidMigration, mode, ModeMerge, ModeSplit)
+	}
+	if !sqlidentifier.IsValid(table.Name) {
+		return fmt.Errorf("%w: invalid table name '%s'", ErrInvalidMigration, table.Name)
+	}
+	if len(table.Columns) == 0 {
+		return fmt.Errorf("%w: no columns to re-encrypt", ErrInvalidMigration)
+	}
+	columns := append([]string{table.IDColumn}, table.Columns...)
+	if table.ZoneColumn != "" {
+		columns = append(columns, table.ZoneColumn)
+	}
+	seen := make(map[string]bool, len(columns))
+	for _, column := range columns {
+		if !sqlidentifier.IsValidColumn(column) || seen[column] {
+			return fmt.Errorf("%w: invalid or duplicated column '%s'", ErrInvalidMigration, column)
+		}
+		seen[column] = true
+	}
+	return nil
+}
+
+// SelectQuery returns query of next batch. Parameters are source zone if table has ZoneColumn and id of the last
+// migrated row if resume is true.
+func (dialect Dialect) SelectQuery(table *Table, resume bool, batchSize int) string {
+	columns := []string{dialect.quote.Identifier(table.IDColumn)}
+	for _, column := range table.Columns {
+		columns = append(columns, dialect.quote.Identifier(column))
+	}
+	var conditions []string
+	position := 1
+	if table.ZoneColumn != "" {
+		conditions = append(conditions, dialect.quote.Identifier(table.ZoneColumn)+" = "+dialect.placeholder(position))
+		position++
+	}
+	if table.Where != "" {
+		conditions = append(conditions, "("+table.Where+")")
+	}
+	if resume {
+		conditions = append(conditions, dialect.quote.Identifier(table.IDColumn)+" > "+dialect.placeholder(position))
+	}
+	query := "SELECT " + strings.Join(columns, ", ") + " FROM " + dialect.quote.Identifier(table.Name)
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	return query + " ORDER BY " + dialect.quote.Identifier(table.IDColumn) + " LIMIT " + strconv.Itoa(batchSize)
+}
+
+// UpdateQuery returns query which updates one row. Parameters are new values of columns, target zone if table has
+// ZoneColumn and id of row.
+func (dialect Dialect) UpdateQuery(table *Table) string {
+	columns := table.Columns
+	if table.ZoneColumn != "" {
+		columns = append(columns[:len(columns):len(columns)], table.ZoneColumn)
+	}
+	assignments := make([]string, 0, len(columns))
+	for i, column := range columns {
+		assignments = append(assignments, dialect.quote.Identifier(column)+" = "+dialect.placeholder(i+1))
+	}
+	return "UPDATE " + dialect.quote.Identifier(table.Name) + " SET " + strings.Join(assignments, ", ") +
+		" WHERE " + dialect.quote.Identifier(table.IDColumn) + " = " + dialect.placeholder(len(columns)+1)
+}
+
+// ZoneReencryptor re-encrypts AcraStructs of source zone with public key of target zone
+type ZoneReencryptor struct {
+	sourceZone   []byte
+	sourceKeys   []*keys.PrivateKey
+	targetZone   []byte
+	targetKeys   []*keys.PrivateKey
+	targetPublic *keys.PublicKey
+}
+
+// NewZoneReencryptor returns ZoneReencryptor. Private keys of target zone are used to recognize AcraStructs which are
+// already migrated. If targetPublic is nil then AcraStructs are only decrypted to check them.
+func NewZoneReencryptor(sourceZone []byte, sourceKeys []*keys.PrivateKey, targetZone []byte, targetKeys []*keys.PrivateKey, targetPublic *keys.PublicKey) *ZoneReencryptor {
+	return &ZoneReencryptor{sourceZone: sourceZone, sourceKeys: sourceKeys, targetZone: targetZone, targetKeys: targetKeys, targetPublic: targetPublic}
+}
+
+// Reencrypt returns AcraStruct decrypted with key of source zone and encrypted with key of target zone. AcraStructs
+// of target zone, e.g. from batch committed before checkpoint was saved, are returned as is.
+func (reencryptor *ZoneReencryptor) Reencrypt(acrastruct []byte) ([]byte, error) {
+	decrypted, err := base.DecryptRotatedAcrastruct(acrastruct, reencryptor.sourceKeys, reencryptor.sourceZone)
+	if err != nil {
+		if len(reencryptor.targetKeys) > 0 {
+			if migrated, targetErr := base.DecryptRotatedAcrastruct(acrastruct, reencryptor.targetKeys, reencryptor.targetZone); targetErr == nil {
+				utils.ZeroizeBytes(migrated)
+				return acrastruct, nil
+			}
+		}
+		return nil, err
+	}
+	defer utils.ZeroizeBytes(decrypted)
+	if reencryptor.targetPublic == nil {
+		return acrastruct, nil
+	}
+	return acrawriter.CreateAcrastruct(decrypted, reencryptor.targetPublic, reencryptor.targetZone)
+}
+
+// Close zeroizes private keys
+func (reencryptor *ZoneReencryptor) Close() {
+	utils.ZeroizePrivateKeys(reencryptor.sourceKeys)
+	utils.ZeroizePrivateKeys(reencryptor.targetKeys)
+}
+
+// Migration re-encrypts rows of table in batches, every batch is updated in one transaction and saved to checkpoint
+// after commit. In dry run mode AcraStructs are only decrypted and checkpoint isn't saved.
+type Migration struct {
+	db             *sql.DB
+	dialect        Dialect
+	table          *Table
+	reencryptor    *ZoneReencryptor
+	batchSize      int
+	dryRun         bool
+	checkpoint     *Checkpoint
+	checkpointPath string
+}
+
+// NewMigration returns Migration which continues from checkpoint
+func NewMigration(db *sql.DB, dialect Dialect, table *Table, reencryptor *ZoneReencryptor, batchSize int, checkpoint *Checkpoint, checkpointPath string, dryRun bool) *Migration {
+	return &Migration{
+		db:             db,
+		dialect:        dialect,
+		table:          table,
+		reencryptor:    reencryptor,
+		batchSize:      batchSize,
+		dryRun:         dryRun,
+		checkpoint:     checkpoint,
+		checkpointPath: checkpointPath,
+	}
+}
+
+// Run migrates batches until all rows are processed
+func (migration *Migration) Run() error {
+	for {
+		count, err := migration.runBatch()
+		if err != nil {
+			return err
+		}
+		if count < migration.batchSize {
+			break
+		}
+	}
+	migration.checkpoint.Finished = true
+	return migration.saveCheckpoint()
+}
+
+func (migration *Migration) saveCheckpoint() error {
+	if migration.dryRun {
+		return nil
+	}
+	if err := migration.checkpoint.Save(migration.checkpointPath); err != nil {
+		log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorZoneMigration).
+			WithField("checkpoint_file", migration.checkpointPath).Errorln("Can't save checkpoint")
+		return err
+	}
+	return nil
+}
+
+// batchRow is id of row and values of encrypted columns
+type batchRow struct {
+	id     interface{}
+	values []interface{}
+}
+
+// readBatch returns rows of next batch
+func (migration *Migration) readBatch() ([]batchRow, error) {
+	var args []interface{}
+	if migration.table.ZoneColumn != "" {
+		args = append(args, migration.checkpoint.SourceZone)
+	}
+	resume := migration.checkpoint.LastID != ""
+	if resume {
+		args = append(args, migration.checkpoint.LastID)
+	}
+	rows, err := migration.db.Query(migration.dialect.SelectQuery(migration.table, resume, migration.batchSize), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var batch []batchRow
+	for rows.Next() {
+		row := batchRow{values: make([]interface{}, len(migration.table.Columns))}
+		pointers := []interface{}{&row.id}
+		for i := range row.values {
+			pointers = append(pointers, &row.values[i])
+		}
+		if err := rows.Scan(pointers...); err != nil {
+			return nil, err
+		}
+		batch = append(batch, row)
+	}
+	return batch, rows.Err()
+}
+
+// runBatch migrates next batch and returns count of read rows
+func (migration *Migration) runBatch() (int, error) {
+	logger := log.WithFields(log.Fields{"table": migration.table.Name, "last_id": migration.checkpoint.LastID})
+	batch, err := migration.readBatch()
+	if err != nil {
+		logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorZoneMigration).Errorln("Can't read batch of rows")
+		return 0, err
+	}
+	if len(batch) == 0 {
+		return 0, nil
+	}
+	updates := make([][]interface{}, 0, len(batch))
+	for _, row := range batch {
+		args := make([]interface{}, 0, len(row.values)+2)
+		for i, value := range row.values {
+			newValue, err := migration.reencryptValue(value)
+			if err != nil {
+				logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorZoneMigration).
+					WithFields(log.Fields{"id": idToString(row.id), "column": migration.table.Columns[i]}).Errorln("Can't re-encrypt value")
+				return 0, err
+			}
+			args = append(args, newValue)
+		}
+		if migration.table.ZoneColumn != "" {
+			args = append(args, migration.checkpoint.TargetZone)
+		}
+		updates = append(updates, append(args, row.id))
+	}
+	if !migration.dryRun {
+		if err := migration.update(updates); err != nil {
+			logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorZoneMigration).Errorln("Can't update batch of rows")
+			return 0, err
+		}
+	}
+	migration.checkpoint.LastID = idToString(batch[len(batch)-1].id)
+	migration.checkpoint.Rows += int64(len(batch))
+	if err := migration.saveCheckpoint(); err != nil {
+		return 0, err
+	}
+	logger.WithFields(log.Fields{"rows": len(batch), "total_rows": migration.checkpoint.Rows}).Infoln("Batch migrated")
+	return len(batch), nil
+}
+
+// update executes updates of batch in one transaction
+func (migration *Migration) update(updates [][]interface{}) error {
+	tx, err := migration.db.Begin()
+	if err != nil {
+		return err
+	}
+	query := migration.dialect.UpdateQuery(migration.table)
+	for _, args := range updates {
+		if _, err := tx.Exec(query, args...); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// reencryptValue re-encrypts value of column, NULL values are kept
+func (migration *Migration) reencryptValue(value interface{}) (interface{}, error) {
+	switch typed := value.(type) {
+	case nil:
+		return nil, nil
+	case []byte:
+		return migration.reencryptor.Reencrypt(typed)
+	case string:
+		return migration.reencryptor.Reencrypt([]byte(typed))
+	}
+	return nil, fmt.Errorf("encrypted column has incorrect type (bytes expected, took %s)", reflect.TypeOf(value))
+}
+
+// idToString converts value of id column to string saved in checkpoint and passed to queries as parameter
+func idToString(id interface{}) string {
+	if value, ok := id.([]byte); ok {
+		return string(value)
+	}
+	return fmt.Sprint(id)
+}
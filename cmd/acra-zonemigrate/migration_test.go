@@ -0,0 +1,185 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	acrawriter "github.com/cossacklabs/acra/acra-writer"
+	"github.com/cossacklabs/acra/decryptor/base"
+	"github.com/cossacklabs/themis/gothemis/keys"
+)
+
+func TestTableValidate(t *testing.T) {
+	valid := Table{Name: "public.users", IDColumn: "id", Columns: []string{"email", "phone"}, ZoneColumn: "zone_id"}
+	if err := valid.Validate(ModeMerge); err != nil {
+		t.Fatal(err)
+	}
+	split := valid
+	split.Where = "tenant_id = 2"
+	if err := split.Validate(ModeSplit); err != nil {
+		t.Fatal(err)
+	}
+	invalid := []struct {
+		mode  string
+		table Table
+	}{
+		{ModeSplit, valid},
+		{"move", valid},
+		{ModeMerge, Table{Name: "users; DROP TABLE users", IDColumn: "id", Columns: []string{"email"}}},
+		{ModeMerge, Table{Name: "users", IDColumn: "id"}},
+		{ModeMerge, Table{Name: "users", IDColumn: "users.id", Columns: []string{"email"}}},
+		{ModeMerge, Table{Name: "users", IDColumn: "id", Columns: []string{"email", "email"}}},
+		{ModeMerge, Table{Name: "users", IDColumn: "id", Columns: []string{"email"}, ZoneColumn: "id"}},
+	}
+	for i, testcase := range invalid {
+		if err := testcase.table.Validate(testcase.mode); !errors.Is(err, ErrInvalidMigration) {
+			t.Fatalf("[%d] Expected ErrInvalidMigration, took %v", i, err)
+		}
+	}
+}
+
+func TestDialectQueries(t *testing.T) {
+	zoneTable := &Table{Name: "public.users", IDColumn: "id", Columns: []string{"email", "phone"}, ZoneColumn: "zone_id", Where: "tenant_id = 2"}
+	plainTable := &Table{Name: "users", IDColumn: "id", Columns: []string{"email"}}
+	testcases := []struct {
+		dialect Dialect
+		table   *Table
+		resume  bool
+		query   string
+		update  string
+	}{
+		{PostgreSQLDialect, zoneTable, true,
+			`SELECT "id", "email", "phone" FROM "public"."users" WHERE "zone_id" = $1 AND (tenant_id = 2) AND "id" > $2 ORDER BY "id" LIMIT 10`,
+			`UPDATE "public"."users" SET "email" = $1, "phone" = $2, "zone_id" = $3 WHERE "id" = $4`},
+		{PostgreSQLDialect, plainTable, false,
+			`SELECT "id", "email" FROM "users" ORDER BY "id" LIMIT 10`,
+			`UPDATE "users" SET "email" = $1 WHERE "id" = $2`},
+		{MySQLDialect, zoneTable, false,
+			"SELECT `id`, `email`, `phone` FROM `public`.`users` WHERE `zone_id` = ? AND (tenant_id = 2) ORDER BY `id` LIMIT 10",
+			"UPDATE `public`.`users` SET `email` = ?, `phone` = ?, `zone_id` = ? WHERE `id` = ?"},
+		{MySQLDialect, plainTable, true,
+			"SELECT `id`, `email` FROM `users` WHERE `id` > ? ORDER BY `id` LIMIT 10",
+			"UPDATE `users` SET `email` = ? WHERE `id` = ?"},
+	}
+	for i, testcase := range testcases {
+		if query := testcase.dialect.SelectQuery(testcase.table, testcase.resume, 10); query != testcase.query {
+			t.Fatalf("[%d] Incorrect select query: %s", i, query)
+		}
+		if query := testcase.dialect.UpdateQuery(testcase.table); query != testcase.update {
+			t.Fatalf("[%d] Incorrect update query: %s", i, query)
+		}
+	}
+	if len(zoneTable.Columns) != 2 {
+		t.Fatal("UpdateQuery changed columns of table")
+	}
+}
+
+func TestCheckpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "checkpoint.json")
+	checkpoint, err := LoadCheckpoint(path)
+	if err != nil || checkpoint != nil {
+		t.Fatalf("Expected no checkpoint, took %v %v", checkpoint, err)
+	}
+	saved := &Checkpoint{Mode: ModeSplit, Table: "users", SourceZone: "source", TargetZone: "generated", LastID: "42", Rows: 42}
+	if err := saved.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	checkpoint, err = LoadCheckpoint(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *checkpoint != *saved {
+		t.Fatalf("Loaded checkpoint %v differs from saved %v", checkpoint, saved)
+	}
+	if err := checkpoint.Matches(ModeSplit, "users", "source", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkpoint.Matches(ModeSplit, "users", "source", "generated"); err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][4]string{
+		{ModeMerge, "users", "source", ""},
+		{ModeSplit, "orders", "source", ""},
+		{ModeSplit, "users", "other", ""},
+		{ModeSplit, "users", "source", "other"},
+	} {
+		if err := checkpoint.Matches(args[0], args[1], args[2], args[3]); !errors.Is(err, ErrCheckpointMismatch) {
+			t.Fatalf("Expected ErrCheckpointMismatch for %v, took %v", args, err)
+		}
+	}
+}
+
+func TestZoneReencryptor(t *testing.T) {
+	sourceKeypair, err := keys.New(keys.TypeEC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	targetKeypair, err := keys.New(keys.TypeEC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sourceZone, targetZone := []byte("source zone"), []byte("target zone")
+	data := []byte("some data")
+	acrastruct, err := acrawriter.CreateAcrastruct(data, sourceKeypair.Public, sourceZone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reencryptor := NewZoneReencryptor(sourceZone, []*keys.PrivateKey{sourceKeypair.Private}, targetZone,
+		[]*keys.PrivateKey{targetKeypair.Private}, targetKeypair.Public)
+	migrated, err := reencryptor.Reencrypt(acrastruct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decrypted, err := base.DecryptAcrastruct(migrated, targetKeypair.Private, targetZone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decrypted, data) {
+		t.Fatal("Re-encrypted AcraStruct contains other data")
+	}
+	// AcraStruct of target zone is kept when migration continues after uncommitted checkpoint
+	again, err := reencryptor.Reencrypt(migrated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(again, migrated) {
+		t.Fatal("Migrated AcraStruct re-encrypted again")
+	}
+	if _, err := reencryptor.Reencrypt([]byte("not acrastruct")); err == nil {
+		t.Fatal("Expected error for invalid AcraStruct")
+	}
+
+	dryRun := NewZoneReencryptor(sourceZone, []*keys.PrivateKey{sourceKeypair.Private}, nil, nil, nil)
+	checked, err := dryRun.Reencrypt(acrastruct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(checked, acrastruct) {
+		t.Fatal("AcraStruct changed in dry run")
+	}
+}
@@ -0,0 +1,220 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	flag_ "flag"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cossacklabs/acra/utils"
+)
+
+// Shells supported by GenerateCompletionFromFlagSets
+const (
+	CompletionBash = "bash"
+	CompletionZsh  = "zsh"
+	CompletionFish = "fish"
+)
+
+// ErrUnsupportedShell returned for shell without completion script
+var ErrUnsupportedShell = errors.New("unsupported shell for completion")
+
+// jsonSchemaDraft is version of JSON Schema used by GenerateFlagsSchemaFromFlagSets
+const jsonSchemaDraft = "http://json-schema.org/draft-07/schema#"
+
+// flagSchema describes one flag as property of JSON Schema
+type flagSchema struct {
+	Type        string      `json:"type"`
+	Description string      `json:"description,omitempty"`
+	Default     interface{} `json:"default,omitempty"`
+	Format      string      `json:"format,omitempty"`
+}
+
+// flagsSchema is JSON Schema of YAML config, keys of config are names of flags
+type flagsSchema struct {
+	Schema               string                 `json:"$schema"`
+	Title                string                 `json:"title"`
+	Type                 string                 `json:"type"`
+	Properties           map[string]*flagSchema `json:"properties"`
+	AdditionalProperties bool                   `json:"additionalProperties"`
+}
+
+// newFlagSchema returns schema of flag's value with type taken from flag.Value and default parsed from flag.DefValue,
+// because value of flag may be already overridden by command line or config
+func newFlagSchema(flag *flag_.Flag) *flagSchema {
+	schema := &flagSchema{Type: "string", Description: flag.Usage}
+	if flag.DefValue != "" {
+		schema.Default = flag.DefValue
+	}
+	getter, ok := flag.Value.(flag_.Getter)
+	if !ok {
+		return schema
+	}
+	switch getter.Get().(type) {
+	case bool:
+		schema.Type = "boolean"
+		if value, err := strconv.ParseBool(flag.DefValue); err == nil {
+			schema.Default = value
+		}
+	case int, int64, uint, uint64:
+		schema.Type = "integer"
+		if value, err := strconv.ParseInt(flag.DefValue, 0, 64); err == nil {
+			schema.Default = value
+		}
+	case float64:
+		schema.Type = "number"
+		if value, err := strconv.ParseFloat(flag.DefValue, 64); err == nil {
+			schema.Default = value
+		}
+	case time.Duration:
+		// durations are parsed by time.ParseDuration, e.g. "1h30m"
+		schema.Format = "duration"
+	}
+	return schema
+}
+
+// GenerateFlagsSchema writes JSON Schema of YAML config built from CLI params
+func GenerateFlagsSchema(output io.Writer, serviceName string) error {
+	return GenerateFlagsSchemaFromFlagSets([]*flag_.FlagSet{flag_.CommandLine}, output, serviceName)
+}
+
+// GenerateFlagsSchemaFromFlagSets writes JSON Schema of YAML config built from CLI flag sets, so config of service may
+// be validated by deployment tools without running it. Flags accepted only from command line aren't included.
+func GenerateFlagsSchemaFromFlagSets(flagSets []*flag_.FlagSet, output io.Writer, serviceName string) error {
+	schema := flagsSchema{
+		Schema: jsonSchemaDraft,
+		Title:  serviceName,
+		Type:   "object",
+		Properties: map[string]*flagSchema{
+			"version": {Type: "string", Description: "version of config format", Default: utils.VERSION},
+		},
+	}
+	visitFlagSets(flagSets, func(flag *flag_.Flag) {
+		if _, cliOnly := cliOnlyFlags[flag.Name]; cliOnly {
+			return
+		}
+		schema.Properties[flag.Name] = newFlagSchema(flag)
+	})
+	encoder := json.NewEncoder(output)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(schema)
+}
+
+// GenerateCompletion writes completion script of CLI params for shell
+func GenerateCompletion(output io.Writer, shell, serviceName string) error {
+	return GenerateCompletionFromFlagSets([]*flag_.FlagSet{flag_.CommandLine}, nil, output, shell, serviceName)
+}
+
+// GenerateCompletionFromFlagSets writes completion script for shell which completes flags of all flag sets and
+// names of subcommands of serviceName binary
+func GenerateCompletionFromFlagSets(flagSets []*flag_.FlagSet, subcommands []string, output io.Writer, shell, serviceName string) error {
+	var flags []*flag_.Flag
+	visitFlagSets(flagSets, func(flag *flag_.Flag) {
+		flags = append(flags, flag)
+	})
+	switch shell {
+	case CompletionBash:
+		generateBashCompletion(flags, subcommands, output, serviceName)
+	case CompletionZsh:
+		generateZshCompletion(flags, subcommands, output, serviceName)
+	case CompletionFish:
+		generateFishCompletion(flags, subcommands, output, serviceName)
+	default:
+		return fmt.Errorf("%w '%s', expected '%s', '%s' or '%s'", ErrUnsupportedShell, shell, CompletionBash,
+			CompletionZsh, CompletionFish)
+	}
+	return nil
+}
+
+// isBoolFlag returns true for flags which don't take value
+func isBoolFlag(flag *flag_.Flag) bool {
+	boolFlag, ok := flag.Value.(interface{ IsBoolFlag() bool })
+	return ok && boolFlag.IsBoolFlag()
+}
+
+// completionDescription returns first line of flag's usage
+func completionDescription(flag *flag_.Flag) string {
+	return strings.TrimSpace(strings.SplitN(flag.Usage, "\n", 2)[0])
+}
+
+// completionFunctionName returns name of shell function for serviceName, e.g. _acra_server
+func completionFunctionName(serviceName string) string {
+	return "_" + strings.Replace(serviceName, "-", "_", -1)
+}
+
+func generateBashCompletion(flags []*flag_.Flag, subcommands []string, output io.Writer, serviceName string) {
+	words := make([]string, 0, len(flags)+len(subcommands))
+	for _, flag := range flags {
+		if isBoolFlag(flag) {
+			words = append(words, "--"+flag.Name)
+		} else {
+			words = append(words, "--"+flag.Name+"=")
+		}
+	}
+	words = append(words, subcommands...)
+	function := completionFunctionName(serviceName)
+	fmt.Fprintf(output, "# bash completion for %s\n", serviceName)
+	fmt.Fprintf(output, "%s() {\n", function)
+	fmt.Fprintf(output, "    local cur=\"${COMP_WORDS[COMP_CWORD]}\"\n")
+	// complete value after "--flag=" as file name
+	fmt.Fprintf(output, "    [[ ${COMP_WORDS[COMP_CWORD-1]} == \"=\" ]] && return\n")
+	fmt.Fprintf(output, "    COMPREPLY=($(compgen -W \"%s\" -- \"$cur\"))\n", strings.Join(words, " "))
+	// don't add space after "--flag=" to let user type value
+	fmt.Fprintf(output, "    [[ ${#COMPREPLY[@]} == 1 && ${COMPREPLY[0]} == *= ]] && compopt -o nospace\n")
+	fmt.Fprintf(output, "}\n")
+	fmt.Fprintf(output, "complete -o default -F %s %s\n", function, serviceName)
+}
+
+func generateZshCompletion(flags []*flag_.Flag, subcommands []string, output io.Writer, serviceName string) {
+	escape := strings.NewReplacer("'", "'\\''", "[", "\\[", "]", "\\]", ":", "\\:")
+	fmt.Fprintf(output, "#compdef %s\n\n", serviceName)
+	fmt.Fprintf(output, "_arguments \\\n")
+	for _, flag := range flags {
+		description := escape.Replace(completionDescription(flag))
+		if isBoolFlag(flag) {
+			fmt.Fprintf(output, "  '--%s[%s]' \\\n", flag.Name, description)
+		} else {
+			fmt.Fprintf(output, "  '--%s=[%s]: :_default' \\\n", flag.Name, description)
+		}
+	}
+	if len(subcommands) != 0 {
+		fmt.Fprintf(output, "  '1:command:(%s)' \\\n", strings.Join(subcommands, " "))
+	}
+	fmt.Fprintf(output, "  '*: :_default'\n")
+}
+
+func generateFishCompletion(flags []*flag_.Flag, subcommands []string, output io.Writer, serviceName string) {
+	escape := strings.NewReplacer("\\", "\\\\", "'", "\\'")
+	fmt.Fprintf(output, "# fish completion for %s\n", serviceName)
+	for _, flag := range flags {
+		line := fmt.Sprintf("complete -c %s -l %s", serviceName, flag.Name)
+		if !isBoolFlag(flag) {
+			line += " -r"
+		}
+		fmt.Fprintf(output, "%s -d '%s'\n", line, escape.Replace(completionDescription(flag)))
+	}
+	if len(subcommands) != 0 {
+		fmt.Fprintf(output, "complete -c %s -n '__fish_use_subcommand' -f -a '%s'\n", serviceName,
+			strings.Join(subcommands, " "))
+	}
+}
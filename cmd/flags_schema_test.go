@@ -0,0 +1,102 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	flag_ "flag"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testFlagSet() *flag_.FlagSet {
+	flags := flag_.NewFlagSet("test", flag_.ContinueOnError)
+	flags.Bool("tls_enable", false, "Enable TLS")
+	flags.Int("port", 9393, "Port to listen")
+	flags.String("client_id", "", "Client ID")
+	flags.Duration("timeout", time.Second, "Timeout of connection")
+	flags.Bool("version", false, "Print version")
+	return flags
+}
+
+func TestGenerateFlagsSchema(t *testing.T) {
+	flags := testFlagSet()
+	// current values of flags don't change defaults in schema
+	if err := flags.Parse([]string{"--port=1", "--client_id=client"}); err != nil {
+		t.Fatal(err)
+	}
+	output := &bytes.Buffer{}
+	if err := GenerateFlagsSchemaFromFlagSets([]*flag_.FlagSet{flags}, output, "acra-test"); err != nil {
+		t.Fatal(err)
+	}
+	schema := flagsSchema{}
+	if err := json.Unmarshal(output.Bytes(), &schema); err != nil {
+		t.Fatal(err)
+	}
+	if schema.Title != "acra-test" || schema.Type != "object" || schema.AdditionalProperties {
+		t.Fatalf("Unexpected schema %+v", schema)
+	}
+	expected := map[string]flagSchema{
+		"version":    {Type: "string", Description: "version of config format"},
+		"tls_enable": {Type: "boolean", Description: "Enable TLS", Default: false},
+		"port":       {Type: "integer", Description: "Port to listen", Default: float64(9393)},
+		"client_id":  {Type: "string", Description: "Client ID"},
+		"timeout":    {Type: "string", Description: "Timeout of connection", Default: "1s", Format: "duration"},
+	}
+	if len(schema.Properties) != len(expected) {
+		t.Fatalf("Expected %d properties, took %d", len(expected), len(schema.Properties))
+	}
+	for name, property := range expected {
+		actual, ok := schema.Properties[name]
+		if !ok {
+			t.Fatalf("Property %s is missing", name)
+		}
+		if name == "version" {
+			actual.Default = nil
+		}
+		if *actual != property {
+			t.Fatalf("Expected %+v for %s, took %+v", property, name, *actual)
+		}
+	}
+}
+
+func TestGenerateCompletion(t *testing.T) {
+	flags := testFlagSet()
+	expected := map[string][]string{
+		CompletionBash: {"--tls_enable ", "--port= ", "complete -o default -F _acra_test acra-test", " list\""},
+		CompletionZsh:  {"#compdef acra-test", "'--tls_enable[Enable TLS]'", "'--port=[Port to listen]: :_default'", "(list)"},
+		CompletionFish: {"complete -c acra-test -l tls_enable -d 'Enable TLS'", "complete -c acra-test -l port -r", "-a 'list'"},
+	}
+	for shell, parts := range expected {
+		output := &bytes.Buffer{}
+		if err := GenerateCompletionFromFlagSets([]*flag_.FlagSet{flags}, []string{"list"}, output, shell, "acra-test"); err != nil {
+			t.Fatal(err)
+		}
+		for _, part := range parts {
+			if !strings.Contains(output.String(), part) {
+				t.Fatalf("%s completion doesn't contain %q:\n%s", shell, part, output.String())
+			}
+		}
+	}
+	err := GenerateCompletionFromFlagSets([]*flag_.FlagSet{flags}, nil, &bytes.Buffer{}, "csh", "acra-test")
+	if !errors.Is(err, ErrUnsupportedShell) {
+		t.Fatalf("Expected ErrUnsupportedShell, took %v", err)
+	}
+}
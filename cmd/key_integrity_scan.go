@@ -0,0 +1,70 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"errors"
+	"flag"
+
+	"github.com/cossacklabs/acra/keystore/filesystem"
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultKeyIntegrityScanRate is default number of keys checked per second on startup
+const DefaultKeyIntegrityScanRate = 100
+
+var keyIntegrityScanOptions struct {
+	enabled    bool
+	sampleSize int
+	rate       int
+}
+
+// ErrInvalidKeyIntegrityScanOptions returned for negative sample size or rate of key integrity scan
+var ErrInvalidKeyIntegrityScanOptions = errors.New("keystore_integrity_scan_sample_size and keystore_integrity_scan_rate can't be negative")
+
+// RegisterKeyIntegrityScanCmdParameters register cli parameters with flag for startup key integrity scan
+func RegisterKeyIntegrityScanCmdParameters() {
+	flag.BoolVar(&keyIntegrityScanOptions.enabled, "keystore_integrity_scan_enable", false, "Check on startup that private keys can be decrypted with master key and exit if they can't (keystore v1 only)")
+	flag.IntVar(&keyIntegrityScanOptions.sampleSize, "keystore_integrity_scan_sample_size", 0, "Number of randomly chosen private keys checked by keystore integrity scan (0 - all keys)")
+	flag.IntVar(&keyIntegrityScanOptions.rate, "keystore_integrity_scan_rate", DefaultKeyIntegrityScanRate, "Maximum number of private keys checked per second by keystore integrity scan (0 - no limit)")
+}
+
+// IsKeyIntegrityScanEnabled returns true if private keys should be checked on startup
+func IsKeyIntegrityScanEnabled() bool {
+	return keyIntegrityScanOptions.enabled
+}
+
+// ScanKeyIntegrity checks private keys of keystore with configured sample size and rate and logs summary
+func ScanKeyIntegrity(keyStore *filesystem.KeyStore) error {
+	if keyIntegrityScanOptions.sampleSize < 0 || keyIntegrityScanOptions.rate < 0 {
+		return ErrInvalidKeyIntegrityScanOptions
+	}
+	log.Infoln("Scanning keystore integrity...")
+	result, err := keyStore.ScanKeyIntegrity(filesystem.KeyIntegrityScanOptions{
+		SampleSize: keyIntegrityScanOptions.sampleSize,
+		Rate:       keyIntegrityScanOptions.rate,
+	})
+	if result != nil {
+		log.WithFields(log.Fields{
+			"total":    result.Total,
+			"scanned":  result.Scanned,
+			"failed":   len(result.FailedKeys),
+			"duration": result.Duration,
+		}).Infoln("Keystore integrity scan finished")
+	}
+	return err
+}
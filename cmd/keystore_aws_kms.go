@@ -0,0 +1,54 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"flag"
+	"time"
+
+	"github.com/cossacklabs/acra/keystore/kms"
+)
+
+var keystoreAWSKMSOptions struct {
+	config   kms.AWSEnvelopeConfig
+	cacheTTL int
+}
+
+// RegisterKeystoreAWSKMSCmdParameters register cli parameters with flags for keystore v1 which keys are sealed with
+// data keys of AWS KMS instead of master key
+func RegisterKeystoreAWSKMSCmdParameters() {
+	flag.StringVar(&keystoreAWSKMSOptions.config.KeyID, "keystore_aws_kms_key_id", "", "AWS KMS key ID, ARN or alias which seals data keys of keystore v1 private keys instead of ACRA_MASTER_KEY. Credentials are read from AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, AWS_SESSION_TOKEN")
+	flag.StringVar(&keystoreAWSKMSOptions.config.Region, "keystore_aws_kms_region", "", "AWS region of KMS key. Default is AWS_REGION")
+	flag.StringVar(&keystoreAWSKMSOptions.config.Endpoint, "keystore_aws_kms_endpoint", "", "Custom AWS KMS endpoint. Default is regional endpoint")
+	flag.StringVar(&keystoreAWSKMSOptions.config.RoleARN, "keystore_aws_kms_role_arn", "", "ARN of IAM role assumed to access AWS KMS key. Credentials of environment are used as is if empty")
+	flag.IntVar(&keystoreAWSKMSOptions.cacheTTL, "keystore_aws_kms_cache_ttl", 300, "Time in seconds while decrypted data keys are kept in memory and used without requests to AWS KMS. 0 means that every key is decrypted by AWS KMS")
+}
+
+// IsKeystoreAWSKMSEnabled returns true if keys of keystore are sealed with AWS KMS
+func IsKeystoreAWSKMSEnabled() bool {
+	return keystoreAWSKMSOptions.config.KeyID != ""
+}
+
+// NewKeystoreAWSKMSEncryptor returns encryptor of keys of keystore which uses AWS KMS key
+func NewKeystoreAWSKMSEncryptor() (*kms.AWSEnvelopeKeyEncryptor, error) {
+	if IsKeystorePKCS11Enabled() {
+		return nil, ErrKeystorePKCS11WithAWSKMS
+	}
+	config := keystoreAWSKMSOptions.config
+	config.CacheTTL = time.Duration(keystoreAWSKMSOptions.cacheTTL) * time.Second
+	return kms.NewAWSEnvelopeKeyEncryptorFromEnvironment(config)
+}
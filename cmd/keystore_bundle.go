@@ -0,0 +1,98 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cossacklabs/acra/keystore/filesystem"
+	"github.com/cossacklabs/acra/keystore/kms"
+)
+
+// maxKeystoreBundleSize limits size of downloaded keystore bundle
+const maxKeystoreBundleSize = 64 * 1024 * 1024
+
+// keystoreBundleFetchTimeout limits time of keystore bundle download
+const keystoreBundleFetchTimeout = time.Second * 30
+
+var keystoreBundleOptions struct {
+	source   string
+	kmsType  string
+	keyID    string
+	endpoint string
+}
+
+// ErrEmptyKeystoreBundleKeyID returned when keystore bundle is used without KMS key
+var ErrEmptyKeystoreBundleKeyID = errors.New("empty keystore_bundle_kms_key_id")
+
+// RegisterKeystoreBundleCmdParameters register cli parameters with flag for in-memory keystore seeded from bundle
+func RegisterKeystoreBundleCmdParameters() {
+	flag.StringVar(&keystoreBundleOptions.source, "keystore_bundle", "", "Path or http(s) URL of KMS-wrapped keystore bundle (created by acra-keys kms-bundle). Keys are loaded from the bundle into memory and never written to disk, keys_dir is used only as in-memory path")
+	flag.StringVar(&keystoreBundleOptions.kmsType, "keystore_bundle_kms", kms.TypeAWS, "KMS used to unwrap keystore bundle: aws (credentials from AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, AWS_SESSION_TOKEN, AWS_REGION) or vault (Transit engine, token from VAULT_TOKEN)")
+	flag.StringVar(&keystoreBundleOptions.keyID, "keystore_bundle_kms_key_id", "", "KMS key which wraps keystore bundle: AWS KMS key ID, ARN or alias, or Vault Transit key as <name> or <mount>/<name>")
+	flag.StringVar(&keystoreBundleOptions.endpoint, "keystore_bundle_kms_endpoint", "", "Custom KMS endpoint. Default is regional AWS KMS endpoint or VAULT_ADDR for Vault")
+}
+
+// IsKeystoreBundleEnabled returns true if keystore should be loaded from bundle into memory
+func IsKeystoreBundleEnabled() bool {
+	return keystoreBundleOptions.source != ""
+}
+
+// fetchKeystoreBundle reads bundle from file or downloads it from http(s) URL
+func fetchKeystoreBundle(source string) ([]byte, error) {
+	if !strings.HasPrefix(source, "http://") && !strings.HasPrefix(source, "https://") {
+		return ioutil.ReadFile(source)
+	}
+	client := &http.Client{Timeout: keystoreBundleFetchTimeout}
+	response, err := client.Get(source)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected response status %d on keystore bundle download", response.StatusCode)
+	}
+	return ioutil.ReadAll(io.LimitReader(response.Body, maxKeystoreBundleSize))
+}
+
+// LoadKeystoreBundle fetches keystore bundle, unwraps it with KMS and returns in-memory storage with keys placed in
+// keyDirectory
+func LoadKeystoreBundle(keyDirectory string) (*filesystem.MemoryStorage, error) {
+	if keystoreBundleOptions.keyID == "" {
+		return nil, ErrEmptyKeystoreBundleKeyID
+	}
+	wrapper, err := kms.NewKeyWrapperFromEnvironment(keystoreBundleOptions.kmsType, keystoreBundleOptions.keyID, keystoreBundleOptions.endpoint)
+	if err != nil {
+		return nil, err
+	}
+	bundle, err := fetchKeystoreBundle(keystoreBundleOptions.source)
+	if err != nil {
+		return nil, err
+	}
+	storage := filesystem.NewMemoryStorage()
+	if err := filesystem.LoadKeyBundle(bundle, wrapper, storage, keyDirectory); err != nil {
+		return nil, err
+	}
+	return storage, nil
+}
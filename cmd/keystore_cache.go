@@ -0,0 +1,70 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"errors"
+	"flag"
+	"time"
+
+	"github.com/cossacklabs/acra/keystore"
+	"github.com/cossacklabs/acra/keystore/lru"
+)
+
+var keystorePrivateKeysCacheOptions struct {
+	size int
+	ttl  int
+}
+
+// ErrInvalidKeystorePrivateKeysCacheTTL returned for negative keystore_private_keys_cache_ttl
+var ErrInvalidKeystorePrivateKeysCacheTTL = errors.New("keystore_private_keys_cache_ttl should be non-negative")
+
+// RegisterKeystorePrivateKeysCacheCmdParameters register cli parameters with flags for cache of decrypted private keys
+func RegisterKeystorePrivateKeysCacheCmdParameters() {
+	flag.IntVar(&keystorePrivateKeysCacheOptions.size, "keystore_private_keys_cache_size", keystore.WithoutCache, "Maximum number of client/zone ids which decrypted private keys are stored in in-memory LRU cache to avoid reading and decryption of keys on every request. 0 - no limits, -1 - turn off cache")
+	flag.IntVar(&keystorePrivateKeysCacheOptions.ttl, "keystore_private_keys_cache_ttl", 300, "Time in seconds after which decrypted private keys are removed from cache, so keys rotated by other processes are used. 0 - keep until eviction")
+}
+
+// IsKeystorePrivateKeysCacheEnabled returns true if decrypted private keys should be cached
+func IsKeystorePrivateKeysCacheEnabled() bool {
+	return keystorePrivateKeysCacheOptions.size != keystore.WithoutCache
+}
+
+func keystorePrivateKeysCacheTTL() (time.Duration, error) {
+	if keystorePrivateKeysCacheOptions.ttl < 0 {
+		return 0, ErrInvalidKeystorePrivateKeysCacheTTL
+	}
+	return time.Duration(keystorePrivateKeysCacheOptions.ttl) * time.Second, nil
+}
+
+// NewKeystoreServerPrivateKeysCache returns keyStore which caches decrypted private keys of wrapped keyStore
+func NewKeystoreServerPrivateKeysCache(keyStore keystore.ServerKeyStore) (*lru.ServerKeyStore, error) {
+	ttl, err := keystorePrivateKeysCacheTTL()
+	if err != nil {
+		return nil, err
+	}
+	return lru.NewServerKeyStore(keyStore, keystorePrivateKeysCacheOptions.size, ttl)
+}
+
+// NewKeystoreTranslationPrivateKeysCache returns keyStore which caches decrypted private keys of wrapped keyStore
+func NewKeystoreTranslationPrivateKeysCache(keyStore keystore.TranslationKeyStore) (*lru.TranslationKeyStore, error) {
+	ttl, err := keystorePrivateKeysCacheTTL()
+	if err != nil {
+		return nil, err
+	}
+	return lru.NewTranslationKeyStore(keyStore, keystorePrivateKeysCacheOptions.size, ttl)
+}
@@ -0,0 +1,64 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"errors"
+	"flag"
+	"os"
+
+	"github.com/cossacklabs/acra/keystore"
+	"github.com/cossacklabs/acra/keystore/kms"
+)
+
+// keystorePKCS11PINEnv is environment variable with PIN of PKCS#11 token user
+const keystorePKCS11PINEnv = "ACRA_KEYSTORE_PKCS11_PIN"
+
+var keystorePKCS11Options struct {
+	config kms.PKCS11Config
+}
+
+// ErrKeystorePKCS11WithAWSKMS returned when master key is configured to be kept both in HSM and AWS KMS
+var ErrKeystorePKCS11WithAWSKMS = errors.New("keystore_pkcs11_module can't be used with keystore_aws_kms_key_id")
+
+// RegisterKeystorePKCS11CmdParameters register cli parameters with flags for keystore v1 which master key is kept
+// in HSM
+func RegisterKeystorePKCS11CmdParameters() {
+	flag.StringVar(&keystorePKCS11Options.config.ModulePath, "keystore_pkcs11_module", "", "Path to PKCS#11 library of HSM (SoftHSM, YubiHSM, CloudHSM) which keeps AES master key of keystore v1 instead of ACRA_MASTER_KEY. PIN is read from "+keystorePKCS11PINEnv+". Requires build with \"-tags pkcs11\"")
+	flag.StringVar(&keystorePKCS11Options.config.TokenLabel, "keystore_pkcs11_token_label", "", "Label of PKCS#11 token with master key. Default is first token")
+	flag.StringVar(&keystorePKCS11Options.config.KeyLabel, "keystore_pkcs11_key_label", "acra_master_key", "Label of AES secret key object on PKCS#11 token used as master key")
+	flag.IntVar(&keystorePKCS11Options.config.SessionPoolSize, "keystore_pkcs11_session_pool_size", kms.DefaultPKCS11SessionPoolSize, "Maximum number of PKCS#11 sessions used concurrently to unwrap keys")
+}
+
+// IsKeystorePKCS11Enabled returns true if master key of keystore is kept in HSM
+func IsKeystorePKCS11Enabled() bool {
+	return keystorePKCS11Options.config.ModulePath != ""
+}
+
+// NewKeystoreMasterKeyProvider returns provider of master key kept in HSM if it's configured or in environment
+func NewKeystoreMasterKeyProvider() (keystore.MasterKeyProvider, error) {
+	if !IsKeystorePKCS11Enabled() {
+		return keystore.EnvironmentMasterKeyProvider{}, nil
+	}
+	config := keystorePKCS11Options.config
+	config.PIN = os.Getenv(keystorePKCS11PINEnv)
+	provider, err := kms.NewPKCS11MasterKeyProvider(config)
+	if err != nil {
+		return nil, err
+	}
+	return provider, nil
+}
@@ -0,0 +1,102 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/cossacklabs/acra/keystore"
+	"github.com/cossacklabs/acra/keystore/filesystem"
+)
+
+// keystoreRedisPasswordEnv is environment variable with password of Redis keystore
+const keystoreRedisPasswordEnv = "ACRA_KEYSTORE_REDIS_PASSWORD"
+
+var keystoreRedisOptions struct {
+	enable    bool
+	addresses string
+	tls       bool
+	tlsCA     string
+	config    filesystem.RedisConfig
+}
+
+// Errors returned for invalid configuration of Redis keystore
+var (
+	ErrKeystoreRedisWithBundle = errors.New("keystore_redis_enable can't be used with keystore_bundle")
+	ErrKeystoreRedisWithVault  = errors.New("keystore_redis_enable can't be used with keystore_vault_enable")
+	ErrKeystoreRedisAddresses  = errors.New("keystore_redis_addresses should contain at least one address")
+)
+
+// RegisterKeystoreRedisCmdParameters register cli parameters with flag for keystore v1 kept in Redis
+func RegisterKeystoreRedisCmdParameters() {
+	flag.BoolVar(&keystoreRedisOptions.enable, "keystore_redis_enable", false, "Keep key files of keystore v1 in Redis encrypted with master key instead of keys_dir, keys_dir is used only as path mapped to Redis keys. Password is read from "+keystoreRedisPasswordEnv)
+	flag.StringVar(&keystoreRedisOptions.addresses, "keystore_redis_addresses", "127.0.0.1:6379", "Comma separated host:port of Redis server, Redis Cluster nodes or Redis Sentinels if keystore_redis_sentinel_master is set")
+	flag.StringVar(&keystoreRedisOptions.config.SentinelMaster, "keystore_redis_sentinel_master", "", "Name of master monitored by Redis Sentinels with keys")
+	flag.StringVar(&keystoreRedisOptions.config.Username, "keystore_redis_username", "", "Username of Redis ACL user")
+	flag.IntVar(&keystoreRedisOptions.config.DB, "keystore_redis_db", 0, "Number of Redis database with keys, should be 0 for Redis Cluster")
+	flag.StringVar(&keystoreRedisOptions.config.Prefix, "keystore_redis_prefix", filesystem.DefaultRedisKeyPrefix, "Prefix of Redis keys with key files")
+	flag.BoolVar(&keystoreRedisOptions.tls, "keystore_redis_tls_enable", false, "Use TLS for connections to Redis")
+	flag.StringVar(&keystoreRedisOptions.tlsCA, "keystore_redis_tls_ca", "", "Path to CA certificate of Redis in addition to system CA certificates")
+}
+
+// IsKeystoreRedisEnabled returns true if keystore should be kept in Redis
+func IsKeystoreRedisEnabled() bool {
+	return keystoreRedisOptions.enable
+}
+
+// NewKeystoreRedisStorage connects to Redis and returns storage with key files of keyDirectory encrypted with encryptor
+func NewKeystoreRedisStorage(keyDirectory string, encryptor keystore.KeyEncryptor) (*filesystem.RedisStorage, error) {
+	if IsKeystoreBundleEnabled() {
+		return nil, ErrKeystoreRedisWithBundle
+	}
+	if IsKeystoreVaultEnabled() {
+		return nil, ErrKeystoreRedisWithVault
+	}
+	config := keystoreRedisOptions.config
+	for _, address := range strings.Split(keystoreRedisOptions.addresses, ",") {
+		if address = strings.TrimSpace(address); address != "" {
+			config.Addresses = append(config.Addresses, address)
+		}
+	}
+	if len(config.Addresses) == 0 {
+		return nil, ErrKeystoreRedisAddresses
+	}
+	config.Password = os.Getenv(keystoreRedisPasswordEnv)
+	if keystoreRedisOptions.tls {
+		roots, err := x509.SystemCertPool()
+		if err != nil {
+			roots = x509.NewCertPool()
+		}
+		if keystoreRedisOptions.tlsCA != "" {
+			caPem, err := ioutil.ReadFile(keystoreRedisOptions.tlsCA)
+			if err != nil {
+				return nil, err
+			}
+			if !roots.AppendCertsFromPEM(caPem) {
+				return nil, errors.New("can't add CA certificate of Redis")
+			}
+		}
+		config.TLS = &tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS12}
+	}
+	return filesystem.NewRedisStorage(config, keyDirectory, encryptor)
+}
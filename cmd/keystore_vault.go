@@ -0,0 +1,59 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"errors"
+	"flag"
+
+	"github.com/cossacklabs/acra/keystore/kms"
+)
+
+var keystoreVaultOptions struct {
+	enable bool
+	config kms.VaultKeyStoreConfig
+}
+
+// ErrKeystoreVaultWithBundle returned when keystore is configured to be loaded both from Vault and from bundle
+var ErrKeystoreVaultWithBundle = errors.New("keystore_vault_enable can't be used with keystore_bundle")
+
+// RegisterKeystoreVaultCmdParameters register cli parameters with flag for keystore v1 kept in Vault KV v2
+func RegisterKeystoreVaultCmdParameters() {
+	flag.BoolVar(&keystoreVaultOptions.enable, "keystore_vault_enable", false, "Keep key files of keystore v1 in Vault KV v2 secrets engine instead of keys_dir, keys_dir is used only as path mapped to Vault secrets")
+	flag.StringVar(&keystoreVaultOptions.config.Address, "keystore_vault_address", "", "Vault address. Default is VAULT_ADDR")
+	flag.StringVar(&keystoreVaultOptions.config.KVMount, "keystore_vault_kv_mount", kms.DefaultVaultKVMount, "Mount path of Vault KV v2 secrets engine with keys")
+	flag.StringVar(&keystoreVaultOptions.config.Path, "keystore_vault_kv_path", kms.DefaultVaultKVPath, "Path of keys in Vault KV v2 secrets engine")
+	flag.StringVar(&keystoreVaultOptions.config.TransitKeyID, "keystore_vault_transit_key", "", "Vault Transit key as <name> or <mount>/<name> which additionally wraps key files stored in KV. Key files aren't wrapped if empty")
+	flag.StringVar(&keystoreVaultOptions.config.Auth.Method, "keystore_vault_auth_method", kms.VaultAuthToken, "Vault auth method: token (token from VAULT_TOKEN), approle (secret ID from VAULT_SECRET_ID) or kubernetes (service account token)")
+	flag.StringVar(&keystoreVaultOptions.config.Auth.Mount, "keystore_vault_auth_mount", "", "Mount path of Vault auth method. Default is name of method")
+	flag.StringVar(&keystoreVaultOptions.config.Auth.RoleID, "keystore_vault_approle_role_id", "", "Role ID of Vault AppRole auth method")
+	flag.StringVar(&keystoreVaultOptions.config.Auth.Role, "keystore_vault_kubernetes_role", "", "Role of Vault Kubernetes auth method")
+	flag.StringVar(&keystoreVaultOptions.config.Auth.KubernetesTokenPath, "keystore_vault_kubernetes_token_path", kms.DefaultVaultKubernetesTokenPath, "Path of Kubernetes service account token used by Vault Kubernetes auth method")
+}
+
+// IsKeystoreVaultEnabled returns true if keystore should be kept in Vault
+func IsKeystoreVaultEnabled() bool {
+	return keystoreVaultOptions.enable
+}
+
+// NewKeystoreVaultStorage logs in to Vault and returns storage with key files of keyDirectory
+func NewKeystoreVaultStorage(keyDirectory string) (*kms.VaultStorage, error) {
+	if IsKeystoreBundleEnabled() {
+		return nil, ErrKeystoreVaultWithBundle
+	}
+	return kms.NewVaultStorage(keystoreVaultOptions.config, keyDirectory)
+}
@@ -0,0 +1,81 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"flag"
+
+	"github.com/cossacklabs/acra/kubernetes"
+	log "github.com/sirupsen/logrus"
+)
+
+var kubernetesSidecarOptions struct {
+	enabled           bool
+	clientIDTemplate  string
+	podInfoDir        string
+	serviceAccountDir string
+	verifyToken       bool
+}
+
+// RegisterKubernetesSidecarCmdParameters register cli parameters with flag for client ID derived from Kubernetes pod
+func RegisterKubernetesSidecarCmdParameters() {
+	flag.BoolVar(&kubernetesSidecarOptions.enabled, "kubernetes_sidecar_enable", false, "Run as sidecar of Kubernetes pod and use client ID derived from pod identity instead of client_id")
+	flag.StringVar(&kubernetesSidecarOptions.clientIDTemplate, "kubernetes_client_id_template", kubernetes.DefaultClientIDTemplate, "Template of client ID with placeholders {namespace}, {pod}, {service_account} and {label:<key>}")
+	flag.StringVar(&kubernetesSidecarOptions.podInfoDir, "kubernetes_pod_info_dir", kubernetes.DefaultPodInfoDir, "Directory of downward API volume with 'labels' file. Pod name, namespace and service account are read from POD_NAME, POD_NAMESPACE and POD_SERVICE_ACCOUNT environment variables")
+	flag.StringVar(&kubernetesSidecarOptions.serviceAccountDir, "kubernetes_service_account_dir", kubernetes.DefaultServiceAccountDir, "Directory of service account volume with token, ca.crt and namespace files")
+	flag.BoolVar(&kubernetesSidecarOptions.verifyToken, "kubernetes_token_review_enable", true, "Verify service account token with TokenReview API of Kubernetes API server and check that it matches namespace and service account of pod. Requires role system:auth-delegator")
+}
+
+// IsKubernetesSidecarEnabled returns true if client ID should be derived from Kubernetes pod identity
+func IsKubernetesSidecarEnabled() bool {
+	return kubernetesSidecarOptions.enabled
+}
+
+// GetKubernetesSidecarClientID returns client ID formatted from identity of pod, verified with service account token
+// if token review is enabled
+func GetKubernetesSidecarClientID() (string, error) {
+	identity, err := kubernetes.PodIdentityFromEnvironment(kubernetesSidecarOptions.serviceAccountDir, kubernetesSidecarOptions.podInfoDir)
+	if err != nil {
+		return "", err
+	}
+	if kubernetesSidecarOptions.verifyToken {
+		reviewer, err := kubernetes.NewTokenReviewerFromEnvironment(kubernetesSidecarOptions.serviceAccountDir)
+		if err != nil {
+			return "", err
+		}
+		token, err := kubernetes.ReadServiceAccountToken(kubernetesSidecarOptions.serviceAccountDir)
+		if err != nil {
+			return "", err
+		}
+		if err := identity.Verify(reviewer, token); err != nil {
+			return "", err
+		}
+	} else {
+		log.Warningln("Pod identity from downward API isn't verified with service account token")
+	}
+	clientID, err := identity.ClientID(kubernetesSidecarOptions.clientIDTemplate)
+	if err != nil {
+		return "", err
+	}
+	log.WithFields(log.Fields{
+		"namespace":       identity.Namespace,
+		"pod":             identity.Name,
+		"service_account": identity.ServiceAccount,
+		"client_id":       clientID,
+	}).Infoln("Derived client ID from Kubernetes pod identity")
+	return clientID, nil
+}
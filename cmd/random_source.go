@@ -0,0 +1,80 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"flag"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/cossacklabs/acra/keystore/kms"
+	"github.com/cossacklabs/acra/logging"
+	"github.com/cossacklabs/acra/random"
+	log "github.com/sirupsen/logrus"
+)
+
+// randomSourcePKCS11Prefix is followed by path to PKCS#11 library of HSM which RNG generates random bytes
+const randomSourcePKCS11Prefix = "pkcs11:"
+
+var randomSourceOptions struct {
+	source           string
+	pkcs11TokenLabel string
+	healthCheck      bool
+}
+
+// RegisterRandomSourceCmdParameters register cli parameters with flag for source of random bytes
+func RegisterRandomSourceCmdParameters() {
+	RegisterRandomSourceCmdParametersWithFlags(flag.CommandLine)
+}
+
+// RegisterRandomSourceCmdParametersWithFlags register cli parameters for source of random bytes in flags
+func RegisterRandomSourceCmdParametersWithFlags(flags *flag.FlagSet) {
+	flags.StringVar(&randomSourceOptions.source, "random_source", random.SourceSystem, "Source of random bytes for generation of keys and nonces: 'system' (OS CSPRNG), 'getrandom' (getrandom syscall, Linux only), 'file:<path>' (character device of hardware RNG, e.g. file:/dev/hwrng) or 'pkcs11:<path>' (C_GenerateRandom of PKCS#11 library of HSM, requires build with \"-tags pkcs11\"). Keys generated by Themis use its own CSPRNG")
+	flags.StringVar(&randomSourceOptions.pkcs11TokenLabel, "random_pkcs11_token_label", "", "Label of PKCS#11 token which generates random bytes for 'pkcs11:<path>' random source. Default is first token")
+	flags.BoolVar(&randomSourceOptions.healthCheck, "random_health_check_enable", true, "Check random source with FIPS 140-2 statistical tests on startup and compare each output block with previous one, exit if source behaves suspiciously")
+}
+
+// newRandomSource returns RNG of PKCS#11 token for randomSourcePKCS11Prefix and sources of random package otherwise
+func newRandomSource(name string) (io.Reader, error) {
+	if strings.HasPrefix(name, randomSourcePKCS11Prefix) {
+		return kms.NewPKCS11RandomSource(strings.TrimPrefix(name, randomSourcePKCS11Prefix), randomSourceOptions.pkcs11TokenLabel)
+	}
+	return random.NewSource(name)
+}
+
+// InitRandomSource configures source of random bytes and checks its health if enabled
+func InitRandomSource() error {
+	source, err := newRandomSource(randomSourceOptions.source)
+	if err != nil {
+		return err
+	}
+	if randomSourceOptions.healthCheck {
+		if err := random.StartupHealthCheck(source); err != nil {
+			return err
+		}
+		source = random.NewHealthCheckedSource(source, func(err error) {
+			log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorRandomSourceHealthCheck).
+				Errorln("Random source failed health check, exiting")
+			os.Exit(1)
+		})
+	}
+	random.SetSource(source)
+	log.WithFields(log.Fields{"source": randomSourceOptions.source, "health_check": randomSourceOptions.healthCheck}).
+		Debugln("Initialized random source")
+	return nil
+}
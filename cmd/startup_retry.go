@@ -0,0 +1,86 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"flag"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Default intervals between retries of unavailable startup dependencies, in milliseconds
+const (
+	DefaultStartupRetryInitialInterval = 500
+	DefaultStartupRetryMaxInterval     = 10000
+)
+
+var startupRetryOptions struct {
+	timeout         int
+	initialInterval int
+	maxInterval     int
+}
+
+// startupTime is start of the period limited by startup_timeout, shared by all dependencies
+var startupTime = time.Now()
+
+// RegisterStartupRetryCmdParameters register cli parameters of retries of unavailable dependencies on startup
+func RegisterStartupRetryCmdParameters() {
+	flag.IntVar(&startupRetryOptions.timeout, "startup_timeout", 0, "Time (in seconds) after start during which unavailable dependencies (keystore, KMS, database, OCSP servers) are retried before exit. 0 - exit on first failure")
+	flag.IntVar(&startupRetryOptions.initialInterval, "startup_retry_initial_interval", DefaultStartupRetryInitialInterval, "Time (in milliseconds) before first retry of unavailable startup dependency, doubled after each retry")
+	flag.IntVar(&startupRetryOptions.maxInterval, "startup_retry_max_interval", DefaultStartupRetryMaxInterval, "Maximum time (in milliseconds) between retries of unavailable startup dependency")
+}
+
+// IsStartupRetryEnabled returns true if unavailable dependencies are retried on startup
+func IsStartupRetryEnabled() bool {
+	return startupRetryOptions.timeout > 0
+}
+
+// RetryOnStartup calls operation until it succeeds or startup_timeout passes since start, with exponential backoff
+// between calls. Error of the last call is returned. Operation is called once if retries are disabled.
+func RetryOnStartup(dependency string, operation func() error) error {
+	deadline := startupTime.Add(time.Duration(startupRetryOptions.timeout) * time.Second)
+	return retryWithBackoff(dependency, operation, deadline,
+		time.Duration(startupRetryOptions.initialInterval)*time.Millisecond,
+		time.Duration(startupRetryOptions.maxInterval)*time.Millisecond, time.Now, time.Sleep)
+}
+
+// retryWithBackoff calls operation until it succeeds or next call would start after deadline
+func retryWithBackoff(dependency string, operation func() error, deadline time.Time, interval, maxInterval time.Duration, now func() time.Time, sleep func(time.Duration)) error {
+	if interval <= 0 {
+		interval = time.Millisecond
+	}
+	for attempt := 1; ; attempt++ {
+		err := operation()
+		if err == nil {
+			if attempt > 1 {
+				log.WithField("dependency", dependency).Infof("Startup dependency became available after %d attempts", attempt)
+			}
+			return nil
+		}
+		if now().Add(interval).After(deadline) {
+			return err
+		}
+		log.WithError(err).WithFields(log.Fields{"dependency": dependency, "attempt": attempt}).
+			Warnf("Startup dependency is unavailable, retry in %s", interval)
+		sleep(interval)
+		interval *= 2
+		if maxInterval > 0 && interval > maxInterval {
+			interval = maxInterval
+		}
+	}
+}
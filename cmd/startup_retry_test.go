@@ -0,0 +1,80 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRetryWithBackoff(t *testing.T) {
+	errUnavailable := errors.New("unavailable")
+	start := time.Now()
+	clock := start
+	var sleeps []time.Duration
+	now := func() time.Time { return clock }
+	sleep := func(interval time.Duration) {
+		sleeps = append(sleeps, interval)
+		clock = clock.Add(interval)
+	}
+
+	calls := 0
+	err := retryWithBackoff("test", func() error {
+		calls++
+		if calls < 4 {
+			return errUnavailable
+		}
+		return nil
+	}, start.Add(time.Minute), time.Second, time.Second*3, now, sleep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []time.Duration{time.Second, time.Second * 2, time.Second * 3}
+	if len(sleeps) != len(expected) {
+		t.Fatalf("Expected %v sleeps, took %v", expected, sleeps)
+	}
+	for i := range expected {
+		if sleeps[i] != expected[i] {
+			t.Fatalf("Expected %v sleeps, took %v", expected, sleeps)
+		}
+	}
+
+	// no retry after deadline
+	calls = 0
+	clock, sleeps = start, nil
+	err = retryWithBackoff("test", func() error {
+		calls++
+		return errUnavailable
+	}, start.Add(time.Second*4), time.Second, time.Minute, now, sleep)
+	if err != errUnavailable {
+		t.Fatalf("Expected errUnavailable, took %v", err)
+	}
+	if calls != 3 {
+		t.Fatalf("Expected 3 calls before deadline, took %d", calls)
+	}
+
+	// retries are disabled with timeout in the past
+	calls = 0
+	err = retryWithBackoff("test", func() error {
+		calls++
+		return errUnavailable
+	}, start, time.Second, time.Minute, now, sleep)
+	if err != errUnavailable || calls != 1 {
+		t.Fatalf("Expected one call, took %d: %v", calls, err)
+	}
+}
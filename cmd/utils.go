@@ -46,11 +46,21 @@ var (
 	config                   = flag_.String("config_file", "", "path to config")
 	dumpconfig               = flag_.Bool("dump_config", false, "dump config")
 	generateMarkdownArgTable = flag_.Bool("generate_markdown_args_table", false, "Generate with yaml config markdown text file with descriptions of all args")
+	printVersion             = flag_.Bool("version", false, "Print version and build information as JSON and exit")
+	generateCompletion       = flag_.String("generate_completion", "", "Print completion script of arguments for shell (bash, zsh or fish) and exit")
+	dumpFlagsSchema          = flag_.Bool("dump_flags_schema", false, "Print JSON Schema of arguments and YAML config and exit")
 )
 
+// cliOnlyFlags are accepted only from command line, they are never read from or dumped into YAML config.
+// "version" key of YAML config is reserved for config format version.
+var cliOnlyFlags = map[string]struct{}{"version": {}, "generate_completion": {}, "dump_flags_schema": {}}
+
 // Argument and configuration parsing errors.
 var (
-	ErrDumpRequested = errors.New("configurtion dump requested")
+	ErrDumpRequested        = errors.New("configurtion dump requested")
+	ErrVersionRequested     = errors.New("version output requested")
+	ErrCompletionRequested  = errors.New("completion script requested")
+	ErrFlagsSchemaRequested = errors.New("flags schema requested")
 )
 
 func init() {
@@ -225,16 +235,27 @@ func GenerateYamlFromFlagSets(flagSets []*flag_.FlagSet, output io.Writer, useDe
 		panic(err)
 	}
 	visitFlagSets(flagSets, func(flag *flag_.Flag) {
+		if _, cliOnly := cliOnlyFlags[flag.Name]; cliOnly {
+			return
+		}
 		var s string
 		if useDefault {
-			s = fmt.Sprintf("# %v\n%v: %v\n", flag.Usage, flag.Name, flag.DefValue)
+			s = fmt.Sprintf("# %v\n%v: %v\n", flag.Usage, flag.Name, yamlValue(flag.DefValue))
 		} else {
-			s = fmt.Sprintf("# %v\n%v: %v\n", flag.Usage, flag.Name, flag.Value)
+			s = fmt.Sprintf("# %v\n%v: %v\n", flag.Usage, flag.Name, yamlValue(flag.Value.String()))
 		}
 		fmt.Fprint(output, s, "\n")
 	})
 }
 
+// yamlValue quotes values which YAML parses as flow mappings or sequences, like templates with {placeholders}
+func yamlValue(value string) string {
+	if strings.HasPrefix(value, "{") || strings.HasPrefix(value, "[") {
+		return strconv.Quote(value)
+	}
+	return value
+}
+
 // GenerateMarkdownDoc generates Markdown file from CLI params
 func GenerateMarkdownDoc(output io.Writer, serviceName string) {
 	GenerateMarkdownDocFromFlagSets([]*flag_.FlagSet{flag_.CommandLine}, output, serviceName)
@@ -338,9 +359,49 @@ func Parse(configPath, serviceName string) error {
 		DumpConfig(configPath, serviceName, true)
 		os.Exit(0)
 	}
+	if err == ErrVersionRequested {
+		PrintVersion(os.Stdout)
+		os.Exit(0)
+	}
+	if err == ErrCompletionRequested {
+		if err := GenerateCompletion(os.Stdout, CompletionShell(), serviceName); err != nil {
+			return err
+		}
+		os.Exit(0)
+	}
+	if err == ErrFlagsSchemaRequested {
+		if err := GenerateFlagsSchema(os.Stdout, serviceName); err != nil {
+			return err
+		}
+		os.Exit(0)
+	}
 	return err
 }
 
+// CompletionShell returns shell passed with --generate_completion
+func CompletionShell() string {
+	return *generateCompletion
+}
+
+// LogHardwareAESSupport warns if CPU doesn't support hardware AES used by crypto backend for AcraStructs
+func LogHardwareAESSupport() {
+	if utils.HardwareAESSupported() {
+		log.Debugln("Hardware AES acceleration is available")
+		return
+	}
+	log.Warningln("CPU doesn't support hardware AES-GCM (AES-NI with PCLMULQDQ or ARMv8 AES with PMULL), " +
+		"encryption is slower and software AES may be vulnerable to timing attacks")
+}
+
+// PrintVersion writes build information of current binary as JSON
+func PrintVersion(output io.Writer) {
+	data, err := utils.GetBuildInfo().ToJSON()
+	if err != nil {
+		panic(err)
+	}
+	fmt.Fprintln(output, string(data))
+}
+
 // ParseFlagsWithConfig parses flag settings from YAML config file and command line.
 func ParseFlagsWithConfig(flags *flag_.FlagSet, arguments []string, configPath, serviceName string) error {
 	/*load from yaml config and cli. if dumpconfig option pass than generate config and exit*/
@@ -350,6 +411,16 @@ func ParseFlagsWithConfig(flags *flag_.FlagSet, arguments []string, configPath,
 	if err != nil {
 		return err
 	}
+	// print version even if config file is missing or broken
+	if *printVersion {
+		return ErrVersionRequested
+	}
+	if *generateCompletion != "" {
+		return ErrCompletionRequested
+	}
+	if *dumpFlagsSchema {
+		return ErrFlagsSchemaRequested
+	}
 
 	configPath = ConfigPath(configPath)
 	var yamlConfig map[string]interface{}
@@ -381,6 +452,9 @@ func ParseFlagsWithConfig(flags *flag_.FlagSet, arguments []string, configPath,
 			// generate args list for flag.Parse as it was from cli args
 			flags.VisitAll(func(flag *flag_.Flag) {
 				// generate only args that wasn't set from cli
+				if _, cliOnly := cliOnlyFlags[flag.Name]; cliOnly {
+					return
+				}
 				if _, alreadySet := setArgs[flag.Name]; !alreadySet {
 					if value, yamlOk := yamlConfig[flag.Name]; yamlOk {
 						if value != nil {
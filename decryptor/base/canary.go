@@ -0,0 +1,195 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package base
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/cossacklabs/acra/logging"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// Labels and values of canary check results
+const (
+	CanaryResultLabel    = "result"
+	CanaryResultSuccess  = "success"
+	CanaryResultMismatch = "mismatch"
+	CanaryResultError    = "error"
+)
+
+var (
+	// CanaryCheckCounter collects count of canary decryption checks by result. Mismatch means that canary row was
+	// read but returned value differs from expected plaintext, error means that it couldn't be read.
+	CanaryCheckCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "acraserver_canary_checks_total",
+			Help: "number of canary decryption checks",
+		}, []string{CanaryResultLabel})
+	// CanaryHealthyGauge is 1 if the last canary check succeeded and 0 otherwise
+	CanaryHealthyGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "acraserver_canary_healthy",
+			Help: "1 if the last canary decryption check succeeded, 0 otherwise",
+		})
+	// CanaryLastSuccessGauge is time of the last successful canary check
+	CanaryLastSuccessGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "acraserver_canary_last_success_timestamp_seconds",
+			Help: "Unix time of the last successful canary decryption check",
+		})
+)
+
+var canaryRegisterLock = sync.Once{}
+
+// RegisterCanaryMetrics register in default prometheus registry metrics related with canary checks
+func RegisterCanaryMetrics() {
+	canaryRegisterLock.Do(func() {
+		prometheus.MustRegister(CanaryCheckCounter)
+		prometheus.MustRegister(CanaryHealthyGauge)
+		prometheus.MustRegister(CanaryLastSuccessGauge)
+	})
+}
+
+// Errors returned by CanaryChecker
+var (
+	ErrInvalidCanaryConfig = errors.New("invalid canary check config")
+	ErrCanaryNotChecked    = errors.New("canary isn't checked yet")
+	ErrCanaryMismatch      = errors.New("canary value doesn't match expected plaintext")
+	// ErrCanaryEncrypted is ErrCanaryMismatch for value which AcraServer didn't decrypt, e.g. because of missing key
+	// or wrong encryptor config
+	ErrCanaryEncrypted = fmt.Errorf("%w: value is returned encrypted", ErrCanaryMismatch)
+)
+
+// CanaryChecker periodically reads known encrypted canary row from the database and compares it with expected
+// plaintext. Query should be executed through AcraServer itself, so successful check proves that keys, decryption
+// and database protocol processing work, while broken keys or config are detected before clients notice them.
+// Result of the last check is served as readiness probe.
+type CanaryChecker struct {
+	db       *sql.DB
+	query    string
+	expected []byte
+	interval time.Duration
+	timeout  time.Duration
+	lock     sync.RWMutex
+	err      error
+	logger   *log.Entry
+}
+
+// NewCanaryChecker returns CanaryChecker which executes query on db every interval and waits for result at most
+// timeout. Query should return one row with one column of canary value.
+func NewCanaryChecker(db *sql.DB, query string, expected []byte, interval, timeout time.Duration) (*CanaryChecker, error) {
+	if query == "" {
+		return nil, fmt.Errorf("%w: empty query", ErrInvalidCanaryConfig)
+	}
+	if len(expected) == 0 {
+		return nil, fmt.Errorf("%w: empty expected value", ErrInvalidCanaryConfig)
+	}
+	if interval <= 0 || timeout <= 0 {
+		return nil, fmt.Errorf("%w: interval and timeout should be greater than zero", ErrInvalidCanaryConfig)
+	}
+	return &CanaryChecker{
+		db:       db,
+		query:    query,
+		expected: expected,
+		interval: interval,
+		timeout:  timeout,
+		err:      ErrCanaryNotChecked,
+		logger:   log.WithField("service", "canary"),
+	}, nil
+}
+
+// Run checks canary immediately and then every interval until ctx is done
+func (checker *CanaryChecker) Run(ctx context.Context) {
+	ticker := time.NewTicker(checker.interval)
+	defer ticker.Stop()
+	for {
+		checker.Check(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Check reads canary once, updates result returned by Ready and metrics
+func (checker *CanaryChecker) Check(ctx context.Context) error {
+	err := checker.check(ctx)
+	checker.lock.Lock()
+	previous := checker.err
+	checker.err = err
+	checker.lock.Unlock()
+	switch {
+	case err == nil:
+		CanaryCheckCounter.WithLabelValues(CanaryResultSuccess).Inc()
+		CanaryHealthyGauge.Set(1)
+		CanaryLastSuccessGauge.Set(float64(time.Now().Unix()))
+		if previous != nil {
+			checker.logger.Infoln("Canary decryption check succeeded")
+		}
+		return nil
+	case errors.Is(err, ErrCanaryMismatch):
+		CanaryCheckCounter.WithLabelValues(CanaryResultMismatch).Inc()
+	default:
+		CanaryCheckCounter.WithLabelValues(CanaryResultError).Inc()
+	}
+	CanaryHealthyGauge.Set(0)
+	checker.logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCanaryCheck).
+		Errorln("Canary decryption check failed")
+	return err
+}
+
+func (checker *CanaryChecker) check(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, checker.timeout)
+	defer cancel()
+	var value []byte
+	if err := checker.db.QueryRowContext(ctx, checker.query).Scan(&value); err != nil {
+		return err
+	}
+	if bytes.Equal(value, checker.expected) {
+		return nil
+	}
+	if ValidateAcraStructLength(value) == nil {
+		return ErrCanaryEncrypted
+	}
+	return ErrCanaryMismatch
+}
+
+// Ready returns nil if the last canary check succeeded or its error
+func (checker *CanaryChecker) Ready() error {
+	checker.lock.RLock()
+	defer checker.lock.RUnlock()
+	return checker.err
+}
+
+// ServeHTTP responds with 200 status if the last canary check succeeded and with 503 otherwise, to use as readiness
+// probe
+func (checker *CanaryChecker) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	if err := checker.Ready(); err != nil {
+		http.Error(writer, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	writer.Write([]byte("ok\n"))
+}
@@ -0,0 +1,153 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package base
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// canaryDriver returns configured value or error for any query
+type canaryDriver struct {
+	lock  sync.Mutex
+	value []byte
+	err   error
+}
+
+func (d *canaryDriver) set(value []byte, err error) {
+	d.lock.Lock()
+	d.value, d.err = value, err
+	d.lock.Unlock()
+}
+
+func (d *canaryDriver) Open(name string) (driver.Conn, error) { return &canaryConn{d}, nil }
+
+type canaryConn struct{ driver *canaryDriver }
+
+func (c *canaryConn) Prepare(query string) (driver.Stmt, error) { return &canaryStmt{c.driver}, nil }
+func (c *canaryConn) Close() error                              { return nil }
+func (c *canaryConn) Begin() (driver.Tx, error)                 { return nil, errors.New("not supported") }
+
+type canaryStmt struct{ driver *canaryDriver }
+
+func (s *canaryStmt) Close() error  { return nil }
+func (s *canaryStmt) NumInput() int { return -1 }
+func (s *canaryStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return nil, errors.New("not supported")
+}
+func (s *canaryStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.driver.lock.Lock()
+	defer s.driver.lock.Unlock()
+	if s.driver.err != nil {
+		return nil, s.driver.err
+	}
+	return &canaryRows{value: s.driver.value}, nil
+}
+
+type canaryRows struct {
+	value []byte
+	read  bool
+}
+
+func (r *canaryRows) Columns() []string { return []string{"data"} }
+func (r *canaryRows) Close() error      { return nil }
+func (r *canaryRows) Next(dest []driver.Value) error {
+	if r.read {
+		return io.EOF
+	}
+	r.read = true
+	dest[0] = r.value
+	return nil
+}
+
+func TestCanaryChecker(t *testing.T) {
+	testDriver := &canaryDriver{}
+	sql.Register("canary_test", testDriver)
+	db, err := sql.Open("canary_test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	expected := []byte("canary plaintext")
+	for _, args := range []struct {
+		query    string
+		expected []byte
+		interval time.Duration
+	}{
+		{"", expected, time.Second},
+		{"select data from canary", nil, time.Second},
+		{"select data from canary", expected, 0},
+	} {
+		if _, err := NewCanaryChecker(db, args.query, args.expected, args.interval, time.Second); !errors.Is(err, ErrInvalidCanaryConfig) {
+			t.Fatalf("Expected ErrInvalidCanaryConfig, took %v", err)
+		}
+	}
+	checker, err := NewCanaryChecker(db, "select data from canary", expected, time.Second, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	probe := func() int {
+		recorder := httptest.NewRecorder()
+		checker.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/ready", nil))
+		return recorder.Code
+	}
+	if err := checker.Ready(); err != ErrCanaryNotChecked {
+		t.Fatalf("Expected ErrCanaryNotChecked, took %v", err)
+	}
+	if code := probe(); code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected 503 before check, took %d", code)
+	}
+
+	acraStruct := append(append([]byte{}, TagBegin...), make([]byte, GetMinAcraStructLength()-len(TagBegin))...)
+	dbError := errors.New("connection refused")
+	testcases := []struct {
+		value    []byte
+		err      error
+		expected error
+	}{
+		{expected, nil, nil},
+		{[]byte("other value"), nil, ErrCanaryMismatch},
+		{acraStruct, nil, ErrCanaryEncrypted},
+		{nil, dbError, dbError},
+		{expected, nil, nil},
+	}
+	for i, testcase := range testcases {
+		testDriver.set(testcase.value, testcase.err)
+		err := checker.Check(context.Background())
+		if !errors.Is(err, testcase.expected) || (testcase.expected == nil && err != nil) {
+			t.Fatalf("[%d] Expected %v, took %v", i, testcase.expected, err)
+		}
+		if err != checker.Ready() {
+			t.Fatalf("[%d] Ready returned %v instead of %v", i, checker.Ready(), err)
+		}
+		expectedCode := http.StatusOK
+		if err != nil {
+			expectedCode = http.StatusServiceUnavailable
+		}
+		if code := probe(); code != expectedCode {
+			t.Fatalf("[%d] Expected %d status, took %d", i, expectedCode, code)
+		}
+	}
+}
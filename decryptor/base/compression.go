@@ -0,0 +1,137 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package base
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// CompressionTag starts data compressed before encryption into AcraStruct. Like TimestampTag it is stored inside
+// encrypted payload and followed by CompressionAlgorithm byte. DecryptAcrastruct decompresses such data, so
+// AcraStructs with compressed data are decrypted by all components as usual.
+var CompressionTag = []byte{0, 'A', 'C', 'R', 'A', 'C', 'Z', 1}
+
+// CompressionHeaderLength is length of CompressionTag and CompressionAlgorithm
+const CompressionHeaderLength = 8 + 1
+
+// MaxDecompressedLength limits size of decompressed data to protect from decompression bombs
+const MaxDecompressedLength = 64 * 1024 * 1024
+
+// CompressionAlgorithm identifies algorithm of compressed data in header
+type CompressionAlgorithm byte
+
+// Supported values of CompressionAlgorithm
+const (
+	// CompressionNone means that data isn't compressed and has no header
+	CompressionNone CompressionAlgorithm = 0
+	// CompressionDeflate is DEFLATE of RFC 1951
+	CompressionDeflate CompressionAlgorithm = 1
+	// CompressionZstd is Zstandard of RFC 8878, faster than DEFLATE with similar or better ratio
+	CompressionZstd CompressionAlgorithm = 2
+)
+
+// zstdFrameMagic starts every zstd frame
+var zstdFrameMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// Errors returned by Decompress
+var (
+	ErrUnknownCompression = errors.New("unknown compression algorithm of AcraStruct data")
+	ErrDecompression      = errors.New("can't decompress AcraStruct data")
+)
+
+// Compress returns data compressed with algorithm and prefixed with CompressionTag. Data is returned as is if
+// compression doesn't make it shorter, e.g. for short or random values, so such values don't grow.
+func Compress(data []byte, algorithm CompressionAlgorithm) ([]byte, error) {
+	if algorithm == CompressionNone {
+		return data, nil
+	}
+	output := &bytes.Buffer{}
+	output.Write(CompressionTag)
+	output.WriteByte(byte(algorithm))
+	switch algorithm {
+	case CompressionDeflate:
+		writer, err := flate.NewWriter(output, flate.DefaultCompression)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := writer.Write(data); err != nil {
+			return nil, err
+		}
+		if err := writer.Close(); err != nil {
+			return nil, err
+		}
+	case CompressionZstd:
+		writer, err := zstd.NewWriter(output, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		if _, err := writer.Write(data); err != nil {
+			return nil, err
+		}
+		if err := writer.Close(); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("%w: %d", ErrUnknownCompression, algorithm)
+	}
+	if output.Len() >= len(data) {
+		return data, nil
+	}
+	return output.Bytes(), nil
+}
+
+// Decompress returns decompressed data and its algorithm, data as is and CompressionNone if data has no header
+func Decompress(data []byte) ([]byte, CompressionAlgorithm, error) {
+	if len(data) < CompressionHeaderLength || !bytes.Equal(data[:len(CompressionTag)], CompressionTag) {
+		return data, CompressionNone, nil
+	}
+	algorithm := CompressionAlgorithm(data[len(CompressionTag)])
+	compressed := data[CompressionHeaderLength:]
+	var reader io.ReadCloser
+	switch algorithm {
+	case CompressionDeflate:
+		reader = flate.NewReader(bytes.NewReader(compressed))
+	case CompressionZstd:
+		// decoder returns no data and no error for input without frames, so such input is considered corrupted
+		if !bytes.HasPrefix(compressed, zstdFrameMagic) {
+			return nil, algorithm, fmt.Errorf("%w: no zstd frame", ErrDecompression)
+		}
+		decoder, err := zstd.NewReader(bytes.NewReader(compressed), zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(MaxDecompressedLength+1))
+		if err != nil {
+			return nil, algorithm, fmt.Errorf("%w: %s", ErrDecompression, err)
+		}
+		reader = decoder.IOReadCloser()
+	default:
+		return nil, algorithm, fmt.Errorf("%w: %d", ErrUnknownCompression, algorithm)
+	}
+	defer reader.Close()
+	decompressed, err := ioutil.ReadAll(io.LimitReader(reader, MaxDecompressedLength+1))
+	if err != nil {
+		return nil, algorithm, fmt.Errorf("%w: %s", ErrDecompression, err)
+	}
+	if len(decompressed) > MaxDecompressedLength {
+		return nil, algorithm, fmt.Errorf("%w: decompressed data is longer than %d bytes", ErrDecompression, MaxDecompressedLength)
+	}
+	return decompressed, algorithm, nil
+}
@@ -18,6 +18,7 @@ package base
 
 import (
 	"context"
+	"time"
 
 	"github.com/cossacklabs/acra/keystore"
 	"github.com/cossacklabs/acra/logging"
@@ -60,6 +61,10 @@ func NewDecryptProcessor(processor DataProcessor) DataProcessor {
 
 // Process implement DataProcessor with AcraStruct decryption
 func (DecryptProcessor) Process(data []byte, context *DataProcessorContext) ([]byte, error) {
+	// don't read keys for request which is already cancelled or timed out
+	if err := context.Context.Err(); err != nil {
+		return []byte{}, err
+	}
 	var privateKeys []*keys.PrivateKey
 	var err error
 	if context.WithZone {
@@ -68,12 +73,25 @@ func (DecryptProcessor) Process(data []byte, context *DataProcessorContext) ([]b
 		privateKeys, err = context.Keystore.GetServerDecryptionPrivateKeys(context.ClientID)
 	}
 	defer utils.ZeroizePrivateKeys(privateKeys)
+	logger := logging.GetLoggerFromContext(context.Context)
 	if err != nil {
-		logging.GetLoggerFromContext(context.Context).WithError(err).WithFields(
+		logger.WithError(err).WithFields(
 			logrus.Fields{"client_id": string(context.ClientID), "zone_id": context.ZoneID}).Warningln("Can't read private key for matched client_id/zone_id")
+		LogKeyLookupFailure(logger, context.ClientID, context.ZoneID, err)
 		return []byte{}, err
 	}
-	return DecryptRotatedAcrastruct(data, privateKeys, context.ZoneID)
+	decrypted, created, keyIndex, err := DecryptRotatedAcrastructWithKeyIndex(data, privateKeys, context.ZoneID)
+	context.CreatedAt = created
+	if err != nil {
+		LogDecryptionFailure(logger, context.ClientID, context.ZoneID, data, privateKeys, err)
+		return decrypted, err
+	}
+	AcrastructDecryptionKeyVersionCounter.WithLabelValues(DecryptionKeyVersion(keyIndex)).Inc()
+	if keyIndex > 0 {
+		logger.WithFields(logrus.Fields{"client_id": string(context.ClientID), "zone_id": string(context.ZoneID), "key_version": keyIndex}).
+			Debugln("AcraStruct decrypted with rotated private key")
+	}
+	return decrypted, nil
 }
 
 // DataProcessorContext store data for DataProcessor
@@ -83,6 +101,8 @@ type DataProcessorContext struct {
 	WithZone bool
 	Keystore keystore.PrivateKeyStore
 	Context  context.Context
+	// CreatedAt is creation time of AcraStruct decrypted last by DecryptProcessor, zero if it has no timestamp
+	CreatedAt time.Time
 }
 
 // NewDataProcessorContext return context with initialized static data
@@ -94,6 +114,7 @@ func NewDataProcessorContext(clientID []byte, withZone bool, keystore keystore.P
 func (ctx *DataProcessorContext) Reset() *DataProcessorContext {
 	ctx.ZoneID = nil
 	ctx.Context = context.Background()
+	ctx.CreatedAt = time.Time{}
 	return ctx
 }
 
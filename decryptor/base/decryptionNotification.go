@@ -2,6 +2,7 @@ package base
 
 import (
 	"context"
+	"time"
 
 	"github.com/sirupsen/logrus"
 )
@@ -96,6 +97,41 @@ func ColumnInfoFromContext(ctx context.Context) (ColumnInfo, bool) {
 	return info, ok
 }
 
+// decryptedAcraStruct store AcraStruct decrypted from column and zone id used for decryption
+type decryptedAcraStruct struct {
+	acraStruct []byte
+	zoneID     []byte
+}
+
+type decryptedAcraStructKey struct{}
+
+// NewContextWithDecryptedAcraStruct return new context which marks column data as decrypted from acraStruct with
+// zoneID, nil zoneID means decryption without zone
+func NewContextWithDecryptedAcraStruct(ctx context.Context, acraStruct, zoneID []byte) context.Context {
+	return context.WithValue(ctx, decryptedAcraStructKey{}, decryptedAcraStruct{acraStruct: acraStruct, zoneID: zoneID})
+}
+
+// DecryptedAcraStructFromContext return decrypted AcraStruct, zone id used for decryption and true if column data
+// was decrypted as whole AcraStruct, otherwise false
+func DecryptedAcraStructFromContext(ctx context.Context) ([]byte, []byte, bool) {
+	v, ok := ctx.Value(decryptedAcraStructKey{}).(decryptedAcraStruct)
+	return v.acraStruct, v.zoneID, ok
+}
+
+type acraStructCreationTimeKey struct{}
+
+// NewContextWithAcraStructCreationTime return new context which stores creation time embedded into decrypted AcraStruct
+func NewContextWithAcraStructCreationTime(ctx context.Context, created time.Time) context.Context {
+	return context.WithValue(ctx, acraStructCreationTimeKey{}, created)
+}
+
+// AcraStructCreationTimeFromContext return creation time of decrypted AcraStruct and true if it has timestamp,
+// otherwise zero time and false
+func AcraStructCreationTimeFromContext(ctx context.Context) (time.Time, bool) {
+	created, ok := ctx.Value(acraStructCreationTimeKey{}).(time.Time)
+	return created, ok
+}
+
 // DecryptionSubscriber interface to subscribe on column's data in db responses
 type DecryptionSubscriber interface {
 	OnColumn(context.Context, []byte) (context.Context, []byte, error)
@@ -166,11 +202,15 @@ func (o *ColumnDecryptionObserver) Unsubscribe(subscriber DecryptionSubscriber)
 // OnColumnDecryption notifies all subscribers about a change in given column, passing the context and data to them.
 // Returns the data and error returned by subscribers.
 // If a subscriber returns an error, it is immediately returned and other subscribers are not notified.
+// Subscribers are not notified after ctx is done, its error is returned instead.
 func (o *ColumnDecryptionObserver) OnColumnDecryption(ctx context.Context, column int, data []byte) ([]byte, error) {
 	var err error
 	// Avoid creating a map entry if it does not exist.
 	subscribers, _ := o.perColumn[column]
 	for _, subscriber := range subscribers {
+		if err = ctx.Err(); err != nil {
+			return data, err
+		}
 		ctx, data, err = subscriber.OnColumn(ctx, data)
 		if err != nil {
 			logrus.WithField("subscriber", subscriber.ID()).WithError(err).Errorln("OnColumn error")
@@ -178,6 +218,9 @@ func (o *ColumnDecryptionObserver) OnColumnDecryption(ctx context.Context, colum
 		}
 	}
 	for _, subscriber := range o.allColumns {
+		if err = ctx.Err(); err != nil {
+			return data, err
+		}
 		ctx, data, err = subscriber.OnColumn(ctx, data)
 		if err != nil {
 			logrus.WithField("subscriber", subscriber.ID()).WithError(err).Errorln("OnColumn error")
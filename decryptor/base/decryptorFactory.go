@@ -26,6 +26,7 @@ type DecryptorSetting struct {
 	withZone             bool
 	checkPoisonRecord    bool
 	wholeMatch           bool
+	inlineFallback       bool
 	keystore             keystore.DecryptionKeyStore
 	poisonCallbacks      *PoisonCallbackStorage
 	encryptorTableSchema config.TableSchemaStore
@@ -51,6 +52,18 @@ func (setting *DecryptorSetting) WholeMatch() bool {
 	return setting.wholeMatch
 }
 
+// InlineFallback return true if AcraStructs should be searched inside values which aren't AcraStructs entirely in
+// wholematch mode
+func (setting *DecryptorSetting) InlineFallback() bool {
+	return setting.inlineFallback
+}
+
+// SetInlineFallback sets whether AcraStructs should be searched inside values which aren't AcraStructs entirely in
+// wholematch mode, e.g. in results of views, CTEs and expressions which don't match columns of encryptor config
+func (setting *DecryptorSetting) SetInlineFallback(value bool) {
+	setting.inlineFallback = value
+}
+
 // CheckPoisonRecord return true if should check poison records
 func (setting *DecryptorSetting) CheckPoisonRecord() bool {
 	return setting.checkPoisonRecord
@@ -0,0 +1,161 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package base
+
+import (
+	"sync"
+	"time"
+
+	"github.com/cossacklabs/acra/logging"
+	"github.com/cossacklabs/acra/utils"
+	"github.com/cossacklabs/themis/gothemis/keys"
+	"github.com/sirupsen/logrus"
+)
+
+// DecryptionStage describes step of AcraStruct decryption
+type DecryptionStage string
+
+// Stages of AcraStruct decryption reported by diagnostics
+const (
+	DecryptionStageSuccess DecryptionStage = ""
+	// AcraStruct has invalid begin tag or length
+	DecryptionStageEnvelopeParse DecryptionStage = "envelope_parse"
+	// private key for client ID or zone ID can't be loaded from keystore
+	DecryptionStageKeyLookup DecryptionStage = "key_lookup"
+	// symmetric key can't be derived from key block with private key of client or zone, AcraStruct encrypted with
+	// another key (including key of another zone, it isn't distinguishable from wrong or rotated key)
+	DecryptionStageKDF DecryptionStage = "kdf"
+	// encrypted data can't be authenticated with derived key, data is corrupted
+	DecryptionStageAEAD DecryptionStage = "aead_tag_mismatch"
+	// encrypted data can be authenticated only without zone ID, AcraStruct created without zone
+	DecryptionStageZoneMismatch DecryptionStage = "zone_mismatch"
+)
+
+// DefaultDecryptionDiagnosticsDuration used when diagnostics enabled without explicit duration
+const DefaultDecryptionDiagnosticsDuration = time.Minute * 10
+
+// DecryptionDiagnostics stores client IDs for which verbose diagnostics of decryption failures is enabled until
+// expiration time. It is safe for concurrent use.
+type DecryptionDiagnostics struct {
+	lock    sync.RWMutex
+	clients map[string]time.Time
+	now     func() time.Time
+}
+
+// NewDecryptionDiagnostics returns DecryptionDiagnostics without enabled clients
+func NewDecryptionDiagnostics() *DecryptionDiagnostics {
+	return &DecryptionDiagnostics{clients: make(map[string]time.Time), now: time.Now}
+}
+
+// defaultDecryptionDiagnostics used by decryptors of all services
+var defaultDecryptionDiagnostics = NewDecryptionDiagnostics()
+
+// GetDecryptionDiagnostics returns DecryptionDiagnostics used by decryptors
+func GetDecryptionDiagnostics() *DecryptionDiagnostics {
+	return defaultDecryptionDiagnostics
+}
+
+// Enable diagnostics for clientID for duration
+func (diagnostics *DecryptionDiagnostics) Enable(clientID []byte, duration time.Duration) {
+	diagnostics.lock.Lock()
+	diagnostics.clients[string(clientID)] = diagnostics.now().Add(duration)
+	diagnostics.lock.Unlock()
+	logrus.WithFields(logrus.Fields{"client_id": string(clientID), "duration": duration}).Infoln("Enabled decryption failure diagnostics")
+}
+
+// Disable diagnostics for clientID
+func (diagnostics *DecryptionDiagnostics) Disable(clientID []byte) {
+	diagnostics.lock.Lock()
+	delete(diagnostics.clients, string(clientID))
+	diagnostics.lock.Unlock()
+	logrus.WithField("client_id", string(clientID)).Infoln("Disabled decryption failure diagnostics")
+}
+
+// IsEnabled returns true if diagnostics for clientID is enabled and not expired
+func (diagnostics *DecryptionDiagnostics) IsEnabled(clientID []byte) bool {
+	diagnostics.lock.RLock()
+	expiration, ok := diagnostics.clients[string(clientID)]
+	diagnostics.lock.RUnlock()
+	if !ok {
+		return false
+	}
+	if diagnostics.now().After(expiration) {
+		diagnostics.lock.Lock()
+		// check that it wasn't re-enabled concurrently
+		if current, ok := diagnostics.clients[string(clientID)]; ok && current.Equal(expiration) {
+			delete(diagnostics.clients, string(clientID))
+		}
+		diagnostics.lock.Unlock()
+		return false
+	}
+	return true
+}
+
+// DiagnoseRotatedAcrastruct returns the furthest stage reached while decrypting data with any of privateKeys.
+// Returns DecryptionStageSuccess if data can be decrypted.
+func DiagnoseRotatedAcrastruct(data []byte, privateKeys []*keys.PrivateKey, zone []byte) DecryptionStage {
+	if len(privateKeys) == 0 {
+		return DecryptionStageKeyLookup
+	}
+	stages := map[DecryptionStage]int{
+		DecryptionStageEnvelopeParse: 0,
+		DecryptionStageKDF:           1,
+		DecryptionStageAEAD:          2,
+		DecryptionStageZoneMismatch:  3,
+	}
+	result := DecryptionStageEnvelopeParse
+	for _, privateKey := range privateKeys {
+		decrypted, stage, _ := decryptAcrastruct(data, privateKey, zone, true)
+		if stage == DecryptionStageSuccess {
+			utils.ZeroizeBytes(decrypted)
+			return DecryptionStageSuccess
+		}
+		if stages[stage] > stages[result] {
+			result = stage
+		}
+	}
+	return result
+}
+
+// LogKeyLookupFailure logs that keys for AcraStruct decryption can't be loaded if diagnostics is enabled for clientID
+func LogKeyLookupFailure(logger *logrus.Entry, clientID, zoneID []byte, err error) {
+	if !GetDecryptionDiagnostics().IsEnabled(clientID) {
+		return
+	}
+	logger.WithError(err).WithFields(logrus.Fields{
+		logging.FieldKeyEventCode: logging.EventCodeErrorDecryptionDiagnostics,
+		"client_id":               string(clientID),
+		"zone_id":                 string(zoneID),
+		"stage":                   DecryptionStageKeyLookup,
+	}).Warningln("Decryption failure diagnostics")
+}
+
+// LogDecryptionFailure logs stage on which AcraStruct decryption with privateKeys failed if diagnostics is enabled for
+// clientID. Only lengths and identifiers are logged, never keys or decrypted data.
+func LogDecryptionFailure(logger *logrus.Entry, clientID, zoneID []byte, data []byte, privateKeys []*keys.PrivateKey, err error) {
+	if !GetDecryptionDiagnostics().IsEnabled(clientID) {
+		return
+	}
+	logger.WithError(err).WithFields(logrus.Fields{
+		logging.FieldKeyEventCode: logging.EventCodeErrorDecryptionDiagnostics,
+		"client_id":               string(clientID),
+		"zone_id":                 string(zoneID),
+		"stage":                   DiagnoseRotatedAcrastruct(data, privateKeys, zoneID),
+		"acrastruct_length":       len(data),
+		"keys_count":              len(privateKeys),
+	}).Warningln("Decryption failure diagnostics")
+}
@@ -0,0 +1,96 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package base_test
+
+import (
+	"testing"
+	"time"
+
+	acrawriter "github.com/cossacklabs/acra/acra-writer"
+	"github.com/cossacklabs/acra/decryptor/base"
+	"github.com/cossacklabs/themis/gothemis/keys"
+)
+
+func TestDiagnoseRotatedAcrastruct(t *testing.T) {
+	keypair, err := keys.New(keys.TypeEC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	anotherKeypair, err := keys.New(keys.TypeEC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zoneID := []byte("DDDDDDDDzone")
+	withZone, err := acrawriter.CreateAcrastruct([]byte("data"), keypair.Public, zoneID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	withoutZone, err := acrawriter.CreateAcrastruct([]byte("data"), keypair.Public, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupted := append([]byte{}, withZone...)
+	corrupted[len(corrupted)-1] ^= 0xff
+
+	testCases := []struct {
+		name     string
+		data     []byte
+		keys     []*keys.PrivateKey
+		zone     []byte
+		expected base.DecryptionStage
+	}{
+		{"valid", withZone, []*keys.PrivateKey{keypair.Private}, zoneID, base.DecryptionStageSuccess},
+		{"short", withZone[:10], []*keys.PrivateKey{keypair.Private}, zoneID, base.DecryptionStageEnvelopeParse},
+		{"no keys", withZone, nil, zoneID, base.DecryptionStageKeyLookup},
+		{"wrong key", withZone, []*keys.PrivateKey{anotherKeypair.Private}, zoneID, base.DecryptionStageKDF},
+		{"wrong key without zone", withoutZone, []*keys.PrivateKey{anotherKeypair.Private}, nil, base.DecryptionStageKDF},
+		{"rotated keys", withZone, []*keys.PrivateKey{anotherKeypair.Private, keypair.Private}, zoneID, base.DecryptionStageSuccess},
+		{"corrupted", corrupted, []*keys.PrivateKey{anotherKeypair.Private, keypair.Private}, zoneID, base.DecryptionStageAEAD},
+		{"without zone", withoutZone, []*keys.PrivateKey{keypair.Private}, zoneID, base.DecryptionStageZoneMismatch},
+	}
+	for _, testCase := range testCases {
+		if stage := base.DiagnoseRotatedAcrastruct(testCase.data, testCase.keys, testCase.zone); stage != testCase.expected {
+			t.Errorf("%s: expected stage '%s', took '%s'", testCase.name, testCase.expected, stage)
+		}
+	}
+	// diagnostics shouldn't change original data
+	if _, err := base.DecryptAcrastruct(withZone, keypair.Private, zoneID); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDecryptionDiagnostics(t *testing.T) {
+	diagnostics := base.NewDecryptionDiagnostics()
+	clientID := []byte("client")
+	if diagnostics.IsEnabled(clientID) {
+		t.Fatal("Diagnostics shouldn't be enabled by default")
+	}
+	diagnostics.Enable(clientID, time.Minute)
+	if !diagnostics.IsEnabled(clientID) {
+		t.Fatal("Diagnostics should be enabled")
+	}
+	if diagnostics.IsEnabled([]byte("another client")) {
+		t.Fatal("Diagnostics should be enabled only for one client")
+	}
+	diagnostics.Disable(clientID)
+	if diagnostics.IsEnabled(clientID) {
+		t.Fatal("Diagnostics should be disabled")
+	}
+	diagnostics.Enable(clientID, -time.Second)
+	if diagnostics.IsEnabled(clientID) {
+		t.Fatal("Diagnostics should be expired")
+	}
+}
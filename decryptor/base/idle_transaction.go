@@ -0,0 +1,192 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package base
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cossacklabs/acra/featureflags"
+	"github.com/cossacklabs/acra/logging"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// Actions for sessions idle in transaction longer than timeout
+const (
+	IdleInTransactionActionLog       = "log"
+	IdleInTransactionActionTerminate = "terminate"
+)
+
+// IdleInTransactionActions is a list of supported actions for sessions idle in transaction
+var IdleInTransactionActions = []string{IdleInTransactionActionLog, IdleInTransactionActionTerminate}
+
+// IdleInTransactionActionLabel is label of IdleInTransactionCounter with action taken for session
+const IdleInTransactionActionLabel = "action"
+
+// IdleInTransactionCounter collects count of sessions which stayed idle in transaction longer than timeout
+var IdleInTransactionCounter = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "acraserver_idle_in_transaction_sessions_total",
+		Help: "number of client sessions idle in transaction longer than timeout",
+	}, []string{IdleInTransactionActionLabel})
+
+var idleInTransactionRegisterLock = sync.Once{}
+
+// RegisterIdleInTransactionMetrics register in default prometheus registry metrics related with sessions idle in
+// transaction
+func RegisterIdleInTransactionMetrics() {
+	idleInTransactionRegisterLock.Do(func() {
+		prometheus.MustRegister(IdleInTransactionCounter)
+	})
+}
+
+// Errors returned for invalid configuration of idle in transaction watchdog
+var (
+	ErrInvalidIdleInTransactionTimeout = errors.New("idle in transaction timeout should be greater than zero")
+	ErrInvalidIdleInTransactionAction  = errors.New("invalid action for sessions idle in transaction")
+)
+
+// IdleInTransactionPolicy describes how long client sessions may stay idle inside open transaction and what to do with
+// sessions which exceed it
+type IdleInTransactionPolicy struct {
+	timeout time.Duration
+	action  string
+}
+
+// NewIdleInTransactionPolicy returns IdleInTransactionPolicy with timeout and one of IdleInTransactionActions
+func NewIdleInTransactionPolicy(timeout time.Duration, action string) (*IdleInTransactionPolicy, error) {
+	if timeout <= 0 {
+		return nil, ErrInvalidIdleInTransactionTimeout
+	}
+	switch action {
+	case IdleInTransactionActionLog, IdleInTransactionActionTerminate:
+	default:
+		return nil, fmt.Errorf("%w '%s', expected one of '%s'", ErrInvalidIdleInTransactionAction, action,
+			strings.Join(IdleInTransactionActions, "', '"))
+	}
+	return &IdleInTransactionPolicy{timeout: timeout, action: action}, nil
+}
+
+// Timeout returns how long session may stay idle in transaction
+func (policy *IdleInTransactionPolicy) Timeout() time.Duration {
+	return policy.timeout
+}
+
+// Action returns action for sessions idle in transaction longer than timeout
+func (policy *IdleInTransactionPolicy) Action() string {
+	return policy.action
+}
+
+// IdleInTransactionTerminateFlag is feature flag which gates IdleInTransactionActionTerminate, sessions for which
+// it's disabled are only logged
+const IdleInTransactionTerminateFlag = "idle_in_transaction_terminate"
+
+// ForSession returns policy for new session of clientID, terminate action is replaced with log if flags disable
+// IdleInTransactionTerminateFlag for the session
+func (policy *IdleInTransactionPolicy) ForSession(flags *featureflags.Flags, clientID []byte) *IdleInTransactionPolicy {
+	if policy.action != IdleInTransactionActionTerminate || flags.Enabled(IdleInTransactionTerminateFlag, clientID, true) {
+		return policy
+	}
+	return &IdleInTransactionPolicy{timeout: policy.timeout, action: IdleInTransactionActionLog}
+}
+
+// IdleInTransactionWatchdog tracks one client session and alerts about it or closes its connections when the session
+// stays idle in transaction longer than timeout of policy, because such sessions hold locks of the database. Proxies
+// call TransactionIdle when the database finished response inside transaction and Activity on every packet of client.
+type IdleInTransactionWatchdog struct {
+	policy  *IdleInTransactionPolicy
+	session ClientSession
+	logger  *log.Entry
+
+	lock sync.Mutex
+	// generation is increased on every activity, so expired timers of previous idle periods are ignored
+	generation uint64
+	timer      *time.Timer
+	stopped    bool
+}
+
+// NewIdleInTransactionWatchdog returns IdleInTransactionWatchdog of session
+func NewIdleInTransactionWatchdog(policy *IdleInTransactionPolicy, session ClientSession, logger *log.Entry) *IdleInTransactionWatchdog {
+	return &IdleInTransactionWatchdog{policy: policy, session: session, logger: logger}
+}
+
+// TransactionIdle starts waiting for activity of client inside open transaction if it isn't started yet
+func (watchdog *IdleInTransactionWatchdog) TransactionIdle() {
+	watchdog.lock.Lock()
+	defer watchdog.lock.Unlock()
+	if watchdog.stopped || watchdog.timer != nil {
+		return
+	}
+	generation := watchdog.generation
+	watchdog.timer = time.AfterFunc(watchdog.policy.timeout, func() {
+		watchdog.expire(generation)
+	})
+}
+
+// Activity stops waiting started by TransactionIdle
+func (watchdog *IdleInTransactionWatchdog) Activity() {
+	watchdog.lock.Lock()
+	defer watchdog.lock.Unlock()
+	watchdog.reset()
+}
+
+// Stop stops watching session, should be called when session ends
+func (watchdog *IdleInTransactionWatchdog) Stop() {
+	watchdog.lock.Lock()
+	defer watchdog.lock.Unlock()
+	watchdog.reset()
+	watchdog.stopped = true
+}
+
+// reset stops timer of current idle period, should be called under lock
+func (watchdog *IdleInTransactionWatchdog) reset() {
+	watchdog.generation++
+	if watchdog.timer != nil {
+		watchdog.timer.Stop()
+		watchdog.timer = nil
+	}
+}
+
+// expire takes action of policy if session is still idle in the same transaction
+func (watchdog *IdleInTransactionWatchdog) expire(generation uint64) {
+	watchdog.lock.Lock()
+	defer watchdog.lock.Unlock()
+	if watchdog.stopped || watchdog.generation != generation {
+		return
+	}
+	watchdog.timer = nil
+	IdleInTransactionCounter.WithLabelValues(watchdog.policy.action).Inc()
+	logger := watchdog.logger.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorIdleInTransaction).
+		WithField("timeout", watchdog.policy.timeout.String())
+	if watchdog.policy.action != IdleInTransactionActionTerminate {
+		logger.Warningln("Client session is idle in transaction longer than timeout")
+		return
+	}
+	logger.Warningln("Terminate client session idle in transaction longer than timeout")
+	watchdog.stopped = true
+	// proxies of session stop on errors of closed connections and the database rolls back the transaction
+	if err := watchdog.session.ClientConnection().Close(); err != nil {
+		logger.WithError(err).Debugln("Can't close client connection")
+	}
+	if err := watchdog.session.DatabaseConnection().Close(); err != nil {
+		logger.WithError(err).Debugln("Can't close database connection")
+	}
+}
@@ -0,0 +1,155 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package base
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/cossacklabs/acra/featureflags"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	log "github.com/sirupsen/logrus"
+)
+
+type testClientSession struct {
+	clientConnection   net.Conn
+	databaseConnection net.Conn
+}
+
+func (session *testClientSession) Context() context.Context                               { return context.Background() }
+func (session *testClientSession) ClientConnection() net.Conn                             { return session.clientConnection }
+func (session *testClientSession) DatabaseConnection() net.Conn                           { return session.databaseConnection }
+func (session *testClientSession) PreparedStatementRegistry() PreparedStatementRegistry   { return nil }
+func (session *testClientSession) SetPreparedStatementRegistry(PreparedStatementRegistry) {}
+func (session *testClientSession) ProtocolState() interface{}                             { return nil }
+func (session *testClientSession) SetProtocolState(interface{})                           {}
+
+func TestNewIdleInTransactionPolicy(t *testing.T) {
+	if _, err := NewIdleInTransactionPolicy(0, IdleInTransactionActionLog); err != ErrInvalidIdleInTransactionTimeout {
+		t.Fatalf("Expected ErrInvalidIdleInTransactionTimeout, took %v", err)
+	}
+	if _, err := NewIdleInTransactionPolicy(time.Second, "kill"); !errors.Is(err, ErrInvalidIdleInTransactionAction) {
+		t.Fatalf("Expected ErrInvalidIdleInTransactionAction, took %v", err)
+	}
+	for _, action := range IdleInTransactionActions {
+		policy, err := NewIdleInTransactionPolicy(time.Second, action)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if policy.Timeout() != time.Second || policy.Action() != action {
+			t.Fatalf("Unexpected policy %v, %s", policy.Timeout(), policy.Action())
+		}
+	}
+}
+
+func TestIdleInTransactionPolicyForSession(t *testing.T) {
+	file, err := ioutil.TempFile("", "feature_flags")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.WriteString("flags:\n  - name: " + IdleInTransactionTerminateFlag + "\n    percentage: 0\n    client_ids: [canary]\n"); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	flags, err := featureflags.NewFlags(featureflags.NewFileSource(file.Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy, err := NewIdleInTransactionPolicy(time.Second, IdleInTransactionActionTerminate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if policy.ForSession(nil, []byte("client")) != policy || policy.ForSession(flags, []byte("canary")) != policy {
+		t.Fatal("Terminate action should be kept without flags and for enabled clients")
+	}
+	sessionPolicy := policy.ForSession(flags, []byte("client"))
+	if sessionPolicy.Action() != IdleInTransactionActionLog || sessionPolicy.Timeout() != policy.Timeout() {
+		t.Fatalf("Expected log action for disabled client, took %s", sessionPolicy.Action())
+	}
+}
+
+func TestIdleInTransactionWatchdog(t *testing.T) {
+	client, clientPeer := net.Pipe()
+	defer clientPeer.Close()
+	database, databasePeer := net.Pipe()
+	defer databasePeer.Close()
+	session := &testClientSession{clientConnection: client, databaseConnection: database}
+
+	policy, err := NewIdleInTransactionPolicy(time.Millisecond*50, IdleInTransactionActionTerminate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	terminated := IdleInTransactionCounter.WithLabelValues(IdleInTransactionActionTerminate)
+	before := testutil.ToFloat64(terminated)
+	watchdog := NewIdleInTransactionWatchdog(policy, session, log.NewEntry(log.StandardLogger()))
+
+	// activity of client before timeout keeps session open
+	watchdog.TransactionIdle()
+	time.Sleep(policy.Timeout() / 2)
+	watchdog.Activity()
+	time.Sleep(policy.Timeout())
+	if value := testutil.ToFloat64(terminated); value != before {
+		t.Fatalf("Session terminated after activity of client, counter %v", value)
+	}
+
+	watchdog.TransactionIdle()
+	// read of peers ends when connections of session are closed
+	clientPeer.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := clientPeer.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Expected closed client connection, took %v", err)
+	}
+	databasePeer.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := databasePeer.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Expected closed database connection, took %v", err)
+	}
+	if value := testutil.ToFloat64(terminated); value != before+1 {
+		t.Fatalf("Expected terminated session counted, took %v", value)
+	}
+	watchdog.Stop()
+}
+
+func TestIdleInTransactionWatchdogStop(t *testing.T) {
+	client, clientPeer := net.Pipe()
+	defer client.Close()
+	defer clientPeer.Close()
+	database, databasePeer := net.Pipe()
+	defer database.Close()
+	defer databasePeer.Close()
+	session := &testClientSession{clientConnection: client, databaseConnection: database}
+
+	policy, err := NewIdleInTransactionPolicy(time.Millisecond*20, IdleInTransactionActionTerminate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	watchdog := NewIdleInTransactionWatchdog(policy, session, log.NewEntry(log.StandardLogger()))
+	watchdog.TransactionIdle()
+	watchdog.Stop()
+	// stopped watchdog doesn't start new idle periods
+	watchdog.TransactionIdle()
+	time.Sleep(policy.Timeout() * 3)
+	clientPeer.SetReadDeadline(time.Now().Add(policy.Timeout()))
+	if _, err := clientPeer.Read(make([]byte, 1)); err == io.EOF {
+		t.Fatal("Connection of stopped watchdog closed")
+	}
+}
@@ -64,6 +64,7 @@ func NewOnQueryObjectFromQuery(query string) OnQueryObject {
 
 // BoundValue is a value provided for prepared statement execution.
 // Its exact type and meaning depends on the corresponding query.
+// Data of NULL value is nil, while empty values have non-nil zero-length data.
 type BoundValue interface {
 	Data() []byte
 	Format() BoundValueFormat
@@ -0,0 +1,40 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package base
+
+import (
+	"errors"
+	"fmt"
+)
+
+// DefaultMaxPacketSize is maximal size of packet payload read from client or database, 1 GiB is max_allowed_packet
+// limit of MySQL and limit of message size of PostgreSQL
+const DefaultMaxPacketSize = 1 << 30
+
+// ErrPacketTooLarge returned when packet declares length greater than configured max packet size
+var ErrPacketTooLarge = errors.New("packet exceeds max packet size")
+
+// ErrInvalidMaxPacketSize returned for max packet size out of range (0, DefaultMaxPacketSize]
+var ErrInvalidMaxPacketSize = fmt.Errorf("max packet size should be greater than zero and not greater than %d", DefaultMaxPacketSize)
+
+// ValidateMaxPacketSize returns ErrInvalidMaxPacketSize if size can't be used as max packet size
+func ValidateMaxPacketSize(size int) error {
+	if size <= 0 || size > DefaultMaxPacketSize {
+		return ErrInvalidMaxPacketSize
+	}
+	return nil
+}
@@ -0,0 +1,206 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package base
+
+import (
+	"errors"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Labels of pipeline metrics
+const (
+	PipelineLabel      = "pipeline"
+	PipelineStageLabel = "stage"
+)
+
+// Errors returned for invalid pipelines
+var (
+	ErrInvalidPipelineQueueSize = errors.New("pipeline queue size should be greater than zero")
+	ErrEmptyPipeline            = errors.New("pipeline should have at least one stage")
+)
+
+var (
+	// PipelineStageProcessingTimeHistogram collect metrics about time of processing of packets by stages of pipelines
+	PipelineStageProcessingTimeHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "acraserver_pipeline_stage_processing_seconds",
+		Help:    "Time of packet processing by stage of pipeline",
+		Buckets: []float64{0.000001, 0.00001, 0.00002, 0.00003, 0.00004, 0.00005, 0.00006, 0.00007, 0.00008, 0.00009, 0.0001, 0.0005, 0.001, 0.005, 0.01, 1},
+	}, []string{PipelineLabel, PipelineStageLabel})
+
+	// PipelineQueueLengthHistogram collect metrics about count of packets waiting for stages of pipelines
+	PipelineQueueLengthHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "acraserver_pipeline_queue_length",
+		Help:    "Count of packets waiting in queue of stage of pipeline when next packet is queued",
+		Buckets: []float64{0, 1, 2, 4, 8, 16, 32, 64, 128, 256},
+	}, []string{PipelineLabel, PipelineStageLabel})
+
+	// PipelineBackpressureCounter collect metrics about time packets waited for full queues of stages of pipelines
+	PipelineBackpressureCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "acraserver_pipeline_backpressure_seconds_total",
+		Help: "Time previous stages of pipeline waited until queue of stage has place for next packet",
+	}, []string{PipelineLabel, PipelineStageLabel})
+)
+
+// PipelineStage is step of packet processing. Process returns false if packet shouldn't be passed to next stages.
+type PipelineStage struct {
+	Name    string
+	Process func(packet interface{}) (bool, error)
+}
+
+type pipelineStageMetrics struct {
+	processingTime prometheus.Observer
+	queueLength    prometheus.Observer
+	backpressure   prometheus.Counter
+}
+
+// Pipeline runs every stage of packet processing in own goroutine, stages are connected with bounded queues and
+// process packets in order they were read. When some stage is slow (e.g. client doesn't read responses or database
+// doesn't accept queries), its queue fills up and previous stages wait, so slow peer stops reading of packets instead
+// of growing memory of buffered packets.
+type Pipeline struct {
+	name      string
+	queueSize int
+	stages    []PipelineStage
+	metrics   []pipelineStageMetrics
+}
+
+// NewPipeline returns pipeline with stages which queues hold up to queueSize packets
+func NewPipeline(name string, queueSize int, stages ...PipelineStage) (*Pipeline, error) {
+	if queueSize < 1 {
+		return nil, ErrInvalidPipelineQueueSize
+	}
+	if len(stages) == 0 {
+		return nil, ErrEmptyPipeline
+	}
+	metrics := make([]pipelineStageMetrics, len(stages))
+	for i, stage := range stages {
+		metrics[i] = pipelineStageMetrics{
+			processingTime: PipelineStageProcessingTimeHistogram.WithLabelValues(name, stage.Name),
+			queueLength:    PipelineQueueLengthHistogram.WithLabelValues(name, stage.Name),
+			backpressure:   PipelineBackpressureCounter.WithLabelValues(name, stage.Name),
+		}
+	}
+	return &Pipeline{name: name, queueSize: queueSize, stages: stages, metrics: metrics}, nil
+}
+
+// Run passes packets returned by read through stages until read returns error. Error of read is returned after all
+// read packets are processed, first error of any stage is returned immediately, read is expected to be interrupted by
+// caller then (e.g. by closing of connection).
+func (pipeline *Pipeline) Run(read func() (interface{}, error)) error {
+	done := make(chan struct{})
+	defer close(done)
+	finished := make(chan struct{})
+	stageErrors := make(chan error, len(pipeline.stages))
+	queues := make([]chan interface{}, len(pipeline.stages))
+	for i := range queues {
+		queues[i] = make(chan interface{}, pipeline.queueSize)
+	}
+	for i := range pipeline.stages {
+		var next chan interface{}
+		if i+1 < len(queues) {
+			next = queues[i+1]
+		}
+		go pipeline.runStage(i, queues[i], next, done, stageErrors, finished)
+	}
+
+	var readErr error
+	go func() {
+		// closed queue notifies stages that there are no more packets, readErr is visible after it
+		defer close(queues[0])
+		for {
+			packet, err := read()
+			if err != nil {
+				readErr = err
+				return
+			}
+			if !pipeline.push(0, queues[0], packet, done) {
+				return
+			}
+		}
+	}()
+
+	select {
+	case err := <-stageErrors:
+		return err
+	case <-finished:
+		// stage which failed closes its output too
+		select {
+		case err := <-stageErrors:
+			return err
+		default:
+			return readErr
+		}
+	}
+}
+
+func (pipeline *Pipeline) runStage(index int, input, output chan interface{}, done <-chan struct{}, stageErrors chan<- error, finished chan struct{}) {
+	if output != nil {
+		defer close(output)
+	} else {
+		defer close(finished)
+	}
+	stage := pipeline.stages[index]
+	for {
+		var packet interface{}
+		var ok bool
+		select {
+		case packet, ok = <-input:
+			if !ok {
+				return
+			}
+		case <-done:
+			return
+		}
+		start := time.Now()
+		forward, err := stage.Process(packet)
+		pipeline.metrics[index].processingTime.Observe(time.Since(start).Seconds())
+		if err != nil {
+			stageErrors <- err
+			return
+		}
+		if forward && output != nil {
+			if !pipeline.push(index+1, output, packet, done) {
+				return
+			}
+		}
+	}
+}
+
+// push waits until queue of stage has place for packet and returns false if pipeline is stopped
+func (pipeline *Pipeline) push(index int, queue chan interface{}, packet interface{}, done <-chan struct{}) bool {
+	metrics := pipeline.metrics[index]
+	metrics.queueLength.Observe(float64(len(queue)))
+	select {
+	case queue <- packet:
+		return true
+	case <-done:
+		return false
+	default:
+	}
+	start := time.Now()
+	defer func() {
+		metrics.backpressure.Add(time.Since(start).Seconds())
+	}()
+	select {
+	case queue <- packet:
+		return true
+	case <-done:
+		return false
+	}
+}
@@ -0,0 +1,134 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package base
+
+import (
+	"errors"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testPacketReader returns numbers from 0 to count-1 and then io.EOF
+func testPacketReader(count int) func() (interface{}, error) {
+	next := 0
+	return func() (interface{}, error) {
+		if next == count {
+			return nil, io.EOF
+		}
+		next++
+		return next - 1, nil
+	}
+}
+
+func TestPipelineOrder(t *testing.T) {
+	var written []int
+	pipeline, err := NewPipeline("test", 2,
+		PipelineStage{Name: "filter", Process: func(packet interface{}) (bool, error) {
+			// drop odd packets
+			return packet.(int)%2 == 0, nil
+		}},
+		PipelineStage{Name: "write", Process: func(packet interface{}) (bool, error) {
+			written = append(written, packet.(int))
+			return true, nil
+		}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pipeline.Run(testPacketReader(100)); err != io.EOF {
+		t.Fatalf("expected io.EOF after all packets, took %v", err)
+	}
+	if len(written) != 50 {
+		t.Fatalf("expected 50 packets, took %d", len(written))
+	}
+	for i, packet := range written {
+		if packet != i*2 {
+			t.Fatalf("unexpected packet %d at position %d", packet, i)
+		}
+	}
+}
+
+func TestPipelineStageError(t *testing.T) {
+	testErr := errors.New("test error")
+	pipeline, err := NewPipeline("test", 1,
+		PipelineStage{Name: "fail", Process: func(packet interface{}) (bool, error) {
+			if packet.(int) == 3 {
+				return false, testErr
+			}
+			return true, nil
+		}},
+		PipelineStage{Name: "write", Process: func(packet interface{}) (bool, error) {
+			return true, nil
+		}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// reader doesn't stop by itself
+	read := func() (interface{}, error) { return 3, nil }
+	if err := pipeline.Run(read); err != testErr {
+		t.Fatalf("expected stage error, took %v", err)
+	}
+}
+
+func TestPipelineBackpressure(t *testing.T) {
+	const queueSize = 2
+	var read int32
+	release := make(chan struct{})
+	pipeline, err := NewPipeline("test", queueSize,
+		PipelineStage{Name: "parse", Process: func(packet interface{}) (bool, error) {
+			return true, nil
+		}},
+		PipelineStage{Name: "write", Process: func(packet interface{}) (bool, error) {
+			// slow peer
+			<-release
+			return true, nil
+		}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := testPacketReader(100)
+	result := make(chan error, 1)
+	go func() {
+		result <- pipeline.Run(func() (interface{}, error) {
+			atomic.AddInt32(&read, 1)
+			return reader()
+		})
+	}()
+	time.Sleep(time.Millisecond * 100)
+	// every stage holds one packet in processing and one queue of queueSize packets, one more packet waits for queue
+	if count := atomic.LoadInt32(&read); count > 2*queueSize+3 {
+		t.Fatalf("expected reading to be blocked by slow stage, read %d packets", count)
+	}
+	close(release)
+	if err := <-result; err != io.EOF {
+		t.Fatalf("expected io.EOF, took %v", err)
+	}
+}
+
+func TestNewPipelineInvalid(t *testing.T) {
+	stage := PipelineStage{Name: "stage", Process: func(interface{}) (bool, error) { return true, nil }}
+	if _, err := NewPipeline("test", 0, stage); err != ErrInvalidPipelineQueueSize {
+		t.Fatalf("expected ErrInvalidPipelineQueueSize, took %v", err)
+	}
+	if _, err := NewPipeline("test", 1); err != ErrEmptyPipeline {
+		t.Fatalf("expected ErrEmptyPipeline, took %v", err)
+	}
+}
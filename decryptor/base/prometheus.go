@@ -1,8 +1,10 @@
 package base
 
 import (
-	"github.com/prometheus/client_golang/prometheus"
+	"strconv"
 	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 // Labels and values about AcraStruct decryptions status
@@ -12,6 +14,16 @@ const (
 	DecryptionTypeFail    = "fail"
 )
 
+// Labels and values about version of private key which decrypted AcraStruct
+const (
+	DecryptionKeyVersionLabel   = "key_version"
+	DecryptionKeyVersionCurrent = "current"
+	DecryptionKeyVersionOlder   = "older"
+)
+
+// maxLabeledKeyVersion is the oldest rotated key which has own label value, older keys are counted together
+const maxLabeledKeyVersion = 10
+
 // Labels and values about data encryption status
 const (
 	EncryptionTypeLabel   = "status"
@@ -41,6 +53,13 @@ var (
 			Help: "number of AcraStruct decryptions",
 		}, []string{DecryptionTypeLabel})
 
+	// AcrastructDecryptionKeyVersionCounter collect successful decryptions by version of used private key
+	AcrastructDecryptionKeyVersionCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "acra_acrastruct_decryption_key_versions_total",
+			Help: "number of AcraStruct decryptions by version of private key, current or number of rotation back from it",
+		}, []string{DecryptionKeyVersionLabel})
+
 	// APIEncryptionCounter collect encryptions count success/failed
 	APIEncryptionCounter = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
@@ -71,6 +90,9 @@ func RegisterDbProcessingMetrics() {
 	dbRegisterLock.Do(func() {
 		prometheus.MustRegister(ResponseProcessingTimeHistogram)
 		prometheus.MustRegister(RequestProcessingTimeHistogram)
+		prometheus.MustRegister(PipelineStageProcessingTimeHistogram)
+		prometheus.MustRegister(PipelineQueueLengthHistogram)
+		prometheus.MustRegister(PipelineBackpressureCounter)
 	})
 }
 
@@ -78,7 +100,21 @@ func RegisterDbProcessingMetrics() {
 func RegisterAcraStructProcessingMetrics() {
 	acraStructRegisterLock.Do(func() {
 		prometheus.MustRegister(AcrastructDecryptionCounter)
+		prometheus.MustRegister(AcrastructDecryptionKeyVersionCounter)
 		prometheus.MustRegister(APIEncryptionCounter)
 	})
 
 }
+
+// DecryptionKeyVersion returns label value of key version by index of key returned by
+// DecryptRotatedAcrastructWithKeyIndex
+func DecryptionKeyVersion(index int) string {
+	switch {
+	case index == 0:
+		return DecryptionKeyVersionCurrent
+	case index > maxLabeledKeyVersion:
+		return DecryptionKeyVersionOlder
+	default:
+		return strconv.Itoa(index)
+	}
+}
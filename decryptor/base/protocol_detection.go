@@ -0,0 +1,107 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package base
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+// DatabaseProtocol is wire protocol of database client
+type DatabaseProtocol string
+
+// Supported database protocols
+const (
+	PostgreSQLProtocol DatabaseProtocol = "postgresql"
+	MySQLProtocol      DatabaseProtocol = "mysql"
+)
+
+// DefaultProtocolDetectionTimeout is time to wait for the first packet from client. PostgreSQL clients send
+// StartupMessage right after connect while MySQL clients wait for handshake from server.
+const DefaultProtocolDetectionTimeout = time.Millisecond * 300
+
+// ErrUnknownDatabaseProtocol returned when client sent data which isn't PostgreSQL startup packet
+var ErrUnknownDatabaseProtocol = errors.New("unknown database protocol")
+
+// PostgreSQL startup packets start with int32 length and int32 protocol version or request code
+const (
+	pgStartupHeaderLength    = 8
+	pgMaxStartupPacketLength = 10000
+	pgProtocolMajorVersion3  = 3
+	pgCancelRequestCode      = 80877102
+	pgSSLRequestCode         = 80877103
+	pgGSSENCRequestCode      = 80877104
+)
+
+func isPostgreSQLStartupHeader(header []byte) bool {
+	length := binary.BigEndian.Uint32(header[:4])
+	if length < pgStartupHeaderLength || length > pgMaxStartupPacketLength {
+		return false
+	}
+	code := binary.BigEndian.Uint32(header[4:])
+	switch code {
+	case pgCancelRequestCode, pgSSLRequestCode, pgGSSENCRequestCode:
+		return true
+	}
+	return code>>16 == pgProtocolMajorVersion3
+}
+
+// prefixedConn returns already read prefix before data of wrapped connection
+type prefixedConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func (conn *prefixedConn) Read(b []byte) (int, error) {
+	if len(conn.prefix) > 0 {
+		n := copy(b, conn.prefix)
+		conn.prefix = conn.prefix[n:]
+		return n, nil
+	}
+	return conn.Conn.Read(b)
+}
+
+// DetectDatabaseProtocol waits for the first packet from client during timeout. PostgreSQL is detected by valid
+// startup packet header, MySQL is assumed if client sent nothing because it waits for server handshake.
+// Returned connection should be used instead of original one, it replays data read during detection.
+func DetectDatabaseProtocol(conn net.Conn, timeout time.Duration) (DatabaseProtocol, net.Conn, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return "", nil, err
+	}
+	header := make([]byte, pgStartupHeaderLength)
+	n, err := io.ReadFull(conn, header)
+	if resetErr := conn.SetReadDeadline(time.Time{}); resetErr != nil {
+		return "", nil, resetErr
+	}
+	if err != nil {
+		if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+			return "", nil, err
+		}
+		// incomplete packet is neither PostgreSQL startup nor silence of MySQL client
+		if n > 0 {
+			return "", nil, ErrUnknownDatabaseProtocol
+		}
+		return MySQLProtocol, conn, nil
+	}
+	if !isPostgreSQLStartupHeader(header) {
+		return "", nil, ErrUnknownDatabaseProtocol
+	}
+	return PostgreSQLProtocol, &prefixedConn{Conn: conn, prefix: header}, nil
+}
@@ -0,0 +1,82 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package base
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+const testDetectionTimeout = time.Millisecond * 50
+
+// detectWithClientData runs detection on connection where client sends data. Returned function closes connections.
+func detectWithClientData(data []byte) (DatabaseProtocol, net.Conn, func(), error) {
+	server, client := net.Pipe()
+	closeConnections := func() {
+		server.Close()
+		client.Close()
+	}
+	if data != nil {
+		go client.Write(data)
+	}
+	protocol, conn, err := DetectDatabaseProtocol(server, testDetectionTimeout)
+	return protocol, conn, closeConnections, err
+}
+
+func TestDetectDatabaseProtocol(t *testing.T) {
+	// StartupMessage for protocol 3.0 with "user" parameter
+	startupMessage := []byte{0, 0, 0, 17, 0, 3, 0, 0, 'u', 's', 'e', 'r', 0, 'a', 0, 0, 0}
+	sslRequest := []byte{0, 0, 0, 8, 4, 210, 22, 47}
+	for _, packet := range [][]byte{startupMessage, sslRequest} {
+		protocol, conn, closeConnections, err := detectWithClientData(packet)
+		defer closeConnections()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if protocol != PostgreSQLProtocol {
+			t.Fatalf("Expected PostgreSQL, took %s", protocol)
+		}
+		// data read during detection should be replayed
+		replayed := make([]byte, len(packet))
+		if _, err := io.ReadFull(conn, replayed); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(replayed, packet) {
+			t.Fatal("Connection doesn't return packet read during detection")
+		}
+	}
+
+	protocol, _, closeConnections, err := detectWithClientData(nil)
+	defer closeConnections()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if protocol != MySQLProtocol {
+		t.Fatalf("Expected MySQL for silent client, took %s", protocol)
+	}
+
+	for _, data := range [][]byte{[]byte("GET / HTTP/1.1\r\n"), {0, 0, 0}} {
+		_, _, closeConnections, err := detectWithClientData(data)
+		defer closeConnections()
+		if err != ErrUnknownDatabaseProtocol {
+			t.Fatalf("Expected ErrUnknownDatabaseProtocol for %q, took %v", data, err)
+		}
+	}
+}
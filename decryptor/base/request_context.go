@@ -0,0 +1,46 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package base
+
+import (
+	"context"
+	"time"
+)
+
+type requestTimeoutKey struct{}
+
+// NewContextWithRequestTimeout return new context which limits processing of each data row of database responses
+// with timeout, zero timeout means no limit
+func NewContextWithRequestTimeout(ctx context.Context, timeout time.Duration) context.Context {
+	return context.WithValue(ctx, requestTimeoutKey{}, timeout)
+}
+
+// RequestTimeoutFromContext return timeout assigned with NewContextWithRequestTimeout, zero if there is no limit
+func RequestTimeoutFromContext(ctx context.Context) time.Duration {
+	timeout, _ := ctx.Value(requestTimeoutKey{}).(time.Duration)
+	return timeout
+}
+
+// NewRequestContext return context to process one data row of database response. It's cancelled with ctx, e.g.
+// when client disconnects, or after request timeout assigned to ctx. Returned cancel func should be called after
+// processing to release resources.
+func NewRequestContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if timeout := RequestTimeoutFromContext(ctx); timeout > 0 {
+		return context.WithTimeout(ctx, timeout)
+	}
+	return context.WithCancel(ctx)
+}
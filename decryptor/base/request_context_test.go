@@ -0,0 +1,76 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package base
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// cancellingSubscriber cancels request on first call and counts calls
+type cancellingSubscriber struct {
+	cancel context.CancelFunc
+	calls  int
+}
+
+func (s *cancellingSubscriber) OnColumn(ctx context.Context, data []byte) (context.Context, []byte, error) {
+	s.calls++
+	s.cancel()
+	return ctx, data, nil
+}
+
+func (s *cancellingSubscriber) ID() string {
+	return "cancellingSubscriber"
+}
+
+func TestNewRequestContext(t *testing.T) {
+	ctx, cancel := NewRequestContext(context.Background())
+	if _, ok := ctx.Deadline(); ok {
+		t.Fatal("Request without timeout has deadline")
+	}
+	cancel()
+	if ctx.Err() != context.Canceled {
+		t.Fatalf("Expected context.Canceled, took %v", ctx.Err())
+	}
+
+	sessionCtx, cancelSession := context.WithCancel(NewContextWithRequestTimeout(context.Background(), time.Minute))
+	ctx, cancel = NewRequestContext(sessionCtx)
+	defer cancel()
+	if deadline, ok := ctx.Deadline(); !ok || time.Until(deadline) > time.Minute {
+		t.Fatalf("Expected deadline in a minute, took %v", deadline)
+	}
+	// closed session cancels its requests
+	cancelSession()
+	if ctx.Err() != context.Canceled {
+		t.Fatalf("Expected context.Canceled, took %v", ctx.Err())
+	}
+}
+
+func TestOnColumnDecryptionCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	subscriber := &cancellingSubscriber{cancel: cancel}
+	observer := NewColumnDecryptionObserver()
+	observer.SubscribeOnColumnDecryption(0, subscriber)
+	observer.SubscribeOnAllColumnsDecryption(subscriber)
+	if _, err := observer.OnColumnDecryption(ctx, 0, []byte("data")); err != context.Canceled {
+		t.Fatalf("Expected context.Canceled, took %v", err)
+	}
+	if subscriber.calls != 1 {
+		t.Fatalf("Expected subscriber to be called once before cancellation, took %d calls", subscriber.calls)
+	}
+}
@@ -0,0 +1,85 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package base
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/cossacklabs/acra/network"
+)
+
+// SessionIdentitySourceClientID exports client ID of connection, other sources are types of identifiers of verified
+// client certificate from network.IdentifierExtractorTypesList
+const SessionIdentitySourceClientID = "client_id"
+
+// Errors returned for identity which can't be exported into database session
+var (
+	ErrInvalidSessionIdentitySource = errors.New("invalid source of session identity")
+	ErrInvalidSessionIdentity       = errors.New("session identity contains zero bytes")
+)
+
+// SessionIdentity exports identity of client verified by AcraServer into its session with the database, so database
+// auditing attributes queries to the client instead of database user of AcraServer
+type SessionIdentity struct {
+	source    string
+	extractor network.CertificateIdentifierExtractor
+}
+
+// NewSessionIdentity returns SessionIdentity which exports client ID or identifier of client certificate of source
+func NewSessionIdentity(source string) (*SessionIdentity, error) {
+	if source == SessionIdentitySourceClientID {
+		return &SessionIdentity{source: source}, nil
+	}
+	extractor, err := network.NewIdentifierExtractorByType(source)
+	if err != nil {
+		return nil, fmt.Errorf("%w '%s', expected '%s' or one of '%s'", ErrInvalidSessionIdentitySource, source,
+			SessionIdentitySourceClientID, strings.Join(network.IdentifierExtractorTypesList, "', '"))
+	}
+	return &SessionIdentity{source: source, extractor: extractor}, nil
+}
+
+// Value returns identity of client with clientID connected through clientConnection. Identifiers of certificate are
+// taken from verified certificate of TLS connection, serial number is returned in hex.
+func (identity *SessionIdentity) Value(clientID []byte, clientConnection net.Conn) (string, error) {
+	value := clientID
+	if identity.extractor != nil {
+		certificate, err := network.VerifiedPeerCertificate(clientConnection)
+		if err != nil {
+			return "", err
+		}
+		value, err = identity.extractor.GetCertificateIdentifier(certificate)
+		if err != nil {
+			return "", err
+		}
+		if identity.source == network.IdentifierExtractorTypeSerialNumber {
+			value = []byte(hex.EncodeToString(value))
+		}
+	}
+	if len(value) == 0 {
+		return "", network.ErrEmptyIdentifier
+	}
+	// values are sent as null-terminated strings of protocols
+	if bytes.IndexByte(value, 0) >= 0 {
+		return "", ErrInvalidSessionIdentity
+	}
+	return string(value), nil
+}
@@ -0,0 +1,56 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package base
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/cossacklabs/acra/network"
+)
+
+func TestSessionIdentity(t *testing.T) {
+	if _, err := NewSessionIdentity("unknown"); !errors.Is(err, ErrInvalidSessionIdentitySource) {
+		t.Fatalf("Expected ErrInvalidSessionIdentitySource, took %v", err)
+	}
+	identity, err := NewSessionIdentity(SessionIdentitySourceClientID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, err := identity.Value([]byte("client"), nil); err != nil || value != "client" {
+		t.Fatalf("Expected client id, took %q, %v", value, err)
+	}
+	if _, err := identity.Value(nil, nil); err != network.ErrEmptyIdentifier {
+		t.Fatalf("Expected ErrEmptyIdentifier, took %v", err)
+	}
+	if _, err := identity.Value([]byte("client\x00"), nil); err != ErrInvalidSessionIdentity {
+		t.Fatalf("Expected ErrInvalidSessionIdentity, took %v", err)
+	}
+
+	identity, err = NewSessionIdentity(network.IdentifierExtractorTypesList[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	// connections without TLS have no verified certificate
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	if _, err := identity.Value([]byte("client"), server); err != network.ErrNoPeerCertificate {
+		t.Fatalf("Expected ErrNoPeerCertificate, took %v", err)
+	}
+}
@@ -0,0 +1,177 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package base
+
+import (
+	"database/sql"
+	"errors"
+	"sync"
+
+	"github.com/cossacklabs/acra/logging"
+	"github.com/cossacklabs/acra/sqlparser"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// Labels and values of shadow writes statuses
+const (
+	ShadowWriteStatusLabel    = "status"
+	ShadowWriteStatusSuccess  = "success"
+	ShadowWriteStatusDiverged = "diverged"
+	ShadowWriteStatusDropped  = "dropped"
+)
+
+// ShadowWriteCounter collects count of shadow writes by status. Diverged writes are queries which shadow database
+// failed to execute, dropped writes weren't sent because queue was full.
+var ShadowWriteCounter = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "acraserver_shadow_writes_total",
+		Help: "number of write queries duplicated to shadow database",
+	}, []string{ShadowWriteStatusLabel})
+
+var shadowWriteRegisterLock = sync.Once{}
+
+// RegisterShadowWriteMetrics register in default prometheus registry metrics related with shadow writes
+func RegisterShadowWriteMetrics() {
+	shadowWriteRegisterLock.Do(func() {
+		prometheus.MustRegister(ShadowWriteCounter)
+	})
+}
+
+// ErrInvalidShadowWriteQueueSize returned for non-positive size of shadow write queue
+var ErrInvalidShadowWriteQueueSize = errors.New("shadow write queue size should be greater than zero")
+
+type shadowQuery struct {
+	query string
+	args  []interface{}
+}
+
+// ShadowWriter is QueryObserver which duplicates INSERT, UPDATE and DELETE queries to shadow database. It should be
+// registered after other observers to see queries and bound values as they are sent to the database, e.g. already
+// encrypted. Queries are executed asynchronously one by one in order of arrival outside of client transactions and
+// never delay or fail processing of original queries.
+type ShadowWriter struct {
+	db     *sql.DB
+	queue  chan shadowQuery
+	done   chan struct{}
+	logger *log.Entry
+}
+
+// NewShadowWriter returns ShadowWriter which keeps at most queueSize pending queries for db and starts worker
+// executing them
+func NewShadowWriter(db *sql.DB, queueSize int) (*ShadowWriter, error) {
+	if queueSize <= 0 {
+		return nil, ErrInvalidShadowWriteQueueSize
+	}
+	writer := &ShadowWriter{
+		db:     db,
+		queue:  make(chan shadowQuery, queueSize),
+		done:   make(chan struct{}),
+		logger: log.WithField("service", "shadow_writer"),
+	}
+	go writer.run()
+	return writer, nil
+}
+
+func (writer *ShadowWriter) run() {
+	defer close(writer.done)
+	for query := range writer.queue {
+		if _, err := writer.db.Exec(query.query, query.args...); err != nil {
+			writer.logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorShadowWrite).
+				Warningln("Shadow database failed to execute query")
+			ShadowWriteCounter.WithLabelValues(ShadowWriteStatusDiverged).Inc()
+			continue
+		}
+		ShadowWriteCounter.WithLabelValues(ShadowWriteStatusSuccess).Inc()
+	}
+}
+
+// Close stops accepting queries and waits until pending queries are executed
+func (writer *ShadowWriter) Close() {
+	close(writer.queue)
+	<-writer.done
+}
+
+func (writer *ShadowWriter) enqueue(query string, args []interface{}) {
+	select {
+	case writer.queue <- shadowQuery{query: query, args: args}:
+	default:
+		ShadowWriteCounter.WithLabelValues(ShadowWriteStatusDropped).Inc()
+	}
+}
+
+// ID returns name of this QueryObserver.
+func (writer *ShadowWriter) ID() string {
+	return "ShadowWriter"
+}
+
+// isShadowedStatement returns true for statements which modify data
+func isShadowedStatement(statement sqlparser.Statement) bool {
+	switch statement.(type) {
+	case *sqlparser.Insert, *sqlparser.Update, *sqlparser.Delete:
+		return true
+	}
+	return false
+}
+
+// hasPlaceholders returns true if statement has placeholders of prepared statements
+func hasPlaceholders(statement sqlparser.Statement) bool {
+	found := false
+	sqlparser.Walk(func(node sqlparser.SQLNode) (bool, error) {
+		if value, ok := node.(*sqlparser.SQLVal); ok && (value.Type == sqlparser.ValArg || value.Type == sqlparser.PgPlaceholder) {
+			found = true
+		}
+		return !found, nil
+	}, statement)
+	return found
+}
+
+// OnQuery duplicates simple write queries. Prepared statements are duplicated on execution in OnBind.
+func (writer *ShadowWriter) OnQuery(query OnQueryObject) (OnQueryObject, bool, error) {
+	statement, err := query.Statement()
+	if err != nil {
+		writer.logger.WithError(err).Debugln("Can't parse query, skip shadow write")
+		return query, false, nil
+	}
+	if !isShadowedStatement(statement) || hasPlaceholders(statement) {
+		return query, false, nil
+	}
+	writer.enqueue(query.Query(), nil)
+	return query, false, nil
+}
+
+// OnBind duplicates execution of prepared write statements with bound values.
+func (writer *ShadowWriter) OnBind(statement sqlparser.Statement, values []BoundValue) ([]BoundValue, bool, error) {
+	if !isShadowedStatement(statement) {
+		return values, false, nil
+	}
+	args := make([]interface{}, len(values))
+	for i, value := range values {
+		data := value.Data()
+		switch {
+		case data == nil:
+			args[i] = nil
+		case value.Format() == TextFormat:
+			args[i] = string(data)
+		default:
+			// copy because bound data may be reused after processing of packet
+			args[i] = append([]byte{}, data...)
+		}
+	}
+	writer.enqueue(sqlparser.String(statement), args)
+	return values, false, nil
+}
@@ -0,0 +1,126 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package base
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/cossacklabs/acra/sqlparser"
+	"github.com/cossacklabs/acra/sqlparser/dialect/postgresql"
+)
+
+// recordingDriver records executed queries with arguments
+type recordingDriver struct {
+	lock    sync.Mutex
+	queries []string
+}
+
+func (d *recordingDriver) Open(name string) (driver.Conn, error) { return &recordingConn{d}, nil }
+
+type recordingConn struct{ driver *recordingDriver }
+
+func (c *recordingConn) Prepare(query string) (driver.Stmt, error) {
+	return &recordingStmt{c.driver, query}, nil
+}
+func (c *recordingConn) Close() error              { return nil }
+func (c *recordingConn) Begin() (driver.Tx, error) { return nil, errors.New("not supported") }
+
+type recordingStmt struct {
+	driver *recordingDriver
+	query  string
+}
+
+func (s *recordingStmt) Close() error  { return nil }
+func (s *recordingStmt) NumInput() int { return -1 }
+func (s *recordingStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.driver.lock.Lock()
+	defer s.driver.lock.Unlock()
+	s.driver.queries = append(s.driver.queries, fmt.Sprintf("%s %v", s.query, args))
+	return driver.RowsAffected(1), nil
+}
+func (s *recordingStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return nil, errors.New("not supported")
+}
+
+func TestShadowWriter(t *testing.T) {
+	sqlparser.SetDefaultDialect(postgresql.NewPostgreSQLDialect())
+	recorder := &recordingDriver{}
+	sql.Register("shadow_write_test", recorder)
+	db, err := sql.Open("shadow_write_test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := NewShadowWriter(db, 0); err != ErrInvalidShadowWriteQueueSize {
+		t.Fatalf("Expected ErrInvalidShadowWriteQueueSize, took %v", err)
+	}
+	writer, err := NewShadowWriter(db, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	queries := []string{
+		"insert into users(id, email) values (1, 'encrypted')",
+		"select * from users",
+		"update users set email = 'encrypted' where id = 1",
+		"insert into users(id, email) values ($1, $2)",
+		"delete from users where id = 1",
+		"not a query",
+	}
+	for _, query := range queries {
+		newQuery, changed, err := writer.OnQuery(NewOnQueryObjectFromQuery(query))
+		if err != nil || changed || newQuery.Query() != query {
+			t.Fatalf("Query shouldn't be changed: %s", query)
+		}
+	}
+	statement, err := sqlparser.Parse("insert into users(id, email) values ($1, $2)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := []BoundValue{NewBoundValue([]byte("2"), TextFormat), NewBoundValue(nil, TextFormat)}
+	if _, changed, err := writer.OnBind(statement, values); err != nil || changed {
+		t.Fatal("Bound values shouldn't be changed")
+	}
+	selectStatement, err := sqlparser.Parse("select * from users where id = $1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := writer.OnBind(selectStatement, values[:1]); err != nil {
+		t.Fatal(err)
+	}
+	writer.Close()
+
+	expected := []string{
+		"insert into users(id, email) values (1, 'encrypted') []",
+		"update users set email = 'encrypted' where id = 1 []",
+		"delete from users where id = 1 []",
+		"insert into users(id, email) values ($1, $2) [2 <nil>]",
+	}
+	if len(recorder.queries) != len(expected) {
+		t.Fatalf("Expected %d shadow queries, took %v", len(expected), recorder.queries)
+	}
+	for i := range expected {
+		if recorder.queries[i] != expected[i] {
+			t.Fatalf("Unexpected shadow query %q, expected %q", recorder.queries[i], expected[i])
+		}
+	}
+}
@@ -0,0 +1,49 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package base
+
+import (
+	"bytes"
+	"encoding/binary"
+	"time"
+)
+
+// TimestampTag starts data encrypted together with creation time of AcraStruct. Timestamp is stored inside encrypted
+// payload, so it's authenticated and the format of AcraStruct stays the same. DecryptAcrastruct removes it, so
+// AcraStructs with timestamps are decrypted by all components as usual.
+var TimestampTag = []byte{0, 'A', 'C', 'R', 'A', 'T', 'S', 1}
+
+// TimestampLength is length of TimestampTag and creation time in seconds since Unix epoch
+const TimestampLength = 8 + 8
+
+// AddCreationTimestamp returns data prefixed with TimestampTag and created time to encrypt into AcraStruct
+func AddCreationTimestamp(data []byte, created time.Time) []byte {
+	output := make([]byte, TimestampLength+len(data))
+	copy(output, TimestampTag)
+	binary.BigEndian.PutUint64(output[len(TimestampTag):TimestampLength], uint64(created.Unix()))
+	copy(output[TimestampLength:], data)
+	return output
+}
+
+// SplitCreationTimestamp returns data without timestamp and creation time, zero time if data has no timestamp
+func SplitCreationTimestamp(data []byte) ([]byte, time.Time) {
+	if len(data) < TimestampLength || !bytes.Equal(data[:len(TimestampTag)], TimestampTag) {
+		return data, time.Time{}
+	}
+	seconds := binary.BigEndian.Uint64(data[len(TimestampTag):TimestampLength])
+	return data[TimestampLength:], time.Unix(int64(seconds), 0)
+}
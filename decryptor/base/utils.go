@@ -19,8 +19,8 @@ package base
 import (
 	"bytes"
 	"encoding/binary"
-
 	"errors"
+	"time"
 
 	"github.com/cossacklabs/acra/keystore"
 	"github.com/cossacklabs/acra/utils"
@@ -72,45 +72,126 @@ func ValidateAcraStructLength(data []byte) error {
 // using zone as context and privateKey as decryption key.
 // Returns error if decryption failed.
 func DecryptAcrastruct(data []byte, privateKey *keys.PrivateKey, zone []byte) ([]byte, error) {
+	decrypted, _, err := DecryptAcrastructWithTimestamp(data, privateKey, zone)
+	return decrypted, err
+}
+
+// DecryptAcrastructWithTimestamp works like DecryptAcrastruct and additionally returns creation time embedded into
+// AcraStruct, zero time if AcraStruct was created without it
+func DecryptAcrastructWithTimestamp(data []byte, privateKey *keys.PrivateKey, zone []byte) ([]byte, time.Time, error) {
+	payload, err := DecryptAcrastructPayload(data, privateKey, zone)
+	if err != nil {
+		return payload, time.Time{}, err
+	}
+	return splitPayload(payload)
+}
+
+// DecryptAcrastructPayload returns data encrypted into AcraStruct as is, with creation timestamp and compression
+// header if AcraStruct has them, to re-encrypt it without changes
+func DecryptAcrastructPayload(data []byte, privateKey *keys.PrivateKey, zone []byte) ([]byte, error) {
+	payload, _, err := decryptAcrastruct(data, privateKey, zone, false)
+	return payload, err
+}
+
+// splitPayload returns decompressed data and creation time of decrypted payload
+func splitPayload(payload []byte) ([]byte, time.Time, error) {
+	payload, created := SplitCreationTimestamp(payload)
+	decompressed, algorithm, err := Decompress(payload)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if algorithm != CompressionNone {
+		utils.ZeroizeBytes(payload)
+	}
+	return decompressed, created, nil
+}
+
+// decryptAcrastruct implements DecryptAcrastruct and returns stage of decryption on which error occurred.
+// If detectZoneMismatch is true then data which can't be authenticated with zone is additionally checked without it.
+func decryptAcrastruct(data []byte, privateKey *keys.PrivateKey, zone []byte, detectZoneMismatch bool) ([]byte, DecryptionStage, error) {
 	if err := ValidateAcraStructLength(data); err != nil {
-		return nil, err
+		return nil, DecryptionStageEnvelopeParse, err
 	}
 	innerData := data[len(TagBegin):]
 	pubkey := &keys.PublicKey{Value: innerData[:PublicKeyLength]}
 	smessage := message.New(privateKey, pubkey)
 	symmetricKey, err := smessage.Unwrap(innerData[PublicKeyLength:KeyBlockLength])
 	if err != nil {
-		return []byte{}, err
+		return []byte{}, DecryptionStageKDF, err
 	}
 	//
 	var length uint64
 	// convert from little endian
 	err = binary.Read(bytes.NewReader(innerData[KeyBlockLength:KeyBlockLength+DataLengthSize]), binary.LittleEndian, &length)
 	if err != nil {
-		return []byte{}, err
+		utils.ZeroizeSymmetricKey(symmetricKey)
+		return []byte{}, DecryptionStageEnvelopeParse, err
 	}
 	scell := cell.New(symmetricKey, cell.ModeSeal)
 	decrypted, err := scell.Unprotect(innerData[KeyBlockLength+DataLengthSize:], nil, zone)
+	if err != nil && zone != nil && detectZoneMismatch {
+		// data can't be authenticated with zone as context. If it can be without context then AcraStruct
+		// was created without zone, otherwise data or its authentication tag is corrupted
+		if withoutZone, checkErr := scell.Unprotect(innerData[KeyBlockLength+DataLengthSize:], nil, nil); checkErr == nil {
+			utils.ZeroizeBytes(withoutZone)
+			utils.ZeroizeSymmetricKey(symmetricKey)
+			return []byte{}, DecryptionStageZoneMismatch, err
+		}
+	}
 	// fill zero symmetric_key
 	utils.ZeroizeSymmetricKey(symmetricKey)
 	if err != nil {
-		return []byte{}, err
+		return []byte{}, DecryptionStageAEAD, err
 	}
-	return decrypted, nil
+	return decrypted, DecryptionStageSuccess, nil
 }
 
 // DecryptRotatedAcrastruct tries decrypting an AcraStruct with a set of rotated keys.
 // It either returns decrypted data if one of the keys succeeds, or an error if none is good.
 func DecryptRotatedAcrastruct(data []byte, privateKeys []*keys.PrivateKey, zone []byte) ([]byte, error) {
+	decryptedData, _, err := DecryptRotatedAcrastructWithTimestamp(data, privateKeys, zone)
+	return decryptedData, err
+}
+
+// DecryptRotatedAcrastructWithTimestamp works like DecryptRotatedAcrastruct and additionally returns creation time
+// embedded into AcraStruct, zero time if AcraStruct was created without it
+func DecryptRotatedAcrastructWithTimestamp(data []byte, privateKeys []*keys.PrivateKey, zone []byte) ([]byte, time.Time, error) {
+	payload, err := DecryptRotatedAcrastructPayload(data, privateKeys, zone)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return splitPayload(payload)
+}
+
+// DecryptRotatedAcrastructWithKeyIndex works like DecryptRotatedAcrastructWithTimestamp and additionally returns
+// index of the key which decrypted AcraStruct: 0 for current key, 1 and more for rotated ones
+func DecryptRotatedAcrastructWithKeyIndex(data []byte, privateKeys []*keys.PrivateKey, zone []byte) ([]byte, time.Time, int, error) {
+	payload, index, err := decryptRotatedAcrastructPayload(data, privateKeys, zone)
+	if err != nil {
+		return nil, time.Time{}, index, err
+	}
+	decrypted, created, err := splitPayload(payload)
+	return decrypted, created, index, err
+}
+
+// DecryptRotatedAcrastructPayload works like DecryptAcrastructPayload with a set of rotated keys
+func DecryptRotatedAcrastructPayload(data []byte, privateKeys []*keys.PrivateKey, zone []byte) ([]byte, error) {
+	payload, _, err := decryptRotatedAcrastructPayload(data, privateKeys, zone)
+	return payload, err
+}
+
+// decryptRotatedAcrastructPayload tries keys from newest to oldest and returns index of the key which succeeded,
+// -1 if none
+func decryptRotatedAcrastructPayload(data []byte, privateKeys []*keys.PrivateKey, zone []byte) ([]byte, int, error) {
 	var err error = ErrNoPrivateKeys
-	var decryptedData []byte
-	for _, privateKey := range privateKeys {
-		decryptedData, err = DecryptAcrastruct(data, privateKey, zone)
+	var payload []byte
+	for i, privateKey := range privateKeys {
+		payload, err = DecryptAcrastructPayload(data, privateKey, zone)
 		if err == nil {
-			return decryptedData, nil
+			return payload, i, nil
 		}
 	}
-	return nil, err
+	return nil, -1, err
 }
 
 // CheckPoisonRecord checks if AcraStruct could be decrypted using Poison Record private key.
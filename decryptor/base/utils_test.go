@@ -18,7 +18,9 @@ package base_test
 import (
 	"bytes"
 	"crypto/rand"
+	"errors"
 	"testing"
+	"time"
 
 	acrawriter "github.com/cossacklabs/acra/acra-writer"
 	// use another package name and explicit import to avoid cyclic import
@@ -84,6 +86,164 @@ func TestDecryptAcrastruct(t *testing.T) {
 	}
 }
 
+func TestDecryptAcrastructWithTimestamp(t *testing.T) {
+	testData := []byte("some data")
+	keypair, err := keys.New(keys.TypeEC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	created := time.Unix(1600000000, 0)
+	acrastruct, err := acrawriter.CreateAcrastruct(base.AddCreationTimestamp(testData, created), keypair.Public, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKeypair, err := keys.New(keys.TypeEC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decrypted, decryptedCreated, err := base.DecryptRotatedAcrastructWithTimestamp(acrastruct, []*keys.PrivateKey{otherKeypair.Private, keypair.Private}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decrypted, testData) || !decryptedCreated.Equal(created) {
+		t.Fatalf("Expected %s created at %s, took %s created at %s", testData, created, decrypted, decryptedCreated)
+	}
+	// timestamp is removed by usual decryption
+	decrypted, err = base.DecryptAcrastruct(acrastruct, keypair.Private, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decrypted, testData) {
+		t.Fatalf("Expected data without timestamp, took %q", decrypted)
+	}
+
+	acrastruct, err = acrawriter.CreateAcrastruct(testData, keypair.Public, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decrypted, decryptedCreated, err = base.DecryptAcrastructWithTimestamp(acrastruct, keypair.Private, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decrypted, testData) || !decryptedCreated.IsZero() {
+		t.Fatalf("Expected %s without creation time, took %s created at %s", testData, decrypted, decryptedCreated)
+	}
+}
+
+func TestDecryptAcrastructWithCompression(t *testing.T) {
+	testData := bytes.Repeat([]byte(`{"name": "value"}`), 100)
+	keypair, err := keys.New(keys.TypeEC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressed, err := base.Compress(testData, base.CompressionDeflate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(compressed) >= len(testData) || !bytes.HasPrefix(compressed, base.CompressionTag) {
+		t.Fatalf("Expected compressed data with header, took %d bytes of %d", len(compressed), len(testData))
+	}
+	// compression and timestamp may be combined
+	created := time.Unix(1600000000, 0)
+	acrastruct, err := acrawriter.CreateAcrastruct(base.AddCreationTimestamp(compressed, created), keypair.Public, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decrypted, decryptedCreated, err := base.DecryptAcrastructWithTimestamp(acrastruct, keypair.Private, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decrypted, testData) || !decryptedCreated.Equal(created) {
+		t.Fatalf("Expected decompressed data created at %s, took %q created at %s", created, decrypted, decryptedCreated)
+	}
+	// payload keeps headers for re-encryption
+	payload, err := base.DecryptAcrastructPayload(acrastruct, keypair.Private, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(payload, base.AddCreationTimestamp(compressed, created)) {
+		t.Fatalf("Expected payload with headers, took %q", payload)
+	}
+
+	// incompressible data is kept as is
+	randomData := make([]byte, 100)
+	if _, err := rand.Read(randomData); err != nil {
+		t.Fatal(err)
+	}
+	compressed, err = base.Compress(randomData, base.CompressionDeflate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(compressed, randomData) {
+		t.Fatal("Expected uncompressed data")
+	}
+
+	compressedZstd, err := base.Compress(testData, base.CompressionZstd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, corrupted := range [][]byte{
+		append(append([]byte{}, base.CompressionTag...), 0xff, 1, 2, 3),
+		append(append([]byte{}, base.CompressionTag...), byte(base.CompressionDeflate), 0xff, 0xff),
+		append(append([]byte{}, base.CompressionTag...), byte(base.CompressionZstd), 0xff, 0xff),
+		compressedZstd[:len(compressedZstd)-4],
+	} {
+		acrastruct, err = acrawriter.CreateAcrastruct(corrupted, keypair.Public, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := base.DecryptAcrastruct(acrastruct, keypair.Private, nil); err == nil {
+			t.Fatal("Expected error for corrupted compressed data")
+		}
+	}
+}
+
+func TestCompressionRoundTrip(t *testing.T) {
+	randomData := make([]byte, 4096)
+	if _, err := rand.Read(randomData); err != nil {
+		t.Fatal(err)
+	}
+	testData := [][]byte{
+		{},
+		[]byte("a"),
+		bytes.Repeat([]byte(`{"name": "value"}`), 1000),
+		// random data followed by repeated data is partially compressible
+		append(append([]byte{}, randomData...), bytes.Repeat([]byte{0}, 4096)...),
+		randomData,
+	}
+	for _, algorithm := range []base.CompressionAlgorithm{base.CompressionDeflate, base.CompressionZstd} {
+		for i, data := range testData {
+			compressed, err := base.Compress(data, algorithm)
+			if err != nil {
+				t.Fatalf("[%d] algorithm %d: %s", i, algorithm, err)
+			}
+			if len(compressed) > len(data) {
+				t.Fatalf("[%d] algorithm %d: compressed data is longer than source, %d > %d", i, algorithm, len(compressed), len(data))
+			}
+			decompressed, usedAlgorithm, err := base.Decompress(compressed)
+			if err != nil {
+				t.Fatalf("[%d] algorithm %d: %s", i, algorithm, err)
+			}
+			if !bytes.Equal(decompressed, data) {
+				t.Fatalf("[%d] algorithm %d: decompressed data doesn't match source data", i, algorithm)
+			}
+			if bytes.HasPrefix(compressed, base.CompressionTag) != (usedAlgorithm == algorithm) {
+				t.Fatalf("[%d] algorithm %d: unexpected algorithm %d of decompressed data", i, algorithm, usedAlgorithm)
+			}
+		}
+	}
+	// decompression bombs are rejected
+	for _, algorithm := range []base.CompressionAlgorithm{base.CompressionDeflate, base.CompressionZstd} {
+		compressed, err := base.Compress(make([]byte, base.MaxDecompressedLength+1), algorithm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := base.Decompress(compressed); !errors.Is(err, base.ErrDecompression) {
+			t.Fatalf("algorithm %d: expected ErrDecompression, took %v", algorithm, err)
+		}
+	}
+}
+
 func TestValidateAcraStructLength(t *testing.T) {
 	testData := make([]byte, 1000)
 	_, err := rand.Read(testData)
@@ -119,3 +279,38 @@ func TestValidateAcraStructLength(t *testing.T) {
 		t.Fatal("Incorrect validation of AcraStruct data length")
 	}
 }
+
+func TestDecryptRotatedAcrastructWithKeyIndex(t *testing.T) {
+	testData := []byte("some data")
+	privateKeys := make([]*keys.PrivateKey, 3)
+	publicKeys := make([]*keys.PublicKey, 3)
+	for i := range privateKeys {
+		keypair, err := keys.New(keys.TypeEC)
+		if err != nil {
+			t.Fatal(err)
+		}
+		privateKeys[i], publicKeys[i] = keypair.Private, keypair.Public
+	}
+	for i, publicKey := range publicKeys {
+		acrastruct, err := acrawriter.CreateAcrastruct(testData, publicKey, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decrypted, _, index, err := base.DecryptRotatedAcrastructWithKeyIndex(acrastruct, privateKeys, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decrypted, testData) || index != i {
+			t.Fatalf("Expected %s decrypted with key %d, took %s with key %d", testData, i, decrypted, index)
+		}
+		// AcraStruct of the oldest key isn't decrypted if its key isn't tried
+		if _, _, index, err := base.DecryptRotatedAcrastructWithKeyIndex(acrastruct, privateKeys[:i], nil); err == nil || index != -1 {
+			t.Fatalf("Expected decryption error without key %d, took index %d and error %v", i, index, err)
+		}
+	}
+	for index, expected := range map[int]string{0: base.DecryptionKeyVersionCurrent, 1: "1", 10: "10", 11: base.DecryptionKeyVersionOlder} {
+		if version := base.DecryptionKeyVersion(index); version != expected {
+			t.Fatalf("Expected key version %s for index %d, took %s", expected, index, version)
+		}
+	}
+}
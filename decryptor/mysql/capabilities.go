@@ -0,0 +1,153 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mysql
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Capability flags of protocol extensions which change format of packets
+const (
+	// ClientCompress - https://dev.mysql.com/doc/internals/en/capability-flags.html#flag-CLIENT_COMPRESS
+	ClientCompress = 0x00000020
+	// ClientZstdCompressionAlgorithm - CLIENT_ZSTD_COMPRESSION_ALGORITHM of MySQL 8.0.18+ and Percona Server
+	ClientZstdCompressionAlgorithm = 0x04000000
+	// ClientQueryAttributes - CLIENT_QUERY_ATTRIBUTES of MySQL 8.0.23+, prepends attributes to COM_QUERY
+	ClientQueryAttributes = 0x08000000
+	// UninspectableCapabilities are all capabilities which AcraServer doesn't support
+	UninspectableCapabilities = ClientCompress | ClientZstdCompressionAlgorithm
+)
+
+// handshakeV10 is protocol version of server greeting
+// https://dev.mysql.com/doc/internals/en/connection-phase-packets.html#packet-Protocol::HandshakeV10
+const handshakeV10 = 0x0a
+
+// CapabilitiesAction defines how AcraServer negotiates capabilities from UninspectableCapabilities
+type CapabilitiesAction string
+
+// Supported values of CapabilitiesAction
+const (
+	// CapabilitiesActionStrip removes capabilities from server greeting and client handshake, so client and server
+	// fall back to plain protocol
+	CapabilitiesActionStrip CapabilitiesAction = "strip"
+	// CapabilitiesActionReject closes connections of clients which request capabilities
+	CapabilitiesActionReject CapabilitiesAction = "reject"
+	// CapabilitiesActionAllow passes capabilities as is, packets of such connections may bypass inspection
+	CapabilitiesActionAllow CapabilitiesAction = "allow"
+)
+
+// ErrInvalidCapabilitiesAction returned for unknown CapabilitiesAction
+var ErrInvalidCapabilitiesAction = errors.New("invalid action on uninspectable capabilities")
+
+// ErrUninspectableCapabilities returned when client requests capabilities rejected by CapabilitiesActionReject
+var ErrUninspectableCapabilities = errors.New("client requested capabilities which can't be inspected")
+
+// ParseCapabilitiesAction validates action on uninspectable capabilities, empty string means CapabilitiesActionStrip
+func ParseCapabilitiesAction(value string) (CapabilitiesAction, error) {
+	switch CapabilitiesAction(value) {
+	case "":
+		return CapabilitiesActionStrip, nil
+	case CapabilitiesActionStrip, CapabilitiesActionReject, CapabilitiesActionAllow:
+		return CapabilitiesAction(value), nil
+	}
+	return "", fmt.Errorf("%w '%s', expected '%s', '%s' or '%s'", ErrInvalidCapabilitiesAction, value,
+		CapabilitiesActionStrip, CapabilitiesActionReject, CapabilitiesActionAllow)
+}
+
+// capabilityNames used to log requested capabilities
+var capabilityNames = []struct {
+	flag uint32
+	name string
+}{
+	{ClientCompress, "CLIENT_COMPRESS"},
+	{ClientZstdCompressionAlgorithm, "CLIENT_ZSTD_COMPRESSION_ALGORITHM"},
+}
+
+// capabilitiesToNames returns names of UninspectableCapabilities set in capabilities
+func capabilitiesToNames(capabilities uint32) []string {
+	var names []string
+	for _, capability := range capabilityNames {
+		if capabilities&capability.flag != 0 {
+			names = append(names, capability.name)
+		}
+	}
+	return names
+}
+
+// ClearServerCapabilities removes flags from capabilities of server greeting and returns removed ones. Other packets
+// aren't changed.
+func (packet *Packet) ClearServerCapabilities(flags uint32) uint32 {
+	if len(packet.data) == 0 || packet.data[0] != handshakeV10 {
+		return 0
+	}
+	endOfServerVersion := bytes.IndexByte(packet.data[1:], 0)
+	if endOfServerVersion < 0 {
+		return 0
+	}
+	// protocol version + server version + 0 + 4 bytes connection id + 8 bytes of auth plugin + 1 byte filler
+	lowerOffset := 1 + endOfServerVersion + 1 + 13
+	// 2 bytes of lower capabilities + 1 byte character set + 2 bytes of status flags
+	upperOffset := lowerOffset + 2 + 3
+	var removed uint32
+	if len(packet.data) >= lowerOffset+2 {
+		removed |= clearUint16Flags(packet.data[lowerOffset:lowerOffset+2], uint16(flags))
+	}
+	if len(packet.data) >= upperOffset+2 {
+		removed |= clearUint16Flags(packet.data[upperOffset:upperOffset+2], uint16(flags>>16)) << 16
+	}
+	return removed
+}
+
+// ClearClientCapabilities removes flags from capabilities of client's SSLRequest or HandshakeResponse and returns
+// removed ones
+func (packet *Packet) ClearClientCapabilities(flags uint32) uint32 {
+	if len(packet.data) < 2 {
+		return 0
+	}
+	// HandshakeResponse320 has only 2 bytes of capabilities
+	if len(packet.data) < 4 || !packet.ClientSupportProtocol41() {
+		return clearUint16Flags(packet.data[:2], uint16(flags))
+	}
+	capabilities := binary.LittleEndian.Uint32(packet.data[:4])
+	binary.LittleEndian.PutUint32(packet.data[:4], capabilities&^flags)
+	return capabilities & flags
+}
+
+func clearUint16Flags(data []byte, flags uint16) uint32 {
+	capabilities := binary.LittleEndian.Uint16(data)
+	binary.LittleEndian.PutUint16(data, capabilities&^flags)
+	return uint32(capabilities & flags)
+}
+
+// safeClientCapabilities returns capabilities of client's SSLRequest, HandshakeResponse41 or HandshakeResponse320
+func (packet *Packet) safeClientCapabilities() uint32 {
+	if len(packet.data) < 2 {
+		return 0
+	}
+	if len(packet.data) < 4 || !packet.ClientSupportProtocol41() {
+		return uint32(binary.LittleEndian.Uint16(packet.data[:2]))
+	}
+	return packet.getClientCapabilities()
+}
+
+// requestedCapabilities returns UninspectableCapabilities requested by client's SSLRequest or HandshakeResponse
+func (packet *Packet) requestedCapabilities() uint32 {
+	return packet.safeClientCapabilities() & UninspectableCapabilities
+}
@@ -0,0 +1,160 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mysql
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/cossacklabs/acra/decryptor/base"
+)
+
+// pipeSession is ClientSession with connections of client and database
+type pipeSession struct {
+	stubSession
+	client, db net.Conn
+}
+
+func (session pipeSession) ClientConnection() net.Conn {
+	return session.client
+}
+
+func (session pipeSession) DatabaseConnection() net.Conn {
+	return session.db
+}
+
+// testServerGreeting returns HandshakeV10 with capabilities
+func testServerGreeting(capabilities uint32) []byte {
+	data := []byte{handshakeV10}
+	data = append(data, "8.0.23"...)
+	// end of server version, connection id, auth plugin data and filler
+	data = append(data, make([]byte, 1+4+8+1)...)
+	data = append(data, byte(capabilities), byte(capabilities>>8))
+	// character set and status flags
+	data = append(data, 0x21, 0x02, 0x00)
+	data = append(data, byte(capabilities>>16), byte(capabilities>>24))
+	// length of auth plugin data and reserved bytes
+	return append(data, make([]byte, 11)...)
+}
+
+// testHandshakeResponse returns HandshakeResponse41 with capabilities
+func testHandshakeResponse(capabilities uint32) []byte {
+	data := make([]byte, 32)
+	binary.LittleEndian.PutUint32(data, capabilities|ClientProtocol41)
+	data = append(data, "user"...)
+	return append(data, 0, 0)
+}
+
+func TestClearCapabilities(t *testing.T) {
+	const otherCapabilities = ClientProtocol41 | ClientDeprecateEOF | 0x0f
+	packet := NewPacket()
+	packet.SetData(testServerGreeting(otherCapabilities | UninspectableCapabilities))
+	if removed := packet.ClearServerCapabilities(UninspectableCapabilities); removed != UninspectableCapabilities {
+		t.Fatalf("Expected all capabilities to be removed, took %x", removed)
+	}
+	if !bytes.Equal(packet.GetData(), testServerGreeting(otherCapabilities)) {
+		t.Fatal("Only uninspectable capabilities should be removed from greeting")
+	}
+	// error instead of greeting isn't changed
+	packet.SetData([]byte{ErrPacket, 0x20, 0x20, 0x20, 0x20})
+	if removed := packet.ClearServerCapabilities(UninspectableCapabilities); removed != 0 {
+		t.Fatal("Error packet shouldn't be changed")
+	}
+
+	packet.SetData(testHandshakeResponse(otherCapabilities | ClientZstdCompressionAlgorithm | ClientCompress))
+	if requested := packet.requestedCapabilities(); requested != ClientZstdCompressionAlgorithm|ClientCompress {
+		t.Fatalf("Unexpected requested capabilities %x", requested)
+	}
+	if removed := packet.ClearClientCapabilities(UninspectableCapabilities); removed != ClientZstdCompressionAlgorithm|ClientCompress {
+		t.Fatalf("Unexpected removed capabilities %x", removed)
+	}
+	if !bytes.Equal(packet.GetData(), testHandshakeResponse(otherCapabilities)) {
+		t.Fatal("Only uninspectable capabilities should be removed from handshake response")
+	}
+	// HandshakeResponse320 has 2 bytes of capabilities
+	packet.SetData([]byte{ClientCompress | 0x0f, 0, 0, 0, 0, 'u', 0})
+	if removed := packet.ClearClientCapabilities(UninspectableCapabilities); removed != ClientCompress || packet.GetData()[0] != 0x0f {
+		t.Fatal("Compression should be removed from HandshakeResponse320")
+	}
+
+	for _, value := range []string{"", "strip", "reject", "allow"} {
+		if _, err := ParseCapabilitiesAction(value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := ParseCapabilitiesAction("downgrade"); !errors.Is(err, ErrInvalidCapabilitiesAction) {
+		t.Fatalf("Expected ErrInvalidCapabilitiesAction, took %v", err)
+	}
+}
+
+func TestNegotiateClientCapabilities(t *testing.T) {
+	requested := uint32(ClientCompress | ClientZstdCompressionAlgorithm | ClientQueryAttributes | 0x0f)
+	testcases := []struct {
+		action   CapabilitiesAction
+		expected []byte
+		err      error
+	}{
+		// query attributes are supported
+		{CapabilitiesActionStrip, testHandshakeResponse(ClientQueryAttributes | 0x0f), nil},
+		{CapabilitiesActionAllow, testHandshakeResponse(requested), nil},
+		{CapabilitiesActionReject, nil, ErrUninspectableCapabilities},
+	}
+	for _, testcase := range testcases {
+		client, proxyClient := net.Pipe()
+		proxyDB, db := net.Pipe()
+		setting := base.NewProxySetting(&decryptorFactory{}, &tableSchemaStore{true}, nil, nil, nil)
+		handler, err := NewMysqlProxy(pipeSession{client: proxyClient, db: proxyDB}, nil, setting)
+		if err != nil {
+			t.Fatal(err)
+		}
+		handler.SetCapabilitiesAction(testcase.action)
+		errCh := make(chan error, 1)
+		go handler.ProxyClientConnection(errCh)
+
+		packet := NewPacket()
+		packet.SetData(testHandshakeResponse(requested))
+		packet.header[SequenceIDIndex] = 1
+		if _, err := client.Write(packet.Dump()); err != nil {
+			t.Fatal(err)
+		}
+		if testcase.err != nil {
+			response, err := ReadPacket(client)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !response.IsErr() {
+				t.Fatalf("[%s] Expected error packet", testcase.action)
+			}
+			if err := <-errCh; !errors.Is(err, testcase.err) {
+				t.Fatalf("[%s] Expected %v, took %v", testcase.action, testcase.err, err)
+			}
+		} else {
+			forwarded, err := ReadPacket(db)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(forwarded.GetData(), testcase.expected) {
+				t.Fatalf("[%s] Unexpected handshake response forwarded to database", testcase.action)
+			}
+		}
+		client.Close()
+		db.Close()
+	}
+}
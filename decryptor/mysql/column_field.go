@@ -42,6 +42,9 @@ type ColumnDescription struct {
 	DefaultValue       []byte
 }
 
+// fixedLengthFieldsSize of ColumnDefinition41 after org_name
+const fixedLengthFieldsSize = 1 + 2 + 4 + 1 + 2 + 1 + 2
+
 // ParseResultField parses binary field and returns ColumnDescription
 func ParseResultField(data []byte) (*ColumnDescription, error) {
 	field := &ColumnDescription{}
@@ -93,6 +96,12 @@ func ParseResultField(data []byte) (*ColumnDescription, error) {
 	}
 	pos += n
 
+	// 0x0C constant + charset + column length + type + flag + decimals + filler
+	if len(data) < pos+fixedLengthFieldsSize {
+		log.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorProtocolProcessing).Errorln("Column definition is shorter than fixed length fields, malformed packet")
+		return nil, ErrMalformPacket
+	}
+
 	//skip 0x0C constant field
 	pos++
 
@@ -130,7 +139,7 @@ func ParseResultField(data []byte) (*ColumnDescription, error) {
 		}
 		pos += n
 
-		if pos+int(field.DefaultValueLength) > len(data) {
+		if field.DefaultValueLength > uint64(len(data)-pos) {
 			log.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorProtocolProcessing).Errorln("Incorrect position, malformed packet")
 			err = ErrMalformPacket
 			return nil, err
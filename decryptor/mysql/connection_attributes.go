@@ -0,0 +1,165 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mysql
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+// Capability flags which define fields of HandshakeResponse41
+// https://dev.mysql.com/doc/internals/en/connection-phase-packets.html#packet-Protocol::HandshakeResponse
+const (
+	// ClientConnectWithDB - database name follows auth response
+	ClientConnectWithDB = 0x00000008
+	// ClientSecureConnection - auth response is prefixed by 1 byte length
+	ClientSecureConnection = 0x00008000
+	// ClientPluginAuth - auth plugin name follows database name
+	ClientPluginAuth = 0x00080000
+	// ClientConnectAttrs - connection attributes end the packet
+	ClientConnectAttrs = 0x00100000
+	// ClientPluginAuthLenencClientData - auth response is length encoded string
+	ClientPluginAuthLenencClientData = 0x00200000
+)
+
+// handshakeResponse41FixedPartLength is length of capabilities, max packet size, character set and filler
+const handshakeResponse41FixedPartLength = 4 + 4 + 1 + 23
+
+// DefaultSessionIdentityAttribute is connection attribute with identity of client, shown in
+// performance_schema.session_connect_attrs
+const DefaultSessionIdentityAttribute = "acra_client_identity"
+
+// ErrConnectAttrsNotSupported returned when neither client nor server support connection attributes
+var ErrConnectAttrsNotSupported = errors.New("connection attributes are not supported by client and database")
+
+// skipNullTerminatedString returns length of null-terminated string at start of data with terminator
+func skipNullTerminatedString(data []byte) (int, error) {
+	end := bytes.IndexByte(data, 0)
+	if end < 0 {
+		return 0, ErrMalformPacket
+	}
+	return end + 1, nil
+}
+
+// connectAttributesOffset returns offset of connection attributes of HandshakeResponse41, which is the end of packet
+// if client doesn't send them
+func (packet *Packet) connectAttributesOffset(capabilities uint32) (int, error) {
+	data := packet.data
+	if len(data) < handshakeResponse41FixedPartLength {
+		return 0, ErrMalformPacket
+	}
+	offset := handshakeResponse41FixedPartLength
+	// username
+	n, err := skipNullTerminatedString(data[offset:])
+	if err != nil {
+		return 0, err
+	}
+	offset += n
+	// auth response
+	switch {
+	case capabilities&ClientPluginAuthLenencClientData != 0:
+		n, err = SkipLengthEncodedString(data[offset:])
+	case capabilities&ClientSecureConnection != 0:
+		if offset >= len(data) || int(data[offset]) > len(data)-offset-1 {
+			return 0, ErrMalformPacket
+		}
+		n = 1 + int(data[offset])
+	default:
+		n, err = skipNullTerminatedString(data[offset:])
+	}
+	if err != nil {
+		return 0, err
+	}
+	offset += n
+	if capabilities&ClientConnectWithDB != 0 {
+		if n, err = skipNullTerminatedString(data[offset:]); err != nil {
+			return 0, err
+		}
+		offset += n
+	}
+	if capabilities&ClientPluginAuth != 0 {
+		if n, err = skipNullTerminatedString(data[offset:]); err != nil {
+			return 0, err
+		}
+		offset += n
+	}
+	return offset, nil
+}
+
+// SetConnectAttribute sets connection attribute of client's HandshakeResponse41 replacing one with the same name. If
+// client doesn't send attributes, they are added if serverCapabilities of greeting support them.
+func (packet *Packet) SetConnectAttribute(name, value string, serverCapabilities uint32) error {
+	if len(packet.data) < 4 || !packet.ClientSupportProtocol41() {
+		return ErrConnectAttrsNotSupported
+	}
+	capabilities := packet.getClientCapabilities()
+	if capabilities&ClientConnectAttrs == 0 && serverCapabilities&ClientConnectAttrs == 0 {
+		return ErrConnectAttrsNotSupported
+	}
+	offset, err := packet.connectAttributesOffset(capabilities)
+	if err != nil {
+		return err
+	}
+	var attributes, rest []byte
+	if capabilities&ClientConnectAttrs != 0 {
+		var n int
+		attributes, n, err = LengthEncodedString(packet.data[offset:])
+		if err != nil {
+			return err
+		}
+		// fields of other capabilities like zstd compression level follow attributes
+		rest = packet.data[offset+n:]
+		attributes, err = replaceConnectAttribute(attributes, name, value)
+		if err != nil {
+			return err
+		}
+	} else {
+		rest = packet.data[offset:]
+		attributes = append(PutLengthEncodedString([]byte(name)), PutLengthEncodedString([]byte(value))...)
+	}
+	output := make([]byte, 0, offset+len(attributes)+9+len(rest))
+	output = append(output, packet.data[:offset]...)
+	output = append(output, PutLengthEncodedString(attributes)...)
+	output = append(output, rest...)
+	binary.LittleEndian.PutUint32(output[:4], capabilities|ClientConnectAttrs)
+	packet.SetData(output)
+	return nil
+}
+
+// replaceConnectAttribute returns key-value pairs of attributes with value of name set, other pairs are kept in their
+// order
+func replaceConnectAttribute(attributes []byte, name, value string) ([]byte, error) {
+	output := make([]byte, 0, len(attributes)+len(name)+len(value)+18)
+	for len(attributes) > 0 {
+		key, n, err := LengthEncodedString(attributes)
+		if err != nil {
+			return nil, err
+		}
+		pairLength := n
+		if n, err = SkipLengthEncodedString(attributes[pairLength:]); err != nil {
+			return nil, err
+		}
+		pairLength += n
+		if string(key) != name {
+			output = append(output, attributes[:pairLength]...)
+		}
+		attributes = attributes[pairLength:]
+	}
+	output = append(output, PutLengthEncodedString([]byte(name))...)
+	return append(output, PutLengthEncodedString([]byte(value))...), nil
+}
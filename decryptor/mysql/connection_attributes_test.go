@@ -0,0 +1,80 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mysql
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// testAttributes returns key-value pairs of connection attributes
+func testAttributes(pairs ...string) []byte {
+	var attributes []byte
+	for _, value := range pairs {
+		attributes = append(attributes, PutLengthEncodedString([]byte(value))...)
+	}
+	return PutLengthEncodedString(attributes)
+}
+
+// testHandshakeResponseWithAttributes returns HandshakeResponse41 with database, auth plugin, attributes and zstd level
+func testHandshakeResponseWithAttributes(capabilities uint32, attributes []byte) []byte {
+	data := make([]byte, handshakeResponse41FixedPartLength)
+	binary.LittleEndian.PutUint32(data, capabilities|ClientProtocol41|ClientSecureConnection|ClientConnectWithDB|ClientPluginAuth)
+	data = append(data, "user\x00"...)
+	data = append(data, 3, 1, 2, 3)
+	data = append(data, "db\x00mysql_native_password\x00"...)
+	data = append(data, attributes...)
+	// zstd compression level
+	return append(data, 3)
+}
+
+func TestSetConnectAttribute(t *testing.T) {
+	testCases := []struct {
+		input    []byte
+		expected []byte
+	}{
+		// attribute replaced, others kept
+		{testHandshakeResponseWithAttributes(ClientConnectAttrs, testAttributes("_client_name", "libmysql", DefaultSessionIdentityAttribute, "spoofed")),
+			testHandshakeResponseWithAttributes(ClientConnectAttrs, testAttributes("_client_name", "libmysql", DefaultSessionIdentityAttribute, "client"))},
+		// attribute added
+		{testHandshakeResponseWithAttributes(ClientConnectAttrs, testAttributes("_client_name", "libmysql")),
+			testHandshakeResponseWithAttributes(ClientConnectAttrs, testAttributes("_client_name", "libmysql", DefaultSessionIdentityAttribute, "client"))},
+		// attributes added to client without them
+		{testHandshakeResponseWithAttributes(0, nil),
+			testHandshakeResponseWithAttributes(ClientConnectAttrs, testAttributes(DefaultSessionIdentityAttribute, "client"))},
+	}
+	for i, testCase := range testCases {
+		packet := NewPacket()
+		packet.SetData(testCase.input)
+		if err := packet.SetConnectAttribute(DefaultSessionIdentityAttribute, "client", ClientConnectAttrs); err != nil {
+			t.Fatalf("[%d] %s", i, err)
+		}
+		if !bytes.Equal(packet.GetData(), testCase.expected) {
+			t.Fatalf("[%d] Expected %v, took %v", i, testCase.expected, packet.GetData())
+		}
+	}
+	packet := NewPacket()
+	packet.SetData(testHandshakeResponseWithAttributes(0, nil))
+	if err := packet.SetConnectAttribute(DefaultSessionIdentityAttribute, "client", 0); err != ErrConnectAttrsNotSupported {
+		t.Fatalf("Expected ErrConnectAttrsNotSupported, took %v", err)
+	}
+	packet.SetData(testHandshakeResponseWithAttributes(ClientConnectAttrs, nil)[:handshakeResponse41FixedPartLength+2])
+	if err := packet.SetConnectAttribute(DefaultSessionIdentityAttribute, "client", ClientConnectAttrs); err != ErrMalformPacket {
+		t.Fatalf("Expected ErrMalformPacket, took %v", err)
+	}
+}
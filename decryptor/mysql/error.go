@@ -62,3 +62,50 @@ func NewQueryInterruptedError(isProtocol41 bool) []byte {
 	data = append(data, mysqlError.Message...)
 	return data
 }
+
+// Too many connections code constants.
+const (
+	// https://dev.mysql.com/doc/refman/5.5/en/error-messages-server.html#error_er_con_count_error
+	ErConCountErrorCode  = 1040
+	ErConCountErrorState = "08004"
+)
+
+// NewTooManyConnectionsError return ERR packet with header which is sent instead of initial handshake packet when
+// connection is rejected. Client capabilities aren't known yet, so SQL state isn't included like MySQL does.
+// https://dev.mysql.com/doc/internals/en/connection-phase.html
+func NewTooManyConnectionsError() []byte {
+	var code uint16 = ErConCountErrorCode
+	message := "Too many connections"
+	// 1 byte ErrPacket flag + 2 bytes of error code = 3
+	data := make([]byte, 0, 3+len(message))
+	data = append(data, ErrPacket)
+	data = append(data, byte(code), byte(code>>8))
+	data = append(data, message...)
+	packet := NewPacket()
+	packet.SetData(data)
+	return packet.Dump()
+}
+
+// Oversized value code constants.
+const (
+	// https://dev.mysql.com/doc/refman/5.5/en/error-messages-server.html#error_er_warn_allowed_packet_overflowed
+	ErAllowedPacketOverflowedCode  = 1301
+	ErAllowedPacketOverflowedState = "HY000"
+)
+
+// NewCiphertextTooLargeError return packed error with message which is sent instead of result set with encrypted
+// value larger than max_ciphertext_size of its column
+// https://dev.mysql.com/doc/internals/en/packet-ERR_Packet.html
+func NewCiphertextTooLargeError(isProtocol41 bool, message string) []byte {
+	var code uint16 = ErAllowedPacketOverflowedCode
+	// 1 byte ErrPacket flag + 2 bytes of error code + 6 bytes of state (protocol41) = 9
+	data := make([]byte, 0, 9+len(message))
+	data = append(data, ErrPacket)
+	data = append(data, byte(code), byte(code>>8))
+	if isProtocol41 {
+		data = append(data, '#')
+		data = append(data, ErAllowedPacketOverflowedState...)
+	}
+	data = append(data, message...)
+	return data
+}
@@ -0,0 +1,85 @@
+//go:build gofuzz
+// +build gofuzz
+
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mysql
+
+import (
+	"context"
+
+	"github.com/cossacklabs/acra/decryptor/base"
+	"github.com/cossacklabs/acra/decryptor/binary"
+	"github.com/cossacklabs/acra/decryptor/postgresql"
+	"github.com/sirupsen/logrus"
+)
+
+// fuzzFields used as column definitions of data rows, they cover all sizes of values in binary protocol
+var fuzzFields = []*ColumnDescription{
+	{Type: TypeVarString}, {Type: TypeTiny}, {Type: TypeShort}, {Type: TypeLong}, {Type: TypeLongLong},
+	{Type: TypeFloat}, {Type: TypeDouble}, {Type: TypeNull}, {Type: TypeDatetime}, {Type: TypeBlob},
+}
+
+// Fuzz is entry point of go-fuzz for parsers of packet payloads from client and database. First byte selects parser
+// and rest is passed as payload, so found crashers may be added to TestMalformedPayloads as is:
+//
+//	go-fuzz-build -o mysql-fuzz.zip github.com/cossacklabs/acra/decryptor/mysql
+//	go-fuzz -bin mysql-fuzz.zip -workdir fuzz
+func Fuzz(data []byte) int {
+	if len(data) == 0 {
+		return -1
+	}
+	payload := data[1:]
+	var err error
+	switch data[0] % 5 {
+	case 0:
+		_, err = ParseResultField(payload)
+	case 1:
+		_, _, err = parseQueryAttributes(payload)
+	case 2:
+		packet := NewPacket()
+		packet.SetData(payload)
+		packet.ServerSupportProtocol41()
+		packet.ClearServerCapabilities(UninspectableCapabilities)
+		packet.ClearClientCapabilities(UninspectableCapabilities)
+		packet.IsSSLRequest()
+		packet.IsEOF()
+		packet.HasMoreResults(true)
+		packet.HasMoreResults(false)
+		_, err = packet.getServerCapabilitiesExtended()
+	case 3:
+		_, err = newFuzzHandler().processTextDataRow(context.Background(), payload, fuzzFields)
+	case 4:
+		_, err = newFuzzHandler().processBinaryDataRow(context.Background(), payload, fuzzFields)
+	}
+	if err != nil {
+		return 0
+	}
+	return 1
+}
+
+// newFuzzHandler returns Handler without connections and subscribers which processes data rows as is
+func newFuzzHandler() *Handler {
+	logger := logrus.NewEntry(logrus.StandardLogger())
+	clientID := []byte("fuzz")
+	pgDecryptor := postgresql.NewPgDecryptor(clientID, binary.NewBinaryDecryptor(logger), false, nil)
+	return &Handler{
+		decryptor:          NewMySQLDecryptor(clientID, pgDecryptor, nil),
+		logger:             logger,
+		decryptionObserver: base.NewColumnDecryptionObserver(),
+	}
+}
@@ -23,6 +23,8 @@ import (
 	"fmt"
 	"io"
 	"net"
+
+	"github.com/cossacklabs/acra/decryptor/base"
 )
 
 // MySQL protocol capability flags https://dev.mysql.com/doc/internals/en/capability-flags.html
@@ -44,6 +46,15 @@ const (
 	ErrPacket = 0xff
 )
 
+// ServerMoreResultsExists status flag of OK and EOF packets set when response has more result sets, e.g. for
+// multi-statement queries and stored procedures
+// https://dev.mysql.com/doc/internals/en/status-flags.html
+const ServerMoreResultsExists = 0x0008
+
+// ServerStatusInTrans status flag of OK and EOF packets set when transaction is active
+// https://dev.mysql.com/doc/internals/en/status-flags.html
+const ServerStatusInTrans = 0x0001
+
 const (
 	// PacketHeaderSize https://dev.mysql.com/doc/internals/en/mysql-packet.html#idm140406396409840
 	PacketHeaderSize = 4
@@ -113,44 +124,46 @@ func (packet *Packet) updatePacketSize(newSize int) {
 	packet.header[2] = byte(newSize >> 16)
 }
 
-// replaceQuery replace query in payload with new and update header with new size
-func (packet *Packet) replaceQuery(newQuery string) {
-	if len(newQuery) > len(packet.data[1:]) {
-		// first byte CMD + new query
-		packet.data = append(packet.data[:1], []byte(newQuery)...)
+// replaceQuery replace query in payload with new and update header with new size, query starts at offset after command
+// byte, e.g. after query attributes
+func (packet *Packet) replaceQuery(offset int, newQuery string) {
+	start := 1 + offset
+	if len(newQuery) > len(packet.data[start:]) {
+		// first byte CMD + query attributes + new query
+		packet.data = append(packet.data[:start], []byte(newQuery)...)
 	} else {
 		// if new query less than before then reuse memory of previous query
-		n := copy(packet.data[1:], newQuery)
-		packet.data = packet.data[:1+n] // CMD + n
+		n := copy(packet.data[start:], newQuery)
+		packet.data = packet.data[:start+n] // CMD + query attributes + n
 	}
-	packet.updatePacketSize(len(newQuery) + 1)
+	packet.updatePacketSize(len(packet.data))
 }
 
-// readPacket read header to struct and return payload as return result or error
-func (packet *Packet) readPacket(connection net.Conn) ([]byte, error) {
-	if _, err := io.ReadFull(connection, packet.header); err != nil {
-		return nil, err
-	}
-
-	length := packet.GetPacketPayloadLength()
-	if length < 1 {
-		return nil, fmt.Errorf("invalid payload length %d", length)
-	}
-
-	data := make([]byte, length)
-	if _, err := io.ReadFull(connection, data); err != nil {
-		return nil, err
-	}
-	if length < MaxPayloadLen {
-		return data, nil
-	}
-
-	var buf []byte
-	buf, err := packet.readPacket(connection)
-	if err != nil {
-		return nil, err
+// readPacket read header to struct and return payload as return result or error. Payload split into several packets
+// of MaxPayloadLen is joined, ErrPacketTooLarge returned if joined payload exceeds maxPacketSize before it's read
+func (packet *Packet) readPacket(connection net.Conn, maxPacketSize int) ([]byte, error) {
+	var data []byte
+	for {
+		if _, err := io.ReadFull(connection, packet.header); err != nil {
+			return nil, err
+		}
+		length := packet.GetPacketPayloadLength()
+		// only last packet of split payload may be empty if payload length is multiple of MaxPayloadLen
+		if length < 1 && data == nil {
+			return nil, fmt.Errorf("invalid payload length %d", length)
+		}
+		if len(data)+length > maxPacketSize {
+			return nil, base.ErrPacketTooLarge
+		}
+		offset := len(data)
+		data = append(data, make([]byte, length)...)
+		if _, err := io.ReadFull(connection, data[offset:]); err != nil {
+			return nil, err
+		}
+		if length < MaxPayloadLen {
+			return data, nil
+		}
 	}
-	return append(data, buf...), nil
 }
 
 // Dump returns packet header and data as []byte
@@ -160,7 +173,13 @@ func (packet *Packet) Dump() []byte {
 
 // ReadPacket header and payload from connection or return error
 func (packet *Packet) ReadPacket(connection net.Conn) error {
-	data, err := packet.readPacket(connection)
+	return packet.ReadPacketWithLimit(connection, base.DefaultMaxPacketSize)
+}
+
+// ReadPacketWithLimit reads header and payload from connection or returns base.ErrPacketTooLarge if payload is larger
+// than maxPacketSize
+func (packet *Packet) ReadPacketWithLimit(connection net.Conn, maxPacketSize int) error {
+	data, err := packet.readPacket(connection, maxPacketSize)
 	if err == nil {
 		packet.data = data
 	}
@@ -171,29 +190,101 @@ func (packet *Packet) ReadPacket(connection net.Conn) error {
 func (packet *Packet) IsEOF() bool {
 	// https://dev.mysql.com/doc/internals/en/packet-OK_Packet.html
 	// https://dev.mysql.com/doc/internals/en/packet-EOF_Packet.html
+	if len(packet.data) == 0 {
+		return false
+	}
 	isOkPacket := packet.data[0] == OkPacket && packet.GetPacketPayloadLength() > 7
 	isEOFPacket := packet.data[0] == EOFPacket && packet.GetPacketPayloadLength() < 9
 	return isOkPacket || isEOFPacket
 }
 
+// getStatusFlags returns status flags of OkPacket or EOFPacket. If client set CLIENT_DEPRECATE_EOF then result sets
+// are terminated by OkPacket with EOFPacket header
+func (packet *Packet) getStatusFlags(deprecateEOF bool) (uint16, error) {
+	data := packet.data
+	if len(data) == 0 || (data[0] != OkPacket && data[0] != EOFPacket) {
+		return 0, ErrMalformPacket
+	}
+	// https://dev.mysql.com/doc/internals/en/packet-EOF_Packet.html
+	if data[0] == EOFPacket && !deprecateEOF {
+		// 1 byte header + 2 bytes of warnings
+		if len(data) < 5 {
+			return 0, ErrMalformPacket
+		}
+		return binary.LittleEndian.Uint16(data[3:5]), nil
+	}
+	// https://dev.mysql.com/doc/internals/en/packet-OK_Packet.html
+	// 1 byte header + affected rows + last insert id
+	pos := 1
+	for i := 0; i < 2; i++ {
+		if pos >= len(data) {
+			return 0, ErrMalformPacket
+		}
+		_, _, n, err := LengthEncodedInt(data[pos:])
+		if err != nil {
+			return 0, err
+		}
+		pos += n
+	}
+	if len(data) < pos+2 {
+		return 0, ErrMalformPacket
+	}
+	return binary.LittleEndian.Uint16(data[pos : pos+2]), nil
+}
+
+// HasMoreResults return true if OkPacket or EOFPacket has SERVER_MORE_RESULTS_EXISTS status flag
+func (packet *Packet) HasMoreResults(deprecateEOF bool) bool {
+	flags, err := packet.getStatusFlags(deprecateEOF)
+	if err != nil {
+		return false
+	}
+	return flags&ServerMoreResultsExists > 0
+}
+
+// InTransaction return true if OkPacket or EOFPacket has SERVER_STATUS_IN_TRANS status flag
+func (packet *Packet) InTransaction(deprecateEOF bool) bool {
+	flags, err := packet.getStatusFlags(deprecateEOF)
+	if err != nil {
+		return false
+	}
+	return flags&ServerStatusInTrans > 0
+}
+
 // IsErr return true if packet has ErrPacket flag
 func (packet *Packet) IsErr() bool {
-	return packet.data[0] == ErrPacket
+	return len(packet.data) > 0 && packet.data[0] == ErrPacket
 }
 
-func (packet *Packet) getServerCapabilities() int {
+// serverCapabilitiesOffset returns offset of lower 2 bytes of capabilities in server greeting or -1 if greeting is
+// shorter
+func (packet *Packet) serverCapabilitiesOffset() int {
 	// https://dev.mysql.com/doc/internals/en/connection-phase-packets.html#idm140437490034448
-	endOfServerVersion := bytes.Index(packet.data[1:], []byte{0}) + 2 // 1 first byte of protocol version and 1 to point to next byte
+	if len(packet.data) == 0 {
+		return -1
+	}
+	endOfServerVersion := bytes.Index(packet.data[1:], []byte{0})
+	if endOfServerVersion < 0 {
+		return -1
+	}
+	// 1 first byte of protocol version and 1 to point to next byte
 	// 4 bytes connection string + 8 bytes of auth plugin + 1 byte filler
-	rawCapabilities := packet.data[endOfServerVersion+13 : endOfServerVersion+13+2]
+	return endOfServerVersion + 2 + 13
+}
+
+func (packet *Packet) getServerCapabilities() int {
+	baseCapabilitiesOffset := packet.serverCapabilitiesOffset()
+	if baseCapabilitiesOffset < 0 || len(packet.data) < baseCapabilitiesOffset+2 {
+		return 0
+	}
+	rawCapabilities := packet.data[baseCapabilitiesOffset : baseCapabilitiesOffset+2]
 	return int(binary.LittleEndian.Uint16(rawCapabilities))
 }
 
 func (packet *Packet) getServerCapabilitiesExtended() (int, error) {
-	// https://dev.mysql.com/doc/internals/en/connection-phase-packets.html#idm140437490034448
-	endOfServerVersion := bytes.Index(packet.data[1:], []byte{0}) + 2 // 1 first byte of protocol version and 1 to point to next byte
-	// 4 bytes connection string + 8 bytes of auth plugin + 1 byte filler
-	baseCapabilitiesOffset := endOfServerVersion + 13
+	baseCapabilitiesOffset := packet.serverCapabilitiesOffset()
+	if baseCapabilitiesOffset < 0 {
+		return 0, ErrPacketHasNotExtendedCapabilities
+	}
 	// 2 bytes of base capabilities + 1 byte character set + 2 bytes of status flags
 	capabilitiesOffset := baseCapabilitiesOffset + 2 + 3
 	if len(packet.data) < capabilitiesOffset+2 {
@@ -211,6 +302,9 @@ func (packet *Packet) ServerSupportProtocol41() bool {
 
 func (packet *Packet) getClientCapabilities() uint32 {
 	// https://dev.mysql.com/doc/internals/en/connection-phase-packets.html#idm140437489940880
+	if len(packet.data) < 4 {
+		return 0
+	}
 	return binary.LittleEndian.Uint32(packet.data[:4])
 }
 
@@ -235,8 +329,14 @@ func (packet *Packet) IsClientDeprecateEOF() bool {
 
 // ReadPacket from connection and return Packet struct with data or error
 func ReadPacket(connection net.Conn) (*Packet, error) {
+	return ReadPacketWithLimit(connection, base.DefaultMaxPacketSize)
+}
+
+// ReadPacketWithLimit reads Packet from connection or returns base.ErrPacketTooLarge if its payload is larger than
+// maxPacketSize
+func ReadPacketWithLimit(connection net.Conn, maxPacketSize int) (*Packet, error) {
 	packet := NewPacket()
-	err := packet.ReadPacket(connection)
+	err := packet.ReadPacketWithLimit(connection, maxPacketSize)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,167 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mysql
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/cossacklabs/acra/decryptor/base"
+	"github.com/cossacklabs/acra/logging"
+	"github.com/sirupsen/logrus"
+)
+
+func TestReadPacketWithLimit(t *testing.T) {
+	packetHeader := func(length int, sequence byte) []byte {
+		return []byte{byte(length), byte(length >> 8), byte(length >> 16), sequence}
+	}
+	// payload split into 2 packets because it's longer than MaxPayloadLen
+	splitPayload := append(packetHeader(MaxPayloadLen, 0), make([]byte, MaxPayloadLen)...)
+	splitPayload = append(splitPayload, packetHeader(5, 1)...)
+	splitPayload = append(splitPayload, 1, 2, 3, 4, 5)
+	// only last packet is empty if payload length is multiple of MaxPayloadLen
+	emptyLastPacket := append(packetHeader(MaxPayloadLen, 0), make([]byte, MaxPayloadLen)...)
+	emptyLastPacket = append(emptyLastPacket, packetHeader(0, 1)...)
+
+	testcases := []struct {
+		data          []byte
+		maxPacketSize int
+		length        int
+		err           error
+	}{
+		{append(packetHeader(3, 0), 1, 2, 3), 3, 3, nil},
+		{append(packetHeader(3, 0), 1, 2, 3), 2, 0, base.ErrPacketTooLarge},
+		{splitPayload, MaxPayloadLen + 5, MaxPayloadLen + 5, nil},
+		{splitPayload, MaxPayloadLen + 4, 0, base.ErrPacketTooLarge},
+		{emptyLastPacket, MaxPayloadLen, MaxPayloadLen, nil},
+	}
+	for i, testcase := range testcases {
+		client, server := net.Pipe()
+		go func() {
+			// write returns error when reader closes connection after rejected header
+			client.Write(testcase.data)
+		}()
+		packet, err := ReadPacketWithLimit(server, testcase.maxPacketSize)
+		client.Close()
+		server.Close()
+		if err != testcase.err {
+			t.Fatalf("[%d] Expected error %v, took %v", i, testcase.err, err)
+		}
+		if err == nil && len(packet.GetData()) != testcase.length {
+			t.Fatalf("[%d] Expected payload of %d bytes, took %d", i, testcase.length, len(packet.GetData()))
+		}
+	}
+}
+
+// TestMalformedPayloads checks that parsers return errors on payloads which declare lengths greater than actual ones
+// instead of panics. New crashers found by Fuzz should be added here.
+func TestMalformedPayloads(t *testing.T) {
+	columnDefinition := func(name string) []byte {
+		var data []byte
+		for _, value := range []string{"def", "db", "table", "table", name, name} {
+			data = append(data, PutLengthEncodedString([]byte(value))...)
+		}
+		return append(data, 0x0c, 33, 0, 0, 1, 0, 0, TypeVarString, 0, 0, 0, 0, 0)
+	}
+	validColumn := columnDefinition("name")
+	if _, err := ParseResultField(validColumn); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < len(validColumn); i++ {
+		if _, err := ParseResultField(validColumn[:i]); err == nil {
+			t.Fatalf("Expected error for column definition truncated to %d bytes", i)
+		}
+	}
+	for i, data := range [][]byte{
+		// length of 8 bytes overflows int
+		{0xfe, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 'a'},
+		{0xfc, 0xff, 0xff, 'a'},
+		{5, 'a'},
+		{},
+	} {
+		if _, _, err := LengthEncodedString(data); err != ErrMalformPacket {
+			t.Fatalf("[%d] Expected ErrMalformPacket for string, took %v", i, err)
+		}
+		if _, err := SkipLengthEncodedString(data); err != ErrMalformPacket {
+			t.Fatalf("[%d] Expected ErrMalformPacket for skipped string, took %v", i, err)
+		}
+	}
+	// default value of COM_FIELD_LIST longer than packet
+	if _, err := ParseResultField(append(validColumn, 0xfc, 0xff, 0xff)); err != ErrMalformPacket {
+		t.Fatalf("Expected ErrMalformPacket for default value, took %v", err)
+	}
+
+	handler := &Handler{
+		decryptor:          getDecryptor(&testKeystore{}),
+		logger:             logging.NewLogger(logrus.NewEntry(logrus.StandardLogger())),
+		decryptionObserver: base.NewColumnDecryptionObserver(),
+	}
+	fields := []*ColumnDescription{{Type: TypeVarString}, {Type: TypeLongLong}, {Type: TypeDouble}}
+	validTextRow := []byte{1, 'a', 2, '1', '0', 3, '1', '.', '5'}
+	if _, err := handler.processTextDataRow(context.Background(), validTextRow, fields); err != nil {
+		t.Fatal(err)
+	}
+	for i, row := range [][]byte{
+		{},
+		validTextRow[:len(validTextRow)-1],
+		append(validTextRow, 0),
+		{1, 'a', 0xfe, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+	} {
+		if _, err := handler.processTextDataRow(context.Background(), row, fields); err != ErrMalformPacket {
+			t.Fatalf("[%d] Expected ErrMalformPacket for text row, took %v", i, err)
+		}
+	}
+	validBinaryRow := append([]byte{OkPacket, 0, 1, 'a'}, 10, 0, 0, 0, 0, 0, 0, 0)
+	validBinaryRow = append(validBinaryRow, 0, 0, 0, 0, 0, 0, 0xf8, 0x3f)
+	if _, err := handler.processBinaryDataRow(context.Background(), validBinaryRow, fields); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < len(validBinaryRow); i++ {
+		if _, err := handler.processBinaryDataRow(context.Background(), validBinaryRow[:i], fields); err != ErrMalformPacket {
+			t.Fatalf("Expected ErrMalformPacket for binary row truncated to %d bytes, took %v", i, err)
+		}
+	}
+	if _, err := handler.processBinaryDataRow(context.Background(), append(validBinaryRow, 0), fields); err != ErrMalformPacket {
+		t.Fatalf("Expected ErrMalformPacket for binary row with extra data, took %v", err)
+	}
+
+	// greetings shorter than capabilities
+	for _, data := range [][]byte{{}, {handshakeV10}, {handshakeV10, '8', 0, 1, 2}} {
+		packet := NewPacket()
+		packet.SetData(data)
+		if packet.ServerSupportProtocol41() || packet.IsEOF() {
+			t.Fatalf("Unexpected flags of packet %v", data)
+		}
+		if _, err := packet.getServerCapabilitiesExtended(); err != ErrPacketHasNotExtendedCapabilities {
+			t.Fatalf("Expected ErrPacketHasNotExtendedCapabilities, took %v", err)
+		}
+	}
+	// handshakes shorter than capabilities
+	for _, data := range [][]byte{{}, {0xff, 0xff}} {
+		packet := NewPacket()
+		packet.SetData(data)
+		if packet.IsSSLRequest() || packet.IsClientDeprecateEOF() || packet.ClientSupportProtocol41() {
+			t.Fatalf("Unexpected flags of packet %v", data)
+		}
+	}
+	packet := NewPacket()
+	packet.SetData(testServerGreeting(ClientProtocol41))
+	if !packet.ServerSupportProtocol41() {
+		t.Fatal("Expected support of protocol 41")
+	}
+}
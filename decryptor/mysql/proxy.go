@@ -19,22 +19,79 @@ package mysql
 import (
 	"github.com/cossacklabs/acra/decryptor/base"
 	"github.com/cossacklabs/acra/encryptor"
+	"github.com/cossacklabs/acra/featureflags"
+	"github.com/cossacklabs/acra/logging"
 )
 
 type proxyFactory struct {
 	dataEncryptor encryptor.DataEncryptor
 	setting       base.ProxySetting
+	options       ProxyFactoryOptions
+}
+
+// ProxyFactoryOptions configures optional processing of MySQL connections
+type ProxyFactoryOptions struct {
+	// ShadowWriter duplicates write queries to shadow database if not nil
+	ShadowWriter base.QueryObserver
+	// ContextConfusionAction enables checks that AcraStructs are decrypted with context of their columns from
+	// encryptor config if set to flag or block
+	ContextConfusionAction encryptor.ContextConfusionAction
+	// MaxAgeAction enables checks of age of AcraStructs of columns with max_age in encryptor config if set to flag
+	// or block
+	MaxAgeAction encryptor.MaxAgeAction
+	// CiphertextSizeAction defines handling of encrypted values larger than max_ciphertext_size of their columns in
+	// encryptor config, encryptor.CiphertextSizeActionError if empty
+	CiphertextSizeAction encryptor.CiphertextSizeAction
+	// DecryptionSchedule masks decrypted values outside of allowed time windows if not nil
+	DecryptionSchedule *encryptor.DecryptionSchedulePolicy
+	// DecryptionPurpose masks decrypted values of columns which purpose of session doesn't allow if not nil
+	DecryptionPurpose *encryptor.DecryptionPurposePolicy
+	// TenantIsolation scopes queries of tenant clients to rows of their tenants if not nil
+	TenantIsolation *encryptor.TenantIsolationPolicy
+	// AccessHeatmap aggregates decryptions of encrypted columns per client if not nil, requires encryptor config
+	AccessHeatmap *encryptor.AccessHeatmap
+	// CapabilitiesAction defines negotiation of capabilities which AcraServer can't inspect, CapabilitiesActionStrip
+	// if empty
+	CapabilitiesAction CapabilitiesAction
+	// MaxPacketSize limits payload of packets from client and database, base.DefaultMaxPacketSize if zero
+	MaxPacketSize int
+	// SessionIdentity exports identity of client into connection attribute SessionIdentityAttribute of connections to
+	// the database if not nil
+	SessionIdentity          *base.SessionIdentity
+	SessionIdentityAttribute string
+	// IdleInTransaction alerts about or terminates sessions idle in transaction longer than its timeout if not nil
+	IdleInTransaction *base.IdleInTransactionPolicy
+	// FeatureFlags gate new behaviors per session, they use default behavior if nil
+	FeatureFlags *featureflags.Flags
 }
 
 // NewProxyFactory return new proxyFactory
 func NewProxyFactory(proxySetting base.ProxySetting) (base.ProxyFactory, error) {
-	dataEncryptor, err := encryptor.NewAcrawriterDataEncryptor(proxySetting.KeyStore())
+	return NewProxyFactoryWithOptions(proxySetting, ProxyFactoryOptions{})
+}
+
+// NewProxyFactoryWithOptions return new proxyFactory with optional processing configured by options
+func NewProxyFactoryWithOptions(proxySetting base.ProxySetting, options ProxyFactoryOptions) (base.ProxyFactory, error) {
+	if options.MaxPacketSize != 0 {
+		if err := base.ValidateMaxPacketSize(options.MaxPacketSize); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := encryptor.ParseCiphertextSizeAction(string(options.CiphertextSizeAction)); err != nil {
+		return nil, err
+	}
+	acrawriterEncryptor, err := encryptor.NewAcrawriterDataEncryptor(proxySetting.KeyStore())
+	if err != nil {
+		return nil, err
+	}
+	dataEncryptor, err := encryptor.NewFormatPreservingDataEncryptor(proxySetting.KeyStore(), acrawriterEncryptor)
 	if err != nil {
 		return nil, err
 	}
 	return &proxyFactory{
 		dataEncryptor: dataEncryptor,
 		setting:       proxySetting,
+		options:       options,
 	}, nil
 }
 
@@ -48,13 +105,87 @@ func (factory *proxyFactory) New(clientID []byte, clientSession base.ClientSessi
 	if err != nil {
 		return nil, err
 	}
+	if factory.options.CapabilitiesAction != "" {
+		proxy.SetCapabilitiesAction(factory.options.CapabilitiesAction)
+	}
+	if factory.options.MaxPacketSize > 0 {
+		proxy.SetMaxPacketSize(factory.options.MaxPacketSize)
+	}
+	if factory.options.SessionIdentity != nil {
+		attribute := factory.options.SessionIdentityAttribute
+		if attribute == "" {
+			attribute = DefaultSessionIdentityAttribute
+		}
+		proxy.SetSessionIdentity(factory.options.SessionIdentity, attribute)
+	}
+	if factory.options.IdleInTransaction != nil {
+		proxy.SetIdleInTransactionWatchdog(base.NewIdleInTransactionWatchdog(factory.options.IdleInTransaction.ForSession(factory.options.FeatureFlags, clientID), clientSession, logging.GetLoggerFromContext(clientSession.Context())))
+	}
+	var queryEncryptor *encryptor.QueryDataEncryptor
 	if !factory.setting.TableSchemaStore().IsEmpty() {
-		queryEncryptor, err := encryptor.NewMysqlQueryEncryptor(factory.setting.TableSchemaStore(), clientID, factory.dataEncryptor)
+		queryEncryptor, err = encryptor.NewMysqlQueryEncryptor(factory.setting.TableSchemaStore(), clientID, factory.dataEncryptor)
 		if err != nil {
 			return nil, err
 		}
+	}
+	var purposeGuard *encryptor.DecryptionPurposeGuard
+	if factory.options.DecryptionPurpose != nil {
+		purposeGuard = encryptor.NewDecryptionPurposeGuard(factory.options.DecryptionPurpose, queryEncryptor, clientID, logging.GetLoggerFromContext(clientSession.Context()))
+		// added first to read signed comments before queries are changed by other observers
+		proxy.AddQueryObserver(purposeGuard)
+	}
+	if factory.options.TenantIsolation != nil {
+		tenantRewriter := encryptor.NewTenantIsolationRewriter(factory.options.TenantIsolation, clientID, logging.GetLoggerFromContext(clientSession.Context()))
+		// added before encryptor, so queries of tenants are processed with their predicates
+		proxy.AddQueryObserver(tenantRewriter)
+		proxy.tenantRewriter = tenantRewriter
+	}
+	if queryEncryptor != nil {
 		proxy.AddQueryObserver(queryEncryptor)
 	}
+	// registered last to duplicate queries in the same form as they are sent to the database
+	if factory.options.ShadowWriter != nil {
+		proxy.AddQueryObserver(factory.options.ShadowWriter)
+	}
+	// lengths of values are checked before they are read to not decrypt oversized values
+	if queryEncryptor != nil {
+		proxy.ciphertextSizeGuard, err = encryptor.NewCiphertextSizeGuard(queryEncryptor, factory.options.CiphertextSizeAction)
+		if err != nil {
+			return nil, err
+		}
+	}
 	proxy.SubscribeOnAllColumnsDecryption(decryptor)
+	// values of format-preserving encrypted columns and values with embedded AcraStructs aren't whole AcraStructs and
+	// are decrypted before checks of other values
+	if queryEncryptor != nil {
+		proxy.SubscribeOnAllColumnsDecryption(encryptor.NewFormatPreservingDecryptor(queryEncryptor, factory.setting.KeyStore(), clientID))
+		proxy.SubscribeOnAllColumnsDecryption(encryptor.NewEmbeddedAcraStructDecryptor(queryEncryptor, factory.setting.KeyStore(), clientID))
+	}
+	// subscribed after decryptor to check decrypted values
+	if queryEncryptor != nil && factory.options.ContextConfusionAction.Enabled() {
+		guard, err := encryptor.NewContextConfusionGuard(queryEncryptor, clientID, factory.options.ContextConfusionAction)
+		if err != nil {
+			return nil, err
+		}
+		proxy.SubscribeOnAllColumnsDecryption(guard)
+	}
+	if queryEncryptor != nil && factory.options.MaxAgeAction.Enabled() {
+		guard, err := encryptor.NewMaxAgeGuard(queryEncryptor, factory.options.MaxAgeAction)
+		if err != nil {
+			return nil, err
+		}
+		proxy.SubscribeOnAllColumnsDecryption(guard)
+	}
+	// subscribed before schedule guard to count decryptions of values which are returned masked too
+	if queryEncryptor != nil && factory.options.AccessHeatmap != nil {
+		proxy.SubscribeOnAllColumnsDecryption(encryptor.NewAccessHeatmapRecorder(factory.options.AccessHeatmap, queryEncryptor, clientID))
+	}
+	if purposeGuard != nil {
+		proxy.SubscribeOnAllColumnsDecryption(purposeGuard)
+	}
+	// subscribed last to mask values which passed all other checks
+	if factory.options.DecryptionSchedule != nil {
+		proxy.SubscribeOnAllColumnsDecryption(encryptor.NewDecryptionScheduleGuard(factory.options.DecryptionSchedule, queryEncryptor, clientID))
+	}
 	return proxy, nil
 }
@@ -1,12 +1,22 @@
 package mysql
 
 import (
+	"bytes"
 	"context"
+	"io/ioutil"
 	"net"
+	"strings"
 	"testing"
 
+	"github.com/cossacklabs/acra/acra-censor"
+	"github.com/cossacklabs/acra/acra-censor/handlers"
 	"github.com/cossacklabs/acra/decryptor/base"
+	"github.com/cossacklabs/acra/encryptor"
 	"github.com/cossacklabs/acra/encryptor/config"
+	"github.com/cossacklabs/acra/logging"
+	"github.com/cossacklabs/acra/sqlparser"
+	mysqlDialect "github.com/cossacklabs/acra/sqlparser/dialect/mysql"
+	"github.com/sirupsen/logrus"
 )
 
 type decryptorFactory struct{}
@@ -25,6 +35,14 @@ func (store *tableSchemaStore) IsEmpty() bool {
 	return store.empty
 }
 
+func (*tableSchemaStore) IsStrict() bool {
+	return false
+}
+
+func (*tableSchemaStore) EncryptedColumns() map[string][]string {
+	return nil
+}
+
 type stubSession struct{}
 
 func (stubSession) Context() context.Context {
@@ -82,3 +100,189 @@ func TestEncryptorTurnOnOff(t *testing.T) {
 		t.Fatal("Unexpected observers count")
 	}
 }
+
+// replaceObserver replaces substring in queries
+type replaceObserver struct{ old, new string }
+
+func (*replaceObserver) ID() string { return "replaceObserver" }
+
+func (observer *replaceObserver) OnQuery(query base.OnQueryObject) (base.OnQueryObject, bool, error) {
+	if !strings.Contains(query.Query(), observer.old) {
+		return query, false, nil
+	}
+	return base.NewOnQueryObjectFromQuery(strings.Replace(query.Query(), observer.old, observer.new, -1)), true, nil
+}
+
+func (*replaceObserver) OnBind(statement sqlparser.Statement, values []base.BoundValue) ([]base.BoundValue, bool, error) {
+	return values, false, nil
+}
+
+func TestMultiStatementQuery(t *testing.T) {
+	censor := acracensor.NewAcraCensor()
+	denyHandler := handlers.NewDenyHandler()
+	denyHandler.AddTables([]string{"secrets"})
+	censor.AddHandler(denyHandler)
+	observerManager, err := base.NewArrayQueryObserverableManager(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	observerManager.AddQueryObserver(&replaceObserver{old: "'plain'", new: "'encrypted'"})
+	handler := &Handler{acracensor: censor, queryObserverManager: observerManager}
+
+	if statements := splitMultiStatementQuery("select 'a;b' from users"); len(statements) != 1 {
+		t.Fatalf("Unexpected statements: %v", statements)
+	}
+	allowed := splitMultiStatementQuery("select * from users; insert into users(name) values ('plain');")
+	if len(allowed) != 2 {
+		t.Fatalf("Unexpected statements: %v", allowed)
+	}
+	if err := handler.checkStatements(allowed, nil); err != nil {
+		t.Fatal(err)
+	}
+	denied := splitMultiStatementQuery("select * from users; select * from secrets")
+	if err := handler.checkStatements(denied, nil); err == nil {
+		t.Fatal("Expected error for not allowed statement")
+	}
+
+	newQuery, changed, err := handler.onStatements(allowed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changed || newQuery != "select * from users; insert into users(name) values ('encrypted')" {
+		t.Fatalf("Unexpected query: %v, %s", changed, newQuery)
+	}
+	if _, changed, err := handler.onStatements(denied); err != nil || changed {
+		t.Fatal("Query shouldn't be changed")
+	}
+}
+
+func TestPacketHasMoreResults(t *testing.T) {
+	testcases := []struct {
+		data         []byte
+		deprecateEOF bool
+		moreResults  bool
+	}{
+		// EOF packet: header, warnings, status flags
+		{[]byte{EOFPacket, 0, 0, ServerMoreResultsExists, 0}, false, true},
+		{[]byte{EOFPacket, 0, 0, 0x02, 0}, false, false},
+		// OK packet: header, affected rows, last insert id, status flags, warnings
+		{[]byte{OkPacket, 1, 0, ServerMoreResultsExists | 0x02, 0, 0, 0}, false, true},
+		{[]byte{OkPacket, 0xfc, 0x10, 0x01, 0, 0x02, 0, 0, 0}, false, false},
+		{[]byte{OkPacket, 0xfc, 0x10, 0x01, 0, ServerMoreResultsExists, 0, 0, 0}, false, true},
+		// OK packet with EOF header which terminates result set if client set CLIENT_DEPRECATE_EOF
+		{[]byte{EOFPacket, 0xfc, 0x10, 0x01, 0, ServerMoreResultsExists, 0, 0, 0}, true, true},
+		{[]byte{EOFPacket, 0, 0, 0x02, 0, 0, 0}, true, false},
+		// malformed packets
+		{[]byte{OkPacket, 1}, false, false},
+		{[]byte{EOFPacket, 0}, false, false},
+		{[]byte{ErrPacket, 0, 0, ServerMoreResultsExists, 0}, false, false},
+	}
+	for i, testcase := range testcases {
+		packet := NewPacket()
+		packet.SetData(testcase.data)
+		if packet.HasMoreResults(testcase.deprecateEOF) != testcase.moreResults {
+			t.Fatalf("[%d] Expected %v", i, testcase.moreResults)
+		}
+	}
+}
+
+func TestPacketInTransaction(t *testing.T) {
+	testcases := []struct {
+		data          []byte
+		deprecateEOF  bool
+		inTransaction bool
+	}{
+		{[]byte{EOFPacket, 0, 0, ServerStatusInTrans | 0x02, 0}, false, true},
+		{[]byte{EOFPacket, 0, 0, 0x02, 0}, false, false},
+		{[]byte{OkPacket, 0, 0, ServerStatusInTrans, 0, 0, 0}, false, true},
+		{[]byte{OkPacket, 0, 0, 0x02, 0, 0, 0}, false, false},
+		{[]byte{EOFPacket, 0, 0, ServerStatusInTrans, 0, 0, 0}, true, true},
+		{[]byte{ErrPacket, 0, 0, ServerStatusInTrans, 0}, false, false},
+	}
+	for i, testcase := range testcases {
+		packet := NewPacket()
+		packet.SetData(testcase.data)
+		if packet.InTransaction(testcase.deprecateEOF) != testcase.inTransaction {
+			t.Fatalf("[%d] Expected %v", i, testcase.inTransaction)
+		}
+	}
+}
+
+func TestQueryResponseCiphertextSize(t *testing.T) {
+	sqlparser.SetDefaultDialect(mysqlDialect.NewMySQLDialect())
+	schemaStore, err := config.MapTableSchemaStoreFromConfig([]byte(`
+schemas:
+  - table: users
+    columns: ["email", "id"]
+    encrypted:
+      - column: email
+        max_ciphertext_size: 8
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	queryEncryptor, err := encryptor.NewMysqlQueryEncryptor(schemaStore, []byte("client"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := queryEncryptor.OnQuery(base.NewOnQueryObjectFromQuery("select email, id from users")); err != nil {
+		t.Fatal(err)
+	}
+	makePacket := func(sequence byte, payload []byte) []byte {
+		return append([]byte{byte(len(payload)), byte(len(payload) >> 8), byte(len(payload) >> 16), sequence}, payload...)
+	}
+	makeField := func(name string) []byte {
+		var field []byte
+		for _, value := range []string{"def", "db", "users", "users", name, name} {
+			field = append(field, PutLengthEncodedString([]byte(value))...)
+		}
+		return append(field, 0x0c, 0x21, 0, 0xff, 0, 0, 0, TypeVarString, 0, 0, 0, 0, 0)
+	}
+	eof := []byte{EOFPacket, 0, 0, 0, 0}
+	row := append(PutLengthEncodedString([]byte("aaaaaaaaa")), PutLengthEncodedString([]byte("1"))...)
+	response := bytes.Join([][]byte{
+		makePacket(1, []byte{2}),
+		makePacket(2, makeField("email")),
+		makePacket(3, makeField("id")),
+		makePacket(4, eof),
+		makePacket(5, row),
+		makePacket(6, row),
+		makePacket(7, eof),
+	}, nil)
+	for _, action := range []encryptor.CiphertextSizeAction{encryptor.CiphertextSizeActionPass, encryptor.CiphertextSizeActionError} {
+		guard, err := encryptor.NewCiphertextSizeGuard(queryEncryptor, action)
+		if err != nil {
+			t.Fatal(err)
+		}
+		handler := &Handler{decryptor: getDecryptor(&testKeystore{}), decryptionObserver: base.NewColumnDecryptionObserver(),
+			logger: logging.NewLogger(logrus.NewEntry(logrus.StandardLogger())), maxPacketSize: base.DefaultMaxPacketSize,
+			clientProtocol41: true, ciphertextSizeGuard: guard}
+		dbConnection, database := net.Pipe()
+		go func() {
+			database.Write(response)
+			database.Close()
+		}()
+		clientConnection, client := net.Pipe()
+		output := make(chan []byte)
+		go func() {
+			data, _ := ioutil.ReadAll(client)
+			output <- data
+		}()
+		packet, err := ReadPacket(dbConnection)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := handler.QueryResponseHandler(context.Background(), packet, dbConnection, clientConnection); err != nil {
+			t.Fatal(err)
+		}
+		clientConnection.Close()
+		expected := response
+		if action == encryptor.CiphertextSizeActionError {
+			// result set is replaced with error
+			expected = makePacket(1, NewCiphertextTooLargeError(true, "encrypted value exceeds max_ciphertext_size of its column: value of column 0 has 9 bytes, max_ciphertext_size is 8"))
+		}
+		if data := <-output; !bytes.Equal(data, expected) {
+			t.Fatalf("[%s] Expected %q, took %q", action, expected, data)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mysql
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/cossacklabs/acra/acra-censor/common"
+)
+
+// flag of parameter type for unsigned integers
+const unsignedParameterFlag = 0x80
+
+// parseQueryAttributes parses attributes which precede query in payload of COM_QUERY (without command byte) if client
+// negotiated CLIENT_QUERY_ATTRIBUTES and returns them with offset of query in payload. Values are converted to their
+// text representation, NULL values are returned as empty strings.
+// https://dev.mysql.com/doc/dev/mysql-server/latest/page_protocol_com_query.html
+func parseQueryAttributes(data []byte) (common.QueryAttributes, int, error) {
+	count, _, n, err := LengthEncodedInt(data)
+	if err != nil {
+		return nil, 0, err
+	}
+	pos := n
+	// parameter_set_count, always 1
+	if _, _, n, err = LengthEncodedInt(data[pos:]); err != nil {
+		return nil, 0, err
+	}
+	pos += n
+	if count == 0 {
+		return nil, pos, nil
+	}
+	if count > uint64(len(data)) {
+		return nil, 0, ErrMalformPacket
+	}
+	nullBitmapSize := int(count+7) / 8
+	// null bitmap and new_params_bind_flag
+	if len(data) < pos+nullBitmapSize+1 {
+		return nil, 0, ErrMalformPacket
+	}
+	nullBitmap := data[pos : pos+nullBitmapSize]
+	pos += nullBitmapSize
+	if data[pos] != 1 {
+		// types and names are always sent with attributes
+		return nil, 0, ErrMalformPacket
+	}
+	pos++
+	types := make([][2]byte, count)
+	names := make([]string, count)
+	for i := range types {
+		if len(data) < pos+2 {
+			return nil, 0, ErrMalformPacket
+		}
+		types[i] = [2]byte{data[pos], data[pos+1]}
+		pos += 2
+		name, n, err := readLengthEncodedString(data[pos:])
+		if err != nil {
+			return nil, 0, err
+		}
+		names[i] = string(name)
+		pos += n
+	}
+	attributes := make(common.QueryAttributes, count)
+	for i := range types {
+		if nullBitmap[i/8]&(1<<uint(i%8)) != 0 {
+			attributes[names[i]] = ""
+			continue
+		}
+		value, n, err := parseBinaryValue(data[pos:], types[i][0], types[i][1]&unsignedParameterFlag != 0)
+		if err != nil {
+			return nil, 0, err
+		}
+		attributes[names[i]] = value
+		pos += n
+	}
+	return attributes, pos, nil
+}
+
+// parseBinaryValue returns text representation and length of value encoded by binary protocol
+// https://dev.mysql.com/doc/internals/en/binary-protocol-value.html
+func parseBinaryValue(data []byte, fieldType byte, unsigned bool) (string, int, error) {
+	fixedSize := func(size int) ([]byte, error) {
+		if len(data) < size {
+			return nil, ErrMalformPacket
+		}
+		return data[:size], nil
+	}
+	switch fieldType {
+	case TypeNull:
+		return "", 0, nil
+	case TypeTiny:
+		value, err := fixedSize(1)
+		if err != nil {
+			return "", 0, err
+		}
+		if unsigned {
+			return strconv.FormatUint(uint64(value[0]), 10), 1, nil
+		}
+		return strconv.FormatInt(int64(int8(value[0])), 10), 1, nil
+	case TypeShort, TypeYear:
+		value, err := fixedSize(2)
+		if err != nil {
+			return "", 0, err
+		}
+		number := binary.LittleEndian.Uint16(value)
+		if unsigned {
+			return strconv.FormatUint(uint64(number), 10), 2, nil
+		}
+		return strconv.FormatInt(int64(int16(number)), 10), 2, nil
+	case TypeLong, TypeInt24:
+		value, err := fixedSize(4)
+		if err != nil {
+			return "", 0, err
+		}
+		number := binary.LittleEndian.Uint32(value)
+		if unsigned {
+			return strconv.FormatUint(uint64(number), 10), 4, nil
+		}
+		return strconv.FormatInt(int64(int32(number)), 10), 4, nil
+	case TypeLongLong:
+		value, err := fixedSize(8)
+		if err != nil {
+			return "", 0, err
+		}
+		number := binary.LittleEndian.Uint64(value)
+		if unsigned {
+			return strconv.FormatUint(number, 10), 8, nil
+		}
+		return strconv.FormatInt(int64(number), 10), 8, nil
+	case TypeFloat:
+		value, err := fixedSize(4)
+		if err != nil {
+			return "", 0, err
+		}
+		return strconv.FormatFloat(float64(math.Float32frombits(binary.LittleEndian.Uint32(value))), 'g', -1, 32), 4, nil
+	case TypeDouble:
+		value, err := fixedSize(8)
+		if err != nil {
+			return "", 0, err
+		}
+		return strconv.FormatFloat(math.Float64frombits(binary.LittleEndian.Uint64(value)), 'g', -1, 64), 8, nil
+	case TypeDate, TypeDatetime, TypeTimestamp:
+		if len(data) < 1 || len(data) < 1+int(data[0]) {
+			return "", 0, ErrMalformPacket
+		}
+		return formatBinaryDatetime(data[1 : 1+data[0]]), 1 + int(data[0]), nil
+	case TypeTime:
+		if len(data) < 1 || len(data) < 1+int(data[0]) {
+			return "", 0, ErrMalformPacket
+		}
+		return formatBinaryTime(data[1 : 1+data[0]]), 1 + int(data[0]), nil
+	case TypeDecimal, TypeNewDecimal, TypeVarchar, TypeBit, TypeEnum, TypeSet, TypeTinyBlob, TypeMediumBlob,
+		TypeLongBlob, TypeBlob, TypeVarString, TypeString, TypeGeometry, TypeJSON:
+		value, n, err := readLengthEncodedString(data)
+		if err != nil {
+			return "", 0, err
+		}
+		return string(value), n, nil
+	}
+	return "", 0, fmt.Errorf("unsupported type %d of query attribute", fieldType)
+}
+
+// readLengthEncodedString returns ErrMalformPacket for NULL strings which are allowed by LengthEncodedString
+func readLengthEncodedString(data []byte) ([]byte, int, error) {
+	value, n, err := LengthEncodedString(data)
+	if err != nil || value == nil {
+		return nil, 0, ErrMalformPacket
+	}
+	return value, n, nil
+}
+
+// formatBinaryDatetime formats DATE, DATETIME or TIMESTAMP value of 0, 4, 7 or 11 bytes
+func formatBinaryDatetime(value []byte) string {
+	var year, month, day, hour, minute, second, microsecond int
+	if len(value) >= 4 {
+		year, month, day = int(binary.LittleEndian.Uint16(value)), int(value[2]), int(value[3])
+	}
+	if len(value) >= 7 {
+		hour, minute, second = int(value[4]), int(value[5]), int(value[6])
+	}
+	if len(value) >= 11 {
+		microsecond = int(binary.LittleEndian.Uint32(value[7:11]))
+	}
+	formatted := fmt.Sprintf("%04d-%02d-%02d", year, month, day)
+	if len(value) > 4 {
+		formatted += fmt.Sprintf(" %02d:%02d:%02d", hour, minute, second)
+	}
+	if len(value) > 7 {
+		formatted += fmt.Sprintf(".%06d", microsecond)
+	}
+	return formatted
+}
+
+// formatBinaryTime formats TIME value of 0, 8 or 12 bytes
+func formatBinaryTime(value []byte) string {
+	var negative bool
+	var days, hour, minute, second, microsecond int
+	if len(value) >= 8 {
+		negative = value[0] == 1
+		days = int(binary.LittleEndian.Uint32(value[1:5]))
+		hour, minute, second = int(value[5]), int(value[6]), int(value[7])
+	}
+	if len(value) >= 12 {
+		microsecond = int(binary.LittleEndian.Uint32(value[8:12]))
+	}
+	formatted := fmt.Sprintf("%02d:%02d:%02d", days*24+hour, minute, second)
+	if negative {
+		formatted = "-" + formatted
+	}
+	if len(value) > 8 {
+		formatted += fmt.Sprintf(".%06d", microsecond)
+	}
+	return formatted
+}
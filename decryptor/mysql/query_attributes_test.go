@@ -0,0 +1,179 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mysql
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"testing"
+
+	acracensor "github.com/cossacklabs/acra/acra-censor"
+	"github.com/cossacklabs/acra/decryptor/base"
+)
+
+// testAttribute is query attribute encoded as parameter of COM_QUERY
+type testAttribute struct {
+	name      string
+	fieldType byte
+	flag      byte
+	value     []byte
+}
+
+// testQueryWithAttributes returns payload of COM_QUERY with attributes
+func testQueryWithAttributes(query string, attributes ...testAttribute) []byte {
+	data := []byte{CommandQuery, byte(len(attributes)), 1}
+	if len(attributes) > 0 {
+		nullBitmap := make([]byte, (len(attributes)+7)/8)
+		for i, attribute := range attributes {
+			if attribute.value == nil {
+				nullBitmap[i/8] |= 1 << uint(i%8)
+			}
+		}
+		data = append(data, nullBitmap...)
+		data = append(data, 1)
+		for _, attribute := range attributes {
+			data = append(data, attribute.fieldType, attribute.flag, byte(len(attribute.name)))
+			data = append(data, attribute.name...)
+		}
+		for _, attribute := range attributes {
+			data = append(data, attribute.value...)
+		}
+	}
+	return append(data, query...)
+}
+
+func TestParseQueryAttributes(t *testing.T) {
+	query := "select 1"
+	payload := testQueryWithAttributes(query,
+		testAttribute{"app_name", TypeVarString, 0, append([]byte{7}, "billing"...)},
+		testAttribute{"tiny", TypeTiny, 0, []byte{0xff}},
+		testAttribute{"utiny", TypeTiny, unsignedParameterFlag, []byte{0xff}},
+		testAttribute{"long", TypeLong, 0, []byte{0xfe, 0xff, 0xff, 0xff}},
+		testAttribute{"longlong", TypeLongLong, unsignedParameterFlag, []byte{1, 0, 0, 0, 0, 0, 0, 0x80}},
+		testAttribute{"double", TypeDouble, 0, []byte{0, 0, 0, 0, 0, 0, 0xf8, 0x3f}},
+		testAttribute{"null", TypeNull, 0, nil},
+		testAttribute{"datetime", TypeDatetime, 0, []byte{7, 0xe4, 0x07, 6, 1, 12, 30, 5}},
+		testAttribute{"time", TypeTime, 0, []byte{8, 1, 1, 0, 0, 0, 2, 3, 4}},
+	)
+	attributes, offset, err := parseQueryAttributes(payload[1:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(payload[1+offset:]) != query {
+		t.Fatalf("Unexpected offset of query %d", offset)
+	}
+	expected := map[string]string{
+		"app_name": "billing",
+		"tiny":     "-1",
+		"utiny":    "255",
+		"long":     "-2",
+		"longlong": "9223372036854775809",
+		"double":   "1.5",
+		"null":     "",
+		"datetime": "2020-06-01 12:30:05",
+		"time":     "-26:03:04",
+	}
+	if len(attributes) != len(expected) {
+		t.Fatalf("Expected %d attributes, took %d", len(expected), len(attributes))
+	}
+	for name, value := range expected {
+		if attributes[name] != value {
+			t.Fatalf("Expected %s='%s', took '%s'", name, value, attributes[name])
+		}
+	}
+
+	// query without attributes
+	payload = testQueryWithAttributes(query)
+	attributes, offset, err = parseQueryAttributes(payload[1:])
+	if err != nil || attributes != nil || string(payload[1+offset:]) != query {
+		t.Fatalf("Unexpected result for query without attributes: %v, %d, %v", attributes, offset, err)
+	}
+
+	// truncated packets
+	payload = testQueryWithAttributes("", testAttribute{"app_name", TypeVarString, 0, append([]byte{7}, "billing"...)})
+	for i := 1; i < len(payload)-1; i++ {
+		if _, _, err := parseQueryAttributes(payload[1:i]); err == nil {
+			t.Fatalf("Expected error for truncated payload of %d bytes", i)
+		}
+	}
+}
+
+func TestQueryAttributesCensor(t *testing.T) {
+	censor := acracensor.NewAcraCensor()
+	defer censor.ReleaseAll()
+	configuration := fmt.Sprintf(`version: %s
+handlers:
+  - handler: query_attributes
+    attributes:
+      app_name: [billing]
+  - handler: allowall`, acracensor.MinimalCensorConfigVersion)
+	if err := censor.LoadConfiguration([]byte(configuration)); err != nil {
+		t.Fatal(err)
+	}
+	client, proxyClient := net.Pipe()
+	proxyDB, db := net.Pipe()
+	defer client.Close()
+	defer db.Close()
+	setting := base.NewProxySetting(&decryptorFactory{}, &tableSchemaStore{true}, nil, nil, censor)
+	handler, err := NewMysqlProxy(pipeSession{client: proxyClient, db: proxyDB}, nil, setting)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errCh := make(chan error, 1)
+	go handler.ProxyClientConnection(errCh)
+
+	write := func(data []byte) {
+		packet := NewPacket()
+		packet.SetData(data)
+		if _, err := client.Write(packet.Dump()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(testHandshakeResponse(ClientQueryAttributes))
+	if _, err := ReadPacket(db); err != nil {
+		t.Fatal(err)
+	}
+
+	allowed := testQueryWithAttributes("select 1", testAttribute{"app_name", TypeString, 0, append([]byte{7}, "billing"...)})
+	write(allowed)
+	forwarded, err := ReadPacket(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(forwarded.GetData(), allowed) {
+		t.Fatal("Allowed query should be forwarded with attributes")
+	}
+	// response handler is switched to result set processing, so it's reset as if database answered
+	handler.resetQueryHandler()
+
+	for _, denied := range [][]byte{
+		testQueryWithAttributes("select 1", testAttribute{"app_name", TypeString, 0, append([]byte{7}, "console"...)}),
+		testQueryWithAttributes("select 1"),
+		// malformed attributes
+		{CommandQuery, 1, 1, 0},
+	} {
+		write(denied)
+		response, err := ReadPacket(client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !response.IsErr() {
+			t.Fatal("Expected error for denied query")
+		}
+	}
+}
@@ -26,13 +26,16 @@ import (
 	"io"
 	"net"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/cossacklabs/acra/acra-censor"
 	"github.com/cossacklabs/acra/acra-censor/common"
 	"github.com/cossacklabs/acra/decryptor/base"
+	"github.com/cossacklabs/acra/encryptor"
 	"github.com/cossacklabs/acra/logging"
 	"github.com/cossacklabs/acra/network"
+	"github.com/cossacklabs/acra/sqlparser"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
 )
@@ -104,6 +107,9 @@ const (
 	TypeBit
 )
 
+// TypeJSON of MySQL 5.7+
+const TypeJSON byte = 0xf5
+
 // MySQL types
 const (
 	TypeNewDecimal byte = iota + 0xf6
@@ -150,11 +156,30 @@ type Handler struct {
 	dbTLSHandshakeFinished chan bool
 	clientConnection       net.Conn
 	dbConnection           net.Conn
-	logger                 *logrus.Entry
+	logger                 logging.Logger
 	ctx                    context.Context
 	queryObserverManager   base.QueryObserverManager
 	decryptionObserver     base.ColumnDecryptionObserver
 	setting                base.ProxySetting
+	// capabilitiesAction defines negotiation of capabilities which AcraServer can't inspect
+	capabilitiesAction CapabilitiesAction
+	// clientQueryAttributes is true if COM_QUERY packets start with query attributes
+	clientQueryAttributes bool
+	// maxPacketSize limits payload of packets from client and database
+	maxPacketSize int
+	// serverCapabilities are capabilities of server greeting
+	serverCapabilities uint32
+	// sessionIdentity exports identity of client into connection attribute sessionIdentityAttribute if not nil
+	sessionIdentity          *base.SessionIdentity
+	sessionIdentityAttribute string
+	// tenantRewriter scopes queries of tenant clients to their rows if not nil
+	tenantRewriter *encryptor.TenantIsolationRewriter
+	// idleWatchdog tracks time of session spent idle in transaction if not nil
+	idleWatchdog *base.IdleInTransactionWatchdog
+	// inTransaction is status of transaction reported by the last response of the database
+	inTransaction bool
+	// ciphertextSizeGuard checks lengths of values in data rows if not nil
+	ciphertextSizeGuard *encryptor.CiphertextSizeGuard
 }
 
 // NewMysqlProxy returns new Handler
@@ -174,12 +199,70 @@ func NewMysqlProxy(session base.ClientSession, decryptor base.Decryptor, setting
 		dbConnection:           session.DatabaseConnection(),
 		setting:                setting,
 		ctx:                    session.Context(),
-		logger:                 logging.GetLoggerFromContext(session.Context()),
+		logger:                 logging.NewLogger(logging.GetLoggerFromContext(session.Context())),
 		queryObserverManager:   observerManager,
 		decryptionObserver:     base.NewColumnDecryptionObserver(),
+		capabilitiesAction:     CapabilitiesActionStrip,
+		maxPacketSize:          base.DefaultMaxPacketSize,
 	}, nil
 }
 
+// SetCapabilitiesAction sets negotiation of capabilities from UninspectableCapabilities
+func (handler *Handler) SetCapabilitiesAction(action CapabilitiesAction) {
+	handler.capabilitiesAction = action
+}
+
+// SetMaxPacketSize sets limit of packet payload, packets exceeding it are rejected with base.ErrPacketTooLarge
+func (handler *Handler) SetMaxPacketSize(size int) {
+	handler.maxPacketSize = size
+}
+
+// negotiateClientCapabilities applies capabilitiesAction to UninspectableCapabilities requested by client's SSLRequest
+// or HandshakeResponse
+func (handler *Handler) negotiateClientCapabilities(packet *Packet) error {
+	requested := packet.requestedCapabilities()
+	if requested == 0 {
+		return nil
+	}
+	logger := handler.logger.WithFields(logrus.Fields{"capabilities": capabilitiesToNames(requested), "action": handler.capabilitiesAction})
+	switch handler.capabilitiesAction {
+	case CapabilitiesActionAllow:
+		logger.Warningln("Client requested capabilities which can't be inspected, packets are passed without processing")
+	case CapabilitiesActionReject:
+		logger.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorProtocolUninspectableCapabilities).
+			Errorln("Reject connection of client which requested capabilities which can't be inspected")
+		return ErrUninspectableCapabilities
+	default:
+		packet.ClearClientCapabilities(UninspectableCapabilities)
+		logger.Debugln("Removed capabilities which can't be inspected from client's handshake")
+	}
+	return nil
+}
+
+// SetSessionIdentity turns on export of identity of client into connection attribute of HandshakeResponse
+func (handler *Handler) SetSessionIdentity(identity *base.SessionIdentity, attribute string) {
+	handler.sessionIdentity = identity
+	handler.sessionIdentityAttribute = attribute
+}
+
+// exportSessionIdentity sets connection attribute of client's HandshakeResponse to identity of client
+func (handler *Handler) exportSessionIdentity(packet *Packet) error {
+	identity, err := handler.sessionIdentity.Value(handler.decryptor.(*Decryptor).clientID, handler.clientConnection)
+	if err != nil {
+		return err
+	}
+	if err := packet.SetConnectAttribute(handler.sessionIdentityAttribute, identity, handler.serverCapabilities); err != nil {
+		return err
+	}
+	handler.logger.WithField("attribute", handler.sessionIdentityAttribute).WithField("identity", identity).Debugln("Exported client identity into connection attributes")
+	return nil
+}
+
+// SetIdleInTransactionWatchdog sets watchdog notified when session waits for client inside transaction
+func (handler *Handler) SetIdleInTransactionWatchdog(watchdog *base.IdleInTransactionWatchdog) {
+	handler.idleWatchdog = watchdog
+}
+
 // SubscribeOnColumnDecryption subscribes for OnColumn notifications about the column, indexed from left to right starting with zero.
 func (handler *Handler) SubscribeOnColumnDecryption(i int, subscriber base.DecryptionSubscriber) {
 	handler.decryptionObserver.SubscribeOnColumnDecryption(i, subscriber)
@@ -231,6 +314,8 @@ func (handler *Handler) ProxyClientConnection(errCh chan<- error) {
 	clientLog := handler.logger.WithField("proxy", "client")
 	clientLog.Debugln("Start proxy client's requests")
 	firstPacket := true
+	// capabilities are sent in SSLRequest and again in HandshakeResponse after switching to TLS
+	handshakeResponse := true
 	prometheusLabels := []string{base.DecryptionDBMysql}
 	// use pointers to function where should be stored some function that should be called if code return error and interrupt loop
 	// default value empty func to avoid != nil check
@@ -251,8 +336,12 @@ func (handler *Handler) ProxyClientConnection(errCh chan<- error) {
 		packetSpanCtx, packetSpan := trace.StartSpan(ctx, "ProxyClientConnectionLoop")
 		packetSpanEndFunc = packetSpan.End
 
-		packet, err := ReadPacket(handler.clientConnection)
+		packet, err := ReadPacketWithLimit(handler.clientConnection, handler.maxPacketSize)
 		if err != nil {
+			if err == base.ErrPacketTooLarge {
+				handler.logger.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorProtocolProcessing).
+					WithField("max_packet_size", handler.maxPacketSize).Errorln("Packet from client exceeds max packet size")
+			}
 			handler.logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorResponseConnectorCantReadFromClient).
 				Debugln("Can't read packet from client")
 			errCh <- err
@@ -260,6 +349,21 @@ func (handler *Handler) ProxyClientConnection(errCh chan<- error) {
 		}
 		// after reading client's packet we start deadline on write to db side
 		handler.dbConnection.SetWriteDeadline(time.Now().Add(network.DefaultNetworkTimeout))
+		if handler.idleWatchdog != nil {
+			handler.idleWatchdog.Activity()
+		}
+		if handshakeResponse {
+			if err := handler.negotiateClientCapabilities(packet); err != nil {
+				protocol41 := len(packet.GetData()) >= 4 && packet.ClientSupportProtocol41()
+				packet.SetData(NewQueryInterruptedError(protocol41))
+				if _, err := handler.clientConnection.Write(packet.Dump()); err != nil {
+					handler.logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorResponseConnectorCantWriteToClient).
+						Debugln("Can't write response with error to client")
+				}
+				errCh <- err
+				return
+			}
+		}
 		if firstPacket {
 			firstPacket = false
 			handler.clientProtocol41 = packet.ClientSupportProtocol41()
@@ -291,6 +395,9 @@ func (handler *Handler) ProxyClientConnection(errCh chan<- error) {
 				if handler.setting.TLSConnectionWrapper().UseConnectionClientID() {
 					handler.logger.WithField("client_id", clientID).Debugln("Set new clientID")
 					handler.decryptor.SetClientID(clientID)
+					if handler.tenantRewriter != nil {
+						handler.tenantRewriter.SetClientID(clientID)
+					}
 				}
 				handler.logger.Debugln("Switched to tls with client. wait switching with db")
 				handler.isTLSHandshake = true
@@ -315,6 +422,30 @@ func (handler *Handler) ProxyClientConnection(errCh chan<- error) {
 				}
 			}
 		}
+		if handshakeResponse {
+			handshakeResponse = false
+			handler.clientQueryAttributes = packet.safeClientCapabilities()&ClientQueryAttributes != 0
+			if handler.sessionIdentity != nil {
+				if exportErr := handler.exportSessionIdentity(packet); exportErr != nil {
+					clientLog.WithError(exportErr).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorSessionIdentityExport).
+						Errorln("Can't export client identity into database session")
+					packet.SetData(NewQueryInterruptedError(handler.clientProtocol41))
+					if _, err := handler.clientConnection.Write(packet.Dump()); err != nil {
+						clientLog.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorResponseConnectorCantWriteToClient).
+							Debugln("Can't write response with error to client")
+					}
+					errCh <- exportErr
+					return
+				}
+			}
+			// HandshakeResponse isn't a command, forward it as is
+			if _, err := handler.dbConnection.Write(packet.Dump()); err != nil {
+				clientLog.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorNetworkWrite).WithError(err).Debugln("Can't write send packet to db")
+				errCh <- err
+				return
+			}
+			continue
+		}
 		handler.clientSequenceNumber = int(packet.GetSequenceNumber())
 		clientLog = clientLog.WithField("sequence_number", handler.clientSequenceNumber)
 		clientLog.Debugln("New packet")
@@ -337,19 +468,40 @@ func (handler *Handler) ProxyClientConnection(errCh chan<- error) {
 			return
 		case CommandQuery, CommandStatementPrepare:
 			_, censorSpan := trace.StartSpan(packetSpanCtx, "censor")
-			query := string(data)
+			var attributes common.QueryAttributes
+			queryOffset := 0
+			if cmd == CommandQuery && handler.clientQueryAttributes {
+				attributes, queryOffset, err = parseQueryAttributes(data)
+				if err != nil {
+					censorSpan.End()
+					// fail closed because query can't be found in packet
+					clientLog.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorProtocolProcessing).Errorln("Can't parse query attributes")
+					packet.SetData(NewQueryInterruptedError(handler.clientProtocol41))
+					if _, err := handler.clientConnection.Write(packet.Dump()); err != nil {
+						handler.logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorResponseConnectorCantWriteToClient).
+							Errorln("Can't write response with error to client")
+					}
+					continue
+				}
+			}
+			query := string(data[queryOffset:])
 
 			// log query with hidden values for debug mode
 			if logging.GetLogLevel() == logging.LogDebug {
-				_, queryWithHiddenValues, _, err := common.HandleRawSQLQuery(query)
-				if err == common.ErrQuerySyntaxError {
-					clientLog.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCensorQueryParseError).Debugf("Parsing error on query: %s", queryWithHiddenValues)
+				queryWithHiddenValues := common.RedactQueryForLog(query)
+				if queryWithHiddenValues == "" {
+					clientLog.WithError(common.ErrQuerySyntaxError).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCensorQueryParseError).Debugln("Parsing error on query, query isn't logged")
 				} else {
 					clientLog.WithFields(logrus.Fields{"sql": queryWithHiddenValues, "command": cmd}).Debugln("Query command")
 				}
 			}
 
-			if err := handler.acracensor.HandleQuery(query); err != nil {
+			statements := []string{query}
+			if cmd == CommandQuery {
+				statements = splitMultiStatementQuery(query)
+			}
+			// whole query is rejected if any of statements is not allowed
+			if err := handler.checkStatements(statements, attributes); err != nil {
 				censorSpan.End()
 				clientLog.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCensorQueryIsNotAllowed).Errorln("Error on AcraCensor check")
 				errPacket := NewQueryInterruptedError(handler.clientProtocol41)
@@ -361,11 +513,22 @@ func (handler *Handler) ProxyClientConnection(errCh chan<- error) {
 				continue
 			}
 
-			newQuery, changed, err := handler.queryObserverManager.OnQuery(base.NewOnQueryObjectFromQuery(query))
+			newQuery, changed, err := handler.onStatements(statements)
 			if err != nil {
 				clientLog.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorEncryptQueryData).Errorln("Error occurred on query handler")
+				// Fail closed if query doesn't match encryptor schema in strict mode, otherwise data may be stored unencrypted,
+				// and if query of tenant isn't scoped.
+				if handler.isRejectedQuery(err) {
+					censorSpan.End()
+					packet.SetData(NewQueryInterruptedError(handler.clientProtocol41))
+					if _, err := handler.clientConnection.Write(packet.Dump()); err != nil {
+						handler.logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorResponseConnectorCantWriteToClient).
+							Errorln("Can't write response with error to client")
+					}
+					continue
+				}
 			} else if changed {
-				packet.replaceQuery(newQuery.Query())
+				packet.replaceQuery(queryOffset, newQuery)
 			}
 
 			if cmd == CommandQuery {
@@ -390,6 +553,63 @@ func (handler *Handler) ProxyClientConnection(errCh chan<- error) {
 	}
 }
 
+// splitMultiStatementQuery returns statements of query separated by semicolons. Queries are split regardless of
+// CLIENT_MULTI_STATEMENTS capability because client may turn it on with COM_SET_OPTION. Query which can't be split
+// is returned as is.
+func splitMultiStatementQuery(query string) []string {
+	pieces, err := sqlparser.SplitStatementToPieces(query)
+	if err != nil || len(pieces) < 2 {
+		return []string{query}
+	}
+	return pieces
+}
+
+// checkStatements passes every non-empty statement through AcraCensor and returns first error
+func (handler *Handler) checkStatements(statements []string, attributes common.QueryAttributes) error {
+	for _, statement := range statements {
+		if len(statements) > 1 && strings.TrimSpace(statement) == "" {
+			continue
+		}
+		if err := handler.acracensor.HandleQueryWithAttributes(statement, attributes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// onStatements passes every non-empty statement through query observers and returns query joined from processed
+// statements if any of them was changed
+func (handler *Handler) onStatements(statements []string) (string, bool, error) {
+	changed := false
+	newStatements := make([]string, len(statements))
+	for i, statement := range statements {
+		newStatements[i] = statement
+		if len(statements) > 1 && strings.TrimSpace(statement) == "" {
+			continue
+		}
+		newQuery, statementChanged, err := handler.queryObserverManager.OnQuery(base.NewOnQueryObjectFromQuery(statement))
+		if err != nil {
+			return "", false, err
+		}
+		if statementChanged {
+			newStatements[i] = newQuery.Query()
+			changed = true
+		}
+	}
+	if !changed {
+		return "", false, nil
+	}
+	return strings.Join(newStatements, ";"), true, nil
+}
+
+// isRejectedQuery returns true if query with err of QueryObservers shouldn't be passed to the database
+func (handler *Handler) isRejectedQuery(err error) bool {
+	if handler.tenantRewriter != nil && handler.tenantRewriter.IsTenant() {
+		return true
+	}
+	return encryptor.IsRejectedQuery(err)
+}
+
 func (handler *Handler) isFieldToDecrypt(field *ColumnDescription) bool {
 	switch field.Type {
 	case TypeVarchar, TypeTinyBlob, TypeMediumBlob, TypeLongBlob, TypeBlob,
@@ -400,29 +620,55 @@ func (handler *Handler) isFieldToDecrypt(field *ColumnDescription) bool {
 	}
 }
 
+// checkColumnSize checks declared length of length encoded value of column before the value is read, returns false if
+// value should be returned as is
+func (handler *Handler) checkColumnSize(index int, data []byte) (bool, error) {
+	if handler.ciphertextSizeGuard == nil {
+		return true, nil
+	}
+	length, isNull, n, err := LengthEncodedInt(data)
+	// malformed values are rejected on reading
+	if err != nil || isNull || length > uint64(len(data)-n) {
+		return true, nil
+	}
+	return handler.ciphertextSizeGuard.CheckColumnSize(index, int(length), handler.logger.Entry())
+}
+
 func (handler *Handler) processTextDataRow(ctx context.Context, rowData []byte, fields []*ColumnDescription) ([]byte, error) {
 	var err error
 	var value []byte
 	var pos int
 	var n int
 	var output []byte
-	var fieldLogger *logrus.Entry
+	var decrypt bool
 	handler.logger.Debugln("Process data rows in text protocol")
+	ctx, cancel := base.NewRequestContext(ctx)
+	defer cancel()
 	for i := range fields {
-		fieldLogger = handler.logger.WithField("field_index", i)
-		value, n, err = LengthEncodedString(rowData[pos:])
+		decrypt, err = handler.checkColumnSize(i, rowData[pos:])
 		if err != nil {
 			return nil, err
 		}
-		value, err = handler.onColumnDecryption(ctx, i, value)
+		value, n, err = LengthEncodedString(rowData[pos:])
 		if err != nil {
-			fieldLogger.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorGeneral).
-				WithError(err).Errorln("Failed to process column data")
 			return nil, err
 		}
+		if decrypt {
+			value, err = handler.onColumnDecryption(ctx, i, value)
+			if err != nil {
+				handler.logger.WithField("field_index", i).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorGeneral).
+					WithError(err).Errorln("Failed to process column data")
+				return nil, err
+			}
+		}
 		output = append(output, PutLengthEncodedString(value)...)
 		pos += n
 	}
+	if pos != len(rowData) {
+		handler.logger.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorProtocolProcessing).
+			Errorln("Data row has more data than columns in result set")
+		return nil, ErrMalformPacket
+	}
 	handler.logger.Debugln("Finish processing text data row")
 
 	return output, nil
@@ -434,8 +680,12 @@ func (handler *Handler) processBinaryDataRow(ctx context.Context, rowData []byte
 	var err error
 	var value []byte
 	var output []byte
+	var decrypt bool
 
 	handler.logger.Debugln("Process data rows in binary protocol")
+	if len(rowData) == 0 {
+		return nil, ErrMalformPacket
+	}
 	// no data in response
 	if rowData[0] == EOFPacket {
 		return rowData, nil
@@ -449,9 +699,15 @@ func (handler *Handler) processBinaryDataRow(ctx context.Context, rowData []byte
 	// 1 - packet header
 	// 7 + 2 offset from docs
 	pos = 1 + ((len(fields) + 7 + 2) >> 3)
+	if len(rowData) < pos {
+		return nil, ErrMalformPacket
+	}
 	nullBitmap := rowData[1:pos]
 	output = append(output, rowData[:pos]...)
 
+	ctx, cancel := base.NewRequestContext(ctx)
+	defer cancel()
+
 	for i := range fields {
 		// https://dev.mysql.com/doc/internals/en/null-bitmap.html
 		// (i+2) / 8 -- calculate byte number in bitmap
@@ -460,17 +716,23 @@ func (handler *Handler) processBinaryDataRow(ctx context.Context, rowData []byte
 			continue
 		}
 		if handler.isFieldToDecrypt(fields[i]) {
+			decrypt, err = handler.checkColumnSize(i, rowData[pos:])
+			if err != nil {
+				return nil, err
+			}
 			value, n, err = LengthEncodedString(rowData[pos:])
 			if err != nil {
 				handler.logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorDecryptorCantDecryptBinary).
 					Errorln("Can't handle length encoded string binary value")
 				return nil, err
 			}
-			value, err = handler.onColumnDecryption(ctx, i, value)
-			if err != nil {
-				handler.logger.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorGeneral).
-					WithField("field_index", i).WithError(err).Errorln("Failed to process column data")
-				return nil, err
+			if decrypt {
+				value, err = handler.onColumnDecryption(ctx, i, value)
+				if err != nil {
+					handler.logger.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorGeneral).
+						WithField("field_index", i).WithError(err).Errorln("Failed to process column data")
+					return nil, err
+				}
 			}
 
 			output = append(output, PutLengthEncodedString(value)...)
@@ -478,6 +740,11 @@ func (handler *Handler) processBinaryDataRow(ctx context.Context, rowData []byte
 			continue
 		}
 		// https://dev.mysql.com/doc/internals/en/binary-protocol-value.html
+		if len(rowData) < pos+binaryValueSize(fields[i].Type) {
+			handler.logger.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorProtocolProcessing).
+				WithField("field_index", i).Errorln("Data row is shorter than binary value")
+			return nil, ErrMalformPacket
+		}
 		switch fields[i].Type {
 		case TypeNull:
 			_, err = handler.processFixedSizeNumberField(ctx, i, fields[i], nil)
@@ -561,9 +828,30 @@ func (handler *Handler) processBinaryDataRow(ctx context.Context, rowData []byte
 			return nil, fmt.Errorf("found unknown FieldType <type=%d> <name=%s> in MySQL response packet", fields[i].Type, fields[i].Name)
 		}
 	}
+	if pos != len(rowData) {
+		handler.logger.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorProtocolProcessing).
+			Errorln("Data row has more data than columns in result set")
+		return nil, ErrMalformPacket
+	}
 	return output, nil
 }
 
+// binaryValueSize returns size of fixed length value in binary protocol or 0 for length encoded values
+// https://dev.mysql.com/doc/internals/en/binary-protocol-value.html
+func binaryValueSize(fieldType byte) int {
+	switch fieldType {
+	case TypeTiny:
+		return 1
+	case TypeShort, TypeYear:
+		return 2
+	case TypeInt24, TypeLong, TypeFloat:
+		return 4
+	case TypeLongLong, TypeDouble:
+		return 8
+	}
+	return 0
+}
+
 func (handler *Handler) processFixedSizeNumberField(ctx context.Context, columnIndex int, column *ColumnDescription, encoded []byte) ([]byte, error) {
 	var value []byte
 	var err error
@@ -714,7 +1002,9 @@ func (handler *Handler) isPreparedStatementResult() bool {
 	return handler.currentCommand == CommandStatementExecute
 }
 
-// QueryResponseHandler parses data from database response
+// QueryResponseHandler parses data from database response. Response of multi-statement query or stored procedure
+// consists of several result sets, each terminated by packet with SERVER_MORE_RESULTS_EXISTS status flag except the
+// last one, so handler stays registered to process next result set.
 func (handler *Handler) QueryResponseHandler(ctx context.Context, packet *Packet, dbConnection, clientConnection net.Conn) (err error) {
 	handler.resetQueryHandler()
 	handler.decryptor.Reset()
@@ -726,11 +1016,17 @@ func (handler *Handler) QueryResponseHandler(ctx context.Context, packet *Packet
 	// https://dev.mysql.com/doc/internals/en/com-query-response.html#text-resultset
 	fieldCount := int(packet.GetData()[0])
 	output := []Dumper{packet}
+	// last packet of result set or OkPacket of statement without result set
+	terminator := packet
+	// oversizedErr is error of row with value larger than max_ciphertext_size, next rows are read but not processed
+	var oversizedErr error
 	if fieldCount != ErrPacket && fieldCount > 0 {
 		handler.logger.Debugln("Read column descriptions")
 		for i := 0; ; i++ {
-			handler.logger.WithField("column_index", i).Debugln("Read column description")
-			fieldPacket, err := ReadPacket(dbConnection)
+			if handler.logger.DebugEnabled() {
+				handler.logger.WithField("column_index", i).Debugln("Read column description")
+			}
+			fieldPacket, err := ReadPacketWithLimit(dbConnection, handler.maxPacketSize)
 			if err != nil {
 				handler.logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorResponseConnectorCantProcessColumn).
 					Debugln("Can't read packet with column description")
@@ -746,14 +1042,18 @@ func (handler *Handler) QueryResponseHandler(ctx context.Context, packet *Packet
 					break
 				}
 			}
-			handler.logger.WithField("column_index", i).Debugln("Parse field")
+			if handler.logger.DebugEnabled() {
+				handler.logger.WithField("column_index", i).Debugln("Parse field")
+			}
 			field, err := ParseResultField(fieldPacket.GetData())
 			if err != nil {
 				handler.logger.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorProtocolProcessing).WithError(err).Errorln("Can't parse result field")
 				return err
 			}
 			if field.IsBinary() {
-				handler.logger.WithField("column_index", i).Debugln("Binary field")
+				if handler.logger.DebugEnabled() {
+					handler.logger.WithField("column_index", i).Debugln("Binary field")
+				}
 				binaryFieldIndexes = append(binaryFieldIndexes, i)
 			}
 			fields = append(fields, field)
@@ -765,57 +1065,93 @@ func (handler *Handler) QueryResponseHandler(ctx context.Context, packet *Packet
 		handler.logger.Debugln("Read data rows")
 		if handler.isPreparedStatementResult() {
 			for {
-				fieldDataPacket, err := ReadPacket(dbConnection)
+				fieldDataPacket, err := ReadPacketWithLimit(dbConnection, handler.maxPacketSize)
 				if err != nil {
 					handler.logger.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorProtocolProcessing).WithError(err).Debugln("Can't read data packet")
 					return err
 				}
-				output = append(output, fieldDataPacket)
+				// rows after oversized value aren't sent
+				if oversizedErr == nil {
+					output = append(output, fieldDataPacket)
+				}
 				if fieldDataPacket.data[0] == EOFPacket {
+					terminator = fieldDataPacket
 					break
 				}
+				if oversizedErr != nil {
+					continue
+				}
 				newData, err := handler.processBinaryDataRow(ctx, fieldDataPacket.GetData(), fields)
+				if errors.Is(err, encryptor.ErrCiphertextTooLarge) {
+					oversizedErr = err
+					continue
+				}
 				if err != nil {
 					handler.logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorProtocolProcessing).
 						Debugln("Can't process binary data row")
 					return err
 				}
-				handler.logger.WithFields(logrus.Fields{"oldLength": fieldDataPacket.GetPacketPayloadLength(), "newLength": len(newData)}).Debugln("Update row data")
+				if handler.logger.DebugEnabled() {
+					handler.logger.WithFields(logrus.Fields{"oldLength": fieldDataPacket.GetPacketPayloadLength(), "newLength": len(newData)}).Debugln("Update row data")
+				}
 				fieldDataPacket.SetData(newData)
 			}
 		} else {
-			var dataLog *logrus.Entry
 			// read data packets
 			for i := 0; ; i++ {
-				dataLog = handler.logger.WithField("data_row_index", i)
+				// index of row is added only to debug entries, so it isn't copied into entry of every row
+				dataLog := handler.logger
+				if dataLog.DebugEnabled() {
+					dataLog = dataLog.WithField("data_row_index", i)
+				}
 				dataLog.Debugln("Read data row")
-				fieldDataPacket, err := ReadPacket(dbConnection)
+				fieldDataPacket, err := ReadPacketWithLimit(dbConnection, handler.maxPacketSize)
 				if err != nil {
 					handler.logger.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorProtocolProcessing).WithError(err).Debugln("Can't read data packet")
 					return err
 				}
-				output = append(output, fieldDataPacket)
+				// rows after oversized value aren't sent
+				if oversizedErr == nil {
+					output = append(output, fieldDataPacket)
+				}
 				if fieldDataPacket.IsEOF() {
 					dataLog.Debugln("Empty result set")
+					terminator = fieldDataPacket
 					break
 				}
 				// skip if no binary fields and nothing to decrypt
-				if len(fields) == 0 {
+				if len(fields) == 0 || oversizedErr != nil {
 					continue
 				}
 				dataLog.Debugln("Process data text row")
 				newData, err := handler.processTextDataRow(ctx, fieldDataPacket.GetData(), fields)
+				if errors.Is(err, encryptor.ErrCiphertextTooLarge) {
+					oversizedErr = err
+					continue
+				}
 				if err != nil {
 					dataLog.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorProtocolProcessing).
 						Debugln("Can't process text data row")
 					return err
 				}
-				dataLog.WithFields(logrus.Fields{"oldLength": fieldDataPacket.GetPacketPayloadLength(), "newLength": len(newData)}).Debugln("Update row data")
+				if dataLog.DebugEnabled() {
+					dataLog.WithFields(logrus.Fields{"oldLength": fieldDataPacket.GetPacketPayloadLength(), "newLength": len(newData)}).Debugln("Update row data")
+				}
 				fieldDataPacket.SetData(newData)
 			}
 		}
 
 	}
+	if oversizedErr != nil {
+		// next result sets would be sent after error which ends response
+		if terminator.HasMoreResults(handler.clientDeprecateEOF) {
+			return oversizedErr
+		}
+		// result set isn't sent yet, so it's replaced with error and connection may be used for next queries
+		packet.SetData(NewCiphertextTooLargeError(handler.clientProtocol41, oversizedErr.Error()))
+		output = []Dumper{packet}
+		fieldCount = ErrPacket
+	}
 
 	// proxy output
 	handler.logger.Debugln("Proxy output")
@@ -827,6 +1163,18 @@ func (handler *Handler) QueryResponseHandler(ctx context.Context, packet *Packet
 		}
 	}
 	handler.resetQueryHandler()
+	if fieldCount != ErrPacket && terminator.HasMoreResults(handler.clientDeprecateEOF) {
+		handler.logger.Debugln("Wait next result set")
+		handler.setQueryHandler(handler.QueryResponseHandler)
+	} else if handler.idleWatchdog != nil {
+		// errors don't have status flags and usually don't finish transaction
+		if fieldCount != ErrPacket {
+			handler.inTransaction = terminator.InTransaction(handler.clientDeprecateEOF)
+		}
+		if handler.inTransaction {
+			handler.idleWatchdog.TransactionIdle()
+		}
+	}
 	handler.logger.Debugln("Query handler finish")
 	return nil
 }
@@ -837,6 +1185,9 @@ func (handler *Handler) ProxyDatabaseConnection(errCh chan<- error) {
 	defer span.End()
 	serverLog := handler.logger.WithField("proxy", "server")
 	serverLog.Debugln("Start proxy db responses")
+	if handler.idleWatchdog != nil {
+		defer handler.idleWatchdog.Stop()
+	}
 	firstPacket := true
 	var responseHandler ResponseHandler
 	prometheusLabels := []string{base.DecryptionDBMysql}
@@ -862,8 +1213,12 @@ func (handler *Handler) ProxyDatabaseConnection(errCh chan<- error) {
 		timer := prometheus.NewTimer(prometheus.ObserverFunc(base.ResponseProcessingTimeHistogram.WithLabelValues(prometheusLabels...).Observe))
 		timerObserveFunc = timer.ObserveDuration
 
-		packet, err := ReadPacket(handler.dbConnection)
+		packet, err := ReadPacketWithLimit(handler.dbConnection, handler.maxPacketSize)
 		if err != nil {
+			if err == base.ErrPacketTooLarge {
+				handler.logger.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorProtocolProcessing).
+					WithField("max_packet_size", handler.maxPacketSize).Errorln("Packet from database exceeds max packet size")
+			}
 			if netErr, ok := err.(net.Error); ok {
 				if netErr.Timeout() && handler.isTLSHandshake {
 					// reset deadline
@@ -887,14 +1242,26 @@ func (handler *Handler) ProxyDatabaseConnection(errCh chan<- error) {
 		}
 		// after reading response from db response set deadline on writing data to client
 		handler.clientConnection.SetWriteDeadline(time.Now().Add(network.DefaultNetworkTimeout))
-		handler.logger.WithField("sequence_number", packet.GetSequenceNumber()).Debugln("New packet from db to client")
+		if handler.logger.DebugEnabled() {
+			handler.logger.WithField("sequence_number", packet.GetSequenceNumber()).Debugln("New packet from db to client")
+		}
 		if packet.IsErr() {
 			handler.resetQueryHandler()
 		}
 		if firstPacket {
 			firstPacket = false
 			handler.serverProtocol41 = packet.ServerSupportProtocol41()
+			handler.serverCapabilities = uint32(packet.getServerCapabilities())
+			if extended, err := packet.getServerCapabilitiesExtended(); err == nil {
+				handler.serverCapabilities |= uint32(extended) << 16
+			}
 			serverLog.Debugf("Set support protocol 41 %v", handler.serverProtocol41)
+			// hide capabilities from client so it doesn't request them
+			if handler.capabilitiesAction == CapabilitiesActionStrip {
+				if removed := packet.ClearServerCapabilities(UninspectableCapabilities); removed != 0 {
+					serverLog.WithField("capabilities", capabilitiesToNames(removed)).Debugln("Removed capabilities which can't be inspected from server greeting")
+				}
+			}
 		}
 		responseHandler = handler.getResponseHandler()
 		err = responseHandler(ctx, packet, handler.dbConnection, handler.clientConnection)
@@ -20,7 +20,6 @@ import (
 	"errors"
 	"github.com/cossacklabs/acra/logging"
 	log "github.com/sirupsen/logrus"
-	"io"
 )
 
 // ErrMalformPacket if packet parsing failed
@@ -80,18 +79,18 @@ func LengthEncodedInt(data []byte) (num uint64, isNull bool, n int, err error) {
 func LengthEncodedString(data []byte) ([]byte, int, error) {
 	// Get length
 	num, isNull, n, err := LengthEncodedInt(data)
+	if err != nil {
+		return nil, 0, err
+	}
 	// NULL values are encoded with special length values. Represent them with "nil" in Go.
 	if isNull {
-		return nil, n, err
+		return nil, n, nil
 	}
-
-	n += int(num)
-
-	// Check data length
-	if len(data) >= n {
-		return data[n-int(num) : n], n, nil
+	// compare without conversion to int which may overflow on declared lengths of 8 bytes
+	if num > uint64(len(data)-n) {
+		return nil, 0, ErrMalformPacket
 	}
-	return nil, n, io.EOF
+	return data[n : n+int(num)], n + int(num), nil
 }
 
 // SkipLengthEncodedString https://dev.mysql.com/doc/internals/en/string.html#packet-Protocol::LengthEncodedString
@@ -100,16 +99,10 @@ func SkipLengthEncodedString(data []byte) (int, error) {
 	if err != nil {
 		return 0, err
 	}
-	if num < 1 {
-		return n, nil
-	}
-
-	n += int(num)
-
-	if len(data) >= n {
-		return n, nil
+	if num > uint64(len(data)-n) {
+		return 0, ErrMalformPacket
 	}
-	return n, io.EOF
+	return n + int(num), nil
 }
 
 // PutLengthEncodedInt https://dev.mysql.com/doc/internals/en/integer.html#packet-Protocol::LengthEncodedInteger
@@ -0,0 +1,588 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package postgresql
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cossacklabs/acra/keystore/kms"
+	"github.com/cossacklabs/acra/logging"
+	"github.com/cossacklabs/acra/network"
+	"github.com/cossacklabs/acra/random"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/pbkdf2"
+	"gopkg.in/yaml.v2"
+)
+
+// Message types of authentication exchange
+// https://www.postgresql.org/docs/current/protocol-message-formats.html
+const (
+	AuthenticationMessageType byte = 'R'
+	PasswordMessageType       byte = 'p'
+)
+
+// Authentication requests of database which AcraServer answers with injected credentials, other methods aren't
+// supported
+const (
+	authenticationOk                = 0
+	authenticationCleartextPassword = 3
+	authenticationMD5Password       = 5
+	authenticationSASL              = 10
+	authenticationSASLContinue      = 11
+	authenticationSASLFinal         = 12
+)
+
+const scramSHA256Mechanism = "SCRAM-SHA-256"
+
+// Errors related to injection of database credentials
+var (
+	ErrInvalidCredentialsConfig  = errors.New("invalid database credentials config")
+	ErrNoDatabaseCredentials     = errors.New("no database credentials for client ID")
+	ErrUnsupportedAuthentication = errors.New("authentication method requested by database isn't supported")
+	ErrInvalidSCRAMExchange      = errors.New("invalid SCRAM-SHA-256 exchange with database")
+	ErrUnverifiedClientID        = errors.New("client ID of connection isn't verified")
+)
+
+// Default settings of refresh of database credentials stored in secret backends
+const (
+	DefaultCredentialsRefreshInterval = time.Minute * 5
+	DefaultCredentialsDrainTimeout    = time.Second * 30
+	// credentialsRetryInterval is time between attempts to fetch credentials after failed refresh
+	credentialsRetryInterval = time.Second * 10
+)
+
+// DatabaseCredentials are user and password which AcraServer uses to connect to the database on behalf of client ID.
+// Password is read from PasswordFile if it's set, Database replaces database requested by client if it's set. If
+// SecretBackend ("vault" or "aws") is set, user and password are fetched from secret SecretID instead, User is used
+// only if secret doesn't contain username. SecretEndpoint overrides default address of secret backend.
+type DatabaseCredentials struct {
+	ClientID       string `yaml:"client_id"`
+	User           string `yaml:"user"`
+	Password       string `yaml:"password"`
+	PasswordFile   string `yaml:"password_file"`
+	Database       string `yaml:"database"`
+	SecretBackend  string `yaml:"secret_backend"`
+	SecretID       string `yaml:"secret_id"`
+	SecretEndpoint string `yaml:"secret_endpoint"`
+}
+
+// CredentialsConfig lists database credentials of client IDs
+type CredentialsConfig struct {
+	Credentials []DatabaseCredentials `yaml:"credentials"`
+}
+
+// secretCredentials is source of credentials of client ID stored in secret backend
+type secretCredentials struct {
+	source kms.DatabaseSecretSource
+	// configured credentials, user and password of secret replace them
+	config       DatabaseCredentials
+	fetchedAt    time.Time
+	refreshAfter time.Duration
+}
+
+// newSecretSourceFunc has signature of kms.NewDatabaseSecretSourceFromEnvironment
+type newSecretSourceFunc func(backendType, secretID, endpoint string) (kms.DatabaseSecretSource, error)
+
+// CredentialStore returns database credentials of client IDs and refreshes ones stored in secret backends.
+// Connections authenticated with credentials which were rotated are closed after drain timeout, so clients reconnect
+// and authenticate with new ones.
+type CredentialStore struct {
+	mutex       sync.RWMutex
+	credentials map[string]DatabaseCredentials
+	secrets     map[string]*secretCredentials
+	// connections authenticated with current credentials of client IDs from secret backends
+	connections      map[string]*network.ConnectionManager
+	drainConnections func(clientID string, manager *network.ConnectionManager, drainTimeout time.Duration)
+}
+
+// LoadCredentialStore reads CredentialsConfig from YAML file and returns CredentialStore of it
+func LoadCredentialStore(path string) (*CredentialStore, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config := &CredentialsConfig{}
+	if err := yaml.Unmarshal(data, config); err != nil {
+		return nil, err
+	}
+	return NewCredentialStore(config)
+}
+
+// NewCredentialStore validates config, reads password files, fetches credentials from secret backends and returns
+// CredentialStore
+func NewCredentialStore(config *CredentialsConfig) (*CredentialStore, error) {
+	return newCredentialStore(config, kms.NewDatabaseSecretSourceFromEnvironment)
+}
+
+func newCredentialStore(config *CredentialsConfig, newSecretSource newSecretSourceFunc) (*CredentialStore, error) {
+	store := &CredentialStore{
+		credentials: make(map[string]DatabaseCredentials, len(config.Credentials)),
+		secrets:     make(map[string]*secretCredentials),
+		connections: make(map[string]*network.ConnectionManager),
+	}
+	store.drainConnections = store.drainAfterTimeout
+	for _, credentials := range config.Credentials {
+		if credentials.ClientID == "" {
+			return nil, fmt.Errorf("%w: client_id is required", ErrInvalidCredentialsConfig)
+		}
+		if _, ok := store.credentials[credentials.ClientID]; ok {
+			return nil, fmt.Errorf("%w: duplicate client_id '%s'", ErrInvalidCredentialsConfig, credentials.ClientID)
+		}
+		if credentials.SecretBackend != "" {
+			if credentials.Password != "" || credentials.PasswordFile != "" {
+				return nil, fmt.Errorf("%w: client_id '%s' should have only one of secret_backend, password and password_file", ErrInvalidCredentialsConfig, credentials.ClientID)
+			}
+			source, err := newSecretSource(credentials.SecretBackend, credentials.SecretID, credentials.SecretEndpoint)
+			if err != nil {
+				return nil, fmt.Errorf("%w: client_id '%s': %s", ErrInvalidCredentialsConfig, credentials.ClientID, err)
+			}
+			secret := &secretCredentials{source: source, config: credentials}
+			if err := store.fetchSecret(credentials.ClientID, secret, time.Now(), 0); err != nil {
+				return nil, fmt.Errorf("can't fetch database credentials of client_id '%s': %w", credentials.ClientID, err)
+			}
+			store.secrets[credentials.ClientID] = secret
+			continue
+		}
+		if credentials.SecretID != "" || credentials.SecretEndpoint != "" {
+			return nil, fmt.Errorf("%w: client_id '%s' has secret_id without secret_backend", ErrInvalidCredentialsConfig, credentials.ClientID)
+		}
+		if credentials.User == "" {
+			return nil, fmt.Errorf("%w: user of client_id '%s' is required", ErrInvalidCredentialsConfig, credentials.ClientID)
+		}
+		if credentials.PasswordFile != "" {
+			if credentials.Password != "" {
+				return nil, fmt.Errorf("%w: client_id '%s' should have only one of password and password_file", ErrInvalidCredentialsConfig, credentials.ClientID)
+			}
+			password, err := ioutil.ReadFile(credentials.PasswordFile)
+			if err != nil {
+				return nil, err
+			}
+			// files of secrets usually end with newline
+			credentials.Password = strings.TrimRight(string(password), "\r\n")
+		}
+		store.credentials[credentials.ClientID] = credentials
+	}
+	return store, nil
+}
+
+// Credentials returns database credentials of clientID
+func (store *CredentialStore) Credentials(clientID []byte) (DatabaseCredentials, bool) {
+	credentials, _, ok := store.credentialsWithConnections(clientID)
+	return credentials, ok
+}
+
+// credentialsWithConnections returns database credentials of clientID and manager of connections which should be
+// closed when credentials are rotated, nil if credentials aren't rotated
+func (store *CredentialStore) credentialsWithConnections(clientID []byte) (DatabaseCredentials, *network.ConnectionManager, bool) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	credentials, ok := store.credentials[string(clientID)]
+	return credentials, store.connections[string(clientID)], ok
+}
+
+// fetchSecret fetches credentials of clientID from secret backend and replaces current ones. If credentials have
+// changed, connections authenticated with previous ones are drained.
+func (store *CredentialStore) fetchSecret(clientID string, secret *secretCredentials, now time.Time, drainTimeout time.Duration) error {
+	fetched, err := secret.source.FetchDatabaseSecret()
+	if err != nil {
+		secret.fetchedAt, secret.refreshAfter = now, credentialsRetryInterval
+		return err
+	}
+	secret.fetchedAt, secret.refreshAfter = now, fetched.RefreshAfter
+	credentials := secret.config
+	if fetched.User != "" {
+		credentials.User = fetched.User
+	}
+	if credentials.User == "" {
+		secret.refreshAfter = credentialsRetryInterval
+		return fmt.Errorf("%w: secret doesn't contain username and user isn't configured", ErrInvalidCredentialsConfig)
+	}
+	credentials.Password = fetched.Password
+
+	store.mutex.Lock()
+	previous, ok := store.credentials[clientID]
+	if ok && previous == credentials {
+		store.mutex.Unlock()
+		return nil
+	}
+	store.credentials[clientID] = credentials
+	previousConnections := store.connections[clientID]
+	store.connections[clientID] = network.NewConnectionManager()
+	store.mutex.Unlock()
+	if previousConnections != nil {
+		log.WithField("client_id", clientID).WithField("user", credentials.User).
+			Infoln("Database credentials were rotated, draining connections authenticated with previous ones")
+		store.drainConnections(clientID, previousConnections, drainTimeout)
+	}
+	return nil
+}
+
+// drainAfterTimeout closes connections that are still open after drain timeout
+func (store *CredentialStore) drainAfterTimeout(clientID string, manager *network.ConnectionManager, drainTimeout time.Duration) {
+	go func() {
+		<-time.After(drainTimeout)
+		if err := manager.CloseConnections(); err != nil {
+			log.WithError(err).WithField("client_id", clientID).Warningln("Can't close drained connections")
+		}
+	}()
+}
+
+// nextRefresh returns time when credentials of the next secret should be refreshed, secrets which don't tell their
+// rotation time are refreshed every refreshInterval
+func (store *CredentialStore) nextRefresh(refreshInterval time.Duration) time.Time {
+	var next time.Time
+	for _, secret := range store.secrets {
+		refreshAfter := secret.refreshAfter
+		if refreshAfter <= 0 {
+			refreshAfter = refreshInterval
+		}
+		if refreshAt := secret.fetchedAt.Add(refreshAfter); next.IsZero() || refreshAt.Before(next) {
+			next = refreshAt
+		}
+	}
+	return next
+}
+
+// refreshDue refreshes credentials of all secrets which should be refreshed at now
+func (store *CredentialStore) refreshDue(now time.Time, refreshInterval, drainTimeout time.Duration) {
+	for clientID, secret := range store.secrets {
+		refreshAfter := secret.refreshAfter
+		if refreshAfter <= 0 {
+			refreshAfter = refreshInterval
+		}
+		if now.Before(secret.fetchedAt.Add(refreshAfter)) {
+			continue
+		}
+		if err := store.fetchSecret(clientID, secret, now, drainTimeout); err != nil {
+			log.WithError(err).WithField("client_id", clientID).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorDatabaseCredentialsInjection).
+				Warningln("Can't refresh database credentials from secret backend, keep using previous ones")
+		}
+	}
+}
+
+// Run refreshes credentials stored in secret backends until ctx is done. Connections authenticated with rotated
+// credentials are closed after drainTimeout.
+func (store *CredentialStore) Run(ctx context.Context, refreshInterval, drainTimeout time.Duration) {
+	if len(store.secrets) == 0 {
+		return
+	}
+	for {
+		timer := time.NewTimer(time.Until(store.nextRefresh(refreshInterval)))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case now := <-timer.C:
+			store.refreshDue(now, refreshInterval, drainTimeout)
+		}
+	}
+}
+
+// credentialInjector replaces user and database of client's startup message with database credentials of its client
+// ID and answers authentication requests of the database with them, so client never receives authentication requests
+// and doesn't know real password
+type credentialInjector struct {
+	store *CredentialStore
+	// startup message is handled by client side goroutine and authentication by database side one
+	mutex       sync.Mutex
+	credentials *DatabaseCredentials
+	scram       *scramClient
+	// connections is manager of connections authenticated with injected credentials, they are closed when credentials
+	// are rotated
+	connections *network.ConnectionManager
+	tracked     net.Conn
+}
+
+func newCredentialInjector(store *CredentialStore) *credentialInjector {
+	return &credentialInjector{store: store}
+}
+
+// injectStartup replaces user and database parameters of startup message with credentials of clientID
+func (injector *credentialInjector) injectStartup(packet *PacketHandler, clientID []byte) error {
+	credentials, connections, ok := injector.store.credentialsWithConnections(clientID)
+	if !ok {
+		return ErrNoDatabaseCredentials
+	}
+	data, err := replaceStartupParameters(packet.descriptionBuf.Bytes(), credentials)
+	if err != nil {
+		return err
+	}
+	packet.ReplaceData(data)
+	injector.mutex.Lock()
+	injector.credentials = &credentials
+	injector.scram = nil
+	injector.connections = connections
+	injector.mutex.Unlock()
+	return nil
+}
+
+// track registers connection to the database authenticated with injected credentials, so it's closed after rotation
+// of credentials
+func (injector *credentialInjector) track(conn net.Conn) {
+	injector.mutex.Lock()
+	defer injector.mutex.Unlock()
+	if injector.connections == nil || injector.tracked != nil {
+		return
+	}
+	injector.connections.AddConnection(conn)
+	injector.tracked = conn
+}
+
+// release stops tracking of connection registered by track
+func (injector *credentialInjector) release() {
+	injector.mutex.Lock()
+	defer injector.mutex.Unlock()
+	if injector.tracked != nil {
+		injector.connections.RemoveConnection(injector.tracked)
+		injector.tracked = nil
+	}
+}
+
+// replaceStartupParameters returns startup message data with user and database of credentials, other parameters are
+// kept in their order
+func replaceStartupParameters(data []byte, credentials DatabaseCredentials) ([]byte, error) {
+	parameters := []startupParameter{{name: "user", value: credentials.User}}
+	if credentials.Database != "" {
+		parameters = append(parameters, startupParameter{name: "database", value: credentials.Database})
+	}
+	return setStartupParameters(data, parameters)
+}
+
+// startupParameter is name and value of parameter of startup message
+type startupParameter struct {
+	name  string
+	value string
+}
+
+// setStartupParameters returns startup message data with values of parameters replaced, other parameters are kept in
+// their order and parameters which client didn't send are appended
+func setStartupParameters(data []byte, parameters []startupParameter) ([]byte, error) {
+	if len(data) < len(StartupRequest) || !bytes.Equal(data[:len(StartupRequest)], StartupRequest) {
+		return nil, ErrInvalidPacketLength
+	}
+	replaced := make(map[string]string, len(parameters))
+	for _, parameter := range parameters {
+		replaced[parameter.name] = parameter.value
+	}
+	output := append([]byte{}, StartupRequest...)
+	rest := data[len(StartupRequest):]
+	for len(rest) > 0 && rest[0] != 0 {
+		fields := bytes.SplitN(rest, []byte{0}, 3)
+		if len(fields) != 3 {
+			return nil, ErrInvalidPacketLength
+		}
+		name, value := string(fields[0]), fields[1]
+		rest = fields[2]
+		if newValue, ok := replaced[name]; ok {
+			value = []byte(newValue)
+			delete(replaced, name)
+		}
+		output = append(output, name...)
+		output = append(output, 0)
+		output = append(output, value...)
+		output = append(output, 0)
+	}
+	// parameters which client didn't send
+	for _, parameter := range parameters {
+		if value, ok := replaced[parameter.name]; ok {
+			output = append(output, parameter.name...)
+			output = append(output, 0)
+			output = append(output, value...)
+			output = append(output, 0)
+			delete(replaced, parameter.name)
+		}
+	}
+	return append(output, 0), nil
+}
+
+// authenticate handles authentication request of the database and returns message which should be sent to the
+// database in response, or forward=true if request is AuthenticationOk which should be forwarded to client
+func (injector *credentialInjector) authenticate(data []byte) (response []byte, forward bool, err error) {
+	if len(data) < 4 {
+		return nil, false, ErrInvalidPacketLength
+	}
+	injector.mutex.Lock()
+	defer injector.mutex.Unlock()
+	code := binary.BigEndian.Uint32(data[:4])
+	if code == authenticationOk {
+		return nil, true, nil
+	}
+	if injector.credentials == nil {
+		return nil, false, ErrNoDatabaseCredentials
+	}
+	credentials := injector.credentials
+	data = data[4:]
+	switch code {
+	case authenticationCleartextPassword:
+		return newPasswordMessage(append([]byte(credentials.Password), 0)), false, nil
+	case authenticationMD5Password:
+		if len(data) != 4 {
+			return nil, false, ErrInvalidPacketLength
+		}
+		return newPasswordMessage(append([]byte(md5Password(credentials.User, credentials.Password, data)), 0)), false, nil
+	case authenticationSASL:
+		// mechanisms are null-terminated names with trailing null, SCRAM-SHA-256-PLUS requires channel binding
+		// with TLS connection of AcraServer which isn't supported
+		if !bytes.Contains(append([]byte{0}, data...), []byte("\x00"+scramSHA256Mechanism+"\x00")) {
+			return nil, false, fmt.Errorf("%w: SASL mechanisms %q", ErrUnsupportedAuthentication, data)
+		}
+		injector.scram, err = newSCRAMClient(credentials.Password)
+		if err != nil {
+			return nil, false, err
+		}
+		clientFirst := injector.scram.clientFirstMessage()
+		message := append([]byte(scramSHA256Mechanism), 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(message[len(scramSHA256Mechanism)+1:], uint32(len(clientFirst)))
+		return newPasswordMessage(append(message, clientFirst...)), false, nil
+	case authenticationSASLContinue:
+		if injector.scram == nil {
+			return nil, false, ErrInvalidSCRAMExchange
+		}
+		clientFinal, err := injector.scram.clientFinalMessage(data)
+		if err != nil {
+			return nil, false, err
+		}
+		return newPasswordMessage(clientFinal), false, nil
+	case authenticationSASLFinal:
+		if injector.scram == nil {
+			return nil, false, ErrInvalidSCRAMExchange
+		}
+		err := injector.scram.verifyServerFinalMessage(data)
+		injector.scram = nil
+		return nil, false, err
+	default:
+		return nil, false, fmt.Errorf("%w: request %d", ErrUnsupportedAuthentication, code)
+	}
+}
+
+// newPasswordMessage returns PasswordMessage (also used for SASL responses) with data
+func newPasswordMessage(data []byte) []byte {
+	message := make([]byte, 5, 5+len(data))
+	message[0] = PasswordMessageType
+	binary.BigEndian.PutUint32(message[1:5], uint32(len(data)+DataRowLengthBufSize))
+	return append(message, data...)
+}
+
+// md5Password returns response to AuthenticationMD5Password: "md5" + md5(md5(password + user) + salt) in hex
+func md5Password(user, password string, salt []byte) string {
+	inner := md5.Sum([]byte(password + user))
+	outer := md5.Sum(append([]byte(hex.EncodeToString(inner[:])), salt...))
+	return "md5" + hex.EncodeToString(outer[:])
+}
+
+// scramNonceLength is length of random part of client nonce
+const scramNonceLength = 18
+
+// scramClient is client side of SCRAM-SHA-256 exchange (RFC 5802, RFC 7677) without channel binding. PostgreSQL
+// ignores user name of SCRAM messages and uses one from startup message.
+type scramClient struct {
+	password        string
+	clientNonce     string
+	clientFirstBare string
+	serverSignature []byte
+}
+
+func newSCRAMClient(password string) (*scramClient, error) {
+	nonce := make([]byte, scramNonceLength)
+	if _, err := random.Read(nonce); err != nil {
+		return nil, err
+	}
+	clientNonce := base64.StdEncoding.EncodeToString(nonce)
+	return &scramClient{password: password, clientNonce: clientNonce, clientFirstBare: "n=,r=" + clientNonce}, nil
+}
+
+// clientFirstMessage returns client-first-message with gs2 header of client without channel binding support
+func (client *scramClient) clientFirstMessage() []byte {
+	return []byte("n,," + client.clientFirstBare)
+}
+
+// clientFinalMessage returns client-final-message with proof of password for server-first-message
+func (client *scramClient) clientFinalMessage(serverFirst []byte) ([]byte, error) {
+	var nonce, salt string
+	var iterations int
+	for _, attribute := range strings.Split(string(serverFirst), ",") {
+		if len(attribute) < 2 || attribute[1] != '=' {
+			return nil, ErrInvalidSCRAMExchange
+		}
+		switch attribute[0] {
+		case 'r':
+			nonce = attribute[2:]
+		case 's':
+			salt = attribute[2:]
+		case 'i':
+			var err error
+			if iterations, err = strconv.Atoi(attribute[2:]); err != nil {
+				return nil, ErrInvalidSCRAMExchange
+			}
+		}
+	}
+	// server nonce extends client nonce
+	if !strings.HasPrefix(nonce, client.clientNonce) || len(nonce) == len(client.clientNonce) || iterations <= 0 {
+		return nil, ErrInvalidSCRAMExchange
+	}
+	saltBytes, err := base64.StdEncoding.DecodeString(salt)
+	if err != nil || len(saltBytes) == 0 {
+		return nil, ErrInvalidSCRAMExchange
+	}
+	// "biws" is base64 of gs2 header "n,,"
+	clientFinalWithoutProof := "c=biws,r=" + nonce
+	authMessage := []byte(client.clientFirstBare + "," + string(serverFirst) + "," + clientFinalWithoutProof)
+
+	saltedPassword := pbkdf2.Key([]byte(client.password), saltBytes, iterations, sha256.Size, sha256.New)
+	clientKey := scramHMAC(saltedPassword, []byte("Client Key"))
+	storedKey := sha256.Sum256(clientKey)
+	clientSignature := scramHMAC(storedKey[:], authMessage)
+	proof := make([]byte, len(clientKey))
+	for i := range clientKey {
+		proof[i] = clientKey[i] ^ clientSignature[i]
+	}
+	client.serverSignature = scramHMAC(scramHMAC(saltedPassword, []byte("Server Key")), authMessage)
+	return []byte(clientFinalWithoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof)), nil
+}
+
+// verifyServerFinalMessage checks that server knows password too
+func (client *scramClient) verifyServerFinalMessage(serverFinal []byte) error {
+	if client.serverSignature == nil || !bytes.HasPrefix(serverFinal, []byte("v=")) {
+		return ErrInvalidSCRAMExchange
+	}
+	signature, err := base64.StdEncoding.DecodeString(string(serverFinal[2:]))
+	if err != nil || !hmac.Equal(signature, client.serverSignature) {
+		return ErrInvalidSCRAMExchange
+	}
+	return nil
+}
+
+func scramHMAC(key, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
@@ -0,0 +1,510 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package postgresql
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cossacklabs/acra/keystore/kms"
+	"github.com/cossacklabs/acra/network"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// newTestStartupMessage returns StartupMessage with parameters as name/value pairs
+func newTestStartupMessage(parameters ...string) []byte {
+	data := append([]byte{}, StartupRequest...)
+	for _, parameter := range parameters {
+		data = append(data, parameter...)
+		data = append(data, 0)
+	}
+	data = append(data, 0)
+	message := make([]byte, 4, 4+len(data))
+	binary.BigEndian.PutUint32(message, uint32(len(data)+4))
+	return append(message, data...)
+}
+
+// newTestAuthenticationMessage returns authentication request of database with code and data
+func newTestAuthenticationMessage(code uint32, data []byte) []byte {
+	message := []byte{AuthenticationMessageType, 0, 0, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(message[1:5], uint32(8+len(data)))
+	binary.BigEndian.PutUint32(message[5:9], code)
+	return append(message, data...)
+}
+
+// passwordMessageData returns data of PasswordMessage after checking its header
+func passwordMessageData(t *testing.T, message []byte) []byte {
+	if len(message) < 5 || message[0] != PasswordMessageType || int(binary.BigEndian.Uint32(message[1:5])) != len(message)-1 {
+		t.Fatalf("Invalid password message: %q", message)
+	}
+	return message[5:]
+}
+
+func TestCredentialStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "credentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	passwordFile := filepath.Join(dir, "password")
+	if err := ioutil.WriteFile(passwordFile, []byte("file secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	configFile := filepath.Join(dir, "credentials.yaml")
+	config := `
+credentials:
+  - client_id: app
+    user: app_user
+    password: secret
+  - client_id: reports
+    user: reports_user
+    password_file: ` + passwordFile + `
+    database: analytics
+`
+	if err := ioutil.WriteFile(configFile, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	store, err := LoadCredentialStore(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if credentials, ok := store.Credentials([]byte("app")); !ok || credentials.User != "app_user" || credentials.Password != "secret" {
+		t.Fatalf("Unexpected credentials: %+v", credentials)
+	}
+	if credentials, ok := store.Credentials([]byte("reports")); !ok || credentials.Password != "file secret" || credentials.Database != "analytics" {
+		t.Fatalf("Unexpected credentials: %+v", credentials)
+	}
+	if _, ok := store.Credentials([]byte("unknown")); ok {
+		t.Fatal("Expected no credentials of unknown client ID")
+	}
+
+	invalidConfigs := []*CredentialsConfig{
+		{Credentials: []DatabaseCredentials{{User: "app_user"}}},
+		{Credentials: []DatabaseCredentials{{ClientID: "app"}}},
+		{Credentials: []DatabaseCredentials{{ClientID: "app", User: "user1"}, {ClientID: "app", User: "user2"}}},
+		{Credentials: []DatabaseCredentials{{ClientID: "app", User: "app_user", Password: "secret", PasswordFile: passwordFile}}},
+	}
+	for i, config := range invalidConfigs {
+		if _, err := NewCredentialStore(config); !errors.Is(err, ErrInvalidCredentialsConfig) {
+			t.Fatalf("[%d] Expected ErrInvalidCredentialsConfig, took %v", i, err)
+		}
+	}
+}
+
+// testSecretSource returns configured secret or error and counts fetches
+type testSecretSource struct {
+	secret  kms.DatabaseSecret
+	err     error
+	fetches int
+}
+
+func (source *testSecretSource) FetchDatabaseSecret() (kms.DatabaseSecret, error) {
+	source.fetches++
+	return source.secret, source.err
+}
+
+func TestCredentialStoreSecretRotation(t *testing.T) {
+	vaultSource := &testSecretSource{secret: kms.DatabaseSecret{User: "v-app-1", Password: "first", RefreshAfter: time.Minute}}
+	awsSource := &testSecretSource{secret: kms.DatabaseSecret{Password: "aws secret"}}
+	sources := map[string]kms.DatabaseSecretSource{"database/creds/app": vaultSource, "rds/reports": awsSource}
+	newSource := func(backendType, secretID, endpoint string) (kms.DatabaseSecretSource, error) {
+		if source, ok := sources[secretID]; ok {
+			return source, nil
+		}
+		return nil, kms.ErrUnsupportedKMS
+	}
+	store, err := newCredentialStore(&CredentialsConfig{Credentials: []DatabaseCredentials{
+		{ClientID: "app", SecretBackend: kms.TypeVault, SecretID: "database/creds/app", Database: "app"},
+		{ClientID: "reports", User: "reports_user", SecretBackend: kms.TypeAWS, SecretID: "rds/reports"},
+		{ClientID: "static", User: "static_user", Password: "static"},
+	}}, newSource)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var drained []string
+	store.drainConnections = func(clientID string, manager *network.ConnectionManager, drainTimeout time.Duration) {
+		if drainTimeout != time.Second {
+			t.Fatalf("Unexpected drain timeout %v", drainTimeout)
+		}
+		drained = append(drained, clientID)
+		manager.CloseConnections()
+	}
+	if credentials, ok := store.Credentials([]byte("app")); !ok || credentials.User != "v-app-1" || credentials.Password != "first" || credentials.Database != "app" {
+		t.Fatalf("Unexpected credentials: %+v", credentials)
+	}
+	// configured user is used if secret doesn't contain username
+	if credentials, ok := store.Credentials([]byte("reports")); !ok || credentials.User != "reports_user" || credentials.Password != "aws secret" {
+		t.Fatalf("Unexpected credentials: %+v", credentials)
+	}
+
+	// connection authenticated with first credentials
+	packet, err := NewClientSidePacketHandler(bytes.NewReader(newTestStartupMessage("user", "client")), bufio.NewWriter(&bytes.Buffer{}), logrus.NewEntry(logrus.StandardLogger()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := packet.ReadClientPacket(); err != nil {
+		t.Fatal(err)
+	}
+	injector := newCredentialInjector(store)
+	if err := injector.injectStartup(packet, []byte("app")); err != nil {
+		t.Fatal(err)
+	}
+	clientConn, dbConn := net.Pipe()
+	defer clientConn.Close()
+	injector.track(dbConn)
+	_, staticConnections, _ := store.credentialsWithConnections([]byte("static"))
+	if staticConnections != nil {
+		t.Fatal("Credentials from config shouldn't be tracked")
+	}
+
+	start := vaultSource.fetches
+	refreshInterval := time.Minute * 5
+	now := time.Now()
+	if next := store.nextRefresh(refreshInterval); next.After(now.Add(time.Minute)) {
+		t.Fatalf("Expected refresh after RefreshAfter of secret, took %v", next.Sub(now))
+	}
+	store.refreshDue(now.Add(time.Second*30), refreshInterval, time.Second)
+	if vaultSource.fetches != start {
+		t.Fatal("Secret was refreshed before RefreshAfter")
+	}
+
+	vaultSource.secret = kms.DatabaseSecret{User: "v-app-2", Password: "second", RefreshAfter: time.Minute}
+	store.refreshDue(now.Add(time.Minute*2), refreshInterval, time.Second)
+	if credentials, _ := store.Credentials([]byte("app")); credentials.User != "v-app-2" || credentials.Password != "second" {
+		t.Fatalf("Credentials weren't rotated: %+v", credentials)
+	}
+	if strings.Join(drained, ",") != "app" {
+		t.Fatalf("Unexpected drained client IDs %v", drained)
+	}
+	if _, err := dbConn.Write([]byte{0}); err == nil {
+		t.Fatal("Connection authenticated with rotated credentials wasn't closed")
+	}
+	injector.release()
+
+	// failed refresh keeps credentials and is retried soon, refresh with the same secret doesn't drain connections
+	awsSource.err = errors.New("unavailable")
+	later := now.Add(refreshInterval * 2)
+	store.refreshDue(later, refreshInterval, time.Second)
+	if credentials, _ := store.Credentials([]byte("reports")); credentials.Password != "aws secret" {
+		t.Fatalf("Credentials were lost after failed refresh: %+v", credentials)
+	}
+	awsSource.err = nil
+	fetches := awsSource.fetches
+	store.refreshDue(later.Add(credentialsRetryInterval), refreshInterval, time.Second)
+	if awsSource.fetches != fetches+1 {
+		t.Fatal("Failed refresh wasn't retried")
+	}
+	if strings.Join(drained, ",") != "app" {
+		t.Fatalf("Unchanged credentials drained connections: %v", drained)
+	}
+
+	invalidConfigs := []*CredentialsConfig{
+		{Credentials: []DatabaseCredentials{{ClientID: "app", SecretBackend: kms.TypeVault, SecretID: "database/creds/app", Password: "secret"}}},
+		{Credentials: []DatabaseCredentials{{ClientID: "app", User: "app_user", Password: "secret", SecretID: "database/creds/app"}}},
+		{Credentials: []DatabaseCredentials{{ClientID: "app", SecretBackend: "gcp", SecretID: "app"}}},
+	}
+	for i, config := range invalidConfigs {
+		if _, err := newCredentialStore(config, newSource); !errors.Is(err, ErrInvalidCredentialsConfig) {
+			t.Fatalf("[%d] Expected ErrInvalidCredentialsConfig, took %v", i, err)
+		}
+	}
+	awsSource.err = errors.New("unavailable")
+	if _, err := newCredentialStore(&CredentialsConfig{Credentials: []DatabaseCredentials{
+		{ClientID: "reports", User: "reports_user", SecretBackend: kms.TypeAWS, SecretID: "rds/reports"},
+	}}, newSource); err == nil {
+		t.Fatal("Expected error if credentials can't be fetched on start")
+	}
+}
+
+func TestInjectStartup(t *testing.T) {
+	store, err := NewCredentialStore(&CredentialsConfig{Credentials: []DatabaseCredentials{
+		{ClientID: "app", User: "app_user", Password: "secret"},
+		{ClientID: "reports", User: "reports_user", Password: "secret", Database: "analytics"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		clientID string
+		startup  []byte
+		expected []byte
+	}{
+		{"app", newTestStartupMessage("user", "client", "database", "db", "application_name", "psql"),
+			newTestStartupMessage("user", "app_user", "database", "db", "application_name", "psql")},
+		{"reports", newTestStartupMessage("user", "client", "application_name", "psql"),
+			newTestStartupMessage("user", "reports_user", "application_name", "psql", "database", "analytics")},
+		{"app", newTestStartupMessage("database", "db"),
+			newTestStartupMessage("database", "db", "user", "app_user")},
+	}
+	for i, testCase := range testCases {
+		output := &bytes.Buffer{}
+		packet, err := NewClientSidePacketHandler(bytes.NewReader(testCase.startup), bufio.NewWriter(output), logrus.NewEntry(logrus.StandardLogger()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := packet.ReadClientPacket(); err != nil {
+			t.Fatal(err)
+		}
+		if !packet.IsStartupMessage() {
+			t.Fatalf("[%d] Startup message isn't recognized", i)
+		}
+		if err := newCredentialInjector(store).injectStartup(packet, []byte(testCase.clientID)); err != nil {
+			t.Fatal(err)
+		}
+		if err := packet.sendPacket(); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(output.Bytes(), testCase.expected) {
+			t.Fatalf("[%d] Expected %q, took %q", i, testCase.expected, output.Bytes())
+		}
+	}
+	packet, err := NewClientSidePacketHandler(bytes.NewReader(testCases[0].startup), bufio.NewWriter(&bytes.Buffer{}), logrus.NewEntry(logrus.StandardLogger()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := packet.ReadClientPacket(); err != nil {
+		t.Fatal(err)
+	}
+	if err := newCredentialInjector(store).injectStartup(packet, []byte("unknown")); err != ErrNoDatabaseCredentials {
+		t.Fatalf("Expected ErrNoDatabaseCredentials, took %v", err)
+	}
+}
+
+func TestHandleClientCredentialsWithoutVerifiedClientID(t *testing.T) {
+	store, err := NewCredentialStore(&CredentialsConfig{Credentials: []DatabaseCredentials{
+		{ClientID: "app", User: "app_user", Password: "secret"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	startup := newTestStartupMessage("user", "client", "database", "db")
+	for _, verified := range []bool{false, true} {
+		clientConnection, acraConnection := net.Pipe()
+		// plaintext connection without SSLRequest has only fallback client ID from configuration
+		proxy := &PgProxy{clientConnection: acraConnection, credentialInjector: newCredentialInjector(store), clientID: []byte("app"), clientIDVerified: verified}
+		output := &bytes.Buffer{}
+		packet, err := NewClientSidePacketHandler(bytes.NewReader(startup), bufio.NewWriter(output), logrus.NewEntry(logrus.StandardLogger()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := packet.ReadClientPacket(); err != nil {
+			t.Fatal(err)
+		}
+		responseCh := make(chan []byte, 1)
+		go func() {
+			response, _ := ioutil.ReadAll(clientConnection)
+			responseCh <- response
+		}()
+		drop, err := proxy.handleClientCredentials(packet, logrus.NewEntry(logrus.StandardLogger()))
+		acraConnection.Close()
+		response := <-responseCh
+		clientConnection.Close()
+		if drop {
+			t.Fatal("Startup message shouldn't be dropped")
+		}
+		if !verified {
+			if err != ErrUnverifiedClientID {
+				t.Fatalf("Expected ErrUnverifiedClientID, took %v", err)
+			}
+			if len(response) == 0 || response[0] != ErrorResponseMessageType {
+				t.Fatalf("Expected error response to client, took %q", response)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := packet.sendPacket(); err != nil {
+			t.Fatal(err)
+		}
+		if expected := newTestStartupMessage("user", "app_user", "database", "db"); !bytes.Equal(output.Bytes(), expected) {
+			t.Fatalf("Expected %q, took %q", expected, output.Bytes())
+		}
+	}
+}
+
+func TestSetStartupParameters(t *testing.T) {
+	parameters := []startupParameter{{name: "application_name", value: "app"}, {name: "acra.client_id", value: "client"}}
+	output, err := setStartupParameters(newTestStartupMessage("user", "user", "application_name", "psql", "database", "db")[4:], parameters)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := newTestStartupMessage("user", "user", "application_name", "app", "database", "db", "acra.client_id", "client")[4:]
+	if !bytes.Equal(output, expected) {
+		t.Fatalf("Expected %q, took %q", expected, output)
+	}
+	if _, err := setStartupParameters([]byte("invalid"), parameters); err != ErrInvalidPacketLength {
+		t.Fatalf("Expected ErrInvalidPacketLength, took %v", err)
+	}
+}
+
+// testSCRAMServer is server side of SCRAM-SHA-256 exchange with known salt and iteration count
+type testSCRAMServer struct {
+	password    string
+	salt        []byte
+	iterations  int
+	serverFirst string
+	clientFirst string
+}
+
+func (server *testSCRAMServer) first(t *testing.T, clientFirst string) string {
+	if !strings.HasPrefix(clientFirst, "n,,n=,r=") {
+		t.Fatalf("Unexpected client-first-message: %s", clientFirst)
+	}
+	server.clientFirst = strings.TrimPrefix(clientFirst, "n,,")
+	nonce := strings.TrimPrefix(server.clientFirst, "n=,r=") + "servernonce"
+	server.serverFirst = "r=" + nonce + ",s=" + base64.StdEncoding.EncodeToString(server.salt) + ",i=" + strconv.Itoa(server.iterations)
+	return server.serverFirst
+}
+
+// final verifies proof of client-final-message and returns server-final-message
+func (server *testSCRAMServer) final(t *testing.T, clientFinal string) string {
+	index := strings.LastIndex(clientFinal, ",p=")
+	if index < 0 {
+		t.Fatalf("Client-final-message without proof: %s", clientFinal)
+	}
+	authMessage := []byte(server.clientFirst + "," + server.serverFirst + "," + clientFinal[:index])
+	proof, err := base64.StdEncoding.DecodeString(clientFinal[index+3:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	saltedPassword := pbkdf2.Key([]byte(server.password), server.salt, server.iterations, sha256.Size, sha256.New)
+	storedKey := sha256.Sum256(scramHMAC(saltedPassword, []byte("Client Key")))
+	clientSignature := scramHMAC(storedKey[:], authMessage)
+	clientKey := make([]byte, len(proof))
+	for i := range proof {
+		clientKey[i] = proof[i] ^ clientSignature[i]
+	}
+	if computed := sha256.Sum256(clientKey); !hmac.Equal(computed[:], storedKey[:]) {
+		t.Fatal("Invalid client proof")
+	}
+	return "v=" + base64.StdEncoding.EncodeToString(scramHMAC(scramHMAC(saltedPassword, []byte("Server Key")), authMessage))
+}
+
+func TestCredentialInjectorAuthenticate(t *testing.T) {
+	credentials := DatabaseCredentials{ClientID: "app", User: "postgres", Password: "secret"}
+	injector := &credentialInjector{credentials: &credentials}
+
+	response, forward, err := injector.authenticate([]byte{0, 0, 0, authenticationCleartextPassword})
+	if err != nil || forward {
+		t.Fatalf("Unexpected result, forward: %v, err: %v", forward, err)
+	}
+	if data := passwordMessageData(t, response); !bytes.Equal(data, []byte("secret\x00")) {
+		t.Fatalf("Unexpected cleartext password: %q", data)
+	}
+
+	response, forward, err = injector.authenticate([]byte{0, 0, 0, authenticationMD5Password, 1, 2, 3, 4})
+	if err != nil || forward {
+		t.Fatalf("Unexpected result, forward: %v, err: %v", forward, err)
+	}
+	// "md5" + md5(md5("secret" + "postgres") + "\x01\x02\x03\x04")
+	if data := passwordMessageData(t, response); !bytes.Equal(data, []byte("md5bb41a296aab6baccb36ff243a562abff\x00")) {
+		t.Fatalf("Unexpected md5 password: %q", data)
+	}
+
+	server := &testSCRAMServer{password: "secret", salt: []byte("salt of server"), iterations: 4096}
+	response, forward, err = injector.authenticate(append([]byte{0, 0, 0, authenticationSASL}, "SCRAM-SHA-256-PLUS\x00SCRAM-SHA-256\x00\x00"...))
+	if err != nil || forward {
+		t.Fatalf("Unexpected result, forward: %v, err: %v", forward, err)
+	}
+	data := passwordMessageData(t, response)
+	mechanism := []byte(scramSHA256Mechanism + "\x00")
+	if !bytes.HasPrefix(data, mechanism) || int(binary.BigEndian.Uint32(data[len(mechanism):])) != len(data)-len(mechanism)-4 {
+		t.Fatalf("Invalid SASLInitialResponse: %q", data)
+	}
+	serverFirst := server.first(t, string(data[len(mechanism)+4:]))
+	response, forward, err = injector.authenticate(append([]byte{0, 0, 0, authenticationSASLContinue}, serverFirst...))
+	if err != nil || forward {
+		t.Fatalf("Unexpected result, forward: %v, err: %v", forward, err)
+	}
+	serverFinal := server.final(t, string(passwordMessageData(t, response)))
+	if response, forward, err = injector.authenticate(append([]byte{0, 0, 0, authenticationSASLFinal}, serverFinal...)); err != nil || forward || response != nil {
+		t.Fatalf("Unexpected result, response: %q, forward: %v, err: %v", response, forward, err)
+	}
+	if _, forward, err = injector.authenticate([]byte{0, 0, 0, authenticationOk}); err != nil || !forward {
+		t.Fatalf("AuthenticationOk should be forwarded, err: %v", err)
+	}
+
+	// server which doesn't know password
+	if _, _, err = injector.authenticate(append([]byte{0, 0, 0, authenticationSASL}, "SCRAM-SHA-256\x00\x00"...)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = injector.authenticate(append([]byte{0, 0, 0, authenticationSASLContinue}, "r=unrelated,s=c2FsdA==,i=4096"...)); err != ErrInvalidSCRAMExchange {
+		t.Fatalf("Expected ErrInvalidSCRAMExchange for foreign nonce, took %v", err)
+	}
+	if _, _, err = injector.authenticate(append([]byte{0, 0, 0, authenticationSASL}, "SCRAM-SHA-256-PLUS\x00\x00"...)); !errors.Is(err, ErrUnsupportedAuthentication) {
+		t.Fatalf("Expected ErrUnsupportedAuthentication, took %v", err)
+	}
+	// GSSAPI
+	if _, _, err = injector.authenticate([]byte{0, 0, 0, 7}); !errors.Is(err, ErrUnsupportedAuthentication) {
+		t.Fatalf("Expected ErrUnsupportedAuthentication, took %v", err)
+	}
+}
+
+func TestDatabaseAuthenticationIsAnswered(t *testing.T) {
+	credentials := DatabaseCredentials{ClientID: "app", User: "postgres", Password: "secret"}
+	dbConnection, acraConnection := net.Pipe()
+	defer dbConnection.Close()
+	defer acraConnection.Close()
+	proxy := &PgProxy{dbConnection: acraConnection, credentialInjector: &credentialInjector{credentials: &credentials}}
+
+	input := append(newTestAuthenticationMessage(authenticationCleartextPassword, nil), newTestAuthenticationMessage(authenticationOk, nil)...)
+	packet, err := NewDbSidePacketHandler(bytes.NewReader(input), bufio.NewWriter(&bytes.Buffer{}), logrus.NewEntry(logrus.StandardLogger()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	responseCh := make(chan []byte, 1)
+	go func() {
+		response := make([]byte, 12)
+		dbConnection.Read(response)
+		responseCh <- response
+	}()
+	if err := packet.ReadPacket(); err != nil {
+		t.Fatal(err)
+	}
+	if !packet.IsAuthentication() {
+		t.Fatal("Authentication request isn't recognized")
+	}
+	forward, err := proxy.handleDatabaseAuthentication(packet, logrus.NewEntry(logrus.StandardLogger()))
+	if err != nil || forward {
+		t.Fatalf("Authentication request shouldn't be forwarded, err: %v", err)
+	}
+	if response := <-responseCh; !bytes.Equal(response, newPasswordMessage([]byte("secret\x00"))) {
+		t.Fatalf("Unexpected response to database: %q", response)
+	}
+	packet.Reset()
+	if err := packet.ReadPacket(); err != nil {
+		t.Fatal(err)
+	}
+	if forward, err := proxy.handleDatabaseAuthentication(packet, logrus.NewEntry(logrus.StandardLogger())); err != nil || !forward {
+		t.Fatalf("AuthenticationOk should be forwarded, err: %v", err)
+	}
+}
@@ -61,6 +61,7 @@ func (fabric *DecryptorFactory) New(clientID []byte) (base.Decryptor, error) {
 	matcherPool := fabric.zoneMatcherFactory()
 	decryptor := NewPgDecryptor(clientID, dataDecryptor, fabric.settings.WithZone(), fabric.settings.Keystore())
 	decryptor.isWholeMatch = fabric.settings.WholeMatch()
+	decryptor.isInlineFallback = fabric.settings.InlineFallback()
 	zoneMatcher := zone.NewZoneMatcher(matcherPool, fabric.settings.Keystore())
 	decryptor.zoneMatcher = zoneMatcher
 	decryptor.callbackStorage = fabric.settings.PoisonCallbacks()
@@ -0,0 +1,116 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package postgresql
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Message types of database errors and notices forwarded to clients
+// https://www.postgresql.org/docs/current/protocol-message-formats.html
+const (
+	ErrorResponseMessageType  byte = 'E'
+	NoticeResponseMessageType byte = 'N'
+)
+
+// Groups of ErrorResponse and NoticeResponse fields which can be stripped by ErrorMessagePolicy
+// https://www.postgresql.org/docs/current/protocol-error-fields.html
+const (
+	// ErrorFieldsSource are file, line and routine of PostgreSQL source code which reveal server version
+	ErrorFieldsSource = "source"
+	// ErrorFieldsInternalQuery are text of internally generated query (e.g. by PL/pgSQL function), position in it
+	// and call stack context
+	ErrorFieldsInternalQuery = "internal_query"
+	// ErrorFieldsHint is hint how to fix the problem
+	ErrorFieldsHint = "hint"
+	// ErrorFieldsDetail is secondary message with details, which may contain values of rows
+	ErrorFieldsDetail = "detail"
+)
+
+// ErrorFieldsList contains all groups of fields accepted by NewErrorMessagePolicy
+var ErrorFieldsList = []string{ErrorFieldsSource, ErrorFieldsInternalQuery, ErrorFieldsHint, ErrorFieldsDetail}
+
+var errorFieldGroups = map[string][]byte{
+	ErrorFieldsSource:        {'F', 'L', 'R'},
+	ErrorFieldsInternalQuery: {'q', 'p', 'W'},
+	ErrorFieldsHint:          {'H'},
+	ErrorFieldsDetail:        {'D'},
+}
+
+// Errors returned by ErrorMessagePolicy
+var (
+	ErrInvalidErrorFields     = errors.New("unknown group of error message fields")
+	ErrMalformedErrorResponse = errors.New("malformed error or notice message")
+)
+
+// ErrorMessagePolicy removes configured fields from ErrorResponse and NoticeResponse messages of database before
+// they are forwarded to clients, so possibly compromised applications learn less about the database
+type ErrorMessagePolicy struct {
+	strippedFields map[byte]bool
+}
+
+// NewErrorMessagePolicy returns ErrorMessagePolicy which strips comma-separated groups of fields from ErrorFieldsList
+func NewErrorMessagePolicy(groups string) (*ErrorMessagePolicy, error) {
+	policy := &ErrorMessagePolicy{strippedFields: make(map[byte]bool)}
+	for _, group := range strings.Split(groups, ",") {
+		group = strings.TrimSpace(group)
+		if group == "" {
+			continue
+		}
+		fields, ok := errorFieldGroups[group]
+		if !ok {
+			return nil, fmt.Errorf("%w '%s', expected %s", ErrInvalidErrorFields, group, strings.Join(ErrorFieldsList, ", "))
+		}
+		for _, field := range fields {
+			policy.strippedFields[field] = true
+		}
+	}
+	return policy, nil
+}
+
+// StripsFields returns true if policy removes any fields
+func (policy *ErrorMessagePolicy) StripsFields() bool {
+	return policy != nil && len(policy.strippedFields) > 0
+}
+
+// Filter returns body of ErrorResponse or NoticeResponse message without stripped fields. The body is sequence of
+// fields, each is type byte followed by null-terminated string, with zero byte at the end.
+func (policy *ErrorMessagePolicy) Filter(data []byte) ([]byte, error) {
+	output := make([]byte, 0, len(data))
+	for {
+		if len(data) == 0 {
+			return nil, ErrMalformedErrorResponse
+		}
+		fieldType := data[0]
+		if fieldType == 0 {
+			return append(output, 0), nil
+		}
+		end := bytes.IndexByte(data[1:], 0)
+		if end < 0 {
+			return nil, ErrMalformedErrorResponse
+		}
+		// type byte, value and its terminator
+		fieldLength := 1 + end + 1
+		if !policy.strippedFields[fieldType] {
+			output = append(output, data[:fieldLength]...)
+		}
+		data = data[fieldLength:]
+	}
+}
@@ -0,0 +1,128 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package postgresql
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+// errorFields returns body of ErrorResponse with fields in order of pairs
+func errorFields(pairs ...string) []byte {
+	output := []byte{}
+	for i := 0; i < len(pairs); i += 2 {
+		output = append(output, pairs[i][0])
+		output = append(output, pairs[i+1]...)
+		output = append(output, 0)
+	}
+	return append(output, 0)
+}
+
+func TestErrorMessagePolicyFilter(t *testing.T) {
+	data := errorFields(
+		"S", "ERROR", "C", "23505", "M", "duplicate key value violates unique constraint",
+		"D", "Key (email)=(user@example.com) already exists.", "H", "Use another email",
+		"W", "SQL statement \"INSERT INTO users VALUES ($1)\"", "q", "INSERT INTO users VALUES ($1)", "p", "1",
+		"F", "nbtinsert.c", "L", "434", "R", "_bt_check_unique")
+
+	policy, err := NewErrorMessagePolicy("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if policy.StripsFields() {
+		t.Fatal("Empty policy strips fields")
+	}
+	if filtered, err := policy.Filter(data); err != nil || !bytes.Equal(filtered, data) {
+		t.Fatalf("Empty policy changed message: %v", err)
+	}
+
+	policy, err = NewErrorMessagePolicy("source, internal_query,hint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	filtered, err := policy.Filter(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := errorFields(
+		"S", "ERROR", "C", "23505", "M", "duplicate key value violates unique constraint",
+		"D", "Key (email)=(user@example.com) already exists.")
+	if !bytes.Equal(filtered, expected) {
+		t.Fatalf("Expected %q, took %q", expected, filtered)
+	}
+	policy, err = NewErrorMessagePolicy(ErrorFieldsDetail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filtered, err := policy.Filter(data); err != nil || bytes.Contains(filtered, []byte("user@example.com")) {
+		t.Fatalf("Detail isn't stripped: %v", err)
+	}
+
+	for _, malformed := range [][]byte{{}, []byte("Mmessage"), []byte("Mmessage\x00")} {
+		if _, err := policy.Filter(malformed); err != ErrMalformedErrorResponse {
+			t.Fatalf("Expected ErrMalformedErrorResponse for %q, took %v", malformed, err)
+		}
+	}
+	if _, err := NewErrorMessagePolicy("source,version"); !errors.Is(err, ErrInvalidErrorFields) {
+		t.Fatalf("Expected ErrInvalidErrorFields, took %v", err)
+	}
+}
+
+func TestErrorOrNoticePacketIsFiltered(t *testing.T) {
+	policy, err := NewErrorMessagePolicy(ErrorFieldsSource)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, messageType := range []byte{ErrorResponseMessageType, NoticeResponseMessageType} {
+		body := errorFields("S", "NOTICE", "M", "relation already exists, skipping", "F", "parse_utilcmd.c")
+		packet := []byte{messageType, 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(packet[1:], uint32(len(body)+4))
+		packet = append(packet, body...)
+
+		output := &bytes.Buffer{}
+		writer := bufio.NewWriter(output)
+		handler, err := NewDbSidePacketHandler(bytes.NewReader(packet), writer, logrus.NewEntry(logrus.StandardLogger()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := handler.ReadPacket(); err != nil {
+			t.Fatal(err)
+		}
+		proxy := &PgProxy{protocolState: NewPgProtocolState(), errorMessagePolicy: policy}
+		if err := proxy.handleDatabasePacket(nil, handler, handler.logger); err != nil {
+			t.Fatal(err)
+		}
+		if proxy.protocolState.LastPacketType() != ErrorOrNoticePacket {
+			t.Fatalf("Packet '%c' isn't recognized as error or notice", messageType)
+		}
+		if err := handler.sendPacket(); err != nil {
+			t.Fatal(err)
+		}
+		expectedBody := errorFields("S", "NOTICE", "M", "relation already exists, skipping")
+		expected := []byte{messageType, 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(expected[1:], uint32(len(expectedBody)+4))
+		expected = append(expected, expectedBody...)
+		if !bytes.Equal(output.Bytes(), expected) {
+			t.Fatalf("Expected %q, took %q", expected, output.Bytes())
+		}
+	}
+}
@@ -0,0 +1,82 @@
+//go:build gofuzz
+// +build gofuzz
+
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package postgresql
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Fuzz is entry point of go-fuzz for parsers of packets from client and database. Data is read as stream of client
+// packets if first byte is even and as stream of database packets otherwise, so found crashers may be added to
+// TestMalformedPackets as is:
+//
+//	go-fuzz-build -o postgresql-fuzz.zip github.com/cossacklabs/acra/decryptor/postgresql
+//	go-fuzz -bin postgresql-fuzz.zip -workdir fuzz
+func Fuzz(data []byte) int {
+	if len(data) == 0 {
+		return -1
+	}
+	logger := logrus.NewEntry(logrus.StandardLogger())
+	reader := bytes.NewReader(data[1:])
+	writer := bufio.NewWriter(ioutil.Discard)
+	var packet *PacketHandler
+	var readPacket func() error
+	if data[0]%2 == 0 {
+		packet, _ = NewClientSidePacketHandler(reader, writer, logger)
+		readPacket = packet.ReadClientPacket
+	} else {
+		packet, _ = NewDbSidePacketHandler(reader, writer, logger)
+		readPacket = func() error {
+			packet.Reset()
+			return packet.ReadPacket()
+		}
+	}
+	result := 0
+	for {
+		if err := readPacket(); err != nil {
+			return result
+		}
+		// at least one packet parsed without errors
+		result = 1
+		switch {
+		case packet.IsSimpleQuery():
+			packet.GetSimpleQuery()
+		case packet.IsParse():
+			packet.GetParseData()
+		case packet.IsBind():
+			if bind, err := packet.GetBindData(); err == nil {
+				bind.GetParameters()
+			}
+		case packet.IsExecute():
+			packet.GetExecuteData()
+		case packet.IsDataRow():
+			if packet.parseColumns(nil) == nil {
+				packet.updateDataFromColumns()
+			}
+		}
+		if _, err := packet.Marshal(); err != nil {
+			return result
+		}
+	}
+}
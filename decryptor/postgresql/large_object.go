@@ -0,0 +1,495 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package postgresql
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+
+	acrawriter "github.com/cossacklabs/acra/acra-writer"
+	"github.com/cossacklabs/acra/decryptor/base"
+	"github.com/cossacklabs/acra/keystore"
+	"github.com/cossacklabs/acra/utils"
+	"github.com/sirupsen/logrus"
+)
+
+// Message types of function call sub-protocol used by clients to work with large objects
+// https://www.postgresql.org/docs/current/protocol-flow.html#id-1.10.5.7.6
+const (
+	FunctionCallMessageType         byte = 'F'
+	FunctionCallResponseMessageType byte = 'V'
+)
+
+// OIDs of large object server-side functions called by libpq and other drivers via fastpath interface
+// https://github.com/postgres/postgres/blob/master/src/include/catalog/pg_proc.dat
+const (
+	loReadOID       = 954
+	loWriteOID      = 955
+	loLseekOID      = 956
+	loTellOID       = 958
+	loTruncateOID   = 1004
+	loLseek64OID    = 3170
+	loTell64OID     = 3171
+	loTruncate64OID = 3172
+)
+
+// DefaultLargeObjectChunkSize equals to LO_BUFSIZE used by lo_import/lo_export of libpq
+const DefaultLargeObjectChunkSize = 8192
+
+// Whence values of lo_lseek
+const (
+	seekSet = 0
+	seekCur = 1
+	seekEnd = 2
+)
+
+const binaryFormatCode = 1
+
+// Errors returned by LargeObjectProcessor
+var (
+	ErrMalformedFunctionCall         = errors.New("malformed function call message")
+	ErrUnsupportedLargeObjectCall    = errors.New("unsupported operation with encrypted large object")
+	ErrInvalidLargeObjectChunkSize   = errors.New("large object chunk size should be greater than zero")
+	ErrUnexpectedLargeObjectDataSize = errors.New("decrypted large object data exceeds requested length")
+)
+
+// functionCall is parsed FunctionCall message
+type functionCall struct {
+	oid           uint32
+	formats       []uint16
+	arguments     [][]byte
+	resultFormat  uint16
+	nullArguments []bool
+}
+
+// argumentFormat returns format code of argument according to rules of FunctionCall message
+func (call *functionCall) argumentFormat(i int) uint16 {
+	switch len(call.formats) {
+	case 0:
+		return 0
+	case 1:
+		return call.formats[0]
+	default:
+		return call.formats[i]
+	}
+}
+
+// binaryArgument returns argument which should be passed in binary format with expected size
+func (call *functionCall) binaryArgument(i, size int) ([]byte, error) {
+	if i >= len(call.arguments) || call.nullArguments[i] || len(call.arguments[i]) != size {
+		return nil, ErrMalformedFunctionCall
+	}
+	if call.argumentFormat(i) != binaryFormatCode {
+		return nil, fmt.Errorf("%w: arguments should be passed in binary format", ErrUnsupportedLargeObjectCall)
+	}
+	return call.arguments[i], nil
+}
+
+func parseFunctionCall(data []byte) (*functionCall, error) {
+	call := &functionCall{}
+	if len(data) < 6 {
+		return nil, ErrMalformedFunctionCall
+	}
+	call.oid = binary.BigEndian.Uint32(data)
+	formatCount := int(binary.BigEndian.Uint16(data[4:]))
+	data = data[6:]
+	if len(data) < formatCount*2+2 {
+		return nil, ErrMalformedFunctionCall
+	}
+	call.formats = make([]uint16, formatCount)
+	for i := range call.formats {
+		call.formats[i] = binary.BigEndian.Uint16(data[i*2:])
+	}
+	data = data[formatCount*2:]
+	argumentCount := int(binary.BigEndian.Uint16(data))
+	data = data[2:]
+	if formatCount > 1 && formatCount != argumentCount {
+		return nil, ErrMalformedFunctionCall
+	}
+	call.arguments = make([][]byte, argumentCount)
+	call.nullArguments = make([]bool, argumentCount)
+	for i := range call.arguments {
+		if len(data) < 4 {
+			return nil, ErrMalformedFunctionCall
+		}
+		length := int32(binary.BigEndian.Uint32(data))
+		data = data[4:]
+		if length < 0 {
+			call.nullArguments[i] = true
+			continue
+		}
+		if len(data) < int(length) {
+			return nil, ErrMalformedFunctionCall
+		}
+		call.arguments[i] = data[:length]
+		data = data[length:]
+	}
+	if len(data) != 2 {
+		return nil, ErrMalformedFunctionCall
+	}
+	call.resultFormat = binary.BigEndian.Uint16(data)
+	return call, nil
+}
+
+// marshal returns FunctionCall message data without message type and length
+func (call *functionCall) marshal() []byte {
+	output := bytes.NewBuffer(make([]byte, 0, 256))
+	binary.Write(output, binary.BigEndian, call.oid)
+	binary.Write(output, binary.BigEndian, uint16(len(call.formats)))
+	for _, format := range call.formats {
+		binary.Write(output, binary.BigEndian, format)
+	}
+	binary.Write(output, binary.BigEndian, uint16(len(call.arguments)))
+	for i, argument := range call.arguments {
+		if call.nullArguments[i] {
+			binary.Write(output, binary.BigEndian, int32(-1))
+			continue
+		}
+		binary.Write(output, binary.BigEndian, uint32(len(argument)))
+		output.Write(argument)
+	}
+	binary.Write(output, binary.BigEndian, call.resultFormat)
+	return output.Bytes()
+}
+
+// pendingLargeObjectCall remembers processed call to handle its result
+type pendingLargeObjectCall struct {
+	oid           uint32
+	plaintextSize int
+}
+
+// LargeObjectProcessor transparently encrypts data of large objects written with lo_write and decrypts data read
+// with lo_read. Data is split into chunks of chunkSize bytes and every chunk is stored as separate AcraStruct
+// encrypted with the key of client ID, so encrypted chunks have the same size except the last one. Offsets of
+// lo_lseek/lo_tell/lo_truncate are translated between plaintext and stored data. Offsets and lengths of reads
+// should be aligned to chunk size, otherwise function call is rejected because it can't be mapped to encrypted data.
+// All written large objects are expected to be written with the same chunk size through AcraServer.
+type LargeObjectProcessor struct {
+	clientID  []byte
+	keystore  keystore.DecryptionKeyStore
+	chunkSize int
+	// overhead of AcraStruct over chunk plaintext, calculated with the first encrypted chunk
+	overhead int
+	// function call waiting for response from the database, accessed from both directions of the proxy
+	pending *pendingLargeObjectCall
+	mutex   sync.Mutex
+	logger  *logrus.Entry
+}
+
+// NewLargeObjectProcessor returns LargeObjectProcessor for connection of client ID
+func NewLargeObjectProcessor(clientID []byte, keystore keystore.DecryptionKeyStore, chunkSize int, logger *logrus.Entry) (*LargeObjectProcessor, error) {
+	if chunkSize <= 0 {
+		return nil, ErrInvalidLargeObjectChunkSize
+	}
+	return &LargeObjectProcessor{
+		clientID:  clientID,
+		keystore:  keystore,
+		chunkSize: chunkSize,
+		logger:    logger.WithField("processor", "large_object"),
+	}, nil
+}
+
+// ProcessFunctionCall processes FunctionCall message data from client and returns data which should be sent to the
+// database. Calls of other functions are returned as is. Error wrapping ErrUnsupportedLargeObjectCall means that the
+// call can't be processed and shouldn't be passed to the database.
+func (processor *LargeObjectProcessor) ProcessFunctionCall(data []byte) ([]byte, error) {
+	processor.mutex.Lock()
+	defer processor.mutex.Unlock()
+	processor.pending = nil
+	call, err := parseFunctionCall(data)
+	if err != nil {
+		return nil, err
+	}
+	pending := &pendingLargeObjectCall{oid: call.oid}
+	switch call.oid {
+	case loWriteOID:
+		// lowrite(fd int4, data bytea)
+		if len(call.arguments) != 2 || call.nullArguments[1] {
+			return nil, ErrMalformedFunctionCall
+		}
+		if call.argumentFormat(1) != binaryFormatCode {
+			return nil, fmt.Errorf("%w: data should be passed in binary format", ErrUnsupportedLargeObjectCall)
+		}
+		encrypted, err := processor.encrypt(call.arguments[1])
+		if err != nil {
+			return nil, err
+		}
+		pending.plaintextSize = len(call.arguments[1])
+		call.arguments[1] = encrypted
+	case loReadOID:
+		// loread(fd int4, len int4)
+		if len(call.arguments) != 2 {
+			return nil, ErrMalformedFunctionCall
+		}
+		lengthArgument, err := call.binaryArgument(1, 4)
+		if err != nil {
+			return nil, err
+		}
+		length := int(int32(binary.BigEndian.Uint32(lengthArgument)))
+		if length < processor.chunkSize {
+			return nil, fmt.Errorf("%w: read length should be at least %d bytes", ErrUnsupportedLargeObjectCall, processor.chunkSize)
+		}
+		if err := processor.initOverhead(); err != nil {
+			return nil, err
+		}
+		pending.plaintextSize = length
+		// read only whole chunks, decrypted data will not exceed requested length
+		encryptedLength, err := processor.encryptedOffset(int64(length/processor.chunkSize*processor.chunkSize), 4)
+		if err != nil {
+			return nil, err
+		}
+		call.arguments[1] = encryptedLength
+	case loLseekOID, loLseek64OID:
+		// lo_lseek(fd int4, offset int4, whence int4)
+		offsetSize := 4
+		if call.oid == loLseek64OID {
+			offsetSize = 8
+		}
+		if len(call.arguments) != 3 {
+			return nil, ErrMalformedFunctionCall
+		}
+		offsetArgument, err := call.binaryArgument(1, offsetSize)
+		if err != nil {
+			return nil, err
+		}
+		whenceArgument, err := call.binaryArgument(2, 4)
+		if err != nil {
+			return nil, err
+		}
+		offset := readSignedInteger(offsetArgument)
+		whence := binary.BigEndian.Uint32(whenceArgument)
+		switch {
+		case whence == seekSet:
+			if err := processor.initOverhead(); err != nil {
+				return nil, err
+			}
+			if call.arguments[1], err = processor.encryptedOffset(offset, offsetSize); err != nil {
+				return nil, err
+			}
+		case (whence == seekCur || whence == seekEnd) && offset == 0:
+		default:
+			return nil, fmt.Errorf("%w: only absolute seek or seek to current position or end are supported", ErrUnsupportedLargeObjectCall)
+		}
+	case loTruncateOID, loTruncate64OID:
+		// lo_truncate(fd int4, len int4)
+		lengthSize := 4
+		if call.oid == loTruncate64OID {
+			lengthSize = 8
+		}
+		if len(call.arguments) != 2 {
+			return nil, ErrMalformedFunctionCall
+		}
+		lengthArgument, err := call.binaryArgument(1, lengthSize)
+		if err != nil {
+			return nil, err
+		}
+		if err := processor.initOverhead(); err != nil {
+			return nil, err
+		}
+		if call.arguments[1], err = processor.encryptedOffset(readSignedInteger(lengthArgument), lengthSize); err != nil {
+			return nil, err
+		}
+	case loTellOID, loTell64OID:
+	default:
+		return data, nil
+	}
+	if call.resultFormat != binaryFormatCode {
+		return nil, fmt.Errorf("%w: result should be requested in binary format", ErrUnsupportedLargeObjectCall)
+	}
+	processor.pending = pending
+	return call.marshal(), nil
+}
+
+// ProcessFunctionCallResponse processes FunctionCallResponse message data from the database and returns data which
+// should be sent to the client
+func (processor *LargeObjectProcessor) ProcessFunctionCallResponse(data []byte) ([]byte, error) {
+	processor.mutex.Lock()
+	pending := processor.pending
+	processor.pending = nil
+	processor.mutex.Unlock()
+	if pending == nil {
+		return data, nil
+	}
+	if len(data) < 4 {
+		return nil, ErrMalformedFunctionCall
+	}
+	length := int32(binary.BigEndian.Uint32(data))
+	// NULL result
+	if length < 0 {
+		return data, nil
+	}
+	result := data[4:]
+	if len(result) != int(length) {
+		return nil, ErrMalformedFunctionCall
+	}
+	var newResult []byte
+	switch pending.oid {
+	case loReadOID:
+		decrypted, err := processor.decrypt(result)
+		if err != nil {
+			return nil, err
+		}
+		if len(decrypted) > pending.plaintextSize {
+			return nil, ErrUnexpectedLargeObjectDataSize
+		}
+		newResult = decrypted
+	case loWriteOID:
+		// lo_write writes all data or fails
+		if len(result) != 4 {
+			return nil, ErrMalformedFunctionCall
+		}
+		newResult = make([]byte, 4)
+		binary.BigEndian.PutUint32(newResult, uint32(pending.plaintextSize))
+	default:
+		// lo_lseek, lo_tell and lo_truncate return offset or status code
+		if len(result) != 4 && len(result) != 8 {
+			return nil, ErrMalformedFunctionCall
+		}
+		if pending.oid == loTruncateOID || pending.oid == loTruncate64OID {
+			return data, nil
+		}
+		offset := readSignedInteger(result)
+		if offset < 0 {
+			return data, nil
+		}
+		newResult = make([]byte, len(result))
+		writeSignedInteger(newResult, processor.plaintextOffset(offset))
+	}
+	output := make([]byte, 4, 4+len(newResult))
+	binary.BigEndian.PutUint32(output, uint32(len(newResult)))
+	return append(output, newResult...), nil
+}
+
+// initOverhead calculates size of AcraStruct with chunk of plaintext to translate offsets
+func (processor *LargeObjectProcessor) initOverhead() error {
+	if processor.overhead > 0 {
+		return nil
+	}
+	encrypted, err := processor.encryptChunk(make([]byte, processor.chunkSize))
+	if err != nil {
+		return err
+	}
+	processor.overhead = len(encrypted) - processor.chunkSize
+	return nil
+}
+
+func (processor *LargeObjectProcessor) encryptedChunkSize() int {
+	return processor.chunkSize + processor.overhead
+}
+
+// encryptedOffset returns offset in stored data encoded as integer of size bytes. Offset should be aligned to chunk size.
+func (processor *LargeObjectProcessor) encryptedOffset(offset int64, size int) ([]byte, error) {
+	if offset < 0 || offset%int64(processor.chunkSize) != 0 {
+		return nil, fmt.Errorf("%w: offset should be multiple of %d", ErrUnsupportedLargeObjectCall, processor.chunkSize)
+	}
+	encryptedOffset := offset / int64(processor.chunkSize) * int64(processor.encryptedChunkSize())
+	if size == 4 && encryptedOffset > int64(int32(^uint32(0)>>1)) {
+		return nil, fmt.Errorf("%w: offset of encrypted data exceeds 32-bit range", ErrUnsupportedLargeObjectCall)
+	}
+	output := make([]byte, size)
+	writeSignedInteger(output, encryptedOffset)
+	return output, nil
+}
+
+// plaintextOffset maps offset in stored data to plaintext. Offsets inside the last incomplete chunk are possible only
+// at the end of large object.
+func (processor *LargeObjectProcessor) plaintextOffset(offset int64) int64 {
+	encryptedChunkSize := int64(processor.encryptedChunkSize())
+	plaintextOffset := offset / encryptedChunkSize * int64(processor.chunkSize)
+	if rest := offset % encryptedChunkSize; rest > int64(processor.overhead) {
+		plaintextOffset += rest - int64(processor.overhead)
+	}
+	return plaintextOffset
+}
+
+func (processor *LargeObjectProcessor) encryptChunk(chunk []byte) ([]byte, error) {
+	publicKey, err := processor.keystore.GetClientIDEncryptionPublicKey(processor.clientID)
+	if err != nil {
+		return nil, err
+	}
+	return acrawriter.CreateAcrastruct(chunk, publicKey, nil)
+}
+
+// encrypt splits data into chunks and returns concatenated AcraStructs
+func (processor *LargeObjectProcessor) encrypt(data []byte) ([]byte, error) {
+	output := make([]byte, 0, len(data)+(len(data)/processor.chunkSize+1)*processor.overhead)
+	for len(data) > 0 {
+		chunkSize := processor.chunkSize
+		if len(data) < chunkSize {
+			chunkSize = len(data)
+		}
+		encrypted, err := processor.encryptChunk(data[:chunkSize])
+		if err != nil {
+			return nil, err
+		}
+		if processor.overhead == 0 {
+			processor.overhead = len(encrypted) - chunkSize
+		}
+		output = append(output, encrypted...)
+		data = data[chunkSize:]
+	}
+	return output, nil
+}
+
+// decrypt returns plaintext of sequential AcraStructs
+func (processor *LargeObjectProcessor) decrypt(data []byte) ([]byte, error) {
+	if len(data) == 0 {
+		return data, nil
+	}
+	privateKeys, err := processor.keystore.GetServerDecryptionPrivateKeys(processor.clientID)
+	defer utils.ZeroizePrivateKeys(privateKeys)
+	if err != nil {
+		return nil, err
+	}
+	output := make([]byte, 0, len(data))
+	for len(data) > 0 {
+		if len(data) < base.GetMinAcraStructLength() {
+			return nil, base.ErrIncorrectAcraStructLength
+		}
+		acraStructLength := base.GetMinAcraStructLength() + base.GetDataLengthFromAcraStruct(data)
+		if acraStructLength > len(data) || acraStructLength < base.GetMinAcraStructLength() {
+			return nil, base.ErrIncorrectAcraStructDataLength
+		}
+		decrypted, err := base.DecryptRotatedAcrastruct(data[:acraStructLength], privateKeys, nil)
+		if err != nil {
+			return nil, err
+		}
+		output = append(output, decrypted...)
+		data = data[acraStructLength:]
+	}
+	return output, nil
+}
+
+// readSignedInteger reads big-endian int4 or int8 value
+func readSignedInteger(data []byte) int64 {
+	if len(data) == 8 {
+		return int64(binary.BigEndian.Uint64(data))
+	}
+	return int64(int32(binary.BigEndian.Uint32(data)))
+}
+
+// writeSignedInteger writes big-endian int4 or int8 value according to length of output
+func writeSignedInteger(output []byte, value int64) {
+	if len(output) == 8 {
+		binary.BigEndian.PutUint64(output, uint64(value))
+		return
+	}
+	binary.BigEndian.PutUint32(output, uint32(int32(value)))
+}
@@ -0,0 +1,193 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package postgresql
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"github.com/cossacklabs/themis/gothemis/keys"
+	"github.com/sirupsen/logrus"
+)
+
+// testFunctionCall returns FunctionCall data like libpq's PQfn with binary arguments and result
+func testFunctionCall(oid uint32, arguments ...[]byte) []byte {
+	call := &functionCall{oid: oid, resultFormat: binaryFormatCode, arguments: arguments, nullArguments: make([]bool, len(arguments))}
+	for range arguments {
+		call.formats = append(call.formats, binaryFormatCode)
+	}
+	return call.marshal()
+}
+
+func testInt4(value int) []byte {
+	output := make([]byte, 4)
+	binary.BigEndian.PutUint32(output, uint32(value))
+	return output
+}
+
+func testInt8(value int) []byte {
+	output := make([]byte, 8)
+	binary.BigEndian.PutUint64(output, uint64(value))
+	return output
+}
+
+func functionCallResponse(result []byte) []byte {
+	return append(testInt4(len(result)), result...)
+}
+
+func TestLargeObjectProcessor(t *testing.T) {
+	keypair, err := keys.New(keys.TypeEC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keystore := &replicationTestKeystore{keypairs: map[string]*keys.Keypair{"client": keypair}}
+	const chunkSize = 16
+	processor, err := NewLargeObjectProcessor([]byte("client"), keystore, chunkSize, logrus.NewEntry(logrus.New()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd := testInt4(0)
+	plaintext := []byte("large object data split into 3 chunks")
+
+	// lo_write stores AcraStruct per chunk and returns length of plaintext
+	newCall, err := processor.ProcessFunctionCall(testFunctionCall(loWriteOID, fd, plaintext))
+	if err != nil {
+		t.Fatal(err)
+	}
+	call, err := parseFunctionCall(newCall)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored := call.arguments[1]
+	if bytes.Contains(stored, plaintext[:chunkSize]) {
+		t.Fatal("Large object data wasn't encrypted")
+	}
+	encryptedChunkSize := chunkSize + processor.overhead
+	if len(stored) != 2*encryptedChunkSize+len(plaintext)-2*chunkSize+processor.overhead {
+		t.Fatalf("Unexpected size of stored data %d", len(stored))
+	}
+	response, err := processor.ProcessFunctionCallResponse(functionCallResponse(testInt4(len(stored))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(response, functionCallResponse(testInt4(len(plaintext)))) {
+		t.Fatal("lo_write result wasn't translated to plaintext length")
+	}
+
+	// lo_lseek64 to the second chunk
+	newCall, err = processor.ProcessFunctionCall(testFunctionCall(loLseek64OID, fd, testInt8(chunkSize), testInt4(seekSet)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if call, _ := parseFunctionCall(newCall); !bytes.Equal(call.arguments[1], testInt8(encryptedChunkSize)) {
+		t.Fatal("Seek offset wasn't translated")
+	}
+	response, err = processor.ProcessFunctionCallResponse(functionCallResponse(testInt8(encryptedChunkSize)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(response, functionCallResponse(testInt8(chunkSize))) {
+		t.Fatal("lo_lseek64 result wasn't translated")
+	}
+
+	// lo_read requests whole encrypted chunks which fit into requested length
+	newCall, err = processor.ProcessFunctionCall(testFunctionCall(loReadOID, fd, testInt4(chunkSize*2+5)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if call, _ := parseFunctionCall(newCall); !bytes.Equal(call.arguments[1], testInt4(encryptedChunkSize*2)) {
+		t.Fatal("Read length wasn't translated")
+	}
+	// the database returns the rest of object after the first chunk
+	response, err = processor.ProcessFunctionCallResponse(functionCallResponse(stored[encryptedChunkSize:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(response, functionCallResponse(plaintext[chunkSize:])) {
+		t.Fatal("lo_read result wasn't decrypted")
+	}
+
+	// lo_tell at the end of object returns plaintext length
+	if _, err := processor.ProcessFunctionCall(testFunctionCall(loTellOID, fd)); err != nil {
+		t.Fatal(err)
+	}
+	response, err = processor.ProcessFunctionCallResponse(functionCallResponse(testInt4(len(stored))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(response, functionCallResponse(testInt4(len(plaintext)))) {
+		t.Fatal("lo_tell result wasn't translated")
+	}
+
+	// calls which can't be mapped to encrypted data are rejected
+	unsupportedCalls := [][]byte{
+		testFunctionCall(loReadOID, fd, testInt4(chunkSize-1)),
+		testFunctionCall(loLseekOID, fd, testInt4(5), testInt4(seekSet)),
+		testFunctionCall(loLseekOID, fd, testInt4(chunkSize), testInt4(seekCur)),
+		testFunctionCall(loTruncateOID, fd, testInt4(5)),
+	}
+	for i, unsupportedCall := range unsupportedCalls {
+		if _, err := processor.ProcessFunctionCall(unsupportedCall); !errors.Is(err, ErrUnsupportedLargeObjectCall) {
+			t.Errorf("%d: expected ErrUnsupportedLargeObjectCall, took %v", i, err)
+		}
+	}
+
+	// other functions are passed as is
+	otherCall := testFunctionCall(952, testInt4(1), testInt4(0x20000))
+	newCall, err = processor.ProcessFunctionCall(otherCall)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(newCall, otherCall) {
+		t.Fatal("Call of other function was changed")
+	}
+	response, err = processor.ProcessFunctionCallResponse(functionCallResponse(testInt4(1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(response, functionCallResponse(testInt4(1))) {
+		t.Fatal("Result of other function was changed")
+	}
+}
+
+func TestParseFunctionCall(t *testing.T) {
+	data := []byte{
+		0, 0, 3, 187, // oid 955
+		0, 1, 0, 1, // one binary format for all arguments
+		0, 2, // arguments
+		0, 0, 0, 4, 0, 0, 0, 1, // fd
+		255, 255, 255, 255, // NULL
+		0, 1, // binary result
+	}
+	call, err := parseFunctionCall(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if call.oid != loWriteOID || call.argumentFormat(1) != binaryFormatCode || !call.nullArguments[1] {
+		t.Fatal("Incorrect parsed function call")
+	}
+	if !bytes.Equal(call.marshal(), data) {
+		t.Fatal("Marshaled function call differs from original")
+	}
+	for i := 0; i < len(data); i++ {
+		if _, err := parseFunctionCall(data[:i]); err != ErrMalformedFunctionCall {
+			t.Fatalf("Expected ErrMalformedFunctionCall for %d bytes, took %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,428 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package postgresql
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	acrawriter "github.com/cossacklabs/acra/acra-writer"
+	"github.com/cossacklabs/acra/decryptor/base"
+	"github.com/cossacklabs/acra/keystore"
+	"github.com/cossacklabs/acra/logging"
+	"github.com/cossacklabs/acra/utils"
+	"github.com/cossacklabs/themis/gothemis/keys"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// Message types of streaming replication protocol
+// https://www.postgresql.org/docs/current/protocol-replication.html
+const (
+	CopyBothResponseMessageType byte = 'W'
+	CopyDataMessageType         byte = 'd'
+	XLogDataMessageType         byte = 'w'
+	// 'w' + WAL start + WAL end + send time
+	xLogDataHeaderSize = 1 + 8 + 8 + 8
+)
+
+// Message types of pgoutput logical decoding plugin
+// https://www.postgresql.org/docs/current/protocol-logicalrep-message-formats.html
+const (
+	pgoutputRelation    byte = 'R'
+	pgoutputInsert      byte = 'I'
+	pgoutputUpdate      byte = 'U'
+	pgoutputDelete      byte = 'D'
+	pgoutputStreamStart byte = 'S'
+	pgoutputStreamStop  byte = 'E'
+
+	tupleNewMarker byte = 'N'
+	tupleKeyMarker byte = 'K'
+	tupleOldMarker byte = 'O'
+
+	tupleColumnNull      byte = 'n'
+	tupleColumnUnchanged byte = 'u'
+	tupleColumnText      byte = 't'
+	tupleColumnBinary    byte = 'b'
+)
+
+// Actions applied to columns of replication stream
+const (
+	ReplicationActionDecrypt   = "decrypt"
+	ReplicationActionReencrypt = "reencrypt"
+)
+
+// Errors related to logical replication processing
+var (
+	ErrMalformedReplicationMessage = errors.New("malformed logical replication message")
+	ErrUnknownRelation             = errors.New("logical replication message refers to unknown relation")
+	ErrInvalidReplicationAction    = errors.New("invalid replication column action")
+)
+
+// ReplicationColumnPolicy describes how to process encrypted column in replication stream.
+// ClientID/ZoneID select keys to decrypt data (client ID of connection is used by default),
+// ReencryptClientID/ReencryptZoneID select public key for "reencrypt" action.
+type ReplicationColumnPolicy struct {
+	Column            string `yaml:"column"`
+	Action            string `yaml:"action"`
+	ClientID          string `yaml:"client_id"`
+	ZoneID            string `yaml:"zone_id"`
+	ReencryptClientID string `yaml:"reencrypt_client_id"`
+	ReencryptZoneID   string `yaml:"reencrypt_zone_id"`
+}
+
+// ReplicationTablePolicy lists processed columns of table. Table may be specified as "name" or "schema.name".
+type ReplicationTablePolicy struct {
+	Table   string                    `yaml:"table"`
+	Columns []ReplicationColumnPolicy `yaml:"columns"`
+}
+
+// ReplicationPolicy describes processing of columns in logical replication stream
+type ReplicationPolicy struct {
+	Tables []ReplicationTablePolicy `yaml:"tables"`
+}
+
+// LoadReplicationPolicy reads ReplicationPolicy from YAML file and validates it
+func LoadReplicationPolicy(path string) (*ReplicationPolicy, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	policy := &ReplicationPolicy{}
+	if err := yaml.Unmarshal(data, policy); err != nil {
+		return nil, err
+	}
+	if err := policy.Validate(); err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+// Validate checks that columns have known actions and keys for re-encryption
+func (policy *ReplicationPolicy) Validate() error {
+	for _, table := range policy.Tables {
+		for _, column := range table.Columns {
+			switch column.Action {
+			case ReplicationActionDecrypt:
+			case ReplicationActionReencrypt:
+				if column.ReencryptClientID == "" && column.ReencryptZoneID == "" {
+					return fmt.Errorf("%w: %s.%s should have reencrypt_client_id or reencrypt_zone_id", ErrInvalidReplicationAction, table.Table, column.Column)
+				}
+			default:
+				return fmt.Errorf("%w: '%s' for %s.%s", ErrInvalidReplicationAction, column.Action, table.Table, column.Column)
+			}
+		}
+	}
+	return nil
+}
+
+// columnPolicy returns policy for column of relation or nil
+func (policy *ReplicationPolicy) columnPolicy(namespace, relation, column string) *ReplicationColumnPolicy {
+	for i := range policy.Tables {
+		table := &policy.Tables[i]
+		if table.Table != relation && table.Table != namespace+"."+relation {
+			continue
+		}
+		for j := range table.Columns {
+			if table.Columns[j].Column == column {
+				return &table.Columns[j]
+			}
+		}
+	}
+	return nil
+}
+
+// replicationRelation stores policies of relation columns in order of columns in tuples
+type replicationRelation struct {
+	name     string
+	policies []*ReplicationColumnPolicy
+}
+
+// LogicalReplicationProcessor decrypts or re-encrypts configured columns in pgoutput logical replication messages
+// of one replication connection
+type LogicalReplicationProcessor struct {
+	policy    *ReplicationPolicy
+	clientID  []byte
+	keystore  keystore.DecryptionKeyStore
+	relations map[uint32]*replicationRelation
+	inStream  bool
+	logger    *logrus.Entry
+}
+
+// NewLogicalReplicationProcessor returns processor which uses keys of clientID if policy doesn't specify other key
+func NewLogicalReplicationProcessor(policy *ReplicationPolicy, clientID []byte, keystore keystore.DecryptionKeyStore, logger *logrus.Entry) *LogicalReplicationProcessor {
+	return &LogicalReplicationProcessor{
+		policy:    policy,
+		clientID:  clientID,
+		keystore:  keystore,
+		relations: make(map[uint32]*replicationRelation),
+		logger:    logger.WithField("replication", "logical"),
+	}
+}
+
+// ProcessCopyData processes payload of CopyData message sent by database in replication mode and returns new payload.
+// Messages other than XLogData with pgoutput Insert/Update/Delete are returned as is.
+func (processor *LogicalReplicationProcessor) ProcessCopyData(data []byte) ([]byte, error) {
+	if len(data) < xLogDataHeaderSize || data[0] != XLogDataMessageType {
+		return data, nil
+	}
+	message, err := processor.processMessage(data[xLogDataHeaderSize:])
+	if err != nil {
+		return nil, err
+	}
+	output := make([]byte, 0, xLogDataHeaderSize+len(message))
+	output = append(output, data[:xLogDataHeaderSize]...)
+	return append(output, message...), nil
+}
+
+// processMessage processes pgoutput message
+func (processor *LogicalReplicationProcessor) processMessage(message []byte) ([]byte, error) {
+	if len(message) == 0 {
+		return message, nil
+	}
+	// messages of streamed transactions contain xid after message type
+	headerSize := 1
+	if processor.inStream {
+		headerSize += 4
+	}
+	switch message[0] {
+	case pgoutputStreamStart:
+		processor.inStream = true
+		return message, nil
+	case pgoutputStreamStop:
+		processor.inStream = false
+		return message, nil
+	case pgoutputRelation:
+		if len(message) < headerSize {
+			return nil, ErrMalformedReplicationMessage
+		}
+		if err := processor.registerRelation(message[headerSize:]); err != nil {
+			return nil, err
+		}
+		return message, nil
+	case pgoutputInsert, pgoutputUpdate, pgoutputDelete:
+		if len(message) < headerSize+4 {
+			return nil, ErrMalformedReplicationMessage
+		}
+		relationID := binary.BigEndian.Uint32(message[headerSize : headerSize+4])
+		relation, ok := processor.relations[relationID]
+		if !ok {
+			return nil, ErrUnknownRelation
+		}
+		if !relation.hasPolicies() {
+			return message, nil
+		}
+		output := bytes.NewBuffer(make([]byte, 0, len(message)))
+		output.Write(message[:headerSize+4])
+		if err := processor.processTuples(relation, message[headerSize+4:], output); err != nil {
+			return nil, err
+		}
+		return output.Bytes(), nil
+	default:
+		return message, nil
+	}
+}
+
+// registerRelation parses Relation message body and stores policies of its columns
+func (processor *LogicalReplicationProcessor) registerRelation(data []byte) error {
+	if len(data) < 4 {
+		return ErrMalformedReplicationMessage
+	}
+	relationID := binary.BigEndian.Uint32(data[:4])
+	namespace, data, err := readString(data[4:])
+	if err != nil {
+		return ErrMalformedReplicationMessage
+	}
+	name, data, err := readString(data)
+	if err != nil {
+		return ErrMalformedReplicationMessage
+	}
+	// replica identity + number of columns
+	if len(data) < 3 {
+		return ErrMalformedReplicationMessage
+	}
+	columnsCount := int(binary.BigEndian.Uint16(data[1:3]))
+	data = data[3:]
+	relation := &replicationRelation{name: name, policies: make([]*ReplicationColumnPolicy, columnsCount)}
+	for i := 0; i < columnsCount; i++ {
+		// flags
+		if len(data) < 1 {
+			return ErrMalformedReplicationMessage
+		}
+		var column string
+		column, data, err = readString(data[1:])
+		if err != nil {
+			return ErrMalformedReplicationMessage
+		}
+		// type oid + type modifier
+		if len(data) < 8 {
+			return ErrMalformedReplicationMessage
+		}
+		data = data[8:]
+		relation.policies[i] = processor.policy.columnPolicy(namespace, name, column)
+	}
+	processor.relations[relationID] = relation
+	return nil
+}
+
+// hasPolicies returns true if any column of relation should be processed
+func (relation *replicationRelation) hasPolicies() bool {
+	for _, policy := range relation.policies {
+		if policy != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// processTuples processes sequence of marked tuples ('K', 'O', 'N') of Insert/Update/Delete messages
+func (processor *LogicalReplicationProcessor) processTuples(relation *replicationRelation, data []byte, output *bytes.Buffer) error {
+	for len(data) > 0 {
+		marker := data[0]
+		if marker != tupleNewMarker && marker != tupleKeyMarker && marker != tupleOldMarker {
+			return ErrMalformedReplicationMessage
+		}
+		output.WriteByte(marker)
+		var err error
+		data, err = processor.processTuple(relation, data[1:], output)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// processTuple processes TupleData and returns rest of data
+func (processor *LogicalReplicationProcessor) processTuple(relation *replicationRelation, data []byte, output *bytes.Buffer) ([]byte, error) {
+	if len(data) < 2 {
+		return nil, ErrMalformedReplicationMessage
+	}
+	columnsCount := int(binary.BigEndian.Uint16(data[:2]))
+	output.Write(data[:2])
+	data = data[2:]
+	lengthBuf := make([]byte, 4)
+	for i := 0; i < columnsCount; i++ {
+		if len(data) < 1 {
+			return nil, ErrMalformedReplicationMessage
+		}
+		kind := data[0]
+		output.WriteByte(kind)
+		data = data[1:]
+		switch kind {
+		case tupleColumnNull, tupleColumnUnchanged:
+			continue
+		case tupleColumnText, tupleColumnBinary:
+		default:
+			return nil, ErrMalformedReplicationMessage
+		}
+		if len(data) < 4 {
+			return nil, ErrMalformedReplicationMessage
+		}
+		length := int(binary.BigEndian.Uint32(data[:4]))
+		if len(data) < 4+length {
+			return nil, ErrMalformedReplicationMessage
+		}
+		value := data[4 : 4+length]
+		data = data[4+length:]
+		if i < len(relation.policies) && relation.policies[i] != nil {
+			value = processor.processValue(relation, relation.policies[i], kind, value)
+		}
+		binary.BigEndian.PutUint32(lengthBuf, uint32(len(value)))
+		output.Write(lengthBuf)
+		output.Write(value)
+	}
+	return data, nil
+}
+
+// processValue applies column policy to value, returns value as is if it can't be processed
+func (processor *LogicalReplicationProcessor) processValue(relation *replicationRelation, policy *ReplicationColumnPolicy, kind byte, value []byte) []byte {
+	logger := processor.logger.WithFields(logrus.Fields{"table": relation.name, "column": policy.Column})
+	var decoded *utils.DecodedData
+	if kind == tupleColumnText {
+		var err error
+		decoded, err = utils.DecodeEscaped(value)
+		if err != nil {
+			logger.WithError(err).Debugln("Column value isn't bytea, skip it")
+			return value
+		}
+	} else {
+		decoded = utils.WrapRawDataAsDecoded(value)
+	}
+	if err := base.ValidateAcraStructLength(decoded.Data()); err != nil {
+		logger.Debugln("Column value isn't AcraStruct, skip it")
+		return value
+	}
+	decrypted, err := processor.decrypt(policy, decoded.Data())
+	if err != nil {
+		logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorDecryptorCantDecryptBinary).
+			Warningln("Can't decrypt AcraStruct in replication stream, leave it as is")
+		return value
+	}
+	result := decrypted
+	if policy.Action == ReplicationActionReencrypt {
+		result, err = processor.encrypt(policy, decrypted)
+		utils.ZeroizeBytes(decrypted)
+		if err != nil {
+			logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCantEncryptData).
+				Warningln("Can't re-encrypt AcraStruct in replication stream, leave it as is")
+			return value
+		}
+	}
+	decoded.Set(result)
+	return decoded.Encoded()
+}
+
+// decrypt AcraStruct with keys of zone or client ID from policy, by default with keys of connection's client ID
+func (processor *LogicalReplicationProcessor) decrypt(policy *ReplicationColumnPolicy, acraStruct []byte) ([]byte, error) {
+	var privateKeys []*keys.PrivateKey
+	var zoneID []byte
+	var err error
+	if policy.ZoneID != "" {
+		zoneID = []byte(policy.ZoneID)
+		privateKeys, err = processor.keystore.GetZonePrivateKeys(zoneID)
+	} else {
+		clientID := processor.clientID
+		if policy.ClientID != "" {
+			clientID = []byte(policy.ClientID)
+		}
+		privateKeys, err = processor.keystore.GetServerDecryptionPrivateKeys(clientID)
+	}
+	defer utils.ZeroizePrivateKeys(privateKeys)
+	if err != nil {
+		return nil, err
+	}
+	return base.DecryptRotatedAcrastruct(acraStruct, privateKeys, zoneID)
+}
+
+// encrypt data with public key of zone or client ID specified for re-encryption
+func (processor *LogicalReplicationProcessor) encrypt(policy *ReplicationColumnPolicy, data []byte) ([]byte, error) {
+	if policy.ReencryptZoneID != "" {
+		publicKey, err := processor.keystore.GetZonePublicKey([]byte(policy.ReencryptZoneID))
+		if err != nil {
+			return nil, err
+		}
+		return acrawriter.CreateAcrastruct(data, publicKey, []byte(policy.ReencryptZoneID))
+	}
+	publicKey, err := processor.keystore.GetClientIDEncryptionPublicKey([]byte(policy.ReencryptClientID))
+	if err != nil {
+		return nil, err
+	}
+	return acrawriter.CreateAcrastruct(data, publicKey, nil)
+}
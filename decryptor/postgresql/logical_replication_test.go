@@ -0,0 +1,263 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package postgresql
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"testing"
+
+	acrawriter "github.com/cossacklabs/acra/acra-writer"
+	"github.com/cossacklabs/acra/decryptor/base"
+	"github.com/cossacklabs/acra/utils"
+	"github.com/cossacklabs/themis/gothemis/keys"
+	"github.com/sirupsen/logrus"
+)
+
+// replicationTestKeystore stores storage keypairs by client ID
+type replicationTestKeystore struct {
+	keypairs map[string]*keys.Keypair
+}
+
+func (keystore *replicationTestKeystore) keypair(id []byte) (*keys.Keypair, error) {
+	keypair, ok := keystore.keypairs[string(id)]
+	if !ok {
+		return nil, errors.New("key not found")
+	}
+	return keypair, nil
+}
+func (keystore *replicationTestKeystore) GetZonePublicKey(zoneID []byte) (*keys.PublicKey, error) {
+	return nil, errors.New("not supported")
+}
+func (keystore *replicationTestKeystore) GetClientIDEncryptionPublicKey(clientID []byte) (*keys.PublicKey, error) {
+	keypair, err := keystore.keypair(clientID)
+	if err != nil {
+		return nil, err
+	}
+	return keypair.Public, nil
+}
+func (keystore *replicationTestKeystore) HasZonePrivateKey(id []byte) bool { return false }
+func (keystore *replicationTestKeystore) GetZonePrivateKey(id []byte) (*keys.PrivateKey, error) {
+	return nil, errors.New("not supported")
+}
+func (keystore *replicationTestKeystore) GetZonePrivateKeys(id []byte) ([]*keys.PrivateKey, error) {
+	return nil, errors.New("not supported")
+}
+func (keystore *replicationTestKeystore) GetServerDecryptionPrivateKey(id []byte) (*keys.PrivateKey, error) {
+	keypair, err := keystore.keypair(id)
+	if err != nil {
+		return nil, err
+	}
+	// return copy because caller zeroizes it
+	return &keys.PrivateKey{Value: append([]byte{}, keypair.Private.Value...)}, nil
+}
+func (keystore *replicationTestKeystore) GetServerDecryptionPrivateKeys(id []byte) ([]*keys.PrivateKey, error) {
+	key, err := keystore.GetServerDecryptionPrivateKey(id)
+	if err != nil {
+		return nil, err
+	}
+	return []*keys.PrivateKey{key}, nil
+}
+func (keystore *replicationTestKeystore) GetPoisonKeyPair() (*keys.Keypair, error) {
+	return nil, errors.New("not supported")
+}
+func (keystore *replicationTestKeystore) GetPoisonPrivateKeys() ([]*keys.PrivateKey, error) {
+	return nil, errors.New("not supported")
+}
+
+func testRelationMessage(relationID uint32, namespace, name string, columns ...string) []byte {
+	output := &bytes.Buffer{}
+	output.WriteByte(pgoutputRelation)
+	binary.Write(output, binary.BigEndian, relationID)
+	writeString(output, namespace)
+	writeString(output, name)
+	// replica identity
+	output.WriteByte('d')
+	binary.Write(output, binary.BigEndian, uint16(len(columns)))
+	for _, column := range columns {
+		// flags
+		output.WriteByte(0)
+		writeString(output, column)
+		// bytea oid and type modifier
+		binary.Write(output, binary.BigEndian, uint32(17))
+		binary.Write(output, binary.BigEndian, int32(-1))
+	}
+	return output.Bytes()
+}
+
+func testInsertMessage(relationID uint32, values ...[]byte) []byte {
+	output := &bytes.Buffer{}
+	output.WriteByte(pgoutputInsert)
+	binary.Write(output, binary.BigEndian, relationID)
+	output.WriteByte(tupleNewMarker)
+	binary.Write(output, binary.BigEndian, uint16(len(values)))
+	for _, value := range values {
+		if value == nil {
+			output.WriteByte(tupleColumnNull)
+			continue
+		}
+		output.WriteByte(tupleColumnText)
+		binary.Write(output, binary.BigEndian, uint32(len(value)))
+		output.Write(value)
+	}
+	return output.Bytes()
+}
+
+// testByteaHex returns data in bytea hex text format
+func testByteaHex(data []byte) []byte {
+	return []byte("\\x" + hex.EncodeToString(data))
+}
+
+func testXLogData(message []byte) []byte {
+	header := make([]byte, xLogDataHeaderSize)
+	header[0] = XLogDataMessageType
+	for i := 1; i < xLogDataHeaderSize; i++ {
+		header[i] = byte(i)
+	}
+	return append(header, message...)
+}
+
+// testInsertValues parses values of Insert message in XLogData
+func testInsertValues(t *testing.T, data []byte) [][]byte {
+	message := data[xLogDataHeaderSize:]
+	if message[0] != pgoutputInsert || message[5] != tupleNewMarker {
+		t.Fatal("Unexpected message")
+	}
+	tuple := message[6:]
+	count := int(binary.BigEndian.Uint16(tuple[:2]))
+	tuple = tuple[2:]
+	values := make([][]byte, 0, count)
+	for i := 0; i < count; i++ {
+		kind := tuple[0]
+		tuple = tuple[1:]
+		if kind == tupleColumnNull {
+			values = append(values, nil)
+			continue
+		}
+		length := int(binary.BigEndian.Uint32(tuple[:4]))
+		values = append(values, tuple[4:4+length])
+		tuple = tuple[4+length:]
+	}
+	if len(tuple) != 0 {
+		t.Fatal("Unexpected data after tuple")
+	}
+	return values
+}
+
+func TestLogicalReplicationProcessor(t *testing.T) {
+	sourceKeypair, err := keys.New(keys.TypeEC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	targetKeypair, err := keys.New(keys.TypeEC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keystore := &replicationTestKeystore{keypairs: map[string]*keys.Keypair{"source": sourceKeypair, "analytics": targetKeypair}}
+	policy := &ReplicationPolicy{Tables: []ReplicationTablePolicy{{
+		Table: "public.users",
+		Columns: []ReplicationColumnPolicy{
+			{Column: "email", Action: ReplicationActionDecrypt},
+			{Column: "ssn", Action: ReplicationActionReencrypt, ReencryptClientID: "analytics"},
+		},
+	}}}
+	if err := policy.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	processor := NewLogicalReplicationProcessor(policy, []byte("source"), keystore, logrus.NewEntry(logrus.StandardLogger()))
+
+	relation := testXLogData(testRelationMessage(1, "public", "users", "id", "email", "ssn", "name"))
+	output, err := processor.ProcessCopyData(relation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(output, relation) {
+		t.Fatal("Relation message shouldn't be changed")
+	}
+
+	email, err := acrawriter.CreateAcrastruct([]byte("user@example.com"), sourceKeypair.Public, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ssn, err := acrawriter.CreateAcrastruct([]byte("123-45-6789"), sourceKeypair.Public, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	insert := testXLogData(testInsertMessage(1, []byte("1"), testByteaHex(email), testByteaHex(ssn), nil))
+	output, err = processor.ProcessCopyData(insert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(output[:xLogDataHeaderSize], insert[:xLogDataHeaderSize]) {
+		t.Fatal("XLogData header was changed")
+	}
+	values := testInsertValues(t, output)
+	if len(values) != 4 || string(values[0]) != "1" || values[3] != nil {
+		t.Fatal("Unprocessed columns were changed")
+	}
+	decodedEmail, err := utils.DecodeEscaped(values[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(decodedEmail.Data()) != "user@example.com" {
+		t.Fatalf("Email wasn't decrypted, took %s", decodedEmail.Data())
+	}
+	decodedSSN, err := utils.DecodeEscaped(values[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := base.DecryptAcrastruct(decodedSSN.Data(), sourceKeypair.Private, nil); err == nil {
+		t.Fatal("SSN should be re-encrypted with another key")
+	}
+	decryptedSSN, err := base.DecryptAcrastruct(decodedSSN.Data(), targetKeypair.Private, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(decryptedSSN) != "123-45-6789" {
+		t.Fatalf("Incorrect re-encrypted SSN, took %s", decryptedSSN)
+	}
+
+	// other messages and tables without policy are passed as is
+	keepalive := []byte{'k', 1, 2, 3}
+	if output, err := processor.ProcessCopyData(keepalive); err != nil || !bytes.Equal(output, keepalive) {
+		t.Fatal("Keepalive message shouldn't be changed")
+	}
+	if _, err := processor.ProcessCopyData(testXLogData(testRelationMessage(2, "public", "orders", "email"))); err != nil {
+		t.Fatal(err)
+	}
+	ordersInsert := testXLogData(testInsertMessage(2, testByteaHex(email)))
+	if output, err := processor.ProcessCopyData(ordersInsert); err != nil || !bytes.Equal(output, ordersInsert) {
+		t.Fatal("Table without policy shouldn't be changed")
+	}
+	if _, err := processor.ProcessCopyData(testXLogData(testInsertMessage(3, []byte("1")))); err != ErrUnknownRelation {
+		t.Fatalf("Expected ErrUnknownRelation, took %v", err)
+	}
+}
+
+func TestReplicationPolicyValidate(t *testing.T) {
+	invalidPolicies := []*ReplicationPolicy{
+		{Tables: []ReplicationTablePolicy{{Table: "users", Columns: []ReplicationColumnPolicy{{Column: "email", Action: "unknown"}}}}},
+		{Tables: []ReplicationTablePolicy{{Table: "users", Columns: []ReplicationColumnPolicy{{Column: "email", Action: ReplicationActionReencrypt}}}}},
+	}
+	for i, policy := range invalidPolicies {
+		if err := policy.Validate(); !errors.Is(err, ErrInvalidReplicationAction) {
+			t.Errorf("%d: expected ErrInvalidReplicationAction, took %v", i, err)
+		}
+	}
+}
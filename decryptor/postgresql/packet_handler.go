@@ -27,6 +27,10 @@ type PacketHandler struct {
 	logger          *logrus.Entry
 	Columns         []*ColumnData
 	terminatePacket bool
+	// maxPacketSize limits length of packets without length itself
+	maxPacketSize int
+	// closeErr closes connection after packet is sent if not nil
+	closeErr error
 }
 
 // NewClientSidePacketHandler return new PacketHandler with initialized own logger for client's packets
@@ -48,9 +52,15 @@ func newPacketHandlerWithLogger(reader io.Reader, writer *bufio.Writer, logger *
 		writer:               writer,
 		logger:               logger,
 		terminatePacket:      false,
+		maxPacketSize:        base.DefaultMaxPacketSize,
 	}, nil
 }
 
+// SetMaxPacketSize sets limit of packet length, packets exceeding it are rejected with base.ErrPacketTooLarge
+func (packet *PacketHandler) SetMaxPacketSize(size int) {
+	packet.maxPacketSize = size
+}
+
 // updatePacketLength update buffer of packet length and set correct size and include size buf itself
 func (packet *PacketHandler) updatePacketLength(newLength int) {
 	// update packet size
@@ -130,6 +140,8 @@ type ColumnData struct {
 	data      *utils.DecodedData
 	changed   bool
 	isNull    bool
+	// skipped column data isn't decoded and decrypted
+	skipped bool
 }
 
 // GetData return raw data, decoded from db format to binary
@@ -150,6 +162,11 @@ func (column *ColumnData) IsNull() bool {
 	return column.isNull
 }
 
+// IsSkipped return true if column data should be returned as is without decoding and decryption
+func (column *ColumnData) IsSkipped() bool {
+	return column.skipped
+}
+
 // ReadLength of column
 func (column *ColumnData) ReadLength(reader io.Reader) error {
 	n, err := io.ReadFull(reader, column.LengthBuf[:])
@@ -166,7 +183,7 @@ const (
 )
 
 // readData read column length and then data from reader
-func (column *ColumnData) readData(reader io.Reader) error {
+func (column *ColumnData) readData(reader *bytes.Reader) error {
 	length := column.Length()
 	if int32(length) == NullColumnValue {
 		column.data = utils.WrapRawDataAsDecoded(nil)
@@ -174,6 +191,10 @@ func (column *ColumnData) readData(reader io.Reader) error {
 		return nil
 	}
 	column.isNull = false
+	// column can't be longer than rest of packet
+	if length > reader.Len() {
+		return ErrPacketTruncated
+	}
 	if length == 0 {
 		var err error
 		column.data, err = utils.DecodeEscaped(nil)
@@ -191,6 +212,10 @@ func (column *ColumnData) readData(reader io.Reader) error {
 	if err != nil {
 		return err
 	}
+	if column.skipped {
+		column.data = utils.WrapRawDataAsDecoded(data)
+		return base.CheckReadWrite(n, length, nil)
+	}
 	column.data, err = utils.DecodeEscaped(data)
 	if err != nil && err != utils.ErrDecodeOctalString {
 		return err
@@ -210,8 +235,16 @@ func (column *ColumnData) SetData(newData []byte) {
 	binary.BigEndian.PutUint32(column.LengthBuf[:], uint32(len(column.data.Encoded())))
 }
 
-// parseColumns split whole data row packet into separate columns data
-func (packet *PacketHandler) parseColumns() error {
+// columnSizeCheck checks declared length of column value with index before value is read, returns false if value
+// should be skipped
+type columnSizeCheck func(index, length int) (bool, error)
+
+// parseColumns split whole data row packet into separate columns data, lengths of not null values are checked with
+// checkSize if it's not nil
+func (packet *PacketHandler) parseColumns(checkSize columnSizeCheck) error {
+	if packet.descriptionBuf.Len() < 2 {
+		return ErrPacketTruncated
+	}
 	packet.columnCount = int(binary.BigEndian.Uint16(packet.descriptionBuf.Bytes()[:2]))
 
 	if packet.columnCount == 0 {
@@ -224,11 +257,21 @@ func (packet *PacketHandler) parseColumns() error {
 		if err := column.ReadLength(columnReader); err != nil {
 			return err
 		}
+		if length := column.Length(); checkSize != nil && int32(length) != NullColumnValue {
+			decrypt, err := checkSize(i, length)
+			if err != nil {
+				return err
+			}
+			column.skipped = !decrypt
+		}
 		if err := column.readData(columnReader); err != nil {
 			return err
 		}
 		columns = append(columns, column)
 	}
+	if columnReader.Len() != 0 {
+		return ErrPacketTruncated
+	}
 	packet.Columns = columns
 	return nil
 }
@@ -240,6 +283,24 @@ func (packet *PacketHandler) Reset() {
 	packet.columnCount = 0
 	packet.Columns = nil
 	packet.messageType[0] = 0
+	packet.closeErr = nil
+}
+
+// replaceWithFatalError replaces packet with ErrorResponse of FATAL severity with SQLSTATE code and message,
+// connection is closed with err after the packet is sent
+func (packet *PacketHandler) replaceWithFatalError(code, message string, err error) {
+	errorResponse := newPgErrorWithCode("FATAL", code, message)
+	packet.messageType[0] = errorResponse[0]
+	// message type and length are followed by fields
+	packet.ReplaceData(errorResponse[5:])
+	packet.columnCount = 0
+	packet.Columns = nil
+	packet.closeErr = err
+}
+
+// closeConnectionError returns error with which connection should be closed after the packet is sent or nil
+func (packet *PacketHandler) closeConnectionError() error {
+	return packet.closeErr
 }
 
 func (packet *PacketHandler) descriptionBufferCopy() []byte {
@@ -293,6 +354,38 @@ func (packet *PacketHandler) IsExecute() bool {
 	return packet.messageType[0] == ExecuteMessageType
 }
 
+// IsCopyBothResponse return true if packet has CopyBothResponse type which starts streaming replication
+func (packet *PacketHandler) IsCopyBothResponse() bool {
+	return packet.messageType[0] == CopyBothResponseMessageType
+}
+
+// IsCopyData return true if packet has CopyData type
+func (packet *PacketHandler) IsCopyData() bool {
+	return packet.messageType[0] == CopyDataMessageType
+}
+
+// IsFunctionCall return true if packet has FunctionCall type
+func (packet *PacketHandler) IsFunctionCall() bool {
+	return packet.messageType[0] == FunctionCallMessageType
+}
+
+// IsFunctionCallResponse return true if packet has FunctionCallResponse type
+func (packet *PacketHandler) IsFunctionCallResponse() bool {
+	return packet.messageType[0] == FunctionCallResponseMessageType
+}
+
+// IsErrorOrNotice return true if packet has ErrorResponse or NoticeResponse type
+func (packet *PacketHandler) IsErrorOrNotice() bool {
+	return packet.messageType[0] == ErrorResponseMessageType || packet.messageType[0] == NoticeResponseMessageType
+}
+
+// ReplaceData replace packet data with new one and update packet length
+func (packet *PacketHandler) ReplaceData(data []byte) {
+	packet.descriptionBuf.Reset()
+	packet.descriptionBuf.Write(data)
+	packet.updatePacketLength(len(data))
+}
+
 // GetParseData returns parsed Parse packet data.
 // Use this only if IsParse() is true.
 func (packet *PacketHandler) GetParseData() (*ParsePacket, error) {
@@ -368,13 +461,33 @@ func (packet *PacketHandler) ReplaceBind(bindPacket *BindPacket) error {
 
 // GetSimpleQuery return query value as string from Query packet
 func (packet *PacketHandler) GetSimpleQuery() (string, error) {
+	// query is null-terminated string
+	if packet.dataLength < 1 || packet.descriptionBuf.Len() < packet.dataLength {
+		return "", ErrPacketTruncated
+	}
 	return string(packet.descriptionBuf.Bytes()[:packet.dataLength-1]), nil
 }
 
-func (packet *PacketHandler) setDataLengthBuffer(dataLengthBuffer []byte) {
+// setDataLengthBuffer sets length of packet data and returns ErrInvalidPacketLength if declared length is shorter than
+// length itself or base.ErrPacketTooLarge if it's greater than maxPacketSize
+func (packet *PacketHandler) setDataLengthBuffer(dataLengthBuffer []byte) error {
 	copy(packet.descriptionLengthBuf, dataLengthBuffer)
+	length := binary.BigEndian.Uint32(dataLengthBuffer)
+	// length includes size of length itself
+	if length < uint32(len(dataLengthBuffer)) {
+		packet.logger.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCodingPostgresqlUnexpectedPacket).
+			WithField("length", length).Errorln("Packet declares length shorter than length itself")
+		return ErrInvalidPacketLength
+	}
 	// set data length without length itself
-	packet.dataLength = int(binary.BigEndian.Uint32(dataLengthBuffer)) - len(dataLengthBuffer)
+	dataLength := length - uint32(len(dataLengthBuffer))
+	if uint64(dataLength) > uint64(packet.maxPacketSize) {
+		packet.logger.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCodingPostgresqlUnexpectedPacket).
+			WithField("length", length).WithField("max_packet_size", packet.maxPacketSize).Errorln("Packet exceeds max packet size")
+		return base.ErrPacketTooLarge
+	}
+	packet.dataLength = int(dataLength)
+	return nil
 }
 
 func (packet *PacketHandler) readDataLength() error {
@@ -383,8 +496,7 @@ func (packet *PacketHandler) readDataLength() error {
 	if err2 := base.CheckReadWrite(n, len(packet.descriptionLengthBuf), err); err2 != nil {
 		return err2
 	}
-	packet.setDataLengthBuffer(packet.descriptionLengthBuf)
-	return nil
+	return packet.setDataLengthBuffer(packet.descriptionLengthBuf)
 }
 
 // readData part of packet
@@ -394,7 +506,7 @@ func (packet *PacketHandler) readData(readLength bool) error {
 			return err
 		}
 	}
-	packet.descriptionBuf.Grow(packet.dataLength)
+	// buffer isn't grown to declared length before data is read to not allocate memory for packets which aren't sent
 	packet.logger.Debugln("Read data")
 	nn, err := io.CopyN(packet.descriptionBuf, packet.reader, int64(packet.dataLength))
 	return base.CheckReadWrite(int(nn), packet.dataLength, err)
@@ -422,6 +534,9 @@ const WithoutMessageType = 0
 // ErrUnsupportedPacketType error when recognized unsupported message type or new added to postgresql wire protocol
 var ErrUnsupportedPacketType = errors.New("unsupported postgresql message type")
 
+// ErrInvalidPacketLength returned when packet declares length shorter than its mandatory fields
+var ErrInvalidPacketLength = errors.New("invalid postgresql packet length")
+
 // ReadClientPacket read and recognize packets that may be sent only from client/frontend. It's all message types marked
 // with (F) or (F/B) on https://www.postgresql.org/docs/current/static/protocol-message-formats.html
 func (packet *PacketHandler) ReadClientPacket() error {
@@ -449,13 +564,17 @@ func (packet *PacketHandler) ReadClientPacket() error {
 		// set message type
 		packet.messageType[0] = packetBuf[0]
 		// general message has 4 bytes after first as length
-		packet.setDataLengthBuffer(packetBuf[1:5])
+		if err := packet.setDataLengthBuffer(packetBuf[1:5]); err != nil {
+			return err
+		}
 		return packet.readData(false)
 	case TerminatePacket[0]:
 		// set message type
 		packet.messageType[0] = packetBuf[0]
 		// general message has 4 bytes after first as length
-		packet.setDataLengthBuffer(packetBuf[1:5])
+		if err := packet.setDataLengthBuffer(packetBuf[1:5]); err != nil {
+			return err
+		}
 		packet.terminatePacket = true
 		if !bytes.Equal(TerminatePacket, packetBuf[:5]) {
 			packet.logger.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCodingPostgresqlUnexpectedPacket).Warningln("Expected Terminate packet but receive something else")
@@ -473,7 +592,9 @@ func (packet *PacketHandler) ReadClientPacket() error {
 		if err := base.CheckReadWrite(n, 4, err); err != nil {
 			return err
 		}
-		packet.setDataLengthBuffer(packetBuf[:4])
+		if err := packet.setDataLengthBuffer(packetBuf[:4]); err != nil {
+			return err
+		}
 
 		// ssl and cancel requests have known and different lengths (8 and 16 respectively) or variable-length in startup request
 		switch packetBuf[3] {
@@ -494,7 +615,13 @@ func (packet *PacketHandler) ReadClientPacket() error {
 				// so we process it as general message type which has first byte as type and next 4 bytes is length of message
 				// above we read 8 bytes as for special messages, so we need to read dataLength -3 bytes
 				packet.messageType[0] = packetBuf[0]
-				packet.setDataLengthBuffer(packetBuf[1:5])
+				if err := packet.setDataLengthBuffer(packetBuf[1:5]); err != nil {
+					return err
+				}
+				// 3 bytes of data are already read
+				if packet.dataLength < 3 {
+					return ErrInvalidPacketLength
+				}
 				packet.descriptionBuf.Reset()
 				packet.descriptionBuf.Write(packetBuf[5:])
 				packet.dataLength -= 3
@@ -506,6 +633,9 @@ func (packet *PacketHandler) ReadClientPacket() error {
 			}
 
 			// we read 4 bytes before. decrease before call readData because it read exactly as dataLength
+			if packet.dataLength < 4 {
+				return ErrInvalidPacketLength
+			}
 			packet.dataLength -= 4
 
 			if err := packet.readData(false); err != nil {
@@ -530,6 +660,41 @@ func (packet *PacketHandler) Marshal() ([]byte, error) {
 	return output, nil
 }
 
+// IsStartupMessage returns true if packet is StartupMessage of client
+func (packet *PacketHandler) IsStartupMessage() bool {
+	return packet.messageType[0] == WithoutMessageType && bytes.HasPrefix(packet.descriptionBuf.Bytes(), StartupRequest)
+}
+
+// StartupParameter returns value of parameter of StartupMessage and true if client sent it
+func (packet *PacketHandler) StartupParameter(name string) (string, bool) {
+	data := packet.descriptionBuf.Bytes()
+	if !bytes.HasPrefix(data, StartupRequest) {
+		return "", false
+	}
+	parameters := data[len(StartupRequest):]
+	for len(parameters) > 0 && parameters[0] != 0 {
+		fields := bytes.SplitN(parameters, []byte{0}, 3)
+		if len(fields) != 3 {
+			return "", false
+		}
+		if string(fields[0]) == name {
+			return string(fields[1]), true
+		}
+		parameters = fields[2]
+	}
+	return "", false
+}
+
+// IsPasswordMessage returns true if packet is PasswordMessage or SASL response of client
+func (packet *PacketHandler) IsPasswordMessage() bool {
+	return packet.messageType[0] == PasswordMessageType
+}
+
+// IsAuthentication returns true if packet is authentication request or AuthenticationOk of database
+func (packet *PacketHandler) IsAuthentication() bool {
+	return packet.messageType[0] == AuthenticationMessageType
+}
+
 // IsSSLRequestAllowed returns true server allowed switch to SSL
 func (packet *PacketHandler) IsSSLRequestAllowed() bool {
 	return packet.messageType[0] == 'S'
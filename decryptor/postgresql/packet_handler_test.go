@@ -20,6 +20,7 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/hex"
+	"github.com/cossacklabs/acra/decryptor/base"
 	"github.com/sirupsen/logrus"
 	"testing"
 )
@@ -116,3 +117,103 @@ func TestClientStartupMessageWithData(t *testing.T) {
 		t.Fatal("Output not equal to correct packet")
 	}
 }
+
+// TestMalformedPackets checks that packets which declare lengths greater than actual ones or shorter than mandatory
+// fields are rejected with errors instead of panics. New crashers found by Fuzz should be added here.
+func TestMalformedPackets(t *testing.T) {
+	newHandler := func(packet []byte) *PacketHandler {
+		handler, err := NewClientSidePacketHandler(bytes.NewReader(packet), bufio.NewWriter(&bytes.Buffer{}), logrus.NewEntry(logrus.StandardLogger()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return handler
+	}
+	clientPackets := []struct {
+		packet []byte
+		err    error
+	}{
+		// length shorter than length itself
+		{[]byte{'Q', 0, 0, 0, 3}, ErrInvalidPacketLength},
+		{[]byte{'X', 0, 0, 0, 0}, ErrInvalidPacketLength},
+		// unknown message type of general format with 3 bytes already read as part of special message
+		{[]byte{1, 0, 0, 0, 6, 1, 2, 3}, ErrInvalidPacketLength},
+		// startup message with length shorter than protocol version
+		{[]byte{0, 0, 0, 7, 0, 3, 0, 0}, ErrInvalidPacketLength},
+		{[]byte{0, 0, 0, 2, 0, 3, 0, 0}, ErrInvalidPacketLength},
+		// length greater than max packet size
+		{[]byte{'Q', 0xff, 0xff, 0xff, 0xff}, base.ErrPacketTooLarge},
+	}
+	for i, testcase := range clientPackets {
+		if err := newHandler(testcase.packet).ReadClientPacket(); err != testcase.err {
+			t.Fatalf("[%d] Expected %v, took %v", i, testcase.err, err)
+		}
+	}
+
+	handler := newHandler([]byte{'Q', 0, 0, 0, 9, 1, 2, 3, 4, 5})
+	handler.SetMaxPacketSize(4)
+	if err := handler.ReadClientPacket(); err != base.ErrPacketTooLarge {
+		t.Fatalf("Expected ErrPacketTooLarge, took %v", err)
+	}
+	// empty query without terminator
+	handler = newHandler([]byte{'Q', 0, 0, 0, 4})
+	if err := handler.ReadClientPacket(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := handler.GetSimpleQuery(); err != ErrPacketTruncated {
+		t.Fatalf("Expected ErrPacketTruncated, took %v", err)
+	}
+
+	dataRows := [][]byte{
+		// column count without columns
+		{},
+		{0},
+		{0, 1},
+		// column longer than packet
+		{0, 1, 0, 0, 0, 5, 'a'},
+		{0, 1, 0x7f, 0xff, 0xff, 0xff, 'a'},
+		// data after last column
+		{0, 1, 0, 0, 0, 1, 'a', 'b'},
+	}
+	for i, row := range dataRows {
+		handler := newHandler(nil)
+		handler.descriptionBuf.Write(row)
+		if err := handler.parseColumns(nil); err == nil {
+			t.Fatalf("[%d] Expected error for malformed data row", i)
+		}
+	}
+	handler = newHandler(nil)
+	handler.descriptionBuf.Write([]byte{0, 2, 0, 0, 0, 1, 'a', 0xff, 0xff, 0xff, 0xff})
+	if err := handler.parseColumns(nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(handler.Columns) != 2 || !handler.Columns[1].IsNull() {
+		t.Fatal("Incorrect columns of data row")
+	}
+
+	// Parse packets truncated before count of parameters or parameters
+	for i, packet := range [][]byte{[]byte("name\x00query\x00"), []byte("name\x00query\x00\x00"), []byte("name\x00query\x00\x00\x02\x00\x00\x00\x17")} {
+		if _, err := NewParsePacket(packet); err != ErrPacketTruncated {
+			t.Fatalf("[%d] Expected ErrPacketTruncated, took %v", i, err)
+		}
+	}
+}
+
+func TestStartupParameter(t *testing.T) {
+	startup := newTestStartupMessage("user", "app", "acra.purpose", "billing", "database", "db")
+	packet, err := NewClientSidePacketHandler(bytes.NewReader(startup), bufio.NewWriter(&bytes.Buffer{}), logrus.NewEntry(logrus.StandardLogger()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := packet.ReadClientPacket(); err != nil {
+		t.Fatal(err)
+	}
+	if value, ok := packet.StartupParameter("acra.purpose"); !ok || value != "billing" {
+		t.Fatalf("Expected billing, took %s, %v", value, ok)
+	}
+	if value, ok := packet.StartupParameter("database"); !ok || value != "db" {
+		t.Fatalf("Expected db, took %s, %v", value, ok)
+	}
+	if _, ok := packet.StartupParameter("application_name"); ok {
+		t.Fatal("Parameter which client didn't send shouldn't be found")
+	}
+}
@@ -30,6 +30,7 @@ import (
 	acracensor "github.com/cossacklabs/acra/acra-censor"
 	"github.com/cossacklabs/acra/acra-censor/common"
 	"github.com/cossacklabs/acra/decryptor/base"
+	"github.com/cossacklabs/acra/encryptor"
 	"github.com/cossacklabs/acra/logging"
 	"github.com/cossacklabs/acra/network"
 	"github.com/cossacklabs/acra/sqlparser"
@@ -49,28 +50,45 @@ var TerminatePacket = []byte{'X', 0, 0, 0, 4}
 
 // NewPgError returns packed error
 func NewPgError(message string) ([]byte, error) {
+	// 42000 - syntax_error_or_access_rule_violation
+	// https://www.postgresql.org/docs/9.3/static/errcodes-appendix.html
+	return newPgErrorWithCode("ERROR", "42000", message), nil
+}
+
+// NewPgTooManyConnectionsError returns packed fatal error which is sent instead of authentication response when
+// connection is rejected due to connection limits
+func NewPgTooManyConnectionsError() []byte {
+	// 53300 - too_many_connections
+	// https://www.postgresql.org/docs/9.3/static/errcodes-appendix.html
+	return newPgErrorWithCode("FATAL", "53300", "too many connections")
+}
+
+// newPgErrorWithCode returns packed ErrorResponse with severity, SQLSTATE code and message
+func newPgErrorWithCode(severity, code, message string) []byte {
 	// 5 = E marker + 4 bytes for message length
-	// 7 is severity error with null terminator
-	// +1 for null terminator of message and packet
-	output := make([]byte, 5+7+7+len(message)+2)
+	// +2 for field type and null terminator of severity, code and message
+	// +1 for null terminator of packet
+	output := make([]byte, 5+len(severity)+2+len(code)+2+len(message)+3)
 	// error message
 	output[0] = 'E'
 	// leave untouched place for length of data
 	output = output[:5]
 	// error severity
-	output = append(output, []byte{'S', 'E', 'R', 'R', 'O', 'R', 0}...)
-	// 42000 - syntax_error_or_access_rule_violation
-	// https://www.postgresql.org/docs/9.3/static/errcodes-appendix.html
-	output = append(output, []byte("C42000")...)
+	output = append(output, 'S')
+	output = append(output, severity...)
+	output = append(output, 0)
+	output = append(output, 'C')
+	output = append(output, code...)
 	output = append(output, 0)
 	// human readable message
-	output = append(output, append([]byte{'M'}, []byte(message)...)...)
+	output = append(output, 'M')
+	output = append(output, message...)
 	output = append(output, 0, 0)
 	// place length of data
 	// -1 byte to exclude type of message
 	// 1:5 4 bytes for packet length without first byte of message type
 	binary.BigEndian.PutUint32(output[1:5], uint32(len(output)-1))
-	return output, nil
+	return output
 }
 
 // Errors returned when initializing session registries.
@@ -112,6 +130,46 @@ type PgProxy struct {
 	decryptionObserver   base.ColumnDecryptionObserver
 	protocolState        *PgProtocolState
 	setting              base.ProxySetting
+	replicationProcessor *LogicalReplicationProcessor
+	largeObjectProcessor *LargeObjectProcessor
+	// maxPacketSize limits length of packets from client and database
+	maxPacketSize int
+	// errorMessagePolicy strips fields of database errors and notices if not nil
+	errorMessagePolicy *ErrorMessagePolicy
+	// credentialInjector authenticates connections to the database with credentials of client ID if not nil
+	credentialInjector *credentialInjector
+	// clientID of connection used to select database credentials
+	clientID []byte
+	// clientIDVerified is true if clientID is authenticated by transport or taken from TLS certificate of client
+	clientIDVerified bool
+	// purposeGuard labels session with purpose of startup parameter if not nil
+	purposeGuard *encryptor.DecryptionPurposeGuard
+	// tenantRewriter scopes queries of tenant clients to their rows if not nil
+	tenantRewriter *encryptor.TenantIsolationRewriter
+	// pipelineQueueSize enables processing of packets in stages of pipeline with queues of this size if greater than
+	// zero
+	pipelineQueueSize int
+	// sessionIdentity exports identity of client into startup parameter sessionIdentityParameter if not nil
+	sessionIdentity          *base.SessionIdentity
+	sessionIdentityParameter string
+	// idleWatchdog tracks time of session spent idle in transaction if not nil
+	idleWatchdog *base.IdleInTransactionWatchdog
+	// ciphertextSizeGuard checks lengths of values in data rows if not nil
+	ciphertextSizeGuard *encryptor.CiphertextSizeGuard
+}
+
+// pipelinePacket is packet passed through stages of pipeline with span and timer of its processing
+type pipelinePacket struct {
+	handler *PacketHandler
+	ctx     context.Context
+	span    *trace.Span
+	timer   *prometheus.Timer
+}
+
+// end finishes span and timer of packet which was forwarded or dropped
+func (packet *pipelinePacket) end() {
+	packet.span.End()
+	packet.timer.ObserveDuration()
 }
 
 // NewPgProxy returns new PgProxy
@@ -146,6 +204,7 @@ func NewPgProxy(session base.ClientSession, decryptor base.Decryptor, setting ba
 		decryptor:            decryptor,
 		decryptionObserver:   base.NewColumnDecryptionObserver(),
 		protocolState:        protocolState,
+		maxPacketSize:        base.DefaultMaxPacketSize,
 	}, nil
 }
 
@@ -199,7 +258,12 @@ func (proxy *PgProxy) ProxyClientConnection(errCh chan<- error) {
 		errCh <- err
 		return
 	}
+	packet.SetMaxPacketSize(proxy.maxPacketSize)
 	prometheusLabels := []string{base.DecryptionDBPostgresql}
+	if proxy.pipelineQueueSize > 0 {
+		proxy.proxyClientConnectionPipeline(ctx, reader, writer, prometheusLabels, logger, errCh)
+		return
+	}
 	// use pointers to function where should be stored some function that should be called if code return error and interrupt loop
 	// default value empty func to avoid != nil check
 	var spanEndFunc = func() {}
@@ -233,25 +297,12 @@ func (proxy *PgProxy) ProxyClientConnection(errCh chan<- error) {
 		}
 		proxy.dbConnection.SetWriteDeadline(time.Now().Add(network.DefaultNetworkTimeout))
 
-		_, censorSpan := trace.StartSpan(packetSpanCtx, "censor")
-
-		// Massage the packet. This should not normally fail. If it does, the database will not receive the packet.
-		censored, err := proxy.handleClientPacket(packet, logger)
+		forward, err := proxy.processClientPacket(packetSpanCtx, packet, logger)
 		if err != nil {
 			errCh <- err
 			return
 		}
-
-		censorSpan.End()
-
-		// If the packet has been rejected by AcraCensor, stop here and don't send it to the database.
-		// Also, craft and send the client an error so that they know their query has been rejected.
-		if censored {
-			err := proxy.sendClientAcraCensorError(logger)
-			if err != nil {
-				errCh <- err
-				return
-			}
+		if !forward {
 			continue
 		}
 
@@ -270,6 +321,113 @@ func (proxy *PgProxy) ProxyClientConnection(errCh chan<- error) {
 	}
 }
 
+// proxyClientConnectionPipeline reads packets of client, processes and forwards them to the database in separate
+// stages of pipeline
+func (proxy *PgProxy) proxyClientConnectionPipeline(ctx context.Context, reader io.Reader, writer *bufio.Writer, prometheusLabels []string, logger *log.Entry, errCh chan<- error) {
+	read := func() (interface{}, error) {
+		// every packet has own handler because previous packets may be still processed by next stages
+		packet, err := NewClientSidePacketHandler(reader, writer, logger)
+		if err != nil {
+			return nil, err
+		}
+		packet.SetMaxPacketSize(proxy.maxPacketSize)
+		timer := prometheus.NewTimer(prometheus.ObserverFunc(base.RequestProcessingTimeHistogram.WithLabelValues(prometheusLabels...).Observe))
+		packetCtx, packetSpan := trace.StartSpan(ctx, "ProxyClientConnectionLoop")
+		if err := packet.ReadClientPacket(); err != nil {
+			packetSpan.End()
+			// log message with debug level because only here we expect and can meet errors with closed connections io.EOF
+			logger.WithError(err).Debugln("Can't read packet from client to database")
+			return nil, err
+		}
+		return &pipelinePacket{handler: packet, ctx: packetCtx, span: packetSpan, timer: timer}, nil
+	}
+	censorStage := base.PipelineStage{Name: "censor", Process: func(item interface{}) (bool, error) {
+		packet := item.(*pipelinePacket)
+		forward, err := proxy.processClientPacket(packet.ctx, packet.handler, logger)
+		if err != nil || !forward {
+			packet.end()
+		}
+		return forward, err
+	}}
+	writeStage := base.PipelineStage{Name: "write", Process: func(item interface{}) (bool, error) {
+		packet := item.(*pipelinePacket)
+		defer packet.end()
+		proxy.dbConnection.SetWriteDeadline(time.Now().Add(network.DefaultNetworkTimeout))
+		if err := packet.handler.sendPacket(); err != nil {
+			logger.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorNetworkWrite).
+				WithError(err).Errorln("Can't send packet")
+			return false, err
+		}
+		// If this is a termination packet, we're done here. Signal EOF and stop the proxy.
+		if packet.handler.terminatePacket {
+			return false, io.EOF
+		}
+		return true, nil
+	}}
+	pipeline, err := base.NewPipeline("postgresql_client", proxy.pipelineQueueSize, censorStage, writeStage)
+	if err != nil {
+		errCh <- err
+		return
+	}
+	err = pipeline.Run(read)
+	// reading is interrupted by switch to TLS after SSLRequest
+	if proxy.tlsSwitch {
+		proxy.tlsSwitch = false
+		proxy.TLSCh <- true
+		return
+	}
+	errCh <- err
+}
+
+// processClientPacket observes and possibly modifies packet of client and returns false if it shouldn't be forwarded
+// to the database
+func (proxy *PgProxy) processClientPacket(ctx context.Context, packet *PacketHandler, logger *log.Entry) (bool, error) {
+	if proxy.idleWatchdog != nil {
+		proxy.idleWatchdog.Activity()
+	}
+	if proxy.purposeGuard != nil && proxy.purposeGuard.StartupParameter() != "" && packet.IsStartupMessage() {
+		if purpose, ok := packet.StartupParameter(proxy.purposeGuard.StartupParameter()); ok {
+			proxy.purposeGuard.SetPurpose(purpose)
+		}
+	}
+
+	if proxy.sessionIdentity != nil && packet.IsStartupMessage() {
+		if err := proxy.exportSessionIdentity(packet, logger); err != nil {
+			return false, err
+		}
+	}
+
+	if proxy.credentialInjector != nil {
+		drop, err := proxy.handleClientCredentials(packet, logger)
+		if err != nil {
+			return false, err
+		}
+		if drop {
+			return false, nil
+		}
+	}
+
+	_, censorSpan := trace.StartSpan(ctx, "censor")
+
+	// Massage the packet. This should not normally fail. If it does, the database will not receive the packet.
+	censored, err := proxy.handleClientPacket(packet, logger)
+	censorSpan.End()
+	if err != nil {
+		// Rejected requests are reported to the client, the connection remains usable.
+		if isRejectedClientRequest(err) {
+			return false, proxy.sendClientError(err.Error(), logger)
+		}
+		return false, err
+	}
+
+	// If the packet has been rejected by AcraCensor, stop here and don't send it to the database.
+	// Also, craft and send the client an error so that they know their query has been rejected.
+	if censored {
+		return false, proxy.sendClientAcraCensorError(logger)
+	}
+	return true, nil
+}
+
 func (proxy *PgProxy) handleClientPacket(packet *PacketHandler, logger *log.Entry) (bool, error) {
 	// Let the protocol observer take a look at the packet, keeping note of it.
 	err := proxy.protocolState.HandleClientPacket(packet)
@@ -287,6 +445,10 @@ func (proxy *PgProxy) handleClientPacket(packet *PacketHandler, logger *log.Entr
 		// Also, remember the requested portal name for future data queries.
 		return proxy.handleBindPacket(packet, logger)
 
+	case FunctionCallPacket:
+		// Large object functions are called directly, their data should be encrypted.
+		return false, proxy.handleFunctionCallPacket(packet, logger)
+
 	default:
 		// Forward all other uninteresting packets to the database without processing.
 		return false, nil
@@ -299,10 +461,10 @@ func (proxy *PgProxy) handleQueryPacket(packet *PacketHandler, logger *log.Entry
 	// Log query text -- if and only if we're in debug mode -- without inserted value data.
 	// The query can still be sensitive though, so only in debug mode can we do this.
 	if logging.GetLogLevel() == logging.LogDebug {
-		_, queryWithHiddenValues, _, err := common.HandleRawSQLQuery(query.Query())
-		if err == common.ErrQuerySyntaxError {
-			logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCensorQueryParseError).
-				Debugf("Parsing error on query: %s", queryWithHiddenValues)
+		queryWithHiddenValues := common.RedactQueryForLog(query.Query())
+		if queryWithHiddenValues == "" {
+			logger.WithError(common.ErrQuerySyntaxError).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCensorQueryParseError).
+				Debugln("Parsing error on query, query isn't logged")
 		} else {
 			log := logger.WithField("sql", queryWithHiddenValues)
 			if proxy.protocolState.LastPacketType() == ParseStatementPacket {
@@ -326,6 +488,11 @@ func (proxy *PgProxy) handleQueryPacket(packet *PacketHandler, logger *log.Entry
 	if err != nil {
 		logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorEncryptQueryData).
 			Errorln("Error occurred on query handler")
+		// Fail closed if query doesn't match encryptor schema in strict mode, otherwise data may be stored unencrypted,
+		// and if query of tenant isn't scoped.
+		if proxy.isRejectedQuery(err) {
+			return false, err
+		}
 	}
 	if changed {
 		packet.ReplaceQuery(newQuery.Query())
@@ -357,6 +524,9 @@ func (proxy *PgProxy) handleBindPacket(packet *PacketHandler, logger *log.Entry)
 	newParameters, changed, err := proxy.queryObserverManager.OnBind(statement.Query(), parameters)
 	if err != nil {
 		log.WithError(err).Error("Failed to handle Bind packet")
+		if proxy.isRejectedQuery(err) {
+			return false, err
+		}
 		return false, nil
 	}
 	// Finally, if the parameter values have been changed, update the packet.
@@ -372,8 +542,40 @@ func (proxy *PgProxy) handleBindPacket(packet *PacketHandler, logger *log.Entry)
 	return false, nil
 }
 
+func (proxy *PgProxy) handleFunctionCallPacket(packet *PacketHandler, logger *log.Entry) error {
+	if proxy.largeObjectProcessor == nil {
+		return nil
+	}
+	newData, err := proxy.largeObjectProcessor.ProcessFunctionCall(packet.descriptionBuf.Bytes())
+	if err != nil {
+		logger.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCantEncryptData).
+			WithError(err).Errorln("Can't process large object function call")
+		return err
+	}
+	packet.ReplaceData(newData)
+	return nil
+}
+
+// isRejectedClientRequest returns true if err means that client's request shouldn't be passed to the database
+func isRejectedClientRequest(err error) bool {
+	return errors.Is(err, ErrUnsupportedLargeObjectCall) || encryptor.IsRejectedQuery(err)
+}
+
+// isRejectedQuery returns true if query with err of QueryObservers shouldn't be passed to the database
+func (proxy *PgProxy) isRejectedQuery(err error) bool {
+	if proxy.tenantRewriter != nil && proxy.tenantRewriter.IsTenant() {
+		return true
+	}
+	return encryptor.IsRejectedQuery(err)
+}
+
 func (proxy *PgProxy) sendClientAcraCensorError(logger *log.Entry) error {
-	errorMessage, err := NewPgError("AcraCensor blocked this query")
+	return proxy.sendClientError("AcraCensor blocked this query", logger)
+}
+
+// sendClientError sends ErrorResponse with message and ReadyForQuery with current transaction status to the client
+func (proxy *PgProxy) sendClientError(message string, logger *log.Entry) error {
+	errorMessage, err := NewPgError(message)
 	if err != nil {
 		logger.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCodingPostgresqlCantGenerateErrorPacket).
 			WithError(err).Errorln("Can't create PostgreSQL error message")
@@ -383,8 +585,10 @@ func (proxy *PgProxy) sendClientAcraCensorError(logger *log.Entry) error {
 	if err := base.CheckReadWrite(n, len(errorMessage), err); err != nil {
 		return err
 	}
-	n, err = proxy.clientConnection.Write(ReadyForQueryPacket)
-	if err := base.CheckReadWrite(n, len(ReadyForQueryPacket), err); err != nil {
+	readyForQuery := append([]byte{}, ReadyForQueryPacket...)
+	readyForQuery[len(readyForQuery)-1] = proxy.protocolState.TransactionStatus()
+	n, err = proxy.clientConnection.Write(readyForQuery)
+	if err := base.CheckReadWrite(n, len(readyForQuery), err); err != nil {
 		return err
 	}
 	return nil
@@ -499,6 +703,14 @@ func (proxy *PgProxy) handleSSLRequest(packet *PacketHandler, logger *log.Entry)
 	if proxy.setting.TLSConnectionWrapper().UseConnectionClientID() {
 		logger.WithField("client_id", string(clientID)).Infoln("Set new clientID")
 		proxy.decryptor.SetClientID(clientID)
+		proxy.clientID = clientID
+		proxy.clientIDVerified = true
+		if proxy.purposeGuard != nil {
+			proxy.purposeGuard.SetClientID(clientID)
+		}
+		if proxy.tenantRewriter != nil {
+			proxy.tenantRewriter.SetClientID(clientID)
+		}
 	}
 	logger.Debugln("Init tls with db")
 	dbTLSConnection, err := proxy.setting.TLSConnectionWrapper().WrapDBConnection(proxy.ctx, proxy.dbConnection)
@@ -514,6 +726,12 @@ func (proxy *PgProxy) handleSSLRequest(packet *PacketHandler, logger *log.Entry)
 func (proxy *PgProxy) ProxyDatabaseConnection(errCh chan<- error) {
 	ctx, span := trace.StartSpan(proxy.ctx, "PgDecryptStream")
 	defer span.End()
+	if proxy.credentialInjector != nil {
+		defer proxy.credentialInjector.release()
+	}
+	if proxy.idleWatchdog != nil {
+		defer proxy.idleWatchdog.Stop()
+	}
 	logger := logging.NewLoggerWithTrace(ctx).WithField("proxy", "server")
 	if proxy.decryptor.IsWholeMatch() {
 		logger = logger.WithField("decrypt_mode", "wholecell")
@@ -530,6 +748,7 @@ func (proxy *PgProxy) ProxyDatabaseConnection(errCh chan<- error) {
 		errCh <- err
 		return
 	}
+	packetHandler.SetMaxPacketSize(proxy.maxPacketSize)
 
 	prometheusLabels := []string{base.DecryptionDBPostgresql}
 	if proxy.decryptor.IsWholeMatch() {
@@ -609,6 +828,13 @@ func (proxy *PgProxy) ProxyDatabaseConnection(errCh chan<- error) {
 			timer.ObserveDuration()
 			continue
 		}
+		if proxy.pipelineQueueSize > 0 {
+			// startup messages are processed, other packets are processed by pipeline
+			packetSpan.End()
+			endLoopSpanFunc = func() {}
+			errCh <- proxy.proxyDatabaseConnectionPipeline(ctx, reader, writer, prometheusLabels, logger)
+			return
+		}
 		timer := prometheus.NewTimer(prometheus.ObserverFunc(base.ResponseProcessingTimeHistogram.WithLabelValues(prometheusLabels...).Observe))
 		if err = packetHandler.ReadPacket(); err != nil {
 			logger.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorDecryptorReadPacket).WithError(err).Debugln("Can't read packet")
@@ -617,12 +843,15 @@ func (proxy *PgProxy) ProxyDatabaseConnection(errCh chan<- error) {
 		}
 		proxy.clientConnection.SetWriteDeadline(time.Now().Add(network.DefaultNetworkTimeout))
 
-		// Massage the packet. This should not normally fail. If it does, the client will not receive the packet.
-		err := proxy.handleDatabasePacket(packetCtx, packetHandler, logger)
+		forward, err := proxy.processDatabasePacket(packetCtx, packetHandler, logger)
 		if err != nil {
 			errCh <- err
 			return
 		}
+		if !forward {
+			timer.ObserveDuration()
+			continue
+		}
 
 		// After tha packet has been observed and possibly modified, forward it to the client.
 		if err = packetHandler.sendPacket(); err != nil {
@@ -631,10 +860,82 @@ func (proxy *PgProxy) ProxyDatabaseConnection(errCh chan<- error) {
 			errCh <- err
 			return
 		}
+		if err = packetHandler.closeConnectionError(); err != nil {
+			errCh <- err
+			return
+		}
 		timer.ObserveDuration()
 	}
 }
 
+// proxyDatabaseConnectionPipeline reads packets of the database, processes and forwards them to client in separate
+// stages of pipeline
+func (proxy *PgProxy) proxyDatabaseConnectionPipeline(ctx context.Context, reader io.Reader, writer *bufio.Writer, prometheusLabels []string, logger *log.Entry) error {
+	read := func() (interface{}, error) {
+		// every packet has own handler because previous packets may be still processed by next stages
+		packet, err := NewDbSidePacketHandler(reader, writer, logger)
+		if err != nil {
+			return nil, err
+		}
+		packet.SetMaxPacketSize(proxy.maxPacketSize)
+		timer := prometheus.NewTimer(prometheus.ObserverFunc(base.ResponseProcessingTimeHistogram.WithLabelValues(prometheusLabels...).Observe))
+		packetCtx, packetSpan := trace.StartSpan(ctx, "PgDecryptStreamLoop")
+		if err := packet.ReadPacket(); err != nil {
+			packetSpan.End()
+			logger.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorDecryptorReadPacket).WithError(err).Debugln("Can't read packet")
+			return nil, err
+		}
+		return &pipelinePacket{handler: packet, ctx: packetCtx, span: packetSpan, timer: timer}, nil
+	}
+	decryptStage := base.PipelineStage{Name: "decrypt", Process: func(item interface{}) (bool, error) {
+		packet := item.(*pipelinePacket)
+		forward, err := proxy.processDatabasePacket(packet.ctx, packet.handler, logger)
+		if err != nil || !forward {
+			packet.end()
+		}
+		return forward, err
+	}}
+	writeStage := base.PipelineStage{Name: "write", Process: func(item interface{}) (bool, error) {
+		packet := item.(*pipelinePacket)
+		defer packet.end()
+		proxy.clientConnection.SetWriteDeadline(time.Now().Add(network.DefaultNetworkTimeout))
+		if err := packet.handler.sendPacket(); err != nil {
+			logger.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorNetworkWrite).
+				WithError(err).Errorln("Can't send packet")
+			return false, err
+		}
+		if err := packet.handler.closeConnectionError(); err != nil {
+			return false, err
+		}
+		return true, nil
+	}}
+	pipeline, err := base.NewPipeline("postgresql_database", proxy.pipelineQueueSize, decryptStage, writeStage)
+	if err != nil {
+		return err
+	}
+	return pipeline.Run(read)
+}
+
+// processDatabasePacket observes and possibly modifies packet of the database and returns false if it shouldn't be
+// forwarded to client
+func (proxy *PgProxy) processDatabasePacket(ctx context.Context, packet *PacketHandler, logger *log.Entry) (bool, error) {
+	if proxy.credentialInjector != nil && packet.IsAuthentication() {
+		forward, err := proxy.handleDatabaseAuthentication(packet, logger)
+		if err != nil || !forward {
+			return false, err
+		}
+	}
+	// Massage the packet. This should not normally fail. If it does, the client will not receive the packet.
+	if err := proxy.handleDatabasePacket(ctx, packet, logger); err != nil {
+		return false, err
+	}
+	// ReadyForQuery inside transaction means that the database waits for next query of client holding locks
+	if proxy.idleWatchdog != nil && packet.IsReadyForQuery() && proxy.protocolState.InTransaction() {
+		proxy.idleWatchdog.TransactionIdle()
+	}
+	return true, nil
+}
+
 func (proxy *PgProxy) handleDatabasePacket(ctx context.Context, packet *PacketHandler, logger *log.Entry) error {
 	// Let the protocol observer take a look at the packet, keeping note of it.
 	err := proxy.protocolState.HandleDatabasePacket(packet)
@@ -657,15 +958,122 @@ func (proxy *PgProxy) handleDatabasePacket(ctx context.Context, packet *PacketHa
 		bindPacket := proxy.protocolState.PendingBind()
 		return proxy.registerCursor(bindPacket, logger)
 
+	case ReplicationDataPacket:
+		// Logical replication stream with data changes, process configured columns.
+		return proxy.handleReplicationDataPacket(packet, logger)
+
+	case FunctionCallResponsePacket:
+		// Result of large object function, decrypt read data and translate offsets.
+		return proxy.handleFunctionCallResponsePacket(packet, logger)
+
+	case ErrorOrNoticePacket:
+		// Error or notice of the database, strip fields which shouldn't reach the client.
+		return proxy.handleErrorOrNoticePacket(packet, logger)
+
 	default:
 		// Forward all other uninteresting packets to the client without processing.
 		return nil
 	}
 }
 
+// handleClientCredentials replaces credentials of startup message with database credentials of client ID and returns
+// true for password messages of client which shouldn't reach the database
+func (proxy *PgProxy) handleClientCredentials(packet *PacketHandler, logger *log.Entry) (bool, error) {
+	if packet.IsPasswordMessage() {
+		// database never requests password from client, it's answered by AcraServer
+		logger.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCodingPostgresqlUnexpectedPacket).
+			Warningln("Dropped password message of client, database credentials are injected by AcraServer")
+		return true, nil
+	}
+	if !packet.IsStartupMessage() {
+		return false, nil
+	}
+	err := ErrUnverifiedClientID
+	if proxy.clientIDVerified {
+		// client ID of plaintext connections is configured fallback which anyone may connect with
+		err = proxy.credentialInjector.injectStartup(packet, proxy.clientID)
+	}
+	if err != nil {
+		logger.WithError(err).WithField("client_id", string(proxy.clientID)).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorDatabaseCredentialsInjection).
+			Errorln("Can't inject database credentials into startup message")
+		errorMessage, innerErr := NewPgError("AcraServer can't authenticate client to the database")
+		if innerErr != nil {
+			return false, innerErr
+		}
+		if _, innerErr := proxy.clientConnection.Write(errorMessage); innerErr != nil {
+			logger.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorNetworkWrite).WithError(innerErr).Errorln("Can't send error to client")
+		}
+		return false, err
+	}
+	logger.WithField("client_id", string(proxy.clientID)).Debugln("Injected database credentials into startup message")
+	return false, nil
+}
+
+// exportSessionIdentity sets startup parameter of the database session to identity of client, connections of clients
+// which identity is unknown are rejected
+func (proxy *PgProxy) exportSessionIdentity(packet *PacketHandler, logger *log.Entry) error {
+	identity, err := proxy.sessionIdentity.Value(proxy.clientID, proxy.clientConnection)
+	if err == nil {
+		var data []byte
+		data, err = setStartupParameters(packet.descriptionBuf.Bytes(), []startupParameter{{name: proxy.sessionIdentityParameter, value: identity}})
+		if err == nil {
+			packet.ReplaceData(data)
+			logger.WithField("parameter", proxy.sessionIdentityParameter).WithField("identity", identity).Debugln("Exported client identity into startup message")
+			return nil
+		}
+	}
+	logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorSessionIdentityExport).
+		Errorln("Can't export client identity into database session")
+	errorMessage, innerErr := NewPgError("AcraServer can't identify client to the database")
+	if innerErr != nil {
+		return innerErr
+	}
+	if _, innerErr := proxy.clientConnection.Write(errorMessage); innerErr != nil {
+		logger.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorNetworkWrite).WithError(innerErr).Errorln("Can't send error to client")
+	}
+	return err
+}
+
+// handleDatabaseAuthentication answers authentication requests of the database with injected credentials and returns
+// true for AuthenticationOk which should be forwarded to client
+func (proxy *PgProxy) handleDatabaseAuthentication(packet *PacketHandler, logger *log.Entry) (bool, error) {
+	response, forward, err := proxy.credentialInjector.authenticate(packet.descriptionBuf.Bytes())
+	if err != nil {
+		logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorDatabaseCredentialsInjection).
+			Errorln("Can't authenticate to the database with injected credentials")
+		return false, err
+	}
+	if forward {
+		proxy.credentialInjector.track(proxy.dbConnection)
+		return true, nil
+	}
+	if response != nil {
+		proxy.dbConnection.SetWriteDeadline(time.Now().Add(network.DefaultNetworkTimeout))
+		n, err := proxy.dbConnection.Write(response)
+		if err := base.CheckReadWrite(n, len(response), err); err != nil {
+			logger.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorNetworkWrite).WithError(err).
+				Errorln("Can't send authentication response to the database")
+			return false, err
+		}
+	}
+	return false, nil
+}
+
 func (proxy *PgProxy) handleQueryDataPacket(ctx context.Context, packet *PacketHandler, logger *log.Entry) error {
 	logger.Debugln("Matched data row packet")
-	if err := packet.parseColumns(); err != nil {
+	var checkSize columnSizeCheck
+	if proxy.ciphertextSizeGuard != nil {
+		checkSize = func(index, length int) (bool, error) {
+			return proxy.ciphertextSizeGuard.CheckColumnSize(index, length, logger)
+		}
+	}
+	if err := packet.parseColumns(checkSize); err != nil {
+		if errors.Is(err, encryptor.ErrCiphertextTooLarge) {
+			// previous rows may be already sent, so row is replaced with fatal error and connection is closed
+			// 54000 - program_limit_exceeded
+			packet.replaceWithFatalError("54000", err.Error(), err)
+			return nil
+		}
 		logger.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCodingPostgresqlCantParseColumnsDescription).
 			WithError(err).Errorln("Can't parse columns in packet")
 		return err
@@ -676,9 +1084,11 @@ func (proxy *PgProxy) handleQueryDataPacket(ctx context.Context, packet *PacketH
 	}
 
 	logger.Debugf("Process columns data")
+	ctx, cancel := base.NewRequestContext(ctx)
+	defer cancel()
 	for i := 0; i < packet.columnCount; i++ {
 		column := packet.Columns[i]
-		if column.IsNull() {
+		if column.IsNull() || column.IsSkipped() {
 			continue
 		}
 		newData, err := proxy.onColumnDecryption(ctx, i, column.GetData())
@@ -695,6 +1105,48 @@ func (proxy *PgProxy) handleQueryDataPacket(ctx context.Context, packet *PacketH
 	return nil
 }
 
+func (proxy *PgProxy) handleReplicationDataPacket(packet *PacketHandler, logger *log.Entry) error {
+	if proxy.replicationProcessor == nil {
+		return nil
+	}
+	newData, err := proxy.replicationProcessor.ProcessCopyData(packet.descriptionBuf.Bytes())
+	if err != nil {
+		logger.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCodingPostgresqlUnexpectedPacket).
+			WithError(err).Errorln("Can't process logical replication message")
+		return err
+	}
+	packet.ReplaceData(newData)
+	return nil
+}
+
+func (proxy *PgProxy) handleErrorOrNoticePacket(packet *PacketHandler, logger *log.Entry) error {
+	if !proxy.errorMessagePolicy.StripsFields() {
+		return nil
+	}
+	newData, err := proxy.errorMessagePolicy.Filter(packet.descriptionBuf.Bytes())
+	if err != nil {
+		logger.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCodingPostgresqlUnexpectedPacket).
+			WithError(err).Errorln("Can't process error or notice of database")
+		return err
+	}
+	packet.ReplaceData(newData)
+	return nil
+}
+
+func (proxy *PgProxy) handleFunctionCallResponsePacket(packet *PacketHandler, logger *log.Entry) error {
+	if proxy.largeObjectProcessor == nil {
+		return nil
+	}
+	newData, err := proxy.largeObjectProcessor.ProcessFunctionCallResponse(packet.descriptionBuf.Bytes())
+	if err != nil {
+		logger.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorDecryptorCantDecryptBinary).
+			WithError(err).Errorln("Can't process large object function result")
+		return err
+	}
+	packet.ReplaceData(newData)
+	return nil
+}
+
 func (proxy *PgProxy) registerPreparedStatement(preparedStatement *ParsePacket, logger *log.Entry) error {
 	name := preparedStatement.Name()
 	queryText := preparedStatement.QueryString()
@@ -3,9 +3,18 @@ package postgresql
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"encoding/binary"
 	"encoding/hex"
-	"github.com/sirupsen/logrus"
+	"errors"
+	"io"
+	"net"
 	"testing"
+
+	"github.com/cossacklabs/acra/decryptor/base"
+	"github.com/cossacklabs/acra/encryptor"
+	"github.com/cossacklabs/acra/encryptor/config"
+	"github.com/sirupsen/logrus"
 )
 
 func TestDataRowLastEmptyColumn(t *testing.T) {
@@ -31,8 +40,116 @@ func TestDataRowLastEmptyColumn(t *testing.T) {
 		t.Fatal("Must be data row")
 	}
 
-	if err := packetHandler.parseColumns(); err != nil {
+	if err := packetHandler.parseColumns(nil); err != nil {
+		t.Fatal(err)
+	}
+
+}
+
+func TestNewPgError(t *testing.T) {
+	output, err := NewPgError("message")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []byte("E\x00\x00\x00\x1cSERROR\x00C42000\x00Mmessage\x00\x00")
+	if !bytes.Equal(output, expected) {
+		t.Fatalf("Expected %q, took %q", expected, output)
+	}
+	expected = []byte("E\x00\x00\x00\x29SFATAL\x00C53300\x00Mtoo many connections\x00\x00")
+	if output := NewPgTooManyConnectionsError(); !bytes.Equal(output, expected) {
+		t.Fatalf("Expected %q, took %q", expected, output)
+	}
+}
+
+func TestProxyDatabaseConnectionPipeline(t *testing.T) {
+	policy, err := NewErrorMessagePolicy(ErrorFieldsSource)
+	if err != nil {
 		t.Fatal(err)
 	}
+	makePacket := func(messageType byte, body []byte) []byte {
+		packet := []byte{messageType, 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(packet[1:], uint32(len(body)+4))
+		return append(packet, body...)
+	}
+	input := &bytes.Buffer{}
+	expected := &bytes.Buffer{}
+	for i := 0; i < 20; i++ {
+		input.Write(makePacket(NoticeResponseMessageType, errorFields("S", "NOTICE", "M", "notice", "F", "parse_utilcmd.c")))
+		expected.Write(makePacket(NoticeResponseMessageType, errorFields("S", "NOTICE", "M", "notice")))
+		input.Write(makePacket(ReadyForQueryMessageType, []byte{'I'}))
+		expected.Write(makePacket(ReadyForQueryMessageType, []byte{'I'}))
+	}
+	clientConnection, _ := net.Pipe()
+	defer clientConnection.Close()
+	proxy := &PgProxy{protocolState: NewPgProtocolState(), errorMessagePolicy: policy, pipelineQueueSize: 2,
+		clientConnection: clientConnection, maxPacketSize: base.DefaultMaxPacketSize}
+	output := &bytes.Buffer{}
+	labels := []string{base.DecryptionDBPostgresql, base.DecryptionModeWhole}
+	err = proxy.proxyDatabaseConnectionPipeline(context.Background(), input, bufio.NewWriter(output), labels, logrus.NewEntry(logrus.StandardLogger()))
+	if err != io.EOF {
+		t.Fatalf("Expected io.EOF, took %v", err)
+	}
+	if !bytes.Equal(output.Bytes(), expected.Bytes()) {
+		t.Fatalf("Expected %q, took %q", expected.Bytes(), output.Bytes())
+	}
+}
 
+func TestDataRowCiphertextSize(t *testing.T) {
+	schemaStore, err := config.MapTableSchemaStoreFromConfig([]byte(`
+schemas:
+  - table: users
+    columns: ["email", "id"]
+    encrypted:
+      - column: email
+        max_ciphertext_size: 8
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	queryEncryptor, err := encryptor.NewPostgresqlQueryEncryptor(schemaStore, []byte("client"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := queryEncryptor.OnQuery(base.NewOnQueryObjectFromQuery("select email, id from users")); err != nil {
+		t.Fatal(err)
+	}
+	// email with escaped 9 bytes which isn't decoded when skipped and null id
+	row := []byte{DataRowMessageType, 0, 0, 0, 4 + 2 + 4 + 9 + 4, 0, 2, 0, 0, 0, 9}
+	row = append(row, `\001aaaaa`...)
+	row = append(row, 0xff, 0xff, 0xff, 0xff)
+	logger := logrus.NewEntry(logrus.StandardLogger())
+	for _, action := range []encryptor.CiphertextSizeAction{encryptor.CiphertextSizeActionPass, encryptor.CiphertextSizeActionError} {
+		guard, err := encryptor.NewCiphertextSizeGuard(queryEncryptor, action)
+		if err != nil {
+			t.Fatal(err)
+		}
+		proxy := &PgProxy{decryptor: NewPgDecryptor([]byte("client"), NewPgHexDecryptor(), false, nil),
+			decryptionObserver: base.NewColumnDecryptionObserver(), ciphertextSizeGuard: guard}
+		packet, err := NewDbSidePacketHandler(bytes.NewReader(row), bufio.NewWriter(&bytes.Buffer{}), logger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := packet.ReadPacket(); err != nil {
+			t.Fatal(err)
+		}
+		if err := proxy.handleQueryDataPacket(context.Background(), packet, logger); err != nil {
+			t.Fatal(err)
+		}
+		output, err := packet.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if action == encryptor.CiphertextSizeActionPass {
+			if !packet.Columns[0].IsSkipped() || len(packet.Columns[0].GetData()) != 9 || !bytes.Equal(output, row) || packet.closeConnectionError() != nil {
+				t.Fatalf("Expected data row returned as is, took %q", output)
+			}
+			continue
+		}
+		if !errors.Is(packet.closeConnectionError(), encryptor.ErrCiphertextTooLarge) {
+			t.Fatalf("Expected connection closed with ErrCiphertextTooLarge, took %v", packet.closeConnectionError())
+		}
+		if !bytes.HasPrefix(output, []byte("E")) || !bytes.Contains(output, []byte("SFATAL\x00C54000\x00M"+packet.closeConnectionError().Error())) {
+			t.Fatalf("Expected fatal error instead of data row, took %q", output)
+		}
+	}
 }
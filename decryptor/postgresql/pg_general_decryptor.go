@@ -42,6 +42,7 @@ var errPlainData = errors.New("plain data without AcraStruct signature")
 type PgDecryptor struct {
 	isWithZone         bool
 	isWholeMatch       bool
+	isInlineFallback   bool
 	keyStore           keystore.DecryptionKeyStore
 	zoneMatcher        *zone.Matcher
 	binaryDecryptor    base.DataDecryptor
@@ -446,13 +447,15 @@ func (decryptor *PgDecryptor) ID() string {
 
 // OnColumn handler which process column data on db response and try to decrypt/detect poison record
 func (decryptor *PgDecryptor) OnColumn(ctx context.Context, data []byte) (context.Context, []byte, error) {
-	logger := logging.GetLoggerFromContext(ctx)
+	logger := logging.NewLogger(logging.GetLoggerFromContext(ctx))
 	span := trace.FromContext(ctx)
 	// try to skip small piece of data that can't be valuable for us
 	// in zonemode skip data which less then zoneid length
 	// without zonemode check that data has length more than min AcraStruct length
 	if (decryptor.IsWithZone() && len(data) < zone.ZoneIDBlockLength) || (!decryptor.IsWithZone() && len(data) < base.GetMinAcraStructLength()) {
-		logger.WithFields(log.Fields{"lest": len(data) < zone.ZoneIDBlockLength, "zone_length": zone.ZoneIDBlockLength, "length": len(data), "with_zone": decryptor.IsWithZone()}).Debugln("Skip decryption because length of block too small for ZoneId or AcraStruct")
+		if logger.DebugEnabled() {
+			logger.WithFields(log.Fields{"lest": len(data) < zone.ZoneIDBlockLength, "zone_length": zone.ZoneIDBlockLength, "length": len(data), "with_zone": decryptor.IsWithZone()}).Debugln("Skip decryption because length of block too small for ZoneId or AcraStruct")
+		}
 		return ctx, data, nil
 	}
 	decryptor.Reset()
@@ -467,10 +470,10 @@ func (decryptor *PgDecryptor) OnColumn(ctx context.Context, data []byte) (contex
 		var err error
 		if decryptor.IsWholeMatch() {
 			// check that it's not poison record
-			err = checkWholePoisonRecord(data, decryptor, logger)
+			err = checkWholePoisonRecord(data, decryptor, logger.Entry())
 		} else {
 			// check that it's not poison record
-			err = checkInlinePoisonRecordInBlock(data, decryptor, logger)
+			err = checkInlinePoisonRecordInBlock(data, decryptor, logger.Entry())
 		}
 		if err != nil {
 			logger.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorDecryptorCantCheckPoisonRecord).WithError(err).Errorln("Can't check poison record in block")
@@ -480,11 +483,14 @@ func (decryptor *PgDecryptor) OnColumn(ctx context.Context, data []byte) (contex
 
 	// create temporary logger to log related zone_id in flow of decryption
 	// client_id set on higher level on start of processing connection
-	decryptionLogger := logger.WithField("zone_id", string(decryptor.GetMatchedZoneID()))
+	decryptionLogger := logger
+	if decryptor.IsWithZone() {
+		decryptionLogger = logger.WithField("zone_id", string(decryptor.GetMatchedZoneID()))
+	}
 	var newData []byte
 	var err error
 	if decryptor.IsWholeMatch() {
-		newData, err = decryptor.processWholeBlockDecryption(ctx, data, decryptionLogger)
+		ctx, newData, err = decryptor.processWholeBlockDecryption(ctx, data, decryptionLogger)
 		if err != nil {
 			decryptionLogger.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorDecryptorCantDecryptBinary).WithError(err).Errorln("Can't process whole block")
 			return ctx, nil, err
@@ -508,35 +514,51 @@ func (decryptor *PgDecryptor) OnColumn(ctx context.Context, data []byte) (contex
 	return ctx, newData, nil
 }
 
-// processWholeBlockDecryption try to decrypt data of column as whole AcraStruct and replace with decrypted data on success
-func (decryptor *PgDecryptor) processWholeBlockDecryption(ctx context.Context, data []byte, logger *log.Entry) ([]byte, error) {
+// processWholeBlockDecryption try to decrypt data of column as whole AcraStruct and replace with decrypted data on
+// success. Returned context marks decrypted data for next subscribers.
+func (decryptor *PgDecryptor) processWholeBlockDecryption(ctx context.Context, data []byte, logger logging.Logger) (context.Context, []byte, error) {
 	span := trace.FromContext(ctx)
 	decryptor.Reset()
 	// TODO here we replace context with correct logger with new passed from caller
 	decryptor.dataProcessorContext.UseContext(ctx)
 	decrypted, err := decryptor.DecryptBlock(data)
 	if err == errPlainData {
+		// it's not AcraStruct, but may contain AcraStructs if it's computed from encrypted columns, e.g. in views or
+		// expressions, so use content-based search of AcraStructs like in inline mode
+		if decryptor.isInlineFallback {
+			logger.Debugln("Search AcraStructs inside value in inline fallback mode")
+			newData, err := decryptor.processInlineBlockDecryption(ctx, data, logger)
+			return ctx, newData, err
+		}
 		// it's not AcraStruct
-		return data, nil
+		return ctx, data, nil
 	}
 	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			// request was cancelled or timed out, it isn't failure of decryption
+			return ctx, nil, ctxErr
+		}
 		span.AddAttributes(trace.BoolAttribute("failed_decryption", true))
 		// check poison records on failed decryption
 		logger.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorDecryptorCantDecryptBinary).WithError(err).Warningln("Can't decrypt AcraStruct: can't unwrap symmetric key")
 		base.AcrastructDecryptionCounter.WithLabelValues(base.DecryptionTypeFail).Inc()
 		if decryptor.IsPoisonRecordCheckOn() {
 			decryptor.Reset()
-			if err := checkWholePoisonRecord(data, decryptor, logger); err != nil {
-				return nil, err
+			if err := checkWholePoisonRecord(data, decryptor, logger.Entry()); err != nil {
+				return ctx, nil, err
 			}
 		}
-		return data, nil
+		return ctx, data, nil
 	}
 	base.AcrastructDecryptionCounter.WithLabelValues(base.DecryptionTypeSuccess).Inc()
-	return decrypted, nil
+	ctx = base.NewContextWithDecryptedAcraStruct(ctx, data, decryptor.GetMatchedZoneID())
+	if created := decryptor.dataProcessorContext.CreatedAt; !created.IsZero() {
+		ctx = base.NewContextWithAcraStructCreationTime(ctx, created)
+	}
+	return ctx, decrypted, nil
 }
 
-func (decryptor *PgDecryptor) processInlineBlockDecryption(ctx context.Context, data []byte, logger *log.Entry) ([]byte, error) {
+func (decryptor *PgDecryptor) processInlineBlockDecryption(ctx context.Context, data []byte, logger logging.Logger) ([]byte, error) {
 	span := trace.FromContext(ctx)
 	// inline mode
 	currentIndex := 0
@@ -564,11 +586,14 @@ func (decryptor *PgDecryptor) processInlineBlockDecryption(ctx context.Context,
 				decryptor.dataProcessorContext.UseContext(ctx)
 				decryptedData, err := decryptor.DecryptBlock(data[currentIndex:endIndex])
 				if err != nil {
+					if ctxErr := ctx.Err(); ctxErr != nil {
+						return nil, ctxErr
+					}
 					if decryptor.IsPoisonRecordCheckOn() {
 						logger.Infoln("Check poison records")
 						blockReader := bytes.NewReader(data[currentIndex:endIndex])
 						poisoned, err := decryptor.CheckPoisonRecord(blockReader)
-						if err = handlePoisonCheckResult(decryptor, poisoned, err, logger); err != nil {
+						if err = handlePoisonCheckResult(decryptor, poisoned, err, logger.Entry()); err != nil {
 							return nil, err
 						}
 					}
@@ -594,7 +619,9 @@ func (decryptor *PgDecryptor) processInlineBlockDecryption(ctx context.Context,
 		continue
 	}
 	if hasDecryptedData {
-		logger.WithFields(log.Fields{"old_size": len(data), "new_size": outputBlock.Len()}).Debugln("Result was changed")
+		if logger.DebugEnabled() {
+			logger.WithFields(log.Fields{"old_size": len(data), "new_size": outputBlock.Len()}).Debugln("Result was changed")
+		}
 		if os.Getenv("ZONE_FOR_ROW") != "on" {
 			decryptor.ResetZoneMatch()
 		}
@@ -0,0 +1,74 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package postgresql
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	acrawriter "github.com/cossacklabs/acra/acra-writer"
+	"github.com/cossacklabs/acra/decryptor/base"
+	"github.com/cossacklabs/themis/gothemis/keys"
+)
+
+func TestPgDecryptorInlineFallback(t *testing.T) {
+	clientID := []byte("client")
+	keypair, err := keys.New(keys.TypeEC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keystore := &replicationTestKeystore{keypairs: map[string]*keys.Keypair{string(clientID): keypair}}
+	acraStruct, err := acrawriter.CreateAcrastruct([]byte("user@example.com"), keypair.Public, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// value of expression computed from encrypted column, e.g. in view or CTE
+	computedValue := append(append([]byte(`{"email": "`), acraStruct...), []byte(`"}`)...)
+	expectedValue := []byte(`{"email": "user@example.com"}`)
+
+	for _, inlineFallback := range []bool{false, true} {
+		setting := base.NewDecryptorSetting(false, true, false, base.NewPoisonCallbackStorage(), keystore)
+		setting.SetInlineFallback(inlineFallback)
+		decryptor, err := NewDecryptorFactory(setting).New(clientID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decryptor.SetDataProcessor(base.DecryptProcessor{})
+		subscriber := decryptor.(base.DecryptionSubscriber)
+
+		// whole AcraStruct is decrypted in any case
+		_, data, err := subscriber.OnColumn(context.Background(), acraStruct)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, []byte("user@example.com")) {
+			t.Fatalf("AcraStruct wasn't decrypted with inline fallback %t", inlineFallback)
+		}
+
+		_, data, err = subscriber.OnColumn(context.Background(), computedValue)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if inlineFallback && !bytes.Equal(data, expectedValue) {
+			t.Fatalf("AcraStruct inside value wasn't decrypted with inline fallback, took %q", data)
+		}
+		if !inlineFallback && !bytes.Equal(data, computedValue) {
+			t.Fatal("Value with inner AcraStruct was changed without inline fallback")
+		}
+	}
+}
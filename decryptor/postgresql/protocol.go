@@ -28,6 +28,10 @@ type PgProtocolState struct {
 	pendingParse   *ParsePacket
 	pendingBind    *BindPacket
 	pendingExecute *ExecutePacket
+	// database streams replication data in CopyData messages
+	replicationMode bool
+	// transaction status from the last ReadyForQuery message
+	transactionStatus byte
 }
 
 // PacketType describes how to handle a message packet.
@@ -41,12 +45,16 @@ const (
 	BindStatementPacket
 	BindCompletePacket
 	DataPacket
+	ReplicationDataPacket
+	FunctionCallPacket
+	FunctionCallResponsePacket
+	ErrorOrNoticePacket
 	OtherPacket
 )
 
 // NewPgProtocolState makes an initial PostgreSQL state, awaiting for queries.
 func NewPgProtocolState() *PgProtocolState {
-	return &PgProtocolState{lastPacketType: OtherPacket}
+	return &PgProtocolState{lastPacketType: OtherPacket, transactionStatus: 'I'}
 }
 
 // LastPacketType returns type of the last seen packet.
@@ -54,6 +62,16 @@ func (p *PgProtocolState) LastPacketType() PacketType {
 	return p.lastPacketType
 }
 
+// TransactionStatus returns transaction status indicator of the last ReadyForQuery message.
+func (p *PgProtocolState) TransactionStatus() byte {
+	return p.transactionStatus
+}
+
+// InTransaction returns true if the last ReadyForQuery message reported open or failed transaction block.
+func (p *PgProtocolState) InTransaction() bool {
+	return p.transactionStatus == 'T' || p.transactionStatus == 'E'
+}
+
 // PendingQuery returns a query object pending response from the database.
 func (p *PgProtocolState) PendingQuery() base.OnQueryObject {
 	return p.pendingQuery
@@ -133,6 +151,12 @@ func (p *PgProtocolState) HandleClientPacket(packet *PacketHandler) error {
 		p.pendingExecute = executePacket
 	}
 
+	// FunctionCall packets call server-side functions directly, drivers use them to work with large objects.
+	if packet.IsFunctionCall() {
+		p.lastPacketType = FunctionCallPacket
+		return nil
+	}
+
 	// We are not interested in other packets, just pass them through.
 	p.lastPacketType = OtherPacket
 	return nil
@@ -157,10 +181,36 @@ func (p *PgProtocolState) HandleDatabasePacket(packet *PacketHandler) error {
 		return nil
 	}
 
+	// CopyBothResponse is sent in response to START_REPLICATION, after that data changes are streamed in CopyData.
+	if packet.IsCopyBothResponse() {
+		p.replicationMode = true
+		p.lastPacketType = OtherPacket
+		return nil
+	}
+
+	if packet.IsFunctionCallResponse() {
+		p.lastPacketType = FunctionCallResponsePacket
+		return nil
+	}
+
+	if packet.IsErrorOrNotice() {
+		p.lastPacketType = ErrorOrNoticePacket
+		return nil
+	}
+
+	if packet.IsCopyData() && p.replicationMode {
+		p.lastPacketType = ReplicationDataPacket
+		return nil
+	}
+
 	// ReadyForQuery starts a new query processing. Forget pending queries.
 	// There is nothing interesting in the packet otherwise.
 	if packet.IsReadyForQuery() {
 		p.forgetQueryState()
+		p.replicationMode = false
+		if data := packet.descriptionBuf.Bytes(); len(data) == 1 {
+			p.transactionStatus = data[0]
+		}
 		p.lastPacketType = OtherPacket
 		return nil
 	}
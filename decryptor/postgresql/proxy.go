@@ -21,16 +21,98 @@ import (
 
 	"github.com/cossacklabs/acra/decryptor/base"
 	"github.com/cossacklabs/acra/encryptor"
+	"github.com/cossacklabs/acra/featureflags"
+	"github.com/cossacklabs/acra/logging"
 )
 
 type proxyFactory struct {
 	setting base.ProxySetting
+	options ProxyFactoryOptions
 }
 
+// ProxyFactoryOptions configures optional processing of PostgreSQL connections
+type ProxyFactoryOptions struct {
+	// ReplicationPolicy describes processing of logical replication streams, they are passed as is if nil
+	ReplicationPolicy *ReplicationPolicy
+	// LargeObjectChunkSize enables encryption of large objects in chunks of this size if greater than zero
+	LargeObjectChunkSize int
+	// ShadowWriter duplicates write queries to shadow database if not nil
+	ShadowWriter base.QueryObserver
+	// ContextConfusionAction enables checks that AcraStructs are decrypted with context of their columns from
+	// encryptor config if set to flag or block
+	ContextConfusionAction encryptor.ContextConfusionAction
+	// MaxAgeAction enables checks of age of AcraStructs of columns with max_age in encryptor config if set to flag
+	// or block
+	MaxAgeAction encryptor.MaxAgeAction
+	// CiphertextSizeAction defines handling of encrypted values larger than max_ciphertext_size of their columns in
+	// encryptor config, encryptor.CiphertextSizeActionError if empty
+	CiphertextSizeAction encryptor.CiphertextSizeAction
+	// DecryptionSchedule masks decrypted values outside of allowed time windows if not nil
+	DecryptionSchedule *encryptor.DecryptionSchedulePolicy
+	// DecryptionPurpose masks decrypted values of columns which purpose of session doesn't allow if not nil
+	DecryptionPurpose *encryptor.DecryptionPurposePolicy
+	// TenantIsolation scopes queries of tenant clients to rows of their tenants if not nil
+	TenantIsolation *encryptor.TenantIsolationPolicy
+	// AccessHeatmap aggregates decryptions of encrypted columns per client if not nil, requires encryptor config
+	AccessHeatmap *encryptor.AccessHeatmap
+	// MaxPacketSize limits length of packets from client and database, base.DefaultMaxPacketSize if zero
+	MaxPacketSize int
+	// ErrorMessagePolicy strips fields of database errors and notices forwarded to clients, they are passed as is
+	// if nil
+	ErrorMessagePolicy *ErrorMessagePolicy
+	// CredentialStore enables injection of database credentials of client IDs into connections to the database, client
+	// credentials are passed as is if nil
+	CredentialStore *CredentialStore
+	// ClientIDVerified is true if client IDs passed to New are authenticated by transport (Secure Session or
+	// certificates of TLS transport). Otherwise credentials are injected only into connections which client ID is
+	// taken from TLS certificate after SSLRequest, other connections are rejected.
+	ClientIDVerified bool
+	// PipelineQueueSize enables processing of packets in stages of pipeline with queues of this size if greater than
+	// zero, packets are processed one by one otherwise
+	PipelineQueueSize int
+	// SessionIdentity exports identity of client into startup parameter SessionIdentityParameter of connections to
+	// the database if not nil
+	SessionIdentity          *base.SessionIdentity
+	SessionIdentityParameter string
+	// IdleInTransaction alerts about or terminates sessions idle in transaction longer than its timeout if not nil
+	IdleInTransaction *base.IdleInTransactionPolicy
+	// FeatureFlags gate new behaviors per session, they use default behavior if nil
+	FeatureFlags *featureflags.Flags
+}
+
+// DefaultSessionIdentityParameter is startup parameter with identity of client, shown in pg_stat_activity and logs
+const DefaultSessionIdentityParameter = "application_name"
+
 // NewProxyFactory return new proxyFactory
 func NewProxyFactory(proxySetting base.ProxySetting) (base.ProxyFactory, error) {
+	return NewProxyFactoryWithOptions(proxySetting, ProxyFactoryOptions{})
+}
+
+// NewProxyFactoryWithReplicationPolicy return new proxyFactory which processes logical replication streams
+// according to replicationPolicy. Replication streams are passed as is if replicationPolicy is nil.
+func NewProxyFactoryWithReplicationPolicy(proxySetting base.ProxySetting, replicationPolicy *ReplicationPolicy) (base.ProxyFactory, error) {
+	return NewProxyFactoryWithOptions(proxySetting, ProxyFactoryOptions{ReplicationPolicy: replicationPolicy})
+}
+
+// NewProxyFactoryWithOptions return new proxyFactory with optional processing configured by options
+func NewProxyFactoryWithOptions(proxySetting base.ProxySetting, options ProxyFactoryOptions) (base.ProxyFactory, error) {
+	if options.LargeObjectChunkSize < 0 {
+		return nil, ErrInvalidLargeObjectChunkSize
+	}
+	if options.MaxPacketSize != 0 {
+		if err := base.ValidateMaxPacketSize(options.MaxPacketSize); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := encryptor.ParseCiphertextSizeAction(string(options.CiphertextSizeAction)); err != nil {
+		return nil, err
+	}
+	if options.PipelineQueueSize < 0 {
+		return nil, base.ErrInvalidPipelineQueueSize
+	}
 	return &proxyFactory{
 		setting: proxySetting,
+		options: options,
 	}, nil
 }
 
@@ -45,23 +127,116 @@ func (factory *proxyFactory) New(clientID []byte, clientSession base.ClientSessi
 	if err != nil {
 		return nil, err
 	}
+	if factory.options.MaxPacketSize > 0 {
+		proxy.maxPacketSize = factory.options.MaxPacketSize
+	}
+	proxy.errorMessagePolicy = factory.options.ErrorMessagePolicy
+	proxy.pipelineQueueSize = factory.options.PipelineQueueSize
+	proxy.clientID = clientID
+	proxy.clientIDVerified = factory.options.ClientIDVerified
+	if factory.options.CredentialStore != nil {
+		proxy.credentialInjector = newCredentialInjector(factory.options.CredentialStore)
+	}
+	if factory.options.SessionIdentity != nil {
+		proxy.sessionIdentity = factory.options.SessionIdentity
+		proxy.sessionIdentityParameter = factory.options.SessionIdentityParameter
+		if proxy.sessionIdentityParameter == "" {
+			proxy.sessionIdentityParameter = DefaultSessionIdentityParameter
+		}
+	}
+	logger := logging.GetLoggerFromContext(clientSession.Context())
+	if factory.options.IdleInTransaction != nil {
+		proxy.idleWatchdog = base.NewIdleInTransactionWatchdog(factory.options.IdleInTransaction.ForSession(factory.options.FeatureFlags, clientID), clientSession, logger)
+	}
+	if factory.options.ReplicationPolicy != nil {
+		proxy.replicationProcessor = NewLogicalReplicationProcessor(factory.options.ReplicationPolicy, clientID, factory.setting.KeyStore(), logger)
+	}
+	if factory.options.LargeObjectChunkSize > 0 {
+		proxy.largeObjectProcessor, err = NewLargeObjectProcessor(clientID, factory.setting.KeyStore(), factory.options.LargeObjectChunkSize, logger)
+		if err != nil {
+			return nil, err
+		}
+	}
 
+	var queryEncryptor *encryptor.QueryDataEncryptor
 	if !factory.setting.TableSchemaStore().IsEmpty() {
-		dataEncryptor, err := encryptor.NewAcrawriterDataEncryptor(factory.setting.KeyStore())
+		acrawriterEncryptor, err := encryptor.NewAcrawriterDataEncryptor(factory.setting.KeyStore())
 		if err != nil {
 			return nil, err
 		}
-		queryEncryptor, err := encryptor.NewPostgresqlQueryEncryptor(factory.setting.TableSchemaStore(), clientID, dataEncryptor)
+		dataEncryptor, err := encryptor.NewFormatPreservingDataEncryptor(factory.setting.KeyStore(), acrawriterEncryptor)
 		if err != nil {
 			return nil, err
 		}
+		queryEncryptor, err = encryptor.NewPostgresqlQueryEncryptor(factory.setting.TableSchemaStore(), clientID, dataEncryptor)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var purposeGuard *encryptor.DecryptionPurposeGuard
+	if factory.options.DecryptionPurpose != nil {
+		purposeGuard = encryptor.NewDecryptionPurposeGuard(factory.options.DecryptionPurpose, queryEncryptor, clientID, logger)
+		// added first to read signed comments before queries are changed by other observers
+		proxy.AddQueryObserver(purposeGuard)
+		proxy.purposeGuard = purposeGuard
+	}
+	if factory.options.TenantIsolation != nil {
+		tenantRewriter := encryptor.NewTenantIsolationRewriter(factory.options.TenantIsolation, clientID, logger)
+		// added before encryptor, so queries of tenants are processed with their predicates
+		proxy.AddQueryObserver(tenantRewriter)
+		proxy.tenantRewriter = tenantRewriter
+	}
+	if queryEncryptor != nil {
 		proxy.AddQueryObserver(queryEncryptor)
 	}
+	// registered last to duplicate queries in the same form as they are sent to the database
+	if factory.options.ShadowWriter != nil {
+		proxy.AddQueryObserver(factory.options.ShadowWriter)
+	}
 	notifier, ok := decryptor.(base.DecryptionSubscriber)
 	if !ok {
 		return nil, errors.New("decryptor doesn't implement DecryptionSubscriber interface")
 	}
+	// lengths of values are checked before they are read to not decrypt oversized values
+	if queryEncryptor != nil {
+		proxy.ciphertextSizeGuard, err = encryptor.NewCiphertextSizeGuard(queryEncryptor, factory.options.CiphertextSizeAction)
+		if err != nil {
+			return nil, err
+		}
+	}
 	proxy.SubscribeOnAllColumnsDecryption(notifier)
+	// values of format-preserving encrypted columns and values with embedded AcraStructs aren't whole AcraStructs and
+	// are decrypted before checks of other values
+	if queryEncryptor != nil {
+		proxy.SubscribeOnAllColumnsDecryption(encryptor.NewFormatPreservingDecryptor(queryEncryptor, factory.setting.KeyStore(), clientID))
+		proxy.SubscribeOnAllColumnsDecryption(encryptor.NewEmbeddedAcraStructDecryptor(queryEncryptor, factory.setting.KeyStore(), clientID))
+	}
+	// subscribed after decryptor to check decrypted values
+	if queryEncryptor != nil && factory.options.ContextConfusionAction.Enabled() {
+		guard, err := encryptor.NewContextConfusionGuard(queryEncryptor, clientID, factory.options.ContextConfusionAction)
+		if err != nil {
+			return nil, err
+		}
+		proxy.SubscribeOnAllColumnsDecryption(guard)
+	}
+	if queryEncryptor != nil && factory.options.MaxAgeAction.Enabled() {
+		guard, err := encryptor.NewMaxAgeGuard(queryEncryptor, factory.options.MaxAgeAction)
+		if err != nil {
+			return nil, err
+		}
+		proxy.SubscribeOnAllColumnsDecryption(guard)
+	}
+	// subscribed before schedule guard to count decryptions of values which are returned masked too
+	if queryEncryptor != nil && factory.options.AccessHeatmap != nil {
+		proxy.SubscribeOnAllColumnsDecryption(encryptor.NewAccessHeatmapRecorder(factory.options.AccessHeatmap, queryEncryptor, clientID))
+	}
+	if purposeGuard != nil {
+		proxy.SubscribeOnAllColumnsDecryption(purposeGuard)
+	}
+	// subscribed last to mask values which passed all other checks
+	if factory.options.DecryptionSchedule != nil {
+		proxy.SubscribeOnAllColumnsDecryption(encryptor.NewDecryptionScheduleGuard(factory.options.DecryptionSchedule, queryEncryptor, clientID))
+	}
 
 	return proxy, nil
 }
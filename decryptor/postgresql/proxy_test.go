@@ -176,6 +176,14 @@ func (store *tableSchemaStore) IsEmpty() bool {
 	return store.empty
 }
 
+func (*tableSchemaStore) IsStrict() bool {
+	return false
+}
+
+func (*tableSchemaStore) EncryptedColumns() map[string][]string {
+	return nil
+}
+
 type stubSession struct{}
 
 func (stubSession) Context() context.Context {
@@ -134,10 +134,16 @@ func NewParsePacket(data []byte) (*ParsePacket, error) {
 	// convert to absolute
 	endIndex += startIndex + 1
 	query := data[startIndex:endIndex]
+	if len(data) < endIndex+2 {
+		return nil, ErrPacketTruncated
+	}
 	numParams := paramsNum(data[endIndex : endIndex+2])
 	endIndex += 2
 	var params []objectID
 	if endIndex < len(data) {
+		if len(data) < endIndex+4*numParams.ToInt() {
+			return nil, ErrPacketTruncated
+		}
 		for i := 0; i < numParams.ToInt(); i++ {
 			params = append(params, data[endIndex:endIndex+4])
 			endIndex += 4
@@ -497,6 +503,12 @@ func writeParameterArray(buf *bytes.Buffer, parameters [][]byte) (int, error) {
 		if len(parameter) > math.MaxUint32 {
 			return 0, ErrArrayTooBig
 		}
+		// NULL value is a nil slice, it's written as -1 length without value bytes.
+		if parameter == nil {
+			binary.BigEndian.PutUint32(tmp[0:4], 0xFFFFFFFF)
+			buf.Write(tmp[0:4])
+			continue
+		}
 		binary.BigEndian.PutUint32(tmp[0:4], uint32(len(parameter)))
 		buf.Write(tmp[0:4])
 		buf.Write(parameter)
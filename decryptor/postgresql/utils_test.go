@@ -62,3 +62,31 @@ func TestParseCommand(t *testing.T) {
 		t.Fatal("parsed and marshaled data not equal")
 	}
 }
+
+func TestBindPacketNullParameters(t *testing.T) {
+	// unnamed portal and statement, text format of all parameters, parameters: NULL, empty value and "1"
+	bindData := []byte{0, 0, 0, 1, 0, 0, 0, 3, 0xFF, 0xFF, 0xFF, 0xFF, 0, 0, 0, 0, 0, 0, 0, 1, '1', 0, 0}
+	packet, err := NewBindPacket(bindData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values, err := packet.GetParameters()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values[0].Data() != nil {
+		t.Fatal("NULL parameter should have nil data")
+	}
+	if data := values[1].Data(); data == nil || len(data) != 0 {
+		t.Fatal("Empty parameter should have non-nil empty data")
+	}
+	packet.SetParameters(values)
+	output := &bytes.Buffer{}
+	n, err := packet.MarshalInto(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(bindData) || !bytes.Equal(output.Bytes(), bindData) {
+		t.Fatalf("Bind packet changed after parameters update: %v", output.Bytes())
+	}
+}
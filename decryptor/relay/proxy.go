@@ -0,0 +1,96 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package relay contains proxy which relays data of arbitrary protocol between client and service without parsing it.
+// AcraServer only terminates TLS of clients with its transport wrapper and originates TLS to the service, so services
+// which aren't databases are protected with the same verification of certificates (OCSP, CRL, pinning).
+package relay
+
+import (
+	"context"
+	"io"
+	"net"
+
+	"github.com/cossacklabs/acra/decryptor/base"
+	"github.com/cossacklabs/acra/logging"
+	log "github.com/sirupsen/logrus"
+)
+
+// ProxyFactory creates relay proxies for new client sessions
+type ProxyFactory struct {
+	tlsWrapper base.TLSConnectionWrapper
+}
+
+// NewProxyFactory returns factory of relay proxies. Connections to the service are wrapped with TLS by tlsWrapper,
+// plain connections are used if it's nil
+func NewProxyFactory(tlsWrapper base.TLSConnectionWrapper) *ProxyFactory {
+	return &ProxyFactory{tlsWrapper: tlsWrapper}
+}
+
+// New returns proxy which relays data of clientSession, connection to the service is wrapped with TLS right away
+func (factory *ProxyFactory) New(clientID []byte, clientSession base.ClientSession) (base.Proxy, error) {
+	ctx := clientSession.Context()
+	logger := logging.GetLoggerFromContext(ctx).WithField("proxy", "relay")
+	observerManager, err := base.NewArrayQueryObserverableManager(ctx)
+	if err != nil {
+		return nil, err
+	}
+	serviceConnection := clientSession.DatabaseConnection()
+	if factory.tlsWrapper != nil {
+		serviceConnection, err = factory.tlsWrapper.WrapDBConnection(ctx, serviceConnection)
+		if err != nil {
+			logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorDecryptorCantInitializeTLS).
+				Errorln("Can't initialize tls connection with service")
+			return nil, err
+		}
+	}
+	return &Proxy{
+		ArrayQueryObserverableManager: observerManager,
+		ctx:                           ctx,
+		clientConnection:              clientSession.ClientConnection(),
+		serviceConnection:             serviceConnection,
+		logger:                        logger.WithField("client_id", string(clientID)),
+	}, nil
+}
+
+// Proxy copies data between client and service as is. Queries aren't parsed, so observers are never called
+type Proxy struct {
+	*base.ArrayQueryObserverableManager
+	ctx               context.Context
+	clientConnection  net.Conn
+	serviceConnection net.Conn
+	logger            *log.Entry
+}
+
+// ProxyClientConnection relays data from client to service until one of connections is closed
+func (proxy *Proxy) ProxyClientConnection(errCh chan<- error) {
+	proxy.logger.Debugln("Relay client -> service")
+	errCh <- relay(proxy.serviceConnection, proxy.clientConnection)
+}
+
+// ProxyDatabaseConnection relays data from service to client until one of connections is closed
+func (proxy *Proxy) ProxyDatabaseConnection(errCh chan<- error) {
+	proxy.logger.Debugln("Relay service -> client")
+	errCh <- relay(proxy.clientConnection, proxy.serviceConnection)
+}
+
+// relay copies data from src to dst and returns io.EOF when src is closed
+func relay(dst io.Writer, src io.Reader) error {
+	if _, err := io.Copy(dst, src); err != nil {
+		return err
+	}
+	return io.EOF
+}
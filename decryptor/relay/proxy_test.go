@@ -0,0 +1,108 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package relay
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/cossacklabs/acra/decryptor/base"
+)
+
+type stubSession struct {
+	base.ClientSession
+	clientConnection, serviceConnection net.Conn
+}
+
+func (stubSession) Context() context.Context {
+	return context.TODO()
+}
+
+func (session stubSession) ClientConnection() net.Conn {
+	return session.clientConnection
+}
+
+func (session stubSession) DatabaseConnection() net.Conn {
+	return session.serviceConnection
+}
+
+// stubTLSWrapper returns connections to service as is or fails wrapping
+type stubTLSWrapper struct {
+	base.TLSConnectionWrapper
+	wrapped int
+	err     error
+}
+
+func (wrapper *stubTLSWrapper) WrapDBConnection(ctx context.Context, conn net.Conn) (net.Conn, error) {
+	wrapper.wrapped++
+	return conn, wrapper.err
+}
+
+func TestRelayProxy(t *testing.T) {
+	client, clientSide := net.Pipe()
+	service, serviceSide := net.Pipe()
+	defer client.Close()
+	defer service.Close()
+	wrapper := &stubTLSWrapper{}
+	proxy, err := NewProxyFactory(wrapper).New([]byte("client"), stubSession{clientConnection: clientSide, serviceConnection: serviceSide})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wrapper.wrapped != 1 {
+		t.Fatal("Connection to service wasn't wrapped with TLS")
+	}
+	clientErrCh := make(chan error, 1)
+	serviceErrCh := make(chan error, 1)
+	go proxy.ProxyClientConnection(clientErrCh)
+	go proxy.ProxyDatabaseConnection(serviceErrCh)
+
+	exchange := func(src, dst net.Conn, data string) {
+		go src.Write([]byte(data))
+		buf := make([]byte, len(data))
+		if _, err := io.ReadFull(dst, buf); err != nil {
+			t.Fatal(err)
+		}
+		if string(buf) != data {
+			t.Fatalf("Expected relayed %q, took %q", data, buf)
+		}
+	}
+	exchange(client, service, "arbitrary request")
+	exchange(service, client, "arbitrary response")
+
+	client.Close()
+	if err := <-clientErrCh; err != io.EOF {
+		t.Fatalf("Expected io.EOF after client closed connection, took %v", err)
+	}
+}
+
+func TestRelayProxyTLSError(t *testing.T) {
+	testErr := errors.New("handshake failed")
+	client, service := net.Pipe()
+	defer client.Close()
+	defer service.Close()
+	_, err := NewProxyFactory(&stubTLSWrapper{err: testErr}).New(nil, stubSession{clientConnection: client, serviceConnection: service})
+	if err != testErr {
+		t.Fatalf("Expected error of TLS handshake, took %v", err)
+	}
+	// without wrapper connection to service is used as is
+	if _, err := NewProxyFactory(nil).New(nil, stubSession{clientConnection: client, serviceConnection: service}); err != nil {
+		t.Fatal(err)
+	}
+}
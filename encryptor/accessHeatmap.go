@@ -0,0 +1,237 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package encryptor
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cossacklabs/acra/logging"
+	"github.com/sirupsen/logrus"
+)
+
+// Defaults of AccessHeatmap
+const (
+	DefaultAccessHeatmapBucketSize     = time.Hour
+	DefaultAccessHeatmapRetention      = time.Hour * 24 * 7
+	DefaultAccessHeatmapExportInterval = time.Minute * 5
+)
+
+// ErrInvalidAccessHeatmap returned for invalid bucket size or retention of AccessHeatmap
+var ErrInvalidAccessHeatmap = errors.New("bucket size and retention of access heatmap should be positive and retention should be not less than bucket size")
+
+// accessKey identifies counter of decryptions of column by client
+type accessKey struct {
+	clientID string
+	table    string
+	column   string
+}
+
+// AccessHeatmap aggregates count of decryptions of encrypted columns per client in time buckets. Buckets older than
+// retention are dropped. It is safe for concurrent use.
+type AccessHeatmap struct {
+	lock       sync.Mutex
+	bucketSize time.Duration
+	retention  time.Duration
+	// buckets maps unix time of bucket start to counters of this bucket
+	buckets map[int64]map[accessKey]uint64
+	// encryptedColumns maps table to encrypted columns from encryptor config, used to report unused columns
+	encryptedColumns map[string][]string
+	now              func() time.Time
+}
+
+// NewAccessHeatmap returns AccessHeatmap with buckets of bucketSize stored for retention period. encryptedColumns
+// are reported as unused if they weren't decrypted during retention period, may be nil.
+func NewAccessHeatmap(bucketSize, retention time.Duration, encryptedColumns map[string][]string) (*AccessHeatmap, error) {
+	if bucketSize <= 0 || retention < bucketSize {
+		return nil, ErrInvalidAccessHeatmap
+	}
+	return &AccessHeatmap{
+		bucketSize:       bucketSize,
+		retention:        retention,
+		buckets:          make(map[int64]map[accessKey]uint64),
+		encryptedColumns: encryptedColumns,
+		now:              time.Now,
+	}, nil
+}
+
+// Record increments count of decryptions of column by clientID in current bucket
+func (heatmap *AccessHeatmap) Record(clientID []byte, table, column string) {
+	now := heatmap.now()
+	start := now.Truncate(heatmap.bucketSize).Unix()
+	key := accessKey{clientID: string(clientID), table: table, column: column}
+	heatmap.lock.Lock()
+	defer heatmap.lock.Unlock()
+	bucket, ok := heatmap.buckets[start]
+	if !ok {
+		// old buckets are dropped only when new one is started, so it isn't done on every decryption
+		heatmap.dropExpired(now)
+		bucket = make(map[accessKey]uint64)
+		heatmap.buckets[start] = bucket
+	}
+	bucket[key]++
+}
+
+// dropExpired removes buckets which ended before retention period, should be called under lock
+func (heatmap *AccessHeatmap) dropExpired(now time.Time) {
+	oldest := now.Add(-heatmap.retention).Unix()
+	for start := range heatmap.buckets {
+		if start+int64(heatmap.bucketSize/time.Second) <= oldest {
+			delete(heatmap.buckets, start)
+		}
+	}
+}
+
+// AccessHeatmapCell is count of decryptions of column by client in one bucket
+type AccessHeatmapCell struct {
+	BucketStart time.Time `json:"bucket_start"`
+	ClientID    string    `json:"client_id"`
+	Table       string    `json:"table"`
+	Column      string    `json:"column"`
+	Count       uint64    `json:"count"`
+}
+
+// AccessHeatmapColumn is count of decryptions of column during retention period, total and per client
+type AccessHeatmapColumn struct {
+	Table   string            `json:"table"`
+	Column  string            `json:"column"`
+	Total   uint64            `json:"total"`
+	Clients map[string]uint64 `json:"clients"`
+}
+
+// AccessHeatmapSnapshot is aggregation of decryptions returned by AcraServer HTTP API and written to export file
+type AccessHeatmapSnapshot struct {
+	GeneratedAt       time.Time             `json:"generated_at"`
+	BucketSizeSeconds int64                 `json:"bucket_size_seconds"`
+	RetentionSeconds  int64                 `json:"retention_seconds"`
+	Cells             []AccessHeatmapCell   `json:"cells"`
+	Columns           []AccessHeatmapColumn `json:"columns"`
+	// UnusedColumns are encrypted columns from encryptor config which weren't decrypted during retention period
+	UnusedColumns []AccessHeatmapColumn `json:"unused_columns"`
+}
+
+// Snapshot returns current aggregation sorted by bucket start, table, column and client ID
+func (heatmap *AccessHeatmap) Snapshot() *AccessHeatmapSnapshot {
+	now := heatmap.now()
+	snapshot := &AccessHeatmapSnapshot{
+		GeneratedAt:       now.UTC(),
+		BucketSizeSeconds: int64(heatmap.bucketSize / time.Second),
+		RetentionSeconds:  int64(heatmap.retention / time.Second),
+		Cells:             []AccessHeatmapCell{},
+		Columns:           []AccessHeatmapColumn{},
+		UnusedColumns:     []AccessHeatmapColumn{},
+	}
+	columns := make(map[[2]string]*AccessHeatmapColumn)
+	heatmap.lock.Lock()
+	heatmap.dropExpired(now)
+	for start, bucket := range heatmap.buckets {
+		for key, count := range bucket {
+			snapshot.Cells = append(snapshot.Cells, AccessHeatmapCell{
+				BucketStart: time.Unix(start, 0).UTC(),
+				ClientID:    key.clientID,
+				Table:       key.table,
+				Column:      key.column,
+				Count:       count,
+			})
+			column, ok := columns[[2]string{key.table, key.column}]
+			if !ok {
+				column = &AccessHeatmapColumn{Table: key.table, Column: key.column, Clients: make(map[string]uint64)}
+				columns[[2]string{key.table, key.column}] = column
+			}
+			column.Total += count
+			column.Clients[key.clientID] += count
+		}
+	}
+	heatmap.lock.Unlock()
+
+	sort.Slice(snapshot.Cells, func(i, j int) bool {
+		left, right := snapshot.Cells[i], snapshot.Cells[j]
+		if !left.BucketStart.Equal(right.BucketStart) {
+			return left.BucketStart.Before(right.BucketStart)
+		}
+		if left.Table != right.Table {
+			return left.Table < right.Table
+		}
+		if left.Column != right.Column {
+			return left.Column < right.Column
+		}
+		return left.ClientID < right.ClientID
+	})
+	for _, column := range columns {
+		snapshot.Columns = append(snapshot.Columns, *column)
+	}
+	sortAccessHeatmapColumns(snapshot.Columns)
+	for table, tableColumns := range heatmap.encryptedColumns {
+		for _, name := range tableColumns {
+			if _, ok := columns[[2]string{table, name}]; !ok {
+				snapshot.UnusedColumns = append(snapshot.UnusedColumns, AccessHeatmapColumn{Table: table, Column: name, Clients: map[string]uint64{}})
+			}
+		}
+	}
+	sortAccessHeatmapColumns(snapshot.UnusedColumns)
+	return snapshot
+}
+
+func sortAccessHeatmapColumns(columns []AccessHeatmapColumn) {
+	sort.Slice(columns, func(i, j int) bool {
+		if columns[i].Table != columns[j].Table {
+			return columns[i].Table < columns[j].Table
+		}
+		return columns[i].Column < columns[j].Column
+	})
+}
+
+// ToJSON returns snapshot of heatmap encoded as JSON
+func (heatmap *AccessHeatmap) ToJSON() ([]byte, error) {
+	return json.Marshal(heatmap.Snapshot())
+}
+
+// Export writes snapshot to temporary file and renames it to path, so readers never see partially written file
+func (heatmap *AccessHeatmap) Export(path string) error {
+	data, err := heatmap.ToJSON()
+	if err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// RunExport exports snapshot to path every interval until ctx is done
+func (heatmap *AccessHeatmap) RunExport(ctx context.Context, path string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := heatmap.Export(path); err != nil {
+				logrus.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorAccessHeatmapExport).
+					WithField("path", path).Warningln("Can't export access heatmap")
+			}
+		}
+	}
+}
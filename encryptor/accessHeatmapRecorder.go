@@ -0,0 +1,63 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package encryptor
+
+import (
+	"context"
+
+	"github.com/cossacklabs/acra/decryptor/base"
+)
+
+// AccessHeatmapRecorder is DecryptionSubscriber which records decryptions of encrypted columns by client to
+// AccessHeatmap. Columns are matched with encryptor config by queryEncryptor and recorded with names from config, so
+// aliases of tables and columns are counted as the same column. It should be subscribed after decryptor.
+type AccessHeatmapRecorder struct {
+	heatmap        *AccessHeatmap
+	queryEncryptor *QueryDataEncryptor
+	clientID       []byte
+}
+
+// NewAccessHeatmapRecorder returns AccessHeatmapRecorder for connection of clientID
+func NewAccessHeatmapRecorder(heatmap *AccessHeatmap, queryEncryptor *QueryDataEncryptor, clientID []byte) *AccessHeatmapRecorder {
+	return &AccessHeatmapRecorder{heatmap: heatmap, queryEncryptor: queryEncryptor, clientID: clientID}
+}
+
+// ID returns name of this DecryptionSubscriber.
+func (recorder *AccessHeatmapRecorder) ID() string {
+	return "AccessHeatmapRecorder"
+}
+
+// OnColumn records decrypted AcraStructs of columns encrypted by config and returns data as is
+func (recorder *AccessHeatmapRecorder) OnColumn(ctx context.Context, data []byte) (context.Context, []byte, error) {
+	if _, _, ok := base.DecryptedAcraStructFromContext(ctx); !ok {
+		return ctx, data, nil
+	}
+	columnInfo, ok := base.ColumnInfoFromContext(ctx)
+	if !ok {
+		return ctx, data, nil
+	}
+	column := recorder.queryEncryptor.getSelectColumnSetting(columnInfo.Index())
+	if column == nil || column.setting == nil {
+		return ctx, data, nil
+	}
+	tableName := column.tableName
+	if schema := recorder.queryEncryptor.schemaStore.GetTableSchema(tableName); schema != nil {
+		tableName = schema.Name()
+	}
+	recorder.heatmap.Record(recorder.clientID, tableName, column.setting.ColumnName())
+	return ctx, data, nil
+}
@@ -0,0 +1,160 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package encryptor
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/cossacklabs/acra/decryptor/base"
+	"github.com/cossacklabs/acra/encryptor/config"
+	"github.com/cossacklabs/acra/sqlparser"
+	"github.com/cossacklabs/acra/sqlparser/dialect/mysql"
+)
+
+func TestAccessHeatmap(t *testing.T) {
+	for _, args := range [][2]time.Duration{{0, time.Hour}, {time.Hour, time.Minute}} {
+		if _, err := NewAccessHeatmap(args[0], args[1], nil); err != ErrInvalidAccessHeatmap {
+			t.Fatalf("Expected ErrInvalidAccessHeatmap for %v, took %v", args, err)
+		}
+	}
+	heatmap, err := NewAccessHeatmap(time.Hour, time.Hour*2, map[string][]string{"users": {"email", "ssn"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2020, 6, 1, 10, 30, 0, 0, time.UTC)
+	heatmap.now = func() time.Time { return now }
+	heatmap.Record([]byte("app"), "users", "email")
+	heatmap.Record([]byte("app"), "users", "email")
+	heatmap.Record([]byte("reporting"), "users", "email")
+	now = now.Add(time.Hour)
+	heatmap.Record([]byte("app"), "users", "email")
+
+	snapshot := heatmap.Snapshot()
+	firstBucket := time.Date(2020, 6, 1, 10, 0, 0, 0, time.UTC)
+	secondBucket := firstBucket.Add(time.Hour)
+	expectedCells := []AccessHeatmapCell{
+		{BucketStart: firstBucket, ClientID: "app", Table: "users", Column: "email", Count: 2},
+		{BucketStart: firstBucket, ClientID: "reporting", Table: "users", Column: "email", Count: 1},
+		{BucketStart: secondBucket, ClientID: "app", Table: "users", Column: "email", Count: 1},
+	}
+	if !reflect.DeepEqual(snapshot.Cells, expectedCells) {
+		t.Fatalf("Incorrect cells %v", snapshot.Cells)
+	}
+	expectedColumns := []AccessHeatmapColumn{{Table: "users", Column: "email", Total: 4, Clients: map[string]uint64{"app": 3, "reporting": 1}}}
+	if !reflect.DeepEqual(snapshot.Columns, expectedColumns) {
+		t.Fatalf("Incorrect columns %v", snapshot.Columns)
+	}
+	if len(snapshot.UnusedColumns) != 1 || snapshot.UnusedColumns[0].Column != "ssn" {
+		t.Fatalf("Incorrect unused columns %v", snapshot.UnusedColumns)
+	}
+	if snapshot.BucketSizeSeconds != 3600 || snapshot.RetentionSeconds != 7200 {
+		t.Fatal("Incorrect bucket size or retention")
+	}
+
+	// the first bucket ends before retention period
+	now = now.Add(time.Hour + time.Minute*30)
+	snapshot = heatmap.Snapshot()
+	if len(snapshot.Cells) != 1 || !snapshot.Cells[0].BucketStart.Equal(secondBucket) {
+		t.Fatalf("Expected only the second bucket, took %v", snapshot.Cells)
+	}
+	now = now.Add(time.Hour)
+	snapshot = heatmap.Snapshot()
+	if len(snapshot.Cells) != 0 || len(snapshot.Columns) != 0 || len(snapshot.UnusedColumns) != 2 {
+		t.Fatalf("Expected empty heatmap, took %v", snapshot)
+	}
+
+	dir, err := ioutil.TempDir("", "heatmap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "heatmap.json")
+	heatmap.Record([]byte("app"), "users", "ssn")
+	if err := heatmap.Export(path); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exported := &AccessHeatmapSnapshot{}
+	if err := json.Unmarshal(data, exported); err != nil {
+		t.Fatal(err)
+	}
+	if len(exported.Cells) != 1 || exported.Cells[0].Column != "ssn" || len(exported.UnusedColumns) != 1 {
+		t.Fatalf("Incorrect exported heatmap %s", data)
+	}
+}
+
+func TestAccessHeatmapRecorder(t *testing.T) {
+	sqlparser.SetDefaultDialect(mysql.NewMySQLDialect())
+	schemaStore, err := config.MapTableSchemaStoreFromConfig([]byte(`
+schemas:
+  - table: users
+    aliases: [customers]
+    columns: ["id", "email", "ssn"]
+    encrypted:
+      - column: email
+        aliases: [mail]
+      - column: ssn
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedColumns := map[string][]string{"users": {"email", "ssn"}}
+	if columns := schemaStore.EncryptedColumns(); !reflect.DeepEqual(columns, expectedColumns) {
+		t.Fatalf("Incorrect encrypted columns %v", columns)
+	}
+	heatmap, err := NewAccessHeatmap(time.Hour, time.Hour, expectedColumns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientID := []byte("app")
+	queryEncryptor, err := NewMysqlQueryEncryptor(schemaStore, clientID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// columns: plain id, email by alias of table and column, ssn from table without schema
+	query := "select id, mail, o.ssn from customers, orders as o"
+	if _, _, err := queryEncryptor.OnQuery(base.NewOnQueryObjectFromQuery(query)); err != nil {
+		t.Fatal(err)
+	}
+	recorder := NewAccessHeatmapRecorder(heatmap, queryEncryptor, clientID)
+	for column := 0; column < 3; column++ {
+		ctx := base.NewContextWithColumnInfo(context.Background(), base.NewColumnInfo(column, ""))
+		ctx = base.NewContextWithDecryptedAcraStruct(ctx, []byte("acrastruct"), nil)
+		if _, data, err := recorder.OnColumn(ctx, []byte("data")); err != nil || string(data) != "data" {
+			t.Fatalf("Unexpected result of column %d: %s %v", column, data, err)
+		}
+	}
+	// values which weren't decrypted aren't recorded
+	ctx := base.NewContextWithColumnInfo(context.Background(), base.NewColumnInfo(1, ""))
+	if _, _, err := recorder.OnColumn(ctx, []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	snapshot := heatmap.Snapshot()
+	if len(snapshot.Columns) != 1 || snapshot.Columns[0].Table != "users" || snapshot.Columns[0].Column != "email" || snapshot.Columns[0].Total != 1 {
+		t.Fatalf("Incorrect recorded columns %v", snapshot.Columns)
+	}
+}
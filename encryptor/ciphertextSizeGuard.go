@@ -0,0 +1,121 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package encryptor
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/cossacklabs/acra/logging"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+// CiphertextSizeAction defines how encrypted values larger than max_ciphertext_size of their column are handled
+type CiphertextSizeAction string
+
+// Supported values of CiphertextSizeAction
+const (
+	// CiphertextSizeActionError rejects database response with oversized value with error to client
+	CiphertextSizeActionError CiphertextSizeAction = "error"
+	// CiphertextSizeActionPass returns oversized values as is without decryption
+	CiphertextSizeActionPass CiphertextSizeAction = "pass"
+)
+
+// Errors returned on oversized encrypted values and their configuration
+var (
+	ErrInvalidCiphertextSizeAction = errors.New("invalid action on oversized encrypted values")
+	ErrCiphertextTooLarge          = errors.New("encrypted value exceeds max_ciphertext_size of its column")
+)
+
+// ParseCiphertextSizeAction validates action on oversized encrypted values, empty string means
+// CiphertextSizeActionError
+func ParseCiphertextSizeAction(value string) (CiphertextSizeAction, error) {
+	switch CiphertextSizeAction(value) {
+	case "":
+		return CiphertextSizeActionError, nil
+	case CiphertextSizeActionError, CiphertextSizeActionPass:
+		return CiphertextSizeAction(value), nil
+	}
+	return "", fmt.Errorf("%w '%s', expected '%s' or '%s'", ErrInvalidCiphertextSizeAction, value,
+		CiphertextSizeActionError, CiphertextSizeActionPass)
+}
+
+// OversizedCiphertextCounter collects count of encrypted values larger than max_ciphertext_size of their column
+var OversizedCiphertextCounter = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "acraserver_oversized_ciphertext_total",
+		Help: "number of encrypted values larger than max_ciphertext_size of their column in encryptor config which weren't decrypted",
+	}, []string{"action"})
+
+var ciphertextSizeRegisterLock = sync.Once{}
+
+// RegisterCiphertextSizeMetrics register in default prometheus registry metrics related with size of encrypted values
+func RegisterCiphertextSizeMetrics() {
+	ciphertextSizeRegisterLock.Do(func() {
+		prometheus.MustRegister(OversizedCiphertextCounter)
+	})
+}
+
+// CiphertextSizeGuard checks lengths of values of columns with max_ciphertext_size in encryptor config which are
+// declared in database responses. Proxies call it when they read length of value, before value is copied and decoded,
+// so oversized AcraStructs don't take memory for decryption.
+type CiphertextSizeGuard struct {
+	queryEncryptor *QueryDataEncryptor
+	action         CiphertextSizeAction
+}
+
+// NewCiphertextSizeGuard returns CiphertextSizeGuard which checks columns of SELECT queries processed by
+// queryEncryptor, empty action means CiphertextSizeActionError
+func NewCiphertextSizeGuard(queryEncryptor *QueryDataEncryptor, action CiphertextSizeAction) (*CiphertextSizeGuard, error) {
+	action, err := ParseCiphertextSizeAction(string(action))
+	if err != nil {
+		return nil, err
+	}
+	return &CiphertextSizeGuard{queryEncryptor: queryEncryptor, action: action}, nil
+}
+
+// CheckColumnSize checks declared length of value of column with index in result set of last query. It returns true if
+// value may be decrypted, false if value should be returned as is and error wrapping ErrCiphertextTooLarge if
+// response should be rejected.
+func (guard *CiphertextSizeGuard) CheckColumnSize(index, size int, logger *logrus.Entry) (bool, error) {
+	column := guard.queryEncryptor.getSelectColumnSetting(index)
+	if column == nil || column.setting == nil {
+		return true, nil
+	}
+	maxSize := column.setting.MaxCiphertextSize()
+	if maxSize <= 0 || size <= maxSize {
+		return true, nil
+	}
+	OversizedCiphertextCounter.WithLabelValues(string(guard.action)).Inc()
+	logger = logger.WithFields(logrus.Fields{
+		"table":               column.tableName,
+		"column":              column.columnName,
+		"column_index":        index,
+		"size":                size,
+		"max_ciphertext_size": maxSize,
+		"action":              guard.action,
+	}).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorEncryptorOversizedCiphertext)
+	if guard.action == CiphertextSizeActionPass {
+		logger.Warningln("Encrypted value is larger than max_ciphertext_size of its column and isn't decrypted")
+		return false, nil
+	}
+	logger.Errorln("Encrypted value is larger than max_ciphertext_size of its column, response is rejected")
+	return false, fmt.Errorf("%w: value of column %d has %d bytes, max_ciphertext_size is %d", ErrCiphertextTooLarge,
+		index, size, maxSize)
+}
@@ -0,0 +1,103 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package encryptor
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/cossacklabs/acra/decryptor/base"
+	"github.com/cossacklabs/acra/encryptor/config"
+	"github.com/cossacklabs/acra/sqlparser"
+	"github.com/cossacklabs/acra/sqlparser/dialect/mysql"
+	"github.com/sirupsen/logrus"
+)
+
+func TestCiphertextSizeGuard(t *testing.T) {
+	sqlparser.SetDefaultDialect(mysql.NewMySQLDialect())
+	configStr := `
+max_ciphertext_size: 16
+schemas:
+  - table: users
+    columns: ["id", "email", "phone"]
+    encrypted:
+      - column: email
+        max_ciphertext_size: 8
+      - column: phone
+`
+	schemaStore, err := config.MapTableSchemaStoreFromConfig([]byte(configStr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, invalid := range []string{
+		"max_ciphertext_size: -1\nschemas:\n  - table: users\n    encrypted:\n      - column: email\n",
+		"schemas:\n  - table: users\n    encrypted:\n      - column: email\n        max_ciphertext_size: -1\n",
+	} {
+		if _, err := config.MapTableSchemaStoreFromConfig([]byte(invalid)); !errors.Is(err, config.ErrInvalidSchemaConfig) {
+			t.Fatalf("Expected ErrInvalidSchemaConfig for negative max_ciphertext_size, took %v", err)
+		}
+	}
+	queryEncryptor, err := NewMysqlQueryEncryptor(schemaStore, []byte("client1"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// columns: email, phone, id
+	if _, _, err := queryEncryptor.OnQuery(base.NewOnQueryObjectFromQuery("select email, phone, id from users")); err != nil {
+		t.Fatal(err)
+	}
+	testcases := []struct {
+		column   int
+		size     int
+		oversize bool
+	}{
+		{0, 8, false},
+		{0, 9, true},
+		// column uses default of config
+		{1, 16, false},
+		{1, 17, true},
+		// column isn't encrypted
+		{2, 100, false},
+	}
+	logger := logrus.NewEntry(logrus.StandardLogger())
+	for _, action := range []CiphertextSizeAction{CiphertextSizeActionPass, CiphertextSizeActionError} {
+		guard, err := NewCiphertextSizeGuard(queryEncryptor, action)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, testcase := range testcases {
+			decrypt, err := guard.CheckColumnSize(testcase.column, testcase.size, logger)
+			if !testcase.oversize {
+				if !decrypt || err != nil {
+					t.Fatalf("[%s][%d] Expected decryption of value, took %v", action, i, err)
+				}
+				continue
+			}
+			if decrypt {
+				t.Fatalf("[%s][%d] Oversized value shouldn't be decrypted", action, i)
+			}
+			if expected := action == CiphertextSizeActionError; errors.Is(err, ErrCiphertextTooLarge) != expected {
+				t.Fatalf("[%s][%d] Expected ErrCiphertextTooLarge %v, took %v", action, i, expected, err)
+			}
+		}
+	}
+	if _, err := NewCiphertextSizeGuard(queryEncryptor, "block"); !errors.Is(err, ErrInvalidCiphertextSizeAction) {
+		t.Fatalf("Expected ErrInvalidCiphertextSizeAction, took %v", err)
+	}
+	if action, err := ParseCiphertextSizeAction(""); err != nil || action != CiphertextSizeActionError {
+		t.Fatalf("Expected default action '%s', took '%s', %v", CiphertextSizeActionError, action, err)
+	}
+}
@@ -17,39 +17,148 @@ limitations under the License.
 package config
 
 import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
 	"gopkg.in/yaml.v2"
 )
 
 // TableSchemaStore fetches schema for encryptable tables in the database.
 type TableSchemaStore interface {
-	// GetTableSchema returns schema for given table if configured, or nil otherwise.
+	// GetTableSchema returns schema for given table or its alias if configured, or nil otherwise.
 	GetTableSchema(tableName string) TableSchema
 	// IsEmpty returns true if the store does not have any schemas.
 	IsEmpty() bool
+	// IsStrict returns true if queries which don't match configured schemas should be rejected.
+	IsStrict() bool
+	// EncryptedColumns returns names of encrypted columns per table, aliases aren't included.
+	EncryptedColumns() map[string][]string
 }
 
 // TableSchema describes a table and its encryption settings per column.
 type TableSchema interface {
 	Name() string
 	Columns() []string
+	// HasColumn returns true if column or its alias is described by the schema.
+	// Schemas without list of columns describe any column.
+	HasColumn(columnName string) bool
 	NeedToEncrypt(columnName string) bool
 	// GetColumnEncryptionSettings fetches encryption settings for given column,
 	// or returns nil if the column should not be encrypted.
 	GetColumnEncryptionSettings(columnName string) ColumnEncryptionSetting
 }
 
+// ErrInvalidSchemaConfig returned for ambiguous table or column names in config
+var ErrInvalidSchemaConfig = errors.New("invalid encryptor schema config")
+
+// ValueHandling defines how values which can't be encrypted are handled: NULLs and empty values, because AcraStruct
+// can't contain empty data
+type ValueHandling string
+
+// Supported values of ValueHandling
+const (
+	// ValueHandlingPass stores value as is without encryption
+	ValueHandlingPass ValueHandling = "pass"
+	// ValueHandlingReject rejects query with such value to guarantee that column contains only encrypted data
+	ValueHandlingReject ValueHandling = "reject"
+)
+
+// DefaultValueHandling is used for empty and NULL values if config doesn't specify it
+const DefaultValueHandling = ValueHandlingPass
+
+// ErrInvalidValueHandling returned for unknown value of empty_value and null_value options
+var ErrInvalidValueHandling = errors.New("invalid handling of empty or NULL values")
+
+// ParseValueHandling validates handling of empty or NULL values, empty string means DefaultValueHandling
+func ParseValueHandling(value string) (ValueHandling, error) {
+	switch ValueHandling(value) {
+	case "":
+		return DefaultValueHandling, nil
+	case ValueHandlingPass, ValueHandlingReject:
+		return ValueHandling(value), nil
+	}
+	return "", fmt.Errorf("%w '%s', expected '%s' or '%s'", ErrInvalidValueHandling, value, ValueHandlingPass, ValueHandlingReject)
+}
+
+// Compression defines algorithm of compression of column values before encryption
+type Compression string
+
+// Supported values of Compression
+const (
+	// CompressionNone encrypts values as is
+	CompressionNone Compression = ""
+	// CompressionDeflate compresses values with DEFLATE, suitable for large text or JSON values
+	CompressionDeflate Compression = "deflate"
+	// CompressionZstd compresses values with Zstandard, faster than DEFLATE on large values
+	CompressionZstd Compression = "zstd"
+)
+
+// FormatPreserving defines format of values of column encrypted with format-preserving encryption instead of
+// AcraStructs, so encrypted values fit into the column without changes of its type or length
+type FormatPreserving string
+
+// Supported values of FormatPreserving
+const (
+	// FormatPreservingNone encrypts values into AcraStructs
+	FormatPreservingNone FormatPreserving = ""
+	// FormatPreservingDigits encrypts strings of digits into strings of digits of the same length, leading zeros
+	// included, like fixed-length CHAR codes
+	FormatPreservingDigits FormatPreserving = "digits"
+	// FormatPreservingInteger encrypts decimal integers into integers with the same sign and number of digits, like
+	// numeric primary keys
+	FormatPreservingInteger FormatPreserving = "integer"
+	// FormatPreservingUUID encrypts UUIDs in text or 16-byte binary form into UUIDs
+	FormatPreservingUUID FormatPreserving = "uuid"
+)
+
+// FPEAlgorithm defines mode of format-preserving encryption of NIST SP 800-38G
+type FPEAlgorithm string
+
+// Supported values of FPEAlgorithm
+const (
+	FPEAlgorithmFF1  FPEAlgorithm = "ff1"
+	FPEAlgorithmFF31 FPEAlgorithm = "ff3-1"
+)
+
+// DefaultFPEAlgorithm is used for format-preserving encrypted columns if config doesn't specify algorithm
+const DefaultFPEAlgorithm = FPEAlgorithmFF1
+
+// EmbeddedAcraStruct defines where AcraStructs embedded into larger values of column are looked for on decryption,
+// like legacy rows stored as plaintext prefix followed by AcraStruct
+type EmbeddedAcraStruct string
+
+// Supported values of EmbeddedAcraStruct
+const (
+	// EmbeddedAcraStructNone decrypts only values which are whole AcraStructs
+	EmbeddedAcraStructNone EmbeddedAcraStruct = ""
+	// EmbeddedAcraStructSuffix decrypts AcraStruct which ends value after plaintext prefix
+	EmbeddedAcraStructSuffix EmbeddedAcraStruct = "suffix"
+	// EmbeddedAcraStructSearch decrypts all AcraStructs found anywhere in value
+	EmbeddedAcraStructSearch EmbeddedAcraStruct = "search"
+)
+
 type storeConfig struct {
-	Schemas []*tableSchema
+	// StrictSchema enables rejecting of queries with columns missing in config (renamed or removed in the database)
+	StrictSchema bool `yaml:"strict_schema"`
+	// EmptyValue and NullValue are defaults for encrypted columns which don't override them
+	EmptyValue string `yaml:"empty_value"`
+	NullValue  string `yaml:"null_value"`
+	// MaxCiphertextSize is default for encrypted columns which don't override it
+	MaxCiphertextSize int `yaml:"max_ciphertext_size"`
+	Schemas           []*tableSchema
 }
 
 // MapTableSchemaStore store schemas per table name
 type MapTableSchemaStore struct {
 	schemas map[string]*tableSchema
+	strict  bool
 }
 
 // NewMapTableSchemaStore return new MapTableSchemaStore
 func NewMapTableSchemaStore() (*MapTableSchemaStore, error) {
-	return &MapTableSchemaStore{make(map[string]*tableSchema)}, nil
+	return &MapTableSchemaStore{schemas: make(map[string]*tableSchema)}, nil
 }
 
 // MapTableSchemaStoreFromConfig parse config and return MapTableSchemaStore with data from config
@@ -58,11 +167,40 @@ func MapTableSchemaStoreFromConfig(config []byte) (*MapTableSchemaStore, error)
 	if err := yaml.Unmarshal(config, &storeConfig); err != nil {
 		return nil, err
 	}
+	emptyValue, err := ParseValueHandling(storeConfig.EmptyValue)
+	if err != nil {
+		return nil, err
+	}
+	nullValue, err := ParseValueHandling(storeConfig.NullValue)
+	if err != nil {
+		return nil, err
+	}
+	if storeConfig.MaxCiphertextSize < 0 {
+		return nil, fmt.Errorf("%w: negative max_ciphertext_size", ErrInvalidSchemaConfig)
+	}
 	mapSchemas := make(map[string]*tableSchema, len(storeConfig.Schemas))
 	for _, schema := range storeConfig.Schemas {
-		mapSchemas[schema.TableName] = schema
+		if err := schema.validate(storeConfig.StrictSchema); err != nil {
+			return nil, err
+		}
+		if err := schema.setValueHandling(emptyValue, nullValue); err != nil {
+			return nil, err
+		}
+		schema.setMaxCiphertextSize(storeConfig.MaxCiphertextSize)
+		// historical names of table refer to the same schema
+		for _, name := range append([]string{schema.TableName}, schema.Aliases...) {
+			if _, ok := mapSchemas[name]; ok {
+				return nil, fmt.Errorf("%w: table '%s' is described more than once", ErrInvalidSchemaConfig, name)
+			}
+			mapSchemas[name] = schema
+		}
 	}
-	return &MapTableSchemaStore{mapSchemas}, nil
+	return &MapTableSchemaStore{schemas: mapSchemas, strict: storeConfig.StrictSchema}, nil
+}
+
+// IsStrict return true if config enables strict_schema
+func (store *MapTableSchemaStore) IsStrict() bool {
+	return store.strict
 }
 
 // GetTableSchema return table schema if exists otherwise nil
@@ -76,6 +214,42 @@ func (store *MapTableSchemaStore) GetTableSchema(tableName string) TableSchema {
 	return nil
 }
 
+// EncryptedColumns return names of encrypted columns per table name from config
+func (store *MapTableSchemaStore) EncryptedColumns() map[string][]string {
+	columns := make(map[string][]string, len(store.schemas))
+	for _, schema := range store.schemas {
+		// aliases of table refer to the same schema
+		if _, ok := columns[schema.TableName]; ok {
+			continue
+		}
+		names := make([]string, 0, len(schema.EncryptionColumnSettings))
+		for _, setting := range schema.EncryptionColumnSettings {
+			names = append(names, setting.Name)
+		}
+		columns[schema.TableName] = names
+	}
+	return columns
+}
+
+// UsesFormatPreservingKey returns true if format-preserving encrypted columns use storage key of client id or zone id,
+// empty id isn't checked. Columns without client_id and zone_id use key of client id of connection, so any client id
+func (store *MapTableSchemaStore) UsesFormatPreservingKey(clientID, zoneID []byte) bool {
+	for _, schema := range store.schemas {
+		for _, setting := range schema.EncryptionColumnSettings {
+			if setting.UsedFormatPreserving == FormatPreservingNone {
+				continue
+			}
+			if len(zoneID) > 0 && setting.UsedZoneID == string(zoneID) {
+				return true
+			}
+			if len(clientID) > 0 && setting.UsedZoneID == "" && (setting.UsedClientID == "" || setting.UsedClientID == string(clientID)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // IsEmpty return true if hasn't any schemas
 func (store *MapTableSchemaStore) IsEmpty() bool {
 	if store.schemas == nil || len(store.schemas) == 0 {
@@ -89,13 +263,49 @@ type ColumnEncryptionSetting interface {
 	ColumnName() string
 	ClientID() []byte
 	ZoneID() []byte
+	// EmptyValue returns how empty values of the column are handled
+	EmptyValue() ValueHandling
+	// NullValue returns how NULLs of the column are handled
+	NullValue() ValueHandling
+	// MaxAge returns maximum age of AcraStructs of the column allowed for decryption, 0 - no limit
+	MaxAge() time.Duration
+	// Compression returns algorithm of compression of values before encryption
+	Compression() Compression
+	// FormatPreserving returns format of values encrypted with format-preserving encryption, FormatPreservingNone if
+	// values are encrypted into AcraStructs
+	FormatPreserving() FormatPreserving
+	// FPEAlgorithm returns mode of format-preserving encryption
+	FPEAlgorithm() FPEAlgorithm
+	// EmbeddedAcraStruct returns where AcraStructs embedded into larger values are decrypted, EmbeddedAcraStructNone
+	// if values are whole AcraStructs
+	EmbeddedAcraStruct() EmbeddedAcraStruct
+	// MaxCiphertextSize returns maximum size of encrypted values of the column allowed for decryption, 0 - no limit
+	MaxCiphertextSize() int
 }
 
 // BasicColumnEncryptionSetting is a basic set of column encryption settings.
 type BasicColumnEncryptionSetting struct {
-	Name         string `yaml:"column"`
-	UsedClientID string `yaml:"client_id"`
-	UsedZoneID   string `yaml:"zone_id"`
+	Name string `yaml:"column"`
+	// Aliases are historical names of the column which are encrypted the same way
+	Aliases      []string `yaml:"aliases"`
+	UsedClientID string   `yaml:"client_id"`
+	UsedZoneID   string   `yaml:"zone_id"`
+	// UsedEmptyValue and UsedNullValue override defaults of the config
+	UsedEmptyValue ValueHandling `yaml:"empty_value"`
+	UsedNullValue  ValueHandling `yaml:"null_value"`
+	// UsedMaxAge turns on embedding of creation time into new AcraStructs and limits age of decrypted ones
+	UsedMaxAge time.Duration `yaml:"max_age"`
+	// UsedCompression turns on compression of values before encryption, decryption doesn't depend on it
+	UsedCompression Compression `yaml:"compression"`
+	// UsedFormatPreserving turns on format-preserving encryption of values instead of AcraStructs
+	UsedFormatPreserving FormatPreserving `yaml:"format_preserving"`
+	UsedFPEAlgorithm     FPEAlgorithm     `yaml:"fpe_algorithm"`
+	// UsedEmbeddedAcraStruct turns on decryption of AcraStructs embedded into larger values, new values are encrypted
+	// as whole AcraStructs anyway
+	UsedEmbeddedAcraStruct EmbeddedAcraStruct `yaml:"embedded_acrastruct"`
+	// UsedMaxCiphertextSize limits size in bytes of encrypted values which are decrypted, overrides default of the
+	// config
+	UsedMaxCiphertextSize int `yaml:"max_ciphertext_size"`
 }
 
 // ColumnName returns name of the column for which these settings are for.
@@ -113,11 +323,169 @@ func (s *BasicColumnEncryptionSetting) ZoneID() []byte {
 	return []byte(s.UsedZoneID)
 }
 
+// EmptyValue returns how to handle empty values of this column, DefaultValueHandling if not set.
+func (s *BasicColumnEncryptionSetting) EmptyValue() ValueHandling {
+	if s.UsedEmptyValue == "" {
+		return DefaultValueHandling
+	}
+	return s.UsedEmptyValue
+}
+
+// NullValue returns how to handle NULLs of this column, DefaultValueHandling if not set.
+func (s *BasicColumnEncryptionSetting) NullValue() ValueHandling {
+	if s.UsedNullValue == "" {
+		return DefaultValueHandling
+	}
+	return s.UsedNullValue
+}
+
+// MaxAge returns maximum age of AcraStructs of this column, 0 if not limited.
+func (s *BasicColumnEncryptionSetting) MaxAge() time.Duration {
+	return s.UsedMaxAge
+}
+
+// Compression returns algorithm of compression of values of this column, CompressionNone if not set.
+func (s *BasicColumnEncryptionSetting) Compression() Compression {
+	return s.UsedCompression
+}
+
+// FormatPreserving returns format of values of this column encrypted with format-preserving encryption,
+// FormatPreservingNone if not set.
+func (s *BasicColumnEncryptionSetting) FormatPreserving() FormatPreserving {
+	return s.UsedFormatPreserving
+}
+
+// FPEAlgorithm returns mode of format-preserving encryption of this column, DefaultFPEAlgorithm if not set.
+func (s *BasicColumnEncryptionSetting) FPEAlgorithm() FPEAlgorithm {
+	if s.UsedFPEAlgorithm == "" {
+		return DefaultFPEAlgorithm
+	}
+	return s.UsedFPEAlgorithm
+}
+
+// EmbeddedAcraStruct returns where AcraStructs embedded into larger values of this column are decrypted,
+// EmbeddedAcraStructNone if not set.
+func (s *BasicColumnEncryptionSetting) EmbeddedAcraStruct() EmbeddedAcraStruct {
+	return s.UsedEmbeddedAcraStruct
+}
+
+// MaxCiphertextSize returns maximum size of encrypted values of this column, 0 if not limited.
+func (s *BasicColumnEncryptionSetting) MaxCiphertextSize() int {
+	return s.UsedMaxCiphertextSize
+}
+
+// validateFormatPreserving checks format-preserving encryption options which exclude AcraStruct ones
+func (s *BasicColumnEncryptionSetting) validateFormatPreserving() error {
+	switch s.UsedFormatPreserving {
+	case FormatPreservingNone:
+		if s.UsedFPEAlgorithm != "" {
+			return errors.New("fpe_algorithm is set without format_preserving")
+		}
+		return nil
+	case FormatPreservingDigits, FormatPreservingInteger, FormatPreservingUUID:
+	default:
+		return fmt.Errorf("unknown format_preserving '%s', expected '%s', '%s' or '%s'", s.UsedFormatPreserving,
+			FormatPreservingDigits, FormatPreservingInteger, FormatPreservingUUID)
+	}
+	switch s.UsedFPEAlgorithm {
+	case "", FPEAlgorithmFF1, FPEAlgorithmFF31:
+	default:
+		return fmt.Errorf("unknown fpe_algorithm '%s', expected '%s' or '%s'", s.UsedFPEAlgorithm, FPEAlgorithmFF1, FPEAlgorithmFF31)
+	}
+	if s.UsedCompression != CompressionNone || s.UsedMaxAge != 0 {
+		return errors.New("compression and max_age are not supported with format_preserving")
+	}
+	if s.UsedEmbeddedAcraStruct != EmbeddedAcraStructNone {
+		return errors.New("embedded_acrastruct is not supported with format_preserving")
+	}
+	return nil
+}
+
 type tableSchema struct {
-	TableName                string                          `yaml:"table"`
+	TableName string `yaml:"table"`
+	// Aliases are historical names of the table
+	Aliases                  []string                        `yaml:"aliases"`
 	TableColumns             []string                        `yaml:"columns"`
 	EncryptionColumnSettings []*BasicColumnEncryptionSetting `yaml:"encrypted"`
 	mapEncryptedColumns      map[string]*BasicColumnEncryptionSetting
+	mapColumns               map[string]bool
+}
+
+// validate checks that names and aliases of encrypted columns are unambiguous and described in list of columns.
+// Encrypted columns missing in the list are rejected in strict mode, otherwise reported with warning.
+func (schema *tableSchema) validate(strict bool) error {
+	columns := make(map[string]bool, len(schema.TableColumns))
+	for _, column := range schema.TableColumns {
+		columns[column] = true
+	}
+	names := make(map[string]bool)
+	for _, setting := range schema.EncryptionColumnSettings {
+		if len(columns) > 0 && !columns[setting.Name] {
+			if strict {
+				return fmt.Errorf("%w: encrypted column '%s' is missing in columns of table '%s'", ErrInvalidSchemaConfig, setting.Name, schema.TableName)
+			}
+			logrus.WithFields(logrus.Fields{"table": schema.TableName, "column": setting.Name}).
+				Warningln("Encrypted column is missing in columns of table")
+		}
+		for _, name := range append([]string{setting.Name}, setting.Aliases...) {
+			if names[name] {
+				return fmt.Errorf("%w: encrypted column '%s' of table '%s' is described more than once", ErrInvalidSchemaConfig, name, schema.TableName)
+			}
+			names[name] = true
+		}
+		if setting.UsedMaxAge < 0 {
+			return fmt.Errorf("%w: negative max_age of column '%s' of table '%s'", ErrInvalidSchemaConfig, setting.Name, schema.TableName)
+		}
+		if setting.UsedMaxCiphertextSize < 0 {
+			return fmt.Errorf("%w: negative max_ciphertext_size of column '%s' of table '%s'", ErrInvalidSchemaConfig, setting.Name, schema.TableName)
+		}
+		switch setting.UsedCompression {
+		case CompressionNone, CompressionDeflate, CompressionZstd:
+		default:
+			return fmt.Errorf("%w: unknown compression '%s' of column '%s' of table '%s', expected '%s' or '%s'", ErrInvalidSchemaConfig, setting.UsedCompression, setting.Name, schema.TableName, CompressionDeflate, CompressionZstd)
+		}
+		switch setting.UsedEmbeddedAcraStruct {
+		case EmbeddedAcraStructNone, EmbeddedAcraStructSuffix, EmbeddedAcraStructSearch:
+		default:
+			return fmt.Errorf("%w: unknown embedded_acrastruct '%s' of column '%s' of table '%s', expected '%s' or '%s'", ErrInvalidSchemaConfig, setting.UsedEmbeddedAcraStruct, setting.Name, schema.TableName, EmbeddedAcraStructSuffix, EmbeddedAcraStructSearch)
+		}
+		if err := setting.validateFormatPreserving(); err != nil {
+			return fmt.Errorf("%w: column '%s' of table '%s': %s", ErrInvalidSchemaConfig, setting.Name, schema.TableName, err)
+		}
+		for _, alias := range setting.Aliases {
+			if columns[alias] {
+				return fmt.Errorf("%w: alias '%s' of column '%s' is another column of table '%s'", ErrInvalidSchemaConfig, alias, setting.Name, schema.TableName)
+			}
+		}
+	}
+	return nil
+}
+
+// setValueHandling validates handling of empty and NULL values of encrypted columns and sets defaults to columns
+// without it
+func (schema *tableSchema) setValueHandling(emptyValue, nullValue ValueHandling) error {
+	for _, setting := range schema.EncryptionColumnSettings {
+		if setting.UsedEmptyValue == "" {
+			setting.UsedEmptyValue = emptyValue
+		} else if _, err := ParseValueHandling(string(setting.UsedEmptyValue)); err != nil {
+			return fmt.Errorf("column '%s' of table '%s': %w", setting.Name, schema.TableName, err)
+		}
+		if setting.UsedNullValue == "" {
+			setting.UsedNullValue = nullValue
+		} else if _, err := ParseValueHandling(string(setting.UsedNullValue)); err != nil {
+			return fmt.Errorf("column '%s' of table '%s': %w", setting.Name, schema.TableName, err)
+		}
+	}
+	return nil
+}
+
+// setMaxCiphertextSize sets default maximum size of encrypted values to columns without it
+func (schema *tableSchema) setMaxCiphertextSize(size int) {
+	for _, setting := range schema.EncryptionColumnSettings {
+		if setting.UsedMaxCiphertextSize == 0 {
+			setting.UsedMaxCiphertextSize = size
+		}
+	}
 }
 
 // Name returns the name of the table.
@@ -130,13 +498,34 @@ func (schema *tableSchema) Columns() []string {
 	return schema.TableColumns
 }
 
-// initMap create map of columns to encrypt from array
+// initMap create map of columns to encrypt from array, aliases refer to settings of renamed columns
 func (schema *tableSchema) initMap() {
 	mapEncryptedColumns := make(map[string]*BasicColumnEncryptionSetting)
+	mapColumns := make(map[string]bool, len(schema.TableColumns))
+	for _, column := range schema.TableColumns {
+		mapColumns[column] = true
+	}
 	for _, column := range schema.EncryptionColumnSettings {
 		mapEncryptedColumns[column.Name] = column
+		mapColumns[column.Name] = true
+		for _, alias := range column.Aliases {
+			mapEncryptedColumns[alias] = column
+			mapColumns[alias] = true
+		}
 	}
 	schema.mapEncryptedColumns = mapEncryptedColumns
+	schema.mapColumns = mapColumns
+}
+
+// HasColumn return true if column is in list of columns or is encrypted column or its alias
+func (schema *tableSchema) HasColumn(columnName string) bool {
+	if len(schema.TableColumns) == 0 {
+		return true
+	}
+	if schema.mapEncryptedColumns == nil {
+		schema.initMap()
+	}
+	return schema.mapColumns[columnName]
 }
 
 // NeedToEncrypt return true if columnName should be encrypted by config
@@ -0,0 +1,151 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package encryptor
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/cossacklabs/acra/decryptor/base"
+	"github.com/cossacklabs/acra/logging"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+// ContextConfusionAction defines how values decrypted with context which doesn't match their column are handled
+type ContextConfusionAction string
+
+// Supported values of ContextConfusionAction
+const (
+	// ContextConfusionActionOff turns off the check
+	ContextConfusionActionOff ContextConfusionAction = "off"
+	// ContextConfusionActionFlag logs and counts such values but returns them decrypted
+	ContextConfusionActionFlag ContextConfusionAction = "flag"
+	// ContextConfusionActionBlock returns such values encrypted as if they couldn't be decrypted
+	ContextConfusionActionBlock ContextConfusionAction = "block"
+)
+
+// Enabled returns true if action turns on the check
+func (action ContextConfusionAction) Enabled() bool {
+	return action == ContextConfusionActionFlag || action == ContextConfusionActionBlock
+}
+
+// ErrInvalidContextConfusionAction returned for unknown ContextConfusionAction
+var ErrInvalidContextConfusionAction = errors.New("invalid action on context confusion")
+
+// ParseContextConfusionAction validates action on context confusion, empty string means ContextConfusionActionOff
+func ParseContextConfusionAction(value string) (ContextConfusionAction, error) {
+	switch ContextConfusionAction(value) {
+	case "":
+		return ContextConfusionActionOff, nil
+	case ContextConfusionActionOff, ContextConfusionActionFlag, ContextConfusionActionBlock:
+		return ContextConfusionAction(value), nil
+	}
+	return "", fmt.Errorf("%w '%s', expected '%s', '%s' or '%s'", ErrInvalidContextConfusionAction, value,
+		ContextConfusionActionOff, ContextConfusionActionFlag, ContextConfusionActionBlock)
+}
+
+// ContextConfusionCounter collects count of values decrypted with context which doesn't match their column
+var ContextConfusionCounter = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "acraserver_context_confusion_total",
+		Help: "number of values decrypted with zone or client id which doesn't match encryptor config of their column",
+	}, []string{"action"})
+
+var contextConfusionRegisterLock = sync.Once{}
+
+// RegisterContextConfusionMetrics register in default prometheus registry metrics related with context confusion
+func RegisterContextConfusionMetrics() {
+	contextConfusionRegisterLock.Do(func() {
+		prometheus.MustRegister(ContextConfusionCounter)
+	})
+}
+
+// ContextConfusionGuard is DecryptionSubscriber which detects AcraStructs copied between columns, rows or zones.
+// AcraStruct from result column of SELECT query should be decrypted with zone or client id from encryptor config of
+// this column, otherwise it was moved there, e.g. to read it through column with weaker access control. Plain columns
+// of tables described by config should contain no AcraStructs at all. Only values decrypted as whole AcraStructs are
+// checked, so it should be subscribed after decryptor.
+type ContextConfusionGuard struct {
+	queryEncryptor *QueryDataEncryptor
+	clientID       []byte
+	action         ContextConfusionAction
+}
+
+// NewContextConfusionGuard returns ContextConfusionGuard which checks columns of SELECT queries processed by
+// queryEncryptor for connection of clientID
+func NewContextConfusionGuard(queryEncryptor *QueryDataEncryptor, clientID []byte, action ContextConfusionAction) (*ContextConfusionGuard, error) {
+	if !action.Enabled() {
+		return nil, ErrInvalidContextConfusionAction
+	}
+	return &ContextConfusionGuard{queryEncryptor: queryEncryptor, clientID: clientID, action: action}, nil
+}
+
+// ID returns name of this DecryptionSubscriber.
+func (guard *ContextConfusionGuard) ID() string {
+	return "ContextConfusionGuard"
+}
+
+// isExpectedContext returns true if AcraStruct decrypted with zoneID or client id of connection if zoneID is nil
+// belongs to column
+func (guard *ContextConfusionGuard) isExpectedContext(column *querySelectSetting, zoneID []byte) bool {
+	if column.setting == nil {
+		return false
+	}
+	if expectedZoneID := column.setting.ZoneID(); len(expectedZoneID) > 0 {
+		return bytes.Equal(zoneID, expectedZoneID)
+	}
+	if zoneID != nil {
+		return false
+	}
+	// columns without client id are encrypted with client id of connection
+	expectedClientID := column.setting.ClientID()
+	return len(expectedClientID) == 0 || bytes.Equal(expectedClientID, guard.clientID)
+}
+
+// OnColumn checks that decrypted AcraStruct belongs to column and handles it according to action otherwise
+func (guard *ContextConfusionGuard) OnColumn(ctx context.Context, data []byte) (context.Context, []byte, error) {
+	acraStruct, zoneID, ok := base.DecryptedAcraStructFromContext(ctx)
+	if !ok {
+		return ctx, data, nil
+	}
+	columnInfo, ok := base.ColumnInfoFromContext(ctx)
+	if !ok {
+		return ctx, data, nil
+	}
+	column := guard.queryEncryptor.getSelectColumnSetting(columnInfo.Index())
+	if column == nil || guard.isExpectedContext(column, zoneID) {
+		return ctx, data, nil
+	}
+	ContextConfusionCounter.WithLabelValues(string(guard.action)).Inc()
+	logger := logging.GetLoggerFromContext(ctx).WithFields(logrus.Fields{
+		"table":        column.tableName,
+		"column":       column.columnName,
+		"column_index": columnInfo.Index(),
+		"zone_id":      string(zoneID),
+		"action":       guard.action,
+	})
+	logger.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorEncryptorContextConfusion).
+		Warningln("AcraStruct was decrypted with context which doesn't match its column")
+	if guard.action == ContextConfusionActionBlock {
+		return ctx, acraStruct, nil
+	}
+	return ctx, data, nil
+}
@@ -0,0 +1,124 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package encryptor
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/cossacklabs/acra/decryptor/base"
+	"github.com/cossacklabs/acra/encryptor/config"
+	"github.com/cossacklabs/acra/sqlparser"
+	"github.com/cossacklabs/acra/sqlparser/dialect/mysql"
+)
+
+func TestContextConfusionGuard(t *testing.T) {
+	sqlparser.SetDefaultDialect(mysql.NewMySQLDialect())
+	configStr := `
+schemas:
+  - table: users
+    columns: ["id", "email", "phone", "notes"]
+    encrypted:
+      - column: email
+      - column: phone
+        zone_id: zone1
+      - column: notes_client
+        client_id: client2
+`
+	schemaStore, err := config.MapTableSchemaStoreFromConfig([]byte(configStr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientID := []byte("client1")
+	queryEncryptor, err := NewMysqlQueryEncryptor(schemaStore, clientID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewContextConfusionGuard(queryEncryptor, clientID, ContextConfusionActionOff); !errors.Is(err, ErrInvalidContextConfusionAction) {
+		t.Fatalf("Expected ErrInvalidContextConfusionAction, took %v", err)
+	}
+	if _, err := ParseContextConfusionAction("drop"); !errors.Is(err, ErrInvalidContextConfusionAction) {
+		t.Fatalf("Expected ErrInvalidContextConfusionAction, took %v", err)
+	}
+	// columns: email, phone, notes, notes_client, id from other table
+	query := "select u.email, u.phone, u.notes, u.notes_client, o.id from users as u, orders as o"
+	if _, _, err := queryEncryptor.OnQuery(base.NewOnQueryObjectFromQuery(query)); err != nil {
+		t.Fatal(err)
+	}
+
+	acraStruct := []byte("acrastruct")
+	decrypted := []byte("decrypted")
+	testcases := []struct {
+		column    int
+		zoneID    []byte
+		confusion bool
+	}{
+		{0, nil, false},
+		{0, []byte("zone1"), true},
+		{1, []byte("zone1"), false},
+		{1, []byte("zone2"), true},
+		{1, nil, true},
+		// plain column
+		{2, nil, true},
+		// column of another client
+		{3, nil, true},
+		// table isn't described by config
+		{4, nil, false},
+	}
+	for _, action := range []ContextConfusionAction{ContextConfusionActionFlag, ContextConfusionActionBlock} {
+		guard, err := NewContextConfusionGuard(queryEncryptor, clientID, action)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, testcase := range testcases {
+			ctx := base.NewContextWithColumnInfo(context.Background(), base.NewColumnInfo(testcase.column, ""))
+			ctx = base.NewContextWithDecryptedAcraStruct(ctx, acraStruct, testcase.zoneID)
+			_, data, err := guard.OnColumn(ctx, decrypted)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := decrypted
+			if testcase.confusion && action == ContextConfusionActionBlock {
+				expected = acraStruct
+			}
+			if !bytes.Equal(data, expected) {
+				t.Fatalf("[%s][%d] Expected %s, took %s", action, i, expected, data)
+			}
+		}
+		// values which weren't decrypted aren't checked
+		ctx := base.NewContextWithColumnInfo(context.Background(), base.NewColumnInfo(2, ""))
+		if _, data, _ := guard.OnColumn(ctx, acraStruct); !bytes.Equal(data, acraStruct) {
+			t.Fatal("Value shouldn't be changed")
+		}
+	}
+
+	// columns of previous SELECT aren't used for next queries
+	if _, _, err := queryEncryptor.OnQuery(base.NewOnQueryObjectFromQuery("insert into orders(id) values (1)")); err != nil {
+		t.Fatal(err)
+	}
+	guard, err := NewContextConfusionGuard(queryEncryptor, clientID, ContextConfusionActionBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := base.NewContextWithColumnInfo(context.Background(), base.NewColumnInfo(2, ""))
+	ctx = base.NewContextWithDecryptedAcraStruct(ctx, acraStruct, nil)
+	if _, data, _ := guard.OnColumn(ctx, decrypted); !bytes.Equal(data, decrypted) {
+		t.Fatal("Value shouldn't be checked without SELECT query")
+	}
+}
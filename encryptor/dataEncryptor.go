@@ -17,6 +17,8 @@ limitations under the License.
 package encryptor
 
 import (
+	"time"
+
 	acrawriter "github.com/cossacklabs/acra/acra-writer"
 	"github.com/cossacklabs/acra/decryptor/base"
 	"github.com/cossacklabs/acra/encryptor/config"
@@ -34,11 +36,36 @@ type DataEncryptor interface {
 // AcrawriterDataEncryptor implement DataEncryptor and encrypt data with AcraStructs
 type AcrawriterDataEncryptor struct {
 	keystore keystore.PublicKeyStore
+	now      func() time.Time
 }
 
 // NewAcrawriterDataEncryptor return new AcrawriterDataEncryptor initialized with keystore
 func NewAcrawriterDataEncryptor(keystore keystore.PublicKeyStore) (*AcrawriterDataEncryptor, error) {
-	return &AcrawriterDataEncryptor{keystore}, nil
+	return &AcrawriterDataEncryptor{keystore: keystore, now: time.Now}, nil
+}
+
+// withTimestamp embeds creation time into data of columns with limited age of AcraStructs
+func (encryptor *AcrawriterDataEncryptor) withTimestamp(data []byte, setting config.ColumnEncryptionSetting) []byte {
+	if setting.MaxAge() <= 0 {
+		return data
+	}
+	return base.AddCreationTimestamp(data, encryptor.now())
+}
+
+// payload returns data to encrypt into AcraStruct: compressed according to column settings and with creation time
+func (encryptor *AcrawriterDataEncryptor) payload(data []byte, setting config.ColumnEncryptionSetting) ([]byte, error) {
+	algorithm := base.CompressionNone
+	switch setting.Compression() {
+	case config.CompressionDeflate:
+		algorithm = base.CompressionDeflate
+	case config.CompressionZstd:
+		algorithm = base.CompressionZstd
+	}
+	compressed, err := base.Compress(data, algorithm)
+	if err != nil {
+		return nil, err
+	}
+	return encryptor.withTimestamp(compressed, setting), nil
 }
 
 // EncryptWithZoneID encrypt with explicit zone id
@@ -50,7 +77,11 @@ func (encryptor *AcrawriterDataEncryptor) EncryptWithZoneID(zoneID, data []byte,
 	if err != nil {
 		return nil, err
 	}
-	return acrawriter.CreateAcrastruct(data, publicKey, zoneID)
+	payload, err := encryptor.payload(data, setting)
+	if err != nil {
+		return nil, err
+	}
+	return acrawriter.CreateAcrastruct(payload, publicKey, zoneID)
 }
 
 // EncryptWithClientID encrypt with explicit client id
@@ -62,5 +93,9 @@ func (encryptor *AcrawriterDataEncryptor) EncryptWithClientID(clientID, data []b
 	if err != nil {
 		return nil, err
 	}
-	return acrawriter.CreateAcrastruct(data, publicKey, nil)
+	payload, err := encryptor.payload(data, setting)
+	if err != nil {
+		return nil, err
+	}
+	return acrawriter.CreateAcrastruct(payload, publicKey, nil)
 }
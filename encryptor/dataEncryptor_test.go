@@ -18,8 +18,12 @@ package encryptor
 
 import (
 	"bytes"
+	"errors"
 	"testing"
+	"time"
 
+	"github.com/cossacklabs/acra/decryptor/base"
+	"github.com/cossacklabs/acra/encryptor/config"
 	"github.com/cossacklabs/themis/gothemis/keys"
 )
 
@@ -53,6 +57,38 @@ func (*emptyEncryptionSetting) ZoneID() []byte {
 	panic("implement me")
 }
 
+func (*emptyEncryptionSetting) EmptyValue() config.ValueHandling {
+	panic("implement me")
+}
+
+func (*emptyEncryptionSetting) NullValue() config.ValueHandling {
+	panic("implement me")
+}
+
+func (*emptyEncryptionSetting) MaxAge() time.Duration {
+	return 0
+}
+
+func (*emptyEncryptionSetting) Compression() config.Compression {
+	return config.CompressionNone
+}
+
+func (*emptyEncryptionSetting) FormatPreserving() config.FormatPreserving {
+	return config.FormatPreservingNone
+}
+
+func (*emptyEncryptionSetting) FPEAlgorithm() config.FPEAlgorithm {
+	return config.DefaultFPEAlgorithm
+}
+
+func (*emptyEncryptionSetting) EmbeddedAcraStruct() config.EmbeddedAcraStruct {
+	return config.EmbeddedAcraStructNone
+}
+
+func (*emptyEncryptionSetting) MaxCiphertextSize() int {
+	return 0
+}
+
 func TestAcrawriterDataEncryptor_EncryptWithClientID(t *testing.T) {
 	keypair, err := keys.New(keys.TypeEC)
 	if err != nil {
@@ -86,3 +122,40 @@ func TestAcrawriterDataEncryptor_EncryptWithClientID(t *testing.T) {
 		t.Fatal("Wasn't used zone id key")
 	}
 }
+
+func TestAcrawriterDataEncryptorCompression(t *testing.T) {
+	keypair, err := keys.New(keys.TypeEC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encryptor, err := NewAcrawriterDataEncryptor(&keyStore{keypair: keypair})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testData := bytes.Repeat([]byte(`{"key": "value"}`), 200)
+	plain, err := encryptor.EncryptWithClientID([]byte("client1"), testData, &config.BasicColumnEncryptionSetting{Name: "data"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, compression := range []config.Compression{config.CompressionDeflate, config.CompressionZstd} {
+		setting := &config.BasicColumnEncryptionSetting{Name: "data", UsedCompression: compression, UsedMaxAge: time.Hour}
+		compressed, err := encryptor.EncryptWithClientID([]byte("client1"), testData, setting)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(compressed) >= len(plain) {
+			t.Fatalf("Expected AcraStruct shorter than %d bytes with %s, took %d", len(plain), compression, len(compressed))
+		}
+		decrypted, err := base.DecryptAcrastruct(compressed, keypair.Private, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decrypted, testData) {
+			t.Fatalf("Decrypted data doesn't match source data with %s", compression)
+		}
+	}
+	configStr := "schemas:\n  - table: users\n    encrypted:\n      - column: email\n        compression: zip\n"
+	if _, err := config.MapTableSchemaStoreFromConfig([]byte(configStr)); !errors.Is(err, config.ErrInvalidSchemaConfig) {
+		t.Fatalf("Expected ErrInvalidSchemaConfig for unknown compression, took %v", err)
+	}
+}
@@ -0,0 +1,202 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package encryptor
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Errors returned by purpose labels of sessions
+var (
+	ErrInvalidDecryptionPurposePolicy = errors.New("invalid decryption purpose policy")
+	ErrInvalidPurposeSignature        = errors.New("invalid signature of purpose label")
+)
+
+// purposeCommentRegexp matches signed comments "/* acra_purpose=<label> signature=<hex HMAC-SHA256> */"
+var purposeCommentRegexp = regexp.MustCompile(`/\*\s*acra_purpose=([A-Za-z0-9_.\-]+)\s+signature=([0-9A-Fa-f]{64})\s*\*/`)
+
+// purposeLabelRegexp limits labels to characters allowed in signed comments
+var purposeLabelRegexp = regexp.MustCompile(`^[A-Za-z0-9_.\-]+$`)
+
+type decryptionPurposeRuleConfig struct {
+	ClientID    string   `yaml:"client_id"`
+	Table       string   `yaml:"table"`
+	Column      string   `yaml:"column"`
+	Purposes    []string `yaml:"purposes"`
+	MaskedValue *string  `yaml:"masked_value"`
+}
+
+type decryptionPurposeConfig struct {
+	StartupParameter string                        `yaml:"startup_parameter"`
+	SigningKeyFile   string                        `yaml:"signing_key_file"`
+	MaskedValue      *string                       `yaml:"masked_value"`
+	Columns          []decryptionPurposeRuleConfig `yaml:"columns"`
+}
+
+// decryptionPurposeRule restricts decryption of column for all or one client to sessions labeled with purposes
+type decryptionPurposeRule struct {
+	clientID    []byte
+	table       string
+	column      string
+	purposes    map[string]bool
+	maskedValue []byte
+}
+
+// appliesTo returns true if rule restricts decryption of column by client
+func (rule *decryptionPurposeRule) appliesTo(clientID []byte, table, column string) bool {
+	if rule.clientID != nil && !bytes.Equal(rule.clientID, clientID) {
+		return false
+	}
+	return rule.table == table && rule.column == column
+}
+
+// DecryptionPurposePolicy restricts decryption of columns to sessions labeled with specific purposes, e.g. allows to
+// read card numbers only for billing. Sessions are labeled with PostgreSQL startup parameter or with comment of query
+// signed with HMAC key shared with applications. If several rules apply to the column, purpose of session should be
+// allowed by all of them.
+type DecryptionPurposePolicy struct {
+	startupParameter string
+	signingKey       []byte
+	rules            []*decryptionPurposeRule
+}
+
+// LoadDecryptionPurposePolicy reads DecryptionPurposePolicy from YAML file
+func LoadDecryptionPurposePolicy(path string) (*DecryptionPurposePolicy, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseDecryptionPurposePolicy(data)
+}
+
+// ParseDecryptionPurposePolicy parses DecryptionPurposePolicy from YAML config and reads key of signed comments from
+// signing_key_file
+func ParseDecryptionPurposePolicy(data []byte) (*DecryptionPurposePolicy, error) {
+	config := &decryptionPurposeConfig{}
+	if err := yaml.UnmarshalStrict(data, config); err != nil {
+		return nil, err
+	}
+	var signingKey []byte
+	if config.SigningKeyFile != "" {
+		var err error
+		if signingKey, err = ioutil.ReadFile(config.SigningKeyFile); err != nil {
+			return nil, err
+		}
+		// trailing newline of text editors isn't part of the key
+		signingKey = bytes.TrimSpace(signingKey)
+		if len(signingKey) == 0 {
+			return nil, fmt.Errorf("%w: signing_key_file '%s' is empty", ErrInvalidDecryptionPurposePolicy, config.SigningKeyFile)
+		}
+	}
+	if config.StartupParameter == "" && len(signingKey) == 0 {
+		return nil, fmt.Errorf("%w: startup_parameter or signing_key_file should be set to label sessions", ErrInvalidDecryptionPurposePolicy)
+	}
+	maskedValue := DefaultMaskedValue
+	if config.MaskedValue != nil {
+		maskedValue = *config.MaskedValue
+	}
+	policy := &DecryptionPurposePolicy{startupParameter: config.StartupParameter, signingKey: signingKey}
+	for _, ruleConfig := range config.Columns {
+		if ruleConfig.Table == "" || ruleConfig.Column == "" {
+			return nil, fmt.Errorf("%w: rules of columns should have table and column", ErrInvalidDecryptionPurposePolicy)
+		}
+		if len(ruleConfig.Purposes) == 0 {
+			return nil, fmt.Errorf("%w: rule for column '%s.%s' should have purposes", ErrInvalidDecryptionPurposePolicy,
+				ruleConfig.Table, ruleConfig.Column)
+		}
+		rule := &decryptionPurposeRule{
+			table:       ruleConfig.Table,
+			column:      ruleConfig.Column,
+			purposes:    make(map[string]bool, len(ruleConfig.Purposes)),
+			maskedValue: []byte(maskedValue),
+		}
+		if ruleConfig.ClientID != "" {
+			rule.clientID = []byte(ruleConfig.ClientID)
+		}
+		if ruleConfig.MaskedValue != nil {
+			rule.maskedValue = []byte(*ruleConfig.MaskedValue)
+		}
+		for _, purpose := range ruleConfig.Purposes {
+			if !purposeLabelRegexp.MatchString(purpose) {
+				return nil, fmt.Errorf("%w: invalid purpose '%s' of column '%s.%s'", ErrInvalidDecryptionPurposePolicy,
+					purpose, ruleConfig.Table, ruleConfig.Column)
+			}
+			rule.purposes[purpose] = true
+		}
+		policy.rules = append(policy.rules, rule)
+	}
+	return policy, nil
+}
+
+// StartupParameter returns name of PostgreSQL startup parameter with purpose of session or empty string if sessions
+// are labeled only with signed comments
+func (policy *DecryptionPurposePolicy) StartupParameter() string {
+	return policy.startupParameter
+}
+
+// deniedBy returns rule which doesn't allow to decrypt column for client in session with purpose or nil if decryption
+// is allowed
+func (policy *DecryptionPurposePolicy) deniedBy(clientID []byte, table, column, purpose string) *decryptionPurposeRule {
+	for _, rule := range policy.rules {
+		if rule.appliesTo(clientID, table, column) && !rule.purposes[purpose] {
+			return rule
+		}
+	}
+	return nil
+}
+
+// SignPurpose returns hex encoded signature of purpose label for comments of queries of clientID
+func SignPurpose(key, clientID []byte, purpose string) string {
+	return hex.EncodeToString(purposeMAC(key, clientID, purpose))
+}
+
+func purposeMAC(key, clientID []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(clientID)
+	mac.Write([]byte{0})
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+// purposeFromQuery returns purpose label of signed comment of query and true, or false if query has no such comment.
+// Signature binds label to client ID, so comments can't be reused by other clients. ErrInvalidPurposeSignature is
+// returned if signature doesn't match or signed comments aren't allowed.
+func (policy *DecryptionPurposePolicy) purposeFromQuery(query string, clientID []byte) (string, bool, error) {
+	if !strings.Contains(query, "acra_purpose=") {
+		return "", false, nil
+	}
+	match := purposeCommentRegexp.FindStringSubmatch(query)
+	if match == nil {
+		return "", false, nil
+	}
+	purpose := match[1]
+	signature, err := hex.DecodeString(match[2])
+	if err != nil || len(policy.signingKey) == 0 || !hmac.Equal(signature, purposeMAC(policy.signingKey, clientID, purpose)) {
+		return purpose, true, ErrInvalidPurposeSignature
+	}
+	return purpose, true, nil
+}
@@ -0,0 +1,162 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package encryptor
+
+import (
+	"context"
+	"sync"
+
+	"github.com/cossacklabs/acra/decryptor/base"
+	"github.com/cossacklabs/acra/logging"
+	"github.com/cossacklabs/acra/sqlparser"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+// DecryptionPurposeMaskedCounter collects count of values masked because purpose of session doesn't allow to decrypt them
+var DecryptionPurposeMaskedCounter = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "acraserver_decryption_purpose_masked_total",
+		Help: "number of decrypted values replaced with masked value because purpose of session isn't allowed for column",
+	})
+
+// DecryptionPurposeInvalidSignatureCounter collects count of queries with purpose comments which signatures don't match
+var DecryptionPurposeInvalidSignatureCounter = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "acraserver_decryption_purpose_invalid_signatures_total",
+		Help: "number of queries with purpose labels ignored due to invalid signature",
+	})
+
+var decryptionPurposeRegisterLock = sync.Once{}
+
+// RegisterDecryptionPurposeMetrics register in default prometheus registry metrics related with purpose labels
+func RegisterDecryptionPurposeMetrics() {
+	decryptionPurposeRegisterLock.Do(func() {
+		prometheus.MustRegister(DecryptionPurposeMaskedCounter)
+		prometheus.MustRegister(DecryptionPurposeInvalidSignatureCounter)
+	})
+}
+
+// DecryptionPurposeGuard labels session with purpose and replaces decrypted values with masked value if policy doesn't
+// allow to decrypt them for this purpose. It is QueryObserver which reads signed comments of queries, so it should be
+// added before observers which change queries, and DecryptionSubscriber which checks values decrypted as whole
+// AcraStructs, so it should be subscribed after decryptor.
+type DecryptionPurposeGuard struct {
+	policy         *DecryptionPurposePolicy
+	queryEncryptor *QueryDataEncryptor
+	logger         *logrus.Entry
+	// lock protects fields changed by queries of client and read on decryption of database responses
+	lock     sync.RWMutex
+	clientID []byte
+	purpose  string
+}
+
+// NewDecryptionPurposeGuard returns DecryptionPurposeGuard for connection of clientID without purpose. Rules are
+// applied only with queryEncryptor which matches columns of SELECT queries with encryptor config.
+func NewDecryptionPurposeGuard(policy *DecryptionPurposePolicy, queryEncryptor *QueryDataEncryptor, clientID []byte, logger *logrus.Entry) *DecryptionPurposeGuard {
+	return &DecryptionPurposeGuard{policy: policy, queryEncryptor: queryEncryptor, clientID: clientID, logger: logger}
+}
+
+// ID returns name of this QueryObserver and DecryptionSubscriber.
+func (guard *DecryptionPurposeGuard) ID() string {
+	return "DecryptionPurposeGuard"
+}
+
+// SetClientID replaces client ID which signatures of comments are verified with, e.g. after it's extracted from
+// TLS certificate
+func (guard *DecryptionPurposeGuard) SetClientID(clientID []byte) {
+	guard.lock.Lock()
+	guard.clientID = clientID
+	guard.lock.Unlock()
+}
+
+// SetPurpose labels session with purpose
+func (guard *DecryptionPurposeGuard) SetPurpose(purpose string) {
+	guard.lock.Lock()
+	guard.purpose = purpose
+	guard.lock.Unlock()
+	guard.logger.WithField("purpose", purpose).Debugln("Set purpose of session")
+}
+
+// Purpose returns purpose label of session, empty if it isn't labeled
+func (guard *DecryptionPurposeGuard) Purpose() string {
+	guard.lock.RLock()
+	defer guard.lock.RUnlock()
+	return guard.purpose
+}
+
+// StartupParameter returns name of PostgreSQL startup parameter with purpose of session, empty if it isn't used
+func (guard *DecryptionPurposeGuard) StartupParameter() string {
+	return guard.policy.StartupParameter()
+}
+
+// OnQuery labels session with purpose of signed comment of query, it stays until next signed comment. Comments with
+// invalid signatures are ignored and don't change current purpose. Query is never changed.
+func (guard *DecryptionPurposeGuard) OnQuery(query base.OnQueryObject) (base.OnQueryObject, bool, error) {
+	guard.lock.RLock()
+	clientID := guard.clientID
+	guard.lock.RUnlock()
+	purpose, ok, err := guard.policy.purposeFromQuery(query.Query(), clientID)
+	if !ok {
+		return query, false, nil
+	}
+	if err != nil {
+		DecryptionPurposeInvalidSignatureCounter.Inc()
+		guard.logger.WithError(err).WithField("purpose", purpose).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorDecryptionPurposeSignature).
+			Warningln("Ignored purpose label of query with invalid signature")
+		return query, false, nil
+	}
+	guard.SetPurpose(purpose)
+	return query, false, nil
+}
+
+// OnBind doesn't process bound values, purposes are set only by comments of queries.
+func (guard *DecryptionPurposeGuard) OnBind(statement sqlparser.Statement, values []base.BoundValue) ([]base.BoundValue, bool, error) {
+	return values, false, nil
+}
+
+// OnColumn returns masked value instead of decrypted AcraStruct if purpose of session isn't allowed for its column
+func (guard *DecryptionPurposeGuard) OnColumn(ctx context.Context, data []byte) (context.Context, []byte, error) {
+	if _, _, ok := base.DecryptedAcraStructFromContext(ctx); !ok {
+		return ctx, data, nil
+	}
+	columnInfo, ok := base.ColumnInfoFromContext(ctx)
+	if !ok || guard.queryEncryptor == nil {
+		return ctx, data, nil
+	}
+	column := guard.queryEncryptor.getSelectColumnSetting(columnInfo.Index())
+	if column == nil {
+		return ctx, data, nil
+	}
+	guard.lock.RLock()
+	clientID, purpose := guard.clientID, guard.purpose
+	guard.lock.RUnlock()
+	rule := guard.policy.deniedBy(clientID, column.tableName, column.columnName, purpose)
+	if rule == nil {
+		return ctx, data, nil
+	}
+	DecryptionPurposeMaskedCounter.Inc()
+	logger := logging.GetLoggerFromContext(ctx).WithFields(logrus.Fields{
+		"table":        column.tableName,
+		"column":       column.columnName,
+		"column_index": columnInfo.Index(),
+		"purpose":      purpose,
+	})
+	logger.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorDecryptionPurposeNotAllowed).
+		Warningln("Decrypted value was masked because purpose of session isn't allowed for column")
+	return ctx, rule.maskedValue, nil
+}
@@ -0,0 +1,208 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package encryptor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/cossacklabs/acra/decryptor/base"
+	"github.com/cossacklabs/acra/encryptor/config"
+	"github.com/cossacklabs/acra/sqlparser"
+	"github.com/cossacklabs/acra/sqlparser/dialect/mysql"
+	"github.com/sirupsen/logrus"
+)
+
+func writePurposeSigningKey(t *testing.T, key string) string {
+	file, err := ioutil.TempFile("", "purpose_key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err := file.WriteString(key); err != nil {
+		t.Fatal(err)
+	}
+	return file.Name()
+}
+
+func TestParseDecryptionPurposePolicy(t *testing.T) {
+	emptyKeyFile := writePurposeSigningKey(t, "\n")
+	defer os.Remove(emptyKeyFile)
+	invalidConfigs := []string{
+		"columns: [{table: users, column: ssn, purposes: [billing]}]",
+		"startup_parameter: acra.purpose\ncolumns: [{table: users, purposes: [billing]}]",
+		"startup_parameter: acra.purpose\ncolumns: [{table: users, column: ssn}]",
+		"startup_parameter: acra.purpose\ncolumns: [{table: users, column: ssn, purposes: ['bill ing']}]",
+		"signing_key_file: /nonexistent/purpose.key",
+		"signing_key_file: " + emptyKeyFile,
+		"unknown: value",
+	}
+	for _, configStr := range invalidConfigs {
+		if _, err := ParseDecryptionPurposePolicy([]byte(configStr)); err == nil {
+			t.Fatalf("Expected error for config '%s'", configStr)
+		}
+	}
+	policy, err := ParseDecryptionPurposePolicy([]byte("startup_parameter: acra.purpose"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if policy.StartupParameter() != "acra.purpose" {
+		t.Fatalf("Unexpected startup parameter %s", policy.StartupParameter())
+	}
+}
+
+func TestPurposeFromQuery(t *testing.T) {
+	keyFile := writePurposeSigningKey(t, "secret key\n")
+	defer os.Remove(keyFile)
+	policy, err := ParseDecryptionPurposePolicy([]byte("signing_key_file: " + keyFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientID := []byte("client")
+	signature := SignPurpose([]byte("secret key"), clientID, "billing")
+
+	query := fmt.Sprintf("/* acra_purpose=billing signature=%s */ select 1", signature)
+	purpose, ok, err := policy.purposeFromQuery(query, clientID)
+	if err != nil || !ok || purpose != "billing" {
+		t.Fatalf("Expected valid purpose, took %s, %v, %v", purpose, ok, err)
+	}
+	if _, ok, _ := policy.purposeFromQuery("select 1 /* other comment */", clientID); ok {
+		t.Fatal("Query without purpose comment shouldn't have purpose")
+	}
+	// signature of another client or another purpose
+	invalidQueries := []string{
+		query,
+		fmt.Sprintf("select 1 /* acra_purpose=support signature=%s */", signature),
+	}
+	for i, invalidQuery := range invalidQueries {
+		otherClientID := clientID
+		if i == 0 {
+			otherClientID = []byte("other")
+		}
+		if _, ok, err := policy.purposeFromQuery(invalidQuery, otherClientID); !ok || !errors.Is(err, ErrInvalidPurposeSignature) {
+			t.Fatalf("[%d] Expected ErrInvalidPurposeSignature, took %v", i, err)
+		}
+	}
+	// without signing key comments aren't trusted
+	policy, err = ParseDecryptionPurposePolicy([]byte("startup_parameter: acra.purpose"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := policy.purposeFromQuery(query, clientID); !errors.Is(err, ErrInvalidPurposeSignature) {
+		t.Fatalf("Expected ErrInvalidPurposeSignature, took %v", err)
+	}
+}
+
+func TestDecryptionPurposeGuard(t *testing.T) {
+	sqlparser.SetDefaultDialect(mysql.NewMySQLDialect())
+	schemaStore, err := config.MapTableSchemaStoreFromConfig([]byte(`
+schemas:
+  - table: users
+    columns: ["id", "email", "ssn"]
+    encrypted:
+      - column: email
+      - column: ssn
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := writePurposeSigningKey(t, "secret key")
+	defer os.Remove(keyFile)
+	policy, err := ParseDecryptionPurposePolicy([]byte(`
+startup_parameter: acra.purpose
+signing_key_file: ` + keyFile + `
+masked_value: "***"
+columns:
+  - table: users
+    column: ssn
+    purposes: [billing, fraud_investigation]
+    masked_value: "XXX"
+  - table: users
+    column: email
+    client_id: reporting
+    purposes: [billing]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decrypted := []byte("decrypted")
+	testcases := []struct {
+		clientID string
+		purpose  string
+		column   int
+		expected string
+	}{
+		{"app", "", 0, "decrypted"},
+		{"app", "", 1, "XXX"},
+		{"app", "billing", 1, "decrypted"},
+		{"app", "fraud_investigation", 1, "decrypted"},
+		{"app", "support", 1, "XXX"},
+		{"reporting", "support", 0, "***"},
+		{"reporting", "billing", 0, "decrypted"},
+		// table isn't described by config
+		{"app", "", 2, "decrypted"},
+	}
+	for i, testcase := range testcases {
+		queryEncryptor, err := NewMysqlQueryEncryptor(schemaStore, []byte(testcase.clientID), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		guard := NewDecryptionPurposeGuard(policy, queryEncryptor, []byte(testcase.clientID), logrus.NewEntry(logrus.StandardLogger()))
+		// columns: email, ssn, ssn from other table
+		query := "select email, ssn, o.ssn from users, orders as o"
+		if testcase.purpose != "" {
+			signature := SignPurpose([]byte("secret key"), []byte(testcase.clientID), testcase.purpose)
+			query = fmt.Sprintf("/* acra_purpose=%s signature=%s */ %s", testcase.purpose, signature, query)
+		}
+		for _, observer := range []base.QueryObserver{guard, queryEncryptor} {
+			if _, _, err := observer.OnQuery(base.NewOnQueryObjectFromQuery(query)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if guard.Purpose() != testcase.purpose {
+			t.Fatalf("[%d] Expected purpose %s, took %s", i, testcase.purpose, guard.Purpose())
+		}
+		ctx := base.NewContextWithColumnInfo(context.Background(), base.NewColumnInfo(testcase.column, ""))
+		if _, data, _ := guard.OnColumn(ctx, decrypted); string(data) != string(decrypted) {
+			t.Fatalf("[%d] Value which wasn't decrypted shouldn't be masked", i)
+		}
+		ctx = base.NewContextWithDecryptedAcraStruct(ctx, []byte("acrastruct"), nil)
+		_, data, err := guard.OnColumn(ctx, decrypted)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != testcase.expected {
+			t.Fatalf("[%d] Expected %s, took %s", i, testcase.expected, data)
+		}
+	}
+
+	// comment with invalid signature doesn't change purpose set by startup parameter
+	guard := NewDecryptionPurposeGuard(policy, nil, []byte("app"), logrus.NewEntry(logrus.StandardLogger()))
+	guard.SetPurpose("billing")
+	query := fmt.Sprintf("/* acra_purpose=support signature=%s */ select 1", SignPurpose([]byte("other key"), []byte("app"), "support"))
+	if _, changed, err := guard.OnQuery(base.NewOnQueryObjectFromQuery(query)); err != nil || changed {
+		t.Fatalf("Query shouldn't be changed or rejected, took %v, %v", changed, err)
+	}
+	if guard.Purpose() != "billing" {
+		t.Fatalf("Expected purpose billing, took %s", guard.Purpose())
+	}
+}
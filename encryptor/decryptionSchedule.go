@@ -0,0 +1,276 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package encryptor
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// ErrInvalidDecryptionSchedule returned for invalid schedules or rules of decryption schedule config
+var ErrInvalidDecryptionSchedule = errors.New("invalid decryption schedule")
+
+// DefaultMaskedValue returned instead of values decrypted outside of allowed windows if config doesn't override it
+const DefaultMaskedValue = "****"
+
+// scheduleField describes range of one field of schedule
+type scheduleField struct {
+	name     string
+	min, max int
+}
+
+var scheduleFields = []scheduleField{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	// 7 is Sunday too
+	{"day of week", 0, 7},
+}
+
+// Schedule is cron-like expression "minute hour day-of-month month day-of-week" which describes minutes when
+// decryption is allowed, e.g. "* 1-4 * * 1-5" allows it from 01:00 till 04:59 on working days. Every field is "*",
+// number, range "a-b", step "*/n" or "a-b/n" or comma-separated list of them. Unlike cron, time should match both day
+// of month and day of week.
+type Schedule struct {
+	expression string
+	// bit masks of allowed values of every field
+	fields [5]uint64
+}
+
+// ParseSchedule parses cron-like expression of Schedule
+func ParseSchedule(expression string) (*Schedule, error) {
+	parts := strings.Fields(expression)
+	if len(parts) != len(scheduleFields) {
+		return nil, fmt.Errorf("%w '%s': expected %d fields", ErrInvalidDecryptionSchedule, expression, len(scheduleFields))
+	}
+	schedule := &Schedule{expression: expression}
+	for i, part := range parts {
+		mask, err := parseScheduleField(part, scheduleFields[i])
+		if err != nil {
+			return nil, fmt.Errorf("%w '%s': %s", ErrInvalidDecryptionSchedule, expression, err)
+		}
+		schedule.fields[i] = mask
+	}
+	// Sunday is 0 in time.Weekday
+	if schedule.fields[4]&(1<<7) != 0 {
+		schedule.fields[4] |= 1
+	}
+	return schedule, nil
+}
+
+func parseScheduleField(value string, field scheduleField) (uint64, error) {
+	var mask uint64
+	for _, item := range strings.Split(value, ",") {
+		step := 1
+		if index := strings.Index(item, "/"); index >= 0 {
+			parsedStep, err := strconv.Atoi(item[index+1:])
+			if err != nil || parsedStep <= 0 {
+				return 0, fmt.Errorf("invalid step of %s '%s'", field.name, item)
+			}
+			step = parsedStep
+			item = item[:index]
+		}
+		start, end := field.min, field.max
+		if item != "*" {
+			bounds := strings.SplitN(item, "-", 2)
+			var err error
+			if start, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, fmt.Errorf("invalid %s '%s'", field.name, item)
+			}
+			end = start
+			if len(bounds) == 2 {
+				if end, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, fmt.Errorf("invalid %s '%s'", field.name, item)
+				}
+			}
+			if start < field.min || end > field.max || start > end {
+				return 0, fmt.Errorf("%s '%s' is out of range %d-%d", field.name, item, field.min, field.max)
+			}
+		}
+		for i := start; i <= end; i += step {
+			mask |= 1 << uint(i)
+		}
+	}
+	return mask, nil
+}
+
+// Matches returns true if minute of t is allowed by schedule
+func (schedule *Schedule) Matches(t time.Time) bool {
+	values := [5]int{t.Minute(), t.Hour(), t.Day(), int(t.Month()), int(t.Weekday())}
+	for i, value := range values {
+		if schedule.fields[i]&(1<<uint(value)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// String returns expression of schedule
+func (schedule *Schedule) String() string {
+	return schedule.expression
+}
+
+type decryptionScheduleRuleConfig struct {
+	ClientID    string   `yaml:"client_id"`
+	Table       string   `yaml:"table"`
+	Column      string   `yaml:"column"`
+	Windows     []string `yaml:"windows"`
+	MaskedValue *string  `yaml:"masked_value"`
+}
+
+type decryptionScheduleConfig struct {
+	Timezone    string                         `yaml:"timezone"`
+	MaskedValue *string                        `yaml:"masked_value"`
+	Clients     []decryptionScheduleRuleConfig `yaml:"clients"`
+	Columns     []decryptionScheduleRuleConfig `yaml:"columns"`
+}
+
+// decryptionScheduleRule restricts decryption for client, column or column of client to windows
+type decryptionScheduleRule struct {
+	clientID    []byte
+	table       string
+	column      string
+	windows     []*Schedule
+	maskedValue []byte
+}
+
+// appliesTo returns true if rule restricts decryption of column by client
+func (rule *decryptionScheduleRule) appliesTo(clientID []byte, table, column string) bool {
+	if rule.clientID != nil && !bytes.Equal(rule.clientID, clientID) {
+		return false
+	}
+	if rule.column == "" {
+		return true
+	}
+	return rule.table == table && rule.column == column
+}
+
+// allows returns true if t is inside of one of windows
+func (rule *decryptionScheduleRule) allows(t time.Time) bool {
+	for _, window := range rule.windows {
+		if window.Matches(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// DecryptionSchedulePolicy restricts decryption of all columns for some clients or some columns for all or one client
+// to time windows, e.g. for batch-only consumers which should never read sensitive data interactively. If several
+// rules apply to the column, decryption is allowed only inside windows of all of them.
+type DecryptionSchedulePolicy struct {
+	location *time.Location
+	rules    []*decryptionScheduleRule
+}
+
+// LoadDecryptionSchedulePolicy reads DecryptionSchedulePolicy from YAML file
+func LoadDecryptionSchedulePolicy(path string) (*DecryptionSchedulePolicy, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseDecryptionSchedulePolicy(data)
+}
+
+// ParseDecryptionSchedulePolicy parses DecryptionSchedulePolicy from YAML config and validates schedules
+func ParseDecryptionSchedulePolicy(data []byte) (*DecryptionSchedulePolicy, error) {
+	config := &decryptionScheduleConfig{}
+	if err := yaml.UnmarshalStrict(data, config); err != nil {
+		return nil, err
+	}
+	location := time.UTC
+	if config.Timezone != "" {
+		var err error
+		if location, err = time.LoadLocation(config.Timezone); err != nil {
+			return nil, fmt.Errorf("%w: timezone '%s': %v", ErrInvalidDecryptionSchedule, config.Timezone, err)
+		}
+	}
+	maskedValue := DefaultMaskedValue
+	if config.MaskedValue != nil {
+		maskedValue = *config.MaskedValue
+	}
+	policy := &DecryptionSchedulePolicy{location: location}
+	for _, ruleConfig := range config.Clients {
+		if ruleConfig.ClientID == "" || ruleConfig.Table != "" || ruleConfig.Column != "" {
+			return nil, fmt.Errorf("%w: rules of clients should have only client_id", ErrInvalidDecryptionSchedule)
+		}
+		if err := policy.addRule(ruleConfig, maskedValue); err != nil {
+			return nil, err
+		}
+	}
+	for _, ruleConfig := range config.Columns {
+		if ruleConfig.Table == "" || ruleConfig.Column == "" {
+			return nil, fmt.Errorf("%w: rules of columns should have table and column", ErrInvalidDecryptionSchedule)
+		}
+		if err := policy.addRule(ruleConfig, maskedValue); err != nil {
+			return nil, err
+		}
+	}
+	return policy, nil
+}
+
+func (policy *DecryptionSchedulePolicy) addRule(config decryptionScheduleRuleConfig, defaultMaskedValue string) error {
+	if len(config.Windows) == 0 {
+		return fmt.Errorf("%w: rule for client '%s', column '%s.%s' should have windows", ErrInvalidDecryptionSchedule,
+			config.ClientID, config.Table, config.Column)
+	}
+	rule := &decryptionScheduleRule{table: config.Table, column: config.Column, maskedValue: []byte(defaultMaskedValue)}
+	if config.ClientID != "" {
+		rule.clientID = []byte(config.ClientID)
+	}
+	if config.MaskedValue != nil {
+		rule.maskedValue = []byte(*config.MaskedValue)
+	}
+	for _, window := range config.Windows {
+		schedule, err := ParseSchedule(window)
+		if err != nil {
+			return err
+		}
+		rule.windows = append(rule.windows, schedule)
+	}
+	policy.rules = append(policy.rules, rule)
+	return nil
+}
+
+// HasColumnRules returns true if some rules restrict decryption of specific columns
+func (policy *DecryptionSchedulePolicy) HasColumnRules() bool {
+	for _, rule := range policy.rules {
+		if rule.column != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// deniedBy returns rule which doesn't allow to decrypt column for client at t or nil if decryption is allowed
+func (policy *DecryptionSchedulePolicy) deniedBy(clientID []byte, table, column string, t time.Time) *decryptionScheduleRule {
+	t = t.In(policy.location)
+	for _, rule := range policy.rules {
+		if rule.appliesTo(clientID, table, column) && !rule.allows(t) {
+			return rule
+		}
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package encryptor
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/cossacklabs/acra/decryptor/base"
+	"github.com/cossacklabs/acra/logging"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+// DecryptionScheduleMaskedCounter collects count of values masked because they were decrypted outside of allowed windows
+var DecryptionScheduleMaskedCounter = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "acraserver_decryption_schedule_masked_total",
+		Help: "number of decrypted values replaced with masked value outside of allowed decryption windows",
+	})
+
+var decryptionScheduleRegisterLock = sync.Once{}
+
+// RegisterDecryptionScheduleMetrics register in default prometheus registry metrics related with decryption schedules
+func RegisterDecryptionScheduleMetrics() {
+	decryptionScheduleRegisterLock.Do(func() {
+		prometheus.MustRegister(DecryptionScheduleMaskedCounter)
+	})
+}
+
+// DecryptionScheduleGuard is DecryptionSubscriber which replaces decrypted values with masked value if policy doesn't
+// allow client to decrypt them at this time. Only values decrypted as whole AcraStructs are checked, so it should be
+// subscribed after decryptor.
+type DecryptionScheduleGuard struct {
+	policy         *DecryptionSchedulePolicy
+	queryEncryptor *QueryDataEncryptor
+	clientID       []byte
+	now            func() time.Time
+}
+
+// NewDecryptionScheduleGuard returns DecryptionScheduleGuard for connection of clientID. Rules of columns are applied
+// only with queryEncryptor which matches columns of SELECT queries with encryptor config, it may be nil if policy has
+// rules of clients only.
+func NewDecryptionScheduleGuard(policy *DecryptionSchedulePolicy, queryEncryptor *QueryDataEncryptor, clientID []byte) *DecryptionScheduleGuard {
+	return &DecryptionScheduleGuard{policy: policy, queryEncryptor: queryEncryptor, clientID: clientID, now: time.Now}
+}
+
+// ID returns name of this DecryptionSubscriber.
+func (guard *DecryptionScheduleGuard) ID() string {
+	return "DecryptionScheduleGuard"
+}
+
+// OnColumn returns masked value instead of decrypted AcraStruct outside of windows allowed by policy
+func (guard *DecryptionScheduleGuard) OnColumn(ctx context.Context, data []byte) (context.Context, []byte, error) {
+	if _, _, ok := base.DecryptedAcraStructFromContext(ctx); !ok {
+		return ctx, data, nil
+	}
+	var tableName, columnName string
+	columnIndex := -1
+	if columnInfo, ok := base.ColumnInfoFromContext(ctx); ok {
+		columnIndex = columnInfo.Index()
+		if guard.queryEncryptor != nil {
+			if column := guard.queryEncryptor.getSelectColumnSetting(columnIndex); column != nil {
+				tableName, columnName = column.tableName, column.columnName
+			}
+		}
+	}
+	rule := guard.policy.deniedBy(guard.clientID, tableName, columnName, guard.now())
+	if rule == nil {
+		return ctx, data, nil
+	}
+	DecryptionScheduleMaskedCounter.Inc()
+	logger := logging.GetLoggerFromContext(ctx).WithFields(logrus.Fields{
+		"table":        tableName,
+		"column":       columnName,
+		"column_index": columnIndex,
+	})
+	logger.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorDecryptionOutsideSchedule).
+		Warningln("Decrypted value was masked because decryption isn't allowed at this time")
+	return ctx, rule.maskedValue, nil
+}
@@ -0,0 +1,195 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package encryptor
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/cossacklabs/acra/decryptor/base"
+	"github.com/cossacklabs/acra/encryptor/config"
+	"github.com/cossacklabs/acra/sqlparser"
+	"github.com/cossacklabs/acra/sqlparser/dialect/mysql"
+)
+
+func TestParseSchedule(t *testing.T) {
+	// 2020-06-01 is Monday
+	monday := time.Date(2020, 6, 1, 2, 30, 0, 0, time.UTC)
+	sunday := time.Date(2020, 6, 7, 2, 30, 0, 0, time.UTC)
+	testcases := []struct {
+		expression string
+		time       time.Time
+		matches    bool
+	}{
+		{"* * * * *", monday, true},
+		{"30 2 * * *", monday, true},
+		{"31 2 * * *", monday, false},
+		{"*/15 1-3 * * 1-5", monday, true},
+		{"*/20 1-3 * * 1-5", monday, false},
+		{"* 1-3 * * 1-5", sunday, false},
+		{"* * * * 0", sunday, true},
+		{"* * * * 7", sunday, true},
+		{"* * * * 6,7", monday, false},
+		{"0-10,25-35 * * * *", monday, true},
+		{"* * 1 6 *", monday, true},
+		// both day of month and day of week should match
+		{"* * 1 * 0", monday, false},
+		{"* 0-23/2 * */5 *", monday, true},
+	}
+	for i, testcase := range testcases {
+		schedule, err := ParseSchedule(testcase.expression)
+		if err != nil {
+			t.Fatalf("[%d] %v", i, err)
+		}
+		if schedule.Matches(testcase.time) != testcase.matches {
+			t.Fatalf("[%d] Expected '%s' matches %s = %v", i, testcase.expression, testcase.time, testcase.matches)
+		}
+	}
+	for _, expression := range []string{"", "* * * *", "* * * * * *", "60 * * * *", "* 24 * * *", "* * 0 * *",
+		"* * * 13 *", "* * * * 8", "5-1 * * * *", "*/0 * * * *", "a * * * *", "1-a * * * *", "1,,2 * * * *"} {
+		if _, err := ParseSchedule(expression); !errors.Is(err, ErrInvalidDecryptionSchedule) {
+			t.Fatalf("Expected ErrInvalidDecryptionSchedule for '%s', took %v", expression, err)
+		}
+	}
+}
+
+func TestParseDecryptionSchedulePolicy(t *testing.T) {
+	invalidConfigs := []string{
+		"timezone: Unknown/Zone",
+		"clients: [{client_id: client1}]",
+		"clients: [{windows: ['* * * * *']}]",
+		"clients: [{client_id: client1, table: users, windows: ['* * * * *']}]",
+		"columns: [{table: users, windows: ['* * * * *']}]",
+		"columns: [{table: users, column: email, windows: ['* * *']}]",
+		"unknown: value",
+	}
+	for _, configStr := range invalidConfigs {
+		if _, err := ParseDecryptionSchedulePolicy([]byte(configStr)); err == nil {
+			t.Fatalf("Expected error for config '%s'", configStr)
+		}
+	}
+	policy, err := ParseDecryptionSchedulePolicy([]byte("clients: [{client_id: client1, windows: ['* * * * *']}]"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if policy.HasColumnRules() {
+		t.Fatal("Policy shouldn't have rules of columns")
+	}
+}
+
+func TestDecryptionScheduleGuard(t *testing.T) {
+	sqlparser.SetDefaultDialect(mysql.NewMySQLDialect())
+	schemaStore, err := config.MapTableSchemaStoreFromConfig([]byte(`
+schemas:
+  - table: users
+    columns: ["id", "email", "ssn"]
+    encrypted:
+      - column: email
+      - column: ssn
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy, err := ParseDecryptionSchedulePolicy([]byte(`
+timezone: Europe/Kiev
+masked_value: "***"
+clients:
+  - client_id: batch
+    windows: ["* 1-4 * * *"]
+columns:
+  - table: users
+    column: ssn
+    windows: ["* 2 * * *", "* 12 * * *"]
+    masked_value: "XXX"
+  - table: users
+    column: email
+    client_id: reporting
+    windows: ["* 12 * * *"]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !policy.HasColumnRules() {
+		t.Fatal("Policy should have rules of columns")
+	}
+	kiev, err := time.LoadLocation("Europe/Kiev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	night := time.Date(2020, 6, 1, 2, 0, 0, 0, kiev)
+	noon := time.Date(2020, 6, 1, 12, 0, 0, 0, kiev)
+	evening := time.Date(2020, 6, 1, 20, 0, 0, 0, kiev)
+
+	decrypted := []byte("decrypted")
+	testcases := []struct {
+		clientID string
+		column   int
+		time     time.Time
+		expected string
+	}{
+		{"batch", 0, night, "decrypted"},
+		{"batch", 0, noon, "***"},
+		{"batch", 1, night, "decrypted"},
+		// both rules of client and column should allow decryption
+		{"batch", 1, noon, "***"},
+		{"batch", 1, evening, "***"},
+		{"app", 0, evening, "decrypted"},
+		{"app", 1, noon, "decrypted"},
+		{"app", 1, evening, "XXX"},
+		{"reporting", 0, noon, "decrypted"},
+		{"reporting", 0, evening, "***"},
+		// table isn't described by config
+		{"app", 2, evening, "decrypted"},
+	}
+	for i, testcase := range testcases {
+		queryEncryptor, err := NewMysqlQueryEncryptor(schemaStore, []byte(testcase.clientID), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// columns: email, ssn, ssn from other table
+		query := "select email, ssn, o.ssn from users, orders as o"
+		if _, _, err := queryEncryptor.OnQuery(base.NewOnQueryObjectFromQuery(query)); err != nil {
+			t.Fatal(err)
+		}
+		guard := NewDecryptionScheduleGuard(policy, queryEncryptor, []byte(testcase.clientID))
+		guard.now = func() time.Time { return testcase.time }
+		ctx := base.NewContextWithColumnInfo(context.Background(), base.NewColumnInfo(testcase.column, ""))
+		ctx = base.NewContextWithDecryptedAcraStruct(ctx, []byte("acrastruct"), nil)
+		_, data, err := guard.OnColumn(ctx, decrypted)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != testcase.expected {
+			t.Fatalf("[%d] Expected %s, took %s", i, testcase.expected, data)
+		}
+	}
+
+	// rules of clients are applied without encryptor config, values which weren't decrypted aren't masked
+	guard := NewDecryptionScheduleGuard(policy, nil, []byte("batch"))
+	guard.now = func() time.Time { return noon }
+	ctx := base.NewContextWithColumnInfo(context.Background(), base.NewColumnInfo(0, ""))
+	if _, data, _ := guard.OnColumn(ctx, decrypted); !bytes.Equal(data, decrypted) {
+		t.Fatal("Value which wasn't decrypted shouldn't be masked")
+	}
+	ctx = base.NewContextWithDecryptedAcraStruct(ctx, []byte("acrastruct"), nil)
+	if _, data, _ := guard.OnColumn(ctx, decrypted); string(data) != "***" {
+		t.Fatalf("Expected masked value, took %s", data)
+	}
+}
@@ -0,0 +1,200 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package encryptor
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"github.com/cossacklabs/acra/decryptor/base"
+	"github.com/cossacklabs/acra/encryptor/config"
+	"github.com/cossacklabs/acra/keystore"
+	"github.com/cossacklabs/acra/logging"
+	"github.com/cossacklabs/acra/utils"
+	"github.com/cossacklabs/themis/gothemis/keys"
+	"github.com/sirupsen/logrus"
+)
+
+// ErrNoEmbeddedAcraStruct returned when value has no AcraStruct which can be decrypted
+var ErrNoEmbeddedAcraStruct = errors.New("value has no embedded AcraStruct")
+
+// embeddedAcraStructLength returns length of AcraStruct which starts at offset of data if its header fits into data and
+// declares data block which fits too, otherwise false
+func embeddedAcraStructLength(data []byte, offset int) (int, bool) {
+	headerLength := base.GetMinAcraStructLength()
+	if len(data)-offset < headerLength {
+		return 0, false
+	}
+	dataLengthBlock := data[offset+headerLength-base.DataLengthSize : offset+headerLength]
+	dataLength := binary.LittleEndian.Uint64(dataLengthBlock)
+	if dataLength > uint64(len(data)-offset-headerLength) {
+		return 0, false
+	}
+	return headerLength + int(dataLength), true
+}
+
+// embeddedAcraStructDecryption stores result of decryption of embedded AcraStructs of value
+type embeddedAcraStructDecryption struct {
+	data []byte
+	// created is the earliest creation time of decrypted AcraStructs, zero if they have no timestamps
+	created time.Time
+}
+
+// decrypt decrypts AcraStruct embedded into data at offset and returns its length, returns false if there is no
+// AcraStruct or it can't be decrypted with privateKeys
+func (result *embeddedAcraStructDecryption) decrypt(data []byte, offset int, privateKeys []*keys.PrivateKey, zoneID []byte) (int, []byte, bool) {
+	length, ok := embeddedAcraStructLength(data, offset)
+	if !ok {
+		return 0, nil, false
+	}
+	decrypted, created, err := base.DecryptRotatedAcrastructWithTimestamp(data[offset:offset+length], privateKeys, zoneID)
+	if err != nil {
+		return 0, nil, false
+	}
+	if !created.IsZero() && (result.created.IsZero() || created.Before(result.created)) {
+		result.created = created
+	}
+	return length, decrypted, true
+}
+
+// decryptEmbeddedAcraStructs replaces AcraStructs embedded into data according to mode with decrypted data and keeps
+// surrounding bytes as is. Bytes which look like AcraStruct header but can't be decrypted are left too.
+func decryptEmbeddedAcraStructs(mode config.EmbeddedAcraStruct, data []byte, privateKeys []*keys.PrivateKey, zoneID []byte) (*embeddedAcraStructDecryption, error) {
+	result := &embeddedAcraStructDecryption{}
+	switch mode {
+	case config.EmbeddedAcraStructSuffix:
+		for offset := bytes.Index(data, base.TagBegin); offset >= 0; {
+			if length, ok := embeddedAcraStructLength(data, offset); ok && offset+length == len(data) {
+				if _, decrypted, ok := result.decrypt(data, offset, privateKeys, zoneID); ok {
+					result.data = append(append(make([]byte, 0, offset+len(decrypted)), data[:offset]...), decrypted...)
+					return result, nil
+				}
+			}
+			next := bytes.Index(data[offset+1:], base.TagBegin)
+			if next < 0 {
+				break
+			}
+			offset += next + 1
+		}
+	case config.EmbeddedAcraStructSearch:
+		output := make([]byte, 0, len(data))
+		found := false
+		// start of bytes not copied into output yet
+		copied := 0
+		for offset := 0; offset < len(data); {
+			next := bytes.Index(data[offset:], base.TagBegin)
+			if next < 0 {
+				break
+			}
+			offset += next
+			length, decrypted, ok := result.decrypt(data, offset, privateKeys, zoneID)
+			if !ok {
+				offset++
+				continue
+			}
+			output = append(append(output, data[copied:offset]...), decrypted...)
+			found = true
+			offset += length
+			copied = offset
+		}
+		if found {
+			result.data = append(output, data[copied:]...)
+			return result, nil
+		}
+	}
+	return nil, ErrNoEmbeddedAcraStruct
+}
+
+// EmbeddedAcraStructDecryptor is DecryptionSubscriber which decrypts AcraStructs embedded into larger values of result
+// columns of SELECT queries with embedded_acrastruct option, like legacy rows stored as plaintext prefix followed by
+// AcraStruct. Decryptor leaves such values as is because they aren't whole AcraStructs, so it's subscribed right after
+// decryptor to pass decrypted values to other subscribers.
+type EmbeddedAcraStructDecryptor struct {
+	queryEncryptor *QueryDataEncryptor
+	keystore       keystore.PrivateKeyStore
+	clientID       []byte
+}
+
+// NewEmbeddedAcraStructDecryptor returns EmbeddedAcraStructDecryptor which decrypts columns of SELECT queries
+// processed by queryEncryptor for connection of clientID
+func NewEmbeddedAcraStructDecryptor(queryEncryptor *QueryDataEncryptor, keystore keystore.PrivateKeyStore, clientID []byte) *EmbeddedAcraStructDecryptor {
+	return &EmbeddedAcraStructDecryptor{queryEncryptor: queryEncryptor, keystore: keystore, clientID: clientID}
+}
+
+// ID returns name of this DecryptionSubscriber.
+func (decryptor *EmbeddedAcraStructDecryptor) ID() string {
+	return "EmbeddedAcraStructDecryptor"
+}
+
+// privateKeys returns rotated storage private keys and zone id of zone or client id which column is encrypted with
+func (decryptor *EmbeddedAcraStructDecryptor) privateKeys(setting config.ColumnEncryptionSetting) ([]*keys.PrivateKey, []byte, error) {
+	if zoneID := setting.ZoneID(); len(zoneID) > 0 {
+		privateKeys, err := decryptor.keystore.GetZonePrivateKeys(zoneID)
+		return privateKeys, zoneID, err
+	}
+	clientID := setting.ClientID()
+	if len(clientID) == 0 {
+		clientID = decryptor.clientID
+	}
+	privateKeys, err := decryptor.keystore.GetServerDecryptionPrivateKeys(clientID)
+	return privateKeys, nil, err
+}
+
+// OnColumn decrypts AcraStructs embedded into value of column, values without them are returned as is
+func (decryptor *EmbeddedAcraStructDecryptor) OnColumn(ctx context.Context, data []byte) (context.Context, []byte, error) {
+	if _, _, ok := base.DecryptedAcraStructFromContext(ctx); ok {
+		return ctx, data, nil
+	}
+	columnInfo, ok := base.ColumnInfoFromContext(ctx)
+	if !ok || len(data) == 0 {
+		return ctx, data, nil
+	}
+	column := decryptor.queryEncryptor.getSelectColumnSetting(columnInfo.Index())
+	if column == nil || column.setting == nil || column.setting.EmbeddedAcraStruct() == config.EmbeddedAcraStructNone {
+		return ctx, data, nil
+	}
+	if !bytes.Contains(data, base.TagBegin) {
+		return ctx, data, nil
+	}
+	logger := logging.GetLoggerFromContext(ctx).WithFields(logrus.Fields{
+		"table":        column.tableName,
+		"column":       column.columnName,
+		"column_index": columnInfo.Index(),
+	})
+	privateKeys, zoneID, err := decryptor.privateKeys(column.setting)
+	if err != nil {
+		logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorEncryptorCantDecryptEmbedded).
+			Warningln("Can't load keys of column with embedded AcraStructs")
+		return ctx, data, nil
+	}
+	defer utils.ZeroizePrivateKeys(privateKeys)
+	result, err := decryptEmbeddedAcraStructs(column.setting.EmbeddedAcraStruct(), data, privateKeys, zoneID)
+	if err != nil {
+		logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorEncryptorCantDecryptEmbedded).
+			Debugln("Can't decrypt embedded AcraStruct of value")
+		return ctx, data, nil
+	}
+	// guards which replace decrypted value return the whole stored value
+	ctx = base.NewContextWithDecryptedAcraStruct(ctx, data, zoneID)
+	if !result.created.IsZero() {
+		ctx = base.NewContextWithAcraStructCreationTime(ctx, result.created)
+	}
+	return ctx, result.data, nil
+}
@@ -0,0 +1,133 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package encryptor
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	acrawriter "github.com/cossacklabs/acra/acra-writer"
+	"github.com/cossacklabs/acra/decryptor/base"
+	"github.com/cossacklabs/acra/encryptor/config"
+	"github.com/cossacklabs/acra/sqlparser"
+	"github.com/cossacklabs/acra/sqlparser/dialect/mysql"
+	"github.com/cossacklabs/themis/gothemis/keys"
+)
+
+func TestEmbeddedAcraStructDecryptor(t *testing.T) {
+	sqlparser.SetDefaultDialect(mysql.NewMySQLDialect())
+	configStr := `
+schemas:
+  - table: users
+    columns: ["suffix", "search", "zone", "plain"]
+    encrypted:
+      - column: suffix
+        embedded_acrastruct: suffix
+      - column: search
+        embedded_acrastruct: search
+      - column: zone
+        embedded_acrastruct: suffix
+        zone_id: zone1
+      - column: plain
+`
+	schemaStore, err := config.MapTableSchemaStoreFromConfig([]byte(configStr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientKeypair, err := keys.New(keys.TypeEC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zoneKeypair, err := keys.New(keys.TypeEC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keystore := privateKeyStore{"client1": clientKeypair, "zone1": zoneKeypair}
+	queryEncryptor, err := NewMysqlQueryEncryptor(schemaStore, []byte("client1"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := queryEncryptor.OnQuery(base.NewOnQueryObjectFromQuery("select suffix, search, zone, plain from users")); err != nil {
+		t.Fatal(err)
+	}
+	acraStruct := func(data string, keypair *keys.Keypair, zoneID []byte) string {
+		encrypted, err := acrawriter.CreateAcrastruct([]byte(data), keypair.Public, zoneID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(encrypted)
+	}
+	first := acraStruct("first", clientKeypair, nil)
+	second := acraStruct("second", clientKeypair, nil)
+	zoned := acraStruct("zoned", zoneKeypair, []byte("zone1"))
+	foreign := acraStruct("foreign", zoneKeypair, nil)
+	// looks like AcraStruct header with data length larger than value
+	truncated := first[:len(first)-1]
+
+	testcases := []struct {
+		column   int
+		value    string
+		expected string
+	}{
+		{0, "prefix:" + first, "prefix:first"},
+		{0, string(base.TagBegin) + "prefix:" + first, string(base.TagBegin) + "prefix:first"},
+		{0, first + ":suffix", first + ":suffix"},
+		{0, "prefix:" + truncated, "prefix:" + truncated},
+		{0, "prefix:" + foreign, "prefix:" + foreign},
+		{1, "a:" + first + ":b:" + second + ":c", "a:first:b:second:c"},
+		{1, "a:" + truncated + ":b:" + second, "a:" + truncated + ":b:second"},
+		{1, "a:" + foreign + ":b:" + second, "a:" + foreign + ":b:second"},
+		{1, "plaintext", "plaintext"},
+		{2, "prefix:" + zoned, "prefix:zoned"},
+		{2, "prefix:" + first, "prefix:" + first},
+		{3, "prefix:" + first, "prefix:" + first},
+	}
+	decryptor := NewEmbeddedAcraStructDecryptor(queryEncryptor, keystore, []byte("client1"))
+	for i, tcase := range testcases {
+		ctx := base.NewContextWithColumnInfo(context.Background(), base.NewColumnInfo(tcase.column, ""))
+		newCtx, decrypted, err := decryptor.OnColumn(ctx, []byte(tcase.value))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(decrypted) != tcase.expected {
+			t.Fatalf("[%d] Expected %q, took %q", i, tcase.expected, decrypted)
+		}
+		// decrypted values are passed to guards with the whole stored value
+		stored, _, ok := base.DecryptedAcraStructFromContext(newCtx)
+		if changed := tcase.value != tcase.expected; ok != changed || (ok && !bytes.Equal(stored, []byte(tcase.value))) {
+			t.Fatalf("[%d] Unexpected decrypted value in context", i)
+		}
+	}
+
+	// values already decrypted by decryptor are left as is
+	ctx := base.NewContextWithColumnInfo(context.Background(), base.NewColumnInfo(0, ""))
+	ctx = base.NewContextWithDecryptedAcraStruct(ctx, []byte(first), nil)
+	if _, data, _ := decryptor.OnColumn(ctx, []byte("prefix:"+second)); string(data) != "prefix:"+second {
+		t.Fatal("Decrypted value was decrypted again")
+	}
+
+	for _, invalidColumn := range []string{
+		"embedded_acrastruct: prefix",
+		"embedded_acrastruct: suffix\n        format_preserving: digits",
+	} {
+		configStr := "schemas:\n  - table: users\n    encrypted:\n      - column: suffix\n        " + invalidColumn + "\n"
+		if _, err := config.MapTableSchemaStoreFromConfig([]byte(configStr)); err == nil {
+			t.Fatalf("Expected error for %s", invalidColumn)
+		}
+	}
+}
@@ -0,0 +1,298 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package encryptor
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+
+	"github.com/cossacklabs/acra/decryptor/base"
+	"github.com/cossacklabs/acra/encryptor/config"
+	"github.com/cossacklabs/acra/encryptor/fpe"
+	"github.com/cossacklabs/acra/keystore"
+	"github.com/cossacklabs/acra/logging"
+	"github.com/cossacklabs/acra/utils"
+	"github.com/cossacklabs/themis/gothemis/keys"
+	"github.com/sirupsen/logrus"
+)
+
+// ErrInvalidFormatPreservingValue returned for values which don't match format of their format-preserving column
+var ErrInvalidFormatPreservingValue = errors.New("value doesn't match format of format-preserving encrypted column")
+
+// fpeKeyContext separates key of format-preserving encryption from other usages of storage private key
+var fpeKeyContext = []byte("acra format-preserving encryption")
+
+// newFormatPreservingCipher returns cipher of column with AES-256 key derived from storage private key of zone or
+// client id, so columns don't need separate keys and are shredded together with AcraStructs. Ciphertexts don't refer
+// to the key and any key decrypts them into some valid value, so values of the column can be decrypted only with
+// current key and "acra-keys rotate" refuses rotation of such keys of encryptor config.
+func newFormatPreservingCipher(privateKey *keys.PrivateKey, setting config.ColumnEncryptionSetting) (fpe.Cipher, error) {
+	mac := hmac.New(sha256.New, privateKey.Value)
+	mac.Write(fpeKeyContext)
+	key := mac.Sum(nil)
+	defer utils.ZeroizeSymmetricKey(key)
+	radix := 10
+	if setting.FormatPreserving() == config.FormatPreservingUUID {
+		radix = 16
+	}
+	var cipher fpe.Cipher
+	var tweak []byte
+	var err error
+	if setting.FPEAlgorithm() == config.FPEAlgorithmFF31 {
+		tweak = make([]byte, fpe.FF3TweakSize)
+		cipher, err = fpe.NewFF31(key, tweak, radix)
+	} else {
+		cipher, err = fpe.NewFF1(key, tweak, radix)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// short integers and digits like ids or last digits of cards are shorter than minimal length of FF1 and FF3-1
+	return fpe.NewShortDomainCipher(cipher, key, tweak, radix)
+}
+
+// parseDigits returns numerals of decimal digits
+func parseDigits(data []byte) ([]byte, error) {
+	numerals := make([]byte, len(data))
+	for i, digit := range data {
+		if digit < '0' || digit > '9' {
+			return nil, ErrInvalidFormatPreservingValue
+		}
+		numerals[i] = digit - '0'
+	}
+	return numerals, nil
+}
+
+func formatDigits(numerals []byte) []byte {
+	output := make([]byte, len(numerals))
+	for i, numeral := range numerals {
+		output[i] = '0' + numeral
+	}
+	return output
+}
+
+// uuidHyphens are positions of hyphens in canonical text form of UUID
+var uuidHyphens = []int{8, 13, 18, 23}
+
+// transformUUID applies transform to hex digits of UUID in canonical text form, as 32 hex digits or 16 bytes of
+// binary form and returns result in the same form
+func transformUUID(data []byte, transform func([]byte) ([]byte, error)) ([]byte, error) {
+	var raw []byte
+	switch len(data) {
+	case 16:
+		raw = data
+	case 32, 36:
+		digits := data
+		if len(data) == 36 {
+			for _, hyphen := range uuidHyphens {
+				if data[hyphen] != '-' {
+					return nil, ErrInvalidFormatPreservingValue
+				}
+			}
+			digits = bytes.Replace(data, []byte("-"), nil, -1)
+		}
+		if len(digits) != 32 {
+			return nil, ErrInvalidFormatPreservingValue
+		}
+		raw = make([]byte, 16)
+		if _, err := hex.Decode(raw, digits); err != nil {
+			return nil, ErrInvalidFormatPreservingValue
+		}
+	default:
+		return nil, ErrInvalidFormatPreservingValue
+	}
+	numerals := make([]byte, 0, 32)
+	for _, b := range raw {
+		numerals = append(numerals, b>>4, b&0x0f)
+	}
+	numerals, err := transform(numerals)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]byte, 16)
+	for i := range result {
+		result[i] = numerals[2*i]<<4 | numerals[2*i+1]
+	}
+	switch len(data) {
+	case 16:
+		return result, nil
+	case 32:
+		return []byte(hex.EncodeToString(result)), nil
+	}
+	encoded := hex.EncodeToString(result)
+	return []byte(encoded[:8] + "-" + encoded[8:12] + "-" + encoded[12:16] + "-" + encoded[16:20] + "-" + encoded[20:]), nil
+}
+
+// transformFormatPreserving applies transform (encryption or decryption of cipher) to value of format
+func transformFormatPreserving(format config.FormatPreserving, data []byte, transform func([]byte) ([]byte, error)) ([]byte, error) {
+	switch format {
+	case config.FormatPreservingDigits:
+		numerals, err := parseDigits(data)
+		if err != nil {
+			return nil, err
+		}
+		result, err := transform(numerals)
+		if err != nil {
+			return nil, err
+		}
+		return formatDigits(result), nil
+	case config.FormatPreservingInteger:
+		sign, digits := data[:0], data
+		if len(data) > 0 && data[0] == '-' {
+			sign, digits = data[:1], data[1:]
+		}
+		numerals, err := parseDigits(digits)
+		if err != nil {
+			return nil, err
+		}
+		// zero is the only integer starting with zero but it has no sign
+		nonZero := len(numerals) > 1 || len(sign) > 0
+		if len(numerals) == 0 || (nonZero && numerals[0] == 0) {
+			return nil, ErrInvalidFormatPreservingValue
+		}
+		// cycle walking: numbers with leading zero are encrypted again until result has the same number of digits,
+		// it's a permutation of numbers without leading zeros. Non-negative one-digit numbers are permuted with zero
+		result, err := transform(numerals)
+		for err == nil && nonZero && result[0] == 0 {
+			result, err = transform(result)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return append(append([]byte{}, sign...), formatDigits(result)...), nil
+	case config.FormatPreservingUUID:
+		return transformUUID(data, transform)
+	}
+	return nil, ErrInvalidFormatPreservingValue
+}
+
+// FormatPreservingDataEncryptor encrypts values of columns with format_preserving option with FF1 or FF3-1 and passes
+// values of other columns to wrapped DataEncryptor
+type FormatPreservingDataEncryptor struct {
+	keystore      keystore.PrivateKeyStore
+	dataEncryptor DataEncryptor
+}
+
+// NewFormatPreservingDataEncryptor returns FormatPreservingDataEncryptor which uses storage private keys from keystore
+func NewFormatPreservingDataEncryptor(keystore keystore.PrivateKeyStore, dataEncryptor DataEncryptor) (*FormatPreservingDataEncryptor, error) {
+	return &FormatPreservingDataEncryptor{keystore: keystore, dataEncryptor: dataEncryptor}, nil
+}
+
+// encryptFormatPreserving encrypts data with format-preserving cipher of privateKey
+func encryptFormatPreserving(privateKey *keys.PrivateKey, data []byte, setting config.ColumnEncryptionSetting) ([]byte, error) {
+	defer utils.ZeroizePrivateKey(privateKey)
+	cipher, err := newFormatPreservingCipher(privateKey, setting)
+	if err != nil {
+		return nil, err
+	}
+	return transformFormatPreserving(setting.FormatPreserving(), data, cipher.Encrypt)
+}
+
+// EncryptWithZoneID encrypt with explicit zone id
+func (encryptor *FormatPreservingDataEncryptor) EncryptWithZoneID(zoneID, data []byte, setting config.ColumnEncryptionSetting) ([]byte, error) {
+	if setting.FormatPreserving() == config.FormatPreservingNone {
+		return encryptor.dataEncryptor.EncryptWithZoneID(zoneID, data, setting)
+	}
+	privateKey, err := encryptor.keystore.GetZonePrivateKey(zoneID)
+	if err != nil {
+		return nil, err
+	}
+	return encryptFormatPreserving(privateKey, data, setting)
+}
+
+// EncryptWithClientID encrypt with explicit client id
+func (encryptor *FormatPreservingDataEncryptor) EncryptWithClientID(clientID, data []byte, setting config.ColumnEncryptionSetting) ([]byte, error) {
+	if setting.FormatPreserving() == config.FormatPreservingNone {
+		return encryptor.dataEncryptor.EncryptWithClientID(clientID, data, setting)
+	}
+	privateKey, err := encryptor.keystore.GetServerDecryptionPrivateKey(clientID)
+	if err != nil {
+		return nil, err
+	}
+	return encryptFormatPreserving(privateKey, data, setting)
+}
+
+// FormatPreservingDecryptor is DecryptionSubscriber which decrypts values of result columns of SELECT queries
+// encrypted with format-preserving encryption. Decryptor doesn't recognize them because they aren't AcraStructs, so
+// it's subscribed right after decryptor to pass decrypted values to other subscribers.
+type FormatPreservingDecryptor struct {
+	queryEncryptor *QueryDataEncryptor
+	keystore       keystore.PrivateKeyStore
+	clientID       []byte
+}
+
+// NewFormatPreservingDecryptor returns FormatPreservingDecryptor which decrypts columns of SELECT queries processed by
+// queryEncryptor for connection of clientID
+func NewFormatPreservingDecryptor(queryEncryptor *QueryDataEncryptor, keystore keystore.PrivateKeyStore, clientID []byte) *FormatPreservingDecryptor {
+	return &FormatPreservingDecryptor{queryEncryptor: queryEncryptor, keystore: keystore, clientID: clientID}
+}
+
+// ID returns name of this DecryptionSubscriber.
+func (decryptor *FormatPreservingDecryptor) ID() string {
+	return "FormatPreservingDecryptor"
+}
+
+// privateKey returns storage private key of zone or client id which column is encrypted with
+func (decryptor *FormatPreservingDecryptor) privateKey(setting config.ColumnEncryptionSetting) (*keys.PrivateKey, error) {
+	if zoneID := setting.ZoneID(); len(zoneID) > 0 {
+		return decryptor.keystore.GetZonePrivateKey(zoneID)
+	}
+	clientID := setting.ClientID()
+	if len(clientID) == 0 {
+		clientID = decryptor.clientID
+	}
+	return decryptor.keystore.GetServerDecryptionPrivateKey(clientID)
+}
+
+// OnColumn decrypts value of format-preserving encrypted column, values which can't be decrypted are returned as is
+func (decryptor *FormatPreservingDecryptor) OnColumn(ctx context.Context, data []byte) (context.Context, []byte, error) {
+	columnInfo, ok := base.ColumnInfoFromContext(ctx)
+	if !ok || len(data) == 0 {
+		return ctx, data, nil
+	}
+	column := decryptor.queryEncryptor.getSelectColumnSetting(columnInfo.Index())
+	if column == nil || column.setting == nil || column.setting.FormatPreserving() == config.FormatPreservingNone {
+		return ctx, data, nil
+	}
+	logger := logging.GetLoggerFromContext(ctx).WithFields(logrus.Fields{
+		"table":        column.tableName,
+		"column":       column.columnName,
+		"column_index": columnInfo.Index(),
+	})
+	privateKey, err := decryptor.privateKey(column.setting)
+	if err != nil {
+		logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorEncryptorCantDecryptFPE).
+			Warningln("Can't load key of format-preserving encrypted column")
+		return ctx, data, nil
+	}
+	defer utils.ZeroizePrivateKey(privateKey)
+	cipher, err := newFormatPreservingCipher(privateKey, column.setting)
+	if err == nil {
+		var decrypted []byte
+		decrypted, err = transformFormatPreserving(column.setting.FormatPreserving(), data, cipher.Decrypt)
+		if err == nil {
+			return ctx, decrypted, nil
+		}
+	}
+	logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorEncryptorCantDecryptFPE).
+		Warningln("Can't decrypt value of format-preserving encrypted column")
+	return ctx, data, nil
+}
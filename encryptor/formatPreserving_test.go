@@ -0,0 +1,232 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package encryptor
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"regexp"
+	"testing"
+
+	"github.com/cossacklabs/acra/decryptor/base"
+	"github.com/cossacklabs/acra/encryptor/config"
+	"github.com/cossacklabs/acra/sqlparser"
+	"github.com/cossacklabs/acra/sqlparser/dialect/mysql"
+	"github.com/cossacklabs/themis/gothemis/keys"
+)
+
+// privateKeyStore returns copies of private keys per zone or client id, like keystores which zeroize them after use
+type privateKeyStore map[string]*keys.Keypair
+
+func (store privateKeyStore) key(id []byte) (*keys.PrivateKey, error) {
+	keypair, ok := store[string(id)]
+	if !ok {
+		return nil, errors.New("key not found")
+	}
+	return &keys.PrivateKey{Value: append([]byte{}, keypair.Private.Value...)}, nil
+}
+
+func (store privateKeyStore) HasZonePrivateKey(id []byte) bool {
+	_, ok := store[string(id)]
+	return ok
+}
+
+func (store privateKeyStore) GetZonePrivateKey(id []byte) (*keys.PrivateKey, error) {
+	return store.key(id)
+}
+
+func (store privateKeyStore) GetZonePrivateKeys(id []byte) ([]*keys.PrivateKey, error) {
+	key, err := store.key(id)
+	return []*keys.PrivateKey{key}, err
+}
+
+func (store privateKeyStore) GetServerDecryptionPrivateKey(id []byte) (*keys.PrivateKey, error) {
+	return store.key(id)
+}
+
+func (store privateKeyStore) GetServerDecryptionPrivateKeys(id []byte) ([]*keys.PrivateKey, error) {
+	key, err := store.key(id)
+	return []*keys.PrivateKey{key}, err
+}
+
+// insertedValues returns values of the first row of INSERT query
+func insertedValues(t *testing.T, query string) []string {
+	statement, err := sqlparser.Parse(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var values []string
+	for _, value := range statement.(*sqlparser.Insert).Rows.(sqlparser.Values)[0] {
+		values = append(values, string(value.(*sqlparser.SQLVal).Val))
+	}
+	return values
+}
+
+func TestFormatPreservingEncryption(t *testing.T) {
+	sqlparser.SetDefaultDialect(mysql.NewMySQLDialect())
+	configStr := `
+schemas:
+  - table: users
+    columns: ["id", "code", "uid", "email"]
+    encrypted:
+      - column: id
+        format_preserving: integer
+      - column: code
+        format_preserving: digits
+        fpe_algorithm: ff3-1
+      - column: uid
+        format_preserving: uuid
+        zone_id: zone1
+      - column: email
+`
+	schemaStore, err := config.MapTableSchemaStoreFromConfig([]byte(configStr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientKeypair, err := keys.New(keys.TypeEC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zoneKeypair, err := keys.New(keys.TypeEC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keystore := privateKeyStore{"client1": clientKeypair, "zone1": zoneKeypair}
+	acrawriterEncryptor, err := NewAcrawriterDataEncryptor(&keyStore{keypair: clientKeypair})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataEncryptor, err := NewFormatPreservingDataEncryptor(keystore, acrawriterEncryptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queryEncryptor, err := NewMysqlQueryEncryptor(schemaStore, []byte("client1"), dataEncryptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plaintexts := []string{"123456789", "0012345678", "c2d29867-3d0b-d497-9191-18a9d8ee7830", "user@example.com"}
+	query, changed, err := queryEncryptor.OnQuery(base.NewOnQueryObjectFromQuery(
+		"insert into users (id, code, uid, email) values (123456789, '0012345678', 'c2d29867-3d0b-d497-9191-18a9d8ee7830', 'user@example.com')"))
+	if err != nil || !changed {
+		t.Fatalf("Expected encrypted query, took %v", err)
+	}
+	encrypted := insertedValues(t, query.Query())
+	formats := []*regexp.Regexp{
+		regexp.MustCompile(`^[1-9][0-9]{8}$`),
+		regexp.MustCompile(`^[0-9]{10}$`),
+		regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`),
+	}
+	for i, format := range formats {
+		if encrypted[i] == plaintexts[i] || !format.MatchString(encrypted[i]) {
+			t.Fatalf("[%d] Unexpected encrypted value %s", i, encrypted[i])
+		}
+	}
+	if err := base.ValidateAcraStructLength([]byte(encrypted[3])); err != nil {
+		t.Fatal("Column without format_preserving isn't encrypted into AcraStruct")
+	}
+
+	// compared values are encrypted the same way to match stored ones
+	query, changed, err = queryEncryptor.OnQuery(base.NewOnQueryObjectFromQuery(
+		"select id, code, uid, email from users where id = 123456789 and code in ('0012345678') and email = 'user@example.com'"))
+	if err != nil || !changed {
+		t.Fatalf("Expected encrypted query, took %v", err)
+	}
+	expectedQuery := "select id, code, uid, email from users where id = " + encrypted[0] + " and code in ('" + encrypted[1] + "') and email = 'user@example.com'"
+	if query.Query() != expectedQuery {
+		t.Fatalf("Expected %s, took %s", expectedQuery, query.Query())
+	}
+
+	decryptor := NewFormatPreservingDecryptor(queryEncryptor, keystore, []byte("client1"))
+	for i, value := range encrypted {
+		ctx := base.NewContextWithColumnInfo(context.Background(), base.NewColumnInfo(i, ""))
+		_, decrypted, err := decryptor.OnColumn(ctx, []byte(value))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// AcraStructs are left to decryptor
+		expected := plaintexts[i]
+		if i == 3 {
+			expected = value
+		}
+		if string(decrypted) != expected {
+			t.Fatalf("[%d] Expected %s, took %s", i, expected, decrypted)
+		}
+	}
+	// UUID in binary form of PostgreSQL protocol
+	uuidSetting := schemaStore.GetTableSchema("users").GetColumnEncryptionSettings("uid")
+	binaryUUID := bytes.Repeat([]byte{0xab}, 16)
+	encryptedUUID, err := dataEncryptor.EncryptWithZoneID([]byte("zone1"), binaryUUID, uuidSetting)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := base.NewContextWithColumnInfo(context.Background(), base.NewColumnInfo(2, ""))
+	if _, decrypted, _ := decryptor.OnColumn(ctx, encryptedUUID); len(encryptedUUID) != 16 || !bytes.Equal(decrypted, binaryUUID) {
+		t.Fatal("Binary UUID wasn't encrypted into binary UUID")
+	}
+
+	// short ids and digits are shorter than minimal length of FF1 and FF3-1
+	for _, values := range [][2]string{{"0", "1234"}, {"7", "5"}, {"-7", "12"}, {"42", "00"}, {"12345", "12345"}, {"-12", ""}} {
+		query, changed, err := queryEncryptor.OnQuery(base.NewOnQueryObjectFromQuery(
+			"insert into users (id, code) values (" + values[0] + ", '" + values[1] + "')"))
+		if err != nil || !changed {
+			t.Fatalf("Expected encrypted query for %v, took %v", values, err)
+		}
+		encrypted := insertedValues(t, query.Query())
+		integerFormat := regexp.MustCompile(`^[0-9]$|^-?[1-9][0-9]*$`)
+		if len(encrypted[0]) != len(values[0]) || !integerFormat.MatchString(encrypted[0]) || (values[0][0] == '-') != (encrypted[0][0] == '-') {
+			t.Fatalf("Unexpected encrypted id %s of %s", encrypted[0], values[0])
+		}
+		if len(encrypted[1]) != len(values[1]) || !regexp.MustCompile(`^[0-9]*$`).MatchString(encrypted[1]) {
+			t.Fatalf("Unexpected encrypted code %s of %s", encrypted[1], values[1])
+		}
+		// decryptor uses columns of the last SELECT query
+		if _, _, err := queryEncryptor.OnQuery(base.NewOnQueryObjectFromQuery("select id, code from users")); err != nil {
+			t.Fatal(err)
+		}
+		for i, value := range encrypted {
+			ctx := base.NewContextWithColumnInfo(context.Background(), base.NewColumnInfo(i, ""))
+			if _, decrypted, _ := decryptor.OnColumn(ctx, []byte(value)); string(decrypted) != values[i] {
+				t.Fatalf("[%d] Expected %s, took %s", i, values[i], decrypted)
+			}
+		}
+	}
+
+	// values which don't match format are rejected instead of storing them unencrypted
+	for _, query := range []string{
+		"insert into users (id) values ('12345a')",
+		"insert into users (id) values (0123456)",
+		"insert into users (uid) values ('not uuid')",
+	} {
+		if _, _, err := queryEncryptor.OnQuery(base.NewOnQueryObjectFromQuery(query)); err == nil {
+			t.Fatalf("Expected error for %s", query)
+		}
+	}
+
+	for _, invalidColumn := range []string{
+		"format_preserving: hex",
+		"format_preserving: uuid\n        fpe_algorithm: ff3",
+		"fpe_algorithm: ff1",
+		"format_preserving: digits\n        compression: deflate",
+	} {
+		configStr := "schemas:\n  - table: users\n    encrypted:\n      - column: id\n        " + invalidColumn + "\n"
+		if _, err := config.MapTableSchemaStoreFromConfig([]byte(configStr)); !errors.Is(err, config.ErrInvalidSchemaConfig) {
+			t.Fatalf("Expected ErrInvalidSchemaConfig for %s, took %v", invalidColumn, err)
+		}
+	}
+}
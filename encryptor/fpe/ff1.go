@@ -0,0 +1,143 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fpe
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"math"
+	"math/big"
+)
+
+const ff1Rounds = 10
+
+// FF1 is FF1 cipher with fixed key, tweak and radix
+type FF1 struct {
+	block  cipher.Block
+	tweak  []byte
+	radix  int
+	minLen int
+}
+
+// NewFF1 returns FF1 cipher with AES key of 16, 24 or 32 bytes and tweak of any length for numerals of radix from 2
+// to 256
+func NewFF1(key, tweak []byte, radix int) (*FF1, error) {
+	if radix < 2 || radix > 256 {
+		return nil, ErrInvalidRadix
+	}
+	if uint64(len(tweak)) > math.MaxUint32 {
+		return nil, ErrInvalidTweak
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return &FF1{block: block, tweak: append([]byte{}, tweak...), radix: radix, minLen: minLength(radix)}, nil
+}
+
+// prf returns CBC-MAC of data with zero IV, data length is multiple of block size
+func (c *FF1) prf(data []byte) []byte {
+	mac := make([]byte, aes.BlockSize)
+	for i := 0; i < len(data); i += aes.BlockSize {
+		for j := 0; j < aes.BlockSize; j++ {
+			mac[j] ^= data[i+j]
+		}
+		c.block.Encrypt(mac, mac)
+	}
+	return mac
+}
+
+// roundNumber returns y of round i calculated from numeral string x of the other half
+func (c *FF1) roundNumber(p []byte, i int, x []byte, b, d int) *big.Int {
+	t := len(c.tweak)
+	padding := ((-t-b-1)%16 + 16) % 16
+	q := make([]byte, 0, t+padding+1+b)
+	q = append(q, c.tweak...)
+	q = append(q, make([]byte, padding)...)
+	q = append(q, byte(i))
+	q = append(q, numBytes(num(x, c.radix), b)...)
+	r := c.prf(append(append([]byte{}, p...), q...))
+
+	s := append([]byte{}, r...)
+	for j := 1; len(s) < d; j++ {
+		block := append([]byte{}, r...)
+		counter := make([]byte, aes.BlockSize)
+		binary.BigEndian.PutUint64(counter[8:], uint64(j))
+		for k := range block {
+			block[k] ^= counter[k]
+		}
+		c.block.Encrypt(block, block)
+		s = append(s, block...)
+	}
+	return new(big.Int).SetBytes(s[:d])
+}
+
+// params returns lengths of halves u and v, b and d of the algorithm and block P for numeral string of length n
+func (c *FF1) params(n int) (int, int, int, int, []byte) {
+	u := n / 2
+	v := n - u
+	// ceil(ceil(v*log2(radix))/8)
+	b := (new(big.Int).Sub(power(c.radix, v), big.NewInt(1)).BitLen() + 7) / 8
+	d := 4*((b+3)/4) + 4
+	p := []byte{1, 2, 1, 0, byte(c.radix >> 8), byte(c.radix), 10, byte(u % 256), 0, 0, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(p[8:12], uint32(n))
+	binary.BigEndian.PutUint32(p[12:16], uint32(len(c.tweak)))
+	return u, v, b, d, p
+}
+
+// Encrypt returns ciphertext of numerals with the same length
+func (c *FF1) Encrypt(numerals []byte) ([]byte, error) {
+	if err := validateNumerals(numerals, c.radix, c.minLen, math.MaxInt32); err != nil {
+		return nil, err
+	}
+	u, v, b, d, p := c.params(len(numerals))
+	a, bHalf := numerals[:u], numerals[u:]
+	for i := 0; i < ff1Rounds; i++ {
+		m := u
+		if i%2 == 1 {
+			m = v
+		}
+		y := c.roundNumber(p, i, bHalf, b, d)
+		result := num(a, c.radix)
+		result.Add(result, y)
+		result.Mod(result, power(c.radix, m))
+		a, bHalf = bHalf, str(result, c.radix, m)
+	}
+	return append(append([]byte{}, a...), bHalf...), nil
+}
+
+// Decrypt returns plaintext of numerals encrypted by Encrypt
+func (c *FF1) Decrypt(numerals []byte) ([]byte, error) {
+	if err := validateNumerals(numerals, c.radix, c.minLen, math.MaxInt32); err != nil {
+		return nil, err
+	}
+	u, v, b, d, p := c.params(len(numerals))
+	a, bHalf := numerals[:u], numerals[u:]
+	for i := ff1Rounds - 1; i >= 0; i-- {
+		m := u
+		if i%2 == 1 {
+			m = v
+		}
+		y := c.roundNumber(p, i, a, b, d)
+		result := num(bHalf, c.radix)
+		result.Sub(result, y)
+		result.Mod(result, power(c.radix, m))
+		a, bHalf = str(result, c.radix, m), a
+	}
+	return append(append([]byte{}, a...), bHalf...), nil
+}
@@ -0,0 +1,126 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fpe
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"math/big"
+)
+
+const ff3Rounds = 8
+
+// FF3TweakSize is size of tweak of FF3-1 in bytes
+const FF3TweakSize = 7
+
+// FF31 is FF3-1 cipher with fixed key, tweak and radix
+type FF31 struct {
+	block cipher.Block
+	// tweakLeft and tweakRight are halves of 56-bit tweak used in odd and even rounds
+	tweakLeft, tweakRight [4]byte
+	radix                 int
+	minLen, maxLen        int
+}
+
+// NewFF31 returns FF3-1 cipher with AES key of 16, 24 or 32 bytes and tweak of FF3TweakSize bytes for numerals of
+// radix from 2 to 256
+func NewFF31(key, tweak []byte, radix int) (*FF31, error) {
+	if len(tweak) != FF3TweakSize {
+		return nil, ErrInvalidTweak
+	}
+	var left, right [4]byte
+	copy(left[:], tweak[:3])
+	left[3] = tweak[3] & 0xf0
+	copy(right[:], tweak[4:])
+	right[3] = tweak[3] << 4
+	return newFF3(key, left, right, radix)
+}
+
+// newFF3 returns cipher with already split tweak, so core of FF3-1 is the same as of FF3 with 64-bit tweak
+func newFF3(key []byte, tweakLeft, tweakRight [4]byte, radix int) (*FF31, error) {
+	if radix < 2 || radix > 256 {
+		return nil, ErrInvalidRadix
+	}
+	// block cipher key is reversed
+	block, err := aes.NewCipher(reverse(key))
+	if err != nil {
+		return nil, err
+	}
+	// 2*floor(log_radix(2^96))
+	maxLen := 0
+	for limit := new(big.Int).Lsh(big.NewInt(1), 96); power(radix, maxLen+1).Cmp(limit) <= 0; {
+		maxLen++
+	}
+	return &FF31{block: block, tweakLeft: tweakLeft, tweakRight: tweakRight, radix: radix, minLen: minLength(radix), maxLen: 2 * maxLen}, nil
+}
+
+// roundNumber returns y of round i calculated from numeral string x of the other half
+func (c *FF31) roundNumber(i int, x []byte) *big.Int {
+	w := c.tweakRight
+	if i%2 == 1 {
+		w = c.tweakLeft
+	}
+	p := make([]byte, aes.BlockSize)
+	copy(p, w[:])
+	p[3] ^= byte(i)
+	copy(p[4:], numBytes(num(reverse(x), c.radix), 12))
+	p = reverse(p)
+	c.block.Encrypt(p, p)
+	return new(big.Int).SetBytes(reverse(p))
+}
+
+// Encrypt returns ciphertext of numerals with the same length
+func (c *FF31) Encrypt(numerals []byte) ([]byte, error) {
+	if err := validateNumerals(numerals, c.radix, c.minLen, c.maxLen); err != nil {
+		return nil, err
+	}
+	u := (len(numerals) + 1) / 2
+	v := len(numerals) - u
+	a, b := numerals[:u], numerals[u:]
+	for i := 0; i < ff3Rounds; i++ {
+		m := u
+		if i%2 == 1 {
+			m = v
+		}
+		result := num(reverse(a), c.radix)
+		result.Add(result, c.roundNumber(i, b))
+		result.Mod(result, power(c.radix, m))
+		a, b = b, reverse(str(result, c.radix, m))
+	}
+	return append(append([]byte{}, a...), b...), nil
+}
+
+// Decrypt returns plaintext of numerals encrypted by Encrypt
+func (c *FF31) Decrypt(numerals []byte) ([]byte, error) {
+	if err := validateNumerals(numerals, c.radix, c.minLen, c.maxLen); err != nil {
+		return nil, err
+	}
+	u := (len(numerals) + 1) / 2
+	v := len(numerals) - u
+	a, b := numerals[:u], numerals[u:]
+	for i := ff3Rounds - 1; i >= 0; i-- {
+		m := u
+		if i%2 == 1 {
+			m = v
+		}
+		result := num(reverse(b), c.radix)
+		result.Sub(result, c.roundNumber(i, a))
+		result.Mod(result, power(c.radix, m))
+		a, b = reverse(str(result, c.radix, m)), a
+	}
+	return append(append([]byte{}, a...), b...), nil
+}
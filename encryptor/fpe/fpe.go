@@ -0,0 +1,110 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package fpe implements format-preserving encryption modes FF1 and FF3-1 of NIST SP 800-38G with AES. They encrypt
+// string of numerals of some radix into string of numerals of the same radix and length, so encrypted UUIDs and
+// digits fit into columns of original types. Encryption is deterministic: equal values with the same key and tweak
+// are encrypted into equal ciphertexts.
+package fpe
+
+import (
+	"errors"
+	"math/big"
+)
+
+// Errors returned for invalid parameters of ciphers or numeral strings
+var (
+	ErrInvalidRadix  = errors.New("unsupported radix")
+	ErrInvalidLength = errors.New("invalid length of numeral string")
+	ErrInvalidNumber = errors.New("numeral is out of radix")
+	ErrInvalidTweak  = errors.New("invalid tweak length")
+)
+
+// minDomainSize is minimal number of possible values of numeral string, radix^minlen >= 1000000 by SP 800-38G Rev. 1
+const minDomainSize = 1000000
+
+// Cipher encrypts numeral strings, numerals are values from 0 to radix-1
+type Cipher interface {
+	Encrypt(numerals []byte) ([]byte, error)
+	Decrypt(numerals []byte) ([]byte, error)
+}
+
+// minLength returns minimal length of numeral strings of radix
+func minLength(radix int) int {
+	length := 1
+	for size := radix; size < minDomainSize; size *= radix {
+		length++
+	}
+	return length
+}
+
+// validateNumerals checks that numeral string has length from minLen to maxLen and its numerals are less than radix
+func validateNumerals(numerals []byte, radix, minLen, maxLen int) error {
+	if len(numerals) < minLen || len(numerals) > maxLen {
+		return ErrInvalidLength
+	}
+	for _, numeral := range numerals {
+		if int(numeral) >= radix {
+			return ErrInvalidNumber
+		}
+	}
+	return nil
+}
+
+// num returns number represented by numeral string of radix, most significant numeral first
+func num(numerals []byte, radix int) *big.Int {
+	result := new(big.Int)
+	bigRadix := big.NewInt(int64(radix))
+	for _, numeral := range numerals {
+		result.Mul(result, bigRadix)
+		result.Add(result, big.NewInt(int64(numeral)))
+	}
+	return result
+}
+
+// str returns numeral string of radix with length numerals which represents x, x should be less than radix^length
+func str(x *big.Int, radix, length int) []byte {
+	numerals := make([]byte, length)
+	value := new(big.Int).Set(x)
+	bigRadix := big.NewInt(int64(radix))
+	remainder := new(big.Int)
+	for i := length - 1; i >= 0; i-- {
+		value.QuoRem(value, bigRadix, remainder)
+		numerals[i] = byte(remainder.Int64())
+	}
+	return numerals
+}
+
+// numBytes returns big-endian representation of x in length bytes
+func numBytes(x *big.Int, length int) []byte {
+	output := make([]byte, length)
+	raw := x.Bytes()
+	copy(output[length-len(raw):], raw)
+	return output
+}
+
+// power returns radix^exponent
+func power(radix, exponent int) *big.Int {
+	return new(big.Int).Exp(big.NewInt(int64(radix)), big.NewInt(int64(exponent)), nil)
+}
+
+func reverse(numerals []byte) []byte {
+	output := make([]byte, len(numerals))
+	for i, numeral := range numerals {
+		output[len(numerals)-1-i] = numeral
+	}
+	return output
+}
@@ -0,0 +1,306 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fpe
+
+import (
+	"bytes"
+	"encoding/hex"
+	"math/big"
+	"strings"
+	"testing"
+)
+
+const testAlphabet = "0123456789abcdefghijklmnopqrstuvwxyz"
+
+func toNumerals(t *testing.T, value string) []byte {
+	numerals := make([]byte, len(value))
+	for i, char := range value {
+		index := strings.IndexRune(testAlphabet, char)
+		if index < 0 {
+			t.Fatalf("Invalid numeral %c", char)
+		}
+		numerals[i] = byte(index)
+	}
+	return numerals
+}
+
+func fromNumerals(numerals []byte) string {
+	output := make([]byte, len(numerals))
+	for i, numeral := range numerals {
+		output[i] = testAlphabet[numeral]
+	}
+	return string(output)
+}
+
+func decodeHex(t *testing.T, value string) []byte {
+	decoded, err := hex.DecodeString(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return decoded
+}
+
+func testCipher(t *testing.T, name string, cipher Cipher, plaintext, ciphertext string) {
+	encrypted, err := cipher.Encrypt(toNumerals(t, plaintext))
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	if fromNumerals(encrypted) != ciphertext {
+		t.Fatalf("%s: expected %s, took %s", name, ciphertext, fromNumerals(encrypted))
+	}
+	decrypted, err := cipher.Decrypt(encrypted)
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	if fromNumerals(decrypted) != plaintext {
+		t.Fatalf("%s: expected decrypted %s, took %s", name, plaintext, fromNumerals(decrypted))
+	}
+}
+
+// samples of NIST SP 800-38G
+func TestFF1(t *testing.T) {
+	testCases := []struct {
+		name, key, tweak      string
+		radix                 int
+		plaintext, ciphertext string
+	}{
+		{"sample 1", "2B7E151628AED2A6ABF7158809CF4F3C", "", 10, "0123456789", "2433477484"},
+		{"sample 2", "2B7E151628AED2A6ABF7158809CF4F3C", "39383736353433323130", 10, "0123456789", "6124200773"},
+		{"sample 3", "2B7E151628AED2A6ABF7158809CF4F3C", "3737373770717273373737", 36, "0123456789abcdefghi", "a9tv40mll9kdu509eum"},
+		{"sample 7", "2B7E151628AED2A6ABF7158809CF4F3CEF4359D8D580AA4F7F036D6F04FC6A94", "", 10, "0123456789", "6657667009"},
+		{"sample 9", "2B7E151628AED2A6ABF7158809CF4F3CEF4359D8D580AA4F7F036D6F04FC6A94", "3737373770717273373737", 36, "0123456789abcdefghi", "xs8a0azh2avyalyzuwd"},
+	}
+	for _, testCase := range testCases {
+		cipher, err := NewFF1(decodeHex(t, testCase.key), decodeHex(t, testCase.tweak), testCase.radix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testCipher(t, testCase.name, cipher, testCase.plaintext, testCase.ciphertext)
+	}
+}
+
+// samples of FF3 with 64-bit tweaks, FF3-1 differs only by splitting of tweak
+func TestFF3(t *testing.T) {
+	testCases := []struct {
+		name, key, tweak      string
+		radix                 int
+		plaintext, ciphertext string
+	}{
+		{"sample 1", "EF4359D8D580AA4F7F036D6F04FC6A94", "D8E7920AFA330A73", 10, "890121234567890000", "750918814058654607"},
+		{"sample 2", "EF4359D8D580AA4F7F036D6F04FC6A94", "9A768A92F60E12D8", 10, "890121234567890000", "018989839189395384"},
+	}
+	for _, testCase := range testCases {
+		tweak := decodeHex(t, testCase.tweak)
+		var left, right [4]byte
+		copy(left[:], tweak[:4])
+		copy(right[:], tweak[4:])
+		cipher, err := newFF3(decodeHex(t, testCase.key), left, right, testCase.radix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testCipher(t, testCase.name, cipher, testCase.plaintext, testCase.ciphertext)
+	}
+}
+
+func TestFF31(t *testing.T) {
+	key := decodeHex(t, "EF4359D8D580AA4F7F036D6F04FC6A94")
+	// first 28 bits of tweak are left half and last 24 bits with 4 bits in between are right one
+	cipher, err := NewFF31(key, decodeHex(t, "D8E792AFA330A0"), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(cipher.tweakLeft[:], decodeHex(t, "D8E792A0")) || !bytes.Equal(cipher.tweakRight[:], decodeHex(t, "A330A0F0")) {
+		t.Fatalf("Unexpected tweak halves %x %x", cipher.tweakLeft, cipher.tweakRight)
+	}
+	plaintext := toNumerals(t, "890121234567890000")
+	encrypted, err := cipher.Encrypt(plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(encrypted, plaintext) || len(encrypted) != len(plaintext) {
+		t.Fatal("Unexpected ciphertext")
+	}
+	decrypted, err := cipher.Decrypt(encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decrypted, plaintext) {
+		t.Fatal("Decrypted value doesn't match plaintext")
+	}
+
+	if _, err := NewFF31(key, make([]byte, 8), 10); err != ErrInvalidTweak {
+		t.Fatalf("Expected ErrInvalidTweak, took %v", err)
+	}
+	// maxlen of radix 10 is 2*floor(log10(2^96)) = 56
+	if _, err := cipher.Encrypt(make([]byte, 57)); err != ErrInvalidLength {
+		t.Fatalf("Expected ErrInvalidLength, took %v", err)
+	}
+	if _, err := cipher.Encrypt(make([]byte, 56)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNumeralsValidation(t *testing.T) {
+	key := make([]byte, 32)
+	ff1, err := NewFF1(key, nil, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ff31, err := NewFF31(key, make([]byte, FF3TweakSize), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cipher := range []Cipher{ff1, ff31} {
+		// radix^minlen >= 1000000
+		if _, err := cipher.Encrypt(make([]byte, 5)); err != ErrInvalidLength {
+			t.Fatalf("Expected ErrInvalidLength, took %v", err)
+		}
+		if _, err := cipher.Decrypt([]byte{0, 1, 2, 3, 4, 10}); err != ErrInvalidNumber {
+			t.Fatalf("Expected ErrInvalidNumber, took %v", err)
+		}
+	}
+	if _, err := NewFF1(key, nil, 1); err != ErrInvalidRadix {
+		t.Fatalf("Expected ErrInvalidRadix, took %v", err)
+	}
+	if minLength(16) != 5 || minLength(10) != 6 {
+		t.Fatal("Unexpected minimal lengths")
+	}
+}
+
+func TestShortDomainCipher(t *testing.T) {
+	key := make([]byte, 32)
+	for radix, lengths := range map[int][]int{10: {0, 1, 2, 3, 4, 5}, 16: {1, 2, 4}} {
+		ff1, err := NewFF1(key, nil, radix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ff31, err := NewFF31(key, make([]byte, FF3TweakSize), radix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, wrapped := range []struct {
+			cipher Cipher
+			tweak  []byte
+		}{{ff1, nil}, {ff31, make([]byte, FF3TweakSize)}} {
+			cipher, err := NewShortDomainCipher(wrapped.cipher, key, wrapped.tweak, radix)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, length := range lengths {
+				// small domains are checked completely and others by samples
+				size := power(radix, length).Int64()
+				step := int64(1)
+				if size > 1000 {
+					step = size/50 + 1
+				}
+				encryptedValues := make(map[string]bool)
+				for value := int64(0); value < size; value += step {
+					plaintext := str(big.NewInt(value), radix, length)
+					encrypted, err := cipher.Encrypt(plaintext)
+					if err != nil {
+						t.Fatalf("radix %d, length %d: %v", radix, length, err)
+					}
+					if len(encrypted) != length || encryptedValues[string(encrypted)] {
+						t.Fatalf("radix %d, length %d: unexpected ciphertext %v of %v", radix, length, encrypted, plaintext)
+					}
+					encryptedValues[string(encrypted)] = true
+					decrypted, err := cipher.Decrypt(encrypted)
+					if err != nil {
+						t.Fatalf("radix %d, length %d: %v", radix, length, err)
+					}
+					if !bytes.Equal(decrypted, plaintext) {
+						t.Fatalf("radix %d, length %d: expected decrypted %v, took %v", radix, length, plaintext, decrypted)
+					}
+				}
+			}
+			// strings of minimal length and longer are encrypted by wrapped cipher
+			plaintext := make([]byte, minLength(radix)+3)
+			expected, err := wrapped.cipher.Encrypt(plaintext)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if encrypted, err := cipher.Encrypt(plaintext); err != nil || !bytes.Equal(encrypted, expected) {
+				t.Fatalf("radix %d: expected ciphertext of wrapped cipher, took %v, %v", radix, encrypted, err)
+			}
+			if _, err := cipher.Encrypt([]byte{1, byte(radix)}); err != ErrInvalidNumber {
+				t.Fatalf("Expected ErrInvalidNumber, took %v", err)
+			}
+		}
+	}
+	// permutation depends on key
+	ff1, err := NewFF1(key, nil, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cipher, err := NewShortDomainCipher(ff1, key, nil, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey := bytes.Repeat([]byte{1}, 32)
+	otherFF1, err := NewFF1(otherKey, nil, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherCipher, err := NewShortDomainCipher(otherFF1, otherKey, nil, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	differs := false
+	for _, plaintext := range [][]byte{{1, 2}, {3, 4}, {5, 6}} {
+		encrypted, _ := cipher.Encrypt(plaintext)
+		otherEncrypted, _ := otherCipher.Encrypt(plaintext)
+		differs = differs || !bytes.Equal(encrypted, otherEncrypted)
+	}
+	if !differs {
+		t.Fatal("Expected different ciphertexts with different keys")
+	}
+}
+
+func TestShortDomainCipherTweak(t *testing.T) {
+	key := make([]byte, 32)
+	tweaks := [][]byte{nil, []byte("tweak"), []byte("another tweak longer than AES block")}
+	for _, length := range []int{2, 4, 5} {
+		ciphertexts := make(map[string]bool)
+		for _, tweak := range tweaks {
+			ff1, err := NewFF1(key, tweak, 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cipher, err := NewShortDomainCipher(ff1, key, tweak, 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ciphertext := make([]byte, 0, 3*length)
+			for _, value := range []int64{1, 2, 3} {
+				plaintext := str(big.NewInt(value), 10, length)
+				encrypted, err := cipher.Encrypt(plaintext)
+				if err != nil {
+					t.Fatal(err)
+				}
+				decrypted, err := cipher.Decrypt(encrypted)
+				if err != nil || !bytes.Equal(decrypted, plaintext) {
+					t.Fatalf("length %d: expected decrypted %v, took %v, %v", length, plaintext, decrypted, err)
+				}
+				ciphertext = append(ciphertext, encrypted...)
+			}
+			if ciphertexts[string(ciphertext)] {
+				t.Fatalf("length %d: expected different ciphertexts with different tweaks", length)
+			}
+			ciphertexts[string(ciphertext)] = true
+		}
+	}
+}
@@ -0,0 +1,188 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fpe
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"math/big"
+	"sort"
+	"sync"
+
+	"github.com/golang/groupcache/lru"
+)
+
+// shortDomainTableSize is maximal number of values of short numeral strings permuted by table instead of cycle walking
+const shortDomainTableSize = 10000
+
+// shortDomainTablesCacheSize is number of tables kept in memory, table of shortDomainTableSize values takes 40KB
+const shortDomainTablesCacheSize = 128
+
+// shortDomainBlockMarker starts first AES block of table permutation followed by radix, length and length of tweak
+const shortDomainBlockMarker = 0xff
+
+// ShortDomainCipher supports numeral strings shorter than minimal length of SP 800-38G, like integers of a few digits.
+// Strings of minimal length and longer are passed to wrapped cipher as is. Shorter strings with more than
+// shortDomainTableSize possible values are padded with leading zeros to minimal length and encrypted by cycle walking:
+// result is encrypted again until it has leading zeros too, that takes on average radix^minlen/radix^len rounds of
+// wrapped cipher. Smaller domains are permuted by table: all strings of the length are ordered by AES CBC-MAC of tweak
+// and their values and ciphertext of value x is x-th string of the order. Short domains have few possible values, so
+// ciphertexts of them are easier to guess than of strings of minimal length.
+type ShortDomainCipher struct {
+	cipher Cipher
+	block  cipher.Block
+	tweak  []byte
+	radix  int
+	minLen int
+}
+
+// NewShortDomainCipher returns ShortDomainCipher which wraps cipher of radix and uses AES key and tweak of cipher for
+// tables
+func NewShortDomainCipher(wrapped Cipher, key, tweak []byte, radix int) (*ShortDomainCipher, error) {
+	if radix < 2 || radix > 256 {
+		return nil, ErrInvalidRadix
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return &ShortDomainCipher{
+		cipher: wrapped, block: block, tweak: append([]byte{}, tweak...), radix: radix, minLen: minLength(radix),
+	}, nil
+}
+
+// shortDomainTable is permutation of values of numeral strings of one length and its inverse
+type shortDomainTable struct {
+	permutation []uint16
+	inverse     []uint16
+}
+
+// shortDomainTables caches tables by their seeds, so tables aren't generated for every value encrypted with the same
+// key and tweak. Ciphers are created for every value and seed identifies key, tweak, radix and length without the key.
+var shortDomainTables = struct {
+	sync.Mutex
+	cache *lru.Cache
+}{cache: lru.New(shortDomainTablesCacheSize)}
+
+// tableSeed returns AES CBC-MAC of block with radix, length and length of tweak followed by tweak padded with zeros
+func (c *ShortDomainCipher) tableSeed(length int) []byte {
+	seed := make([]byte, aes.BlockSize)
+	seed[0] = shortDomainBlockMarker
+	binary.BigEndian.PutUint16(seed[1:3], uint16(c.radix))
+	seed[3] = byte(length)
+	binary.BigEndian.PutUint32(seed[4:8], uint32(len(c.tweak)))
+	c.block.Encrypt(seed, seed)
+	for offset := 0; offset < len(c.tweak); offset += aes.BlockSize {
+		end := offset + aes.BlockSize
+		if end > len(c.tweak) {
+			end = len(c.tweak)
+		}
+		for i, b := range c.tweak[offset:end] {
+			seed[i] ^= b
+		}
+		c.block.Encrypt(seed, seed)
+	}
+	return seed
+}
+
+// table returns all values of numeral strings of length ordered by AES CBC-MAC of tweak and their values
+func (c *ShortDomainCipher) table(length int) *shortDomainTable {
+	seed := c.tableSeed(length)
+	shortDomainTables.Lock()
+	cached, ok := shortDomainTables.cache.Get(string(seed))
+	shortDomainTables.Unlock()
+	if ok {
+		return cached.(*shortDomainTable)
+	}
+	size := power(c.radix, length).Int64()
+	values := make([]uint16, size)
+	keys := make([][]byte, size)
+	for i := range values {
+		values[i] = uint16(i)
+		block := append([]byte{}, seed...)
+		var value [8]byte
+		binary.BigEndian.PutUint64(value[:], uint64(i))
+		for j, b := range value {
+			block[8+j] ^= b
+		}
+		c.block.Encrypt(block, block)
+		keys[i] = block
+	}
+	sort.Slice(values, func(i, j int) bool {
+		return string(keys[values[i]]) < string(keys[values[j]])
+	})
+	table := &shortDomainTable{permutation: values, inverse: make([]uint16, size)}
+	for i, value := range values {
+		table.inverse[value] = uint16(i)
+	}
+	shortDomainTables.Lock()
+	shortDomainTables.cache.Add(string(seed), table)
+	shortDomainTables.Unlock()
+	return table
+}
+
+// cycleWalk pads numerals with leading zeros to minimal length and applies transform until result has them too
+func (c *ShortDomainCipher) cycleWalk(numerals []byte, transform func([]byte) ([]byte, error)) ([]byte, error) {
+	padding := c.minLen - len(numerals)
+	result := append(make([]byte, padding), numerals...)
+	for {
+		var err error
+		result, err = transform(result)
+		if err != nil {
+			return nil, err
+		}
+		if num(result[:padding], c.radix).Sign() == 0 {
+			return result[padding:], nil
+		}
+	}
+}
+
+// isTableDomain returns true if numeral strings of length are permuted by table
+func (c *ShortDomainCipher) isTableDomain(length int) bool {
+	return power(c.radix, length).Cmp(big.NewInt(shortDomainTableSize)) <= 0
+}
+
+// Encrypt returns ciphertext of numerals with the same length
+func (c *ShortDomainCipher) Encrypt(numerals []byte) ([]byte, error) {
+	if len(numerals) >= c.minLen {
+		return c.cipher.Encrypt(numerals)
+	}
+	if err := validateNumerals(numerals, c.radix, 0, c.minLen); err != nil {
+		return nil, err
+	}
+	if !c.isTableDomain(len(numerals)) {
+		return c.cycleWalk(numerals, c.cipher.Encrypt)
+	}
+	table := c.table(len(numerals))
+	return str(big.NewInt(int64(table.permutation[num(numerals, c.radix).Int64()])), c.radix, len(numerals)), nil
+}
+
+// Decrypt returns plaintext of numerals encrypted by Encrypt
+func (c *ShortDomainCipher) Decrypt(numerals []byte) ([]byte, error) {
+	if len(numerals) >= c.minLen {
+		return c.cipher.Decrypt(numerals)
+	}
+	if err := validateNumerals(numerals, c.radix, 0, c.minLen); err != nil {
+		return nil, err
+	}
+	if !c.isTableDomain(len(numerals)) {
+		return c.cycleWalk(numerals, c.cipher.Decrypt)
+	}
+	table := c.table(len(numerals))
+	return str(big.NewInt(int64(table.inverse[num(numerals, c.radix).Int64()])), c.radix, len(numerals)), nil
+}
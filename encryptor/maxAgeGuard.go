@@ -0,0 +1,142 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package encryptor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/cossacklabs/acra/decryptor/base"
+	"github.com/cossacklabs/acra/logging"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+// MaxAgeAction defines how AcraStructs older than max_age of their column are handled
+type MaxAgeAction string
+
+// Supported values of MaxAgeAction
+const (
+	// MaxAgeActionOff turns off the check
+	MaxAgeActionOff MaxAgeAction = "off"
+	// MaxAgeActionFlag logs and counts stale AcraStructs but returns them decrypted
+	MaxAgeActionFlag MaxAgeAction = "flag"
+	// MaxAgeActionBlock returns stale AcraStructs encrypted as if they couldn't be decrypted
+	MaxAgeActionBlock MaxAgeAction = "block"
+)
+
+// Enabled returns true if action turns on the check
+func (action MaxAgeAction) Enabled() bool {
+	return action == MaxAgeActionFlag || action == MaxAgeActionBlock
+}
+
+// ErrInvalidMaxAgeAction returned for unknown MaxAgeAction
+var ErrInvalidMaxAgeAction = errors.New("invalid action on stale AcraStructs")
+
+// ParseMaxAgeAction validates action on stale AcraStructs, empty string means MaxAgeActionOff
+func ParseMaxAgeAction(value string) (MaxAgeAction, error) {
+	switch MaxAgeAction(value) {
+	case "":
+		return MaxAgeActionOff, nil
+	case MaxAgeActionOff, MaxAgeActionFlag, MaxAgeActionBlock:
+		return MaxAgeAction(value), nil
+	}
+	return "", fmt.Errorf("%w '%s', expected '%s', '%s' or '%s'", ErrInvalidMaxAgeAction, value,
+		MaxAgeActionOff, MaxAgeActionFlag, MaxAgeActionBlock)
+}
+
+// StaleAcraStructCounter collects count of decrypted AcraStructs older than max_age of their column
+var StaleAcraStructCounter = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "acraserver_stale_acrastruct_total",
+		Help: "number of decrypted AcraStructs older than max_age of their column in encryptor config",
+	}, []string{"action"})
+
+var maxAgeRegisterLock = sync.Once{}
+
+// RegisterMaxAgeMetrics register in default prometheus registry metrics related with max age of AcraStructs
+func RegisterMaxAgeMetrics() {
+	maxAgeRegisterLock.Do(func() {
+		prometheus.MustRegister(StaleAcraStructCounter)
+	})
+}
+
+// MaxAgeGuard is DecryptionSubscriber which detects stale AcraStructs: AcraStructs of columns with max_age in
+// encryptor config which were created earlier than max_age ago, e.g. to force re-encryption of data. Creation time is
+// embedded into AcraStructs encrypted by AcraServer for such columns, AcraStructs without it have unknown age and
+// aren't checked. Only values decrypted as whole AcraStructs are checked, so it should be subscribed after decryptor.
+type MaxAgeGuard struct {
+	queryEncryptor *QueryDataEncryptor
+	action         MaxAgeAction
+	now            func() time.Time
+}
+
+// NewMaxAgeGuard returns MaxAgeGuard which checks columns of SELECT queries processed by queryEncryptor
+func NewMaxAgeGuard(queryEncryptor *QueryDataEncryptor, action MaxAgeAction) (*MaxAgeGuard, error) {
+	if !action.Enabled() {
+		return nil, ErrInvalidMaxAgeAction
+	}
+	return &MaxAgeGuard{queryEncryptor: queryEncryptor, action: action, now: time.Now}, nil
+}
+
+// ID returns name of this DecryptionSubscriber.
+func (guard *MaxAgeGuard) ID() string {
+	return "MaxAgeGuard"
+}
+
+// OnColumn checks age of decrypted AcraStruct and handles it according to action if it's older than max_age
+func (guard *MaxAgeGuard) OnColumn(ctx context.Context, data []byte) (context.Context, []byte, error) {
+	acraStruct, _, ok := base.DecryptedAcraStructFromContext(ctx)
+	if !ok {
+		return ctx, data, nil
+	}
+	created, ok := base.AcraStructCreationTimeFromContext(ctx)
+	if !ok {
+		return ctx, data, nil
+	}
+	columnInfo, ok := base.ColumnInfoFromContext(ctx)
+	if !ok {
+		return ctx, data, nil
+	}
+	column := guard.queryEncryptor.getSelectColumnSetting(columnInfo.Index())
+	if column == nil || column.setting == nil {
+		return ctx, data, nil
+	}
+	maxAge := column.setting.MaxAge()
+	age := guard.now().Sub(created)
+	if maxAge <= 0 || age <= maxAge {
+		return ctx, data, nil
+	}
+	StaleAcraStructCounter.WithLabelValues(string(guard.action)).Inc()
+	logger := logging.GetLoggerFromContext(ctx).WithFields(logrus.Fields{
+		"table":        column.tableName,
+		"column":       column.columnName,
+		"column_index": columnInfo.Index(),
+		"created_at":   created.UTC().Format(time.RFC3339),
+		"max_age":      maxAge.String(),
+		"action":       guard.action,
+	})
+	logger.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorEncryptorStaleAcraStruct).
+		Warningln("Decrypted AcraStruct is older than max_age of its column")
+	if guard.action == MaxAgeActionBlock {
+		return ctx, acraStruct, nil
+	}
+	return ctx, data, nil
+}
@@ -0,0 +1,140 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package encryptor
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/cossacklabs/acra/decryptor/base"
+	"github.com/cossacklabs/acra/encryptor/config"
+	"github.com/cossacklabs/acra/sqlparser"
+	"github.com/cossacklabs/acra/sqlparser/dialect/mysql"
+	"github.com/cossacklabs/themis/gothemis/keys"
+)
+
+func TestMaxAgeGuard(t *testing.T) {
+	sqlparser.SetDefaultDialect(mysql.NewMySQLDialect())
+	configStr := `
+schemas:
+  - table: users
+    columns: ["id", "email", "phone"]
+    encrypted:
+      - column: email
+        max_age: 720h
+      - column: phone
+`
+	schemaStore, err := config.MapTableSchemaStoreFromConfig([]byte(configStr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := config.MapTableSchemaStoreFromConfig([]byte("schemas:\n  - table: users\n    encrypted:\n      - column: email\n        max_age: -1h\n")); !errors.Is(err, config.ErrInvalidSchemaConfig) {
+		t.Fatalf("Expected ErrInvalidSchemaConfig for negative max_age, took %v", err)
+	}
+	queryEncryptor, err := NewMysqlQueryEncryptor(schemaStore, []byte("client1"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewMaxAgeGuard(queryEncryptor, MaxAgeActionOff); !errors.Is(err, ErrInvalidMaxAgeAction) {
+		t.Fatalf("Expected ErrInvalidMaxAgeAction, took %v", err)
+	}
+	if _, err := ParseMaxAgeAction("drop"); !errors.Is(err, ErrInvalidMaxAgeAction) {
+		t.Fatalf("Expected ErrInvalidMaxAgeAction, took %v", err)
+	}
+	// columns: email, phone, id
+	if _, _, err := queryEncryptor.OnQuery(base.NewOnQueryObjectFromQuery("select email, phone, id from users")); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Unix(1600000000, 0)
+	acraStruct := []byte("acrastruct")
+	decrypted := []byte("decrypted")
+	testcases := []struct {
+		column  int
+		created time.Time
+		stale   bool
+	}{
+		{0, now.Add(-time.Hour), false},
+		{0, now.Add(-721 * time.Hour), true},
+		// AcraStruct without timestamp
+		{0, time.Time{}, false},
+		// column without max_age
+		{1, now.Add(-721 * time.Hour), false},
+		// column isn't encrypted
+		{2, now.Add(-721 * time.Hour), false},
+	}
+	for _, action := range []MaxAgeAction{MaxAgeActionFlag, MaxAgeActionBlock} {
+		guard, err := NewMaxAgeGuard(queryEncryptor, action)
+		if err != nil {
+			t.Fatal(err)
+		}
+		guard.now = func() time.Time { return now }
+		for i, testcase := range testcases {
+			ctx := base.NewContextWithColumnInfo(context.Background(), base.NewColumnInfo(testcase.column, ""))
+			ctx = base.NewContextWithDecryptedAcraStruct(ctx, acraStruct, nil)
+			if !testcase.created.IsZero() {
+				ctx = base.NewContextWithAcraStructCreationTime(ctx, testcase.created)
+			}
+			_, data, err := guard.OnColumn(ctx, decrypted)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := decrypted
+			if testcase.stale && action == MaxAgeActionBlock {
+				expected = acraStruct
+			}
+			if !bytes.Equal(data, expected) {
+				t.Fatalf("[%s][%d] Expected %s, took %s", action, i, expected, data)
+			}
+		}
+	}
+}
+
+func TestAcrawriterDataEncryptorTimestamp(t *testing.T) {
+	keypair, err := keys.New(keys.TypeEC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encryptor, err := NewAcrawriterDataEncryptor(&keyStore{keypair: keypair})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1600000000, 0)
+	encryptor.now = func() time.Time { return now }
+	testData := []byte("some raw data")
+	for _, maxAge := range []time.Duration{0, time.Hour} {
+		setting := &config.BasicColumnEncryptionSetting{Name: "email", UsedMaxAge: maxAge}
+		acraStruct, err := encryptor.EncryptWithClientID([]byte("client1"), testData, setting)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decrypted, created, err := base.DecryptAcrastructWithTimestamp(acraStruct, keypair.Private, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decrypted, testData) {
+			t.Fatalf("Expected %s, took %s", testData, decrypted)
+		}
+		// timestamp is embedded only into AcraStructs of columns with max_age
+		if (maxAge > 0) != created.Equal(now) || (maxAge == 0) != created.IsZero() {
+			t.Fatalf("Unexpected creation time %s for max_age %s", created, maxAge)
+		}
+	}
+}
@@ -19,6 +19,7 @@ package encryptor
 import (
 	"bytes"
 	"errors"
+	"fmt"
 	"reflect"
 	"strconv"
 	"strings"
@@ -62,6 +63,42 @@ func (encryptor *QueryDataEncryptor) ID() string {
 	return "QueryDataEncryptor"
 }
 
+// ErrSchemaDrift is returned in strict mode when query doesn't match schema of table from config,
+// e.g. column was renamed or removed in the database but config wasn't updated
+var ErrSchemaDrift = errors.New("query doesn't match encryptor schema of table")
+
+// onSchemaDrift reports mismatch of query and schema and returns ErrSchemaDrift if schema store is strict
+func (encryptor *QueryDataEncryptor) onSchemaDrift(schema config.TableSchema, reason string, fields logrus.Fields) error {
+	logrus.WithFields(fields).WithField("table", schema.Name()).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorEncryptorSchemaDrift).
+		Warningf("Schema drift detected: %s, update encryptor config", reason)
+	if encryptor.schemaStore.IsStrict() {
+		return fmt.Errorf("%w '%s': %s", ErrSchemaDrift, schema.Name(), reason)
+	}
+	return nil
+}
+
+// checkColumns reports columns of query which are not described in schema
+func (encryptor *QueryDataEncryptor) checkColumns(schema config.TableSchema, columns ...string) error {
+	for _, column := range columns {
+		if !schema.HasColumn(column) {
+			if err := encryptor.onSchemaDrift(schema, "unknown column", logrus.Fields{"column": column}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkRowLength reports rows which have a different number of values than columns of table in INSERT without
+// list of columns, it means that columns were added to or removed from the table
+func (encryptor *QueryDataEncryptor) checkRowLength(schema config.TableSchema, columns []string, row sqlparser.ValTuple) (bool, error) {
+	if len(row) == len(columns) {
+		return true, nil
+	}
+	err := encryptor.onSchemaDrift(schema, "number of inserted values doesn't match columns", logrus.Fields{"values": len(row), "columns": len(columns)})
+	return false, err
+}
+
 // encryptInsertQuery encrypt data in insert query in VALUES and ON DUPLICATE KEY UPDATE statements
 func (encryptor *QueryDataEncryptor) encryptInsertQuery(insert *sqlparser.Insert) (bool, error) {
 	tableName := insert.Table.Name
@@ -78,6 +115,9 @@ func (encryptor *QueryDataEncryptor) encryptInsertQuery(insert *sqlparser.Insert
 		for _, col := range insert.Columns {
 			columnsName = append(columnsName, col.String())
 		}
+		if err := encryptor.checkColumns(schema, columnsName...); err != nil {
+			return false, err
+		}
 	} else if cols := schema.Columns(); len(cols) > 0 {
 		columnsName = cols
 	}
@@ -88,6 +128,12 @@ func (encryptor *QueryDataEncryptor) encryptInsertQuery(insert *sqlparser.Insert
 		switch rows := insert.Rows.(type) {
 		case sqlparser.Values:
 			for _, valTuple := range rows {
+				// values can't be matched with columns, leave them unchanged if schema isn't strict
+				if ok, err := encryptor.checkRowLength(schema, columnsName, valTuple); err != nil {
+					return changed, err
+				} else if !ok {
+					continue
+				}
 				// collect values per column
 				for j, value := range valTuple {
 					columnName := columnsName[j]
@@ -113,6 +159,27 @@ func (encryptor *QueryDataEncryptor) encryptInsertQuery(insert *sqlparser.Insert
 	return changed, nil
 }
 
+// Errors returned for NULL and empty values of encrypted columns which are rejected by column settings
+var (
+	ErrNullValueRejected  = errors.New("NULL value of encrypted column is rejected")
+	ErrEmptyValueRejected = errors.New("empty value of encrypted column is rejected")
+)
+
+// checkUnencryptableValue returns error if NULL or empty value, which can't be encrypted into AcraStruct, is rejected
+// by column settings instead of passing as is
+func checkUnencryptableValue(setting config.ColumnEncryptionSetting, isNull bool) error {
+	if isNull {
+		if setting.NullValue() == config.ValueHandlingReject {
+			return ErrNullValueRejected
+		}
+		return nil
+	}
+	if setting.EmptyValue() == config.ValueHandlingReject {
+		return ErrEmptyValueRejected
+	}
+	return nil
+}
+
 // ErrUpdateLeaveDataUnchanged show that data wasn't changed in UpdateExpressionValue with updateFunc
 var ErrUpdateLeaveDataUnchanged = errors.New("updateFunc didn't change data")
 
@@ -153,11 +220,15 @@ func UpdateExpressionValue(expr sqlparser.Expr, coder DBDataCoder, updateFunc fu
 // encryptExpression check that expr is SQLVal and has Hexval then try to encrypt
 func (encryptor *QueryDataEncryptor) encryptExpression(expr sqlparser.Expr, schema config.TableSchema, columnName string) (bool, error) {
 	if schema.NeedToEncrypt(columnName) {
+		setting := schema.GetColumnEncryptionSettings(columnName)
+		if _, ok := expr.(*sqlparser.NullVal); ok {
+			return false, checkUnencryptableValue(setting, true)
+		}
 		err := UpdateExpressionValue(expr, encryptor.dataCoder, func(data []byte) ([]byte, error) {
 			if len(data) == 0 {
-				return data, nil
+				return data, checkUnencryptableValue(setting, false)
 			}
-			return encryptor.encryptWithColumnSettings(schema.GetColumnEncryptionSettings(columnName), data)
+			return encryptor.encryptWithColumnSettings(setting, data)
 		})
 		// didn't change anything because it already encrypted
 		if err == ErrUpdateLeaveDataUnchanged {
@@ -229,6 +300,9 @@ func (encryptor *QueryDataEncryptor) encryptUpdateExpressions(exprs sqlparser.Up
 			continue
 		}
 		columnName := expr.Name.Name.String()
+		if err := encryptor.checkColumns(schema, columnName); err != nil {
+			return changed, err
+		}
 		if changedExpr, err := encryptor.encryptExpression(expr.Expr, schema, columnName); err != nil {
 			logrus.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorEncryptorCantEncryptExpression).WithError(err).Errorln("Can't update expression with encrypted sql value")
 			return changed, err
@@ -239,6 +313,71 @@ func (encryptor *QueryDataEncryptor) encryptUpdateExpressions(exprs sqlparser.Up
 	return changed, nil
 }
 
+// isEqualityComparison returns true if operator compares values for (in)equality, so deterministically encrypted
+// literals are compared the same way as plaintext
+func isEqualityComparison(operator string) bool {
+	switch operator {
+	case sqlparser.EqualStr, sqlparser.NotEqualStr, sqlparser.NullSafeEqualStr, sqlparser.InStr, sqlparser.NotInStr:
+		return true
+	}
+	return false
+}
+
+// encryptWhereLiterals encrypts literals compared for equality with format-preserving encrypted columns in WHERE
+// clause, so lookups by encrypted values like primary keys match stored ones. AcraStructs are randomized and can't be
+// matched this way. Columns without table qualifier are recognized as columns of the first table.
+func (encryptor *QueryDataEncryptor) encryptWhereLiterals(where *sqlparser.Where, tables []*AliasedTableName) (bool, error) {
+	if where == nil || len(tables) == 0 {
+		return false, nil
+	}
+	qualifierMap := NewAliasToTableMapFromTables(tables)
+	firstTable := tables[0].TableName.Name.String()
+	changed := false
+	err := sqlparser.Walk(func(node sqlparser.SQLNode) (bool, error) {
+		comparison, ok := node.(*sqlparser.ComparisonExpr)
+		if !ok || !isEqualityComparison(comparison.Operator) {
+			return true, nil
+		}
+		column, ok := comparison.Left.(*sqlparser.ColName)
+		if !ok {
+			return true, nil
+		}
+		tableName := firstTable
+		if !column.Qualifier.IsEmpty() {
+			tableName = qualifierMap[column.Qualifier.Name.String()]
+		}
+		schema := encryptor.schemaStore.GetTableSchema(tableName)
+		if schema == nil {
+			return true, nil
+		}
+		setting := schema.GetColumnEncryptionSettings(column.Name.String())
+		if setting == nil || setting.FormatPreserving() == config.FormatPreservingNone {
+			return true, nil
+		}
+		values := []sqlparser.Expr{comparison.Right}
+		if tuple, ok := comparison.Right.(sqlparser.ValTuple); ok {
+			values = tuple
+		}
+		for _, value := range values {
+			err := UpdateExpressionValue(value, encryptor.dataCoder, func(data []byte) ([]byte, error) {
+				if len(data) == 0 {
+					return data, nil
+				}
+				return encryptor.encryptWithColumnSettings(setting, data)
+			})
+			if err == ErrUpdateLeaveDataUnchanged {
+				continue
+			} else if err != nil {
+				logrus.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorEncryptorCantEncryptExpression).WithError(err).Errorln("Can't encrypt compared value of format-preserving column")
+				return false, err
+			}
+			changed = true
+		}
+		return false, nil
+	}, where)
+	return changed, err
+}
+
 // AliasToTableMap store table alias as key and table name as value
 type AliasToTableMap map[string]string
 
@@ -266,7 +405,17 @@ func (encryptor *QueryDataEncryptor) encryptUpdateQuery(update *sqlparser.Update
 	}
 	qualifierMap := NewAliasToTableMapFromTables(tables)
 	firstTable := tables[0].TableName
-	return encryptor.encryptUpdateExpressions(update.Exprs, firstTable, qualifierMap)
+	changed, err := encryptor.encryptUpdateExpressions(update.Exprs, firstTable, qualifierMap)
+	if err != nil {
+		return changed, err
+	}
+	whereChanged, err := encryptor.encryptWhereLiterals(update.Where, tables)
+	return changed || whereChanged, err
+}
+
+// encryptDeleteQuery encrypts literals of WHERE clause of DELETE query compared with format-preserving encrypted columns
+func (encryptor *QueryDataEncryptor) encryptDeleteQuery(statement *sqlparser.Delete) (bool, error) {
+	return encryptor.encryptWhereLiterals(statement.Where, GetTablesWithAliases(statement.TableExprs))
 }
 
 func (encryptor *QueryDataEncryptor) onSelect(statement *sqlparser.Select) (bool, error) {
@@ -275,25 +424,84 @@ func (encryptor *QueryDataEncryptor) onSelect(statement *sqlparser.Select) (bool
 	for _, data := range columns {
 		if data != nil {
 			if schema := encryptor.schemaStore.GetTableSchema(data.Table); schema != nil {
-				if columnSetting := schema.GetColumnEncryptionSettings(data.Name); columnSetting != nil {
-					querySelectSettings = append(querySelectSettings, &querySelectSetting{
-						setting:     columnSetting,
-						tableName:   data.Table,
-						columnName:  data.Name,
-						columnAlias: data.Alias,
-					})
-					continue
+				if err := encryptor.checkColumns(schema, data.Name); err != nil {
+					return false, err
 				}
+				// plain columns of described tables are stored without settings
+				querySelectSettings = append(querySelectSettings, &querySelectSetting{
+					setting:     schema.GetColumnEncryptionSettings(data.Name),
+					tableName:   data.Table,
+					columnName:  data.Name,
+					columnAlias: data.Alias,
+				})
+				continue
 			}
 		}
 		querySelectSettings = append(querySelectSettings, nil)
 	}
 	encryptor.querySelectSettings = querySelectSettings
-	return false, nil
+	return encryptor.encryptWhereLiterals(statement.Where, GetTablesWithAliases(statement.From))
+}
+
+// onReturning stores settings of result columns of RETURNING clause, so rows returned by INSERT are decrypted and
+// checked by the same subscribers as rows of SELECT
+func (encryptor *QueryDataEncryptor) onReturning(returning sqlparser.Returning, table sqlparser.TableName) error {
+	if len(returning) == 0 {
+		return nil
+	}
+	tableName := table.Name.String()
+	schema := encryptor.schemaStore.GetTableSchema(tableName)
+	querySelectSettings := make([]*querySelectSetting, 0, len(returning))
+	for _, expr := range returning {
+		switch expr := expr.(type) {
+		case *sqlparser.StarExpr:
+			// columns are known only if schema describes all of them in order of table
+			if schema == nil || len(schema.Columns()) == 0 {
+				encryptor.querySelectSettings = querySelectSettings
+				return nil
+			}
+			for _, column := range schema.Columns() {
+				querySelectSettings = append(querySelectSettings, &querySelectSetting{
+					setting:     schema.GetColumnEncryptionSettings(column),
+					tableName:   tableName,
+					columnName:  column,
+					columnAlias: tableName,
+				})
+			}
+			continue
+		case *sqlparser.ColName:
+			if schema != nil && (expr.Qualifier.Name.IsEmpty() || expr.Qualifier.Name.String() == tableName) {
+				if err := encryptor.checkColumns(schema, expr.Name.String()); err != nil {
+					return err
+				}
+				querySelectSettings = append(querySelectSettings, &querySelectSetting{
+					setting:     schema.GetColumnEncryptionSettings(expr.Name.String()),
+					tableName:   tableName,
+					columnName:  expr.Name.String(),
+					columnAlias: tableName,
+				})
+				continue
+			}
+		}
+		querySelectSettings = append(querySelectSettings, nil)
+	}
+	encryptor.querySelectSettings = querySelectSettings
+	return nil
+}
+
+// getSelectColumnSetting returns settings of result column of last SELECT or INSERT ... RETURNING query by its index or
+// nil if column isn't from table described by schema. Column settings of plain columns are nil.
+func (encryptor *QueryDataEncryptor) getSelectColumnSetting(index int) *querySelectSetting {
+	if index < 0 || index >= len(encryptor.querySelectSettings) {
+		return nil
+	}
+	return encryptor.querySelectSettings[index]
 }
 
 // OnQuery raw data in query according to TableSchemaStore
 func (encryptor *QueryDataEncryptor) OnQuery(query base.OnQueryObject) (base.OnQueryObject, bool, error) {
+	// columns of previous SELECT don't describe response of this query
+	encryptor.querySelectSettings = nil
 	statement, err := query.Statement()
 	if err != nil {
 		return query, false, err
@@ -303,9 +511,13 @@ func (encryptor *QueryDataEncryptor) OnQuery(query base.OnQueryObject) (base.OnQ
 	case *sqlparser.Select:
 		changed, err = encryptor.onSelect(statement)
 	case *sqlparser.Insert:
-		changed, err = encryptor.encryptInsertQuery(statement)
+		if err = encryptor.onReturning(statement.Returning, statement.Table); err == nil {
+			changed, err = encryptor.encryptInsertQuery(statement)
+		}
 	case *sqlparser.Update:
 		changed, err = encryptor.encryptUpdateQuery(statement)
+	case *sqlparser.Delete:
+		changed, err = encryptor.encryptDeleteQuery(statement)
 	}
 	if err != nil {
 		return query, false, err
@@ -358,6 +570,9 @@ func (encryptor *QueryDataEncryptor) encryptInsertValues(insert *sqlparser.Inser
 		for i, column := range insert.Columns {
 			columns[i] = column.String()
 		}
+		if err := encryptor.checkColumns(schema, columns...); err != nil {
+			return values, false, err
+		}
 	} else if cols := schema.Columns(); len(cols) > 0 {
 		columns = cols
 	}
@@ -380,6 +595,11 @@ func (encryptor *QueryDataEncryptor) encryptInsertValues(insert *sqlparser.Inser
 	switch rows := insert.Rows.(type) {
 	case sqlparser.Values:
 		for _, row := range rows {
+			if ok, err := encryptor.checkRowLength(schema, columns, row); err != nil {
+				return values, false, err
+			} else if !ok {
+				continue
+			}
 			for i, value := range row {
 				switch value := value.(type) {
 				case *sqlparser.SQLVal:
@@ -423,6 +643,7 @@ func (encryptor *QueryDataEncryptor) encryptUpdateValues(update *sqlparser.Updat
 	}
 
 	placeholders := make(map[int]string, len(values))
+	qualifierMap := NewAliasToTableMapFromTables(tables)
 
 	// We can only process simple queries of the form
 	//
@@ -435,6 +656,11 @@ func (encryptor *QueryDataEncryptor) encryptUpdateValues(update *sqlparser.Updat
 	// Walk through SET clauses to find out which placeholders stand for which columns.
 	for _, expr := range update.Exprs {
 		columnName := expr.Name.Name.String()
+		if expr.Name.Qualifier.IsEmpty() || qualifierMap[expr.Name.Qualifier.Name.String()] == tableName {
+			if err := encryptor.checkColumns(schema, columnName); err != nil {
+				return values, false, err
+			}
+		}
 		switch value := expr.Expr.(type) {
 		case *sqlparser.SQLVal:
 			err := encryptor.updatePlaceholderMap(values, placeholders, value, columnName)
@@ -497,6 +723,17 @@ func (encryptor *QueryDataEncryptor) encryptValuesWithPlaceholders(values []base
 		if !schema.NeedToEncrypt(columnName) {
 			continue
 		}
+		settings := schema.GetColumnEncryptionSettings(columnName)
+		data := values[valueIndex].Data()
+		// NULL and empty values are passed as is or rejected because AcraStruct can't contain empty data
+		if len(data) == 0 {
+			if err := checkUnencryptableValue(settings, data == nil); err != nil {
+				logrus.WithError(err).WithFields(logrus.Fields{"index": valueIndex, "column": columnName}).
+					Debug("Rejected value of encrypted column")
+				return oldValues, false, err
+			}
+			continue
+		}
 
 		// Allocate the result slice only if there are some values that need encryption.
 		// Otherwise we'll just return the original old one.
@@ -506,9 +743,7 @@ func (encryptor *QueryDataEncryptor) encryptValuesWithPlaceholders(values []base
 		}
 		changed = true
 
-		settings := schema.GetColumnEncryptionSettings(columnName)
 		format := values[valueIndex].Format()
-		data := values[valueIndex].Data()
 		switch format {
 		// TODO(ilammy, 2020-10-19): handle non-bytes binary data
 		// Encryptor expects binary data to be passed in raw bytes, but most non-byte-arrays
@@ -19,6 +19,7 @@ package encryptor
 import (
 	"bytes"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"testing"
 
@@ -445,3 +446,258 @@ schemas:
 	// avoid side effect for other tests with configuring default dialect
 	sqlparser.SetDefaultDialect(mysql.NewMySQLDialect())
 }
+
+func TestQueryDataEncryptorSchemaDrift(t *testing.T) {
+	configTemplate := `
+strict_schema: %t
+schemas:
+  - table: users
+    aliases: ["customers"]
+    columns: ["id", "email", "phone"]
+    encrypted:
+      - column: "email"
+        aliases: ["mail"]
+`
+	encryptedValue := []byte("encrypted")
+	testData := []struct {
+		query     string
+		encrypted int
+		drift     bool
+	}{
+		// historical names of table and column
+		{query: "INSERT INTO customers (id, mail) VALUES (1, 'data')", encrypted: 1},
+		{query: "UPDATE users SET mail='data'", encrypted: 1},
+		// column was renamed in the database but config wasn't updated
+		{query: "INSERT INTO users (id, contact_email) VALUES (1, 'data')", drift: true},
+		{query: "UPDATE users SET contact_email='data'", drift: true},
+		{query: "SELECT contact_email FROM users", drift: true},
+		// column was added to the table
+		{query: "INSERT INTO users VALUES (1, 'data', 'phone', 'address')", drift: true},
+		{query: "INSERT INTO users VALUES (1, 'data', 'phone')", encrypted: 1},
+	}
+	for _, strict := range []bool{false, true} {
+		schemaStore, err := config.MapTableSchemaStoreFromConfig([]byte(fmt.Sprintf(configTemplate, strict)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		encryptor := &testEncryptor{value: encryptedValue}
+		queryEncryptor, err := NewMysqlQueryEncryptor(schemaStore, []byte("client"), encryptor)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, testCase := range testData {
+			encryptor.reset()
+			_, _, err := queryEncryptor.OnQuery(base.NewOnQueryObjectFromQuery(testCase.query))
+			if strict && testCase.drift {
+				if !errors.Is(err, ErrSchemaDrift) {
+					t.Fatalf("%d. Expected ErrSchemaDrift in strict mode, took %v", i, err)
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatalf("%d. Unexpected error %v", i, err)
+			}
+			if len(encryptor.fetchedIDs) != testCase.encrypted {
+				t.Fatalf("%d. Expected %d encrypted values, took %d", i, testCase.encrypted, len(encryptor.fetchedIDs))
+			}
+		}
+	}
+}
+
+func TestMapTableSchemaStoreFromConfigInvalid(t *testing.T) {
+	testConfigs := []string{
+		// table alias equals to other table
+		`
+schemas:
+  - table: users
+    aliases: [customers]
+  - table: customers
+`,
+		// alias of encrypted column is another column
+		`
+schemas:
+  - table: users
+    columns: [id, email, mail]
+    encrypted:
+      - column: email
+        aliases: [mail]
+`,
+		// encrypted column isn't listed in columns in strict mode
+		`
+strict_schema: true
+schemas:
+  - table: users
+    columns: [id, mail]
+    encrypted:
+      - column: email
+`,
+	}
+	for i, testConfig := range testConfigs {
+		if _, err := config.MapTableSchemaStoreFromConfig([]byte(testConfig)); !errors.Is(err, config.ErrInvalidSchemaConfig) {
+			t.Errorf("%d. Expected ErrInvalidSchemaConfig, took %v", i, err)
+		}
+	}
+}
+
+func TestQueryDataEncryptorEmptyAndNullValues(t *testing.T) {
+	testConfig := `
+null_value: reject
+schemas:
+  - table: users
+    columns: ["id", "email", "phone"]
+    encrypted:
+      - column: "email"
+        empty_value: reject
+      - column: "phone"
+        null_value: pass
+`
+	schemaStore, err := config.MapTableSchemaStoreFromConfig([]byte(testConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	encryptor := &testEncryptor{value: []byte("encrypted")}
+	queryEncryptor, err := NewPostgresqlQueryEncryptor(schemaStore, []byte("client"), encryptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testData := []struct {
+		query     string
+		encrypted int
+		err       error
+	}{
+		{query: "INSERT INTO users (id, email, phone) VALUES (1, 'email', '')", encrypted: 1},
+		{query: "INSERT INTO users (id, email, phone) VALUES (1, 'email', NULL)", encrypted: 1},
+		{query: "INSERT INTO users (id, email, phone) VALUES (1, '', 'phone')", err: ErrEmptyValueRejected},
+		{query: "UPDATE users SET email=NULL", err: ErrNullValueRejected},
+	}
+	sqlparser.SetDefaultDialect(postgresql.NewPostgreSQLDialect())
+	for i, testCase := range testData {
+		encryptor.reset()
+		_, _, err := queryEncryptor.OnQuery(base.NewOnQueryObjectFromQuery(testCase.query))
+		if err != testCase.err {
+			t.Fatalf("%d. Expected error %v, took %v", i, testCase.err, err)
+		}
+		if len(encryptor.fetchedIDs) != testCase.encrypted {
+			t.Fatalf("%d. Expected %d encrypted values, took %d", i, testCase.encrypted, len(encryptor.fetchedIDs))
+		}
+	}
+	// avoid side effect for other tests with configuring default dialect
+	sqlparser.SetDefaultDialect(mysql.NewMySQLDialect())
+
+	statement, err := sqlparser.ParseWithDialect(postgresql.NewPostgreSQLDialect(), "INSERT INTO users (id, email, phone) VALUES ($1, $2, $3)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bind := func(email, phone []byte) ([]base.BoundValue, error) {
+		values := []base.BoundValue{base.NewBoundValue([]byte("1"), base.TextFormat), base.NewBoundValue(email, base.TextFormat), base.NewBoundValue(phone, base.TextFormat)}
+		newValues, _, err := queryEncryptor.OnBind(statement, values)
+		return newValues, err
+	}
+	// NULL and empty values are passed as is
+	for _, phone := range [][]byte{nil, {}} {
+		values, err := bind([]byte("email"), phone)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data := values[2].Data(); len(data) != 0 || (data == nil) != (phone == nil) {
+			t.Fatalf("Expected phone %v, took %v", phone, data)
+		}
+	}
+	if _, err := bind(nil, []byte("phone")); err != ErrNullValueRejected {
+		t.Fatalf("Expected ErrNullValueRejected, took %v", err)
+	}
+	if _, err := bind([]byte{}, []byte("phone")); err != ErrEmptyValueRejected {
+		t.Fatalf("Expected ErrEmptyValueRejected, took %v", err)
+	}
+
+	invalidConfigs := []string{
+		"empty_value: encrypt",
+		`
+schemas:
+  - table: users
+    encrypted:
+      - column: email
+        null_value: encrypt
+`,
+	}
+	for i, invalidConfig := range invalidConfigs {
+		if _, err := config.MapTableSchemaStoreFromConfig([]byte(invalidConfig)); !errors.Is(err, config.ErrInvalidValueHandling) {
+			t.Fatalf("%d. Expected ErrInvalidValueHandling, took %v", i, err)
+		}
+	}
+}
+
+func TestQueryDataEncryptorReturning(t *testing.T) {
+	testConfig := `
+schemas:
+  - table: users
+    columns: ["id", "email", "phone"]
+    encrypted:
+      - column: "email"
+      - column: "phone"
+        zone_id: zone1
+  - table: orders
+    encrypted:
+      - column: "data"
+`
+	schemaStore, err := config.MapTableSchemaStoreFromConfig([]byte(testConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testData := []struct {
+		query string
+		// expected columns of result, empty for columns without settings
+		columns []string
+	}{
+		{"INSERT INTO users (id, email) VALUES (1, 'data') RETURNING id, email", []string{"id", "email"}},
+		{"INSERT INTO users (id, email) VALUES (1, 'data') RETURNING users.phone, 1, email", []string{"phone", "", "email"}},
+		{"INSERT INTO users (id, email) VALUES (1, 'data') RETURNING *", []string{"id", "email", "phone"}},
+		// columns of table without described columns are known only if they're listed explicitly
+		{"INSERT INTO orders (id, data) VALUES (1, 'data') RETURNING *", nil},
+		{"INSERT INTO orders (id, data) VALUES (1, 'data') RETURNING id, data", []string{"id", "data"}},
+		{"INSERT INTO unknown (id, data) VALUES (1, 'data') RETURNING id, data", []string{"", ""}},
+		{"INSERT INTO users (id, email) VALUES (1, 'data')", nil},
+	}
+	for _, testDialect := range []dialect.Dialect{mysql.NewMySQLDialect(), postgresql.NewPostgreSQLDialect()} {
+		sqlparser.SetDefaultDialect(testDialect)
+		encryptor := &testEncryptor{value: []byte("encrypted")}
+		queryEncryptor, err := NewPostgresqlQueryEncryptor(schemaStore, []byte("client"), encryptor)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := testDialect.(*mysql.MySQLDialect); ok {
+			queryEncryptor, err = NewMysqlQueryEncryptor(schemaStore, []byte("client"), encryptor)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		for i, testCase := range testData {
+			// settings of previous SELECT aren't used for INSERT
+			if _, _, err := queryEncryptor.OnQuery(base.NewOnQueryObjectFromQuery("SELECT email, phone, id FROM users")); err != nil {
+				t.Fatal(err)
+			}
+			if _, _, err := queryEncryptor.OnQuery(base.NewOnQueryObjectFromQuery(testCase.query)); err != nil {
+				t.Fatalf("%d. %v", i, err)
+			}
+			if len(queryEncryptor.querySelectSettings) != len(testCase.columns) {
+				t.Fatalf("%d. Expected %d result columns, took %d", i, len(testCase.columns), len(queryEncryptor.querySelectSettings))
+			}
+			for index, column := range testCase.columns {
+				setting := queryEncryptor.getSelectColumnSetting(index)
+				if column == "" {
+					if setting != nil {
+						t.Fatalf("%d. Expected column %d without settings", i, index)
+					}
+					continue
+				}
+				if setting == nil || setting.columnName != column {
+					t.Fatalf("%d. Expected settings of column %s at %d", i, column, index)
+				}
+				if (setting.setting != nil) != (column != "id") {
+					t.Fatalf("%d. Unexpected encryption settings of column %s", i, column)
+				}
+			}
+		}
+	}
+	sqlparser.SetDefaultDialect(mysql.NewMySQLDialect())
+}
@@ -0,0 +1,356 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package encryptor
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"github.com/cossacklabs/acra/decryptor/base"
+	"github.com/cossacklabs/acra/logging"
+	"github.com/cossacklabs/acra/sqlparser"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// Errors returned by tenant isolation
+var (
+	ErrInvalidTenantIsolationPolicy = errors.New("invalid tenant isolation policy")
+	ErrTenantIsolation              = errors.New("query can't be scoped to tenant")
+)
+
+// TenantIsolationRejectedCounter collects count of queries of tenants rejected because they can't be scoped
+var TenantIsolationRejectedCounter = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "acraserver_tenant_isolation_rejected_queries_total",
+		Help: "number of queries of tenants rejected because tenant predicates can't be added to them",
+	})
+
+var tenantIsolationRegisterLock = sync.Once{}
+
+// RegisterTenantIsolationMetrics register in default prometheus registry metrics related with tenant isolation
+func RegisterTenantIsolationMetrics() {
+	tenantIsolationRegisterLock.Do(func() {
+		prometheus.MustRegister(TenantIsolationRejectedCounter)
+	})
+}
+
+type tenantTableConfig struct {
+	Table  string `yaml:"table"`
+	Column string `yaml:"column"`
+}
+
+type tenantClientConfig struct {
+	ClientID string `yaml:"client_id"`
+	Tenant   string `yaml:"tenant"`
+}
+
+type tenantIsolationConfig struct {
+	Tables  []tenantTableConfig  `yaml:"tables"`
+	Tenants []tenantClientConfig `yaml:"tenants"`
+}
+
+// TenantIsolationPolicy describes tables shared by tenants with columns of tenant identifiers and tenants of client
+// IDs. Queries of these clients are scoped to rows of their tenant, queries of other clients aren't changed.
+// Table names are compared case-insensitively: unquoted identifiers are folded to lower case by PostgreSQL and
+// compared case-insensitively by MySQL. Quoted identifiers are matched the same way because the parser doesn't keep
+// quotes of identifiers, so tables which names differ only in case are scoped too instead of being left unscoped.
+type TenantIsolationPolicy struct {
+	// columns of tenant identifiers by table names in lower case
+	columns map[string]string
+	// tenants by client IDs
+	tenants map[string]string
+}
+
+// LoadTenantIsolationPolicy reads TenantIsolationPolicy from YAML file
+func LoadTenantIsolationPolicy(path string) (*TenantIsolationPolicy, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseTenantIsolationPolicy(data)
+}
+
+// ParseTenantIsolationPolicy parses TenantIsolationPolicy from YAML config
+func ParseTenantIsolationPolicy(data []byte) (*TenantIsolationPolicy, error) {
+	config := &tenantIsolationConfig{}
+	if err := yaml.UnmarshalStrict(data, config); err != nil {
+		return nil, err
+	}
+	if len(config.Tables) == 0 || len(config.Tenants) == 0 {
+		return nil, fmt.Errorf("%w: tables and tenants should be set", ErrInvalidTenantIsolationPolicy)
+	}
+	policy := &TenantIsolationPolicy{
+		columns: make(map[string]string, len(config.Tables)),
+		tenants: make(map[string]string, len(config.Tenants)),
+	}
+	for _, table := range config.Tables {
+		if table.Table == "" || table.Column == "" {
+			return nil, fmt.Errorf("%w: tables should have table and column", ErrInvalidTenantIsolationPolicy)
+		}
+		name := strings.ToLower(table.Table)
+		if _, ok := policy.columns[name]; ok {
+			return nil, fmt.Errorf("%w: duplicate table '%s'", ErrInvalidTenantIsolationPolicy, table.Table)
+		}
+		policy.columns[name] = table.Column
+	}
+	for _, tenant := range config.Tenants {
+		if tenant.ClientID == "" || tenant.Tenant == "" {
+			return nil, fmt.Errorf("%w: tenants should have client_id and tenant", ErrInvalidTenantIsolationPolicy)
+		}
+		// escaping of string literals differs between databases and their settings
+		if strings.ContainsAny(tenant.Tenant, "'\\") {
+			return nil, fmt.Errorf("%w: tenant of client_id '%s' can't contain quotes and backslashes", ErrInvalidTenantIsolationPolicy, tenant.ClientID)
+		}
+		if _, ok := policy.tenants[tenant.ClientID]; ok {
+			return nil, fmt.Errorf("%w: duplicate client_id '%s'", ErrInvalidTenantIsolationPolicy, tenant.ClientID)
+		}
+		policy.tenants[tenant.ClientID] = tenant.Tenant
+	}
+	return policy, nil
+}
+
+// tenantColumn returns tenant column of table and true, or false if table isn't shared by tenants
+func (policy *TenantIsolationPolicy) tenantColumn(table sqlparser.TableIdent) (string, bool) {
+	column, ok := policy.columns[strings.ToLower(table.RawValue())]
+	return column, ok
+}
+
+// tenant returns tenant of clientID and true, or false if queries of client aren't scoped
+func (policy *TenantIsolationPolicy) tenant(clientID []byte) (string, bool) {
+	tenant, ok := policy.tenants[string(clientID)]
+	return tenant, ok
+}
+
+// scope adds predicates of tenant to all SELECT, UPDATE and DELETE statements of statement including subqueries and
+// returns true if statement was changed
+func (policy *TenantIsolationPolicy) scope(statement sqlparser.Statement, tenant string) (bool, error) {
+	changed := false
+	err := sqlparser.Walk(func(node sqlparser.SQLNode) (bool, error) {
+		var tables sqlparser.TableExprs
+		var where **sqlparser.Where
+		switch node := node.(type) {
+		case *sqlparser.Select:
+			tables, where = node.From, &node.Where
+		case *sqlparser.Update:
+			if err := policy.checkUpdateExprs(node); err != nil {
+				return false, err
+			}
+			tables, where = node.TableExprs, &node.Where
+		case *sqlparser.Delete:
+			tables, where = node.TableExprs, &node.Where
+		default:
+			return true, nil
+		}
+		predicates, joinsChanged, err := policy.tablePredicates(tables, tenant)
+		if err != nil {
+			return false, err
+		}
+		if len(predicates) > 0 {
+			var expr sqlparser.Expr
+			if *where != nil {
+				expr = (*where).Expr
+			}
+			*where = sqlparser.NewWhere(sqlparser.WhereStr, andPredicates(expr, predicates))
+		}
+		changed = changed || joinsChanged || len(predicates) > 0
+		return true, nil
+	}, statement)
+	return changed, err
+}
+
+// checkUpdateExprs returns error if UPDATE changes tenant of rows
+func (policy *TenantIsolationPolicy) checkUpdateExprs(update *sqlparser.Update) error {
+	for _, table := range GetTablesWithAliases(update.TableExprs) {
+		column, ok := policy.tenantColumn(table.TableName.Name)
+		if !ok {
+			continue
+		}
+		for _, expr := range update.Exprs {
+			if expr.Name.Name.EqualString(column) {
+				return fmt.Errorf("%w: column '%s' of table '%s' can't be updated", ErrTenantIsolation, column, table.TableName.Name.RawValue())
+			}
+		}
+	}
+	return nil
+}
+
+// tablePredicates returns predicates of tenant for WHERE clause of tables. Predicates of tables which rows are
+// optional in outer joins are added to ON conditions of joins instead, so the second result is true if joins were
+// changed.
+func (policy *TenantIsolationPolicy) tablePredicates(tables sqlparser.TableExprs, tenant string) ([]sqlparser.Expr, bool, error) {
+	var predicates []sqlparser.Expr
+	changed := false
+	for _, tableExpr := range tables {
+		switch tableExpr := tableExpr.(type) {
+		case *sqlparser.AliasedTableExpr:
+			// subqueries are scoped by own WHERE clauses
+			tableName, ok := tableExpr.Expr.(sqlparser.TableName)
+			if !ok {
+				continue
+			}
+			column, ok := policy.tenantColumn(tableName.Name)
+			if !ok {
+				continue
+			}
+			qualifier := tableName
+			if !tableExpr.As.IsEmpty() {
+				qualifier = sqlparser.TableName{Name: tableExpr.As}
+			}
+			predicates = append(predicates, &sqlparser.ComparisonExpr{
+				Operator: sqlparser.EqualStr,
+				Left:     &sqlparser.ColName{Name: sqlparser.NewColIdent(column), Qualifier: qualifier},
+				Right:    sqlparser.NewStrVal([]byte(tenant)),
+			})
+		case *sqlparser.ParenTableExpr:
+			parenPredicates, parenChanged, err := policy.tablePredicates(tableExpr.Exprs, tenant)
+			if err != nil {
+				return nil, false, err
+			}
+			predicates = append(predicates, parenPredicates...)
+			changed = changed || parenChanged
+		case *sqlparser.JoinTableExpr:
+			left, leftChanged, err := policy.tablePredicates(sqlparser.TableExprs{tableExpr.LeftExpr}, tenant)
+			if err != nil {
+				return nil, false, err
+			}
+			right, rightChanged, err := policy.tablePredicates(sqlparser.TableExprs{tableExpr.RightExpr}, tenant)
+			if err != nil {
+				return nil, false, err
+			}
+			changed = changed || leftChanged || rightChanged
+			var optional []sqlparser.Expr
+			switch tableExpr.Join {
+			case sqlparser.LeftJoinStr, sqlparser.NaturalLeftJoinStr:
+				predicates, optional = append(predicates, left...), right
+			case sqlparser.RightJoinStr, sqlparser.NaturalRightJoinStr:
+				predicates, optional = append(predicates, right...), left
+			default:
+				predicates = append(append(predicates, left...), right...)
+			}
+			if len(optional) == 0 {
+				continue
+			}
+			// USING and NATURAL joins have no condition which predicates may be added to
+			if tableExpr.Condition.On == nil {
+				return nil, false, fmt.Errorf("%w: %s without ON condition", ErrTenantIsolation, tableExpr.Join)
+			}
+			tableExpr.Condition.On = andPredicates(tableExpr.Condition.On, optional)
+			changed = true
+		default:
+			return nil, false, fmt.Errorf("%w: unsupported table expression", ErrTenantIsolation)
+		}
+	}
+	return predicates, changed, nil
+}
+
+// andPredicates returns conjunction of expr and predicates, expr may be nil
+func andPredicates(expr sqlparser.Expr, predicates []sqlparser.Expr) sqlparser.Expr {
+	if _, ok := expr.(*sqlparser.OrExpr); ok {
+		expr = &sqlparser.ParenExpr{Expr: expr}
+	}
+	for _, predicate := range predicates {
+		if expr == nil {
+			expr = predicate
+			continue
+		}
+		expr = &sqlparser.AndExpr{Left: expr, Right: predicate}
+	}
+	return expr
+}
+
+// TenantIsolationRewriter is QueryObserver which scopes queries of tenant clients to rows of their tenant with
+// predicates on tenant columns, e.g. "WHERE orders.tenant_id = 'acme'", for databases without row-level security.
+// Queries which can't be scoped are rejected. INSERT statements aren't changed, their tenant columns should be set by
+// applications.
+type TenantIsolationRewriter struct {
+	policy *TenantIsolationPolicy
+	logger *logrus.Entry
+	// lock protects clientID changed after TLS handshake
+	lock     sync.RWMutex
+	clientID []byte
+}
+
+// NewTenantIsolationRewriter returns TenantIsolationRewriter for connection of clientID
+func NewTenantIsolationRewriter(policy *TenantIsolationPolicy, clientID []byte, logger *logrus.Entry) *TenantIsolationRewriter {
+	return &TenantIsolationRewriter{policy: policy, clientID: clientID, logger: logger}
+}
+
+// ID returns name of this QueryObserver.
+func (rewriter *TenantIsolationRewriter) ID() string {
+	return "TenantIsolationRewriter"
+}
+
+// SetClientID replaces client ID which tenant queries are scoped to, e.g. after it's extracted from TLS certificate
+func (rewriter *TenantIsolationRewriter) SetClientID(clientID []byte) {
+	rewriter.lock.Lock()
+	rewriter.clientID = clientID
+	rewriter.lock.Unlock()
+}
+
+// IsTenant returns true if queries of connection are scoped to tenant. Queries of tenants should be rejected on errors
+// of other QueryObservers too, because original queries aren't scoped.
+func (rewriter *TenantIsolationRewriter) IsTenant() bool {
+	rewriter.lock.RLock()
+	defer rewriter.lock.RUnlock()
+	_, ok := rewriter.policy.tenant(rewriter.clientID)
+	return ok
+}
+
+// OnQuery adds predicates of tenant to queries of tenant clients and returns ErrTenantIsolation for queries which
+// can't be parsed or scoped
+func (rewriter *TenantIsolationRewriter) OnQuery(query base.OnQueryObject) (base.OnQueryObject, bool, error) {
+	rewriter.lock.RLock()
+	clientID := rewriter.clientID
+	rewriter.lock.RUnlock()
+	tenant, ok := rewriter.policy.tenant(clientID)
+	if !ok {
+		return query, false, nil
+	}
+	statement, err := query.Statement()
+	if err == nil {
+		var changed bool
+		changed, err = rewriter.policy.scope(statement, tenant)
+		if err == nil {
+			if !changed {
+				return query, false, nil
+			}
+			rewriter.logger.WithField("tenant", tenant).Debugln("Query scoped to tenant")
+			return base.NewOnQueryObjectFromStatement(statement), true, nil
+		}
+	} else {
+		err = fmt.Errorf("%w: %s", ErrTenantIsolation, err)
+	}
+	TenantIsolationRejectedCounter.Inc()
+	rewriter.logger.WithError(err).WithField("tenant", tenant).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorEncryptorTenantIsolation).
+		Warningln("Query of tenant was rejected")
+	return query, false, err
+}
+
+// OnBind doesn't process bound values, tenant predicates don't use placeholders.
+func (rewriter *TenantIsolationRewriter) OnBind(statement sqlparser.Statement, values []base.BoundValue) ([]base.BoundValue, bool, error) {
+	return values, false, nil
+}
+
+// IsRejectedQuery returns true if err of QueryObserver means that query shouldn't be sent to the database
+func IsRejectedQuery(err error) bool {
+	return errors.Is(err, ErrSchemaDrift) || errors.Is(err, ErrTenantIsolation)
+}
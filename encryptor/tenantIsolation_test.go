@@ -0,0 +1,177 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package encryptor
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/cossacklabs/acra/decryptor/base"
+	"github.com/cossacklabs/acra/sqlparser"
+	"github.com/cossacklabs/acra/sqlparser/dialect"
+	"github.com/cossacklabs/acra/sqlparser/dialect/mysql"
+	"github.com/cossacklabs/acra/sqlparser/dialect/postgresql"
+	"github.com/sirupsen/logrus"
+)
+
+func TestParseTenantIsolationPolicy(t *testing.T) {
+	invalidConfigs := []string{
+		"tables: [{table: orders, column: tenant_id}]",
+		"tenants: [{client_id: app, tenant: acme}]",
+		"tables: [{table: orders}]\ntenants: [{client_id: app, tenant: acme}]",
+		"tables: [{table: orders, column: tenant_id}, {table: orders, column: owner}]\ntenants: [{client_id: app, tenant: acme}]",
+		"tables: [{table: orders, column: tenant_id}, {table: ORDERS, column: owner}]\ntenants: [{client_id: app, tenant: acme}]",
+		"tables: [{table: orders, column: tenant_id}]\ntenants: [{client_id: app}]",
+		"tables: [{table: orders, column: tenant_id}]\ntenants: [{client_id: app, tenant: acme}, {client_id: app, tenant: other}]",
+		"tables: [{table: orders, column: tenant_id}]\ntenants: [{client_id: app, tenant: \"it's\"}]",
+		"unknown: value",
+	}
+	for _, configStr := range invalidConfigs {
+		if _, err := ParseTenantIsolationPolicy([]byte(configStr)); err == nil {
+			t.Fatalf("Expected error for config '%s'", configStr)
+		}
+	}
+}
+
+func TestTenantIsolationRewriter(t *testing.T) {
+	sqlparser.SetDefaultDialect(mysql.NewMySQLDialect())
+	policy, err := ParseTenantIsolationPolicy([]byte(`
+tables:
+  - table: orders
+    column: tenant_id
+  - table: customers
+    column: tenant
+tenants:
+  - client_id: acme_app
+    tenant: acme
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		query    string
+		expected string
+	}{
+		{"select * from orders",
+			"select * from orders where orders.tenant_id = 'acme'"},
+		{"select * from orders as o where o.id = 1 or o.id = 2",
+			"select * from orders as o where (o.id = 1 or o.id = 2) and o.tenant_id = 'acme'"},
+		{"select * from orders as o join customers as c on o.customer_id = c.id",
+			"select * from orders as o join customers as c on o.customer_id = c.id where o.tenant_id = 'acme' and c.tenant = 'acme'"},
+		{"select * from orders as o left join customers as c on o.customer_id = c.id",
+			"select * from orders as o left join customers as c on o.customer_id = c.id and c.tenant = 'acme' where o.tenant_id = 'acme'"},
+		{"select * from products where id in (select product_id from orders)",
+			"select * from products where id in (select product_id from orders where orders.tenant_id = 'acme')"},
+		{"update orders set amount = 1 where id = 2",
+			"update orders set amount = 1 where id = 2 and orders.tenant_id = 'acme'"},
+		{"delete from orders where id = 2",
+			"delete from orders where id = 2 and orders.tenant_id = 'acme'"},
+		// tables without tenant columns aren't changed
+		{"select * from products", "select * from products"},
+	}
+	rewriter := NewTenantIsolationRewriter(policy, []byte("acme_app"), logrus.NewEntry(logrus.StandardLogger()))
+	for i, testCase := range testCases {
+		query, changed, err := rewriter.OnQuery(base.NewOnQueryObjectFromQuery(testCase.query))
+		if err != nil {
+			t.Fatalf("[%d] %s", i, err)
+		}
+		if query.Query() != testCase.expected || changed != (testCase.query != testCase.expected) {
+			t.Fatalf("[%d] Expected '%s', took '%s'", i, testCase.expected, query.Query())
+		}
+	}
+	rejectedQueries := []string{
+		"update orders set tenant_id = 'other' where id = 1",
+		"select * from customers left join orders using (customer_id)",
+		"not a query",
+	}
+	for _, query := range rejectedQueries {
+		if _, _, err := rewriter.OnQuery(base.NewOnQueryObjectFromQuery(query)); !errors.Is(err, ErrTenantIsolation) || !IsRejectedQuery(err) {
+			t.Fatalf("Expected ErrTenantIsolation for '%s', took %v", query, err)
+		}
+	}
+
+	// queries of other clients aren't changed
+	rewriter.SetClientID([]byte("admin"))
+	if rewriter.IsTenant() {
+		t.Fatal("Unexpected tenant of client")
+	}
+	query := "select * from orders"
+	if result, changed, err := rewriter.OnQuery(base.NewOnQueryObjectFromQuery(query)); err != nil || changed || result.Query() != query {
+		t.Fatalf("Query of client without tenant was changed: '%s', %v", result.Query(), err)
+	}
+}
+
+func TestTenantIsolationRewriterTableNameCase(t *testing.T) {
+	policy, err := ParseTenantIsolationPolicy([]byte(`
+tables:
+  - table: Orders
+    column: tenant_id
+tenants:
+  - client_id: acme_app
+    tenant: acme
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		query    string
+		expected string
+	}{
+		{"select * from orders",
+			"select * from orders where orders.tenant_id = 'acme'"},
+		{"select * from ORDERS",
+			"select * from ORDERS where ORDERS.tenant_id = 'acme'"},
+		{"select * from Orders o",
+			"select * from Orders as o where o.tenant_id = 'acme'"},
+		{"select * from orders as O where O.id = 1",
+			"select * from orders as O where O.id = 1 and O.tenant_id = 'acme'"},
+		{"update ORDERS set amount = 1 where id = 2",
+			"update ORDERS set amount = 1 where id = 2 and ORDERS.tenant_id = 'acme'"},
+		{"update Orders as o set amount = 1 where o.id = 2",
+			"update Orders as o set amount = 1 where o.id = 2 and o.tenant_id = 'acme'"},
+		{"delete from ORDERS where id = 2",
+			"delete from ORDERS where id = 2 and ORDERS.tenant_id = 'acme'"},
+		{"delete o from OrDeRs as o where o.id = 2",
+			"delete o from OrDeRs as o where o.id = 2 and o.tenant_id = 'acme'"},
+	}
+	testDialects := []dialect.Dialect{mysql.NewMySQLDialect(), postgresql.NewPostgreSQLDialect()}
+	rewriter := NewTenantIsolationRewriter(policy, []byte("acme_app"), logrus.NewEntry(logrus.StandardLogger()))
+	for _, testDialect := range testDialects {
+		sqlparser.SetDefaultDialect(testDialect)
+		for i, testCase := range testCases {
+			query, changed, err := rewriter.OnQuery(base.NewOnQueryObjectFromQuery(testCase.query))
+			if err != nil {
+				t.Fatalf("[%T %d] %s", testDialect, i, err)
+			}
+			if query.Query() != testCase.expected || !changed {
+				t.Fatalf("[%T %d] Expected '%s', took '%s'", testDialect, i, testCase.expected, query.Query())
+			}
+		}
+		if _, _, err := rewriter.OnQuery(base.NewOnQueryObjectFromQuery("update ORDERS set TENANT_ID = 'other'")); !errors.Is(err, ErrTenantIsolation) {
+			t.Fatalf("[%T] Expected ErrTenantIsolation for update of tenant column, took %v", testDialect, err)
+		}
+	}
+	// quoted identifiers are matched case-insensitively too
+	sqlparser.SetDefaultDialect(postgresql.NewPostgreSQLDialect())
+	if _, changed, err := rewriter.OnQuery(base.NewOnQueryObjectFromQuery(`select * from "ORDERS"`)); err != nil || !changed {
+		t.Fatalf("Quoted table wasn't scoped: %v", err)
+	}
+	sqlparser.SetDefaultDialect(mysql.NewMySQLDialect())
+	if _, changed, err := rewriter.OnQuery(base.NewOnQueryObjectFromQuery("select * from `ORDERS`")); err != nil || !changed {
+		t.Fatalf("Quoted table wasn't scoped: %v", err)
+	}
+}
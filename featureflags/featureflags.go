@@ -0,0 +1,232 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package featureflags gates new behaviors of Acra services by rules loaded from file or remote endpoint, so risky
+// features are rolled out to percentage of sessions or listed client IDs gradually and disabled without restart.
+package featureflags
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v2"
+)
+
+// Rollout kinds define what percentage of flag is taken of
+const (
+	// RolloutSession enables flag for percentage of sessions chosen randomly
+	RolloutSession = "session"
+	// RolloutClient enables flag for percentage of client IDs, the same client ID always gets the same decision
+	RolloutClient = "client"
+)
+
+// SupportedRollouts is a list of supported rollout kinds
+var SupportedRollouts = []string{RolloutSession, RolloutClient}
+
+// percentage is split into buckets, so rollout is set with precision of 0.01%
+const bucketCount = 10000
+
+// ErrInvalidConfig returned for invalid rules of feature flags
+var ErrInvalidConfig = errors.New("invalid feature flags config")
+
+// FlagConfig describes rollout of one feature flag. Enabled set to false disables flag for everyone, listed client
+// IDs get enabled flag regardless of percentage, other ones get it with Percentage chance (100 if omitted).
+type FlagConfig struct {
+	Name       string   `yaml:"name"`
+	Enabled    *bool    `yaml:"enabled"`
+	Percentage *float64 `yaml:"percentage"`
+	Rollout    string   `yaml:"rollout"`
+	ClientIDs  []string `yaml:"client_ids"`
+}
+
+// Config is configuration of feature flags in YAML or JSON format
+type Config struct {
+	Flags []FlagConfig `yaml:"flags"`
+}
+
+// ParseConfig parses configuration of feature flags in YAML or JSON format
+func ParseConfig(data []byte) (*Config, error) {
+	config := &Config{}
+	if err := yaml.UnmarshalStrict(data, config); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidConfig, err)
+	}
+	return config, nil
+}
+
+// flagRule is validated FlagConfig
+type flagRule struct {
+	enabled   bool
+	threshold uint64
+	rollout   string
+	clientIDs map[string]struct{}
+}
+
+// compileRules validates config and returns rules of flags by their names
+func compileRules(config *Config) (map[string]*flagRule, error) {
+	rules := make(map[string]*flagRule, len(config.Flags))
+	for _, flagConfig := range config.Flags {
+		if flagConfig.Name == "" {
+			return nil, fmt.Errorf("%w: flag without name", ErrInvalidConfig)
+		}
+		if _, ok := rules[flagConfig.Name]; ok {
+			return nil, fmt.Errorf("%w: duplicated flag '%s'", ErrInvalidConfig, flagConfig.Name)
+		}
+		rule := &flagRule{enabled: true, threshold: bucketCount, rollout: RolloutSession, clientIDs: make(map[string]struct{}, len(flagConfig.ClientIDs))}
+		if flagConfig.Enabled != nil {
+			rule.enabled = *flagConfig.Enabled
+		}
+		if flagConfig.Percentage != nil {
+			percentage := *flagConfig.Percentage
+			if math.IsNaN(percentage) || percentage < 0 || percentage > 100 {
+				return nil, fmt.Errorf("%w: percentage of flag '%s' should be in range [0, 100]", ErrInvalidConfig, flagConfig.Name)
+			}
+			rule.threshold = uint64(math.Round(percentage * bucketCount / 100))
+		}
+		switch flagConfig.Rollout {
+		case "":
+		case RolloutSession, RolloutClient:
+			rule.rollout = flagConfig.Rollout
+		default:
+			return nil, fmt.Errorf("%w: flag '%s' has unknown rollout '%s', expected one of '%s'", ErrInvalidConfig,
+				flagConfig.Name, flagConfig.Rollout, strings.Join(SupportedRollouts, "', '"))
+		}
+		for _, clientID := range flagConfig.ClientIDs {
+			rule.clientIDs[clientID] = struct{}{}
+		}
+		rules[flagConfig.Name] = rule
+	}
+	return rules, nil
+}
+
+// bucket returns bucket of evaluation, random for sessions and derived from name of flag and client ID for clients.
+// Buckets of client IDs are stable, so clients enabled with lower percentage stay enabled when it's increased.
+func (rule *flagRule) bucket(name string, clientID []byte) uint64 {
+	if rule.rollout == RolloutClient {
+		hash := sha256.New()
+		hash.Write([]byte(name))
+		hash.Write([]byte{0})
+		hash.Write(clientID)
+		return binary.BigEndian.Uint64(hash.Sum(nil)) % bucketCount
+	}
+	return uint64(rand.Int63n(bucketCount))
+}
+
+// evaluate returns whether flag is enabled for clientID
+func (rule *flagRule) evaluate(name string, clientID []byte) bool {
+	if !rule.enabled {
+		return false
+	}
+	if _, ok := rule.clientIDs[string(clientID)]; ok {
+		return true
+	}
+	return rule.bucket(name, clientID) < rule.threshold
+}
+
+// Flags evaluates feature flags by last successfully loaded rules of Source
+type Flags struct {
+	source Source
+	rules  atomic.Value
+}
+
+// NewFlags returns Flags with rules of source, which should load successfully
+func NewFlags(source Source) (*Flags, error) {
+	flags := &Flags{source: source}
+	if err := flags.Reload(); err != nil {
+		return nil, err
+	}
+	return flags, nil
+}
+
+// Reload loads rules from source and replaces used ones, previous rules are kept on failure
+func (flags *Flags) Reload() error {
+	rules, err := flags.load()
+	if err != nil {
+		FeatureFlagReloadsCounter.WithLabelValues(ReloadStatusFail).Inc()
+		return err
+	}
+	flags.rules.Store(rules)
+	FeatureFlagReloadsCounter.WithLabelValues(ReloadStatusSuccess).Inc()
+	return nil
+}
+
+func (flags *Flags) load() (map[string]*flagRule, error) {
+	config, err := flags.source.Load()
+	if err != nil {
+		return nil, err
+	}
+	return compileRules(config)
+}
+
+// Enabled returns whether flag name is enabled for session of clientID. Flags unknown to rules and nil Flags return
+// defaultValue. Session rollouts make new decision on each call, so callers evaluate flag once per session.
+func (flags *Flags) Enabled(name string, clientID []byte, defaultValue bool) bool {
+	if flags == nil {
+		return defaultValue
+	}
+	result := defaultValue
+	rules, _ := flags.rules.Load().(map[string]*flagRule)
+	if rule, ok := rules[name]; ok {
+		result = rule.evaluate(name, clientID)
+	}
+	FeatureFlagEvaluationsCounter.WithLabelValues(name, strconv.FormatBool(result)).Inc()
+	return result
+}
+
+// Labels of feature flag metrics
+const (
+	FlagLabel         = "flag"
+	EnabledLabel      = "enabled"
+	ReloadStatusLabel = "status"
+)
+
+// Values of ReloadStatusLabel
+const (
+	ReloadStatusSuccess = "success"
+	ReloadStatusFail    = "fail"
+)
+
+// FeatureFlagEvaluationsCounter collects count of feature flag evaluations by flags and their results
+var FeatureFlagEvaluationsCounter = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "acra_feature_flag_evaluations_total",
+		Help: "number of feature flag evaluations by flag and result",
+	}, []string{FlagLabel, EnabledLabel})
+
+// FeatureFlagReloadsCounter collects count of reloads of feature flag rules
+var FeatureFlagReloadsCounter = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "acra_feature_flags_reloads_total",
+		Help: "number of reloads of feature flag rules",
+	}, []string{ReloadStatusLabel})
+
+var featureFlagsRegisterLock = sync.Once{}
+
+// RegisterFeatureFlagsMetrics register in default prometheus registry metrics related with feature flags
+func RegisterFeatureFlagsMetrics() {
+	featureFlagsRegisterLock.Do(func() {
+		prometheus.MustRegister(FeatureFlagEvaluationsCounter)
+		prometheus.MustRegister(FeatureFlagReloadsCounter)
+	})
+}
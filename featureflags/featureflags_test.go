@@ -0,0 +1,132 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package featureflags
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+type testSource struct {
+	data []byte
+	err  error
+}
+
+func (source *testSource) Load() (*Config, error) {
+	if source.err != nil {
+		return nil, source.err
+	}
+	return ParseConfig(source.data)
+}
+
+func (source *testSource) String() string {
+	return "test"
+}
+
+func TestFlagsEnabled(t *testing.T) {
+	source := &testSource{data: []byte(`
+flags:
+  - name: disabled
+    enabled: false
+    client_ids: [canary]
+  - name: all
+  - name: nobody
+    percentage: 0
+    client_ids: [canary]
+  - name: half
+    percentage: 50
+    rollout: client
+`)}
+	flags, err := NewFlags(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, clientID := range []string{"canary", "client"} {
+		if flags.Enabled("disabled", []byte(clientID), true) {
+			t.Fatal("Disabled flag should be disabled for listed clients too")
+		}
+		if !flags.Enabled("all", []byte(clientID), false) {
+			t.Fatal("Flag without percentage should be enabled for everyone")
+		}
+		if !flags.Enabled("unknown", []byte(clientID), true) || flags.Enabled("unknown", []byte(clientID), false) {
+			t.Fatal("Unknown flag should return default value")
+		}
+	}
+	if !flags.Enabled("nobody", []byte("canary"), false) || flags.Enabled("nobody", []byte("client"), true) {
+		t.Fatal("Flag with zero percentage should be enabled only for listed clients")
+	}
+
+	enabled := 0
+	for i := 0; i < 1000; i++ {
+		clientID := []byte(fmt.Sprintf("client%d", i))
+		result := flags.Enabled("half", clientID, false)
+		if result != flags.Enabled("half", clientID, false) {
+			t.Fatal("Client rollout should return the same result for the same client")
+		}
+		if result {
+			enabled++
+		}
+	}
+	if enabled < 400 || enabled > 600 {
+		t.Fatalf("Expected about half of clients enabled, took %d", enabled)
+	}
+
+	var nilFlags *Flags
+	if !nilFlags.Enabled("all", nil, true) {
+		t.Fatal("Nil flags should return default value")
+	}
+}
+
+func TestFlagsReloadKeepsPreviousRules(t *testing.T) {
+	source := &testSource{data: []byte(`{"flags": [{"name": "feature", "enabled": true}]}`)}
+	flags, err := NewFlags(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	source.err = errors.New("unavailable")
+	if err := flags.Reload(); err == nil {
+		t.Fatal("Expected error of source")
+	}
+	if !flags.Enabled("feature", nil, false) {
+		t.Fatal("Previous rules should be used after failed reload")
+	}
+	source.err = nil
+	source.data = []byte(`{"flags": [{"name": "feature", "enabled": false}]}`)
+	if err := flags.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if flags.Enabled("feature", nil, true) {
+		t.Fatal("Flag should be disabled after reload")
+	}
+}
+
+func TestInvalidConfig(t *testing.T) {
+	configs := []string{
+		`flags: [{enabled: true}]`,
+		`flags: [{name: a}, {name: a}]`,
+		`flags: [{name: a, percentage: 101}]`,
+		`flags: [{name: a, percentage: -1}]`,
+		`flags: [{name: a, rollout: region}]`,
+		`flags: [{name: a, unknown: field}]`,
+	}
+	for _, config := range configs {
+		if _, err := NewFlags(&testSource{data: []byte(config)}); !errors.Is(err, ErrInvalidConfig) {
+			t.Fatalf("Expected ErrInvalidConfig for %s, took %v", config, err)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package featureflags
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/cossacklabs/acra/logging"
+	log "github.com/sirupsen/logrus"
+)
+
+// Source loads configuration of feature flags
+type Source interface {
+	Load() (*Config, error)
+	String() string
+}
+
+// FileSource loads configuration of feature flags from YAML or JSON file
+type FileSource struct {
+	path string
+}
+
+// NewFileSource returns FileSource of file by path
+func NewFileSource(path string) *FileSource {
+	return &FileSource{path: path}
+}
+
+// Load reads and parses file
+func (source *FileSource) Load() (*Config, error) {
+	data, err := ioutil.ReadFile(source.path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseConfig(data)
+}
+
+// String returns path of file
+func (source *FileSource) String() string {
+	return source.path
+}
+
+// DefaultHTTPTimeout is timeout of requests of HTTPSource, which is shorter than usual reload interval
+const DefaultHTTPTimeout = 10 * time.Second
+
+// maxRemoteConfigSize limits size of configuration returned by remote endpoint
+const maxRemoteConfigSize = 1 << 20
+
+// HTTPSource loads configuration of feature flags from HTTP(S) endpoint, so fleet of services shares the same rules
+type HTTPSource struct {
+	url    string
+	client *http.Client
+}
+
+// NewHTTPSource returns HTTPSource of url with timeout of requests
+func NewHTTPSource(url string, timeout time.Duration) *HTTPSource {
+	return &HTTPSource{url: url, client: &http.Client{Timeout: timeout}}
+}
+
+// Load requests configuration with GET request
+func (source *HTTPSource) Load() (*Config, error) {
+	response, err := source.client.Get(source.url)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status of feature flags endpoint: %s", response.Status)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(response.Body, maxRemoteConfigSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxRemoteConfigSize {
+		return nil, fmt.Errorf("%w: larger than %d bytes", ErrInvalidConfig, maxRemoteConfigSize)
+	}
+	return ParseConfig(data)
+}
+
+// String returns URL of endpoint
+func (source *HTTPSource) String() string {
+	return source.url
+}
+
+// Run reloads rules every interval (if it's greater than zero) and when any of signals is received, until ctx is done
+func (flags *Flags) Run(ctx context.Context, interval time.Duration, signals ...os.Signal) {
+	var ticks <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		ticks = ticker.C
+	}
+	signalCh := make(chan os.Signal, 1)
+	if len(signals) > 0 {
+		signal.Notify(signalCh, signals...)
+		defer signal.Stop(signalCh)
+	}
+	logger := log.WithField("source", flags.source.String())
+	for {
+		var err error
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticks:
+			if err = flags.Reload(); err == nil {
+				logger.Debugln("Feature flags reloaded")
+			}
+		case sig := <-signalCh:
+			if err = flags.Reload(); err == nil {
+				logger.WithField("signal", sig.String()).Infoln("Feature flags reloaded by signal")
+			}
+		}
+		if err != nil {
+			logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+				Errorln("Can't reload feature flags, previous ones are used")
+		}
+	}
+}
@@ -0,0 +1,70 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package featureflags
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestFileSource(t *testing.T) {
+	file, err := ioutil.TempFile("", "feature_flags")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.WriteString("flags:\n  - name: feature\n    percentage: 0\n"); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	flags, err := NewFlags(NewFileSource(file.Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flags.Enabled("feature", []byte("client"), true) {
+		t.Fatal("Flag should be disabled by rules of file")
+	}
+	if _, err := NewFlags(NewFileSource(file.Name() + ".missing")); err == nil {
+		t.Fatal("Expected error for missing file")
+	}
+}
+
+func TestHTTPSource(t *testing.T) {
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.WriteHeader(status)
+		writer.Write([]byte(`{"flags": [{"name": "feature", "client_ids": ["client"], "percentage": 0}]}`))
+	}))
+	defer server.Close()
+	flags, err := NewFlags(NewHTTPSource(server.URL, DefaultHTTPTimeout))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !flags.Enabled("feature", []byte("client"), false) || flags.Enabled("feature", []byte("other"), true) {
+		t.Fatal("Flag should be enabled only for listed client")
+	}
+	status = http.StatusInternalServerError
+	if err := flags.Reload(); err == nil {
+		t.Fatal("Expected error for failed response")
+	}
+	if !flags.Enabled("feature", []byte("client"), false) {
+		t.Fatal("Previous rules should be used after failed reload")
+	}
+}
@@ -23,6 +23,9 @@ const (
 	WithoutCache = -1
 )
 
+// AllHistoricalKeys means that all rotated keys are used to decrypt data
+const AllHistoricalKeys = -1
+
 // NoCache is cache implementation for case when keystore should not to use any cache
 type NoCache struct{}
 
@@ -0,0 +1,127 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filesystem
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/cossacklabs/acra/keystore"
+	"github.com/cossacklabs/acra/utils"
+)
+
+// KeyStoreBackupVersion is the current version of keystore backup format
+const KeyStoreBackupVersion = 1
+
+// keyStoreBackupContext binds encrypted backup data to its purpose
+var keyStoreBackupContext = []byte("acra keystore backup")
+
+// Errors returned by keystore backup functions
+var (
+	ErrInvalidKeyStoreBackup            = errors.New("invalid keystore backup")
+	ErrUnsupportedKeyStoreBackupVersion = errors.New("unsupported keystore backup version")
+)
+
+// keyStoreBackup is serialized form of keystore backup. Data is sealed keyStoreBackupFiles under backup key, Secure Cell
+// authenticates it, so modified backups aren't imported.
+type keyStoreBackup struct {
+	Version int    `json:"version"`
+	Data    []byte `json:"data"`
+}
+
+// keyStoreBackupFiles are files of private and public key directories of keystore. Private keys inside stay encrypted
+// with master key, public ones are empty if both directories are the same.
+type keyStoreBackupFiles struct {
+	Private []keyBundleFile `json:"private"`
+	Public  []keyBundleFile `json:"public,omitempty"`
+}
+
+// Export returns archive of all keys of keystore encrypted with backupKey. Private keys inside remain encrypted with
+// master key, so keystore which imports it should use the same master key, but may use another storage.
+func (store *KeyStore) Export(backupKey []byte) ([]byte, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	files := keyStoreBackupFiles{}
+	var err error
+	files.Private, err = collectKeyBundleFiles(store.fs, store.privateKeyDirectory, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	if store.publicKeyDirectory != store.privateKeyDirectory {
+		files.Public, err = collectKeyBundleFiles(store.fs, store.publicKeyDirectory, "", nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+	plaintext, err := json.Marshal(files)
+	if err != nil {
+		return nil, err
+	}
+	defer utils.ZeroizeBytes(plaintext)
+	encryptor, err := keystore.NewSCellKeyEncryptor(backupKey)
+	if err != nil {
+		return nil, err
+	}
+	data, err := encryptor.Encrypt(plaintext, keyStoreBackupContext)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(&keyStoreBackup{Version: KeyStoreBackupVersion, Data: data})
+}
+
+// Import writes keys of archive created by Export with backupKey into keystore replacing files with the same names,
+// other keys of keystore are kept. Returns number of imported files.
+func (store *KeyStore) Import(backupData, backupKey []byte) (int, error) {
+	backup := &keyStoreBackup{}
+	if err := json.Unmarshal(backupData, backup); err != nil {
+		return 0, fmt.Errorf("%w: %s", ErrInvalidKeyStoreBackup, err)
+	}
+	if backup.Version != KeyStoreBackupVersion {
+		return 0, ErrUnsupportedKeyStoreBackupVersion
+	}
+	encryptor, err := keystore.NewSCellKeyEncryptor(backupKey)
+	if err != nil {
+		return 0, err
+	}
+	plaintext, err := encryptor.Decrypt(backup.Data, keyStoreBackupContext)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s", ErrInvalidKeyStoreBackup, err)
+	}
+	defer utils.ZeroizeBytes(plaintext)
+	files := keyStoreBackupFiles{}
+	if err := json.Unmarshal(plaintext, &files); err != nil {
+		return 0, fmt.Errorf("%w: %s", ErrInvalidKeyStoreBackup, err)
+	}
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	// cached keys may be replaced by imported ones
+	defer store.cache.Clear()
+	if err := writeKeyBundleFiles(store.fs, store.privateKeyDirectory, files.Private, ErrInvalidKeyStoreBackup); err != nil {
+		return 0, err
+	}
+	if err := writeKeyBundleFiles(store.fs, store.publicKeyDirectory, files.Public, ErrInvalidKeyStoreBackup); err != nil {
+		return 0, err
+	}
+	imported := 0
+	for _, file := range append(files.Private, files.Public...) {
+		if !file.Mode.IsDir() {
+			imported++
+		}
+	}
+	return imported, nil
+}
@@ -0,0 +1,93 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filesystem
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/cossacklabs/acra/keystore"
+)
+
+func TestKeyStoreBackup(t *testing.T) {
+	encryptor, err := keystore.NewSCellKeyEncryptor([]byte("master key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sourceKeyStore, err := NewCustomFilesystemKeyStore().KeyDirectories("/keys", "/public").Encryptor(encryptor).Storage(NewMemoryStorage()).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientID := []byte("client")
+	if err := sourceKeyStore.GenerateDataEncryptionKeys(clientID); err != nil {
+		t.Fatal(err)
+	}
+	expectedKey, err := sourceKeyStore.GetServerDecryptionPrivateKey(clientID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedPublicKey, err := sourceKeyStore.GetClientIDEncryptionPublicKey(clientID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backupKey := []byte("backup key")
+	backup, err := sourceKeyStore.Export(backupKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// keys are migrated into another storage with the same master key
+	targetKeyStore, err := NewCustomFilesystemKeyStore().KeyDirectories("/run/keys", "/run/public").Encryptor(encryptor).Storage(NewMemoryStorage()).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := targetKeyStore.Import(backup, []byte("wrong key")); !errors.Is(err, ErrInvalidKeyStoreBackup) {
+		t.Fatalf("Expected ErrInvalidKeyStoreBackup for wrong backup key, took %v", err)
+	}
+	tampered := &keyStoreBackup{}
+	if err := json.Unmarshal(backup, tampered); err != nil {
+		t.Fatal(err)
+	}
+	tampered.Data[len(tampered.Data)-1] ^= 1
+	tamperedBackup, err := json.Marshal(tampered)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := targetKeyStore.Import(tamperedBackup, backupKey); !errors.Is(err, ErrInvalidKeyStoreBackup) {
+		t.Fatalf("Expected ErrInvalidKeyStoreBackup for modified backup, took %v", err)
+	}
+	imported, err := targetKeyStore.Import(backup, backupKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported != 2 {
+		t.Fatalf("Expected private and public key files imported, took %d", imported)
+	}
+	privateKey, err := targetKeyStore.GetServerDecryptionPrivateKey(clientID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey, err := targetKeyStore.GetClientIDEncryptionPublicKey(clientID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(privateKey.Value, expectedKey.Value) || !bytes.Equal(publicKey.Value, expectedPublicKey.Value) {
+		t.Fatal("Restored keys don't match exported ones")
+	}
+}
@@ -0,0 +1,174 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filesystem
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/cossacklabs/acra/keystore"
+	"github.com/cossacklabs/acra/utils"
+)
+
+// KeyBundleVersion is the current version of key bundle format
+const KeyBundleVersion = 1
+
+// keyBundleContext binds encrypted bundle data to its purpose
+var keyBundleContext = []byte("acra key bundle")
+
+// Errors returned by key bundle functions
+var (
+	ErrInvalidKeyBundle            = errors.New("invalid key bundle")
+	ErrUnsupportedKeyBundleVersion = errors.New("unsupported key bundle version")
+)
+
+// KeyWrapper encrypts and decrypts data keys with a key managed by external KMS
+type KeyWrapper interface {
+	WrapKey(key []byte) ([]byte, error)
+	UnwrapKey(wrappedKey []byte) ([]byte, error)
+}
+
+// keyBundle is serialized form of key bundle. Data is a sealed list of keystore files under a random data key,
+// which is wrapped by KMS. Private keys inside stay encrypted with master key as in the filesystem keystore.
+type keyBundle struct {
+	Version    int    `json:"version"`
+	WrappedKey []byte `json:"wrapped_key"`
+	Data       []byte `json:"data"`
+}
+
+// keyBundleFile is a file or directory of keystore with path relative to key directory
+type keyBundleFile struct {
+	Path string      `json:"path"`
+	Mode os.FileMode `json:"mode"`
+	Data []byte      `json:"data,omitempty"`
+}
+
+func collectKeyBundleFiles(storage Storage, root, relativePath string, files []keyBundleFile) ([]keyBundleFile, error) {
+	infos, err := storage.ReadDir(filepath.Join(root, relativePath))
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range infos {
+		path := filepath.Join(relativePath, info.Name())
+		if info.IsDir() {
+			files = append(files, keyBundleFile{Path: path, Mode: info.Mode()})
+			files, err = collectKeyBundleFiles(storage, root, path, files)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		data, err := storage.ReadFile(filepath.Join(root, path))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, keyBundleFile{Path: path, Mode: info.Mode(), Data: data})
+	}
+	return files, nil
+}
+
+// CreateKeyBundle packs all files of key directory into a bundle encrypted with a data key wrapped by KMS
+func CreateKeyBundle(storage Storage, keyDirectory string, wrapper KeyWrapper) ([]byte, error) {
+	files, err := collectKeyBundleFiles(storage, keyDirectory, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := json.Marshal(files)
+	if err != nil {
+		return nil, err
+	}
+	defer utils.ZeroizeBytes(plaintext)
+	dataKey, err := keystore.GenerateSymmetricKey()
+	if err != nil {
+		return nil, err
+	}
+	defer utils.ZeroizeSymmetricKey(dataKey)
+	encryptor, err := keystore.NewSCellKeyEncryptor(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	data, err := encryptor.Encrypt(plaintext, keyBundleContext)
+	if err != nil {
+		return nil, err
+	}
+	wrappedKey, err := wrapper.WrapKey(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(&keyBundle{Version: KeyBundleVersion, WrappedKey: wrappedKey, Data: data})
+}
+
+// LoadKeyBundle decrypts the bundle with a data key unwrapped by KMS and writes its files into key directory of
+// the storage. It's used to seed MemoryStorage at startup.
+func LoadKeyBundle(bundleData []byte, wrapper KeyWrapper, storage Storage, keyDirectory string) error {
+	bundle := &keyBundle{}
+	if err := json.Unmarshal(bundleData, bundle); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidKeyBundle, err)
+	}
+	if bundle.Version != KeyBundleVersion {
+		return ErrUnsupportedKeyBundleVersion
+	}
+	dataKey, err := wrapper.UnwrapKey(bundle.WrappedKey)
+	if err != nil {
+		return err
+	}
+	defer utils.ZeroizeSymmetricKey(dataKey)
+	encryptor, err := keystore.NewSCellKeyEncryptor(dataKey)
+	if err != nil {
+		return err
+	}
+	plaintext, err := encryptor.Decrypt(bundle.Data, keyBundleContext)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidKeyBundle, err)
+	}
+	defer utils.ZeroizeBytes(plaintext)
+	var files []keyBundleFile
+	if err := json.Unmarshal(plaintext, &files); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidKeyBundle, err)
+	}
+	return writeKeyBundleFiles(storage, keyDirectory, files, ErrInvalidKeyBundle)
+}
+
+// writeKeyBundleFiles writes files with paths relative to key directory into storage. invalidErr is wrapped for
+// paths outside of key directory
+func writeKeyBundleFiles(storage Storage, keyDirectory string, files []keyBundleFile, invalidErr error) error {
+	if err := storage.MkdirAll(keyDirectory, keyDirMode); err != nil {
+		return err
+	}
+	var err error
+	for _, file := range files {
+		path := filepath.Clean(file.Path)
+		if filepath.IsAbs(path) || path == ".." || strings.HasPrefix(path, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("%w: file path %s is outside of key directory", invalidErr, file.Path)
+		}
+		path = filepath.Join(keyDirectory, path)
+		if file.Mode.IsDir() {
+			err = storage.MkdirAll(path, file.Mode.Perm())
+		} else {
+			err = storage.WriteFile(path, file.Data, file.Mode.Perm())
+			utils.ZeroizeBytes(file.Data)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filesystem
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/cossacklabs/acra/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrKeyIntegrityScanFailed returned when some private keys can't be decrypted with current master key
+var ErrKeyIntegrityScanFailed = errors.New("private keys can't be decrypted with master key")
+
+// KeyIntegrityScanOptions limits startup scan of private keys.
+// SampleSize is number of randomly chosen keys to check, 0 checks all keys.
+// Rate is maximum number of keys checked per second, 0 means no limit.
+type KeyIntegrityScanOptions struct {
+	SampleSize int
+	Rate       int
+}
+
+// KeyIntegrityScanResult summarizes integrity scan of private keys.
+type KeyIntegrityScanResult struct {
+	Total      int
+	Scanned    int
+	FailedKeys []string
+	Duration   time.Duration
+}
+
+// enumeratePrivateKeyPaths walks private key directory and returns paths of current encrypted private keys,
+// ignoring public keys, plaintext keys and history of rotated keys
+func (store *KeyStore) enumeratePrivateKeyPaths() ([]string, error) {
+	var paths []string
+	directories := []string{store.privateKeyDirectory}
+	for i := 0; i < len(directories); i++ {
+		files, err := store.fs.ReadDir(directories[i])
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			path := filepath.Join(directories[i], file.Name())
+			if file.IsDir() {
+				if !strings.HasSuffix(file.Name(), historyDirSuffix) {
+					directories = append(directories, path)
+				}
+				continue
+			}
+			key := defaultClassifier.ClassifyExportedKey(path)
+			if key == nil || key.PrivatePath == "" {
+				continue
+			}
+			paths = append(paths, path)
+		}
+	}
+	return paths, nil
+}
+
+// ScanKeyIntegrity checks that private keys can be decrypted with master key of the keystore. Keys are checked with
+// limited rate to avoid load spikes on start. Returns ErrKeyIntegrityScanFailed if any checked key can't be decrypted.
+// Scan stops on the first key if it fails because most likely wrong master key is used.
+func (store *KeyStore) ScanKeyIntegrity(options KeyIntegrityScanOptions) (*KeyIntegrityScanResult, error) {
+	startTime := time.Now()
+	paths, err := store.enumeratePrivateKeyPaths()
+	if err != nil {
+		return nil, err
+	}
+	result := &KeyIntegrityScanResult{Total: len(paths)}
+	if options.SampleSize > 0 && options.SampleSize < len(paths) {
+		sample := make([]string, options.SampleSize)
+		for i, index := range rand.Perm(len(paths))[:options.SampleSize] {
+			sample[i] = paths[index]
+		}
+		paths = sample
+	}
+	var throttle <-chan time.Time
+	if options.Rate > 0 {
+		ticker := time.NewTicker(time.Second / time.Duration(options.Rate))
+		defer ticker.Stop()
+		throttle = ticker.C
+	}
+	for i, path := range paths {
+		if throttle != nil && i > 0 {
+			<-throttle
+		}
+		result.Scanned++
+		encryptedKey, err := store.fs.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		key := defaultClassifier.ClassifyExportedKey(path)
+		decryptedKey, err := store.encryptor.Decrypt(encryptedKey, key.ID)
+		if err != nil {
+			log.WithError(err).WithField("path", path).Warningln("Can't decrypt private key with master key")
+			result.FailedKeys = append(result.FailedKeys, path)
+			if result.Scanned == 1 {
+				break
+			}
+			continue
+		}
+		utils.ZeroizeBytes(decryptedKey)
+	}
+	result.Duration = time.Since(startTime)
+	if len(result.FailedKeys) > 0 {
+		return result, fmt.Errorf("%w: %d of %d checked keys", ErrKeyIntegrityScanFailed, len(result.FailedKeys), result.Scanned)
+	}
+	return result, nil
+}
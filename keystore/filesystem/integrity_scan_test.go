@@ -0,0 +1,86 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filesystem
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/cossacklabs/acra/keystore"
+)
+
+func TestKeyStoreScanKeyIntegrity(t *testing.T) {
+	encryptor, err := keystore.NewSCellKeyEncryptor([]byte("master key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage := NewMemoryStorage()
+	keyStore, err := NewCustomFilesystemKeyStore().KeyDirectory("/keys").Encryptor(encryptor).Storage(storage).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientID := []byte("client")
+	if err := keyStore.GenerateDataEncryptionKeys(clientID); err != nil {
+		t.Fatal(err)
+	}
+	if err := keyStore.GenerateServerKeys(clientID); err != nil {
+		t.Fatal(err)
+	}
+	zoneID, _, err := keyStore.GenerateZoneKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// rotated keys are kept in history and aren't checked
+	if _, err := keyStore.RotateZoneKey(zoneID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keyStore.GetPoisonKeyPair(); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := keyStore.ScanKeyIntegrity(KeyIntegrityScanOptions{Rate: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Total != 4 || result.Scanned != 4 || len(result.FailedKeys) != 0 {
+		t.Fatalf("Unexpected scan result %+v", result)
+	}
+	result, err = keyStore.ScanKeyIntegrity(KeyIntegrityScanOptions{SampleSize: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Total != 4 || result.Scanned != 2 {
+		t.Fatalf("Unexpected scan result of sample %+v", result)
+	}
+
+	wrongEncryptor, err := keystore.NewSCellKeyEncryptor([]byte("wrong master key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrongKeyStore, err := NewCustomFilesystemKeyStore().KeyDirectory("/keys").Encryptor(wrongEncryptor).Storage(storage).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err = wrongKeyStore.ScanKeyIntegrity(KeyIntegrityScanOptions{})
+	if !errors.Is(err, ErrKeyIntegrityScanFailed) {
+		t.Fatalf("Expected ErrKeyIntegrityScanFailed, took %v", err)
+	}
+	// scan stops on the first key because master key is wrong
+	if result.Scanned != 1 || len(result.FailedKeys) != 1 {
+		t.Fatalf("Unexpected scan result with wrong master key %+v", result)
+	}
+}
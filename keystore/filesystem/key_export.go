@@ -284,6 +284,11 @@ func (*DefaultKeyFileClassifier) ClassifyExportedKey(path string) *ExportedKey {
 
 	filename := filepath.Base(path)
 
+	// files which mark revoked zones aren't keys
+	if strings.HasSuffix(filename, revokedZoneSuffix) {
+		return nil
+	}
+
 	if strings.HasSuffix(filename, "_storage.pub") {
 		id := []byte(strings.TrimSuffix(filename, "_storage.pub"))
 		return NewExportedPublicKey(path, id, PurposeStorageClientKeyPair)
@@ -0,0 +1,343 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filesystem
+
+import (
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cossacklabs/acra/random"
+	"github.com/cossacklabs/acra/utils"
+)
+
+// memoryFile is a file or directory of MemoryStorage
+type memoryFile struct {
+	data    []byte
+	mode    os.FileMode
+	modTime time.Time
+}
+
+// memoryFileInfo implements os.FileInfo for files of MemoryStorage
+type memoryFileInfo struct {
+	name string
+	file *memoryFile
+}
+
+func (info *memoryFileInfo) Name() string       { return info.name }
+func (info *memoryFileInfo) Size() int64        { return int64(len(info.file.data)) }
+func (info *memoryFileInfo) Mode() os.FileMode  { return info.file.mode }
+func (info *memoryFileInfo) ModTime() time.Time { return info.file.modTime }
+func (info *memoryFileInfo) IsDir() bool        { return info.file.mode.IsDir() }
+func (info *memoryFileInfo) Sys() interface{}   { return nil }
+
+// MemoryStorage keeps key files in memory and never writes them to disk. Key files keep the same format as in
+// filesystem, so private keys remain encrypted with master key. Removed and overwritten data is zeroized.
+type MemoryStorage struct {
+	files map[string]*memoryFile
+	mutex sync.RWMutex
+}
+
+// NewMemoryStorage returns empty MemoryStorage
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{files: make(map[string]*memoryFile)}
+}
+
+func cleanPath(path string) string {
+	return filepath.Clean(path)
+}
+
+func pathError(op, path string, err error) error {
+	return &os.PathError{Op: op, Path: path, Err: err}
+}
+
+// parentExists returns true if the parent directory of path exists. Relative paths are resolved against virtual
+// current directory which always exists.
+func (storage *MemoryStorage) parentExists(path string) bool {
+	parent := filepath.Dir(path)
+	if parent == "." || parent == string(filepath.Separator) {
+		return true
+	}
+	file, ok := storage.files[parent]
+	return ok && file.mode.IsDir()
+}
+
+// Stat a file at given path.
+func (storage *MemoryStorage) Stat(path string) (os.FileInfo, error) {
+	storage.mutex.RLock()
+	defer storage.mutex.RUnlock()
+	path = cleanPath(path)
+	file, ok := storage.files[path]
+	if !ok {
+		return nil, pathError("stat", path, os.ErrNotExist)
+	}
+	return &memoryFileInfo{name: filepath.Base(path), file: file}, nil
+}
+
+// Exists checks whether a file exists at a given path.
+func (storage *MemoryStorage) Exists(path string) (bool, error) {
+	_, err := storage.Stat(path)
+	if err == nil {
+		return true, nil
+	}
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return false, err
+}
+
+// ReadDir reads a directory and returns information about its contents sorted by name.
+func (storage *MemoryStorage) ReadDir(path string) ([]os.FileInfo, error) {
+	storage.mutex.RLock()
+	defer storage.mutex.RUnlock()
+	path = cleanPath(path)
+	if dir, ok := storage.files[path]; !ok || !dir.mode.IsDir() {
+		return nil, pathError("readdir", path, os.ErrNotExist)
+	}
+	var infos []os.FileInfo
+	for name, file := range storage.files {
+		if name != path && filepath.Dir(name) == path {
+			infos = append(infos, &memoryFileInfo{name: filepath.Base(name), file: file})
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	return infos, nil
+}
+
+// MkdirAll creates directory at given path with given permissions, including all missing intermediate directories.
+func (storage *MemoryStorage) MkdirAll(path string, perm os.FileMode) error {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	return storage.mkdirAll(cleanPath(path), perm)
+}
+
+func (storage *MemoryStorage) mkdirAll(path string, perm os.FileMode) error {
+	if path == "." || path == string(filepath.Separator) {
+		return nil
+	}
+	if file, ok := storage.files[path]; ok {
+		if !file.mode.IsDir() {
+			return pathError("mkdir", path, os.ErrExist)
+		}
+		return nil
+	}
+	if err := storage.mkdirAll(filepath.Dir(path), perm); err != nil {
+		return err
+	}
+	storage.files[path] = &memoryFile{mode: os.ModeDir | perm.Perm(), modTime: time.Now()}
+	return nil
+}
+
+// Rename a file atomically from oldpath to newpath, replacing a file at newpath if it exists.
+func (storage *MemoryStorage) Rename(oldpath, newpath string) error {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	oldpath, newpath = cleanPath(oldpath), cleanPath(newpath)
+	file, ok := storage.files[oldpath]
+	if !ok {
+		return pathError("rename", oldpath, os.ErrNotExist)
+	}
+	if !storage.parentExists(newpath) {
+		return pathError("rename", newpath, os.ErrNotExist)
+	}
+	if file.mode.IsDir() {
+		// move all children of directory
+		prefix := oldpath + string(filepath.Separator)
+		for name, child := range storage.files {
+			if strings.HasPrefix(name, prefix) {
+				delete(storage.files, name)
+				storage.files[newpath+string(filepath.Separator)+strings.TrimPrefix(name, prefix)] = child
+			}
+		}
+	}
+	replaced, hasReplaced := storage.files[newpath]
+	delete(storage.files, oldpath)
+	storage.files[newpath] = file
+	if hasReplaced {
+		storage.zeroizeUnlinked(replaced)
+	}
+	return nil
+}
+
+func randomSuffix() (string, error) {
+	suffix := make([]byte, 8)
+	if _, err := random.Read(suffix); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(suffix), nil
+}
+
+// createUnique creates file or directory with unique name made of pattern and random suffix
+func (storage *MemoryStorage) createUnique(op, pattern string, mode os.FileMode) (string, error) {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	pattern = cleanPath(pattern)
+	if !storage.parentExists(pattern) {
+		return "", pathError(op, pattern, os.ErrNotExist)
+	}
+	for {
+		suffix, err := randomSuffix()
+		if err != nil {
+			return "", err
+		}
+		path := pattern + suffix
+		if _, ok := storage.files[path]; ok {
+			continue
+		}
+		storage.files[path] = &memoryFile{mode: mode, modTime: time.Now()}
+		return path, nil
+	}
+}
+
+// TempFile creates a new temporary file with given name pattern and access permissions.
+func (storage *MemoryStorage) TempFile(pattern string, perm os.FileMode) (string, error) {
+	return storage.createUnique("createtemp", pattern, perm.Perm())
+}
+
+// TempDir creates a new temporary directory with given name pattern and access permissions.
+func (storage *MemoryStorage) TempDir(pattern string, perm os.FileMode) (string, error) {
+	return storage.createUnique("mkdirtemp", pattern, os.ModeDir|perm.Perm())
+}
+
+// Link creates newpath which refers to the same file as oldpath.
+func (storage *MemoryStorage) Link(oldpath, newpath string) error {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	oldpath, newpath = cleanPath(oldpath), cleanPath(newpath)
+	file, ok := storage.files[oldpath]
+	if !ok || file.mode.IsDir() {
+		return pathError("link", oldpath, os.ErrNotExist)
+	}
+	if _, ok := storage.files[newpath]; ok {
+		return pathError("link", newpath, os.ErrExist)
+	}
+	if !storage.parentExists(newpath) {
+		return pathError("link", newpath, os.ErrNotExist)
+	}
+	storage.files[newpath] = file
+	return nil
+}
+
+// Copy a file from src to dst, preserving access mode. It is an error if dst already exists.
+func (storage *MemoryStorage) Copy(src, dst string) error {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	src, dst = cleanPath(src), cleanPath(dst)
+	file, ok := storage.files[src]
+	if !ok || file.mode.IsDir() {
+		return pathError("copy", src, os.ErrNotExist)
+	}
+	if _, ok := storage.files[dst]; ok {
+		return pathError("copy", dst, os.ErrExist)
+	}
+	if !storage.parentExists(dst) {
+		return pathError("copy", dst, os.ErrNotExist)
+	}
+	storage.files[dst] = &memoryFile{data: append([]byte{}, file.data...), mode: file.mode, modTime: time.Now()}
+	return nil
+}
+
+// ReadFile returns copy of file content.
+func (storage *MemoryStorage) ReadFile(path string) ([]byte, error) {
+	storage.mutex.RLock()
+	defer storage.mutex.RUnlock()
+	path = cleanPath(path)
+	file, ok := storage.files[path]
+	if !ok || file.mode.IsDir() {
+		return nil, pathError("open", path, os.ErrNotExist)
+	}
+	return append([]byte{}, file.data...), nil
+}
+
+// WriteFile replaces entire content of the specified file, creating it with specified mode if it does not exist.
+func (storage *MemoryStorage) WriteFile(path string, data []byte, perm os.FileMode) error {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	path = cleanPath(path)
+	if !storage.parentExists(path) {
+		return pathError("open", path, os.ErrNotExist)
+	}
+	file, ok := storage.files[path]
+	if ok && file.mode.IsDir() {
+		return pathError("open", path, os.ErrExist)
+	}
+	if !ok {
+		file = &memoryFile{mode: perm.Perm()}
+		storage.files[path] = file
+	}
+	// hard links refer to the same file so it's updated in place
+	utils.ZeroizeBytes(file.data)
+	file.data = append([]byte{}, data...)
+	file.modTime = time.Now()
+	return nil
+}
+
+// Remove the file or empty directory at given path.
+func (storage *MemoryStorage) Remove(path string) error {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	path = cleanPath(path)
+	file, ok := storage.files[path]
+	if !ok {
+		return pathError("remove", path, os.ErrNotExist)
+	}
+	if file.mode.IsDir() {
+		prefix := path + string(filepath.Separator)
+		for name := range storage.files {
+			if strings.HasPrefix(name, prefix) {
+				return pathError("remove", path, os.ErrExist)
+			}
+		}
+	}
+	storage.remove(path)
+	return nil
+}
+
+// RemoveAll removes the path with any children that it contains.
+func (storage *MemoryStorage) RemoveAll(path string) error {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	path = cleanPath(path)
+	prefix := path + string(filepath.Separator)
+	for name := range storage.files {
+		if name == path || strings.HasPrefix(name, prefix) {
+			storage.remove(name)
+		}
+	}
+	return nil
+}
+
+// remove deletes file and zeroizes its data if there are no other links to it
+func (storage *MemoryStorage) remove(path string) {
+	file := storage.files[path]
+	delete(storage.files, path)
+	storage.zeroizeUnlinked(file)
+}
+
+// zeroizeUnlinked zeroizes data of file which isn't referred by any path
+func (storage *MemoryStorage) zeroizeUnlinked(file *memoryFile) {
+	for _, other := range storage.files {
+		if other == file {
+			return
+		}
+	}
+	utils.ZeroizeBytes(file.data)
+}
@@ -0,0 +1,159 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filesystem
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/cossacklabs/acra/keystore"
+)
+
+func TestMemoryStorageKeyStore(t *testing.T) {
+	FilesystemKeyStoreTests(NewMemoryStorage(), t)
+}
+
+func TestMemoryStorageHardLink(t *testing.T) {
+	storage := NewMemoryStorage()
+	if err := storage.MkdirAll("/keys/history", keyDirMode); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.WriteFile("/keys/key", []byte("old"), PrivateFileMode); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Link("/keys/key", "/keys/history/key"); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.WriteFile("/keys/key", []byte("new"), PrivateFileMode); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := storage.ReadFile("/keys/history/key"); !bytes.Equal(data, []byte("new")) {
+		t.Fatal("Link doesn't refer to the same file")
+	}
+	if err := storage.Remove("/keys"); err == nil {
+		t.Fatal("Expected error on removal of non-empty directory")
+	}
+	if err := storage.RemoveAll("/keys"); err != nil {
+		t.Fatal(err)
+	}
+	if exists, _ := storage.Exists("/keys/history/key"); exists {
+		t.Fatal("File wasn't removed with parent directory")
+	}
+}
+
+// testKeyWrapper wraps keys with Secure Cell instead of KMS
+type testKeyWrapper struct {
+	encryptor keystore.KeyEncryptor
+}
+
+func (wrapper testKeyWrapper) WrapKey(key []byte) ([]byte, error) {
+	return wrapper.encryptor.Encrypt(key, nil)
+}
+
+func (wrapper testKeyWrapper) UnwrapKey(wrappedKey []byte) ([]byte, error) {
+	return wrapper.encryptor.Decrypt(wrappedKey, nil)
+}
+
+func TestKeyBundle(t *testing.T) {
+	encryptor, err := keystore.NewSCellKeyEncryptor([]byte("master key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	source := NewMemoryStorage()
+	sourceKeyStore, err := NewCustomFilesystemKeyStore().KeyDirectory("/keys").Encryptor(encryptor).Storage(source).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientID := []byte("client")
+	if err := sourceKeyStore.GenerateDataEncryptionKeys(clientID); err != nil {
+		t.Fatal(err)
+	}
+	expectedKey, err := sourceKeyStore.GetServerDecryptionPrivateKey(clientID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wrapperEncryptor, err := keystore.NewSCellKeyEncryptor([]byte("kms key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrapper := testKeyWrapper{wrapperEncryptor}
+	bundle, err := CreateKeyBundle(source, "/keys", wrapper)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	storage := NewMemoryStorage()
+	if err := LoadKeyBundle(bundle, wrapper, storage, "/run/keys"); err != nil {
+		t.Fatal(err)
+	}
+	keyStore, err := NewCustomFilesystemKeyStore().KeyDirectory("/run/keys").Encryptor(encryptor).Storage(storage).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := keyStore.GetServerDecryptionPrivateKey(clientID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(key.Value, expectedKey.Value) {
+		t.Fatal("Loaded key differs from original")
+	}
+
+	otherEncryptor, err := keystore.NewSCellKeyEncryptor([]byte("other kms key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadKeyBundle(bundle, testKeyWrapper{otherEncryptor}, NewMemoryStorage(), "/keys"); err == nil {
+		t.Fatal("Expected error with incorrect KMS key")
+	}
+}
+
+func TestKeyBundlePathOutsideKeyDirectory(t *testing.T) {
+	encryptor, err := keystore.NewSCellKeyEncryptor([]byte("kms key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrapper := testKeyWrapper{encryptor}
+	dataKey := []byte("data key")
+	wrappedKey, err := wrapper.WrapKey(dataKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataEncryptor, err := keystore.NewSCellKeyEncryptor(dataKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"../key", "/etc/key"} {
+		files, err := json.Marshal([]keyBundleFile{{Path: path, Mode: PrivateFileMode, Data: []byte("key")}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := dataEncryptor.Encrypt(files, keyBundleContext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bundle, err := json.Marshal(&keyBundle{Version: KeyBundleVersion, WrappedKey: wrappedKey, Data: data})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := LoadKeyBundle(bundle, wrapper, NewMemoryStorage(), "/keys"); !errors.Is(err, ErrInvalidKeyBundle) {
+			t.Fatalf("%s: expected ErrInvalidKeyBundle, took %v", path, err)
+		}
+	}
+}
@@ -0,0 +1,412 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filesystem
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// redisTimeout limits every command sent to Redis
+	redisTimeout = time.Second * 10
+	// redisMaxAttempts limits reconnections and redirects of one operation
+	redisMaxAttempts = 5
+	// redisMaxBulkLength is max length of bulk string reply accepted from Redis
+	redisMaxBulkLength = 512 * 1024 * 1024
+)
+
+var (
+	errRedisProtocol  = errors.New("unexpected reply of Redis")
+	errRedisNotMaster = errors.New("Redis server returned by Sentinel isn't master")
+)
+
+// redisError is error reply of Redis
+type redisError string
+
+func (err redisError) Error() string {
+	return "redis: " + string(err)
+}
+
+// redirect returns address of node and true if error is MOVED or ASK redirection of Redis Cluster
+func (err redisError) redirect() (address string, ask bool, ok bool) {
+	fields := strings.Fields(string(err))
+	if len(fields) != 3 || (fields[0] != "MOVED" && fields[0] != "ASK") {
+		return "", false, false
+	}
+	return fields[2], fields[0] == "ASK", true
+}
+
+// redisConn is connection to Redis which sends commands and reads replies of RESP protocol
+type redisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
+}
+
+// do sends command and returns its reply: string, int64, []byte, []interface{} or nil. Error replies are returned as
+// redisError.
+func (conn *redisConn) do(args ...string) (interface{}, error) {
+	if err := conn.conn.SetDeadline(time.Now().Add(redisTimeout)); err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(conn.writer, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(conn.writer, "$%d\r\n", len(arg))
+		conn.writer.WriteString(arg)
+		conn.writer.WriteString("\r\n")
+	}
+	if err := conn.writer.Flush(); err != nil {
+		return nil, err
+	}
+	return conn.readReply()
+}
+
+func (conn *redisConn) readReply() (interface{}, error) {
+	line, err := conn.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if len(line) == 0 {
+		return nil, errRedisProtocol
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		length, err := strconv.Atoi(line[1:])
+		if err != nil || length > redisMaxBulkLength {
+			return nil, errRedisProtocol
+		}
+		if length < 0 {
+			return nil, nil
+		}
+		data := make([]byte, length+2)
+		if _, err := io.ReadFull(conn.reader, data); err != nil {
+			return nil, err
+		}
+		return data[:length], nil
+	case '*':
+		count, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, errRedisProtocol
+		}
+		if count < 0 {
+			return nil, nil
+		}
+		items := make([]interface{}, 0, count)
+		for i := 0; i < count; i++ {
+			item, err := conn.readReply()
+			if replyErr, ok := err.(redisError); ok {
+				// errors of commands of transaction are items of EXEC reply
+				items = append(items, replyErr)
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+		}
+		return items, nil
+	}
+	return nil, errRedisProtocol
+}
+
+func (conn *redisConn) close() {
+	conn.conn.Close()
+}
+
+// redisString converts bulk or simple string reply to string
+func redisString(reply interface{}) string {
+	switch value := reply.(type) {
+	case []byte:
+		return string(value)
+	case string:
+		return value
+	}
+	return ""
+}
+
+// redisInt converts integer or bulk string reply to integer, 0 is returned for nil replies
+func redisInt(reply interface{}) int64 {
+	switch value := reply.(type) {
+	case int64:
+		return value
+	case []byte:
+		number, _ := strconv.ParseInt(string(value), 10, 64)
+		return number
+	}
+	return 0
+}
+
+// isRetryableRedisError returns true for errors after which operation may succeed on other connection
+func isRetryableRedisError(err error) bool {
+	if replyErr, ok := err.(redisError); ok {
+		// replica which was master before failover
+		return strings.HasPrefix(string(replyErr), "READONLY")
+	}
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+	return err == io.EOF || err == io.ErrUnexpectedEOF
+}
+
+// redisClient keeps connection to Redis server, master monitored by Sentinels or node of Redis Cluster which serves
+// keys of keystore, it reconnects after failures, failovers and cluster redirects
+type redisClient struct {
+	config RedisConfig
+
+	lock    sync.Mutex
+	conn    *redisConn
+	address string
+	asking  bool
+}
+
+func newRedisClient(config RedisConfig) (*redisClient, error) {
+	if len(config.Addresses) == 0 {
+		return nil, errors.New("empty list of Redis addresses")
+	}
+	return &redisClient{config: config}, nil
+}
+
+// connect opens connection to address, authenticating and selecting database for Redis servers
+func (client *redisClient) connect(address string, server bool) (*redisConn, error) {
+	dialer := &net.Dialer{Timeout: redisTimeout}
+	var netConn net.Conn
+	var err error
+	if client.config.TLS != nil {
+		tlsConfig := client.config.TLS.Clone()
+		if tlsConfig.ServerName == "" {
+			tlsConfig.ServerName, _, _ = net.SplitHostPort(address)
+		}
+		netConn, err = tls.DialWithDialer(dialer, "tcp", address, tlsConfig)
+	} else {
+		netConn, err = dialer.Dial("tcp", address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn := &redisConn{conn: netConn, reader: bufio.NewReader(netConn), writer: bufio.NewWriter(netConn)}
+	if !server {
+		return conn, nil
+	}
+	if client.config.Password != "" {
+		args := []string{"AUTH", client.config.Password}
+		if client.config.Username != "" {
+			args = []string{"AUTH", client.config.Username, client.config.Password}
+		}
+		if _, err := conn.do(args...); err != nil {
+			conn.close()
+			return nil, err
+		}
+	}
+	if client.config.DB != 0 {
+		if _, err := conn.do("SELECT", strconv.Itoa(client.config.DB)); err != nil {
+			conn.close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// masterAddress asks Sentinels for address of current master
+func (client *redisClient) masterAddress() (string, error) {
+	var lastErr error
+	for _, address := range client.config.Addresses {
+		conn, err := client.connect(address, false)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		reply, err := conn.do("SENTINEL", "get-master-addr-by-name", client.config.SentinelMaster)
+		conn.close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		hostPort, ok := reply.([]interface{})
+		if !ok || len(hostPort) != 2 {
+			lastErr = fmt.Errorf("Sentinel %s doesn't know master %s", address, client.config.SentinelMaster)
+			continue
+		}
+		return net.JoinHostPort(redisString(hostPort[0]), redisString(hostPort[1])), nil
+	}
+	return "", lastErr
+}
+
+// dial connects to node which served keys last time, to current master of Sentinels or to any configured address
+func (client *redisClient) dial() (*redisConn, error) {
+	var addresses []string
+	if client.config.SentinelMaster != "" {
+		address, err := client.masterAddress()
+		if err != nil {
+			return nil, err
+		}
+		addresses = []string{address}
+	} else {
+		if client.address != "" {
+			addresses = append(addresses, client.address)
+		}
+		addresses = append(addresses, client.config.Addresses...)
+	}
+	var lastErr error
+	for _, address := range addresses {
+		conn, err := client.connect(address, true)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if client.config.SentinelMaster != "" {
+			role, err := conn.do("ROLE")
+			if items, ok := role.([]interface{}); err != nil || !ok || len(items) == 0 || redisString(items[0]) != "master" {
+				conn.close()
+				lastErr = errRedisNotMaster
+				continue
+			}
+		}
+		client.address = address
+		return conn, nil
+	}
+	return nil, lastErr
+}
+
+// run calls fn with connection, repeating it on other connection after redirects, failovers and network errors
+func (client *redisClient) run(fn func(conn *redisConn) error) error {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	var lastErr error
+	for attempt := 0; attempt < redisMaxAttempts; attempt++ {
+		if client.conn == nil {
+			conn, err := client.dial()
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			client.conn = conn
+		}
+		if client.asking {
+			client.asking = false
+			if _, err := client.conn.do("ASKING"); err != nil {
+				lastErr = err
+				client.reset()
+				continue
+			}
+		}
+		err := fn(client.conn)
+		if err == nil {
+			return nil
+		}
+		lastErr = err
+		if replyErr, ok := err.(redisError); ok {
+			if address, ask, ok := replyErr.redirect(); ok {
+				client.reset()
+				client.address, client.asking = address, ask
+				continue
+			}
+		}
+		if !isRetryableRedisError(err) {
+			return err
+		}
+		client.reset()
+		// master may be changed
+		client.address = ""
+	}
+	return lastErr
+}
+
+func (client *redisClient) reset() {
+	if client.conn != nil {
+		client.conn.close()
+		client.conn = nil
+	}
+}
+
+// do sends single command
+func (client *redisClient) do(args ...string) (interface{}, error) {
+	var reply interface{}
+	err := client.run(func(conn *redisConn) (err error) {
+		reply, err = conn.do(args...)
+		return err
+	})
+	return reply, err
+}
+
+// transaction watches keys, calls prepare to read current values and return commands, and executes commands in
+// MULTI/EXEC transaction. ErrRedisKeyConflict is returned if watched keys were changed before EXEC.
+func (client *redisClient) transaction(keys []string, prepare func(conn *redisConn) ([][]string, error)) error {
+	return client.run(func(conn *redisConn) error {
+		if len(keys) > 0 {
+			if _, err := conn.do(append([]string{"WATCH"}, keys...)...); err != nil {
+				return err
+			}
+		}
+		commands, err := prepare(conn)
+		if err != nil {
+			if len(keys) > 0 {
+				conn.do("UNWATCH")
+			}
+			return err
+		}
+		if _, err := conn.do("MULTI"); err != nil {
+			return err
+		}
+		for _, command := range commands {
+			if _, err := conn.do(command...); err != nil {
+				conn.do("DISCARD")
+				return err
+			}
+		}
+		reply, err := conn.do("EXEC")
+		if err != nil {
+			return err
+		}
+		// nil reply means that watched keys were changed
+		if reply == nil {
+			return ErrRedisKeyConflict
+		}
+		results, ok := reply.([]interface{})
+		if !ok {
+			return errRedisProtocol
+		}
+		for _, result := range results {
+			if replyErr, ok := result.(redisError); ok {
+				return replyErr
+			}
+		}
+		return nil
+	})
+}
+
+// close closes current connection
+func (client *redisClient) close() {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	client.reset()
+}
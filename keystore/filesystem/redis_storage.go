@@ -0,0 +1,639 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filesystem
+
+import (
+	"crypto/tls"
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cossacklabs/acra/keystore"
+	"github.com/cossacklabs/acra/utils"
+)
+
+// DefaultRedisKeyPrefix is default prefix of Redis keys with key files
+const DefaultRedisKeyPrefix = "acra"
+
+// redisDirMode is mode of directories of RedisStorage
+const redisDirMode = os.ModeDir | 0700
+
+// Errors returned by RedisStorage
+var (
+	ErrRedisKeyConflict         = errors.New("key file was changed concurrently by another instance")
+	ErrRedisPathOutsideKeyStore = errors.New("path is outside of key directory")
+)
+
+// RedisConfig describes connection to Redis with key files
+type RedisConfig struct {
+	// Addresses are host:port of Redis server, nodes of Redis Cluster or Sentinels if SentinelMaster is set
+	Addresses []string
+	// SentinelMaster is name of master monitored by Sentinels
+	SentinelMaster string
+	Username       string
+	Password       string
+	DB             int
+	// TLS configures connections to Redis if not nil
+	TLS *tls.Config
+	// Prefix of Redis keys, default is DefaultRedisKeyPrefix
+	Prefix string
+}
+
+// redisFileInfo implements os.FileInfo for files and directories of RedisStorage
+type redisFileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (info *redisFileInfo) Name() string       { return info.name }
+func (info *redisFileInfo) Size() int64        { return info.size }
+func (info *redisFileInfo) Mode() os.FileMode  { return info.mode }
+func (info *redisFileInfo) ModTime() time.Time { return info.modTime }
+func (info *redisFileInfo) IsDir() bool        { return info.mode.IsDir() }
+func (info *redisFileInfo) Sys() interface{}   { return nil }
+
+// RedisStorage keeps key files of key directory in Redis, so several AcraServers and AcraTranslators may share keys.
+// Every file is hash with content encrypted with master key in context of file path, mode, modification time and
+// version, every directory is set of names of its entries. All keys have the same hash tag made of prefix, so they
+// belong to one slot of Redis Cluster and may be changed in transactions.
+//
+// Renames are optimistically locked: if file was changed by another instance after this one has seen it with Stat or
+// ReadFile, Rename returns ErrRedisKeyConflict. So when several instances generate or rotate the same key, one of
+// them wins and others fail instead of overwriting the key silently.
+type RedisStorage struct {
+	client    *redisClient
+	prefix    string
+	root      string
+	encryptor keystore.KeyEncryptor
+
+	lock     sync.Mutex
+	versions map[string]int64
+}
+
+// NewRedisStorage returns RedisStorage of keyDirectory which encrypts key files with encryptor
+func NewRedisStorage(config RedisConfig, keyDirectory string, encryptor keystore.KeyEncryptor) (*RedisStorage, error) {
+	client, err := newRedisClient(config)
+	if err != nil {
+		return nil, err
+	}
+	prefix := config.Prefix
+	if prefix == "" {
+		prefix = DefaultRedisKeyPrefix
+	}
+	storage := &RedisStorage{
+		client:    client,
+		prefix:    "{" + prefix + "}",
+		root:      filepath.Clean(keyDirectory),
+		encryptor: encryptor,
+		versions:  make(map[string]int64),
+	}
+	if _, err := client.do("PING"); err != nil {
+		client.close()
+		return nil, err
+	}
+	return storage, nil
+}
+
+// Close closes connection to Redis
+func (storage *RedisStorage) Close() {
+	storage.client.close()
+}
+
+// relativePath returns slash separated path relative to key directory, "." is key directory itself
+func (storage *RedisStorage) relativePath(op, filePath string) (string, error) {
+	relative, err := filepath.Rel(storage.root, filepath.Clean(filePath))
+	if err != nil || relative == ".." || strings.HasPrefix(relative, ".."+string(filepath.Separator)) {
+		return "", pathError(op, filePath, ErrRedisPathOutsideKeyStore)
+	}
+	return filepath.ToSlash(relative), nil
+}
+
+func (storage *RedisStorage) fileKey(relative string) string {
+	return storage.prefix + ":file:" + relative
+}
+
+func (storage *RedisStorage) dirKey(relative string) string {
+	return storage.prefix + ":dir:" + relative
+}
+
+// linkCommands return commands which add entry of relative path to its parent directory and all parents up to key
+// directory
+func (storage *RedisStorage) linkCommands(relative string, dir bool) [][]string {
+	var commands [][]string
+	for relative != "." {
+		parent, name := path.Dir(relative), path.Base(relative)
+		if dir {
+			name += "/"
+		}
+		commands = append(commands, []string{"SADD", storage.dirKey(parent), name})
+		relative, dir = parent, true
+	}
+	return commands
+}
+
+// unlinkCommand returns command which removes entry of relative path from its parent directory
+func (storage *RedisStorage) unlinkCommand(relative string, dir bool) []string {
+	name := path.Base(relative)
+	if dir {
+		name += "/"
+	}
+	return []string{"SREM", storage.dirKey(path.Dir(relative)), name}
+}
+
+// seen remembers version of file which was seen by this instance
+func (storage *RedisStorage) seen(relative string, version int64) {
+	storage.lock.Lock()
+	storage.versions[relative] = version
+	storage.lock.Unlock()
+}
+
+func (storage *RedisStorage) seenVersion(relative string) (int64, bool) {
+	storage.lock.Lock()
+	defer storage.lock.Unlock()
+	version, ok := storage.versions[relative]
+	return version, ok
+}
+
+func (storage *RedisStorage) encrypt(data []byte, relative string) (string, error) {
+	// Secure Cell can't encrypt empty data, empty files are stored as they are
+	if len(data) == 0 {
+		return "", nil
+	}
+	encrypted, err := storage.encryptor.Encrypt(data, []byte(relative))
+	if err != nil {
+		return "", err
+	}
+	return string(encrypted), nil
+}
+
+func (storage *RedisStorage) decrypt(data []byte, relative string) ([]byte, error) {
+	if len(data) == 0 {
+		return []byte{}, nil
+	}
+	return storage.encryptor.Decrypt(data, []byte(relative))
+}
+
+// reencrypt decrypts content of file and encrypts it in context of other path
+func (storage *RedisStorage) reencrypt(data []byte, from, to string) (string, error) {
+	decrypted, err := storage.decrypt(data, from)
+	if err != nil {
+		return "", err
+	}
+	defer utils.ZeroizeBytes(decrypted)
+	return storage.encrypt(decrypted, to)
+}
+
+// readRedisFile returns fields of file hash, nil map is returned if file doesn't exist
+func readRedisFile(conn *redisConn, key string) (map[string][]byte, error) {
+	reply, err := conn.do("HGETALL", key)
+	if err != nil {
+		return nil, err
+	}
+	items, ok := reply.([]interface{})
+	if !ok || len(items)%2 != 0 {
+		return nil, errRedisProtocol
+	}
+	if len(items) == 0 {
+		return nil, nil
+	}
+	fields := make(map[string][]byte, len(items)/2)
+	for i := 0; i < len(items); i += 2 {
+		value, _ := items[i+1].([]byte)
+		fields[redisString(items[i])] = value
+	}
+	return fields, nil
+}
+
+// fileCommand returns command which writes all fields of file hash
+func (storage *RedisStorage) fileCommand(key, data string, mode os.FileMode, modTime, size, version int64) []string {
+	return []string{"HSET", key,
+		"data", data,
+		"mode", strconv.FormatUint(uint64(mode.Perm()), 10),
+		"mtime", strconv.FormatInt(modTime, 10),
+		"size", strconv.FormatInt(size, 10),
+		"version", strconv.FormatInt(version, 10),
+	}
+}
+
+func (storage *RedisStorage) isDir(relative string) (bool, error) {
+	if relative == "." {
+		return true, nil
+	}
+	reply, err := storage.client.do("SISMEMBER", storage.dirKey(path.Dir(relative)), path.Base(relative)+"/")
+	if err != nil {
+		return false, err
+	}
+	return redisInt(reply) == 1, nil
+}
+
+// Stat a file at given path.
+func (storage *RedisStorage) Stat(filePath string) (os.FileInfo, error) {
+	relative, err := storage.relativePath("stat", filePath)
+	if err != nil {
+		return nil, err
+	}
+	name := filepath.Base(filePath)
+	reply, err := storage.client.do("HMGET", storage.fileKey(relative), "mode", "mtime", "size", "version")
+	if err != nil {
+		return nil, pathError("stat", filePath, err)
+	}
+	fields, ok := reply.([]interface{})
+	if !ok || len(fields) != 4 {
+		return nil, pathError("stat", filePath, errRedisProtocol)
+	}
+	if fields[3] != nil {
+		storage.seen(relative, redisInt(fields[3]))
+		return &redisFileInfo{
+			name:    name,
+			size:    redisInt(fields[2]),
+			mode:    os.FileMode(redisInt(fields[0])).Perm(),
+			modTime: time.Unix(0, redisInt(fields[1])),
+		}, nil
+	}
+	dir, err := storage.isDir(relative)
+	if err != nil {
+		return nil, pathError("stat", filePath, err)
+	}
+	if dir {
+		return &redisFileInfo{name: name, mode: redisDirMode}, nil
+	}
+	// absence of file is seen too, so file created concurrently isn't overwritten
+	storage.seen(relative, 0)
+	return nil, pathError("stat", filePath, os.ErrNotExist)
+}
+
+// Exists checks whether a file exists at a given path.
+func (storage *RedisStorage) Exists(path string) (bool, error) {
+	_, err := storage.Stat(path)
+	if err == nil {
+		return true, nil
+	}
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return false, err
+}
+
+// ReadDir returns names and types of files and directories at path sorted by name.
+func (storage *RedisStorage) ReadDir(dirPath string) ([]os.FileInfo, error) {
+	relative, err := storage.relativePath("readdir", dirPath)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := storage.isDir(relative)
+	if err != nil {
+		return nil, pathError("readdir", dirPath, err)
+	}
+	if !dir {
+		return nil, pathError("readdir", dirPath, os.ErrNotExist)
+	}
+	reply, err := storage.client.do("SMEMBERS", storage.dirKey(relative))
+	if err != nil {
+		return nil, pathError("readdir", dirPath, err)
+	}
+	items, _ := reply.([]interface{})
+	names := make([]string, 0, len(items))
+	for _, item := range items {
+		names = append(names, redisString(item))
+	}
+	sort.Strings(names)
+	infos := make([]os.FileInfo, 0, len(names))
+	for _, name := range names {
+		if strings.HasSuffix(name, "/") {
+			infos = append(infos, &redisFileInfo{name: strings.TrimSuffix(name, "/"), mode: redisDirMode})
+			continue
+		}
+		infos = append(infos, &redisFileInfo{name: name, mode: PrivateFileMode})
+	}
+	return infos, nil
+}
+
+// MkdirAll creates a directory named path, along with any necessary parents.
+func (storage *RedisStorage) MkdirAll(dirPath string, perm os.FileMode) error {
+	relative, err := storage.relativePath("mkdir", dirPath)
+	if err != nil {
+		return err
+	}
+	commands := storage.linkCommands(relative, true)
+	if len(commands) == 0 {
+		return nil
+	}
+	err = storage.client.transaction(nil, func(*redisConn) ([][]string, error) {
+		return commands, nil
+	})
+	if err != nil {
+		return pathError("mkdir", dirPath, err)
+	}
+	return nil
+}
+
+// Rename a file from oldpath to newpath, replacing a file at newpath if it exists. ErrRedisKeyConflict is returned
+// if newpath was changed by another instance since it was seen by Stat or ReadFile.
+func (storage *RedisStorage) Rename(oldpath, newpath string) error {
+	oldRelative, err := storage.relativePath("rename", oldpath)
+	if err != nil {
+		return err
+	}
+	newRelative, err := storage.relativePath("rename", newpath)
+	if err != nil {
+		return err
+	}
+	oldKey, newKey := storage.fileKey(oldRelative), storage.fileKey(newRelative)
+	var version int64
+	err = storage.client.transaction([]string{oldKey, newKey}, func(conn *redisConn) ([][]string, error) {
+		fields, err := readRedisFile(conn, oldKey)
+		if err != nil {
+			return nil, err
+		}
+		if fields == nil {
+			return nil, os.ErrNotExist
+		}
+		current, err := conn.do("HGET", newKey, "version")
+		if err != nil {
+			return nil, err
+		}
+		if seen, ok := storage.seenVersion(newRelative); ok && seen != redisInt(current) {
+			return nil, ErrRedisKeyConflict
+		}
+		data, err := storage.reencrypt(fields["data"], oldRelative, newRelative)
+		if err != nil {
+			return nil, err
+		}
+		version = redisInt(current) + 1
+		commands := [][]string{
+			{"DEL", newKey},
+			storage.fileCommand(newKey, data, os.FileMode(redisInt(fields["mode"])), redisInt(fields["mtime"]), redisInt(fields["size"]), version),
+			{"DEL", oldKey},
+			storage.unlinkCommand(oldRelative, false),
+		}
+		return append(commands, storage.linkCommands(newRelative, false)...), nil
+	})
+	if err != nil {
+		return pathError("rename", oldpath, err)
+	}
+	storage.seen(newRelative, version)
+	return nil
+}
+
+// TempFile creates a new empty file with given name pattern and access permissions.
+func (storage *RedisStorage) TempFile(pattern string, perm os.FileMode) (string, error) {
+	for {
+		suffix, err := randomSuffix()
+		if err != nil {
+			return "", err
+		}
+		filePath := pattern + suffix
+		relative, err := storage.relativePath("createtemp", filePath)
+		if err != nil {
+			return "", err
+		}
+		key := storage.fileKey(relative)
+		created := false
+		err = storage.client.transaction([]string{key}, func(conn *redisConn) ([][]string, error) {
+			exists, err := conn.do("EXISTS", key)
+			if err != nil || redisInt(exists) != 0 {
+				return nil, err
+			}
+			created = true
+			commands := [][]string{storage.fileCommand(key, "", perm, time.Now().UnixNano(), 0, 1)}
+			return append(commands, storage.linkCommands(relative, false)...), nil
+		})
+		if err == ErrRedisKeyConflict || (err == nil && !created) {
+			continue
+		}
+		if err != nil {
+			return "", pathError("createtemp", filePath, err)
+		}
+		return filePath, nil
+	}
+}
+
+// TempDir creates a new directory with given name pattern and access permissions.
+func (storage *RedisStorage) TempDir(pattern string, perm os.FileMode) (string, error) {
+	for {
+		suffix, err := randomSuffix()
+		if err != nil {
+			return "", err
+		}
+		dirPath := pattern + suffix
+		exists, err := storage.Exists(dirPath)
+		if err != nil {
+			return "", err
+		}
+		if exists {
+			continue
+		}
+		if err := storage.MkdirAll(dirPath, perm); err != nil {
+			return "", err
+		}
+		return dirPath, nil
+	}
+}
+
+// Link copies file because Redis doesn't support links. It is an error if newpath already exists.
+func (storage *RedisStorage) Link(oldpath, newpath string) error {
+	return storage.Copy(oldpath, newpath)
+}
+
+// Copy a file from src to dst, preserving access mode. It is an error if dst already exists.
+func (storage *RedisStorage) Copy(src, dst string) error {
+	srcRelative, err := storage.relativePath("copy", src)
+	if err != nil {
+		return err
+	}
+	dstRelative, err := storage.relativePath("copy", dst)
+	if err != nil {
+		return err
+	}
+	srcKey, dstKey := storage.fileKey(srcRelative), storage.fileKey(dstRelative)
+	err = storage.client.transaction([]string{srcKey, dstKey}, func(conn *redisConn) ([][]string, error) {
+		fields, err := readRedisFile(conn, srcKey)
+		if err != nil {
+			return nil, err
+		}
+		if fields == nil {
+			return nil, os.ErrNotExist
+		}
+		exists, err := conn.do("EXISTS", dstKey)
+		if err != nil {
+			return nil, err
+		}
+		if redisInt(exists) != 0 {
+			return nil, os.ErrExist
+		}
+		data, err := storage.reencrypt(fields["data"], srcRelative, dstRelative)
+		if err != nil {
+			return nil, err
+		}
+		commands := [][]string{
+			storage.fileCommand(dstKey, data, os.FileMode(redisInt(fields["mode"])), time.Now().UnixNano(), redisInt(fields["size"]), 1),
+		}
+		return append(commands, storage.linkCommands(dstRelative, false)...), nil
+	})
+	if err != nil {
+		return pathError("copy", src, err)
+	}
+	return nil
+}
+
+// ReadFile reads entire content of the specified file.
+func (storage *RedisStorage) ReadFile(filePath string) ([]byte, error) {
+	relative, err := storage.relativePath("open", filePath)
+	if err != nil {
+		return nil, err
+	}
+	reply, err := storage.client.do("HMGET", storage.fileKey(relative), "data", "version")
+	if err != nil {
+		return nil, pathError("open", filePath, err)
+	}
+	fields, ok := reply.([]interface{})
+	if !ok || len(fields) != 2 {
+		return nil, pathError("open", filePath, errRedisProtocol)
+	}
+	if fields[1] == nil {
+		return nil, pathError("open", filePath, os.ErrNotExist)
+	}
+	storage.seen(relative, redisInt(fields[1]))
+	data, _ := fields[0].([]byte)
+	decrypted, err := storage.decrypt(data, relative)
+	if err != nil {
+		return nil, pathError("open", filePath, err)
+	}
+	return decrypted, nil
+}
+
+// WriteFile replaces entire content of the specified file.
+func (storage *RedisStorage) WriteFile(filePath string, data []byte, perm os.FileMode) error {
+	relative, err := storage.relativePath("open", filePath)
+	if err != nil {
+		return err
+	}
+	encrypted, err := storage.encrypt(data, relative)
+	if err != nil {
+		return pathError("open", filePath, err)
+	}
+	key := storage.fileKey(relative)
+	err = storage.client.transaction(nil, func(*redisConn) ([][]string, error) {
+		commands := [][]string{
+			{"HSETNX", key, "mode", strconv.FormatUint(uint64(perm.Perm()), 10)},
+			{"HSET", key, "data", encrypted, "mtime", strconv.FormatInt(time.Now().UnixNano(), 10), "size", strconv.Itoa(len(data))},
+			{"HINCRBY", key, "version", "1"},
+		}
+		return append(commands, storage.linkCommands(relative, false)...), nil
+	})
+	if err != nil {
+		return pathError("open", filePath, err)
+	}
+	return nil
+}
+
+// Remove the file or empty directory at given path.
+func (storage *RedisStorage) Remove(filePath string) error {
+	relative, err := storage.relativePath("remove", filePath)
+	if err != nil {
+		return err
+	}
+	fileKey, dirKey := storage.fileKey(relative), storage.dirKey(relative)
+	err = storage.client.transaction([]string{fileKey, dirKey}, func(conn *redisConn) ([][]string, error) {
+		exists, err := conn.do("EXISTS", fileKey)
+		if err != nil {
+			return nil, err
+		}
+		if redisInt(exists) != 0 {
+			return [][]string{{"DEL", fileKey}, storage.unlinkCommand(relative, false)}, nil
+		}
+		entries, err := conn.do("SCARD", dirKey)
+		if err != nil {
+			return nil, err
+		}
+		if redisInt(entries) != 0 {
+			return nil, os.ErrExist
+		}
+		if relative == "." {
+			return nil, nil
+		}
+		dir, err := conn.do("SISMEMBER", storage.dirKey(path.Dir(relative)), path.Base(relative)+"/")
+		if err != nil {
+			return nil, err
+		}
+		if redisInt(dir) == 0 {
+			return nil, os.ErrNotExist
+		}
+		return [][]string{storage.unlinkCommand(relative, true)}, nil
+	})
+	if err != nil {
+		return pathError("remove", filePath, err)
+	}
+	return nil
+}
+
+// RemoveAll removes the path with any children that it contains.
+func (storage *RedisStorage) RemoveAll(filePath string) error {
+	infos, err := storage.ReadDir(filePath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, info := range infos {
+		if err := storage.RemoveAll(filepath.Join(filePath, info.Name())); err != nil {
+			return err
+		}
+	}
+	err = storage.Remove(filePath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// RedisKeyStore is keystore with key files kept in Redis
+type RedisKeyStore struct {
+	*KeyStore
+	storage *RedisStorage
+}
+
+// NewRedisKeyStore returns keystore of keyDirectory stored in Redis with private keys and key files encrypted by
+// encryptor
+func NewRedisKeyStore(config RedisConfig, keyDirectory string, encryptor keystore.KeyEncryptor, cacheSize int) (*RedisKeyStore, error) {
+	storage, err := NewRedisStorage(config, keyDirectory, encryptor)
+	if err != nil {
+		return nil, err
+	}
+	keyStore, err := NewCustomFilesystemKeyStore().
+		KeyDirectory(keyDirectory).
+		Encryptor(encryptor).
+		Storage(storage).
+		CacheSize(cacheSize).
+		Build()
+	if err != nil {
+		storage.Close()
+		return nil, err
+	}
+	return &RedisKeyStore{KeyStore: keyStore, storage: storage}, nil
+}
+
+// Storage returns storage of key files of keystore
+func (store *RedisKeyStore) Storage() *RedisStorage {
+	return store.storage
+}
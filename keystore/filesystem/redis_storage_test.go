@@ -0,0 +1,488 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filesystem
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/cossacklabs/acra/keystore"
+)
+
+// fakeRedis implements commands of Redis used by RedisStorage
+type fakeRedis struct {
+	listener net.Listener
+	lock     sync.Mutex
+	hashes   map[string]map[string]string
+	sets     map[string]map[string]bool
+	// modifications counts changes of keys for WATCH
+	modifications map[string]int
+	password      string
+	// moved is address of node which serves keys, every key command is redirected there
+	moved string
+	// master is address returned to SENTINEL command
+	master string
+}
+
+// fakeRedisAbort is reply of EXEC if watched keys were changed
+type fakeRedisAbort struct{}
+
+// newFakeRedis returns server which accepts connections after start, so it may be configured before
+func newFakeRedis(t *testing.T) *fakeRedis {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	redis := &fakeRedis{
+		listener:      listener,
+		hashes:        make(map[string]map[string]string),
+		sets:          make(map[string]map[string]bool),
+		modifications: make(map[string]int),
+	}
+	return redis
+}
+
+func (redis *fakeRedis) start() {
+	go func() {
+		for {
+			conn, err := redis.listener.Accept()
+			if err != nil {
+				return
+			}
+			go redis.serve(conn)
+		}
+	}()
+}
+
+func (redis *fakeRedis) address() string {
+	return redis.listener.Addr().String()
+}
+
+func (redis *fakeRedis) close() {
+	redis.listener.Close()
+}
+
+func readFakeRedisCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	count, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, count)
+	for i := range args {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		length, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+		if err != nil {
+			return nil, err
+		}
+		data := make([]byte, length+2)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return nil, err
+		}
+		args[i] = string(data[:length])
+	}
+	return args, nil
+}
+
+func writeFakeRedisReply(writer *bufio.Writer, reply interface{}) {
+	switch value := reply.(type) {
+	case nil:
+		writer.WriteString("$-1\r\n")
+	case fakeRedisAbort:
+		writer.WriteString("*-1\r\n")
+	case redisError:
+		fmt.Fprintf(writer, "-%s\r\n", string(value))
+	case int:
+		fmt.Fprintf(writer, ":%d\r\n", value)
+	case string:
+		fmt.Fprintf(writer, "$%d\r\n%s\r\n", len(value), value)
+	case []string:
+		fmt.Fprintf(writer, "*%d\r\n", len(value))
+		for _, item := range value {
+			fmt.Fprintf(writer, "$%d\r\n%s\r\n", len(item), item)
+		}
+	case []interface{}:
+		fmt.Fprintf(writer, "*%d\r\n", len(value))
+		for _, item := range value {
+			writeFakeRedisReply(writer, item)
+		}
+	}
+}
+
+func (redis *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	reader, writer := bufio.NewReader(conn), bufio.NewWriter(conn)
+	authenticated := redis.password == ""
+	watched := make(map[string]int)
+	var queue [][]string
+	multi := false
+	for {
+		args, err := readFakeRedisCommand(reader)
+		if err != nil {
+			return
+		}
+		command := strings.ToUpper(args[0])
+		var reply interface{}
+		redis.lock.Lock()
+		switch {
+		case command == "AUTH":
+			authenticated = args[len(args)-1] == redis.password
+			reply = redisError("WRONGPASS invalid password")
+			if authenticated {
+				reply = "OK"
+			}
+		case !authenticated:
+			reply = redisError("NOAUTH Authentication required")
+		case command == "SENTINEL":
+			host, port, _ := net.SplitHostPort(redis.master)
+			reply = []string{host, port}
+		case command == "ROLE":
+			reply = []interface{}{"master", 0, []interface{}{}}
+		case command == "PING", command == "SELECT", command == "ASKING":
+			reply = "OK"
+		case redis.moved != "":
+			reply = redisError("MOVED 1 " + redis.moved)
+		case command == "WATCH":
+			for _, key := range args[1:] {
+				watched[key] = redis.modifications[key]
+			}
+			reply = "OK"
+		case command == "UNWATCH":
+			watched = make(map[string]int)
+			reply = "OK"
+		case command == "MULTI":
+			multi, queue = true, nil
+			reply = "OK"
+		case command == "DISCARD":
+			multi, queue, watched = false, nil, make(map[string]int)
+			reply = "OK"
+		case command == "EXEC":
+			aborted := false
+			for key, modifications := range watched {
+				if redis.modifications[key] != modifications {
+					aborted = true
+				}
+			}
+			if aborted {
+				reply = fakeRedisAbort{}
+			} else {
+				results := make([]interface{}, 0, len(queue))
+				for _, queued := range queue {
+					results = append(results, redis.execute(queued))
+				}
+				reply = results
+			}
+			multi, queue, watched = false, nil, make(map[string]int)
+		case multi:
+			queue = append(queue, args)
+			reply = "QUEUED"
+		default:
+			reply = redis.execute(args)
+		}
+		redis.lock.Unlock()
+		writeFakeRedisReply(writer, reply)
+		if err := writer.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func (redis *fakeRedis) execute(args []string) interface{} {
+	command, key := strings.ToUpper(args[0]), args[1]
+	hash, set := redis.hashes[key], redis.sets[key]
+	switch command {
+	case "HGETALL":
+		var fields []string
+		for field, value := range hash {
+			fields = append(fields, field, value)
+		}
+		return toInterfaces(fields)
+	case "HMGET":
+		values := make([]interface{}, 0, len(args)-2)
+		for _, field := range args[2:] {
+			if value, ok := hash[field]; ok {
+				values = append(values, value)
+			} else {
+				values = append(values, nil)
+			}
+		}
+		return values
+	case "HGET":
+		if value, ok := hash[args[2]]; ok {
+			return value
+		}
+		return nil
+	case "HSET", "HSETNX", "HINCRBY":
+		if hash == nil {
+			hash = make(map[string]string)
+			redis.hashes[key] = hash
+		}
+		redis.modifications[key]++
+		switch command {
+		case "HSETNX":
+			if _, ok := hash[args[2]]; ok {
+				return 0
+			}
+			hash[args[2]] = args[3]
+		case "HINCRBY":
+			value, _ := strconv.Atoi(hash[args[2]])
+			increment, _ := strconv.Atoi(args[3])
+			hash[args[2]] = strconv.Itoa(value + increment)
+			return value + increment
+		default:
+			for i := 2; i+1 < len(args); i += 2 {
+				hash[args[i]] = args[i+1]
+			}
+		}
+		return 1
+	case "DEL":
+		deleted := 0
+		for _, key := range args[1:] {
+			if _, ok := redis.hashes[key]; ok {
+				deleted++
+			}
+			if _, ok := redis.sets[key]; ok {
+				deleted++
+			}
+			delete(redis.hashes, key)
+			delete(redis.sets, key)
+			redis.modifications[key]++
+		}
+		return deleted
+	case "EXISTS":
+		if hash != nil || set != nil {
+			return 1
+		}
+		return 0
+	case "SADD":
+		if set == nil {
+			set = make(map[string]bool)
+			redis.sets[key] = set
+		}
+		redis.modifications[key]++
+		for _, member := range args[2:] {
+			set[member] = true
+		}
+		return len(args) - 2
+	case "SREM":
+		redis.modifications[key]++
+		for _, member := range args[2:] {
+			delete(set, member)
+		}
+		if len(set) == 0 {
+			delete(redis.sets, key)
+		}
+		return len(args) - 2
+	case "SMEMBERS":
+		members := make([]string, 0, len(set))
+		for member := range set {
+			members = append(members, member)
+		}
+		return members
+	case "SISMEMBER":
+		if set[args[2]] {
+			return 1
+		}
+		return 0
+	case "SCARD":
+		return len(set)
+	}
+	return redisError("ERR unknown command " + command)
+}
+
+func toInterfaces(values []string) []interface{} {
+	items := make([]interface{}, len(values))
+	for i, value := range values {
+		items[i] = value
+	}
+	return items
+}
+
+func newTestRedisEncryptor(t *testing.T) keystore.KeyEncryptor {
+	encryptor, err := keystore.NewSCellKeyEncryptor(bytes.Repeat([]byte("k"), keystore.SymmetricKeyLength))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return encryptor
+}
+
+func TestRedisStorageKeyStore(t *testing.T) {
+	redis := newFakeRedis(t)
+	redis.start()
+	defer redis.close()
+	storage, err := NewRedisStorage(RedisConfig{Addresses: []string{redis.address()}}, ".", newTestRedisEncryptor(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+	FilesystemKeyStoreTests(storage, t)
+}
+
+func TestRedisKeyStore(t *testing.T) {
+	master := newFakeRedis(t)
+	master.password = "password"
+	master.start()
+	defer master.close()
+	sentinel := newFakeRedis(t)
+	sentinel.master = master.address()
+	sentinel.start()
+	defer sentinel.close()
+
+	config := RedisConfig{Addresses: []string{sentinel.address()}, SentinelMaster: "acra", Password: "password"}
+	store, err := NewRedisKeyStore(config, "/keys", newTestRedisEncryptor(t), keystore.WithoutCache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Storage().Close()
+	clientID := []byte("client")
+	for i := 0; i < 2; i++ {
+		if err := store.GenerateDataEncryptionKeys(clientID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	privateKeys, err := store.GetServerDecryptionPrivateKeys(clientID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(privateKeys) != 2 {
+		t.Fatalf("Expected current and historical keys, took %d", len(privateKeys))
+	}
+	publicKey, err := store.GetClientIDEncryptionPublicKey(clientID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	master.lock.Lock()
+	defer master.lock.Unlock()
+	for key, fields := range master.hashes {
+		if !strings.HasPrefix(key, "{"+DefaultRedisKeyPrefix+"}:") {
+			t.Fatalf("Key %s doesn't have hash tag of prefix", key)
+		}
+		if fields["data"] != "" && strings.Contains(fields["data"], string(publicKey.Value)) {
+			t.Fatalf("Key file %s is stored unencrypted", key)
+		}
+	}
+}
+
+func TestRedisStorageConflict(t *testing.T) {
+	redis := newFakeRedis(t)
+	redis.start()
+	defer redis.close()
+	config := RedisConfig{Addresses: []string{redis.address()}}
+	first, err := NewRedisStorage(config, "/keys", newTestRedisEncryptor(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	second, err := NewRedisStorage(config, "/keys", newTestRedisEncryptor(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+
+	if exists, err := first.Exists("/keys/key"); err != nil || exists {
+		t.Fatal("Expected absent file", err)
+	}
+	// another instance generates the same key meanwhile
+	if err := second.WriteFile("/keys/key", []byte("second"), PrivateFileMode); err != nil {
+		t.Fatal(err)
+	}
+	tmp, err := first.TempFile("/keys/key", PrivateFileMode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := first.WriteFile(tmp, []byte("first"), PrivateFileMode); err != nil {
+		t.Fatal(err)
+	}
+	err = first.Rename(tmp, "/keys/key")
+	if pathErr, ok := err.(*os.PathError); !ok || pathErr.Err != ErrRedisKeyConflict {
+		t.Fatalf("Expected ErrRedisKeyConflict, took %v", err)
+	}
+	data, err := first.ReadFile("/keys/key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, []byte("second")) {
+		t.Fatal("Key of another instance was overwritten")
+	}
+	// file was seen again by ReadFile, so rename succeeds now
+	if err := first.Rename(tmp, "/keys/key"); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := second.ReadFile("/keys/key"); !bytes.Equal(data, []byte("first")) {
+		t.Fatal("Unexpected content after rename")
+	}
+	infos, err := second.ReadDir("/keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 1 || infos[0].Name() != "key" {
+		t.Fatal("Expected only renamed file in directory")
+	}
+}
+
+func TestRedisStorageClusterRedirect(t *testing.T) {
+	node := newFakeRedis(t)
+	node.start()
+	defer node.close()
+	other := newFakeRedis(t)
+	other.moved = node.address()
+	other.start()
+	defer other.close()
+
+	storage, err := NewRedisStorage(RedisConfig{Addresses: []string{other.address()}}, "/keys", newTestRedisEncryptor(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+	if err := storage.WriteFile("/keys/dir/key", []byte("data"), PrivateFileMode); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := storage.ReadFile("/keys/dir/key"); err != nil || !bytes.Equal(data, []byte("data")) {
+		t.Fatal("Unexpected content of file", err)
+	}
+	node.lock.Lock()
+	other.lock.Lock()
+	written := len(node.hashes) == 1 && len(other.hashes) == 0
+	other.lock.Unlock()
+	node.lock.Unlock()
+	if !written {
+		t.Fatal("Expected file on node which serves slot")
+	}
+	if err := storage.Remove("/keys/dir"); err == nil {
+		t.Fatal("Expected error on removal of non-empty directory")
+	}
+	if err := storage.RemoveAll("/keys/dir"); err != nil {
+		t.Fatal(err)
+	}
+	if exists, _ := storage.Exists("/keys/dir"); exists {
+		t.Fatal("Directory wasn't removed")
+	}
+}
@@ -0,0 +1,126 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filesystem
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+
+	"github.com/cossacklabs/acra/keystore"
+	"github.com/cossacklabs/acra/utils"
+)
+
+// ErrResealNotSupported returned when keystore encryptor has single master key, so there is no other key to reseal with
+var ErrResealNotSupported = errors.New("keystore uses single master key, nothing to reseal")
+
+// ResealResult summarizes resealing of private keys with the newest master key.
+type ResealResult struct {
+	Total    int
+	Resealed int
+}
+
+// sealedKeyFile is path of private key encrypted with master key and its encryption context
+type sealedKeyFile struct {
+	path    string
+	context []byte
+}
+
+// enumerateSealedKeyFiles walks private key directory and returns current and rotated private keys
+func (store *KeyStore) enumerateSealedKeyFiles() ([]sealedKeyFile, error) {
+	var files []sealedKeyFile
+	directories := []string{store.privateKeyDirectory}
+	for i := 0; i < len(directories); i++ {
+		entries, err := store.fs.ReadDir(directories[i])
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			path := filepath.Join(directories[i], entry.Name())
+			if entry.IsDir() {
+				directories = append(directories, path)
+				continue
+			}
+			// rotated keys are kept in history directory named after current key and encrypted in the same context
+			keyPath := path
+			if strings.HasSuffix(directories[i], historyDirSuffix) {
+				keyPath = strings.TrimSuffix(directories[i], historyDirSuffix)
+			}
+			key := defaultClassifier.ClassifyExportedKey(keyPath)
+			if key == nil || key.PrivatePath == "" {
+				continue
+			}
+			files = append(files, sealedKeyFile{path: path, context: key.ID})
+		}
+	}
+	return files, nil
+}
+
+// Reseal encrypts private keys, including rotated ones, with the newest master key if they are encrypted with
+// older master keys. Files are replaced without keeping history, so old master keys may be removed afterwards.
+// Returns ErrResealNotSupported if keystore encryptor has single master key.
+func (store *KeyStore) Reseal() (*ResealResult, error) {
+	resealer, ok := store.encryptor.(keystore.MasterKeyResealer)
+	if !ok {
+		return nil, ErrResealNotSupported
+	}
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	// cached keys are encrypted with old master keys
+	defer store.cache.Clear()
+	files, err := store.enumerateSealedKeyFiles()
+	if err != nil {
+		return nil, err
+	}
+	result := &ResealResult{Total: len(files)}
+	for _, file := range files {
+		encrypted, err := store.fs.ReadFile(file.path)
+		if err != nil {
+			return result, err
+		}
+		if !resealer.NeedsReseal(encrypted) {
+			continue
+		}
+		decrypted, err := resealer.Decrypt(encrypted, file.context)
+		if err != nil {
+			return result, err
+		}
+		resealed, err := resealer.Encrypt(decrypted, file.context)
+		utils.ZeroizeBytes(decrypted)
+		if err != nil {
+			return result, err
+		}
+		if err := store.replaceKeyFile(file.path, resealed); err != nil {
+			return result, err
+		}
+		result.Resealed++
+	}
+	return result, nil
+}
+
+// replaceKeyFile atomically replaces content of private key file without backup of previous content
+func (store *KeyStore) replaceKeyFile(path string, data []byte) error {
+	tmpFilename, err := store.fs.TempFile(path, PrivateFileMode)
+	if err != nil {
+		return err
+	}
+	if err := store.fs.WriteFile(tmpFilename, data, PrivateFileMode); err != nil {
+		store.fs.Remove(tmpFilename)
+		return err
+	}
+	return store.fs.Rename(tmpFilename, path)
+}
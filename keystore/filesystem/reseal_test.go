@@ -0,0 +1,120 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filesystem
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/cossacklabs/acra/keystore"
+)
+
+func TestKeyStoreReseal(t *testing.T) {
+	oldMasterKey, err := keystore.GenerateSymmetricKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	newMasterKey, err := keystore.GenerateSymmetricKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldEncryptor, err := keystore.NewSCellKeyEncryptor(oldMasterKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage := NewMemoryStorage()
+	oldKeyStore, err := NewCustomFilesystemKeyStore().KeyDirectory("/keys").Encryptor(oldEncryptor).Storage(storage).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := oldKeyStore.Reseal(); err != ErrResealNotSupported {
+		t.Fatalf("Expected ErrResealNotSupported, took %v", err)
+	}
+	clientID := []byte("client")
+	if err := oldKeyStore.GenerateDataEncryptionKeys(clientID); err != nil {
+		t.Fatal(err)
+	}
+	zoneID, _, err := oldKeyStore.GenerateZoneKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := oldKeyStore.RotateZoneKey(zoneID); err != nil {
+		t.Fatal(err)
+	}
+	expectedZoneKeys, err := oldKeyStore.GetZonePrivateKeys(zoneID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedClientKey, err := oldKeyStore.GetServerDecryptionPrivateKey(clientID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encryptor, err := keystore.NewMultiMasterKeyEncryptor([]keystore.MasterKey{{ID: "new", Key: newMasterKey}, {ID: "old", Key: oldMasterKey}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyStore, err := NewCustomFilesystemKeyStore().KeyDirectory("/keys").Encryptor(encryptor).Storage(storage).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := keyStore.Reseal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// client storage key, current and rotated zone keys
+	if result.Total != 3 || result.Resealed != 3 {
+		t.Fatalf("Expected 3 resealed keys, took %+v", result)
+	}
+	result, err = keyStore.Reseal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Total != 3 || result.Resealed != 0 {
+		t.Fatalf("Expected no keys resealed twice, took %+v", result)
+	}
+
+	// keys are readable without old master key
+	newEncryptor, err := keystore.NewMultiMasterKeyEncryptor([]keystore.MasterKey{{ID: "new", Key: newMasterKey}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	newKeyStore, err := NewCustomFilesystemKeyStore().KeyDirectory("/keys").Encryptor(newEncryptor).Storage(storage).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	zoneKeys, err := newKeyStore.GetZonePrivateKeys(zoneID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// resealing doesn't add history of keys
+	if len(zoneKeys) != len(expectedZoneKeys) {
+		t.Fatalf("Expected %d zone keys, took %d", len(expectedZoneKeys), len(zoneKeys))
+	}
+	for i := range zoneKeys {
+		if !bytes.Equal(zoneKeys[i].Value, expectedZoneKeys[i].Value) {
+			t.Fatalf("Zone key %d changed after reseal", i)
+		}
+	}
+	clientKey, err := newKeyStore.GetServerDecryptionPrivateKey(clientID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(clientKey.Value, expectedClientKey.Value) {
+		t.Fatal("Client key changed after reseal")
+	}
+}
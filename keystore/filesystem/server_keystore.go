@@ -25,7 +25,6 @@ limitations under the License.
 package filesystem
 
 import (
-	"crypto/rand"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -36,6 +35,7 @@ import (
 
 	"github.com/cossacklabs/acra/keystore"
 	"github.com/cossacklabs/acra/keystore/lru"
+	"github.com/cossacklabs/acra/random"
 	"github.com/cossacklabs/acra/utils"
 	"github.com/cossacklabs/acra/zone"
 	"github.com/cossacklabs/themis/gothemis/keys"
@@ -58,6 +58,8 @@ type KeyStore struct {
 	fs                  Storage
 	lock                *sync.RWMutex
 	encryptor           keystore.KeyEncryptor
+	historicalKeysLimit int
+	revokedZones        *zoneRevocationCache
 }
 
 // NewFileSystemKeyStoreWithCacheSize represents keystore that reads keys from key folders, and stores them in cache.
@@ -82,14 +84,16 @@ type KeyStoreBuilder struct {
 	encryptor     keystore.KeyEncryptor
 	storage       Storage
 	cacheSize     int
+	historyLimit  int
 }
 
 // NewCustomFilesystemKeyStore allows a custom-made KeyStore to be built.
 // You must set at least root key directories and provide a KeyEncryptor.
 func NewCustomFilesystemKeyStore() *KeyStoreBuilder {
 	return &KeyStoreBuilder{
-		storage:   &fileStorage{},
-		cacheSize: keystore.InfiniteCacheSize,
+		storage:      &fileStorage{},
+		cacheSize:    keystore.InfiniteCacheSize,
+		historyLimit: keystore.AllHistoricalKeys,
 	}
 }
 
@@ -125,10 +129,18 @@ func (b *KeyStoreBuilder) CacheSize(cacheSize int) *KeyStoreBuilder {
 	return b
 }
 
+// HistoricalKeysLimit sets how many rotated keys are returned after the current one for decryption of data.
+// By default all rotated keys are returned.
+func (b *KeyStoreBuilder) HistoricalKeysLimit(limit int) *KeyStoreBuilder {
+	b.historyLimit = limit
+	return b
+}
+
 var (
 	errNoPrivateKeyDir = errors.New("private key directory not specified")
 	errNoPublicKeyDir  = errors.New("public key directory not specified")
 	errNoEncryptor     = errors.New("encryptor not specified")
+	errInvalidLimit    = errors.New("invalid limit of historical keys")
 )
 
 // Build constructs a KeyStore with specified parameters.
@@ -142,7 +154,15 @@ func (b *KeyStoreBuilder) Build() (*KeyStore, error) {
 	if b.encryptor == nil {
 		return nil, errNoEncryptor
 	}
-	return newFilesystemKeyStore(b.privateKeyDir, b.publicKeyDir, b.storage, b.encryptor, b.cacheSize)
+	if b.historyLimit < keystore.AllHistoricalKeys {
+		return nil, errInvalidLimit
+	}
+	store, err := newFilesystemKeyStore(b.privateKeyDir, b.publicKeyDir, b.storage, b.encryptor, b.cacheSize)
+	if err != nil {
+		return nil, err
+	}
+	store.historicalKeysLimit = b.historyLimit
+	return store, nil
 }
 
 // IsKeyDirectory checks if the local directory contains a keystore.
@@ -198,7 +218,8 @@ func newFilesystemKeyStore(privateKeyFolder, publicKeyFolder string, storage Sto
 		}
 	}
 	store := &KeyStore{privateKeyDirectory: privateKeyFolder, publicKeyDirectory: publicKeyFolder,
-		cache: cache, lock: &sync.RWMutex{}, encryptor: encryptor, fs: storage}
+		cache: cache, lock: &sync.RWMutex{}, encryptor: encryptor, fs: storage, historicalKeysLimit: keystore.AllHistoricalKeys,
+		revokedZones: newZoneRevocationCache()}
 	// set callback on cache value removing
 
 	return store, nil
@@ -247,7 +268,7 @@ func (store *KeyStore) SaveKeyPairWithFilename(keypair *keys.Keypair, filename s
 
 func (store *KeyStore) generateKey(filename string, length uint8) ([]byte, error) {
 	randomBytes := make([]byte, length)
-	_, err := rand.Read(randomBytes)
+	_, err := random.Read(randomBytes)
 	// Note that err == nil only if we read len(b) bytes.
 	if err != nil {
 		log.Error(err)
@@ -388,6 +409,19 @@ func (store *KeyStore) GetHistoricalPrivateKeyFilenames(filename string) ([]stri
 	return paths, nil
 }
 
+// getDecryptionKeyFilenames returns filenames of current and rotated keys which may be used to decrypt data,
+// from newest to oldest, limited by configured number of historical keys
+func (store *KeyStore) getDecryptionKeyFilenames(filename string) ([]string, error) {
+	filenames, err := store.GetHistoricalPrivateKeyFilenames(filename)
+	if err != nil {
+		return nil, err
+	}
+	if store.historicalKeysLimit != keystore.AllHistoricalKeys && len(filenames) > store.historicalKeysLimit+1 {
+		filenames = filenames[:store.historicalKeysLimit+1]
+	}
+	return filenames, nil
+}
+
 func (store *KeyStore) loadPrivateKey(path string) (*keys.PrivateKey, error) {
 	fi, err := store.fs.Stat(path)
 	if err != nil {
@@ -466,6 +500,9 @@ func (store *KeyStore) getPublicKeyByFilename(filename string) (*keys.PublicKey,
 
 // GetZonePublicKey return PublicKey by zoneID from cache or load from main store
 func (store *KeyStore) GetZonePublicKey(zoneID []byte) (*keys.PublicKey, error) {
+	if err := store.CheckZoneRevoked(zoneID); err != nil {
+		return nil, err
+	}
 	fname := store.GetPublicKeyFilePath(getZonePublicKeyFilename(zoneID))
 	return store.getPublicKeyByFilename(fname)
 }
@@ -481,8 +518,11 @@ func (store *KeyStore) GetClientIDEncryptionPublicKey(clientID []byte) (*keys.Pu
 }
 
 // GetZonePrivateKey reads encrypted zone private key from fs, decrypts it with master key and zoneId
-// and returns plaintext private key, or reading/decryption error.
+// and returns plaintext private key, or reading/decryption error. Returns ErrZoneRevoked for revoked zones.
 func (store *KeyStore) GetZonePrivateKey(id []byte) (*keys.PrivateKey, error) {
+	if err := store.CheckZoneRevoked(id); err != nil {
+		return nil, err
+	}
 	fname := GetZoneKeyFilename(id)
 	return store.getPrivateKeyByFilename(id, fname)
 }
@@ -508,11 +548,14 @@ func (store *KeyStore) HasZonePrivateKey(id []byte) bool {
 	return exists
 }
 
-// GetZonePrivateKeys reads all historical encrypted zone private keys from fs,
+// GetZonePrivateKeys reads current and historical encrypted zone private keys from fs,
 // decrypts them with master key and zoneId, and returns plaintext private keys,
-// or reading/decryption error.
+// or reading/decryption error. Returns ErrZoneRevoked for revoked zones.
 func (store *KeyStore) GetZonePrivateKeys(id []byte) ([]*keys.PrivateKey, error) {
-	filenames, err := store.GetHistoricalPrivateKeyFilenames(GetZoneKeyFilename(id))
+	if err := store.CheckZoneRevoked(id); err != nil {
+		return nil, err
+	}
+	filenames, err := store.getDecryptionKeyFilenames(GetZoneKeyFilename(id))
 	if err != nil {
 		return nil, err
 	}
@@ -560,7 +603,7 @@ func (store *KeyStore) GetServerDecryptionPrivateKey(id []byte) (*keys.PrivateKe
 // decrypts them with master key and clientID, and returns plaintext private keys,
 // or reading/decryption error.
 func (store *KeyStore) GetServerDecryptionPrivateKeys(id []byte) ([]*keys.PrivateKey, error) {
-	filenames, err := store.GetHistoricalPrivateKeyFilenames(GetServerDecryptionKeyFilename(id))
+	filenames, err := store.getDecryptionKeyFilenames(GetServerDecryptionKeyFilename(id))
 	if err != nil {
 		return nil, err
 	}
@@ -637,6 +680,7 @@ func (store *KeyStore) ListKeys() ([]keystore.KeyDescription, error) {
 // Reset clears all cached keys
 func (store *KeyStore) Reset() {
 	store.cache.Clear()
+	store.revokedZones.clear()
 }
 
 // GetPoisonKeyPair generates EC keypair for encrypting/decrypting poison records, and writes it to fs
@@ -718,8 +762,12 @@ func (store *KeyStore) GetAuthKey(remove bool) ([]byte, error) {
 	return store.generateKey(BasicAuthKeyFilename, keystore.BasicAuthKeyLength)
 }
 
-// RotateZoneKey generate new key pair for ZoneId, overwrite private key with new and return new public key
+// RotateZoneKey generate new key pair for ZoneId, overwrite private key with new and return new public key.
+// Returns ErrZoneRevoked for revoked zones.
 func (store *KeyStore) RotateZoneKey(zoneID []byte) ([]byte, error) {
+	if err := store.CheckZoneRevoked(zoneID); err != nil {
+		return nil, err
+	}
 	_, public, err := store.generateZoneKey(zoneID)
 	return public, err
 }
@@ -792,6 +840,38 @@ func (store *KeyStore) DestroyTranslatorKeypair(id []byte) error {
 	return store.destroyKeyWithFilename(filename)
 }
 
+// destroyKeyHistoryWithFilename removes current and all rotated private and public keys with given filename.
+func (store *KeyStore) destroyKeyHistoryWithFilename(filename string) error {
+	historicalFilenames, err := store.GetHistoricalPrivateKeyFilenames(filename)
+	if err != nil {
+		return err
+	}
+	for _, name := range historicalFilenames {
+		store.cache.Add(name, nil)
+	}
+	err = store.fs.RemoveAll(getHistoryDirName(store.GetPrivateKeyFilePath(filename)))
+	if err != nil {
+		return err
+	}
+	err = store.fs.RemoveAll(getHistoryDirName(store.GetPublicKeyFilePath(filename + ".pub")))
+	if err != nil {
+		return err
+	}
+	return store.destroyKeyWithFilename(filename)
+}
+
+// DestroyDataEncryptionKeys destroys current and all rotated storage keypairs for given clientID.
+func (store *KeyStore) DestroyDataEncryptionKeys(id []byte) error {
+	filename := GetServerDecryptionKeyFilename(id)
+	return store.destroyKeyHistoryWithFilename(filename)
+}
+
+// DestroyZoneKeys destroys current and all rotated keypairs for given zoneID.
+func (store *KeyStore) DestroyZoneKeys(id []byte) error {
+	filename := GetZoneKeyFilename(id)
+	return store.destroyKeyHistoryWithFilename(filename)
+}
+
 // Add value to inner cache
 func (store *KeyStore) Add(keyID string, keyValue []byte) {
 	store.cache.Add(keyID, keyValue)
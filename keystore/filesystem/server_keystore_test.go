@@ -737,3 +737,60 @@ func testHistoricalKeyAccess(storage Storage, t *testing.T) {
 		}
 	}
 }
+
+func TestHistoricalKeysLimit(t *testing.T) {
+	encryptor, err := keystore.NewSCellKeyEncryptor([]byte("some key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewCustomFilesystemKeyStore().KeyDirectory("/keys").Encryptor(encryptor).Storage(NewMemoryStorage()).
+		HistoricalKeysLimit(-2).Build(); err != errInvalidLimit {
+		t.Fatalf("Expected errInvalidLimit, took %v", err)
+	}
+	storage := NewMemoryStorage()
+	keyStore, err := NewCustomFilesystemKeyStore().KeyDirectory("/keys").Encryptor(encryptor).Storage(storage).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _, err := keyStore.GenerateZoneKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := keyStore.RotateZoneKey(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	allPrivateKeys, err := keyStore.GetZonePrivateKeys(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(allPrivateKeys) != 4 {
+		t.Fatalf("Expected current and 3 rotated keys, took %d", len(allPrivateKeys))
+	}
+
+	for _, limit := range []int{0, 1, 3, 10} {
+		limitedKeyStore, err := NewCustomFilesystemKeyStore().KeyDirectory("/keys").Encryptor(encryptor).Storage(storage).
+			HistoricalKeysLimit(limit).Build()
+		if err != nil {
+			t.Fatal(err)
+		}
+		privateKeys, err := limitedKeyStore.GetZonePrivateKeys(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := limit + 1
+		if expected > len(allPrivateKeys) {
+			expected = len(allPrivateKeys)
+		}
+		if len(privateKeys) != expected {
+			t.Fatalf("Expected %d keys with limit %d, took %d", expected, limit, len(privateKeys))
+		}
+		// newest keys are kept
+		for i, privateKey := range privateKeys {
+			if !bytes.Equal(privateKey.Value, allPrivateKeys[i].Value) {
+				t.Fatalf("Unexpected key %d with limit %d", i, limit)
+			}
+		}
+	}
+}
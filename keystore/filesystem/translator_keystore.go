@@ -64,6 +64,12 @@ func (b *TranslatorFileSystemKeyStoreBuilder) Storage(storage Storage) *Translat
 	return b
 }
 
+// CacheSize sets cache size to use.
+func (b *TranslatorFileSystemKeyStoreBuilder) CacheSize(cacheSize int) *TranslatorFileSystemKeyStoreBuilder {
+	b.keyStoreBuilder.CacheSize(cacheSize)
+	return b
+}
+
 // Build a keystore.
 func (b *TranslatorFileSystemKeyStoreBuilder) Build() (*TranslatorFileSystemKeyStore, error) {
 	if b.directory == "" {
@@ -0,0 +1,174 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filesystem
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cossacklabs/acra/keystore"
+)
+
+// revokedZoneSuffix is suffix of files which mark zones as revoked, they are kept next to private keys of zones
+const revokedZoneSuffix = ".revoked"
+
+// zoneKeySuffix is suffix of private keys of zones, see GetZoneKeyFilename
+const zoneKeySuffix = "_zone"
+
+// getRevokedZoneFilename returns name of file which marks zone as revoked
+func getRevokedZoneFilename(id []byte) string {
+	return GetZoneKeyFilename(id) + revokedZoneSuffix
+}
+
+// zoneRevocationCheckInterval is time during which state of zone revocation is kept in memory instead of checking
+// revocation marker on every usage of zone keys, so zones revoked by other processes are refused after this delay
+const zoneRevocationCheckInterval = 5 * time.Second
+
+// zoneRevocationState is state of zone revocation and time when it was checked
+type zoneRevocationState struct {
+	revoked bool
+	checked time.Time
+}
+
+// zoneRevocationCache keeps states of zone revocation for zoneRevocationCheckInterval
+type zoneRevocationCache struct {
+	now    func() time.Time
+	mutex  sync.Mutex
+	states map[string]zoneRevocationState
+}
+
+func newZoneRevocationCache() *zoneRevocationCache {
+	return &zoneRevocationCache{now: time.Now, states: make(map[string]zoneRevocationState)}
+}
+
+// get returns cached state of zone revocation or state returned by check which is cached if checked successfully
+func (cache *zoneRevocationCache) get(id []byte, check func() (bool, error)) (bool, error) {
+	now := cache.now()
+	cache.mutex.Lock()
+	state, ok := cache.states[string(id)]
+	cache.mutex.Unlock()
+	if ok && now.Sub(state.checked) < zoneRevocationCheckInterval {
+		return state.revoked, nil
+	}
+	revoked, err := check()
+	if err != nil {
+		return false, err
+	}
+	cache.set(id, revoked, now)
+	return revoked, nil
+}
+
+func (cache *zoneRevocationCache) set(id []byte, revoked bool, checked time.Time) {
+	cache.mutex.Lock()
+	cache.states[string(id)] = zoneRevocationState{revoked: revoked, checked: checked}
+	cache.mutex.Unlock()
+}
+
+// clear removes all cached states
+func (cache *zoneRevocationCache) clear() {
+	cache.mutex.Lock()
+	cache.states = make(map[string]zoneRevocationState)
+	cache.mutex.Unlock()
+}
+
+// CheckZoneRevoked returns ErrZoneRevoked if zone is revoked. Revocations by this keystore are seen immediately and
+// by other processes after zoneRevocationCheckInterval.
+func (store *KeyStore) CheckZoneRevoked(id []byte) error {
+	revoked, err := store.revokedZones.get(id, func() (bool, error) {
+		return store.fs.Exists(store.GetPrivateKeyFilePath(getRevokedZoneFilename(id)))
+	})
+	if err != nil {
+		return err
+	}
+	if revoked {
+		return keystore.ErrZoneRevoked
+	}
+	return nil
+}
+
+// ListZones returns zones which have private keys in keystore, sorted by zone ID.
+func (store *KeyStore) ListZones() ([]keystore.ZoneDescription, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	entries, err := store.fs.ReadDir(store.privateKeyDirectory)
+	if err != nil {
+		return nil, err
+	}
+	revoked := make(map[string]bool)
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), zoneKeySuffix+revokedZoneSuffix) {
+			revoked[strings.TrimSuffix(entry.Name(), zoneKeySuffix+revokedZoneSuffix)] = true
+		}
+	}
+	var zones []keystore.ZoneDescription
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), zoneKeySuffix) {
+			continue
+		}
+		id := strings.TrimSuffix(entry.Name(), zoneKeySuffix)
+		zone := keystore.ZoneDescription{ZoneID: []byte(id), Revoked: revoked[id]}
+		if zone.Revoked {
+			zone.RevokedAt = store.readZoneRevocationTime([]byte(id))
+		}
+		zones = append(zones, zone)
+	}
+	return zones, nil
+}
+
+// readZoneRevocationTime returns time of revocation written by RevokeZone, nil if it can't be read
+func (store *KeyStore) readZoneRevocationTime(id []byte) *time.Time {
+	data, err := store.fs.ReadFile(store.GetPrivateKeyFilePath(getRevokedZoneFilename(id)))
+	if err != nil {
+		return nil
+	}
+	revokedAt, err := time.Parse(time.RFC3339, strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil
+	}
+	return &revokedAt
+}
+
+// RevokeZone marks zone as revoked, so its private and public keys are refused with ErrZoneRevoked and the zone
+// can't be rotated. Keys are kept, so revocation may be undone by removal of "<zone ID>_zone.revoked" file.
+// Returns ErrZoneNotFound if zone has no private key. Revocation of revoked zone keeps its first revocation time.
+func (store *KeyStore) RevokeZone(id []byte) error {
+	if !keystore.ValidateID(id) {
+		return keystore.ErrInvalidClientID
+	}
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	exists, err := store.fs.Exists(store.GetPrivateKeyFilePath(GetZoneKeyFilename(id)))
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return keystore.ErrZoneNotFound
+	}
+	path := store.GetPrivateKeyFilePath(getRevokedZoneFilename(id))
+	revoked, err := store.fs.Exists(path)
+	if err != nil || revoked {
+		return err
+	}
+	if err := store.fs.WriteFile(path, []byte(time.Now().UTC().Format(time.RFC3339)+"\n"), PrivateFileMode); err != nil {
+		return err
+	}
+	// cached keys of zone shouldn't be used anymore
+	store.cache.Clear()
+	store.revokedZones.set(id, true, store.revokedZones.now())
+	return nil
+}
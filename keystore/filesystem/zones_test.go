@@ -0,0 +1,145 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filesystem
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/cossacklabs/acra/keystore"
+)
+
+func TestRevokeZone(t *testing.T) {
+	encryptor, err := keystore.NewSCellKeyEncryptor([]byte("master key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewCustomFilesystemKeyStore().KeyDirectories("/keys", "/keys").Encryptor(encryptor).Storage(NewMemoryStorage()).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	revokedZone, _, err := store.GenerateZoneKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	activeZone, _, err := store.GenerateZoneKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.RotateZoneKey(revokedZone); err != nil {
+		t.Fatal(err)
+	}
+	// load keys into cache before revocation
+	if _, err := store.GetZonePrivateKeys(revokedZone); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.RevokeZone([]byte("unknown zone id")); err != keystore.ErrZoneNotFound {
+		t.Fatalf("Expected ErrZoneNotFound, took %v", err)
+	}
+	if err := store.RevokeZone(revokedZone); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.RevokeZone(revokedZone); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.GetZonePrivateKey(revokedZone); err != keystore.ErrZoneRevoked {
+		t.Fatalf("Expected ErrZoneRevoked, took %v", err)
+	}
+	if _, err := store.GetZonePrivateKeys(revokedZone); err != keystore.ErrZoneRevoked {
+		t.Fatalf("Expected ErrZoneRevoked, took %v", err)
+	}
+	if _, err := store.GetZonePublicKey(revokedZone); err != keystore.ErrZoneRevoked {
+		t.Fatalf("Expected ErrZoneRevoked, took %v", err)
+	}
+	if _, err := store.RotateZoneKey(revokedZone); err != keystore.ErrZoneRevoked {
+		t.Fatalf("Expected ErrZoneRevoked, took %v", err)
+	}
+	if !store.HasZonePrivateKey(revokedZone) {
+		t.Fatal("Revoked zone should exist, so its ID isn't generated again")
+	}
+	if _, err := store.GetZonePrivateKeys(activeZone); err != nil {
+		t.Fatal(err)
+	}
+
+	zones, err := store.ListZones()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(zones) != 2 {
+		t.Fatalf("Expected 2 zones, took %d", len(zones))
+	}
+	for _, zone := range zones {
+		revoked := bytes.Equal(zone.ZoneID, revokedZone)
+		if !revoked && !bytes.Equal(zone.ZoneID, activeZone) {
+			t.Fatalf("Unexpected zone %s", zone.ZoneID)
+		}
+		if zone.Revoked != revoked || (zone.RevokedAt != nil) != revoked {
+			t.Fatalf("Unexpected revocation status of zone %s", zone.ZoneID)
+		}
+	}
+
+	// marker of revocation isn't a key, so keys are resealed and scanned without it
+	paths, err := store.enumeratePrivateKeyPaths()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range paths {
+		if bytes.HasSuffix([]byte(path), []byte(revokedZoneSuffix)) {
+			t.Fatalf("Marker of revoked zone is listed as private key: %s", path)
+		}
+	}
+}
+
+func TestZoneRevocationByOtherProcess(t *testing.T) {
+	encryptor, err := keystore.NewSCellKeyEncryptor([]byte("master key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage := NewMemoryStorage()
+	store, err := NewCustomFilesystemKeyStore().KeyDirectories("/keys", "/keys").Encryptor(encryptor).Storage(storage).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherStore, err := NewCustomFilesystemKeyStore().KeyDirectories("/keys", "/keys").Encryptor(encryptor).Storage(storage).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	store.revokedZones.now = func() time.Time { return now }
+	zoneID, _, err := store.GenerateZoneKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.CheckZoneRevoked(zoneID); err != nil {
+		t.Fatal(err)
+	}
+	if err := otherStore.RevokeZone(zoneID); err != nil {
+		t.Fatal(err)
+	}
+	// state of revocation is cached for zoneRevocationCheckInterval
+	if err := store.CheckZoneRevoked(zoneID); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(zoneRevocationCheckInterval)
+	if err := store.CheckZoneRevoked(zoneID); err != keystore.ErrZoneRevoked {
+		t.Fatalf("Expected ErrZoneRevoked after %s, took %v", zoneRevocationCheckInterval, err)
+	}
+	if err := otherStore.CheckZoneRevoked(zoneID); err != keystore.ErrZoneRevoked {
+		t.Fatalf("Expected ErrZoneRevoked right after revocation, took %v", err)
+	}
+}
@@ -0,0 +1,245 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package keystore
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+
+	"github.com/cossacklabs/acra/random"
+	"github.com/cossacklabs/acra/utils"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/scrypt"
+)
+
+// MasterKeyKDFFileVarSuffix is appended to name of master key environment variable to get name of variable with path
+// to KDF parameters. If it's set then master key variable keeps passphrase instead of base64 encoded key.
+const MasterKeyKDFFileVarSuffix = "_KDF_FILE"
+
+// Supported algorithms of master key derivation:
+const (
+	KDFAlgorithmArgon2id = "argon2id"
+	KDFAlgorithmScrypt   = "scrypt"
+)
+
+// SupportedKDFAlgorithms is a list of supported algorithms of master key derivation.
+var SupportedKDFAlgorithms = []string{KDFAlgorithmArgon2id, KDFAlgorithmScrypt}
+
+// MasterKeyKDFVersion is the current version of master key KDF parameters format
+const MasterKeyKDFVersion = 1
+
+// MinMasterKeyPassphraseLength is minimal length of passphrase in bytes
+const MinMasterKeyPassphraseLength = 12
+
+const kdfSaltLength = 16
+
+// Default parameters are recommended by RFC 9106 for argon2id with 64 MiB of memory and by golang.org/x/crypto/scrypt
+const (
+	defaultArgon2Time    = 3
+	defaultArgon2Memory  = 64 * 1024
+	defaultArgon2Threads = 4
+	defaultScryptN       = 1 << 15
+	defaultScryptR       = 8
+	defaultScryptP       = 1
+)
+
+// kdfCheckContext is HMAC message which authenticates derived master key, so wrong passphrase is detected
+// before keystore is used
+var kdfCheckContext = []byte("acra master key kdf check")
+
+// Errors returned by master key derivation
+var (
+	ErrUnknownKDFAlgorithm       = errors.New("unknown master key KDF algorithm")
+	ErrUnsupportedKDFVersion     = errors.New("unsupported version of master key KDF parameters")
+	ErrInvalidKDFParameters      = errors.New("invalid master key KDF parameters")
+	ErrShortMasterKeyPassphrase  = errors.New("master key passphrase is too short")
+	ErrWrongMasterKeyPassphrase  = errors.New("master key passphrase doesn't match KDF parameters")
+	ErrMasterKeyKDFFileExists    = errors.New("file with master key KDF parameters already exists")
+	errKDFParametersWithoutCheck = errors.New("master key KDF parameters don't have check value")
+)
+
+// MasterKeyKDFParameters are salt and cost parameters used to derive master key from passphrase. Time, Memory (KiB)
+// and Threads are used by argon2id, N, R and P are used by scrypt. Check is HMAC of kdfCheckContext with derived key.
+type MasterKeyKDFParameters struct {
+	Version   int    `json:"version"`
+	Algorithm string `json:"algorithm"`
+	Salt      []byte `json:"salt"`
+	Time      uint32 `json:"time,omitempty"`
+	Memory    uint32 `json:"memory,omitempty"`
+	Threads   uint8  `json:"threads,omitempty"`
+	N         int    `json:"n,omitempty"`
+	R         int    `json:"r,omitempty"`
+	P         int    `json:"p,omitempty"`
+	Check     []byte `json:"check"`
+}
+
+// NewMasterKeyKDFParameters returns parameters of algorithm with default cost and new random salt
+func NewMasterKeyKDFParameters(algorithm string) (*MasterKeyKDFParameters, error) {
+	params := &MasterKeyKDFParameters{Version: MasterKeyKDFVersion, Algorithm: algorithm}
+	switch algorithm {
+	case KDFAlgorithmArgon2id:
+		params.Time, params.Memory, params.Threads = defaultArgon2Time, defaultArgon2Memory, defaultArgon2Threads
+	case KDFAlgorithmScrypt:
+		params.N, params.R, params.P = defaultScryptN, defaultScryptR, defaultScryptP
+	default:
+		return nil, ErrUnknownKDFAlgorithm
+	}
+	params.Salt = make([]byte, kdfSaltLength)
+	if _, err := random.Read(params.Salt); err != nil {
+		return nil, err
+	}
+	return params, nil
+}
+
+// ParseMasterKeyKDFParameters unmarshals and validates KDF parameters
+func ParseMasterKeyKDFParameters(data []byte) (*MasterKeyKDFParameters, error) {
+	params := &MasterKeyKDFParameters{}
+	if err := json.Unmarshal(data, params); err != nil {
+		return nil, ErrInvalidKDFParameters
+	}
+	if err := params.validate(); err != nil {
+		return nil, err
+	}
+	if len(params.Check) == 0 {
+		return nil, errKDFParametersWithoutCheck
+	}
+	return params, nil
+}
+
+// ReadMasterKeyKDFParameters reads KDF parameters from file
+func ReadMasterKeyKDFParameters(path string) (*MasterKeyKDFParameters, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseMasterKeyKDFParameters(data)
+}
+
+// WriteFile writes parameters into new file, existing files aren't overwritten because keys encrypted with master
+// key derived with them become unreadable
+func (params *MasterKeyKDFParameters) WriteFile(path string) error {
+	data, err := json.MarshalIndent(params, "", "  ")
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if os.IsExist(err) {
+		return ErrMasterKeyKDFFileExists
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func (params *MasterKeyKDFParameters) validate() error {
+	if params.Version != MasterKeyKDFVersion {
+		return ErrUnsupportedKDFVersion
+	}
+	if len(params.Salt) < kdfSaltLength {
+		return ErrInvalidKDFParameters
+	}
+	switch params.Algorithm {
+	case KDFAlgorithmArgon2id:
+		// argon2 requires at least 8 KiB of memory per thread
+		if params.Time == 0 || params.Threads == 0 || params.Memory < 8*uint32(params.Threads) {
+			return ErrInvalidKDFParameters
+		}
+	case KDFAlgorithmScrypt:
+		if params.N <= 1 || params.N&(params.N-1) != 0 || params.R <= 0 || params.P <= 0 || uint64(params.R)*uint64(params.P) >= 1<<30 {
+			return ErrInvalidKDFParameters
+		}
+	default:
+		return ErrUnknownKDFAlgorithm
+	}
+	return nil
+}
+
+// deriveKey returns master key derived from passphrase without verification of check value
+func (params *MasterKeyKDFParameters) deriveKey(passphrase []byte) ([]byte, error) {
+	if err := params.validate(); err != nil {
+		return nil, err
+	}
+	if len(passphrase) < MinMasterKeyPassphraseLength {
+		return nil, ErrShortMasterKeyPassphrase
+	}
+	switch params.Algorithm {
+	case KDFAlgorithmArgon2id:
+		return argon2.IDKey(passphrase, params.Salt, params.Time, params.Memory, params.Threads, SymmetricKeyLength), nil
+	case KDFAlgorithmScrypt:
+		return scrypt.Key(passphrase, params.Salt, params.N, params.R, params.P, SymmetricKeyLength)
+	}
+	return nil, ErrUnknownKDFAlgorithm
+}
+
+func kdfCheckValue(key []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(kdfCheckContext)
+	return mac.Sum(nil)
+}
+
+// Seal derives master key from passphrase and stores its check value into parameters
+func (params *MasterKeyKDFParameters) Seal(passphrase []byte) ([]byte, error) {
+	key, err := params.deriveKey(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	params.Check = kdfCheckValue(key)
+	return key, nil
+}
+
+// DeriveMasterKey derives master key from passphrase and verifies it with check value of parameters
+func (params *MasterKeyKDFParameters) DeriveMasterKey(passphrase []byte) ([]byte, error) {
+	if len(params.Check) == 0 {
+		return nil, errKDFParametersWithoutCheck
+	}
+	key, err := params.deriveKey(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(kdfCheckValue(key), params.Check) {
+		utils.ZeroizeSymmetricKey(key)
+		return nil, ErrWrongMasterKeyPassphrase
+	}
+	return key, nil
+}
+
+// getMasterKeyFromPassphrase derives master key from passphrase with parameters from kdfFile
+func getMasterKeyFromPassphrase(varname, passphrase, kdfFile string) ([]byte, error) {
+	params, err := ReadMasterKeyKDFParameters(kdfFile)
+	if err != nil {
+		log.WithError(err).WithField("path", kdfFile).Warnf("Failed to read KDF parameters of %s", varname)
+		return nil, err
+	}
+	passphraseBytes := []byte(passphrase)
+	defer utils.ZeroizeBytes(passphraseBytes)
+	key, err := params.DeriveMasterKey(passphraseBytes)
+	if err != nil {
+		log.WithError(err).Warnf("Failed to derive master key from %s", varname)
+		return nil, err
+	}
+	return key, nil
+}
@@ -0,0 +1,147 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package keystore
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testKDFParameters returns parameters with low cost to keep tests fast
+func testKDFParameters(t *testing.T, algorithm string) *MasterKeyKDFParameters {
+	params, err := NewMasterKeyKDFParameters(algorithm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	switch algorithm {
+	case KDFAlgorithmArgon2id:
+		params.Time, params.Memory, params.Threads = 1, 64, 1
+	case KDFAlgorithmScrypt:
+		params.N = 1 << 4
+	}
+	return params
+}
+
+func TestMasterKeyKDF(t *testing.T) {
+	passphrase := []byte("correct horse battery staple")
+	for _, algorithm := range SupportedKDFAlgorithms {
+		params := testKDFParameters(t, algorithm)
+		key, err := params.Seal(passphrase)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ValidateMasterKey(key); err != nil {
+			t.Fatal(err)
+		}
+		derived, err := params.DeriveMasterKey(passphrase)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(derived, key) {
+			t.Fatalf("%s: derived key doesn't match sealed one", algorithm)
+		}
+		if _, err := params.DeriveMasterKey([]byte("wrong horse battery staple")); err != ErrWrongMasterKeyPassphrase {
+			t.Fatalf("%s: expected ErrWrongMasterKeyPassphrase, took %v", algorithm, err)
+		}
+		if _, err := params.DeriveMasterKey([]byte("short")); err != ErrShortMasterKeyPassphrase {
+			t.Fatalf("%s: expected ErrShortMasterKeyPassphrase, took %v", algorithm, err)
+		}
+		// the same passphrase with another salt gives another key
+		otherParams := testKDFParameters(t, algorithm)
+		otherKey, err := otherParams.Seal(passphrase)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Equal(otherKey, key) {
+			t.Fatalf("%s: keys derived with different salts are equal", algorithm)
+		}
+	}
+
+	if _, err := NewMasterKeyKDFParameters("pbkdf2"); err != ErrUnknownKDFAlgorithm {
+		t.Fatalf("Expected ErrUnknownKDFAlgorithm, took %v", err)
+	}
+	invalid := []*MasterKeyKDFParameters{
+		{Version: MasterKeyKDFVersion, Algorithm: KDFAlgorithmArgon2id, Salt: make([]byte, 4), Time: 1, Memory: 64, Threads: 1},
+		{Version: MasterKeyKDFVersion, Algorithm: KDFAlgorithmArgon2id, Salt: make([]byte, kdfSaltLength), Time: 0, Memory: 64, Threads: 1},
+		{Version: MasterKeyKDFVersion, Algorithm: KDFAlgorithmArgon2id, Salt: make([]byte, kdfSaltLength), Time: 1, Memory: 8, Threads: 4},
+		{Version: MasterKeyKDFVersion, Algorithm: KDFAlgorithmScrypt, Salt: make([]byte, kdfSaltLength), N: 1000, R: 8, P: 1},
+		{Version: MasterKeyKDFVersion, Algorithm: KDFAlgorithmScrypt, Salt: make([]byte, kdfSaltLength), N: 16, R: 0, P: 1},
+	}
+	for i, params := range invalid {
+		if _, err := params.Seal(passphrase); err != ErrInvalidKDFParameters {
+			t.Fatalf("Expected ErrInvalidKDFParameters for parameters %d, took %v", i, err)
+		}
+	}
+	if _, err := (&MasterKeyKDFParameters{Version: 2, Algorithm: KDFAlgorithmScrypt}).Seal(passphrase); err != ErrUnsupportedKDFVersion {
+		t.Fatalf("Expected ErrUnsupportedKDFVersion, took %v", err)
+	}
+}
+
+func TestGetMasterKeyFromPassphrase(t *testing.T) {
+	dir, err := ioutil.TempDir("", "acra_master_key_kdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	kdfFile := filepath.Join(dir, "master_key_kdf.json")
+	passphrase := "correct horse battery staple"
+	params := testKDFParameters(t, KDFAlgorithmArgon2id)
+	key, err := params.Seal([]byte(passphrase))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := params.WriteFile(kdfFile); err != nil {
+		t.Fatal(err)
+	}
+	if err := params.WriteFile(kdfFile); err != ErrMasterKeyKDFFileExists {
+		t.Fatalf("Expected ErrMasterKeyKDFFileExists, took %v", err)
+	}
+
+	kdfVarName := AcraMasterKeyVarName + MasterKeyKDFFileVarSuffix
+	defer os.Unsetenv(kdfVarName)
+	defer os.Unsetenv(AcraMasterKeyVarName)
+	if err := os.Setenv(kdfVarName, kdfFile); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Setenv(AcraMasterKeyVarName, passphrase); err != nil {
+		t.Fatal(err)
+	}
+	envKey, err := GetMasterKeyFromEnvironment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(envKey, key) {
+		t.Fatal("Master key derived from environment doesn't match sealed one")
+	}
+	if err := os.Setenv(AcraMasterKeyVarName, "wrong horse battery staple"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := GetMasterKeyFromEnvironment(); err != ErrWrongMasterKeyPassphrase {
+		t.Fatalf("Expected ErrWrongMasterKeyPassphrase, took %v", err)
+	}
+
+	// parameters without check value can't verify passphrase
+	if err := ioutil.WriteFile(kdfFile, []byte(`{"version":1,"algorithm":"scrypt","salt":"AAAAAAAAAAAAAAAAAAAAAA==","n":16,"r":8,"p":1}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := GetMasterKeyFromEnvironment(); err != errKDFParametersWithoutCheck {
+		t.Fatalf("Expected errKDFParametersWithoutCheck, took %v", err)
+	}
+}
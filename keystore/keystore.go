@@ -20,13 +20,14 @@ limitations under the License.
 package keystore
 
 import (
-	"crypto/rand"
 	"encoding/base64"
 	"errors"
 	"fmt"
 	"os"
 	"strings"
+	"time"
 
+	"github.com/cossacklabs/acra/random"
 	"github.com/cossacklabs/themis/gothemis/cell"
 	"github.com/cossacklabs/themis/gothemis/keys"
 	log "github.com/sirupsen/logrus"
@@ -53,11 +54,17 @@ var (
 	ErrNotImplemented           = errors.New("not implemented")
 )
 
+// Errors returned for operations with zones.
+var (
+	ErrZoneRevoked  = errors.New("zone is revoked")
+	ErrZoneNotFound = errors.New("zone not found")
+)
+
 // GenerateSymmetricKey return new generated symmetric key that must used in keystore as master key and will comply
 // our requirements.
 func GenerateSymmetricKey() ([]byte, error) {
 	key := make([]byte, SymmetricKeyLength)
-	n, err := rand.Read(key)
+	n, err := random.Read(key)
 	if err != nil {
 		return nil, err
 	}
@@ -95,13 +102,17 @@ func GetMasterKeyFromEnvironment() (key []byte, err error) {
 	return GetMasterKeyFromEnvironmentVariable(AcraMasterKeyVarName)
 }
 
-// GetMasterKeyFromEnvironmentVariable return master key from specified environment variable.
+// GetMasterKeyFromEnvironmentVariable return master key from specified environment variable. If variable with
+// MasterKeyKDFFileVarSuffix is set then master key is derived from passphrase kept in specified variable.
 func GetMasterKeyFromEnvironmentVariable(varname string) ([]byte, error) {
 	b64value := os.Getenv(varname)
 	if len(b64value) == 0 {
 		log.Warnf("%v environment variable is not set", varname)
 		return nil, ErrEmptyMasterKey
 	}
+	if kdfFile := os.Getenv(varname + MasterKeyKDFFileVarSuffix); kdfFile != "" {
+		return getMasterKeyFromPassphrase(varname, b64value, kdfFile)
+	}
 	key, err := base64.StdEncoding.DecodeString(b64value)
 	if err != nil {
 		log.WithError(err).Warnf("Failed to decode %s", varname)
@@ -120,6 +131,29 @@ type KeyEncryptor interface {
 	Decrypt(key, context []byte) ([]byte, error)
 }
 
+// MasterKeyProvider keeps master key of keystore and returns KeyEncryptor which uses it. Providers may keep master key
+// outside of process memory, so KeyEncryptor only asks them to encrypt and decrypt keys.
+type MasterKeyProvider interface {
+	KeyEncryptor() (KeyEncryptor, error)
+}
+
+// EnvironmentMasterKeyProvider takes master key from environment variable with name AcraMasterKeyVarName, or several
+// master keys from AcraMasterKeysVarName
+type EnvironmentMasterKeyProvider struct{}
+
+// KeyEncryptor returns SCellKeyEncryptor with master key from environment, or MultiMasterKeyEncryptor if several
+// master keys are set in AcraMasterKeysVarName
+func (EnvironmentMasterKeyProvider) KeyEncryptor() (KeyEncryptor, error) {
+	if IsMultiMasterKeyEnabled() {
+		return NewMultiMasterKeyEncryptorFromEnvironment()
+	}
+	masterKey, err := GetMasterKeyFromEnvironment()
+	if err != nil {
+		return nil, err
+	}
+	return NewSCellKeyEncryptor(masterKey)
+}
+
 // SCellKeyEncryptor uses Themis Secure Cell with provided master key to encrypt and decrypt keys.
 type SCellKeyEncryptor struct {
 	scell *cell.SecureCell
@@ -200,6 +234,31 @@ type StorageKeyCreation interface {
 	RotateZoneKey(zoneID []byte) ([]byte, error)
 }
 
+// ZoneDescription describes a zone in the keystore.
+type ZoneDescription struct {
+	ZoneID    []byte
+	Revoked   bool
+	RevokedAt *time.Time `json:",omitempty"`
+}
+
+// ZoneManagement enables listing, revocation and rotation of zones. It is used by acra-keys tool.
+type ZoneManagement interface {
+	// Lists zones of the keystore sorted by zone ID.
+	ListZones() ([]ZoneDescription, error)
+	// Marks zone as revoked, so its keys are refused with ErrZoneRevoked. Keys are kept.
+	RevokeZone(zoneID []byte) error
+	// Generates a new key pair and replaces the current key pair for given zone ID.
+	// Returns new public key data, error.
+	RotateZoneKey(zoneID []byte) ([]byte, error)
+}
+
+// ZoneRevocationChecker is implemented by keystores with revocable zones. Wrappers which cache keys of zones check
+// revocation before serving cached keys.
+type ZoneRevocationChecker interface {
+	// Returns ErrZoneRevoked if zone is revoked.
+	CheckZoneRevoked(zoneID []byte) error
+}
+
 // DecryptionKeyStore enables AcraStruct decryption. It is used by acra-server.
 type DecryptionKeyStore interface {
 	PublicKeyStore
@@ -210,10 +269,19 @@ type DecryptionKeyStore interface {
 // KeyMaking enables keystore initialization. It is used by acra-keymaker tool.
 type KeyMaking interface {
 	StorageKeyCreation
+	StorageKeyDestruction
 	TransportKeyCreation
 	WebConfigKeyStore
 }
 
+// StorageKeyDestruction enables crypto-shredding of data encrypted with storage keys.
+type StorageKeyDestruction interface {
+	// Destroys current and all rotated storage key pairs for given client ID.
+	DestroyDataEncryptionKeys(clientID []byte) error
+	// Destroys current and all rotated key pairs for given zone ID.
+	DestroyZoneKeys(zoneID []byte) error
+}
+
 // PoisonKeyStore provides access to poison record key pairs.
 type PoisonKeyStore interface {
 	// Reads current poison record key pair, creating it if it does not exist yet.
@@ -0,0 +1,219 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kms
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Environment variables with AWS credentials, the same as used by AWS SDK and CLI
+const (
+	awsAccessKeyIDEnv     = "AWS_ACCESS_KEY_ID"
+	awsSecretAccessKeyEnv = "AWS_SECRET_ACCESS_KEY"
+	awsSessionTokenEnv    = "AWS_SESSION_TOKEN"
+	awsRegionEnv          = "AWS_REGION"
+	awsDefaultRegionEnv   = "AWS_DEFAULT_REGION"
+)
+
+const (
+	awsKMSService       = "kms"
+	awsSigningAlgorithm = "AWS4-HMAC-SHA256"
+	awsDateFormat       = "20060102T150405Z"
+)
+
+// awsCredentials used to sign requests with AWS Signature Version 4
+type awsCredentials struct {
+	accessKeyID     string
+	secretAccessKey string
+	sessionToken    string
+}
+
+// AWSKeyWrapper wraps keys with AWS KMS Encrypt and Decrypt API
+type AWSKeyWrapper struct {
+	keyID       string
+	endpoint    string
+	region      string
+	credentials awsCredentials
+	// role replaces credentials with ones of assumed role if it's set
+	role   *awsAssumedRole
+	client *http.Client
+	// now is time.Now, replaced in tests
+	now func() time.Time
+}
+
+// NewAWSKeyWrapperFromEnvironment returns wrapper which uses AWS KMS key with keyID (key ID, ARN or alias).
+// Credentials and region are read from AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, AWS_SESSION_TOKEN and AWS_REGION
+// environment variables. Empty endpoint means regional endpoint of AWS KMS.
+func NewAWSKeyWrapperFromEnvironment(keyID, endpoint string) (*AWSKeyWrapper, error) {
+	credentials, region, err := awsEnvironment()
+	if err != nil {
+		return nil, err
+	}
+	return newAWSKeyWrapper(keyID, endpoint, region, credentials), nil
+}
+
+// awsEnvironment reads credentials and region from environment variables of AWS SDK
+func awsEnvironment() (awsCredentials, string, error) {
+	return awsEnvironmentWithRegion("")
+}
+
+// awsEnvironmentWithRegion reads credentials from environment variables of AWS SDK, empty region is read from them too
+func awsEnvironmentWithRegion(region string) (awsCredentials, string, error) {
+	credentials := awsCredentials{
+		accessKeyID:     os.Getenv(awsAccessKeyIDEnv),
+		secretAccessKey: os.Getenv(awsSecretAccessKeyEnv),
+		sessionToken:    os.Getenv(awsSessionTokenEnv),
+	}
+	if credentials.accessKeyID == "" || credentials.secretAccessKey == "" {
+		return awsCredentials{}, "", fmt.Errorf("%w: set %s and %s", ErrMissingCredentials, awsAccessKeyIDEnv, awsSecretAccessKeyEnv)
+	}
+	if region == "" {
+		region = os.Getenv(awsRegionEnv)
+	}
+	if region == "" {
+		region = os.Getenv(awsDefaultRegionEnv)
+	}
+	if region == "" {
+		return awsCredentials{}, "", fmt.Errorf("%w: set %s", ErrMissingCredentials, awsRegionEnv)
+	}
+	return credentials, region, nil
+}
+
+func newAWSKeyWrapper(keyID, endpoint, region string, credentials awsCredentials) *AWSKeyWrapper {
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://kms.%s.amazonaws.com/", region)
+	}
+	return &AWSKeyWrapper{
+		keyID:       keyID,
+		endpoint:    endpoint,
+		region:      region,
+		credentials: credentials,
+		client:      &http.Client{Timeout: defaultHTTPTimeout},
+		now:         time.Now,
+	}
+}
+
+// call invokes action of AWS KMS JSON API
+func (wrapper *AWSKeyWrapper) call(action string, body, result interface{}) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequest(http.MethodPost, wrapper.endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	request.Header.Set("X-Amz-Target", "TrentService."+action)
+	credentials := wrapper.credentials
+	if wrapper.role != nil {
+		if credentials, err = wrapper.role.current(wrapper.now()); err != nil {
+			return err
+		}
+	}
+	signAWSRequest(request, payload, awsKMSService, wrapper.region, credentials, wrapper.now())
+	return doJSONRequest(wrapper.client, request, result)
+}
+
+// WrapKey encrypts key with AWS KMS key
+func (wrapper *AWSKeyWrapper) WrapKey(key []byte) ([]byte, error) {
+	var response struct {
+		CiphertextBlob []byte
+	}
+	err := wrapper.call("Encrypt", map[string]interface{}{"KeyId": wrapper.keyID, "Plaintext": key}, &response)
+	if err != nil {
+		return nil, err
+	}
+	return response.CiphertextBlob, nil
+}
+
+// UnwrapKey decrypts key wrapped by WrapKey
+func (wrapper *AWSKeyWrapper) UnwrapKey(wrappedKey []byte) ([]byte, error) {
+	var response struct {
+		Plaintext []byte
+	}
+	err := wrapper.call("Decrypt", map[string]interface{}{"KeyId": wrapper.keyID, "CiphertextBlob": wrappedKey}, &response)
+	if err != nil {
+		return nil, err
+	}
+	return response.Plaintext, nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
+
+// signAWSRequest adds X-Amz-Date and Authorization headers of AWS Signature Version 4. All headers set before the
+// call are signed. Requests are expected to have path without escaping and no query.
+func signAWSRequest(request *http.Request, payload []byte, service, region string, credentials awsCredentials, now time.Time) {
+	amzDate := now.UTC().Format(awsDateFormat)
+	date := amzDate[:8]
+	request.Header.Set("X-Amz-Date", amzDate)
+	if credentials.sessionToken != "" {
+		request.Header.Set("X-Amz-Security-Token", credentials.sessionToken)
+	}
+
+	headers := map[string]string{"host": request.URL.Host}
+	for name, values := range request.Header {
+		headers[strings.ToLower(name)] = strings.Join(values, ",")
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	canonicalHeaders := &strings.Builder{}
+	for _, name := range names {
+		fmt.Fprintf(canonicalHeaders, "%s:%s\n", name, strings.TrimSpace(headers[name]))
+	}
+	signedHeaders := strings.Join(names, ";")
+	path := request.URL.Path
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		request.Method, path, request.URL.RawQuery, canonicalHeaders.String(), signedHeaders, sha256Hex(payload),
+	}, "\n")
+
+	scope := strings.Join([]string{date, region, service, "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{awsSigningAlgorithm, amzDate, scope, sha256Hex([]byte(canonicalRequest))}, "\n")
+	signingKey := hmacSHA256([]byte("AWS4"+credentials.secretAccessKey), date)
+	signingKey = hmacSHA256(signingKey, region)
+	signingKey = hmacSHA256(signingKey, service)
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	request.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		awsSigningAlgorithm, credentials.accessKeyID, scope, signedHeaders, signature))
+}
@@ -0,0 +1,283 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kms
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/cossacklabs/acra/keystore"
+	"github.com/cossacklabs/acra/utils"
+)
+
+const (
+	awsSTSService = "sts"
+	// awsRoleSessionName is name of sessions of assumed role visible in CloudTrail
+	awsRoleSessionName = "acra"
+	// awsRoleSessionDuration is requested duration of assumed role credentials
+	awsRoleSessionDuration = time.Hour
+	// awsRoleRefreshBefore is time before expiration when credentials of assumed role are renewed
+	awsRoleRefreshBefore = time.Minute * 5
+	// awsEncryptionContextKey is key of AWS KMS encryption context with context of sealed key
+	awsEncryptionContextKey = "acra_key_context"
+)
+
+// awsEnvelopeMagic starts keys sealed by AWSEnvelopeKeyEncryptor
+var awsEnvelopeMagic = []byte("AKE1")
+
+// ErrInvalidAWSEnvelope returned for keys which aren't sealed by AWSEnvelopeKeyEncryptor
+var ErrInvalidAWSEnvelope = errors.New("key isn't sealed with AWS KMS envelope")
+
+// awsAssumedRole takes temporary credentials of role with AWS STS AssumeRole API and renews them before expiration
+type awsAssumedRole struct {
+	roleARN     string
+	endpoint    string
+	region      string
+	credentials awsCredentials
+	client      *http.Client
+
+	lock       sync.Mutex
+	assumed    awsCredentials
+	expiration time.Time
+}
+
+func newAWSAssumedRole(roleARN, region string, credentials awsCredentials) *awsAssumedRole {
+	return &awsAssumedRole{
+		roleARN:     roleARN,
+		endpoint:    fmt.Sprintf("https://sts.%s.amazonaws.com/", region),
+		region:      region,
+		credentials: credentials,
+		client:      &http.Client{Timeout: defaultHTTPTimeout},
+	}
+}
+
+// current returns credentials of role, assuming it again if current ones expire soon
+func (role *awsAssumedRole) current(now time.Time) (awsCredentials, error) {
+	role.lock.Lock()
+	defer role.lock.Unlock()
+	if now.Add(awsRoleRefreshBefore).Before(role.expiration) {
+		return role.assumed, nil
+	}
+	payload := []byte(url.Values{
+		"Action":          {"AssumeRole"},
+		"Version":         {"2011-06-15"},
+		"RoleArn":         {role.roleARN},
+		"RoleSessionName": {awsRoleSessionName},
+		"DurationSeconds": {fmt.Sprintf("%d", int(awsRoleSessionDuration.Seconds()))},
+	}.Encode())
+	request, err := http.NewRequest(http.MethodPost, role.endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	signAWSRequest(request, payload, awsSTSService, role.region, role.credentials, now)
+	response, err := role.client.Do(request)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		responseBody, _ := ioutil.ReadAll(io.LimitReader(response.Body, 1024))
+		return awsCredentials{}, fmt.Errorf("unexpected AWS STS response status %d: %s", response.StatusCode, bytes.TrimSpace(responseBody))
+	}
+	var result struct {
+		Credentials struct {
+			AccessKeyID     string    `xml:"AccessKeyId"`
+			SecretAccessKey string    `xml:"SecretAccessKey"`
+			SessionToken    string    `xml:"SessionToken"`
+			Expiration      time.Time `xml:"Expiration"`
+		} `xml:"AssumeRoleResult>Credentials"`
+	}
+	if err := xml.NewDecoder(response.Body).Decode(&result); err != nil {
+		return awsCredentials{}, err
+	}
+	role.assumed = awsCredentials{
+		accessKeyID:     result.Credentials.AccessKeyID,
+		secretAccessKey: result.Credentials.SecretAccessKey,
+		sessionToken:    result.Credentials.SessionToken,
+	}
+	role.expiration = result.Credentials.Expiration
+	return role.assumed, nil
+}
+
+// AWSEnvelopeConfig describes AWS KMS key which seals data keys of keystore
+type AWSEnvelopeConfig struct {
+	// KeyID is AWS KMS key ID, ARN or alias
+	KeyID string
+	// Region of AWS KMS, empty means AWS_REGION
+	Region string
+	// Endpoint of AWS KMS, empty means regional endpoint
+	Endpoint string
+	// RoleARN is role assumed to access KMS key, empty means that credentials of environment are used as is
+	RoleARN string
+	// CacheTTL is time while decrypted data keys are kept in memory and used without requests to AWS KMS, 0 disables
+	// caching
+	CacheTTL time.Duration
+}
+
+// cachedDataKey is decrypted data key with time after which it's removed from cache
+type cachedDataKey struct {
+	key     []byte
+	expires time.Time
+}
+
+// AWSEnvelopeKeyEncryptor is keystore.KeyEncryptor which encrypts every key with own data key generated by AWS KMS
+// GenerateDataKey API. Keys are encrypted locally, only data keys sealed with KMS key are sent to AWS KMS Decrypt API,
+// with context of key (e.g. client ID) as encryption context, so decryption of every key is audited by AWS.
+type AWSEnvelopeKeyEncryptor struct {
+	wrapper  *AWSKeyWrapper
+	cacheTTL time.Duration
+
+	lock  sync.Mutex
+	cache map[[sha256.Size]byte]cachedDataKey
+}
+
+// NewAWSEnvelopeKeyEncryptorFromEnvironment returns encryptor which uses AWS KMS key of config. Credentials are read
+// from AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN environment variables.
+func NewAWSEnvelopeKeyEncryptorFromEnvironment(config AWSEnvelopeConfig) (*AWSEnvelopeKeyEncryptor, error) {
+	if config.KeyID == "" {
+		return nil, errors.New("empty AWS KMS key ID")
+	}
+	credentials, region, err := awsEnvironmentWithRegion(config.Region)
+	if err != nil {
+		return nil, err
+	}
+	wrapper := newAWSKeyWrapper(config.KeyID, config.Endpoint, region, credentials)
+	if config.RoleARN != "" {
+		wrapper.role = newAWSAssumedRole(config.RoleARN, region, credentials)
+	}
+	return newAWSEnvelopeKeyEncryptor(wrapper, config.CacheTTL), nil
+}
+
+func newAWSEnvelopeKeyEncryptor(wrapper *AWSKeyWrapper, cacheTTL time.Duration) *AWSEnvelopeKeyEncryptor {
+	return &AWSEnvelopeKeyEncryptor{wrapper: wrapper, cacheTTL: cacheTTL, cache: make(map[[sha256.Size]byte]cachedDataKey)}
+}
+
+func awsEncryptionContext(context []byte) map[string]string {
+	return map[string]string{awsEncryptionContextKey: string(context)}
+}
+
+// cacheDataKey keeps copy of decrypted data key of sealed data key and removes expired ones
+func (encryptor *AWSEnvelopeKeyEncryptor) cacheDataKey(sealedDataKey, dataKey []byte) {
+	if encryptor.cacheTTL <= 0 {
+		return
+	}
+	now := encryptor.wrapper.now()
+	encryptor.lock.Lock()
+	defer encryptor.lock.Unlock()
+	for id, cached := range encryptor.cache {
+		if now.After(cached.expires) {
+			utils.ZeroizeBytes(cached.key)
+			delete(encryptor.cache, id)
+		}
+	}
+	encryptor.cache[sha256.Sum256(sealedDataKey)] = cachedDataKey{key: append([]byte{}, dataKey...), expires: now.Add(encryptor.cacheTTL)}
+}
+
+// lookupDataKey returns copy of decrypted data key of sealed data key if it's cached and not expired
+func (encryptor *AWSEnvelopeKeyEncryptor) lookupDataKey(sealedDataKey []byte) ([]byte, bool) {
+	if encryptor.cacheTTL <= 0 {
+		return nil, false
+	}
+	encryptor.lock.Lock()
+	defer encryptor.lock.Unlock()
+	cached, ok := encryptor.cache[sha256.Sum256(sealedDataKey)]
+	if !ok || encryptor.wrapper.now().After(cached.expires) {
+		return nil, false
+	}
+	return append([]byte{}, cached.key...), true
+}
+
+// Encrypt generates data key with AWS KMS and returns key encrypted with it, prepended by sealed data key
+func (encryptor *AWSEnvelopeKeyEncryptor) Encrypt(key, context []byte) ([]byte, error) {
+	var response struct {
+		CiphertextBlob []byte
+		Plaintext      []byte
+	}
+	err := encryptor.wrapper.call("GenerateDataKey", map[string]interface{}{
+		"KeyId":             encryptor.wrapper.keyID,
+		"KeySpec":           "AES_256",
+		"EncryptionContext": awsEncryptionContext(context),
+	}, &response)
+	if err != nil {
+		return nil, err
+	}
+	defer utils.ZeroizeBytes(response.Plaintext)
+	if len(response.CiphertextBlob) == 0 || len(response.CiphertextBlob) > 0xffff {
+		return nil, errors.New("unexpected size of data key generated by AWS KMS")
+	}
+	cellEncryptor, err := keystore.NewSCellKeyEncryptor(response.Plaintext)
+	if err != nil {
+		return nil, err
+	}
+	encrypted, err := cellEncryptor.Encrypt(key, context)
+	if err != nil {
+		return nil, err
+	}
+	encryptor.cacheDataKey(response.CiphertextBlob, response.Plaintext)
+	sealed := make([]byte, 0, len(awsEnvelopeMagic)+2+len(response.CiphertextBlob)+len(encrypted))
+	sealed = append(sealed, awsEnvelopeMagic...)
+	sealed = append(sealed, 0, 0)
+	binary.BigEndian.PutUint16(sealed[len(awsEnvelopeMagic):], uint16(len(response.CiphertextBlob)))
+	sealed = append(sealed, response.CiphertextBlob...)
+	return append(sealed, encrypted...), nil
+}
+
+// Decrypt decrypts data key with AWS KMS, or takes it from cache, and returns key decrypted with it
+func (encryptor *AWSEnvelopeKeyEncryptor) Decrypt(sealed, context []byte) ([]byte, error) {
+	headerLength := len(awsEnvelopeMagic) + 2
+	if len(sealed) < headerLength || !bytes.HasPrefix(sealed, awsEnvelopeMagic) {
+		return nil, ErrInvalidAWSEnvelope
+	}
+	sealedDataKeyLength := int(binary.BigEndian.Uint16(sealed[len(awsEnvelopeMagic):]))
+	if len(sealed) < headerLength+sealedDataKeyLength {
+		return nil, ErrInvalidAWSEnvelope
+	}
+	sealedDataKey, encrypted := sealed[headerLength:headerLength+sealedDataKeyLength], sealed[headerLength+sealedDataKeyLength:]
+	dataKey, ok := encryptor.lookupDataKey(sealedDataKey)
+	if !ok {
+		var response struct {
+			Plaintext []byte
+		}
+		err := encryptor.wrapper.call("Decrypt", map[string]interface{}{
+			"KeyId":             encryptor.wrapper.keyID,
+			"CiphertextBlob":    sealedDataKey,
+			"EncryptionContext": awsEncryptionContext(context),
+		}, &response)
+		if err != nil {
+			return nil, err
+		}
+		dataKey = response.Plaintext
+		encryptor.cacheDataKey(sealedDataKey, dataKey)
+	}
+	defer utils.ZeroizeBytes(dataKey)
+	cellEncryptor, err := keystore.NewSCellKeyEncryptor(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return cellEncryptor.Decrypt(encrypted, context)
+}
@@ -0,0 +1,193 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kms
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const awsSecretsManagerService = "secretsmanager"
+
+// vaultStaticRotationDelay is added to TTL of Vault static role, so password is fetched after rotation
+const vaultStaticRotationDelay = time.Second
+
+// ErrInvalidDatabaseSecret returned when secret doesn't contain database password
+var ErrInvalidDatabaseSecret = errors.New("secret doesn't contain database password")
+
+// DatabaseSecret is database user and password stored in secret backend
+type DatabaseSecret struct {
+	User     string
+	Password string
+	// RefreshAfter is time after which secret should be fetched again because it's going to expire or rotate, 0 if
+	// secret backend doesn't tell it
+	RefreshAfter time.Duration
+}
+
+// DatabaseSecretSource fetches current database credentials from secret backend
+type DatabaseSecretSource interface {
+	FetchDatabaseSecret() (DatabaseSecret, error)
+}
+
+// NewDatabaseSecretSourceFromEnvironment returns source of database credentials stored in secret backend with
+// backendType ("vault" or "aws") under secretID. Credentials of backend are read from its environment variables like
+// in NewKeyWrapperFromEnvironment.
+func NewDatabaseSecretSourceFromEnvironment(backendType, secretID, endpoint string) (DatabaseSecretSource, error) {
+	if secretID == "" {
+		return nil, errors.New("empty secret ID")
+	}
+	switch backendType {
+	case TypeAWS:
+		credentials, region, err := awsEnvironment()
+		if err != nil {
+			return nil, err
+		}
+		return newAWSDatabaseSecretSource(secretID, endpoint, region, credentials), nil
+	case TypeVault:
+		address, token, err := vaultEnvironment(endpoint)
+		if err != nil {
+			return nil, err
+		}
+		return newVaultDatabaseSecretSource(secretID, address, token), nil
+	default:
+		return nil, ErrUnsupportedKMS
+	}
+}
+
+// VaultDatabaseSecretSource reads credentials from Vault path, like "database/creds/<role>" of dynamic role or
+// "database/static-creds/<role>" of static role of database secrets engine, or KV (v1 or v2) secret with "username"
+// and "password" keys
+type VaultDatabaseSecretSource struct {
+	address string
+	token   string
+	path    string
+	client  *http.Client
+}
+
+func newVaultDatabaseSecretSource(path, address, token string) *VaultDatabaseSecretSource {
+	return &VaultDatabaseSecretSource{
+		address: strings.TrimSuffix(address, "/"),
+		token:   token,
+		path:    strings.Trim(path, "/"),
+		client:  &http.Client{Timeout: defaultHTTPTimeout},
+	}
+}
+
+// vaultDatabaseSecretData is data of database secrets engine and KV v1 secrets, KV v2 wraps it into "data" field
+type vaultDatabaseSecretData struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// TTL is time until rotation of static role password
+	TTL  int64                    `json:"ttl"`
+	Data *vaultDatabaseSecretData `json:"data"`
+}
+
+// FetchDatabaseSecret reads secret. Dynamic credentials are refreshed after 2/3 of their lease, so connections
+// authenticated with previous ones may be closed before lease expires. Static role passwords are refreshed right
+// after rotation.
+func (source *VaultDatabaseSecretSource) FetchDatabaseSecret() (DatabaseSecret, error) {
+	request, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/v1/%s", source.address, source.path), nil)
+	if err != nil {
+		return DatabaseSecret{}, err
+	}
+	request.Header.Set("X-Vault-Token", source.token)
+	var response struct {
+		LeaseDuration int64                   `json:"lease_duration"`
+		Data          vaultDatabaseSecretData `json:"data"`
+	}
+	if err := doJSONRequest(source.client, request, &response); err != nil {
+		return DatabaseSecret{}, err
+	}
+	data := response.Data
+	if data.Data != nil {
+		data = *data.Data
+	}
+	if data.Password == "" {
+		return DatabaseSecret{}, ErrInvalidDatabaseSecret
+	}
+	secret := DatabaseSecret{User: data.Username, Password: data.Password}
+	if response.LeaseDuration > 0 {
+		secret.RefreshAfter = time.Duration(response.LeaseDuration) * time.Second * 2 / 3
+	} else if data.TTL > 0 {
+		secret.RefreshAfter = time.Duration(data.TTL)*time.Second + vaultStaticRotationDelay
+	}
+	return secret, nil
+}
+
+// AWSDatabaseSecretSource reads credentials from AWS Secrets Manager secret with JSON value containing "username"
+// and "password" keys, like secrets of Amazon RDS
+type AWSDatabaseSecretSource struct {
+	secretID    string
+	endpoint    string
+	region      string
+	credentials awsCredentials
+	client      *http.Client
+	// now is time.Now, replaced in tests
+	now func() time.Time
+}
+
+func newAWSDatabaseSecretSource(secretID, endpoint, region string, credentials awsCredentials) *AWSDatabaseSecretSource {
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://secretsmanager.%s.amazonaws.com/", region)
+	}
+	return &AWSDatabaseSecretSource{
+		secretID:    secretID,
+		endpoint:    endpoint,
+		region:      region,
+		credentials: credentials,
+		client:      &http.Client{Timeout: defaultHTTPTimeout},
+		now:         time.Now,
+	}
+}
+
+// FetchDatabaseSecret reads current version of secret. Secrets Manager doesn't tell when secret is rotated, so
+// RefreshAfter is 0.
+func (source *AWSDatabaseSecretSource) FetchDatabaseSecret() (DatabaseSecret, error) {
+	payload, err := json.Marshal(map[string]string{"SecretId": source.secretID})
+	if err != nil {
+		return DatabaseSecret{}, err
+	}
+	request, err := http.NewRequest(http.MethodPost, source.endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return DatabaseSecret{}, err
+	}
+	request.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	request.Header.Set("X-Amz-Target", "secretsmanager.GetSecretValue")
+	signAWSRequest(request, payload, awsSecretsManagerService, source.region, source.credentials, source.now())
+	var response struct {
+		SecretString string
+	}
+	if err := doJSONRequest(source.client, request, &response); err != nil {
+		return DatabaseSecret{}, err
+	}
+	var value struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	if err := json.Unmarshal([]byte(response.SecretString), &value); err != nil {
+		return DatabaseSecret{}, fmt.Errorf("%w: value isn't JSON object", ErrInvalidDatabaseSecret)
+	}
+	if value.Password == "" {
+		return DatabaseSecret{}, ErrInvalidDatabaseSecret
+	}
+	return DatabaseSecret{User: value.Username, Password: value.Password}, nil
+}
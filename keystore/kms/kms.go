@@ -0,0 +1,75 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package kms contains clients of external key management services which wrap data keys of keystore bundles.
+// Only wrap and unwrap of small data keys are performed by KMS, keys itself never leave Acra. Secret managers of the
+// same services are also used as sources of database credentials, and Vault KV secrets engine as storage of key files.
+package kms
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/cossacklabs/acra/keystore/filesystem"
+)
+
+// Supported KMS types
+const (
+	TypeAWS   = "aws"
+	TypeVault = "vault"
+)
+
+// defaultHTTPTimeout limits time of KMS requests
+const defaultHTTPTimeout = time.Second * 10
+
+// ErrUnsupportedKMS returned for unknown KMS type
+var ErrUnsupportedKMS = errors.New("unsupported KMS type")
+
+// ErrMissingCredentials returned when KMS credentials aren't set in environment
+var ErrMissingCredentials = errors.New("KMS credentials aren't set")
+
+// NewKeyWrapperFromEnvironment returns wrapper of KMS with kmsType which uses keyID. Credentials are read from
+// environment variables of the KMS. Empty endpoint means default endpoint of the service.
+func NewKeyWrapperFromEnvironment(kmsType, keyID, endpoint string) (filesystem.KeyWrapper, error) {
+	switch kmsType {
+	case TypeAWS:
+		return NewAWSKeyWrapperFromEnvironment(keyID, endpoint)
+	case TypeVault:
+		return NewVaultKeyWrapperFromEnvironment(keyID, endpoint)
+	default:
+		return nil, ErrUnsupportedKMS
+	}
+}
+
+// doJSONRequest sends request with JSON body and decodes JSON response into result
+func doJSONRequest(client *http.Client, request *http.Request, result interface{}) error {
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		responseBody, _ := ioutil.ReadAll(io.LimitReader(response.Body, 1024))
+		return fmt.Errorf("unexpected KMS response status %d: %s", response.StatusCode, bytes.TrimSpace(responseBody))
+	}
+	return json.NewDecoder(response.Body).Decode(result)
+}
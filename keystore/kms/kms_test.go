@@ -0,0 +1,714 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kms
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cossacklabs/acra/keystore"
+)
+
+func TestSignAWSRequest(t *testing.T) {
+	// "get-vanilla" case of AWS Signature Version 4 test suite
+	request, err := http.NewRequest(http.MethodGet, "https://example.amazonaws.com/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	credentials := awsCredentials{accessKeyID: "AKIDEXAMPLE", secretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"}
+	signAWSRequest(request, nil, "service", "us-east-1", credentials, time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+	expected := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, " +
+		"SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"
+	if authorization := request.Header.Get("Authorization"); authorization != expected {
+		t.Fatalf("Incorrect signature: %s", authorization)
+	}
+}
+
+func TestAWSKeyWrapper(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=key/") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		var body struct {
+			KeyID          string `json:"KeyId"`
+			Plaintext      []byte
+			CiphertextBlob []byte
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.KeyID != "alias/acra" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		// reverse data instead of encryption
+		reverse := func(data []byte) []byte {
+			result := make([]byte, len(data))
+			for i := range data {
+				result[len(data)-1-i] = data[i]
+			}
+			return result
+		}
+		switch r.Header.Get("X-Amz-Target") {
+		case "TrentService.Encrypt":
+			json.NewEncoder(w).Encode(map[string][]byte{"CiphertextBlob": reverse(body.Plaintext)})
+		case "TrentService.Decrypt":
+			json.NewEncoder(w).Encode(map[string][]byte{"Plaintext": reverse(body.CiphertextBlob)})
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+
+	wrapper := newAWSKeyWrapper("alias/acra", server.URL, "eu-west-1", awsCredentials{accessKeyID: "key", secretAccessKey: "secret"})
+	key := []byte("data key")
+	wrappedKey, err := wrapper.WrapKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(wrappedKey, key) {
+		t.Fatal("Key wasn't wrapped")
+	}
+	unwrappedKey, err := wrapper.UnwrapKey(wrappedKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(unwrappedKey, key) {
+		t.Fatal("Unwrapped key differs from original")
+	}
+
+	wrapper = newAWSKeyWrapper("alias/acra", server.URL, "eu-west-1", awsCredentials{accessKeyID: "other", secretAccessKey: "secret"})
+	if _, err := wrapper.WrapKey(key); err == nil {
+		t.Fatal("Expected error on rejected request")
+	}
+}
+
+func TestVaultKeyWrapper(t *testing.T) {
+	var requestedPaths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestedPaths = append(requestedPaths, r.URL.Path)
+		if r.Header.Get("X-Vault-Token") != "token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		var body map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if strings.Contains(r.URL.Path, "/encrypt/") {
+			json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]string{"ciphertext": "vault:v1:" + body["plaintext"]}})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]string{"plaintext": strings.TrimPrefix(body["ciphertext"], "vault:v1:")}})
+	}))
+	defer server.Close()
+
+	wrapper := newVaultKeyWrapper("secrets/transit/acra", server.URL+"/", "token")
+	key := []byte("data key")
+	wrappedKey, err := wrapper.WrapKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(wrappedKey, []byte("vault:v1:")) {
+		t.Fatalf("Unexpected wrapped key %s", wrappedKey)
+	}
+	unwrappedKey, err := wrapper.UnwrapKey(wrappedKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(unwrappedKey, key) {
+		t.Fatal("Unwrapped key differs from original")
+	}
+	expectedPaths := []string{"/v1/secrets/transit/encrypt/acra", "/v1/secrets/transit/decrypt/acra"}
+	if strings.Join(requestedPaths, ",") != strings.Join(expectedPaths, ",") {
+		t.Fatalf("Unexpected requested paths %v", requestedPaths)
+	}
+
+	if _, err := newVaultKeyWrapper("acra", server.URL, "other").WrapKey(key); err == nil {
+		t.Fatal("Expected error on rejected request")
+	}
+}
+
+func TestVaultDatabaseSecretSource(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/database/creds/app":
+			json.NewEncoder(w).Encode(map[string]interface{}{"lease_duration": 3600, "data": map[string]string{"username": "v-app-1", "password": "dynamic"}})
+		case "/v1/database/static-creds/app":
+			json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{"username": "app", "password": "static", "ttl": 60}})
+		case "/v1/secret/data/app":
+			json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{"data": map[string]string{"username": "app", "password": "kv"}}})
+		case "/v1/secret/empty":
+			json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]string{"username": "app"}})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	testCases := []struct {
+		path   string
+		secret DatabaseSecret
+	}{
+		{"database/creds/app", DatabaseSecret{User: "v-app-1", Password: "dynamic", RefreshAfter: time.Minute * 40}},
+		{"/database/static-creds/app", DatabaseSecret{User: "app", Password: "static", RefreshAfter: time.Minute + vaultStaticRotationDelay}},
+		{"secret/data/app", DatabaseSecret{User: "app", Password: "kv"}},
+	}
+	for _, testCase := range testCases {
+		secret, err := newVaultDatabaseSecretSource(testCase.path, server.URL, "token").FetchDatabaseSecret()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if secret != testCase.secret {
+			t.Fatalf("Unexpected secret of %s: %+v", testCase.path, secret)
+		}
+	}
+	if _, err := newVaultDatabaseSecretSource("secret/empty", server.URL, "token").FetchDatabaseSecret(); err != ErrInvalidDatabaseSecret {
+		t.Fatalf("Expected ErrInvalidDatabaseSecret, took %v", err)
+	}
+	if _, err := newVaultDatabaseSecretSource("database/creds/app", server.URL, "other").FetchDatabaseSecret(); err == nil {
+		t.Fatal("Expected error on rejected request")
+	}
+}
+
+func TestAWSDatabaseSecretSource(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.Header.Get("Authorization"), "/eu-west-1/secretsmanager/aws4_request") ||
+			r.Header.Get("X-Amz-Target") != "secretsmanager.GetSecretValue" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		var body struct {
+			SecretID string `json:"SecretId"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		switch body.SecretID {
+		case "rds/app":
+			json.NewEncoder(w).Encode(map[string]string{"SecretString": `{"engine":"postgres","username":"app","password":"secret"}`})
+		case "plain":
+			json.NewEncoder(w).Encode(map[string]string{"SecretString": "secret"})
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+
+	credentials := awsCredentials{accessKeyID: "key", secretAccessKey: "secret"}
+	secret, err := newAWSDatabaseSecretSource("rds/app", server.URL, "eu-west-1", credentials).FetchDatabaseSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secret != (DatabaseSecret{User: "app", Password: "secret"}) {
+		t.Fatalf("Unexpected secret: %+v", secret)
+	}
+	if _, err := newAWSDatabaseSecretSource("plain", server.URL, "eu-west-1", credentials).FetchDatabaseSecret(); !errors.Is(err, ErrInvalidDatabaseSecret) {
+		t.Fatalf("Expected ErrInvalidDatabaseSecret, took %v", err)
+	}
+	if _, err := newAWSDatabaseSecretSource("missing", server.URL, "eu-west-1", credentials).FetchDatabaseSecret(); err == nil {
+		t.Fatal("Expected error on rejected request")
+	}
+	if _, err := NewDatabaseSecretSourceFromEnvironment("gcp", "app", ""); err != ErrUnsupportedKMS {
+		t.Fatalf("Expected ErrUnsupportedKMS, took %v", err)
+	}
+}
+
+// fakeVault serves AppRole login, KV v2 and Transit endpoints of Vault API
+type fakeVault struct {
+	lock    sync.Mutex
+	secrets map[string]json.RawMessage
+	tokens  map[string]bool
+	logins  int
+}
+
+func newFakeVault() *fakeVault {
+	return &fakeVault{secrets: make(map[string]json.RawMessage), tokens: make(map[string]bool)}
+}
+
+// expireTokens makes all issued tokens invalid
+func (vault *fakeVault) expireTokens() {
+	vault.lock.Lock()
+	vault.tokens = make(map[string]bool)
+	vault.lock.Unlock()
+}
+
+func (vault *fakeVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	vault.lock.Lock()
+	defer vault.lock.Unlock()
+	if r.URL.Path == "/v1/auth/approle/login" {
+		var body map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body["role_id"] != "role" || body["secret_id"] != "secret" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		vault.logins++
+		token := fmt.Sprintf("token-%d", vault.logins)
+		vault.tokens[token] = true
+		json.NewEncoder(w).Encode(map[string]interface{}{"auth": map[string]string{"client_token": token}})
+		return
+	}
+	if !vault.tokens[r.Header.Get("X-Vault-Token")] {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/v1/secret/data/"):
+		path := strings.TrimPrefix(r.URL.Path, "/v1/secret/data/")
+		if r.Method == http.MethodGet {
+			data, ok := vault.secrets[path]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{
+				"data": data, "metadata": map[string]interface{}{"created_time": time.Now(), "version": 1}}})
+			return
+		}
+		var body struct {
+			Data json.RawMessage `json:"data"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		vault.secrets[path] = body.Data
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{"version": 1}})
+	case strings.HasPrefix(r.URL.Path, "/v1/secret/metadata/"):
+		path := strings.TrimPrefix(r.URL.Path, "/v1/secret/metadata/")
+		if r.Method == http.MethodDelete {
+			delete(vault.secrets, path)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		names := map[string]bool{}
+		for secretPath := range vault.secrets {
+			if !strings.HasPrefix(secretPath, path+"/") {
+				continue
+			}
+			name := strings.TrimPrefix(secretPath, path+"/")
+			if i := strings.Index(name, "/"); i >= 0 {
+				name = name[:i+1]
+			}
+			names[name] = true
+		}
+		if len(names) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		keys := []string{}
+		for name := range names {
+			keys = append(keys, name)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{"keys": keys}})
+	case r.URL.Path == "/v1/transit/encrypt/acra":
+		var body map[string]string
+		json.NewDecoder(r.Body).Decode(&body)
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]string{"ciphertext": "vault:v1:" + body["plaintext"]}})
+	case r.URL.Path == "/v1/transit/decrypt/acra":
+		var body map[string]string
+		json.NewDecoder(r.Body).Decode(&body)
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]string{"plaintext": strings.TrimPrefix(body["ciphertext"], "vault:v1:")}})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestVaultKeyStore(t *testing.T) {
+	vault := newFakeVault()
+	server := httptest.NewServer(vault)
+	defer server.Close()
+	os.Setenv(vaultSecretIDEnv, "secret")
+	defer os.Unsetenv(vaultSecretIDEnv)
+
+	config := VaultKeyStoreConfig{
+		Address:      server.URL,
+		TransitKeyID: "acra",
+		Auth:         VaultAuthConfig{Method: VaultAuthAppRole, RoleID: "role"},
+	}
+	encryptor, err := keystore.NewSCellKeyEncryptor(bytes.Repeat([]byte("k"), keystore.SymmetricKeyLength))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewVaultKeyStore(config, "/keys", encryptor, keystore.WithoutCache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientID := []byte("client")
+	for i := 0; i < 2; i++ {
+		if err := store.GenerateDataEncryptionKeys(clientID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	privateKeys, err := store.GetServerDecryptionPrivateKeys(clientID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(privateKeys) != 2 {
+		t.Fatalf("Expected current and historical keys, took %d", len(privateKeys))
+	}
+	if _, err := store.GetClientIDEncryptionPublicKey(clientID); err != nil {
+		t.Fatal(err)
+	}
+	for path, data := range vault.secrets {
+		if !strings.HasPrefix(path, DefaultVaultKVPath+"/") {
+			t.Fatalf("Secret %s is outside of configured path", path)
+		}
+		if !bytes.Contains(data, []byte(`"wrapped":true`)) {
+			t.Fatalf("Secret %s isn't wrapped with Transit key", path)
+		}
+	}
+
+	// expired token is replaced by login
+	vault.expireTokens()
+	if _, err := store.GetServerDecryptionPrivateKey(clientID); err != nil {
+		t.Fatal(err)
+	}
+	if vault.logins != 2 {
+		t.Fatalf("Expected 2 logins, took %d", vault.logins)
+	}
+
+	if err := store.DestroyDataEncryptionKeys(clientID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.GetServerDecryptionPrivateKey(clientID); err == nil {
+		t.Fatal("Expected error for destroyed key")
+	}
+	if _, err := store.Storage().ReadFile("/other/key"); !errors.Is(err, ErrPathOutsideKeyDirectory) {
+		t.Fatalf("Expected ErrPathOutsideKeyDirectory, took %v", err)
+	}
+	if _, err := NewVaultStorage(VaultKeyStoreConfig{Address: server.URL, Auth: VaultAuthConfig{Method: "ldap"}}, "/keys"); err != ErrUnsupportedVaultAuth {
+		t.Fatalf("Expected ErrUnsupportedVaultAuth, took %v", err)
+	}
+}
+
+func TestAWSEnvelopeKeyEncryptor(t *testing.T) {
+	var decryptCalls, assumeRoleCalls int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization := r.Header.Get("Authorization")
+		if strings.Contains(authorization, "/sts/aws4_request") {
+			if !strings.HasPrefix(authorization, "AWS4-HMAC-SHA256 Credential=key/") {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			assumeRoleCalls++
+			r.ParseForm()
+			if r.Form.Get("RoleArn") != "arn:aws:iam::123456789012:role/acra" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			fmt.Fprintf(w, `<AssumeRoleResponse><AssumeRoleResult><Credentials><AccessKeyId>role-key</AccessKeyId>`+
+				`<SecretAccessKey>role-secret</SecretAccessKey><SessionToken>session</SessionToken>`+
+				`<Expiration>%s</Expiration></Credentials></AssumeRoleResult></AssumeRoleResponse>`, time.Now().Add(time.Hour).UTC().Format(time.RFC3339))
+			return
+		}
+		if !strings.HasPrefix(authorization, "AWS4-HMAC-SHA256 Credential=role-key/") || r.Header.Get("X-Amz-Security-Token") != "session" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		var body struct {
+			KeyID             string `json:"KeyId"`
+			CiphertextBlob    []byte
+			EncryptionContext map[string]string
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.KeyID != "alias/acra" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		// data key is derived from encryption context, sealed data key is context itself
+		dataKey := bytes.Repeat([]byte(body.EncryptionContext[awsEncryptionContextKey]+"#"), keystore.SymmetricKeyLength)[:keystore.SymmetricKeyLength]
+		switch r.Header.Get("X-Amz-Target") {
+		case "TrentService.GenerateDataKey":
+			json.NewEncoder(w).Encode(map[string][]byte{"Plaintext": dataKey, "CiphertextBlob": []byte(body.EncryptionContext[awsEncryptionContextKey])})
+		case "TrentService.Decrypt":
+			decryptCalls++
+			if string(body.CiphertextBlob) != body.EncryptionContext[awsEncryptionContextKey] {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string][]byte{"Plaintext": dataKey})
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+
+	now := time.Now()
+	wrapper := newAWSKeyWrapper("alias/acra", server.URL, "eu-west-1", awsCredentials{accessKeyID: "key", secretAccessKey: "secret"})
+	wrapper.role = newAWSAssumedRole("arn:aws:iam::123456789012:role/acra", "eu-west-1", wrapper.credentials)
+	wrapper.role.endpoint = server.URL
+	wrapper.now = func() time.Time { return now }
+	encryptor := newAWSEnvelopeKeyEncryptor(wrapper, time.Minute)
+
+	key := []byte("private key")
+	sealed, err := encryptor.Encrypt(key, []byte("client"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(sealed, key) {
+		t.Fatal("Key wasn't encrypted")
+	}
+	// data key is cached by Encrypt and until TTL expires
+	for i, expectedCalls := range []int{0, 0, 1} {
+		if i == 2 {
+			now = now.Add(time.Minute * 2)
+		}
+		decrypted, err := encryptor.Decrypt(sealed, []byte("client"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decrypted, key) {
+			t.Fatal("Decrypted key differs from original")
+		}
+		if decryptCalls != expectedCalls {
+			t.Fatalf("[%d] Expected %d Decrypt calls, took %d", i, expectedCalls, decryptCalls)
+		}
+	}
+	if assumeRoleCalls != 1 {
+		t.Fatalf("Credentials of role should be reused until expiration, took %d AssumeRole calls", assumeRoleCalls)
+	}
+	if _, err := encryptor.Decrypt(sealed, []byte("other")); err == nil {
+		t.Fatal("Expected error for other context")
+	}
+	if _, err := encryptor.Decrypt(key, []byte("client")); err != ErrInvalidAWSEnvelope {
+		t.Fatalf("Expected ErrInvalidAWSEnvelope, took %v", err)
+	}
+}
+
+// fakePKCS11Module keeps AES keys of token in memory and encrypts with Go AES-GCM
+type fakePKCS11Module struct {
+	lock        sync.Mutex
+	keys        map[string][]byte
+	sessions    map[uint]bool
+	nextSession uint
+	maxSessions int
+	// invalidate makes next operation fail like after restart of token
+	invalidate  bool
+	finalized   bool
+	randomCalls int
+}
+
+func newFakePKCS11Module(label string) *fakePKCS11Module {
+	return &fakePKCS11Module{keys: map[string][]byte{label: bytes.Repeat([]byte("k"), 32)}, sessions: make(map[uint]bool)}
+}
+
+func (module *fakePKCS11Module) openSession() (uint, error) {
+	module.lock.Lock()
+	defer module.lock.Unlock()
+	module.nextSession++
+	module.sessions[module.nextSession] = true
+	if len(module.sessions) > module.maxSessions {
+		module.maxSessions = len(module.sessions)
+	}
+	return module.nextSession, nil
+}
+
+func (module *fakePKCS11Module) closeSession(session uint) {
+	module.lock.Lock()
+	defer module.lock.Unlock()
+	delete(module.sessions, session)
+}
+
+func (module *fakePKCS11Module) login(session uint, pin string) error {
+	if pin != "1234" {
+		return ckrPINIncorrect
+	}
+	return nil
+}
+
+func (module *fakePKCS11Module) findSecretKey(session uint, label string) (uint, error) {
+	if _, ok := module.keys[label]; !ok {
+		return 0, ErrPKCS11KeyNotFound
+	}
+	return 1, nil
+}
+
+func (module *fakePKCS11Module) gcm(session uint) (cipher.AEAD, error) {
+	module.lock.Lock()
+	defer module.lock.Unlock()
+	if module.invalidate {
+		module.invalidate = false
+		return nil, ckrSessionHandleInvalid
+	}
+	if !module.sessions[session] {
+		return nil, ckrSessionHandleInvalid
+	}
+	for _, key := range module.keys {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	}
+	return nil, ErrPKCS11KeyNotFound
+}
+
+func (module *fakePKCS11Module) encrypt(session, key uint, iv, aad, data []byte) ([]byte, error) {
+	gcm, err := module.gcm(session)
+	if err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nil, iv, data, aad), nil
+}
+
+func (module *fakePKCS11Module) decrypt(session, key uint, iv, aad, data []byte) ([]byte, error) {
+	gcm, err := module.gcm(session)
+	if err != nil {
+		return nil, err
+	}
+	return gcm.Open(nil, iv, data, aad)
+}
+
+func (module *fakePKCS11Module) generateRandom(session uint, data []byte) error {
+	module.lock.Lock()
+	defer module.lock.Unlock()
+	if module.invalidate {
+		module.invalidate = false
+		return ckrSessionHandleInvalid
+	}
+	if !module.sessions[session] {
+		return ckrSessionHandleInvalid
+	}
+	module.randomCalls++
+	_, err := rand.Read(data)
+	return err
+}
+
+func (module *fakePKCS11Module) finalize() {
+	module.lock.Lock()
+	defer module.lock.Unlock()
+	module.finalized = true
+}
+
+func TestPKCS11KeyEncryptor(t *testing.T) {
+	module := newFakePKCS11Module("acra")
+	provider, err := newPKCS11MasterKeyProvider(module, PKCS11Config{PIN: "1234", KeyLabel: "acra", SessionPoolSize: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	encryptor, err := provider.KeyEncryptor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, context := []byte("private key"), []byte("client")
+	sealed, err := encryptor.Encrypt(key, context)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(sealed, pkcs11EnvelopeMagic) || bytes.Contains(sealed, key) {
+		t.Fatal("Key isn't sealed with PKCS#11 envelope")
+	}
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			decrypted, err := encryptor.Decrypt(sealed, context)
+			if err != nil || !bytes.Equal(decrypted, key) {
+				t.Error("Unexpected decrypted key", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if module.maxSessions > 2 {
+		t.Fatalf("Expected no more than 2 sessions, took %d", module.maxSessions)
+	}
+	if _, err := encryptor.Decrypt(sealed, []byte("other client")); err == nil {
+		t.Fatal("Expected error on decryption in other context")
+	}
+	if _, err := encryptor.Decrypt(key, context); err != ErrInvalidPKCS11Envelope {
+		t.Fatalf("Expected ErrInvalidPKCS11Envelope, took %v", err)
+	}
+	// broken session is replaced with new one
+	module.lock.Lock()
+	module.invalidate = true
+	module.lock.Unlock()
+	if decrypted, err := encryptor.Decrypt(sealed, context); err != nil || !bytes.Equal(decrypted, key) {
+		t.Fatal("Expected decryption with new session", err)
+	}
+	provider.Close()
+	if len(module.sessions) != 0 || !module.finalized {
+		t.Fatal("Expected closed sessions and finalized module")
+	}
+	if _, err := encryptor.Decrypt(sealed, context); err != errPKCS11ProviderIsClosed {
+		t.Fatalf("Expected error of closed provider, took %v", err)
+	}
+}
+
+func TestNewPKCS11MasterKeyProviderInvalid(t *testing.T) {
+	if _, err := newPKCS11MasterKeyProvider(newFakePKCS11Module("acra"), PKCS11Config{PIN: "0000", KeyLabel: "acra"}); err != ckrPINIncorrect {
+		t.Fatalf("Expected CKR_PIN_INCORRECT, took %v", err)
+	}
+	if _, err := newPKCS11MasterKeyProvider(newFakePKCS11Module("acra"), PKCS11Config{PIN: "1234", KeyLabel: "other"}); err != ErrPKCS11KeyNotFound {
+		t.Fatalf("Expected ErrPKCS11KeyNotFound, took %v", err)
+	}
+	if _, err := NewPKCS11MasterKeyProvider(PKCS11Config{KeyLabel: "acra"}); err != ErrPKCS11ModuleNotSet {
+		t.Fatalf("Expected ErrPKCS11ModuleNotSet, took %v", err)
+	}
+}
+
+func TestPKCS11RandomSource(t *testing.T) {
+	module := newFakePKCS11Module("acra")
+	source, err := newPKCS11RandomSource(module)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, pkcs11RandomChunkSize*2+1)
+	if n, err := source.Read(data); err != nil || n != len(data) {
+		t.Fatalf("Expected %d random bytes, took %d, %v", len(data), n, err)
+	}
+	if bytes.Equal(data, make([]byte, len(data))) {
+		t.Fatal("Random bytes aren't generated by token")
+	}
+	// startup check and 3 chunks
+	if module.randomCalls != 4 {
+		t.Fatalf("Expected 4 calls of C_GenerateRandom, took %d", module.randomCalls)
+	}
+	// broken session is replaced with new one
+	module.lock.Lock()
+	module.invalidate = true
+	module.lock.Unlock()
+	if _, err := source.Read(data); err != nil {
+		t.Fatal("Expected random bytes with new session", err)
+	}
+	source.Close()
+	if len(module.sessions) != 0 || !module.finalized {
+		t.Fatal("Expected closed sessions and finalized module")
+	}
+	if _, err := source.Read(data); err != errPKCS11RandomSourceIsClosed {
+		t.Fatalf("Expected error of closed source, took %v", err)
+	}
+	if _, err := NewPKCS11RandomSource("", ""); err != ErrPKCS11ModuleNotSet {
+		t.Fatalf("Expected ErrPKCS11ModuleNotSet, took %v", err)
+	}
+}
@@ -0,0 +1,370 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kms
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/cossacklabs/acra/keystore"
+	"github.com/cossacklabs/acra/random"
+	"github.com/cossacklabs/acra/utils"
+)
+
+// DefaultPKCS11SessionPoolSize is default number of PKCS#11 sessions used concurrently
+const DefaultPKCS11SessionPoolSize = 4
+
+const (
+	// pkcs11IVLength is length of AES-GCM IV of sealed data keys
+	pkcs11IVLength = 12
+	// pkcs11TagLength is length of AES-GCM tag of sealed data keys
+	pkcs11TagLength = 16
+)
+
+// pkcs11EnvelopeMagic starts keys sealed by PKCS11KeyEncryptor
+var pkcs11EnvelopeMagic = []byte("PKE1")
+
+// Errors returned by PKCS#11 master key provider
+var (
+	ErrInvalidPKCS11Envelope  = errors.New("key isn't sealed with PKCS#11 master key")
+	ErrPKCS11NotSupported     = errors.New("PKCS#11 support isn't compiled in, build with \"-tags pkcs11\"")
+	ErrPKCS11KeyNotFound      = errors.New("master key isn't found on PKCS#11 token")
+	ErrPKCS11TokenNotFound    = errors.New("PKCS#11 token isn't found")
+	ErrInvalidPKCS11PoolSize  = errors.New("PKCS#11 session pool size should be greater than zero")
+	ErrPKCS11ModuleNotSet     = errors.New("path of PKCS#11 module isn't set")
+	ErrPKCS11KeyLabelNotSet   = errors.New("label of PKCS#11 master key isn't set")
+	errPKCS11ProviderIsClosed = errors.New("PKCS#11 master key provider is closed")
+)
+
+// PKCS11Config describes AES key of HSM token which is used as master key of keystore
+type PKCS11Config struct {
+	// ModulePath is path of PKCS#11 library of HSM
+	ModulePath string
+	// TokenLabel is label of token with master key, empty means first token
+	TokenLabel string
+	// PIN of token user
+	PIN string
+	// KeyLabel is label of AES secret key object
+	KeyLabel string
+	// SessionPoolSize limits number of sessions used concurrently, default is DefaultPKCS11SessionPoolSize
+	SessionPoolSize int
+}
+
+// pkcs11Module is subset of PKCS#11 API used to encrypt and decrypt data keys with AES-GCM on token and to generate
+// random bytes with RNG of token
+type pkcs11Module interface {
+	openSession() (uint, error)
+	closeSession(session uint)
+	login(session uint, pin string) error
+	findSecretKey(session uint, label string) (uint, error)
+	encrypt(session, key uint, iv, aad, data []byte) ([]byte, error)
+	decrypt(session, key uint, iv, aad, data []byte) ([]byte, error)
+	generateRandom(session uint, data []byte) error
+	finalize()
+}
+
+// pkcs11Error is CK_RV code returned by PKCS#11 module
+type pkcs11Error uint
+
+// CK_RV codes handled by provider
+const (
+	ckrDeviceError          pkcs11Error = 0x30
+	ckrDeviceRemoved        pkcs11Error = 0x32
+	ckrPINIncorrect         pkcs11Error = 0xa0
+	ckrSessionClosed        pkcs11Error = 0xb0
+	ckrSessionHandleInvalid pkcs11Error = 0xb3
+	ckrTokenNotPresent      pkcs11Error = 0xe0
+	ckrUserAlreadyLoggedIn  pkcs11Error = 0x100
+	ckrUserNotLoggedIn      pkcs11Error = 0x101
+)
+
+var pkcs11ErrorNames = map[pkcs11Error]string{
+	ckrDeviceError:          "CKR_DEVICE_ERROR",
+	ckrDeviceRemoved:        "CKR_DEVICE_REMOVED",
+	ckrPINIncorrect:         "CKR_PIN_INCORRECT",
+	ckrSessionClosed:        "CKR_SESSION_CLOSED",
+	ckrSessionHandleInvalid: "CKR_SESSION_HANDLE_INVALID",
+	ckrTokenNotPresent:      "CKR_TOKEN_NOT_PRESENT",
+	ckrUserAlreadyLoggedIn:  "CKR_USER_ALREADY_LOGGED_IN",
+	ckrUserNotLoggedIn:      "CKR_USER_NOT_LOGGED_IN",
+}
+
+func (err pkcs11Error) Error() string {
+	if name, ok := pkcs11ErrorNames[err]; ok {
+		return "PKCS#11 error " + name
+	}
+	return fmt.Sprintf("PKCS#11 error 0x%x", uint(err))
+}
+
+// isPKCS11SessionError returns true if session can't be used anymore and operation may succeed with new one
+func isPKCS11SessionError(err error) bool {
+	switch err {
+	case ckrDeviceError, ckrDeviceRemoved, ckrSessionClosed, ckrSessionHandleInvalid, ckrTokenNotPresent, ckrUserNotLoggedIn:
+		return true
+	}
+	return false
+}
+
+// pkcs11Session is opened session with handle of master key found in it
+type pkcs11Session struct {
+	handle uint
+	key    uint
+}
+
+// PKCS11MasterKeyProvider keeps master key on HSM token, so it never leaves HSM. Keys of keystore are encrypted with
+// own data keys which are sealed with AES-GCM on token and unsealed through token on every decryption. Sessions are
+// taken from pool which limits number of concurrent operations on token.
+type PKCS11MasterKeyProvider struct {
+	module   pkcs11Module
+	pin      string
+	keyLabel string
+
+	// busy holds place for every session in use, so no more than pool size sessions are opened
+	busy chan struct{}
+	idle chan *pkcs11Session
+
+	lock     sync.Mutex
+	loggedIn bool
+	closed   bool
+}
+
+// NewPKCS11MasterKeyProvider loads PKCS#11 module and checks that master key is accessible on token
+func NewPKCS11MasterKeyProvider(config PKCS11Config) (*PKCS11MasterKeyProvider, error) {
+	if config.ModulePath == "" {
+		return nil, ErrPKCS11ModuleNotSet
+	}
+	if config.KeyLabel == "" {
+		return nil, ErrPKCS11KeyLabelNotSet
+	}
+	module, err := loadPKCS11Module(config.ModulePath, config.TokenLabel)
+	if err != nil {
+		return nil, err
+	}
+	provider, err := newPKCS11MasterKeyProvider(module, config)
+	if err != nil {
+		module.finalize()
+		return nil, err
+	}
+	return provider, nil
+}
+
+func newPKCS11MasterKeyProvider(module pkcs11Module, config PKCS11Config) (*PKCS11MasterKeyProvider, error) {
+	poolSize := config.SessionPoolSize
+	if poolSize == 0 {
+		poolSize = DefaultPKCS11SessionPoolSize
+	}
+	if poolSize < 0 {
+		return nil, ErrInvalidPKCS11PoolSize
+	}
+	provider := &PKCS11MasterKeyProvider{
+		module:   module,
+		pin:      config.PIN,
+		keyLabel: config.KeyLabel,
+		busy:     make(chan struct{}, poolSize),
+		idle:     make(chan *pkcs11Session, poolSize),
+	}
+	// fail on start if token or key aren't accessible instead of first key decryption
+	if err := provider.do(func(*pkcs11Session) error { return nil }); err != nil {
+		return nil, err
+	}
+	return provider, nil
+}
+
+// KeyEncryptor returns encryptor of keystore keys which seals their data keys with master key on token
+func (provider *PKCS11MasterKeyProvider) KeyEncryptor() (keystore.KeyEncryptor, error) {
+	return &PKCS11KeyEncryptor{provider: provider}, nil
+}
+
+// open opens session, logging in if it's first session of token, and finds master key
+func (provider *PKCS11MasterKeyProvider) open() (*pkcs11Session, error) {
+	handle, err := provider.module.openSession()
+	if err != nil {
+		return nil, err
+	}
+	provider.lock.Lock()
+	if !provider.loggedIn {
+		// login state is shared by all sessions of application
+		if err := provider.module.login(handle, provider.pin); err != nil && err != ckrUserAlreadyLoggedIn {
+			provider.lock.Unlock()
+			provider.module.closeSession(handle)
+			return nil, err
+		}
+		provider.loggedIn = true
+	}
+	provider.lock.Unlock()
+	key, err := provider.module.findSecretKey(handle, provider.keyLabel)
+	if err != nil {
+		provider.module.closeSession(handle)
+		return nil, err
+	}
+	return &pkcs11Session{handle: handle, key: key}, nil
+}
+
+// acquire returns idle session or opens new one, waiting while all sessions of pool are in use
+func (provider *PKCS11MasterKeyProvider) acquire() (*pkcs11Session, error) {
+	provider.busy <- struct{}{}
+	select {
+	case session := <-provider.idle:
+		return session, nil
+	default:
+	}
+	session, err := provider.open()
+	if err != nil {
+		<-provider.busy
+		return nil, err
+	}
+	return session, nil
+}
+
+// release returns session to pool or closes it if it was broken by err or provider is closed
+func (provider *PKCS11MasterKeyProvider) release(session *pkcs11Session, err error) {
+	defer func() { <-provider.busy }()
+	provider.lock.Lock()
+	closed := provider.closed
+	if isPKCS11SessionError(err) {
+		// token may be reinserted or restarted, login again
+		provider.loggedIn = false
+	}
+	provider.lock.Unlock()
+	if closed || isPKCS11SessionError(err) {
+		provider.module.closeSession(session.handle)
+		return
+	}
+	provider.idle <- session
+}
+
+// do runs fn with session of pool, repeating it once with new session if token invalidated previous one
+func (provider *PKCS11MasterKeyProvider) do(fn func(session *pkcs11Session) error) error {
+	for attempt := 0; ; attempt++ {
+		provider.lock.Lock()
+		closed := provider.closed
+		provider.lock.Unlock()
+		if closed {
+			return errPKCS11ProviderIsClosed
+		}
+		session, err := provider.acquire()
+		if err != nil {
+			return err
+		}
+		err = fn(session)
+		provider.release(session, err)
+		if isPKCS11SessionError(err) && attempt == 0 {
+			continue
+		}
+		return err
+	}
+}
+
+// Close closes idle sessions and finalizes PKCS#11 module, sessions in use are closed when released
+func (provider *PKCS11MasterKeyProvider) Close() {
+	provider.lock.Lock()
+	if provider.closed {
+		provider.lock.Unlock()
+		return
+	}
+	provider.closed = true
+	provider.lock.Unlock()
+	// wait for operations in progress
+	for i := 0; i < cap(provider.busy); i++ {
+		provider.busy <- struct{}{}
+	}
+	for {
+		select {
+		case session := <-provider.idle:
+			provider.module.closeSession(session.handle)
+		default:
+			provider.module.finalize()
+			return
+		}
+	}
+}
+
+// PKCS11KeyEncryptor is keystore.KeyEncryptor which encrypts every key with own data key sealed with master key on
+// PKCS#11 token
+type PKCS11KeyEncryptor struct {
+	provider *PKCS11MasterKeyProvider
+}
+
+// Encrypt generates data key, seals it on token in context of key and returns key encrypted with data key, prepended
+// by sealed data key
+func (encryptor *PKCS11KeyEncryptor) Encrypt(key, context []byte) ([]byte, error) {
+	dataKey := make([]byte, keystore.SymmetricKeyLength)
+	if _, err := random.Read(dataKey); err != nil {
+		return nil, err
+	}
+	defer utils.ZeroizeBytes(dataKey)
+	iv := make([]byte, pkcs11IVLength)
+	if _, err := random.Read(iv); err != nil {
+		return nil, err
+	}
+	var sealedDataKey []byte
+	err := encryptor.provider.do(func(session *pkcs11Session) (err error) {
+		sealedDataKey, err = encryptor.provider.module.encrypt(session.handle, session.key, iv, context, dataKey)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	cellEncryptor, err := keystore.NewSCellKeyEncryptor(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	encrypted, err := cellEncryptor.Encrypt(key, context)
+	if err != nil {
+		return nil, err
+	}
+	sealedLength := len(iv) + len(sealedDataKey)
+	sealed := make([]byte, 0, len(pkcs11EnvelopeMagic)+2+sealedLength+len(encrypted))
+	sealed = append(sealed, pkcs11EnvelopeMagic...)
+	sealed = append(sealed, 0, 0)
+	binary.BigEndian.PutUint16(sealed[len(pkcs11EnvelopeMagic):], uint16(sealedLength))
+	sealed = append(sealed, iv...)
+	sealed = append(sealed, sealedDataKey...)
+	return append(sealed, encrypted...), nil
+}
+
+// Decrypt unseals data key on token and returns key decrypted with it
+func (encryptor *PKCS11KeyEncryptor) Decrypt(sealed, context []byte) ([]byte, error) {
+	headerLength := len(pkcs11EnvelopeMagic) + 2
+	if len(sealed) < headerLength || !bytes.HasPrefix(sealed, pkcs11EnvelopeMagic) {
+		return nil, ErrInvalidPKCS11Envelope
+	}
+	sealedLength := int(binary.BigEndian.Uint16(sealed[len(pkcs11EnvelopeMagic):]))
+	if sealedLength < pkcs11IVLength+pkcs11TagLength || len(sealed) < headerLength+sealedLength {
+		return nil, ErrInvalidPKCS11Envelope
+	}
+	iv := sealed[headerLength : headerLength+pkcs11IVLength]
+	sealedDataKey := sealed[headerLength+pkcs11IVLength : headerLength+sealedLength]
+	encrypted := sealed[headerLength+sealedLength:]
+	var dataKey []byte
+	err := encryptor.provider.do(func(session *pkcs11Session) (err error) {
+		dataKey, err = encryptor.provider.module.decrypt(session.handle, session.key, iv, context, sealedDataKey)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer utils.ZeroizeBytes(dataKey)
+	cellEncryptor, err := keystore.NewSCellKeyEncryptor(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return cellEncryptor.Decrypt(encrypted, context)
+}
@@ -0,0 +1,277 @@
+//go:build pkcs11
+// +build pkcs11
+
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kms
+
+/*
+#cgo linux LDFLAGS: -ldl
+#include <dlfcn.h>
+#include <stdlib.h>
+#include <string.h>
+
+// Types of PKCS#11 2.40 API used by module, declared here to not depend on headers of specific vendor
+typedef unsigned long CK_ULONG;
+typedef CK_ULONG CK_RV;
+
+typedef struct { unsigned char major; unsigned char minor; } CK_VERSION;
+typedef struct { CK_ULONG type; void *pValue; CK_ULONG ulValueLen; } CK_ATTRIBUTE;
+typedef struct { CK_ULONG mechanism; void *pParameter; CK_ULONG ulParameterLen; } CK_MECHANISM;
+typedef struct {
+	unsigned char *pIv; CK_ULONG ulIvLen; CK_ULONG ulIvBits;
+	unsigned char *pAAD; CK_ULONG ulAADLen; CK_ULONG ulTagBits;
+} CK_GCM_PARAMS;
+typedef struct {
+	void *CreateMutex; void *DestroyMutex; void *LockMutex; void *UnlockMutex;
+	CK_ULONG flags; void *pReserved;
+} CK_C_INITIALIZE_ARGS;
+
+// CK_FUNCTION_LIST up to C_GenerateRandom, functions are in order of specification
+typedef struct {
+	CK_VERSION version;
+	void *functions[65];
+} CK_FUNCTION_LIST;
+
+enum {
+	fnInitialize = 0, fnFinalize = 1, fnGetSlotList = 4, fnGetTokenInfo = 6, fnOpenSession = 12, fnCloseSession = 13,
+	fnLogin = 18, fnFindObjectsInit = 26, fnFindObjects = 27, fnFindObjectsFinal = 28, fnEncryptInit = 29,
+	fnEncrypt = 30, fnDecryptInit = 33, fnDecrypt = 34, fnGenerateRandom = 64,
+};
+
+#define CKF_OS_LOCKING_OK 0x2
+#define CKF_SERIAL_SESSION 0x4
+#define CKU_USER 1
+#define CKO_SECRET_KEY 4
+#define CKA_CLASS 0x0
+#define CKA_LABEL 0x3
+#define CKM_AES_GCM 0x1087
+#define CKR_GENERAL_ERROR 0x5
+
+static CK_FUNCTION_LIST *acra_pkcs11_load(const char *path, void **handle) {
+	*handle = dlopen(path, RTLD_NOW | RTLD_LOCAL);
+	if (!*handle) {
+		return NULL;
+	}
+	CK_RV (*getFunctionList)(CK_FUNCTION_LIST **) = (CK_RV (*)(CK_FUNCTION_LIST **))dlsym(*handle, "C_GetFunctionList");
+	CK_FUNCTION_LIST *list = NULL;
+	if (!getFunctionList || getFunctionList(&list) != 0) {
+		dlclose(*handle);
+		*handle = NULL;
+		return NULL;
+	}
+	return list;
+}
+
+static CK_RV acra_pkcs11_initialize(CK_FUNCTION_LIST *list) {
+	CK_C_INITIALIZE_ARGS args;
+	memset(&args, 0, sizeof(args));
+	// Go calls module from different threads
+	args.flags = CKF_OS_LOCKING_OK;
+	return ((CK_RV (*)(void *))list->functions[fnInitialize])(&args);
+}
+
+static void acra_pkcs11_finalize(CK_FUNCTION_LIST *list, void *handle) {
+	((CK_RV (*)(void *))list->functions[fnFinalize])(NULL);
+	dlclose(handle);
+}
+
+static CK_RV acra_pkcs11_slots(CK_FUNCTION_LIST *list, CK_ULONG *slots, CK_ULONG *count) {
+	return ((CK_RV (*)(unsigned char, CK_ULONG *, CK_ULONG *))list->functions[fnGetSlotList])(1, slots, count);
+}
+
+static CK_RV acra_pkcs11_token_label(CK_FUNCTION_LIST *list, CK_ULONG slot, unsigned char *label) {
+	// CK_TOKEN_INFO starts with 32 bytes of label padded with spaces
+	unsigned char info[1024];
+	CK_RV rv = ((CK_RV (*)(CK_ULONG, void *))list->functions[fnGetTokenInfo])(slot, info);
+	if (rv == 0) {
+		memcpy(label, info, 32);
+	}
+	return rv;
+}
+
+static CK_RV acra_pkcs11_open_session(CK_FUNCTION_LIST *list, CK_ULONG slot, CK_ULONG *session) {
+	return ((CK_RV (*)(CK_ULONG, CK_ULONG, void *, void *, CK_ULONG *))list->functions[fnOpenSession])(slot, CKF_SERIAL_SESSION, NULL, NULL, session);
+}
+
+static CK_RV acra_pkcs11_close_session(CK_FUNCTION_LIST *list, CK_ULONG session) {
+	return ((CK_RV (*)(CK_ULONG))list->functions[fnCloseSession])(session);
+}
+
+static CK_RV acra_pkcs11_login(CK_FUNCTION_LIST *list, CK_ULONG session, unsigned char *pin, CK_ULONG pinLength) {
+	return ((CK_RV (*)(CK_ULONG, CK_ULONG, unsigned char *, CK_ULONG))list->functions[fnLogin])(session, CKU_USER, pin, pinLength);
+}
+
+static CK_RV acra_pkcs11_find_secret_key(CK_FUNCTION_LIST *list, CK_ULONG session, unsigned char *label, CK_ULONG labelLength, CK_ULONG *key, CK_ULONG *count) {
+	CK_ULONG class = CKO_SECRET_KEY;
+	CK_ATTRIBUTE template[2] = {
+		{CKA_CLASS, &class, sizeof(class)},
+		{CKA_LABEL, label, labelLength},
+	};
+	CK_RV rv = ((CK_RV (*)(CK_ULONG, CK_ATTRIBUTE *, CK_ULONG))list->functions[fnFindObjectsInit])(session, template, 2);
+	if (rv != 0) {
+		return rv;
+	}
+	rv = ((CK_RV (*)(CK_ULONG, CK_ULONG *, CK_ULONG, CK_ULONG *))list->functions[fnFindObjects])(session, key, 1, count);
+	CK_RV final = ((CK_RV (*)(CK_ULONG))list->functions[fnFindObjectsFinal])(session);
+	return rv != 0 ? rv : final;
+}
+
+static CK_RV acra_pkcs11_aes_gcm(CK_FUNCTION_LIST *list, int encrypt, CK_ULONG session, CK_ULONG key,
+		unsigned char *iv, CK_ULONG ivLength, unsigned char *aad, CK_ULONG aadLength,
+		unsigned char *data, CK_ULONG dataLength, unsigned char *out, CK_ULONG *outLength) {
+	CK_GCM_PARAMS params = {iv, ivLength, ivLength * 8, aad, aadLength, 128};
+	CK_MECHANISM mechanism = {CKM_AES_GCM, &params, sizeof(params)};
+	CK_RV rv = ((CK_RV (*)(CK_ULONG, CK_MECHANISM *, CK_ULONG))list->functions[encrypt ? fnEncryptInit : fnDecryptInit])(session, &mechanism, key);
+	if (rv != 0) {
+		return rv;
+	}
+	return ((CK_RV (*)(CK_ULONG, unsigned char *, CK_ULONG, unsigned char *, CK_ULONG *))list->functions[encrypt ? fnEncrypt : fnDecrypt])(session, data, dataLength, out, outLength);
+}
+
+static CK_RV acra_pkcs11_generate_random(CK_FUNCTION_LIST *list, CK_ULONG session, unsigned char *data, CK_ULONG dataLength) {
+	return ((CK_RV (*)(CK_ULONG, unsigned char *, CK_ULONG))list->functions[fnGenerateRandom])(session, data, dataLength);
+}
+*/
+import "C"
+
+import (
+	"bytes"
+	"fmt"
+	"unsafe"
+)
+
+// pkcs11MaxSlots limits number of slots with tokens looked through to find token by label
+const pkcs11MaxSlots = 64
+
+// cgoPKCS11Module calls PKCS#11 library loaded with dlopen
+type cgoPKCS11Module struct {
+	handle unsafe.Pointer
+	list   *C.CK_FUNCTION_LIST
+	slot   C.CK_ULONG
+}
+
+func pkcs11Result(rv C.CK_RV) error {
+	if rv == 0 {
+		return nil
+	}
+	return pkcs11Error(rv)
+}
+
+// bytesPointer returns pointer to data of slice or nil for empty slices
+func bytesPointer(data []byte) *C.uchar {
+	if len(data) == 0 {
+		return nil
+	}
+	return (*C.uchar)(unsafe.Pointer(&data[0]))
+}
+
+// loadPKCS11Module loads and initializes PKCS#11 library and finds slot of token with tokenLabel or first token
+func loadPKCS11Module(path, tokenLabel string) (pkcs11Module, error) {
+	cPath := C.CString(path)
+	defer C.free(unsafe.Pointer(cPath))
+	var handle unsafe.Pointer
+	list := C.acra_pkcs11_load(cPath, &handle)
+	if list == nil {
+		return nil, fmt.Errorf("can't load PKCS#11 module %s: %s", path, C.GoString(C.dlerror()))
+	}
+	if err := pkcs11Result(C.acra_pkcs11_initialize(list)); err != nil {
+		C.dlclose(handle)
+		return nil, err
+	}
+	module := &cgoPKCS11Module{handle: handle, list: list}
+	slots := make([]C.CK_ULONG, pkcs11MaxSlots)
+	count := C.CK_ULONG(len(slots))
+	if err := pkcs11Result(C.acra_pkcs11_slots(list, &slots[0], &count)); err != nil {
+		module.finalize()
+		return nil, err
+	}
+	for _, slot := range slots[:count] {
+		label := make([]byte, 32)
+		if err := pkcs11Result(C.acra_pkcs11_token_label(list, slot, bytesPointer(label))); err != nil {
+			continue
+		}
+		if tokenLabel == "" || string(bytes.TrimRight(label, " ")) == tokenLabel {
+			module.slot = slot
+			return module, nil
+		}
+	}
+	module.finalize()
+	return nil, ErrPKCS11TokenNotFound
+}
+
+func (module *cgoPKCS11Module) openSession() (uint, error) {
+	var session C.CK_ULONG
+	if err := pkcs11Result(C.acra_pkcs11_open_session(module.list, module.slot, &session)); err != nil {
+		return 0, err
+	}
+	return uint(session), nil
+}
+
+func (module *cgoPKCS11Module) closeSession(session uint) {
+	C.acra_pkcs11_close_session(module.list, C.CK_ULONG(session))
+}
+
+func (module *cgoPKCS11Module) login(session uint, pin string) error {
+	pinBytes := []byte(pin)
+	return pkcs11Result(C.acra_pkcs11_login(module.list, C.CK_ULONG(session), bytesPointer(pinBytes), C.CK_ULONG(len(pinBytes))))
+}
+
+func (module *cgoPKCS11Module) findSecretKey(session uint, label string) (uint, error) {
+	labelBytes := []byte(label)
+	var key, count C.CK_ULONG
+	err := pkcs11Result(C.acra_pkcs11_find_secret_key(module.list, C.CK_ULONG(session), bytesPointer(labelBytes), C.CK_ULONG(len(labelBytes)), &key, &count))
+	if err != nil {
+		return 0, err
+	}
+	if count == 0 {
+		return 0, ErrPKCS11KeyNotFound
+	}
+	return uint(key), nil
+}
+
+func (module *cgoPKCS11Module) aesGCM(encrypt bool, session, key uint, iv, aad, data []byte) ([]byte, error) {
+	out := make([]byte, len(data)+pkcs11TagLength)
+	outLength := C.CK_ULONG(len(out))
+	var mode C.int
+	if encrypt {
+		mode = 1
+	}
+	err := pkcs11Result(C.acra_pkcs11_aes_gcm(module.list, mode, C.CK_ULONG(session), C.CK_ULONG(key),
+		bytesPointer(iv), C.CK_ULONG(len(iv)), bytesPointer(aad), C.CK_ULONG(len(aad)),
+		bytesPointer(data), C.CK_ULONG(len(data)), bytesPointer(out), &outLength))
+	if err != nil {
+		return nil, err
+	}
+	return out[:outLength], nil
+}
+
+func (module *cgoPKCS11Module) encrypt(session, key uint, iv, aad, data []byte) ([]byte, error) {
+	return module.aesGCM(true, session, key, iv, aad, data)
+}
+
+func (module *cgoPKCS11Module) decrypt(session, key uint, iv, aad, data []byte) ([]byte, error) {
+	return module.aesGCM(false, session, key, iv, aad, data)
+}
+
+func (module *cgoPKCS11Module) generateRandom(session uint, data []byte) error {
+	return pkcs11Result(C.acra_pkcs11_generate_random(module.list, C.CK_ULONG(session), bytesPointer(data), C.CK_ULONG(len(data))))
+}
+
+func (module *cgoPKCS11Module) finalize() {
+	C.acra_pkcs11_finalize(module.list, module.handle)
+}
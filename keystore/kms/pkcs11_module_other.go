@@ -0,0 +1,25 @@
+//go:build !pkcs11
+// +build !pkcs11
+
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kms
+
+// loadPKCS11Module isn't supported without cgo binding which is compiled with "pkcs11" build tag
+func loadPKCS11Module(path, tokenLabel string) (pkcs11Module, error) {
+	return nil, ErrPKCS11NotSupported
+}
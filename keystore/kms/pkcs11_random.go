@@ -0,0 +1,119 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kms
+
+import (
+	"errors"
+	"sync"
+)
+
+// pkcs11RandomChunkSize limits length of C_GenerateRandom call, some tokens reject large requests
+const pkcs11RandomChunkSize = 1024
+
+var errPKCS11RandomSourceIsClosed = errors.New("PKCS#11 random source is closed")
+
+// PKCS11RandomSource is source of random bytes generated by RNG of PKCS#11 token with C_GenerateRandom. Token isn't
+// logged in because C_GenerateRandom is allowed in public session. Reads are serialized and use one session which is
+// reopened once if token invalidated it.
+type PKCS11RandomSource struct {
+	lock    sync.Mutex
+	module  pkcs11Module
+	session uint
+	opened  bool
+	closed  bool
+}
+
+// NewPKCS11RandomSource loads PKCS#11 module and opens session on token with tokenLabel or first token
+func NewPKCS11RandomSource(modulePath, tokenLabel string) (*PKCS11RandomSource, error) {
+	if modulePath == "" {
+		return nil, ErrPKCS11ModuleNotSet
+	}
+	module, err := loadPKCS11Module(modulePath, tokenLabel)
+	if err != nil {
+		return nil, err
+	}
+	source, err := newPKCS11RandomSource(module)
+	if err != nil {
+		module.finalize()
+		return nil, err
+	}
+	return source, nil
+}
+
+func newPKCS11RandomSource(module pkcs11Module) (*PKCS11RandomSource, error) {
+	source := &PKCS11RandomSource{module: module}
+	// fail on start if token doesn't generate random bytes instead of first key generation
+	if err := source.generate(make([]byte, 1)); err != nil {
+		return nil, err
+	}
+	return source, nil
+}
+
+// generate fills data with C_GenerateRandom, opening session if needed, should be called under lock
+func (source *PKCS11RandomSource) generate(data []byte) error {
+	for attempt := 0; ; attempt++ {
+		if !source.opened {
+			session, err := source.module.openSession()
+			if err != nil {
+				return err
+			}
+			source.session, source.opened = session, true
+		}
+		err := source.module.generateRandom(source.session, data)
+		if isPKCS11SessionError(err) {
+			source.module.closeSession(source.session)
+			source.opened = false
+			if attempt == 0 {
+				continue
+			}
+		}
+		return err
+	}
+}
+
+// Read fills data with random bytes of token, returns error without partial result if token fails
+func (source *PKCS11RandomSource) Read(data []byte) (int, error) {
+	source.lock.Lock()
+	defer source.lock.Unlock()
+	if source.closed {
+		return 0, errPKCS11RandomSourceIsClosed
+	}
+	for offset := 0; offset < len(data); offset += pkcs11RandomChunkSize {
+		end := offset + pkcs11RandomChunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		if err := source.generate(data[offset:end]); err != nil {
+			return 0, err
+		}
+	}
+	return len(data), nil
+}
+
+// Close closes session and finalizes PKCS#11 module
+func (source *PKCS11RandomSource) Close() {
+	source.lock.Lock()
+	defer source.lock.Unlock()
+	if source.closed {
+		return
+	}
+	source.closed = true
+	if source.opened {
+		source.module.closeSession(source.session)
+	}
+	source.module.finalize()
+}
@@ -0,0 +1,112 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kms
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Environment variables with Vault address and token, the same as used by Vault CLI
+const (
+	vaultAddressEnv = "VAULT_ADDR"
+	vaultTokenEnv   = "VAULT_TOKEN"
+)
+
+// defaultVaultTransitMount is default mount path of Vault Transit secrets engine
+const defaultVaultTransitMount = "transit"
+
+// VaultKeyWrapper wraps keys with Vault Transit secrets engine
+type VaultKeyWrapper struct {
+	mount   string
+	keyName string
+	client  *vaultClient
+}
+
+// NewVaultKeyWrapperFromEnvironment returns wrapper which uses Transit key with keyID in form "name" or
+// "mount/name". Token is read from VAULT_TOKEN environment variable, empty address means VAULT_ADDR.
+func NewVaultKeyWrapperFromEnvironment(keyID, address string) (*VaultKeyWrapper, error) {
+	address, token, err := vaultEnvironment(address)
+	if err != nil {
+		return nil, err
+	}
+	return newVaultKeyWrapper(keyID, address, token), nil
+}
+
+// vaultEnvironment returns address (VAULT_ADDR if empty) and token read from environment variables of Vault CLI
+func vaultEnvironment(address string) (string, string, error) {
+	if address == "" {
+		address = os.Getenv(vaultAddressEnv)
+	}
+	if address == "" {
+		return "", "", fmt.Errorf("%w: set %s", ErrMissingCredentials, vaultAddressEnv)
+	}
+	token := os.Getenv(vaultTokenEnv)
+	if token == "" {
+		return "", "", fmt.Errorf("%w: set %s", ErrMissingCredentials, vaultTokenEnv)
+	}
+	return address, token, nil
+}
+
+func newVaultKeyWrapper(keyID, address, token string) *VaultKeyWrapper {
+	return newVaultKeyWrapperWithClient(keyID, newVaultClient(address, token))
+}
+
+func newVaultKeyWrapperWithClient(keyID string, client *vaultClient) *VaultKeyWrapper {
+	mount, keyName := defaultVaultTransitMount, keyID
+	if i := strings.LastIndex(keyID, "/"); i >= 0 {
+		mount, keyName = keyID[:i], keyID[i+1:]
+	}
+	return &VaultKeyWrapper{
+		mount:   strings.Trim(mount, "/"),
+		keyName: keyName,
+		client:  client,
+	}
+}
+
+// call invokes operation (encrypt or decrypt) of Transit key
+func (wrapper *VaultKeyWrapper) call(operation string, body, result interface{}) error {
+	return wrapper.client.call(http.MethodPost, fmt.Sprintf("%s/%s/%s", wrapper.mount, operation, wrapper.keyName), body, result)
+}
+
+// WrapKey encrypts key with Transit key. Vault ciphertext ("vault:v1:...") is returned as is.
+func (wrapper *VaultKeyWrapper) WrapKey(key []byte) ([]byte, error) {
+	var response struct {
+		Data struct {
+			Ciphertext string `json:"ciphertext"`
+		} `json:"data"`
+	}
+	if err := wrapper.call("encrypt", map[string]interface{}{"plaintext": key}, &response); err != nil {
+		return nil, err
+	}
+	return []byte(response.Data.Ciphertext), nil
+}
+
+// UnwrapKey decrypts key wrapped by WrapKey
+func (wrapper *VaultKeyWrapper) UnwrapKey(wrappedKey []byte) ([]byte, error) {
+	var response struct {
+		Data struct {
+			Plaintext []byte `json:"plaintext"`
+		} `json:"data"`
+	}
+	if err := wrapper.call("decrypt", map[string]interface{}{"ciphertext": string(wrappedKey)}, &response); err != nil {
+		return nil, err
+	}
+	return response.Data.Plaintext, nil
+}
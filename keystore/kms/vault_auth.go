@@ -0,0 +1,233 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kms
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Vault auth methods which tokens of Vault clients are taken with
+const (
+	VaultAuthToken      = "token"
+	VaultAuthAppRole    = "approle"
+	VaultAuthKubernetes = "kubernetes"
+)
+
+// vaultSecretIDEnv is environment variable with secret ID of AppRole, so it isn't passed via command line
+const vaultSecretIDEnv = "VAULT_SECRET_ID"
+
+// DefaultVaultKubernetesTokenPath is path of service account token mounted into pods of Kubernetes
+const DefaultVaultKubernetesTokenPath = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+// ErrUnsupportedVaultAuth returned for unknown Vault auth method
+var ErrUnsupportedVaultAuth = errors.New("unsupported Vault auth method")
+
+// errVaultNotFound returned by vaultClient on 404 response
+var errVaultNotFound = errors.New("Vault path not found")
+
+// VaultAuthConfig describes how client logs in to Vault
+type VaultAuthConfig struct {
+	// Method is one of VaultAuthToken (token from VAULT_TOKEN), VaultAuthAppRole or VaultAuthKubernetes
+	Method string
+	// Mount is path of auth method, default is name of method
+	Mount string
+	// RoleID of AppRole, secret ID is read from VAULT_SECRET_ID
+	RoleID string
+	// Role of Kubernetes auth method
+	Role string
+	// KubernetesTokenPath is file with service account JWT, default is DefaultVaultKubernetesTokenPath
+	KubernetesTokenPath string
+}
+
+// vaultClient sends requests to Vault API. Tokens taken by login methods expire, so on rejected request token is
+// taken again and request is repeated once.
+type vaultClient struct {
+	address string
+	client  *http.Client
+	// login returns new token, nil for static tokens
+	login func(client *vaultClient) (string, error)
+	lock  sync.RWMutex
+	token string
+}
+
+func newVaultClient(address, token string) *vaultClient {
+	return &vaultClient{
+		address: strings.TrimSuffix(address, "/"),
+		token:   token,
+		client:  &http.Client{Timeout: defaultHTTPTimeout},
+	}
+}
+
+// newVaultClientWithAuth returns client logged in with auth method of config. Empty address means VAULT_ADDR.
+func newVaultClientWithAuth(address string, config VaultAuthConfig) (*vaultClient, error) {
+	if config.Method == "" || config.Method == VaultAuthToken {
+		address, token, err := vaultEnvironment(address)
+		if err != nil {
+			return nil, err
+		}
+		return newVaultClient(address, token), nil
+	}
+	if address == "" {
+		address = os.Getenv(vaultAddressEnv)
+	}
+	if address == "" {
+		return nil, fmt.Errorf("%w: set %s", ErrMissingCredentials, vaultAddressEnv)
+	}
+	mount := config.Mount
+	if mount == "" {
+		mount = config.Method
+	}
+	var credentials func() (map[string]string, error)
+	switch config.Method {
+	case VaultAuthAppRole:
+		secretID := os.Getenv(vaultSecretIDEnv)
+		if config.RoleID == "" || secretID == "" {
+			return nil, fmt.Errorf("%w: set role ID and %s", ErrMissingCredentials, vaultSecretIDEnv)
+		}
+		credentials = func() (map[string]string, error) {
+			return map[string]string{"role_id": config.RoleID, "secret_id": secretID}, nil
+		}
+	case VaultAuthKubernetes:
+		if config.Role == "" {
+			return nil, fmt.Errorf("%w: set Kubernetes role", ErrMissingCredentials)
+		}
+		tokenPath := config.KubernetesTokenPath
+		if tokenPath == "" {
+			tokenPath = DefaultVaultKubernetesTokenPath
+		}
+		credentials = func() (map[string]string, error) {
+			// service account tokens are rotated by kubelet, so file is read on every login
+			jwt, err := ioutil.ReadFile(tokenPath)
+			if err != nil {
+				return nil, err
+			}
+			return map[string]string{"role": config.Role, "jwt": strings.TrimSpace(string(jwt))}, nil
+		}
+	default:
+		return nil, ErrUnsupportedVaultAuth
+	}
+	client := newVaultClient(address, "")
+	client.login = func(client *vaultClient) (string, error) {
+		body, err := credentials()
+		if err != nil {
+			return "", err
+		}
+		var response struct {
+			Auth struct {
+				ClientToken string `json:"client_token"`
+			} `json:"auth"`
+		}
+		if err := client.send(http.MethodPost, "auth/"+strings.Trim(mount, "/")+"/login", "", body, &response); err != nil {
+			return "", err
+		}
+		if response.Auth.ClientToken == "" {
+			return "", errors.New("Vault login response doesn't contain token")
+		}
+		return response.Auth.ClientToken, nil
+	}
+	if err := client.relogin(); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// relogin replaces token with new one taken by login
+func (client *vaultClient) relogin() error {
+	token, err := client.login(client)
+	if err != nil {
+		return err
+	}
+	client.lock.Lock()
+	client.token = token
+	client.lock.Unlock()
+	return nil
+}
+
+// call sends request to path of Vault API with JSON body and decodes JSON response into result if it's not nil
+func (client *vaultClient) call(method, path string, body, result interface{}) error {
+	client.lock.RLock()
+	token := client.token
+	client.lock.RUnlock()
+	err := client.send(method, path, token, body, result)
+	var statusErr vaultStatusError
+	if client.login != nil && errors.As(err, &statusErr) && statusErr == http.StatusForbidden {
+		if err := client.relogin(); err != nil {
+			return err
+		}
+		client.lock.RLock()
+		token = client.token
+		client.lock.RUnlock()
+		return client.send(method, path, token, body, result)
+	}
+	return err
+}
+
+// vaultStatusError is unexpected status of Vault response
+type vaultStatusError int
+
+func (err vaultStatusError) Error() string {
+	return fmt.Sprintf("unexpected Vault response status %d", int(err))
+}
+
+func (client *vaultClient) send(method, path, token string, body, result interface{}) error {
+	var payload io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		payload = bytes.NewReader(data)
+	}
+	request, err := http.NewRequest(method, fmt.Sprintf("%s/v1/%s", client.address, path), payload)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		request.Header.Set("X-Vault-Token", token)
+	}
+	response, err := client.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	switch response.StatusCode {
+	case http.StatusOK:
+	case http.StatusNoContent:
+		return nil
+	case http.StatusNotFound:
+		return errVaultNotFound
+	default:
+		responseBody, _ := ioutil.ReadAll(io.LimitReader(response.Body, 1024))
+		return fmt.Errorf("%w: %s", vaultStatusError(response.StatusCode), bytes.TrimSpace(responseBody))
+	}
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(response.Body).Decode(result)
+}
@@ -0,0 +1,441 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kms
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cossacklabs/acra/keystore"
+	"github.com/cossacklabs/acra/keystore/filesystem"
+	"github.com/cossacklabs/acra/random"
+)
+
+// Default location of keys in Vault KV v2 secrets engine
+const (
+	DefaultVaultKVMount = "secret"
+	DefaultVaultKVPath  = "acra"
+)
+
+// vaultDirMode is mode of directories of VaultStorage, directories exist only as prefixes of secrets
+const vaultDirMode = os.ModeDir | 0700
+
+// ErrPathOutsideKeyDirectory returned for paths which can't be mapped to Vault secrets of key directory
+var ErrPathOutsideKeyDirectory = errors.New("path is outside of key directory")
+
+// VaultKeyStoreConfig describes where keys are stored in Vault
+type VaultKeyStoreConfig struct {
+	// Address of Vault, empty means VAULT_ADDR
+	Address string
+	// KVMount is mount path of KV v2 secrets engine, default is DefaultVaultKVMount
+	KVMount string
+	// Path is prefix of secrets with key files, default is DefaultVaultKVPath
+	Path string
+	// TransitKeyID is Transit key in form "name" or "mount/name" which wraps key files before they're stored in KV,
+	// empty means that key files are stored as is
+	TransitKeyID string
+	Auth         VaultAuthConfig
+}
+
+// vaultFileData is data of KV secret with key file
+type vaultFileData struct {
+	// Content is base64 encoded data of key file or Transit ciphertext if Wrapped is true
+	Content string      `json:"content"`
+	Mode    os.FileMode `json:"mode"`
+	Wrapped bool        `json:"wrapped,omitempty"`
+}
+
+// vaultFileInfo implements os.FileInfo for files and directories of VaultStorage
+type vaultFileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (info *vaultFileInfo) Name() string       { return info.name }
+func (info *vaultFileInfo) Size() int64        { return info.size }
+func (info *vaultFileInfo) Mode() os.FileMode  { return info.mode }
+func (info *vaultFileInfo) ModTime() time.Time { return info.modTime }
+func (info *vaultFileInfo) IsDir() bool        { return info.mode.IsDir() }
+func (info *vaultFileInfo) Sys() interface{}   { return nil }
+
+// VaultStorage keeps key files of key directory as secrets of Vault KV v2 secrets engine, path of file relative to
+// key directory is path of secret under configured prefix. Key files keep the same format as in filesystem, so
+// private keys remain encrypted with master key, and may be additionally wrapped with Vault Transit key.
+// Directories exist only as prefixes of secrets, so empty directories aren't kept. Renames aren't atomic: secret is
+// written to new path before it's removed from old one. ReadDir doesn't return sizes and modification times of
+// files, Stat does.
+type VaultStorage struct {
+	client  *vaultClient
+	mount   string
+	prefix  string
+	root    string
+	wrapper *VaultKeyWrapper
+}
+
+// NewVaultStorage returns VaultStorage of keyDirectory which logs in to Vault with auth method of config
+func NewVaultStorage(config VaultKeyStoreConfig, keyDirectory string) (*VaultStorage, error) {
+	client, err := newVaultClientWithAuth(config.Address, config.Auth)
+	if err != nil {
+		return nil, err
+	}
+	return newVaultStorage(client, config, keyDirectory), nil
+}
+
+func newVaultStorage(client *vaultClient, config VaultKeyStoreConfig, keyDirectory string) *VaultStorage {
+	mount, prefix := config.KVMount, config.Path
+	if mount == "" {
+		mount = DefaultVaultKVMount
+	}
+	if prefix == "" {
+		prefix = DefaultVaultKVPath
+	}
+	storage := &VaultStorage{
+		client: client,
+		mount:  strings.Trim(mount, "/"),
+		prefix: strings.Trim(prefix, "/"),
+		root:   filepath.Clean(keyDirectory),
+	}
+	if config.TransitKeyID != "" {
+		storage.wrapper = newVaultKeyWrapperWithClient(config.TransitKeyID, client)
+	}
+	return storage
+}
+
+// secretPath returns path of secret relative to mount of KV engine
+func (storage *VaultStorage) secretPath(op, path string) (string, error) {
+	relative, err := filepath.Rel(storage.root, filepath.Clean(path))
+	if err != nil || relative == ".." || strings.HasPrefix(relative, ".."+string(filepath.Separator)) {
+		return "", pathError(op, path, ErrPathOutsideKeyDirectory)
+	}
+	if relative == "." {
+		return storage.prefix, nil
+	}
+	return storage.prefix + "/" + filepath.ToSlash(relative), nil
+}
+
+func pathError(op, path string, err error) error {
+	if err == errVaultNotFound {
+		err = os.ErrNotExist
+	}
+	return &os.PathError{Op: op, Path: path, Err: err}
+}
+
+// readSecret returns stored data of key file and time when it was written
+func (storage *VaultStorage) readSecret(op, path string) (*vaultFileData, time.Time, error) {
+	secretPath, err := storage.secretPath(op, path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	var response struct {
+		Data struct {
+			Data     *vaultFileData `json:"data"`
+			Metadata struct {
+				CreatedTime time.Time `json:"created_time"`
+			} `json:"metadata"`
+		} `json:"data"`
+	}
+	if err := storage.client.call(http.MethodGet, storage.mount+"/data/"+secretPath, nil, &response); err != nil {
+		return nil, time.Time{}, pathError(op, path, err)
+	}
+	// secrets with deleted or destroyed latest version have null data
+	if response.Data.Data == nil {
+		return nil, time.Time{}, pathError(op, path, os.ErrNotExist)
+	}
+	return response.Data.Data, response.Data.Metadata.CreatedTime, nil
+}
+
+func (storage *VaultStorage) writeSecret(op, path string, data *vaultFileData) error {
+	secretPath, err := storage.secretPath(op, path)
+	if err != nil {
+		return err
+	}
+	body := map[string]interface{}{"data": data}
+	if err := storage.client.call(http.MethodPost, storage.mount+"/data/"+secretPath, body, nil); err != nil {
+		return pathError(op, path, err)
+	}
+	return nil
+}
+
+// deleteSecret removes all versions of secret, so removed keys can't be restored from Vault
+func (storage *VaultStorage) deleteSecret(op, path string) error {
+	secretPath, err := storage.secretPath(op, path)
+	if err != nil {
+		return err
+	}
+	if err := storage.client.call(http.MethodDelete, storage.mount+"/metadata/"+secretPath, nil, nil); err != nil {
+		return pathError(op, path, err)
+	}
+	return nil
+}
+
+// list returns names of secrets and directories at path, names of directories end with "/"
+func (storage *VaultStorage) list(op, path string) ([]string, error) {
+	secretPath, err := storage.secretPath(op, path)
+	if err != nil {
+		return nil, err
+	}
+	var response struct {
+		Data struct {
+			Keys []string `json:"keys"`
+		} `json:"data"`
+	}
+	if err := storage.client.call("LIST", storage.mount+"/metadata/"+secretPath, nil, &response); err != nil {
+		return nil, pathError(op, path, err)
+	}
+	return response.Data.Keys, nil
+}
+
+// Stat a file at given path.
+func (storage *VaultStorage) Stat(path string) (os.FileInfo, error) {
+	data, modTime, err := storage.readSecret("stat", path)
+	if err == nil {
+		return &vaultFileInfo{name: filepath.Base(path), size: int64(base64.StdEncoding.DecodedLen(len(data.Content))), mode: data.Mode.Perm(), modTime: modTime}, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	names, err := storage.list("stat", path)
+	if err != nil {
+		return nil, err
+	}
+	if len(names) == 0 {
+		return nil, pathError("stat", path, os.ErrNotExist)
+	}
+	return &vaultFileInfo{name: filepath.Base(path), mode: vaultDirMode}, nil
+}
+
+// Exists checks whether a file exists at a given path.
+func (storage *VaultStorage) Exists(path string) (bool, error) {
+	_, err := storage.Stat(path)
+	if err == nil {
+		return true, nil
+	}
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return false, err
+}
+
+// ReadDir returns names and types of files and directories at path sorted by name.
+func (storage *VaultStorage) ReadDir(path string) ([]os.FileInfo, error) {
+	names, err := storage.list("readdir", path)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	infos := make([]os.FileInfo, 0, len(names))
+	for _, name := range names {
+		if strings.HasSuffix(name, "/") {
+			infos = append(infos, &vaultFileInfo{name: strings.TrimSuffix(name, "/"), mode: vaultDirMode})
+			continue
+		}
+		infos = append(infos, &vaultFileInfo{name: name, mode: filesystem.PrivateFileMode})
+	}
+	return infos, nil
+}
+
+// MkdirAll does nothing because directories exist only as prefixes of secrets.
+func (storage *VaultStorage) MkdirAll(path string, perm os.FileMode) error {
+	_, err := storage.secretPath("mkdir", path)
+	return err
+}
+
+// Rename a file from oldpath to newpath, replacing a file at newpath if it exists.
+func (storage *VaultStorage) Rename(oldpath, newpath string) error {
+	data, _, err := storage.readSecret("rename", oldpath)
+	if err != nil {
+		return err
+	}
+	if err := storage.writeSecret("rename", newpath, data); err != nil {
+		return err
+	}
+	return storage.deleteSecret("rename", oldpath)
+}
+
+func randomSuffix() (string, error) {
+	suffix := make([]byte, 8)
+	if _, err := random.Read(suffix); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(suffix), nil
+}
+
+// TempFile creates a new empty file with given name pattern and access permissions.
+func (storage *VaultStorage) TempFile(pattern string, perm os.FileMode) (string, error) {
+	for {
+		suffix, err := randomSuffix()
+		if err != nil {
+			return "", err
+		}
+		path := pattern + suffix
+		exists, err := storage.Exists(path)
+		if err != nil {
+			return "", err
+		}
+		if exists {
+			continue
+		}
+		if err := storage.writeSecret("createtemp", path, &vaultFileData{Mode: perm.Perm()}); err != nil {
+			return "", err
+		}
+		return path, nil
+	}
+}
+
+// TempDir returns unique name of directory made of name pattern, directory exists after files are written into it.
+func (storage *VaultStorage) TempDir(pattern string, perm os.FileMode) (string, error) {
+	for {
+		suffix, err := randomSuffix()
+		if err != nil {
+			return "", err
+		}
+		path := pattern + suffix
+		exists, err := storage.Exists(path)
+		if err != nil {
+			return "", err
+		}
+		if !exists {
+			return path, nil
+		}
+	}
+}
+
+// Link copies file because Vault doesn't support links. It is an error if newpath already exists.
+func (storage *VaultStorage) Link(oldpath, newpath string) error {
+	return storage.Copy(oldpath, newpath)
+}
+
+// Copy a file from src to dst, preserving access mode. It is an error if dst already exists.
+func (storage *VaultStorage) Copy(src, dst string) error {
+	data, _, err := storage.readSecret("copy", src)
+	if err != nil {
+		return err
+	}
+	exists, err := storage.Exists(dst)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return pathError("copy", dst, os.ErrExist)
+	}
+	return storage.writeSecret("copy", dst, data)
+}
+
+// ReadFile reads entire content of the specified file unwrapping it with Transit key if it was wrapped.
+func (storage *VaultStorage) ReadFile(path string) ([]byte, error) {
+	data, _, err := storage.readSecret("open", path)
+	if err != nil {
+		return nil, err
+	}
+	if data.Wrapped {
+		if storage.wrapper == nil {
+			return nil, pathError("open", path, errors.New("file is wrapped with Vault Transit key which isn't configured"))
+		}
+		return storage.wrapper.UnwrapKey([]byte(data.Content))
+	}
+	return base64.StdEncoding.DecodeString(data.Content)
+}
+
+// WriteFile replaces entire content of the specified file, wrapping it with Transit key if it's configured.
+func (storage *VaultStorage) WriteFile(path string, data []byte, perm os.FileMode) error {
+	fileData := &vaultFileData{Mode: perm.Perm()}
+	if storage.wrapper != nil {
+		wrapped, err := storage.wrapper.WrapKey(data)
+		if err != nil {
+			return err
+		}
+		fileData.Content, fileData.Wrapped = string(wrapped), true
+	} else {
+		fileData.Content = base64.StdEncoding.EncodeToString(data)
+	}
+	return storage.writeSecret("open", path, fileData)
+}
+
+// Remove the file or empty directory at given path.
+func (storage *VaultStorage) Remove(path string) error {
+	_, _, err := storage.readSecret("remove", path)
+	if err == nil {
+		return storage.deleteSecret("remove", path)
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+	names, err := storage.list("remove", path)
+	if err != nil {
+		return err
+	}
+	if len(names) != 0 {
+		return pathError("remove", path, os.ErrExist)
+	}
+	return pathError("remove", path, os.ErrNotExist)
+}
+
+// RemoveAll removes the path with any children that it contains.
+func (storage *VaultStorage) RemoveAll(path string) error {
+	names, err := storage.list("removeall", path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, name := range names {
+		if err := storage.RemoveAll(filepath.Join(path, name)); err != nil {
+			return err
+		}
+	}
+	err = storage.deleteSecret("removeall", path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// VaultKeyStore is keystore with key files kept in Vault KV v2 secrets engine
+type VaultKeyStore struct {
+	*filesystem.KeyStore
+	storage *VaultStorage
+}
+
+// NewVaultKeyStore returns keystore of keyDirectory stored in Vault with private keys encrypted by encryptor
+func NewVaultKeyStore(config VaultKeyStoreConfig, keyDirectory string, encryptor keystore.KeyEncryptor, cacheSize int) (*VaultKeyStore, error) {
+	storage, err := NewVaultStorage(config, keyDirectory)
+	if err != nil {
+		return nil, err
+	}
+	keyStore, err := filesystem.NewCustomFilesystemKeyStore().
+		KeyDirectory(keyDirectory).
+		Encryptor(encryptor).
+		Storage(storage).
+		CacheSize(cacheSize).
+		Build()
+	if err != nil {
+		return nil, err
+	}
+	return &VaultKeyStore{KeyStore: keyStore, storage: storage}, nil
+}
+
+// Storage returns storage of key files of keystore
+func (store *VaultKeyStore) Storage() *VaultStorage {
+	return store.storage
+}
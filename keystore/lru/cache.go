@@ -15,7 +15,8 @@ limitations under the License.
 */
 
 // Package lru implements simple LRU cache used by Keystore. LRU cache stores in memory some amount of
-// encrypted keys and removes less used keys upon adding new ones.
+// encrypted keys and removes less used keys upon adding new ones. ServerKeyStore and TranslationKeyStore wrap
+// keystores and cache decrypted private keys with limited lifetime.
 package lru
 
 import (
@@ -0,0 +1,339 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lru
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/cossacklabs/acra/keystore"
+	"github.com/cossacklabs/acra/utils"
+	"github.com/cossacklabs/themis/gothemis/keys"
+	"github.com/golang/groupcache/lru"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ErrInvalidPrivateKeyCacheSize returned for negative size of cache of decrypted private keys
+var ErrInvalidPrivateKeyCacheSize = errors.New("size of cache of decrypted private keys should be non-negative")
+
+// Labels and values of requests of cached private keys
+const (
+	KeyCacheResultLabel = "result"
+	KeyCacheResultHit   = "hit"
+	KeyCacheResultMiss  = "miss"
+)
+
+// KeyCacheRequestsCounter collects count of requests of decrypted private keys served from cache or keystore
+var KeyCacheRequestsCounter = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "acra_keystore_cache_requests_total",
+		Help: "number of requests of decrypted private keys, by result of cache lookup",
+	}, []string{KeyCacheResultLabel})
+
+var keyCacheRegisterLock = sync.Once{}
+
+// RegisterKeyStoreCacheMetrics register in default prometheus registry metrics related with cache of private keys
+func RegisterKeyStoreCacheMetrics() {
+	keyCacheRegisterLock.Do(func() {
+		prometheus.MustRegister(KeyCacheRequestsCounter)
+	})
+}
+
+// Prefixes of ids of cached private keys by their purpose
+const (
+	zonePrivateKeyPrefix      = "zone:"
+	zonePrivateKeysPrefix     = "zones:"
+	clientPrivateKeyPrefix    = "client:"
+	clientPrivateKeysPrefix   = "clients:"
+	transportPrivateKeyPrefix = "transport:"
+	poisonPrivateKeysID       = "poison"
+)
+
+// cachedPrivateKeys is decrypted private keys with time after which they are removed from cache
+type cachedPrivateKeys struct {
+	keys    []*keys.PrivateKey
+	expires time.Time
+}
+
+// copyPrivateKeys returns copies of privateKeys, because callers zeroize keys after use
+func copyPrivateKeys(privateKeys []*keys.PrivateKey) []*keys.PrivateKey {
+	result := make([]*keys.PrivateKey, 0, len(privateKeys))
+	for _, privateKey := range privateKeys {
+		result = append(result, &keys.PrivateKey{Value: append([]byte{}, privateKey.Value...)})
+	}
+	return result
+}
+
+// privateKeyCache keeps copies of decrypted private keys, limited by count of ids and time since loading
+type privateKeyCache struct {
+	ttl   time.Duration
+	now   func() time.Time
+	mutex sync.Mutex
+	lru   *lru.Cache
+}
+
+func newPrivateKeyCache(size int, ttl time.Duration) (*privateKeyCache, error) {
+	if size < 0 {
+		return nil, ErrInvalidPrivateKeyCacheSize
+	}
+	cache := &privateKeyCache{ttl: ttl, now: time.Now, lru: lru.New(size)}
+	cache.lru.OnEvicted = func(key lru.Key, value interface{}) {
+		utils.ZeroizePrivateKeys(value.(cachedPrivateKeys).keys)
+	}
+	return cache, nil
+}
+
+// get returns copies of cached keys of id or keys returned by load which are cached if loaded successfully
+func (cache *privateKeyCache) get(id string, load func() ([]*keys.PrivateKey, error)) ([]*keys.PrivateKey, error) {
+	now := cache.now()
+	cache.mutex.Lock()
+	if value, ok := cache.lru.Get(id); ok {
+		cached := value.(cachedPrivateKeys)
+		if cache.ttl <= 0 || now.Before(cached.expires) {
+			result := copyPrivateKeys(cached.keys)
+			cache.mutex.Unlock()
+			KeyCacheRequestsCounter.WithLabelValues(KeyCacheResultHit).Inc()
+			return result, nil
+		}
+		cache.lru.Remove(id)
+	}
+	cache.mutex.Unlock()
+	KeyCacheRequestsCounter.WithLabelValues(KeyCacheResultMiss).Inc()
+	privateKeys, err := load()
+	if err != nil {
+		return nil, err
+	}
+	cache.mutex.Lock()
+	cache.lru.Add(id, cachedPrivateKeys{keys: copyPrivateKeys(privateKeys), expires: now.Add(cache.ttl)})
+	cache.mutex.Unlock()
+	return privateKeys, nil
+}
+
+// getOne works like get for single key
+func (cache *privateKeyCache) getOne(id string, load func() (*keys.PrivateKey, error)) (*keys.PrivateKey, error) {
+	privateKeys, err := cache.get(id, func() ([]*keys.PrivateKey, error) {
+		privateKey, err := load()
+		if err != nil {
+			return nil, err
+		}
+		return []*keys.PrivateKey{privateKey}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return privateKeys[0], nil
+}
+
+// remove removes keys of ids from cache with zeroing
+func (cache *privateKeyCache) remove(ids ...string) {
+	cache.mutex.Lock()
+	for _, id := range ids {
+		cache.lru.Remove(id)
+	}
+	cache.mutex.Unlock()
+}
+
+// removeZone removes current and rotated keys of zoneID
+func (cache *privateKeyCache) removeZone(zoneID []byte) {
+	cache.remove(zonePrivateKeyPrefix+string(zoneID), zonePrivateKeysPrefix+string(zoneID))
+}
+
+// removeClient removes current and rotated storage keys of clientID
+func (cache *privateKeyCache) removeClient(clientID []byte) {
+	cache.remove(clientPrivateKeyPrefix+string(clientID), clientPrivateKeysPrefix+string(clientID))
+}
+
+// checkZoneRevoked checks revocation of zone if keyStore revokes zones, so cached keys of revoked zone aren't served.
+// Keys of zone are removed from cache if it's revoked.
+func (cache *privateKeyCache) checkZoneRevoked(keyStore interface{}, zoneID []byte) error {
+	checker, ok := keyStore.(keystore.ZoneRevocationChecker)
+	if !ok {
+		return nil
+	}
+	if err := checker.CheckZoneRevoked(zoneID); err != nil {
+		cache.removeZone(zoneID)
+		return err
+	}
+	return nil
+}
+
+// clear removes all keys with zeroing
+func (cache *privateKeyCache) clear() {
+	cache.mutex.Lock()
+	cache.lru.Clear()
+	cache.mutex.Unlock()
+}
+
+// ServerKeyStore wraps keystore.ServerKeyStore and keeps decrypted private keys in memory, so they aren't read and
+// decrypted on every request. Keys are removed from cache after ttl and on rotation through this keystore. Keys rotated
+// by other processes (e.g. acra-keymaker) are used after ttl or after Reset. Revocation of zones is checked by wrapped
+// keystore before cached keys of zones are served.
+type ServerKeyStore struct {
+	keystore.ServerKeyStore
+	cache *privateKeyCache
+}
+
+// NewServerKeyStore returns keyStore with cache of decrypted private keys of size ids, 0 - no limits. Keys are cached
+// for ttl, 0 - until eviction or rotation.
+func NewServerKeyStore(keyStore keystore.ServerKeyStore, size int, ttl time.Duration) (*ServerKeyStore, error) {
+	cache, err := newPrivateKeyCache(size, ttl)
+	if err != nil {
+		return nil, err
+	}
+	return &ServerKeyStore{ServerKeyStore: keyStore, cache: cache}, nil
+}
+
+// GetZonePrivateKey returns cached current private key of zone
+func (store *ServerKeyStore) GetZonePrivateKey(id []byte) (*keys.PrivateKey, error) {
+	if err := store.cache.checkZoneRevoked(store.ServerKeyStore, id); err != nil {
+		return nil, err
+	}
+	return store.cache.getOne(zonePrivateKeyPrefix+string(id), func() (*keys.PrivateKey, error) {
+		return store.ServerKeyStore.GetZonePrivateKey(id)
+	})
+}
+
+// GetZonePrivateKeys returns cached current and rotated private keys of zone
+func (store *ServerKeyStore) GetZonePrivateKeys(id []byte) ([]*keys.PrivateKey, error) {
+	if err := store.cache.checkZoneRevoked(store.ServerKeyStore, id); err != nil {
+		return nil, err
+	}
+	return store.cache.get(zonePrivateKeysPrefix+string(id), func() ([]*keys.PrivateKey, error) {
+		return store.ServerKeyStore.GetZonePrivateKeys(id)
+	})
+}
+
+// GetServerDecryptionPrivateKey returns cached current storage private key of client id
+func (store *ServerKeyStore) GetServerDecryptionPrivateKey(id []byte) (*keys.PrivateKey, error) {
+	return store.cache.getOne(clientPrivateKeyPrefix+string(id), func() (*keys.PrivateKey, error) {
+		return store.ServerKeyStore.GetServerDecryptionPrivateKey(id)
+	})
+}
+
+// GetServerDecryptionPrivateKeys returns cached current and rotated storage private keys of client id
+func (store *ServerKeyStore) GetServerDecryptionPrivateKeys(id []byte) ([]*keys.PrivateKey, error) {
+	return store.cache.get(clientPrivateKeysPrefix+string(id), func() ([]*keys.PrivateKey, error) {
+		return store.ServerKeyStore.GetServerDecryptionPrivateKeys(id)
+	})
+}
+
+// GetPoisonPrivateKeys returns cached private keys of poison records
+func (store *ServerKeyStore) GetPoisonPrivateKeys() ([]*keys.PrivateKey, error) {
+	return store.cache.get(poisonPrivateKeysID, store.ServerKeyStore.GetPoisonPrivateKeys)
+}
+
+// GetPrivateKey returns cached transport private key of id
+func (store *ServerKeyStore) GetPrivateKey(id []byte) (*keys.PrivateKey, error) {
+	return store.cache.getOne(transportPrivateKeyPrefix+string(id), func() (*keys.PrivateKey, error) {
+		return store.ServerKeyStore.GetPrivateKey(id)
+	})
+}
+
+// GenerateDataEncryptionKeys generates new storage keys of client id and removes old ones from cache
+func (store *ServerKeyStore) GenerateDataEncryptionKeys(clientID []byte) error {
+	defer store.cache.removeClient(clientID)
+	return store.ServerKeyStore.GenerateDataEncryptionKeys(clientID)
+}
+
+// SaveDataEncryptionKeys saves storage keys of client id and removes old ones from cache
+func (store *ServerKeyStore) SaveDataEncryptionKeys(clientID []byte, keypair *keys.Keypair) error {
+	defer store.cache.removeClient(clientID)
+	return store.ServerKeyStore.SaveDataEncryptionKeys(clientID, keypair)
+}
+
+// SaveZoneKeypair saves keys of zone and removes old ones from cache
+func (store *ServerKeyStore) SaveZoneKeypair(zoneID []byte, keypair *keys.Keypair) error {
+	defer store.cache.removeZone(zoneID)
+	return store.ServerKeyStore.SaveZoneKeypair(zoneID, keypair)
+}
+
+// RotateZoneKey generates new keys of zone and removes old ones from cache
+func (store *ServerKeyStore) RotateZoneKey(zoneID []byte) ([]byte, error) {
+	defer store.cache.removeZone(zoneID)
+	return store.ServerKeyStore.RotateZoneKey(zoneID)
+}
+
+// Reset clears cache of decrypted private keys and caches of wrapped keystore
+func (store *ServerKeyStore) Reset() {
+	store.cache.clear()
+	store.ServerKeyStore.Reset()
+}
+
+// TranslationKeyStore wraps keystore.TranslationKeyStore and keeps decrypted private keys in memory like
+// ServerKeyStore. Translator doesn't rotate keys, so they are removed from cache only after ttl or on revocation of
+// zone.
+type TranslationKeyStore struct {
+	keystore.TranslationKeyStore
+	cache *privateKeyCache
+}
+
+// NewTranslationKeyStore returns keyStore with cache of decrypted private keys of size ids, 0 - no limits. Keys are
+// cached for ttl, 0 - until eviction.
+func NewTranslationKeyStore(keyStore keystore.TranslationKeyStore, size int, ttl time.Duration) (*TranslationKeyStore, error) {
+	cache, err := newPrivateKeyCache(size, ttl)
+	if err != nil {
+		return nil, err
+	}
+	return &TranslationKeyStore{TranslationKeyStore: keyStore, cache: cache}, nil
+}
+
+// GetZonePrivateKey returns cached current private key of zone
+func (store *TranslationKeyStore) GetZonePrivateKey(id []byte) (*keys.PrivateKey, error) {
+	if err := store.cache.checkZoneRevoked(store.TranslationKeyStore, id); err != nil {
+		return nil, err
+	}
+	return store.cache.getOne(zonePrivateKeyPrefix+string(id), func() (*keys.PrivateKey, error) {
+		return store.TranslationKeyStore.GetZonePrivateKey(id)
+	})
+}
+
+// GetZonePrivateKeys returns cached current and rotated private keys of zone
+func (store *TranslationKeyStore) GetZonePrivateKeys(id []byte) ([]*keys.PrivateKey, error) {
+	if err := store.cache.checkZoneRevoked(store.TranslationKeyStore, id); err != nil {
+		return nil, err
+	}
+	return store.cache.get(zonePrivateKeysPrefix+string(id), func() ([]*keys.PrivateKey, error) {
+		return store.TranslationKeyStore.GetZonePrivateKeys(id)
+	})
+}
+
+// GetServerDecryptionPrivateKey returns cached current storage private key of client id
+func (store *TranslationKeyStore) GetServerDecryptionPrivateKey(id []byte) (*keys.PrivateKey, error) {
+	return store.cache.getOne(clientPrivateKeyPrefix+string(id), func() (*keys.PrivateKey, error) {
+		return store.TranslationKeyStore.GetServerDecryptionPrivateKey(id)
+	})
+}
+
+// GetServerDecryptionPrivateKeys returns cached current and rotated storage private keys of client id
+func (store *TranslationKeyStore) GetServerDecryptionPrivateKeys(id []byte) ([]*keys.PrivateKey, error) {
+	return store.cache.get(clientPrivateKeysPrefix+string(id), func() ([]*keys.PrivateKey, error) {
+		return store.TranslationKeyStore.GetServerDecryptionPrivateKeys(id)
+	})
+}
+
+// GetPoisonPrivateKeys returns cached private keys of poison records
+func (store *TranslationKeyStore) GetPoisonPrivateKeys() ([]*keys.PrivateKey, error) {
+	return store.cache.get(poisonPrivateKeysID, store.TranslationKeyStore.GetPoisonPrivateKeys)
+}
+
+// GetPrivateKey returns cached transport private key of id
+func (store *TranslationKeyStore) GetPrivateKey(id []byte) (*keys.PrivateKey, error) {
+	return store.cache.getOne(transportPrivateKeyPrefix+string(id), func() (*keys.PrivateKey, error) {
+		return store.TranslationKeyStore.GetPrivateKey(id)
+	})
+}
@@ -0,0 +1,173 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lru
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/cossacklabs/acra/keystore"
+	"github.com/cossacklabs/acra/utils"
+	"github.com/cossacklabs/themis/gothemis/keys"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// countingKeyStore returns storage keys of client ids and counts loads of them
+type countingKeyStore struct {
+	keystore.ServerKeyStore
+	keys  map[string]*keys.PrivateKey
+	loads int
+	reset bool
+}
+
+func (store *countingKeyStore) GetServerDecryptionPrivateKeys(id []byte) ([]*keys.PrivateKey, error) {
+	store.loads++
+	privateKey, ok := store.keys[string(id)]
+	if !ok {
+		return nil, errors.New("key not found")
+	}
+	return []*keys.PrivateKey{{Value: append([]byte{}, privateKey.Value...)}}, nil
+}
+
+func (store *countingKeyStore) SaveDataEncryptionKeys(id []byte, keypair *keys.Keypair) error {
+	store.keys[string(id)] = keypair.Private
+	return nil
+}
+
+func (store *countingKeyStore) Reset() {
+	store.reset = true
+}
+
+func TestServerKeyStoreCache(t *testing.T) {
+	if _, err := NewServerKeyStore(nil, -1, 0); err != ErrInvalidPrivateKeyCacheSize {
+		t.Fatalf("Expected ErrInvalidPrivateKeyCacheSize, took %v", err)
+	}
+	underlying := &countingKeyStore{keys: map[string]*keys.PrivateKey{
+		"client1": {Value: []byte("key1")},
+		"client2": {Value: []byte("key2")},
+	}}
+	keyStore, err := NewServerKeyStore(underlying, 1, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	keyStore.cache.now = func() time.Time { return now }
+	get := func(id string) []byte {
+		privateKeys, err := keyStore.GetServerDecryptionPrivateKeys([]byte(id))
+		if err != nil {
+			t.Fatal(err)
+		}
+		value := append([]byte{}, privateKeys[0].Value...)
+		// callers zeroize keys after use, it shouldn't affect cached ones
+		utils.ZeroizePrivateKeys(privateKeys)
+		return value
+	}
+	hits := testutil.ToFloat64(KeyCacheRequestsCounter.WithLabelValues(KeyCacheResultHit))
+	misses := testutil.ToFloat64(KeyCacheRequestsCounter.WithLabelValues(KeyCacheResultMiss))
+
+	if !bytes.Equal(get("client1"), []byte("key1")) || !bytes.Equal(get("client1"), []byte("key1")) || underlying.loads != 1 {
+		t.Fatalf("Expected key loaded once, took %d loads", underlying.loads)
+	}
+	if testutil.ToFloat64(KeyCacheRequestsCounter.WithLabelValues(KeyCacheResultHit))-hits != 1 ||
+		testutil.ToFloat64(KeyCacheRequestsCounter.WithLabelValues(KeyCacheResultMiss))-misses != 1 {
+		t.Fatal("Unexpected metrics of cache")
+	}
+	// errors aren't cached
+	for i := 0; i < 2; i++ {
+		if _, err := keyStore.GetServerDecryptionPrivateKeys([]byte("unknown")); err == nil {
+			t.Fatal("Expected error for unknown client id")
+		}
+	}
+	if underlying.loads != 3 {
+		t.Fatalf("Expected loads of unknown key on every request, took %d loads", underlying.loads)
+	}
+	// the least recently used key is evicted
+	get("client1")
+	get("client2")
+	get("client1")
+	if underlying.loads != 5 {
+		t.Fatalf("Expected evicted key loaded again, took %d loads", underlying.loads)
+	}
+	// expired key is loaded again
+	now = now.Add(time.Minute)
+	get("client1")
+	if underlying.loads != 6 {
+		t.Fatalf("Expected expired key loaded again, took %d loads", underlying.loads)
+	}
+	// rotated key is used right away
+	if err := keyStore.SaveDataEncryptionKeys([]byte("client1"), &keys.Keypair{Private: &keys.PrivateKey{Value: []byte("new key1")}}); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(get("client1"), []byte("new key1")) {
+		t.Fatal("Cache returned key removed by rotation")
+	}
+	keyStore.Reset()
+	get("client1")
+	if !underlying.reset || underlying.loads != 8 {
+		t.Fatal("Reset didn't clear cache of wrapped keystore")
+	}
+}
+
+// revokingKeyStore returns zone keys and revokes zones like filesystem keystore
+type revokingKeyStore struct {
+	keystore.ServerKeyStore
+	revoked map[string]bool
+	loads   int
+}
+
+func (store *revokingKeyStore) GetZonePrivateKeys(id []byte) ([]*keys.PrivateKey, error) {
+	store.loads++
+	return []*keys.PrivateKey{{Value: append([]byte("key of "), id...)}}, nil
+}
+
+func (store *revokingKeyStore) CheckZoneRevoked(id []byte) error {
+	if store.revoked[string(id)] {
+		return keystore.ErrZoneRevoked
+	}
+	return nil
+}
+
+func TestServerKeyStoreCacheZoneRevocation(t *testing.T) {
+	underlying := &revokingKeyStore{revoked: make(map[string]bool)}
+	keyStore, err := NewServerKeyStore(underlying, 0, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := keyStore.GetZonePrivateKeys([]byte("zone1")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if underlying.loads != 1 {
+		t.Fatalf("Expected key loaded once, took %d loads", underlying.loads)
+	}
+	// cached keys of revoked zone aren't served before ttl
+	underlying.revoked["zone1"] = true
+	if _, err := keyStore.GetZonePrivateKeys([]byte("zone1")); err != keystore.ErrZoneRevoked {
+		t.Fatalf("Expected ErrZoneRevoked, took %v", err)
+	}
+	// and are removed from cache, so keys are loaded again after undoing revocation
+	underlying.revoked["zone1"] = false
+	if _, err := keyStore.GetZonePrivateKeys([]byte("zone1")); err != nil {
+		t.Fatal(err)
+	}
+	if underlying.loads != 2 {
+		t.Fatalf("Expected keys of revoked zone removed from cache, took %d loads", underlying.loads)
+	}
+}
@@ -0,0 +1,216 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package keystore
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/cossacklabs/acra/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+// AcraMasterKeysVarName is environment variable with several master keys of keystore v1 as comma-separated list of
+// <key ID>:<base64 key>. The first key encrypts new keys, others only decrypt keys encrypted with them earlier.
+// If it's set then AcraMasterKeyVarName is ignored.
+const AcraMasterKeysVarName = "ACRA_MASTER_KEYS"
+
+// MaxMasterKeyIDLength is maximal length of master key ID in bytes
+const MaxMasterKeyIDLength = 255
+
+// masterKeyEnvelopeMagic starts keys encrypted by MultiMasterKeyEncryptor and is followed by length of master key ID,
+// the ID and key encrypted with Secure Cell
+var masterKeyEnvelopeMagic = []byte("MKE1")
+
+// Errors returned by MultiMasterKeyEncryptor
+var (
+	ErrNoMasterKeys          = errors.New("no master keys")
+	ErrInvalidMasterKeyID    = errors.New("invalid master key ID")
+	ErrDuplicateMasterKeyID  = errors.New("duplicate master key ID")
+	ErrUnknownMasterKeyID    = errors.New("key is encrypted with unknown master key")
+	ErrInvalidMasterKeyList  = errors.New("invalid list of master keys")
+	errInvalidMasterEnvelope = errors.New("invalid master key envelope")
+)
+
+// MasterKey is master key of keystore with its ID
+type MasterKey struct {
+	ID  string
+	Key []byte
+}
+
+// MasterKeyResealer is KeyEncryptor with several master keys which tells whether key needs to be encrypted again
+// with the newest master key
+type MasterKeyResealer interface {
+	KeyEncryptor
+	NeedsReseal(encrypted []byte) bool
+}
+
+// MultiMasterKeyEncryptor encrypts keys with the first of master keys and decrypts keys encrypted with any of them,
+// so master key may be replaced gradually. Encrypted keys start with ID of used master key. Keys encrypted by
+// SCellKeyEncryptor before have no ID and are decrypted with every master key in turn.
+type MultiMasterKeyEncryptor struct {
+	ids        []string
+	encryptors map[string]*SCellKeyEncryptor
+}
+
+// NewMultiMasterKeyEncryptor returns MultiMasterKeyEncryptor which encrypts new keys with the first of masterKeys
+func NewMultiMasterKeyEncryptor(masterKeys []MasterKey) (*MultiMasterKeyEncryptor, error) {
+	if len(masterKeys) == 0 {
+		return nil, ErrNoMasterKeys
+	}
+	encryptor := &MultiMasterKeyEncryptor{encryptors: make(map[string]*SCellKeyEncryptor, len(masterKeys))}
+	for _, masterKey := range masterKeys {
+		if err := validateMasterKeyID(masterKey.ID); err != nil {
+			return nil, err
+		}
+		if _, ok := encryptor.encryptors[masterKey.ID]; ok {
+			return nil, ErrDuplicateMasterKeyID
+		}
+		if err := ValidateMasterKey(masterKey.Key); err != nil {
+			return nil, err
+		}
+		cellEncryptor, err := NewSCellKeyEncryptor(masterKey.Key)
+		if err != nil {
+			return nil, err
+		}
+		encryptor.ids = append(encryptor.ids, masterKey.ID)
+		encryptor.encryptors[masterKey.ID] = cellEncryptor
+	}
+	return encryptor, nil
+}
+
+// validateMasterKeyID allows IDs which can be written into AcraMasterKeysVarName
+func validateMasterKeyID(id string) error {
+	if len(id) == 0 || len(id) > MaxMasterKeyIDLength || strings.ContainsAny(id, ",: ") {
+		return ErrInvalidMasterKeyID
+	}
+	return nil
+}
+
+// ActiveKeyID returns ID of master key which encrypts new keys
+func (encryptor *MultiMasterKeyEncryptor) ActiveKeyID() string {
+	return encryptor.ids[0]
+}
+
+// Encrypt returns key encrypted with active master key and prepended by its ID
+func (encryptor *MultiMasterKeyEncryptor) Encrypt(key, context []byte) ([]byte, error) {
+	id := encryptor.ActiveKeyID()
+	encrypted, err := encryptor.encryptors[id].Encrypt(key, context)
+	if err != nil {
+		return nil, err
+	}
+	sealed := make([]byte, 0, len(masterKeyEnvelopeMagic)+1+len(id)+len(encrypted))
+	sealed = append(sealed, masterKeyEnvelopeMagic...)
+	sealed = append(sealed, byte(len(id)))
+	sealed = append(sealed, id...)
+	return append(sealed, encrypted...), nil
+}
+
+// Decrypt returns key decrypted with master key which ID it has, or with the first master key which can decrypt it
+// if it has no ID
+func (encryptor *MultiMasterKeyEncryptor) Decrypt(sealed, context []byte) ([]byte, error) {
+	id, encrypted, err := parseMasterKeyEnvelope(sealed)
+	if err == errInvalidMasterEnvelope {
+		for _, id := range encryptor.ids {
+			decrypted, err := encryptor.encryptors[id].Decrypt(sealed, context)
+			if err == nil {
+				return decrypted, nil
+			}
+		}
+		return nil, ErrUnknownMasterKeyID
+	}
+	cellEncryptor, ok := encryptor.encryptors[id]
+	if !ok {
+		return nil, ErrUnknownMasterKeyID
+	}
+	return cellEncryptor.Decrypt(encrypted, context)
+}
+
+// NeedsReseal returns true if key isn't encrypted with active master key
+func (encryptor *MultiMasterKeyEncryptor) NeedsReseal(sealed []byte) bool {
+	id, _, err := parseMasterKeyEnvelope(sealed)
+	return err != nil || id != encryptor.ActiveKeyID()
+}
+
+// parseMasterKeyEnvelope returns master key ID and encrypted key
+func parseMasterKeyEnvelope(sealed []byte) (string, []byte, error) {
+	headerLength := len(masterKeyEnvelopeMagic) + 1
+	if len(sealed) < headerLength || !bytes.HasPrefix(sealed, masterKeyEnvelopeMagic) {
+		return "", nil, errInvalidMasterEnvelope
+	}
+	idLength := int(sealed[len(masterKeyEnvelopeMagic)])
+	if idLength == 0 || len(sealed) < headerLength+idLength {
+		return "", nil, errInvalidMasterEnvelope
+	}
+	return string(sealed[headerLength : headerLength+idLength]), sealed[headerLength+idLength:], nil
+}
+
+// ParseMasterKeys parses comma-separated list of <key ID>:<base64 key>
+func ParseMasterKeys(value string) ([]MasterKey, error) {
+	var masterKeys []MasterKey
+	for _, item := range strings.Split(value, ",") {
+		parts := strings.SplitN(strings.TrimSpace(item), ":", 2)
+		if len(parts) != 2 {
+			ZeroizeMasterKeys(masterKeys)
+			return nil, ErrInvalidMasterKeyList
+		}
+		if err := validateMasterKeyID(parts[0]); err != nil {
+			ZeroizeMasterKeys(masterKeys)
+			return nil, err
+		}
+		key, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil {
+			ZeroizeMasterKeys(masterKeys)
+			return nil, fmt.Errorf("%w: master key %s: %s", ErrInvalidMasterKeyList, parts[0], err)
+		}
+		masterKeys = append(masterKeys, MasterKey{ID: parts[0], Key: key})
+	}
+	return masterKeys, nil
+}
+
+// ZeroizeMasterKeys wipes values of master keys
+func ZeroizeMasterKeys(masterKeys []MasterKey) {
+	for _, masterKey := range masterKeys {
+		utils.ZeroizeSymmetricKey(masterKey.Key)
+	}
+}
+
+// IsMultiMasterKeyEnabled returns true if several master keys are set in environment variable AcraMasterKeysVarName
+func IsMultiMasterKeyEnabled() bool {
+	return os.Getenv(AcraMasterKeysVarName) != ""
+}
+
+// NewMultiMasterKeyEncryptorFromEnvironment returns MultiMasterKeyEncryptor with master keys from environment
+// variable AcraMasterKeysVarName
+func NewMultiMasterKeyEncryptorFromEnvironment() (*MultiMasterKeyEncryptor, error) {
+	masterKeys, err := ParseMasterKeys(os.Getenv(AcraMasterKeysVarName))
+	if err != nil {
+		log.WithError(err).Warnf("Failed to parse %s", AcraMasterKeysVarName)
+		return nil, err
+	}
+	encryptor, err := NewMultiMasterKeyEncryptor(masterKeys)
+	if err != nil {
+		ZeroizeMasterKeys(masterKeys)
+		log.WithError(err).Warnf("Invalid master keys in %s", AcraMasterKeysVarName)
+		return nil, err
+	}
+	return encryptor, nil
+}
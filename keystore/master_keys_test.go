@@ -0,0 +1,129 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package keystore
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"os"
+	"testing"
+)
+
+func testMasterKey(t *testing.T, id string) MasterKey {
+	key, err := GenerateSymmetricKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return MasterKey{ID: id, Key: key}
+}
+
+func TestMultiMasterKeyEncryptor(t *testing.T) {
+	oldKey, newKey := testMasterKey(t, "2020-01"), testMasterKey(t, "2020-06")
+	context := []byte("client_storage")
+	privateKey := []byte("private key")
+
+	legacyEncryptor, err := NewSCellKeyEncryptor(oldKey.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacySealed, err := legacyEncryptor.Encrypt(privateKey, context)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldEncryptor, err := NewMultiMasterKeyEncryptor([]MasterKey{oldKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldSealed, err := oldEncryptor.Encrypt(privateKey, context)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encryptor, err := NewMultiMasterKeyEncryptor([]MasterKey{newKey, oldKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encryptor.ActiveKeyID() != newKey.ID {
+		t.Fatalf("Expected active master key %s, took %s", newKey.ID, encryptor.ActiveKeyID())
+	}
+	newSealed, err := encryptor.Encrypt(privateKey, context)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(newSealed, append(append(masterKeyEnvelopeMagic, byte(len(newKey.ID))), newKey.ID...)) {
+		t.Fatal("Encrypted key doesn't start with ID of active master key")
+	}
+	for name, sealed := range map[string][]byte{"legacy": legacySealed, "old": oldSealed, "new": newSealed} {
+		decrypted, err := encryptor.Decrypt(sealed, context)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !bytes.Equal(decrypted, privateKey) {
+			t.Fatalf("%s: decrypted key doesn't match", name)
+		}
+		if encryptor.NeedsReseal(sealed) != (name != "new") {
+			t.Fatalf("%s: unexpected reseal status", name)
+		}
+	}
+	// keys encrypted with the new master key can't be read without it
+	if _, err := oldEncryptor.Decrypt(newSealed, context); err != ErrUnknownMasterKeyID {
+		t.Fatalf("Expected ErrUnknownMasterKeyID, took %v", err)
+	}
+	if _, err := encryptor.Decrypt(newSealed, []byte("other context")); err == nil {
+		t.Fatal("Expected error for wrong context")
+	}
+
+	if _, err := NewMultiMasterKeyEncryptor(nil); err != ErrNoMasterKeys {
+		t.Fatalf("Expected ErrNoMasterKeys, took %v", err)
+	}
+	if _, err := NewMultiMasterKeyEncryptor([]MasterKey{oldKey, oldKey}); err != ErrDuplicateMasterKeyID {
+		t.Fatalf("Expected ErrDuplicateMasterKeyID, took %v", err)
+	}
+	if _, err := NewMultiMasterKeyEncryptor([]MasterKey{{ID: "a:b", Key: oldKey.Key}}); err != ErrInvalidMasterKeyID {
+		t.Fatalf("Expected ErrInvalidMasterKeyID, took %v", err)
+	}
+	if _, err := NewMultiMasterKeyEncryptor([]MasterKey{{ID: "short", Key: []byte("short")}}); err != ErrMasterKeyIncorrectLength {
+		t.Fatalf("Expected ErrMasterKeyIncorrectLength, took %v", err)
+	}
+}
+
+func TestMultiMasterKeyEncryptorFromEnvironment(t *testing.T) {
+	oldKey, newKey := testMasterKey(t, "old"), testMasterKey(t, "new")
+	defer os.Unsetenv(AcraMasterKeysVarName)
+	value := newKey.ID + ":" + base64.StdEncoding.EncodeToString(newKey.Key) + ", " + oldKey.ID + ":" + base64.StdEncoding.EncodeToString(oldKey.Key)
+	if err := os.Setenv(AcraMasterKeysVarName, value); err != nil {
+		t.Fatal(err)
+	}
+	encryptor, err := EnvironmentMasterKeyProvider{}.KeyEncryptor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	multiEncryptor, ok := encryptor.(*MultiMasterKeyEncryptor)
+	if !ok || multiEncryptor.ActiveKeyID() != newKey.ID {
+		t.Fatalf("Expected MultiMasterKeyEncryptor with active key %s, took %#v", newKey.ID, encryptor)
+	}
+
+	for _, value := range []string{"old", "old:not base64", ":" + base64.StdEncoding.EncodeToString(oldKey.Key)} {
+		if err := os.Setenv(AcraMasterKeysVarName, value); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := NewMultiMasterKeyEncryptorFromEnvironment(); !errors.Is(err, ErrInvalidMasterKeyList) && err != ErrInvalidMasterKeyID {
+			t.Fatalf("Expected invalid master key list error for %q, took %v", value, err)
+		}
+	}
+}
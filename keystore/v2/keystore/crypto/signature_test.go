@@ -0,0 +1,49 @@
+/*
+ * Copyright 2020, Cossack Labs Limited
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package crypto
+
+import (
+	"testing"
+)
+
+// signatureMismatches returns signer, data and two wrong signatures which differ from valid one in first and
+// last byte
+func signatureMismatches(t testing.TB) (*SignSha256, []byte, []byte, []byte) {
+	signer, err := NewSignSha256([]byte("signature key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("key ring data")
+	valid := signer.Sign(data, []byte("context"))
+	early := append([]byte{}, valid...)
+	early[0] ^= 0xff
+	late := append([]byte{}, valid...)
+	late[len(late)-1] ^= 0xff
+	if !signer.Verify(valid, data, []byte("context")) || signer.Verify(early, data, []byte("context")) ||
+		signer.Verify(late, data, []byte("context")) {
+		t.Fatal("Invalid verification of signatures")
+	}
+	return signer, data, early, late
+}
+
+func BenchmarkSignSha256Verify(b *testing.B) {
+	signer, data, _, late := signatureMismatches(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		signer.Verify(late, data, []byte("context"))
+	}
+}
@@ -0,0 +1,36 @@
+//go:build constanttime
+// +build constanttime
+
+/*
+ * Copyright 2020, Cossack Labs Limited
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package crypto
+
+import (
+	"testing"
+
+	"github.com/cossacklabs/acra/utils/timing"
+)
+
+func TestSignSha256VerifyConstantTime(t *testing.T) {
+	signer, data, early, late := signatureMismatches(t)
+	result := timing.Measure(func(signature []byte) {
+		signer.Verify(signature, data, []byte("context"))
+	}, early, late, timing.DefaultSamples)
+	if result.Leaks() {
+		t.Fatalf("Verification time depends on position of mismatched byte, t=%f", result.T)
+	}
+}
@@ -255,6 +255,8 @@ func (s *KeyStore) keyRingSignatureContext(path string) []byte {
 var (
 	errIncorrectContentType = errors.New("incorrect ASN.1 ContentType")
 	errUnsupportedVersion   = errors.New("unsupported ASN.1 Version")
+	// errKeyRingPurposeMismatch is returned for key ring stored at path of another purpose
+	errKeyRingPurposeMismatch = errors.New("key ring purpose doesn't match its path")
 )
 
 func (s *KeyStore) signKeyRing(ring *asn1.KeyRing, path string) ([]byte, []asn1.Signature, error) {
@@ -294,6 +296,14 @@ func (s *KeyStore) verifyKeyRing(data []byte, path string) (*asn1.KeyRing, []asn
 	ringData, err := asn1.UnmarshalKeyRing(verified.Payload.Data.FullBytes)
 	if err != nil {
 		log.WithError(err).Debug("failed to unmarshal key ring data")
+		return nil, nil, err
+	}
+	// Signature context already binds container to the path, this also rejects key rings which were signed
+	// for one purpose but describe another one, so keys aren't used for purposes they weren't created for.
+	if string(ringData.Purpose) != path {
+		log.WithField("actual", string(ringData.Purpose)).WithField("expected", path).
+			Warn("key ring purpose doesn't match its path")
+		return nil, nil, errKeyRingPurposeMismatch
 	}
 	log.WithField("last-modified", verified.Payload.LastModified).
 		Trace("loaded key ring")
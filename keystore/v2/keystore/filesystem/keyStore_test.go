@@ -21,9 +21,11 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/cossacklabs/acra/keystore/v2/keystore/api"
 	"github.com/cossacklabs/acra/keystore/v2/keystore/api/tests"
+	"github.com/cossacklabs/acra/keystore/v2/keystore/asn1"
 	"github.com/cossacklabs/acra/keystore/v2/keystore/crypto"
 	backend "github.com/cossacklabs/acra/keystore/v2/keystore/filesystem/backend"
 	backendAPI "github.com/cossacklabs/acra/keystore/v2/keystore/filesystem/backend/api"
@@ -193,6 +195,81 @@ func TestKeyStorePersistence(t *testing.T) {
 	}
 }
 
+func TestKeyStoreRingIntegrity(t *testing.T) {
+	store, err := NewInMemory(testKeyStoreSuite(t))
+	if err != nil {
+		t.Fatalf("cannot create in-memory keystore: %v", err)
+	}
+	s := store.(*KeyStore)
+	_, err = s.OpenKeyRingRW("client/alice/storage")
+	if err != nil {
+		t.Fatalf("failed to create key ring: %v", err)
+	}
+	_, err = s.OpenKeyRingRW("client/bob/storage")
+	if err != nil {
+		t.Fatalf("failed to create key ring: %v", err)
+	}
+
+	// key ring of one client copied in place of another one is signed for another path
+	data, err := s.fetchASNring("client/alice/storage")
+	if err != nil {
+		t.Fatalf("failed to read key ring: %v", err)
+	}
+	err = s.pushASNring(data, "client/bob/storage")
+	if err != nil {
+		t.Fatalf("failed to write key ring: %v", err)
+	}
+	_, err = s.OpenKeyRing("client/bob/storage")
+	if err == nil {
+		t.Error("opened key ring copied from another path")
+	}
+
+	// properly signed key ring which describes another purpose
+	ring := newKeyRing(s, "client/alice/storage")
+	data, _, err = s.signKeyRing(ring.data, "client/bob/storage")
+	if err != nil {
+		t.Fatalf("failed to sign key ring: %v", err)
+	}
+	err = s.pushASNring(data, "client/bob/storage")
+	if err != nil {
+		t.Fatalf("failed to write key ring: %v", err)
+	}
+	_, err = s.OpenKeyRing("client/bob/storage")
+	if err != errKeyRingPurposeMismatch {
+		t.Errorf("expected errKeyRingPurposeMismatch, took %v", err)
+	}
+
+	// header of signed key ring is changed without signing, e.g. version or modification time
+	ring = newKeyRing(s, "client/bob/storage")
+	_, signatures, err := s.signKeyRing(ring.data, "client/bob/storage")
+	if err != nil {
+		t.Fatalf("failed to sign key ring: %v", err)
+	}
+	for _, payload := range []asn1.SignedPayload{
+		{ContentType: asn1.TypeKeyRing, Version: asn1.KeyRingVersion2, LastModified: time.Now().Add(-time.Hour), Data: *ring.data},
+		{ContentType: asn1.TypeKeyRing, Version: asn1.KeyRingVersion2 + 1, LastModified: time.Now(), Data: *ring.data},
+	} {
+		container := asn1.SignedContainer{Payload: payload, Signatures: signatures}
+		data, err = container.Marshal()
+		if err != nil {
+			t.Fatalf("failed to marshal key ring: %v", err)
+		}
+		err = s.pushASNring(data, "client/bob/storage")
+		if err != nil {
+			t.Fatalf("failed to write key ring: %v", err)
+		}
+		_, err = s.OpenKeyRing("client/bob/storage")
+		if err == nil {
+			t.Error("opened key ring with modified header")
+		}
+	}
+
+	_, err = s.OpenKeyRing("client/alice/storage")
+	if err != nil {
+		t.Errorf("failed to open key ring: %v", err)
+	}
+}
+
 func TestKeyStoreInMemory(t *testing.T) {
 	tests.TestKeyStore(t, newInMemoryKeyStore)
 }
@@ -17,10 +17,10 @@
 package keystore
 
 import (
-	"crypto/rand"
 	"time"
 
 	"github.com/cossacklabs/acra/keystore/v2/keystore/api"
+	"github.com/cossacklabs/acra/random"
 	"github.com/cossacklabs/themis/gothemis/keys"
 )
 
@@ -121,6 +121,27 @@ func (s *ServerKeyStore) destroyCurrentKeyPair(ring api.MutableKeyRing) error {
 	return nil
 }
 
+func (s *ServerKeyStore) destroyAllKeyPairs(ring api.MutableKeyRing) error {
+	seqnums, err := ring.AllKeys()
+	if err != nil {
+		return err
+	}
+	for _, seqnum := range seqnums {
+		state, err := ring.State(seqnum)
+		if err != nil {
+			return err
+		}
+		if state == api.KeyDestroyed {
+			continue
+		}
+		err = ring.DestroyKey(seqnum)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (s *ServerKeyStore) describeNewKeyPair(keypair *keys.Keypair) api.KeyDescription {
 	return api.KeyDescription{
 		ValidSince: time.Now(),
@@ -140,7 +161,7 @@ const symmtricKeyBytes = 32
 // TODO: replace with keys.NewSymetricKey() once GoThemis 0.13 is released
 func (s *ServerKeyStore) newSymmetricKey() ([]byte, error) {
 	randomBytes := make([]byte, symmtricKeyBytes)
-	_, err := rand.Read(randomBytes)
+	_, err := random.Read(randomBytes)
 	if err != nil {
 		return nil, err
 	}
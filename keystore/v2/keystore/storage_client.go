@@ -121,3 +121,19 @@ func (s *ServerKeyStore) SaveDataEncryptionKeys(clientID []byte, keypair *keys.K
 	}
 	return nil
 }
+
+// DestroyDataEncryptionKeys destroys current and all rotated storage keypairs used by given client.
+func (s *ServerKeyStore) DestroyDataEncryptionKeys(clientID []byte) error {
+	log := s.log.WithField("clientID", clientID)
+	ring, err := s.OpenKeyRingRW(s.clientStorageKeyPairPath(clientID))
+	if err != nil {
+		log.WithError(err).Debug("failed to open storage key ring for client")
+		return err
+	}
+	err = s.destroyAllKeyPairs(ring)
+	if err != nil {
+		log.WithError(err).Debug("failed to destroy storage key pairs for client")
+		return err
+	}
+	return nil
+}
@@ -159,3 +159,19 @@ func (s *ServerKeyStore) RotateZoneKey(zoneID []byte) ([]byte, error) {
 	utils.ZeroizePrivateKey(pair.Private)
 	return pair.Public.Value, nil
 }
+
+// DestroyZoneKeys destroys current and all rotated storage keypairs used in given zone.
+func (s *ServerKeyStore) DestroyZoneKeys(zoneID []byte) error {
+	log := s.log.WithField("zoneID", zoneID)
+	ring, err := s.OpenKeyRingRW(s.zoneStorageKeyPairPath(zoneID))
+	if err != nil {
+		log.WithError(err).Debug("failed to open storage key ring for zone")
+		return err
+	}
+	err = s.destroyAllKeyPairs(ring)
+	if err != nil {
+		log.WithError(err).Debug("failed to destroy storage key pairs for zone")
+		return err
+	}
+	return nil
+}
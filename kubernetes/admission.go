@@ -0,0 +1,146 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kubernetes
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// maxAdmissionReviewSize limits size of AdmissionReview request body, Kubernetes objects are limited by 1.5 MiB
+const maxAdmissionReviewSize = 3 * 1024 * 1024
+
+// Operation of admission request which isn't validated, objects being deleted can't break anything
+const admissionOperationDelete = "DELETE"
+
+// ErrInvalidAdmissionReview returned for requests which aren't AdmissionReview with request
+var ErrInvalidAdmissionReview = errors.New("request isn't AdmissionReview")
+
+// AdmissionReview is request and response of admission webhook (admission.k8s.io/v1 API)
+type AdmissionReview struct {
+	APIVersion string             `json:"apiVersion"`
+	Kind       string             `json:"kind"`
+	Request    *AdmissionRequest  `json:"request,omitempty"`
+	Response   *AdmissionResponse `json:"response,omitempty"`
+}
+
+// GroupVersionKind identifies kind of object of admission request
+type GroupVersionKind struct {
+	Group   string `json:"group"`
+	Version string `json:"version"`
+	Kind    string `json:"kind"`
+}
+
+// AdmissionRequest describes operation with object which should be admitted
+type AdmissionRequest struct {
+	UID       string           `json:"uid"`
+	Kind      GroupVersionKind `json:"kind"`
+	Name      string           `json:"name"`
+	Namespace string           `json:"namespace"`
+	Operation string           `json:"operation"`
+	Object    json.RawMessage  `json:"object,omitempty"`
+}
+
+// AdmissionStatus describes reason of denial
+type AdmissionStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// AdmissionResponse tells whether object of request with UID is admitted
+type AdmissionResponse struct {
+	UID     string           `json:"uid"`
+	Allowed bool             `json:"allowed"`
+	Status  *AdmissionStatus `json:"status,omitempty"`
+}
+
+// ObjectMeta is metadata of Kubernetes object
+type ObjectMeta struct {
+	Name      string            `json:"name"`
+	Namespace string            `json:"namespace"`
+	Labels    map[string]string `json:"labels"`
+}
+
+// ConfigMap is Kubernetes ConfigMap with text data
+type ConfigMap struct {
+	Metadata ObjectMeta        `json:"metadata"`
+	Data     map[string]string `json:"data"`
+}
+
+// ConfigMapValidator checks ConfigMaps before they are created or updated
+type ConfigMapValidator interface {
+	// ValidateConfigMap returns error which describes why configMap shouldn't be admitted
+	ValidateConfigMap(ctx context.Context, configMap *ConfigMap) error
+}
+
+// AdmissionHandler serves requests of validating admission webhook and denies ConfigMaps rejected by validator.
+// Other kinds of objects and deletions are allowed.
+type AdmissionHandler struct {
+	validator ConfigMapValidator
+}
+
+// NewAdmissionHandler returns AdmissionHandler which validates ConfigMaps with validator
+func NewAdmissionHandler(validator ConfigMapValidator) *AdmissionHandler {
+	return &AdmissionHandler{validator: validator}
+}
+
+// ServeHTTP handles AdmissionReview request and responds with AdmissionReview of the same API version
+func (handler *AdmissionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	var review AdmissionReview
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxAdmissionReviewSize)).Decode(&review); err != nil || review.Request == nil {
+		log.WithError(err).Warningln("Can't decode AdmissionReview")
+		http.Error(w, ErrInvalidAdmissionReview.Error(), http.StatusBadRequest)
+		return
+	}
+	response := handler.Review(r.Context(), review.Request)
+	output, err := json.Marshal(AdmissionReview{APIVersion: review.APIVersion, Kind: review.Kind, Response: response})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(output)
+}
+
+// Review returns decision about object of request
+func (handler *AdmissionHandler) Review(ctx context.Context, request *AdmissionRequest) *AdmissionResponse {
+	logger := log.WithFields(log.Fields{"namespace": request.Namespace, "name": request.Name, "operation": request.Operation})
+	if request.Kind.Kind != "ConfigMap" || request.Operation == admissionOperationDelete {
+		logger.WithField("kind", request.Kind.Kind).Debugln("Object isn't validated")
+		return &AdmissionResponse{UID: request.UID, Allowed: true}
+	}
+	var configMap ConfigMap
+	if err := json.Unmarshal(request.Object, &configMap); err != nil {
+		logger.WithError(err).Warningln("Can't decode ConfigMap")
+		return &AdmissionResponse{UID: request.UID, Status: &AdmissionStatus{Code: http.StatusBadRequest, Message: err.Error()}}
+	}
+	if err := handler.validator.ValidateConfigMap(ctx, &configMap); err != nil {
+		logger.WithError(err).Infoln("ConfigMap is denied")
+		return &AdmissionResponse{UID: request.UID, Status: &AdmissionStatus{Code: http.StatusForbidden, Message: err.Error()}}
+	}
+	logger.Debugln("ConfigMap is allowed")
+	return &AdmissionResponse{UID: request.UID, Allowed: true}
+}
@@ -0,0 +1,98 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kubernetes
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// testConfigMapValidator denies ConfigMaps with "invalid" key
+type testConfigMapValidator struct {
+	calls int
+}
+
+func (v *testConfigMapValidator) ValidateConfigMap(ctx context.Context, configMap *ConfigMap) error {
+	v.calls++
+	if _, ok := configMap.Data["invalid"]; ok {
+		return errors.New("invalid config")
+	}
+	return nil
+}
+
+func TestAdmissionHandler(t *testing.T) {
+	validator := &testConfigMapValidator{}
+	server := httptest.NewServer(NewAdmissionHandler(validator))
+	defer server.Close()
+
+	review := func(body string) *AdmissionReview {
+		response, err := http.Post(server.URL, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer response.Body.Close()
+		if response.StatusCode != http.StatusOK {
+			t.Fatalf("Unexpected status %d", response.StatusCode)
+		}
+		var review AdmissionReview
+		if err := json.NewDecoder(response.Body).Decode(&review); err != nil {
+			t.Fatal(err)
+		}
+		return &review
+	}
+	request := `{"apiVersion":"admission.k8s.io/v1","kind":"AdmissionReview","request":{"uid":"%s","kind":{"version":"v1","kind":"%s"},"namespace":"acra","name":"acra-server-config","operation":"%s","object":%s}}`
+	for _, testcase := range []struct {
+		kind, operation, object string
+		allowed                 bool
+	}{
+		{"ConfigMap", "CREATE", `{"metadata":{"name":"acra-server-config"},"data":{"encryptor_config.yaml":"schemas: []"}}`, true},
+		{"ConfigMap", "UPDATE", `{"metadata":{"name":"acra-server-config"},"data":{"invalid":""}}`, false},
+		{"ConfigMap", "CREATE", `{"data":[]}`, false},
+		{"ConfigMap", "DELETE", `null`, true},
+		{"Secret", "CREATE", `{"data":{"invalid":""}}`, true},
+	} {
+		uid := testcase.kind + "-" + testcase.operation
+		result := review(fmt.Sprintf(request, uid, testcase.kind, testcase.operation, testcase.object))
+		if result.APIVersion != "admission.k8s.io/v1" || result.Kind != "AdmissionReview" || result.Response == nil {
+			t.Fatalf("[%s] Unexpected response %+v", uid, result)
+		}
+		if result.Response.UID != uid || result.Response.Allowed != testcase.allowed {
+			t.Fatalf("[%s] Expected allowed=%v, took %+v", uid, testcase.allowed, result.Response)
+		}
+		if !testcase.allowed && (result.Response.Status == nil || result.Response.Status.Message == "") {
+			t.Fatalf("[%s] Denial without reason", uid)
+		}
+	}
+	if validator.calls != 2 {
+		t.Fatalf("Expected validation of 2 ConfigMaps, took %d", validator.calls)
+	}
+
+	response, err := http.Post(server.URL, "application/json", strings.NewReader(`{"kind":"AdmissionReview"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for review without request, took %d", response.StatusCode)
+	}
+}
@@ -0,0 +1,175 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package kubernetes derives identity of Acra services running as sidecar containers of Kubernetes pods. Pod name,
+// namespace, service account and labels are read from downward API, service account is confirmed by TokenReview of
+// pod's service account token on Kubernetes API server, so client ID doesn't require distribution of certificates.
+package kubernetes
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Defaults of downward API and service account volumes
+const (
+	DefaultServiceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+	DefaultPodInfoDir        = "/etc/podinfo"
+	DefaultClientIDTemplate  = "{namespace}_{service_account}"
+)
+
+// Environment variables which should be set from pod fields with downward API
+const (
+	EnvPodName           = "POD_NAME"
+	EnvPodNamespace      = "POD_NAMESPACE"
+	EnvPodServiceAccount = "POD_SERVICE_ACCOUNT"
+)
+
+// Errors returned by PodIdentity
+var (
+	ErrInvalidLabels           = errors.New("invalid downward API labels file")
+	ErrInvalidClientIDTemplate = errors.New("invalid client ID template")
+	ErrEmptyIdentityField      = errors.New("pod identity field used by client ID template is empty")
+	ErrIdentityMismatch        = errors.New("service account token doesn't belong to pod's namespace and service account")
+)
+
+// PodIdentity describes pod in which service runs
+type PodIdentity struct {
+	Name           string
+	Namespace      string
+	ServiceAccount string
+	Labels         map[string]string
+}
+
+// PodIdentityFromEnvironment reads pod fields from environment variables and labels from "labels" file of downward API
+// volume mounted to podInfoDir. Namespace is read from service account volume if it isn't set in environment.
+// Missing labels file means pod without labels.
+func PodIdentityFromEnvironment(serviceAccountDir, podInfoDir string) (*PodIdentity, error) {
+	identity := &PodIdentity{
+		Name:           os.Getenv(EnvPodName),
+		Namespace:      os.Getenv(EnvPodNamespace),
+		ServiceAccount: os.Getenv(EnvPodServiceAccount),
+		Labels:         map[string]string{},
+	}
+	if identity.Namespace == "" {
+		namespace, err := ioutil.ReadFile(filepath.Join(serviceAccountDir, "namespace"))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		identity.Namespace = string(bytes.TrimSpace(namespace))
+	}
+	labels, err := ioutil.ReadFile(filepath.Join(podInfoDir, "labels"))
+	if os.IsNotExist(err) {
+		return identity, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	identity.Labels, err = ParseDownwardAPILabels(labels)
+	if err != nil {
+		return nil, err
+	}
+	return identity, nil
+}
+
+// ParseDownwardAPILabels parses labels file of downward API volume with lines like key="value"
+func ParseDownwardAPILabels(data []byte) (map[string]string, error) {
+	labels := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("%w: line '%s'", ErrInvalidLabels, line)
+		}
+		value, err := strconv.Unquote(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("%w: value of label '%s' isn't quoted", ErrInvalidLabels, parts[0])
+		}
+		labels[parts[0]] = value
+	}
+	return labels, scanner.Err()
+}
+
+// placeholderRegexp matches {namespace}, {pod}, {service_account} and {label:<key>} placeholders of client ID template
+var placeholderRegexp = regexp.MustCompile(`\{([^{}]*)\}`)
+
+// ClientID returns client ID formatted by template with placeholders {namespace}, {pod}, {service_account} and
+// {label:<key>}. Placeholders of empty fields and missing labels are errors, so all pods don't share client ID by
+// misconfiguration.
+func (identity *PodIdentity) ClientID(template string) (string, error) {
+	var err error
+	clientID := placeholderRegexp.ReplaceAllStringFunc(template, func(placeholder string) string {
+		name := placeholder[1 : len(placeholder)-1]
+		var value string
+		switch {
+		case name == "namespace":
+			value = identity.Namespace
+		case name == "pod":
+			value = identity.Name
+		case name == "service_account":
+			value = identity.ServiceAccount
+		case strings.HasPrefix(name, "label:"):
+			value = identity.Labels[strings.TrimPrefix(name, "label:")]
+		default:
+			if err == nil {
+				err = fmt.Errorf("%w: unknown placeholder %s", ErrInvalidClientIDTemplate, placeholder)
+			}
+			return ""
+		}
+		if value == "" && err == nil {
+			err = fmt.Errorf("%w: %s", ErrEmptyIdentityField, placeholder)
+		}
+		return value
+	})
+	if err != nil {
+		return "", err
+	}
+	if strings.ContainsAny(clientID, "{}") {
+		return "", fmt.Errorf("%w: unbalanced braces in '%s'", ErrInvalidClientIDTemplate, template)
+	}
+	return clientID, nil
+}
+
+// Verify checks with reviewer that token is valid token of service account of pod. Namespace and service account
+// which aren't set by downward API are taken from the token.
+func (identity *PodIdentity) Verify(reviewer *TokenReviewer, token string) error {
+	namespace, serviceAccount, err := reviewer.Review(token)
+	if err != nil {
+		return err
+	}
+	if identity.Namespace == "" {
+		identity.Namespace = namespace
+	}
+	if identity.ServiceAccount == "" {
+		identity.ServiceAccount = serviceAccount
+	}
+	if identity.Namespace != namespace || identity.ServiceAccount != serviceAccount {
+		return fmt.Errorf("%w: token of %s/%s", ErrIdentityMismatch, namespace, serviceAccount)
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kubernetes
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseDownwardAPILabels(t *testing.T) {
+	labels, err := ParseDownwardAPILabels([]byte("app=\"billing\"\ntenant=\"acme\"\n\npod-template-hash=\"6d4cf56db6\"\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"app": "billing", "tenant": "acme", "pod-template-hash": "6d4cf56db6"}
+	if !reflect.DeepEqual(labels, expected) {
+		t.Fatalf("Incorrect labels %v", labels)
+	}
+	for _, data := range []string{"app", "=\"value\"", "app=billing"} {
+		if _, err := ParseDownwardAPILabels([]byte(data)); !errors.Is(err, ErrInvalidLabels) {
+			t.Fatalf("Expected ErrInvalidLabels for %s, took %v", data, err)
+		}
+	}
+}
+
+func TestPodIdentityClientID(t *testing.T) {
+	identity := &PodIdentity{Name: "billing-1", Namespace: "payments", ServiceAccount: "billing", Labels: map[string]string{"tenant": "acme"}}
+	testcases := []struct {
+		template string
+		clientID string
+		err      error
+	}{
+		{DefaultClientIDTemplate, "payments_billing", nil},
+		{"tenant_{label:tenant}", "tenant_acme", nil},
+		{"{pod}", "billing-1", nil},
+		{"{label:missing}", "", ErrEmptyIdentityField},
+		{"{node}", "", ErrInvalidClientIDTemplate},
+		{"{namespace", "", ErrInvalidClientIDTemplate},
+	}
+	for _, testcase := range testcases {
+		clientID, err := identity.ClientID(testcase.template)
+		if !errors.Is(err, testcase.err) || clientID != testcase.clientID {
+			t.Fatalf("Template %s: expected %s and %v, took %s and %v", testcase.template, testcase.clientID, testcase.err, clientID, err)
+		}
+	}
+}
+
+func TestPodIdentityFromEnvironment(t *testing.T) {
+	dir, err := ioutil.TempDir("", "podinfo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "namespace"), []byte("payments\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "labels"), []byte("tenant=\"acme\"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{EnvPodName, EnvPodNamespace, EnvPodServiceAccount} {
+		defer os.Setenv(name, os.Getenv(name))
+	}
+	os.Setenv(EnvPodName, "billing-1")
+	os.Unsetenv(EnvPodNamespace)
+	os.Unsetenv(EnvPodServiceAccount)
+	identity, err := PodIdentityFromEnvironment(dir, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &PodIdentity{Name: "billing-1", Namespace: "payments", Labels: map[string]string{"tenant": "acme"}}
+	if !reflect.DeepEqual(identity, expected) {
+		t.Fatalf("Incorrect identity %v", identity)
+	}
+	// labels volume isn't mounted
+	identity, err = PodIdentityFromEnvironment(dir, filepath.Join(dir, "missing"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(identity.Labels) != 0 {
+		t.Fatalf("Expected no labels, took %v", identity.Labels)
+	}
+}
+
+func TestTokenReview(t *testing.T) {
+	users := map[string]string{
+		"billing-token": "system:serviceaccount:payments:billing",
+		"user-token":    "admin",
+	}
+	server := httptest.NewTLSServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		review := &tokenReview{}
+		if request.URL.Path != "/apis/authentication.k8s.io/v1/tokenreviews" || json.NewDecoder(request.Body).Decode(review) != nil {
+			writer.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if request.Header.Get("Authorization") != "Bearer "+review.Spec.Token {
+			writer.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		review.Status = &tokenReviewStatus{}
+		if username, ok := users[review.Spec.Token]; ok {
+			review.Status.Authenticated = true
+			review.Status.User.Username = username
+		} else {
+			review.Status.Error = "invalid bearer token"
+		}
+		writer.WriteHeader(http.StatusCreated)
+		json.NewEncoder(writer).Encode(review)
+	}))
+	defer server.Close()
+	reviewer := NewTokenReviewer(server.URL, server.Client())
+
+	namespace, serviceAccount, err := reviewer.Review("billing-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if namespace != "payments" || serviceAccount != "billing" {
+		t.Fatalf("Incorrect service account %s/%s", namespace, serviceAccount)
+	}
+	if _, _, err := reviewer.Review("invalid-token"); !errors.Is(err, ErrTokenNotAuthenticated) {
+		t.Fatalf("Expected ErrTokenNotAuthenticated, took %v", err)
+	}
+	if _, _, err := reviewer.Review("user-token"); !errors.Is(err, ErrNotServiceAccount) {
+		t.Fatalf("Expected ErrNotServiceAccount, took %v", err)
+	}
+
+	identity := &PodIdentity{Namespace: "payments"}
+	if err := identity.Verify(reviewer, "billing-token"); err != nil {
+		t.Fatal(err)
+	}
+	if identity.ServiceAccount != "billing" {
+		t.Fatal("Service account isn't taken from token")
+	}
+	identity = &PodIdentity{Namespace: "payments", ServiceAccount: "reporting"}
+	if err := identity.Verify(reviewer, "billing-token"); !errors.Is(err, ErrIdentityMismatch) {
+		t.Fatalf("Expected ErrIdentityMismatch, took %v", err)
+	}
+}
@@ -0,0 +1,153 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kubernetes
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// defaultHTTPTimeout limits time of requests to Kubernetes API server
+const defaultHTTPTimeout = time.Second * 10
+
+// serviceAccountUserPrefix is prefix of usernames of service accounts, followed by <namespace>:<name>
+const serviceAccountUserPrefix = "system:serviceaccount:"
+
+// Errors returned by TokenReviewer
+var (
+	ErrNotInCluster          = errors.New("KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT aren't set, service doesn't run in Kubernetes pod")
+	ErrTokenNotAuthenticated = errors.New("service account token isn't authenticated by Kubernetes API server")
+	ErrNotServiceAccount     = errors.New("token doesn't belong to service account")
+)
+
+// TokenReviewer validates service account tokens with TokenReview API of Kubernetes API server
+type TokenReviewer struct {
+	client    *http.Client
+	apiServer string
+}
+
+// NewTokenReviewer returns TokenReviewer which sends requests to apiServer URL with client
+func NewTokenReviewer(apiServer string, client *http.Client) *TokenReviewer {
+	return &TokenReviewer{client: client, apiServer: strings.TrimSuffix(apiServer, "/")}
+}
+
+// NewTokenReviewerFromEnvironment returns TokenReviewer of API server of cluster in which pod runs. Address is read
+// from KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT, server certificate is verified with CA of service account.
+func NewTokenReviewerFromEnvironment(serviceAccountDir string) (*TokenReviewer, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, ErrNotInCluster
+	}
+	caData, err := ioutil.ReadFile(filepath.Join(serviceAccountDir, "ca.crt"))
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caData) {
+		return nil, fmt.Errorf("no certificates in %s", filepath.Join(serviceAccountDir, "ca.crt"))
+	}
+	client := &http.Client{
+		Timeout:   defaultHTTPTimeout,
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+	}
+	return NewTokenReviewer("https://"+net.JoinHostPort(host, port), client), nil
+}
+
+// ReadServiceAccountToken returns token of pod's service account
+func ReadServiceAccountToken(serviceAccountDir string) (string, error) {
+	token, err := ioutil.ReadFile(filepath.Join(serviceAccountDir, "token"))
+	if err != nil {
+		return "", err
+	}
+	return string(bytes.TrimSpace(token)), nil
+}
+
+type tokenReview struct {
+	APIVersion string             `json:"apiVersion"`
+	Kind       string             `json:"kind"`
+	Spec       tokenReviewSpec    `json:"spec"`
+	Status     *tokenReviewStatus `json:"status,omitempty"`
+}
+
+type tokenReviewSpec struct {
+	Token string `json:"token"`
+}
+
+type tokenReviewStatus struct {
+	Authenticated bool `json:"authenticated"`
+	User          struct {
+		Username string `json:"username"`
+	} `json:"user"`
+	Error string `json:"error,omitempty"`
+}
+
+// Review returns namespace and name of service account of authenticated token. Token is used for authentication of
+// request too, so service account should be allowed to create TokenReviews (role system:auth-delegator).
+func (reviewer *TokenReviewer) Review(token string) (string, string, error) {
+	body, err := json.Marshal(&tokenReview{
+		APIVersion: "authentication.k8s.io/v1",
+		Kind:       "TokenReview",
+		Spec:       tokenReviewSpec{Token: token},
+	})
+	if err != nil {
+		return "", "", err
+	}
+	request, err := http.NewRequest(http.MethodPost, reviewer.apiServer+"/apis/authentication.k8s.io/v1/tokenreviews", bytes.NewReader(body))
+	if err != nil {
+		return "", "", err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("Authorization", "Bearer "+token)
+	response, err := reviewer.client.Do(request)
+	if err != nil {
+		return "", "", err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK && response.StatusCode != http.StatusCreated {
+		responseBody, _ := ioutil.ReadAll(io.LimitReader(response.Body, 1024))
+		return "", "", fmt.Errorf("unexpected TokenReview response status %d: %s", response.StatusCode, bytes.TrimSpace(responseBody))
+	}
+	result := &tokenReview{}
+	if err := json.NewDecoder(response.Body).Decode(result); err != nil {
+		return "", "", err
+	}
+	if result.Status == nil || !result.Status.Authenticated {
+		reason := ""
+		if result.Status != nil {
+			reason = result.Status.Error
+		}
+		return "", "", fmt.Errorf("%w: %s", ErrTokenNotAuthenticated, reason)
+	}
+	username := result.Status.User.Username
+	parts := strings.Split(strings.TrimPrefix(username, serviceAccountUserPrefix), ":")
+	if !strings.HasPrefix(username, serviceAccountUserPrefix) || len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("%w: %s", ErrNotServiceAccount, username)
+	}
+	return parts[0], parts[1], nil
+}
@@ -0,0 +1,132 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logging
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Names of logging backends
+const (
+	// LogrusBackendName formats entries with formatters of this package, it's always available
+	LogrusBackendName = "logrus"
+	// ZapBackendName encodes entries with zap, it's available only in binaries built with "zap" build tag
+	ZapBackendName = "zap"
+)
+
+// DefaultBackendName is backend used if other one isn't configured
+const DefaultBackendName = LogrusBackendName
+
+// Errors returned by backend configuration
+var (
+	ErrUnknownBackend           = errors.New("unknown logging backend")
+	ErrUnsupportedBackendFormat = errors.New("logging format isn't supported by backend")
+)
+
+// Backend writes entries of logging calls. Calls are made via logrus API, backend replaces formatting and output of
+// entries, so faster encoders may be used without changes of callers.
+type Backend interface {
+	// Write encodes and writes entry, called concurrently
+	Write(entry *log.Entry) error
+	// Sync flushes buffered entries
+	Sync() error
+}
+
+// BackendFactory returns Backend which writes entries in format (plaintext, json or cef) with serviceName to output
+type BackendFactory func(format, serviceName string, output io.Writer) (Backend, error)
+
+var (
+	backendsLock sync.Mutex
+	backends     = map[string]BackendFactory{}
+)
+
+// RegisterBackend makes backend available by name for SetBackend
+func RegisterBackend(name string, factory BackendFactory) {
+	backendsLock.Lock()
+	defer backendsLock.Unlock()
+	backends[name] = factory
+}
+
+// BackendNames returns sorted names of available backends
+func BackendNames() []string {
+	backendsLock.Lock()
+	defer backendsLock.Unlock()
+	names := []string{LogrusBackendName}
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// SetBackend replaces output of standard logger with backend of name which writes to output. Logrus backend keeps
+// formatter set by CreateFormatter, so it should be called after it.
+func SetBackend(name, format, serviceName string, output io.Writer) (Backend, error) {
+	if name == "" || name == LogrusBackendName {
+		log.SetOutput(output)
+		return nil, nil
+	}
+	backendsLock.Lock()
+	factory, ok := backends[name]
+	backendsLock.Unlock()
+	if !ok {
+		if name == ZapBackendName {
+			return nil, fmt.Errorf("%w: %s isn't compiled in, build with \"-tags zap\"", ErrUnknownBackend, name)
+		}
+		return nil, fmt.Errorf("%w: %s, available: %s", ErrUnknownBackend, name, strings.Join(BackendNames(), ", "))
+	}
+	backend, err := factory(strings.ToLower(format), serviceName, output)
+	if err != nil {
+		return nil, err
+	}
+	// logrus still filters entries by level and passes them to hooks, formatting and output are done by backend
+	log.SetFormatter(nopFormatter{})
+	log.SetOutput(ioutil.Discard)
+	log.AddHook(&backendHook{backend: backend})
+	return backend, nil
+}
+
+// nopFormatter skips formatting of entries written by backend
+type nopFormatter struct{}
+
+// Format returns nothing
+func (nopFormatter) Format(*log.Entry) ([]byte, error) {
+	return nil, nil
+}
+
+// backendHook passes entries of all levels to backend
+type backendHook struct {
+	backend Backend
+}
+
+// Levels returns all levels, entries are filtered by level of logger before hooks
+func (hook *backendHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+// Fire writes entry with backend
+func (hook *backendHook) Fire(entry *log.Entry) error {
+	return hook.backend.Write(entry)
+}
@@ -0,0 +1,192 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logging
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type stubBackend struct {
+	lock    sync.Mutex
+	entries []*log.Entry
+}
+
+func (backend *stubBackend) Write(entry *log.Entry) error {
+	backend.lock.Lock()
+	defer backend.lock.Unlock()
+	backend.entries = append(backend.entries, entry)
+	return nil
+}
+
+func (backend *stubBackend) Sync() error {
+	return nil
+}
+
+// restoreStandardLogger returns function which restores formatter, output, hooks and level of standard logger
+func restoreStandardLogger() func() {
+	logger := log.StandardLogger()
+	formatter, output, level := logger.Formatter, logger.Out, logger.GetLevel()
+	hooks := logger.ReplaceHooks(make(log.LevelHooks))
+	return func() {
+		logger.SetFormatter(formatter)
+		logger.SetOutput(output)
+		logger.SetLevel(level)
+		logger.ReplaceHooks(hooks)
+	}
+}
+
+func TestSetBackend(t *testing.T) {
+	defer restoreStandardLogger()()
+	backend := &stubBackend{}
+	RegisterBackend("stub", func(format, serviceName string, output io.Writer) (Backend, error) {
+		if format != JsonFormatString {
+			return nil, ErrUnsupportedBackendFormat
+		}
+		return backend, nil
+	})
+	names := []string{"unknown"}
+	// zap backend is registered only with build tag
+	if _, ok := backends[ZapBackendName]; !ok {
+		names = append(names, ZapBackendName)
+	}
+	for _, name := range names {
+		if _, err := SetBackend(name, JsonFormatString, "test", os.Stderr); !errors.Is(err, ErrUnknownBackend) {
+			t.Fatalf("Expected ErrUnknownBackend for %s, took %v", name, err)
+		}
+	}
+	if _, err := SetBackend("stub", CefFormatString, "test", os.Stderr); !errors.Is(err, ErrUnsupportedBackendFormat) {
+		t.Fatalf("Expected ErrUnsupportedBackendFormat, took %v", err)
+	}
+
+	output := &bytes.Buffer{}
+	if _, err := SetBackend(LogrusBackendName, JsonFormatString, "test", output); err != nil {
+		t.Fatal(err)
+	}
+	log.Warningln("logrus entry")
+	if !bytes.Contains(output.Bytes(), []byte("logrus entry")) {
+		t.Fatal("Logrus backend should write entries to output")
+	}
+
+	output.Reset()
+	if _, err := SetBackend("stub", JsonFormatString, "test", output); err != nil {
+		t.Fatal(err)
+	}
+	log.SetLevel(log.InfoLevel)
+	log.WithField("key", "value").Warningln("backend entry")
+	log.Debugln("filtered entry")
+	if output.Len() != 0 {
+		t.Fatal("Entries of other backend shouldn't be written by logrus")
+	}
+	if len(backend.entries) != 1 {
+		t.Fatalf("Expected 1 entry, took %d", len(backend.entries))
+	}
+	entry := backend.entries[0]
+	if entry.Message != "backend entry" || entry.Level != log.WarnLevel || entry.Data["key"] != "value" {
+		t.Fatalf("Unexpected entry %v", entry)
+	}
+}
+
+// packetLogger returns entry with fields like ones logged per packet by proxies
+func packetLogger(logger *log.Logger) *log.Entry {
+	return log.NewEntry(logger).WithFields(log.Fields{
+		"session_id":      "6f8a92cb",
+		"client_id":       "client",
+		"proxy":           "client_side",
+		"packet_type":     "Q",
+		"packet_size":     1024,
+		FieldKeyEventCode: EventCodeGeneral,
+	})
+}
+
+func benchmarkLogger(b *testing.B, logger *log.Logger) {
+	entry := packetLogger(logger)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		entry.WithField("column_index", i).Debugln("Process column")
+	}
+}
+
+func newBenchmarkLogger(formatter log.Formatter, level log.Level) *log.Logger {
+	logger := log.New()
+	logger.SetFormatter(formatter)
+	logger.SetOutput(ioutil.Discard)
+	logger.SetLevel(level)
+	return logger
+}
+
+func BenchmarkLogrusDebugDisabled(b *testing.B) {
+	benchmarkLogger(b, newBenchmarkLogger(TextFormatter(), log.InfoLevel))
+}
+
+// BenchmarkLoggerDebugDisabled measures debug logging of hot paths which check level before adding fields
+func BenchmarkLoggerDebugDisabled(b *testing.B) {
+	logger := NewLogger(packetLogger(newBenchmarkLogger(TextFormatter(), log.InfoLevel)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if logger.DebugEnabled() {
+			logger.WithField("column_index", i).Debugln("Process column")
+		}
+	}
+}
+
+func BenchmarkLogrusTextFormatter(b *testing.B) {
+	benchmarkLogger(b, newBenchmarkLogger(TextFormatter(), log.DebugLevel))
+}
+
+func BenchmarkLogrusJSONFormatter(b *testing.B) {
+	formatter := JSONFormatter()
+	formatter.SetServiceName("benchmark")
+	benchmarkLogger(b, newBenchmarkLogger(formatter, log.DebugLevel))
+}
+
+func BenchmarkLogrusCEFFormatter(b *testing.B) {
+	formatter := CEFFormatter()
+	formatter.SetServiceName("benchmark")
+	benchmarkLogger(b, newBenchmarkLogger(formatter, log.DebugLevel))
+}
+
+// benchmarkBackend measures logging calls with entries written by backend
+func benchmarkBackend(b *testing.B, backend Backend) {
+	logger := newBenchmarkLogger(nopFormatter{}, log.DebugLevel)
+	logger.AddHook(&backendHook{backend: backend})
+	benchmarkLogger(b, logger)
+}
+
+func BenchmarkBackendHook(b *testing.B) {
+	benchmarkBackend(b, &nopBackend{})
+}
+
+// nopBackend drops entries to measure overhead of logrus calls without encoding
+type nopBackend struct{}
+
+func (*nopBackend) Write(*log.Entry) error {
+	return nil
+}
+
+func (*nopBackend) Sync() error {
+	return nil
+}
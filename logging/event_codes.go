@@ -21,6 +21,9 @@ const (
 	// 100 .. 200 some events
 	EventCodeGeneral = 100
 
+	// data retention audit
+	EventCodeRetentionAudit = 110
+
 	// 500 .. 600 errors
 	EventCodeErrorGeneral         = 500
 	EventCodeErrorWrongParam      = 501
@@ -38,6 +41,7 @@ const (
 	EventCodeErrorCantReadKeys                 = 511
 	EventCodeErrorCantLoadMasterKey            = 512
 	EventCodeErrorCantInitPrivateKeysEncryptor = 513
+	EventCodeErrorKeyIntegrityScanFailed       = 514
 
 	// system events
 	EventCodeErrorCantGetFileDescriptor     = 520
@@ -109,7 +113,8 @@ const (
 	EventCodeErrorHTTPAPICantDecryptAuthData = 593
 
 	// mysql processing
-	EventCodeErrorProtocolProcessing = 600
+	EventCodeErrorProtocolProcessing                = 600
+	EventCodeErrorProtocolUninspectableCapabilities = 601
 
 	// AcraTranslator
 	EventCodeErrorTranslatorCantHandleHTTPRequest       = 700
@@ -128,6 +133,8 @@ const (
 	EventCodeErrorTranslatorCantHandleGRPCConnection    = 713
 	EventCodeErrorTranslatorClientIDMissing             = 714
 	EventCodeErrorTranslatorCantAcceptNewGRPCConnection = 715
+	EventCodeErrorTranslatorQuotaExceeded               = 716
+	EventCodeErrorTranslatorIdempotencyKey              = 717
 
 	// tracing
 	EventCodeErrorTracingCantSendTrace    = 800
@@ -141,6 +148,16 @@ const (
 	EventCodeErrorDataEncryptorInitialization    = 902
 	EventCodeErrorEncryptorCantEncryptExpression = 903
 	EventCodeErrorCantEncryptData                = 904
+	EventCodeErrorEncryptorSchemaDrift           = 905
+	EventCodeErrorEncryptorContextConfusion      = 906
+	EventCodeErrorDecryptionOutsideSchedule      = 907
+	EventCodeErrorEncryptorStaleAcraStruct       = 908
+	EventCodeErrorEncryptorCantDecryptFPE        = 909
+	EventCodeErrorDecryptionPurposeNotAllowed    = 910
+	EventCodeErrorDecryptionPurposeSignature     = 911
+	EventCodeErrorEncryptorCantDecryptEmbedded   = 912
+	EventCodeErrorEncryptorTenantIsolation       = 913
+	EventCodeErrorEncryptorOversizedCiphertext   = 914
 
 	// metrics
 	EventCodeErrorPrometheusHTTPHandler       = 1000
@@ -166,4 +183,47 @@ const (
 	EventCodeErrorNetworkWrite      = 1300
 	EventCodeErrorNetworkFlush      = 1301
 	EventCodeErrorNetworkTLSGeneral = 1302
+
+	// decryption diagnostics
+	EventCodeErrorDecryptionDiagnostics = 1400
+
+	// notifications
+	EventCodeErrorNotificationDelivery = 1500
+	EventCodeErrorCertificateExpiry    = 1501
+
+	// data retention
+	EventCodeErrorRetentionJob = 1600
+
+	// shadow writes
+	EventCodeErrorShadowWrite = 1700
+
+	// audit export
+	EventCodeErrorAuditExport = 1800
+
+	// zone migration
+	EventCodeErrorZoneMigration = 1900
+
+	// access heatmap
+	EventCodeErrorAccessHeatmapExport = 2000
+
+	// token authentication
+	EventCodeErrorTokenAuthentication = 2100
+
+	// standby pair
+	EventCodeErrorStandbyPair = 2200
+
+	// random source
+	EventCodeErrorRandomSource            = 2300
+	EventCodeErrorRandomSourceHealthCheck = 2301
+
+	// canary decryption checks
+	EventCodeErrorCanaryCheck = 2400
+
+	// injection of database credentials
+	EventCodeErrorDatabaseCredentialsInjection = 2500
+	// export of client identity into database session
+	EventCodeErrorSessionIdentityExport = 2501
+
+	// sessions idle in transaction
+	EventCodeErrorIdleInTransaction = 2600
 )
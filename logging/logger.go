@@ -0,0 +1,99 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logging
+
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+// Logger is logging API of per-packet and per-column processing of proxies and decryptors. Entries are written with
+// formatter or Backend set by SetBackend. Debug entries of hot paths are logged only if DebugEnabled returns true, so
+// their fields aren't copied into new entries when debug level is disabled.
+type Logger interface {
+	// DebugEnabled returns true if debug entries are written
+	DebugEnabled() bool
+	WithField(key string, value interface{}) Logger
+	WithFields(fields log.Fields) Logger
+	WithError(err error) Logger
+	Debugln(args ...interface{})
+	Debugf(format string, args ...interface{})
+	Infoln(args ...interface{})
+	Warningln(args ...interface{})
+	Errorln(args ...interface{})
+	// Entry returns logrus entry of logger for functions which accept only it
+	Entry() *log.Entry
+}
+
+// entryLogger implements Logger with logrus entry, it's stored in interface without allocation
+type entryLogger struct {
+	entry *log.Entry
+}
+
+// NewLogger returns Logger which writes entries with fields of entry
+func NewLogger(entry *log.Entry) Logger {
+	return entryLogger{entry: entry}
+}
+
+// DebugEnabled returns true if level of logger of entry is debug
+func (logger entryLogger) DebugEnabled() bool {
+	return logger.entry.Logger.IsLevelEnabled(log.DebugLevel)
+}
+
+// WithField returns Logger with additional field
+func (logger entryLogger) WithField(key string, value interface{}) Logger {
+	return entryLogger{entry: logger.entry.WithField(key, value)}
+}
+
+// WithFields returns Logger with additional fields
+func (logger entryLogger) WithFields(fields log.Fields) Logger {
+	return entryLogger{entry: logger.entry.WithFields(fields)}
+}
+
+// WithError returns Logger with error field
+func (logger entryLogger) WithError(err error) Logger {
+	return entryLogger{entry: logger.entry.WithError(err)}
+}
+
+// Debugln logs entry at debug level
+func (logger entryLogger) Debugln(args ...interface{}) {
+	logger.entry.Debugln(args...)
+}
+
+// Debugf logs formatted entry at debug level
+func (logger entryLogger) Debugf(format string, args ...interface{}) {
+	logger.entry.Debugf(format, args...)
+}
+
+// Infoln logs entry at info level
+func (logger entryLogger) Infoln(args ...interface{}) {
+	logger.entry.Infoln(args...)
+}
+
+// Warningln logs entry at warning level
+func (logger entryLogger) Warningln(args ...interface{}) {
+	logger.entry.Warningln(args...)
+}
+
+// Errorln logs entry at error level
+func (logger entryLogger) Errorln(args ...interface{}) {
+	logger.entry.Errorln(args...)
+}
+
+// Entry returns wrapped logrus entry
+func (logger entryLogger) Entry() *log.Entry {
+	return logger.entry
+}
@@ -0,0 +1,51 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logging
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func TestLogger(t *testing.T) {
+	output := &bytes.Buffer{}
+	logrusLogger := log.New()
+	logrusLogger.SetOutput(output)
+	logrusLogger.SetFormatter(JSONFormatter())
+	logrusLogger.SetLevel(log.InfoLevel)
+	logger := NewLogger(log.NewEntry(logrusLogger)).WithField("client_id", "client")
+	if logger.DebugEnabled() {
+		t.Fatal("Debug shouldn't be enabled on info level")
+	}
+	logger.Debugln("filtered entry")
+	if output.Len() != 0 {
+		t.Fatal("Debug entry shouldn't be written on info level")
+	}
+	logger.WithError(errors.New("test error")).WithFields(log.Fields{"column_index": 1}).Warningln("entry")
+	for _, expected := range []string{`"client_id":"client"`, `"error":"test error"`, `"column_index":1`, `"msg":"entry"`} {
+		if !bytes.Contains(output.Bytes(), []byte(expected)) {
+			t.Fatalf("Expected %s in %s", expected, output.String())
+		}
+	}
+	logrusLogger.SetLevel(log.DebugLevel)
+	if !logger.DebugEnabled() || logger.Entry().Data["client_id"] != "client" {
+		t.Fatal("Debug should be enabled on debug level")
+	}
+}
@@ -0,0 +1,106 @@
+//go:build zap
+// +build zap
+
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logging
+
+import (
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/cossacklabs/acra/utils"
+	log "github.com/sirupsen/logrus"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+func init() {
+	RegisterBackend(ZapBackendName, newZapBackend)
+}
+
+// zapBackend encodes entries with zap encoders which don't allocate for every field
+type zapBackend struct {
+	core zapcore.Core
+}
+
+// newZapBackend returns backend which writes plaintext or json entries with the same keys as formatters of package
+func newZapBackend(format, serviceName string, output io.Writer) (Backend, error) {
+	encoderConfig := zap.NewProductionEncoderConfig()
+	encoderConfig.TimeKey = JSONFieldMap[log.FieldKeyTime]
+	encoderConfig.MessageKey = JSONFieldMap[log.FieldKeyMsg]
+	encoderConfig.LevelKey = JSONFieldMap[log.FieldKeyLevel]
+	encoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
+	var encoder zapcore.Encoder
+	switch format {
+	case JsonFormatString:
+		encoder = zapcore.NewJSONEncoder(encoderConfig)
+	case PlaintextFormatString, "":
+		encoder = zapcore.NewConsoleEncoder(encoderConfig)
+	default:
+		return nil, fmt.Errorf("%w: %s by %s", ErrUnsupportedBackendFormat, format, ZapBackendName)
+	}
+	// levels are filtered by logrus before entries reach backend
+	core := zapcore.NewCore(encoder, zapcore.AddSync(output), zapcore.DebugLevel).With([]zapcore.Field{
+		zap.String(FieldKeyProduct, serviceName),
+		zap.String(FieldKeyVersion, utils.VERSION),
+	})
+	return &zapBackend{core: core}, nil
+}
+
+// zapLevel returns zap level of logrus level
+func zapLevel(level log.Level) zapcore.Level {
+	switch level {
+	case log.PanicLevel:
+		return zapcore.PanicLevel
+	case log.FatalLevel:
+		return zapcore.FatalLevel
+	case log.ErrorLevel:
+		return zapcore.ErrorLevel
+	case log.WarnLevel:
+		return zapcore.WarnLevel
+	case log.InfoLevel:
+		return zapcore.InfoLevel
+	default:
+		return zapcore.DebugLevel
+	}
+}
+
+// Write encodes entry with fields sorted by key. Logrus exits or panics after fatal and panic entries itself.
+func (backend *zapBackend) Write(entry *log.Entry) error {
+	checked := backend.core.Check(zapcore.Entry{Level: zapLevel(entry.Level), Time: entry.Time, Message: entry.Message}, nil)
+	if checked == nil {
+		return nil
+	}
+	keys := make([]string, 0, len(entry.Data))
+	for key := range entry.Data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	fields := make([]zapcore.Field, len(keys))
+	for i, key := range keys {
+		fields[i] = zap.Any(key, entry.Data[key])
+	}
+	checked.Write(fields...)
+	return nil
+}
+
+// Sync flushes buffered entries of output
+func (backend *zapBackend) Sync() error {
+	return backend.core.Sync()
+}
@@ -0,0 +1,80 @@
+//go:build zap
+// +build zap
+
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func TestZapBackend(t *testing.T) {
+	defer restoreStandardLogger()()
+	if _, err := SetBackend(ZapBackendName, CefFormatString, "test", ioutil.Discard); !errors.Is(err, ErrUnsupportedBackendFormat) {
+		t.Fatalf("Expected ErrUnsupportedBackendFormat, took %v", err)
+	}
+	output := &bytes.Buffer{}
+	backend, err := SetBackend(ZapBackendName, JsonFormatString, "test", output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log.SetLevel(log.InfoLevel)
+	log.WithField("key", "value").WithError(errors.New("some error")).Warningln("zap entry")
+	log.Debugln("filtered entry")
+	if err := backend.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	entry := map[string]interface{}{}
+	if err := json.Unmarshal(output.Bytes(), &entry); err != nil {
+		t.Fatalf("Expected one JSON entry, took %s: %v", output.Bytes(), err)
+	}
+	expected := map[string]interface{}{
+		"msg":           "zap entry",
+		"level":         "warn",
+		"key":           "value",
+		"error":         "some error",
+		FieldKeyProduct: "test",
+	}
+	for key, value := range expected {
+		if entry[key] != value {
+			t.Fatalf("Expected %s=%v, took %v", key, value, entry[key])
+		}
+	}
+}
+
+func BenchmarkZapJSONBackend(b *testing.B) {
+	backend, err := newZapBackend(JsonFormatString, "benchmark", ioutil.Discard)
+	if err != nil {
+		b.Fatal(err)
+	}
+	benchmarkBackend(b, backend)
+}
+
+func BenchmarkZapConsoleBackend(b *testing.B) {
+	backend, err := newZapBackend(PlaintextFormatString, "benchmark", ioutil.Discard)
+	if err != nil {
+		b.Fatal(err)
+	}
+	benchmarkBackend(b, backend)
+}
@@ -17,6 +17,7 @@ limitations under the License.
 package network
 
 import (
+	"context"
 	"crypto/x509"
 	"errors"
 	log "github.com/sirupsen/logrus"
@@ -30,38 +31,21 @@ var (
 
 // CertVerifier is a generic certificate verifier
 type CertVerifier interface {
-	// Verify checks whether the certificate is revoked.
+	// Verify checks whether the certificate is revoked or shouldn't be accepted for other reasons.
 	// The error is returned if:
 	// - the certificate was revoked
 	// - (for OCSP) the certificate is not known by OCSP server and we requested tls_ocsp_required == "yes" or "all"
 	// - (for OCSP) if we were unable to contact OCSP server(s) but we really need the response, tls_ocsp_required == "all"
-	Verify(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error
+	// - (for allowlist) the certificate isn't in allowlist
+	// - (for script) verifier script exited with non-zero code
+	// - ctx was cancelled before verification finished
+	Verify(ctx context.Context, rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error
 }
 
-// NewCertVerifierFromConfigs creates a CertVerifier based on passed OCSP and CRL configs
+// NewCertVerifierFromConfigs creates a CertVerifier based on passed OCSP and CRL configs, which requires both OCSP
+// and CRL checks (if enabled) to pass
 func NewCertVerifierFromConfigs(ocspConfig *OCSPConfig, crlConfig *CRLConfig) (CertVerifier, error) {
-	certVerifier := NewCertVerifierAll()
-
-	if ocspConfig.UseOCSP() {
-		log.Debugln("NewCertVerifierFromConfigs(): adding OCSP verifier")
-		ocspVerifier := DefaultOCSPVerifier{
-			Config: *ocspConfig,
-			Client: NewDefaultOCSPClient(),
-		}
-		certVerifier.Push(ocspVerifier)
-	}
-
-	if crlConfig.UseCRL() {
-		log.Debugln("NewCertVerifierFromConfigs(): adding CRL verifier")
-		crlVerifier := DefaultCRLVerifier{
-			Config: *crlConfig,
-			Client: NewDefaultCRLClient(),
-			Cache:  NewLRUCRLCache(crlConfig.cacheSize),
-		}
-		certVerifier.Push(crlVerifier)
-	}
-
-	return certVerifier, nil
+	return NewCompositeVerifierFromConfigs(DefaultCompositeVerifierConfig(), ocspConfig, crlConfig)
 }
 
 // CertVerifierAll is an implementation of CertVerifier that requires all verifiers to return success
@@ -80,9 +64,12 @@ func (v *CertVerifierAll) Push(verifier CertVerifier) {
 }
 
 // Verify returns number of confirmations or error
-func (v CertVerifierAll) Verify(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+func (v CertVerifierAll) Verify(ctx context.Context, rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
 	for _, verifier := range v.verifiers {
-		err := verifier.Verify(rawCerts, verifiedChains)
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		err := verifier.Verify(ctx, rawCerts, verifiedChains)
 		if err != nil {
 			log.WithError(err).Debugln("Certificate verification failed")
 			return err
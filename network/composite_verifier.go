@@ -0,0 +1,319 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package network
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Names of verifiers accepted by tls_verifiers
+const (
+	CertVerifierOCSP      = "ocsp"
+	CertVerifierCRL       = "crl"
+	CertVerifierAllowlist = "allowlist"
+	CertVerifierScript    = "script"
+)
+
+// CertVerifierNamesList contains all names of verifiers accepted by tls_verifiers
+var CertVerifierNamesList = []string{CertVerifierOCSP, CertVerifierCRL, CertVerifierAllowlist, CertVerifierScript}
+
+// Combination modes of CompositeVerifier accepted by tls_verifiers_mode
+const (
+	// CertVerifierModeAll requires all verifiers to accept the certificate
+	CertVerifierModeAll = "all"
+	// CertVerifierModeAny requires at least one verifier to accept the certificate
+	CertVerifierModeAny = "any"
+)
+
+// DefaultCertVerifiers is default value of tls_verifiers, revocation is checked like before verifiers were
+// configurable
+const DefaultCertVerifiers = CertVerifierOCSP + "," + CertVerifierCRL
+
+// Errors returned by CompositeVerifier and its verifiers
+var (
+	ErrInvalidConfigCertVerifier     = errors.New("invalid `tls_verifiers` value")
+	ErrInvalidConfigCertVerifierMode = errors.New("invalid `tls_verifiers_mode` value")
+	ErrInvalidConfigCertAllowlist    = errors.New("invalid certificate allowlist")
+	ErrCertNotAllowed                = errors.New("certificate isn't in allowlist")
+	ErrCertRejectedByScript          = errors.New("certificate was rejected by verifier script")
+	ErrCertVerifiersNoneAccepted     = errors.New("none of certificate verifiers accepted the certificate")
+)
+
+// CompositeVerifierConfig describes which verifiers CompositeVerifier runs and how their results are combined
+type CompositeVerifierConfig struct {
+	// Verifiers are names of verifiers in order they run
+	Verifiers []string
+	Mode      string
+	// AllowlistPath is path to file used by allowlist verifier
+	AllowlistPath string
+	// ScriptPath is path to executable used by script verifier
+	ScriptPath string
+}
+
+// DefaultCompositeVerifierConfig returns config which checks revocation with OCSP and CRL
+func DefaultCompositeVerifierConfig() CompositeVerifierConfig {
+	config, _ := NewCompositeVerifierConfig(DefaultCertVerifiers, CertVerifierModeAll, "", "")
+	return config
+}
+
+// NewCompositeVerifierConfig parses comma-separated list of verifiers and validates that files required by them are
+// passed
+func NewCompositeVerifierConfig(verifiers, mode, allowlistPath, scriptPath string) (CompositeVerifierConfig, error) {
+	if mode != CertVerifierModeAll && mode != CertVerifierModeAny {
+		return CompositeVerifierConfig{}, ErrInvalidConfigCertVerifierMode
+	}
+	config := CompositeVerifierConfig{Mode: mode, AllowlistPath: allowlistPath, ScriptPath: scriptPath}
+	seen := make(map[string]bool)
+	for _, name := range strings.Split(verifiers, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		known := false
+		for _, knownName := range CertVerifierNamesList {
+			known = known || name == knownName
+		}
+		if !known || seen[name] {
+			return CompositeVerifierConfig{}, fmt.Errorf("%w: unknown or repeated verifier '%s'", ErrInvalidConfigCertVerifier, name)
+		}
+		if name == CertVerifierAllowlist && allowlistPath == "" {
+			return CompositeVerifierConfig{}, fmt.Errorf("%w: allowlist verifier requires `tls_cert_allowlist_file`", ErrInvalidConfigCertVerifier)
+		}
+		if name == CertVerifierScript && scriptPath == "" {
+			return CompositeVerifierConfig{}, fmt.Errorf("%w: script verifier requires `tls_verifier_script`", ErrInvalidConfigCertVerifier)
+		}
+		seen[name] = true
+		config.Verifiers = append(config.Verifiers, name)
+	}
+	return config, nil
+}
+
+// namedCertVerifier is verifier of CompositeVerifier with name used in logs
+type namedCertVerifier struct {
+	name     string
+	verifier CertVerifier
+}
+
+// CompositeVerifier is CertVerifier which runs ordered list of verifiers against the peer's certificates and
+// combines their results: in CertVerifierModeAll it stops on first rejection, in CertVerifierModeAny on first
+// acceptance.
+type CompositeVerifier struct {
+	verifiers []namedCertVerifier
+	mode      string
+}
+
+// NewCompositeVerifier creates CompositeVerifier without verifiers, which accepts any certificate
+func NewCompositeVerifier(mode string) (*CompositeVerifier, error) {
+	if mode != CertVerifierModeAll && mode != CertVerifierModeAny {
+		return nil, ErrInvalidConfigCertVerifierMode
+	}
+	return &CompositeVerifier{mode: mode}, nil
+}
+
+// Add appends verifier to the end of the list
+func (v *CompositeVerifier) Add(name string, verifier CertVerifier) {
+	v.verifiers = append(v.verifiers, namedCertVerifier{name: name, verifier: verifier})
+}
+
+// Verify runs verifiers in order and combines their results according to mode
+func (v *CompositeVerifier) Verify(ctx context.Context, rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	var rejections []string
+	var firstErr error
+	for _, verifier := range v.verifiers {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		err := verifier.verifier.Verify(ctx, rawCerts, verifiedChains)
+		if err == nil {
+			if v.mode == CertVerifierModeAny {
+				log.WithField("verifier", verifier.name).Debugln("Certificate accepted by verifier")
+				return nil
+			}
+			continue
+		}
+		log.WithError(err).WithField("verifier", verifier.name).Debugln("Certificate verification failed")
+		if v.mode == CertVerifierModeAll {
+			return err
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		rejections = append(rejections, fmt.Sprintf("%s: %s", verifier.name, err))
+	}
+	if firstErr != nil {
+		// first error is wrapped, so errors.Is() still recognizes e.g. revoked certificates
+		return fmt.Errorf("%w (%s): %s", firstErr, ErrCertVerifiersNoneAccepted, strings.Join(rejections, "; "))
+	}
+	return nil
+}
+
+// NewCompositeVerifierFromConfigs creates CompositeVerifier with verifiers listed in config. OCSP and CRL verifiers
+// are skipped if their configs don't enable them.
+func NewCompositeVerifierFromConfigs(config CompositeVerifierConfig, ocspConfig *OCSPConfig, crlConfig *CRLConfig) (CertVerifier, error) {
+	composite, err := NewCompositeVerifier(config.Mode)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range config.Verifiers {
+		switch name {
+		case CertVerifierOCSP:
+			if !ocspConfig.UseOCSP() {
+				continue
+			}
+			log.Debugln("NewCompositeVerifierFromConfigs(): adding OCSP verifier")
+			composite.Add(name, DefaultOCSPVerifier{
+				Config: *ocspConfig,
+				Client: ocspConfig.Client(),
+			})
+		case CertVerifierCRL:
+			if !crlConfig.UseCRL() {
+				continue
+			}
+			log.Debugln("NewCompositeVerifierFromConfigs(): adding CRL verifier")
+			composite.Add(name, DefaultCRLVerifier{
+				Config: *crlConfig,
+				Client: NewDefaultCRLClient(),
+				Cache:  NewLRUCRLCache(crlConfig.cacheSize),
+			})
+		case CertVerifierAllowlist:
+			allowlist, err := LoadAllowlistCertVerifier(config.AllowlistPath)
+			if err != nil {
+				return nil, err
+			}
+			log.WithField("path", config.AllowlistPath).Debugln("NewCompositeVerifierFromConfigs(): adding allowlist verifier")
+			composite.Add(name, allowlist)
+		case CertVerifierScript:
+			log.WithField("path", config.ScriptPath).Debugln("NewCompositeVerifierFromConfigs(): adding script verifier")
+			composite.Add(name, NewScriptCertVerifier(config.ScriptPath))
+		default:
+			return nil, fmt.Errorf("%w: unknown verifier '%s'", ErrInvalidConfigCertVerifier, name)
+		}
+	}
+	return composite, nil
+}
+
+// AllowlistCertVerifier accepts only peers whose leaf certificate has SHA-256 fingerprint from allowlist
+type AllowlistCertVerifier struct {
+	fingerprints map[string]bool
+}
+
+// certificateFingerprint returns hex SHA-256 of DER-encoded certificate
+func certificateFingerprint(rawCert []byte) string {
+	hash := sha256.Sum256(rawCert)
+	return hex.EncodeToString(hash[:])
+}
+
+// NewAllowlistCertVerifier creates AllowlistCertVerifier with hex SHA-256 fingerprints of allowed certificates,
+// bytes of fingerprint may be separated by colons like in `openssl x509 -fingerprint -sha256` output
+func NewAllowlistCertVerifier(fingerprints []string) (AllowlistCertVerifier, error) {
+	verifier := AllowlistCertVerifier{fingerprints: make(map[string]bool, len(fingerprints))}
+	for _, fingerprint := range fingerprints {
+		normalized := strings.ToLower(strings.Replace(fingerprint, ":", "", -1))
+		if decoded, err := hex.DecodeString(normalized); err != nil || len(decoded) != sha256.Size {
+			return AllowlistCertVerifier{}, fmt.Errorf("%w: '%s' isn't SHA-256 fingerprint", ErrInvalidConfigCertAllowlist, fingerprint)
+		}
+		verifier.fingerprints[normalized] = true
+	}
+	return verifier, nil
+}
+
+// LoadAllowlistCertVerifier creates AllowlistCertVerifier with fingerprints read from file, one per line. Empty
+// lines and lines starting with '#' are ignored.
+func LoadAllowlistCertVerifier(path string) (AllowlistCertVerifier, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return AllowlistCertVerifier{}, err
+	}
+	defer file.Close()
+	var fingerprints []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fingerprints = append(fingerprints, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return AllowlistCertVerifier{}, err
+	}
+	return NewAllowlistCertVerifier(fingerprints)
+}
+
+// Verify accepts the peer if fingerprint of its certificate is in allowlist
+func (v AllowlistCertVerifier) Verify(ctx context.Context, rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return ErrEmptyCertChain
+	}
+	fingerprint := certificateFingerprint(rawCerts[0])
+	if !v.fingerprints[fingerprint] {
+		log.WithField("certificate_sha256", fingerprint).Warnln("Certificate isn't in allowlist")
+		return ErrCertNotAllowed
+	}
+	return nil
+}
+
+// ScriptCertVerifier runs external executable to verify the peer. The executable reads PEM-encoded certificates
+// sent by the peer, leaf one first, from stdin and accepts the peer with zero exit code. It's killed when ctx is done.
+type ScriptCertVerifier struct {
+	path string
+}
+
+// NewScriptCertVerifier creates ScriptCertVerifier which runs executable at path
+func NewScriptCertVerifier(path string) ScriptCertVerifier {
+	return ScriptCertVerifier{path: path}
+}
+
+// Verify runs the script with peer's certificates in stdin
+func (v ScriptCertVerifier) Verify(ctx context.Context, rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return ErrEmptyCertChain
+	}
+	input := &bytes.Buffer{}
+	for _, rawCert := range rawCerts {
+		if err := pem.Encode(input, &pem.Block{Type: "CERTIFICATE", Bytes: rawCert}); err != nil {
+			return err
+		}
+	}
+	command := exec.CommandContext(ctx, v.path)
+	command.Stdin = input
+	output, err := command.CombinedOutput()
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	if err != nil {
+		if _, ok := err.(*exec.ExitError); !ok {
+			// script couldn't be started at all
+			return err
+		}
+		return fmt.Errorf("%w: %s: %s", ErrCertRejectedByScript, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
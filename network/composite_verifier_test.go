@@ -0,0 +1,198 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package network
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testCertVerifier returns configured error and counts calls
+type testCertVerifier struct {
+	err   error
+	calls int
+}
+
+func (v *testCertVerifier) Verify(ctx context.Context, rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	v.calls++
+	return v.err
+}
+
+func TestNewCompositeVerifierConfig(t *testing.T) {
+	config, err := NewCompositeVerifierConfig(" crl, ocsp ,allowlist", CertVerifierModeAny, "allowlist.txt", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(config.Verifiers, ",") != "crl,ocsp,allowlist" {
+		t.Fatalf("Unexpected order of verifiers: %v", config.Verifiers)
+	}
+	if config := DefaultCompositeVerifierConfig(); strings.Join(config.Verifiers, ",") != DefaultCertVerifiers || config.Mode != CertVerifierModeAll {
+		t.Fatalf("Unexpected default config: %v", config)
+	}
+	for _, testcase := range []struct {
+		verifiers, mode string
+		expected        error
+	}{
+		{"ocsp", "one", ErrInvalidConfigCertVerifierMode},
+		{"ocsp,unknown", CertVerifierModeAll, ErrInvalidConfigCertVerifier},
+		{"ocsp,ocsp", CertVerifierModeAll, ErrInvalidConfigCertVerifier},
+		// files of verifiers aren't set
+		{"allowlist", CertVerifierModeAll, ErrInvalidConfigCertVerifier},
+		{"script", CertVerifierModeAll, ErrInvalidConfigCertVerifier},
+	} {
+		if _, err := NewCompositeVerifierConfig(testcase.verifiers, testcase.mode, "", ""); !errors.Is(err, testcase.expected) {
+			t.Fatalf("[%s] Expected %v, took %v", testcase.verifiers, testcase.expected, err)
+		}
+	}
+}
+
+func TestCompositeVerifier(t *testing.T) {
+	revoked := &testCertVerifier{err: ErrCertWasRevoked}
+	failed := &testCertVerifier{err: errors.New("unavailable")}
+	accepted := &testCertVerifier{}
+
+	allVerifier, err := NewCompositeVerifier(CertVerifierModeAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	allVerifier.Add("accepted", accepted)
+	allVerifier.Add("revoked", revoked)
+	allVerifier.Add("failed", failed)
+	if err := allVerifier.Verify(context.Background(), nil, nil); err != ErrCertWasRevoked {
+		t.Fatalf("Expected ErrCertWasRevoked, took %v", err)
+	}
+	if accepted.calls != 1 || revoked.calls != 1 || failed.calls != 0 {
+		t.Fatal("Verifiers after first rejection are called in 'all' mode")
+	}
+
+	anyVerifier, err := NewCompositeVerifier(CertVerifierModeAny)
+	if err != nil {
+		t.Fatal(err)
+	}
+	anyVerifier.Add("revoked", revoked)
+	anyVerifier.Add("failed", failed)
+	if err := anyVerifier.Verify(context.Background(), nil, nil); !errors.Is(err, ErrCertWasRevoked) || !strings.Contains(err.Error(), "failed: unavailable") {
+		t.Fatalf("Expected ErrCertWasRevoked with all rejections, took %v", err)
+	}
+	anyVerifier.Add("accepted", accepted)
+	anyVerifier.Add("unreachable", failed)
+	failed.calls = 0
+	if err := anyVerifier.Verify(context.Background(), nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if failed.calls != 1 {
+		t.Fatal("Verifiers after first acceptance are called in 'any' mode")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := anyVerifier.Verify(ctx, nil, nil); err != context.Canceled {
+		t.Fatalf("Expected context.Canceled, took %v", err)
+	}
+	if _, err := NewCompositeVerifier("none"); err != ErrInvalidConfigCertVerifierMode {
+		t.Fatalf("Expected ErrInvalidConfigCertVerifierMode, took %v", err)
+	}
+}
+
+func TestAllowlistCertVerifier(t *testing.T) {
+	rawCerts, _ := getValidTestChain(t)
+	fingerprint := certificateFingerprint(rawCerts[0])
+	// openssl-like format with colons and upper case
+	var colonSeparated []string
+	for i := 0; i < len(fingerprint); i += 2 {
+		colonSeparated = append(colonSeparated, strings.ToUpper(fingerprint[i:i+2]))
+	}
+
+	dir, err := ioutil.TempDir("", "allowlist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "allowlist.txt")
+	content := "# allowed clients\n\n" + strings.Join(colonSeparated, ":") + "\n"
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	verifier, err := LoadAllowlistCertVerifier(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verifier.Verify(context.Background(), rawCerts, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifier.Verify(context.Background(), rawCerts[1:], nil); err != ErrCertNotAllowed {
+		t.Fatalf("Expected ErrCertNotAllowed, took %v", err)
+	}
+	if err := verifier.Verify(context.Background(), nil, nil); err != ErrEmptyCertChain {
+		t.Fatalf("Expected ErrEmptyCertChain, took %v", err)
+	}
+	if _, err := NewAllowlistCertVerifier([]string{"abcd"}); !errors.Is(err, ErrInvalidConfigCertAllowlist) {
+		t.Fatalf("Expected ErrInvalidConfigCertAllowlist, took %v", err)
+	}
+
+	// allowlist combined with disabled OCSP and CRL
+	config, err := NewCompositeVerifierConfig("ocsp,crl,allowlist", CertVerifierModeAll, path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ocspConfig, err := NewOCSPConfig("", OcspRequiredAllowUnknownStr, OcspFromCertIgnoreStr, false, OcspHttpClientDefaultTimeout, OcspDefaultVerifyTimeout, DefaultOCSPClientConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	crlConfig, err := NewCRLConfig("", CrlFromCertIgnoreStr, false, CrlDefaultCacheSize, CrlDisableCacheTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	composite, err := NewCompositeVerifierFromConfigs(config, ocspConfig, crlConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := composite.Verify(context.Background(), rawCerts[1:], nil); err != ErrCertNotAllowed {
+		t.Fatalf("Expected ErrCertNotAllowed, took %v", err)
+	}
+}
+
+func TestScriptCertVerifier(t *testing.T) {
+	rawCerts, _ := getValidTestChain(t)
+	dir, err := ioutil.TempDir("", "verifier_script")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// accepts chains of two certificates
+	path := filepath.Join(dir, "verify.sh")
+	script := "#!/bin/sh\ncount=$(grep -c 'BEGIN CERTIFICATE')\nif [ \"$count\" != 2 ]; then echo \"got $count certificates\"; exit 1; fi\n"
+	if err := ioutil.WriteFile(path, []byte(script), 0700); err != nil {
+		t.Fatal(err)
+	}
+	verifier := NewScriptCertVerifier(path)
+	if err := verifier.Verify(context.Background(), rawCerts[:2], nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifier.Verify(context.Background(), rawCerts[:1], nil); !errors.Is(err, ErrCertRejectedByScript) || !strings.Contains(err.Error(), "got 1 certificates") {
+		t.Fatalf("Expected ErrCertRejectedByScript with output, took %v", err)
+	}
+	if err := NewScriptCertVerifier(filepath.Join(dir, "missing.sh")).Verify(context.Background(), rawCerts, nil); err == nil || errors.Is(err, ErrCertRejectedByScript) {
+		t.Fatalf("Expected error of missing script, took %v", err)
+	}
+}
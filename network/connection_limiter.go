@@ -0,0 +1,184 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package network
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/golang/groupcache/lru"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Errors returned when new connection exceeds limits
+var (
+	ErrTooManyConnections     = errors.New("too many concurrent connections")
+	ErrConnectionRateExceeded = errors.New("connection rate of client address exceeded")
+	ErrHandshakeRateExceeded  = errors.New("handshake rate exceeded")
+)
+
+// Labels and values of rejected connections
+const (
+	RejectedConnectionReasonLabel          = "reason"
+	RejectedConnectionReasonMaxConnections = "max_connections"
+	RejectedConnectionReasonAddressRate    = "address_rate"
+	RejectedConnectionReasonHandshakeRate  = "handshake_rate"
+)
+
+// connectionRateAddressesCacheSize limits count of client addresses which connection rate is tracked, the least
+// recently connected ones are forgotten
+const connectionRateAddressesCacheSize = 65536
+
+// RejectedConnectionsCounter collects count of connections rejected by ConnectionLimiter by reason
+var RejectedConnectionsCounter = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "acra_rejected_connections_total",
+		Help: "number of connections rejected due to connection limits, by reason",
+	}, []string{RejectedConnectionReasonLabel})
+
+var connectionLimiterRegisterLock = sync.Once{}
+
+// RegisterConnectionLimiterMetrics register in default prometheus registry metrics related with connection limits
+func RegisterConnectionLimiterMetrics() {
+	connectionLimiterRegisterLock.Do(func() {
+		prometheus.MustRegister(RejectedConnectionsCounter)
+	})
+}
+
+// ConnectionLimits configures ConnectionLimiter. Zero values mean no limit.
+type ConnectionLimits struct {
+	// MaxConnections limits count of concurrent connections
+	MaxConnections int
+	// AddressRate limits new connections per second from one IP address
+	AddressRate float64
+	// HandshakeRate limits new connections per second which start handshakes, from all addresses
+	HandshakeRate float64
+}
+
+// Enabled returns true if any limit is configured
+func (limits ConnectionLimits) Enabled() bool {
+	return limits != ConnectionLimits{}
+}
+
+// tokenBucket allows rate events per second with bursts up to rate, but at least one event
+type tokenBucket struct {
+	tokens     float64
+	lastRefill time.Time
+}
+
+// tokenBucketCapacity returns max count of tokens of bucket with rate
+func tokenBucketCapacity(rate float64) float64 {
+	if rate < 1 {
+		return 1
+	}
+	return rate
+}
+
+// newTokenBucket returns full bucket
+func newTokenBucket(rate float64, now time.Time) *tokenBucket {
+	return &tokenBucket{tokens: tokenBucketCapacity(rate), lastRefill: now}
+}
+
+// take refills bucket and takes token if it's available
+func (bucket *tokenBucket) take(rate float64, now time.Time) bool {
+	capacity := tokenBucketCapacity(rate)
+	bucket.tokens += now.Sub(bucket.lastRefill).Seconds() * rate
+	if bucket.tokens > capacity {
+		bucket.tokens = capacity
+	}
+	bucket.lastRefill = now
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// ConnectionLimiter protects from connection floods by limiting concurrent connections, rate of connections from one
+// IP address and rate of handshakes. It is safe for concurrent use.
+type ConnectionLimiter struct {
+	limits     ConnectionLimits
+	lock       sync.Mutex
+	active     int
+	addresses  *lru.Cache
+	handshakes *tokenBucket
+	now        func() time.Time
+}
+
+// NewConnectionLimiter returns ConnectionLimiter which enforces limits
+func NewConnectionLimiter(limits ConnectionLimits) *ConnectionLimiter {
+	now := time.Now
+	return &ConnectionLimiter{
+		limits:     limits,
+		addresses:  lru.New(connectionRateAddressesCacheSize),
+		handshakes: newTokenBucket(limits.HandshakeRate, now()),
+		now:        now,
+	}
+}
+
+// addressKey returns IP address of TCP connections or whole address of others
+func addressKey(addr net.Addr) string {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP.String()
+	}
+	return addr.String()
+}
+
+// Acquire registers new connection from addr and returns function which releases it after connection is closed, or
+// error if connection exceeds limits. Nil ConnectionLimiter allows all connections.
+func (limiter *ConnectionLimiter) Acquire(addr net.Addr) (func(), error) {
+	if limiter == nil {
+		return func() {}, nil
+	}
+	now := limiter.now()
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+	if limiter.limits.MaxConnections > 0 && limiter.active >= limiter.limits.MaxConnections {
+		RejectedConnectionsCounter.WithLabelValues(RejectedConnectionReasonMaxConnections).Inc()
+		return nil, ErrTooManyConnections
+	}
+	if limiter.limits.AddressRate > 0 && addr != nil {
+		key := addressKey(addr)
+		var bucket *tokenBucket
+		if value, ok := limiter.addresses.Get(key); ok {
+			bucket = value.(*tokenBucket)
+		} else {
+			bucket = newTokenBucket(limiter.limits.AddressRate, now)
+			limiter.addresses.Add(key, bucket)
+		}
+		if !bucket.take(limiter.limits.AddressRate, now) {
+			RejectedConnectionsCounter.WithLabelValues(RejectedConnectionReasonAddressRate).Inc()
+			return nil, ErrConnectionRateExceeded
+		}
+	}
+	// handshake is checked last, so connections rejected by other limits don't spend tokens of other clients
+	if limiter.limits.HandshakeRate > 0 && !limiter.handshakes.take(limiter.limits.HandshakeRate, now) {
+		RejectedConnectionsCounter.WithLabelValues(RejectedConnectionReasonHandshakeRate).Inc()
+		return nil, ErrHandshakeRateExceeded
+	}
+	limiter.active++
+	once := sync.Once{}
+	return func() {
+		once.Do(func() {
+			limiter.lock.Lock()
+			limiter.active--
+			limiter.lock.Unlock()
+		})
+	}, nil
+}
@@ -0,0 +1,97 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package network
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestConnectionLimiter(t *testing.T) {
+	var nilLimiter *ConnectionLimiter
+	if release, err := nilLimiter.Acquire(nil); err != nil {
+		t.Fatal(err)
+	} else {
+		release()
+	}
+	if (ConnectionLimits{}).Enabled() {
+		t.Fatal("Expected limits without values to be disabled")
+	}
+
+	now := time.Now()
+	clientA := &net.TCPAddr{IP: net.ParseIP("192.168.0.1"), Port: 50001}
+	clientB := &net.TCPAddr{IP: net.ParseIP("192.168.0.2"), Port: 50001}
+
+	limiter := NewConnectionLimiter(ConnectionLimits{MaxConnections: 2})
+	releaseFirst, err := limiter.Acquire(clientA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := limiter.Acquire(clientB); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := limiter.Acquire(clientB); err != ErrTooManyConnections {
+		t.Fatalf("Expected ErrTooManyConnections, took %v", err)
+	}
+	// released connection frees place only once
+	releaseFirst()
+	releaseFirst()
+	if _, err := limiter.Acquire(clientB); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := limiter.Acquire(clientB); err != ErrTooManyConnections {
+		t.Fatalf("Expected ErrTooManyConnections, took %v", err)
+	}
+
+	limiter = NewConnectionLimiter(ConnectionLimits{AddressRate: 2})
+	limiter.now = func() time.Time { return now }
+	for i := 0; i < 2; i++ {
+		// ports of the same IP share rate
+		if _, err := limiter.Acquire(&net.TCPAddr{IP: clientA.IP, Port: 50000 + i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := limiter.Acquire(clientA); err != ErrConnectionRateExceeded {
+		t.Fatalf("Expected ErrConnectionRateExceeded, took %v", err)
+	}
+	if _, err := limiter.Acquire(clientB); err != nil {
+		t.Fatal(err)
+	}
+	limiter.now = func() time.Time { return now.Add(time.Millisecond * 500) }
+	if _, err := limiter.Acquire(clientA); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := limiter.Acquire(clientA); err != ErrConnectionRateExceeded {
+		t.Fatalf("Expected ErrConnectionRateExceeded, took %v", err)
+	}
+
+	// rates less than one connection per second still allow one connection
+	limiter = NewConnectionLimiter(ConnectionLimits{HandshakeRate: 0.5})
+	limiter.handshakes.lastRefill = now
+	limiter.now = func() time.Time { return now }
+	if _, err := limiter.Acquire(clientA); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := limiter.Acquire(clientB); err != ErrHandshakeRateExceeded {
+		t.Fatalf("Expected ErrHandshakeRateExceeded, took %v", err)
+	}
+	limiter.now = func() time.Time { return now.Add(time.Second * 2) }
+	if _, err := limiter.Acquire(clientB); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -17,6 +17,7 @@ limitations under the License.
 package network
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
@@ -473,8 +474,11 @@ func (v DefaultCRLVerifier) verifyCertWithIssuer(cert, issuer *x509.Certificate,
 }
 
 // Verify ensures configured CRLs do not contain certificate from passed chain
-func (v DefaultCRLVerifier) Verify(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+func (v DefaultCRLVerifier) Verify(ctx context.Context, rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
 	for _, chain := range verifiedChains {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		if len(chain) == 0 {
 			switch v.Config.ClientAuthType {
 			case tls.NoClientCert, tls.RequestClientCert, tls.RequireAnyClientCert:
@@ -495,6 +499,10 @@ func (v DefaultCRLVerifier) Verify(rawCerts [][]byte, verifiedChains [][]*x509.C
 			cert := chain[i]
 			issuer := chain[i+1]
 
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
 			// 3rd argument, useConfigURL, whether to use OCSP server URL from configuration (if set),
 			// don't use it for other certificates except end one (i.e. don't use it when checking intermediate
 			// certificates because v.Config.checkOnlyLeafCertificate == false)
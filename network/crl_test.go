@@ -18,6 +18,7 @@ package network
 
 import (
 	"bytes"
+	"context"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
@@ -487,7 +488,7 @@ func testDefaultCRLVerifierWithGroupValid(t *testing.T, certGroup TestCertGroup)
 
 	certGroup.validVerifiedChains[0][0].CRLDistributionPoints = []string{url}
 
-	err := crlVerifier.Verify(certGroup.validRawCerts, certGroup.validVerifiedChains)
+	err := crlVerifier.Verify(context.Background(), certGroup.validRawCerts, certGroup.validVerifiedChains)
 	if err != nil {
 		t.Fatalf("Unexpected error for valid certificate: %v\n", err)
 	}
@@ -521,7 +522,7 @@ func testDefaultCRLVerifierWithGroupRevoked(t *testing.T, certGroup TestCertGrou
 
 	certGroup.invalidVerifiedChains[0][0].CRLDistributionPoints = []string{url}
 
-	err := crlVerifier.Verify(certGroup.invalidRawCerts, certGroup.invalidVerifiedChains)
+	err := crlVerifier.Verify(context.Background(), certGroup.invalidRawCerts, certGroup.invalidVerifiedChains)
 	if err == nil {
 		t.Fatal("Unexpected success when verifying revoked certificate\n")
 	}
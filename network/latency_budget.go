@@ -0,0 +1,211 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package network
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/cossacklabs/acra/logging"
+	"github.com/golang/groupcache/lru"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// Labels and values of deferred verifications statuses
+const (
+	DeferredVerificationStatusLabel    = "status"
+	DeferredVerificationStatusDeferred = "deferred"
+	DeferredVerificationStatusAccepted = "accepted"
+	DeferredVerificationStatusRejected = "rejected"
+)
+
+// deferredVerdictsCacheSize limits count of verdicts of finished deferred verifications waiting for next handshake
+const deferredVerdictsCacheSize = 1024
+
+// DefaultDeferredVerificationTimeout is default deadline of certificate verification continued in background
+const DefaultDeferredVerificationTimeout = time.Second * 30
+
+// Errors returned by LatencyBudgetCertVerifier
+var (
+	ErrVerificationExceedsBudget   = errors.New("certificate verification exceeds latency budget")
+	ErrDeferredVerificationTimeout = errors.New("deferred certificate verification exceeds timeout")
+)
+
+// DeferredVerificationsCounter collects count of certificate verifications which exceeded latency budget and were
+// finished in background by their verdicts
+var DeferredVerificationsCounter = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "acra_tls_deferred_verifications_total",
+		Help: "number of peer certificate verifications deferred due to latency budget, by status",
+	}, []string{DeferredVerificationStatusLabel})
+
+var latencyBudgetRegisterLock = sync.Once{}
+
+// RegisterLatencyBudgetMetrics register in default prometheus registry metrics related with latency budget
+func RegisterLatencyBudgetMetrics() {
+	latencyBudgetRegisterLock.Do(func() {
+		prometheus.MustRegister(DeferredVerificationsCounter)
+	})
+}
+
+// deferredVerdict is result of verification finished after handshake, lru.Cache can't tell nil error from missing one
+type deferredVerdict struct {
+	err error
+}
+
+// verification is verification of certificate in progress, err is set before done is closed
+type verification struct {
+	done chan struct{}
+	err  error
+}
+
+// LatencyBudgetCertVerifier limits time TLS handshake waits for wrapped verifier, so slow OCSP servers, CRL
+// distribution points or scripts don't make latency of new connections unpredictable. Verification which exceeds
+// budget continues in background until timeout and the peer is accepted, or rejected if failClosed is set (e.g.
+// OCSP responses are required). Its verdict is returned to the next handshake with the same certificate, so revoked
+// peer is rejected on reconnection, and also stored by CachingCertVerifier if it's wrapped. Handshakes of the same
+// certificate started while it's verified in background wait for its verdict and are never accepted without it.
+type LatencyBudgetCertVerifier struct {
+	verifier   CertVerifier
+	budget     time.Duration
+	timeout    time.Duration
+	failClosed bool
+	mutex      sync.Mutex
+	// inFlight are certificates being verified, they aren't verified again until it's finished
+	inFlight map[string]*verification
+	deferred *lru.Cache
+}
+
+// NewLatencyBudgetCertVerifier returns verifier which waits for certVerifier at most budget, or certVerifier itself if
+// budget isn't positive. Deferred verifications which take longer than timeout reject the peer on next handshake.
+// Peers which verification exceeds budget are rejected if failClosed is true.
+func NewLatencyBudgetCertVerifier(certVerifier CertVerifier, budget, timeout time.Duration, failClosed bool) CertVerifier {
+	if budget <= 0 {
+		return certVerifier
+	}
+	if timeout <= 0 {
+		timeout = DefaultDeferredVerificationTimeout
+	}
+	return &LatencyBudgetCertVerifier{
+		verifier:   certVerifier,
+		budget:     budget,
+		timeout:    timeout,
+		failClosed: failClosed,
+		inFlight:   make(map[string]*verification),
+		deferred:   lru.New(deferredVerdictsCacheSize),
+	}
+}
+
+// start runs wrapped verifier until timeout and returns verification which is done when verdict is ready
+func (v *LatencyBudgetCertVerifier) start(rawCerts [][]byte, verifiedChains [][]*x509.Certificate, logger *log.Entry) *verification {
+	current := &verification{done: make(chan struct{})}
+	// verification isn't bound to handshake, so it finishes after deadline of handshake
+	verifyCtx, cancel := context.WithTimeout(logging.SetLoggerToContext(context.Background(), logger), v.timeout)
+	go func() {
+		defer cancel()
+		defer close(current.done)
+		result := make(chan error, 1)
+		go func() {
+			result <- v.verifier.Verify(verifyCtx, rawCerts, verifiedChains)
+		}()
+		select {
+		case current.err = <-result:
+		// wrapped verifier may ignore cancellation, its verdict isn't waited for anymore
+		case <-verifyCtx.Done():
+			current.err = ErrDeferredVerificationTimeout
+		}
+	}()
+	return current
+}
+
+// finish waits for verification deferred after handshake and stores its verdict for next handshake
+func (v *LatencyBudgetCertVerifier) finish(key string, deferred *verification, logger *log.Entry) {
+	<-deferred.done
+	v.mutex.Lock()
+	delete(v.inFlight, key)
+	v.deferred.Add(key, deferredVerdict{err: deferred.err})
+	v.mutex.Unlock()
+	if deferred.err != nil {
+		DeferredVerificationsCounter.WithLabelValues(DeferredVerificationStatusRejected).Inc()
+		logger.WithError(deferred.err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorNetworkTLSGeneral).
+			Errorln("Deferred certificate verification rejected peer, its next connection will be rejected")
+		return
+	}
+	DeferredVerificationsCounter.WithLabelValues(DeferredVerificationStatusAccepted).Inc()
+	logger.Debugln("Deferred certificate verification accepted peer")
+}
+
+// Verify returns verdict of wrapped verifier if it's ready within budget, or verdict of previous deferred verification
+// of the same certificate. Otherwise verification is deferred and the peer is accepted unless failClosed is set.
+func (v *LatencyBudgetCertVerifier) Verify(ctx context.Context, rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return v.verifier.Verify(ctx, rawCerts, verifiedChains)
+	}
+	hash := sha256.Sum256(rawCerts[0])
+	key := hex.EncodeToString(hash[:])
+	logger := logging.GetLoggerFromContext(ctx).WithField("certificate_sha256", key)
+
+	v.mutex.Lock()
+	if value, ok := v.deferred.Get(key); ok {
+		v.deferred.Remove(key)
+		v.mutex.Unlock()
+		logger.Debugln("Use verdict of deferred certificate verification")
+		return value.(deferredVerdict).err
+	}
+	current, verifying := v.inFlight[key]
+	if !verifying {
+		current = v.start(rawCerts, verifiedChains, logger)
+		v.inFlight[key] = current
+	}
+	v.mutex.Unlock()
+	if verifying {
+		logger.Debugln("Certificate is already verified, wait for its verdict")
+		select {
+		case <-current.done:
+			return current.err
+		case <-ctx.Done():
+			return ErrVerificationExceedsBudget
+		}
+	}
+
+	timer := time.NewTimer(v.budget)
+	defer timer.Stop()
+	select {
+	case <-current.done:
+		v.mutex.Lock()
+		delete(v.inFlight, key)
+		v.mutex.Unlock()
+		return current.err
+	case <-timer.C:
+	}
+
+	DeferredVerificationsCounter.WithLabelValues(DeferredVerificationStatusDeferred).Inc()
+	go v.finish(key, current, logger)
+	logger = logger.WithField("budget", v.budget.String()).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorNetworkTLSGeneral)
+	if v.failClosed {
+		logger.Warnln("Certificate verification exceeds latency budget, reject peer and finish verification in background")
+		return ErrVerificationExceedsBudget
+	}
+	logger.Warnln("Certificate verification exceeds latency budget, accept peer and finish verification in background")
+	return nil
+}
@@ -0,0 +1,137 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package network
+
+import (
+	"context"
+	"crypto/x509"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// blockingCertVerifier returns err after release is closed
+type blockingCertVerifier struct {
+	err     error
+	release chan struct{}
+	calls   int32
+}
+
+func (v *blockingCertVerifier) Verify(ctx context.Context, rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	atomic.AddInt32(&v.calls, 1)
+	<-v.release
+	return v.err
+}
+
+// waitDeferredVerdict waits until background verification of certificate stores its verdict
+func waitDeferredVerdict(t *testing.T, verifier *LatencyBudgetCertVerifier) {
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		verifier.mutex.Lock()
+		finished := len(verifier.inFlight) == 0
+		verifier.mutex.Unlock()
+		if finished {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Deferred verification didn't finish")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestLatencyBudgetCertVerifier(t *testing.T) {
+	rawCerts, verifiedChains := getDERTestChain(t)
+	fast := &testCertVerifier{err: ErrCertWasRevoked}
+	if verifier := NewLatencyBudgetCertVerifier(fast, 0, 0, false); verifier != CertVerifier(fast) {
+		t.Fatal("Expected verifier without budget to be returned as is")
+	}
+	// verdicts ready within budget are returned as is
+	if err := NewLatencyBudgetCertVerifier(fast, time.Second, 0, false).Verify(context.Background(), rawCerts, verifiedChains); err != ErrCertWasRevoked {
+		t.Fatalf("Expected ErrCertWasRevoked, took %v", err)
+	}
+
+	slow := &blockingCertVerifier{err: ErrCertWasRevoked, release: make(chan struct{})}
+	verifier := NewLatencyBudgetCertVerifier(slow, time.Millisecond*10, time.Minute, false).(*LatencyBudgetCertVerifier)
+	start := time.Now()
+	if err := verifier.Verify(context.Background(), rawCerts, verifiedChains); err != nil {
+		t.Fatalf("Expected peer accepted after budget, took %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("Handshake waited for slow verifier")
+	}
+	// certificate verified in background isn't verified again and its handshakes aren't accepted without verdict
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	if err := verifier.Verify(ctx, rawCerts, verifiedChains); err != ErrVerificationExceedsBudget {
+		t.Fatalf("Expected ErrVerificationExceedsBudget after deadline of handshake, took %v", err)
+	}
+	if calls := atomic.LoadInt32(&slow.calls); calls != 1 {
+		t.Fatalf("Expected 1 verification, took %d", calls)
+	}
+	waiting := make(chan error, 1)
+	go func() {
+		waiting <- verifier.Verify(context.Background(), rawCerts, verifiedChains)
+	}()
+	// let handshake start waiting before verification finishes
+	time.Sleep(time.Millisecond * 20)
+	close(slow.release)
+	if err := <-waiting; err != ErrCertWasRevoked {
+		t.Fatalf("Expected ErrCertWasRevoked for handshake waiting for verification, took %v", err)
+	}
+	waitDeferredVerdict(t, verifier)
+	// next handshake takes verdict of deferred verification, the one after it verifies again
+	if err := verifier.Verify(context.Background(), rawCerts, verifiedChains); err != ErrCertWasRevoked {
+		t.Fatalf("Expected ErrCertWasRevoked of deferred verification, took %v", err)
+	}
+	if err := verifier.Verify(context.Background(), rawCerts, verifiedChains); err != ErrCertWasRevoked {
+		t.Fatalf("Expected ErrCertWasRevoked, took %v", err)
+	}
+	if calls := atomic.LoadInt32(&slow.calls); calls != 2 {
+		t.Fatalf("Expected 2 verifications, took %d", calls)
+	}
+}
+
+func TestLatencyBudgetCertVerifierFailClosed(t *testing.T) {
+	rawCerts, verifiedChains := getDERTestChain(t)
+	slow := &blockingCertVerifier{release: make(chan struct{})}
+	verifier := NewLatencyBudgetCertVerifier(slow, time.Millisecond*10, time.Minute, true).(*LatencyBudgetCertVerifier)
+	if err := verifier.Verify(context.Background(), rawCerts, verifiedChains); err != ErrVerificationExceedsBudget {
+		t.Fatalf("Expected ErrVerificationExceedsBudget, took %v", err)
+	}
+	close(slow.release)
+	waitDeferredVerdict(t, verifier)
+	// verdict of verification finished in background accepts next handshake
+	if err := verifier.Verify(context.Background(), rawCerts, verifiedChains); err != nil {
+		t.Fatalf("Expected peer accepted by deferred verdict, took %v", err)
+	}
+}
+
+func TestLatencyBudgetCertVerifierTimeout(t *testing.T) {
+	rawCerts, verifiedChains := getDERTestChain(t)
+	// verifier which never finishes
+	hung := &blockingCertVerifier{release: make(chan struct{})}
+	defer close(hung.release)
+	verifier := NewLatencyBudgetCertVerifier(hung, time.Millisecond*10, time.Millisecond*50, false).(*LatencyBudgetCertVerifier)
+	if err := verifier.Verify(context.Background(), rawCerts, verifiedChains); err != nil {
+		t.Fatalf("Expected peer accepted after budget, took %v", err)
+	}
+	waitDeferredVerdict(t, verifier)
+	if err := verifier.Verify(context.Background(), rawCerts, verifiedChains); err != ErrDeferredVerificationTimeout {
+		t.Fatalf("Expected ErrDeferredVerificationTimeout, took %v", err)
+	}
+}
@@ -0,0 +1,603 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package network
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Multiplexed session carries many logical streams over one connection between AcraConnector and AcraServer, so
+// every client connection doesn't need own TCP connection and TLS or Secure Session handshake. Framing is the same as
+// of yamux: every frame starts with header of version, type, flags, stream ID and length. Data frames have payload
+// of length bytes, window update frames use length as increase of send window of stream. Every stream may have up to
+// muxWindowSize bytes sent but not read by peer, so slow streams don't block other ones.
+
+const (
+	muxVersion    byte = 0
+	muxHeaderSize      = 12
+	// muxWindowSize is size of receive buffer of every stream
+	muxWindowSize uint32 = 256 * 1024
+	// muxMaxFrameSize limits payload of data frames
+	muxMaxFrameSize = 32 * 1024
+	// muxAcceptBacklog limits count of opened streams which aren't accepted yet
+	muxAcceptBacklog = 256
+)
+
+// Types of frames
+const (
+	muxTypeData byte = iota
+	muxTypeWindowUpdate
+	muxTypeGoAway
+)
+
+// Flags of frames
+const (
+	// muxFlagSYN opens new stream
+	muxFlagSYN uint16 = 1 << iota
+	// muxFlagFIN closes stream
+	muxFlagFIN
+	// muxFlagRST rejects stream
+	muxFlagRST
+)
+
+// muxMagic is sent by client before frames, so server distinguishes multiplexed connections from plain ones which
+// start with small length of trace data
+var muxMagic = []byte("AMUX")
+
+// Errors returned by multiplexed sessions and streams
+var (
+	ErrMuxSessionClosed = errors.New("multiplexed session is closed")
+	ErrMuxStreamReset   = errors.New("stream was reset by peer")
+	errMuxProtocol      = errors.New("multiplexing protocol violation")
+)
+
+// muxTimeoutError returned by operations of streams after deadline
+type muxTimeoutError struct{}
+
+func (muxTimeoutError) Error() string   { return "i/o timeout" }
+func (muxTimeoutError) Timeout() bool   { return true }
+func (muxTimeoutError) Temporary() bool { return true }
+
+// muxPrefixedConn returns already read prefix before data of wrapped connection
+type muxPrefixedConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func (conn *muxPrefixedConn) Read(b []byte) (int, error) {
+	if len(conn.prefix) > 0 {
+		n := copy(b, conn.prefix)
+		conn.prefix = conn.prefix[n:]
+		return n, nil
+	}
+	return conn.Conn.Read(b)
+}
+
+// MuxSession is multiplexed session over one connection. Client opens streams with OpenStream, server accepts them
+// with Accept, so session may be used as net.Listener of streams.
+type MuxSession struct {
+	conn      net.Conn
+	writeLock sync.Mutex
+
+	streamsLock sync.Mutex
+	streams     map[uint32]*MuxStream
+	nextID      uint32
+	accept      chan *MuxStream
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewMuxClientSession starts multiplexed session over conn on side which opens streams
+func NewMuxClientSession(conn net.Conn) (*MuxSession, error) {
+	if _, err := conn.Write(muxMagic); err != nil {
+		return nil, err
+	}
+	return newMuxSession(conn, 1), nil
+}
+
+// AcceptMuxSession reads first bytes of conn and returns MuxSession if peer started multiplexed session. Otherwise
+// it returns connection which reads the same data as conn.
+func AcceptMuxSession(conn net.Conn) (*MuxSession, net.Conn, error) {
+	prefix := make([]byte, len(muxMagic))
+	if _, err := io.ReadFull(conn, prefix); err != nil {
+		return nil, nil, err
+	}
+	if !bytes.Equal(prefix, muxMagic) {
+		return nil, &muxPrefixedConn{Conn: conn, prefix: prefix}, nil
+	}
+	return newMuxSession(conn, 2), nil, nil
+}
+
+// newMuxSession returns session which opens streams with odd (client) or even (server) IDs starting from firstID
+func newMuxSession(conn net.Conn, firstID uint32) *MuxSession {
+	session := &MuxSession{
+		conn:    conn,
+		streams: make(map[uint32]*MuxStream),
+		nextID:  firstID,
+		accept:  make(chan *MuxStream, muxAcceptBacklog),
+		closed:  make(chan struct{}),
+	}
+	go session.recvLoop()
+	return session
+}
+
+// OpenStream opens new stream
+func (session *MuxSession) OpenStream() (*MuxStream, error) {
+	session.streamsLock.Lock()
+	if session.IsClosed() {
+		session.streamsLock.Unlock()
+		return nil, ErrMuxSessionClosed
+	}
+	stream := newMuxStream(session, session.nextID)
+	session.nextID += 2
+	session.streams[stream.id] = stream
+	session.streamsLock.Unlock()
+	if err := session.writeFrame(muxTypeData, muxFlagSYN, stream.id, 0, nil); err != nil {
+		session.removeStream(stream.id)
+		return nil, err
+	}
+	return stream, nil
+}
+
+// Accept waits for and returns next stream opened by peer
+func (session *MuxSession) Accept() (net.Conn, error) {
+	select {
+	case stream := <-session.accept:
+		return stream, nil
+	case <-session.closed:
+		return nil, ErrMuxSessionClosed
+	}
+}
+
+// Addr returns local address of connection of session
+func (session *MuxSession) Addr() net.Addr {
+	return session.conn.LocalAddr()
+}
+
+// NumStreams returns count of opened streams
+func (session *MuxSession) NumStreams() int {
+	session.streamsLock.Lock()
+	defer session.streamsLock.Unlock()
+	return len(session.streams)
+}
+
+// IsClosed returns true if session is closed and can't carry streams anymore
+func (session *MuxSession) IsClosed() bool {
+	select {
+	case <-session.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close notifies peer and closes session with all its streams
+func (session *MuxSession) Close() error {
+	if session.IsClosed() {
+		return nil
+	}
+	// peer closes session too after GoAway, error doesn't matter
+	_ = session.writeFrame(muxTypeGoAway, 0, 0, 0, nil)
+	session.shutdown()
+	return nil
+}
+
+func (session *MuxSession) shutdown() {
+	session.closeOnce.Do(func() {
+		close(session.closed)
+		session.conn.Close()
+	})
+}
+
+func (session *MuxSession) removeStream(id uint32) {
+	session.streamsLock.Lock()
+	delete(session.streams, id)
+	session.streamsLock.Unlock()
+}
+
+func (session *MuxSession) writeFrame(frameType byte, flags uint16, streamID, length uint32, payload []byte) error {
+	if payload != nil {
+		length = uint32(len(payload))
+	}
+	frame := make([]byte, muxHeaderSize+len(payload))
+	frame[0] = muxVersion
+	frame[1] = frameType
+	binary.BigEndian.PutUint16(frame[2:4], flags)
+	binary.BigEndian.PutUint32(frame[4:8], streamID)
+	binary.BigEndian.PutUint32(frame[8:12], length)
+	copy(frame[muxHeaderSize:], payload)
+	session.writeLock.Lock()
+	defer session.writeLock.Unlock()
+	if session.IsClosed() {
+		return ErrMuxSessionClosed
+	}
+	if _, err := session.conn.Write(frame); err != nil {
+		session.shutdown()
+		return err
+	}
+	return nil
+}
+
+// recvLoop reads frames and dispatches them to streams until session is closed
+func (session *MuxSession) recvLoop() {
+	header := make([]byte, muxHeaderSize)
+	for {
+		if _, err := io.ReadFull(session.conn, header); err != nil {
+			session.shutdown()
+			return
+		}
+		if header[0] != muxVersion {
+			session.shutdown()
+			return
+		}
+		frameType, flags := header[1], binary.BigEndian.Uint16(header[2:4])
+		streamID, length := binary.BigEndian.Uint32(header[4:8]), binary.BigEndian.Uint32(header[8:12])
+		var err error
+		switch frameType {
+		case muxTypeData:
+			if length > muxMaxFrameSize {
+				err = errMuxProtocol
+				break
+			}
+			payload := make([]byte, length)
+			if _, err = io.ReadFull(session.conn, payload); err != nil {
+				break
+			}
+			err = session.handleData(flags, streamID, payload)
+		case muxTypeWindowUpdate:
+			session.streamsLock.Lock()
+			stream := session.streams[streamID]
+			session.streamsLock.Unlock()
+			if stream != nil {
+				stream.increaseSendWindow(length)
+			}
+		case muxTypeGoAway:
+			err = ErrMuxSessionClosed
+		default:
+			err = errMuxProtocol
+		}
+		if err != nil {
+			session.shutdown()
+			return
+		}
+	}
+}
+
+func (session *MuxSession) handleData(flags uint16, streamID uint32, payload []byte) error {
+	session.streamsLock.Lock()
+	stream := session.streams[streamID]
+	if flags&muxFlagSYN != 0 {
+		// peer opens streams only with IDs of other parity
+		if stream != nil || streamID%2 == session.nextID%2 {
+			session.streamsLock.Unlock()
+			return errMuxProtocol
+		}
+		stream = newMuxStream(session, streamID)
+		session.streams[streamID] = stream
+		select {
+		case session.accept <- stream:
+		default:
+			delete(session.streams, streamID)
+			session.streamsLock.Unlock()
+			return session.writeFrame(muxTypeData, muxFlagRST, streamID, 0, nil)
+		}
+	}
+	session.streamsLock.Unlock()
+	// frames of streams closed locally are dropped
+	if stream == nil {
+		return nil
+	}
+	if flags&muxFlagRST != 0 {
+		stream.remoteReset()
+		return nil
+	}
+	if len(payload) > 0 {
+		if err := stream.receive(payload); err != nil {
+			return err
+		}
+	}
+	if flags&muxFlagFIN != 0 {
+		stream.remoteClose()
+	}
+	return nil
+}
+
+// MuxStream is logical connection of multiplexed session. Half-closed streams aren't supported: stream which was
+// closed by peer returns buffered data and io.EOF on reads and fails on writes. Write deadline limits only time of
+// waiting until peer reads previously sent data.
+type MuxStream struct {
+	id      uint32
+	session *MuxSession
+
+	lock          sync.Mutex
+	recvBuffer    bytes.Buffer
+	recvWindow    uint32
+	consumed      uint32
+	sendWindow    uint32
+	localClosed   bool
+	remoteClosed  bool
+	reset         bool
+	readDeadline  time.Time
+	writeDeadline time.Time
+	readNotify    chan struct{}
+	writeNotify   chan struct{}
+}
+
+func newMuxStream(session *MuxSession, id uint32) *MuxStream {
+	return &MuxStream{
+		id:          id,
+		session:     session,
+		recvWindow:  muxWindowSize,
+		sendWindow:  muxWindowSize,
+		readNotify:  make(chan struct{}, 1),
+		writeNotify: make(chan struct{}, 1),
+	}
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// wait blocks until notification, deadline or close of session
+func (stream *MuxStream) wait(ch chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		delay := time.Until(deadline)
+		if delay <= 0 {
+			return muxTimeoutError{}
+		}
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-ch:
+		return nil
+	case <-timeout:
+		return muxTimeoutError{}
+	case <-stream.session.closed:
+		return nil
+	}
+}
+
+// receive appends data sent by peer to buffer
+func (stream *MuxStream) receive(data []byte) error {
+	stream.lock.Lock()
+	defer stream.lock.Unlock()
+	if uint32(len(data)) > stream.recvWindow {
+		return errMuxProtocol
+	}
+	stream.recvWindow -= uint32(len(data))
+	if !stream.localClosed {
+		stream.recvBuffer.Write(data)
+	}
+	notify(stream.readNotify)
+	return nil
+}
+
+func (stream *MuxStream) increaseSendWindow(delta uint32) {
+	stream.lock.Lock()
+	stream.sendWindow += delta
+	stream.lock.Unlock()
+	notify(stream.writeNotify)
+}
+
+func (stream *MuxStream) remoteClose() {
+	stream.lock.Lock()
+	stream.remoteClosed = true
+	stream.lock.Unlock()
+	notify(stream.readNotify)
+	notify(stream.writeNotify)
+}
+
+func (stream *MuxStream) remoteReset() {
+	stream.lock.Lock()
+	stream.reset = true
+	stream.lock.Unlock()
+	notify(stream.readNotify)
+	notify(stream.writeNotify)
+}
+
+// Read reads data sent by peer
+func (stream *MuxStream) Read(b []byte) (int, error) {
+	for {
+		stream.lock.Lock()
+		if stream.recvBuffer.Len() > 0 {
+			n, _ := stream.recvBuffer.Read(b)
+			stream.consumed += uint32(n)
+			// window is announced in large chunks, so every read doesn't produce frame
+			var update uint32
+			if stream.consumed >= muxWindowSize/2 && !stream.remoteClosed {
+				update = stream.consumed
+				stream.recvWindow += update
+				stream.consumed = 0
+			}
+			stream.lock.Unlock()
+			if update > 0 {
+				if err := stream.session.writeFrame(muxTypeWindowUpdate, 0, stream.id, update, nil); err != nil {
+					return n, err
+				}
+			}
+			return n, nil
+		}
+		reset, remoteClosed, localClosed, deadline := stream.reset, stream.remoteClosed, stream.localClosed, stream.readDeadline
+		stream.lock.Unlock()
+		switch {
+		case reset:
+			return 0, ErrMuxStreamReset
+		case remoteClosed:
+			return 0, io.EOF
+		case localClosed:
+			return 0, io.ErrClosedPipe
+		case stream.session.IsClosed():
+			return 0, ErrMuxSessionClosed
+		}
+		if err := stream.wait(stream.readNotify, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Write sends data to peer, waiting while peer didn't read previously sent data
+func (stream *MuxStream) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		stream.lock.Lock()
+		reset, closed, window, deadline := stream.reset, stream.localClosed || stream.remoteClosed, stream.sendWindow, stream.writeDeadline
+		switch {
+		case reset:
+			stream.lock.Unlock()
+			return written, ErrMuxStreamReset
+		case closed:
+			stream.lock.Unlock()
+			return written, io.ErrClosedPipe
+		case stream.session.IsClosed():
+			stream.lock.Unlock()
+			return written, ErrMuxSessionClosed
+		}
+		if window == 0 {
+			stream.lock.Unlock()
+			if err := stream.wait(stream.writeNotify, deadline); err != nil {
+				return written, err
+			}
+			continue
+		}
+		n := len(b) - written
+		if n > muxMaxFrameSize {
+			n = muxMaxFrameSize
+		}
+		if uint32(n) > window {
+			n = int(window)
+		}
+		stream.sendWindow -= uint32(n)
+		stream.lock.Unlock()
+		if err := stream.session.writeFrame(muxTypeData, 0, stream.id, 0, b[written:written+n]); err != nil {
+			return written, err
+		}
+		written += n
+	}
+	return written, nil
+}
+
+// Close closes stream on both sides, unread data is dropped
+func (stream *MuxStream) Close() error {
+	stream.lock.Lock()
+	if stream.localClosed {
+		stream.lock.Unlock()
+		return nil
+	}
+	stream.localClosed = true
+	stream.recvBuffer.Reset()
+	sendFIN := !stream.reset && !stream.remoteClosed
+	stream.lock.Unlock()
+	notify(stream.readNotify)
+	notify(stream.writeNotify)
+	stream.session.removeStream(stream.id)
+	if !sendFIN || stream.session.IsClosed() {
+		return nil
+	}
+	return stream.session.writeFrame(muxTypeData, muxFlagFIN, stream.id, 0, nil)
+}
+
+// LocalAddr returns local address of connection of session
+func (stream *MuxStream) LocalAddr() net.Addr {
+	return stream.session.conn.LocalAddr()
+}
+
+// RemoteAddr returns remote address of connection of session
+func (stream *MuxStream) RemoteAddr() net.Addr {
+	return stream.session.conn.RemoteAddr()
+}
+
+// SetDeadline sets read and write deadlines
+func (stream *MuxStream) SetDeadline(t time.Time) error {
+	stream.SetReadDeadline(t)
+	return stream.SetWriteDeadline(t)
+}
+
+// SetReadDeadline sets deadline of reads
+func (stream *MuxStream) SetReadDeadline(t time.Time) error {
+	stream.lock.Lock()
+	stream.readDeadline = t
+	stream.lock.Unlock()
+	notify(stream.readNotify)
+	return nil
+}
+
+// SetWriteDeadline sets deadline of waiting for send window
+func (stream *MuxStream) SetWriteDeadline(t time.Time) error {
+	stream.lock.Lock()
+	stream.writeDeadline = t
+	stream.lock.Unlock()
+	notify(stream.writeNotify)
+	return nil
+}
+
+// MuxDialer opens streams of multiplexed session over connection made by dial, session is made again after it's
+// closed
+type MuxDialer struct {
+	dial    func() (net.Conn, error)
+	lock    sync.Mutex
+	session *MuxSession
+}
+
+// NewMuxDialer returns MuxDialer which makes connections of sessions with dial
+func NewMuxDialer(dial func() (net.Conn, error)) *MuxDialer {
+	return &MuxDialer{dial: dial}
+}
+
+// Dial opens new stream, connecting to peer if there is no open session
+func (dialer *MuxDialer) Dial() (net.Conn, error) {
+	dialer.lock.Lock()
+	if dialer.session == nil || dialer.session.IsClosed() {
+		conn, err := dialer.dial()
+		if err != nil {
+			dialer.lock.Unlock()
+			return nil, err
+		}
+		session, err := NewMuxClientSession(conn)
+		if err != nil {
+			conn.Close()
+			dialer.lock.Unlock()
+			return nil, err
+		}
+		dialer.session = session
+	}
+	session := dialer.session
+	dialer.lock.Unlock()
+	return session.OpenStream()
+}
+
+// Close closes current session with all its streams
+func (dialer *MuxDialer) Close() error {
+	dialer.lock.Lock()
+	defer dialer.lock.Unlock()
+	if dialer.session == nil {
+		return nil
+	}
+	return dialer.session.Close()
+}
@@ -0,0 +1,225 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package network
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestMuxSessions(t *testing.T) (*MuxSession, *MuxSession) {
+	clientConn, serverConn := net.Pipe()
+	serverSession := make(chan *MuxSession, 1)
+	go func() {
+		session, plain, err := AcceptMuxSession(serverConn)
+		if err != nil || plain != nil {
+			t.Error("expected multiplexed session", err)
+		}
+		serverSession <- session
+	}()
+	client, err := NewMuxClientSession(clientConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, <-serverSession
+}
+
+func TestMuxStreams(t *testing.T) {
+	client, server := newTestMuxSessions(t)
+	defer client.Close()
+	defer server.Close()
+	// echo server
+	go func() {
+		for {
+			conn, err := server.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	// more data than window to check window updates
+	data := make([]byte, int(muxWindowSize)*3)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stream, err := client.OpenStream()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer stream.Close()
+			go stream.Write(data)
+			echo := make([]byte, len(data))
+			if _, err := io.ReadFull(stream, echo); err != nil {
+				t.Error(err)
+				return
+			}
+			if !bytes.Equal(echo, data) {
+				t.Error("echo doesn't match sent data")
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestMuxStreamClose(t *testing.T) {
+	client, server := newTestMuxSessions(t)
+	defer client.Close()
+	defer server.Close()
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := server.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Write([]byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Close(); err != nil {
+		t.Fatal(err)
+	}
+	received, err := ioutil.ReadAll(accepted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(received) != "data" {
+		t.Fatalf("unexpected data %q", received)
+	}
+	if _, err := accepted.Write([]byte("data")); err != io.ErrClosedPipe {
+		t.Fatalf("expected io.ErrClosedPipe, took %v", err)
+	}
+	accepted.Close()
+	if n := client.NumStreams(); n != 0 {
+		t.Fatalf("expected no streams of client, took %d", n)
+	}
+}
+
+func TestMuxStreamDeadline(t *testing.T) {
+	client, server := newTestMuxSessions(t)
+	defer client.Close()
+	defer server.Close()
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.SetReadDeadline(time.Now().Add(time.Millisecond * 50))
+	_, err = stream.Read(make([]byte, 1))
+	netErr, ok := err.(net.Error)
+	if !ok || !netErr.Timeout() {
+		t.Fatalf("expected timeout error, took %v", err)
+	}
+}
+
+func TestMuxSessionClose(t *testing.T) {
+	client, server := newTestMuxSessions(t)
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := server.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	if _, err := accepted.Read(make([]byte, 1)); err != ErrMuxSessionClosed {
+		t.Fatalf("expected ErrMuxSessionClosed, took %v", err)
+	}
+	if _, err := stream.Write([]byte("data")); err != ErrMuxSessionClosed {
+		t.Fatalf("expected ErrMuxSessionClosed, took %v", err)
+	}
+	if _, err := server.Accept(); err != ErrMuxSessionClosed {
+		t.Fatalf("expected ErrMuxSessionClosed, took %v", err)
+	}
+}
+
+func TestAcceptMuxSessionPlainConnection(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go clientConn.Write([]byte("plain data"))
+	session, plain, err := AcceptMuxSession(serverConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session != nil {
+		t.Fatal("expected plain connection")
+	}
+	received := make([]byte, len("plain data"))
+	if _, err := io.ReadFull(plain, received); err != nil {
+		t.Fatal(err)
+	}
+	if string(received) != "plain data" {
+		t.Fatalf("unexpected data %q", received)
+	}
+}
+
+func TestMuxDialerReconnect(t *testing.T) {
+	sessions := make(chan *MuxSession, 2)
+	dialer := NewMuxDialer(func() (net.Conn, error) {
+		clientConn, serverConn := net.Pipe()
+		go func() {
+			session, _, err := AcceptMuxSession(serverConn)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			sessions <- session
+		}()
+		return clientConn, nil
+	})
+	defer dialer.Close()
+	first, err := dialer.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := dialer.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := <-sessions
+	if first.(*MuxStream).session != second.(*MuxStream).session {
+		t.Fatal("expected streams of one session")
+	}
+	server.Close()
+	if _, err := first.Read(make([]byte, 1)); err == nil {
+		t.Fatal("expected error after close of session")
+	}
+	third, err := dialer.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer (<-sessions).Close()
+	if third.(*MuxStream).session == first.(*MuxStream).session {
+		t.Fatal("expected new session after close")
+	}
+}
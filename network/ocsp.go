@@ -18,15 +18,24 @@ package network
 
 import (
 	"bytes"
+	"context"
 	"crypto"
+	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
 	"errors"
+	"fmt"
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/crypto/ocsp"
 	"io/ioutil"
 	"net/http"
 	url_ "net/url"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -38,8 +47,79 @@ var (
 	ErrOCSPRequiredAllButGotError  = errors.New("cannot query OCSP server, but --tls_ocsp_required=all was passed")
 	ErrOCSPUnknownCertificate      = errors.New("OCSP server doesn't know about certificate")
 	ErrOCSPNoConfirms              = errors.New("none of OCSP servers confirmed the certificate")
+	ErrInvalidConfigOCSPTimeout    = errors.New("OCSP timeouts should be greater than zero")
+	ErrInvalidConfigOCSPResponder  = errors.New("invalid OCSP responder, expected <url>[;priority=<number>][;role=required|advisory]")
+	ErrOCSPRequiredResponderFailed = errors.New("cannot query OCSP responder with required role")
+	ErrInvalidConfigOCSPProxy      = errors.New("invalid OCSP HTTP proxy URL")
+	ErrInvalidConfigOCSPCABundle   = errors.New("OCSP CA bundle doesn't contain PEM-encoded certificates")
+	ErrOCSPHTTPStatus              = errors.New("OCSP server responded with unexpected HTTP status")
+	ErrInvalidConfigOCSPNonce      = errors.New("invalid `ocsp_nonce` value")
+	ErrOCSPNonceMissing            = errors.New("OCSP response doesn't contain nonce of request")
+	ErrOCSPNonceMismatch           = errors.New("OCSP response contains nonce different from one of request")
+	ErrOCSPResponseNotYetValid     = errors.New("OCSP response is produced in the future")
+	ErrOCSPResponseExpired         = errors.New("OCSP response is stale, its NextUpdate has passed")
 )
 
+// Roles of OCSP responders from configuration
+const (
+	// OCSPResponderRoleDefault responder is handled according to `--tls_ocsp_required`
+	OCSPResponderRoleDefault = ""
+	// OCSPResponderRoleRequired responder should respond and know the certificate, otherwise the certificate is denied
+	OCSPResponderRoleRequired = "required"
+	// OCSPResponderRoleAdvisory responder can't confirm the certificate, its errors and unknown responses are only
+	// logged, but revocation is respected
+	OCSPResponderRoleAdvisory = "advisory"
+)
+
+// OCSPResponder is OCSP server from configuration
+type OCSPResponder struct {
+	URL string
+	// Priority orders responders, lower goes first. Responders with next priority are backups queried only if none
+	// of responders with previous priority responded
+	Priority int
+	Role     string
+}
+
+// ParseOCSPResponders parses comma-separated list of responders, each is <url>[;priority=<number>][;role=<role>]
+func ParseOCSPResponders(value string) ([]OCSPResponder, error) {
+	var responders []OCSPResponder
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		parts := strings.Split(item, ";")
+		responder := OCSPResponder{URL: strings.TrimSpace(parts[0])}
+		if _, err := url_.Parse(responder.URL); err != nil || responder.URL == "" {
+			return nil, fmt.Errorf("%w: '%s'", ErrInvalidConfigOCSPResponder, item)
+		}
+		for _, option := range parts[1:] {
+			nameValue := strings.SplitN(strings.TrimSpace(option), "=", 2)
+			if len(nameValue) != 2 {
+				return nil, fmt.Errorf("%w: '%s'", ErrInvalidConfigOCSPResponder, item)
+			}
+			switch nameValue[0] {
+			case "priority":
+				priority, err := strconv.Atoi(nameValue[1])
+				if err != nil {
+					return nil, fmt.Errorf("%w: '%s'", ErrInvalidConfigOCSPResponder, item)
+				}
+				responder.Priority = priority
+			case "role":
+				if nameValue[1] != OCSPResponderRoleRequired && nameValue[1] != OCSPResponderRoleAdvisory {
+					return nil, fmt.Errorf("%w: '%s'", ErrInvalidConfigOCSPResponder, item)
+				}
+				responder.Role = nameValue[1]
+			default:
+				return nil, fmt.Errorf("%w: '%s'", ErrInvalidConfigOCSPResponder, item)
+			}
+		}
+		responders = append(responders, responder)
+	}
+	sort.SliceStable(responders, func(i, j int) bool { return responders[i].Priority < responders[j].Priority })
+	return responders, nil
+}
+
 // Possible values for flag `--tls_ocsp_required`
 const (
 	// Deny certificates now known by OCSP server(s)
@@ -103,6 +183,37 @@ var (
 	}
 )
 
+// Possible values for flag `--tls_ocsp_nonce`
+const (
+	// Don't add nonce to OCSP requests, so short requests may be sent with GET and cached
+	OcspNonceNoneStr = "none"
+	// Add nonce to OCSP requests and verify it if server echoes it in response
+	OcspNonceUseStr = "use"
+	// Add nonce to OCSP requests and deny responses which don't contain the same nonce
+	OcspNonceRequireStr = "require"
+)
+
+// OcspNonceValuesList contains all possible values for flag `--tls_ocsp_nonce`
+var OcspNonceValuesList = []string{
+	OcspNonceNoneStr,
+	OcspNonceUseStr,
+	OcspNonceRequireStr,
+}
+
+var (
+	ocspNonceValValues = map[string]int{
+		OcspNonceNoneStr:    ocspNonceNone,
+		OcspNonceUseStr:     ocspNonceUse,
+		OcspNonceRequireStr: ocspNonceRequire,
+	}
+)
+
+const (
+	ocspNonceNone int = iota
+	ocspNonceUse
+	ocspNonceRequire
+)
+
 const (
 	ocspFromCertUse int = iota
 	ocspFromCertTrust
@@ -112,20 +223,32 @@ const (
 
 // OCSPConfig contains configuration related to certificate validation using OCSP
 type OCSPConfig struct {
-	url                      string
-	required                 int // ocspRequired*
-	fromCert                 int // ocspFromCert*
+	responders               []OCSPResponder // sorted by priority
+	required                 int             // ocspRequired*
+	fromCert                 int             // ocspFromCert*
 	checkOnlyLeafCertificate bool
+	queryTimeout             time.Duration
+	verifyTimeout            time.Duration
+	client                   DefaultOCSPClient
 	ClientAuthType           tls.ClientAuthType
 }
 
 const (
 	// OcspHttpClientDefaultTimeout is default timeout for HTTP client used to perform OCSP queries
 	OcspHttpClientDefaultTimeout = time.Second * time.Duration(15)
+	// OcspDefaultVerifyTimeout is default deadline for all OCSP queries made to verify one certificate chain
+	OcspDefaultVerifyTimeout = time.Second * time.Duration(30)
+	// OcspDefaultRetryDelay is default delay before first retry of failed OCSP request, it's doubled for next ones
+	OcspDefaultRetryDelay = time.Millisecond * time.Duration(500)
+	// OcspDefaultClockSkew is default tolerance of difference between local clock and clock of OCSP server
+	OcspDefaultClockSkew = time.Minute * time.Duration(5)
 )
 
-// NewOCSPConfig creates new OCSPConfig
-func NewOCSPConfig(url, required, fromCert string, checkOnlyLeafCertificate bool) (*OCSPConfig, error) {
+// NewOCSPConfig creates new OCSPConfig. url is comma-separated list of responders parsed by ParseOCSPResponders.
+// queryTimeout limits each query to OCSP server including retries, verifyTimeout limits all queries made to verify
+// one certificate chain, servers which didn't respond in time are treated as unavailable. Queries are sent by
+// client configured with clientConfig.
+func NewOCSPConfig(url, required, fromCert string, checkOnlyLeafCertificate bool, queryTimeout, verifyTimeout time.Duration, clientConfig OCSPClientConfig) (*OCSPConfig, error) {
 	requiredVal, ok := ocspRequiredValValues[required]
 	if !ok {
 		return nil, ErrInvalidConfigOCSPRequired
@@ -136,22 +259,30 @@ func NewOCSPConfig(url, required, fromCert string, checkOnlyLeafCertificate bool
 		return nil, ErrInvalidConfigOCSPFromCert
 	}
 
-	if requiredVal == ocspRequiredGood && url == "" {
+	responders, err := ParseOCSPResponders(url)
+	if err != nil {
+		return nil, err
+	}
+
+	if requiredVal == ocspRequiredGood && len(responders) == 0 {
 		return nil, ErrInvalidConfigAllRequiresURL
 	}
 
-	if url != "" {
-		_, err := url_.Parse(url)
-		if err != nil {
-			return nil, err
-		}
+	if queryTimeout <= 0 || verifyTimeout <= 0 {
+		return nil, ErrInvalidConfigOCSPTimeout
+	}
+
+	client, err := NewOCSPClient(clientConfig)
+	if err != nil {
+		return nil, err
+	}
 
-		log.Debugf("OCSP: Using server '%s'", url)
+	for _, responder := range responders {
+		log.WithFields(log.Fields{"priority": responder.Priority, "role": responder.Role}).Debugf("OCSP: Using server '%s'", responder.URL)
 
-		httpClient := &http.Client{}
-		_, err = httpClient.Head(url)
+		_, err = client.httpClient.Head(responder.URL)
 		if err != nil {
-			log.WithError(err).WithField("url", url).Warnln("OCSP: Cannot reach configured server")
+			log.WithError(err).WithField("url", responder.URL).Warnln("OCSP: Cannot reach configured server")
 		}
 	}
 
@@ -176,10 +307,14 @@ func NewOCSPConfig(url, required, fromCert string, checkOnlyLeafCertificate bool
 	}
 
 	return &OCSPConfig{
-		url:            url,
-		required:       requiredVal,
-		fromCert:       fromCertVal,
-		ClientAuthType: tls.RequireAndVerifyClientCert,
+		responders:               responders,
+		required:                 requiredVal,
+		fromCert:                 fromCertVal,
+		checkOnlyLeafCertificate: checkOnlyLeafCertificate,
+		queryTimeout:             queryTimeout,
+		verifyTimeout:            verifyTimeout,
+		client:                   client,
+		ClientAuthType:           tls.RequireAndVerifyClientCert,
 	}, nil
 }
 
@@ -188,56 +323,289 @@ func (c *OCSPConfig) UseOCSP() bool {
 	if c == nil {
 		return false
 	}
-	return c.url != "" || c.fromCert != ocspFromCertIgnore
+	return len(c.responders) > 0 || c.fromCert != ocspFromCertIgnore
 }
 
 // OCSPClient is used to perform OCSP queries to some URL
 type OCSPClient interface {
-	// Query generates OCSP request about specified certificate, sends it to server and returns the response
-	Query(commonName string, clientCert, issuerCert *x509.Certificate, ocspServerURL string) (*ocsp.Response, error)
+	// Query generates OCSP request about specified certificate, sends it to server and returns the response,
+	// the request is aborted when ctx is done
+	Query(ctx context.Context, commonName string, clientCert, issuerCert *x509.Certificate, ocspServerURL string) (*ocsp.Response, error)
+}
+
+// OCSPClientConfig configures HTTP client used to perform OCSP queries
+type OCSPClientConfig struct {
+	// Timeout limits each HTTP request including connection and reading of response
+	Timeout time.Duration
+	// ProxyURL is URL of HTTP proxy, proxy from environment (HTTP_PROXY, HTTPS_PROXY, NO_PROXY) is used if empty
+	ProxyURL string
+	// CABundlePath is path to PEM file with CA certificates to verify OCSP servers over HTTPS, system roots are
+	// used if empty
+	CABundlePath string
+	// Retries is number of times failed request is repeated, requests are retried on network errors and 5xx
+	// HTTP statuses
+	Retries uint
+	// RetryDelay is delay before first retry, it's doubled for next ones
+	RetryDelay time.Duration
+	// ForcePOST disables GET requests, for servers which mishandle them
+	ForcePOST bool
+	// Nonce is one of OcspNonceValuesList, whether to add nonce extension (RFC 8954) to requests and how to verify
+	// it in responses, empty value is the same as OcspNonceNoneStr
+	Nonce string
+	// ClockSkew is tolerance of local and server clocks difference used to check ThisUpdate and NextUpdate of
+	// responses
+	ClockSkew time.Duration
+}
+
+// DefaultOCSPClientConfig returns OCSPClientConfig with default timeout and without retries
+func DefaultOCSPClientConfig() OCSPClientConfig {
+	return OCSPClientConfig{Timeout: OcspHttpClientDefaultTimeout, RetryDelay: OcspDefaultRetryDelay, ClockSkew: OcspDefaultClockSkew}
 }
 
 // DefaultOCSPClient is a default implementation of OCSPClient
 type DefaultOCSPClient struct {
 	httpClient *http.Client
+	retries    uint
+	retryDelay time.Duration
+	forcePOST  bool
+	nonce      int // ocspNonce*
+	clockSkew  time.Duration
 }
 
-// NewDefaultOCSPClient creates new DefaultOCSPClient
+// NewDefaultOCSPClient creates new DefaultOCSPClient with DefaultOCSPClientConfig
 func NewDefaultOCSPClient() DefaultOCSPClient {
 	return DefaultOCSPClient{httpClient: &http.Client{
 		Timeout: OcspHttpClientDefaultTimeout,
-	}}
+	}, retryDelay: OcspDefaultRetryDelay, clockSkew: OcspDefaultClockSkew}
+}
+
+// NewOCSPClient creates new DefaultOCSPClient with HTTP client configured by config
+func NewOCSPClient(config OCSPClientConfig) (DefaultOCSPClient, error) {
+	if config.Timeout <= 0 {
+		return DefaultOCSPClient{}, ErrInvalidConfigOCSPTimeout
+	}
+	nonce := ocspNonceNone
+	if config.Nonce != "" {
+		var ok bool
+		if nonce, ok = ocspNonceValValues[config.Nonce]; !ok {
+			return DefaultOCSPClient{}, ErrInvalidConfigOCSPNonce
+		}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if config.ProxyURL != "" {
+		proxyURL, err := url_.Parse(config.ProxyURL)
+		if err != nil || proxyURL.Host == "" {
+			return DefaultOCSPClient{}, ErrInvalidConfigOCSPProxy
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+	if config.CABundlePath != "" {
+		bundle, err := ioutil.ReadFile(config.CABundlePath)
+		if err != nil {
+			return DefaultOCSPClient{}, err
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(bundle) {
+			return DefaultOCSPClient{}, ErrInvalidConfigOCSPCABundle
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: roots}
+	}
+	return DefaultOCSPClient{
+		httpClient: &http.Client{Timeout: config.Timeout, Transport: transport},
+		retries:    config.Retries,
+		retryDelay: config.RetryDelay,
+		forcePOST:  config.ForcePOST,
+		nonce:      nonce,
+		clockSkew:  config.ClockSkew,
+	}, nil
+}
+
+// Client returns OCSP client configured by OCSPClientConfig passed to NewOCSPConfig
+func (c *OCSPConfig) Client() DefaultOCSPClient {
+	return c.client
+}
+
+// OCSPRawClient is used to perform OCSP queries when DER-encoded response is needed, like for OCSP stapling
+type OCSPRawClient interface {
+	// QueryRaw generates OCSP request about specified certificate, sends it to server and returns the response
+	// both DER-encoded and parsed, the request is aborted when ctx is done
+	QueryRaw(ctx context.Context, commonName string, clientCert, issuerCert *x509.Certificate, ocspServerURL string) ([]byte, *ocsp.Response, error)
 }
 
 // Query generates OCSP request about specified certificate, sends it to server and returns the response
-func (c DefaultOCSPClient) Query(commonName string, clientCert, issuerCert *x509.Certificate, ocspServerURL string) (*ocsp.Response, error) {
+func (c DefaultOCSPClient) Query(ctx context.Context, commonName string, clientCert, issuerCert *x509.Certificate, ocspServerURL string) (*ocsp.Response, error) {
+	_, response, err := c.QueryRaw(ctx, commonName, clientCert, issuerCert, ocspServerURL)
+	return response, err
+}
+
+// QueryRaw generates OCSP request about specified certificate, sends it to server and returns the response both
+// DER-encoded and parsed
+func (c DefaultOCSPClient) QueryRaw(ctx context.Context, commonName string, clientCert, issuerCert *x509.Certificate, ocspServerURL string) ([]byte, *ocsp.Response, error) {
 	opts := &ocsp.RequestOptions{Hash: crypto.SHA256}
 	buffer, err := ocsp.CreateRequest(clientCert, issuerCert, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	var nonce []byte
+	if c.nonce != ocspNonceNone {
+		nonce = make([]byte, ocspNonceLength)
+		if _, err := rand.Read(nonce); err != nil {
+			return nil, nil, err
+		}
+		buffer, err = addOCSPRequestNonce(buffer, nonce)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	ocspURL, err := url_.Parse(ocspServerURL)
+	if err != nil {
+		return nil, nil, err
+	}
+	delay := c.retryDelay
+	for attempt := uint(0); ; attempt++ {
+		output, retry, err := c.send(ctx, ocspURL, buffer)
+		if err == nil {
+			ocspResponse, err := ocsp.ParseResponse(output, issuerCert)
+			if err != nil {
+				return nil, nil, err
+			}
+			if err := c.verifyResponse(ocspResponse, nonce); err != nil {
+				return nil, nil, err
+			}
+			return output, ocspResponse, nil
+		}
+		if !retry || attempt >= c.retries {
+			return nil, nil, err
+		}
+		log.WithError(err).WithField("url", ocspServerURL).Debugf("OCSP: Request failed, retry in %v", delay)
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, nil, ctx.Err()
+		case <-timer.C:
+		}
+		delay *= 2
+	}
+}
+
+// ocspNonceLength is length of nonce added to requests, RFC 8954 recommends 32 bytes
+const ocspNonceLength = 32
+
+// oidOCSPNonce is identifier of nonce extension of OCSP requests and responses
+var oidOCSPNonce = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 2}
+
+// ocspRequestASN1 is OCSPRequest (RFC 6960, section 4.1.1) without signature, which isn't used by ocsp.CreateRequest
+type ocspRequestASN1 struct {
+	TBSRequest ocspTBSRequestASN1
+}
+
+type ocspTBSRequestASN1 struct {
+	Version       int           `asn1:"explicit,tag:0,default:0,optional"`
+	RequestorName asn1.RawValue `asn1:"explicit,tag:1,optional"`
+	RequestList   []asn1.RawValue
+	Extensions    []pkix.Extension `asn1:"explicit,tag:2,optional"`
+}
+
+// addOCSPRequestNonce returns DER-encoded OCSP request with nonce extension added to requestExtensions, since
+// ocsp.CreateRequest can't add extensions
+func addOCSPRequestNonce(request, nonce []byte) ([]byte, error) {
+	var parsed ocspRequestASN1
+	rest, err := asn1.Unmarshal(request, &parsed)
 	if err != nil {
 		return nil, err
 	}
-	httpRequest, err := http.NewRequest(http.MethodPost, ocspServerURL, bytes.NewBuffer(buffer))
+	if len(rest) != 0 {
+		return nil, asn1.SyntaxError{Msg: "trailing data after OCSP request"}
+	}
+	value, err := asn1.Marshal(nonce)
 	if err != nil {
 		return nil, err
 	}
-	ocspURL, err := url_.Parse(ocspServerURL)
+	parsed.TBSRequest.Extensions = append(parsed.TBSRequest.Extensions, pkix.Extension{Id: oidOCSPNonce, Value: value})
+	return asn1.Marshal(parsed)
+}
+
+// verifyResponse checks that response was produced within ThisUpdate/NextUpdate window with tolerance of clock
+// skew, and contains nonce of request if it was sent
+func (c DefaultOCSPClient) verifyResponse(response *ocsp.Response, nonce []byte) error {
+	now := time.Now()
+	if response.ThisUpdate.After(now.Add(c.clockSkew)) {
+		return fmt.Errorf("%w, ThisUpdate %s", ErrOCSPResponseNotYetValid, response.ThisUpdate)
+	}
+	if !response.NextUpdate.IsZero() && response.NextUpdate.Before(now.Add(-c.clockSkew)) {
+		return fmt.Errorf("%w at %s", ErrOCSPResponseExpired, response.NextUpdate)
+	}
+	if c.nonce == ocspNonceNone {
+		return nil
+	}
+	for _, extension := range response.Extensions {
+		if !extension.Id.Equal(oidOCSPNonce) {
+			continue
+		}
+		// value should be DER-encoded OCTET STRING, but some servers put raw nonce
+		var responseNonce []byte
+		if rest, err := asn1.Unmarshal(extension.Value, &responseNonce); err != nil || len(rest) != 0 {
+			responseNonce = extension.Value
+		}
+		if !bytes.Equal(responseNonce, nonce) {
+			return ErrOCSPNonceMismatch
+		}
+		return nil
+	}
+	if c.nonce == ocspNonceRequire {
+		return ErrOCSPNonceMissing
+	}
+	log.Debugln("OCSP: Server didn't echo nonce of request")
+	return nil
+}
+
+// ocspMaxGETRequestLength is limit of encoded request sent with GET, longer requests are sent with POST
+const ocspMaxGETRequestLength = 255
+
+// newHTTPRequest returns HTTP request with OCSP request encoded into URL (RFC 6960, appendix A.1) if it's shorter
+// than ocspMaxGETRequestLength and POST isn't forced, GET requests may be cached by CDNs. Otherwise OCSP request is
+// sent as body of POST.
+func (c DefaultOCSPClient) newHTTPRequest(ctx context.Context, ocspURL *url_.URL, request []byte) (*http.Request, error) {
+	if encoded := url_.QueryEscape(base64.StdEncoding.EncodeToString(request)); !c.forcePOST && len(encoded) < ocspMaxGETRequestLength {
+		getURL := strings.TrimSuffix(ocspURL.String(), "/") + "/" + encoded
+		httpRequest, err := http.NewRequestWithContext(ctx, http.MethodGet, getURL, nil)
+		if err != nil {
+			return nil, err
+		}
+		httpRequest.Header.Add("Accept", "application/ocsp-response")
+		return httpRequest, nil
+	}
+	httpRequest, err := http.NewRequestWithContext(ctx, http.MethodPost, ocspURL.String(), bytes.NewBuffer(request))
 	if err != nil {
 		return nil, err
 	}
 	httpRequest.Header.Add("Content-Type", "application/ocsp-request")
 	httpRequest.Header.Add("Accept", "application/ocsp-response")
 	httpRequest.Header.Add("host", ocspURL.Host)
+	return httpRequest, nil
+}
+
+// send sends OCSP request and returns body of response, or error and true if request may be retried
+func (c DefaultOCSPClient) send(ctx context.Context, ocspURL *url_.URL, request []byte) ([]byte, bool, error) {
+	httpRequest, err := c.newHTTPRequest(ctx, ocspURL, request)
+	if err != nil {
+		return nil, false, err
+	}
 	httpResponse, err := c.httpClient.Do(httpRequest)
 	if err != nil {
-		return nil, err
+		// request cancelled by ctx isn't retried
+		return nil, ctx.Err() == nil, err
 	}
 	defer httpResponse.Body.Close()
+	if httpResponse.StatusCode != http.StatusOK {
+		return nil, httpResponse.StatusCode >= http.StatusInternalServerError, fmt.Errorf("%w %d", ErrOCSPHTTPStatus, httpResponse.StatusCode)
+	}
 	output, err := ioutil.ReadAll(httpResponse.Body)
 	if err != nil {
-		return nil, err
+		return nil, ctx.Err() == nil, err
 	}
-	ocspResponse, err := ocsp.ParseResponse(output, issuerCert)
-	return ocspResponse, err
+	return output, false, nil
 }
 
 // DefaultOCSPVerifier is a default OCSP verifier
@@ -250,104 +618,207 @@ type DefaultOCSPVerifier struct {
 type ocspServerToCheck struct {
 	url      string
 	fromCert bool
+	role     string
 }
 
-func (v DefaultOCSPVerifier) verifyCertWithIssuer(cert, issuer *x509.Certificate, useConfigURL bool) error {
-	log.Debugf("OCSP: Verifying '%s'", cert.Subject.String())
+// ocspQueryResult is response or error of one OCSP server
+type ocspQueryResult struct {
+	server   ocspServerToCheck
+	response *ocsp.Response
+	err      error
+}
 
-	for _, ocspServer := range cert.OCSPServer {
-		log.Debugf("OCSP: certificate contains OCSP URL: %s", ocspServer)
-	}
+// ocspWaveResult summarizes responses of servers queried at once
+type ocspWaveResult struct {
+	// servers is number of queried servers which can confirm the certificate, i.e. not advisory ones
+	servers  int
+	confirms int
+	// responded is true if any server from configuration responded
+	responded bool
+}
 
-	serversToCheck := []ocspServerToCheck{}
+// requiredError returns error to deny the certificate with if server didn't respond, nil if it's allowed
+func (v DefaultOCSPVerifier) requiredError(server ocspServerToCheck) error {
+	switch server.role {
+	case OCSPResponderRoleRequired:
+		return ErrOCSPRequiredResponderFailed
+	case OCSPResponderRoleAdvisory:
+		return nil
+	}
+	if v.Config.required == ocspRequiredGood {
+		return ErrOCSPRequiredAllButGotError
+	}
+	return nil
+}
 
+// serverWaves returns servers grouped into waves of concurrent queries. The first wave contains servers from
+// certificate and responders from configuration with highest priority, next waves contain backup responders.
+func (v DefaultOCSPVerifier) serverWaves(cert *x509.Certificate, useConfigURL bool) [][]ocspServerToCheck {
+	serversFromCert := []ocspServerToCheck{}
 	if v.Config.fromCert != ocspFromCertIgnore {
 		for _, ocspServer := range cert.OCSPServer {
 			serverToCheck := ocspServerToCheck{url: ocspServer, fromCert: true}
 			log.Debugf("OCSP: appending server %s, from cert", serverToCheck.url)
-			serversToCheck = append(serversToCheck, serverToCheck)
+			serversFromCert = append(serversFromCert, serverToCheck)
 		}
 	} else if len(cert.OCSPServer) > 0 {
 		log.Debugf("OCSP: Ignoring %d OCSP servers from certificate", len(cert.OCSPServer))
 	}
 
-	if v.Config.url != "" && useConfigURL {
-		serverToCheck := ocspServerToCheck{url: v.Config.url, fromCert: false}
-
-		if v.Config.fromCert == ocspFromCertPrefer || v.Config.fromCert == ocspFromCertTrust {
-			log.Debugf("OCSP: appending server %s, from config", serverToCheck.url)
-			serversToCheck = append(serversToCheck, serverToCheck)
-		} else {
-			log.Debugf("OCSP: prepending server %s, from config", serverToCheck.url)
-			serversToCheck = append([]ocspServerToCheck{serverToCheck}, serversToCheck...)
+	waves := [][]ocspServerToCheck{}
+	if useConfigURL {
+		for i, responder := range v.Config.responders {
+			serverToCheck := ocspServerToCheck{url: responder.URL, fromCert: false, role: responder.Role}
+			if i == 0 || responder.Priority != v.Config.responders[i-1].Priority {
+				waves = append(waves, nil)
+			}
+			log.Debugf("OCSP: appending server %s, from config, priority %d", serverToCheck.url, responder.Priority)
+			waves[len(waves)-1] = append(waves[len(waves)-1], serverToCheck)
 		}
 	}
+	if len(waves) == 0 {
+		return [][]ocspServerToCheck{serversFromCert}
+	}
+	if v.Config.fromCert == ocspFromCertPrefer || v.Config.fromCert == ocspFromCertTrust {
+		waves[0] = append(serversFromCert, waves[0]...)
+	} else {
+		waves[0] = append(waves[0], serversFromCert...)
+	}
+	return waves
+}
 
-	queriedOCSPs := make(map[string]struct{})
+func (v DefaultOCSPVerifier) verifyCertWithIssuer(ctx context.Context, cert, issuer *x509.Certificate, useConfigURL bool) error {
+	log.Debugf("OCSP: Verifying '%s'", cert.Subject.String())
 
-	confirms := 0
+	for _, ocspServer := range cert.OCSPServer {
+		log.Debugf("OCSP: certificate contains OCSP URL: %s", ocspServer)
+	}
 
-	for _, serverToCheck := range serversToCheck {
-		log.Debugf("OCSP: Trying server %s", serverToCheck.url)
+	queriedOCSPs := make(map[string]struct{})
+	total := ocspWaveResult{}
+	for i, wave := range v.serverWaves(cert, useConfigURL) {
+		if i > 0 {
+			if total.responded || ctx.Err() != nil {
+				break
+			}
+			log.Debugln("OCSP: Configured responders didn't respond, trying backup responders")
+		}
+		result, err := v.queryWave(ctx, cert, issuer, wave, queriedOCSPs)
+		if err != nil {
+			return err
+		}
+		total.servers += result.servers
+		total.confirms += result.confirms
+		total.responded = result.responded
+	}
 
+	return v.checkConfirms(total.servers, total.confirms)
+}
+
+// queryWave queries servers concurrently, each URL once. Queries still running on return are aborted
+func (v DefaultOCSPVerifier) queryWave(ctx context.Context, cert, issuer *x509.Certificate, servers []ocspServerToCheck, queriedOCSPs map[string]struct{}) (ocspWaveResult, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	wave := ocspWaveResult{}
+	results := make(chan ocspQueryResult, len(servers))
+	pending := make(map[string]ocspServerToCheck, len(servers))
+	for _, serverToCheck := range servers {
 		if _, ok := queriedOCSPs[serverToCheck.url]; ok {
-			log.Debugln("OCSP: Skipping, already queried")
+			log.Debugf("OCSP: Skipping %s, already queried", serverToCheck.url)
 			continue
 		}
+		queriedOCSPs[serverToCheck.url] = struct{}{}
+		pending[serverToCheck.url] = serverToCheck
+		if serverToCheck.role != OCSPResponderRoleAdvisory {
+			wave.servers++
+		}
+		log.Debugf("OCSP: Trying server %s", serverToCheck.url)
+		go func(server ocspServerToCheck) {
+			queryCtx, cancel := context.WithTimeout(ctx, v.Config.queryTimeout)
+			defer cancel()
+			response, err := v.Client.Query(queryCtx, cert.Issuer.CommonName, cert, issuer, server.url)
+			results <- ocspQueryResult{server: server, response: response, err: err}
+		}(serverToCheck)
+	}
 
-		response, err := v.Client.Query(cert.Issuer.CommonName, cert, issuer, serverToCheck.url)
-		if err != nil {
-			log.WithError(err).WithField("url", serverToCheck.url).Warnln("Cannot query OCSP server")
+	for len(pending) > 0 {
+		var result ocspQueryResult
+		select {
+		case result = <-results:
+		case <-ctx.Done():
+			if ctx.Err() == context.Canceled {
+				// verification isn't needed anymore, like when peer disconnected
+				return wave, ctx.Err()
+			}
+			log.WithError(ctx.Err()).Warnf("OCSP: %d server(s) didn't respond in time", len(pending))
+			for _, server := range pending {
+				if err := v.requiredError(server); err != nil {
+					return wave, err
+				}
+			}
+			return wave, nil
+		}
+		delete(pending, result.server.url)
+		logger := log.WithField("url", result.server.url)
 
-			if v.Config.required == ocspRequiredGood {
-				return ErrOCSPRequiredAllButGotError
+		if result.err != nil {
+			logger.WithError(result.err).Warnln("Cannot query OCSP server")
+
+			if err := v.requiredError(result.server); err != nil {
+				return wave, err
 			}
 
 			continue
 		}
+		if !result.server.fromCert {
+			wave.responded = true
+		}
 
-		switch response.Status {
+		switch result.response.Status {
 		case ocsp.Good:
-			confirms++
+			if result.server.role == OCSPResponderRoleAdvisory {
+				logger.Debugln("OCSP: confirmed by advisory server, not counted")
+				continue
+			}
+			wave.confirms++
 
-			if serverToCheck.fromCert {
+			if result.server.fromCert {
 				log.Debugln("OCSP: confirmed by server from certificate")
 			} else {
 				log.Debugln("OCSP: confirmed by server from config")
 			}
-
-			if v.Config.required != ocspRequiredGood {
-				// One confirmation is enough if we don't require all OCSP servers to confirm the certificate validity
-				break
-			}
-
-			if serverToCheck.fromCert && v.Config.fromCert == ocspFromCertTrust {
-				// If this OCSP server came from certificate and `--tls_ocsp_from_cert=trust`, don't perform further checks
-				break
-			}
 		case ocsp.Revoked:
 			// If any OCSP server replies with "certificate was revoked", return error immediately
-			log.WithField("serial", cert.SerialNumber).WithField("revoked_at", response.RevokedAt).Warnln("OCSP: Certificate was revoked")
-			return ErrCertWasRevoked
+			logger.WithField("serial", cert.SerialNumber).WithField("revoked_at", result.response.RevokedAt).Warnln("OCSP: Certificate was revoked")
+			return wave, ErrCertWasRevoked
 		case ocsp.Unknown:
-			// Treat "Unknown" response as error if tls_ocsp_required is "yes" or "all"
-			if v.Config.required != ocspRequiredAllowUnknown {
-				log.WithField("url", serverToCheck.url).WithField("serial", cert.SerialNumber).Warnln("OCSP server doesn't know about certificate")
-				return ErrOCSPUnknownCertificate
+			// Treat "Unknown" response as error if tls_ocsp_required is "yes" or "all", or responder is required
+			switch {
+			case result.server.role == OCSPResponderRoleAdvisory:
+				logger.WithField("serial", cert.SerialNumber).Infoln("OCSP: Advisory server doesn't know about certificate")
+			case result.server.role == OCSPResponderRoleRequired || v.Config.required != ocspRequiredAllowUnknown:
+				logger.WithField("serial", cert.SerialNumber).Warnln("OCSP server doesn't know about certificate")
+				return wave, ErrOCSPUnknownCertificate
 			}
 		}
-
-		queriedOCSPs[serverToCheck.url] = struct{}{}
 	}
 
-	if len(serversToCheck) > 0 && confirms == 0 {
+	return wave, nil
+}
+
+// checkConfirms returns error if there were servers to check but none of them confirmed the certificate
+func (v DefaultOCSPVerifier) checkConfirms(servers, confirms int) error {
+	if servers > 0 && confirms == 0 {
 		return ErrOCSPNoConfirms
 	}
 	return nil
 }
 
 // Verify ensures certificate is not revoked by querying configured OCSP servers
-func (v DefaultOCSPVerifier) Verify(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+func (v DefaultOCSPVerifier) Verify(ctx context.Context, rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	ctx, cancel := context.WithTimeout(ctx, v.Config.verifyTimeout)
+	defer cancel()
+
 	for _, chain := range verifiedChains {
 		if len(chain) == 0 {
 			switch v.Config.ClientAuthType {
@@ -362,18 +833,14 @@ func (v DefaultOCSPVerifier) Verify(rawCerts [][]byte, verifiedChains [][]*x509.
 		if len(chain) == 1 {
 			log.WithField("serial", chain[0].SerialNumber).
 				Warnln("OCSP: Certificate chain consists of one root certificate, it is recommended to use dedicated non-root certificates for TLS handshake")
-			return v.verifyCertWithIssuer(chain[0], chain[0], false)
+			return v.verifyChainLevel(ctx, chain, 0, false)
 		}
 
 		for i := 0; i < len(chain)-1; i++ {
-			cert := chain[i]
-			issuer := chain[i+1]
-
-			// 3rd argument, useConfigURL, whether to use OCSP server URL from configuration (if set),
+			// 4th argument, useConfigURL, whether to use OCSP server URL from configuration (if set),
 			// don't use it for other certificates except end one (i.e. don't use it when checking intermediate
 			// certificates because v.Config.checkOnlyLeafCertificate == false)
-			err := v.verifyCertWithIssuer(cert, issuer, i == 0)
-			if err != nil {
+			if err := v.verifyChainLevel(ctx, chain, i, i == 0); err != nil {
 				return err
 			}
 
@@ -385,3 +852,19 @@ func (v DefaultOCSPVerifier) Verify(rawCerts [][]byte, verifiedChains [][]*x509.
 
 	return nil
 }
+
+// verifyChainLevel verifies certificate chain[level] with its issuer, the next one in chain or itself if it's the
+// only one. Returned error contains level (0 is leaf) and subject of certificate which failed verification.
+func (v DefaultOCSPVerifier) verifyChainLevel(ctx context.Context, chain []*x509.Certificate, level int, useConfigURL bool) error {
+	cert, issuer := chain[level], chain[level]
+	if level+1 < len(chain) {
+		issuer = chain[level+1]
+	}
+	logger := log.WithFields(log.Fields{"chain_level": level, "subject": cert.Subject.String(), "serial": cert.SerialNumber})
+	if err := v.verifyCertWithIssuer(ctx, cert, issuer, useConfigURL); err != nil {
+		logger.WithError(err).Warnln("OCSP: Certificate of chain didn't pass verification")
+		return fmt.Errorf("%w: certificate #%d of chain '%s'", err, level, cert.Subject.String())
+	}
+	logger.Debugln("OCSP: Certificate of chain passed verification")
+	return nil
+}
@@ -0,0 +1,200 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package network
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/cossacklabs/acra/logging"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ocsp"
+)
+
+// Defaults of OCSPStapler
+const (
+	DefaultOCSPStaplingRefreshInterval = time.Hour
+	// failed refresh is retried earlier than regular one
+	ocspStaplingRetryInterval = time.Minute
+)
+
+// Errors returned by OCSPStapler
+var (
+	ErrOCSPStaplingNoCertificate = errors.New("TLS config has no certificate to staple OCSP response for")
+	ErrOCSPStaplingNoIssuer      = errors.New("certificate file should contain issuer certificate after leaf one to staple OCSP response")
+	ErrOCSPStaplingNoServer      = errors.New("certificate doesn't list OCSP servers and OCSP stapling URL isn't set")
+	ErrOCSPStaplingNotGood       = errors.New("OCSP server didn't confirm own certificate")
+)
+
+// OCSPStapler fetches OCSP responses for own certificate of TLS listener and staples them into handshakes, so peers
+// don't need to query OCSP server themselves. Last good response is stapled until its next update time.
+type OCSPStapler struct {
+	mutex        sync.RWMutex
+	certificate  tls.Certificate
+	stapled      *tls.Certificate
+	nextUpdate   time.Time
+	leaf         *x509.Certificate
+	issuer       *x509.Certificate
+	url          string
+	configURL    string
+	client       OCSPRawClient
+	queryTimeout time.Duration
+	now          func() time.Time
+}
+
+// NewOCSPStapler returns OCSPStapler for the only certificate of config. If url is empty, first OCSP server listed in
+// certificate is used.
+func NewOCSPStapler(config *tls.Config, url string, client OCSPRawClient, queryTimeout time.Duration) (*OCSPStapler, error) {
+	if len(config.Certificates) != 1 {
+		return nil, ErrOCSPStaplingNoCertificate
+	}
+	if queryTimeout <= 0 {
+		return nil, ErrInvalidConfigOCSPTimeout
+	}
+	stapler := &OCSPStapler{
+		configURL:    url,
+		client:       client,
+		queryTimeout: queryTimeout,
+		now:          time.Now,
+	}
+	if err := stapler.SetCertificate(config.Certificates[0]); err != nil {
+		return nil, err
+	}
+	return stapler, nil
+}
+
+// SetCertificate replaces own certificate, e.g. after reload by TLSReloader. Response stapled for previous
+// certificate isn't served anymore, Refresh should be called to staple new one.
+func (stapler *OCSPStapler) SetCertificate(certificate tls.Certificate) error {
+	if len(certificate.Certificate) < 2 {
+		return ErrOCSPStaplingNoIssuer
+	}
+	leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil {
+		return err
+	}
+	issuer, err := x509.ParseCertificate(certificate.Certificate[1])
+	if err != nil {
+		return err
+	}
+	url := stapler.configURL
+	if url == "" {
+		if len(leaf.OCSPServer) == 0 {
+			return ErrOCSPStaplingNoServer
+		}
+		url = leaf.OCSPServer[0]
+	}
+	stapler.mutex.Lock()
+	stapler.certificate, stapler.leaf, stapler.issuer, stapler.url = certificate, leaf, issuer, url
+	stapler.stapled, stapler.nextUpdate = nil, time.Time{}
+	stapler.mutex.Unlock()
+	return nil
+}
+
+// Apply makes config of TLS listener serve certificate with stapled OCSP response
+func (stapler *OCSPStapler) Apply(config *tls.Config) {
+	config.Certificates = nil
+	config.GetCertificate = stapler.GetCertificate
+}
+
+// GetCertificate returns certificate with last OCSP response, or without it if there is no valid response.
+// Used as tls.Config.GetCertificate.
+func (stapler *OCSPStapler) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	stapler.mutex.RLock()
+	defer stapler.mutex.RUnlock()
+	if stapler.stapled != nil && (stapler.nextUpdate.IsZero() || stapler.now().Before(stapler.nextUpdate)) {
+		return stapler.stapled, nil
+	}
+	return &stapler.certificate, nil
+}
+
+// Refresh queries OCSP server and staples response if it confirms the certificate. Previous response is kept on
+// error until its next update time.
+func (stapler *OCSPStapler) Refresh(ctx context.Context) error {
+	stapler.mutex.RLock()
+	certificate, leaf, issuer, url := stapler.certificate, stapler.leaf, stapler.issuer, stapler.url
+	stapler.mutex.RUnlock()
+	queryCtx, cancel := context.WithTimeout(ctx, stapler.queryTimeout)
+	defer cancel()
+	raw, response, err := stapler.client.QueryRaw(queryCtx, leaf.Issuer.CommonName, leaf, issuer, url)
+	if err != nil {
+		return err
+	}
+	stapler.mutex.Lock()
+	defer stapler.mutex.Unlock()
+	// certificate was replaced during query, response is about previous one
+	if stapler.leaf != leaf {
+		return nil
+	}
+	if response.Status != ocsp.Good {
+		if response.Status == ocsp.Revoked {
+			// don't serve confirmation which became outdated
+			stapler.stapled = nil
+		}
+		return ErrOCSPStaplingNotGood
+	}
+	stapled := certificate
+	stapled.OCSPStaple = raw
+	stapler.stapled, stapler.nextUpdate = &stapled, response.NextUpdate
+	log.WithField("next_update", response.NextUpdate).Debugln("OCSP stapling: response refreshed")
+	return nil
+}
+
+// nextRefresh returns time until next refresh, earlier than interval if stapled response expires before it
+func (stapler *OCSPStapler) nextRefresh(interval time.Duration, lastErr error) time.Duration {
+	if lastErr != nil && ocspStaplingRetryInterval < interval {
+		interval = ocspStaplingRetryInterval
+	}
+	stapler.mutex.RLock()
+	nextUpdate := stapler.nextUpdate
+	stapler.mutex.RUnlock()
+	if nextUpdate.IsZero() {
+		return interval
+	}
+	if halfValid := nextUpdate.Sub(stapler.now()) / 2; halfValid < interval {
+		if halfValid < time.Second {
+			return time.Second
+		}
+		return halfValid
+	}
+	return interval
+}
+
+// Run refreshes OCSP response every interval until ctx is done
+func (stapler *OCSPStapler) Run(ctx context.Context, interval time.Duration) {
+	var err error
+	for {
+		timer := time.NewTimer(stapler.nextRefresh(interval, err))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		if err = stapler.Refresh(ctx); err != nil {
+			stapler.mutex.RLock()
+			url := stapler.url
+			stapler.mutex.RUnlock()
+			log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorNetworkTLSGeneral).
+				WithField("url", url).Warnln("OCSP stapling: can't refresh response")
+		}
+	}
+}
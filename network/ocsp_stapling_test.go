@@ -0,0 +1,184 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package network
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// testOCSPRawClient returns configured response or error
+type testOCSPRawClient struct {
+	raw      []byte
+	response *ocsp.Response
+	err      error
+}
+
+func (c *testOCSPRawClient) QueryRaw(ctx context.Context, commonName string, clientCert, issuerCert *x509.Certificate, ocspServerURL string) ([]byte, *ocsp.Response, error) {
+	return c.raw, c.response, c.err
+}
+
+// getTestStaplingCertificate returns certificate of server signed by generated CA, with issuer in chain
+func getTestStaplingCertificate(t *testing.T, ocspServers []string) tls.Certificate {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "acra-server"},
+		DNSNames:     []string{"acra-server"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		OCSPServer:   ocspServers,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der, caDER}, PrivateKey: key}
+}
+
+func TestOCSPStapler(t *testing.T) {
+	client := &testOCSPRawClient{}
+	certificate := getTestStaplingCertificate(t, []string{"http://ocsp.example.com"})
+	withoutIssuer := certificate
+	withoutIssuer.Certificate = certificate.Certificate[:1]
+	for _, testcase := range []struct {
+		config   *tls.Config
+		url      string
+		expected error
+	}{
+		{&tls.Config{}, "", ErrOCSPStaplingNoCertificate},
+		{&tls.Config{Certificates: []tls.Certificate{withoutIssuer}}, "", ErrOCSPStaplingNoIssuer},
+		{&tls.Config{Certificates: []tls.Certificate{getTestStaplingCertificate(t, nil)}}, "", ErrOCSPStaplingNoServer},
+	} {
+		if _, err := NewOCSPStapler(testcase.config, testcase.url, client, time.Second); err != testcase.expected {
+			t.Fatalf("Expected %v, took %v", testcase.expected, err)
+		}
+	}
+	if _, err := NewOCSPStapler(&tls.Config{Certificates: []tls.Certificate{getTestStaplingCertificate(t, nil)}}, "http://ocsp.example.com", client, time.Second); err != nil {
+		t.Fatalf("Unexpected error with URL from config: %v", err)
+	}
+
+	config := &tls.Config{Certificates: []tls.Certificate{certificate}}
+	stapler, err := NewOCSPStapler(config, "", client, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stapler.Apply(config)
+	now := time.Now()
+	stapler.now = func() time.Time { return now }
+	staple := func() []byte {
+		stapled, err := stapler.GetCertificate(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return stapled.OCSPStaple
+	}
+	if staple() != nil {
+		t.Fatal("Expected certificate without staple before refresh")
+	}
+
+	client.raw, client.response = []byte("good response"), &ocsp.Response{Status: ocsp.Good, NextUpdate: now.Add(time.Hour)}
+	if err := stapler.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(staple(), client.raw) {
+		t.Fatal("Response isn't stapled")
+	}
+	// response expires after refresh interval, so it's refreshed earlier
+	if next := stapler.nextRefresh(2*time.Hour, nil); next != 30*time.Minute {
+		t.Fatalf("Expected refresh in 30m, took %v", next)
+	}
+	if next := stapler.nextRefresh(2*time.Hour, errors.New("unavailable")); next != ocspStaplingRetryInterval {
+		t.Fatalf("Expected retry in %v, took %v", ocspStaplingRetryInterval, next)
+	}
+
+	// the handshake contains stapled response
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+	go tls.Server(serverConn, config).Handshake()
+	tlsClient := tls.Client(clientConn, &tls.Config{InsecureSkipVerify: true})
+	if err := tlsClient.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(tlsClient.ConnectionState().OCSPResponse, client.raw) {
+		t.Fatal("Handshake doesn't contain stapled response")
+	}
+
+	// failed refresh keeps previous response until it expires
+	client.err = errors.New("unavailable")
+	if err := stapler.Refresh(context.Background()); err != client.err {
+		t.Fatalf("Expected error of client, took %v", err)
+	}
+	if !bytes.Equal(staple(), []byte("good response")) {
+		t.Fatal("Response isn't kept after failed refresh")
+	}
+	now = now.Add(2 * time.Hour)
+	if staple() != nil {
+		t.Fatal("Expired response is stapled")
+	}
+
+	// revoked certificate isn't stapled
+	now = now.Add(-2 * time.Hour)
+	client.err = nil
+	client.raw, client.response = []byte("revoked response"), &ocsp.Response{Status: ocsp.Revoked}
+	if err := stapler.Refresh(context.Background()); err != ErrOCSPStaplingNotGood {
+		t.Fatalf("Expected ErrOCSPStaplingNotGood, took %v", err)
+	}
+	if staple() != nil {
+		t.Fatal("Response is stapled after revocation")
+	}
+}
@@ -17,16 +17,27 @@ limitations under the License.
 package network
 
 import (
+	"context"
 	"crypto"
 	"crypto/rsa"
 	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
 	"encoding/pem"
 	"errors"
 	"fmt"
 	"golang.org/x/crypto/ocsp"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
+	url_ "net/url"
+	"os"
 	"path"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -87,28 +98,43 @@ type ocspServerConfig struct {
 func getTestOCSPServer(t *testing.T, config ocspServerConfig) (*http.Server, string) {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", func(res http.ResponseWriter, req *http.Request) {
-		contentType, ok := req.Header["Content-Type"]
-		if !ok {
-			t.Log("No Content-Type header in request\n")
-			res.WriteHeader(400)
-			return
-		}
+		var rawOCSPRequest []byte
+		if req.Method == http.MethodGet {
+			// request is encoded into last segment of URL, slashes of base64 are escaped
+			encoded, err := url_.QueryUnescape(path.Base(req.URL.EscapedPath()))
+			if err == nil {
+				rawOCSPRequest, err = base64.StdEncoding.DecodeString(encoded)
+			}
+			if err != nil {
+				t.Logf("Cannot decode the request from URL: %v\n", err)
+				res.WriteHeader(400)
+				return
+			}
+		} else {
+			contentType, ok := req.Header["Content-Type"]
+			if !ok {
+				t.Log("No Content-Type header in request\n")
+				res.WriteHeader(400)
+				return
+			}
 
-		if len(contentType) > 1 || contentType[0] != "application/ocsp-request" {
-			t.Log("Content-Type != application/ocsp-request\n")
-			res.WriteHeader(400)
-			return
-		}
+			if len(contentType) > 1 || contentType[0] != "application/ocsp-request" {
+				t.Log("Content-Type != application/ocsp-request\n")
+				res.WriteHeader(400)
+				return
+			}
 
-		rawOCSPRequest := make([]byte, 1024*16)
-		n, err := req.Body.Read(rawOCSPRequest)
-		if err != nil && err.Error() != "EOF" {
-			t.Logf("Cannot read the request: %v\n", err)
-			res.WriteHeader(400)
-			return
+			rawOCSPRequest = make([]byte, 1024*16)
+			n, err := req.Body.Read(rawOCSPRequest)
+			if err != nil && err.Error() != "EOF" {
+				t.Logf("Cannot read the request: %v\n", err)
+				res.WriteHeader(400)
+				return
+			}
+			rawOCSPRequest = rawOCSPRequest[:n]
 		}
 
-		ocspRequest, err := ocsp.ParseRequest(rawOCSPRequest[:n])
+		ocspRequest, err := ocsp.ParseRequest(rawOCSPRequest)
 		if err != nil {
 			t.Logf("Cannot parse the request (%d bytes)\n", len(rawOCSPRequest))
 			res.WriteHeader(400)
@@ -212,7 +238,7 @@ func getTestOCSPCertAndKey(t *testing.T, prefix, certFilename, keyFilename strin
 
 func TestOCSPConfig(t *testing.T) {
 	expectOk := func(url, required, fromCert string, checkWholeChain bool) {
-		config, err := NewOCSPConfig(url, required, fromCert, checkWholeChain)
+		config, err := NewOCSPConfig(url, required, fromCert, checkWholeChain, OcspHttpClientDefaultTimeout, OcspDefaultVerifyTimeout, DefaultOCSPClientConfig())
 		if config == nil || err != nil {
 			t.Logf("url=%v, required=%v, fromCert=%v, checkWholeChain=%v\n", url, required, fromCert, checkWholeChain)
 			t.Logf("config=%v, err=%v\n", config, err)
@@ -221,7 +247,7 @@ func TestOCSPConfig(t *testing.T) {
 	}
 
 	expectErr := func(url, required, fromCert string, checkWholeChain bool) {
-		config, err := NewOCSPConfig(url, required, fromCert, checkWholeChain)
+		config, err := NewOCSPConfig(url, required, fromCert, checkWholeChain, OcspHttpClientDefaultTimeout, OcspDefaultVerifyTimeout, DefaultOCSPClientConfig())
 		if config != nil || err == nil {
 			t.Logf("url=%v, required=%v, fromCert=%v, checkWholeChain=%v\n", url, required, fromCert, checkWholeChain)
 			t.Logf("config=%v, err=%v\n", config, err)
@@ -286,7 +312,7 @@ func testDefaultOCSPClientWithGroup(t *testing.T, certGroup TestCertGroup) {
 	url := fmt.Sprintf("http://%s", addr)
 
 	checkCase := func(t *testing.T, data *ocspTestCase) {
-		ocspResponse, err := ocspClient.Query(data.cert.Subject.CommonName, data.cert, ocspServerConfig.issuerCert, url)
+		ocspResponse, err := ocspClient.Query(context.Background(), data.cert.Subject.CommonName, data.cert, ocspServerConfig.issuerCert, url)
 		if err != nil {
 			t.Fatalf("Unexpected error during reading %s: %v\n", url, err)
 		}
@@ -317,7 +343,7 @@ func testWithConfigAndValidChain(t *testing.T, ocspConfig *OCSPConfig, rawCerts
 
 	ocspVerifier := DefaultOCSPVerifier{Config: *ocspConfig, Client: ocspClient}
 
-	err := ocspVerifier.Verify(rawCerts, verifiedChains)
+	err := ocspVerifier.Verify(context.Background(), rawCerts, verifiedChains)
 	if err != nil {
 		t.Fatalf("Unexpected error for valid certificate: %v\n", err)
 	}
@@ -328,11 +354,11 @@ func testWithConfigAndRevokedChain(t *testing.T, ocspConfig *OCSPConfig, rawCert
 
 	ocspVerifier := DefaultOCSPVerifier{Config: *ocspConfig, Client: ocspClient}
 
-	err := ocspVerifier.Verify(rawCerts, verifiedChains)
+	err := ocspVerifier.Verify(context.Background(), rawCerts, verifiedChains)
 	if err == nil {
 		t.Fatal("Unexpected success when verifying revoked certificate\n")
 	}
-	if err != ErrCertWasRevoked {
+	if !errors.Is(err, ErrCertWasRevoked) {
 		t.Logf("Verify error: %v\n", err)
 		t.Fatalf("Expected error: %v\n", ErrCertWasRevoked)
 	}
@@ -376,7 +402,7 @@ func testDefaultOCSPVerifierWithGroupValid(t *testing.T, certGroup TestCertGroup
 	//
 	// Test with default config, certificates contain OCSP server inside
 	//
-	ocspConfig, err := NewOCSPConfig(url, OcspRequiredGoodStr, OcspFromCertUseStr, false)
+	ocspConfig, err := NewOCSPConfig(url, OcspRequiredGoodStr, OcspFromCertUseStr, false, OcspHttpClientDefaultTimeout, OcspDefaultVerifyTimeout, DefaultOCSPClientConfig())
 	if err != nil {
 		t.Fatalf("Failed to create OCSPConfig: %v\n", err)
 	}
@@ -388,7 +414,7 @@ func testDefaultOCSPVerifierWithGroupValid(t *testing.T, certGroup TestCertGroup
 	//
 	// Test with URL in config only
 	//
-	ocspConfig, err = NewOCSPConfig(url, OcspRequiredGoodStr, OcspFromCertUseStr, false)
+	ocspConfig, err = NewOCSPConfig(url, OcspRequiredGoodStr, OcspFromCertUseStr, false, OcspHttpClientDefaultTimeout, OcspDefaultVerifyTimeout, DefaultOCSPClientConfig())
 	if err != nil {
 		t.Fatalf("Failed to create OCSPConfig: %v\n", err)
 	}
@@ -435,7 +461,7 @@ func testDefaultOCSPVerifierWithGroupRevoked(t *testing.T, certGroup TestCertGro
 	//
 	// Test with default config, certificates contain OCSP server inside
 	//
-	ocspConfig, err := NewOCSPConfig(url, OcspRequiredGoodStr, OcspFromCertUseStr, false)
+	ocspConfig, err := NewOCSPConfig(url, OcspRequiredGoodStr, OcspFromCertUseStr, false, OcspHttpClientDefaultTimeout, OcspDefaultVerifyTimeout, DefaultOCSPClientConfig())
 	if err != nil {
 		t.Fatalf("Failed to create OCSPConfig: %v\n", err)
 	}
@@ -449,7 +475,7 @@ func testDefaultOCSPVerifierWithGroupRevoked(t *testing.T, certGroup TestCertGro
 		//
 		// Test with URL in config only
 		//
-		ocspConfig, err = NewOCSPConfig(url, OcspRequiredGoodStr, OcspFromCertUseStr, false)
+		ocspConfig, err = NewOCSPConfig(url, OcspRequiredGoodStr, OcspFromCertUseStr, false, OcspHttpClientDefaultTimeout, OcspDefaultVerifyTimeout, DefaultOCSPClientConfig())
 		if err != nil {
 			t.Fatalf("Failed to create OCSPConfig: %v\n", err)
 		}
@@ -470,3 +496,466 @@ func TestDefaultOCSPVerifier(t *testing.T) {
 	testDefaultOCSPVerifierWithGroup(t, getTestCertGroup3(t))
 	testDefaultOCSPVerifierWithGroup(t, getTestCertGroupOnlyRoot(t))
 }
+
+// ocspTestResponder describes response of one server for testOCSPClient
+type ocspTestResponder struct {
+	status int
+	delay  time.Duration
+}
+
+// errTestOCSPUnavailable is returned by testOCSPClient for URLs without responder
+var errTestOCSPUnavailable = errors.New("OCSP server is unavailable")
+
+// testOCSPClient responds after delay of configured responder, or returns error if ctx is done earlier.
+// With barrier set, queries respond only after all of them were started. With queried set, URLs of queries are
+// recorded into it.
+type testOCSPClient struct {
+	responders map[string]ocspTestResponder
+	barrier    *sync.WaitGroup
+	queried    *sync.Map
+}
+
+func (c testOCSPClient) Query(ctx context.Context, commonName string, clientCert, issuerCert *x509.Certificate, ocspServerURL string) (*ocsp.Response, error) {
+	if c.barrier != nil {
+		c.barrier.Done()
+		c.barrier.Wait()
+	}
+	if c.queried != nil {
+		c.queried.Store(ocspServerURL, true)
+	}
+	responder, ok := c.responders[ocspServerURL]
+	if !ok {
+		return nil, errTestOCSPUnavailable
+	}
+	select {
+	case <-time.After(responder.delay):
+		return &ocsp.Response{Status: responder.status, SerialNumber: clientCert.SerialNumber}, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func TestDefaultOCSPVerifierParallelQueries(t *testing.T) {
+	const slow = time.Hour
+	good := ocspTestResponder{status: ocsp.Good}
+	issuer := &x509.Certificate{}
+	verify := func(required string, queryTimeout, verifyTimeout time.Duration, barrier *sync.WaitGroup, responders ...ocspTestResponder) error {
+		client := testOCSPClient{responders: make(map[string]ocspTestResponder), barrier: barrier}
+		cert := &x509.Certificate{}
+		for i, responder := range responders {
+			url := fmt.Sprintf("http://ocsp%d.example.com", i)
+			client.responders[url] = responder
+			cert.OCSPServer = append(cert.OCSPServer, url)
+		}
+		config, err := NewOCSPConfig(cert.OCSPServer[0], required, OcspFromCertUseStr, false, queryTimeout, verifyTimeout, DefaultOCSPClientConfig())
+		if err != nil {
+			t.Fatal(err)
+		}
+		verifier := DefaultOCSPVerifier{Config: *config, Client: client}
+		return verifier.Verify(context.Background(), nil, [][]*x509.Certificate{{cert, issuer}})
+	}
+
+	// all responders are queried at once, sequential queries would hit the timeout waiting for the barrier
+	barrier := &sync.WaitGroup{}
+	barrier.Add(3)
+	if err := verify(OcspRequiredGoodStr, time.Second, time.Second, barrier, good, good, good); err != nil {
+		t.Fatalf("Expected success of parallel queries, took %v", err)
+	}
+
+	testcases := []struct {
+		required      string
+		queryTimeout  time.Duration
+		verifyTimeout time.Duration
+		responders    []ocspTestResponder
+		expected      error
+	}{
+		// responder which exceeds query timeout is unavailable
+		{OcspRequiredDenyUnknownStr, time.Millisecond * 50, time.Second, []ocspTestResponder{good, {ocsp.Good, slow}}, nil},
+		{OcspRequiredGoodStr, time.Millisecond * 50, time.Second, []ocspTestResponder{good, {ocsp.Good, slow}}, ErrOCSPRequiredAllButGotError},
+		{OcspRequiredDenyUnknownStr, time.Millisecond * 50, time.Second, []ocspTestResponder{{ocsp.Good, slow}}, ErrOCSPNoConfirms},
+		// responders which didn't respond until deadline are unavailable
+		{OcspRequiredDenyUnknownStr, time.Second, time.Millisecond * 50, []ocspTestResponder{good, {ocsp.Good, slow}}, nil},
+		{OcspRequiredGoodStr, time.Second, time.Millisecond * 50, []ocspTestResponder{good, {ocsp.Good, slow}}, ErrOCSPRequiredAllButGotError},
+		// any revoked or unknown response fails verification without waiting for slow responders
+		{OcspRequiredDenyUnknownStr, slow, slow, []ocspTestResponder{good, {ocsp.Revoked, 0}, {ocsp.Good, slow}}, ErrCertWasRevoked},
+		{OcspRequiredDenyUnknownStr, slow, slow, []ocspTestResponder{good, {ocsp.Unknown, 0}, {ocsp.Good, slow}}, ErrOCSPUnknownCertificate},
+		{OcspRequiredAllowUnknownStr, time.Second, time.Second, []ocspTestResponder{good, {ocsp.Unknown, 0}}, nil},
+	}
+	for i, testcase := range testcases {
+		if err := verify(testcase.required, testcase.queryTimeout, testcase.verifyTimeout, nil, testcase.responders...); !errors.Is(err, testcase.expected) {
+			t.Fatalf("[%d] Expected %v, took %v", i, testcase.expected, err)
+		}
+	}
+
+	for _, timeouts := range [][2]time.Duration{{0, time.Second}, {time.Second, 0}} {
+		if _, err := NewOCSPConfig("", OcspRequiredDenyUnknownStr, OcspFromCertUseStr, false, timeouts[0], timeouts[1], DefaultOCSPClientConfig()); err != ErrInvalidConfigOCSPTimeout {
+			t.Fatalf("Expected ErrInvalidConfigOCSPTimeout, took %v", err)
+		}
+	}
+}
+
+func TestDefaultOCSPVerifierChainLevels(t *testing.T) {
+	leaf := &x509.Certificate{OCSPServer: []string{"http://leaf.example.com"}}
+	leaf.Subject.CommonName = "leaf"
+	intermediate := &x509.Certificate{OCSPServer: []string{"http://intermediate.example.com"}}
+	intermediate.Subject.CommonName = "intermediate"
+	root := &x509.Certificate{}
+	client := testOCSPClient{responders: map[string]ocspTestResponder{
+		"http://leaf.example.com":         {status: ocsp.Good},
+		"http://intermediate.example.com": {status: ocsp.Revoked},
+	}}
+	verify := func(checkOnlyLeafCertificate bool) error {
+		config, err := NewOCSPConfig("", OcspRequiredDenyUnknownStr, OcspFromCertUseStr, checkOnlyLeafCertificate, time.Second, time.Second, DefaultOCSPClientConfig())
+		if err != nil {
+			t.Fatal(err)
+		}
+		verifier := DefaultOCSPVerifier{Config: *config, Client: client}
+		return verifier.Verify(context.Background(), nil, [][]*x509.Certificate{{leaf, intermediate, root}})
+	}
+
+	// revoked intermediate certificate isn't checked in leaf only mode
+	if err := verify(true); err != nil {
+		t.Fatalf("Unexpected error in leaf only mode: %v", err)
+	}
+	err := verify(false)
+	if !errors.Is(err, ErrCertWasRevoked) {
+		t.Fatalf("Expected ErrCertWasRevoked, took %v", err)
+	}
+	if expected := "certificate #1 of chain 'CN=intermediate'"; !strings.Contains(err.Error(), expected) {
+		t.Fatalf("Expected error with '%s', took '%v'", expected, err)
+	}
+}
+
+func TestParseOCSPResponders(t *testing.T) {
+	responders, err := ParseOCSPResponders("http://backup.example.com;priority=1, http://primary.example.com;role=required,http://advisory.example.com;role=advisory;priority=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []OCSPResponder{
+		{URL: "http://primary.example.com", Priority: 0, Role: OCSPResponderRoleRequired},
+		{URL: "http://backup.example.com", Priority: 1, Role: OCSPResponderRoleDefault},
+		{URL: "http://advisory.example.com", Priority: 1, Role: OCSPResponderRoleAdvisory},
+	}
+	if len(responders) != len(expected) {
+		t.Fatalf("Expected %v, took %v", expected, responders)
+	}
+	for i := range expected {
+		if responders[i] != expected[i] {
+			t.Fatalf("Expected %v, took %v", expected, responders)
+		}
+	}
+	if responders, err := ParseOCSPResponders(""); err != nil || len(responders) != 0 {
+		t.Fatalf("Expected no responders, took %v and %v", responders, err)
+	}
+	for _, value := range []string{
+		"http://ocsp.example.com;priority=first",
+		"http://ocsp.example.com;role=optional",
+		"http://ocsp.example.com;weight=1",
+		"http://ocsp.example.com;priority",
+		";priority=1",
+	} {
+		if _, err := ParseOCSPResponders(value); !errors.Is(err, ErrInvalidConfigOCSPResponder) {
+			t.Fatalf("[%s] Expected ErrInvalidConfigOCSPResponder, took %v", value, err)
+		}
+	}
+}
+
+func TestDefaultOCSPVerifierResponders(t *testing.T) {
+	good := ocspTestResponder{status: ocsp.Good}
+	unknown := ocspTestResponder{status: ocsp.Unknown}
+	revoked := ocspTestResponder{status: ocsp.Revoked}
+	// verify returns error of verification and URLs of queried responders
+	verify := func(required, url string, responders map[string]ocspTestResponder) (error, []string) {
+		queried := &sync.Map{}
+		client := testOCSPClient{responders: responders, queried: queried}
+		config, err := NewOCSPConfig(url, required, OcspFromCertIgnoreStr, false, time.Second, time.Second, DefaultOCSPClientConfig())
+		if err != nil {
+			t.Fatal(err)
+		}
+		verifier := DefaultOCSPVerifier{Config: *config, Client: client}
+		err = verifier.Verify(context.Background(), nil, [][]*x509.Certificate{{{}, {}}})
+		urls := []string{}
+		queried.Range(func(key, value interface{}) bool {
+			urls = append(urls, key.(string))
+			return true
+		})
+		sort.Strings(urls)
+		return err, urls
+	}
+	const (
+		primary = "http://primary.example.com"
+		backup  = "http://backup.example.com"
+	)
+	testcases := []struct {
+		required   string
+		url        string
+		responders map[string]ocspTestResponder
+		expected   error
+		// queried isn't checked if nil, e.g. if verification may finish before all queries are started
+		queried []string
+	}{
+		// backup is queried only if primary didn't respond
+		{OcspRequiredDenyUnknownStr, primary + "," + backup + ";priority=1", map[string]ocspTestResponder{primary: good, backup: good}, nil, []string{primary}},
+		{OcspRequiredDenyUnknownStr, primary + "," + backup + ";priority=1", map[string]ocspTestResponder{primary: unknown, backup: good}, ErrOCSPUnknownCertificate, []string{primary}},
+		{OcspRequiredDenyUnknownStr, primary + "," + backup + ";priority=1", map[string]ocspTestResponder{backup: good}, nil, []string{backup, primary}},
+		{OcspRequiredDenyUnknownStr, primary + "," + backup + ";priority=1", map[string]ocspTestResponder{}, ErrOCSPNoConfirms, []string{backup, primary}},
+		// responders with the same priority are queried together
+		{OcspRequiredDenyUnknownStr, primary + "," + backup, map[string]ocspTestResponder{primary: good, backup: good}, nil, []string{backup, primary}},
+		// required responder should respond and know the certificate
+		{OcspRequiredAllowUnknownStr, primary + ";role=required," + backup, map[string]ocspTestResponder{backup: good}, ErrOCSPRequiredResponderFailed, []string{backup, primary}},
+		{OcspRequiredAllowUnknownStr, primary + ";role=required," + backup, map[string]ocspTestResponder{primary: unknown, backup: good}, ErrOCSPUnknownCertificate, []string{backup, primary}},
+		// advisory responder can't confirm or deny certificate except revocation, even with requireGood
+		{OcspRequiredGoodStr, primary + "," + backup + ";role=advisory", map[string]ocspTestResponder{primary: good}, nil, []string{backup, primary}},
+		{OcspRequiredGoodStr, primary + "," + backup + ";role=advisory", map[string]ocspTestResponder{primary: good, backup: unknown}, nil, []string{backup, primary}},
+		// only advisory responders just monitor certificates
+		{OcspRequiredDenyUnknownStr, primary + ";role=advisory", map[string]ocspTestResponder{primary: unknown}, nil, []string{primary}},
+		{OcspRequiredDenyUnknownStr, primary + "," + backup + ";role=advisory", map[string]ocspTestResponder{primary: good, backup: revoked}, ErrCertWasRevoked, nil},
+	}
+	for i, testcase := range testcases {
+		err, queried := verify(testcase.required, testcase.url, testcase.responders)
+		if !errors.Is(err, testcase.expected) {
+			t.Fatalf("[%d] Expected %v, took %v", i, testcase.expected, err)
+		}
+		if testcase.queried != nil && strings.Join(queried, " ") != strings.Join(testcase.queried, " ") {
+			t.Fatalf("[%d] Expected queries to %v, took %v", i, testcase.queried, queried)
+		}
+	}
+}
+
+func TestNewOCSPClient(t *testing.T) {
+	_, chains := getValidTestChain(t)
+	cert, issuer := chains[0][0], chains[0][1]
+	// changed only between requests
+	var requests, status int32 = 0, http.StatusServiceUnavailable
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+	}))
+	defer server.Close()
+	bundle, err := ioutil.TempFile("", "ocsp_ca_bundle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(bundle.Name())
+	if err := pem.Encode(bundle, &pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}); err != nil {
+		t.Fatal(err)
+	}
+	bundle.Close()
+
+	config := DefaultOCSPClientConfig()
+	config.CABundlePath = bundle.Name()
+	config.Retries = 2
+	config.RetryDelay = time.Millisecond
+	client, err := NewOCSPClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// server is trusted with CA bundle, 5xx responses are retried
+	if _, err := client.Query(context.Background(), "", cert, issuer, server.URL); !errors.Is(err, ErrOCSPHTTPStatus) || atomic.LoadInt32(&requests) != 3 {
+		t.Fatalf("Expected ErrOCSPHTTPStatus after 3 requests, took %v after %d", err, requests)
+	}
+	atomic.StoreInt32(&requests, 0)
+	atomic.StoreInt32(&status, http.StatusNotFound)
+	if _, err := client.Query(context.Background(), "", cert, issuer, server.URL); !errors.Is(err, ErrOCSPHTTPStatus) || atomic.LoadInt32(&requests) != 1 {
+		t.Fatalf("Expected ErrOCSPHTTPStatus after 1 request, took %v after %d", err, requests)
+	}
+	// without bundle server's certificate isn't trusted
+	atomic.StoreInt32(&requests, 0)
+	if _, err := NewDefaultOCSPClient().Query(context.Background(), "", cert, issuer, server.URL); err == nil || errors.Is(err, ErrOCSPHTTPStatus) || atomic.LoadInt32(&requests) != 0 {
+		t.Fatalf("Expected TLS error, took %v after %d requests", err, requests)
+	}
+
+	// requests go through proxy
+	proxied := make(chan string, 1)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied <- r.URL.String()
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer proxy.Close()
+	config = DefaultOCSPClientConfig()
+	config.ProxyURL = proxy.URL
+	client, err = NewOCSPClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Query(context.Background(), "", cert, issuer, "http://ocsp.example.com/query"); !errors.Is(err, ErrOCSPHTTPStatus) {
+		t.Fatalf("Expected ErrOCSPHTTPStatus from proxy, took %v", err)
+	}
+	if url := <-proxied; !strings.HasPrefix(url, "http://ocsp.example.com/query/") {
+		t.Fatalf("Expected proxied request, took '%s'", url)
+	}
+
+	invalidBundle, err := ioutil.TempFile("", "ocsp_ca_bundle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(invalidBundle.Name())
+	invalidBundle.Close()
+	for _, testcase := range []struct {
+		config   OCSPClientConfig
+		expected error
+	}{
+		{OCSPClientConfig{}, ErrInvalidConfigOCSPTimeout},
+		{OCSPClientConfig{Timeout: time.Second, ProxyURL: "proxy"}, ErrInvalidConfigOCSPProxy},
+		{OCSPClientConfig{Timeout: time.Second, CABundlePath: invalidBundle.Name()}, ErrInvalidConfigOCSPCABundle},
+	} {
+		if _, err := NewOCSPClient(testcase.config); err != testcase.expected {
+			t.Fatalf("Expected %v, took %v", testcase.expected, err)
+		}
+	}
+}
+
+func TestOCSPClientMethods(t *testing.T) {
+	_, chains := getValidTestChain(t)
+	cert, issuer := chains[0][0], chains[0][1]
+	methods := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body []byte
+		var err error
+		if r.Method == http.MethodGet {
+			var encoded string
+			encoded, err = url_.QueryUnescape(strings.TrimPrefix(r.URL.EscapedPath(), "/ocsp/"))
+			if err == nil {
+				body, err = base64.StdEncoding.DecodeString(encoded)
+			}
+		} else {
+			body, err = ioutil.ReadAll(r.Body)
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if _, err := ocsp.ParseRequest(body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		methods <- r.Method
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	for _, forcePOST := range []bool{false, true} {
+		config := DefaultOCSPClientConfig()
+		config.ForcePOST = forcePOST
+		client, err := NewOCSPClient(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := http.MethodGet
+		if forcePOST {
+			expected = http.MethodPost
+		}
+		// handler responds with 404 to requests it parsed
+		if _, err := client.Query(context.Background(), "", cert, issuer, server.URL+"/ocsp/"); !errors.Is(err, ErrOCSPHTTPStatus) || !strings.HasSuffix(err.Error(), "404") {
+			t.Fatalf("Expected ErrOCSPHTTPStatus with 404, took %v", err)
+		}
+		if method := <-methods; method != expected {
+			t.Fatalf("Expected %s request, took %s", expected, method)
+		}
+
+		// long requests don't fit into URL
+		ocspURL, _ := url_.Parse(server.URL)
+		request, err := client.newHTTPRequest(context.Background(), ocspURL, make([]byte, ocspMaxGETRequestLength))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if request.Method != http.MethodPost {
+			t.Fatalf("Expected POST for long request, took %s", request.Method)
+		}
+	}
+}
+
+func TestOCSPClientNonceAndFreshness(t *testing.T) {
+	certGroup := getTestCertGroup(t)
+	cert, issuer := certGroup.validVerifiedChains[0][0], certGroup.validVerifiedChains[0][1]
+	responderCert, responderKey := getTestOCSPCertAndKey(t, certGroup.prefix, certGroup.ocspCert, certGroup.ocspKey)
+
+	// server responds with nonce from request modified by echoNonce, and with configured update times
+	var thisUpdate, nextUpdate time.Time
+	var echoNonce func(nonce []byte) []byte
+	requestNonces := make(chan []byte, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		request, err := ocsp.ParseRequest(body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var parsed ocspRequestASN1
+		if _, err := asn1.Unmarshal(body, &parsed); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		template := ocsp.Response{Status: ocsp.Good, SerialNumber: request.SerialNumber, Certificate: responderCert, ThisUpdate: thisUpdate, NextUpdate: nextUpdate}
+		var nonce []byte
+		for _, extension := range parsed.TBSRequest.Extensions {
+			if extension.Id.Equal(oidOCSPNonce) {
+				nonce = extension.Value
+				if value := echoNonce(extension.Value); value != nil {
+					template.ExtraExtensions = []pkix.Extension{{Id: oidOCSPNonce, Value: value}}
+				}
+			}
+		}
+		requestNonces <- nonce
+		response, err := ocsp.CreateResponse(issuer, responderCert, template, responderKey)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write(response)
+	}))
+	defer server.Close()
+	echo := func(nonce []byte) []byte { return nonce }
+	omit := func(nonce []byte) []byte { return nil }
+	replace := func(nonce []byte) []byte { value, _ := asn1.Marshal([]byte("other nonce")); return value }
+	unwrapped := func(nonce []byte) []byte {
+		var value []byte
+		asn1.Unmarshal(nonce, &value)
+		return value
+	}
+
+	now := time.Now()
+	for i, testcase := range []struct {
+		nonce                  string
+		echoNonce              func([]byte) []byte
+		thisUpdate, nextUpdate time.Time
+		expected               error
+	}{
+		{OcspNonceNoneStr, echo, now, now.Add(time.Hour), nil},
+		{OcspNonceUseStr, echo, now, now.Add(time.Hour), nil},
+		{OcspNonceUseStr, omit, now, now.Add(time.Hour), nil},
+		{OcspNonceUseStr, unwrapped, now, time.Time{}, nil},
+		{OcspNonceUseStr, replace, now, now.Add(time.Hour), ErrOCSPNonceMismatch},
+		{OcspNonceRequireStr, echo, now, now.Add(time.Hour), nil},
+		{OcspNonceRequireStr, omit, now, now.Add(time.Hour), ErrOCSPNonceMissing},
+		// within clock skew
+		{OcspNonceNoneStr, echo, now.Add(time.Minute), now.Add(-time.Minute), nil},
+		{OcspNonceNoneStr, echo, now.Add(time.Hour), now.Add(2 * time.Hour), ErrOCSPResponseNotYetValid},
+		{OcspNonceNoneStr, echo, now.Add(-2 * time.Hour), now.Add(-time.Hour), ErrOCSPResponseExpired},
+	} {
+		config := DefaultOCSPClientConfig()
+		config.Nonce = testcase.nonce
+		config.ForcePOST = true
+		client, err := NewOCSPClient(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		thisUpdate, nextUpdate, echoNonce = testcase.thisUpdate, testcase.nextUpdate, testcase.echoNonce
+		_, err = client.Query(context.Background(), "", cert, issuer, server.URL)
+		if !errors.Is(err, testcase.expected) {
+			t.Fatalf("[%d] Expected %v, took %v", i, testcase.expected, err)
+		}
+		nonce := <-requestNonces
+		if (testcase.nonce == OcspNonceNoneStr) != (nonce == nil) {
+			t.Fatalf("[%d] Unexpected nonce %v in request with '%s' mode", i, nonce, testcase.nonce)
+		}
+	}
+
+	if _, err := NewOCSPClient(OCSPClientConfig{Timeout: time.Second, Nonce: "always"}); err != ErrInvalidConfigOCSPNonce {
+		t.Fatalf("Expected ErrInvalidConfigOCSPNonce, took %v", err)
+	}
+}
@@ -0,0 +1,101 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/cossacklabs/acra/logging"
+)
+
+// Errors related with identification of clients by credentials of unix socket peers
+var (
+	ErrPeerCredentialsNotSupported = errors.New("credentials of unix socket peers aren't supported on this platform")
+	ErrNotUnixSocketConnection     = errors.New("connection isn't unix socket connection")
+	ErrUnknownPeerUID              = errors.New("client ID isn't configured for uid of unix socket peer")
+	ErrInvalidPeerClientIDs        = errors.New("invalid client IDs of unix socket peers, <uid>:<client_id> expected")
+)
+
+// PeerCredentials are credentials of process connected over unix socket
+type PeerCredentials struct {
+	PID int32
+	UID uint32
+	GID uint32
+}
+
+// ParsePeerClientIDs parses comma-separated list of <uid>:<client_id> pairs
+func ParsePeerClientIDs(value string) (map[uint32][]byte, error) {
+	clientIDs := make(map[uint32][]byte)
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, ":", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidPeerClientIDs, pair)
+		}
+		uid, err := strconv.ParseUint(parts[0], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidPeerClientIDs, pair)
+		}
+		if _, ok := clientIDs[uint32(uid)]; ok {
+			return nil, fmt.Errorf("%w: duplicated uid %d", ErrInvalidPeerClientIDs, uid)
+		}
+		clientIDs[uint32(uid)] = []byte(parts[1])
+	}
+	if len(clientIDs) == 0 {
+		return nil, ErrInvalidPeerClientIDs
+	}
+	return clientIDs, nil
+}
+
+// PeerCredentialsConnectionWrapper identifies clients connected over unix socket by uid of their process, so sidecar
+// deployments don't need TLS certificates to tell clients apart. Other connections are passed to wrapped
+// ConnectionWrapper.
+type PeerCredentialsConnectionWrapper struct {
+	ConnectionWrapper
+	clientIDs map[uint32][]byte
+}
+
+// NewPeerCredentialsConnectionWrapper returns wrapper which uses client ID of clientIDs by uid of unix socket peer
+func NewPeerCredentialsConnectionWrapper(wrapper ConnectionWrapper, clientIDs map[uint32][]byte) *PeerCredentialsConnectionWrapper {
+	return &PeerCredentialsConnectionWrapper{ConnectionWrapper: wrapper, clientIDs: clientIDs}
+}
+
+// WrapServer returns client ID of uid of unix socket peer, connections of other uids are rejected
+func (wrapper *PeerCredentialsConnectionWrapper) WrapServer(ctx context.Context, conn net.Conn) (net.Conn, []byte, error) {
+	if _, ok := UnwrapSafeCloseConnection(conn).(*net.UnixConn); !ok {
+		return wrapper.ConnectionWrapper.WrapServer(ctx, conn)
+	}
+	credentials, err := GetPeerCredentials(conn)
+	if err != nil {
+		return nil, nil, err
+	}
+	logger := logging.GetLoggerFromContext(ctx).WithField("uid", credentials.UID).WithField("pid", credentials.PID)
+	clientID, ok := wrapper.clientIDs[credentials.UID]
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: %d", ErrUnknownPeerUID, credentials.UID)
+	}
+	logger.WithField("client_id", string(clientID)).Debugln("Use client ID of unix socket peer")
+	return conn, clientID, nil
+}
@@ -0,0 +1,47 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package network
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// GetPeerCredentials returns credentials of process connected over unix socket with SO_PEERCRED
+func GetPeerCredentials(conn net.Conn) (*PeerCredentials, error) {
+	unixConn, ok := UnwrapSafeCloseConnection(conn).(*net.UnixConn)
+	if !ok {
+		return nil, ErrNotUnixSocketConnection
+	}
+	rawConn, err := unixConn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var ucred *unix.Ucred
+	var ucredErr error
+	err = rawConn.Control(func(fd uintptr) {
+		ucred, ucredErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if ucredErr != nil {
+		return nil, ucredErr
+	}
+	return &PeerCredentials{PID: ucred.Pid, UID: ucred.Uid, GID: ucred.Gid}, nil
+}
@@ -0,0 +1,119 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package network
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParsePeerClientIDs(t *testing.T) {
+	clientIDs, err := ParsePeerClientIDs("1000:client1, 0:admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(clientIDs[1000]) != "client1" || string(clientIDs[0]) != "admin" {
+		t.Fatalf("Unexpected client IDs %v", clientIDs)
+	}
+	for _, value := range []string{"", "1000", "1000:", "user:client1", "1000:client1,1000:client2"} {
+		if _, err := ParsePeerClientIDs(value); !errors.Is(err, ErrInvalidPeerClientIDs) {
+			t.Fatalf("%q: expected ErrInvalidPeerClientIDs, took %v", value, err)
+		}
+	}
+}
+
+func TestPeerCredentialsConnectionWrapper(t *testing.T) {
+	dir, err := ioutil.TempDir("", "acra-peer-credentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	listener, err := Listen("unix://" + filepath.Join(dir, "acra.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	var connections []net.Conn
+	defer func() {
+		for _, conn := range connections {
+			conn.Close()
+		}
+	}()
+	accept := func() net.Conn {
+		client, err := net.Dial("unix", filepath.Join(dir, "acra.sock"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		connections = append(connections, client)
+		conn, err := listener.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		connections = append(connections, conn)
+		return conn
+	}
+
+	credentials, err := GetPeerCredentials(accept())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if credentials.UID != uint32(os.Getuid()) || credentials.PID != int32(os.Getpid()) {
+		t.Fatalf("Unexpected credentials %+v", credentials)
+	}
+
+	tcpClientID := []byte("tcp client")
+	wrapper := NewPeerCredentialsConnectionWrapper(&RawConnectionWrapper{ClientID: tcpClientID}, map[uint32][]byte{uint32(os.Getuid()): []byte("sidecar")})
+	_, clientID, err := wrapper.WrapServer(context.Background(), accept())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(clientID) != "sidecar" {
+		t.Fatalf("Expected client ID of uid, took %s", clientID)
+	}
+	wrapper = NewPeerCredentialsConnectionWrapper(&RawConnectionWrapper{ClientID: tcpClientID}, map[uint32][]byte{uint32(os.Getuid()) + 1: []byte("sidecar")})
+	if _, _, err := wrapper.WrapServer(context.Background(), accept()); !errors.Is(err, ErrUnknownPeerUID) {
+		t.Fatalf("Expected ErrUnknownPeerUID, took %v", err)
+	}
+
+	// TCP connections are identified by wrapped ConnectionWrapper
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcpListener.Close()
+	tcpClient, err := net.Dial("tcp", tcpListener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcpClient.Close()
+	tcpConn, err := tcpListener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcpConn.Close()
+	if _, clientID, err := wrapper.WrapServer(context.Background(), tcpConn); err != nil || string(clientID) != string(tcpClientID) {
+		t.Fatalf("Expected client ID of wrapped wrapper, took %s: %v", clientID, err)
+	}
+	if _, err := GetPeerCredentials(tcpConn); err != ErrNotUnixSocketConnection {
+		t.Fatalf("Expected ErrNotUnixSocketConnection, took %v", err)
+	}
+}
@@ -0,0 +1,248 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package network
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Errors returned by PROXY protocol processing
+var (
+	ErrInvalidProxyProtocolHeader     = errors.New("invalid PROXY protocol header")
+	ErrProxyProtocolNoTrustedNetworks = errors.New("PROXY protocol requires at least one trusted network")
+)
+
+// DefaultProxyProtocolHeaderTimeout limits time to wait for PROXY protocol header from trusted peer
+const DefaultProxyProtocolHeaderTimeout = time.Second * 5
+
+const (
+	// proxyProtocolV1MaxLength is max length of text header including CRLF
+	proxyProtocolV1MaxLength = 107
+	// proxyProtocolV2HeaderLength is length of signature, version with command, family and length of addresses
+	proxyProtocolV2HeaderLength = 16
+	proxyProtocolV2Version      = 0x20
+	proxyProtocolV2CommandLocal = 0x00
+	proxyProtocolV2CommandProxy = 0x01
+	proxyProtocolV2FamilyUnspec = 0x00
+	proxyProtocolV2FamilyInet   = 0x11
+	proxyProtocolV2FamilyInet6  = 0x21
+	proxyProtocolV2InetLength   = 12
+	proxyProtocolV2Inet6Length  = 36
+)
+
+var (
+	proxyProtocolV1Prefix    = []byte("PROXY ")
+	proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// proxyProtocolConnection is connection which returns address of client passed in PROXY protocol header instead of
+// address of proxy
+type proxyProtocolConnection struct {
+	net.Conn
+	remoteAddr net.Addr
+}
+
+// RemoteAddr returns address of client from PROXY protocol header
+func (conn *proxyProtocolConnection) RemoteAddr() net.Addr {
+	return conn.remoteAddr
+}
+
+// ProxyProtocolAcceptor reads PROXY protocol v1 or v2 header from connections of trusted load balancers, so real
+// client address is used instead of address of load balancer. Other peers can't spoof their address with the header,
+// their connections are used as is.
+type ProxyProtocolAcceptor struct {
+	trustedNetworks []*net.IPNet
+	timeout         time.Duration
+}
+
+// NewProxyProtocolAcceptor returns ProxyProtocolAcceptor which expects headers from peers of trustedCIDRs
+func NewProxyProtocolAcceptor(trustedCIDRs []string) (*ProxyProtocolAcceptor, error) {
+	acceptor := &ProxyProtocolAcceptor{timeout: DefaultProxyProtocolHeaderTimeout}
+	for _, cidr := range trustedCIDRs {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid PROXY protocol trusted network %s: %w", cidr, err)
+		}
+		acceptor.trustedNetworks = append(acceptor.trustedNetworks, network)
+	}
+	if len(acceptor.trustedNetworks) == 0 {
+		return nil, ErrProxyProtocolNoTrustedNetworks
+	}
+	return acceptor, nil
+}
+
+// isTrusted returns true if connection comes from trusted network over TCP
+func (acceptor *ProxyProtocolAcceptor) isTrusted(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, network := range acceptor.trustedNetworks {
+		if network.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// Accept reads PROXY protocol header from connection of trusted peer and returns connection with client address from
+// the header. Trusted peers must send the header, connections of other peers are returned as is.
+func (acceptor *ProxyProtocolAcceptor) Accept(conn net.Conn) (net.Conn, error) {
+	if !acceptor.isTrusted(conn.RemoteAddr()) {
+		return conn, nil
+	}
+	if err := conn.SetReadDeadline(time.Now().Add(acceptor.timeout)); err != nil {
+		return nil, err
+	}
+	addr, err := ReadProxyProtocolHeader(conn)
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+	if addr == nil {
+		return conn, nil
+	}
+	return &proxyProtocolConnection{Conn: conn, remoteAddr: addr}, nil
+}
+
+// ReadProxyProtocolHeader reads PROXY protocol v1 or v2 header and returns source address from it, or nil if header
+// doesn't carry address (UNKNOWN or LOCAL connections like health checks). Reader isn't buffered, so data after
+// header is left unread.
+func ReadProxyProtocolHeader(reader io.Reader) (net.Addr, error) {
+	prefix := make([]byte, len(proxyProtocolV1Prefix), proxyProtocolV2HeaderLength)
+	if _, err := io.ReadFull(reader, prefix); err != nil {
+		return nil, err
+	}
+	if bytes.Equal(prefix, proxyProtocolV1Prefix) {
+		return readProxyProtocolV1(reader, prefix)
+	}
+	if bytes.Equal(prefix, proxyProtocolV2Signature[:len(prefix)]) {
+		header := prefix[:proxyProtocolV2HeaderLength]
+		if _, err := io.ReadFull(reader, header[len(prefix):]); err != nil {
+			return nil, err
+		}
+		return readProxyProtocolV2(reader, header)
+	}
+	return nil, ErrInvalidProxyProtocolHeader
+}
+
+// readProxyProtocolV1 reads the rest of text header like "PROXY TCP4 <source> <destination> <source port> <port>\r\n"
+func readProxyProtocolV1(reader io.Reader, prefix []byte) (net.Addr, error) {
+	line := append(make([]byte, 0, proxyProtocolV1MaxLength), prefix...)
+	char := make([]byte, 1)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) == proxyProtocolV1MaxLength {
+			return nil, ErrInvalidProxyProtocolHeader
+		}
+		if _, err := io.ReadFull(reader, char); err != nil {
+			return nil, err
+		}
+		line = append(line, char[0])
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, ErrInvalidProxyProtocolHeader
+	}
+	ip := net.ParseIP(fields[2])
+	if ip == nil || net.ParseIP(fields[3]) == nil || (ip.To4() != nil) != (fields[1] == "TCP4") {
+		return nil, ErrInvalidProxyProtocolHeader
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, ErrInvalidProxyProtocolHeader
+	}
+	if _, err := strconv.ParseUint(fields[5], 10, 16); err != nil {
+		return nil, ErrInvalidProxyProtocolHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyProtocolV2 reads addresses of binary header and skips TLVs after them
+func readProxyProtocolV2(reader io.Reader, header []byte) (net.Addr, error) {
+	versionCommand, family := header[12], header[13]
+	if !bytes.Equal(header[:len(proxyProtocolV2Signature)], proxyProtocolV2Signature) || versionCommand&0xf0 != proxyProtocolV2Version {
+		return nil, ErrInvalidProxyProtocolHeader
+	}
+	addresses := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(reader, addresses); err != nil {
+		return nil, err
+	}
+	switch versionCommand & 0x0f {
+	case proxyProtocolV2CommandLocal:
+		return nil, nil
+	case proxyProtocolV2CommandProxy:
+	default:
+		return nil, ErrInvalidProxyProtocolHeader
+	}
+	switch family {
+	case proxyProtocolV2FamilyInet:
+		if len(addresses) < proxyProtocolV2InetLength {
+			return nil, ErrInvalidProxyProtocolHeader
+		}
+		return &net.TCPAddr{IP: net.IP(addresses[:4]), Port: int(binary.BigEndian.Uint16(addresses[8:]))}, nil
+	case proxyProtocolV2FamilyInet6:
+		if len(addresses) < proxyProtocolV2Inet6Length {
+			return nil, ErrInvalidProxyProtocolHeader
+		}
+		return &net.TCPAddr{IP: net.IP(addresses[:16]), Port: int(binary.BigEndian.Uint16(addresses[32:]))}, nil
+	}
+	// UDP and unix sockets aren't proxied by AcraServer, keep address of proxy
+	return nil, nil
+}
+
+// WriteProxyProtocolHeader writes PROXY protocol v2 header with addresses of proxied TCP connection, or LOCAL header
+// if they aren't TCP addresses of the same family
+func WriteProxyProtocolHeader(writer io.Writer, source, destination net.Addr) error {
+	header := append(make([]byte, 0, proxyProtocolV2HeaderLength+proxyProtocolV2Inet6Length), proxyProtocolV2Signature...)
+	sourceTCP, sourceOk := source.(*net.TCPAddr)
+	destinationTCP, destinationOk := destination.(*net.TCPAddr)
+	if !sourceOk || !destinationOk || (sourceTCP.IP.To4() != nil) != (destinationTCP.IP.To4() != nil) {
+		header = append(header, proxyProtocolV2Version|proxyProtocolV2CommandLocal, proxyProtocolV2FamilyUnspec, 0, 0)
+		_, err := writer.Write(header)
+		return err
+	}
+	header = append(header, proxyProtocolV2Version|proxyProtocolV2CommandProxy)
+	sourceIP, destinationIP := sourceTCP.IP.To4(), destinationTCP.IP.To4()
+	if sourceIP != nil {
+		header = append(header, proxyProtocolV2FamilyInet, 0, proxyProtocolV2InetLength)
+	} else {
+		sourceIP, destinationIP = sourceTCP.IP.To16(), destinationTCP.IP.To16()
+		header = append(header, proxyProtocolV2FamilyInet6, 0, proxyProtocolV2Inet6Length)
+	}
+	header = append(header, sourceIP...)
+	header = append(header, destinationIP...)
+	header = append(header, byte(sourceTCP.Port>>8), byte(sourceTCP.Port), byte(destinationTCP.Port>>8), byte(destinationTCP.Port))
+	_, err := writer.Write(header)
+	return err
+}
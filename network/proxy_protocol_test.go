@@ -0,0 +1,167 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package network
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+func TestReadProxyProtocolHeader(t *testing.T) {
+	testCases := []struct {
+		header  string
+		address string
+	}{
+		{"PROXY TCP4 192.168.0.1 192.168.0.11 56324 9393\r\n", "192.168.0.1:56324"},
+		{"PROXY TCP6 2001:db8::1 2001:db8::2 56324 9393\r\n", "[2001:db8::1]:56324"},
+		{"PROXY UNKNOWN ffff:f...f:ffff ffff:f...f:ffff 65535 65535\r\n", ""},
+		{"PROXY UNKNOWN\r\n", ""},
+	}
+	for _, testCase := range testCases {
+		reader := bytes.NewReader([]byte(testCase.header + "data"))
+		addr, err := ReadProxyProtocolHeader(reader)
+		if err != nil {
+			t.Fatalf("%q: %v", testCase.header, err)
+		}
+		if (addr == nil && testCase.address != "") || (addr != nil && addr.String() != testCase.address) {
+			t.Fatalf("%q: expected %s, took %v", testCase.header, testCase.address, addr)
+		}
+		if rest, _ := ioutil.ReadAll(reader); string(rest) != "data" {
+			t.Fatalf("%q: data after header was read", testCase.header)
+		}
+	}
+
+	for _, header := range []string{
+		"GET / HTTP/1.1\r\n",
+		"PROXY TCP4 192.168.0.1 192.168.0.11 56324\r\n",
+		"PROXY TCP4 2001:db8::1 192.168.0.11 56324 9393\r\n",
+		"PROXY TCP4 192.168.0.1 192.168.0.11 65536 9393\r\n",
+		"PROXY TCP4 192.168.0.1 192.168.0.11 56324 9393 " + string(bytes.Repeat([]byte("x"), 100)) + "\r\n",
+		"\r\n\r\n\x00\r\nQUIX\n\x21\x11\x00\x0c",
+	} {
+		if _, err := ReadProxyProtocolHeader(bytes.NewReader([]byte(header))); err != ErrInvalidProxyProtocolHeader {
+			t.Fatalf("%q: expected ErrInvalidProxyProtocolHeader, took %v", header, err)
+		}
+	}
+}
+
+func TestProxyProtocolV2(t *testing.T) {
+	testCases := []struct {
+		source, destination net.Addr
+		expected            string
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("192.168.0.1"), Port: 56324}, &net.TCPAddr{IP: net.ParseIP("192.168.0.11"), Port: 9393}, "192.168.0.1:56324"},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324}, &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 9393}, "[2001:db8::1]:56324"},
+		// unix sockets and mixed families are sent as LOCAL connections
+		{&net.UnixAddr{Name: "@", Net: "unix"}, &net.TCPAddr{IP: net.ParseIP("192.168.0.11"), Port: 9393}, ""},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324}, &net.TCPAddr{IP: net.ParseIP("192.168.0.11"), Port: 9393}, ""},
+	}
+	for _, testCase := range testCases {
+		buffer := &bytes.Buffer{}
+		if err := WriteProxyProtocolHeader(buffer, testCase.source, testCase.destination); err != nil {
+			t.Fatal(err)
+		}
+		buffer.WriteString("data")
+		addr, err := ReadProxyProtocolHeader(buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (addr == nil && testCase.expected != "") || (addr != nil && addr.String() != testCase.expected) {
+			t.Fatalf("Expected %s, took %v", testCase.expected, addr)
+		}
+		if buffer.String() != "data" {
+			t.Fatal("Data after header was read")
+		}
+	}
+	// TLVs after addresses are skipped
+	header := []byte("\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x10\xc0\xa8\x00\x01\xc0\xa8\x00\x0b\xdc\x04\x24\xb1\x04\x00\x01\x00data")
+	reader := bytes.NewReader(header)
+	addr, err := ReadProxyProtocolHeader(reader)
+	if err != nil || addr.String() != "192.168.0.1:56324" {
+		t.Fatalf("Unexpected address %v: %v", addr, err)
+	}
+	if rest, _ := ioutil.ReadAll(reader); string(rest) != "data" {
+		t.Fatal("TLVs weren't skipped")
+	}
+}
+
+func TestProxyProtocolAcceptor(t *testing.T) {
+	if _, err := NewProxyProtocolAcceptor([]string{" "}); err != ErrProxyProtocolNoTrustedNetworks {
+		t.Fatalf("Expected ErrProxyProtocolNoTrustedNetworks, took %v", err)
+	}
+	if _, err := NewProxyProtocolAcceptor([]string{"10.0.0.0"}); err == nil {
+		t.Fatal("Expected error for invalid CIDR")
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	accept := func(acceptor *ProxyProtocolAcceptor, header string) (net.Conn, error) {
+		client, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		if _, err := client.Write([]byte(header + "data")); err != nil {
+			t.Fatal(err)
+		}
+		conn, err := listener.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return acceptor.Accept(conn)
+	}
+	header := "PROXY TCP4 192.168.0.1 192.168.0.11 56324 9393\r\n"
+
+	trusted, err := NewProxyProtocolAcceptor([]string{"10.0.0.0/8", "127.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := accept(trusted, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn.RemoteAddr().String() != "192.168.0.1:56324" {
+		t.Fatalf("Unexpected remote address %s", conn.RemoteAddr())
+	}
+	data := make([]byte, 4)
+	if _, err := conn.Read(data); err != nil || string(data) != "data" {
+		t.Fatalf("Unexpected data %q after header: %v", data, err)
+	}
+	conn.Close()
+	// trusted peers must send header
+	if _, err := accept(trusted, "GET / HTTP/1.1\r\n"); err != ErrInvalidProxyProtocolHeader {
+		t.Fatalf("Expected ErrInvalidProxyProtocolHeader, took %v", err)
+	}
+
+	// header of untrusted peer isn't read, so it can't spoof its address
+	untrusted, err := NewProxyProtocolAcceptor([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err = accept(untrusted, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if conn.RemoteAddr().String() == "192.168.0.1:56324" {
+		t.Fatal("Address of untrusted peer was replaced")
+	}
+}
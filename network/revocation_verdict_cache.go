@@ -0,0 +1,189 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package network
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/groupcache/lru"
+	log "github.com/sirupsen/logrus"
+)
+
+// Default values of revocation verdict cache
+const (
+	RevocationVerdictDefaultCacheSize = 1024
+	RevocationVerdictDisableCacheTime = 0
+)
+
+// revocationVerdict is result of revocation check valid until expiration
+type revocationVerdict struct {
+	err       error
+	expiresAt time.Time
+}
+
+// RevocationVerdictCache stores results of OCSP/CRL checks by identity of peer certificate for limited time, shared by
+// all connections, so repeated and resumed TLS sessions of the same client reuse still valid verdict instead of
+// querying OCSP servers and fetching CRLs from scratch
+type RevocationVerdictCache struct {
+	cache lru.Cache
+	// keys of cached verdicts, lru.Cache doesn't allow to iterate over them
+	keys  map[string]struct{}
+	mutex sync.Mutex
+	ttl   time.Duration
+	now   func() time.Time
+}
+
+// NewRevocationVerdictCache creates new RevocationVerdictCache which stores at most maxEntries verdicts for ttl
+func NewRevocationVerdictCache(maxEntries uint, ttl time.Duration) *RevocationVerdictCache {
+	c := &RevocationVerdictCache{cache: lru.Cache{MaxEntries: int(maxEntries)}, keys: map[string]struct{}{}, ttl: ttl, now: time.Now}
+	c.cache.OnEvicted = func(key lru.Key, value interface{}) {
+		delete(c.keys, key.(string))
+	}
+	return c
+}
+
+// Get returns true and cached verdict if it isn't expired yet
+func (c *RevocationVerdictCache) Get(key string) (bool, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	value, ok := c.cache.Get(key)
+	if !ok {
+		return false, nil
+	}
+	verdict := value.(revocationVerdict)
+	if !c.now().Before(verdict.expiresAt) {
+		c.cache.Remove(key)
+		return false, nil
+	}
+	return true, verdict.err
+}
+
+// Put stores verdict until ttl expires
+func (c *RevocationVerdictCache) Put(key string, err error) {
+	c.mutex.Lock()
+	c.cache.Add(key, revocationVerdict{err: err, expiresAt: c.now().Add(c.ttl)})
+	c.keys[key] = struct{}{}
+	c.mutex.Unlock()
+}
+
+// verdictNames are names of cached verdicts in exported state
+var verdictNames = map[string]error{
+	"valid":   nil,
+	"revoked": ErrCertWasRevoked,
+	"unknown": ErrOCSPUnknownCertificate,
+}
+
+type exportedVerdict struct {
+	Key       string    `json:"key"`
+	Verdict   string    `json:"verdict"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// StateName returns name of state synced by standby pair
+func (c *RevocationVerdictCache) StateName() string {
+	return "revocation_verdicts"
+}
+
+// ExportState returns verdicts which aren't expired yet
+func (c *RevocationVerdictCache) ExportState() ([]byte, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	now := c.now()
+	verdicts := make([]exportedVerdict, 0, len(c.keys))
+	for key := range c.keys {
+		value, ok := c.cache.Get(key)
+		if !ok {
+			continue
+		}
+		verdict := value.(revocationVerdict)
+		if !now.Before(verdict.expiresAt) {
+			continue
+		}
+		for name, err := range verdictNames {
+			if errors.Is(verdict.err, err) {
+				verdicts = append(verdicts, exportedVerdict{Key: key, Verdict: name, ExpiresAt: verdict.expiresAt})
+				break
+			}
+		}
+	}
+	sort.Slice(verdicts, func(i, j int) bool { return verdicts[i].Key < verdicts[j].Key })
+	return json.Marshal(verdicts)
+}
+
+// ImportState adds exported verdicts with their expiration time
+func (c *RevocationVerdictCache) ImportState(data []byte) error {
+	verdicts := []exportedVerdict{}
+	if err := json.Unmarshal(data, &verdicts); err != nil {
+		return err
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, verdict := range verdicts {
+		err, ok := verdictNames[verdict.Verdict]
+		if !ok {
+			return fmt.Errorf("unknown revocation verdict '%s'", verdict.Verdict)
+		}
+		c.cache.Add(verdict.Key, revocationVerdict{err: err, expiresAt: verdict.ExpiresAt})
+		c.keys[verdict.Key] = struct{}{}
+	}
+	return nil
+}
+
+// isDefiniteVerdict returns true for verdicts which don't depend on availability of OCSP servers and CRLs
+func isDefiniteVerdict(err error) bool {
+	return err == nil || errors.Is(err, ErrCertWasRevoked) || errors.Is(err, ErrOCSPUnknownCertificate)
+}
+
+// CachingCertVerifier is CertVerifier which reuses verdicts of wrapped verifier from RevocationVerdictCache. Verdicts
+// are cached by SHA-256 of peer's leaf certificate, only successful checks and revoked or unknown certificates are
+// cached, so failed queries to OCSP servers or CRLs are retried on next handshake.
+type CachingCertVerifier struct {
+	verifier CertVerifier
+	cache    *RevocationVerdictCache
+}
+
+// NewCachingCertVerifier creates new CachingCertVerifier
+func NewCachingCertVerifier(verifier CertVerifier, cache *RevocationVerdictCache) CachingCertVerifier {
+	return CachingCertVerifier{verifier: verifier, cache: cache}
+}
+
+// Verify returns cached verdict while it's valid or verifies certificate with wrapped verifier otherwise
+func (v CachingCertVerifier) Verify(ctx context.Context, rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return v.verifier.Verify(ctx, rawCerts, verifiedChains)
+	}
+	hash := sha256.Sum256(rawCerts[0])
+	key := hex.EncodeToString(hash[:])
+	if ok, err := v.cache.Get(key); ok {
+		log.WithField("certificate_sha256", key).Debugln("Use cached revocation verdict")
+		return err
+	}
+	err := v.verifier.Verify(ctx, rawCerts, verifiedChains)
+	if isDefiniteVerdict(err) {
+		v.cache.Put(key, err)
+	}
+	return err
+}
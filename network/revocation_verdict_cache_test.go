@@ -0,0 +1,234 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package network
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingCertVerifier returns configured verdict and counts calls
+type countingCertVerifier struct {
+	lock    sync.Mutex
+	calls   int
+	verdict error
+}
+
+func (v *countingCertVerifier) Verify(ctx context.Context, rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.calls++
+	return v.verdict
+}
+
+func (v *countingCertVerifier) set(verdict error) {
+	v.lock.Lock()
+	v.verdict = verdict
+	v.lock.Unlock()
+}
+
+func (v *countingCertVerifier) count() int {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	return v.calls
+}
+
+// testClock is adjustable time source of RevocationVerdictCache
+type testClock struct {
+	lock sync.Mutex
+	now  time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+func (c *testClock) Add(duration time.Duration) {
+	c.lock.Lock()
+	c.now = c.now.Add(duration)
+	c.lock.Unlock()
+}
+
+func newTestVerdictCache(ttl time.Duration) (*RevocationVerdictCache, *testClock) {
+	clock := &testClock{now: time.Now()}
+	cache := NewRevocationVerdictCache(RevocationVerdictDefaultCacheSize, ttl)
+	cache.now = clock.Now
+	return cache, clock
+}
+
+func TestCachingCertVerifier(t *testing.T) {
+	cache, clock := newTestVerdictCache(time.Minute)
+	counter := &countingCertVerifier{}
+	verifier := NewCachingCertVerifier(counter, cache)
+	client1 := [][]byte{[]byte("client1 certificate")}
+	client2 := [][]byte{[]byte("client2 certificate")}
+
+	for i := 0; i < 3; i++ {
+		if err := verifier.Verify(context.Background(), client1, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if counter.count() != 1 {
+		t.Fatalf("Expected one verification of the same certificate, took %d", counter.count())
+	}
+	// verdicts are stored per certificate
+	counter.set(ErrCertWasRevoked)
+	if err := verifier.Verify(context.Background(), client2, nil); err != ErrCertWasRevoked {
+		t.Fatalf("Expected ErrCertWasRevoked, took %v", err)
+	}
+	if err := verifier.Verify(context.Background(), client2, nil); err != ErrCertWasRevoked || counter.count() != 2 {
+		t.Fatalf("Expected cached ErrCertWasRevoked, took %v after %d verifications", err, counter.count())
+	}
+	if err := verifier.Verify(context.Background(), client1, nil); err != nil {
+		t.Fatal("Expected cached verdict of client1")
+	}
+	// expired verdict is verified again
+	clock.Add(time.Minute)
+	if err := verifier.Verify(context.Background(), client1, nil); err != ErrCertWasRevoked || counter.count() != 3 {
+		t.Fatalf("Expected new verification after expiration, took %v after %d verifications", err, counter.count())
+	}
+	// failed queries aren't cached
+	counter.set(ErrOCSPRequiredAllButGotError)
+	clock.Add(time.Minute)
+	for i := 0; i < 2; i++ {
+		if err := verifier.Verify(context.Background(), client1, nil); err != ErrOCSPRequiredAllButGotError {
+			t.Fatalf("Expected ErrOCSPRequiredAllButGotError, took %v", err)
+		}
+	}
+	if counter.count() != 5 {
+		t.Fatalf("Failed verifications shouldn't be cached, took %d verifications", counter.count())
+	}
+}
+
+func TestTLSResumedSessionRevocationCheck(t *testing.T) {
+	clientConfig, serverConfig := getTLSConfigs(t)
+	clientConfig.ClientSessionCache = tls.NewLRUClientSessionCache(1)
+	cache, clock := newTestVerdictCache(time.Hour)
+	counter := &countingCertVerifier{}
+	verifier := NewCachingCertVerifier(counter, cache)
+	serverConfig.VerifyPeerCertificate = verifyPeerCertificateWithContext(context.Background(), verifier)
+	tlsConfigVerifiers.Store(serverConfig, verifier)
+	serverWrapper, err := NewTLSConnectionWrapper([]byte("client"), serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	address := fmt.Sprintf("localhost:%d", listener.Addr().(*net.TCPAddr).Port)
+
+	// connect returns whether session was resumed and error of server side
+	connect := func() (bool, error) {
+		clientConn, serverConn := getConnectionPair(address, listener, t)
+		defer clientConn.Close()
+		serverErr := make(chan error, 1)
+		go func() {
+			conn, _, err := serverWrapper.WrapServer(context.TODO(), serverConn)
+			if err == nil {
+				// client receives session tickets of TLS 1.3 on read after handshake
+				_, err = conn.Write([]byte{1})
+			}
+			conn.Close()
+			serverErr <- err
+		}()
+		tlsConn := tls.Client(clientConn, clientConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			t.Fatal(err)
+		}
+		tlsConn.Read(make([]byte, 1))
+		return tlsConn.ConnectionState().DidResume, <-serverErr
+	}
+
+	if resumed, err := connect(); err != nil || resumed {
+		t.Fatalf("Expected successful full handshake, took resumed=%v, err=%v", resumed, err)
+	}
+	if resumed, err := connect(); err != nil || !resumed {
+		t.Fatalf("Expected successful resumed session, took resumed=%v, err=%v", resumed, err)
+	}
+	if counter.count() != 1 {
+		t.Fatalf("Resumed session should reuse verdict of full handshake, took %d verifications", counter.count())
+	}
+	// resumed session after expiration of verdict verifies certificate again
+	counter.set(ErrCertWasRevoked)
+	clock.Add(time.Hour)
+	if resumed, err := connect(); !errors.Is(err, ErrCertWasRevoked) || !resumed {
+		t.Fatalf("Expected resumed session with revoked certificate to be rejected, took resumed=%v, err=%v", resumed, err)
+	}
+	if counter.count() != 2 {
+		t.Fatalf("Expected verification after expiration of verdict, took %d verifications", counter.count())
+	}
+}
+
+func TestRevocationVerdictCacheState(t *testing.T) {
+	cache, clock := newTestVerdictCache(time.Minute)
+	cache.Put("valid", nil)
+	cache.Put("revoked", ErrCertWasRevoked)
+	cache.Put("unknown", ErrOCSPUnknownCertificate)
+	clock.Add(time.Second * 30)
+	cache.Put("later", nil)
+	clock.Add(time.Second * 40)
+	state, err := cache.ExportState()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	imported, importedClock := newTestVerdictCache(time.Minute)
+	importedClock.now = clock.Now()
+	if err := imported.ImportState(state); err != nil {
+		t.Fatal(err)
+	}
+	// expired verdicts aren't exported
+	for _, key := range []string{"valid", "revoked", "unknown"} {
+		if ok, _ := imported.Get(key); ok {
+			t.Fatalf("Expired verdict %s shouldn't be imported", key)
+		}
+	}
+	if ok, err := imported.Get("later"); !ok || err != nil {
+		t.Fatalf("Expected imported valid verdict, took %v and %v", ok, err)
+	}
+	// imported verdicts keep expiration time of exported ones
+	importedClock.Add(time.Second * 20)
+	if ok, _ := imported.Get("later"); ok {
+		t.Fatal("Imported verdict should expire at the same time as exported one")
+	}
+
+	cache.Put("revoked", ErrCertWasRevoked)
+	state, err = cache.ExportState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := imported.ImportState(state); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := imported.Get("revoked"); !ok || err != ErrCertWasRevoked {
+		t.Fatalf("Expected imported ErrCertWasRevoked, took %v and %v", ok, err)
+	}
+	if err := imported.ImportState([]byte(`[{"key": "other", "verdict": "failed"}]`)); err == nil {
+		t.Fatal("Expected error for unknown verdict")
+	}
+}
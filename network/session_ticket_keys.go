@@ -0,0 +1,255 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package network
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/cossacklabs/acra/keystore"
+	"github.com/cossacklabs/acra/logging"
+	"github.com/cossacklabs/acra/random"
+	log "github.com/sirupsen/logrus"
+)
+
+// Defaults of SessionTicketKeys
+const (
+	DefaultSessionTicketKeyRotationInterval = time.Hour
+	// keys of previous intervals still decrypt tickets issued before rotation
+	sessionTicketKeysCount = 3
+)
+
+// ErrInvalidSessionTicketKeys returned if imported state doesn't contain session ticket keys
+var ErrInvalidSessionTicketKeys = errors.New("invalid session ticket keys")
+
+// SessionTicketKeys rotates keys of TLS session tickets of tls.Config objects. Go generates random ticket keys in
+// each process, so sessions can't be resumed on other node, shared SessionTicketKeys allow to resume sessions after
+// failover to standby node.
+type SessionTicketKeys struct {
+	mutex       sync.Mutex
+	keys        [][32]byte
+	lastRotated time.Time
+	configs     []*tls.Config
+	now         func() time.Time
+}
+
+// NewSessionTicketKeys returns SessionTicketKeys with new random key
+func NewSessionTicketKeys() (*SessionTicketKeys, error) {
+	ticketKeys := &SessionTicketKeys{now: time.Now}
+	if err := ticketKeys.Rotate(); err != nil {
+		return nil, err
+	}
+	return ticketKeys, nil
+}
+
+// Apply uses keys for session tickets of config and updates them on rotation and import
+func (ticketKeys *SessionTicketKeys) Apply(config *tls.Config) {
+	ticketKeys.mutex.Lock()
+	defer ticketKeys.mutex.Unlock()
+	ticketKeys.configs = append(ticketKeys.configs, config)
+	config.SetSessionTicketKeys(ticketKeys.keys)
+}
+
+// Rotate adds new random key used for new tickets and removes the oldest one
+func (ticketKeys *SessionTicketKeys) Rotate() error {
+	var key [32]byte
+	if _, err := random.Read(key[:]); err != nil {
+		return err
+	}
+	ticketKeys.mutex.Lock()
+	defer ticketKeys.mutex.Unlock()
+	keys := append([][32]byte{key}, ticketKeys.keys...)
+	if len(keys) > sessionTicketKeysCount {
+		keys = keys[:sessionTicketKeysCount]
+	}
+	ticketKeys.setKeys(keys, ticketKeys.now())
+	return nil
+}
+
+// RotateIfExpired rotates keys if they weren't rotated during interval
+func (ticketKeys *SessionTicketKeys) RotateIfExpired(interval time.Duration) error {
+	if !ticketKeys.expired(interval) {
+		return nil
+	}
+	return ticketKeys.Rotate()
+}
+
+// expired returns true if keys weren't rotated during interval
+func (ticketKeys *SessionTicketKeys) expired(interval time.Duration) bool {
+	ticketKeys.mutex.Lock()
+	defer ticketKeys.mutex.Unlock()
+	return ticketKeys.now().Sub(ticketKeys.lastRotated) >= interval
+}
+
+// setKeys should be called with locked mutex
+func (ticketKeys *SessionTicketKeys) setKeys(keys [][32]byte, rotated time.Time) {
+	ticketKeys.keys = keys
+	ticketKeys.lastRotated = rotated
+	for _, config := range ticketKeys.configs {
+		config.SetSessionTicketKeys(keys)
+	}
+}
+
+type sessionTicketKeysState struct {
+	Keys        [][]byte  `json:"keys"`
+	LastRotated time.Time `json:"last_rotated"`
+}
+
+// StateName returns name of state synced by standby pair
+func (ticketKeys *SessionTicketKeys) StateName() string {
+	return "session_ticket_keys"
+}
+
+// ExportState returns keys and time of last rotation
+func (ticketKeys *SessionTicketKeys) ExportState() ([]byte, error) {
+	ticketKeys.mutex.Lock()
+	defer ticketKeys.mutex.Unlock()
+	state := sessionTicketKeysState{LastRotated: ticketKeys.lastRotated}
+	for _, key := range ticketKeys.keys {
+		state.Keys = append(state.Keys, append([]byte{}, key[:]...))
+	}
+	return json.Marshal(state)
+}
+
+// ImportState replaces keys with exported ones
+func (ticketKeys *SessionTicketKeys) ImportState(data []byte) error {
+	state := sessionTicketKeysState{}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	if len(state.Keys) == 0 {
+		return ErrInvalidSessionTicketKeys
+	}
+	keys := make([][32]byte, len(state.Keys))
+	for i, key := range state.Keys {
+		if len(key) != 32 {
+			return ErrInvalidSessionTicketKeys
+		}
+		copy(keys[i][:], key)
+	}
+	ticketKeys.mutex.Lock()
+	defer ticketKeys.mutex.Unlock()
+	ticketKeys.setKeys(keys, state.LastRotated)
+	return nil
+}
+
+// SessionTicketKeysStorage stores exported state of SessionTicketKeys shared by several instances
+type SessionTicketKeysStorage interface {
+	// LoadSessionTicketKeys returns stored state or nil if nothing is stored yet
+	LoadSessionTicketKeys() ([]byte, error)
+	StoreSessionTicketKeys(state []byte) error
+}
+
+// Sync imports keys of storage and rotates them if no instance rotated them during interval, rotated keys are stored
+// for other instances. Keys are stored as is if storage is empty. If several instances rotate keys at the same time,
+// keys of the last one are used by all of them after next sync, sessions with tickets of other keys fall back to full
+// handshake.
+func (ticketKeys *SessionTicketKeys) Sync(storage SessionTicketKeysStorage, interval time.Duration) error {
+	state, err := storage.LoadSessionTicketKeys()
+	if err != nil {
+		return err
+	}
+	if state != nil {
+		if err := ticketKeys.ImportState(state); err != nil {
+			return err
+		}
+		if !ticketKeys.expired(interval) {
+			return nil
+		}
+		if err := ticketKeys.Rotate(); err != nil {
+			return err
+		}
+	}
+	state, err = ticketKeys.ExportState()
+	if err != nil {
+		return err
+	}
+	return storage.StoreSessionTicketKeys(state)
+}
+
+// RunSync syncs keys with storage every checkInterval until ctx is done
+func (ticketKeys *SessionTicketKeys) RunSync(ctx context.Context, storage SessionTicketKeysStorage, interval, checkInterval time.Duration) {
+	ticker := time.NewTicker(checkInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := ticketKeys.Sync(storage, interval); err != nil {
+			log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorTransportConfiguration).
+				Warningln("Can't sync TLS session ticket keys with storage")
+		}
+	}
+}
+
+// SessionTicketKeysFileName is name of file in keystore directory with TLS session ticket keys
+const SessionTicketKeysFileName = ".tls_session_ticket_keys"
+
+// FileSessionTicketKeysStorage stores TLS session ticket keys in file encrypted with master key, so instances which
+// share keystore directory resume TLS sessions of each other
+type FileSessionTicketKeysStorage struct {
+	path      string
+	encryptor keystore.KeyEncryptor
+}
+
+// NewFileSessionTicketKeysStorage returns storage of keys in file of keysDir encrypted with encryptor
+func NewFileSessionTicketKeysStorage(keysDir string, encryptor keystore.KeyEncryptor) *FileSessionTicketKeysStorage {
+	return &FileSessionTicketKeysStorage{path: filepath.Join(keysDir, SessionTicketKeysFileName), encryptor: encryptor}
+}
+
+// LoadSessionTicketKeys returns decrypted state of file or nil if file doesn't exist
+func (storage *FileSessionTicketKeysStorage) LoadSessionTicketKeys() ([]byte, error) {
+	encrypted, err := ioutil.ReadFile(storage.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return storage.encryptor.Decrypt(encrypted, []byte(SessionTicketKeysFileName))
+}
+
+// StoreSessionTicketKeys encrypts state and replaces file via temporary file, so other instances never read partially
+// written file
+func (storage *FileSessionTicketKeysStorage) StoreSessionTicketKeys(state []byte) error {
+	encrypted, err := storage.encryptor.Encrypt(state, []byte(SessionTicketKeysFileName))
+	if err != nil {
+		return err
+	}
+	tmpFile, err := ioutil.TempFile(filepath.Dir(storage.path), SessionTicketKeysFileName+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	if _, err := tmpFile.Write(encrypted); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), storage.path)
+}
@@ -0,0 +1,197 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package network
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/cossacklabs/acra/keystore"
+)
+
+func TestSessionTicketKeysRotation(t *testing.T) {
+	ticketKeys, err := NewSessionTicketKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	ticketKeys.now = func() time.Time { return now }
+	first := ticketKeys.keys[0]
+	if err := ticketKeys.RotateIfExpired(time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if len(ticketKeys.keys) != 1 {
+		t.Fatal("Keys shouldn't be rotated before interval")
+	}
+	for i := 0; i < sessionTicketKeysCount+1; i++ {
+		now = now.Add(time.Hour)
+		if err := ticketKeys.RotateIfExpired(time.Hour); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(ticketKeys.keys) != sessionTicketKeysCount {
+		t.Fatalf("Expected %d keys, took %d", sessionTicketKeysCount, len(ticketKeys.keys))
+	}
+	for _, key := range ticketKeys.keys {
+		if key == first {
+			t.Fatal("The oldest key should be removed")
+		}
+	}
+
+	state, err := ticketKeys.ExportState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	imported, err := NewSessionTicketKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := imported.ImportState(state); err != nil {
+		t.Fatal(err)
+	}
+	if len(imported.keys) != len(ticketKeys.keys) || imported.keys[0] != ticketKeys.keys[0] || !imported.lastRotated.Equal(now) {
+		t.Fatal("Imported keys differ from exported ones")
+	}
+	for _, data := range []string{`{"keys": []}`, `{"keys": ["AAEC"]}`} {
+		if err := imported.ImportState([]byte(data)); err != ErrInvalidSessionTicketKeys {
+			t.Fatalf("Expected ErrInvalidSessionTicketKeys for %s, took %v", data, err)
+		}
+	}
+}
+
+func TestSessionTicketKeysResumptionOnOtherNode(t *testing.T) {
+	clientConfig, serverConfig := getTLSConfigs(t)
+	clientConfig.ClientSessionCache = tls.NewLRUClientSessionCache(1)
+	activeKeys, err := NewSessionTicketKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	activeConfig := serverConfig.Clone()
+	activeKeys.Apply(activeConfig)
+	standbyKeys, err := NewSessionTicketKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	standbyConfig := serverConfig.Clone()
+	standbyKeys.Apply(standbyConfig)
+
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	address := fmt.Sprintf("localhost:%d", listener.Addr().(*net.TCPAddr).Port)
+	connect := func(config *tls.Config) bool {
+		clientConn, serverConn := getConnectionPair(address, listener, t)
+		defer clientConn.Close()
+		serverErr := make(chan error, 1)
+		go func() {
+			conn := tls.Server(serverConn, config)
+			_, err := conn.Write([]byte{1})
+			conn.Close()
+			serverErr <- err
+		}()
+		tlsConn := tls.Client(clientConn, clientConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			t.Fatal(err)
+		}
+		tlsConn.Read(make([]byte, 1))
+		if err := <-serverErr; err != nil {
+			t.Fatal(err)
+		}
+		return tlsConn.ConnectionState().DidResume
+	}
+
+	if connect(activeConfig) {
+		t.Fatal("Expected full handshake")
+	}
+	if connect(standbyConfig) {
+		t.Fatal("Session shouldn't be resumed with other ticket keys")
+	}
+	connect(activeConfig)
+	state, err := activeKeys.ExportState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := standbyKeys.ImportState(state); err != nil {
+		t.Fatal(err)
+	}
+	if !connect(standbyConfig) {
+		t.Fatal("Expected session resumed with imported ticket keys")
+	}
+}
+
+func TestSessionTicketKeysSyncWithFileStorage(t *testing.T) {
+	keysDir, err := ioutil.TempDir("", "session_ticket_keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(keysDir)
+	encryptor, err := keystore.NewSCellKeyEncryptor([]byte("master key of session ticket keys"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage := NewFileSessionTicketKeysStorage(keysDir, encryptor)
+	if state, err := storage.LoadSessionTicketKeys(); err != nil || state != nil {
+		t.Fatalf("Empty storage should return nil state, took %v", err)
+	}
+	now := time.Now()
+	instances := make([]*SessionTicketKeys, 2)
+	for i := range instances {
+		if instances[i], err = NewSessionTicketKeys(); err != nil {
+			t.Fatal(err)
+		}
+		instances[i].now = func() time.Time { return now }
+		if err := instances[i].Sync(storage, time.Hour); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// keys of first instance are stored and imported by second one
+	if len(instances[1].keys) != 1 || instances[1].keys[0] != instances[0].keys[0] {
+		t.Fatal("Instances should use the same keys")
+	}
+	first := instances[0].keys[0]
+
+	// first keys were generated with real time after now
+	now = now.Add(2 * time.Hour)
+	if err := instances[1].Sync(storage, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if len(instances[1].keys) != 2 || instances[1].keys[1] != first {
+		t.Fatal("Expired keys should be rotated keeping previous key")
+	}
+	// rotated keys aren't rotated again by other instance
+	if err := instances[0].Sync(storage, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if len(instances[0].keys) != 2 || instances[0].keys[0] != instances[1].keys[0] {
+		t.Fatal("Rotated keys should be imported from storage")
+	}
+
+	otherEncryptor, err := keystore.NewSCellKeyEncryptor([]byte("other master key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewFileSessionTicketKeysStorage(keysDir, otherEncryptor).LoadSessionTicketKeys(); err == nil {
+		t.Fatal("Keys shouldn't be decrypted with other master key")
+	}
+}
@@ -0,0 +1,354 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package network
+
+import (
+	"context"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cossacklabs/acra/logging"
+	"github.com/golang/protobuf/proto"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// Default settings of SpiffeCredentialsProvider
+const (
+	// DefaultSpiffeFetchTimeout limits waiting for the first SVID at startup
+	DefaultSpiffeFetchTimeout = time.Second * 30
+	// spiffeRetryInterval is time between reconnections to Workload API after errors
+	spiffeRetryInterval = time.Second * 5
+	spiffeScheme        = "spiffe"
+)
+
+// Workload API of SPIFFE, https://github.com/spiffe/spiffe/blob/master/standards/SPIFFE_Workload_API.md
+const (
+	spiffeFetchX509SVIDMethod = "/SpiffeWorkloadAPI/FetchX509SVID"
+	spiffeSecurityHeader      = "workload.spiffe.io"
+)
+
+// Errors related to SPIFFE identities
+var (
+	ErrInvalidSpiffeConfig = errors.New("invalid SPIFFE config")
+	ErrNoSpiffeID          = errors.New("certificate doesn't have SPIFFE ID")
+	ErrSpiffeIDNotAllowed  = errors.New("SPIFFE ID isn't allowed")
+	ErrNoX509SVID          = errors.New("no X.509 SVID in Workload API response")
+	ErrInvalidX509SVID     = errors.New("invalid X.509 SVID")
+	ErrX509SVIDNotFetched  = errors.New("no X.509 SVID fetched yet")
+)
+
+// x509SVIDRequest is X509SVIDRequest message of Workload API
+type x509SVIDRequest struct{}
+
+func (m *x509SVIDRequest) Reset()         { *m = x509SVIDRequest{} }
+func (m *x509SVIDRequest) String() string { return proto.CompactTextString(m) }
+func (*x509SVIDRequest) ProtoMessage()    {}
+
+// x509SVIDResponse is X509SVIDResponse message of Workload API
+type x509SVIDResponse struct {
+	Svids            []*x509SVID       `protobuf:"bytes,1,rep,name=svids,proto3"`
+	Crl              [][]byte          `protobuf:"bytes,2,rep,name=crl,proto3"`
+	FederatedBundles map[string][]byte `protobuf:"bytes,3,rep,name=federated_bundles,json=federatedBundles,proto3" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+}
+
+func (m *x509SVIDResponse) Reset()         { *m = x509SVIDResponse{} }
+func (m *x509SVIDResponse) String() string { return proto.CompactTextString(m) }
+func (*x509SVIDResponse) ProtoMessage()    {}
+
+// x509SVID is X509SVID message of Workload API. Certificates are concatenated ASN.1 DER certificates with leaf first,
+// key is PKCS#8 DER private key, bundle is concatenated DER CA certificates of trust domain.
+type x509SVID struct {
+	SpiffeID    string `protobuf:"bytes,1,opt,name=spiffe_id,json=spiffeId,proto3"`
+	X509Svid    []byte `protobuf:"bytes,2,opt,name=x509_svid,json=x509Svid,proto3"`
+	X509SvidKey []byte `protobuf:"bytes,3,opt,name=x509_svid_key,json=x509SvidKey,proto3"`
+	Bundle      []byte `protobuf:"bytes,4,opt,name=bundle,proto3"`
+}
+
+func (m *x509SVID) Reset()         { *m = x509SVID{} }
+func (m *x509SVID) String() string { return proto.CompactTextString(m) }
+func (*x509SVID) ProtoMessage()    {}
+
+// SpiffeCredentialsProvider fetches X.509 SVIDs of workload from SPIRE agent by Workload API and uses them instead of
+// certificate files in TLS configs. SVIDs rotated by agent are used by new connections. Peers are accepted if their
+// certificate is issued by CA of trust domain and has SPIFFE ID of trust domain listed in allowed IDs (any ID of
+// trust domain if list is empty). Server certificates are verified by SPIFFE ID instead of host name.
+type SpiffeCredentialsProvider struct {
+	socketPath  string
+	trustDomain string
+	allowedIDs  map[string]bool
+	mutex       sync.RWMutex
+	certificate *tls.Certificate
+	spiffeID    string
+	bundle      *x509.CertPool
+	ready       chan struct{}
+}
+
+// NewSpiffeCredentialsProvider returns SpiffeCredentialsProvider of Workload API listening on socketPath (path of unix
+// socket or unix:// URL), accepting SPIFFE IDs of trustDomain from allowedIDs
+func NewSpiffeCredentialsProvider(socketPath, trustDomain string, allowedIDs []string) (*SpiffeCredentialsProvider, error) {
+	socketPath = strings.TrimPrefix(socketPath, "unix://")
+	if socketPath == "" {
+		return nil, fmt.Errorf("%w: empty Workload API socket path", ErrInvalidSpiffeConfig)
+	}
+	if trustDomain == "" || strings.ContainsAny(trustDomain, "/:") {
+		return nil, fmt.Errorf("%w: invalid trust domain '%s'", ErrInvalidSpiffeConfig, trustDomain)
+	}
+	allowed := make(map[string]bool, len(allowedIDs))
+	for _, id := range allowedIDs {
+		id = strings.TrimSpace(id)
+		if id == "" {
+			continue
+		}
+		if domain, err := spiffeIDTrustDomain(id); err != nil || domain != trustDomain {
+			return nil, fmt.Errorf("%w: '%s' isn't SPIFFE ID of trust domain '%s'", ErrInvalidSpiffeConfig, id, trustDomain)
+		}
+		allowed[id] = true
+	}
+	return &SpiffeCredentialsProvider{socketPath: socketPath, trustDomain: trustDomain, allowedIDs: allowed, ready: make(chan struct{})}, nil
+}
+
+// spiffeIDTrustDomain returns trust domain of SPIFFE ID like spiffe://example.org/workload
+func spiffeIDTrustDomain(id string) (string, error) {
+	spiffeURL, err := url.Parse(id)
+	if err != nil {
+		return "", err
+	}
+	if spiffeURL.Scheme != spiffeScheme || spiffeURL.Host == "" || spiffeURL.User != nil || spiffeURL.RawQuery != "" || spiffeURL.Fragment != "" {
+		return "", ErrNoSpiffeID
+	}
+	return spiffeURL.Host, nil
+}
+
+// certificateSpiffeID returns SPIFFE ID from URI SAN of certificate, SVIDs have exactly one URI SAN
+func certificateSpiffeID(certificate *x509.Certificate) (string, error) {
+	if len(certificate.URIs) != 1 || certificate.URIs[0].Scheme != spiffeScheme {
+		return "", ErrNoSpiffeID
+	}
+	return certificate.URIs[0].String(), nil
+}
+
+// Apply makes new connections with config use last fetched SVID and bundle. Config should be created by NewTLSConfig.
+func (provider *SpiffeCredentialsProvider) Apply(config *tls.Config) {
+	tlsConfigMaterials.Store(config, provider)
+}
+
+// SpiffeID returns SPIFFE ID of last fetched SVID
+func (provider *SpiffeCredentialsProvider) SpiffeID() string {
+	provider.mutex.RLock()
+	defer provider.mutex.RUnlock()
+	return provider.spiffeID
+}
+
+// WaitForSVID blocks until the first SVID is fetched or ctx is done
+func (provider *SpiffeCredentialsProvider) WaitForSVID(ctx context.Context) error {
+	select {
+	case <-provider.ready:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Run streams SVIDs from Workload API and reconnects after errors until ctx is done
+func (provider *SpiffeCredentialsProvider) Run(ctx context.Context) {
+	logger := log.WithField("socket", provider.socketPath)
+	for {
+		err := provider.watch(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorNetworkTLSGeneral).
+			Errorf("SPIFFE: Workload API stream failed, reconnect in %s", spiffeRetryInterval)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(spiffeRetryInterval):
+		}
+	}
+}
+
+// watch receives SVID updates from one stream of Workload API
+func (provider *SpiffeCredentialsProvider) watch(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	connection, err := grpc.DialContext(ctx, provider.socketPath, grpc.WithInsecure(), grpc.WithDialer(func(address string, timeout time.Duration) (net.Conn, error) {
+		return net.DialTimeout("unix", address, timeout)
+	}))
+	if err != nil {
+		return err
+	}
+	defer connection.Close()
+	// agent rejects requests without security header
+	ctx = metadata.AppendToOutgoingContext(ctx, spiffeSecurityHeader, "true")
+	stream, err := connection.NewStream(ctx, &grpc.StreamDesc{StreamName: "FetchX509SVID", ServerStreams: true}, spiffeFetchX509SVIDMethod)
+	if err != nil {
+		return err
+	}
+	if err := stream.SendMsg(&x509SVIDRequest{}); err != nil {
+		return err
+	}
+	if err := stream.CloseSend(); err != nil {
+		return err
+	}
+	for {
+		response := &x509SVIDResponse{}
+		if err := stream.RecvMsg(response); err != nil {
+			return err
+		}
+		if err := provider.update(response); err != nil {
+			// agent sends next SVIDs on rotation, previous SVID is used until then
+			log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorNetworkTLSGeneral).
+				Errorln("SPIFFE: can't use X.509 SVID from Workload API")
+		}
+	}
+}
+
+// update replaces SVID and bundle with the first SVID of response
+func (provider *SpiffeCredentialsProvider) update(response *x509SVIDResponse) error {
+	if len(response.Svids) == 0 {
+		return ErrNoX509SVID
+	}
+	svid := response.Svids[0]
+	certificates, err := x509.ParseCertificates(svid.X509Svid)
+	if err != nil || len(certificates) == 0 {
+		return fmt.Errorf("%w: can't parse certificates", ErrInvalidX509SVID)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(svid.X509SvidKey)
+	if err != nil {
+		return fmt.Errorf("%w: can't parse private key", ErrInvalidX509SVID)
+	}
+	if signer, ok := key.(crypto.Signer); !ok || !publicKeysEqual(signer.Public(), certificates[0].PublicKey) {
+		return fmt.Errorf("%w: private key doesn't match certificate", ErrInvalidX509SVID)
+	}
+	spiffeID, err := certificateSpiffeID(certificates[0])
+	if err != nil {
+		return err
+	}
+	if domain, _ := spiffeIDTrustDomain(spiffeID); domain != provider.trustDomain {
+		return fmt.Errorf("%w: SVID '%s' doesn't belong to trust domain '%s'", ErrInvalidX509SVID, spiffeID, provider.trustDomain)
+	}
+	bundleCertificates, err := x509.ParseCertificates(svid.Bundle)
+	if err != nil || len(bundleCertificates) == 0 {
+		return fmt.Errorf("%w: can't parse bundle", ErrInvalidX509SVID)
+	}
+	bundle := x509.NewCertPool()
+	for _, certificate := range bundleCertificates {
+		bundle.AddCert(certificate)
+	}
+	certificate := &tls.Certificate{PrivateKey: key, Leaf: certificates[0]}
+	for _, parsed := range certificates {
+		certificate.Certificate = append(certificate.Certificate, parsed.Raw)
+	}
+
+	provider.mutex.Lock()
+	provider.certificate = certificate
+	provider.spiffeID = spiffeID
+	provider.bundle = bundle
+	provider.mutex.Unlock()
+	select {
+	case <-provider.ready:
+	default:
+		close(provider.ready)
+	}
+	log.WithField("spiffe_id", spiffeID).WithField("not_after", certificates[0].NotAfter).Infoln("SPIFFE: X.509 SVID updated")
+	return nil
+}
+
+// publicKeysEqual compares public keys by their PKIX encoding
+func publicKeysEqual(a, b crypto.PublicKey) bool {
+	aDER, errA := x509.MarshalPKIXPublicKey(a)
+	bDER, errB := x509.MarshalPKIXPublicKey(b)
+	return errA == nil && errB == nil && string(aDER) == string(bDER)
+}
+
+// applyMaterial sets last fetched SVID and bundle to config of connection and verifies peers by SPIFFE ID before
+// verifier of config
+func (provider *SpiffeCredentialsProvider) applyMaterial(config *tls.Config) {
+	provider.mutex.RLock()
+	certificate, bundle := provider.certificate, provider.bundle
+	provider.mutex.RUnlock()
+	if certificate != nil {
+		config.Certificates = []tls.Certificate{*certificate}
+	}
+	config.RootCAs = bundle
+	config.ClientCAs = bundle
+	// SVIDs have SPIFFE ID instead of host names, so server certificates are verified by VerifyPeerCertificate.
+	// Servers ignore this option and verify client certificates with ClientCAs.
+	config.InsecureSkipVerify = true
+	next := config.VerifyPeerCertificate
+	config.VerifyPeerCertificate = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		verifiedChains, err := provider.verifyPeer(bundle, rawCerts, verifiedChains)
+		if err != nil {
+			return err
+		}
+		if next != nil {
+			return next(rawCerts, verifiedChains)
+		}
+		return nil
+	}
+}
+
+// verifyPeer verifies certificate chain of peer with bundle if it wasn't verified by TLS handshake and checks SPIFFE ID
+// of peer, returns verified chains
+func (provider *SpiffeCredentialsProvider) verifyPeer(bundle *x509.CertPool, rawCerts [][]byte, verifiedChains [][]*x509.Certificate) ([][]*x509.Certificate, error) {
+	if len(rawCerts) == 0 {
+		return nil, ErrNoPeerCertificate
+	}
+	if bundle == nil {
+		return nil, ErrX509SVIDNotFetched
+	}
+	certificates := make([]*x509.Certificate, 0, len(rawCerts))
+	for _, raw := range rawCerts {
+		certificate, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return nil, err
+		}
+		certificates = append(certificates, certificate)
+	}
+	if len(verifiedChains) == 0 {
+		intermediates := x509.NewCertPool()
+		for _, certificate := range certificates[1:] {
+			intermediates.AddCert(certificate)
+		}
+		chains, err := certificates[0].Verify(x509.VerifyOptions{Roots: bundle, Intermediates: intermediates, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}})
+		if err != nil {
+			return nil, err
+		}
+		verifiedChains = chains
+	}
+	spiffeID, err := certificateSpiffeID(certificates[0])
+	if err != nil {
+		return nil, err
+	}
+	if domain, _ := spiffeIDTrustDomain(spiffeID); domain != provider.trustDomain {
+		return nil, fmt.Errorf("%w: '%s' doesn't belong to trust domain '%s'", ErrSpiffeIDNotAllowed, spiffeID, provider.trustDomain)
+	}
+	if len(provider.allowedIDs) > 0 && !provider.allowedIDs[spiffeID] {
+		return nil, fmt.Errorf("%w: '%s'", ErrSpiffeIDNotAllowed, spiffeID)
+	}
+	return verifiedChains, nil
+}
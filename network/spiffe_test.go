@@ -0,0 +1,298 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package network
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// testSpiffeCA issues X.509 SVIDs of trust domain
+type testSpiffeCA struct {
+	certificate *x509.Certificate
+	key         *ecdsa.PrivateKey
+}
+
+func newTestSpiffeCA(t *testing.T) *testSpiffeCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "SPIRE CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testSpiffeCA{certificate: certificate, key: key}
+}
+
+// svid returns X509SVID message of Workload API with SPIFFE ID and serial number
+func (ca *testSpiffeCA) svid(t *testing.T, spiffeID string, serial int64) *x509SVID {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uri, err := url.Parse(spiffeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		URIs:         []*url.URL{uri},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.certificate, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &x509SVID{SpiffeID: spiffeID, X509Svid: der, X509SvidKey: keyDER, Bundle: ca.certificate.Raw}
+}
+
+// startTestWorkloadAPI serves Workload API on unix socket and streams responses sent to returned channel
+func startTestWorkloadAPI(t *testing.T, socketPath string) (chan *x509SVIDResponse, func()) {
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	responses := make(chan *x509SVIDResponse, 2)
+	server := grpc.NewServer()
+	server.RegisterService(&grpc.ServiceDesc{
+		ServiceName: "SpiffeWorkloadAPI",
+		HandlerType: (*interface{})(nil),
+		Streams: []grpc.StreamDesc{{
+			StreamName:    "FetchX509SVID",
+			ServerStreams: true,
+			Handler: func(srv interface{}, stream grpc.ServerStream) error {
+				md, _ := metadata.FromIncomingContext(stream.Context())
+				if values := md.Get(spiffeSecurityHeader); len(values) != 1 || values[0] != "true" {
+					return status.Error(codes.InvalidArgument, "security header is missing")
+				}
+				if err := stream.RecvMsg(&x509SVIDRequest{}); err != nil {
+					return err
+				}
+				for {
+					select {
+					case response := <-responses:
+						if err := stream.SendMsg(response); err != nil {
+							return err
+						}
+					case <-stream.Context().Done():
+						return nil
+					}
+				}
+			},
+		}},
+	}, struct{}{})
+	go server.Serve(listener)
+	return responses, server.Stop
+}
+
+func TestSpiffeCredentialsProvider(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spiffe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socketPath := filepath.Join(dir, "agent.sock")
+	responses, stop := startTestWorkloadAPI(t, socketPath)
+	defer stop()
+	ca := newTestSpiffeCA(t)
+	responses <- &x509SVIDResponse{Svids: []*x509SVID{ca.svid(t, "spiffe://example.org/acra-server", 2)}}
+
+	serverProvider, err := NewSpiffeCredentialsProvider("unix://"+socketPath, "example.org", []string{"spiffe://example.org/app"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go serverProvider.Run(ctx)
+	waitCtx, waitCancel := context.WithTimeout(ctx, time.Second*5)
+	defer waitCancel()
+	if err := serverProvider.WaitForSVID(waitCtx); err != nil {
+		t.Fatal(err)
+	}
+	if serverProvider.SpiffeID() != "spiffe://example.org/acra-server" {
+		t.Fatalf("Unexpected SPIFFE ID: %s", serverProvider.SpiffeID())
+	}
+
+	serverConfig, err := NewTLSConfig("", "", "", "", tls.RequireAndVerifyClientCert, NewCertVerifierAll())
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverProvider.Apply(serverConfig)
+	converter, err := NewDefaultHexIdentifierConverter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	handshake := func(clientSVID *x509SVID) ([]byte, error) {
+		clientProvider, err := NewSpiffeCredentialsProvider(socketPath, "example.org", []string{"spiffe://example.org/acra-server"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := clientProvider.update(&x509SVIDResponse{Svids: []*x509SVID{clientSVID}}); err != nil {
+			t.Fatal(err)
+		}
+		// server name isn't used by SPIFFE verification
+		clientConfig, err := NewTLSConfig("acra-server", "", "", "", tls.NoClientCert, NewCertVerifierAll())
+		if err != nil {
+			t.Fatal(err)
+		}
+		clientProvider.Apply(clientConfig)
+		wrapper, err := NewTLSAuthenticationConnectionWrapper(clientConfig, serverConfig, SpiffeIDExtractor{}, converter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// TCP instead of synchronous net.Pipe, so handshake messages and alerts written at the same time don't block
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer listener.Close()
+		clientConn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer clientConn.Close()
+		serverConn, err := listener.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer serverConn.Close()
+		clientErr := make(chan error, 1)
+		go func() {
+			conn, err := wrapper.WrapClient(context.Background(), clientConn)
+			if err == nil {
+				// wait for client ID check of server
+				conn.Read(make([]byte, 1))
+			}
+			clientErr <- err
+		}()
+		_, clientID, err := wrapper.WrapServer(context.Background(), serverConn)
+		serverConn.Close()
+		<-clientErr
+		return clientID, err
+	}
+
+	clientID, err := handshake(ca.svid(t, "spiffe://example.org/app", 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedClientID, err := converter.Convert([]byte("spiffe://example.org/app"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(clientID) != string(expectedClientID) {
+		t.Fatalf("Expected client ID of SPIFFE ID, took %s", clientID)
+	}
+	if _, err := handshake(ca.svid(t, "spiffe://example.org/other", 11)); err == nil {
+		t.Fatal("Expected error of handshake with SPIFFE ID missing in allowlist")
+	}
+	if _, err := handshake(newTestSpiffeCA(t).svid(t, "spiffe://example.org/app", 12)); err == nil {
+		t.Fatal("Expected error of handshake with SVID of foreign CA")
+	}
+
+	// rotated SVID is used by new connections
+	responses <- &x509SVIDResponse{Svids: []*x509SVID{ca.svid(t, "spiffe://example.org/acra-server", 3)}}
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		serverProvider.mutex.RLock()
+		serial := serverProvider.certificate.Leaf.SerialNumber.Int64()
+		serverProvider.mutex.RUnlock()
+		if serial == 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Rotated SVID wasn't applied")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	if _, err := handshake(ca.svid(t, "spiffe://example.org/app", 13)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSpiffeCredentialsProviderConfig(t *testing.T) {
+	invalid := []struct {
+		socket, trustDomain string
+		allowedIDs          []string
+	}{
+		{"", "example.org", nil},
+		{"/tmp/agent.sock", "", nil},
+		{"/tmp/agent.sock", "spiffe://example.org", nil},
+		{"/tmp/agent.sock", "example.org", []string{"spiffe://other.org/app"}},
+		{"/tmp/agent.sock", "example.org", []string{"https://example.org/app"}},
+	}
+	for i, testCase := range invalid {
+		if _, err := NewSpiffeCredentialsProvider(testCase.socket, testCase.trustDomain, testCase.allowedIDs); !errors.Is(err, ErrInvalidSpiffeConfig) {
+			t.Fatalf("[%d] Expected ErrInvalidSpiffeConfig, took %v", i, err)
+		}
+	}
+	provider, err := NewSpiffeCredentialsProvider("/tmp/agent.sock", "example.org", []string{" spiffe://example.org/app", ""})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := newTestSpiffeCA(t)
+	if err := provider.update(&x509SVIDResponse{}); err != ErrNoX509SVID {
+		t.Fatalf("Expected ErrNoX509SVID, took %v", err)
+	}
+	if err := provider.update(&x509SVIDResponse{Svids: []*x509SVID{ca.svid(t, "spiffe://other.org/app", 2)}}); !errors.Is(err, ErrInvalidX509SVID) {
+		t.Fatalf("Expected ErrInvalidX509SVID for foreign trust domain, took %v", err)
+	}
+	mismatched := ca.svid(t, "spiffe://example.org/app", 3)
+	mismatched.X509SvidKey = ca.svid(t, "spiffe://example.org/app", 4).X509SvidKey
+	if err := provider.update(&x509SVIDResponse{Svids: []*x509SVID{mismatched}}); !errors.Is(err, ErrInvalidX509SVID) {
+		t.Fatalf("Expected ErrInvalidX509SVID for mismatched key, took %v", err)
+	}
+}
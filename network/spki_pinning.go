@@ -0,0 +1,110 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package network
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Errors returned by SPKIPinVerifier
+var (
+	ErrInvalidConfigPinnedSPKI = errors.New("invalid `tls_pinned_spki` value")
+	ErrSPKIPinMismatch         = errors.New("certificate public key doesn't match any pinned SPKI hash")
+)
+
+// SPKIPinVerifier accepts only peers whose certificate has public key with SHA-256 hash of SubjectPublicKeyInfo from
+// pins. Unlike CA validation it keeps rejecting peers with certificates issued by compromised or misused CA.
+type SPKIPinVerifier struct {
+	pins       map[string]bool
+	matchChain bool
+}
+
+// spkiHash returns base64 SHA-256 of DER-encoded SubjectPublicKeyInfo of certificate, like
+// `openssl x509 -pubkey -noout | openssl pkey -pubin -outform der | openssl dgst -sha256 -binary | base64`
+func spkiHash(certificate *x509.Certificate) string {
+	hash := sha256.Sum256(certificate.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+// NewSPKIPinVerifier creates SPKIPinVerifier with base64 SHA-256 SPKI hashes. If matchChain is true, the peer is
+// accepted if any certificate of verified chain matches a pin. Otherwise only leaf certificate is matched.
+func NewSPKIPinVerifier(pins []string, matchChain bool) (*SPKIPinVerifier, error) {
+	verifier := &SPKIPinVerifier{pins: make(map[string]bool, len(pins)), matchChain: matchChain}
+	for _, pin := range pins {
+		pin = strings.TrimSpace(pin)
+		if pin == "" {
+			continue
+		}
+		if decoded, err := base64.StdEncoding.DecodeString(pin); err != nil || len(decoded) != sha256.Size {
+			return nil, fmt.Errorf("%w: '%s' isn't base64 SHA-256 hash", ErrInvalidConfigPinnedSPKI, pin)
+		}
+		verifier.pins[pin] = true
+	}
+	if len(verifier.pins) == 0 {
+		return nil, fmt.Errorf("%w: no pins", ErrInvalidConfigPinnedSPKI)
+	}
+	return verifier, nil
+}
+
+// NewPinnedCertVerifier returns verifier which checks comma-separated SPKI pins before certVerifier, or certVerifier
+// itself if pins are empty. Pins are checked regardless of how certVerifier combines results of its verifiers.
+func NewPinnedCertVerifier(pins string, matchChain bool, certVerifier CertVerifier) (CertVerifier, error) {
+	if strings.TrimSpace(pins) == "" {
+		return certVerifier, nil
+	}
+	pinVerifier, err := NewSPKIPinVerifier(strings.Split(pins, ","), matchChain)
+	if err != nil {
+		return nil, err
+	}
+	return NewCertVerifierAll(pinVerifier, certVerifier), nil
+}
+
+// Verify accepts the peer if its leaf certificate or, with matchChain, any certificate of verified chains has pinned
+// public key. Certificates sent by peer which aren't part of verified chain aren't matched because anyone may send
+// them.
+func (v *SPKIPinVerifier) Verify(ctx context.Context, rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return ErrEmptyCertChain
+	}
+	leaf, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return err
+	}
+	leafHash := spkiHash(leaf)
+	if v.pins[leafHash] {
+		return nil
+	}
+	if v.matchChain {
+		for _, chain := range verifiedChains {
+			for _, certificate := range chain {
+				if v.pins[spkiHash(certificate)] {
+					return nil
+				}
+			}
+		}
+	}
+	log.WithField("spki_sha256", leafHash).Warnln("Certificate public key doesn't match pinned SPKI hashes")
+	return ErrSPKIPinMismatch
+}
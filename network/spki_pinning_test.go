@@ -0,0 +1,120 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package network
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"testing"
+)
+
+// getDERTestChain returns chain of getValidTestChain3 with DER-encoded raw certificates like in TLS handshakes
+func getDERTestChain(t *testing.T) ([][]byte, [][]*x509.Certificate) {
+	_, verifiedChains := getValidTestChain3(t)
+	var rawCerts [][]byte
+	for _, certificate := range verifiedChains[0] {
+		rawCerts = append(rawCerts, certificate.Raw)
+	}
+	return rawCerts, verifiedChains
+}
+
+func TestSPKIPinVerifier(t *testing.T) {
+	rawCerts, verifiedChains := getDERTestChain(t)
+	chain := verifiedChains[0]
+	leafPin := spkiHash(chain[0])
+	caPin := spkiHash(chain[len(chain)-1])
+
+	leafVerifier, err := NewSPKIPinVerifier([]string{" " + leafPin, ""}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := leafVerifier.Verify(context.Background(), rawCerts, verifiedChains); err != nil {
+		t.Fatal(err)
+	}
+	if err := leafVerifier.Verify(context.Background(), nil, nil); err != ErrEmptyCertChain {
+		t.Fatalf("Expected ErrEmptyCertChain, took %v", err)
+	}
+
+	caVerifier, err := NewSPKIPinVerifier([]string{caPin}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := caVerifier.Verify(context.Background(), rawCerts, verifiedChains); err != ErrSPKIPinMismatch {
+		t.Fatalf("Expected ErrSPKIPinMismatch for CA pin in leaf mode, took %v", err)
+	}
+	chainVerifier, err := NewSPKIPinVerifier([]string{caPin}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := chainVerifier.Verify(context.Background(), rawCerts, verifiedChains); err != nil {
+		t.Fatal(err)
+	}
+	// CA certificate sent by peer without verified chain proves nothing
+	if err := chainVerifier.Verify(context.Background(), rawCerts, nil); err != ErrSPKIPinMismatch {
+		t.Fatalf("Expected ErrSPKIPinMismatch without verified chains, took %v", err)
+	}
+
+	for _, pins := range [][]string{nil, {""}, {"not base64"}, {"YWJjZA=="}} {
+		if _, err := NewSPKIPinVerifier(pins, false); !errors.Is(err, ErrInvalidConfigPinnedSPKI) {
+			t.Fatalf("Expected ErrInvalidConfigPinnedSPKI for %v, took %v", pins, err)
+		}
+	}
+}
+
+func TestNewPinnedCertVerifier(t *testing.T) {
+	rawCerts, verifiedChains := getDERTestChain(t)
+	accepting := &testCertVerifier{}
+	verifier, err := NewPinnedCertVerifier(" ", false, accepting)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if verifier != CertVerifier(accepting) {
+		t.Fatal("Expected verifier without pins to be returned as is")
+	}
+
+	// mismatched pin rejects peer even if verifiers combined in "any" mode accept it
+	composite, err := NewCompositeVerifier(CertVerifierModeAny)
+	if err != nil {
+		t.Fatal(err)
+	}
+	composite.Add("test", accepting)
+	otherPin := spkiHash(verifiedChains[0][1])
+	verifier, err = NewPinnedCertVerifier(otherPin, false, composite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verifier.Verify(context.Background(), rawCerts, verifiedChains); err != ErrSPKIPinMismatch {
+		t.Fatalf("Expected ErrSPKIPinMismatch, took %v", err)
+	}
+	if accepting.calls != 0 {
+		t.Fatal("Verifiers ran after pin mismatch")
+	}
+	verifier, err = NewPinnedCertVerifier(otherPin+","+spkiHash(verifiedChains[0][0]), false, composite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verifier.Verify(context.Background(), rawCerts, verifiedChains); err != nil {
+		t.Fatal(err)
+	}
+	if accepting.calls != 1 {
+		t.Fatal("Verifiers didn't run after pin match")
+	}
+	if _, err := NewPinnedCertVerifier("abcd", false, composite); !errors.Is(err, ErrInvalidConfigPinnedSPKI) {
+		t.Fatalf("Expected ErrInvalidConfigPinnedSPKI, took %v", err)
+	}
+}
@@ -0,0 +1,206 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package network
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Default settings of SRV records resolution
+const (
+	DefaultSRVRefreshInterval = time.Second * 30
+	DefaultSRVDrainTimeout    = time.Second * 10
+)
+
+// ErrNoSRVTargets returned when SRV record doesn't have any targets
+var ErrNoSRVTargets = errors.New("SRV record has no targets")
+
+// srvLookupFunc has signature of net.LookupSRV
+type srvLookupFunc func(service, proto, name string) (string, []*net.SRV, error)
+
+// SRVResolver resolves service address from DNS SRV record, periodically re-resolves it and drains connections
+// to targets removed from the record.
+type SRVResolver struct {
+	name             string
+	refreshInterval  time.Duration
+	drainTimeout     time.Duration
+	lookup           srvLookupFunc
+	lock             sync.Mutex
+	targets          []*net.SRV
+	connections      map[string]*ConnectionManager
+	drainConnections func(address string, manager *ConnectionManager)
+}
+
+// NewSRVResolver returns SRVResolver for full SRV record name like "_postgresql._tcp.db.example.com"
+func NewSRVResolver(name string, refreshInterval, drainTimeout time.Duration) (*SRVResolver, error) {
+	if name == "" {
+		return nil, errors.New("empty SRV record name")
+	}
+	resolver := &SRVResolver{
+		name:            name,
+		refreshInterval: refreshInterval,
+		drainTimeout:    drainTimeout,
+		lookup:          net.LookupSRV,
+		connections:     make(map[string]*ConnectionManager),
+	}
+	resolver.drainConnections = resolver.drainAfterTimeout
+	return resolver, nil
+}
+
+// Name returns SRV record name
+func (resolver *SRVResolver) Name() string {
+	return resolver.name
+}
+
+// Resolve looks up SRV record and updates list of targets, connections to removed targets are drained
+func (resolver *SRVResolver) Resolve() error {
+	_, targets, err := resolver.lookup("", "", resolver.name)
+	if err != nil {
+		return err
+	}
+	if len(targets) == 0 {
+		return ErrNoSRVTargets
+	}
+	// lookup returns records sorted by priority and randomized by weight, keep own stable order instead
+	sort.Slice(targets, func(i, j int) bool {
+		if targets[i].Priority != targets[j].Priority {
+			return targets[i].Priority < targets[j].Priority
+		}
+		return srvTargetAddress(targets[i]) < srvTargetAddress(targets[j])
+	})
+	current := make(map[string]struct{}, len(targets))
+	for _, target := range targets {
+		current[srvTargetAddress(target)] = struct{}{}
+	}
+
+	resolver.lock.Lock()
+	resolver.targets = targets
+	removed := make(map[string]*ConnectionManager)
+	for address, manager := range resolver.connections {
+		if _, ok := current[address]; !ok {
+			removed[address] = manager
+			delete(resolver.connections, address)
+		}
+	}
+	resolver.lock.Unlock()
+
+	for address, manager := range removed {
+		log.WithField("address", address).WithField("srv", resolver.name).Infoln("Target removed from SRV record, draining connections")
+		resolver.drainConnections(address, manager)
+	}
+	return nil
+}
+
+// drainAfterTimeout closes connections that are still open after drain timeout
+func (resolver *SRVResolver) drainAfterTimeout(address string, manager *ConnectionManager) {
+	go func() {
+		<-time.After(resolver.drainTimeout)
+		if err := manager.CloseConnections(); err != nil {
+			log.WithError(err).WithField("address", address).Warningln("Can't close drained connections")
+		}
+	}()
+}
+
+// Run re-resolves SRV record every refresh interval until ctx is done
+func (resolver *SRVResolver) Run(ctx context.Context) {
+	ticker := time.NewTicker(resolver.refreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := resolver.Resolve(); err != nil {
+				log.WithError(err).WithField("srv", resolver.name).Warningln("Can't re-resolve SRV record, keep using previous targets")
+			}
+		}
+	}
+}
+
+// Address returns "host:port" of target with the lowest priority value, selected randomly according to weights
+func (resolver *SRVResolver) Address() (string, error) {
+	resolver.lock.Lock()
+	defer resolver.lock.Unlock()
+	if len(resolver.targets) == 0 {
+		return "", ErrNoSRVTargets
+	}
+	priority := resolver.targets[0].Priority
+	var candidates []*net.SRV
+	totalWeight := 0
+	for _, target := range resolver.targets {
+		if target.Priority != priority {
+			break
+		}
+		candidates = append(candidates, target)
+		totalWeight += int(target.Weight)
+	}
+	if totalWeight == 0 {
+		return srvTargetAddress(candidates[rand.Intn(len(candidates))]), nil
+	}
+	value := rand.Intn(totalWeight)
+	for _, target := range candidates {
+		value -= int(target.Weight)
+		if value < 0 {
+			return srvTargetAddress(target), nil
+		}
+	}
+	return srvTargetAddress(candidates[len(candidates)-1]), nil
+}
+
+// TrackConnection registers connection to address so it will be drained if address disappears from SRV record.
+// Returned connection removes itself from tracking on Close.
+func (resolver *SRVResolver) TrackConnection(address string, conn net.Conn) net.Conn {
+	resolver.lock.Lock()
+	manager, ok := resolver.connections[address]
+	if !ok {
+		manager = NewConnectionManager()
+		resolver.connections[address] = manager
+	}
+	resolver.lock.Unlock()
+	manager.AddConnection(conn)
+	return &trackedConnection{Conn: conn, manager: manager}
+}
+
+// trackedConnection removes itself from ConnectionManager on first Close
+type trackedConnection struct {
+	net.Conn
+	manager *ConnectionManager
+	once    sync.Once
+}
+
+// Close connection and stop tracking it
+func (conn *trackedConnection) Close() error {
+	conn.once.Do(func() {
+		conn.manager.RemoveConnection(conn.Conn)
+	})
+	return conn.Conn.Close()
+}
+
+// srvTargetAddress returns "host:port" of SRV target without trailing dot of FQDN
+func srvTargetAddress(target *net.SRV) string {
+	return net.JoinHostPort(strings.TrimSuffix(target.Target, "."), strconv.Itoa(int(target.Port)))
+}
@@ -0,0 +1,114 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package network
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSRVResolverAddress(t *testing.T) {
+	resolver, err := NewSRVResolver("_postgresql._tcp.db.example.com", time.Second, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := resolver.Address(); err != ErrNoSRVTargets {
+		t.Fatalf("Expected %s before resolution, took %v", ErrNoSRVTargets, err)
+	}
+	resolver.lookup = func(service, proto, name string) (string, []*net.SRV, error) {
+		return "", []*net.SRV{
+			{Target: "backup.example.com.", Port: 5432, Priority: 20, Weight: 100},
+			{Target: "primary.example.com.", Port: 5433, Priority: 10, Weight: 0},
+		}, nil
+	}
+	if err := resolver.Resolve(); err != nil {
+		t.Fatal(err)
+	}
+	// target with the lowest priority value must be used
+	for i := 0; i < 10; i++ {
+		address, err := resolver.Address()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if address != "primary.example.com:5433" {
+			t.Fatalf("Unexpected address %s", address)
+		}
+	}
+
+	resolver.lookup = func(service, proto, name string) (string, []*net.SRV, error) {
+		return "", nil, errors.New("lookup error")
+	}
+	if err := resolver.Resolve(); err == nil {
+		t.Fatal("Expected lookup error")
+	}
+	// previous targets are kept on error
+	if address, err := resolver.Address(); err != nil || address != "primary.example.com:5433" {
+		t.Fatalf("Unexpected address %s, error %v", address, err)
+	}
+}
+
+func TestSRVResolverDrainRemovedTargets(t *testing.T) {
+	resolver, err := NewSRVResolver("_mysql._tcp.db.example.com", time.Second, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	targets := []*net.SRV{
+		{Target: "first.example.com.", Port: 3306},
+		{Target: "second.example.com.", Port: 3306},
+	}
+	resolver.lookup = func(service, proto, name string) (string, []*net.SRV, error) {
+		return "", targets, nil
+	}
+	drained := make(map[string]*ConnectionManager)
+	resolver.drainConnections = func(address string, manager *ConnectionManager) {
+		drained[address] = manager
+	}
+	if err := resolver.Resolve(); err != nil {
+		t.Fatal(err)
+	}
+
+	firstClient, firstServer := net.Pipe()
+	defer firstServer.Close()
+	firstConn := resolver.TrackConnection("first.example.com:3306", firstClient)
+	secondClient, secondServer := net.Pipe()
+	defer secondServer.Close()
+	secondConn := resolver.TrackConnection("second.example.com:3306", secondClient)
+	defer secondConn.Close()
+
+	targets = targets[1:]
+	if err := resolver.Resolve(); err != nil {
+		t.Fatal(err)
+	}
+	if len(drained) != 1 {
+		t.Fatalf("Expected to drain one target, drained %v", drained)
+	}
+	manager, ok := drained["first.example.com:3306"]
+	if !ok {
+		t.Fatalf("Removed target wasn't drained, drained %v", drained)
+	}
+	if manager.Counter != 1 {
+		t.Fatalf("Expected one tracked connection, took %d", manager.Counter)
+	}
+	if err := firstConn.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if manager.Counter != 0 {
+		t.Fatalf("Closed connection should be untracked, took %d", manager.Counter)
+	}
+}
@@ -11,13 +11,23 @@ import (
 // Set of constants with
 const (
 	IdentifierExtractorTypeDistinguishedName = "distinguished_name"
+	IdentifierExtractorTypeCommonName        = "common_name"
+	IdentifierExtractorTypeSANDNS            = "san_dns"
+	IdentifierExtractorTypeSANURI            = "san_uri"
 	IdentifierExtractorTypeSerialNumber      = "serial_number"
+	IdentifierExtractorTypeFingerprint       = "fingerprint"
+	IdentifierExtractorTypeSpiffeID          = "spiffe_id"
 )
 
 // IdentifierExtractorTypesList list of all acceptable types for IdentifierExtractor
 var IdentifierExtractorTypesList = []string{
 	IdentifierExtractorTypeDistinguishedName,
+	IdentifierExtractorTypeCommonName,
+	IdentifierExtractorTypeSANDNS,
+	IdentifierExtractorTypeSANURI,
 	IdentifierExtractorTypeSerialNumber,
+	IdentifierExtractorTypeFingerprint,
+	IdentifierExtractorTypeSpiffeID,
 }
 
 // ErrInvalidIdentifierExtractorType return when used invalid value of identifier extractor type
@@ -28,8 +38,18 @@ func NewIdentifierExtractorByType(extractorType string) (CertificateIdentifierEx
 	switch extractorType {
 	case IdentifierExtractorTypeDistinguishedName:
 		return DistinguishedNameExtractor{}, nil
+	case IdentifierExtractorTypeCommonName:
+		return CommonNameExtractor{}, nil
+	case IdentifierExtractorTypeSANDNS:
+		return SANDNSExtractor{}, nil
+	case IdentifierExtractorTypeSANURI:
+		return SANURIExtractor{}, nil
 	case IdentifierExtractorTypeSerialNumber:
 		return SerialNumberExtractor{}, nil
+	case IdentifierExtractorTypeFingerprint:
+		return FingerprintExtractor{}, nil
+	case IdentifierExtractorTypeSpiffeID:
+		return SpiffeIDExtractor{}, nil
 	default:
 		return nil, ErrInvalidIdentifierExtractorType
 	}
@@ -56,6 +76,63 @@ func (e DistinguishedNameExtractor) GetCertificateIdentifier(certificate *x509.C
 	return id, nil
 }
 
+// CommonNameExtractor implementation for CertificateIdentifierExtractor interface, which return CommonName of Subject as client's identifier
+type CommonNameExtractor struct{}
+
+// GetCertificateIdentifier return CN attribute of Subject as client's identifier
+func (e CommonNameExtractor) GetCertificateIdentifier(certificate *x509.Certificate) ([]byte, error) {
+	if certificate == nil {
+		return nil, ErrNoPeerCertificate
+	}
+	if certificate.Subject.CommonName == "" {
+		return nil, ErrEmptyIdentifier
+	}
+	return []byte(certificate.Subject.CommonName), nil
+}
+
+// SANDNSExtractor implementation for CertificateIdentifierExtractor interface, which return DNS name from SubjectAltName as client's identifier
+type SANDNSExtractor struct{}
+
+// GetCertificateIdentifier return first DNS name of SubjectAltName extension as client's identifier
+func (e SANDNSExtractor) GetCertificateIdentifier(certificate *x509.Certificate) ([]byte, error) {
+	if certificate == nil {
+		return nil, ErrNoPeerCertificate
+	}
+	if len(certificate.DNSNames) == 0 || certificate.DNSNames[0] == "" {
+		return nil, ErrEmptyIdentifier
+	}
+	return []byte(certificate.DNSNames[0]), nil
+}
+
+// SANURIExtractor implementation for CertificateIdentifierExtractor interface, which return URI from SubjectAltName as client's identifier
+type SANURIExtractor struct{}
+
+// GetCertificateIdentifier return first URI of SubjectAltName extension as client's identifier
+func (e SANURIExtractor) GetCertificateIdentifier(certificate *x509.Certificate) ([]byte, error) {
+	if certificate == nil {
+		return nil, ErrNoPeerCertificate
+	}
+	if len(certificate.URIs) == 0 || certificate.URIs[0] == nil {
+		return nil, ErrEmptyIdentifier
+	}
+	return []byte(certificate.URIs[0].String()), nil
+}
+
+// FingerprintExtractor implementation for CertificateIdentifierExtractor interface, which return fingerprint of certificate as client's identifier
+type FingerprintExtractor struct{}
+
+// GetCertificateIdentifier return hex SHA-256 of DER-encoded certificate as client's identifier, like in
+// `openssl x509 -in client.crt -noout -fingerprint -sha256` output without colons in lower case
+func (e FingerprintExtractor) GetCertificateIdentifier(certificate *x509.Certificate) ([]byte, error) {
+	if certificate == nil {
+		return nil, ErrNoPeerCertificate
+	}
+	if len(certificate.Raw) == 0 {
+		return nil, ErrEmptyIdentifier
+	}
+	return []byte(certificateFingerprint(certificate.Raw)), nil
+}
+
 // SerialNumberExtractor implementation for CertificateIdentifierExtractor interface, which return SerialNumber of certificate as client's identifier
 type SerialNumberExtractor struct{}
 
@@ -70,6 +147,21 @@ func (e SerialNumberExtractor) GetCertificateIdentifier(certificate *x509.Certif
 	return certificate.SerialNumber.Bytes(), nil
 }
 
+// SpiffeIDExtractor implementation for CertificateIdentifierExtractor interface, which return SPIFFE ID of X.509 SVID as client's identifier
+type SpiffeIDExtractor struct{}
+
+// GetCertificateIdentifier return SPIFFE ID from URI SAN like spiffe://example.org/workload as client's identifier
+func (e SpiffeIDExtractor) GetCertificateIdentifier(certificate *x509.Certificate) ([]byte, error) {
+	if certificate == nil {
+		return nil, ErrNoPeerCertificate
+	}
+	id, err := certificateSpiffeID(certificate)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(id), nil
+}
+
 // ErrEmptyIdentifier used when passed empty identifier with zero length
 var ErrEmptyIdentifier = errors.New("empty identifier")
 
@@ -3,6 +3,7 @@ package network
 import (
 	"bytes"
 	"crypto/rand"
+	"crypto/sha256"
 	"crypto/sha512"
 	"crypto/x509"
 	"encoding/hex"
@@ -10,6 +11,7 @@ import (
 	"errors"
 	"hash"
 	"io/ioutil"
+	"net/url"
 	"os"
 	"path/filepath"
 	"testing"
@@ -113,6 +115,49 @@ func TestCommonNameExtractor_GetCertificateIdentifier(t *testing.T) {
 	}
 }
 
+func TestCertificateFieldExtractors(t *testing.T) {
+	certificate := getAcraWriterTestx509Certificate(t)
+	uri, err := url.Parse("spiffe://example.org/acra-writer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	withSAN := *certificate
+	withSAN.DNSNames = []string{"writer.example.org", "other.example.org"}
+	withSAN.URIs = []*url.URL{uri}
+	fingerprint := sha256.Sum256(certificate.Raw)
+	testCases := []struct {
+		extractorType string
+		expected      string
+	}{
+		{IdentifierExtractorTypeCommonName, certificate.Subject.CommonName},
+		{IdentifierExtractorTypeSANDNS, "writer.example.org"},
+		{IdentifierExtractorTypeSANURI, "spiffe://example.org/acra-writer"},
+		{IdentifierExtractorTypeFingerprint, hex.EncodeToString(fingerprint[:])},
+	}
+	for _, testCase := range testCases {
+		extractor, err := NewIdentifierExtractorByType(testCase.extractorType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := extractor.GetCertificateIdentifier(nil); err != ErrNoPeerCertificate {
+			t.Fatalf("[%s] Expected ErrNoPeerCertificate error, took %v", testCase.extractorType, err)
+		}
+		if _, err := extractor.GetCertificateIdentifier(&x509.Certificate{}); err != ErrEmptyIdentifier {
+			t.Fatalf("[%s] Expected ErrEmptyIdentifier error, took %v", testCase.extractorType, err)
+		}
+		identifier, err := extractor.GetCertificateIdentifier(&withSAN)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if testCase.expected == "" || string(identifier) != testCase.expected {
+			t.Fatalf("[%s] Expected identifier '%s', took '%s'", testCase.extractorType, testCase.expected, identifier)
+		}
+	}
+	if _, err := NewIdentifierExtractorByType("email"); err != ErrInvalidIdentifierExtractorType {
+		t.Fatalf("Expected ErrInvalidIdentifierExtractorType, took %v", err)
+	}
+}
+
 func TestValidateClientsAuthenticationCertificate(t *testing.T) {
 	if err := ValidateClientsAuthenticationCertificate(nil); err != ErrNoPeerCertificate {
 		t.Fatal("Not denied empty certificate")
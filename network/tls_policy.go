@@ -0,0 +1,165 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package network
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Names of TLS policy profiles
+const (
+	// TLSPolicyModern allows only TLS 1.3
+	TLSPolicyModern = "modern"
+	// TLSPolicyIntermediate allows TLS 1.2 with ECDHE AEAD cipher suites and TLS 1.3
+	TLSPolicyIntermediate = "intermediate"
+	// TLSPolicyFIPS allows only TLS 1.2 with ECDHE AES-GCM cipher suites on NIST curves
+	TLSPolicyFIPS = "fips"
+)
+
+// DefaultTLSPolicy is profile used if other one isn't configured
+const DefaultTLSPolicy = TLSPolicyIntermediate
+
+// Errors returned by TLS policy configuration
+var (
+	ErrUnknownTLSPolicy      = errors.New("unknown TLS policy profile")
+	ErrUnknownTLSVersion     = errors.New("unknown TLS version")
+	ErrUnknownTLSCipherSuite = errors.New("unknown TLS cipher suite")
+	ErrInvalidTLSVersions    = errors.New("min TLS version is greater than max TLS version")
+)
+
+// tlsVersions maps names accepted by tls_min_version/tls_max_version to versions
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsCipherSuites maps IANA names of cipher suites of TLS 1.0-1.2 to their ids, cipher suites of TLS 1.3 aren't
+// configurable in crypto/tls
+var tlsCipherSuites = map[string]uint16{
+	"TLS_RSA_WITH_AES_128_CBC_SHA":                  tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_RSA_WITH_AES_256_CBC_SHA":                  tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_RSA_WITH_AES_128_GCM_SHA256":               tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_RSA_WITH_AES_256_GCM_SHA384":               tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA":          tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA":          tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA":            tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA":            tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256":       tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384":       tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256": tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+	"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256":         tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384":         tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256":   tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+}
+
+// TLSPolicy is set of TLS versions, cipher suites and curves allowed in handshakes
+type TLSPolicy struct {
+	MinVersion uint16
+	MaxVersion uint16
+	// CipherSuites are used by TLS 1.0-1.2 handshakes, nil means default cipher suites of crypto/tls
+	CipherSuites []uint16
+	// CurvePreferences are used by ECDHE key exchange, nil means default curves of crypto/tls
+	CurvePreferences []tls.CurveID
+}
+
+// tlsPolicyProfiles are named policies selected by tls_policy
+var tlsPolicyProfiles = map[string]TLSPolicy{
+	TLSPolicyModern: {
+		MinVersion: tls.VersionTLS13,
+		MaxVersion: tls.VersionTLS13,
+	},
+	TLSPolicyIntermediate: {
+		MinVersion:   tls.VersionTLS12,
+		MaxVersion:   tls.VersionTLS13,
+		CipherSuites: allowedCipherSuits,
+	},
+	// TLS 1.3 isn't allowed because crypto/tls always enables CHACHA20_POLY1305 cipher suite for it
+	TLSPolicyFIPS: {
+		MinVersion: tls.VersionTLS12,
+		MaxVersion: tls.VersionTLS12,
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+		},
+		CurvePreferences: []tls.CurveID{tls.CurveP256, tls.CurveP384},
+	},
+}
+
+// NewTLSPolicy returns policy of profile (DefaultTLSPolicy if empty) with versions and comma-separated list of
+// cipher suites replaced by minVersion, maxVersion and cipherSuites if they are set
+func NewTLSPolicy(profile, minVersion, maxVersion, cipherSuites string) (*TLSPolicy, error) {
+	if profile == "" {
+		profile = DefaultTLSPolicy
+	}
+	policy, ok := tlsPolicyProfiles[strings.ToLower(profile)]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownTLSPolicy, profile)
+	}
+	var err error
+	if minVersion != "" {
+		if policy.MinVersion, err = parseTLSVersion(minVersion); err != nil {
+			return nil, err
+		}
+	}
+	if maxVersion != "" {
+		if policy.MaxVersion, err = parseTLSVersion(maxVersion); err != nil {
+			return nil, err
+		}
+	}
+	if policy.MinVersion > policy.MaxVersion {
+		return nil, ErrInvalidTLSVersions
+	}
+	if cipherSuites != "" {
+		policy.CipherSuites = nil
+		for _, name := range strings.Split(cipherSuites, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			id, ok := tlsCipherSuites[strings.ToUpper(name)]
+			if !ok {
+				return nil, fmt.Errorf("%w: %s", ErrUnknownTLSCipherSuite, name)
+			}
+			policy.CipherSuites = append(policy.CipherSuites, id)
+		}
+	}
+	return &policy, nil
+}
+
+// parseTLSVersion accepts versions like "1.2" or "TLS1.2"
+func parseTLSVersion(version string) (uint16, error) {
+	value, ok := tlsVersions[strings.TrimPrefix(strings.ToLower(strings.TrimSpace(version)), "tls")]
+	if !ok {
+		return 0, fmt.Errorf("%w: %s", ErrUnknownTLSVersion, version)
+	}
+	return value, nil
+}
+
+// Apply replaces versions, cipher suites and curves of config with ones of policy
+func (policy *TLSPolicy) Apply(config *tls.Config) {
+	config.MinVersion = policy.MinVersion
+	config.MaxVersion = policy.MaxVersion
+	config.CipherSuites = policy.CipherSuites
+	config.CurvePreferences = policy.CurvePreferences
+}
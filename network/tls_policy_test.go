@@ -0,0 +1,122 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package network
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestNewTLSPolicy(t *testing.T) {
+	policy, err := NewTLSPolicy("", "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if policy.MinVersion != tls.VersionTLS12 || policy.MaxVersion != tls.VersionTLS13 || len(policy.CipherSuites) != len(allowedCipherSuits) {
+		t.Fatalf("Expected intermediate policy by default, took %+v", policy)
+	}
+	policy, err = NewTLSPolicy("FIPS", "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if policy.MaxVersion != tls.VersionTLS12 || len(policy.CurvePreferences) != 2 {
+		t.Fatalf("Unexpected fips policy %+v", policy)
+	}
+	policy, err = NewTLSPolicy(TLSPolicyModern, "1.2", "tls1.3", " TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if policy.MinVersion != tls.VersionTLS12 || policy.MaxVersion != tls.VersionTLS13 ||
+		len(policy.CipherSuites) != 1 || policy.CipherSuites[0] != tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 {
+		t.Fatalf("Versions and cipher suites weren't overridden: %+v", policy)
+	}
+	// overrides don't change profiles
+	if policy, _ := NewTLSPolicy(TLSPolicyModern, "", "", ""); policy.MinVersion != tls.VersionTLS13 {
+		t.Fatal("Profile was changed")
+	}
+
+	testCases := []struct {
+		profile, minVersion, maxVersion, cipherSuites string
+		err                                           error
+	}{
+		{"old", "", "", "", ErrUnknownTLSPolicy},
+		{"", "1.4", "", "", ErrUnknownTLSVersion},
+		{"", "", "ssl3.0", "", ErrUnknownTLSVersion},
+		{"", "1.3", "1.2", "", ErrInvalidTLSVersions},
+		{"", "", "", "TLS_RSA_WITH_RC4_128_SHA", ErrUnknownTLSCipherSuite},
+	}
+	for _, testCase := range testCases {
+		if _, err := NewTLSPolicy(testCase.profile, testCase.minVersion, testCase.maxVersion, testCase.cipherSuites); !errors.Is(err, testCase.err) {
+			t.Fatalf("%+v: expected %v, took %v", testCase, testCase.err, err)
+		}
+	}
+}
+
+func TestTLSPolicyHandshake(t *testing.T) {
+	handshake := func(clientConfig, serverConfig *tls.Config) (uint16, error) {
+		clientConn, serverConn := net.Pipe()
+		defer clientConn.Close()
+		defer serverConn.Close()
+		server := tls.Server(serverConn, serverConfig)
+		result := make(chan error, 1)
+		go func() {
+			err := server.Handshake()
+			// unblock client waiting for server response
+			serverConn.Close()
+			result <- err
+		}()
+		client := tls.Client(clientConn, clientConfig)
+		clientErr := client.Handshake()
+		if err := <-result; err != nil {
+			return 0, err
+		}
+		if clientErr != nil {
+			return 0, clientErr
+		}
+		return client.ConnectionState().Version, nil
+	}
+	policies := map[string]uint16{TLSPolicyModern: tls.VersionTLS13, TLSPolicyIntermediate: tls.VersionTLS13, TLSPolicyFIPS: tls.VersionTLS12}
+	for profile, expectedVersion := range policies {
+		clientConfig, serverConfig := getTLSConfigs(t)
+		policy, err := NewTLSPolicy(profile, "", "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		policy.Apply(serverConfig)
+		version, err := handshake(clientConfig, serverConfig)
+		if err != nil {
+			t.Fatalf("%s: %v", profile, err)
+		}
+		if version != expectedVersion {
+			t.Fatalf("%s: expected version %x, took %x", profile, expectedVersion, version)
+		}
+	}
+
+	// clients without TLS 1.3 are rejected by modern policy
+	clientConfig, serverConfig := getTLSConfigs(t)
+	policy, err := NewTLSPolicy(TLSPolicyModern, "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy.Apply(serverConfig)
+	clientConfig.MaxVersion = tls.VersionTLS12
+	if _, err := handshake(clientConfig, serverConfig); err == nil {
+		t.Fatal("Expected handshake error")
+	}
+}
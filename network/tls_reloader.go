@@ -0,0 +1,195 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package network
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"os/signal"
+	"sync"
+	"time"
+
+	"github.com/cossacklabs/acra/logging"
+	log "github.com/sirupsen/logrus"
+)
+
+// tlsMaterial is CA certificates and own certificates loaded from files at once
+type tlsMaterial struct {
+	roots        *x509.CertPool
+	certificates []tls.Certificate
+}
+
+// tlsFileStamp is modification time and size of file used to detect its changes
+type tlsFileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// TLSReloadCallback is called with new certificate after successful reload, certificate is nil if reloader doesn't
+// load own certificate
+type TLSReloadCallback func(certificate *tls.Certificate)
+
+// TLSReloader reloads CA certificates, certificate and private key of tls.Config objects created by NewTLSConfig
+// from files without restart. Material is replaced atomically: new handshakes use the last successfully loaded
+// files, established connections keep certificates of their handshakes. Failed reloads keep previous material.
+type TLSReloader struct {
+	caPath, keyPath, crtPath string
+	mutex                    sync.RWMutex
+	material                 tlsMaterial
+	stamps                   map[string]tlsFileStamp
+	callbacks                []TLSReloadCallback
+}
+
+// NewTLSReloader returns TLSReloader of files with the same meaning as arguments of NewTLSConfig and loads them
+func NewTLSReloader(caPath, keyPath, crtPath string) (*TLSReloader, error) {
+	reloader := &TLSReloader{caPath: caPath, keyPath: keyPath, crtPath: crtPath}
+	if err := reloader.Reload(); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+// Apply makes new connections with config use material loaded by reloader. Config should be created by NewTLSConfig.
+func (reloader *TLSReloader) Apply(config *tls.Config) {
+	tlsConfigMaterials.Store(config, reloader)
+}
+
+// OnReload adds callback called after each successful reload
+func (reloader *TLSReloader) OnReload(callback TLSReloadCallback) {
+	reloader.mutex.Lock()
+	reloader.callbacks = append(reloader.callbacks, callback)
+	reloader.mutex.Unlock()
+}
+
+// paths returns set paths of reloaded files
+func (reloader *TLSReloader) paths() []string {
+	var paths []string
+	for _, path := range []string{reloader.caPath, reloader.keyPath, reloader.crtPath} {
+		if path != "" {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// fileStamps returns stamps of reloaded files, missing files have zero stamps
+func (reloader *TLSReloader) fileStamps() map[string]tlsFileStamp {
+	stamps := make(map[string]tlsFileStamp)
+	for _, path := range reloader.paths() {
+		// os.Stat follows symlinks, so updates of Kubernetes secrets with atomic swap of symlinks are detected too
+		if info, err := os.Stat(path); err == nil {
+			stamps[path] = tlsFileStamp{modTime: info.ModTime(), size: info.Size()}
+		}
+	}
+	return stamps
+}
+
+// Reload loads files and replaces material used by new connections
+func (reloader *TLSReloader) Reload() error {
+	stamps := reloader.fileStamps()
+	roots, certificates, err := loadTLSMaterial(reloader.caPath, reloader.keyPath, reloader.crtPath)
+	reloader.mutex.Lock()
+	// stamps are updated even after failure, so files are reloaded on next change instead of every check
+	reloader.stamps = stamps
+	if err != nil {
+		reloader.mutex.Unlock()
+		return err
+	}
+	reloader.material = tlsMaterial{roots: roots, certificates: certificates}
+	callbacks := reloader.callbacks
+	reloader.mutex.Unlock()
+
+	var certificate *tls.Certificate
+	if len(certificates) > 0 {
+		certificate = &certificates[0]
+	}
+	for _, callback := range callbacks {
+		callback(certificate)
+	}
+	log.WithField("paths", reloader.paths()).Debugln("TLS: certificates reloaded")
+	return nil
+}
+
+// ReloadIfChanged reloads files if modification time or size of any of them changed since last reload and returns
+// true if reload was attempted
+func (reloader *TLSReloader) ReloadIfChanged() (bool, error) {
+	stamps := reloader.fileStamps()
+	reloader.mutex.RLock()
+	changed := len(stamps) != len(reloader.stamps)
+	for path, stamp := range stamps {
+		if previous, ok := reloader.stamps[path]; !ok || !previous.modTime.Equal(stamp.modTime) || previous.size != stamp.size {
+			changed = true
+		}
+	}
+	reloader.mutex.RUnlock()
+	if !changed {
+		return false, nil
+	}
+	return true, reloader.Reload()
+}
+
+// applyMaterial sets last loaded material to config of connection. Own certificates aren't set if config gets them
+// with GetCertificate, e.g. from OCSPStapler which should be updated with OnReload.
+func (reloader *TLSReloader) applyMaterial(config *tls.Config) {
+	reloader.mutex.RLock()
+	material := reloader.material
+	reloader.mutex.RUnlock()
+	config.RootCAs = material.roots
+	config.ClientCAs = material.roots
+	if config.GetCertificate == nil {
+		config.Certificates = material.certificates
+	}
+}
+
+// Run checks files for changes every interval (if it's greater than zero) and reloads them on changes and when any
+// of signals is received, until ctx is done
+func (reloader *TLSReloader) Run(ctx context.Context, interval time.Duration, signals ...os.Signal) {
+	var ticks <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		ticks = ticker.C
+	}
+	signalCh := make(chan os.Signal, 1)
+	if len(signals) > 0 {
+		signal.Notify(signalCh, signals...)
+		defer signal.Stop(signalCh)
+	}
+	logger := log.WithField("paths", reloader.paths())
+	for {
+		var err error
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticks:
+			var reloaded bool
+			if reloaded, err = reloader.ReloadIfChanged(); reloaded && err == nil {
+				logger.Infoln("TLS: certificates changed and reloaded")
+			}
+		case sig := <-signalCh:
+			if err = reloader.Reload(); err == nil {
+				logger.WithField("signal", sig.String()).Infoln("TLS: certificates reloaded by signal")
+			}
+		}
+		if err != nil {
+			logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorNetworkTLSGeneral).
+				Errorln("TLS: can't reload certificates, previous ones are used")
+		}
+	}
+}
@@ -0,0 +1,165 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package network
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestTLSFiles writes CA, leaf certificate and private key of certificate to files with modification time mtime
+func writeTestTLSFiles(t *testing.T, certificate tls.Certificate, caPath, keyPath, crtPath string, mtime time.Time) {
+	keyDER, err := x509.MarshalECPrivateKey(certificate.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{
+		caPath:  pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate.Certificate[1]}),
+		keyPath: pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+		crtPath: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate.Certificate[0]}),
+	}
+	for path, data := range files {
+		if err := ioutil.WriteFile(path, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// testReloadedHandshake returns leaf certificate of server after handshake with configs
+func testReloadedHandshake(t *testing.T, serverConfig, clientConfig *tls.Config) ([]byte, error) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- tls.Server(serverConn, serverConfig).Handshake()
+		serverConn.Close()
+	}()
+	client := tls.Client(clientConn, configWithContext(context.Background(), clientConfig))
+	err := client.Handshake()
+	clientConn.Close()
+	<-serverErr
+	if err != nil {
+		return nil, err
+	}
+	return client.ConnectionState().PeerCertificates[0].Raw, nil
+}
+
+func TestTLSReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls_reloader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	caPath, keyPath, crtPath := filepath.Join(dir, "ca.crt"), filepath.Join(dir, "server.key"), filepath.Join(dir, "server.crt")
+	mtime := time.Now().Add(-time.Hour)
+	oldCertificate := getTestStaplingCertificate(t, nil)
+	writeTestTLSFiles(t, oldCertificate, caPath, keyPath, crtPath, mtime)
+
+	serverConfig, err := NewTLSConfig("", "", keyPath, crtPath, tls.NoClientCert, NewCertVerifierAll())
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientConfig, err := NewTLSConfig("acra-server", caPath, "", "", tls.NoClientCert, NewCertVerifierAll())
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverReloader, err := NewTLSReloader("", keyPath, crtPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverReloader.Apply(serverConfig)
+	clientReloader, err := NewTLSReloader(caPath, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientReloader.Apply(clientConfig)
+	var reloadedCertificate *tls.Certificate
+	serverReloader.OnReload(func(certificate *tls.Certificate) {
+		reloadedCertificate = certificate
+	})
+
+	leaf, err := testReloadedHandshake(t, serverConfig, clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(leaf, oldCertificate.Certificate[0]) {
+		t.Fatal("Server used unexpected certificate")
+	}
+	if reloaded, err := serverReloader.ReloadIfChanged(); reloaded || err != nil {
+		t.Fatalf("Unchanged files were reloaded, err: %v", err)
+	}
+
+	// certificate issued by another CA, so client trusts it only after reload of CA file
+	newCertificate := getTestStaplingCertificate(t, nil)
+	mtime = mtime.Add(time.Minute)
+	writeTestTLSFiles(t, newCertificate, caPath, keyPath, crtPath, mtime)
+	if reloaded, err := serverReloader.ReloadIfChanged(); !reloaded || err != nil {
+		t.Fatalf("Changed files weren't reloaded, err: %v", err)
+	}
+	if reloadedCertificate == nil || !bytes.Equal(reloadedCertificate.Certificate[0], newCertificate.Certificate[0]) {
+		t.Fatal("Callback didn't get reloaded certificate")
+	}
+	if _, err := testReloadedHandshake(t, serverConfig, clientConfig); err == nil {
+		t.Fatal("Expected error of handshake with certificate of unknown CA")
+	}
+	if reloaded, err := clientReloader.ReloadIfChanged(); !reloaded || err != nil {
+		t.Fatalf("Changed CA file wasn't reloaded, err: %v", err)
+	}
+	leaf, err = testReloadedHandshake(t, serverConfig, clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(leaf, newCertificate.Certificate[0]) {
+		t.Fatal("Server didn't use reloaded certificate")
+	}
+
+	// broken files don't replace loaded certificates and aren't reloaded again until they change
+	mtime = mtime.Add(time.Minute)
+	if err := ioutil.WriteFile(crtPath, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(crtPath, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	if reloaded, err := serverReloader.ReloadIfChanged(); !reloaded || err == nil {
+		t.Fatal("Expected error of reload of broken certificate")
+	}
+	if reloaded, _ := serverReloader.ReloadIfChanged(); reloaded {
+		t.Fatal("Broken certificate was reloaded without changes")
+	}
+	leaf, err = testReloadedHandshake(t, serverConfig, clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(leaf, newCertificate.Certificate[0]) {
+		t.Fatal("Server didn't keep previous certificate")
+	}
+}
@@ -28,6 +28,7 @@ import (
 	"io/ioutil"
 	"net"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -63,25 +64,56 @@ var (
 	tlsOcspRequired                 string
 	tlsOcspFromCert                 string
 	tlsOcspCheckOnlyLeafCertificate bool
+	tlsOcspQueryTimeout             uint
+	tlsOcspVerifyTimeout            uint
+	tlsOcspClientTimeout            uint
+	tlsOcspHTTPProxy                string
+	tlsOcspCABundle                 string
+	tlsOcspRetryCount               uint
+	tlsOcspForcePOST                bool
+	tlsOcspNonce                    string
+	tlsOcspClockSkew                uint
+	tlsVerifiers                    string
+	tlsVerifiersMode                string
+	tlsCertAllowlistFile            string
+	tlsVerifierScript               string
 	tlsCrlURL                       string
 	tlsCrlFromCert                  string
 	tlsCrlCheckOnlyLeafCertificate  bool
 	tlsCrlCacheSize                 uint
 	tlsCrlCacheTime                 uint
+	tlsPinnedSPKI                   string
+	tlsPinnedSPKIMatchChain         bool
+	tlsVerifyLatencyBudget          uint
+	tlsVerifyDeferredTimeout        uint
 )
 
-// RegisterTLSBaseArgs register CLI args tls_ca|tls_key|tls_cert|tls_auth|tls_ocsp_url|tls_ocsp_required|tls_ocsp_from_cert|tls_ocsp_check_only_leaf_certificate|tls_crl_url|tls_crl_from_cert|tls_crl_check_only_leaf_certificate|tls_crl_cache_size|tls_crl_cache_time which allow to get tls.Config by NewTLSConfigFromBaseArgs function
+// RegisterTLSBaseArgs register CLI args tls_ca|tls_key|tls_cert|tls_auth|tls_ocsp_url|tls_ocsp_required|tls_ocsp_from_cert|tls_ocsp_check_only_leaf_certificate|tls_ocsp_query_timeout|tls_ocsp_verify_timeout|tls_ocsp_client_timeout|tls_ocsp_http_proxy|tls_ocsp_ca_bundle|tls_ocsp_retry_count|tls_ocsp_force_post|tls_ocsp_nonce|tls_ocsp_clock_skew|tls_verifiers|tls_verifiers_mode|tls_cert_allowlist_file|tls_verifier_script|tls_crl_url|tls_crl_from_cert|tls_crl_check_only_leaf_certificate|tls_crl_cache_size|tls_crl_cache_time|tls_pinned_spki|tls_pinned_spki_match_chain|tls_verify_latency_budget|tls_verify_deferred_timeout which allow to get tls.Config by NewTLSConfigFromBaseArgs function
 func RegisterTLSBaseArgs() {
 	flag.StringVar(&tlsCA, "tls_ca", "", "Path to root certificate which will be used with system root certificates to validate peer's certificate")
 	flag.StringVar(&tlsKey, "tls_key", "", "Path to private key that will be used for TLS connections")
 	flag.StringVar(&tlsCert, "tls_cert", "", "Path to certificate")
 	flag.IntVar(&tlsAuthType, "tls_auth", int(tls.RequireAndVerifyClientCert), "Set authentication mode that will be used in TLS connection. Values in range 0-4 that set auth type (https://golang.org/pkg/crypto/tls/#ClientAuthType). Default is tls.RequireAndVerifyClientCert")
-	flag.StringVar(&tlsOcspURL, "tls_ocsp_url", "", "OCSP service URL")
+	flag.StringVar(&tlsOcspURL, "tls_ocsp_url", "", "OCSP service URL. Comma-separated list of responders <url>[;priority=<number>][;role=required|advisory] is accepted: responders with greater priority are backups queried only if previous ones didn't respond, advisory responders can only deny revoked certificates, required ones should know the certificate")
 	flag.StringVar(&tlsOcspRequired, "tls_ocsp_required", OcspRequiredDenyUnknownStr,
 		fmt.Sprintf("How to treat certificates unknown to OCSP: <%s>", strings.Join(OcspRequiredValuesList, "|")))
 	flag.StringVar(&tlsOcspFromCert, "tls_ocsp_from_cert", OcspFromCertPreferStr,
 		fmt.Sprintf("How to treat OCSP server described in certificate itself: <%s>", strings.Join(OcspFromCertValuesList, "|")))
 	flag.BoolVar(&tlsOcspCheckOnlyLeafCertificate, "tls_ocsp_check_only_leaf_certificate", false, "Put 'true' to check only final/last certificate, or 'false' to check the whole certificate chain using OCSP")
+	flag.UintVar(&tlsOcspQueryTimeout, "tls_ocsp_query_timeout", uint(OcspHttpClientDefaultTimeout/time.Second), "Timeout of each OCSP query, in seconds")
+	flag.UintVar(&tlsOcspVerifyTimeout, "tls_ocsp_verify_timeout", uint(OcspDefaultVerifyTimeout/time.Second), "Deadline of all OCSP queries made to verify certificate chain, in seconds. Servers that don't respond in time are treated as unavailable")
+	flag.UintVar(&tlsOcspClientTimeout, "tls_ocsp_client_timeout", uint(OcspHttpClientDefaultTimeout/time.Second), "Timeout of each HTTP request to OCSP server including connection, in seconds")
+	flag.StringVar(&tlsOcspHTTPProxy, "tls_ocsp_http_proxy", "", "URL of HTTP proxy for OCSP queries (default - proxy from HTTP_PROXY/HTTPS_PROXY/NO_PROXY environment variables)")
+	flag.StringVar(&tlsOcspCABundle, "tls_ocsp_ca_bundle", "", "Path to PEM file with CA certificates to verify OCSP servers with HTTPS URLs (default - system root certificates)")
+	flag.UintVar(&tlsOcspRetryCount, "tls_ocsp_retry_count", 0, "How many times to retry OCSP requests failed with network errors or 5xx HTTP statuses, within tls_ocsp_query_timeout")
+	flag.BoolVar(&tlsOcspForcePOST, "tls_ocsp_force_post", false, "Send OCSP requests only with POST method. By default short requests are sent with GET method, which may be cached by CDNs and HTTP caches")
+	flag.StringVar(&tlsOcspNonce, "tls_ocsp_nonce", OcspNonceNoneStr,
+		fmt.Sprintf("Whether to add nonce to OCSP requests to prevent replay of old responses: <%s>. Requests with nonce aren't cached by HTTP caches", strings.Join(OcspNonceValuesList, "|")))
+	flag.UintVar(&tlsOcspClockSkew, "tls_ocsp_clock_skew", uint(OcspDefaultClockSkew/time.Second), "Tolerance of clock difference with OCSP server, in seconds. Responses produced later than now, or with NextUpdate earlier than now, by more than this value are denied")
+	flag.StringVar(&tlsVerifiers, "tls_verifiers", DefaultCertVerifiers, "Comma-separated list of verifiers of peer certificates in order they run: <ocsp|crl|allowlist|script>. ocsp and crl run only if enabled by their settings")
+	flag.StringVar(&tlsVerifiersMode, "tls_verifiers_mode", CertVerifierModeAll, "How to combine results of tls_verifiers: <all|any>. 'all' requires every verifier to accept the certificate, 'any' requires at least one")
+	flag.StringVar(&tlsCertAllowlistFile, "tls_cert_allowlist_file", "", "Path to file with SHA-256 fingerprints of allowed peer certificates, one per line, used by 'allowlist' verifier")
+	flag.StringVar(&tlsVerifierScript, "tls_verifier_script", "", "Path to executable used by 'script' verifier, it reads PEM certificates of the peer from stdin and accepts the peer with zero exit code")
 	flag.StringVar(&tlsCrlURL, "tls_crl_url", "", "URL of the Certificate Revocation List (CRL) to use")
 	flag.StringVar(&tlsCrlFromCert, "tls_crl_from_cert", CrlFromCertPreferStr,
 		fmt.Sprintf("How to treat CRL URL described in certificate itself: <%s>", strings.Join(CrlFromCertValuesList, "|")))
@@ -89,6 +121,10 @@ func RegisterTLSBaseArgs() {
 	flag.UintVar(&tlsCrlCacheSize, "tls_crl_cache_size", CrlDefaultCacheSize, "How many CRLs to cache in memory (use 0 to disable caching)")
 	flag.UintVar(&tlsCrlCacheTime, "tls_crl_cache_time", CrlDisableCacheTime,
 		fmt.Sprintf("How long to keep CRLs cached, in seconds (use 0 to disable caching, maximum: %d s)", CrlCacheTimeMax))
+	flag.StringVar(&tlsPinnedSPKI, "tls_pinned_spki", "", "Comma-separated list of base64 SHA-256 hashes of SubjectPublicKeyInfo of allowed peer certificates. Peers without pinned public key are rejected even if their certificate is issued by trusted CA")
+	flag.BoolVar(&tlsPinnedSPKIMatchChain, "tls_pinned_spki_match_chain", false, "Put 'true' to accept peer if any certificate of verified chain (like intermediate or root CA) matches tls_pinned_spki, or 'false' to match only leaf certificate")
+	flag.UintVar(&tlsVerifyLatencyBudget, "tls_verify_latency_budget", 0, "Maximum time (in milliseconds) TLS handshake waits for tls_verifiers (OCSP/CRL queries, script). Slower verification continues in background, the peer is accepted (rejected if tls_ocsp_required is requireGood) and its next handshake gets the verdict (0 - wait until verification finishes)")
+	flag.UintVar(&tlsVerifyDeferredTimeout, "tls_verify_deferred_timeout", uint(DefaultDeferredVerificationTimeout/time.Second), "Deadline (in seconds) of certificate verification continued in background after tls_verify_latency_budget, peer is rejected on next handshake if it's exceeded")
 }
 
 // RegisterTLSClientArgs register CLI args tls_server_sni used by TLS client's connection
@@ -98,7 +134,18 @@ func RegisterTLSClientArgs() {
 
 // NewTLSConfigFromBaseArgs return new tls clientConfig with params passed by cli params
 func NewTLSConfigFromBaseArgs() (*tls.Config, error) {
-	ocspConfig, err := NewOCSPConfig(tlsOcspURL, tlsOcspRequired, tlsOcspFromCert, tlsOcspCheckOnlyLeafCertificate)
+	ocspHTTPClientConfig := OCSPClientConfig{
+		Timeout:      time.Duration(tlsOcspClientTimeout) * time.Second,
+		ProxyURL:     tlsOcspHTTPProxy,
+		CABundlePath: tlsOcspCABundle,
+		Retries:      tlsOcspRetryCount,
+		RetryDelay:   OcspDefaultRetryDelay,
+		ForcePOST:    tlsOcspForcePOST,
+		Nonce:        tlsOcspNonce,
+		ClockSkew:    time.Duration(tlsOcspClockSkew) * time.Second,
+	}
+	ocspConfig, err := NewOCSPConfig(tlsOcspURL, tlsOcspRequired, tlsOcspFromCert, tlsOcspCheckOnlyLeafCertificate,
+		time.Duration(tlsOcspQueryTimeout)*time.Second, time.Duration(tlsOcspVerifyTimeout)*time.Second, ocspHTTPClientConfig)
 	if err != nil {
 		return nil, err
 	}
@@ -108,7 +155,18 @@ func NewTLSConfigFromBaseArgs() (*tls.Config, error) {
 		return nil, err
 	}
 
-	certVerifier, err := NewCertVerifierFromConfigs(ocspConfig, crlConfig)
+	verifierConfig, err := NewCompositeVerifierConfig(tlsVerifiers, tlsVerifiersMode, tlsCertAllowlistFile, tlsVerifierScript)
+	if err != nil {
+		return nil, err
+	}
+
+	certVerifier, err := NewCompositeVerifierFromConfigs(verifierConfig, ocspConfig, crlConfig)
+	if err != nil {
+		return nil, err
+	}
+	certVerifier = NewLatencyBudgetCertVerifier(certVerifier, time.Duration(tlsVerifyLatencyBudget)*time.Millisecond,
+		time.Duration(tlsVerifyDeferredTimeout)*time.Second, tlsOcspRequired == OcspRequiredGoodStr)
+	certVerifier, err = NewPinnedCertVerifier(tlsPinnedSPKI, tlsPinnedSPKIMatchChain, certVerifier)
 	if err != nil {
 		return nil, err
 	}
@@ -118,6 +176,40 @@ func NewTLSConfigFromBaseArgs() (*tls.Config, error) {
 
 // NewTLSConfig creates x509 TLS clientConfig from provided params, tried to load system CA certificate
 func NewTLSConfig(serverName string, caPath, keyPath, crtPath string, authType tls.ClientAuthType, certVerifier CertVerifier) (*tls.Config, error) {
+	roots, certificates, err := loadTLSMaterial(caPath, keyPath, crtPath)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		RootCAs:               roots,
+		ClientCAs:             roots,
+		Certificates:          certificates,
+		ServerName:            serverName,
+		ClientAuth:            authType,
+		MinVersion:            tls.VersionTLS12,
+		CipherSuites:          allowedCipherSuits,
+		VerifyPeerCertificate: verifyPeerCertificateWithContext(context.Background(), certVerifier),
+	}
+	// server side handshakes use config itself to share its session ticket keys, connection's copy replaces it after
+	// ClientHello
+	config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		if ctx, ok := serverHandshakeContexts.Load(hello.Conn); ok {
+			return configWithContext(ctx.(context.Context), config), nil
+		}
+		// listeners which don't use TLSConnectionWrapper get reloaded certificates too
+		if _, ok := tlsConfigMaterials.Load(config); ok {
+			return configWithContext(context.Background(), config), nil
+		}
+		return nil, nil
+	}
+	tlsConfigVerifiers.Store(config, certVerifier)
+	return config, nil
+}
+
+// loadTLSMaterial returns system CA certificates with CA certificates from caPath and certificate with private key
+// if both paths are set
+func loadTLSMaterial(caPath, keyPath, crtPath string) (*x509.CertPool, []tls.Certificate, error) {
 	var roots *x509.CertPool
 	var err error
 	// use system pool as default
@@ -133,12 +225,12 @@ func NewTLSConfig(serverName string, caPath, keyPath, crtPath string, authType t
 		caPem, err := ioutil.ReadFile(caPath)
 		if err != nil {
 			log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorGeneral).Errorln("Can't read root CA certificate")
-			return nil, err
+			return nil, nil, err
 		}
 		log.Debugln("Adding CA root certificate")
 		if ok := roots.AppendCertsFromPEM(caPem); !ok {
 			log.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorNetworkTLSGeneral).Errorln("Can't add CA certificate from PEM")
-			return nil, errors.New("can't add CA certificate")
+			return nil, nil, errors.New("can't add CA certificate")
 		}
 	}
 	// use certificate if not empty
@@ -146,29 +238,55 @@ func NewTLSConfig(serverName string, caPath, keyPath, crtPath string, authType t
 	if crtPath != "" && keyPath != "" {
 		cer, err := tls.LoadX509KeyPair(crtPath, keyPath)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		certificates = append(certificates, cer)
 	}
+	return roots, certificates, nil
+}
+
+var (
+	// tlsConfigVerifiers keeps CertVerifier of each config created by NewTLSConfig, so revocation checks can be
+	// bound to context of connection
+	tlsConfigVerifiers sync.Map
+	// tlsConfigMaterials keeps tlsMaterialSource applied to config, connections use material it loaded last
+	tlsConfigMaterials sync.Map
+	// serverHandshakeContexts keeps context of each connection during server side handshake
+	serverHandshakeContexts sync.Map
+)
 
-	verifyPeerCertificate := func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
-		err := certVerifier.Verify(rawCerts, verifiedChains)
+func verifyPeerCertificateWithContext(ctx context.Context, certVerifier CertVerifier) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		err := certVerifier.Verify(ctx, rawCerts, verifiedChains)
 
 		log.WithError(err).WithField("valid", err == nil).Debugln("verifyPeerCertificate")
 
 		return err
 	}
+}
 
-	return &tls.Config{
-		RootCAs:               roots,
-		ClientCAs:             roots,
-		Certificates:          certificates,
-		ServerName:            serverName,
-		ClientAuth:            authType,
-		MinVersion:            tls.VersionTLS12,
-		CipherSuites:          allowedCipherSuits,
-		VerifyPeerCertificate: verifyPeerCertificate,
-	}, nil
+// tlsMaterialSource sets certificates loaded last to config of new connection
+type tlsMaterialSource interface {
+	applyMaterial(config *tls.Config)
+}
+
+// configWithContext returns copy of config created by NewTLSConfig which aborts revocation checks of peer
+// certificates when ctx is done and uses certificates last loaded by TLSReloader or SpiffeCredentialsProvider, other
+// configs are returned as is. CertVerifier passed to NewTLSConfig replaces VerifyPeerCertificate set later.
+func configWithContext(ctx context.Context, config *tls.Config) *tls.Config {
+	certVerifier, hasVerifier := tlsConfigVerifiers.Load(config)
+	material, hasMaterial := tlsConfigMaterials.Load(config)
+	if !hasVerifier && !hasMaterial {
+		return config
+	}
+	connectionConfig := config.Clone()
+	if hasVerifier {
+		connectionConfig.VerifyPeerCertificate = verifyPeerCertificateWithContext(ctx, certVerifier.(CertVerifier))
+	}
+	if hasMaterial {
+		material.(tlsMaterialSource).applyMaterial(connectionConfig)
+	}
+	return connectionConfig
 }
 
 // NewTLSConnectionWrapper returns new TLSConnectionWrapper
@@ -184,17 +302,51 @@ func NewTLSAuthenticationConnectionWrapper(clientConfig, serverConfig *tls.Confi
 
 // WrapClient wraps client connection into TLS
 func (wrapper *TLSConnectionWrapper) WrapClient(ctx context.Context, conn net.Conn) (net.Conn, error) {
-	conn.SetDeadline(time.Now().Add(DefaultNetworkTimeout))
-	tlsConn := tls.Client(conn, wrapper.clientConfig)
+	deadline := time.Now().Add(DefaultNetworkTimeout)
+	ctx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+	conn.SetDeadline(deadline)
+	config := configWithContext(ctx, wrapper.clientConfig)
+	tlsConn := tls.Client(conn, config)
 	err := tlsConn.Handshake()
 	if err != nil {
 		conn.SetDeadline(time.Time{})
 		return conn, err
 	}
 	conn.SetDeadline(time.Time{})
+	if err := verifyResumedSession(config, tlsConn.ConnectionState()); err != nil {
+		return conn, err
+	}
 	return newSafeCloseConnection(tlsConn), nil
 }
 
+// verifyResumedSession checks revocation of peer certificates of resumed TLS session because VerifyPeerCertificate
+// isn't called for all kinds of resumed sessions. Verdicts of full handshake are reused if certificate verifier caches
+// them.
+func verifyResumedSession(config *tls.Config, state tls.ConnectionState) error {
+	if !state.DidResume || config.VerifyPeerCertificate == nil || len(state.PeerCertificates) == 0 {
+		return nil
+	}
+	rawCerts := make([][]byte, 0, len(state.PeerCertificates))
+	for _, certificate := range state.PeerCertificates {
+		rawCerts = append(rawCerts, certificate.Raw)
+	}
+	return config.VerifyPeerCertificate(rawCerts, state.VerifiedChains)
+}
+
+// VerifiedPeerCertificate returns verified certificate of peer of TLS connection returned by TLSConnectionWrapper
+func VerifiedPeerCertificate(conn net.Conn) (*x509.Certificate, error) {
+	tlsConn, ok := UnwrapSafeCloseConnection(conn).(*tls.Conn)
+	if !ok {
+		return nil, ErrNoPeerCertificate
+	}
+	state := tlsConn.ConnectionState()
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil, ErrNoPeerCertificate
+	}
+	return state.VerifiedChains[0][0], nil
+}
+
 func (wrapper *TLSConnectionWrapper) getClientIDFromCertificate(certificate *x509.Certificate) ([]byte, error) {
 	identifier, err := wrapper.idExtractor.GetCertificateIdentifier(certificate)
 	if err != nil {
@@ -211,7 +363,13 @@ func (wrapper *TLSConnectionWrapper) getClientIDFromCertificate(certificate *x50
 
 // WrapServer wraps server connection into TLS
 func (wrapper *TLSConnectionWrapper) WrapServer(ctx context.Context, conn net.Conn) (net.Conn, []byte, error) {
-	conn.SetDeadline(time.Now().Add(DefaultNetworkTimeout))
+	deadline := time.Now().Add(DefaultNetworkTimeout)
+	ctx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+	conn.SetDeadline(deadline)
+	serverHandshakeContexts.Store(conn, ctx)
+	defer serverHandshakeContexts.Delete(conn)
+	config := configWithContext(ctx, wrapper.serverConfig)
 	tlsConn := tls.Server(conn, wrapper.serverConfig)
 	err := tlsConn.Handshake()
 	if err != nil {
@@ -219,10 +377,13 @@ func (wrapper *TLSConnectionWrapper) WrapServer(ctx context.Context, conn net.Co
 		return conn, nil, err
 	}
 	conn.SetDeadline(time.Time{})
+	connectionInfo := tlsConn.ConnectionState()
+	if err := verifyResumedSession(config, connectionInfo); err != nil {
+		return conn, nil, err
+	}
 	if wrapper.clientID != nil {
 		return newSafeCloseConnection(tlsConn), wrapper.clientID, nil
 	}
-	connectionInfo := tlsConn.ConnectionState()
 	if len(connectionInfo.VerifiedChains) == 0 || len(connectionInfo.VerifiedChains[0]) == 0 {
 		return conn, nil, ErrNoPeerCertificate
 	}
@@ -136,6 +136,51 @@ type ListenerWithFileDescriptor interface {
 	File() (f *os.File, err error)
 }
 
+// ErrInvalidUnixSocketMode returned for invalid permissions of unix socket in connection string
+var ErrInvalidUnixSocketMode = errors.New("invalid mode of unix socket, octal permissions like 0660 expected")
+
+// removeStaleUnixSocket removes socket file left by process which didn't close its listener (crash or graceful
+// restart), so new listener can bind to the path. Socket which accepts connections is left as is.
+func removeStaleUnixSocket(path string) error {
+	info, err := os.Lstat(path)
+	if err != nil || info.Mode()&os.ModeSocket == 0 {
+		return nil
+	}
+	conn, err := net.Dial("unix", path)
+	if err == nil {
+		return conn.Close()
+	}
+	log.WithField("path", path).Infoln("Remove stale unix socket")
+	return os.Remove(path)
+}
+
+// listenUnixSocket listens to unix socket and sets permissions of socket file from "mode" parameter of url like
+// unix:///path/to/socket?mode=0660
+func listenUnixSocket(url *url_.URL) (net.Listener, error) {
+	var mode uint64
+	if value := url.Query().Get("mode"); value != "" {
+		var err error
+		mode, err = strconv.ParseUint(value, 8, 32)
+		if err != nil || mode > 0777 {
+			return nil, ErrInvalidUnixSocketMode
+		}
+	}
+	if err := removeStaleUnixSocket(url.Path); err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen(url.Scheme, url.Path)
+	if err != nil {
+		return nil, err
+	}
+	if mode != 0 {
+		if err := os.Chmod(url.Path, os.FileMode(mode)); err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+	return listener, nil
+}
+
 // Listen returns listener for connection string
 func Listen(connectionString string) (net.Listener, error) {
 	url, err := url_.Parse(connectionString)
@@ -145,7 +190,7 @@ func Listen(connectionString string) (net.Listener, error) {
 	url.Scheme = customSchemeToBaseGolangScheme(url.Scheme)
 	var listener net.Listener
 	if url.Scheme == "unix" {
-		listener, err = net.Listen(url.Scheme, url.Path)
+		listener, err = listenUnixSocket(url)
 	} else {
 		listener, err = net.Listen(url.Scheme, url.Host)
 	}
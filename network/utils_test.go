@@ -18,7 +18,10 @@ package network
 
 import (
 	"errors"
+	"io/ioutil"
 	"net"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 )
@@ -79,3 +82,46 @@ func TestSafeCloseConnection(t *testing.T) {
 		t.Fatal("Close method return incorrect error")
 	}
 }
+
+func TestListenUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "acra-listen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "acra.sock")
+	listener, err := Listen("unix://" + path + "?mode=0660")
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0660 {
+		t.Fatalf("Expected mode 0660, took %v", info.Mode().Perm())
+	}
+	// socket which accepts connections isn't removed
+	if _, err := Listen("unix://" + path); err == nil {
+		t.Fatal("Expected error on listening to used socket")
+	}
+
+	// socket file left by process without closing listener is removed
+	unixListener := UnwrapSafeCloseListener(listener).(*net.UnixListener)
+	unixListener.SetUnlinkOnClose(false)
+	if err := listener.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatal("Expected socket file left after close")
+	}
+	listener, err = Listen("unix://" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.Close()
+
+	if _, err := Listen("unix://" + path + "?mode=999"); err != ErrInvalidUnixSocketMode {
+		t.Fatalf("Expected ErrInvalidUnixSocketMode, took %v", err)
+	}
+}
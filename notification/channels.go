@@ -0,0 +1,141 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package notification
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// DefaultPagerDutyURL is endpoint of PagerDuty Events API v2
+const DefaultPagerDutyURL = "https://events.pagerduty.com/v2/enqueue"
+
+// defaultHTTPTimeout limits time of webhook requests
+const defaultHTTPTimeout = time.Second * 10
+
+func postJSON(client *http.Client, url string, body interface{}, expectedStatus int) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	response, err := client.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != expectedStatus {
+		responseBody, _ := ioutil.ReadAll(io.LimitReader(response.Body, 1024))
+		return fmt.Errorf("unexpected response status %d: %s", response.StatusCode, bytes.TrimSpace(responseBody))
+	}
+	return nil
+}
+
+// SlackNotifier posts events to Slack incoming webhook
+type SlackNotifier struct {
+	webhookURL string
+	client     *http.Client
+}
+
+// NewSlackNotifier returns notifier for Slack incoming webhook URL
+func NewSlackNotifier(webhookURL string) *SlackNotifier {
+	return &SlackNotifier{webhookURL: webhookURL, client: &http.Client{Timeout: defaultHTTPTimeout}}
+}
+
+// Notify posts event as message text
+func (notifier *SlackNotifier) Notify(event *Event) error {
+	return postJSON(notifier.client, notifier.webhookURL, map[string]string{"text": event.Text()}, http.StatusOK)
+}
+
+// PagerDutyNotifier triggers alerts via PagerDuty Events API v2
+type PagerDutyNotifier struct {
+	url        string
+	routingKey string
+	client     *http.Client
+}
+
+// NewPagerDutyNotifier returns notifier for integration routingKey. Empty url means DefaultPagerDutyURL.
+func NewPagerDutyNotifier(url, routingKey string) *PagerDutyNotifier {
+	if url == "" {
+		url = DefaultPagerDutyURL
+	}
+	return &PagerDutyNotifier{url: url, routingKey: routingKey, client: &http.Client{Timeout: defaultHTTPTimeout}}
+}
+
+// Notify triggers alert, events of same type and source are deduplicated by PagerDuty
+func (notifier *PagerDutyNotifier) Notify(event *Event) error {
+	body := map[string]interface{}{
+		"routing_key":  notifier.routingKey,
+		"event_action": "trigger",
+		"dedup_key":    event.Source + "/" + event.Type,
+		"payload": map[string]interface{}{
+			"summary":        event.Summary,
+			"source":         event.Source,
+			"severity":       event.Severity,
+			"timestamp":      event.Time.UTC().Format(time.RFC3339),
+			"class":          event.Type,
+			"custom_details": event.Details,
+		},
+	}
+	return postJSON(notifier.client, notifier.url, body, http.StatusAccepted)
+}
+
+// EmailNotifier sends events via SMTP server. Connection is upgraded with STARTTLS if server supports it.
+type EmailNotifier struct {
+	address string
+	auth    smtp.Auth
+	from    string
+	to      []string
+	// sendMail is smtp.SendMail, replaced in tests
+	sendMail func(addr string, a smtp.Auth, from string, to []string, msg []byte) error
+}
+
+// NewEmailNotifier returns notifier which sends emails through SMTP server at address (host:port).
+// PLAIN authentication is used if username isn't empty.
+func NewEmailNotifier(address, username, password, from string, to []string) (*EmailNotifier, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	var auth smtp.Auth
+	if username != "" {
+		auth = smtp.PlainAuth("", username, password, host)
+	}
+	return &EmailNotifier{address: address, auth: auth, from: from, to: to, sendMail: smtp.SendMail}, nil
+}
+
+// Notify sends event as plain text email
+func (notifier *EmailNotifier) Notify(event *Event) error {
+	message := &bytes.Buffer{}
+	fmt.Fprintf(message, "From: %s\r\n", notifier.from)
+	fmt.Fprintf(message, "To: %s\r\n", strings.Join(notifier.to, ", "))
+	// header values can't contain line breaks
+	subject := strings.NewReplacer("\r", " ", "\n", " ").Replace(fmt.Sprintf("[%s] %s: %s", strings.ToUpper(event.Severity), event.Source, event.Summary))
+	fmt.Fprintf(message, "Subject: %s\r\n", subject)
+	fmt.Fprintf(message, "Date: %s\r\n", event.Time.Format(time.RFC1123Z))
+	message.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n")
+	message.WriteString(strings.Replace(event.Text(), "\n", "\r\n", -1))
+	message.WriteString("\r\n")
+	return notifier.sendMail(notifier.address, notifier.auth, notifier.from, notifier.to, message.Bytes())
+}
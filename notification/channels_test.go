@@ -0,0 +1,99 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package notification
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/smtp"
+	"strings"
+	"testing"
+)
+
+func testEvent() *Event {
+	return NewEvent(EventTypePoisonRecord, SeverityCritical, "acra-server", "Poison record detected", map[string]string{"client_id": "client"})
+}
+
+func TestSlackNotifier(t *testing.T) {
+	var body map[string]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&body)
+	}))
+	defer server.Close()
+	if err := NewSlackNotifier(server.URL).Notify(testEvent()); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(body["text"], "[CRITICAL] acra-server: Poison record detected\nclient_id: client\n") {
+		t.Fatalf("Incorrect message %s", body["text"])
+	}
+}
+
+func TestPagerDutyNotifier(t *testing.T) {
+	var body map[string]interface{}
+	status := http.StatusAccepted
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&body)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+	notifier := NewPagerDutyNotifier(server.URL, "key")
+	if err := notifier.Notify(testEvent()); err != nil {
+		t.Fatal(err)
+	}
+	payload := body["payload"].(map[string]interface{})
+	if body["routing_key"] != "key" || body["event_action"] != "trigger" || payload["severity"] != SeverityCritical ||
+		payload["summary"] != "Poison record detected" || payload["source"] != "acra-server" {
+		t.Fatalf("Incorrect request %v", body)
+	}
+	status = http.StatusBadRequest
+	if err := notifier.Notify(testEvent()); err == nil {
+		t.Fatal("Expected error for rejected event")
+	}
+}
+
+func TestEmailNotifier(t *testing.T) {
+	notifier, err := NewEmailNotifier("smtp.example.com:587", "user", "password", "acra@example.com", []string{"a@example.com", "b@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var message string
+	var recipients []string
+	notifier.sendMail = func(addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+		if addr != "smtp.example.com:587" || a == nil || from != "acra@example.com" {
+			t.Fatal("Incorrect SMTP parameters")
+		}
+		recipients = to
+		message = string(msg)
+		return nil
+	}
+	event := testEvent()
+	event.Summary = "Poison record\r\nBcc: attacker@example.com"
+	if err := notifier.Notify(event); err != nil {
+		t.Fatal(err)
+	}
+	if len(recipients) != 2 || !strings.Contains(message, "To: a@example.com, b@example.com\r\n") {
+		t.Fatal("Incorrect recipients")
+	}
+	headers := message[:strings.Index(message, "\r\n\r\n")]
+	if strings.Contains(headers, "\r\nBcc:") {
+		t.Fatal("Line breaks in summary shouldn't create headers")
+	}
+	if !strings.Contains(message, "\r\n\r\n[CRITICAL] acra-server: Poison record") {
+		t.Fatalf("Incorrect message %s", message)
+	}
+}
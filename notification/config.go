@@ -0,0 +1,136 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package notification
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Types of channels in configuration
+const (
+	ChannelTypeSlack     = "slack"
+	ChannelTypePagerDuty = "pagerduty"
+	ChannelTypeEmail     = "email"
+)
+
+// ErrInvalidConfig returned for invalid notification configuration
+var ErrInvalidConfig = errors.New("invalid notification config")
+
+// ChannelConfig describes one notification channel. Secrets support ${ENV_VARIABLE} syntax.
+type ChannelConfig struct {
+	Name string `yaml:"name"`
+	Type string `yaml:"type"`
+	// slack
+	WebhookURL string `yaml:"webhook_url"`
+	// pagerduty
+	RoutingKey string `yaml:"routing_key"`
+	URL        string `yaml:"url"`
+	// email
+	SMTPAddress string   `yaml:"smtp_address"`
+	Username    string   `yaml:"username"`
+	Password    string   `yaml:"password"`
+	From        string   `yaml:"from"`
+	To          []string `yaml:"to"`
+}
+
+// RouteConfig sends events of listed types ("*" for all) to channels
+type RouteConfig struct {
+	Events   []string `yaml:"events"`
+	Channels []string `yaml:"channels"`
+	// RepeatInterval in seconds limits how often events of same type are sent to channel
+	RepeatInterval int `yaml:"repeat_interval"`
+}
+
+// Config is configuration of notification channels and routing
+type Config struct {
+	Channels []ChannelConfig `yaml:"channels"`
+	Routes   []RouteConfig   `yaml:"routes"`
+}
+
+// NewRouterFromConfig returns Router with channels and routes from config
+func NewRouterFromConfig(config *Config) (*Router, error) {
+	router := NewRouter()
+	for _, channelConfig := range config.Channels {
+		if channelConfig.Name == "" {
+			return nil, fmt.Errorf("%w: channel without name", ErrInvalidConfig)
+		}
+		if _, ok := router.channels[channelConfig.Name]; ok {
+			return nil, fmt.Errorf("%w: duplicated channel '%s'", ErrInvalidConfig, channelConfig.Name)
+		}
+		channel, err := newChannel(&channelConfig)
+		if err != nil {
+			return nil, err
+		}
+		router.AddChannel(channelConfig.Name, channel)
+	}
+	for _, routeConfig := range config.Routes {
+		if routeConfig.RepeatInterval < 0 {
+			return nil, fmt.Errorf("%w: negative repeat_interval", ErrInvalidConfig)
+		}
+		if err := router.AddRoute(routeConfig.Events, routeConfig.Channels, time.Duration(routeConfig.RepeatInterval)*time.Second); err != nil {
+			return nil, err
+		}
+	}
+	return router, nil
+}
+
+func newChannel(config *ChannelConfig) (Notifier, error) {
+	switch config.Type {
+	case ChannelTypeSlack:
+		webhookURL := os.ExpandEnv(config.WebhookURL)
+		if webhookURL == "" {
+			return nil, fmt.Errorf("%w: channel '%s' requires webhook_url", ErrInvalidConfig, config.Name)
+		}
+		return NewSlackNotifier(webhookURL), nil
+	case ChannelTypePagerDuty:
+		routingKey := os.ExpandEnv(config.RoutingKey)
+		if routingKey == "" {
+			return nil, fmt.Errorf("%w: channel '%s' requires routing_key", ErrInvalidConfig, config.Name)
+		}
+		return NewPagerDutyNotifier(config.URL, routingKey), nil
+	case ChannelTypeEmail:
+		if config.SMTPAddress == "" || config.From == "" || len(config.To) == 0 {
+			return nil, fmt.Errorf("%w: channel '%s' requires smtp_address, from and to", ErrInvalidConfig, config.Name)
+		}
+		notifier, err := NewEmailNotifier(config.SMTPAddress, os.ExpandEnv(config.Username), os.ExpandEnv(config.Password), config.From, config.To)
+		if err != nil {
+			return nil, fmt.Errorf("%w: channel '%s': %s", ErrInvalidConfig, config.Name, err)
+		}
+		return notifier, nil
+	default:
+		return nil, fmt.Errorf("%w: channel '%s' has unknown type '%s'", ErrInvalidConfig, config.Name, config.Type)
+	}
+}
+
+// LoadRouter reads configuration from YAML file and returns Router
+func LoadRouter(path string) (*Router, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config := &Config{}
+	if err := yaml.UnmarshalStrict(data, config); err != nil {
+		return nil, err
+	}
+	return NewRouterFromConfig(config)
+}
@@ -0,0 +1,215 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package notification delivers operational alerts (poison record detection, certificate expiry, anomalies)
+// to notification channels: Slack webhooks, PagerDuty Events API and email over SMTP. Events are routed to
+// channels by their types according to YAML configuration.
+package notification
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cossacklabs/acra/logging"
+	log "github.com/sirupsen/logrus"
+)
+
+// Types of events
+const (
+	EventTypePoisonRecord      = "poison_record"
+	EventTypeCertificateExpiry = "certificate_expiry"
+	EventTypeAnomaly           = "anomaly"
+	// EventTypeAny used in routes to match all event types
+	EventTypeAny = "*"
+)
+
+// Severities of events, values match PagerDuty severities
+const (
+	SeverityCritical = "critical"
+	SeverityError    = "error"
+	SeverityWarning  = "warning"
+	SeverityInfo     = "info"
+)
+
+// Event describes operational alert
+type Event struct {
+	Type     string
+	Severity string
+	// Source is name of service which generated event
+	Source  string
+	Summary string
+	Details map[string]string
+	Time    time.Time
+}
+
+// NewEvent returns event with current time
+func NewEvent(eventType, severity, source, summary string, details map[string]string) *Event {
+	return &Event{Type: eventType, Severity: severity, Source: source, Summary: summary, Details: details, Time: time.Now()}
+}
+
+// Text returns human readable representation of event with sorted details
+func (event *Event) Text() string {
+	lines := []string{fmt.Sprintf("[%s] %s: %s", strings.ToUpper(event.Severity), event.Source, event.Summary)}
+	keys := make([]string, 0, len(event.Details))
+	for key := range event.Details {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		lines = append(lines, fmt.Sprintf("%s: %s", key, event.Details[key]))
+	}
+	lines = append(lines, fmt.Sprintf("event: %s, time: %s", event.Type, event.Time.UTC().Format(time.RFC3339)))
+	return strings.Join(lines, "\n")
+}
+
+// Notifier delivers events
+type Notifier interface {
+	Notify(event *Event) error
+}
+
+type route struct {
+	eventTypes     map[string]bool
+	channels       []string
+	repeatInterval time.Duration
+}
+
+func (r *route) matches(eventType string) bool {
+	return r.eventTypes[eventType] || r.eventTypes[EventTypeAny]
+}
+
+// Router sends events to channels of all routes matching event type. Events of same type are sent to channel
+// of route not more often than once per repeat interval of that route.
+type Router struct {
+	channels map[string]Notifier
+	routes   []*route
+	mutex    sync.Mutex
+	lastSent map[string]time.Time
+}
+
+// NewRouter returns router without routes
+func NewRouter() *Router {
+	return &Router{channels: make(map[string]Notifier), lastSent: make(map[string]time.Time)}
+}
+
+// AddChannel registers channel with name
+func (router *Router) AddChannel(name string, channel Notifier) {
+	router.channels[name] = channel
+}
+
+// AddRoute sends events of eventTypes to channels. Channels should be registered before.
+func (router *Router) AddRoute(eventTypes, channels []string, repeatInterval time.Duration) error {
+	r := &route{eventTypes: make(map[string]bool, len(eventTypes)), repeatInterval: repeatInterval}
+	for _, eventType := range eventTypes {
+		switch eventType {
+		case EventTypePoisonRecord, EventTypeCertificateExpiry, EventTypeAnomaly, EventTypeAny:
+			r.eventTypes[eventType] = true
+		default:
+			return fmt.Errorf("%w: unknown event type '%s'", ErrInvalidConfig, eventType)
+		}
+	}
+	for _, channel := range channels {
+		if _, ok := router.channels[channel]; !ok {
+			return fmt.Errorf("%w: unknown channel '%s'", ErrInvalidConfig, channel)
+		}
+	}
+	r.channels = channels
+	router.routes = append(router.routes, r)
+	return nil
+}
+
+// shouldSend returns true if event of eventType wasn't sent to channel of route during its repeat interval
+func (router *Router) shouldSend(routeIndex int, channel, eventType string, now time.Time) bool {
+	r := router.routes[routeIndex]
+	if r.repeatInterval == 0 {
+		return true
+	}
+	key := fmt.Sprintf("%d/%s/%s", routeIndex, channel, eventType)
+	router.mutex.Lock()
+	defer router.mutex.Unlock()
+	if last, ok := router.lastSent[key]; ok && now.Sub(last) < r.repeatInterval {
+		return false
+	}
+	router.lastSent[key] = now
+	return true
+}
+
+// Notify sends event to each matched channel once and returns first delivery error. Delivery to other channels
+// continues after error.
+func (router *Router) Notify(event *Event) error {
+	var firstErr error
+	sent := make(map[string]bool)
+	for i, r := range router.routes {
+		if !r.matches(event.Type) {
+			continue
+		}
+		for _, channel := range r.channels {
+			if sent[channel] || !router.shouldSend(i, channel, event.Type, event.Time) {
+				continue
+			}
+			sent[channel] = true
+			if err := router.channels[channel].Notify(event); err != nil {
+				log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorNotificationDelivery).
+					WithFields(log.Fields{"channel": channel, "event": event.Type}).Errorln("Can't deliver notification")
+				if firstErr == nil {
+					firstErr = err
+				}
+			}
+		}
+	}
+	return firstErr
+}
+
+// defaultAsyncQueueSize is size of AsyncNotifier queue
+const defaultAsyncQueueSize = 100
+
+// AsyncNotifier delivers events in background without blocking caller. Events are dropped when queue is full.
+type AsyncNotifier struct {
+	notifier Notifier
+	queue    chan *Event
+}
+
+// NewAsyncNotifier starts goroutine which delivers events through notifier
+func NewAsyncNotifier(notifier Notifier) *AsyncNotifier {
+	asyncNotifier := &AsyncNotifier{notifier: notifier, queue: make(chan *Event, defaultAsyncQueueSize)}
+	go asyncNotifier.run()
+	return asyncNotifier
+}
+
+func (notifier *AsyncNotifier) run() {
+	for event := range notifier.queue {
+		// errors are logged by router
+		notifier.notifier.Notify(event)
+	}
+}
+
+// Notify queues event, never returns error
+func (notifier *AsyncNotifier) Notify(event *Event) error {
+	select {
+	case notifier.queue <- event:
+	default:
+		log.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorNotificationDelivery).
+			WithField("event", event.Type).Warningln("Notification queue is full, event dropped")
+	}
+	return nil
+}
+
+// Close stops delivery, should be called once
+func (notifier *AsyncNotifier) Close() {
+	close(notifier.queue)
+}
@@ -0,0 +1,160 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package notification
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testNotifier struct {
+	mutex  sync.Mutex
+	events []*Event
+	err    error
+}
+
+func (notifier *testNotifier) Notify(event *Event) error {
+	notifier.mutex.Lock()
+	defer notifier.mutex.Unlock()
+	notifier.events = append(notifier.events, event)
+	return notifier.err
+}
+
+func (notifier *testNotifier) count() int {
+	notifier.mutex.Lock()
+	defer notifier.mutex.Unlock()
+	return len(notifier.events)
+}
+
+func TestRouter(t *testing.T) {
+	slack := &testNotifier{}
+	pagerduty := &testNotifier{err: errors.New("unavailable")}
+	router := NewRouter()
+	router.AddChannel("slack", slack)
+	router.AddChannel("pagerduty", pagerduty)
+	if err := router.AddRoute([]string{EventTypePoisonRecord}, []string{"pagerduty", "slack"}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := router.AddRoute([]string{EventTypeAny}, []string{"slack"}, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	// poison record matches both routes but is sent to slack once, error of pagerduty is returned
+	if err := router.Notify(NewEvent(EventTypePoisonRecord, SeverityCritical, "acra-server", "poison", nil)); err == nil {
+		t.Fatal("Expected delivery error")
+	}
+	if slack.count() != 1 || pagerduty.count() != 1 {
+		t.Fatalf("Incorrect routing, slack=%d, pagerduty=%d", slack.count(), pagerduty.count())
+	}
+
+	// anomalies are sent to slack not more often than once per minute
+	event := NewEvent(EventTypeAnomaly, SeverityWarning, "acra-censor", "denied", nil)
+	for i := 0; i < 3; i++ {
+		if err := router.Notify(event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if slack.count() != 2 || pagerduty.count() != 1 {
+		t.Fatalf("Incorrect repeat interval, slack=%d, pagerduty=%d", slack.count(), pagerduty.count())
+	}
+	event = NewEvent(EventTypeAnomaly, SeverityWarning, "acra-censor", "denied", nil)
+	event.Time = event.Time.Add(time.Minute)
+	router.Notify(event)
+	if slack.count() != 3 {
+		t.Fatal("Event should be sent after repeat interval")
+	}
+
+	if err := router.AddRoute([]string{"unknown"}, []string{"slack"}, 0); !errors.Is(err, ErrInvalidConfig) {
+		t.Fatalf("Expected ErrInvalidConfig for unknown event type, took %v", err)
+	}
+	if err := router.AddRoute([]string{EventTypeAnomaly}, []string{"email"}, 0); !errors.Is(err, ErrInvalidConfig) {
+		t.Fatalf("Expected ErrInvalidConfig for unknown channel, took %v", err)
+	}
+}
+
+func TestAsyncNotifier(t *testing.T) {
+	notifier := &testNotifier{}
+	asyncNotifier := NewAsyncNotifier(notifier)
+	defer asyncNotifier.Close()
+	asyncNotifier.Notify(NewEvent(EventTypeAnomaly, SeverityWarning, "acra-censor", "denied", nil))
+	for i := 0; i < 100 && notifier.count() == 0; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if notifier.count() != 1 {
+		t.Fatal("Event wasn't delivered")
+	}
+}
+
+func TestLoadRouter(t *testing.T) {
+	file, err := ioutil.TempFile("", "notification")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	os.Setenv("TEST_NOTIFICATION_ROUTING_KEY", "key")
+	defer os.Unsetenv("TEST_NOTIFICATION_ROUTING_KEY")
+	config := `
+channels:
+  - name: slack
+    type: slack
+    webhook_url: https://hooks.slack.com/services/test
+  - name: oncall
+    type: pagerduty
+    routing_key: ${TEST_NOTIFICATION_ROUTING_KEY}
+  - name: email
+    type: email
+    smtp_address: smtp.example.com:587
+    from: acra@example.com
+    to: [security@example.com]
+routes:
+  - events: [poison_record]
+    channels: [oncall, slack]
+  - events: [certificate_expiry, anomaly]
+    channels: [email]
+    repeat_interval: 300
+`
+	if _, err := file.WriteString(config); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	router, err := LoadRouter(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(router.channels) != 3 || len(router.routes) != 2 || router.routes[1].repeatInterval != time.Minute*5 {
+		t.Fatal("Incorrect router")
+	}
+	if router.channels["oncall"].(*PagerDutyNotifier).routingKey != "key" {
+		t.Fatal("Routing key wasn't expanded from environment")
+	}
+
+	invalidConfigs := []*Config{
+		{Channels: []ChannelConfig{{Name: "slack", Type: ChannelTypeSlack}}},
+		{Channels: []ChannelConfig{{Name: "sms", Type: "sms"}}},
+		{Channels: []ChannelConfig{{Name: "email", Type: ChannelTypeEmail, SMTPAddress: "smtp.example.com", From: "a@example.com", To: []string{"b@example.com"}}}},
+		{Channels: []ChannelConfig{{Name: "a", Type: ChannelTypeSlack, WebhookURL: "url"}, {Name: "a", Type: ChannelTypeSlack, WebhookURL: "url"}}},
+	}
+	for i, config := range invalidConfigs {
+		if _, err := NewRouterFromConfig(config); !errors.Is(err, ErrInvalidConfig) {
+			t.Errorf("%d: expected ErrInvalidConfig, took %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package notification
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"time"
+
+	"github.com/cossacklabs/acra/logging"
+	log "github.com/sirupsen/logrus"
+)
+
+// PoisonRecordCallback sends notification on detecting poison record. Implements base.PoisonCallback.
+type PoisonRecordCallback struct {
+	notifier Notifier
+	source   string
+}
+
+// NewPoisonRecordCallback returns callback which notifies about poison records detected by service source
+func NewPoisonRecordCallback(notifier Notifier, source string) *PoisonRecordCallback {
+	return &PoisonRecordCallback{notifier: notifier, source: source}
+}
+
+// Call sends notification. Delivery errors are logged and don't stop other poison record callbacks.
+func (callback *PoisonRecordCallback) Call() error {
+	callback.notifier.Notify(NewEvent(EventTypePoisonRecord, SeverityCritical, callback.source, "Poison record detected", nil))
+	return nil
+}
+
+// DefaultCertificateExpiryThreshold is time before certificate expiration when notifications start
+const DefaultCertificateExpiryThreshold = time.Hour * 24 * 30
+
+// certificateCheckInterval is interval between checks of certificates
+const certificateCheckInterval = time.Hour * 12
+
+// CertificateExpiryChecker notifies about certificates which expire during threshold or have expired
+type CertificateExpiryChecker struct {
+	notifier  Notifier
+	source    string
+	paths     []string
+	threshold time.Duration
+}
+
+// NewCertificateExpiryChecker returns checker of PEM certificates in files from paths. Empty paths are skipped.
+func NewCertificateExpiryChecker(notifier Notifier, source string, paths []string, threshold time.Duration) *CertificateExpiryChecker {
+	uniquePaths := make([]string, 0, len(paths))
+	seen := make(map[string]bool)
+	for _, path := range paths {
+		if path != "" && !seen[path] {
+			seen[path] = true
+			uniquePaths = append(uniquePaths, path)
+		}
+	}
+	return &CertificateExpiryChecker{notifier: notifier, source: source, paths: uniquePaths, threshold: threshold}
+}
+
+// HasCertificates returns true if there are certificates to check
+func (checker *CertificateExpiryChecker) HasCertificates() bool {
+	return len(checker.paths) > 0
+}
+
+// Check reads all certificates and sends one notification per expiring certificate
+func (checker *CertificateExpiryChecker) Check(now time.Time) {
+	for _, path := range checker.paths {
+		certificates, err := readCertificates(path)
+		if err != nil {
+			log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCertificateExpiry).
+				WithField("path", path).Warningln("Can't read certificate to check expiration")
+			continue
+		}
+		for _, certificate := range certificates {
+			left := certificate.NotAfter.Sub(now)
+			if left > checker.threshold {
+				continue
+			}
+			severity := SeverityWarning
+			summary := fmt.Sprintf("Certificate '%s' expires in %d days", certificate.Subject.String(), int(math.Ceil(left.Hours()/24)))
+			if left <= 0 {
+				severity = SeverityCritical
+				summary = fmt.Sprintf("Certificate '%s' has expired", certificate.Subject.String())
+			}
+			log.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCertificateExpiry).WithField("path", path).Warningln(summary)
+			checker.notifier.Notify(NewEvent(EventTypeCertificateExpiry, severity, checker.source, summary, map[string]string{
+				"path":      path,
+				"serial":    certificate.SerialNumber.String(),
+				"not_after": certificate.NotAfter.UTC().Format(time.RFC3339),
+			}))
+		}
+	}
+}
+
+// Run checks certificates immediately and then periodically until stop is closed
+func (checker *CertificateExpiryChecker) Run(stop <-chan struct{}) {
+	checker.Check(time.Now())
+	ticker := time.NewTicker(certificateCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			checker.Check(time.Now())
+		case <-stop:
+			return
+		}
+	}
+}
+
+func readCertificates(path string) ([]*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var certificates []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		certificate, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certificates = append(certificates, certificate)
+	}
+	if len(certificates) == 0 {
+		return nil, fmt.Errorf("no PEM certificates found")
+	}
+	return certificates, nil
+}
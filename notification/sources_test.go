@@ -0,0 +1,93 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package notification
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"testing"
+	"time"
+)
+
+func writeTestCertificate(t *testing.T, notAfter time.Time) string {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "acra-server"},
+		NotBefore:    notAfter.Add(-time.Hour * 24 * 365),
+		NotAfter:     notAfter,
+	}
+	certificate, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := ioutil.TempFile("", "certificate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if err := pem.Encode(file, &pem.Block{Type: "CERTIFICATE", Bytes: certificate}); err != nil {
+		t.Fatal(err)
+	}
+	return file.Name()
+}
+
+func TestCertificateExpiryChecker(t *testing.T) {
+	now := time.Now()
+	valid := writeTestCertificate(t, now.Add(time.Hour*24*90))
+	defer os.Remove(valid)
+	expiring := writeTestCertificate(t, now.Add(time.Hour*24*10))
+	defer os.Remove(expiring)
+	expired := writeTestCertificate(t, now.Add(-time.Hour))
+	defer os.Remove(expired)
+
+	notifier := &testNotifier{}
+	checker := NewCertificateExpiryChecker(notifier, "acra-server", []string{valid, expiring, "", expiring, expired}, DefaultCertificateExpiryThreshold)
+	checker.Check(now)
+	if notifier.count() != 2 {
+		t.Fatalf("Expected 2 events, took %d", notifier.count())
+	}
+	if notifier.events[0].Severity != SeverityWarning || notifier.events[0].Summary != "Certificate 'CN=acra-server' expires in 10 days" {
+		t.Fatalf("Incorrect event for expiring certificate: %s", notifier.events[0].Summary)
+	}
+	if notifier.events[1].Severity != SeverityCritical || notifier.events[1].Details["path"] != expired {
+		t.Fatal("Incorrect event for expired certificate")
+	}
+	if NewCertificateExpiryChecker(notifier, "acra-server", []string{"", ""}, DefaultCertificateExpiryThreshold).HasCertificates() {
+		t.Fatal("Empty paths should be skipped")
+	}
+}
+
+func TestPoisonRecordCallback(t *testing.T) {
+	notifier := &testNotifier{}
+	if err := NewPoisonRecordCallback(notifier, "acra-server").Call(); err != nil {
+		t.Fatal(err)
+	}
+	if notifier.count() != 1 || notifier.events[0].Type != EventTypePoisonRecord {
+		t.Fatal("Poison record event wasn't sent")
+	}
+}
@@ -0,0 +1,272 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package oidc
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cossacklabs/acra/logging"
+	log "github.com/sirupsen/logrus"
+)
+
+// Defaults of KeySet
+const (
+	DefaultHTTPTimeout     = time.Second * 10
+	DefaultRefreshInterval = time.Hour
+	// minimal time between refreshes triggered by tokens with unknown key ID
+	minRefreshInterval = time.Minute
+)
+
+// Errors returned by KeySet
+var (
+	ErrUnknownKey  = errors.New("token is signed with unknown key")
+	ErrInvalidJWKS = errors.New("invalid JSON Web Key Set")
+	ErrNoJWKSURI   = errors.New("OpenID provider configuration doesn't contain jwks_uri")
+	ErrEmptyKeySet = errors.New("JSON Web Key Set doesn't contain signing keys")
+)
+
+// DiscoverJWKSURL returns URL of JSON Web Key Set from OpenID provider configuration of issuer
+func DiscoverJWKSURL(issuer string, client *http.Client) (string, error) {
+	configuration := struct {
+		Issuer  string `json:"issuer"`
+		JWKSURI string `json:"jwks_uri"`
+	}{}
+	if err := getJSON(client, strings.TrimSuffix(issuer, "/")+"/.well-known/openid-configuration", &configuration); err != nil {
+		return "", err
+	}
+	if configuration.Issuer != issuer {
+		return "", fmt.Errorf("%w: provider configuration belongs to '%s'", ErrInvalidIssuer, configuration.Issuer)
+	}
+	if configuration.JWKSURI == "" {
+		return "", ErrNoJWKSURI
+	}
+	return configuration.JWKSURI, nil
+}
+
+// KeySet stores public keys of JSON Web Key Set loaded from URL. It is safe for concurrent use.
+type KeySet struct {
+	url         string
+	client      *http.Client
+	lock        sync.RWMutex
+	keys        map[string]*verificationKey
+	lastRefresh time.Time
+	now         func() time.Time
+}
+
+// NewKeySet returns KeySet which loads keys from url with client. Keys are loaded on first use or Refresh call.
+func NewKeySet(url string, client *http.Client) *KeySet {
+	return &KeySet{url: url, client: client, keys: map[string]*verificationKey{}, now: time.Now}
+}
+
+// Refresh replaces keys with JSON Web Key Set loaded from URL
+func (set *KeySet) Refresh() error {
+	set.lock.Lock()
+	defer set.lock.Unlock()
+	return set.refresh()
+}
+
+func (set *KeySet) refresh() error {
+	set.lastRefresh = set.now()
+	jwks := struct {
+		Keys []jsonWebKey `json:"keys"`
+	}{}
+	if err := getJSON(set.client, set.url, &jwks); err != nil {
+		return err
+	}
+	keys := make(map[string]*verificationKey, len(jwks.Keys))
+	for _, key := range jwks.Keys {
+		if key.Use != "" && key.Use != "sig" {
+			continue
+		}
+		publicKey, err := key.publicKey()
+		if err != nil {
+			return fmt.Errorf("%w: key '%s': %s", ErrInvalidJWKS, key.KeyID, err)
+		}
+		keys[key.KeyID] = &verificationKey{key: publicKey, algorithm: key.Algorithm}
+	}
+	if len(keys) == 0 {
+		return ErrEmptyKeySet
+	}
+	set.keys = keys
+	return nil
+}
+
+// verificationKey is public key of JSON Web Key Set and algorithm it's restricted to, empty if key hasn't "alg"
+type verificationKey struct {
+	key       crypto.PublicKey
+	algorithm string
+}
+
+// Key returns public key with keyID. Key set is refreshed if key is unknown, but not more often than once a minute,
+// so keys rotated by provider are picked up without restart. Empty keyID matches the key of single-key set.
+func (set *KeySet) Key(keyID string) (crypto.PublicKey, error) {
+	key, err := set.verificationKey(keyID)
+	if err != nil {
+		return nil, err
+	}
+	return key.key, nil
+}
+
+// verificationKey returns key with keyID and its algorithm, refreshed like in Key
+func (set *KeySet) verificationKey(keyID string) (*verificationKey, error) {
+	set.lock.RLock()
+	key, ok := set.lookup(keyID)
+	set.lock.RUnlock()
+	if ok {
+		return key, nil
+	}
+	set.lock.Lock()
+	defer set.lock.Unlock()
+	// key may be loaded by concurrent refresh
+	if key, ok := set.lookup(keyID); ok {
+		return key, nil
+	}
+	if !set.lastRefresh.IsZero() && set.now().Sub(set.lastRefresh) < minRefreshInterval {
+		return nil, fmt.Errorf("%w: '%s'", ErrUnknownKey, keyID)
+	}
+	if err := set.refresh(); err != nil {
+		return nil, err
+	}
+	if key, ok := set.lookup(keyID); ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("%w: '%s'", ErrUnknownKey, keyID)
+}
+
+func (set *KeySet) lookup(keyID string) (*verificationKey, bool) {
+	if keyID == "" && len(set.keys) == 1 {
+		for _, key := range set.keys {
+			return key, true
+		}
+	}
+	key, ok := set.keys[keyID]
+	return key, ok
+}
+
+// RunRefresh refreshes keys every interval until ctx is done
+func (set *KeySet) RunRefresh(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := set.Refresh(); err != nil {
+				log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorTokenAuthentication).
+					WithField("jwks_url", set.url).Warningln("Can't refresh JSON Web Key Set, previous keys are used")
+			}
+		}
+	}
+}
+
+// jsonWebKey is public RSA or EC key from JSON Web Key Set (RFC 7517)
+type jsonWebKey struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	N         string `json:"n"`
+	E         string `json:"e"`
+	Curve     string `json:"crv"`
+	X         string `json:"x"`
+	Y         string `json:"y"`
+}
+
+func (key *jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch key.KeyType {
+	case "RSA":
+		n, err := decodeBigInt(key.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(key.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch key.Curve {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve '%s'", key.Curve)
+		}
+		x, err := decodeBigInt(key.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(key.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point isn't on curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type '%s'", key.KeyType)
+	}
+}
+
+func decodeBigInt(value string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, errors.New("empty key parameter")
+	}
+	return new(big.Int).SetBytes(data), nil
+}
+
+func getJSON(client *http.Client, url string, result interface{}) error {
+	response, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(response.Body, 1024))
+		return fmt.Errorf("unexpected response status %d from %s: %s", response.StatusCode, url, bytes.TrimSpace(body))
+	}
+	return json.NewDecoder(response.Body).Decode(result)
+}
@@ -0,0 +1,224 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package oidc verifies JSON Web Tokens issued by OpenID Connect providers, like service account tokens of Kubernetes
+// or workload identity tokens of cloud platforms. Tokens are signed with asymmetric keys (RS256/384/512,
+// ES256/384/512) from provider's JSON Web Key Set, issuer, audience and validity period are checked on verification.
+package oidc
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// DefaultLeeway is allowed clock skew between provider and service on checks of token validity period
+const DefaultLeeway = time.Minute
+
+// Errors returned by Verifier
+var (
+	ErrMalformedToken       = errors.New("malformed JSON Web Token")
+	ErrUnsupportedAlgorithm = errors.New("unsupported token signature algorithm")
+	ErrAlgorithmMismatch    = errors.New("token signature algorithm doesn't match key")
+	ErrInvalidSignature     = errors.New("invalid token signature")
+	ErrInvalidIssuer        = errors.New("invalid token issuer")
+	ErrInvalidAudience      = errors.New("token isn't issued for configured audience")
+	ErrTokenExpired         = errors.New("token is expired")
+	ErrTokenNotYetValid     = errors.New("token isn't valid yet")
+)
+
+// Claims of verified token
+type Claims map[string]interface{}
+
+// signatureAlgorithm verifies signature of hashed data with public key
+type signatureAlgorithm struct {
+	hash crypto.Hash
+	// curve of EC keys of algorithm, nil for RSA
+	curve  elliptic.Curve
+	verify func(key crypto.PublicKey, algorithm signatureAlgorithm, hashed, signature []byte) error
+}
+
+// algorithms supported for verification. Symmetric and "none" algorithms are rejected because key of token signed
+// with them would have to be known by all services which verify tokens.
+var algorithms = map[string]signatureAlgorithm{
+	"RS256": {crypto.SHA256, nil, verifyRSA},
+	"RS384": {crypto.SHA384, nil, verifyRSA},
+	"RS512": {crypto.SHA512, nil, verifyRSA},
+	"ES256": {crypto.SHA256, elliptic.P256(), verifyECDSA},
+	"ES384": {crypto.SHA384, elliptic.P384(), verifyECDSA},
+	"ES512": {crypto.SHA512, elliptic.P521(), verifyECDSA},
+}
+
+func verifyRSA(key crypto.PublicKey, algorithm signatureAlgorithm, hashed, signature []byte) error {
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("%w: key isn't RSA key", ErrInvalidSignature)
+	}
+	if err := rsa.VerifyPKCS1v15(rsaKey, algorithm.hash, hashed, signature); err != nil {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// verifyECDSA verifies signature encoded as concatenated R and S of the curve size (RFC 7518, section 3.4). Key should
+// be of the curve of algorithm, so ES256 signatures aren't accepted from keys of other curves.
+func verifyECDSA(key crypto.PublicKey, algorithm signatureAlgorithm, hashed, signature []byte) error {
+	ecKey, ok := key.(*ecdsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("%w: key isn't EC key", ErrInvalidSignature)
+	}
+	if ecKey.Curve.Params().Name != algorithm.curve.Params().Name {
+		return fmt.Errorf("%w: key of curve %s", ErrAlgorithmMismatch, ecKey.Curve.Params().Name)
+	}
+	size := (ecKey.Curve.Params().BitSize + 7) / 8
+	if len(signature) != 2*size {
+		return ErrInvalidSignature
+	}
+	r := new(big.Int).SetBytes(signature[:size])
+	s := new(big.Int).SetBytes(signature[size:])
+	if !ecdsa.Verify(ecKey, hashed, r, s) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// Verifier verifies tokens of one issuer and audience
+type Verifier struct {
+	issuer   string
+	audience string
+	keys     *KeySet
+	leeway   time.Duration
+	now      func() time.Time
+}
+
+// NewVerifier returns Verifier of tokens issued by issuer for audience and signed with keys from KeySet
+func NewVerifier(issuer, audience string, keys *KeySet) (*Verifier, error) {
+	if issuer == "" || audience == "" {
+		return nil, errors.New("token issuer and audience should be specified")
+	}
+	return &Verifier{issuer: issuer, audience: audience, keys: keys, leeway: DefaultLeeway, now: time.Now}, nil
+}
+
+// Verify checks signature, issuer, audience and validity period of token and returns its claims
+func (verifier *Verifier) Verify(token string) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformedToken
+	}
+	header := struct {
+		Algorithm string `json:"alg"`
+		KeyID     string `json:"kid"`
+	}{}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+	algorithm, ok := algorithms[header.Algorithm]
+	if !ok {
+		return nil, fmt.Errorf("%w: '%s'", ErrUnsupportedAlgorithm, header.Algorithm)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrMalformedToken
+	}
+	key, err := verifier.keys.verificationKey(header.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	// "alg" of key restricts it to one algorithm (RFC 7517, section 4.4)
+	if key.algorithm != "" && key.algorithm != header.Algorithm {
+		return nil, fmt.Errorf("%w: key is used with '%s', token is signed with '%s'", ErrAlgorithmMismatch, key.algorithm, header.Algorithm)
+	}
+	hasher := algorithm.hash.New()
+	hasher.Write([]byte(parts[0] + "." + parts[1]))
+	if err := algorithm.verify(key.key, algorithm, hasher.Sum(nil), signature); err != nil {
+		return nil, err
+	}
+	claims := Claims{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if err := verifier.checkClaims(claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func (verifier *Verifier) checkClaims(claims Claims) error {
+	if issuer, _ := claims["iss"].(string); issuer != verifier.issuer {
+		return fmt.Errorf("%w: '%s'", ErrInvalidIssuer, issuer)
+	}
+	if !claims.HasAudience(verifier.audience) {
+		return ErrInvalidAudience
+	}
+	now := verifier.now()
+	expiration, ok := claims.time("exp")
+	if !ok {
+		return fmt.Errorf("%w: token without expiration time", ErrMalformedToken)
+	}
+	if !now.Before(expiration.Add(verifier.leeway)) {
+		return ErrTokenExpired
+	}
+	if notBefore, ok := claims.time("nbf"); ok && now.Add(verifier.leeway).Before(notBefore) {
+		return ErrTokenNotYetValid
+	}
+	if issuedAt, ok := claims.time("iat"); ok && now.Add(verifier.leeway).Before(issuedAt) {
+		return ErrTokenNotYetValid
+	}
+	return nil
+}
+
+// HasAudience returns true if "aud" claim is equal to audience or is a list which contains it
+func (claims Claims) HasAudience(audience string) bool {
+	switch value := claims["aud"].(type) {
+	case string:
+		return value == audience
+	case []interface{}:
+		for _, item := range value {
+			if item == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// time returns NumericDate claim as time
+func (claims Claims) time(name string) (time.Time, bool) {
+	value, ok := claims[name].(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(value), 0), true
+}
+
+func decodeSegment(segment string, result interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return ErrMalformedToken
+	}
+	if err := json.Unmarshal(data, result); err != nil {
+		return fmt.Errorf("%w: %s", ErrMalformedToken, err)
+	}
+	return nil
+}
@@ -0,0 +1,215 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package oidc
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+const testIssuer = "https://issuer.example.com"
+
+func encodeSegment(t *testing.T, value interface{}) string {
+	data, err := json.Marshal(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// signToken returns token signed with RSA or ECDSA key
+func signToken(t *testing.T, key crypto.Signer, algorithm, keyID string, claims map[string]interface{}) string {
+	signed := encodeSegment(t, map[string]string{"alg": algorithm, "kid": keyID, "typ": "JWT"}) + "." + encodeSegment(t, claims)
+	hash := algorithms[algorithm].hash
+	if hash == 0 {
+		hash = crypto.SHA256
+	}
+	hasher := hash.New()
+	hasher.Write([]byte(signed))
+	hashed := hasher.Sum(nil)
+	var signature []byte
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		var err error
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key, hash, hashed)
+		if err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, key, hashed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		signature = make([]byte, 2*size)
+		rBytes, sBytes := r.Bytes(), s.Bytes()
+		copy(signature[size-len(rBytes):size], rBytes)
+		copy(signature[2*size-len(sBytes):], sBytes)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func newJWKSServer(t *testing.T, rsaKey *rsa.PrivateKey, ecKey *ecdsa.PrivateKey, requests *int) *httptest.Server {
+	encode := func(value *big.Int) string { return base64.RawURLEncoding.EncodeToString(value.Bytes()) }
+	jwks := map[string]interface{}{"keys": []map[string]string{
+		{"kty": "RSA", "kid": "rsa", "use": "sig", "n": encode(rsaKey.N), "e": encode(big.NewInt(int64(rsaKey.E)))},
+		{"kty": "RSA", "kid": "rsa384", "alg": "RS384", "n": encode(rsaKey.N), "e": encode(big.NewInt(int64(rsaKey.E)))},
+		{"kty": "EC", "kid": "ec", "crv": "P-256", "x": encode(ecKey.X), "y": encode(ecKey.Y)},
+		{"kty": "RSA", "kid": "encryption", "use": "enc", "n": "invalid"},
+	}}
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		switch request.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(writer).Encode(map[string]string{"issuer": server.URL, "jwks_uri": server.URL + "/keys"})
+		case "/keys":
+			*requests++
+			json.NewEncoder(writer).Encode(jwks)
+		default:
+			writer.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	return server
+}
+
+func TestVerifier(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	requests := 0
+	server := newJWKSServer(t, rsaKey, ecKey, &requests)
+	defer server.Close()
+
+	jwksURL, err := DiscoverJWKSURL(server.URL, server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if jwksURL != server.URL+"/keys" {
+		t.Fatalf("Incorrect discovered JWKS URL %s", jwksURL)
+	}
+	if _, err := DiscoverJWKSURL(server.URL+"/other", server.Client()); err == nil {
+		t.Fatal("Expected error for issuer without provider configuration")
+	}
+	keySet := NewKeySet(jwksURL, server.Client())
+	now := time.Unix(1600000000, 0)
+	keySet.now = func() time.Time { return now }
+	verifier, err := NewVerifier(testIssuer, "acra-translator", keySet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifier.now = keySet.now
+
+	validClaims := func() map[string]interface{} {
+		return map[string]interface{}{
+			"iss": testIssuer,
+			"sub": "billing",
+			"aud": []string{"other", "acra-translator"},
+			"exp": now.Add(time.Hour).Unix(),
+			"iat": now.Unix(),
+		}
+	}
+	for _, token := range []string{
+		signToken(t, rsaKey, "RS256", "rsa", validClaims()),
+		signToken(t, rsaKey, "RS384", "rsa384", validClaims()),
+		signToken(t, ecKey, "ES256", "ec", validClaims()),
+	} {
+		claims, err := verifier.Verify(token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if claims["sub"] != "billing" {
+			t.Fatalf("Incorrect claims %v", claims)
+		}
+	}
+	if requests != 1 {
+		t.Fatalf("Expected one request of JWKS, took %d", requests)
+	}
+	// refresh on unknown key isn't rate limited after a minute since loading of keys
+	now = now.Add(minRefreshInterval)
+
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	withClaim := func(name string, value interface{}) map[string]interface{} {
+		claims := validClaims()
+		if value == nil {
+			delete(claims, name)
+		} else {
+			claims[name] = value
+		}
+		return claims
+	}
+	testcases := []struct {
+		name  string
+		token string
+		err   error
+	}{
+		{"malformed", "header.payload", ErrMalformedToken},
+		{"none algorithm", signToken(t, rsaKey, "none", "rsa", validClaims()), ErrUnsupportedAlgorithm},
+		{"HMAC algorithm", signToken(t, rsaKey, "HS256", "rsa", validClaims()), ErrUnsupportedAlgorithm},
+		{"other key", signToken(t, otherKey, "RS256", "rsa", validClaims()), ErrInvalidSignature},
+		{"key of other type", signToken(t, rsaKey, "ES256", "rsa", validClaims()), ErrInvalidSignature},
+		{"key of other curve", signToken(t, ecKey, "ES384", "ec", validClaims()), ErrAlgorithmMismatch},
+		{"other algorithm of key", signToken(t, rsaKey, "RS256", "rsa384", validClaims()), ErrAlgorithmMismatch},
+		{"unknown key", signToken(t, otherKey, "RS256", "unknown", validClaims()), ErrUnknownKey},
+		{"other issuer", signToken(t, rsaKey, "RS256", "rsa", withClaim("iss", "https://other.example.com")), ErrInvalidIssuer},
+		{"other audience", signToken(t, rsaKey, "RS256", "rsa", withClaim("aud", "other")), ErrInvalidAudience},
+		{"expired", signToken(t, rsaKey, "RS256", "rsa", withClaim("exp", now.Add(-time.Hour).Unix())), ErrTokenExpired},
+		{"without expiration", signToken(t, rsaKey, "RS256", "rsa", withClaim("exp", nil)), ErrMalformedToken},
+		{"not yet valid", signToken(t, rsaKey, "RS256", "rsa", withClaim("nbf", now.Add(time.Hour).Unix())), ErrTokenNotYetValid},
+	}
+	for _, testcase := range testcases {
+		if _, err := verifier.Verify(testcase.token); !errors.Is(err, testcase.err) {
+			t.Fatalf("%s: expected %v, took %v", testcase.name, testcase.err, err)
+		}
+	}
+	// skew within leeway is allowed
+	if _, err := verifier.Verify(signToken(t, rsaKey, "RS256", "rsa", withClaim("exp", now.Add(-time.Second*30).Unix()))); err != nil {
+		t.Fatal(err)
+	}
+
+	// unknown key triggered one refresh, next one is allowed after a minute
+	if requests != 2 {
+		t.Fatalf("Expected refresh on unknown key, took %d requests", requests)
+	}
+	verifier.Verify(signToken(t, otherKey, "RS256", "unknown", validClaims()))
+	if requests != 2 {
+		t.Fatalf("Expected rate limited refresh, took %d requests", requests)
+	}
+	now = now.Add(time.Minute)
+	verifier.Verify(signToken(t, otherKey, "RS256", "unknown", validClaims()))
+	if requests != 3 {
+		t.Fatalf("Expected refresh after a minute, took %d requests", requests)
+	}
+}
@@ -22,9 +22,9 @@ limitations under the License.
 package poison
 
 import (
-	"crypto/rand"
 	"github.com/cossacklabs/acra/acra-writer"
 	"github.com/cossacklabs/acra/keystore"
+	"github.com/cossacklabs/acra/random"
 	math_rand "math/rand"
 	"time"
 )
@@ -49,7 +49,7 @@ func CreatePoisonRecord(keystore keystore.PoisonKeyStore, dataLength int) ([]byt
 	}
 	// +1 for excluding 0
 	data := make([]byte, dataLength)
-	_, err = rand.Read(data)
+	_, err = random.Read(data)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,50 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package random
+
+import (
+	"fmt"
+	"io"
+
+	"golang.org/x/sys/unix"
+)
+
+// getrandomSource reads random bytes with getrandom syscall without fallback to /dev/urandom
+type getrandomSource struct{}
+
+func newGetrandomSource() (io.Reader, error) {
+	// check that kernel supports syscall
+	if _, err := unix.Getrandom(make([]byte, 1), 0); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedSource, err)
+	}
+	return &getrandomSource{}, nil
+}
+
+func (getrandomSource) Read(data []byte) (int, error) {
+	read := 0
+	for read < len(data) {
+		n, err := unix.Getrandom(data[read:], 0)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return read, err
+		}
+		read += n
+	}
+	return read, nil
+}
@@ -0,0 +1,195 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package random
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// ErrHealthCheckFailed returned if random source doesn't pass health checks
+var ErrHealthCheckFailed = errors.New("random source failed health check")
+
+// StartupSampleLength is length of sample checked by StartupHealthCheck, 20000 bits as in FIPS 140-2 statistical tests
+const StartupSampleLength = 20000 / 8
+
+// continuousBlockLength is length of blocks compared by continuous test of HealthCheckedSource
+const continuousBlockLength = 16
+
+// StartupHealthCheck reads sample from source and checks it with monobit, poker, runs and long run tests of FIPS 140-2.
+// Output of working CSPRNG fails them with probability about 10^-6.
+func StartupHealthCheck(source io.Reader) error {
+	sample := make([]byte, StartupSampleLength)
+	if _, err := io.ReadFull(source, sample); err != nil {
+		return fmt.Errorf("%w: can't read sample: %s", ErrHealthCheckFailed, err)
+	}
+	for _, test := range []struct {
+		name  string
+		check func([]byte) bool
+	}{
+		{"monobit", monobitTest},
+		{"poker", pokerTest},
+		{"runs", runsTest},
+		{"long run", longRunTest},
+	} {
+		if !test.check(sample) {
+			return fmt.Errorf("%w: %s test", ErrHealthCheckFailed, test.name)
+		}
+	}
+	return nil
+}
+
+// monobitTest checks that count of ones is within 9725..10275
+func monobitTest(sample []byte) bool {
+	ones := 0
+	for _, b := range sample {
+		for ; b != 0; b &= b - 1 {
+			ones++
+		}
+	}
+	return ones > 9725 && ones < 10275
+}
+
+// pokerTest checks distribution of 4-bit segments
+func pokerTest(sample []byte) bool {
+	var counts [16]int
+	for _, b := range sample {
+		counts[b>>4]++
+		counts[b&0x0f]++
+	}
+	sum := 0
+	for _, count := range counts {
+		sum += count * count
+	}
+	// X = 16/5000 * sum - 5000 should be within 2.16..46.17
+	x := float64(16*sum)/5000 - 5000
+	return x > 2.16 && x < 46.17
+}
+
+// bitRuns calls f for length and bit of each run of identical bits
+func bitRuns(sample []byte, f func(length int, bit byte)) {
+	length := 0
+	var previous byte
+	for i := 0; i < len(sample)*8; i++ {
+		bit := (sample[i/8] >> (7 - uint(i%8))) & 1
+		if length > 0 && bit != previous {
+			f(length, previous)
+			length = 0
+		}
+		previous = bit
+		length++
+	}
+	f(length, previous)
+}
+
+// runsTest checks count of runs of each length from 1 to 6+ for zeros and ones
+func runsTest(sample []byte) bool {
+	intervals := [6][2]int{{2315, 2685}, {1114, 1386}, {527, 723}, {240, 384}, {103, 209}, {103, 209}}
+	var counts [2][6]int
+	bitRuns(sample, func(length int, bit byte) {
+		if length > 6 {
+			length = 6
+		}
+		counts[bit][length-1]++
+	})
+	for bit := range counts {
+		for i, count := range counts[bit] {
+			if count < intervals[i][0] || count > intervals[i][1] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// longRunTest checks that there are no runs of 26 or more identical bits
+func longRunTest(sample []byte) bool {
+	ok := true
+	bitRuns(sample, func(length int, bit byte) {
+		if length >= 26 {
+			ok = false
+		}
+	})
+	return ok
+}
+
+// HealthCheckedSource compares each 16-byte block of source with previous one like continuous random number generator
+// test of FIPS 140-2 and fails all reads after the first repeated block, so stuck source can't be used to generate keys
+// anymore. Safe for concurrent use.
+type HealthCheckedSource struct {
+	lock        sync.Mutex
+	source      io.Reader
+	previous    [sha256.Size]byte
+	hasPrevious bool
+	buffer      []byte
+	err         error
+	onFail      func(error)
+}
+
+// NewHealthCheckedSource returns HealthCheckedSource of source, onFail is called once on failure of check, may be nil
+func NewHealthCheckedSource(source io.Reader, onFail func(error)) *HealthCheckedSource {
+	return &HealthCheckedSource{source: source, onFail: onFail}
+}
+
+// Read fills data with checked random bytes or returns ErrHealthCheckFailed if source failed health check
+func (checked *HealthCheckedSource) Read(data []byte) (int, error) {
+	checked.lock.Lock()
+	defer checked.lock.Unlock()
+	read := 0
+	for read < len(data) {
+		if checked.err != nil {
+			return read, checked.err
+		}
+		if len(checked.buffer) == 0 {
+			if err := checked.nextBlock(); err != nil {
+				return read, err
+			}
+			continue
+		}
+		n := copy(data[read:], checked.buffer)
+		// used random bytes aren't kept in memory
+		for i := range checked.buffer[:n] {
+			checked.buffer[i] = 0
+		}
+		checked.buffer = checked.buffer[n:]
+		read += n
+	}
+	return read, nil
+}
+
+// nextBlock reads next block from source and checks it, should be called with locked mutex
+func (checked *HealthCheckedSource) nextBlock() error {
+	block := make([]byte, continuousBlockLength)
+	if _, err := io.ReadFull(checked.source, block); err != nil {
+		return err
+	}
+	// hash of block is kept instead of random bytes which may become part of key
+	hash := sha256.Sum256(block)
+	if checked.hasPrevious && hash == checked.previous {
+		checked.err = fmt.Errorf("%w: repeated output block", ErrHealthCheckFailed)
+		if checked.onFail != nil {
+			checked.onFail(checked.err)
+		}
+		return checked.err
+	}
+	checked.previous, checked.hasPrevious = hash, true
+	checked.buffer = block
+	return nil
+}
@@ -0,0 +1,101 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package random provides source of random bytes used by Acra for generation of keys and nonces. Source is system
+// CSPRNG by default and may be replaced on startup by getrandom syscall or character device of hardware RNG (e.g.
+// /dev/hwrng of HSM TRNG), optionally wrapped with health checks which stop returning random bytes once source
+// behaves suspiciously.
+package random
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Names of supported random sources, SourceFilePrefix is followed by path to device or file
+const (
+	SourceSystem     = "system"
+	SourceGetrandom  = "getrandom"
+	SourceFilePrefix = "file:"
+)
+
+// Errors returned by NewSource
+var (
+	ErrUnknownSource     = errors.New("unknown random source")
+	ErrUnsupportedSource = errors.New("random source isn't supported on this platform")
+)
+
+var (
+	sourceLock sync.RWMutex
+	source     io.Reader = rand.Reader
+)
+
+// SetSource replaces source used by Read, should be called on startup before generation of keys
+func SetSource(newSource io.Reader) {
+	sourceLock.Lock()
+	source = newSource
+	sourceLock.Unlock()
+}
+
+// Reader returns current source of random bytes
+func Reader() io.Reader {
+	sourceLock.RLock()
+	defer sourceLock.RUnlock()
+	return source
+}
+
+// Read fills data with random bytes from current source, returns error if source can't fill it completely
+func Read(data []byte) (int, error) {
+	return io.ReadFull(Reader(), data)
+}
+
+// NewSource returns source by name: SourceSystem (or empty name) for crypto/rand, SourceGetrandom for getrandom
+// syscall which blocks until kernel entropy pool is initialized, or SourceFilePrefix with path to device of hardware
+// RNG
+func NewSource(name string) (io.Reader, error) {
+	switch {
+	case name == "" || name == SourceSystem:
+		return rand.Reader, nil
+	case name == SourceGetrandom:
+		return newGetrandomSource()
+	case strings.HasPrefix(name, SourceFilePrefix):
+		path := strings.TrimPrefix(name, SourceFilePrefix)
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		return &fileSource{file: file}, nil
+	}
+	return nil, fmt.Errorf("%w '%s', expected '%s', '%s' or '%s<path>'", ErrUnknownSource, name, SourceSystem,
+		SourceGetrandom, SourceFilePrefix)
+}
+
+// fileSource reads random bytes from device, reads are serialized because devices may return partial reads
+type fileSource struct {
+	lock sync.Mutex
+	file *os.File
+}
+
+func (source *fileSource) Read(data []byte) (int, error) {
+	source.lock.Lock()
+	defer source.lock.Unlock()
+	return io.ReadFull(source.file, data)
+}
@@ -0,0 +1,142 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package random
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"testing"
+)
+
+// repeatingSource returns the same byte sequence
+type repeatingSource struct {
+	pattern []byte
+	offset  int
+}
+
+func (source *repeatingSource) Read(data []byte) (int, error) {
+	for i := range data {
+		data[i] = source.pattern[source.offset%len(source.pattern)]
+		source.offset++
+	}
+	return len(data), nil
+}
+
+// counterSource returns big-endian counter, it passes continuous test but isn't random
+type counterSource struct {
+	counter *big.Int
+}
+
+func (source *counterSource) Read(data []byte) (int, error) {
+	for i := 0; i < len(data); i += 16 {
+		source.counter.Add(source.counter, big.NewInt(1))
+		block := make([]byte, 16)
+		value := source.counter.Bytes()
+		copy(block[16-len(value):], value)
+		copy(data[i:], block)
+	}
+	return len(data), nil
+}
+
+func TestStartupHealthCheck(t *testing.T) {
+	for _, source := range []string{SourceSystem, SourceGetrandom} {
+		reader, err := NewSource(source)
+		if errors.Is(err, ErrUnsupportedSource) {
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := StartupHealthCheck(reader); err != nil {
+			t.Fatalf("Source %s: %v", source, err)
+		}
+	}
+	for _, source := range []io.Reader{
+		&repeatingSource{pattern: []byte{0}},
+		&repeatingSource{pattern: []byte{0x55}},
+		&counterSource{counter: big.NewInt(0)},
+	} {
+		if err := StartupHealthCheck(source); !errors.Is(err, ErrHealthCheckFailed) {
+			t.Fatalf("Expected ErrHealthCheckFailed for %T, took %v", source, err)
+		}
+	}
+	if _, err := NewSource("pkcs11"); !errors.Is(err, ErrUnknownSource) {
+		t.Fatalf("Expected ErrUnknownSource, took %v", err)
+	}
+}
+
+func TestFileSource(t *testing.T) {
+	file, err := ioutil.TempFile("", "random")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	content := make([]byte, 64)
+	if _, err := rand.Read(content); err != nil {
+		t.Fatal(err)
+	}
+	file.Write(content)
+	file.Close()
+	source, err := NewSource(SourceFilePrefix + file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer SetSource(Reader())
+	SetSource(source)
+	data := make([]byte, 48)
+	if _, err := Read(data); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, content[:48]) {
+		t.Fatal("Read data differs from content of file")
+	}
+	// exhausted source fails instead of returning partially filled data
+	if _, err := Read(data); err == nil {
+		t.Fatal("Expected error on short read")
+	}
+}
+
+func TestHealthCheckedSource(t *testing.T) {
+	checked := NewHealthCheckedSource(rand.Reader, nil)
+	data := make([]byte, 1000)
+	for _, length := range []int{1, 15, 16, 17, 1000} {
+		if n, err := checked.Read(data[:length]); err != nil || n != length {
+			t.Fatalf("Expected %d bytes, took %d and %v", length, n, err)
+		}
+	}
+
+	failures := 0
+	checked = NewHealthCheckedSource(&repeatingSource{pattern: []byte("0123456789abcdef")}, func(error) { failures++ })
+	if _, err := checked.Read(data[:16]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := checked.Read(data[:16]); !errors.Is(err, ErrHealthCheckFailed) {
+		t.Fatalf("Expected ErrHealthCheckFailed on repeated block, took %v", err)
+	}
+	// failed source isn't used anymore
+	if _, err := checked.Read(data[:1]); !errors.Is(err, ErrHealthCheckFailed) {
+		t.Fatalf("Expected ErrHealthCheckFailed after failure, took %v", err)
+	}
+	if failures != 1 {
+		t.Fatalf("Expected one call of onFail, took %d", failures)
+	}
+}
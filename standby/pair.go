@@ -0,0 +1,356 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package standby coordinates active/standby pair of services via shared directory. Active node holds lease and
+// renews it with heartbeat, publishes state encrypted with master key (session ticket keys, caches) and standby node
+// imports it, so standby is ready to take over when heartbeats stop for failover timeout. Heartbeats are compared by
+// local time of standby, so clocks of nodes don't have to be synchronized.
+package standby
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/cossacklabs/acra/keystore"
+	"github.com/cossacklabs/acra/logging"
+	log "github.com/sirupsen/logrus"
+)
+
+// Defaults of Pair
+const (
+	DefaultHeartbeatInterval = time.Second
+	DefaultFailoverTimeout   = time.Second * 5
+)
+
+// Role of node in pair
+type Role string
+
+// Roles of node in pair
+const (
+	RoleStandby Role = "standby"
+	RoleActive  Role = "active"
+)
+
+// Errors returned by Pair
+var (
+	ErrInvalidOptions = errors.New("invalid standby pair options")
+	ErrLeaseLost      = errors.New("lease of active node is taken by other node")
+)
+
+const (
+	leaseFileName  = "lease.json"
+	stateDirName   = "state"
+	stateExtension = ".state"
+)
+
+// SyncedState is state published by active node and imported by standby node
+type SyncedState interface {
+	// StateName is unique name of state used as file name and encryption context
+	StateName() string
+	ExportState() ([]byte, error)
+	ImportState(data []byte) error
+}
+
+// lease is stored in shared directory. Active node increments Heartbeat, holder change or new Epoch means takeover.
+type lease struct {
+	Holder    string    `json:"holder"`
+	Epoch     uint64    `json:"epoch"`
+	Heartbeat uint64    `json:"heartbeat"`
+	Updated   time.Time `json:"updated"`
+}
+
+// Options of Pair
+type Options struct {
+	// Dir is directory shared by both nodes
+	Dir    string
+	NodeID string
+	// Encryptor encrypts published state, both nodes should use the same master key
+	Encryptor         keystore.KeyEncryptor
+	HeartbeatInterval time.Duration
+	FailoverTimeout   time.Duration
+}
+
+// Pair is node of active/standby pair
+type Pair struct {
+	options Options
+	lock    sync.Mutex
+	role    Role
+	epoch   uint64
+	states  []SyncedState
+	// hashes of last published or imported states by name
+	stateHashes map[string][sha256.Size]byte
+	// last observed lease and local time of its change
+	observed     lease
+	observedTime time.Time
+	active       chan struct{}
+	lost         chan struct{}
+	now          func() time.Time
+}
+
+// NewPair returns standby node of pair, it becomes active by Run when active node doesn't renew lease
+func NewPair(options Options) (*Pair, error) {
+	if options.Dir == "" || options.NodeID == "" || options.Encryptor == nil {
+		return nil, ErrInvalidOptions
+	}
+	if options.HeartbeatInterval <= 0 || options.FailoverTimeout <= options.HeartbeatInterval {
+		return nil, ErrInvalidOptions
+	}
+	if err := os.MkdirAll(filepath.Join(options.Dir, stateDirName), 0700); err != nil {
+		return nil, err
+	}
+	return &Pair{
+		options:     options,
+		role:        RoleStandby,
+		stateHashes: map[string][sha256.Size]byte{},
+		active:      make(chan struct{}),
+		lost:        make(chan struct{}),
+		now:         time.Now,
+	}, nil
+}
+
+// Register adds state which is synced between nodes. Should be called before Run.
+func (pair *Pair) Register(state SyncedState) {
+	pair.states = append(pair.states, state)
+}
+
+// Role returns current role of node
+func (pair *Pair) Role() Role {
+	pair.lock.Lock()
+	defer pair.lock.Unlock()
+	return pair.role
+}
+
+// Active returns channel which is closed when node becomes active
+func (pair *Pair) Active() <-chan struct{} {
+	return pair.active
+}
+
+// Lost returns channel which is closed when active node finds that other node took lease over. Node should stop
+// serving connections because the other node serves them.
+func (pair *Pair) Lost() <-chan struct{} {
+	return pair.lost
+}
+
+// Run sends heartbeats and publishes states while node is active or imports states and watches heartbeats of active
+// node while node is standby, until ctx is done or lease is lost
+func (pair *Pair) Run(ctx context.Context) {
+	ticker := time.NewTicker(pair.options.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		if err := pair.step(); err != nil {
+			if err == ErrLeaseLost {
+				log.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorStandbyPair).
+					Errorln("Lease of active node is taken by other node")
+				close(pair.lost)
+				return
+			}
+			log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorStandbyPair).
+				WithField("role", pair.Role()).Warningln("Can't sync with standby pair")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// step makes one iteration of Run
+func (pair *Pair) step() error {
+	if pair.Role() == RoleActive {
+		if err := pair.renew(); err != nil {
+			return err
+		}
+		return pair.publishStates()
+	}
+	if err := pair.importStates(); err != nil {
+		log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorStandbyPair).
+			Warningln("Can't import state of active node")
+	}
+	current, err := pair.readLease()
+	if err != nil {
+		return err
+	}
+	now := pair.now()
+	if pair.observedTime.IsZero() || current != pair.observed {
+		pair.observed = current
+		pair.observedTime = now
+	}
+	// lease without holder is released by stopped active node, lease of this node is left by previous process
+	takeover := current.Holder == "" || current.Holder == pair.options.NodeID ||
+		now.Sub(pair.observedTime) >= pair.options.FailoverTimeout
+	if !takeover {
+		return nil
+	}
+	return pair.acquire(current)
+}
+
+// acquire writes lease of this node and becomes active if other node didn't overwrite it during heartbeat interval
+func (pair *Pair) acquire(previous lease) error {
+	acquired := lease{Holder: pair.options.NodeID, Epoch: previous.Epoch + 1, Updated: pair.now()}
+	if err := pair.writeLease(acquired); err != nil {
+		return err
+	}
+	time.Sleep(pair.options.HeartbeatInterval)
+	current, err := pair.readLease()
+	if err != nil {
+		return err
+	}
+	if current.Holder != acquired.Holder || current.Epoch != acquired.Epoch {
+		// other standby took lease concurrently
+		pair.observed = current
+		pair.observedTime = pair.now()
+		return nil
+	}
+	// latest state of previous active node is imported before serving connections
+	if err := pair.importStates(); err != nil {
+		log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorStandbyPair).
+			Warningln("Can't import state of previous active node")
+	}
+	pair.lock.Lock()
+	pair.role = RoleActive
+	pair.epoch = acquired.Epoch
+	pair.lock.Unlock()
+	log.WithFields(log.Fields{"node_id": pair.options.NodeID, "epoch": acquired.Epoch, "previous_holder": previous.Holder}).
+		Infoln("Node became active")
+	close(pair.active)
+	return nil
+}
+
+// renew increments heartbeat of lease held by this node
+func (pair *Pair) renew() error {
+	current, err := pair.readLease()
+	if err != nil {
+		return err
+	}
+	if current.Holder != pair.options.NodeID || current.Epoch != pair.epoch {
+		return ErrLeaseLost
+	}
+	current.Heartbeat++
+	current.Updated = pair.now()
+	return pair.writeLease(current)
+}
+
+// Release releases lease of active node, so standby takes over without waiting for failover timeout
+func (pair *Pair) Release() error {
+	if pair.Role() != RoleActive {
+		return nil
+	}
+	if err := pair.publishStates(); err != nil {
+		log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorStandbyPair).
+			Warningln("Can't publish state before release of lease")
+	}
+	current, err := pair.readLease()
+	if err != nil {
+		return err
+	}
+	if current.Holder != pair.options.NodeID || current.Epoch != pair.epoch {
+		return nil
+	}
+	return pair.writeLease(lease{Epoch: current.Epoch, Updated: pair.now()})
+}
+
+func (pair *Pair) readLease() (lease, error) {
+	current := lease{}
+	data, err := ioutil.ReadFile(filepath.Join(pair.options.Dir, leaseFileName))
+	if os.IsNotExist(err) {
+		return current, nil
+	}
+	if err != nil {
+		return current, err
+	}
+	err = json.Unmarshal(data, &current)
+	return current, err
+}
+
+func (pair *Pair) writeLease(value lease) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return pair.writeFileAtomic(filepath.Join(pair.options.Dir, leaseFileName), data)
+}
+
+func (pair *Pair) statePath(state SyncedState) string {
+	return filepath.Join(pair.options.Dir, stateDirName, state.StateName()+stateExtension)
+}
+
+// publishStates writes encrypted states which changed since last publication
+func (pair *Pair) publishStates() error {
+	for _, state := range pair.states {
+		data, err := state.ExportState()
+		if err != nil {
+			return err
+		}
+		hash := sha256.Sum256(data)
+		if pair.stateHashes[state.StateName()] == hash {
+			continue
+		}
+		encrypted, err := pair.options.Encryptor.Encrypt(data, []byte(state.StateName()))
+		if err != nil {
+			return err
+		}
+		if err := pair.writeFileAtomic(pair.statePath(state), encrypted); err != nil {
+			return err
+		}
+		pair.stateHashes[state.StateName()] = hash
+	}
+	return nil
+}
+
+// importStates imports states published by active node which changed since last import
+func (pair *Pair) importStates() error {
+	for _, state := range pair.states {
+		encrypted, err := ioutil.ReadFile(pair.statePath(state))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		data, err := pair.options.Encryptor.Decrypt(encrypted, []byte(state.StateName()))
+		if err != nil {
+			return err
+		}
+		hash := sha256.Sum256(data)
+		if pair.stateHashes[state.StateName()] == hash {
+			continue
+		}
+		if err := state.ImportState(data); err != nil {
+			return err
+		}
+		pair.stateHashes[state.StateName()] = hash
+		log.WithField("state", state.StateName()).Debugln("Imported state of active node")
+	}
+	return nil
+}
+
+// writeFileAtomic replaces file with data via temporary file of this node, so other node never reads partially
+// written file
+func (pair *Pair) writeFileAtomic(path string, data []byte) error {
+	tmpPath := path + "." + pair.options.NodeID + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
@@ -0,0 +1,163 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package standby
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cossacklabs/acra/keystore"
+)
+
+type testState struct {
+	data     []byte
+	imported int
+}
+
+func (state *testState) StateName() string {
+	return "test"
+}
+
+func (state *testState) ExportState() ([]byte, error) {
+	return state.data, nil
+}
+
+func (state *testState) ImportState(data []byte) error {
+	state.data = append([]byte{}, data...)
+	state.imported++
+	return nil
+}
+
+func newTestPair(t *testing.T, dir, nodeID string, encryptor keystore.KeyEncryptor) (*Pair, *testState, *time.Time) {
+	pair, err := NewPair(Options{
+		Dir:               dir,
+		NodeID:            nodeID,
+		Encryptor:         encryptor,
+		HeartbeatInterval: time.Millisecond * 10,
+		FailoverTimeout:   time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	pair.now = func() time.Time { return now }
+	state := &testState{}
+	pair.Register(state)
+	return pair, state, &now
+}
+
+func isClosed(channel <-chan struct{}) bool {
+	select {
+	case <-channel:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestPairFailover(t *testing.T) {
+	dir, err := ioutil.TempDir("", "standby_pair")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	masterKey, err := keystore.GenerateSymmetricKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	encryptor, err := keystore.NewSCellKeyEncryptor(masterKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewPair(Options{Dir: dir, NodeID: "a", Encryptor: encryptor, HeartbeatInterval: time.Second, FailoverTimeout: time.Second}); err != ErrInvalidOptions {
+		t.Fatalf("Expected ErrInvalidOptions for failover timeout not greater than heartbeat, took %v", err)
+	}
+
+	first, firstState, _ := newTestPair(t, dir, "first", encryptor)
+	second, secondState, secondNow := newTestPair(t, dir, "second", encryptor)
+
+	// the first node takes lease without holder immediately
+	if err := first.step(); err != nil {
+		t.Fatal(err)
+	}
+	if first.Role() != RoleActive || !isClosed(first.Active()) {
+		t.Fatal("Expected active first node")
+	}
+	firstState.data = []byte("state of first node")
+	if err := first.step(); err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := ioutil.ReadFile(filepath.Join(dir, stateDirName, "test"+stateExtension))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(encrypted, firstState.data) {
+		t.Fatal("Published state should be encrypted")
+	}
+
+	// the second node stays standby while heartbeats change and imports state once
+	for i := 0; i < 3; i++ {
+		if err := second.step(); err != nil {
+			t.Fatal(err)
+		}
+		*secondNow = secondNow.Add(time.Millisecond * 500)
+		if err := first.step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if second.Role() != RoleStandby || isClosed(second.Active()) {
+		t.Fatal("Standby node shouldn't take over while active node sends heartbeats")
+	}
+	if !bytes.Equal(secondState.data, firstState.data) || secondState.imported != 1 {
+		t.Fatalf("Expected one import of state, took %q after %d imports", secondState.data, secondState.imported)
+	}
+
+	// heartbeats stop for failover timeout
+	if err := second.step(); err != nil {
+		t.Fatal(err)
+	}
+	*secondNow = secondNow.Add(time.Second)
+	if err := second.step(); err != nil {
+		t.Fatal(err)
+	}
+	if second.Role() != RoleActive || !isClosed(second.Active()) {
+		t.Fatal("Expected takeover by standby node after failover timeout")
+	}
+	if err := first.step(); err != ErrLeaseLost {
+		t.Fatalf("Expected ErrLeaseLost, took %v", err)
+	}
+
+	// released lease is taken without waiting for failover timeout
+	secondState.data = []byte("state of second node")
+	if err := second.Release(); err != nil {
+		t.Fatal(err)
+	}
+	third, thirdState, _ := newTestPair(t, dir, "third", encryptor)
+	if err := third.step(); err != nil {
+		t.Fatal(err)
+	}
+	if third.Role() != RoleActive {
+		t.Fatal("Expected takeover of released lease")
+	}
+	if !bytes.Equal(thirdState.data, secondState.data) {
+		t.Fatalf("Expected state published on release, took %q", thirdState.data)
+	}
+}
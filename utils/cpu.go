@@ -0,0 +1,37 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"runtime"
+
+	"golang.org/x/sys/cpu"
+)
+
+// HardwareAESSupported returns true if CPU has instructions used by crypto backend for hardware AES-GCM: AES-NI with
+// PCLMULQDQ on x86 or AES with PMULL on ARMv8 (NEON crypto extension). Themis calls AEAD of OpenSSL/BoringSSL which
+// selects these implementations at runtime, otherwise AcraStructs are encrypted with slower software AES which
+// isn't guaranteed to be constant-time.
+func HardwareAESSupported() bool {
+	switch runtime.GOARCH {
+	case "amd64", "386":
+		return cpu.X86.HasAES && cpu.X86.HasPCLMULQDQ
+	case "arm64":
+		return cpu.ARM64.HasAES && cpu.ARM64.HasPMULL
+	}
+	return false
+}
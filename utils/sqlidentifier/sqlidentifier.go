@@ -0,0 +1,56 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package sqlidentifier validates and quotes table and column names of configs of tools which generate SQL queries
+// themselves, like acra-retention and acra-zonemigrate. Only names of latin letters, digits, "_" and "$" are accepted,
+// so quoted names can't contain quotes and don't need escaping.
+package sqlidentifier
+
+import (
+	"regexp"
+	"strings"
+)
+
+// identifierRegexp matches plain and schema qualified SQL identifiers which are safe to use in generated queries
+var identifierRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_$]*(\.[A-Za-z_][A-Za-z0-9_$]*)?$`)
+
+// IsValid returns true if identifier is plain or schema qualified ("schema.name") name which is safe to quote
+func IsValid(identifier string) bool {
+	return identifierRegexp.MatchString(identifier)
+}
+
+// IsValidColumn returns true if identifier is plain name which is safe to quote
+func IsValidColumn(identifier string) bool {
+	return IsValid(identifier) && !strings.Contains(identifier, ".")
+}
+
+// Quote is quote symbol of identifiers of database dialect
+type Quote string
+
+// Quotes of supported databases
+const (
+	PostgreSQLQuote Quote = `"`
+	MySQLQuote      Quote = "`"
+)
+
+// Identifier quotes every part of validated (schema qualified) identifier
+func (quote Quote) Identifier(identifier string) string {
+	parts := strings.Split(identifier, ".")
+	for i, part := range parts {
+		parts[i] = string(quote) + part + string(quote)
+	}
+	return strings.Join(parts, ".")
+}
@@ -0,0 +1,56 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sqlidentifier
+
+import (
+	"testing"
+)
+
+func TestIdentifier(t *testing.T) {
+	testCases := []struct {
+		identifier string
+		valid      bool
+		column     bool
+		postgresql string
+		mysql      string
+	}{
+		{"users", true, true, `"users"`, "`users`"},
+		{"public.users", true, false, `"public"."users"`, "`public`.`users`"},
+		{"_name$1", true, true, `"_name$1"`, "`_name$1`"},
+		{"", false, false, "", ""},
+		{"1users", false, false, "", ""},
+		{"a.b.c", false, false, "", ""},
+		{"users.", false, false, "", ""},
+		{`us"ers`, false, false, "", ""},
+		{"us`ers", false, false, "", ""},
+		{"users; DROP TABLE users", false, false, "", ""},
+	}
+	for _, testCase := range testCases {
+		if IsValid(testCase.identifier) != testCase.valid || IsValidColumn(testCase.identifier) != testCase.column {
+			t.Fatalf("Unexpected validation result of '%s'", testCase.identifier)
+		}
+		if !testCase.valid {
+			continue
+		}
+		if quoted := PostgreSQLQuote.Identifier(testCase.identifier); quoted != testCase.postgresql {
+			t.Fatalf("Expected %s, took %s", testCase.postgresql, quoted)
+		}
+		if quoted := MySQLQuote.Identifier(testCase.identifier); quoted != testCase.mysql {
+			t.Fatalf("Expected %s, took %s", testCase.mysql, quoted)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package timing detects data-dependent execution time of operations on secret data, like MAC checks, with
+// the statistical test of dudect ("Dude, is my code constant time?"): operation is measured with inputs of two classes
+// in random order and mean durations of the classes are compared with Welch's t-test. It's used by tests built with
+// "constanttime" tag: go test -tags constanttime -run ConstantTime ./...
+package timing
+
+import (
+	"math"
+	"math/rand"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"time"
+)
+
+// LeakThreshold is absolute value of t-statistic above which operation is considered leaking, the same as in dudect
+const LeakThreshold = 4.5
+
+// DefaultSamples is count of measurements enough to detect leaks of byte-by-byte comparisons
+const DefaultSamples = 20000
+
+// batchSize is count of calls measured together to make duration much longer than timer resolution
+const batchSize = 20
+
+// cropPercentile drops the slowest measurements which are mostly caused by scheduler and interrupts
+const cropPercentile = 0.9
+
+// Result of measurement
+type Result struct {
+	// T is Welch's t-statistic of durations of two classes
+	T       float64
+	Samples int
+}
+
+// Leaks returns true if duration of operation depends on class of input
+func (result Result) Leaks() bool {
+	return math.Abs(result.T) > LeakThreshold
+}
+
+// Measure calls operation with inputs of classA and classB in random order and compares their durations. Inputs of
+// classes should differ in secret-dependent way, e.g. MAC which differs from expected one in first byte and the same
+// MAC which differs in last byte.
+func Measure(operation func(input []byte), classA, classB []byte, samples int) Result {
+	inputs := [2][]byte{classA, classB}
+	random := rand.New(rand.NewSource(time.Now().UnixNano()))
+	classes := make([]int, samples)
+	durations := make([]float64, samples)
+
+	// avoid garbage collection during measurement
+	runtime.GC()
+	defer debug.SetGCPercent(debug.SetGCPercent(-1))
+	// warm up caches and branch predictors
+	for i := 0; i < samples/10; i++ {
+		operation(inputs[i%2])
+	}
+	for i := range durations {
+		class := random.Intn(2)
+		input := inputs[class]
+		start := time.Now()
+		for j := 0; j < batchSize; j++ {
+			operation(input)
+		}
+		durations[i] = float64(time.Since(start))
+		classes[i] = class
+	}
+
+	sorted := append([]float64{}, durations...)
+	sort.Float64s(sorted)
+	threshold := sorted[int(float64(len(sorted)-1)*cropPercentile)]
+	var stats [2]welfordStats
+	for i, duration := range durations {
+		if duration <= threshold {
+			stats[classes[i]].add(duration)
+		}
+	}
+	return Result{T: welchT(stats[0], stats[1]), Samples: stats[0].count + stats[1].count}
+}
+
+// welfordStats computes mean and variance online
+type welfordStats struct {
+	count int
+	mean  float64
+	m2    float64
+}
+
+func (stats *welfordStats) add(value float64) {
+	stats.count++
+	delta := value - stats.mean
+	stats.mean += delta / float64(stats.count)
+	stats.m2 += delta * (value - stats.mean)
+}
+
+func (stats *welfordStats) variance() float64 {
+	if stats.count < 2 {
+		return 0
+	}
+	return stats.m2 / float64(stats.count-1)
+}
+
+func welchT(a, b welfordStats) float64 {
+	if a.count == 0 || b.count == 0 {
+		return 0
+	}
+	denominator := math.Sqrt(a.variance()/float64(a.count) + b.variance()/float64(b.count))
+	if denominator == 0 {
+		return 0
+	}
+	return (a.mean - b.mean) / denominator
+}
@@ -0,0 +1,52 @@
+//go:build constanttime
+// +build constanttime
+
+/*
+Copyright 2020, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package timing
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"testing"
+)
+
+// earlyAndLateMismatch returns expected value and two values which differ from it in first and last byte
+func earlyAndLateMismatch(size int) ([]byte, []byte, []byte) {
+	expected := bytes.Repeat([]byte{'a'}, size)
+	early := append([]byte{}, expected...)
+	early[0] = 'b'
+	late := append([]byte{}, expected...)
+	late[size-1] = 'b'
+	return expected, early, late
+}
+
+func TestConstantTimeDetectsLeak(t *testing.T) {
+	expected, early, late := earlyAndLateMismatch(4096)
+	result := Measure(func(input []byte) { bytes.Equal(expected, input) }, early, late, DefaultSamples)
+	if !result.Leaks() {
+		t.Fatalf("Expected leak of bytes.Equal to be detected, took t=%f", result.T)
+	}
+}
+
+func TestConstantTimeCompare(t *testing.T) {
+	expected, early, late := earlyAndLateMismatch(4096)
+	result := Measure(func(input []byte) { subtle.ConstantTimeCompare(expected, input) }, early, late, DefaultSamples)
+	if result.Leaks() {
+		t.Fatalf("subtle.ConstantTimeCompare shouldn't leak, took t=%f", result.T)
+	}
+}
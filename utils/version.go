@@ -17,8 +17,10 @@ limitations under the License.
 package utils
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"runtime"
 	"strconv"
 	"strings"
 )
@@ -28,6 +30,18 @@ import (
 // -ldflags "-X github.com/cossacklabs/acra/utils.VERSION=X.X.X"
 var VERSION = "0.85.0"
 
+// Build metadata embedded into binaries at link time, for example:
+// -ldflags "-X github.com/cossacklabs/acra/utils.Commit=$(git rev-parse HEAD)"
+// Default values are used for binaries built without the Makefile.
+var (
+	// Commit is VCS revision the binary was built from
+	Commit = "unknown"
+	// BuildFlags are extra flags passed to "go build" (-trimpath, tags, etc.)
+	BuildFlags = ""
+	// CryptoBackend is the name of cryptographic library used by Acra
+	CryptoBackend = "themis"
+)
+
 // Version store version info
 type Version struct {
 	Major string
@@ -47,6 +61,17 @@ const (
 // Edition type of product
 var Edition ProductEdition = CommunityEdition
 
+// String returns human-readable edition name
+func (edition ProductEdition) String() string {
+	switch edition {
+	case CommunityEdition:
+		return "community"
+	case EnterpriseEdition:
+		return "enterprise"
+	}
+	return "unknown"
+}
+
 // ComparisonStatus result of comparison versions
 type ComparisonStatus int
 
@@ -160,3 +185,34 @@ func ParseVersion(version string) (*Version, error) {
 func GetParsedVersion() (*Version, error) {
 	return ParseVersion(VERSION)
 }
+
+// BuildInfo describes exact build of running binary: version, VCS revision, build flags and crypto backend
+type BuildInfo struct {
+	Version       string `json:"version"`
+	Edition       string `json:"edition"`
+	Commit        string `json:"commit"`
+	BuildFlags    string `json:"build_flags"`
+	CryptoBackend string `json:"crypto_backend"`
+	GoVersion     string `json:"go_version"`
+	Platform      string `json:"platform"`
+	HardwareAES   bool   `json:"hardware_aes"`
+}
+
+// GetBuildInfo returns BuildInfo of current binary
+func GetBuildInfo() *BuildInfo {
+	return &BuildInfo{
+		Version:       VERSION,
+		Edition:       Edition.String(),
+		Commit:        Commit,
+		BuildFlags:    BuildFlags,
+		CryptoBackend: CryptoBackend,
+		GoVersion:     runtime.Version(),
+		Platform:      fmt.Sprintf("%s/%s", runtime.GOOS, runtime.GOARCH),
+		HardwareAES:   HardwareAESSupported(),
+	}
+}
+
+// ToJSON returns BuildInfo serialized as JSON
+func (info *BuildInfo) ToJSON() ([]byte, error) {
+	return json.Marshal(info)
+}
@@ -1,6 +1,9 @@
 package utils
 
-import "testing"
+import (
+	"encoding/json"
+	"testing"
+)
 
 func TestParseVersion(t *testing.T) {
 	// > 3 parts of version
@@ -122,3 +125,24 @@ func TestGetParsedVersion(t *testing.T) {
 		}
 	}
 }
+
+func TestGetBuildInfo(t *testing.T) {
+	info := GetBuildInfo()
+	if info.Version != VERSION {
+		t.Fatalf("Expected version %s, took %s", VERSION, info.Version)
+	}
+	if info.Edition != "community" {
+		t.Fatalf("Expected community edition, took %s", info.Edition)
+	}
+	data, err := info.ToJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := &BuildInfo{}
+	if err := json.Unmarshal(data, decoded); err != nil {
+		t.Fatal(err)
+	}
+	if *decoded != *info {
+		t.Fatalf("Decoded build info %v not equal to source %v", decoded, info)
+	}
+}